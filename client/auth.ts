@@ -2,6 +2,35 @@ import NextAuth from "next-auth"
 import Credentials from "next-auth/providers/credentials"
 import { InvalidLoginError } from "./lib/auth-errors"
 
+const API_URL = 'https://tumble.royer.app/api/v1'
+
+// Access tokens from the API are short-lived; trade the refresh token for a
+// new pair shortly before the current one expires
+async function refreshAccessToken(token: any) {
+  try {
+    const response = await fetch(`${API_URL}/auth/refresh`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ refresh_token: token.refreshToken }),
+    })
+    if (!response.ok) {
+      throw new Error(await response.text())
+    }
+
+    const data = await response.json()
+    return {
+      ...token,
+      accessToken: data.token,
+      refreshToken: data.refresh_token,
+      accessTokenExpires: Date.now() + data.expires_in * 1000,
+    }
+  } catch (error) {
+    return { ...token, error: "RefreshAccessTokenError" }
+  }
+}
+
 export const { handlers, signIn, signOut, auth } = NextAuth({
   providers: [
     Credentials({
@@ -15,7 +44,7 @@ export const { handlers, signIn, signOut, auth } = NextAuth({
         }
 
         try {
-          const response = await fetch(`https://tumble.royer.app/api/v1/auth/login`, {
+          const response = await fetch(`${API_URL}/auth/login`, {
             method: 'POST',
             headers: {
               'Content-Type': 'application/json',
@@ -47,6 +76,8 @@ export const { handlers, signIn, signOut, auth } = NextAuth({
             first_name: data.user.first_name,
             last_name: data.user.last_name,
             accessToken: data.token,
+            refreshToken: data.refresh_token,
+            accessTokenExpires: Date.now() + data.expires_in * 1000,
           }
         } catch (error: any) {
           throw new InvalidLoginError(error.message || "Authentication failed")
@@ -55,20 +86,27 @@ export const { handlers, signIn, signOut, auth } = NextAuth({
     })
   ],
   callbacks: {
-    jwt({ token, user }) {
+    async jwt({ token, user }) {
       if (user) {
         token.accessToken = (user as any).accessToken
+        token.refreshToken = (user as any).refreshToken
+        token.accessTokenExpires = (user as any).accessTokenExpires
         token.role = (user as any).role
         token.status = (user as any).status
         token.first_name = (user as any).first_name
         token.last_name = (user as any).last_name
+        return token
       }
-      return token
+      if (Date.now() < (token.accessTokenExpires as number) - 60 * 1000) {
+        return token
+      }
+      return refreshAccessToken(token)
     },
     session({ session, token }) {
       return {
         ...session,
         accessToken: token.accessToken,
+        error: token.error,
         user: {
           ...session.user,
           role: token.role,
@@ -79,6 +117,21 @@ export const { handlers, signIn, signOut, auth } = NextAuth({
       }
     },
   },
+  events: {
+    // End the API session too, so its refresh token stops working
+    async signOut(message) {
+      const token = 'token' in message ? (message.token as any) : null
+      if (token?.refreshToken) {
+        await fetch(`${API_URL}/auth/logout`, {
+          method: 'POST',
+          headers: {
+            'Content-Type': 'application/json',
+          },
+          body: JSON.stringify({ refresh_token: token.refreshToken }),
+        }).catch(() => {})
+      }
+    },
+  },
   pages: {
     signIn: '/auth/signin',
     error: '/auth/error',
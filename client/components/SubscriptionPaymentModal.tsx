@@ -200,6 +200,9 @@ export default function SubscriptionPaymentModal({ planId, isOpen, onSuccess, on
           if (response.ok) {
             const data = await response.json()
             setClientSecret(data.client_secret)
+          } else if (response.status === 409) {
+            // Card-on-file limit; the server explains it
+            setError((await response.text()).trim())
           } else {
             setError('Failed to create setup intent')
           }
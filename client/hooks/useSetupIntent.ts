@@ -26,6 +26,9 @@ export function useSetupIntent() {
       if (response.ok) {
         const data = await response.json()
         setClientSecret(data.client_secret)
+      } else if (response.status === 409) {
+        // Card-on-file limit; the server explains it
+        setError((await response.text()).trim())
       } else {
         setError('Failed to create setup intent')
       }
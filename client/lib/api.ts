@@ -19,6 +19,7 @@ export interface OrderStatus {
 
 export const statusConfig: Record<string, OrderStatus> = {
   pending: { color: 'bg-gray-100 text-gray-800', icon: Clock, label: 'Pending' },
+  pending_review: { color: 'bg-amber-100 text-amber-800', icon: Clock, label: 'Pending Review' },
   scheduled: { color: 'bg-blue-100 text-blue-800', icon: Calendar, label: 'Scheduled' },
   picked_up: { color: 'bg-orange-100 text-orange-800', icon: Truck, label: 'Picked Up' },
   in_process: { color: 'bg-yellow-100 text-yellow-800', icon: Clock, label: 'In Process' },
@@ -38,12 +39,38 @@ export interface User {
   role: string
   avatar_url?: string
   email_verified_at?: string
+  // Set while the customer has paused their own account
+  deactivated_at?: string
   created_at: string
+  is_sandbox?: boolean
 }
 
 export interface AuthResponse {
   token: string
   user: User
+  // Ask the customer to confirm, then call authApi.reactivateAccount
+  reactivation_required?: boolean
+}
+
+export interface AccountStatus {
+  deactivated: boolean
+  deactivated_at?: string
+  subscriptions: number[]
+  upcoming_orders: number
+}
+
+export interface PushDevice {
+  id: number
+  platform: 'ios' | 'android'
+  app_version?: string
+  last_seen_at: string
+  created_at: string
+}
+
+export interface PushPreferences {
+  order_updates: boolean
+  driver_arrival: boolean
+  payment_issues: boolean
 }
 
 export interface LoginRequest {
@@ -66,6 +93,9 @@ export interface SubscriptionPlan {
   price_per_month: number
   pickups_per_month: number
   is_active: boolean
+  // Offer for first-time subscribers
+  trial_days: number
+  intro_price?: number
 }
 
 export interface CreateSubscriptionRequest {
@@ -138,6 +168,28 @@ export interface Subscription {
   pickups_used_this_period: number
   created_at: string
   updated_at: string
+  // Renewal info, included on the current subscription
+  renewal_date?: string
+  next_charge?: SubscriptionCharge
+  cancellation_effective_date?: string
+  pause_history?: SubscriptionPause[]
+  // Offer the subscription started with
+  trial_ends_at?: string
+  on_trial: boolean
+  intro_price?: number
+}
+
+export interface SubscriptionCharge {
+  date: string
+  amount: number
+  plan_id: number
+  plan_name: string
+  plan_change: boolean
+}
+
+export interface SubscriptionPause {
+  paused_at: string
+  resumed_at?: string
 }
 
 export interface Address {
@@ -181,6 +233,16 @@ export interface Service {
   description: string
   base_price: number
   is_active: boolean
+  bag_pricing?: BagPricing
+}
+
+// Laundry preferences for one order line; unset fields use the facility's defaults
+export interface ItemOptions {
+  detergent?: 'standard' | 'free_clear' | 'sensitive' | 'eco'
+  water_temperature?: 'cold' | 'warm' | 'hot'
+  hang_dry?: boolean
+  fold_style?: 'standard' | 'rolled' | 'hung'
+  allergy_safe?: boolean
 }
 
 export interface OrderItem {
@@ -189,6 +251,8 @@ export interface OrderItem {
   quantity: number
   price: number
   notes?: string
+  options?: ItemOptions
+  options_price?: number // What the options added to the line, set by the server
 }
 
 export interface CreateOrderRequest {
@@ -201,6 +265,8 @@ export interface CreateOrderRequest {
   special_instructions?: string
   items: OrderItem[]
   tip?: number
+  // Deliver to a locker or pickup point; a full locker fails with HTTP 409
+  delivery_location_id?: number
 }
 
 export interface CreateOrderResponse {
@@ -222,6 +288,7 @@ export interface Order {
   tax?: number
   tip?: number
   total?: number
+  overweight_charge?: number
   special_instructions?: string
   pickup_date: string
   delivery_date: string
@@ -230,6 +297,120 @@ export interface Order {
   created_at: string
   updated_at: string
   items?: OrderItem[]
+  slot_adjustment?: OrderSlotAdjustment
+  zone_surcharge?: OrderZoneSurcharge
+  // What the order was sold with; missing on older orders
+  pricing?: OrderPricingSnapshot
+  locker?: LockerReservation
+}
+
+export interface PickupLocation {
+  id: number
+  name: string
+  location_type: 'locker' | 'pickup_point'
+  street_address: string
+  city: string
+  state: string
+  zip_code: string
+  compartments?: number
+  hold_hours: number
+  instructions?: string
+  is_active: boolean
+  // Free compartments; missing for pickup points
+  available?: number
+  created_at: string
+}
+
+// The access code arrives once the driver drops the order off
+export interface LockerReservation {
+  id: number
+  order_id: number
+  location_id: number
+  location_name: string
+  address: string
+  status: 'reserved' | 'occupied' | 'collected' | 'released'
+  access_code?: string
+  dropped_off_at?: string
+  expires_at?: string
+  collected_at?: string
+  released_at?: string
+  release_reason?: 'cancelled' | 'expired'
+}
+
+export type PickupLocationRequest = Omit<PickupLocation, 'id' | 'available' | 'created_at'>
+
+export interface PricedLine {
+  kind: 'service' | 'item_options' | 'garment' | 'add_on'
+  line_id: number
+  name: string
+  description?: string
+  quantity: number
+  unit_price: number
+  list_price?: number
+  included_pounds?: number
+  overweight_rate?: number
+}
+
+export interface OrderPricingSnapshot {
+  captured_at: string
+  plan?: {
+    plan_id: number
+    name: string
+    monthly_price: number
+    pickups_per_month: number
+    over_quota_pickup_fee: number
+  }
+  lines: PricedLine[]
+  slot_adjustment?: OrderSlotAdjustment
+  zone_surcharge?: OrderZoneSurcharge
+  subtotal: number
+  tax: number
+  tip: number
+  total: number
+  credit_applied: number
+}
+
+export interface OrderZoneSurcharge {
+  zone: string
+  amount: number
+}
+
+export interface ServiceAreaCheck {
+  zip_code: string
+  covered: boolean
+  zone?: string
+  surcharge: number
+}
+
+export interface ServiceZone {
+  id: number
+  name: string
+  surcharge: number
+  zip_count: number
+}
+
+export interface ServiceArea {
+  zip_code: string
+  zone_id: number | null
+  zone_name?: string
+  surcharge: number
+  is_active: boolean
+  waitlist_count: number
+}
+
+export interface WaitlistEntry {
+  id: number
+  email: string
+  zip_code: string
+  user_id?: number
+  created_at: string
+  notified_at?: string
+}
+
+export interface OrderSlotAdjustment {
+  label: string
+  multiplier_percent: number
+  amount: number
 }
 
 export interface SubscriptionUsage {
@@ -244,6 +425,27 @@ export interface SubscriptionUsage {
   bags_remaining: number
 }
 
+// How pickups past the quota are paid for: on each order, or added up on
+// the monthly invoice
+export type OverageBilling = 'per_order' | 'period_end'
+
+export interface SubscriptionOverage {
+  id: number
+  order_id: number
+  amount: number
+  description: string
+  period_end: string
+  status: 'pending' | 'invoiced' | 'voided'
+  created_at: string
+  invoiced_at?: string
+}
+
+export interface SubscriptionOverages {
+  billing: OverageBilling
+  pending: SubscriptionOverage[]
+  pending_total: number
+}
+
 export interface CostCalculation {
   subtotal: number
   subscription_discount: number
@@ -304,14 +506,132 @@ export const authApi = {
     }
   },
 
+  async getAccountBlocks(session: any): Promise<CustomerBlock[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/account/blocks`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async appealBlock(session: any, blockId: number, message: string): Promise<BlocklistAppeal> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/account/blocks/${blockId}/appeal`, {
+      method: 'POST',
+      body: JSON.stringify({ message }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getMyPermissions(session: any): Promise<{ role: string, permissions: string[] }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/account/permissions`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Pauses subscriptions, auto-scheduling and marketing until reactivated
+  async deactivateAccount(session: any, reason?: string): Promise<AccountStatus> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/account/deactivate`, {
+      method: 'POST',
+      body: JSON.stringify({ reason }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async reactivateAccount(session: any): Promise<AccountStatus> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/account/reactivate`, {
+      method: 'POST',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Call on every app launch; the token can change between launches
+  async registerPushDevice(session: any, token: string, platform: 'ios' | 'android', appVersion?: string): Promise<PushDevice> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/account/push-devices`, {
+      method: 'POST',
+      body: JSON.stringify({ token, platform, app_version: appVersion }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async unregisterPushDevice(session: any, token: string): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/account/push-devices/${encodeURIComponent(token)}`, {
+      method: 'DELETE',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+
+  async getPushPreferences(session: any): Promise<PushPreferences> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/account/push-preferences`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updatePushPreferences(session: any, preferences: Partial<PushPreferences>): Promise<PushPreferences> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/account/push-preferences`, {
+      method: 'PUT',
+      body: JSON.stringify(preferences),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
   getGoogleAuthUrl(): string {
     return `${API_BASE_URL}/api/v1/auth/google`
   }
 }
 
 export const subscriptionApi = {
-  async getPlans(): Promise<SubscriptionPlan[]> {
-    const response = await fetch(`${API_BASE_URL}/api/v1/subscriptions/plans`)
+  // Plans sold at zipCode when given, else in the signed-in customer's market
+  async getPlans(zipCode?: string, session?: any): Promise<SubscriptionPlan[]> {
+    const query = zipCode ? `?zip_code=${encodeURIComponent(zipCode)}` : ''
+    const url = `${API_BASE_URL}/api/v1/subscriptions/plans${query}`
+    const response = session ? await authFetchWithSession(session, url) : await fetch(url)
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -388,6 +708,34 @@ export const subscriptionApi = {
     return response.json()
   },
 
+  async getSubscriptionOverages(session: any): Promise<SubscriptionOverages | null> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/subscriptions/overages`)
+
+    if (!response.ok) {
+      if (response.status === 404) {
+        return null // No subscription found
+      }
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async setOverageBilling(session: any, billing: OverageBilling): Promise<SubscriptionOverages> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/subscriptions/overages`, {
+      method: 'PUT',
+      body: JSON.stringify({ billing }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
   async getSubscriptionPreferences(session: any): Promise<SubscriptionPreferences | null> {
     const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/subscriptions/preferences`)
 
@@ -428,6 +776,134 @@ export const subscriptionApi = {
   }
 }
 
+export interface OrderCancellation {
+  order_id: number
+  late: boolean
+  free_until: string
+  refund?: Refund
+  credit_amount: number
+  credits_returned: number
+  cancelled_at: string
+}
+
+export interface OrderReviewRequest {
+  rating: number
+  driver_rating?: number
+  comment?: string
+}
+
+export interface OrderRating {
+  order_id: number
+  rating: number
+  driver_rating?: number
+  comment?: string
+  created_at: string
+}
+
+// Garments a driver added at pickup, or the facility flagged damaged or
+// substituted. They arrive on the order's Centrifuge channel as
+// order_item_event events.
+export interface OrderItemEvent {
+  id: number
+  event: 'item.added' | 'item.damaged' | 'item.substituted'
+  order_garment_id: number
+  garment_name: string
+  quantity: number
+  previous_garment_name: string | null
+}
+
+// In-app chat on an order between the customer, its drivers and support.
+// New messages and read receipts arrive on the conversation's Centrifuge
+// channel as order_message and order_message_read events, and typing as
+// order_typing events. The app sends its own typing with the chat_typing
+// RPC, passing {order_id, typing}.
+export interface OrderMessage {
+  id: number
+  order_id: number
+  sender_id: number | null
+  sender_role: 'customer' | 'driver' | 'support'
+  sender_name: string
+  body: string
+  created_at: string
+}
+
+export interface OrderMessageRead {
+  order_id: number
+  user_id: number
+  role: 'customer' | 'driver' | 'support'
+  last_read_message_id: number
+  read_at: string
+}
+
+export interface OrderChatTyping {
+  order_id: number
+  user_id: number
+  role: 'customer' | 'driver' | 'support'
+  typing: boolean
+}
+
+export interface OrderConversation {
+  order_id: number
+  channel: string
+  role: 'customer' | 'driver' | 'support'
+  can_send: boolean
+  unread: number
+  messages: OrderMessage[]
+  reads: OrderMessageRead[]
+}
+
+export interface ConversationSummary {
+  order_id: number
+  order_status: string
+  customer_id: number
+  customer_name: string
+  messages: number
+  last_message: OrderMessage
+  awaiting_reply: boolean
+}
+
+// Shared by customers and drivers (/orders) and support (/admin/orders)
+async function getOrderMessages(session: any, base: string, orderId: number, after?: number): Promise<OrderConversation> {
+  const query = after ? `?after=${after}` : ''
+  const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/${base}/${orderId}/messages${query}`)
+
+  if (!response.ok) {
+    const errorText = await response.text()
+    throw new Error(`HTTP ${response.status}: ${errorText}`)
+  }
+
+  return response.json()
+}
+
+async function sendOrderMessage(session: any, base: string, orderId: number, body: string): Promise<OrderMessage> {
+  const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/${base}/${orderId}/messages`, {
+    method: 'POST',
+    body: JSON.stringify({ body }),
+  })
+
+  if (!response.ok) {
+    const errorText = await response.text()
+    throw new Error(`HTTP ${response.status}: ${errorText}`)
+  }
+
+  return response.json()
+}
+
+// Resolves to null when the conversation has no messages yet
+async function markOrderMessagesRead(session: any, base: string, orderId: number, lastReadMessageId?: number): Promise<OrderMessageRead | null> {
+  const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/${base}/${orderId}/messages/read`, {
+    method: 'POST',
+    body: JSON.stringify(lastReadMessageId ? { last_read_message_id: lastReadMessageId } : {}),
+  })
+
+  if (!response.ok) {
+    const errorText = await response.text()
+    throw new Error(`HTTP ${response.status}: ${errorText}`)
+  }
+
+  return response.status === 204 ? null : response.json()
+}
+
 export const orderApi = {
   async createOrder(session: any, request: CreateOrderRequest): Promise<CreateOrderResponse> {
     const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/orders/create`, {
@@ -452,12 +928,14 @@ export const orderApi = {
     }
 
     return response.json()
-  }
-}
+  },
 
-export const addressApi = {
-  async getAddresses(session: any): Promise<Address[]> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/addresses`)
+  // Open pickup slots per date; the end defaults to a week from the start
+  async getAvailability(session: any, start: string, end?: string, zipCode?: string): Promise<SlotDayAvailability[]> {
+    const params = new URLSearchParams({ start })
+    if (end) params.set('end', end)
+    if (zipCode) params.set('zip_code', zipCode)
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/availability?${params}`)
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -467,10 +945,11 @@ export const addressApi = {
     return response.json()
   },
 
-  async createAddress(session: any, request: CreateAddressRequest): Promise<Address> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/addresses/create`, {
+  // Refunds before the free cancellation window closes, credits the account after
+  async cancelOrder(session: any, orderId: number, reason?: string): Promise<OrderCancellation> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/orders/${orderId}/cancel`, {
       method: 'POST',
-      body: JSON.stringify(request),
+      body: JSON.stringify({ reason }),
     })
 
     if (!response.ok) {
@@ -481,10 +960,11 @@ export const addressApi = {
     return response.json()
   },
 
-  async updateAddress(session: any, addressId: number, request: UpdateAddressRequest): Promise<Address> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/addresses/${addressId}`, {
-      method: 'PUT',
-      body: JSON.stringify(request),
+  // Rates a delivered order once; driver_rating defaults to the order rating
+  async reviewOrder(session: any, orderId: number, review: OrderReviewRequest): Promise<OrderRating> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/orders/${orderId}/review`, {
+      method: 'POST',
+      body: JSON.stringify(review),
     })
 
     if (!response.ok) {
@@ -495,21 +975,166 @@ export const addressApi = {
     return response.json()
   },
 
-  async deleteAddress(session: any, addressId: number): Promise<void> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/addresses/${addressId}`, {
-      method: 'DELETE',
-    })
+  // The customer and the order's drivers; the chat closes once the order is delivered or cancelled
+  getMessages(session: any, orderId: number, after?: number): Promise<OrderConversation> {
+    return getOrderMessages(session, 'orders', orderId, after)
+  },
+
+  sendMessage(session: any, orderId: number, body: string): Promise<OrderMessage> {
+    return sendOrderMessage(session, 'orders', orderId, body)
+  },
+
+  markMessagesRead(session: any, orderId: number, lastReadMessageId?: number): Promise<OrderMessageRead | null> {
+    return markOrderMessagesRead(session, 'orders', orderId, lastReadMessageId)
+  },
+
+  // Drivers who've served the customer, to favorite or block
+  async getDriverPreferences(session: any): Promise<DriverPreferences> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver-preferences`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async setDriverPreference(session: any, driverId: number, preference: DriverPreference, reason?: string): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver-preferences/${driverId}`, {
+      method: 'PUT',
+      body: JSON.stringify({ preference, ...(reason ? { reason } : {}) }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+
+  async clearDriverPreference(session: any, driverId: number): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver-preferences/${driverId}`, {
+      method: 'DELETE',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+}
+
+export const addressApi = {
+  async getAddresses(session: any): Promise<Address[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/addresses`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async createAddress(session: any, request: CreateAddressRequest): Promise<Address> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/addresses/create`, {
+      method: 'POST',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updateAddress(session: any, addressId: number, request: UpdateAddressRequest): Promise<Address> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/addresses/${addressId}`, {
+      method: 'PUT',
+      body: JSON.stringify(request),
+    })
 
     if (!response.ok) {
       const errorText = await response.text()
       throw new Error(`HTTP ${response.status}: ${errorText}`)
     }
+
+    return response.json()
+  },
+
+  async deleteAddress(session: any, addressId: number): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/addresses/${addressId}`, {
+      method: 'DELETE',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  }
+}
+
+// Addresses and orders outside coverage fail with HTTP 422 and
+// "waitlist": true, pointing the customer at joinWaitlist
+export const serviceAreaApi = {
+  async checkZip(zipCode: string): Promise<ServiceAreaCheck> {
+    const response = await fetch(`${API_BASE_URL}/api/v1/service-areas/check?zip=${encodeURIComponent(zipCode)}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Lockers and pickup points, ones in or near zipCode first
+  async getPickupLocations(zipCode?: string): Promise<PickupLocation[]> {
+    const query = zipCode ? `?zip=${encodeURIComponent(zipCode)}` : ''
+    const response = await fetch(`${API_BASE_URL}/api/v1/pickup-locations${query}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async joinWaitlist(email: string, zipCode: string): Promise<{ email: string; zip_code: string; message: string }> {
+    const response = await fetch(`${API_BASE_URL}/api/v1/service-areas/waitlist`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ email, zip_code: zipCode }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
   }
 }
 
 export const serviceApi = {
-  async getServices(): Promise<Service[]> {
-    const response = await fetch(`${API_BASE_URL}/api/v1/services`)
+  async getServices(zipCode?: string): Promise<Service[]> {
+    const query = zipCode ? `?zip_code=${encodeURIComponent(zipCode)}` : ''
+    const response = await fetch(`${API_BASE_URL}/api/v1/services${query}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // The market the customer's default address is in, or null outside them
+  async getMyMarket(session: any): Promise<Pick<Market, 'id' | 'slug' | 'name'> | null> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/market`)
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -524,27 +1149,2291 @@ export interface RouteOrderStatusRequest {
   status: 'pending' | 'completed' | 'failed'
 }
 
-export interface EarningsData {
-  today: number
-  thisWeek: number
-  thisMonth: number
-  total: number
-  completedOrders: number
-  averagePerOrder: number
-  hoursWorked: number
-  hourlyRate: number
+export interface SafetyReport {
+  id: number
+  driver_id: number | null
+  route_order_id?: number
+  order_id?: number
+  category: 'aggressive_person' | 'dangerous_animal' | 'unsafe_premises' | 'harassment' | 'other'
+  description: string
+  status: 'open' | 'dismissed' | 'actioned'
+  review_notes?: string
+  reviewed_at?: string
+  created_at: string
 }
 
-export interface EarningsHistory {
+export interface BlocklistAppeal {
+  id: number
+  entry_id: number
+  message: string
+  status: 'pending' | 'approved' | 'denied'
+  response?: string
+  reviewed_at?: string
+  created_at: string
+}
+
+export interface CustomerBlock {
+  id: number
+  scope: 'account' | 'address'
+  address_label?: string
+  created_at: string
+  appeal?: BlocklistAppeal
+}
+
+export interface TimelineEvent {
+  kind: 'orders' | 'notes' | 'payments' | 'subscriptions' | 'claims' | 'account' | 'notifications'
+  type: string
+  source_id: number
+  occurred_at: string
+  summary: string
+  detail?: string
+  status?: string
+  order_id?: number
+  amount_cents?: number
+  actor_id?: number
+  actor_name?: string
+}
+
+export interface CustomerTimeline {
+  events: TimelineEvent[]
+  next_before?: string
+}
+
+// One field an admin edit changed, with its value before and after
+export interface FieldChange {
+  field: string
+  old: unknown
+  new: unknown
+}
+
+export interface AuditLogEntry {
+  id: number
+  actor_id?: number
+  actor_name?: string
+  actor_role?: string
+  action: string
+  path: string
+  target_type?: string
+  target_id?: string
+  status_code: number
+  request_body?: unknown
+  before?: unknown
+  after?: unknown
+  changed_fields: string[]
+  changes: FieldChange[]
+  ip_address?: string
+  user_agent?: string
+  created_at: string
+}
+
+export interface SlotPriceRule {
+  id: number
+  name: string
+  day_of_week: number | null
+  time_slot: string | null
+  multiplier_percent: number
+  is_active: boolean
+}
+
+export interface SlotCapacity {
+  id: number
+  market: string | null
+  day_of_week: number | null
+  time_slot: string
+  capacity: number
+}
+
+export interface PickupSlotAvailability {
+  time_slot: string
+  capacity: number
+  booked: number
+  held: number
+  available: number
+  price_label?: string
+  price_multiplier_percent: number
+}
+
+export type WeatherSeverity = 'moderate' | 'severe'
+
+export interface DayWeatherRisk {
+  severity: WeatherSeverity
+  summary: string
+}
+
+export interface SlotDayAvailability {
   date: string
+  slots: PickupSlotAvailability[]
+  weather?: DayWeatherRisk
+}
+
+export interface BagPricing {
+  id: number
+  service_id: number
+  service_name: string
+  market: string | null
+  size_label: string
+  price: number
+  included_pounds: number
+  overweight_rate: number
+  is_active: boolean
+}
+
+export interface BagWeight {
+  order_item_id: number
+  weight: number
+}
+
+export interface BagWeightResult {
+  order_id: number
+  total_weight: number
+  included_pounds: number
+  overweight_charge: number
+}
+
+// Critical order updates carry an event_id; acknowledge it with this
+// Centrifuge RPC (data: { event_id }) or the customer is notified again
+export const REALTIME_ACK_RPC = 'ack_event'
+
+export interface RealtimeDeliveryStats {
+  status: string
+  published: number
+  acked: number
+  late_acked: number
+  fell_back: number
+  pending: number
+  fallback_rate: number
+  avg_ack_seconds?: number
+}
+
+// Realtime order updates Centrifuge failed to publish and what became of them
+export interface RealtimeRetryStats {
+  failed: number
+  retry_failed: number
+  recovered: number
+  superseded: number
+  dropped: number
+  pending: number
+}
+
+// Counts deleted by a sandbox purge
+export interface SandboxPurgeResult {
   orders: number
-  earnings: number
-  hours: number
+  payments: number
+  notifications: number
 }
 
-export const driverApi = {
-  async getRoutes(session: any): Promise<any[]> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/routes`)
+export interface StopNavigation {
+  google_maps: string
+  apple_maps: string
+}
+
+export interface ManifestStop {
+  sequence: number
+  route_order_id: number
+  order_id: number
+  order_number: string
+  status: string
+  customer_name: string
+  phone: string
+  address: string
+  location?: LatLng
+  time_slot: string
+  eta?: string
+  bags: number
+  garments: number
+  instructions: string[]
+  care_options: string[] // e.g. "Bedding: hang dry, cold wash"
+  navigation?: StopNavigation
+}
+
+export interface RouteManifest {
+  route_id: number
+  route_date: string
+  route_type: string
+  status: string
+  driver_name: string
+  stops: ManifestStop[]
+  navigation_url?: string
+  generated_at: string
+}
+
+export interface RouteRemainingItem {
+  order_id: number
+  bags: number
+  description: string
+}
+
+export interface RouteCashTip {
+  order_id: number
+  amount: number
+}
+
+export interface RouteCloseoutRequest {
+  bags_confirmed: boolean
+  remaining_items?: RouteRemainingItem[]
+  cash_tips?: RouteCashTip[]
+  notes?: string
+}
+
+export interface CloseoutStop {
+  order_id: number
+  order_number: string
+  status: string
+  bags: number
+  notes?: string
+}
+
+export interface RouteCloseoutReport {
+  route_id: number
+  route_date: string
+  route_type: string
+  driver_id: number
+  driver_name: string
+  started_at?: string
+  ended_at?: string
+  closed_at: string
+  stops_completed: number
+  stops_failed: number
+  bags_expected: number
+  bags_returned: number
+  bags_confirmed: boolean
+  failed_stops: CloseoutStop[]
+  remaining_items: RouteRemainingItem[]
+  online_tips: number
+  cash_tips: number
+  cash_tips_by_order: RouteCashTip[]
+  notes?: string
+  needs_facility_review: boolean
+}
+
+export interface Market {
+  id: number
+  slug: string
+  name: string
+  is_active: boolean
+  zip_prefixes: string[]
+  customers: number
+  drivers: number
+  services: number
+  plans: number
+  created_at: string
+  updated_at: string
+}
+
+export interface IntakePause {
+  id: number
+  market_id?: number // Unset for everywhere
+  market_name?: string
+  reason: string
+  paused_by?: number
+  paused_at: string
+  resumed_by?: number
+  resumed_at?: string
+}
+
+export interface DrainMarketResponse {
+  market: string
+  date: string
+  released_orders: number[]
+  cancelled_routes: number[]
+  trimmed_routes: number[]
+}
+
+export interface QueueRedrive {
+  queue: 'webhooks' | 'push' | 'stripe'
+  requeued: number
+  still_failing?: number
+}
+
+export interface IncidentSnapshotData {
+  taken_at: string
+  intake_pauses: IntakePause[]
+  degraded_features: { feature: string; since: string; last_error: string }[]
+  open_orders: Record<string, number>
+  orders_last_hour: number
+  routes: {
+    route_id: number
+    route_type: string
+    status: string
+    driver_id?: number
+    driver_name?: string
+    pending: number
+    completed: number
+    failed: number
+  }[]
+  queues: { queue: string; pending: number; failed: number; oldest_pending_at?: string }[]
+  open_alerts: Record<string, number>
+}
+
+export interface IncidentSnapshot {
+  id: number
+  incident: string
+  notes?: string
+  taken_by?: number
+  created_at: string
+  data?: IncidentSnapshotData // Left out of lists
+}
+
+export type FacilityStage = 'received' | 'washing' | 'drying' | 'folding' | 'folded'
+
+export interface FacilityBag {
+  id: number
+  order_id: number
+  order_number: string
+  order_item_id?: number
+  bag_code: string
+  stage: FacilityStage
+  weight?: number // Pounds, from the facility scale
+  received_at: string
+  stage_updated_at: string
+  released_at?: string
+  care_options: string[]
+}
+
+export interface FacilityIntakeRequest {
+  order_id: number
+  bag_code: string
+  order_item_id?: number // Required when the order has more than one line of bags
+}
+
+export interface MarketRequest {
+  slug?: string
+  name?: string
+  is_active?: boolean
+  zip_prefixes?: string[] // Replaces the market's prefixes when set
+}
+
+export interface Permission {
+  name: string
+  description: string
+}
+
+export interface Role {
+  name: string
+  description: string
+  built_in: boolean
+  permissions: string[]
+  user_count: number
+  created_at: string
+  updated_at: string
+}
+
+export interface DeliverySignature {
+  id: number
+  route_order_id: number
+  order_id: number
+  signer_name: string
+  content_type: string
+  strokes?: unknown[]
+  url?: string
+  signed_at: string
+}
+
+export interface StopPhoto {
+  id: number
+  route_order_id: number
+  order_id: number
+  stop_type: 'pickup' | 'delivery'
+  content_type: string
+  url?: string
+  taken_at: string
+  // Set for drivers and admins when the photo failed a quality check
+  quality_issues?: StopPhotoIssue[]
+}
+
+export type StopPhotoIssue =
+  | 'unreadable'
+  | 'low_resolution'
+  | 'too_dark'
+  | 'overexposed'
+  | 'stale_timestamp'
+  | 'future_timestamp'
+  | 'duplicate'
+
+export interface FlaggedStopPhoto extends StopPhoto {
+  driver_id: number | null
+  driver_name: string | null
+  width: number | null
+  height: number | null
+  brightness: number | null
+  captured_at: string | null
+}
+
+export interface WeatherAffectedRoute {
+  route_id: number
+  route_type: 'pickup' | 'delivery'
+  status: string
+  driver_id?: number
+  driver_name?: string
+  stops: number
+}
+
+export interface WeatherAdvisory {
+  id: number
+  market: string
+  date: string
+  severity: WeatherSeverity
+  summary: string
+  weather_code?: number
+  precipitation_mm?: number
+  snowfall_cm?: number
+  wind_gust_kmh?: number
+  fetched_at: string
+  rescheduled_to?: string
+  rescheduled_by?: number
+  rescheduled_at?: string
+  routes?: WeatherAffectedRoute[]
+  affected_orders: number
+}
+
+export interface WeatherRescheduledOrder {
+  order_id: number
+  route_id: number
+  route_type: 'pickup' | 'delivery'
+  new_date: string
+}
+
+export interface WeatherRescheduleResponse {
+  advisory: WeatherAdvisory
+  moved_routes: number[]
+  orders: WeatherRescheduledOrder[]
+}
+
+export interface ProofOfDelivery {
+  order_id: number
+  photos: StopPhoto[]
+  pickup_signature: DeliverySignature | null
+  delivery_signature: DeliverySignature | null
+}
+
+export interface EarningsData {
+  today: number
+  thisWeek: number
+  thisMonth: number
+  total: number
+  completedOrders: number
+  averagePerOrder: number
+  hoursWorked: number
+  hourlyRate: number
+  // Stop pay and tips earned but not yet transferred
+  unpaidBalance: number
+  payoutAccount: DriverPayoutAccount
+  payouts: DriverPayout[]
+}
+
+export interface DriverPayoutAccount {
+  connected: boolean
+  details_submitted: boolean
+  payouts_enabled: boolean
+}
+
+export interface DriverPayout {
+  id: number
+  driver_id: number
+  driver_name?: string
+  period_start: string
+  period_end: string
+  stop_count: number
+  stop_pay: number
+  tips: number
+  amount: number
+  status: 'pending' | 'processing' | 'paid' | 'failed'
+  stripe_transfer_id?: string
+  failure_reason?: string
+  paid_at?: string
+  created_at: string
+}
+
+export interface EarningsHistory {
+  date: string
+  orders: number
+  earnings: number
+  hours: number
+}
+
+export interface DriverWeeklyStats {
+  weekStart: string
+  completedStops: number
+  onTimePercent: number | null
+  earnings: number
+  tips: number
+  averageRouteMinutes: number | null
+}
+
+export interface DriverPerformance {
+  completedStops: number
+  onTimePercent: number | null
+  totalTips: number
+  averageRouteMinutes: number | null
+  weeks: DriverWeeklyStats[]
+}
+
+export interface DriverReview {
+  orderId: number
+  rating: number
+  comment?: string
+  createdAt: string
+}
+
+export interface DriverReviews {
+  rating: number | null
+  ratingCount: number
+  reviews: DriverReview[]
+}
+
+export const driverApi = {
+  async getRoutes(session: any): Promise<any[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/routes`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getRouteManifest(session: any, routeId: number): Promise<RouteManifest> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/routes/${routeId}/manifest`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async closeOutRoute(session: any, routeId: number, closeout: RouteCloseoutRequest): Promise<RouteCloseoutReport> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/routes/${routeId}/close-out`, {
+      method: 'POST',
+      body: JSON.stringify(closeout),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async recordBagWeights(session: any, routeOrderId: number, bags: BagWeight[]): Promise<BagWeightResult> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/route-orders/${routeOrderId}/weights`, {
+      method: 'PUT',
+      body: JSON.stringify({ bags }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updateRouteOrderStatus(session: any, routeOrderId: number, request: RouteOrderStatusRequest): Promise<{ message: string }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/route-orders/status?id=${routeOrderId}`, {
+      method: 'PUT',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Uploads as multipart, so the JSON content type authFetchWithSession sets is left off
+  async captureSignature(session: any, routeOrderId: number, image: Blob, signerName: string, strokes?: unknown[]): Promise<DeliverySignature> {
+    const form = new FormData()
+    form.append('signature', image, 'signature.png')
+    form.append('signer_name', signerName)
+    if (strokes) form.append('strokes', JSON.stringify(strokes))
+
+    const response = await fetch(`${API_BASE_URL}/api/v1/driver/route-orders/${routeOrderId}/signature`, {
+      method: 'POST',
+      headers: { 'Authorization': `Bearer ${session?.accessToken}` },
+      body: form,
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // deviceHash is the hex SHA-256 of the photo as taken, before any resizing
+  async uploadStopPhoto(session: any, routeOrderId: number, image: Blob, deviceHash?: string): Promise<StopPhoto> {
+    const form = new FormData()
+    form.append('photo', image, 'photo.jpg')
+    if (deviceHash) form.append('hash', deviceHash)
+
+    const response = await fetch(`${API_BASE_URL}/api/v1/driver/route-orders/${routeOrderId}/photos`, {
+      method: 'POST',
+      headers: { 'Authorization': `Bearer ${session?.accessToken}` },
+      body: form,
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async reportSafetyIssue(session: any, routeOrderId: number, category: SafetyReport['category'], description: string): Promise<SafetyReport> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/safety-reports`, {
+      method: 'POST',
+      body: JSON.stringify({ route_order_id: routeOrderId, category, description }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getCompletedDeliveries(session: any, params?: { period?: string }): Promise<any[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.period) searchParams.append('period', params.period)
+
+    const url = `${API_BASE_URL}/api/v1/driver/routes${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    const routes = await response.json()
+    
+    // Filter to only completed route orders and flatten the data
+    const completedDeliveries: any[] = []
+    routes.forEach((route: any) => {
+      route.orders?.forEach((order: any) => {
+        if (order.status === 'completed') {
+          completedDeliveries.push({
+            ...order,
+            route_id: route.id,
+            route_type: route.route_type,
+            route_date: route.route_date,
+            route_status: route.status
+          })
+        }
+      })
+    })
+
+    return completedDeliveries
+  },
+
+  async getEarnings(session: any): Promise<EarningsData> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/earnings`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getEarningsHistory(session: any, params?: { period?: string }): Promise<EarningsHistory[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.period) searchParams.append('period', params.period)
+
+    const url = `${API_BASE_URL}/api/v1/driver/earnings/history${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getStats(session: any, weeks?: number): Promise<DriverPerformance> {
+    const query = weeks ? `?weeks=${weeks}` : ''
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/stats${query}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getReviews(session: any): Promise<DriverReviews> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/reviews`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Returns a Stripe-hosted link to set up or finish the payout account
+  async startPayoutOnboarding(session: any): Promise<{ url: string; expires_at: string }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/payouts/onboarding`, {
+      method: 'POST',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getPayoutAccount(session: any): Promise<DriverPayoutAccount> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/payouts/account`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  }
+}
+
+export interface AdminOrder extends Order {
+  user_email: string
+  user_name: string
+  route_id?: number
+  route_type?: string
+  driver_name?: string
+  driver_id?: number
+  is_assigned: boolean
+  refunded_amount: number
+}
+
+export interface RouteAssignmentRequest {
+  driver_id: number
+  order_ids: number[]
+  route_date: string
+  route_type: 'pickup' | 'delivery'
+  // Assign even if the driver's day goes over their capacity
+  allow_overload?: boolean
+}
+
+export interface RouteCapacity {
+  max_bags: number
+  max_minutes: number
+}
+
+// A driver's day with the route added; warnings list the limits it goes over
+export interface RouteLoad {
+  driver_id: number
+  route_date: string
+  stops: number
+  bags: number
+  drive_minutes: number
+  service_minutes: number
+  total_minutes: number
+  capacity: RouteCapacity
+  warnings: string[]
+}
+
+export interface DriverSuggestion {
+  driver_id: number
+  driver_name: string
+  distance_km: number | null
+  routes_on_date: number
+  stops_on_date: number
+  zone_stops: number
+  zone_completion_rate: number | null
+  favorited_by: number
+  tier: string // Last week's scorecard tier
+  route_priority: number // Lower is offered routes first
+  score: number
+  load: RouteLoad
+}
+
+export type DriverPreference = 'favorite' | 'blocked'
+
+export interface ServedDriver {
+  driver_id: number
+  driver_name: string
+  stops: number
+  last_served_at: string
+  preference: DriverPreference | null
+  reason?: string
+}
+
+export interface DriverPreferences {
+  drivers: ServedDriver[]
+  max_blocked: number
+}
+
+export interface DriverPreferenceStats {
+  driver_id: number
+  driver_name: string
+  customers_served: number
+  favorited_by: number
+  blocked_by: number
+  block_rate: number | null
+  recent_block_reasons: string[]
+}
+
+export interface BulkStatusUpdateRequest {
+  order_ids: number[]
+  status: string
+  notes?: string
+}
+
+export interface BulkStatusUpdateResponse {
+  message: string
+  updated_count: number
+  total_orders: number
+  // Keyed by order ID
+  changes: FieldChange[]
+}
+
+export type AdminBatchAction =
+  | { type: 'update_status'; order_id: number; status: string; notes?: string }
+  | { type: 'assign_route'; order_id: number; route_id: number }
+  | { type: 'add_note'; order_id: number; notes: string }
+
+export interface AdminBatchRequest {
+  actions: AdminBatchAction[]
+  suppress_notifications?: boolean
+}
+
+export interface AdminBatchResponse {
+  committed: boolean
+  results: {
+    index: number
+    type: AdminBatchAction['type']
+    order_id: number
+    result: 'applied' | 'failed' | 'rolled_back' | 'not_run'
+    error?: string
+  }[]
+}
+
+export interface LatLng {
+  latitude: number
+  longitude: number
+}
+
+export interface OptimizationSuggestionsRequest {
+  order_ids: number[]
+  route_type?: 'pickup' | 'delivery'
+  start_time?: string // HH:MM, default 08:00
+  start?: LatLng // Defaults to the depot
+  jurisdiction?: string // Labor rules for breaks, default if left out
+}
+
+export interface OrderLocation {
+  id: number
+  pickup_date: string
+  pickup_time_slot: string
+  delivery_date: string
+  delivery_time_slot: string
+  pickup_address: string
+  pickup_city: string
+  pickup_zip: string
+  delivery_address: string
+  delivery_city: string
+  delivery_zip: string
+  customer_name: string
+}
+
+export interface OptimizationSuggestion {
+  type: string
+  message: string
+  groups: { [key: string]: number[] }
+}
+
+export interface OptimizedStop extends LatLng {
+  sequence: number
+  order_id: number
+  address_id: number
+  address: string
+  travel_minutes: number
+  eta: string // HH:MM
+}
+
+export interface OptimizedBreak {
+  after_sequence: number // Taken after this stop
+  break_type: 'rest' | 'meal'
+  duration_minutes: number
+  estimated_start?: string // HH:MM
+}
+
+export interface OptimizedRoute {
+  route_type: 'pickup' | 'delivery'
+  start_time: string
+  start?: LatLng
+  stops: OptimizedStop[]
+  total_travel_minutes: number
+  baseline_travel_minutes: number
+  finish_time: string
+  breaks: OptimizedBreak[]
+  travel_time_source: 'osrm' | 'estimated'
+  unlocated_order_ids: number[]
+}
+
+export interface OptimizationSuggestionsResponse {
+  orders: OrderLocation[]
+  suggestions: OptimizationSuggestion[]
+  optimized_route: OptimizedRoute
+  total_orders: number
+}
+
+export interface OrderResolution {
+  id: number
+  order_id: number
+  resolved_by: number
+  resolution_type: 'reschedule' | 'partial_refund' | 'full_refund' | 'credit' | 'waive_fee'
+  reschedule_date?: string
+  refund_amount?: number
+  credit_amount?: number
+  notes: string
+  created_at: string
+  refund?: Refund
+}
+
+export interface Refund {
+  id: number
+  payment_id: number
+  order_id?: number
+  resolution_id?: number
+  amount: number
+  reason: string
+  status: 'pending' | 'requires_action' | 'succeeded' | 'failed' | 'canceled'
+  stripe_refund_id?: string
+  failure_reason?: string
+  created_by?: number
+  created_at: string
+  updated_at: string
+}
+
+// Everything about one order for the admin dashboard; payments are left out
+// for staff without payments.read
+export interface AdminOrderDetail {
+  order: Order
+  customer: { id: number; name: string; email: string }
+  routes: {
+    route_id: number
+    route_type: 'pickup' | 'delivery'
+    route_date: string
+    route_status: string
+    driver_id?: number
+    driver_name?: string
+    sequence: number
+    stop_status: 'pending' | 'completed' | 'failed'
+    assigned_at: string
+    completed_at?: string
+  }[]
+  resolutions: OrderResolution[]
+  payments?: {
+    id: number
+    amount: number
+    refunded_amount: number
+    payment_type: string
+    status: string
+    stripe_payment_intent_id?: string
+    refunds: Refund[]
+    created_at: string
+  }[]
+  timeline: {
+    kind: 'status' | 'route' | 'payment' | 'refund' | 'resolution'
+    source_id: number
+    occurred_at: string
+    summary: string
+    actor_id?: number
+  }[]
+}
+
+export interface CreateOrderResolutionRequest {
+  order_id: number
+  resolution_type: 'reschedule' | 'partial_refund' | 'full_refund' | 'credit' | 'waive_fee'
+  reschedule_date?: string
+  refund_amount?: number
+  credit_amount?: number
+  notes: string
+}
+
+export interface DriverStats {
+  driver_id: number
+  driver_name: string
+  total_deliveries: number
+  today_deliveries: number
+  avg_delivery_time_minutes: number | null
+  rating: number | null
+  rating_count: number
+  order_rating: number | null
+  expenses_this_month: number
+  miles_this_month: number
+  stats_refreshed_at: string | null
+}
+
+export interface OrderReview {
+  id: number
+  order_id: number
+  customer_id: number
+  customer_name: string
+  driver_id: number | null
+  driver_name: string | null
+  rating: number
+  driver_rating?: number
+  comment?: string
+  created_at: string
+  hidden_at?: string
+  hidden_by?: number
+  hidden_reason?: string
+}
+
+export interface RevenueAnalytics {
+  date: string
+  revenue: number
+  order_count: number
+  average_order_value: number
+}
+
+export interface LedgerEntry {
+  account: string
+  debit: number
+  credit: number
+}
+
+export interface LedgerTransaction {
+  id: number
+  source: 'payment' | 'stripe_fee' | 'refund' | 'credit' | 'driver_earning' | 'driver_payout' | 'invoice'
+  source_ref: string
+  description: string
+  user_id?: number
+  order_id?: number
+  occurred_at: string
+  entries: LedgerEntry[]
+}
+
+export interface LedgerAccountBalance {
+  name: string
+  type: 'asset' | 'liability' | 'revenue' | 'contra_revenue' | 'expense'
+  description: string
+  debits: number
+  credits: number
+  balance: number
+}
+
+export interface TrialBalance {
+  accounts: LedgerAccountBalance[]
+  total_debits: number
+  total_credits: number
+}
+
+export interface LedgerCheck {
+  ok: boolean
+  total_debits: number
+  total_credits: number
+  unbalanced_transactions: number[]
+  mismatches: { account: string; ledger: number; expected: number }[]
+}
+
+export interface UpdatePlanOfferRequest {
+  trial_days: number
+  intro_price?: number | null
+}
+
+export interface TrialCohort {
+  month: string
+  started: number
+  in_trial: number
+  converted: number
+  cancelled: number
+  conversion_rate: number
+}
+
+export interface TrialAnalytics {
+  months: number
+  cohorts: TrialCohort[]
+  total: TrialCohort
+  intro: {
+    started: number
+    active: number
+    retention_rate: number
+  }
+}
+
+// A soft-launch market measured from the day it launched. Acquisition cost is
+// promo credit granted per ordering customer; ad spend isn't tracked.
+export interface MarketAnalytics {
+  market: string
+  invite_only: boolean
+  launched_on: string
+  days_live: number
+  orders: {
+    total: number
+    last_seven_days: number
+    per_week: number
+    customers: number
+    repeat_customers: number
+    retention_rate: number
+    active_subscribers: number
+  }
+  acquisition: {
+    channel: string
+    signups: number
+    customers: number
+    conversion_rate: number
+    promos: number
+    credit_granted_cents: number
+    cac_cents: number
+  }[]
+  capacity: {
+    from: string
+    to: string
+    capacity: number
+    booked: number
+    market_pickups: number
+    dedicated_slots: number
+    utilization_rate: number
+  }
+}
+
+// An order over the review threshold, held until an admin confirms it
+export interface HeldOrder {
+  order_id: number
+  user_id: number
+  customer_name: string
+  customer_email: string
+  total_cents: number
+  threshold_cents: number
+  pickup_date: string
+  pickup_time_slot?: string
+  account_created_at: string
+  prior_orders: number
+  held_at: string
+}
+
+// A publishable key for the booking widget on a partner site
+export interface WidgetKey {
+  id: number
+  publishable_key: string
+  name: string
+  allowed_origins: string[]
+  is_active: boolean
+  created_at: string
+  updated_at: string
+}
+
+// A booking started in a partner's widget, picked up at checkout
+export interface BookingDraft {
+  token: string
+  zip_code: string
+  pickup_date: string
+  pickup_time_slot: string
+  bags: number
+  quote: {
+    bag_price_cents: number
+    subtotal_cents: number
+    slot_adjustment_cents: number
+    slot_price_label?: string
+    zone_surcharge_cents: number
+    total_cents: number
+  }
+  expires_at: string
+}
+
+// An address whose new geocode landed far from its old pin: a customer who
+// moved, or an edit that put the pin somewhere wrong
+export interface AddressGeocodeDrift {
+  id: number
+  address_id: number
+  user_id?: number
+  address?: string
+  reason: 'edited' | 'recheck'
+  previous: { latitude: number; longitude: number }
+  location: { latitude: number; longitude: number }
+  distance_km: number
+  reviewed_at?: string
+  reviewed_by?: number
+  review_note?: string
+  detected_at: string
+}
+
+export interface GeocodeBackfillRun {
+  id: number
+  recheck: boolean
+  candidates: number
+  geocoded: number
+  not_found: number
+  failed: number
+  drifted: number
+  duration_ms: number
+  triggered_by?: number
+  created_at: string
+  drifts: AddressGeocodeDrift[]
+}
+
+export const adminApi = {
+  async getOrdersSummary(session: any, market?: string): Promise<any> {
+    const query = market ? `?market=${encodeURIComponent(market)}` : ''
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/summary${query}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getAllOrders(session: any, params?: { status?: string, date?: string, user_id?: string, market?: string, limit?: number, offset?: number }): Promise<AdminOrder[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.status) searchParams.append('status', params.status)
+    if (params?.date) searchParams.append('date', params.date)
+    if (params?.user_id) searchParams.append('user_id', params.user_id)
+    if (params?.market) searchParams.append('market', params.market)
+    if (params?.limit) searchParams.append('limit', params.limit.toString())
+    if (params?.offset) searchParams.append('offset', params.offset.toString())
+
+    const url = `${API_BASE_URL}/api/v1/admin/orders${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getUsers(session: any, params?: { role?: string, search?: string, sandbox?: boolean, limit?: number, offset?: number }): Promise<User[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.role) searchParams.append('role', params.role)
+    if (params?.sandbox !== undefined) searchParams.append('sandbox', String(params.sandbox))
+    if (params?.search) searchParams.append('search', params.search)
+    if (params?.limit) searchParams.append('limit', params.limit.toString())
+    if (params?.offset) searchParams.append('offset', params.offset.toString())
+
+    const url = `${API_BASE_URL}/api/v1/admin/users${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getDriverStats(session: any, market?: string): Promise<DriverStats[]> {
+    const query = market ? `?market=${encodeURIComponent(market)}` : ''
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/drivers/stats${query}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getDriverPreferenceStats(session: any): Promise<DriverPreferenceStats[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/drivers/preferences`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getReviews(session: any, params?: { driver_id?: number; max_rating?: number; hidden?: boolean; limit?: number }): Promise<OrderReview[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.driver_id) searchParams.append('driver_id', params.driver_id.toString())
+    if (params?.max_rating) searchParams.append('max_rating', params.max_rating.toString())
+    if (params?.hidden !== undefined) searchParams.append('hidden', String(params.hidden))
+    if (params?.limit) searchParams.append('limit', params.limit.toString())
+
+    const url = `${API_BASE_URL}/api/v1/admin/reviews${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Hidden reviews stop counting toward the driver's rating
+  async moderateReview(session: any, reviewId: number, hidden: boolean, reason?: string): Promise<OrderReview> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/reviews/${reviewId}/moderation`, {
+      method: 'PUT',
+      body: JSON.stringify({ hidden, reason }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // A 409 carries the driver's load when the route would overload them
+  async assignDriverToRoute(session: any, request: RouteAssignmentRequest): Promise<{ message: string, route_id: number, load: RouteLoad }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/routes/assign`, {
+      method: 'POST',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async suggestDrivers(session: any, request: Omit<RouteAssignmentRequest, 'driver_id'>): Promise<{ suggested_drivers: DriverSuggestion[] }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/routes/assign`, {
+      method: 'POST',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async setDriverHomeBase(session: any, driverId: number, latitude: number | null, longitude: number | null): Promise<{ driver_id: number, latitude: number | null, longitude: number | null }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/drivers/${driverId}/home-base`, {
+      method: 'PUT',
+      body: JSON.stringify({ latitude, longitude }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async setDriverCapacity(session: any, driverId: number, maxBags: number | null, maxMinutes: number | null): Promise<RouteCapacity> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/drivers/${driverId}/capacity`, {
+      method: 'PUT',
+      body: JSON.stringify({ max_bags: maxBags, max_minutes: maxMinutes }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getMarkets(session: any): Promise<Market[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/markets`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async createMarket(session: any, request: MarketRequest): Promise<Market> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/markets`, {
+      method: 'POST',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updateMarket(session: any, marketId: number, request: MarketRequest): Promise<Market> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/markets/${marketId}`, {
+      method: 'PUT',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Ties a driver, service or plan to a market; null unties it
+  async setDriverMarket(session: any, driverId: number, marketId: number | null): Promise<{ id: number; market_id: number | null }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/drivers/${driverId}/market`, {
+      method: 'PUT',
+      body: JSON.stringify({ market_id: marketId }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async setServiceMarket(session: any, serviceId: number, marketId: number | null): Promise<{ id: number; market_id: number | null }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/services/${serviceId}/market`, {
+      method: 'PUT',
+      body: JSON.stringify({ market_id: marketId }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async setPlanMarket(session: any, planId: number, marketId: number | null): Promise<{ id: number; market_id: number | null }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/subscription-plans/${planId}/market`, {
+      method: 'PUT',
+      body: JSON.stringify({ market_id: marketId }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getIntakePauses(session: any): Promise<IntakePause[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/recovery/intake-pauses`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Stops new orders everywhere, or in one market by slug or ID
+  async pauseIntake(session: any, reason: string, market?: string): Promise<IntakePause> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/recovery/intake-pauses`, {
+      method: 'POST',
+      body: JSON.stringify({ reason, market }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async resumeIntake(session: any, pauseId: number): Promise<IntakePause> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/recovery/intake-pauses/${pauseId}/resume`, {
+      method: 'POST',
+      body: JSON.stringify({}),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // confirm must repeat the market's slug
+  async drainMarket(session: any, market: string, request: { reason: string; confirm: string; date?: string }): Promise<DrainMarketResponse> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/recovery/markets/${encodeURIComponent(market)}/drain`, {
+      method: 'POST',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async redriveQueues(session: any, request: { queues?: QueueRedrive['queue'][]; since?: string } = {}): Promise<QueueRedrive[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/recovery/redrive`, {
+      method: 'POST',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async createIncidentSnapshot(session: any, incident: string, notes?: string): Promise<IncidentSnapshot> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/recovery/snapshots`, {
+      method: 'POST',
+      body: JSON.stringify({ incident, notes }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getIncidentSnapshots(session: any): Promise<IncidentSnapshot[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/recovery/snapshots`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getIncidentSnapshot(session: any, snapshotId: number): Promise<IncidentSnapshot> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/recovery/snapshots/${snapshotId}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getFacilityBags(session: any, params?: { stage?: FacilityStage; orderId?: number }): Promise<FacilityBag[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.stage) searchParams.append('stage', params.stage)
+    if (params?.orderId) searchParams.append('order_id', String(params.orderId))
+
+    const url = `${API_BASE_URL}/api/v1/admin/facility/bags${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async scanBagIntake(session: any, request: FacilityIntakeRequest): Promise<FacilityBag> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/facility/intake`, {
+      method: 'POST',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updateBagStage(session: any, bagCode: string, stage: FacilityStage): Promise<FacilityBag> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/facility/bags/${encodeURIComponent(bagCode)}/stage`, {
+      method: 'PUT',
+      body: JSON.stringify({ stage }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async recordFacilityWeight(session: any, bagCode: string, weight: number): Promise<BagWeightResult> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/facility/bags/${encodeURIComponent(bagCode)}/weight`, {
+      method: 'PUT',
+      body: JSON.stringify({ weight }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async markOrderReady(session: any, orderId: number, notes?: string): Promise<Order> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/facility/orders/${orderId}/ready`, {
+      method: 'POST',
+      body: JSON.stringify({ notes }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updateUserRole(session: any, userId: number, role: string): Promise<{ message: string }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/users/${userId}/role`, {
+      method: 'PUT',
+      body: JSON.stringify({ role }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async createUser(session: any, userData: { first_name: string, last_name: string, email: string, phone?: string, role: string, status: string }): Promise<User> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/users`, {
+      method: 'POST',
+      body: JSON.stringify(userData),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updateUser(session: any, userId: number, userData: { first_name: string, last_name: string, email: string, phone?: string, role: string, status: string }): Promise<User & { changes: FieldChange[] }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/users/${userId}`, {
+      method: 'PUT',
+      body: JSON.stringify(userData),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async deleteUser(session: any, userId: number): Promise<{ message: string }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/users/${userId}`, {
+      method: 'DELETE',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getCustomerTimeline(session: any, userId: number, params?: { kinds?: TimelineEvent['kind'][], before?: string, limit?: number }): Promise<CustomerTimeline> {
+    const searchParams = new URLSearchParams()
+    if (params?.kinds?.length) searchParams.append('kinds', params.kinds.join(','))
+    if (params?.before) searchParams.append('before', params.before)
+    if (params?.limit) searchParams.append('limit', params.limit.toString())
+
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/users/${userId}/timeline?${searchParams}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getAuditLog(session: any, params?: { actor_id?: number, target_type?: string, target_id?: string, action?: string, outcome?: 'success' | 'failure', from?: string, to?: string, before_id?: number, limit?: number }): Promise<{ entries: AuditLogEntry[], next_before_id?: number }> {
+    const searchParams = new URLSearchParams()
+    Object.entries(params ?? {}).forEach(([key, value]) => {
+      if (value !== undefined && value !== '') searchParams.append(key, String(value))
+    })
+
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/audit-log?${searchParams}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getSlotPriceRules(session: any): Promise<SlotPriceRule[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/slot-pricing`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async createSlotPriceRule(session: any, rule: Omit<SlotPriceRule, 'id'>): Promise<SlotPriceRule> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/slot-pricing`, {
+      method: 'POST',
+      body: JSON.stringify(rule),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updateSlotPriceRule(session: any, id: number, rule: Omit<SlotPriceRule, 'id'>): Promise<SlotPriceRule> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/slot-pricing/${id}`, {
+      method: 'PUT',
+      body: JSON.stringify(rule),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async deleteSlotPriceRule(session: any, id: number): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/slot-pricing/${id}`, {
+      method: 'DELETE',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+
+  async getSlotCapacities(session: any): Promise<SlotCapacity[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/slot-capacities`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async createSlotCapacity(session: any, capacity: Omit<SlotCapacity, 'id'>): Promise<SlotCapacity> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/slot-capacities`, {
+      method: 'POST',
+      body: JSON.stringify(capacity),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updateSlotCapacity(session: any, id: number, capacity: Omit<SlotCapacity, 'id'>): Promise<SlotCapacity> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/slot-capacities/${id}`, {
+      method: 'PUT',
+      body: JSON.stringify(capacity),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async deleteSlotCapacity(session: any, id: number): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/slot-capacities/${id}`, {
+      method: 'DELETE',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+
+  async getAdminPickupLocations(session: any): Promise<PickupLocation[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/pickup-locations`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async createPickupLocation(session: any, location: PickupLocationRequest): Promise<PickupLocation> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/pickup-locations`, {
+      method: 'POST',
+      body: JSON.stringify(location),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updatePickupLocation(session: any, id: number, location: PickupLocationRequest): Promise<PickupLocation> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/pickup-locations/${id}`, {
+      method: 'PUT',
+      body: JSON.stringify(location),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async deletePickupLocation(session: any, id: number): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/pickup-locations/${id}`, {
+      method: 'DELETE',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+
+  // Records a customer collecting their order with its access code
+  async collectFromLocker(session: any, locationId: number, accessCode: string): Promise<LockerReservation> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/pickup-locations/${locationId}/collect`, {
+      method: 'POST',
+      body: JSON.stringify({ access_code: accessCode }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getServiceZones(session: any): Promise<ServiceZone[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/service-zones`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async createServiceZone(session: any, zone: { name: string; surcharge: number }): Promise<ServiceZone> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/service-zones`, {
+      method: 'POST',
+      body: JSON.stringify(zone),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updateServiceZone(session: any, id: number, zone: { name: string; surcharge: number }): Promise<ServiceZone> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/service-zones/${id}`, {
+      method: 'PUT',
+      body: JSON.stringify(zone),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async deleteServiceZone(session: any, id: number): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/service-zones/${id}`, {
+      method: 'DELETE',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+
+  async getServiceAreas(session: any, zoneId?: number, market?: string): Promise<ServiceArea[]> {
+    const searchParams = new URLSearchParams()
+    if (zoneId !== undefined) searchParams.append('zone_id', zoneId.toString())
+    if (market) searchParams.append('market', market)
+
+    const url = `${API_BASE_URL}/api/v1/admin/service-areas${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Adds ZIPs to coverage, or moves ones already listed to the zone
+  async setServiceAreas(session: any, request: { zip_codes: string[]; zone_id: number | null; is_active?: boolean }): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/service-areas`, {
+      method: 'POST',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+
+  async deleteServiceArea(session: any, zipCode: string): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/service-areas/${encodeURIComponent(zipCode)}`, {
+      method: 'DELETE',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+
+  async getServiceAreaWaitlist(session: any, zipCode?: string): Promise<WaitlistEntry[]> {
+    const query = zipCode ? `?zip=${encodeURIComponent(zipCode)}` : ''
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/service-areas/waitlist${query}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getDriverPayouts(session: any, params?: { status?: string; driver_id?: number; week?: string }): Promise<DriverPayout[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.status) searchParams.append('status', params.status)
+    if (params?.driver_id) searchParams.append('driver_id', String(params.driver_id))
+    if (params?.week) searchParams.append('week', params.week)
+
+    const url = `${API_BASE_URL}/api/v1/admin/driver-payouts${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Runs payouts for a finished week now; defaults to last week
+  async runDriverPayouts(session: any, weekStart?: string): Promise<DriverPayout[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/driver-payouts/run`, {
+      method: 'POST',
+      body: JSON.stringify(weekStart ? { week_start: weekStart } : {}),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getLedgerTransactions(session: any, params?: { source?: string; account?: string; user_id?: number; order_id?: number; from?: string; to?: string; limit?: number }): Promise<LedgerTransaction[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.source) searchParams.append('source', params.source)
+    if (params?.account) searchParams.append('account', params.account)
+    if (params?.user_id) searchParams.append('user_id', String(params.user_id))
+    if (params?.order_id) searchParams.append('order_id', String(params.order_id))
+    if (params?.from) searchParams.append('from', params.from)
+    if (params?.to) searchParams.append('to', params.to)
+    if (params?.limit) searchParams.append('limit', String(params.limit))
+
+    const url = `${API_BASE_URL}/api/v1/admin/ledger/transactions${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getLedgerBalances(session: any, params?: { from?: string; to?: string }): Promise<TrialBalance> {
+    const searchParams = new URLSearchParams()
+    if (params?.from) searchParams.append('from', params.from)
+    if (params?.to) searchParams.append('to', params.to)
+
+    const url = `${API_BASE_URL}/api/v1/admin/ledger/balances${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async checkLedger(session: any): Promise<LedgerCheck> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/ledger/check`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getBagPricing(session: any, market?: string): Promise<BagPricing[]> {
+    const query = market ? `?market=${encodeURIComponent(market)}` : ''
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/bag-pricing${query}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async createBagPricing(session: any, pricing: Omit<BagPricing, 'id' | 'service_name'>): Promise<BagPricing> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/bag-pricing`, {
+      method: 'POST',
+      body: JSON.stringify(pricing),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updateBagPricing(session: any, id: number, pricing: Omit<BagPricing, 'id' | 'service_name'>): Promise<BagPricing> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/bag-pricing/${id}`, {
+      method: 'PUT',
+      body: JSON.stringify(pricing),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async deleteBagPricing(session: any, id: number): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/bag-pricing/${id}`, {
+      method: 'DELETE',
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+
+  async getProofOfDelivery(session: any, orderId: number): Promise<ProofOfDelivery> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/${orderId}/proof-of-delivery`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Support can read and reply in any order's chat, including closed ones
+  getOrderMessages(session: any, orderId: number, after?: number): Promise<OrderConversation> {
+    return getOrderMessages(session, 'admin/orders', orderId, after)
+  },
+
+  sendOrderMessage(session: any, orderId: number, body: string): Promise<OrderMessage> {
+    return sendOrderMessage(session, 'admin/orders', orderId, body)
+  },
+
+  markOrderMessagesRead(session: any, orderId: number, lastReadMessageId?: number): Promise<OrderMessageRead | null> {
+    return markOrderMessagesRead(session, 'admin/orders', orderId, lastReadMessageId)
+  },
+
+  async getConversations(session: any, params?: { awaiting_reply?: boolean; limit?: number }): Promise<ConversationSummary[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.awaiting_reply) searchParams.append('awaiting_reply', 'true')
+    if (params?.limit) searchParams.append('limit', params.limit.toString())
+
+    const url = `${API_BASE_URL}/api/v1/admin/conversations${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Geocodes new and edited addresses now rather than waiting for the nightly run
+  async runGeocodeBackfill(session: any, options?: { limit?: number; recheck?: boolean }): Promise<GeocodeBackfillRun> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/addresses/geocode-backfill`, {
+      method: 'POST',
+      body: JSON.stringify(options ?? {}),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getGeocodeDrifts(session: any, params?: { reviewed?: boolean; limit?: number }): Promise<AddressGeocodeDrift[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.reviewed !== undefined) searchParams.append('reviewed', String(params.reviewed))
+    if (params?.limit) searchParams.append('limit', params.limit.toString())
+
+    const url = `${API_BASE_URL}/api/v1/admin/addresses/geocode-drift${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async reviewGeocodeDrift(session: any, driftId: number, note?: string): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/addresses/geocode-drift/${driftId}/review`, {
+      method: 'POST',
+      body: JSON.stringify(note ? { note } : {}),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
+
+  async getRouteCloseout(session: any, routeId: number): Promise<RouteCloseoutReport> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/routes/${routeId}/closeout`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getWeatherAdvisories(session: any, params?: { from?: string; to?: string }): Promise<WeatherAdvisory[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.from) searchParams.append('from', params.from)
+    if (params?.to) searchParams.append('to', params.to)
+
+    const url = `${API_BASE_URL}/api/v1/admin/weather/advisories${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async rescheduleWeatherRoutes(session: any, advisoryId: number, newDate: string, routeIds?: number[]): Promise<WeatherRescheduleResponse> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/weather/advisories/${advisoryId}/reschedule`, {
+      method: 'POST',
+      body: JSON.stringify({ new_date: newDate, ...(routeIds?.length ? { route_ids: routeIds } : {}) }),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getFlaggedStopPhotos(session: any, params?: { driver_id?: number; limit?: number }): Promise<FlaggedStopPhoto[]> {
+    const searchParams = new URLSearchParams()
+    if (params?.driver_id) searchParams.append('driver_id', params.driver_id.toString())
+    if (params?.limit) searchParams.append('limit', params.limit.toString())
+
+    const url = `${API_BASE_URL}/api/v1/admin/stop-photos/flagged${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async getRealtimeDeliveryStats(session: any, days?: number): Promise<RealtimeDeliveryStats[]> {
+    const searchParams = new URLSearchParams()
+    if (days) searchParams.append('days', String(days))
+
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/analytics/realtime-deliveries?${searchParams}`)
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -554,11 +3443,8 @@ export const driverApi = {
     return response.json()
   },
 
-  async updateRouteOrderStatus(session: any, routeOrderId: number, request: RouteOrderStatusRequest): Promise<{ message: string }> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/route-orders/status?id=${routeOrderId}`, {
-      method: 'PUT',
-      body: JSON.stringify(request),
-    })
+  async getRealtimePublishFailures(session: any): Promise<RealtimeRetryStats> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/analytics/realtime-publish-failures`)
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -568,41 +3454,25 @@ export const driverApi = {
     return response.json()
   },
 
-  async getCompletedDeliveries(session: any, params?: { period?: string }): Promise<any[]> {
-    const searchParams = new URLSearchParams()
-    if (params?.period) searchParams.append('period', params.period)
-
-    const url = `${API_BASE_URL}/api/v1/driver/routes${searchParams.toString() ? '?' + searchParams.toString() : ''}`
-    const response = await authFetchWithSession(session, url)
+  async setUserSandbox(session: any, userId: number, isSandbox: boolean): Promise<{ user_id: number, is_sandbox: boolean }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/users/${userId}/sandbox`, {
+      method: 'PUT',
+      body: JSON.stringify({ is_sandbox: isSandbox }),
+    })
 
     if (!response.ok) {
       const errorText = await response.text()
       throw new Error(`HTTP ${response.status}: ${errorText}`)
     }
 
-    const routes = await response.json()
-    
-    // Filter to only completed route orders and flatten the data
-    const completedDeliveries: any[] = []
-    routes.forEach((route: any) => {
-      route.orders?.forEach((order: any) => {
-        if (order.status === 'completed') {
-          completedDeliveries.push({
-            ...order,
-            route_id: route.id,
-            route_type: route.route_type,
-            route_date: route.route_date,
-            route_status: route.status
-          })
-        }
-      })
-    })
-
-    return completedDeliveries
+    return response.json()
   },
 
-  async getEarnings(session: any): Promise<EarningsData> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/driver/earnings`)
+  async purgeSandboxData(session: any, userId?: number): Promise<SandboxPurgeResult> {
+    const query = userId ? `?user_id=${userId}` : ''
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/sandbox/purge${query}`, {
+      method: 'POST',
+    })
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -612,12 +3482,8 @@ export const driverApi = {
     return response.json()
   },
 
-  async getEarningsHistory(session: any, params?: { period?: string }): Promise<EarningsHistory[]> {
-    const searchParams = new URLSearchParams()
-    if (params?.period) searchParams.append('period', params.period)
-
-    const url = `${API_BASE_URL}/api/v1/driver/earnings/history${searchParams.toString() ? '?' + searchParams.toString() : ''}`
-    const response = await authFetchWithSession(session, url)
+  async getPermissions(session: any): Promise<Permission[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/permissions`)
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -625,109 +3491,65 @@ export const driverApi = {
     }
 
     return response.json()
-  }
-}
+  },
 
-export interface AdminOrder extends Order {
-  user_email: string
-  user_name: string
-  route_id?: number
-  route_type?: string
-  driver_name?: string
-  driver_id?: number
-  is_assigned: boolean
-}
+  async getRoles(session: any): Promise<Role[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/roles`)
 
-export interface RouteAssignmentRequest {
-  driver_id: number
-  order_ids: number[]
-  route_date: string
-  route_type: 'pickup' | 'delivery'
-}
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
 
-export interface BulkStatusUpdateRequest {
-  order_ids: number[]
-  status: string
-  notes?: string
-}
+    return response.json()
+  },
 
-export interface BulkStatusUpdateResponse {
-  message: string
-  updated_count: number
-  total_orders: number
-}
+  async createRole(session: any, role: { name: string, description?: string, permissions: string[] }): Promise<Role> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/roles`, {
+      method: 'POST',
+      body: JSON.stringify(role),
+    })
 
-export interface OptimizationSuggestionsRequest {
-  order_ids: number[]
-}
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
 
-export interface OrderLocation {
-  id: number
-  pickup_date: string
-  pickup_time_slot: string
-  delivery_date: string
-  delivery_time_slot: string
-  pickup_address: string
-  pickup_city: string
-  pickup_zip: string
-  delivery_address: string
-  delivery_city: string
-  delivery_zip: string
-  customer_name: string
-}
+    return response.json()
+  },
 
-export interface OptimizationSuggestion {
-  type: string
-  message: string
-  groups: { [key: string]: number[] }
-}
+  async updateRole(session: any, name: string, role: { description?: string, permissions: string[] }): Promise<Role> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/roles/${name}`, {
+      method: 'PUT',
+      body: JSON.stringify(role),
+    })
 
-export interface OptimizationSuggestionsResponse {
-  orders: OrderLocation[]
-  suggestions: OptimizationSuggestion[]
-  total_orders: number
-}
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
 
-export interface OrderResolution {
-  id: number
-  order_id: number
-  resolved_by: number
-  resolution_type: 'reschedule' | 'partial_refund' | 'full_refund' | 'credit' | 'waive_fee'
-  reschedule_date?: string
-  refund_amount?: number
-  credit_amount?: number
-  notes: string
-  created_at: string
-}
+    return response.json()
+  },
 
-export interface CreateOrderResolutionRequest {
-  order_id: number
-  resolution_type: 'reschedule' | 'partial_refund' | 'full_refund' | 'credit' | 'waive_fee'
-  reschedule_date?: string
-  refund_amount?: number
-  credit_amount?: number
-  notes: string
-}
+  async deleteRole(session: any, name: string): Promise<void> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/roles/${name}`, {
+      method: 'DELETE',
+    })
 
-export interface DriverStats {
-  driver_id: number
-  driver_name: string
-  total_deliveries: number
-  today_deliveries: number
-  avg_delivery_time_minutes: number
-  rating: number
-}
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+  },
 
-export interface RevenueAnalytics {
-  date: string
-  revenue: number
-  order_count: number
-  average_order_value: number
-}
+  async getRevenueAnalytics(session: any, period?: 'day' | 'week' | 'month', market?: string): Promise<RevenueAnalytics[]> {
+    const searchParams = new URLSearchParams()
+    if (period) searchParams.append('period', period)
+    if (market) searchParams.append('market', market)
 
-export const adminApi = {
-  async getOrdersSummary(session: any): Promise<any> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/summary`)
+    const url = `${API_BASE_URL}/api/v1/admin/analytics/revenue${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const response = await authFetchWithSession(session, url)
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -737,15 +3559,11 @@ export const adminApi = {
     return response.json()
   },
 
-  async getAllOrders(session: any, params?: { status?: string, date?: string, user_id?: string, limit?: number, offset?: number }): Promise<AdminOrder[]> {
+  async getTrialAnalytics(session: any, months?: number): Promise<TrialAnalytics> {
     const searchParams = new URLSearchParams()
-    if (params?.status) searchParams.append('status', params.status)
-    if (params?.date) searchParams.append('date', params.date)
-    if (params?.user_id) searchParams.append('user_id', params.user_id)
-    if (params?.limit) searchParams.append('limit', params.limit.toString())
-    if (params?.offset) searchParams.append('offset', params.offset.toString())
+    if (months) searchParams.append('months', months.toString())
 
-    const url = `${API_BASE_URL}/api/v1/admin/orders${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const url = `${API_BASE_URL}/api/v1/admin/analytics/trials${searchParams.toString() ? '?' + searchParams.toString() : ''}`
     const response = await authFetchWithSession(session, url)
 
     if (!response.ok) {
@@ -756,14 +3574,11 @@ export const adminApi = {
     return response.json()
   },
 
-  async getUsers(session: any, params?: { role?: string, search?: string, limit?: number, offset?: number }): Promise<User[]> {
+  async getMarketAnalytics(session: any, market?: string): Promise<MarketAnalytics[]> {
     const searchParams = new URLSearchParams()
-    if (params?.role) searchParams.append('role', params.role)
-    if (params?.search) searchParams.append('search', params.search)
-    if (params?.limit) searchParams.append('limit', params.limit.toString())
-    if (params?.offset) searchParams.append('offset', params.offset.toString())
+    if (market) searchParams.append('market', market)
 
-    const url = `${API_BASE_URL}/api/v1/admin/users${searchParams.toString() ? '?' + searchParams.toString() : ''}`
+    const url = `${API_BASE_URL}/api/v1/admin/analytics/markets${searchParams.toString() ? '?' + searchParams.toString() : ''}`
     const response = await authFetchWithSession(session, url)
 
     if (!response.ok) {
@@ -774,8 +3589,8 @@ export const adminApi = {
     return response.json()
   },
 
-  async getDriverStats(session: any): Promise<DriverStats[]> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/drivers/stats`)
+  async getOrderReviews(session: any): Promise<HeldOrder[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/reviews`)
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -785,10 +3600,10 @@ export const adminApi = {
     return response.json()
   },
 
-  async assignDriverToRoute(session: any, request: RouteAssignmentRequest): Promise<{ message: string, route_id: number }> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/routes/assign`, {
+  async approveOrderReview(session: any, orderId: number, notes?: string): Promise<{ order_id: number; status: string; checkout_url?: string; payment_error?: string }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/${orderId}/review/approve`, {
       method: 'POST',
-      body: JSON.stringify(request),
+      body: JSON.stringify({ notes: notes ?? '' }),
     })
 
     if (!response.ok) {
@@ -799,10 +3614,10 @@ export const adminApi = {
     return response.json()
   },
 
-  async updateUserRole(session: any, userId: number, role: string): Promise<{ message: string }> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/users/${userId}/role`, {
-      method: 'PUT',
-      body: JSON.stringify({ role }),
+  async rejectOrderReview(session: any, orderId: number, notes: string): Promise<{ order_id: number; status: string; credits_returned: number }> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/${orderId}/review/reject`, {
+      method: 'POST',
+      body: JSON.stringify({ notes }),
     })
 
     if (!response.ok) {
@@ -813,11 +3628,8 @@ export const adminApi = {
     return response.json()
   },
 
-  async createUser(session: any, userData: { first_name: string, last_name: string, email: string, phone?: string, role: string, status: string }): Promise<User> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/users`, {
-      method: 'POST',
-      body: JSON.stringify(userData),
-    })
+  async getBookingDraft(session: any, token: string): Promise<BookingDraft> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/booking-drafts/${encodeURIComponent(token)}`)
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -827,11 +3639,8 @@ export const adminApi = {
     return response.json()
   },
 
-  async updateUser(session: any, userId: number, userData: { first_name: string, last_name: string, email: string, phone?: string, role: string, status: string }): Promise<User> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/users/${userId}`, {
-      method: 'PUT',
-      body: JSON.stringify(userData),
-    })
+  async getWidgetKeys(session: any): Promise<WidgetKey[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/widget-keys`)
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -841,9 +3650,10 @@ export const adminApi = {
     return response.json()
   },
 
-  async deleteUser(session: any, userId: number): Promise<{ message: string }> {
-    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/users/${userId}`, {
-      method: 'DELETE',
+  async createWidgetKey(session: any, request: { name: string; allowed_origins: string[] }): Promise<WidgetKey> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/widget-keys`, {
+      method: 'POST',
+      body: JSON.stringify(request),
     })
 
     if (!response.ok) {
@@ -854,12 +3664,25 @@ export const adminApi = {
     return response.json()
   },
 
-  async getRevenueAnalytics(session: any, period?: 'day' | 'week' | 'month'): Promise<RevenueAnalytics[]> {
-    const searchParams = new URLSearchParams()
-    if (period) searchParams.append('period', period)
+  async updateWidgetKey(session: any, keyId: number, request: { name: string; allowed_origins: string[]; is_active?: boolean }): Promise<WidgetKey> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/widget-keys/${keyId}`, {
+      method: 'PUT',
+      body: JSON.stringify(request),
+    })
 
-    const url = `${API_BASE_URL}/api/v1/admin/analytics/revenue${searchParams.toString() ? '?' + searchParams.toString() : ''}`
-    const response = await authFetchWithSession(session, url)
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  async updatePlanOffer(session: any, planId: number, request: UpdatePlanOfferRequest): Promise<SubscriptionPlan> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/subscription-plans/${planId}/offer`, {
+      method: 'PUT',
+      body: JSON.stringify(request),
+    })
 
     if (!response.ok) {
       const errorText = await response.text()
@@ -883,6 +3706,22 @@ export const adminApi = {
     return response.json()
   },
 
+  // Runs every action or none; a rejected batch still resolves with the
+  // per-action results so the toolbar can show which one failed
+  async runAdminBatch(session: any, request: AdminBatchRequest): Promise<AdminBatchResponse> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/batch`, {
+      method: 'POST',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok && response.headers.get('Content-Type') !== 'application/json') {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
   async getOptimizationSuggestions(session: any, request: OptimizationSuggestionsRequest): Promise<OptimizationSuggestionsResponse> {
     const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/routes/optimization-suggestions`, {
       method: 'POST',
@@ -897,7 +3736,7 @@ export const adminApi = {
     return response.json()
   },
 
-  async createOrderResolution(session: any, request: CreateOrderResolutionRequest): Promise<OrderResolution> {
+  async createOrderResolution(session: any, request: CreateOrderResolutionRequest): Promise<OrderResolution & { changes: FieldChange[] }> {
     const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/resolution`, {
       method: 'POST',
       body: JSON.stringify(request),
@@ -911,6 +3750,17 @@ export const adminApi = {
     return response.json()
   },
 
+  async getAdminOrder(session: any, orderId: number): Promise<AdminOrderDetail> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/${orderId}`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
   async getOrderResolutions(session: any, orderId: number): Promise<OrderResolution[]> {
     const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/${orderId}/resolutions`)
 
@@ -919,6 +3769,33 @@ export const adminApi = {
       throw new Error(`HTTP ${response.status}: ${errorText}`)
     }
 
+    return response.json()
+  },
+
+  async getOrderRefunds(session: any, orderId: number): Promise<Refund[]> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/${orderId}/refunds`)
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
+    return response.json()
+  },
+
+  // Leave amount out to refund everything left on the order's payment
+  // Refunds an amount, or one line of the order at the price it was sold for
+  async createRefund(session: any, orderId: number, request: { amount?: number; reason: string; line_kind?: PricedLine['kind']; line_id?: number; quantity?: number }): Promise<Refund> {
+    const response = await authFetchWithSession(session, `${API_BASE_URL}/api/v1/admin/orders/${orderId}/refunds`, {
+      method: 'POST',
+      body: JSON.stringify(request),
+    })
+
+    if (!response.ok) {
+      const errorText = await response.text()
+      throw new Error(`HTTP ${response.status}: ${errorText}`)
+    }
+
     return response.json()
   }
 }
\ No newline at end of file
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxDeactivationReasonLength = 500
+
+// AccountDeactivationHandler lets customers pause their whole account and
+// come back later. Nothing is cancelled or deleted: active subscriptions are
+// paused, auto-scheduling and marketing notifications stop, and signing in
+// again offers to undo it all.
+type AccountDeactivationHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewAccountDeactivationHandler(db *sql.DB) *AccountDeactivationHandler {
+	return &AccountDeactivationHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type DeactivateAccountRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// AccountStatus is where a customer's account stands after deactivating or
+// reactivating it
+type AccountStatus struct {
+	Deactivated   bool       `json:"deactivated"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	// Subscriptions paused or resumed by this change
+	Subscriptions []int `json:"subscriptions"`
+	// Orders already booked keep going ahead; the customer can cancel them
+	UpcomingOrders int `json:"upcoming_orders"`
+}
+
+// notDeactivated is a SQL condition that's true when the account in
+// userColumn hasn't been deactivated by its owner. Auto-scheduling and
+// marketing notifications AND it into their WHERE clauses.
+func notDeactivated(userColumn string) string {
+	return "NOT EXISTS (SELECT 1 FROM users du WHERE du.id = " + userColumn + " AND du.deactivated_at IS NOT NULL)"
+}
+
+func countUpcomingOrders(q queryRower, userID int) (int, error) {
+	var count int
+	err := q.QueryRow(`
+		SELECT COUNT(*) FROM orders
+		WHERE user_id = $1 AND status NOT IN ('delivered', 'cancelled')`,
+		userID,
+	).Scan(&count)
+	return count, err
+}
+
+// handleDeactivateAccount pauses the signed-in customer's account
+func (h *AccountDeactivationHandler) handleDeactivateAccount(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req DeactivateAccountRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if len(req.Reason) > maxDeactivationReasonLength {
+		http.Error(w, "reason is too long", http.StatusBadRequest)
+		return
+	}
+	var reason *string
+	if req.Reason != "" {
+		reason = &req.Reason
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to deactivate account", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	status := AccountStatus{Deactivated: true, Subscriptions: []int{}}
+	err = tx.QueryRow(`
+		UPDATE users SET deactivated_at = CURRENT_TIMESTAMP, deactivation_reason = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND deactivated_at IS NULL
+		RETURNING deactivated_at`,
+		userID, reason,
+	).Scan(&status.DeactivatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Account is already deactivated", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to deactivate account", http.StatusInternalServerError)
+		return
+	}
+
+	if status.Subscriptions, err = setDeactivationPause(tx, userID, true); err != nil {
+		http.Error(w, "Failed to pause subscriptions", http.StatusInternalServerError)
+		return
+	}
+	if status.UpcomingOrders, err = countUpcomingOrders(tx, userID); err != nil {
+		http.Error(w, "Failed to deactivate account", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to deactivate account", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d deactivated their account, pausing %d subscriptions", userID, len(status.Subscriptions))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleReactivateAccount undoes a deactivation. The app calls it once a
+// deactivated customer signs in and confirms they're back.
+func (h *AccountDeactivationHandler) handleReactivateAccount(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to reactivate account", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users SET deactivated_at = NULL, deactivation_reason = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND deactivated_at IS NOT NULL`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to reactivate account", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Account is not deactivated", http.StatusConflict)
+		return
+	}
+
+	status := AccountStatus{}
+	if status.Subscriptions, err = setDeactivationPause(tx, userID, false); err != nil {
+		http.Error(w, "Failed to resume subscriptions", http.StatusInternalServerError)
+		return
+	}
+	if status.UpcomingOrders, err = countUpcomingOrders(tx, userID); err != nil {
+		http.Error(w, "Failed to reactivate account", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to reactivate account", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d reactivated their account, resuming %d subscriptions", userID, len(status.Subscriptions))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// setDeactivationPause pauses a customer's active subscriptions, or resumes
+// the ones a deactivation paused, recording each in the pause history. It
+// returns the subscriptions it changed.
+func setDeactivationPause(tx *sql.Tx, userID int, pause bool) ([]int, error) {
+	from, to := "paused", "active"
+	query := `
+		UPDATE subscriptions SET status = 'active', paused_by_deactivation = false, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND status = 'paused' AND paused_by_deactivation
+		RETURNING id`
+	if pause {
+		from, to = "active", "paused"
+		query = `
+			UPDATE subscriptions SET status = 'paused', paused_by_deactivation = true, updated_at = CURRENT_TIMESTAMP
+			WHERE user_id = $1 AND status = 'active'
+			RETURNING id`
+	}
+	rows, err := tx.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if err := recordSubscriptionStatusChange(tx, id, from, to); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
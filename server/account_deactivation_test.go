@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccountDeactivation(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUserWithPassword(t, "pause-me@example.com", "Pause", "Me", "password123")
+	addressID := db.CreateTestAddress(t, userID)
+	planID := db.GetPlanID(t, "Family Fresh")
+	activeID := db.CreateTestSubscription(t, userID, planID)
+	// A subscription the customer paused themselves stays paused after reactivating
+	pausedID := db.CreateTestSubscription(t, userID, planID)
+	db.Exec("UPDATE subscriptions SET status = 'paused' WHERE id = $1", pausedID)
+	db.Exec(`
+		INSERT INTO subscription_preferences (user_id, default_pickup_address_id, default_delivery_address_id, preferred_pickup_day, auto_schedule_enabled)
+		VALUES ($1, $2, $2, 'wednesday', true)`,
+		userID, addressID,
+	)
+	db.CreateTestOrder(t, userID, addressID)
+
+	handler := NewAccountDeactivationHandler(db.DB)
+	handler.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+	call := func(fn http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		fn(w, httptest.NewRequest("POST", "/api/v1/account", strings.NewReader(body)))
+		return w
+	}
+	subscriptionStatus := func(id int) string {
+		var status string
+		db.QueryRow("SELECT status FROM subscriptions WHERE id = $1", id).Scan(&status)
+		return status
+	}
+	scheduler := &AutoScheduler{db: db.DB}
+	scheduled := func() bool {
+		users, err := scheduler.getScheduleableUsers()
+		if err != nil {
+			t.Fatalf("Failed to get scheduleable users: %v", err)
+		}
+		for _, u := range users {
+			if u.UserID == userID {
+				return true
+			}
+		}
+		return false
+	}
+
+	if w := call(handler.handleReactivateAccount, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d reactivating an active account, got %d", http.StatusConflict, w.Code)
+	}
+
+	w := call(handler.handleDeactivateAccount, `{"reason": "Travelling for the summer"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var status AccountStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if !status.Deactivated || len(status.Subscriptions) != 1 || status.Subscriptions[0] != activeID || status.UpcomingOrders != 1 {
+		t.Errorf("Expected the active subscription paused and one upcoming order, got %s", w.Body.String())
+	}
+	if subscriptionStatus(activeID) != "paused" || scheduled() {
+		t.Error("Expected the subscription paused and auto-scheduling stopped")
+	}
+	if w := call(handler.handleDeactivateAccount, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d deactivating twice, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Signing in still works and asks the customer to confirm reactivating
+	body, _ := json.Marshal(LoginRequest{Email: "pause-me@example.com", Password: "password123"})
+	w = httptest.NewRecorder()
+	NewAuthHandler(db.DB).handleLogin(w, httptest.NewRequest("POST", "/api/v1/auth/login", bytes.NewBuffer(body)))
+	var login AuthResponse
+	json.Unmarshal(w.Body.Bytes(), &login)
+	if w.Code != http.StatusOK || !login.ReactivationRequired || login.User.DeactivatedAt == nil {
+		t.Errorf("Expected a login asking for reactivation, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = call(handler.handleReactivateAccount, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.Deactivated || len(status.Subscriptions) != 1 || status.Subscriptions[0] != activeID {
+		t.Errorf("Expected only the subscription deactivation paused to resume, got %s", w.Body.String())
+	}
+	if subscriptionStatus(activeID) != "active" || subscriptionStatus(pausedID) != "paused" || !scheduled() {
+		t.Error("Expected the account back to how it was before deactivating")
+	}
+
+	var pauses int
+	db.QueryRow("SELECT COUNT(*) FROM subscription_pauses WHERE subscription_id = $1 AND resumed_at IS NOT NULL", activeID).Scan(&pauses)
+	if pauses != 1 {
+		t.Errorf("Expected the deactivation in the pause history, got %d closed pauses", pauses)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// AccountHistoryHandler exposes the change history of customer addresses and
+// profile fields, so disputes can be settled from what the data actually was
+type AccountHistoryHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewAccountHistoryHandler(db *sql.DB) *AccountHistoryHandler {
+	return &AccountHistoryHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type AccountChange struct {
+	ID            int             `json:"id"`
+	EntityType    string          `json:"entity_type"` // address or profile
+	EntityID      int             `json:"entity_id"`
+	ChangeType    string          `json:"change_type"` // created, updated or deleted
+	ChangedFields []string        `json:"changed_fields"`
+	Before        json.RawMessage `json:"before,omitempty"`
+	After         json.RawMessage `json:"after,omitempty"`
+	ChangedBy     *int            `json:"changed_by,omitempty"`
+	EditedBy      string          `json:"edited_by"` // you, support, other or system
+	EditorName    *string         `json:"editor_name,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+type queryRower interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}
+
+type execer interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}
+
+type queryer interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}
+
+// Snapshots hold only the fields customers care about, so history diffs stay readable
+const (
+	addressSnapshotQuery = `
+		SELECT row_to_json(a) FROM (
+			SELECT type, street_address, city, state, zip_code, delivery_instructions, is_default
+			FROM addresses WHERE id = $1
+		) a`
+	profileSnapshotQuery = `
+		SELECT row_to_json(u) FROM (
+			SELECT email, first_name, last_name, phone, role, status
+			FROM users WHERE id = $1
+		) u`
+)
+
+// snapshotAddress returns the current tracked fields of an address, or nil if
+// it doesn't exist
+func snapshotAddress(q queryRower, addressID int) (json.RawMessage, error) {
+	return snapshotRow(q, addressSnapshotQuery, addressID)
+}
+
+// snapshotProfile returns the current tracked profile fields of a user
+func snapshotProfile(q queryRower, userID int) (json.RawMessage, error) {
+	return snapshotRow(q, profileSnapshotQuery, userID)
+}
+
+func snapshotRow(q queryRower, query string, id int) (json.RawMessage, error) {
+	var data []byte
+	err := q.QueryRow(query, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+// FieldChange is one top-level field that differs between two snapshots
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// fieldChanges diffs two snapshots field by field, sorted by field. A field
+// missing from one side is reported as null there.
+func fieldChanges(before, after json.RawMessage) []FieldChange {
+	var beforeFields, afterFields map[string]interface{}
+	if len(before) > 0 {
+		json.Unmarshal(before, &beforeFields)
+	}
+	if len(after) > 0 {
+		json.Unmarshal(after, &afterFields)
+	}
+
+	seen := map[string]bool{}
+	changes := []FieldChange{}
+	for _, m := range []map[string]interface{}{beforeFields, afterFields} {
+		for field := range m {
+			if seen[field] {
+				continue
+			}
+			seen[field] = true
+			if !reflect.DeepEqual(beforeFields[field], afterFields[field]) {
+				changes = append(changes, FieldChange{Field: field, Old: beforeFields[field], New: afterFields[field]})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// changedFields lists the top-level fields that differ between two snapshots
+func changedFields(before, after json.RawMessage) []string {
+	fields := []string{}
+	for _, c := range fieldChanges(before, after) {
+		fields = append(fields, c.Field)
+	}
+	return fields
+}
+
+// recordAccountChange stores a version of an address or profile. Updates
+// that didn't change any tracked field aren't recorded.
+func recordAccountChange(q execer, userID, editorID int, entityType string, entityID int, before, after json.RawMessage) error {
+	changeType := "updated"
+	switch {
+	case before == nil && after == nil:
+		return nil
+	case before == nil:
+		changeType = "created"
+	case after == nil:
+		changeType = "deleted"
+	}
+
+	fields := changedFields(before, after)
+	if changeType == "updated" && len(fields) == 0 {
+		return nil
+	}
+
+	var beforeData, afterData interface{}
+	if before != nil {
+		beforeData = []byte(before)
+	}
+	if after != nil {
+		afterData = []byte(after)
+	}
+
+	_, err := q.Exec(`
+		INSERT INTO account_change_history
+			(user_id, entity_type, entity_id, change_type, changed_fields, before_data, after_data, changed_by, changed_by_role)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, (SELECT role FROM users WHERE id = $8))`,
+		userID, entityType, entityID, changeType, pq.Array(fields), beforeData, afterData, editorID,
+	)
+	return err
+}
+
+// updateTrackedProfile runs an update to a user's profile fields and
+// records the change in their history in the same transaction
+func updateTrackedProfile(db *sql.DB, userID, editorID int, update string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := snapshotProfile(tx, userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(update, args...); err != nil {
+		return err
+	}
+	after, err := snapshotProfile(tx, userID)
+	if err != nil {
+		return err
+	}
+	if err := recordAccountChange(tx, userID, editorID, "profile", userID, before, after); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// editedByLabel describes who made a change from the account owner's point
+// of view. Staff names aren't shown to customers.
+func editedByLabel(ownerID int, changedBy *int, role sql.NullString) string {
+	switch {
+	case changedBy == nil:
+		return "system"
+	case *changedBy == ownerID:
+		return "you"
+	case role.Valid && role.String != "customer" && role.String != "driver":
+		return "support"
+	default:
+		return "other"
+	}
+}
+
+func (h *AccountHistoryHandler) queryHistory(ownerID int, where string, args []interface{}, includeEditorNames bool) ([]AccountChange, error) {
+	rows, err := h.db.Query(`
+		SELECT h.id, h.entity_type, h.entity_id, h.change_type, h.changed_fields,
+		       h.before_data, h.after_data, h.changed_by, h.changed_by_role,
+		       u.first_name || ' ' || u.last_name, h.created_at
+		FROM account_change_history h
+		LEFT JOIN users u ON h.changed_by = u.id
+		WHERE `+where+`
+		ORDER BY h.created_at DESC, h.id DESC
+		LIMIT 200`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []AccountChange{}
+	for rows.Next() {
+		var c AccountChange
+		var before, after []byte
+		var role, editorName sql.NullString
+		err := rows.Scan(&c.ID, &c.EntityType, &c.EntityID, &c.ChangeType, pq.Array(&c.ChangedFields),
+			&before, &after, &c.ChangedBy, &role, &editorName, &c.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if before != nil {
+			c.Before = json.RawMessage(before)
+		}
+		if after != nil {
+			c.After = json.RawMessage(after)
+		}
+		c.EditedBy = editedByLabel(ownerID, c.ChangedBy, role)
+		if includeEditorNames && editorName.Valid {
+			c.EditorName = &editorName.String
+		} else if c.EditedBy == "support" {
+			c.ChangedBy = nil
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// handleGetAccountHistory returns the change history of the user's own
+// addresses and profile (?entity_type= and ?entity_id= filter it)
+func (h *AccountHistoryHandler) handleGetAccountHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	where, args, ok := historyFilters(w, r, userID)
+	if !ok {
+		return
+	}
+
+	changes, err := h.queryHistory(userID, where, args, false)
+	if err != nil {
+		http.Error(w, "Failed to fetch account history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+// historyFilters builds the WHERE clause shared by the customer and admin views
+func historyFilters(w http.ResponseWriter, r *http.Request, userID int) (string, []interface{}, bool) {
+	where := "h.user_id = $1"
+	args := []interface{}{userID}
+
+	if entityType := r.URL.Query().Get("entity_type"); entityType != "" {
+		if entityType != "address" && entityType != "profile" {
+			http.Error(w, "entity_type must be address or profile", http.StatusBadRequest)
+			return "", nil, false
+		}
+		args = append(args, entityType)
+		where += " AND h.entity_type = $" + strconv.Itoa(len(args))
+	}
+	if entityIDStr := r.URL.Query().Get("entity_id"); entityIDStr != "" {
+		entityID, err := strconv.Atoi(entityIDStr)
+		if err != nil {
+			http.Error(w, "Invalid entity_id", http.StatusBadRequest)
+			return "", nil, false
+		}
+		args = append(args, entityID)
+		where += " AND h.entity_id = $" + strconv.Itoa(len(args))
+	}
+	return where, args, true
+}
+
+// handleAdminGetUserHistory returns a customer's change history with editor names
+func (h *AccountHistoryHandler) handleAdminGetUserHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	where, args, ok := historyFilters(w, r, userID)
+	if !ok {
+		return
+	}
+
+	changes, err := h.queryHistory(userID, where, args, true)
+	if err != nil {
+		http.Error(w, "Failed to fetch account history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+// addressAsOf reconstructs an address as it was at a point in time from its
+// history. Addresses with no recorded changes are returned as they are now.
+func addressAsOf(db *sql.DB, addressID int, at time.Time) (json.RawMessage, error) {
+	var data []byte
+	err := db.QueryRow(`
+		SELECT after_data FROM account_change_history
+		WHERE entity_type = 'address' AND entity_id = $1 AND created_at <= $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1`,
+		addressID, at,
+	).Scan(&data)
+	if err == nil {
+		return json.RawMessage(data), nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// Nothing recorded yet at that time, so the first later change shows what it was
+	err = db.QueryRow(`
+		SELECT before_data FROM account_change_history
+		WHERE entity_type = 'address' AND entity_id = $1 AND created_at > $2
+		ORDER BY created_at, id
+		LIMIT 1`,
+		addressID, at,
+	).Scan(&data)
+	if err == nil {
+		return json.RawMessage(data), nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return snapshotAddress(db, addressID)
+}
+
+type OrderAddressVersions struct {
+	AddressID      int             `json:"address_id"`
+	AtOrderCreated json.RawMessage `json:"at_order_created"`
+	AtStop         json.RawMessage `json:"at_stop,omitempty"` // When the driver completed or failed the stop
+	Current        json.RawMessage `json:"current"`
+}
+
+// handleAdminGetOrderAddressHistory shows the pickup and delivery addresses
+// of an order as they were when it was placed and when the driver arrived,
+// along with every change made to them since the order was created
+func (h *AccountHistoryHandler) handleAdminGetOrderAddressHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var userID, pickupAddressID, deliveryAddressID int
+	var createdAt time.Time
+	err = h.db.QueryRow(`
+		SELECT user_id, pickup_address_id, delivery_address_id, created_at
+		FROM orders WHERE id = $1`,
+		orderID,
+	).Scan(&userID, &pickupAddressID, &deliveryAddressID, &createdAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	versions := func(addressID int, routeType string) (OrderAddressVersions, error) {
+		v := OrderAddressVersions{AddressID: addressID}
+		var err error
+		if v.AtOrderCreated, err = addressAsOf(h.db, addressID, createdAt); err != nil {
+			return v, err
+		}
+		if v.Current, err = snapshotAddress(h.db, addressID); err != nil {
+			return v, err
+		}
+
+		var stopTime time.Time
+		err = h.db.QueryRow(`
+			SELECT ro.actual_time FROM route_orders ro
+			JOIN driver_routes dr ON ro.route_id = dr.id
+			WHERE ro.order_id = $1 AND dr.route_type = $2 AND ro.actual_time IS NOT NULL
+			ORDER BY ro.actual_time DESC
+			LIMIT 1`,
+			orderID, routeType,
+		).Scan(&stopTime)
+		if err == nil {
+			v.AtStop, err = addressAsOf(h.db, addressID, stopTime)
+			return v, err
+		}
+		if err != sql.ErrNoRows {
+			return v, err
+		}
+		return v, nil
+	}
+
+	pickup, err := versions(pickupAddressID, "pickup")
+	if err != nil {
+		http.Error(w, "Failed to reconstruct address history", http.StatusInternalServerError)
+		return
+	}
+	delivery, err := versions(deliveryAddressID, "delivery")
+	if err != nil {
+		http.Error(w, "Failed to reconstruct address history", http.StatusInternalServerError)
+		return
+	}
+
+	changes, err := h.queryHistory(userID,
+		"h.entity_type = 'address' AND h.entity_id = ANY($1) AND h.created_at >= $2",
+		[]interface{}{pq.Array([]int{pickupAddressID, deliveryAddressID}), createdAt}, true)
+	if err != nil {
+		http.Error(w, "Failed to fetch address history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id":         orderID,
+		"order_created_at": createdAt,
+		"pickup_address":   pickup,
+		"delivery_address": delivery,
+		"changes":          changes,
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestChangedFields(t *testing.T) {
+	before := json.RawMessage(`{"street_address":"1 Old St","city":"Springfield","is_default":true,"delivery_instructions":null}`)
+	after := json.RawMessage(`{"street_address":"2 New Ave","city":"Springfield","is_default":true,"delivery_instructions":"Side door"}`)
+
+	fields := changedFields(before, after)
+	expected := []string{"delivery_instructions", "street_address"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %v, got %v", expected, fields)
+	}
+
+	if fields := changedFields(before, before); len(fields) != 0 {
+		t.Errorf("Expected no changes, got %v", fields)
+	}
+	if fields := changedFields(nil, after); len(fields) != 4 {
+		t.Errorf("Expected every field to be new on create, got %v", fields)
+	}
+}
+
+func TestFieldChanges(t *testing.T) {
+	before := json.RawMessage(`{"status":"failed","pickup_date":"2024-03-01","total_cents":4500}`)
+	after := json.RawMessage(`{"status":"scheduled","pickup_date":"2024-03-04","total_cents":4500}`)
+
+	changes := fieldChanges(before, after)
+	expected := []FieldChange{
+		{Field: "pickup_date", Old: "2024-03-01", New: "2024-03-04"},
+		{Field: "status", Old: "failed", New: "scheduled"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, changes)
+	}
+
+	// Fields only on one side are reported against null
+	changes = fieldChanges(json.RawMessage(`{"phone":"555-0100"}`), json.RawMessage(`{}`))
+	if len(changes) != 1 || changes[0].Old != "555-0100" || changes[0].New != nil {
+		t.Errorf("Expected the removed phone, got %+v", changes)
+	}
+}
+
+func TestEditedByLabel(t *testing.T) {
+	owner, admin := 1, 2
+	if label := editedByLabel(owner, &owner, sql.NullString{String: "customer", Valid: true}); label != "you" {
+		t.Errorf("Expected you, got %s", label)
+	}
+	if label := editedByLabel(owner, &admin, sql.NullString{String: "admin", Valid: true}); label != "support" {
+		t.Errorf("Expected support, got %s", label)
+	}
+	if label := editedByLabel(owner, nil, sql.NullString{}); label != "system" {
+		t.Errorf("Expected system, got %s", label)
+	}
+}
+
+func TestAccountHistory_AddressVersions(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "history@example.com", "History", "User")
+
+	addresses := &AddressHandler{
+		db: db.DB,
+		getUserID: func(r *http.Request, db *sql.DB) (int, error) {
+			return userID, nil
+		},
+	}
+
+	body, _ := json.Marshal(CreateAddressRequest{
+		Type: "home", StreetAddress: "1 Old St", City: "Springfield", State: "IL", ZipCode: "62701", IsDefault: true,
+	})
+	w := httptest.NewRecorder()
+	addresses.handleCreateAddress(w, httptest.NewRequest("POST", "/api/v1/addresses/create", bytes.NewBuffer(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var address Address
+	json.Unmarshal(w.Body.Bytes(), &address)
+
+	// Pretend the address was created well before the order
+	db.Exec("UPDATE account_change_history SET created_at = CURRENT_TIMESTAMP - INTERVAL '1 day' WHERE entity_id = $1", address.ID)
+	orderTime := time.Now().Add(-time.Hour)
+
+	body, _ = json.Marshal(CreateAddressRequest{StreetAddress: "2 New Ave", IsDefault: true})
+	req := httptest.NewRequest("PUT", fmt.Sprintf("/api/v1/addresses/%d", address.ID), bytes.NewBuffer(body))
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(address.ID)})
+	w = httptest.NewRecorder()
+	addresses.handleUpdateAddress(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	history := NewAccountHistoryHandler(db.DB)
+	history.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return userID, nil
+	}
+	w = httptest.NewRecorder()
+	history.handleGetAccountHistory(w, httptest.NewRequest("GET", "/api/v1/account/history?entity_type=address", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var changes []AccountChange
+	if err := json.Unmarshal(w.Body.Bytes(), &changes); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("Expected create and update entries, got %d", len(changes))
+	}
+	if changes[0].ChangeType != "updated" || !reflect.DeepEqual(changes[0].ChangedFields, []string{"street_address"}) {
+		t.Errorf("Expected street_address update first, got %s %v", changes[0].ChangeType, changes[0].ChangedFields)
+	}
+	if changes[0].EditedBy != "you" {
+		t.Errorf("Expected change to be attributed to the customer, got %s", changes[0].EditedBy)
+	}
+
+	// The address as it was when the order was placed is the old one
+	data, err := addressAsOf(db.DB, address.ID, orderTime)
+	if err != nil {
+		t.Fatalf("Failed to reconstruct address: %v", err)
+	}
+	var asOf map[string]interface{}
+	json.Unmarshal(data, &asOf)
+	if asOf["street_address"] != "1 Old St" {
+		t.Errorf("Expected old street address at order time, got %v", asOf["street_address"])
+	}
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tumble-backend/money"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// AddOnHandler serves the checkout add-on catalog and its admin CRUD
+type AddOnHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewAddOnHandler(db *sql.DB) *AddOnHandler {
+	return &AddOnHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// ServiceAddOn is an optional extra offered at checkout
+type ServiceAddOn struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	DisplayName string   `json:"display_name"`
+	Description string   `json:"description"`
+	PricingType string   `json:"pricing_type"` // flat, per_bag or percent
+	Price       float64  `json:"price"`        // Flat and per-bag add-ons
+	Percent     int      `json:"percent"`      // Percent-of-subtotal add-ons
+	Markets     []string `json:"markets"`      // 3-digit ZIP prefixes; empty means every market
+	IsActive    bool     `json:"is_active"`
+	SortOrder   int      `json:"sort_order"`
+	// ItemOption, when set, makes the add-on price that option on order
+	// lines (e.g. "hang_dry") instead of being offered at checkout
+	ItemOption string `json:"item_option,omitempty"`
+}
+
+// OrderAddOn is an add-on on an order at the price it was sold for
+type OrderAddOn struct {
+	ID          int     `json:"id"`
+	AddOnID     int     `json:"add_on_id"`
+	Name        string  `json:"name"`
+	DisplayName string  `json:"display_name"`
+	Quantity    int     `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+}
+
+var (
+	errUnknownAddOn     = errors.New("unknown add-on")
+	errAddOnUnavailable = errors.New("add-on is not available in this area")
+)
+
+// priceAddOn returns the quantity and unit price in cents an add-on is sold
+// at for an order with the given bag count and pre-add-on subtotal. A zero
+// quantity means the add-on doesn't apply (e.g. per-bag with no bags).
+func priceAddOn(addOn ServiceAddOn, bagCount, subtotalCents int) (int, int) {
+	switch addOn.PricingType {
+	case "per_bag":
+		return bagCount, dollarsToCents(addOn.Price)
+	case "percent":
+		if subtotalCents <= 0 {
+			return 0, 0
+		}
+		return 1, money.Percent(subtotalCents, addOn.Percent)
+	default:
+		return 1, dollarsToCents(addOn.Price)
+	}
+}
+
+// addOnAvailableIn reports whether an add-on is offered at a ZIP code
+func addOnAvailableIn(markets []string, zipCode string) bool {
+	if len(markets) == 0 {
+		return true
+	}
+	for _, market := range markets {
+		if strings.HasPrefix(zipCode, market) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAddOn checks an add-on definition from the admin API
+func validateAddOn(addOn ServiceAddOn) error {
+	if addOn.Name == "" || addOn.DisplayName == "" {
+		return fmt.Errorf("name and display_name are required")
+	}
+	switch addOn.PricingType {
+	case "flat", "per_bag":
+		if addOn.Price < 0 {
+			return fmt.Errorf("price cannot be negative")
+		}
+	case "percent":
+		if addOn.Percent <= 0 || addOn.Percent > 100 {
+			return fmt.Errorf("percent must be between 1 and 100")
+		}
+	default:
+		return fmt.Errorf("pricing_type must be flat, per_bag or percent")
+	}
+	if addOn.ItemOption != "" && !validItemOption(addOn.ItemOption) {
+		return fmt.Errorf("item_option must be an item option such as hang_dry or detergent:sensitive")
+	}
+	for _, market := range addOn.Markets {
+		if len(market) != 3 {
+			return fmt.Errorf("markets must be 3-digit ZIP prefixes")
+		}
+		if _, err := strconv.Atoi(market); err != nil {
+			return fmt.Errorf("markets must be 3-digit ZIP prefixes")
+		}
+	}
+	return nil
+}
+
+const addOnColumns = `id, name, display_name, COALESCE(description, ''), pricing_type,
+	price_cents, percent, markets, is_active, sort_order, COALESCE(item_option, '')`
+
+func scanAddOn(scanner interface{ Scan(...interface{}) error }) (ServiceAddOn, error) {
+	var addOn ServiceAddOn
+	var priceCents int
+	err := scanner.Scan(&addOn.ID, &addOn.Name, &addOn.DisplayName, &addOn.Description,
+		&addOn.PricingType, &priceCents, &addOn.Percent, pq.Array(&addOn.Markets),
+		&addOn.IsActive, &addOn.SortOrder, &addOn.ItemOption)
+	if err != nil {
+		return addOn, err
+	}
+	addOn.Price = centsToDollars(priceCents)
+	if addOn.Markets == nil {
+		addOn.Markets = []string{}
+	}
+	return addOn, nil
+}
+
+func queryAddOns(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, where string, args ...interface{}) ([]ServiceAddOn, error) {
+	rows, err := q.Query("SELECT "+addOnColumns+" FROM service_add_ons "+where+" ORDER BY sort_order, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addOns := []ServiceAddOn{}
+	for rows.Next() {
+		addOn, err := scanAddOn(rows)
+		if err != nil {
+			return nil, err
+		}
+		addOns = append(addOns, addOn)
+	}
+	return addOns, nil
+}
+
+// insertOrderAddOns prices the requested add-ons against the order and adds
+// them, returning their combined cost in cents
+func insertOrderAddOns(tx *sql.Tx, orderID int, addOnIDs []int, zipCode string, bagCount, subtotalCents int) (int, error) {
+	if len(addOnIDs) == 0 {
+		return 0, nil
+	}
+
+	addOns, err := queryAddOns(tx, "WHERE id = ANY($1) AND is_active = true AND item_option IS NULL", pq.Array(addOnIDs))
+	if err != nil {
+		return 0, err
+	}
+	byID := map[int]ServiceAddOn{}
+	for _, addOn := range addOns {
+		byID[addOn.ID] = addOn
+	}
+
+	totalCents := 0
+	seen := map[int]bool{}
+	for _, id := range addOnIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		addOn, ok := byID[id]
+		if !ok {
+			return 0, errUnknownAddOn
+		}
+		if !addOnAvailableIn(addOn.Markets, zipCode) {
+			return 0, errAddOnUnavailable
+		}
+
+		quantity, unitCents := priceAddOn(addOn, bagCount, subtotalCents)
+		if quantity == 0 {
+			continue
+		}
+		_, err := tx.Exec(`
+			INSERT INTO order_add_ons (order_id, add_on_id, quantity, unit_price_cents)
+			VALUES ($1, $2, $3, $4)`,
+			orderID, id, quantity, unitCents,
+		)
+		if err != nil {
+			return 0, err
+		}
+		totalCents += quantity * unitCents
+	}
+	return totalCents, nil
+}
+
+// getOrderAddOns returns the add-ons on an order
+func getOrderAddOns(db *sql.DB, orderID int) ([]OrderAddOn, error) {
+	rows, err := db.Query(`
+		SELECT oa.id, oa.add_on_id, sa.name, sa.display_name, oa.quantity, oa.unit_price_cents
+		FROM order_add_ons oa
+		JOIN service_add_ons sa ON oa.add_on_id = sa.id
+		WHERE oa.order_id = $1
+		ORDER BY sa.sort_order, oa.id`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addOns := []OrderAddOn{}
+	for rows.Next() {
+		var a OrderAddOn
+		var unitPriceCents int
+		if err := rows.Scan(&a.ID, &a.AddOnID, &a.Name, &a.DisplayName, &a.Quantity, &unitPriceCents); err != nil {
+			return nil, err
+		}
+		a.UnitPrice = centsToDollars(unitPriceCents)
+		addOns = append(addOns, a)
+	}
+	return addOns, nil
+}
+
+// handleGetAddOns lists active checkout add-ons. With ?address_id= only
+// add-ons offered at that address are returned.
+func (h *AddOnHandler) handleGetAddOns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addOns, err := queryAddOns(h.db, "WHERE is_active = true AND item_option IS NULL")
+	if err != nil {
+		http.Error(w, "Failed to fetch add-ons", http.StatusInternalServerError)
+		return
+	}
+
+	if addressIDStr := r.URL.Query().Get("address_id"); addressIDStr != "" {
+		userID, err := h.getUserID(r, h.db)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		addressID, err := strconv.Atoi(addressIDStr)
+		if err != nil {
+			http.Error(w, "Invalid address ID", http.StatusBadRequest)
+			return
+		}
+		var zipCode string
+		err = h.db.QueryRow("SELECT zip_code FROM addresses WHERE id = $1 AND user_id = $2", addressID, userID).Scan(&zipCode)
+		if err != nil {
+			http.Error(w, "Address not found", http.StatusNotFound)
+			return
+		}
+
+		available := []ServiceAddOn{}
+		for _, addOn := range addOns {
+			if addOnAvailableIn(addOn.Markets, zipCode) {
+				available = append(available, addOn)
+			}
+		}
+		addOns = available
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addOns)
+}
+
+type AddOnQuoteRequest struct {
+	AddressID int     `json:"address_id"`
+	AddOnIDs  []int   `json:"add_on_ids"`
+	BagCount  int     `json:"bag_count"`
+	Subtotal  float64 `json:"subtotal"` // Order subtotal before add-ons
+	// PickupDate and PickupTimeSlot, when given, apply peak or off-peak slot pricing
+	PickupDate     string `json:"pickup_date,omitempty"`
+	PickupTimeSlot string `json:"pickup_time_slot,omitempty"`
+}
+
+type AddOnQuoteLine struct {
+	AddOnID     int     `json:"add_on_id"`
+	DisplayName string  `json:"display_name"`
+	Quantity    int     `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+	LineTotal   float64 `json:"line_total"`
+	Available   bool    `json:"available"`
+}
+
+// handleQuoteAddOns prices add-ons for a cart at checkout using the same
+// rules order creation applies
+func (h *AddOnHandler) handleQuoteAddOns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req AddOnQuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.BagCount < 0 || req.Subtotal < 0 {
+		http.Error(w, "bag_count and subtotal cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	var zipCode string
+	err = h.db.QueryRow("SELECT zip_code FROM addresses WHERE id = $1 AND user_id = $2", req.AddressID, userID).Scan(&zipCode)
+	if err != nil {
+		http.Error(w, "Address not found", http.StatusNotFound)
+		return
+	}
+
+	var slotRule *SlotPriceRule
+	if req.PickupDate != "" {
+		pickupDate, err := time.Parse("2006-01-02", req.PickupDate)
+		if err != nil {
+			http.Error(w, "Invalid pickup date", http.StatusBadRequest)
+			return
+		}
+		slotRule, err = slotPriceRuleFor(h.db, pickupDate, req.PickupTimeSlot)
+		if err != nil {
+			http.Error(w, "Failed to price pickup slot", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	addOns, err := queryAddOns(h.db, "WHERE id = ANY($1) AND is_active = true AND item_option IS NULL", pq.Array(req.AddOnIDs))
+	if err != nil {
+		http.Error(w, "Failed to fetch add-ons", http.StatusInternalServerError)
+		return
+	}
+
+	subtotalCents := dollarsToCents(req.Subtotal)
+	lines := []AddOnQuoteLine{}
+	totalCents := 0
+	for _, addOn := range addOns {
+		line := AddOnQuoteLine{
+			AddOnID:     addOn.ID,
+			DisplayName: addOn.DisplayName,
+			Available:   addOnAvailableIn(addOn.Markets, zipCode),
+		}
+		if line.Available {
+			quantity, unitCents := priceAddOn(addOn, req.BagCount, subtotalCents)
+			line.Quantity = quantity
+			line.UnitPrice = centsToDollars(unitCents)
+			line.LineTotal = centsToDollars(quantity * unitCents)
+			totalCents += quantity * unitCents
+		}
+		lines = append(lines, line)
+	}
+
+	// Slot pricing scales the services only, the same as order creation
+	var slotAdjustment *OrderSlotAdjustment
+	slotAdjustmentCents := slotRule.adjustmentCents(subtotalCents)
+	if slotRule != nil {
+		slotAdjustment = &OrderSlotAdjustment{
+			Label:             slotRule.Name,
+			MultiplierPercent: slotRule.MultiplierPercent,
+			Amount:            centsToDollars(slotAdjustmentCents),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"lines":           lines,
+		"total":           centsToDollars(totalCents),
+		"slot_adjustment": slotAdjustment,
+		"subtotal":        centsToDollars(subtotalCents + totalCents + slotAdjustmentCents),
+	})
+}
+
+// addOnNameTaken writes a conflict response when another add-on already uses name
+func (h *AddOnHandler) addOnNameTaken(w http.ResponseWriter, name string, addOnID int) bool {
+	var existingID int
+	err := h.db.QueryRow("SELECT id FROM service_add_ons WHERE name = $1 AND id != $2", name, addOnID).Scan(&existingID)
+	if err == nil {
+		http.Error(w, "An add-on with this name already exists", http.StatusConflict)
+		return true
+	} else if err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return true
+	}
+	return false
+}
+
+// itemOptionTaken writes a conflict response when err is another active
+// add-on already pricing the same item option
+func itemOptionTaken(w http.ResponseWriter, err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "Another active add-on already prices this item option", http.StatusConflict)
+		return true
+	}
+	return false
+}
+
+// handleAdminGetAddOns lists every add-on, including inactive ones
+func (h *AddOnHandler) handleAdminGetAddOns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addOns, err := queryAddOns(h.db, "")
+	if err != nil {
+		http.Error(w, "Failed to fetch add-ons", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addOns)
+}
+
+// handleAdminCreateAddOn adds an add-on to the catalog
+func (h *AddOnHandler) handleAdminCreateAddOn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := ServiceAddOn{IsActive: true}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateAddOn(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Markets == nil {
+		req.Markets = []string{}
+	}
+
+	if h.addOnNameTaken(w, req.Name, 0) {
+		return
+	}
+
+	row := h.db.QueryRow(`
+		INSERT INTO service_add_ons (name, display_name, description, pricing_type, price_cents, percent, markets, is_active, sort_order, item_option)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''))
+		RETURNING `+addOnColumns,
+		req.Name, req.DisplayName, req.Description, req.PricingType, dollarsToCents(req.Price),
+		req.Percent, pq.Array(req.Markets), req.IsActive, req.SortOrder, req.ItemOption,
+	)
+	addOn, err := scanAddOn(row)
+	if itemOptionTaken(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create add-on", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(addOn)
+}
+
+// handleAdminUpdateAddOn replaces an add-on's definition. Orders already
+// placed keep the price they were sold at.
+func (h *AddOnHandler) handleAdminUpdateAddOn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addOnID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid add-on ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ServiceAddOn
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateAddOn(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Markets == nil {
+		req.Markets = []string{}
+	}
+
+	if h.addOnNameTaken(w, req.Name, addOnID) {
+		return
+	}
+
+	row := h.db.QueryRow(`
+		UPDATE service_add_ons
+		SET name = $1, display_name = $2, description = $3, pricing_type = $4, price_cents = $5,
+		    percent = $6, markets = $7, is_active = $8, sort_order = $9, item_option = NULLIF($10, '')
+		WHERE id = $11
+		RETURNING `+addOnColumns,
+		req.Name, req.DisplayName, req.Description, req.PricingType, dollarsToCents(req.Price),
+		req.Percent, pq.Array(req.Markets), req.IsActive, req.SortOrder, req.ItemOption, addOnID,
+	)
+	addOn, err := scanAddOn(row)
+	if itemOptionTaken(w, err) {
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Add-on not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update add-on", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addOn)
+}
+
+// handleAdminDeleteAddOn retires an add-on. It's deactivated rather than
+// deleted because past orders reference it.
+func (h *AddOnHandler) handleAdminDeleteAddOn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addOnID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid add-on ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec("UPDATE service_add_ons SET is_active = false WHERE id = $1", addOnID)
+	if err != nil {
+		http.Error(w, "Failed to delete add-on", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Add-on not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPriceAddOn(t *testing.T) {
+	tests := []struct {
+		name             string
+		addOn            ServiceAddOn
+		bagCount         int
+		subtotalCents    int
+		expectedQuantity int
+		expectedUnit     int
+	}{
+		{"Flat", ServiceAddOn{PricingType: "flat", Price: 3.00}, 2, 6000, 1, 300},
+		{"Per bag", ServiceAddOn{PricingType: "per_bag", Price: 5.00}, 3, 9000, 3, 500},
+		{"Per bag with no bags", ServiceAddOn{PricingType: "per_bag", Price: 5.00}, 0, 0, 0, 500},
+		{"Percent of subtotal", ServiceAddOn{PricingType: "percent", Percent: 50}, 2, 6000, 1, 3000},
+		{"Percent of a covered order", ServiceAddOn{PricingType: "percent", Percent: 50}, 2, 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quantity, unit := priceAddOn(tt.addOn, tt.bagCount, tt.subtotalCents)
+			if quantity != tt.expectedQuantity || unit != tt.expectedUnit {
+				t.Errorf("Expected %d x %d cents, got %d x %d cents", tt.expectedQuantity, tt.expectedUnit, quantity, unit)
+			}
+		})
+	}
+}
+
+func TestAddOnAvailableIn(t *testing.T) {
+	if !addOnAvailableIn(nil, "94107") {
+		t.Error("Expected add-on with no markets to be available everywhere")
+	}
+	if !addOnAvailableIn([]string{"100", "941"}, "94107") {
+		t.Error("Expected add-on to be available in a listed market")
+	}
+	if addOnAvailableIn([]string{"100"}, "94107") {
+		t.Error("Expected add-on to be unavailable outside its markets")
+	}
+}
+
+func TestValidateAddOn(t *testing.T) {
+	tests := []struct {
+		name    string
+		addOn   ServiceAddOn
+		wantErr bool
+	}{
+		{"Valid flat", ServiceAddOn{Name: "starch", DisplayName: "Starch", PricingType: "flat", Price: 2}, false},
+		{"Valid percent", ServiceAddOn{Name: "rush", DisplayName: "Rush", PricingType: "percent", Percent: 50, Markets: []string{"941"}}, false},
+		{"Missing name", ServiceAddOn{DisplayName: "Starch", PricingType: "flat"}, true},
+		{"Unknown pricing type", ServiceAddOn{Name: "x", DisplayName: "X", PricingType: "weekly"}, true},
+		{"Percent out of range", ServiceAddOn{Name: "x", DisplayName: "X", PricingType: "percent", Percent: 150}, true},
+		{"Bad market", ServiceAddOn{Name: "x", DisplayName: "X", PricingType: "flat", Markets: []string{"94107"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateAddOn(tt.addOn); (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestAddOnHandler_AdminCRUDAndOrderPricing(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "addons@example.com", "AddOn", "User")
+	addressID := db.CreateTestAddress(t, userID)
+	orderID := db.CreateTestOrder(t, userID, addressID)
+
+	handler := NewAddOnHandler(db.DB)
+
+	// Create an add-on only offered outside the test address's market
+	body, _ := json.Marshal(ServiceAddOn{
+		Name: "eco_wash", DisplayName: "Eco Wash", PricingType: "flat", Price: 4.00,
+		Markets: []string{"000"}, IsActive: true,
+	})
+	req := httptest.NewRequest("POST", "/api/v1/admin/add-ons", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	handler.handleAdminCreateAddOn(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var ecoWash ServiceAddOn
+	json.Unmarshal(w.Body.Bytes(), &ecoWash)
+
+	req = httptest.NewRequest("POST", "/api/v1/admin/add-ons", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	handler.handleAdminCreateAddOn(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for duplicate name, got %d", http.StatusConflict, w.Code)
+	}
+
+	var zipCode string
+	db.QueryRow("SELECT zip_code FROM addresses WHERE id = $1", addressID).Scan(&zipCode)
+
+	var hangDryID, scentFreeID int
+	db.QueryRow("SELECT id FROM service_add_ons WHERE name = 'hang_dry'").Scan(&hangDryID)
+	db.QueryRow("SELECT id FROM service_add_ons WHERE name = 'scent_free'").Scan(&scentFreeID)
+
+	tx, _ := db.Begin()
+	if _, err := insertOrderAddOns(tx, orderID, []int{ecoWash.ID}, zipCode, 2, 6000); err != errAddOnUnavailable {
+		t.Errorf("Expected add-on to be unavailable in this market, got %v", err)
+	}
+	tx.Rollback()
+
+	tx, _ = db.Begin()
+	addOnCents, err := insertOrderAddOns(tx, orderID, []int{hangDryID, scentFreeID, scentFreeID}, zipCode, 2, 6000)
+	if err != nil {
+		t.Fatalf("Failed to insert add-ons: %v", err)
+	}
+	tx.Commit()
+	if addOnCents != 1300 {
+		t.Errorf("Expected 2 bags of hang dry plus scent-free to cost 1300 cents, got %d", addOnCents)
+	}
+
+	// Deleting deactivates, so the order keeps its add-on
+	req = httptest.NewRequest("DELETE", "/api/v1/admin/add-ons/"+fmt.Sprint(scentFreeID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(scentFreeID)})
+	w = httptest.NewRecorder()
+	handler.handleAdminDeleteAddOn(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	addOns, err := getOrderAddOns(db.DB, orderID)
+	if err != nil || len(addOns) != 2 {
+		t.Fatalf("Expected 2 add-ons on the order, got %d (%v)", len(addOns), err)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/add-ons", nil)
+	w = httptest.NewRecorder()
+	handler.handleGetAddOns(w, req)
+	var catalog []ServiceAddOn
+	json.Unmarshal(w.Body.Bytes(), &catalog)
+	for _, addOn := range catalog {
+		if addOn.ID == scentFreeID {
+			t.Error("Expected deleted add-on to be hidden from the catalog")
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// AddressOrderUse is an unfinished order that still picks up from or
+// delivers to an address
+type AddressOrderUse struct {
+	OrderID    int     `json:"order_id"`
+	Status     string  `json:"status"`
+	PickupDate *string `json:"pickup_date,omitempty"`
+	Pickup     bool    `json:"pickup"`
+	Delivery   bool    `json:"delivery"`
+	// Movable is false once the leg using this address is underway
+	Movable bool `json:"movable"`
+}
+
+// AddressUsage is what depends on an address: active orders and the
+// subscription preferences auto-scheduled pickups are generated from
+type AddressUsage struct {
+	ActiveOrders []AddressOrderUse `json:"active_orders"`
+	AutoSchedule bool              `json:"auto_schedule"`
+}
+
+func (u AddressUsage) inUse() bool {
+	return len(u.ActiveOrders) > 0 || u.AutoSchedule
+}
+
+// movable reports whether anything could be reassigned to another address
+func (u AddressUsage) movable() bool {
+	if u.AutoSchedule {
+		return true
+	}
+	for _, o := range u.ActiveOrders {
+		if o.Movable {
+			return true
+		}
+	}
+	return false
+}
+
+// Pickups can move until the driver has collected, deliveries until the
+// driver is on the way
+var (
+	movablePickupStatuses   = pickupAheadOrderStatuses()
+	movableDeliveryStatuses = deliveryAheadOrderStatuses()
+)
+
+// findAddressUsage looks up everything still relying on an address
+func findAddressUsage(db *sql.DB, addressID int) (AddressUsage, error) {
+	usage := AddressUsage{ActiveOrders: []AddressOrderUse{}}
+
+	rows, err := db.Query(`
+		SELECT id, status, TO_CHAR(pickup_date, 'YYYY-MM-DD'),
+		       pickup_address_id = $1, delivery_address_id = $1,
+		       (pickup_address_id = $1 AND status = ANY($3)) OR (delivery_address_id = $1 AND status = ANY($4))
+		FROM orders
+		WHERE (pickup_address_id = $1 OR delivery_address_id = $1)
+		  AND status <> ALL($2)
+		ORDER BY pickup_date NULLS LAST, id`,
+		addressID, pq.Array(terminalOrderStatuses()),
+		pq.Array(movablePickupStatuses), pq.Array(movableDeliveryStatuses),
+	)
+	if err != nil {
+		return usage, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o AddressOrderUse
+		var pickup, delivery sql.NullBool
+		if err := rows.Scan(&o.OrderID, &o.Status, &o.PickupDate, &pickup, &delivery, &o.Movable); err != nil {
+			return usage, err
+		}
+		o.Pickup, o.Delivery = pickup.Bool, delivery.Bool
+		usage.ActiveOrders = append(usage.ActiveOrders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return usage, err
+	}
+
+	err = db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM subscription_preferences sp
+			WHERE sp.default_pickup_address_id = $1 OR sp.default_delivery_address_id = $1
+			   OR EXISTS (
+				SELECT 1 FROM jsonb_array_elements(sp.address_rotation) stop
+				WHERE (stop->>'pickup_address_id')::int = $1 OR (stop->>'delivery_address_id')::int = $1
+			   )
+			   OR EXISTS (
+				SELECT 1 FROM jsonb_each(sp.weekday_addresses) day
+				WHERE (day.value->>'pickup_address_id')::int = $1 OR (day.value->>'delivery_address_id')::int = $1
+			   )
+		)`,
+		addressID,
+	).Scan(&usage.AutoSchedule)
+	return usage, err
+}
+
+type ReassignAddressRequest struct {
+	ToAddressID int `json:"to_address_id"`
+	// OrderIDs limits which orders move; all movable orders move when empty
+	OrderIDs []int `json:"order_ids,omitempty"`
+}
+
+// handleReassignAddress points the caller's upcoming orders and
+// auto-schedule preferences at another of their addresses, so the old one
+// can be retired. Legs that are already underway stay where they are.
+func (h *AddressHandler) handleReassignAddress(w http.ResponseWriter, r *http.Request) {
+	addressID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid address ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReassignAddressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ToAddressID == 0 {
+		http.Error(w, "to_address_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.ToAddressID == addressID {
+		http.Error(w, "to_address_id must be a different address", http.StatusBadRequest)
+		return
+	}
+
+	var owned int
+	err = h.db.QueryRow(
+		"SELECT COUNT(*) FROM addresses WHERE id IN ($1, $2) AND user_id = $3",
+		addressID, req.ToAddressID, userID,
+	).Scan(&owned)
+	if err != nil {
+		http.Error(w, "Failed to fetch addresses", http.StatusInternalServerError)
+		return
+	}
+	if owned != 2 {
+		http.Error(w, "Address not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var orderFilter interface{}
+	if len(req.OrderIDs) > 0 {
+		orderFilter = pq.Array(req.OrderIDs)
+	}
+	var pickupsMoved, deliveriesMoved int64
+	result, err := tx.Exec(`
+		UPDATE orders SET pickup_address_id = $2
+		WHERE pickup_address_id = $1 AND user_id = $3 AND status = ANY($4)
+		  AND ($5::int[] IS NULL OR id = ANY($5))`,
+		addressID, req.ToAddressID, userID, pq.Array(movablePickupStatuses), orderFilter,
+	)
+	if err == nil {
+		pickupsMoved, _ = result.RowsAffected()
+		result, err = tx.Exec(`
+			UPDATE orders SET delivery_address_id = $2
+			WHERE delivery_address_id = $1 AND user_id = $3 AND status = ANY($4)
+			  AND ($5::int[] IS NULL OR id = ANY($5))`,
+			addressID, req.ToAddressID, userID, pq.Array(movableDeliveryStatuses), orderFilter,
+		)
+	}
+	if err != nil {
+		http.Error(w, "Failed to update orders", http.StatusInternalServerError)
+		return
+	}
+	deliveriesMoved, _ = result.RowsAffected()
+
+	preferencesMoved, err := reassignPreferenceAddresses(tx, userID, addressID, req.ToAddressID)
+	if err != nil {
+		http.Error(w, "Failed to update subscription preferences", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to reassign address", http.StatusInternalServerError)
+		return
+	}
+
+	usage, err := findAddressUsage(h.db, addressID)
+	if err != nil {
+		http.Error(w, "Failed to check address usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pickups_moved":       pickupsMoved,
+		"deliveries_moved":    deliveriesMoved,
+		"auto_schedule_moved": preferencesMoved,
+		"remaining_usage":     usage,
+	})
+}
+
+// reassignPreferenceAddresses swaps one address for another everywhere in
+// a user's subscription preferences, including rotation and weekday stops
+func reassignPreferenceAddresses(tx *sql.Tx, userID, fromID, toID int) (bool, error) {
+	var pickupID, deliveryID sql.NullInt64
+	var rotationJSON, weekdayJSON []byte
+	err := tx.QueryRow(`
+		SELECT default_pickup_address_id, default_delivery_address_id, address_rotation, weekday_addresses
+		FROM subscription_preferences WHERE user_id = $1
+		FOR UPDATE`,
+		userID,
+	).Scan(&pickupID, &deliveryID, &rotationJSON, &weekdayJSON)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var rotation []AddressStop
+	weekdays := map[string]AddressStop{}
+	if err := json.Unmarshal(rotationJSON, &rotation); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(weekdayJSON, &weekdays); err != nil {
+		return false, err
+	}
+
+	changed := false
+	swap := func(id *int) {
+		if *id == fromID {
+			*id = toID
+			changed = true
+		}
+	}
+	swapNull := func(id *sql.NullInt64) {
+		if id.Valid && int(id.Int64) == fromID {
+			id.Int64 = int64(toID)
+			changed = true
+		}
+	}
+	swapNull(&pickupID)
+	swapNull(&deliveryID)
+	for i := range rotation {
+		swap(&rotation[i].PickupAddressID)
+		swap(&rotation[i].DeliveryAddressID)
+	}
+	for day, stop := range weekdays {
+		swap(&stop.PickupAddressID)
+		swap(&stop.DeliveryAddressID)
+		weekdays[day] = stop
+	}
+	if !changed {
+		return false, nil
+	}
+
+	rotationJSON, _ = json.Marshal(rotation)
+	weekdayJSON, _ = json.Marshal(weekdays)
+	_, err = tx.Exec(`
+		UPDATE subscription_preferences
+		SET default_pickup_address_id = $2, default_delivery_address_id = $3,
+		    address_rotation = $4, weekday_addresses = $5
+		WHERE user_id = $1`,
+		userID, pickupID, deliveryID, rotationJSON, weekdayJSON,
+	)
+	return err == nil, err
+}
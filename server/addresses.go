@@ -29,6 +29,19 @@ type Address struct {
 	IsDefault            bool    `json:"is_default"`
 }
 
+// AddressUpdateResponse is the updated address plus what the edit affects
+type AddressUpdateResponse struct {
+	Address
+	// Active orders now using the edited location
+	AffectedOrders       []AddressOrderUse `json:"affected_orders"`
+	AutoScheduleAffected bool              `json:"auto_schedule_affected"`
+	// Set when this became the default while the old default is still in use
+	PreviousDefaultID    *int          `json:"previous_default_id,omitempty"`
+	PreviousDefaultUsage *AddressUsage `json:"previous_default_usage,omitempty"`
+	// PromptReassign asks the client to offer POST /addresses/{previous_default_id}/reassign
+	PromptReassign bool `json:"prompt_reassign"`
+}
+
 type CreateAddressRequest struct {
 	Type                 string  `json:"type"`
 	StreetAddress        string  `json:"street_address"`
@@ -60,13 +73,21 @@ func (h *AddressHandler) handleGetAddresses(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Household members can also see the addresses the owner shares with them
+	ownerID := userID
+	if r.URL.Query().Get("include_household") == "true" {
+		if householdOwnerID, err := householdOwnerFor(h.db, userID, "schedule"); err == nil {
+			ownerID = householdOwnerID
+		}
+	}
+
 	rows, err := h.db.Query(`
 		SELECT id, user_id, type, street_address, city, state, zip_code, 
 			   delivery_instructions, is_default
 		FROM addresses
-		WHERE user_id = $1
-		ORDER BY is_default DESC, created_at DESC`,
-		userID,
+		WHERE user_id = $1 OR user_id = $2
+		ORDER BY user_id = $1 DESC, is_default DESC, created_at DESC`,
+		userID, ownerID,
 	)
 	if err != nil {
 		http.Error(w, "Failed to fetch addresses", http.StatusInternalServerError)
@@ -119,6 +140,15 @@ func (h *AddressHandler) handleCreateAddress(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// Soft-launch markets only serve customers who were invited
+	if !requireInvite(w, h.db, userID, req.ZipCode) {
+		return
+	}
+	// Only take addresses we can pick up from
+	if _, ok := requireServiceArea(w, h.db, req.ZipCode); !ok {
+		return
+	}
+
 	// Validate type
 	if req.Type != "home" && req.Type != "work" && req.Type != "other" {
 		req.Type = "home"
@@ -161,6 +191,15 @@ func (h *AddressHandler) handleCreateAddress(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	after, err := snapshotAddress(tx, addressID)
+	if err == nil {
+		err = recordAccountChange(tx, userID, userID, "address", addressID, nil, after)
+	}
+	if err != nil {
+		http.Error(w, "Failed to record address history", http.StatusInternalServerError)
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
 		http.Error(w, "Failed to complete address creation", http.StatusInternalServerError)
@@ -235,6 +274,16 @@ func (h *AddressHandler) handleUpdateAddress(w http.ResponseWriter, r *http.Requ
 		"is_default", req.IsDefault,
 	)
 
+	if req.ZipCode != "" {
+		if !requireInvite(w, h.db, userID, req.ZipCode) {
+			return
+		}
+		if _, ok := requireServiceArea(w, h.db, req.ZipCode); !ok {
+			logger.Info("Address outside service area", "zip_code", req.ZipCode)
+			return
+		}
+	}
+
 	// Begin transaction
 	tx, err := h.db.Begin()
 	if err != nil {
@@ -243,10 +292,32 @@ func (h *AddressHandler) handleUpdateAddress(w http.ResponseWriter, r *http.Requ
 	}
 	defer tx.Rollback()
 
+	// Snapshot the address before editing so the change can be versioned
+	before, err := snapshotAddress(tx, addressID)
+	if err != nil {
+		http.Error(w, "Failed to fetch address", http.StatusInternalServerError)
+		return
+	}
+
 	// If this is set as default, unset other defaults
+	var previousDefaultID *int
 	if req.IsDefault {
 		dbLogger := LogDatabase("unset_defaults", userID).With("address_id", addressID)
 		dbLogger.Info("Unsetting other defaults")
+		var id int
+		err = tx.QueryRow(`
+			SELECT id FROM addresses
+			WHERE user_id = $1 AND is_default = true AND id != $2
+			LIMIT 1`,
+			userID, addressID,
+		).Scan(&id)
+		if err == nil {
+			previousDefaultID = &id
+		} else if err != sql.ErrNoRows {
+			dbLogger.Error("Failed to fetch current default", "error", err)
+			http.Error(w, "Failed to update defaults", http.StatusInternalServerError)
+			return
+		}
 		_, err = tx.Exec(`
 			UPDATE addresses SET is_default = false 
 			WHERE user_id = $1 AND is_default = true AND id != $2`,
@@ -290,6 +361,14 @@ func (h *AddressHandler) handleUpdateAddress(w http.ResponseWriter, r *http.Requ
 		updateValues = append(updateValues, req.ZipCode)
 		paramIndex++
 	}
+	// A moved address is geocoded again by the nightly backfill or the next
+	// time it's routed. The old pin is kept to check how far it moved.
+	if req.StreetAddress != "" || req.City != "" || req.State != "" || req.ZipCode != "" {
+		updateFields = append(updateFields,
+			"previous_latitude = COALESCE(latitude, previous_latitude)",
+			"previous_longitude = COALESCE(longitude, previous_longitude)",
+			"latitude = NULL", "longitude = NULL", "geocoded_at = NULL", "geocode_failed_at = NULL")
+	}
 	if req.DeliveryInstructions != nil {
 		updateFields = append(updateFields, "delivery_instructions = $"+strconv.Itoa(paramIndex))
 		updateValues = append(updateValues, req.DeliveryInstructions)
@@ -340,6 +419,16 @@ func (h *AddressHandler) handleUpdateAddress(w http.ResponseWriter, r *http.Requ
 	}
 	dbLogger.Info("Address updated successfully", "rows_affected", rowsAffected)
 
+	after, err := snapshotAddress(tx, addressID)
+	if err == nil {
+		err = recordAccountChange(tx, userID, userID, "address", addressID, before, after)
+	}
+	if err != nil {
+		dbLogger.Error("Failed to record address history", "error", err)
+		http.Error(w, "Failed to record address history", http.StatusInternalServerError)
+		return
+	}
+
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
 		dbLogger.Error("Failed to commit transaction", "error", err)
@@ -371,9 +460,49 @@ func (h *AddressHandler) handleUpdateAddress(w http.ResponseWriter, r *http.Requ
 		"address_type", addr.Type,
 		"city", addr.City,
 	)
-	
+
+	// Orders follow the address they point at, so tell the customer which
+	// ones just moved with the edit. A new default doesn't move anything by
+	// itself, so flag what still uses the old default for them to reassign.
+	resp := AddressUpdateResponse{Address: addr, AffectedOrders: []AddressOrderUse{}}
+	if locationChanged(before, after) {
+		usage, err := findAddressUsage(h.db, addressID)
+		if err != nil {
+			logger.Error("Failed to check address usage", "error", err)
+			http.Error(w, "Failed to check address usage", http.StatusInternalServerError)
+			return
+		}
+		resp.AffectedOrders = usage.ActiveOrders
+		resp.AutoScheduleAffected = usage.AutoSchedule
+	}
+	if previousDefaultID != nil {
+		usage, err := findAddressUsage(h.db, *previousDefaultID)
+		if err != nil {
+			logger.Error("Failed to check previous default usage", "error", err)
+			http.Error(w, "Failed to check address usage", http.StatusInternalServerError)
+			return
+		}
+		if usage.inUse() {
+			resp.PreviousDefaultID = previousDefaultID
+			resp.PreviousDefaultUsage = &usage
+			resp.PromptReassign = usage.movable()
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(addr)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// locationChanged reports whether an edit moved the address somewhere else,
+// as opposed to touching only its label, instructions or default flag
+func locationChanged(before, after json.RawMessage) bool {
+	for _, field := range changedFields(before, after) {
+		switch field {
+		case "street_address", "city", "state", "zip_code":
+			return true
+		}
+	}
+	return false
 }
 
 // handleDeleteAddress deletes an address
@@ -398,7 +527,47 @@ func (h *AddressHandler) handleDeleteAddress(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Check if address is referenced by any orders
+	var owned bool
+	err = h.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM addresses WHERE id = $1 AND user_id = $2)",
+		addressID, userID,
+	).Scan(&owned)
+	if err != nil {
+		http.Error(w, "Failed to check address usage", http.StatusInternalServerError)
+		return
+	}
+	if !owned {
+		http.Error(w, "Address not found", http.StatusNotFound)
+		return
+	}
+
+	// Active orders and auto-scheduled pickups must be moved off the address
+	// first; deleting it would leave them with nowhere to go
+	usage, err := findAddressUsage(h.db, addressID)
+	if err != nil {
+		http.Error(w, "Failed to check address usage", http.StatusInternalServerError)
+		return
+	}
+	if usage.inUse() {
+		conflictType := "active_orders"
+		message := fmt.Sprintf("This address is used by %d active order(s). Move them to another address before deleting it.", len(usage.ActiveOrders))
+		if len(usage.ActiveOrders) == 0 {
+			conflictType = "auto_schedule"
+			message = "Your recurring pickups are scheduled from this address. Move them to another address before deleting it."
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":         "Cannot delete address",
+			"message":       message,
+			"conflict_type": conflictType,
+			"order_count":   len(usage.ActiveOrders),
+			"usage":         usage,
+		})
+		return
+	}
+
+	// Past orders keep pointing at the address for their records
 	var orderCount int
 	err = h.db.QueryRow(`
 		SELECT COUNT(*) FROM orders 
@@ -423,8 +592,21 @@ func (h *AddressHandler) handleDeleteAddress(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := snapshotAddress(tx, addressID)
+	if err != nil {
+		http.Error(w, "Failed to fetch address", http.StatusInternalServerError)
+		return
+	}
+
 	// Delete address
-	result, err := h.db.Exec(`
+	result, err := tx.Exec(`
 		DELETE FROM addresses 
 		WHERE id = $1 AND user_id = $2`,
 		addressID, userID,
@@ -440,6 +622,16 @@ func (h *AddressHandler) handleDeleteAddress(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if err := recordAccountChange(tx, userID, userID, "address", addressID, before, nil); err != nil {
+		http.Error(w, "Failed to record address history", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete address", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "Address deleted successfully",
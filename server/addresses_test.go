@@ -603,4 +603,86 @@ func BenchmarkAddressHandler_GetAddresses(b *testing.B) {
 
 		handler.handleGetAddresses(w, req)
 	}
-}
\ No newline at end of file
+}
+
+func TestAddressHandler_ChangePropagation(t *testing.T) {
+	InitLogger()
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "mover@example.com", "Moving", "Customer")
+	oldID := db.CreateTestAddress(t, userID)
+	var newID int
+	db.QueryRow(`
+		INSERT INTO addresses (user_id, street_address, city, state, zip_code, is_default)
+		VALUES ($1, '9 New Home Rd', 'Test City', 'CA', '12345', false)
+		RETURNING id`,
+		userID,
+	).Scan(&newID)
+	orderID := db.CreateTestOrder(t, userID, oldID)
+	db.Exec(`
+		INSERT INTO subscription_preferences (user_id, default_pickup_address_id, address_rotation)
+		VALUES ($1, $2, $3)`,
+		userID, oldID, fmt.Sprintf(`[{"pickup_address_id": %d, "delivery_address_id": %d}]`, oldID, oldID),
+	)
+
+	handler := NewAddressHandler(db.DB)
+	handler.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+	addressRequest := func(method string, id int, body string) *http.Request {
+		req := httptest.NewRequest(method, fmt.Sprintf("/addresses/%d", id), bytes.NewBufferString(body))
+		return mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(id)})
+	}
+
+	// Making the new address the default flags what the old one still serves
+	w := httptest.NewRecorder()
+	handler.handleUpdateAddress(w, addressRequest("PUT", newID, `{"is_default": true}`))
+	var update AddressUpdateResponse
+	json.Unmarshal(w.Body.Bytes(), &update)
+	if w.Code != http.StatusOK || update.PreviousDefaultID == nil || *update.PreviousDefaultID != oldID || !update.PromptReassign {
+		t.Fatalf("Expected a prompt to reassign the old default, got %d %s", w.Code, w.Body.String())
+	}
+	if usage := update.PreviousDefaultUsage; len(usage.ActiveOrders) != 1 || usage.ActiveOrders[0].OrderID != orderID || !usage.AutoSchedule {
+		t.Errorf("Unexpected previous default usage %+v", usage)
+	}
+
+	// Moving the old address lists the orders that moved with it
+	w = httptest.NewRecorder()
+	handler.handleUpdateAddress(w, addressRequest("PUT", oldID, `{"street_address": "124 Test St"}`))
+	update = AddressUpdateResponse{}
+	json.Unmarshal(w.Body.Bytes(), &update)
+	if len(update.AffectedOrders) != 1 || !update.AutoScheduleAffected {
+		t.Errorf("Expected the edit to flag the order and recurring pickups, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleDeleteAddress(w, addressRequest("DELETE", oldID, ""))
+	var conflict map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &conflict)
+	if w.Code != http.StatusConflict || conflict["conflict_type"] != "active_orders" {
+		t.Fatalf("Expected deletion to be blocked by the active order, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleReassignAddress(w, addressRequest("POST", oldID, fmt.Sprintf(`{"to_address_id": %d}`, newID)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var pickupID, deliveryID, preferenceID int
+	var rotation string
+	db.QueryRow("SELECT pickup_address_id, delivery_address_id FROM orders WHERE id = $1", orderID).Scan(&pickupID, &deliveryID)
+	db.QueryRow("SELECT default_pickup_address_id, address_rotation::text FROM subscription_preferences WHERE user_id = $1", userID).Scan(&preferenceID, &rotation)
+	if pickupID != newID || deliveryID != newID || preferenceID != newID {
+		t.Errorf("Expected the order and preferences to use address %d, got %d/%d/%d", newID, pickupID, deliveryID, preferenceID)
+	}
+	var stops []AddressStop
+	json.Unmarshal([]byte(rotation), &stops)
+	if len(stops) != 1 || stops[0].PickupAddressID != newID || stops[0].DeliveryAddressID != newID {
+		t.Errorf("Expected the rotation to use address %d, got %s", newID, rotation)
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleDeleteAddress(w, addressRequest("DELETE", oldID, ""))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the unused address to delete, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -4,10 +4,14 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"tumble-backend/money"
+
 	"github.com/gorilla/mux"
 	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
@@ -32,14 +36,23 @@ type OrderLocation struct {
 type AdminHandler struct {
 	db        *sql.DB
 	realtime  RealtimeInterface
+	userSync  *UserSyncHandler
 	getUserID func(*http.Request, *sql.DB) (int, error)
+	// Route optimization; without a geocoder or routing provider it works
+	// from stored coordinates and straight-line estimates
+	geocoder    Geocoder
+	travelTimes TravelTimeEstimator
+	depot       *LatLng
 }
 
 func NewAdminHandler(db *sql.DB, realtime RealtimeInterface) *AdminHandler {
 	return &AdminHandler{
-		db:        db,
-		realtime:  realtime,
-		getUserID: getUserIDFromRequest,
+		db:          db,
+		realtime:    realtime,
+		getUserID:   getUserIDFromRequest,
+		geocoder:    geocoderFromEnv(),
+		travelTimes: travelTimesFromEnv(),
+		depot:       routeDepotFromEnv(),
 	}
 }
 
@@ -65,7 +78,7 @@ func (h *AdminHandler) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		next(w, r)
+		h.audited(userID, next)(w, r)
 	}
 }
 
@@ -82,6 +95,7 @@ type AdminUserResponse struct {
 	CreatedAt          time.Time `json:"created_at"`
 	TotalOrders        int       `json:"total_orders"`
 	ActiveSubscription bool      `json:"active_subscription"`
+	IsSandbox          bool      `json:"is_sandbox"`
 }
 
 // handleGetUsers returns all users with optional filters
@@ -113,7 +127,8 @@ func (h *AdminHandler) handleGetUsers(w http.ResponseWriter, r *http.Request) {
 			u.id, u.email, u.first_name, u.last_name, u.phone, u.role, u.status,
 			u.email_verified_at IS NOT NULL as email_verified, u.created_at,
 			COUNT(DISTINCT o.id) as total_orders,
-			EXISTS(SELECT 1 FROM subscriptions s WHERE s.user_id = u.id AND s.status = 'active') as has_subscription
+			EXISTS(SELECT 1 FROM subscriptions s WHERE s.user_id = u.id AND s.status = 'active') as has_subscription,
+			u.is_sandbox
 		FROM users u
 		LEFT JOIN orders o ON u.id = o.user_id
 		WHERE 1=1`
@@ -127,6 +142,12 @@ func (h *AdminHandler) handleGetUsers(w http.ResponseWriter, r *http.Request) {
 		args = append(args, role)
 	}
 
+	if sandbox, err := strconv.ParseBool(r.URL.Query().Get("sandbox")); err == nil {
+		argCount++
+		query += fmt.Sprintf(" AND u.is_sandbox = $%d", argCount)
+		args = append(args, sandbox)
+	}
+
 	if search != "" {
 		argCount++
 		query += fmt.Sprintf(" AND (u.email ILIKE $%d OR u.first_name ILIKE $%d OR u.last_name ILIKE $%d)", argCount, argCount, argCount)
@@ -156,7 +177,7 @@ func (h *AdminHandler) handleGetUsers(w http.ResponseWriter, r *http.Request) {
 		var u AdminUserResponse
 		err := rows.Scan(
 			&u.ID, &u.Email, &u.FirstName, &u.LastName, &u.Phone, &u.Role, &u.Status,
-			&u.EmailVerified, &u.CreatedAt, &u.TotalOrders, &u.ActiveSubscription,
+			&u.EmailVerified, &u.CreatedAt, &u.TotalOrders, &u.ActiveSubscription, &u.IsSandbox,
 		)
 		if err != nil {
 			continue
@@ -199,16 +220,25 @@ func (h *AdminHandler) handleUpdateUserRole(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Validate role
-	if req.Role != "customer" && req.Role != "driver" && req.Role != "admin" {
+	if exists, err := roleExists(h.db, req.Role); err != nil || !exists {
 		http.Error(w, "Invalid role", http.StatusBadRequest)
 		return
 	}
+	if !h.checkAdminGrant(w, r, req.Role, userID) {
+		return
+	}
+	editorID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	_, err = h.db.Exec("UPDATE users SET role = $1 WHERE id = $2", req.Role, userID)
+	err = updateTrackedProfile(h.db, userID, editorID, "UPDATE users SET role = $1 WHERE id = $2", req.Role, userID)
 	if err != nil {
 		http.Error(w, "Failed to update user role", http.StatusInternalServerError)
 		return
 	}
+	h.userSync.notifyUser("user.updated", userID)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Role updated successfully"})
@@ -235,6 +265,7 @@ func (h *AdminHandler) handleCreateUser(w http.ResponseWriter, r *http.Request)
 		Phone     string `json:"phone"`
 		Role      string `json:"role"`
 		Status    string `json:"status"`
+		IsSandbox bool   `json:"is_sandbox"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -253,9 +284,12 @@ func (h *AdminHandler) handleCreateUser(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Validate role
-	if req.Role != "customer" && req.Role != "driver" && req.Role != "admin" {
+	if exists, err := roleExists(h.db, req.Role); err != nil || !exists {
 		logger.Warn("Invalid role provided", "role", req.Role)
-		http.Error(w, "Role must be customer, driver, or admin", http.StatusBadRequest)
+		http.Error(w, "Role must be customer, driver, admin or a custom role", http.StatusBadRequest)
+		return
+	}
+	if !h.checkAdminGrant(w, r, req.Role, 0) {
 		return
 	}
 
@@ -290,10 +324,10 @@ func (h *AdminHandler) handleCreateUser(w http.ResponseWriter, r *http.Request)
 
 	var userID int
 	err = h.db.QueryRow(`
-		INSERT INTO users (email, password_hash, first_name, last_name, phone, role, status, email_verified_at, created_at)
-		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		INSERT INTO users (email, password_hash, first_name, last_name, phone, role, status, is_sandbox, email_verified_at, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
 		RETURNING id
-	`, req.Email, hashedPassword, req.FirstName, req.LastName, req.Phone, req.Role, req.Status).Scan(&userID)
+	`, req.Email, hashedPassword, req.FirstName, req.LastName, req.Phone, req.Role, req.Status, req.IsSandbox).Scan(&userID)
 
 	if err != nil {
 		logger.Error("Failed to insert user into database", "error", err, "email", req.Email, "role", req.Role)
@@ -302,6 +336,7 @@ func (h *AdminHandler) handleCreateUser(w http.ResponseWriter, r *http.Request)
 	}
 
 	logger.Info("Successfully created user", "user_id", userID, "email", req.Email, "role", req.Role)
+	h.userSync.notifyUser("user.created", userID)
 
 	// Return the created user
 	var phone *string
@@ -321,6 +356,7 @@ func (h *AdminHandler) handleCreateUser(w http.ResponseWriter, r *http.Request)
 		CreatedAt:     time.Now(),
 		TotalOrders:   0,
 		ActiveSubscription: false,
+		IsSandbox:     req.IsSandbox,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -372,10 +408,13 @@ func (h *AdminHandler) handleUpdateUser(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Validate role
-	if req.Role != "customer" && req.Role != "driver" && req.Role != "admin" {
+	if exists, err := roleExists(h.db, req.Role); err != nil || !exists {
 		http.Error(w, "Invalid role", http.StatusBadRequest)
 		return
 	}
+	if !h.checkAdminGrant(w, r, req.Role, userID) {
+		return
+	}
 
 	// Validate status
 	if req.Status != "active" && req.Status != "inactive" && req.Status != "suspended" {
@@ -394,6 +433,18 @@ func (h *AdminHandler) handleUpdateUser(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Version the profile so customers can see who changed it
+	editorID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	before, err := snapshotProfile(h.db, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
 	// Update user
 	_, err = h.db.Exec(`
 		UPDATE users 
@@ -406,6 +457,16 @@ func (h *AdminHandler) handleUpdateUser(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	after, err := snapshotProfile(h.db, userID)
+	if err == nil {
+		err = recordAccountChange(h.db, userID, editorID, "profile", userID, before, after)
+	}
+	if err != nil {
+		http.Error(w, "Failed to record profile history", http.StatusInternalServerError)
+		return
+	}
+	h.userSync.notifyUser("user.updated", userID)
+
 	// Return the updated user
 	var user AdminUserResponse
 	err = h.db.QueryRow(`
@@ -413,14 +474,15 @@ func (h *AdminHandler) handleUpdateUser(w http.ResponseWriter, r *http.Request)
 			u.id, u.email, u.first_name, u.last_name, u.phone, u.role, u.status,
 			u.email_verified_at IS NOT NULL as email_verified, u.created_at,
 			COUNT(DISTINCT o.id) as total_orders,
-			EXISTS(SELECT 1 FROM subscriptions s WHERE s.user_id = u.id AND s.status = 'active') as has_subscription
+			EXISTS(SELECT 1 FROM subscriptions s WHERE s.user_id = u.id AND s.status = 'active') as has_subscription,
+			u.is_sandbox
 		FROM users u
 		LEFT JOIN orders o ON u.id = o.user_id
 		WHERE u.id = $1
 		GROUP BY u.id
 	`, userID).Scan(
 		&user.ID, &user.Email, &user.FirstName, &user.LastName, &user.Phone, &user.Role, &user.Status,
-		&user.EmailVerified, &user.CreatedAt, &user.TotalOrders, &user.ActiveSubscription,
+		&user.EmailVerified, &user.CreatedAt, &user.TotalOrders, &user.ActiveSubscription, &user.IsSandbox,
 	)
 
 	if err != nil {
@@ -428,8 +490,12 @@ func (h *AdminHandler) handleUpdateUser(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Show the admin exactly what their edit changed
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(struct {
+		AdminUserResponse
+		Changes []FieldChange `json:"changes"`
+	}{user, fieldChanges(before, after)})
 }
 
 // handleUpdateUserStatus updates a user's status
@@ -484,11 +550,14 @@ func (h *AdminHandler) handleUpdateUserStatus(w http.ResponseWriter, r *http.Req
 		http.Error(w, "You cannot change your own account status", http.StatusForbidden)
 		return
 	}
+	if !h.checkAdminGrant(w, r, "", userID) {
+		return
+	}
 
 	logger.Info("Updating user status", "target_user_id", userID, "new_status", req.Status)
 
 	// Update user status
-	_, err = h.db.Exec("UPDATE users SET status = $1 WHERE id = $2", req.Status, userID)
+	err = updateTrackedProfile(h.db, userID, currentUserID, "UPDATE users SET status = $1 WHERE id = $2", req.Status, userID)
 	if err != nil {
 		logger.Error("Failed to update user status", "error", err, "target_user_id", userID, "status", req.Status)
 		http.Error(w, "Failed to update user status", http.StatusInternalServerError)
@@ -496,6 +565,7 @@ func (h *AdminHandler) handleUpdateUserStatus(w http.ResponseWriter, r *http.Req
 	}
 
 	logger.Info("Successfully updated user status", "target_user_id", userID, "new_status", req.Status)
+	h.userSync.notifyUser("user.updated", userID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -571,6 +641,24 @@ func (h *AdminHandler) handleDeleteUser(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Accounts under legal hold have to be preserved as they are
+	onHold, err := isOnLegalHold(h.db, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if onHold {
+		http.Error(w, "This user is under legal hold and cannot be deleted", http.StatusConflict)
+		return
+	}
+
+	// Capture the user's claims so the app can be told who was removed
+	claims, err := getUserSyncClaims(h.db, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
 	// Begin transaction for safe deletion
 	tx, err := h.db.Begin()
 	if err != nil {
@@ -625,6 +713,8 @@ func (h *AdminHandler) handleDeleteUser(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Failed to complete deletion", http.StatusInternalServerError)
 		return
 	}
+	claims.Status = "deleted"
+	h.userSync.notifyClaims("user.deleted", *claims)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "User deleted successfully"})
@@ -648,6 +738,11 @@ func (h *AdminHandler) handleGetOrdersSummary(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	marketID, ok := adminMarketFilter(w, r, h.db)
+	if !ok {
+		return
+	}
+
 	var summary AdminOrderSummary
 
 	// Get overall statistics
@@ -659,8 +754,8 @@ func (h *AdminHandler) handleGetOrdersSummary(w http.ResponseWriter, r *http.Req
 			COUNT(CASE WHEN status = 'delivered' THEN 1 END) as completed,
 			COALESCE(SUM(total), 0) as total_revenue
 		FROM orders
-		WHERE status != 'cancelled'
-	`).Scan(&summary.TotalOrders, &summary.PendingOrders, &summary.InProcessOrders,
+		WHERE status != 'cancelled' AND `+orderInMarket("orders", "$1")+`
+	`, marketID).Scan(&summary.TotalOrders, &summary.PendingOrders, &summary.InProcessOrders,
 		&summary.CompletedOrders, &summary.TotalRevenue)
 
 	if err != nil {
@@ -675,8 +770,8 @@ func (h *AdminHandler) handleGetOrdersSummary(w http.ResponseWriter, r *http.Req
 			COALESCE(SUM(total), 0) as today_revenue
 		FROM orders
 		WHERE DATE(created_at) = CURRENT_DATE
-		AND status != 'cancelled'
-	`).Scan(&summary.TodayOrders, &summary.TodayRevenue)
+		AND status != 'cancelled' AND `+orderInMarket("orders", "$1")+`
+	`, marketID).Scan(&summary.TodayOrders, &summary.TodayRevenue)
 
 	if err != nil {
 		// Non-critical error, just log and continue
@@ -717,9 +812,7 @@ func (h *AdminHandler) handleGetAllOrders(w http.ResponseWriter, r *http.Request
 		SELECT DISTINCT ON (o.id)
 			o.id, o.user_id, o.subscription_id, o.pickup_address_id, o.delivery_address_id,
 			o.status, o.total_weight, 
-			COALESCE(oi_totals.subtotal, 0) as subtotal,
-			ROUND(COALESCE(oi_totals.subtotal, 0) * 0.06, 2) as tax,
-			ROUND(COALESCE(oi_totals.subtotal, 0) * 1.06, 2) as total,
+			o.subtotal_cents, o.tax_cents, o.total_cents,
 			o.special_instructions,
 			o.pickup_date, o.delivery_date, o.pickup_time_slot, o.delivery_time_slot,
 			o.created_at, o.updated_at,
@@ -728,14 +821,10 @@ func (h *AdminHandler) handleGetAllOrders(w http.ResponseWriter, r *http.Request
 			latest_route.route_type, 
 			latest_route.driver_name,
 			COALESCE(latest_route.driver_id, 0) as driver_id,
-			CASE WHEN latest_route.route_id IS NOT NULL THEN true ELSE false END as is_assigned
+			CASE WHEN latest_route.route_id IS NOT NULL THEN true ELSE false END as is_assigned,
+			COALESCE((SELECT SUM(rf.amount_cents) FROM refunds rf WHERE rf.order_id = o.id AND rf.status = 'succeeded'), 0) as refunded_cents
 		FROM orders o
 		JOIN users u ON o.user_id = u.id
-		LEFT JOIN (
-			SELECT order_id, SUM(price * quantity) as subtotal
-			FROM order_items
-			GROUP BY order_id
-		) oi_totals ON o.id = oi_totals.order_id
 		LEFT JOIN (
 			SELECT DISTINCT ON (ro.order_id)
 				ro.order_id,
@@ -771,6 +860,16 @@ func (h *AdminHandler) handleGetAllOrders(w http.ResponseWriter, r *http.Request
 		args = append(args, userID)
 	}
 
+	marketID, ok := adminMarketFilter(w, r, h.db)
+	if !ok {
+		return
+	}
+	if marketID != nil {
+		argCount++
+		query += " AND " + orderInMarket("o", fmt.Sprintf("$%d", argCount))
+		args = append(args, *marketID)
+	}
+
 	query += " ORDER BY o.id, o.created_at DESC"
 
 	argCount++
@@ -797,28 +896,45 @@ func (h *AdminHandler) handleGetAllOrders(w http.ResponseWriter, r *http.Request
 		DriverName  *string `json:"driver_name,omitempty"`
 		DriverID    *int    `json:"driver_id,omitempty"`
 		IsAssigned  bool    `json:"is_assigned"`
+		RefundedAmount float64 `json:"refunded_amount"`
 	}
 
 	orders := []AdminOrder{}
 	for rows.Next() {
 		var o AdminOrder
 		var firstName, lastName string
+		var subtotalCents, taxCents, totalCents sql.NullInt64
+		var refundedCents int
 		err := rows.Scan(
 			&o.ID, &o.UserID, &o.SubscriptionID, &o.PickupAddressID, &o.DeliveryAddressID,
-			&o.Status, &o.TotalWeight, &o.Subtotal, &o.Tax, &o.Total, &o.SpecialInstructions,
+			&o.Status, &o.TotalWeight, &subtotalCents, &taxCents, &totalCents, &o.SpecialInstructions,
 			&o.PickupDate, &o.DeliveryDate, &o.PickupTimeSlot, &o.DeliveryTimeSlot,
 			&o.CreatedAt, &o.UpdatedAt,
 			&o.UserEmail, &firstName, &lastName,
-			&o.RouteID, &o.RouteType, &o.DriverName, &o.DriverID, &o.IsAssigned,
+			&o.RouteID, &o.RouteType, &o.DriverName, &o.DriverID, &o.IsAssigned, &refundedCents,
 		)
 		if err != nil {
 			continue
 		}
 		o.UserName = firstName + " " + lastName
+		o.RefundedAmount = centsToDollars(refundedCents)
+		if subtotalCents.Valid {
+			subtotal := centsToDollars(int(subtotalCents.Int64))
+			o.Subtotal = &subtotal
+		}
+		if taxCents.Valid {
+			tax := centsToDollars(int(taxCents.Int64))
+			o.Tax = &tax
+		}
+		if totalCents.Valid {
+			total := centsToDollars(int(totalCents.Int64))
+			o.Total = &total
+		}
 
 		// Fetch order items for each order (same as in orders.go)
 		itemRows, err := h.db.Query(`
-			SELECT oi.id, oi.order_id, oi.service_id, s.name, oi.quantity, oi.weight, oi.price_cents, oi.notes
+			SELECT oi.id, oi.order_id, oi.service_id, s.name, oi.quantity, oi.weight, oi.price_cents, oi.notes,
+			       `+itemOptionColumns+`, oi.options_price_cents
 			FROM order_items oi
 			JOIN services s ON oi.service_id = s.id
 			WHERE oi.order_id = $1`,
@@ -828,14 +944,17 @@ func (h *AdminHandler) handleGetAllOrders(w http.ResponseWriter, r *http.Request
 			o.Items = []OrderItem{}
 			for itemRows.Next() {
 				var item OrderItem
-				var priceCents int
+				var priceCents, optionsCents int
+				var opts ItemOptions
 				err := itemRows.Scan(
 					&item.ID, &item.OrderID, &item.ServiceID, &item.ServiceName,
 					&item.Quantity, &item.Weight, &priceCents, &item.Notes,
+					&opts.Detergent, &opts.WaterTemperature, &opts.HangDry, &opts.FoldStyle, &opts.AllergySafe, &optionsCents,
 				)
 				if err == nil {
 					// Convert cents to dollars for JSON response
-					item.Price = float64(priceCents) / 100.0
+					item.Price = centsToDollars(priceCents)
+					item.setOptions(opts, optionsCents)
 					o.Items = append(o.Items, item)
 				}
 			}
@@ -884,6 +1003,11 @@ func (h *AdminHandler) handleGetRevenueAnalytics(w http.ResponseWriter, r *http.
 		interval = "30 days"
 	}
 
+	marketID, ok := adminMarketFilter(w, r, h.db)
+	if !ok {
+		return
+	}
+
 	query := fmt.Sprintf(`
 		SELECT 
 			TO_CHAR(DATE(created_at), '%s') as period,
@@ -893,11 +1017,12 @@ func (h *AdminHandler) handleGetRevenueAnalytics(w http.ResponseWriter, r *http.
 		FROM orders
 		WHERE status != 'cancelled'
 		AND created_at >= CURRENT_DATE - INTERVAL '%s'
+		AND %s
 		GROUP BY period
 		ORDER BY period DESC
-	`, dateFormat, interval)
+	`, dateFormat, interval, orderInMarket("orders", "$1"))
 
-	rows, err := h.db.Query(query)
+	rows, err := h.db.Query(query, marketID)
 	if err != nil {
 		http.Error(w, "Failed to fetch analytics", http.StatusInternalServerError)
 		return
@@ -920,37 +1045,54 @@ func (h *AdminHandler) handleGetRevenueAnalytics(w http.ResponseWriter, r *http.
 
 // Driver Management
 type DriverStats struct {
-	DriverID        int     `json:"driver_id"`
-	DriverName      string  `json:"driver_name"`
-	TotalDeliveries int     `json:"total_deliveries"`
-	TodayDeliveries int     `json:"today_deliveries"`
-	AvgDeliveryTime float64 `json:"avg_delivery_time_minutes"`
-	Rating          float64 `json:"rating"`
+	DriverID        int      `json:"driver_id"`
+	DriverName      string   `json:"driver_name"`
+	TotalDeliveries int      `json:"total_deliveries"`
+	TodayDeliveries int      `json:"today_deliveries"`
+	AvgDeliveryTime *float64 `json:"avg_delivery_time_minutes"` // nil until a timed stop is completed
+	Rating          *float64 `json:"rating"`                    // nil until the driver is rated
+	RatingCount     int      `json:"rating_count"`
+	OrderRating     *float64 `json:"order_rating"` // Average rating of the orders they delivered
+	// Mileage and tolls logged this month, owed on top of commission
+	ExpensesThisMonth float64 `json:"expenses_this_month"`
+	MilesThisMonth    float64 `json:"miles_this_month"`
+	// When the summary these came from was last recomputed
+	StatsRefreshedAt *time.Time `json:"stats_refreshed_at"`
 }
 
-// handleGetDriverStats returns driver performance statistics
+// handleGetDriverStats returns driver performance statistics from the
+// driver_stats_summary table. Drivers the background refresh hasn't reached
+// yet show zeros and a null stats_refreshed_at.
 func (h *AdminHandler) handleGetDriverStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	// Day and month counts from a summary taken before midnight or the
+	// month's end no longer apply
 	query := `
 		SELECT 
 			u.id, u.first_name || ' ' || u.last_name as name,
-			COUNT(DISTINCT ro.order_id) as total_deliveries,
-			COUNT(DISTINCT CASE WHEN DATE(dr.route_date) = CURRENT_DATE THEN ro.order_id END) as today_deliveries,
-			0 as avg_delivery_time,
-			0 as rating
+			COALESCE(s.total_deliveries, 0),
+			CASE WHEN s.stats_date = CURRENT_DATE THEN s.today_deliveries ELSE 0 END,
+			s.avg_delivery_minutes, s.rating, COALESCE(s.rating_count, 0), s.order_rating,
+			CASE WHEN DATE_TRUNC('month', s.stats_date) = DATE_TRUNC('month', CURRENT_DATE)
+			     THEN s.expense_cents_this_month ELSE 0 END,
+			CASE WHEN DATE_TRUNC('month', s.stats_date) = DATE_TRUNC('month', CURRENT_DATE)
+			     THEN s.miles_this_month ELSE 0 END,
+			s.refreshed_at
 		FROM users u
-		LEFT JOIN driver_routes dr ON u.id = dr.driver_id
-		LEFT JOIN route_orders ro ON dr.id = ro.route_id AND ro.status = 'completed'
-		WHERE u.role = 'driver'
-		GROUP BY u.id, u.first_name, u.last_name
-		ORDER BY total_deliveries DESC
+		LEFT JOIN driver_stats_summary s ON s.driver_id = u.id
+		WHERE u.role = 'driver' AND ($1::int IS NULL OR u.home_market_id = $1)
+		ORDER BY 3 DESC, u.id
 	`
 
-	rows, err := h.db.Query(query)
+	marketID, ok := adminMarketFilter(w, r, h.db)
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(query, marketID)
 	if err != nil {
 		http.Error(w, "Failed to fetch driver stats", http.StatusInternalServerError)
 		return
@@ -960,13 +1102,16 @@ func (h *AdminHandler) handleGetDriverStats(w http.ResponseWriter, r *http.Reque
 	drivers := []DriverStats{}
 	for rows.Next() {
 		var d DriverStats
+		var expenseCents int
 		err := rows.Scan(
 			&d.DriverID, &d.DriverName, &d.TotalDeliveries,
-			&d.TodayDeliveries, &d.AvgDeliveryTime, &d.Rating,
+			&d.TodayDeliveries, &d.AvgDeliveryTime, &d.Rating, &d.RatingCount, &d.OrderRating,
+			&expenseCents, &d.MilesThisMonth, &d.StatsRefreshedAt,
 		)
 		if err != nil {
 			continue
 		}
+		d.ExpensesThisMonth = centsToDollars(expenseCents)
 		drivers = append(drivers, d)
 	}
 
@@ -974,7 +1119,8 @@ func (h *AdminHandler) handleGetDriverStats(w http.ResponseWriter, r *http.Reque
 	json.NewEncoder(w).Encode(drivers)
 }
 
-// handleAssignDriverToRoute assigns a driver to orders
+// handleAssignDriverToRoute assigns a driver to orders. Without a driver_id
+// nothing is created and the drivers suggested for the route are returned.
 func (h *AdminHandler) handleAssignDriverToRoute(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -982,10 +1128,16 @@ func (h *AdminHandler) handleAssignDriverToRoute(w http.ResponseWriter, r *http.
 	}
 
 	var req struct {
-		DriverID  int    `json:"driver_id"`
+		DriverID  int    `json:"driver_id"` // Leave out to get suggestions
 		OrderIDs  []int  `json:"order_ids"`
 		RouteDate string `json:"route_date"`
 		RouteType string `json:"route_type"` // "pickup" or "delivery"
+		// Optional: the labor rules breaks follow, and a start time (HH:MM)
+		// to schedule breaks and ETAs from
+		Jurisdiction *string `json:"jurisdiction,omitempty"`
+		StartTime    string  `json:"start_time,omitempty"`
+		// Assign even if the driver's day goes over their capacity
+		AllowOverload bool `json:"allow_overload,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -999,6 +1151,76 @@ func (h *AdminHandler) handleAssignDriverToRoute(w http.ResponseWriter, r *http.
 		return
 	}
 
+	var startTime *time.Time
+	if req.StartTime != "" {
+		parsed, err := time.Parse("15:04", req.StartTime)
+		if err != nil {
+			http.Error(w, "start_time must be HH:MM", http.StatusBadRequest)
+			return
+		}
+		startTime = &parsed
+	}
+
+	if _, err := time.Parse("2006-01-02", req.RouteDate); err != nil {
+		http.Error(w, "route_date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	if req.DriverID == 0 {
+		suggestions, err := suggestDrivers(h.db, req.OrderIDs, req.RouteDate, req.RouteType)
+		if err != nil {
+			http.Error(w, "Failed to suggest drivers", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"suggested_drivers": suggestions,
+		})
+		return
+	}
+
+	// Drivers can't take routes until their onboarding checklist is done
+	pending, err := pendingOnboardingSteps(h.db, req.DriverID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(pending) > 0 {
+		http.Error(w, "Driver has not finished onboarding: "+strings.Join(pending, ", "), http.StatusConflict)
+		return
+	}
+
+	// Customers who blocked a driver never get them
+	blocked, err := ordersBlockingDriver(h.db, req.DriverID, req.OrderIDs)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(blocked) > 0 {
+		http.Error(w, fmt.Sprintf("Driver is blocked by the customers of orders %v", blocked), http.StatusConflict)
+		return
+	}
+	outside, err := ordersOutsideDriverMarket(h.db, req.DriverID, req.OrderIDs)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(outside) > 0 {
+		http.Error(w, fmt.Sprintf("Orders %v are outside the driver's market", outside), http.StatusConflict)
+		return
+	}
+
+	// Held orders aren't confirmed yet, so no driver should go out for them
+	held, err := ordersPendingReview(h.db, req.OrderIDs)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(held) > 0 {
+		http.Error(w, fmt.Sprintf("Orders pending review can't be routed: %v", held), http.StatusConflict)
+		return
+	}
+
 	// Begin transaction
 	tx, err := h.db.Begin()
 	if err != nil {
@@ -1007,14 +1229,46 @@ func (h *AdminHandler) handleAssignDriverToRoute(w http.ResponseWriter, r *http.
 	}
 	defer tx.Rollback()
 
+	// Don't plan a day the driver can't get through unless dispatch says to
+	if err := lockDriverLoad(tx, req.DriverID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	load, err := driverDayLoad(tx, req.DriverID, req.RouteDate, req.OrderIDs)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Driver not found", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if load.Overloaded() && !req.AllowOverload {
+		writeRouteOverloaded(w, load)
+		return
+	}
+	var overloadAcceptedBy *int
+	if load.Overloaded() {
+		adminID, err := h.getUserID(r, h.db)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		overloadAcceptedBy = &adminID
+	}
+
 	// Create driver route
 	var routeID int
 	err = tx.QueryRow(`
-		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
-		VALUES ($1, $2, $3, 'planned')
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status, jurisdiction, overload_accepted_by)
+		VALUES ($1, $2, $3, 'planned', NULLIF($4, ''), $5)
 		RETURNING id
-	`, req.DriverID, req.RouteDate, req.RouteType).Scan(&routeID)
+	`, req.DriverID, req.RouteDate, req.RouteType, req.Jurisdiction, overloadAcceptedBy).Scan(&routeID)
 
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" && req.Jurisdiction != nil {
+		http.Error(w, "Unknown jurisdiction", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to create route", http.StatusInternalServerError)
 		return
@@ -1033,15 +1287,28 @@ func (h *AdminHandler) handleAssignDriverToRoute(w http.ResponseWriter, r *http.
 		}
 	}
 
+	// Place the breaks the route's labor rules call for
+	if _, err := scheduleRoute(tx, routeID, startTime, true); err != nil {
+		http.Error(w, "Failed to schedule route", http.StatusInternalServerError)
+		return
+	}
+
+	// The new route isn't visible outside the transaction yet, so it's
+	// logged as created
+	setAuditTarget(r, h.db, "routes", routeID)
 	if err := tx.Commit(); err != nil {
 		http.Error(w, "Failed to complete assignment", http.StatusInternalServerError)
 		return
 	}
+	if load.Overloaded() {
+		alertRouteOverloaded(h.db, routeID, load)
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":  "Route created successfully",
 		"route_id": routeID,
+		"load":     load,
 	})
 }
 
@@ -1053,9 +1320,10 @@ func (h *AdminHandler) handleBulkOrderStatusUpdate(w http.ResponseWriter, r *htt
 	}
 
 	var req struct {
-		OrderIDs []int  `json:"order_ids"`
-		Status   string `json:"status"`
-		Notes    string `json:"notes,omitempty"`
+		OrderIDs              []int  `json:"order_ids"`
+		Status                string `json:"status"`
+		Notes                 string `json:"notes,omitempty"`
+		SuppressNotifications bool   `json:"suppress_notifications,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -1064,15 +1332,8 @@ func (h *AdminHandler) handleBulkOrderStatusUpdate(w http.ResponseWriter, r *htt
 	}
 
 	// Validate status
-	validStatuses := []string{"pending", "scheduled", "picked_up", "in_process", "ready", "out_for_delivery", "delivered", "cancelled"}
-	isValidStatus := false
-	for _, status := range validStatuses {
-		if req.Status == status {
-			isValidStatus = true
-			break
-		}
-	}
-	if !isValidStatus {
+	// Admins may move orders to any status, so transitions aren't enforced here
+	if !isValidOrderStatus(req.Status) {
 		http.Error(w, "Invalid status", http.StatusBadRequest)
 		return
 	}
@@ -1098,47 +1359,70 @@ func (h *AdminHandler) handleBulkOrderStatusUpdate(w http.ResponseWriter, r *htt
 	defer tx.Rollback()
 
 	updatedCount := 0
+	// Remember who owns each updated order so they can be notified after commit
+	orderOwners := make(map[int]int)
+	// Each order's status before and after, for the audit log
+	previousStatuses := make(map[string]string)
+	newStatuses := make(map[string]string)
 	// Update each order
 	for _, orderID := range req.OrderIDs {
 		// Update order status
-		result, err := tx.Exec(`
-			UPDATE orders 
+		var orderUserID int
+		var previousStatus string
+		err := tx.QueryRow(`
+			UPDATE orders o
 			SET status = $1, updated_at = CURRENT_TIMESTAMP 
-			WHERE id = $2
-		`, req.Status, orderID)
+			FROM (SELECT id, status FROM orders WHERE id = $2 FOR UPDATE) prev
+			WHERE o.id = prev.id
+			RETURNING o.user_id, prev.status
+		`, req.Status, orderID).Scan(&orderUserID, &previousStatus)
 
 		if err != nil {
 			continue // Skip failed updates but don't fail the whole operation
 		}
 
-		if affected, _ := result.RowsAffected(); affected > 0 {
-			updatedCount++
+		updatedCount++
+		orderOwners[orderID] = orderUserID
+		previousStatuses[strconv.Itoa(orderID)] = previousStatus
+		newStatuses[strconv.Itoa(orderID)] = req.Status
 
-			// Add status history entry
-			notes := req.Notes
-			if notes == "" {
-				notes = fmt.Sprintf("Bulk status update to %s", req.Status)
-			}
+		// Add status history entry
+		notes := req.Notes
+		if notes == "" {
+			notes = fmt.Sprintf("Bulk status update to %s", req.Status)
+		}
 
-			_, err = tx.Exec(`
-				INSERT INTO order_status_history (order_id, status, notes, updated_by)
-				VALUES ($1, $2, $3, $4)
-			`, orderID, req.Status, notes, userID)
+		_, err = tx.Exec(`
+			INSERT INTO order_status_history (order_id, status, notes, updated_by)
+			VALUES ($1, $2, $3, $4)
+		`, orderID, req.Status, notes, userID)
 
-			// Don't fail if history insert fails
-		}
+		// Don't fail if history insert fails
 	}
 
 	if err := tx.Commit(); err != nil {
 		http.Error(w, "Failed to complete bulk update", http.StatusInternalServerError)
 		return
 	}
+	setAuditChange(r, previousStatuses, newStatuses)
+	before, _ := json.Marshal(previousStatuses)
+	after, _ := json.Marshal(newStatuses)
+
+	// Notify customers unless this is a correction that shouldn't reach them
+	if notifier := notifierFor(h.realtime, req.SuppressNotifications); notifier != nil {
+		message := orderStatusMessage(req.Status)
+		for orderID, orderUserID := range orderOwners {
+			notifier.PublishOrderUpdate(orderUserID, orderID, req.Status, message, nil)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":        "Bulk status update completed",
 		"updated_count":  updatedCount,
 		"total_orders":   len(req.OrderIDs),
+		// Keyed by order ID, each order's status before and after
+		"changes":        fieldChanges(before, after),
 	})
 }
 
@@ -1151,6 +1435,12 @@ func (h *AdminHandler) handleGetRouteOptimizationSuggestions(w http.ResponseWrit
 
 	var req struct {
 		OrderIDs []int `json:"order_ids"`
+		// The optimized route covers these orders' pickups (default) or deliveries
+		RouteType string  `json:"route_type"`
+		StartTime string  `json:"start_time"` // HH:MM, default 08:00
+		Start     *LatLng `json:"start"`      // Defaults to the depot
+		// Labor rules the route's breaks follow, default if left out
+		Jurisdiction string `json:"jurisdiction,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -1162,6 +1452,21 @@ func (h *AdminHandler) handleGetRouteOptimizationSuggestions(w http.ResponseWrit
 		http.Error(w, "No orders specified", http.StatusBadRequest)
 		return
 	}
+	if req.RouteType == "" {
+		req.RouteType = "pickup"
+	}
+	if !validRouteType(req.RouteType) {
+		http.Error(w, "route_type must be pickup or delivery", http.StatusBadRequest)
+		return
+	}
+	startTime, err := parseRouteStartTime(req.StartTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Start == nil {
+		req.Start = h.depot
+	}
 
 	// Get orders with addresses
 	rows, err := h.db.Query(`
@@ -1200,6 +1505,24 @@ func (h *AdminHandler) handleGetRouteOptimizationSuggestions(w http.ResponseWrit
 		orders = append(orders, order)
 	}
 
+	policy, err := jurisdictionPolicy(h.db, req.Jurisdiction)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown jurisdiction", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load break policy: %v", err)
+		http.Error(w, "Failed to optimize route", http.StatusInternalServerError)
+		return
+	}
+
+	optimized, err := h.optimizeRoute(r.Context(), req.OrderIDs, req.RouteType, startTime, req.Start, policy)
+	if err != nil {
+		log.Printf("Failed to optimize route: %v", err)
+		http.Error(w, "Failed to optimize route", http.StatusInternalServerError)
+		return
+	}
+
 	// Enhanced optimization suggestions
 	suggestions := map[string]interface{}{
 		"orders": orders,
@@ -1211,7 +1534,7 @@ func (h *AdminHandler) handleGetRouteOptimizationSuggestions(w http.ResponseWrit
 			},
 			{
 				"type": "geographic_clusters",
-				"message": "Groups orders by geographic proximity for both pickup and delivery locations. Minimizes driving distance between stops.",
+				"message": "Groups orders by pickup and delivery ZIP code. See optimized_route for a driving order.",
 				"groups": groupOrdersByGeographicClusters(orders),
 			},
 			{
@@ -1220,6 +1543,7 @@ func (h *AdminHandler) handleGetRouteOptimizationSuggestions(w http.ResponseWrit
 				"groups": groupOrdersByTimeSlot(orders),
 			},
 		},
+		"optimized_route": optimized,
 		"total_orders": len(orders),
 	}
 
@@ -1282,6 +1606,8 @@ type OrderResolution struct {
 	CreditAmount   *float64  `json:"credit_amount,omitempty"`
 	Notes          string    `json:"notes"`
 	CreatedAt      time.Time `json:"created_at"`
+	// Refund is the Stripe refund a refund resolution issued
+	Refund *Refund `json:"refund,omitempty"`
 }
 
 type CreateOrderResolutionRequest struct {
@@ -1291,6 +1617,8 @@ type CreateOrderResolutionRequest struct {
 	RefundAmount   *float64 `json:"refund_amount,omitempty"`
 	CreditAmount   *float64 `json:"credit_amount,omitempty"`
 	Notes          string   `json:"notes"`
+	// SuppressNotifications skips the customer notification for corrections
+	SuppressNotifications bool `json:"suppress_notifications,omitempty"`
 }
 
 // handleCreateOrderResolution creates a resolution for a failed order
@@ -1311,6 +1639,7 @@ func (h *AdminHandler) handleCreateOrderResolution(w http.ResponseWriter, r *htt
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	setAuditTarget(r, h.db, "orders", req.OrderID)
 
 	// Validate resolution type
 	validTypes := map[string]bool{
@@ -1330,10 +1659,14 @@ func (h *AdminHandler) handleCreateOrderResolution(w http.ResponseWriter, r *htt
 		http.Error(w, "Reschedule date is required for reschedule resolution", http.StatusBadRequest)
 		return
 	}
-	if (req.ResolutionType == "partial_refund" || req.ResolutionType == "full_refund") && req.RefundAmount == nil {
+	// Full refunds return whatever is left on the order's payment
+	if req.ResolutionType == "partial_refund" && req.RefundAmount == nil {
 		http.Error(w, "Refund amount is required for refund resolution", http.StatusBadRequest)
 		return
 	}
+	if req.ResolutionType == "full_refund" {
+		req.RefundAmount = nil
+	}
 	if req.ResolutionType == "credit" && req.CreditAmount == nil {
 		http.Error(w, "Credit amount is required for credit resolution", http.StatusBadRequest)
 		return
@@ -1350,12 +1683,13 @@ func (h *AdminHandler) handleCreateOrderResolution(w http.ResponseWriter, r *htt
 	// Verify order exists and is failed
 	var orderStatus string
 	var userEmail string
+	var orderUserID int
 	err = tx.QueryRow(`
-		SELECT o.status, u.email
+		SELECT o.status, u.email, o.user_id
 		FROM orders o
 		JOIN users u ON o.user_id = u.id
 		WHERE o.id = $1
-	`, req.OrderID).Scan(&orderStatus, &userEmail)
+	`, req.OrderID).Scan(&orderStatus, &userEmail, &orderUserID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Order not found", http.StatusNotFound)
@@ -1369,6 +1703,7 @@ func (h *AdminHandler) handleCreateOrderResolution(w http.ResponseWriter, r *htt
 		http.Error(w, "Order is not in failed status", http.StatusBadRequest)
 		return
 	}
+	orderBefore := auditSnapshot(tx, "orders", strconv.Itoa(req.OrderID))
 
 	// Insert order resolution
 	var resolution OrderResolution
@@ -1414,28 +1749,85 @@ func (h *AdminHandler) handleCreateOrderResolution(w http.ResponseWriter, r *htt
 		return
 	}
 
-	// TODO: Process refunds/credits through payment system
+	// Credit resolutions go on the customer's account for their next order
+	if req.ResolutionType == "credit" {
+		creditCents := dollarsToCents(*req.CreditAmount)
+		if creditCents <= 0 || creditCents > maxCreditGrantCents {
+			http.Error(w, fmt.Sprintf("Credit amount must be between $0.01 and %s", money.Format(maxCreditGrantCents)), http.StatusBadRequest)
+			return
+		}
+		reason := fmt.Sprintf("Resolution for order #%d", req.OrderID)
+		if req.Notes != "" {
+			reason += ": " + req.Notes
+		}
+		if _, err := addCredit(tx, orderUserID, creditCents, "resolution", reason, &userID, &req.OrderID, &resolution.ID); err != nil {
+			http.Error(w, "Failed to credit customer", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Refunds are reserved here and sent to Stripe once the resolution commits
+	var refundID int
+	if req.ResolutionType == "partial_refund" || req.ResolutionType == "full_refund" {
+		amountCents := 0
+		if req.RefundAmount != nil {
+			if amountCents = dollarsToCents(*req.RefundAmount); amountCents <= 0 {
+				http.Error(w, "Refund amount must be positive", http.StatusBadRequest)
+				return
+			}
+		}
+		reason := fmt.Sprintf("Resolution for order #%d", req.OrderID)
+		if req.Notes != "" {
+			reason += ": " + req.Notes
+		}
+		refundID, amountCents, err = reserveRefund(tx, req.OrderID, amountCents, reason, &userID, &resolution.ID)
+		if err == errNoRefundablePayment || err == errRefundTooLarge {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to create refund", http.StatusInternalServerError)
+			return
+		}
+		refundAmount := centsToDollars(amountCents)
+		resolution.RefundAmount = &refundAmount
+		if _, err := tx.Exec("UPDATE order_resolutions SET refund_amount = $1 WHERE id = $2", refundAmount, resolution.ID); err != nil {
+			http.Error(w, "Failed to create resolution", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// TODO: Send notification to customer
 
 	// Send real-time update
-	if h.realtime != nil {
-		// Get user ID for the order
-		var orderUserID int
-		err = tx.QueryRow("SELECT user_id FROM orders WHERE id = $1", req.OrderID).Scan(&orderUserID)
-		if err == nil {
-			statusMessage := fmt.Sprintf("Order resolution: %s", req.ResolutionType)
-			h.realtime.PublishOrderUpdate(orderUserID, req.OrderID, newStatus, statusMessage, nil)
-		}
+	if notifier := notifierFor(h.realtime, req.SuppressNotifications); notifier != nil {
+		statusMessage := fmt.Sprintf("Order resolution: %s", req.ResolutionType)
+		notifier.PublishOrderUpdate(orderUserID, req.OrderID, newStatus, statusMessage, nil)
 	}
 
+	orderAfter := auditSnapshot(tx, "orders", strconv.Itoa(req.OrderID))
+
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
 		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
 		return
 	}
 
+	// A refund Stripe rejects is flagged for an admin and can be retried from
+	// the order, so it doesn't undo the resolution
+	if refundID != 0 {
+		if resolution.Refund, err = submitRefund(h.db, refundID); err != nil {
+			http.Error(w, "Failed to record refund", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Changes are what the resolution did to the order itself
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resolution)
+	json.NewEncoder(w).Encode(struct {
+		OrderResolution
+		Changes []FieldChange `json:"changes"`
+	}{resolution, fieldChanges(orderBefore, orderAfter)})
 }
 
 // handleGetOrderResolutions gets all resolutions for an order
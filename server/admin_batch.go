@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxBatchActions bounds how much work one batch request can hold a
+// transaction open for
+const maxBatchActions = 200
+
+// BatchAction is one item in an admin batch. Which fields are used depends
+// on Type:
+//   - update_status: OrderID, Status and optional Notes
+//   - assign_route: OrderID and RouteID; the order becomes the route's last
+//     stop, as long as the driver's day stays within their capacity
+//   - add_note: OrderID and Notes
+type BatchAction struct {
+	Type    string `json:"type"`
+	OrderID int    `json:"order_id"`
+	Status  string `json:"status,omitempty"`
+	RouteID int    `json:"route_id,omitempty"`
+	Notes   string `json:"notes,omitempty"`
+}
+
+type BatchRequest struct {
+	Actions               []BatchAction `json:"actions"`
+	SuppressNotifications bool          `json:"suppress_notifications,omitempty"`
+}
+
+// BatchActionResult reports what happened to one action. Result is
+// "applied", "failed", "rolled_back" (it worked but another action failed),
+// or "not_run" (it came after the failure).
+type BatchActionResult struct {
+	Index   int    `json:"index"`
+	Type    string `json:"type"`
+	OrderID int    `json:"order_id"`
+	Result  string `json:"result"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Committed bool                `json:"committed"`
+	Results   []BatchActionResult `json:"results"`
+}
+
+// batchActionError is a failure caused by the action itself rather than the
+// database, so its message is safe to show the admin
+type batchActionError struct{ msg string }
+
+func (e *batchActionError) Error() string { return e.msg }
+
+func batchFailure(format string, args ...interface{}) error {
+	return &batchActionError{msg: fmt.Sprintf(format, args...)}
+}
+
+// validate checks an action before anything runs, so a malformed batch is
+// rejected without touching the database
+func (a BatchAction) validate() error {
+	if a.OrderID <= 0 {
+		return batchFailure("order_id is required")
+	}
+	switch a.Type {
+	case "update_status":
+		// Admins may move orders to any status, as with bulk updates
+		if !isValidOrderStatus(a.Status) {
+			return batchFailure("invalid status %q", a.Status)
+		}
+	case "assign_route":
+		if a.RouteID <= 0 {
+			return batchFailure("route_id is required")
+		}
+	case "add_note":
+		if strings.TrimSpace(a.Notes) == "" {
+			return batchFailure("notes are required")
+		}
+	default:
+		return batchFailure("unknown action type %q", a.Type)
+	}
+	return nil
+}
+
+// statusChange is a status update to announce once the batch commits
+type statusChange struct {
+	userID  int
+	orderID int
+	status  string
+}
+
+// applyBatchAction runs one action inside the batch transaction. Status
+// changes are returned so customers are only notified after commit.
+func applyBatchAction(tx *sql.Tx, a BatchAction, adminID int) (*statusChange, error) {
+	switch a.Type {
+	case "update_status":
+		var orderUserID int
+		err := tx.QueryRow(`
+			UPDATE orders
+			SET status = $1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $2
+			RETURNING user_id`,
+			a.Status, a.OrderID,
+		).Scan(&orderUserID)
+		if err == sql.ErrNoRows {
+			return nil, batchFailure("order not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		notes := a.Notes
+		if notes == "" {
+			notes = fmt.Sprintf("Batch status update to %s", a.Status)
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO order_status_history (order_id, status, notes, updated_by)
+			VALUES ($1, $2, $3, $4)`,
+			a.OrderID, a.Status, notes, adminID,
+		); err != nil {
+			return nil, err
+		}
+		return &statusChange{userID: orderUserID, orderID: a.OrderID, status: a.Status}, nil
+
+	case "assign_route":
+		var routeStatus, routeDate string
+		var driverID int
+		err := tx.QueryRow(`
+			SELECT status, driver_id, TO_CHAR(route_date, 'YYYY-MM-DD')
+			FROM driver_routes WHERE id = $1 FOR UPDATE`,
+			a.RouteID,
+		).Scan(&routeStatus, &driverID, &routeDate)
+		if err == sql.ErrNoRows {
+			return nil, batchFailure("route not found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if routeStatus != "planned" && routeStatus != "in_progress" {
+			return nil, batchFailure("route is %s", routeStatus)
+		}
+		var orderStatus sql.NullString
+		var alreadyOnRoute bool
+		if err := tx.QueryRow(`
+			SELECT (SELECT status FROM orders WHERE id = $1),
+			       EXISTS (SELECT 1 FROM route_orders WHERE route_id = $2 AND order_id = $1)`,
+			a.OrderID, a.RouteID,
+		).Scan(&orderStatus, &alreadyOnRoute); err != nil {
+			return nil, err
+		}
+		if !orderStatus.Valid {
+			return nil, batchFailure("order not found")
+		}
+		if orderStatus.String == "pending_review" {
+			return nil, batchFailure("order is pending review")
+		}
+		if alreadyOnRoute {
+			return nil, batchFailure("order is already on route %d", a.RouteID)
+		}
+		blocked, err := ordersBlockingDriver(tx, driverID, []int{a.OrderID})
+		if err != nil {
+			return nil, err
+		}
+		if len(blocked) > 0 {
+			return nil, batchFailure("the customer has blocked the route's driver")
+		}
+		outside, err := ordersOutsideDriverMarket(tx, driverID, []int{a.OrderID})
+		if err != nil {
+			return nil, err
+		}
+		if len(outside) > 0 {
+			return nil, batchFailure("the order is outside the route driver's market")
+		}
+		if err := lockDriverLoad(tx, driverID); err != nil {
+			return nil, err
+		}
+		// Earlier actions in the batch count toward the driver's day too
+		load, err := driverDayLoad(tx, driverID, routeDate, []int{a.OrderID})
+		if err != nil {
+			return nil, err
+		}
+		if load.Overloaded() {
+			return nil, batchFailure("route would exceed the driver's capacity: %s", strings.Join(load.Warnings, "; "))
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO route_orders (route_id, order_id, sequence_number, status)
+			SELECT $1, $2, COALESCE(MAX(sequence_number), 0) + 1, 'pending'
+			FROM route_orders WHERE route_id = $1`,
+			a.RouteID, a.OrderID,
+		); err != nil {
+			return nil, err
+		}
+		// Keep breaks and ETAs in line with the longer route
+		if _, err := scheduleRoute(tx, a.RouteID, nil, true); err != nil {
+			return nil, err
+		}
+		return nil, nil
+
+	case "add_note":
+		// Notes live in the status history under the order's current status
+		result, err := tx.Exec(`
+			INSERT INTO order_status_history (order_id, status, notes, updated_by)
+			SELECT id, status, $2, $3 FROM orders WHERE id = $1`,
+			a.OrderID, strings.TrimSpace(a.Notes), adminID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return nil, batchFailure("order not found")
+		}
+		return nil, nil
+	}
+	return nil, batchFailure("unknown action type %q", a.Type)
+}
+
+// handleAdminBatch runs a list of admin actions in one transaction, so the
+// multi-select toolbar needs a single request. Either every action is
+// applied or none are; the per-item results say which action failed and why.
+func (h *AdminHandler) handleAdminBatch(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Actions) == 0 {
+		http.Error(w, "No actions specified", http.StatusBadRequest)
+		return
+	}
+	if len(req.Actions) > maxBatchActions {
+		http.Error(w, fmt.Sprintf("A batch can hold at most %d actions", maxBatchActions), http.StatusBadRequest)
+		return
+	}
+
+	resp := BatchResponse{Results: make([]BatchActionResult, len(req.Actions))}
+	invalid := false
+	for i, a := range req.Actions {
+		resp.Results[i] = BatchActionResult{Index: i, Type: a.Type, OrderID: a.OrderID, Result: "not_run"}
+		if err := a.validate(); err != nil {
+			resp.Results[i].Result = "failed"
+			resp.Results[i].Error = err.Error()
+			invalid = true
+		}
+	}
+	if invalid {
+		writeBatchResponse(w, http.StatusBadRequest, resp)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var changes []*statusChange
+	for i, a := range req.Actions {
+		change, err := applyBatchAction(tx, a, adminID)
+		if err != nil {
+			var actionErr *batchActionError
+			if !errors.As(err, &actionErr) {
+				LogRequest("admin_batch", r.Method, r.URL.Path, adminID).Error("Batch action failed", "error", err, "index", i, "type", a.Type)
+				err = errors.New("internal error")
+			}
+			for j := 0; j < i; j++ {
+				resp.Results[j].Result = "rolled_back"
+			}
+			resp.Results[i].Result = "failed"
+			resp.Results[i].Error = err.Error()
+			writeBatchResponse(w, http.StatusConflict, resp)
+			return
+		}
+		resp.Results[i].Result = "applied"
+		if change != nil {
+			changes = append(changes, change)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to complete batch", http.StatusInternalServerError)
+		return
+	}
+	resp.Committed = true
+
+	if notifier := notifierFor(h.realtime, req.SuppressNotifications); notifier != nil {
+		for _, c := range changes {
+			notifier.PublishOrderUpdate(c.userID, c.orderID, c.status, orderStatusMessage(c.status), nil)
+		}
+	}
+
+	writeBatchResponse(w, http.StatusOK, resp)
+}
+
+func writeBatchResponse(w http.ResponseWriter, status int, resp BatchResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler_Batch(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "batch-admin@example.com", "Batch", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	driverID := db.CreateTestUser(t, "batch-driver@example.com", "Batch", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "batch-customer@example.com", "Batch", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	firstOrderID := db.CreateTestOrder(t, customerID, addressID)
+	secondOrderID := db.CreateTestOrder(t, customerID, addressID)
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'planned')
+		RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+
+	handler := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	batch := func(body string) (int, BatchResponse) {
+		w := httptest.NewRecorder()
+		handler.handleAdminBatch(w, httptest.NewRequest("POST", "/api/v1/admin/batch", strings.NewReader(body)))
+		var resp BatchResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	historyCount := func() int {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM order_status_history WHERE order_id IN ($1, $2)", firstOrderID, secondOrderID).Scan(&n)
+		return n
+	}
+	initialHistory := historyCount()
+
+	// Malformed actions are rejected before anything runs
+	code, resp := batch(fmt.Sprintf(`{"actions": [
+		{"type": "add_note", "order_id": %d, "notes": "ok"},
+		{"type": "launch_rocket", "order_id": %d}
+	]}`, firstOrderID, secondOrderID))
+	if code != http.StatusBadRequest || resp.Results[0].Result != "not_run" || resp.Results[1].Result != "failed" {
+		t.Errorf("Expected the unknown action to fail validation, got %d %+v", code, resp.Results)
+	}
+
+	// A failure part way rolls back the actions before it
+	code, resp = batch(fmt.Sprintf(`{"suppress_notifications": true, "actions": [
+		{"type": "update_status", "order_id": %d, "status": "picked_up"},
+		{"type": "assign_route", "order_id": %d, "route_id": %d},
+		{"type": "add_note", "order_id": %d, "notes": "Never runs"}
+	]}`, firstOrderID, firstOrderID, routeID+1000, secondOrderID))
+	if code != http.StatusConflict || resp.Committed {
+		t.Fatalf("Expected status %d, got %d", http.StatusConflict, code)
+	}
+	if got := []string{resp.Results[0].Result, resp.Results[1].Result, resp.Results[2].Result}; got[0] != "rolled_back" || got[1] != "failed" || got[2] != "not_run" {
+		t.Errorf("Unexpected results: %v", got)
+	}
+	if resp.Results[1].Error != "route not found" {
+		t.Errorf("Expected a route not found error, got %q", resp.Results[1].Error)
+	}
+	var status string
+	db.QueryRow("SELECT status FROM orders WHERE id = $1", firstOrderID).Scan(&status)
+	if status != "scheduled" || historyCount() != initialHistory {
+		t.Errorf("Expected nothing to change, got status %s", status)
+	}
+
+	// A clean batch applies everything
+	code, resp = batch(fmt.Sprintf(`{"suppress_notifications": true, "actions": [
+		{"type": "update_status", "order_id": %d, "status": "picked_up"},
+		{"type": "assign_route", "order_id": %d, "route_id": %d},
+		{"type": "assign_route", "order_id": %d, "route_id": %d},
+		{"type": "add_note", "order_id": %d, "notes": "Gate code 4321"}
+	]}`, firstOrderID, firstOrderID, routeID, secondOrderID, routeID, secondOrderID))
+	if code != http.StatusOK || !resp.Committed {
+		t.Fatalf("Expected status %d, got %d: %+v", http.StatusOK, code, resp.Results)
+	}
+
+	db.QueryRow("SELECT status FROM orders WHERE id = $1", firstOrderID).Scan(&status)
+	if status != "picked_up" {
+		t.Errorf("Expected the order to be picked up, got %s", status)
+	}
+	var lastStop int
+	db.QueryRow("SELECT order_id FROM route_orders WHERE route_id = $1 ORDER BY sequence_number DESC LIMIT 1", routeID).Scan(&lastStop)
+	if lastStop != secondOrderID {
+		t.Errorf("Expected order %d to be the last stop, got %d", secondOrderID, lastStop)
+	}
+	var note string
+	db.QueryRow("SELECT status || ': ' || notes FROM order_status_history WHERE order_id = $1 ORDER BY id DESC LIMIT 1", secondOrderID).Scan(&note)
+	if note != "scheduled: Gate code 4321" {
+		t.Errorf("Expected the note under the current status, got %q", note)
+	}
+
+	// Assigning the same order twice fails
+	code, _ = batch(fmt.Sprintf(`{"actions": [{"type": "assign_route", "order_id": %d, "route_id": %d}]}`, firstOrderID, routeID))
+	if code != http.StatusConflict {
+		t.Errorf("Expected status %d for a duplicate stop, got %d", http.StatusConflict, code)
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"tumble-backend/money"
+
+	"github.com/gorilla/mux"
+)
+
+// How long a scheduled route can go unstarted, and a payment can wait on its
+// webhook, before admins are alerted
+const (
+	driverNoShowGrace     = 30 * time.Minute
+	stuckWebhookThreshold = time.Hour
+)
+
+var inboxSeverities = map[string]bool{"info": true, "warning": true, "critical": true}
+
+// AdminAlert is an event that lands in the admin inbox. DedupeKey identifies
+// the underlying event so repeated reports of it stay a single item.
+type AdminAlert struct {
+	Type      string
+	Severity  string
+	Title     string
+	Message   string
+	OrderID   *int
+	DedupeKey string
+	Data      interface{}
+}
+
+type AdminInboxItem struct {
+	ID             int              `json:"id"`
+	AlertType      string           `json:"alert_type"`
+	Severity       string           `json:"severity"`
+	Title          string           `json:"title"`
+	Message        string           `json:"message"`
+	Data           *json.RawMessage `json:"data,omitempty"`
+	OrderID        *int             `json:"order_id,omitempty"`
+	Status         string           `json:"status"`
+	AssignedTo     *int             `json:"assigned_to,omitempty"`
+	AssignedName   *string          `json:"assigned_name,omitempty"`
+	AcknowledgedBy *int             `json:"acknowledged_by,omitempty"`
+	AcknowledgedAt *time.Time       `json:"acknowledged_at,omitempty"`
+	ResolvedBy     *int             `json:"resolved_by,omitempty"`
+	ResolvedAt     *time.Time       `json:"resolved_at,omitempty"`
+	ResolutionNote *string          `json:"resolution_note,omitempty"`
+	IsRead         bool             `json:"is_read"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+// raiseAdminAlert records an alert in the admin inbox. It is a no-op while an
+// unresolved item with the same dedupe key exists.
+func raiseAdminAlert(q execer, alert AdminAlert) error {
+	severity := alert.Severity
+	if !inboxSeverities[severity] {
+		severity = "warning"
+	}
+
+	var data []byte
+	if alert.Data != nil {
+		var err error
+		if data, err = json.Marshal(alert.Data); err != nil {
+			return err
+		}
+	}
+
+	_, err := q.Exec(`
+		INSERT INTO admin_inbox_items (alert_type, severity, title, message, data, order_id, dedupe_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (dedupe_key) WHERE status <> 'resolved' DO NOTHING`,
+		alert.Type, severity, alert.Title, alert.Message, data, alert.OrderID, alert.DedupeKey,
+	)
+	return err
+}
+
+// logAdminAlert raises an alert from a code path that can't fail because of it
+func logAdminAlert(q execer, alert AdminAlert) {
+	if err := raiseAdminAlert(q, alert); err != nil {
+		log.Printf("Error raising admin alert %s: %v", alert.DedupeKey, err)
+	}
+}
+
+// processAdminAlerts looks for problems nothing else reports: drivers who
+// haven't started today's routes and payments whose webhook never arrived
+func (s *AutoScheduler) processAdminAlerts() {
+	rows, err := s.db.Query(`
+		SELECT dr.id, dr.driver_id, u.first_name || ' ' || u.last_name, dr.route_type, dr.estimated_start_time::text
+		FROM driver_routes dr
+		JOIN users u ON dr.driver_id = u.id
+		WHERE dr.route_date = CURRENT_DATE
+		  AND dr.status = 'planned'
+		  AND dr.actual_start_time IS NULL
+		  AND dr.estimated_start_time IS NOT NULL
+		  AND CURRENT_DATE + dr.estimated_start_time < LOCALTIMESTAMP - $1::interval`,
+		fmt.Sprintf("%d minutes", int(driverNoShowGrace.Minutes())),
+	)
+	if err != nil {
+		log.Printf("Error checking for driver no-shows: %v", err)
+	} else {
+		for rows.Next() {
+			var routeID, driverID int
+			var driverName, routeType, startTime string
+			if err := rows.Scan(&routeID, &driverID, &driverName, &routeType, &startTime); err != nil {
+				continue
+			}
+			logAdminAlert(s.db, AdminAlert{
+				Type:      "driver_no_show",
+				Severity:  "critical",
+				Title:     fmt.Sprintf("%s hasn't started their %s route", driverName, routeType),
+				Message:   fmt.Sprintf("Route %d was due to start at %s", routeID, startTime),
+				DedupeKey: fmt.Sprintf("driver_no_show:%d", routeID),
+				Data:      map[string]int{"route_id": routeID, "driver_id": driverID},
+			})
+		}
+		rows.Close()
+	}
+
+	rows, err = s.db.Query(`
+		SELECT id, order_id, stripe_payment_intent_id, amount_cents
+		FROM payments
+		WHERE status = 'pending'
+		  AND stripe_payment_intent_id IS NOT NULL
+		  AND created_at < $1`,
+		time.Now().Add(-stuckWebhookThreshold),
+	)
+	if err != nil {
+		log.Printf("Error checking for stuck payment webhooks: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var paymentID, amountCents int
+		var orderID *int
+		var paymentIntentID string
+		if err := rows.Scan(&paymentID, &orderID, &paymentIntentID, &amountCents); err != nil {
+			continue
+		}
+		logAdminAlert(s.db, AdminAlert{
+			Type:      "stuck_webhook",
+			Severity:  "warning",
+			Title:     "Payment is still pending",
+			Message:   fmt.Sprintf("No Stripe webhook has settled payment %s (%s)", paymentIntentID, money.Format(amountCents)),
+			OrderID:   orderID,
+			DedupeKey: fmt.Sprintf("stuck_webhook:%d", paymentID),
+		})
+	}
+}
+
+type AdminInboxHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewAdminInboxHandler(db *sql.DB) *AdminInboxHandler {
+	return &AdminInboxHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type AssignInboxItemRequest struct {
+	AdminID *int `json:"admin_id"` // null unassigns
+}
+
+type ResolveInboxItemRequest struct {
+	Note string `json:"note"`
+}
+
+func (h *AdminInboxHandler) getItem(itemID, adminID int) (*AdminInboxItem, error) {
+	items, err := h.queryItems("WHERE i.id = $2", adminID, itemID)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &items[0], nil
+}
+
+// queryItems loads inbox items with read state for adminID ($1)
+func (h *AdminInboxHandler) queryItems(where string, args ...interface{}) ([]AdminInboxItem, error) {
+	rows, err := h.db.Query(`
+		SELECT i.id, i.alert_type, i.severity, i.title, i.message, i.data, i.order_id, i.status,
+		       i.assigned_to, u.first_name || ' ' || u.last_name,
+		       i.acknowledged_by, i.acknowledged_at, i.resolved_by, i.resolved_at, i.resolution_note,
+		       r.item_id IS NOT NULL, i.created_at
+		FROM admin_inbox_items i
+		LEFT JOIN users u ON i.assigned_to = u.id
+		LEFT JOIN admin_inbox_reads r ON r.item_id = i.id AND r.admin_id = $1
+		`+where+`
+		ORDER BY i.created_at DESC
+		LIMIT 200`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []AdminInboxItem{}
+	for rows.Next() {
+		var item AdminInboxItem
+		var data []byte
+		if err := rows.Scan(
+			&item.ID, &item.AlertType, &item.Severity, &item.Title, &item.Message, &data, &item.OrderID, &item.Status,
+			&item.AssignedTo, &item.AssignedName,
+			&item.AcknowledgedBy, &item.AcknowledgedAt, &item.ResolvedBy, &item.ResolvedAt, &item.ResolutionNote,
+			&item.IsRead, &item.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		if data != nil {
+			raw := json.RawMessage(data)
+			item.Data = &raw
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// handleGetInbox lists inbox items. Filters: ?status= (default unresolved),
+// ?type=, ?assigned=me|unassigned and ?unread=true.
+func (h *AdminInboxHandler) handleGetInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	where := "WHERE 1=1"
+	args := []interface{}{adminID}
+
+	switch status := query.Get("status"); status {
+	case "":
+		where += " AND i.status <> 'resolved'"
+	case "all":
+	case "open", "acknowledged", "resolved":
+		args = append(args, status)
+		where += fmt.Sprintf(" AND i.status = $%d", len(args))
+	default:
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	if alertType := query.Get("type"); alertType != "" {
+		args = append(args, alertType)
+		where += fmt.Sprintf(" AND i.alert_type = $%d", len(args))
+	}
+	switch query.Get("assigned") {
+	case "":
+	case "me":
+		where += " AND i.assigned_to = $1"
+	case "unassigned":
+		where += " AND i.assigned_to IS NULL"
+	default:
+		http.Error(w, "Invalid assigned filter", http.StatusBadRequest)
+		return
+	}
+	if query.Get("unread") == "true" {
+		where += " AND r.item_id IS NULL"
+	}
+
+	items, err := h.queryItems(where, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch inbox", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// handleGetInboxCounts returns badge counts for the signed-in admin
+func (h *AdminInboxHandler) handleGetInboxCounts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var unread, assignedToMe, open, critical int
+	err = h.db.QueryRow(`
+		SELECT
+			COUNT(*) FILTER (WHERE r.item_id IS NULL),
+			COUNT(*) FILTER (WHERE i.assigned_to = $1),
+			COUNT(*) FILTER (WHERE i.status = 'open'),
+			COUNT(*) FILTER (WHERE i.severity = 'critical')
+		FROM admin_inbox_items i
+		LEFT JOIN admin_inbox_reads r ON r.item_id = i.id AND r.admin_id = $1
+		WHERE i.status <> 'resolved'`,
+		adminID,
+	).Scan(&unread, &assignedToMe, &open, &critical)
+	if err != nil {
+		http.Error(w, "Failed to fetch inbox counts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"unread":         unread,
+		"assigned_to_me": assignedToMe,
+		"open":           open,
+		"critical":       critical,
+	})
+}
+
+// handleMarkInboxRead marks one item, or with no {id} every item, as read
+func (h *AdminInboxHandler) handleMarkInboxRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if idStr, ok := mux.Vars(r)["id"]; ok {
+		itemID, err := strconv.Atoi(idStr)
+		if err != nil {
+			http.Error(w, "Invalid item ID", http.StatusBadRequest)
+			return
+		}
+		result, err := h.db.Exec(`
+			INSERT INTO admin_inbox_reads (item_id, admin_id)
+			SELECT id, $2 FROM admin_inbox_items WHERE id = $1
+			ON CONFLICT DO NOTHING`,
+			itemID, adminID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to mark item read", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			var exists bool
+			h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM admin_inbox_items WHERE id = $1)", itemID).Scan(&exists)
+			if !exists {
+				http.Error(w, "Inbox item not found", http.StatusNotFound)
+				return
+			}
+		}
+	} else {
+		_, err := h.db.Exec(`
+			INSERT INTO admin_inbox_reads (item_id, admin_id)
+			SELECT id, $1 FROM admin_inbox_items WHERE status <> 'resolved'
+			ON CONFLICT DO NOTHING`,
+			adminID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to mark items read", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAssignInboxItem assigns an item to an admin, or unassigns it
+func (h *AdminInboxHandler) handleAssignInboxItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	itemID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid item ID", http.StatusBadRequest)
+		return
+	}
+
+	var req AssignInboxItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.AdminID != nil {
+		ok, err := userHasPermission(h.db, *req.AdminID, "inbox.manage")
+		if err != nil || !ok {
+			http.Error(w, "Items can only be assigned to staff who can manage the inbox", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := h.db.Exec("UPDATE admin_inbox_items SET assigned_to = $1 WHERE id = $2", req.AdminID, itemID)
+	if err != nil {
+		http.Error(w, "Failed to assign item", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Inbox item not found", http.StatusNotFound)
+		return
+	}
+
+	h.respondWithItem(w, itemID, adminID)
+}
+
+// handleAcknowledgeInboxItem records that an admin is looking into an item
+func (h *AdminInboxHandler) handleAcknowledgeInboxItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	itemID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid item ID", http.StatusBadRequest)
+		return
+	}
+
+	// Acknowledging also claims unassigned items
+	result, err := h.db.Exec(`
+		UPDATE admin_inbox_items
+		SET status = 'acknowledged', acknowledged_by = $1, acknowledged_at = CURRENT_TIMESTAMP,
+		    assigned_to = COALESCE(assigned_to, $1)
+		WHERE id = $2 AND status = 'open'`,
+		adminID, itemID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to acknowledge item", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		h.respondWithStatusConflict(w, itemID, "Only open items can be acknowledged")
+		return
+	}
+	h.db.Exec("INSERT INTO admin_inbox_reads (item_id, admin_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", itemID, adminID)
+
+	h.respondWithItem(w, itemID, adminID)
+}
+
+// handleResolveInboxItem closes an item. A later alert for the same event
+// opens a new one.
+func (h *AdminInboxHandler) handleResolveInboxItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	itemID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid item ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ResolveInboxItemRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	var note *string
+	if req.Note != "" {
+		note = &req.Note
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE admin_inbox_items
+		SET status = 'resolved', resolved_by = $1, resolved_at = CURRENT_TIMESTAMP, resolution_note = $2
+		WHERE id = $3 AND status <> 'resolved'`,
+		adminID, note, itemID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to resolve item", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		h.respondWithStatusConflict(w, itemID, "Item is already resolved")
+		return
+	}
+	h.db.Exec("INSERT INTO admin_inbox_reads (item_id, admin_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", itemID, adminID)
+
+	h.respondWithItem(w, itemID, adminID)
+}
+
+// respondWithStatusConflict distinguishes a missing item from one in the wrong state
+func (h *AdminInboxHandler) respondWithStatusConflict(w http.ResponseWriter, itemID int, message string) {
+	var exists bool
+	h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM admin_inbox_items WHERE id = $1)", itemID).Scan(&exists)
+	if !exists {
+		http.Error(w, "Inbox item not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, message, http.StatusConflict)
+}
+
+func (h *AdminInboxHandler) respondWithItem(w http.ResponseWriter, itemID, adminID int) {
+	item, err := h.getItem(itemID, adminID)
+	if err != nil {
+		http.Error(w, "Failed to fetch inbox item", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
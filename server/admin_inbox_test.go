@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRaiseAdminAlert_Dedupes(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	alert := AdminAlert{
+		Type:      "payment_dispute",
+		Severity:  "critical",
+		Title:     "Customer disputed a charge",
+		Message:   "Dispute dp_123",
+		DedupeKey: "payment_dispute:dp_123",
+	}
+	for i := 0; i < 2; i++ {
+		if err := raiseAdminAlert(db.DB, alert); err != nil {
+			t.Fatalf("Failed to raise alert: %v", err)
+		}
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM admin_inbox_items WHERE dedupe_key = $1", alert.DedupeKey).Scan(&count)
+	if count != 1 {
+		t.Fatalf("Expected 1 inbox item for a repeated alert, got %d", count)
+	}
+
+	// Once resolved, the same event can be raised again
+	db.Exec("UPDATE admin_inbox_items SET status = 'resolved' WHERE dedupe_key = $1", alert.DedupeKey)
+	if err := raiseAdminAlert(db.DB, alert); err != nil {
+		t.Fatalf("Failed to raise alert: %v", err)
+	}
+	db.QueryRow("SELECT COUNT(*) FROM admin_inbox_items WHERE dedupe_key = $1", alert.DedupeKey).Scan(&count)
+	if count != 2 {
+		t.Errorf("Expected a new inbox item after resolving, got %d items", count)
+	}
+}
+
+func TestAdminInbox_AcknowledgeAndResolve(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "inbox-admin@example.com", "Inbox", "Admin")
+	otherAdminID := db.CreateTestUser(t, "inbox-other@example.com", "Other", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id IN ($1, $2)", adminID, otherAdminID)
+
+	if err := raiseAdminAlert(db.DB, AdminAlert{
+		Type:      "driver_no_show",
+		Severity:  "critical",
+		Title:     "Driver hasn't started their pickup route",
+		Message:   "Route 1 was due to start at 08:00:00",
+		DedupeKey: "driver_no_show:1",
+	}); err != nil {
+		t.Fatalf("Failed to raise alert: %v", err)
+	}
+	var itemID int
+	db.QueryRow("SELECT id FROM admin_inbox_items WHERE dedupe_key = 'driver_no_show:1'").Scan(&itemID)
+
+	handler := NewAdminInboxHandler(db.DB)
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return adminID, nil
+	}
+
+	counts := func() map[string]int {
+		req := httptest.NewRequest("GET", "/api/v1/admin/inbox/counts", nil)
+		w := httptest.NewRecorder()
+		handler.handleGetInboxCounts(w, req)
+		var response map[string]int
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response
+	}
+	if c := counts(); c["unread"] != 1 || c["critical"] != 1 {
+		t.Fatalf("Expected 1 unread critical item, got %v", c)
+	}
+
+	idVars := map[string]string{"id": fmt.Sprintf("%d", itemID)}
+
+	// Assign to the other admin, then acknowledge without taking it over
+	body, _ := json.Marshal(AssignInboxItemRequest{AdminID: &otherAdminID})
+	req := httptest.NewRequest("PUT", fmt.Sprintf("/api/v1/admin/inbox/%d/assign", itemID), bytes.NewBuffer(body))
+	req = mux.SetURLVars(req, idVars)
+	w := httptest.NewRecorder()
+	handler.handleAssignInboxItem(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", fmt.Sprintf("/api/v1/admin/inbox/%d/acknowledge", itemID), nil)
+	req = mux.SetURLVars(req, idVars)
+	w = httptest.NewRecorder()
+	handler.handleAcknowledgeInboxItem(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var item AdminInboxItem
+	json.Unmarshal(w.Body.Bytes(), &item)
+	if item.Status != "acknowledged" || item.AssignedTo == nil || *item.AssignedTo != otherAdminID || !item.IsRead {
+		t.Errorf("Expected acknowledged, read item still assigned to %d, got %+v", otherAdminID, item)
+	}
+	if c := counts(); c["unread"] != 0 {
+		t.Errorf("Expected no unread items after acknowledging, got %v", c)
+	}
+
+	body, _ = json.Marshal(ResolveInboxItemRequest{Note: "Driver called in sick, route reassigned"})
+	req = httptest.NewRequest("POST", fmt.Sprintf("/api/v1/admin/inbox/%d/resolve", itemID), bytes.NewBuffer(body))
+	req = mux.SetURLVars(req, idVars)
+	w = httptest.NewRecorder()
+	handler.handleResolveInboxItem(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// Resolved items drop out of the default view and can't be acknowledged
+	req = httptest.NewRequest("GET", "/api/v1/admin/inbox", nil)
+	w = httptest.NewRecorder()
+	handler.handleGetInbox(w, req)
+	var items []AdminInboxItem
+	json.Unmarshal(w.Body.Bytes(), &items)
+	if len(items) != 0 {
+		t.Errorf("Expected resolved item to be hidden by default, got %d items", len(items))
+	}
+
+	req = httptest.NewRequest("POST", fmt.Sprintf("/api/v1/admin/inbox/%d/acknowledge", itemID), nil)
+	req = mux.SetURLVars(req, idVars)
+	w = httptest.NewRecorder()
+	handler.handleAcknowledgeInboxItem(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d acknowledging a resolved item, got %d", http.StatusConflict, w.Code)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AdminOrderDetail is everything support needs about one order in one
+// response
+type AdminOrderDetail struct {
+	Order       *Order             `json:"order"`
+	Customer    AdminOrderCustomer `json:"customer"`
+	Routes      []AdminOrderRoute  `json:"routes"`
+	Resolutions []OrderResolution  `json:"resolutions"`
+	// Payments, with their refunds, are left out for staff without
+	// payments.read
+	Payments []AdminOrderPayment `json:"payments,omitempty"`
+	// Timeline merges the above oldest first
+	Timeline []OrderTimelineEvent `json:"timeline"`
+}
+
+type AdminOrderCustomer struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// AdminOrderRoute is a route the order has been on and its stop on it
+type AdminOrderRoute struct {
+	RouteID     int        `json:"route_id"`
+	RouteType   string     `json:"route_type"`
+	RouteDate   string     `json:"route_date"`
+	RouteStatus string     `json:"route_status"`
+	DriverID    *int       `json:"driver_id,omitempty"`
+	DriverName  *string    `json:"driver_name,omitempty"`
+	Sequence    int        `json:"sequence"`
+	StopStatus  string     `json:"stop_status"`
+	AssignedAt  time.Time  `json:"assigned_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type AdminOrderPayment struct {
+	ID                    int       `json:"id"`
+	Amount                float64   `json:"amount"`
+	RefundedAmount        float64   `json:"refunded_amount"`
+	PaymentType           string    `json:"payment_type"`
+	Status                string    `json:"status"`
+	StripePaymentIntentID *string   `json:"stripe_payment_intent_id,omitempty"`
+	Refunds               []Refund  `json:"refunds"`
+	CreatedAt             time.Time `json:"created_at"`
+}
+
+// OrderTimelineEvent is one thing that happened to an order
+type OrderTimelineEvent struct {
+	Kind       string    `json:"kind"` // status, route, payment, refund, resolution
+	SourceID   int       `json:"source_id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Summary    string    `json:"summary"`
+	ActorID    *int      `json:"actor_id,omitempty"`
+}
+
+// handleGetAdminOrder returns an order with its items, status history,
+// routes and drivers, resolutions, and payments and refunds, so the
+// dashboard doesn't have to stitch the separate endpoints together
+func (h *AdminHandler) handleGetAdminOrder(w http.ResponseWriter, r *http.Request) {
+	staffID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	order, err := getOrder(h.db, orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	detail := AdminOrderDetail{Order: order}
+
+	if err := h.db.QueryRow(
+		"SELECT id, first_name || ' ' || last_name, email FROM users WHERE id = $1", order.UserID,
+	).Scan(&detail.Customer.ID, &detail.Customer.Name, &detail.Customer.Email); err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	if detail.Routes, err = adminOrderRoutes(h.db, orderID); err != nil {
+		http.Error(w, "Failed to fetch order routes", http.StatusInternalServerError)
+		return
+	}
+	if detail.Resolutions, err = adminOrderResolutions(h.db, orderID); err != nil {
+		http.Error(w, "Failed to fetch order resolutions", http.StatusInternalServerError)
+		return
+	}
+
+	canSeePayments, err := userHasPermission(h.db, staffID, "payments.read")
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if canSeePayments {
+		if detail.Payments, err = adminOrderPayments(h.db, orderID); err != nil {
+			http.Error(w, "Failed to fetch order payments", http.StatusInternalServerError)
+			return
+		}
+		if detail.Payments == nil {
+			detail.Payments = []AdminOrderPayment{}
+		}
+	}
+
+	detail.Timeline = detail.timeline()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+func adminOrderRoutes(db *sql.DB, orderID int) ([]AdminOrderRoute, error) {
+	rows, err := db.Query(`
+		SELECT dr.id, dr.route_type, dr.route_date::text, dr.status, dr.driver_id,
+		       u.first_name || ' ' || u.last_name, ro.sequence_number, ro.status, ro.created_at, ro.actual_time
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		LEFT JOIN users u ON dr.driver_id = u.id
+		WHERE ro.order_id = $1
+		ORDER BY dr.route_date, ro.created_at`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	routes := []AdminOrderRoute{}
+	for rows.Next() {
+		var rt AdminOrderRoute
+		if err := rows.Scan(&rt.RouteID, &rt.RouteType, &rt.RouteDate, &rt.RouteStatus, &rt.DriverID,
+			&rt.DriverName, &rt.Sequence, &rt.StopStatus, &rt.AssignedAt, &rt.CompletedAt); err != nil {
+			return nil, err
+		}
+		routes = append(routes, rt)
+	}
+	return routes, rows.Err()
+}
+
+func adminOrderResolutions(db *sql.DB, orderID int) ([]OrderResolution, error) {
+	rows, err := db.Query(`
+		SELECT id, order_id, COALESCE(resolved_by, 0), resolution_type, reschedule_date::text,
+		       refund_amount, credit_amount, COALESCE(notes, ''), created_at
+		FROM order_resolutions
+		WHERE order_id = $1
+		ORDER BY created_at DESC`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resolutions := []OrderResolution{}
+	for rows.Next() {
+		var res OrderResolution
+		if err := rows.Scan(&res.ID, &res.OrderID, &res.ResolvedBy, &res.ResolutionType, &res.RescheduleDate,
+			&res.RefundAmount, &res.CreditAmount, &res.Notes, &res.CreatedAt); err != nil {
+			return nil, err
+		}
+		resolutions = append(resolutions, res)
+	}
+	return resolutions, rows.Err()
+}
+
+func adminOrderPayments(db *sql.DB, orderID int) ([]AdminOrderPayment, error) {
+	rows, err := db.Query(`
+		SELECT id, amount_cents, payment_type, status, stripe_payment_intent_id, created_at
+		FROM payments
+		WHERE order_id = $1
+		ORDER BY created_at DESC`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []AdminOrderPayment
+	var paymentIDs []int
+	for rows.Next() {
+		var p AdminOrderPayment
+		var amountCents int
+		if err := rows.Scan(&p.ID, &amountCents, &p.PaymentType, &p.Status, &p.StripePaymentIntentID, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		p.Amount = centsToDollars(amountCents)
+		payments = append(payments, p)
+		paymentIDs = append(paymentIDs, p.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	refunds, err := refundsForPayments(db, paymentIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range payments {
+		payments[i].Refunds = refunds[payments[i].ID]
+		if payments[i].Refunds == nil {
+			payments[i].Refunds = []Refund{}
+		}
+		refundedCents := 0
+		for _, rf := range payments[i].Refunds {
+			if rf.Status == "succeeded" {
+				refundedCents += dollarsToCents(rf.Amount)
+			}
+		}
+		payments[i].RefundedAmount = centsToDollars(refundedCents)
+	}
+	return payments, nil
+}
+
+// timeline merges the order's status changes, route stops, resolutions,
+// payments and refunds, oldest first
+func (d *AdminOrderDetail) timeline() []OrderTimelineEvent {
+	events := []OrderTimelineEvent{}
+	for _, s := range d.Order.StatusHistory {
+		summary := "Status changed to " + strings.ReplaceAll(s.Status, "_", " ")
+		events = append(events, OrderTimelineEvent{Kind: "status", SourceID: s.ID, OccurredAt: s.CreatedAt, Summary: summary, ActorID: s.UpdatedBy})
+	}
+	for _, rt := range d.Routes {
+		driver := "no driver"
+		if rt.DriverName != nil {
+			driver = *rt.DriverName
+		}
+		events = append(events, OrderTimelineEvent{
+			Kind: "route", SourceID: rt.RouteID, OccurredAt: rt.AssignedAt,
+			Summary: fmt.Sprintf("Added to %s route #%d on %s with %s", rt.RouteType, rt.RouteID, rt.RouteDate, driver),
+		})
+		if rt.CompletedAt != nil {
+			events = append(events, OrderTimelineEvent{
+				Kind: "route", SourceID: rt.RouteID, OccurredAt: *rt.CompletedAt,
+				Summary: fmt.Sprintf("Stop %s on %s route #%d", rt.StopStatus, rt.RouteType, rt.RouteID),
+			})
+		}
+	}
+	for _, res := range d.Resolutions {
+		event := OrderTimelineEvent{
+			Kind: "resolution", SourceID: res.ID, OccurredAt: res.CreatedAt,
+			Summary: "Resolved: " + strings.ReplaceAll(res.ResolutionType, "_", " "),
+		}
+		if res.ResolvedBy != 0 {
+			resolvedBy := res.ResolvedBy
+			event.ActorID = &resolvedBy
+		}
+		events = append(events, event)
+	}
+	for _, p := range d.Payments {
+		events = append(events, OrderTimelineEvent{
+			Kind: "payment", SourceID: p.ID, OccurredAt: p.CreatedAt,
+			Summary: fmt.Sprintf("Payment of $%.2f %s", p.Amount, p.Status),
+		})
+		for _, rf := range p.Refunds {
+			events = append(events, OrderTimelineEvent{
+				Kind: "refund", SourceID: rf.ID, OccurredAt: rf.CreatedAt,
+				Summary: fmt.Sprintf("Refund of $%.2f %s", rf.Amount, rf.Status), ActorID: rf.CreatedBy,
+			})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].OccurredAt.Before(events[j].OccurredAt)
+	})
+	return events
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAdminOrderDetail(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "detail-admin@example.com", "Detail", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	supportID := db.CreateTestUser(t, "detail-support@example.com", "Detail", "Support")
+	db.Exec("INSERT INTO roles (name) VALUES ('support')")
+	db.Exec("INSERT INTO role_permissions (role, permission) VALUES ('support', 'orders.read')")
+	db.Exec("UPDATE users SET role = 'support' WHERE id = $1", supportID)
+	driverID := db.CreateTestUser(t, "detail-driver@example.com", "Route", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "detail-customer@example.com", "Detail", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	var routeID, paymentID, resolutionID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'completed') RETURNING id`, driverID).Scan(&routeID)
+	db.Exec(`
+		INSERT INTO route_orders (route_id, order_id, sequence_number, status, actual_time, created_at)
+		VALUES ($1, $2, 1, 'completed', NOW() + INTERVAL '2 minutes', NOW() + INTERVAL '1 minute')`, routeID, orderID)
+	db.QueryRow(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, created_at)
+		VALUES ($1, $2, 4500, 'extra_order', 'completed', NOW() + INTERVAL '3 minutes') RETURNING id`, customerID, orderID).Scan(&paymentID)
+	db.QueryRow(`
+		INSERT INTO order_resolutions (order_id, resolved_by, resolution_type, refund_amount, notes, created_at)
+		VALUES ($1, $2, 'partial_refund', 10, 'Missing sock', NOW() + INTERVAL '4 minutes') RETURNING id`, orderID, adminID).Scan(&resolutionID)
+	db.Exec(`
+		INSERT INTO refunds (payment_id, order_id, user_id, resolution_id, amount_cents, reason, status, created_by, created_at)
+		VALUES ($1, $2, $3, $4, 1000, 'Missing sock', 'succeeded', $5, NOW() + INTERVAL '5 minutes')`, paymentID, orderID, customerID, resolutionID, adminID)
+
+	get := func(staffID int, id string) (AdminOrderDetail, int) {
+		handler := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(staffID).getUserIDFromRequest}
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/admin/orders/x", nil), map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		handler.handleGetAdminOrder(w, req)
+		var detail AdminOrderDetail
+		json.Unmarshal(w.Body.Bytes(), &detail)
+		return detail, w.Code
+	}
+
+	detail, code := get(adminID, fmt.Sprint(orderID))
+	if code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	if detail.Order == nil || detail.Order.ID != orderID || detail.Customer.Email != "detail-customer@example.com" {
+		t.Errorf("Expected the order and its customer, got %+v %+v", detail.Order, detail.Customer)
+	}
+	if len(detail.Routes) != 1 || detail.Routes[0].DriverName == nil || *detail.Routes[0].DriverName != "Route Driver" {
+		t.Errorf("Expected the pickup route and its driver, got %+v", detail.Routes)
+	}
+	if len(detail.Resolutions) != 1 || len(detail.Payments) != 1 || len(detail.Payments[0].Refunds) != 1 {
+		t.Fatalf("Expected the resolution and the payment with its refund, got %+v %+v", detail.Resolutions, detail.Payments)
+	}
+	if detail.Payments[0].RefundedAmount != 10 {
+		t.Errorf("Expected $10 refunded, got %v", detail.Payments[0].RefundedAmount)
+	}
+
+	var kinds []string
+	for _, e := range detail.Timeline {
+		kinds = append(kinds, e.Kind)
+	}
+	expected := []string{"route", "route", "payment", "resolution", "refund"}
+	if len(kinds) < len(expected) || fmt.Sprint(kinds[len(kinds)-len(expected):]) != fmt.Sprint(expected) {
+		t.Errorf("Expected the timeline to end %v oldest first, got %v", expected, kinds)
+	}
+
+	// Support staff without payments.read don't see payments
+	detail, code = get(supportID, fmt.Sprint(orderID))
+	if code != http.StatusOK || detail.Payments != nil {
+		t.Errorf("Expected payments hidden, got %d %+v", code, detail.Payments)
+	}
+	for _, e := range detail.Timeline {
+		if e.Kind == "payment" || e.Kind == "refund" {
+			t.Errorf("Expected no payment events, got %+v", e)
+		}
+	}
+
+	if _, code := get(adminID, "999999"); code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown order, got %d", http.StatusNotFound, code)
+	}
+}
@@ -276,6 +276,15 @@ func TestAdminHandler_UpdateUserRole(t *testing.T) {
 				if role != tt.newRole {
 					t.Errorf("Expected role %s, got %s", tt.newRole, role)
 				}
+				var recorded bool
+				db.QueryRow(`
+					SELECT EXISTS(SELECT 1 FROM account_change_history
+					WHERE user_id = $1 AND entity_type = 'profile' AND 'role' = ANY(changed_fields))`,
+					tt.userID,
+				).Scan(&recorded)
+				if !recorded {
+					t.Error("Expected the role change in the account's history")
+				}
 			}
 		})
 	}
@@ -423,6 +432,10 @@ func TestAdminHandler_AssignDriverToRoute(t *testing.T) {
 	
 	driverID := db.CreateTestUser(t, "driver@example.com", "Driver", "User")
 	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	db.CompleteTestDriverOnboarding(t, driverID)
+
+	newDriverID := db.CreateTestUser(t, "new-driver@example.com", "New", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", newDriverID)
 	
 	customerID := db.CreateTestUser(t, "customer@example.com", "Customer", "User")
 	addressID := db.CreateTestAddress(t, customerID)
@@ -463,6 +476,16 @@ func TestAdminHandler_AssignDriverToRoute(t *testing.T) {
 			},
 			expectedStatus: http.StatusBadRequest,
 		},
+		{
+			name: "Driver still onboarding",
+			request: map[string]interface{}{
+				"driver_id":  newDriverID,
+				"order_ids":  []int{orderID1},
+				"route_date": "2024-12-01",
+				"route_type": "pickup",
+			},
+			expectedStatus: http.StatusConflict,
+		},
 	}
 
 	for _, tt := range tests {
@@ -614,6 +637,61 @@ func TestAdminHandler_BulkOrderStatusUpdate(t *testing.T) {
 	}
 }
 
+func TestAdminHandler_BulkOrderStatusUpdate_SuppressNotifications(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "admin@example.com", "Admin", "User")
+	userID := db.CreateTestUser(t, "customer@example.com", "Test", "Customer")
+	addressID := db.CreateTestAddress(t, userID)
+	orderID := db.CreateTestOrder(t, userID, addressID)
+
+	mockRealtime := NewMockRealtimeHandler()
+	handler := &AdminHandler{
+		db:       db.DB,
+		realtime: mockRealtime,
+		getUserID: func(r *http.Request, db *sql.DB) (int, error) {
+			return adminID, nil
+		},
+	}
+
+	tests := []struct {
+		name            string
+		suppress        bool
+		expectedUpdates int
+	}{
+		{name: "Customer notified by default", suppress: false, expectedUpdates: 1},
+		{name: "Correction suppressed", suppress: true, expectedUpdates: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRealtime.ClearUpdates()
+
+			body, _ := json.Marshal(map[string]interface{}{
+				"order_ids":              []int{orderID},
+				"status":                 "ready",
+				"suppress_notifications": tt.suppress,
+			})
+			req := httptest.NewRequest("PUT", "/api/v1/admin/orders/bulk-status", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			handler.handleBulkOrderStatusUpdate(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d. Body: %s", w.Code, w.Body.String())
+			}
+			if len(mockRealtime.PublishedUpdates) != tt.expectedUpdates {
+				t.Errorf("Expected %d published updates, got %d", tt.expectedUpdates, len(mockRealtime.PublishedUpdates))
+			}
+			if tt.expectedUpdates > 0 && mockRealtime.PublishedUpdates[0].UserID != userID {
+				t.Errorf("Expected update for user %d, got %d", userID, mockRealtime.PublishedUpdates[0].UserID)
+			}
+		})
+	}
+}
+
 func TestAdminHandler_BulkOrderStatusUpdate_Unauthorized(t *testing.T) {
 	db := SetupTestDB(t)
 	defer db.CleanupTestDB()
@@ -1381,6 +1459,22 @@ func TestAdminHandler_UpdateUser(t *testing.T) {
 				if response.Role != tt.requestBody["role"] {
 					t.Errorf("Expected role %s, got %s", tt.requestBody["role"], response.Role)
 				}
+
+				// The response says what the edit changed
+				var diff struct {
+					Changes []FieldChange `json:"changes"`
+				}
+				json.Unmarshal(w.Body.Bytes(), &diff)
+				changed := map[string]FieldChange{}
+				for _, c := range diff.Changes {
+					changed[c.Field] = c
+				}
+				if c, ok := changed["role"]; !ok || c.Old != "customer" || c.New != "driver" {
+					t.Errorf("Expected the role change from customer to driver, got %+v", diff.Changes)
+				}
+				if _, ok := changed["status"]; ok {
+					t.Errorf("Expected the unchanged status left out, got %+v", diff.Changes)
+				}
 			}
 		})
 	}
@@ -1719,6 +1813,15 @@ func TestAdminHandler_UpdateUserStatus(t *testing.T) {
 				if dbStatus != tt.expectedStatusValue {
 					t.Errorf("Expected database status %s, got %s", tt.expectedStatusValue, dbStatus)
 				}
+				var changedBy int
+				db.QueryRow(`
+					SELECT changed_by FROM account_change_history
+					WHERE user_id = $1 AND entity_type = 'profile' AND 'status' = ANY(changed_fields)`,
+					tt.userID,
+				).Scan(&changedBy)
+				if changedBy != adminID {
+					t.Errorf("Expected the status change in the account's history by %d, got %d", adminID, changedBy)
+				}
 			}
 		})
 	}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	// maxAuditBody is the largest request body copied into the log
+	maxAuditBody = 64 << 10
+
+	defaultAuditLogLimit = 100
+	maxAuditLogLimit     = 500
+)
+
+// auditSnapshotQueries read the state of a target before and after an admin
+// write, keyed by target type. Targets without one are logged with their
+// request body only.
+var auditSnapshotQueries = map[string]string{
+	"users": profileSnapshotQuery,
+	"orders": `
+		SELECT row_to_json(o) FROM (
+			SELECT status, pickup_date, pickup_time_slot, delivery_date, delivery_time_slot,
+			       pickup_address_id, delivery_address_id, total_cents, special_instructions
+			FROM orders WHERE id = $1
+		) o`,
+	"routes": `
+		SELECT row_to_json(r) FROM (
+			SELECT dr.driver_id, dr.route_date, dr.route_type, dr.status, dr.estimated_start_time, dr.jurisdiction,
+			       ARRAY(SELECT order_id FROM route_orders WHERE route_id = dr.id ORDER BY sequence_number) AS stops
+			FROM driver_routes dr WHERE dr.id = $1
+		) r`,
+	"reviews": `
+		SELECT row_to_json(r) FROM (
+			SELECT order_id, driver_id, rating, driver_rating, hidden_at, hidden_by, hidden_reason
+			FROM order_ratings WHERE id = $1
+		) r`,
+	"slot-pricing": `
+		SELECT row_to_json(s) FROM (
+			SELECT name, day_of_week, time_slot, multiplier_percent, is_active
+			FROM slot_price_rules WHERE id = $1
+		) s`,
+}
+
+// auditEntry is built up while an audited request runs. Handlers can point
+// it at a target the route doesn't name, or supply the change themselves.
+type auditEntry struct {
+	targetType string
+	targetID   string
+	before     json.RawMessage
+	after      json.RawMessage
+	// explicit is set once a handler has supplied before/after itself
+	explicit bool
+}
+
+type auditContextKey struct{}
+
+func auditFromRequest(r *http.Request) *auditEntry {
+	entry, _ := r.Context().Value(auditContextKey{}).(*auditEntry)
+	return entry
+}
+
+// setAuditTarget points the audit entry at a record named in the body
+// rather than the route. Call it before writing: the record's current state
+// is taken as the before snapshot, and it's snapshotted again afterwards.
+func setAuditTarget(r *http.Request, q queryRower, targetType string, targetID int) {
+	if entry := auditFromRequest(r); entry != nil {
+		entry.targetType = targetType
+		entry.targetID = strconv.Itoa(targetID)
+		entry.before = auditSnapshot(q, entry.targetType, entry.targetID)
+	}
+}
+
+// setAuditChange records a handler's own before and after, for writes that
+// touch several records at once
+func setAuditChange(r *http.Request, before, after interface{}) {
+	entry := auditFromRequest(r)
+	if entry == nil {
+		return
+	}
+	entry.before, _ = json.Marshal(before)
+	entry.after, _ = json.Marshal(after)
+	entry.explicit = true
+}
+
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// auditRoute returns the request's route template without the API prefix
+func auditRoute(r *http.Request) string {
+	path := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			path = tmpl
+		}
+	}
+	return strings.TrimPrefix(path, "/api/v1")
+}
+
+// auditTargetFromRoute reads the target from the route: the segment after
+// /admin/ is the type and the first path variable is the ID
+func auditTargetFromRoute(r *http.Request, route string) (string, string) {
+	segments := strings.Split(strings.TrimPrefix(route, "/admin/"), "/")
+	targetType := segments[0]
+	if targetType == "drivers" {
+		targetType = "users"
+	}
+	vars := mux.Vars(r)
+	for _, key := range []string{"id", "orderId", "name", "market", "jurisdiction"} {
+		if v := vars[key]; v != "" {
+			return targetType, v
+		}
+	}
+	return targetType, ""
+}
+
+func auditSnapshot(q queryRower, targetType, targetID string) json.RawMessage {
+	query, ok := auditSnapshotQueries[targetType]
+	if !ok {
+		return nil
+	}
+	id, err := strconv.Atoi(targetID)
+	if err != nil {
+		return nil
+	}
+	snapshot, _ := snapshotRow(q, query, id)
+	return snapshot
+}
+
+// redactAuditBody drops secrets from a JSON request body before it's
+// stored. Bodies that aren't JSON objects or arrays aren't stored.
+func redactAuditBody(body []byte) json.RawMessage {
+	var v interface{}
+	if len(body) == 0 || json.Unmarshal(body, &v) != nil {
+		return nil
+	}
+	var redact func(interface{}) interface{}
+	redact = func(v interface{}) interface{} {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, field := range t {
+				key := strings.ToLower(k)
+				if strings.Contains(key, "password") || strings.Contains(key, "token") || strings.Contains(key, "secret") {
+					t[k] = "[redacted]"
+				} else {
+					t[k] = redact(field)
+				}
+			}
+		case []interface{}:
+			for i := range t {
+				t[i] = redact(t[i])
+			}
+		}
+		return v
+	}
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		return nil
+	}
+	redacted, _ := json.Marshal(redact(v))
+	return redacted
+}
+
+// audited records an admin write in the audit log once the handler has
+// run. It's applied by requireAdmin and requirePermission after the caller
+// is authorized, so only writes by staff are recorded.
+func (h *AdminHandler) audited(actorID int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isWriteMethod(r.Method) {
+			next(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(r.Body, maxAuditBody+1))
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		}
+		requestBody := json.RawMessage(nil)
+		if len(body) <= maxAuditBody {
+			requestBody = redactAuditBody(body)
+		}
+
+		route := auditRoute(r)
+		entry := &auditEntry{}
+		entry.targetType, entry.targetID = auditTargetFromRoute(r, route)
+		entry.before = auditSnapshot(h.db, entry.targetType, entry.targetID)
+
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next(wrapped, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, entry)))
+
+		if !entry.explicit {
+			entry.after = auditSnapshot(h.db, entry.targetType, entry.targetID)
+		}
+		var targetType, targetID *string
+		if entry.targetType != "" {
+			targetType = &entry.targetType
+		}
+		if entry.targetID != "" {
+			targetID = &entry.targetID
+		}
+
+		changes := fieldChanges(entry.before, entry.after)
+		fields := make([]string, len(changes))
+		for i, c := range changes {
+			fields[i] = c.Field
+		}
+		changesJSON, _ := json.Marshal(changes)
+
+		_, err := h.db.Exec(`
+			INSERT INTO audit_log (actor_id, actor_role, action, path, target_type, target_id, status_code,
+			                       request_body, before_data, after_data, changed_fields, field_changes, ip_address, user_agent)
+			VALUES ($1, (SELECT role FROM users WHERE id = $1), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, NULLIF($13, ''))`,
+			actorID, r.Method+" "+route, r.URL.Path, targetType, targetID, wrapped.statusCode,
+			nullableJSON(requestBody), nullableJSON(entry.before), nullableJSON(entry.after),
+			pq.Array(fields), changesJSON, clientIP(r), r.UserAgent(),
+		)
+		if err != nil {
+			LogRequest("audit_log", r.Method, r.URL.Path, actorID).Error("Failed to write audit log", "error", err)
+		}
+	}
+}
+
+// nullableJSON stores missing snapshots as NULL rather than JSON null
+func nullableJSON(data json.RawMessage) interface{} {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	return []byte(data)
+}
+
+type AuditLogEntry struct {
+	ID            int64           `json:"id"`
+	ActorID       *int            `json:"actor_id,omitempty"`
+	ActorName     *string         `json:"actor_name,omitempty"`
+	ActorRole     *string         `json:"actor_role,omitempty"`
+	Action        string          `json:"action"`
+	Path          string          `json:"path"`
+	TargetType    *string         `json:"target_type,omitempty"`
+	TargetID      *string         `json:"target_id,omitempty"`
+	StatusCode    int             `json:"status_code"`
+	RequestBody   json.RawMessage `json:"request_body,omitempty"`
+	Before        json.RawMessage `json:"before,omitempty"`
+	After         json.RawMessage `json:"after,omitempty"`
+	ChangedFields []string        `json:"changed_fields"`
+	Changes       []FieldChange   `json:"changes"` // each changed field's old and new value
+	IPAddress     *string         `json:"ip_address,omitempty"`
+	UserAgent     *string         `json:"user_agent,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+type AuditLogPage struct {
+	Entries []AuditLogEntry `json:"entries"`
+	// NextBeforeID is what to pass as before_id for the next page
+	NextBeforeID int64 `json:"next_before_id,omitempty"`
+}
+
+// handleGetAuditLog lists audit entries newest first. Filters: actor_id,
+// target_type, target_id, action (substring of the method and route),
+// outcome (success or failure), from and to (RFC 3339); page with limit
+// and before_id.
+func (h *AdminHandler) handleGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	where := []string{"TRUE"}
+	args := []interface{}{}
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, strings.ReplaceAll(clause, "?", "$"+strconv.Itoa(len(args))))
+	}
+
+	for _, param := range []string{"actor_id", "before_id"} {
+		v := query.Get(param)
+		if v == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid "+param, http.StatusBadRequest)
+			return
+		}
+		if param == "actor_id" {
+			add("a.actor_id = ?", id)
+		} else {
+			add("a.id < ?", id)
+		}
+	}
+	if v := query.Get("target_type"); v != "" {
+		add("a.target_type = ?", v)
+	}
+	if v := query.Get("target_id"); v != "" {
+		add("a.target_id = ?", v)
+	}
+	if v := query.Get("action"); v != "" {
+		add("a.action ILIKE '%' || ? || '%'", v)
+	}
+	switch query.Get("outcome") {
+	case "":
+	case "success":
+		where = append(where, "a.status_code < 400")
+	case "failure":
+		where = append(where, "a.status_code >= 400")
+	default:
+		http.Error(w, "outcome must be success or failure", http.StatusBadRequest)
+		return
+	}
+	for _, param := range []string{"from", "to"} {
+		v := query.Get(param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, param+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		if param == "from" {
+			add("a.created_at >= ?", t)
+		} else {
+			add("a.created_at < ?", t)
+		}
+	}
+
+	limit := defaultAuditLogLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxAuditLogLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxAuditLogLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	args = append(args, limit+1)
+
+	rows, err := h.db.Query(`
+		SELECT a.id, a.actor_id, u.first_name || ' ' || u.last_name, a.actor_role, a.action, a.path,
+		       a.target_type, a.target_id, a.status_code, a.request_body, a.before_data, a.after_data,
+		       a.changed_fields, a.field_changes, a.ip_address, a.user_agent, a.created_at
+		FROM audit_log a
+		LEFT JOIN users u ON u.id = a.actor_id
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY a.id DESC
+		LIMIT $`+strconv.Itoa(len(args)),
+		args...,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := AuditLogPage{Entries: []AuditLogEntry{}}
+	for rows.Next() {
+		var e AuditLogEntry
+		var requestBody, before, after, changes []byte
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.ActorName, &e.ActorRole, &e.Action, &e.Path,
+			&e.TargetType, &e.TargetID, &e.StatusCode, &requestBody, &before, &after,
+			pq.Array(&e.ChangedFields), &changes, &e.IPAddress, &e.UserAgent, &e.CreatedAt); err != nil {
+			http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+			return
+		}
+		e.RequestBody, e.Before, e.After = requestBody, before, after
+		if e.ChangedFields == nil {
+			e.ChangedFields = []string{}
+		}
+		if json.Unmarshal(changes, &e.Changes) != nil || e.Changes == nil {
+			e.Changes = []FieldChange{}
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	if len(page.Entries) > limit {
+		page.Entries = page.Entries[:limit]
+		page.NextBeforeID = page.Entries[limit-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
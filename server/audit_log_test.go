@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRedactAuditBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{`{"email": "a@example.com", "password": "hunter2"}`, `{"email":"a@example.com","password":"[redacted]"}`},
+		{`{"actions": [{"type": "add_note", "api_token": "x"}]}`, `{"actions":[{"api_token":"[redacted]","type":"add_note"}]}`},
+		{`"just a string"`, ``},
+		{`not json`, ``},
+		{``, ``},
+	}
+	for _, tt := range tests {
+		if got := string(redactAuditBody([]byte(tt.body))); got != tt.expected {
+			t.Errorf("redactAuditBody(%s) = %s, expected %s", tt.body, got, tt.expected)
+		}
+	}
+}
+
+func TestAuditLogRecordsAdminWrites(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "audit-admin@example.com", "Audit", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	customerID := db.CreateTestUser(t, "audit-customer@example.com", "Audit", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	handler := &AdminHandler{db: db.DB, realtime: NewMockRealtimeHandler(), getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	updateRole := func(role string) int {
+		req := httptest.NewRequest("PUT", "/api/v1/admin/users/role", strings.NewReader(`{"role": "`+role+`"}`))
+		req.RemoteAddr = "203.0.113.7:5555"
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(customerID)})
+		w := httptest.NewRecorder()
+		handler.requirePermission("users.manage", handler.handleUpdateUserRole)(w, req)
+		return w.Code
+	}
+	if code := updateRole("driver"); code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := updateRole("pilot"); code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, code)
+	}
+
+	w := httptest.NewRecorder()
+	handler.requirePermission("orders.manage", handler.handleBulkOrderStatusUpdate)(w, httptest.NewRequest("PUT", "/api/v1/admin/orders/bulk-status",
+		strings.NewReader(fmt.Sprintf(`{"order_ids": [%d], "status": "picked_up"}`, orderID))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// Reads aren't logged
+	handler.requirePermission("users.read", handler.handleGetUsers)(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/admin/users", nil))
+
+	get := func(query string) AuditLogPage {
+		w := httptest.NewRecorder()
+		handler.handleGetAuditLog(w, httptest.NewRequest("GET", "/api/v1/admin/audit-log"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var page AuditLogPage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return page
+	}
+
+	page := get("")
+	if len(page.Entries) != 3 {
+		t.Fatalf("Expected three writes logged, got %d", len(page.Entries))
+	}
+
+	page = get(fmt.Sprintf("?target_type=users&target_id=%d&outcome=success", customerID))
+	if len(page.Entries) != 1 {
+		t.Fatalf("Expected one successful user change, got %d", len(page.Entries))
+	}
+	entry := page.Entries[0]
+	if entry.ActorID == nil || *entry.ActorID != adminID || entry.IPAddress == nil || *entry.IPAddress != "203.0.113.7" {
+		t.Errorf("Expected the actor and IP to be recorded, got %+v", entry)
+	}
+	if fmt.Sprint(entry.ChangedFields) != "[role]" || !strings.Contains(string(entry.Before), `"customer"`) || !strings.Contains(string(entry.After), `"driver"`) {
+		t.Errorf("Expected a role diff, got %v %s -> %s", entry.ChangedFields, entry.Before, entry.After)
+	}
+	if len(entry.Changes) != 1 || entry.Changes[0].Old != "customer" || entry.Changes[0].New != "driver" {
+		t.Errorf("Expected the role's old and new value, got %+v", entry.Changes)
+	}
+
+	if page := get("?outcome=failure"); len(page.Entries) != 1 || page.Entries[0].StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the rejected change to be logged, got %+v", page.Entries)
+	}
+
+	page = get("?action=bulk-status")
+	if len(page.Entries) != 1 || fmt.Sprint(page.Entries[0].ChangedFields) != fmt.Sprintf("[%d]", orderID) {
+		t.Fatalf("Expected the bulk update to list the changed order, got %+v", page.Entries)
+	}
+	if !strings.Contains(string(page.Entries[0].Before), `"scheduled"`) {
+		t.Errorf("Expected the previous status, got %s", page.Entries[0].Before)
+	}
+
+	page = get("?limit=2")
+	if len(page.Entries) != 2 || page.NextBeforeID == 0 {
+		t.Fatalf("Expected a first page of two, got %+v", page)
+	}
+	if rest := get(fmt.Sprintf("?before_id=%d", page.NextBeforeID)); len(rest.Entries) != 1 {
+		t.Errorf("Expected one entry on the second page, got %d", len(rest.Entries))
+	}
+}
@@ -21,24 +21,32 @@ import (
 
 // getUserIDFromRequest extracts user ID from JWT token in Authorization header
 func getUserIDFromRequest(r *http.Request, db *sql.DB) (int, error) {
+	userID, _, err := sessionFromRequest(r, db)
+	return userID, err
+}
+
+// sessionFromRequest validates the access token in the Authorization header
+// and returns its user and session. Tokens from revoked sessions are refused.
+func sessionFromRequest(r *http.Request, db *sql.DB) (int, string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		return 0, fmt.Errorf("no authorization header")
+		return 0, "", fmt.Errorf("no authorization header")
 	}
 
 	// Extract token from "Bearer <token>"
 	parts := strings.Split(authHeader, " ")
 	if len(parts) != 2 || parts[0] != "Bearer" {
-		return 0, fmt.Errorf("invalid authorization header format")
+		return 0, "", fmt.Errorf("invalid authorization header format")
 	}
 
-	tokenString := parts[1]
-	
+	return sessionFromToken(parts[1], db)
+}
+
+// sessionFromToken validates an access token and returns its user and
+// session. The realtime connection presents the same token as API calls.
+func sessionFromToken(tokenString string, db *sql.DB) (int, string, error) {
 	// Parse and validate JWT token
-	jwtSecret := []byte(os.Getenv("JWT_SECRET"))
-	if len(jwtSecret) == 0 {
-		jwtSecret = []byte("default-secret-key")
-	}
+	jwtSecret := jwtSecretFromEnv()
 
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		// Validate signing method
@@ -49,24 +57,42 @@ func getUserIDFromRequest(r *http.Request, db *sql.DB) (int, error) {
 	})
 
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse token: %v", err)
+		return 0, "", fmt.Errorf("failed to parse token: %v", err)
 	}
 
 	if !token.Valid {
-		return 0, fmt.Errorf("invalid token")
+		return 0, "", fmt.Errorf("invalid token")
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return 0, fmt.Errorf("invalid token claims")
+		return 0, "", fmt.Errorf("invalid token claims")
 	}
 
 	userIDFloat, ok := claims["user_id"].(float64)
 	if !ok {
-		return 0, fmt.Errorf("user_id not found in token")
+		return 0, "", fmt.Errorf("user_id not found in token")
 	}
 
-	return int(userIDFloat), nil
+	// Access tokens are only as good as the session that issued them
+	sessionID, ok := claims["sid"].(string)
+	if !ok {
+		return 0, "", fmt.Errorf("token has no session")
+	}
+	var active bool
+	err = db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM sessions
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP)`,
+		sessionID, int(userIDFloat),
+	).Scan(&active)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to check session: %v", err)
+	}
+	if !active {
+		return 0, "", fmt.Errorf("session expired or revoked")
+	}
+
+	return int(userIDFloat), sessionID, nil
 }
 
 type AuthHandler struct {
@@ -86,7 +112,9 @@ type User struct {
 	GoogleID        *string   `json:"google_id,omitempty"`
 	AvatarURL       *string   `json:"avatar_url,omitempty"`
 	EmailVerifiedAt *time.Time `json:"email_verified_at"`
-	CreatedAt       time.Time `json:"created_at"`
+	// Set while the customer has paused their own account
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
 }
 
 type LoginRequest struct {
@@ -95,16 +123,23 @@ type LoginRequest struct {
 }
 
 type RegisterRequest struct {
-	Email     string `json:"email"`
-	Password  string `json:"password"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Phone     string `json:"phone,omitempty"`
+	Email      string `json:"email"`
+	Password   string `json:"password"`
+	FirstName  string `json:"first_name"`
+	LastName   string `json:"last_name"`
+	Phone      string `json:"phone,omitempty"`
+	ZipCode    string `json:"zip_code,omitempty"`    // Checked against soft-launch markets
+	InviteCode string `json:"invite_code,omitempty"` // Required in invite-only markets
 }
 
 type AuthResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // Seconds until token expires
+	User         User   `json:"user"`
+	// The customer deactivated their account; the app asks them to confirm
+	// reactivating it with POST /account/reactivate
+	ReactivationRequired bool `json:"reactivation_required,omitempty"`
 }
 
 type ChangePasswordRequest struct {
@@ -122,11 +157,16 @@ type GoogleUserInfo struct {
 	Picture       string `json:"picture"`
 }
 
-func NewAuthHandler(db *sql.DB) *AuthHandler {
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "fallback-secret-key"
+// jwtSecretFromEnv is the key access tokens are signed and checked with.
+// Issuing and checking must agree, so both go through here.
+func jwtSecretFromEnv() []byte {
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		return []byte(secret)
 	}
+	return []byte("fallback-secret-key")
+}
+
+func NewAuthHandler(db *sql.DB) *AuthHandler {
 
 	googleConfig := &oauth2.Config{
 		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
@@ -141,15 +181,17 @@ func NewAuthHandler(db *sql.DB) *AuthHandler {
 
 	return &AuthHandler{
 		db:           db,
-		jwtSecret:    []byte(jwtSecret),
+		jwtSecret:    jwtSecretFromEnv(),
 		googleConfig: googleConfig,
 	}
 }
 
-func (h *AuthHandler) generateJWT(userID int) (string, error) {
+// generateJWT issues a short-lived access token for a session
+func (h *AuthHandler) generateJWT(userID int, sessionID string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24 * 7).Unix(), // 7 days
+		"sid":     sessionID,
+		"exp":     time.Now().Add(accessTokenTTL()).Unix(),
 		"iat":     time.Now().Unix(),
 	})
 
@@ -167,23 +209,7 @@ func (h *AuthHandler) checkPassword(password, hash string) bool {
 }
 
 func (h *AuthHandler) getUserByID(userID int) (*User, error) {
-	query := `
-		SELECT id, email, first_name, last_name, phone, role, status, google_id, avatar_url, email_verified_at, created_at
-		FROM users WHERE id = $1
-	`
-	
-	user := &User{}
-	err := h.db.QueryRow(query, userID).Scan(
-		&user.ID, &user.Email, &user.FirstName, &user.LastName,
-		&user.Phone, &user.Role, &user.Status, &user.GoogleID, &user.AvatarURL,
-		&user.EmailVerifiedAt, &user.CreatedAt,
-	)
-	
-	if err != nil {
-		return nil, err
-	}
-	
-	return user, nil
+	return pgUserRepo{db: h.db}.Get(context.Background(), userID)
 }
 
 func (h *AuthHandler) getUserByEmail(email string) (*User, error) {
@@ -244,6 +270,24 @@ func (h *AuthHandler) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Soft-launch markets only take signups with an invite code
+	req.ZipCode = strings.TrimSpace(req.ZipCode)
+	if req.ZipCode != "" && marketForZip(req.ZipCode) == "" {
+		http.Error(w, "Invalid ZIP code", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.InviteCode) == "" {
+		required, err := inviteRequired(h.db, req.ZipCode)
+		if err != nil {
+			http.Error(w, "Error checking invite requirement", http.StatusInternalServerError)
+			return
+		}
+		if required {
+			http.Error(w, "An invite code is required to sign up in your area", http.StatusForbidden)
+			return
+		}
+	}
+
 	// Hash password
 	hashedPassword, err := h.hashPassword(req.Password)
 	if err != nil {
@@ -251,10 +295,31 @@ func (h *AuthHandler) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var inviteCodeID *int
+	if strings.TrimSpace(req.InviteCode) != "" {
+		codeID, err := redeemInviteCode(tx, req.InviteCode, req.ZipCode)
+		if err == errInvalidInviteCode {
+			http.Error(w, "Invalid or expired invite code", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error checking invite code", http.StatusInternalServerError)
+			return
+		}
+		inviteCodeID = &codeID
+	}
+
 	// Create user
 	query := `
-		INSERT INTO users (email, password_hash, first_name, last_name, phone, role)
-		VALUES ($1, $2, $3, $4, $5, 'customer')
+		INSERT INTO users (email, password_hash, first_name, last_name, phone, role, invite_code_id, signup_zip)
+		VALUES ($1, $2, $3, $4, $5, 'customer', $6, NULLIF($7, ''))
 		RETURNING id, created_at
 	`
 	
@@ -265,14 +330,18 @@ func (h *AuthHandler) handleRegister(w http.ResponseWriter, r *http.Request) {
 		phone = nil
 	}
 	
-	err = h.db.QueryRow(query, req.Email, hashedPassword, req.FirstName, req.LastName, phone).Scan(&userID, &createdAt)
+	err = tx.QueryRow(query, req.Email, hashedPassword, req.FirstName, req.LastName, phone, inviteCodeID, req.ZipCode).Scan(&userID, &createdAt)
 	if err != nil {
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error creating user", http.StatusInternalServerError)
+		return
+	}
 
-	// Generate JWT
-	token, err := h.generateJWT(userID)
+	// Start a session
+	token, refreshToken, err := h.startSession(r, userID)
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
@@ -286,8 +355,10 @@ func (h *AuthHandler) handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := AuthResponse{
-		Token: token,
-		User:  *user,
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL().Seconds()),
+		User:         *user,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -329,13 +400,6 @@ func (h *AuthHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate JWT
-	token, err := h.generateJWT(userID)
-	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
-		return
-	}
-
 	// Get user details
 	user, err := h.getUserByID(userID)
 	if err != nil {
@@ -358,9 +422,19 @@ func (h *AuthHandler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Start a session
+	token, refreshToken, err := h.startSession(r, userID)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
 	response := AuthResponse{
-		Token: token,
-		User:  *user,
+		Token:                token,
+		RefreshToken:         refreshToken,
+		ExpiresIn:            int(accessTokenTTL().Seconds()),
+		User:                 *user,
+		ReactivationRequired: user.DeactivatedAt != nil,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -450,16 +524,16 @@ func (h *AuthHandler) handleGoogleCallback(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	// Generate JWT
-	jwtToken, err := h.generateJWT(userID)
+	// The frontend trades the one-time code for tokens, keeping them out of
+	// the URL, browser history and logs
+	loginCode, err := issueLoginCode(h.db, userID)
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
 
-	// Redirect to frontend with token
 	frontendURL := os.Getenv("FRONTEND_URL")
-	redirectURL := fmt.Sprintf("%s/auth/callback?token=%s", frontendURL, jwtToken)
+	redirectURL := fmt.Sprintf("%s/auth/callback?code=%s", frontendURL, loginCode)
 	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 }
 
@@ -538,18 +612,43 @@ func (h *AuthHandler) handleChangePassword(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Update password in database
+	// Update password in database, logging out every session that knew the old one
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Error updating password", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	updateQuery := `UPDATE users SET password_hash = $1 WHERE id = $2`
-	_, err = h.db.Exec(updateQuery, newPasswordHash, userID)
+	_, err = tx.Exec(updateQuery, newPasswordHash, userID)
+	if err == nil {
+		err = revokeUserSessions(tx, userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		http.Error(w, "Error updating password", http.StatusInternalServerError)
 		return
 	}
 
+	// Keep the user logged in here with a fresh session
+	token, refreshToken, err := h.startSession(r, userID)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
 	// Return success response
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Password changed successfully"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Password changed successfully",
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(accessTokenTTL().Seconds()),
+	})
 }
 
 func (h *AuthHandler) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
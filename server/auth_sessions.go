@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// accessTokenTTL is how long an access token works before the client has to
+// refresh it (ACCESS_TOKEN_TTL_MINUTES)
+func accessTokenTTL() time.Duration {
+	if minutes, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_TTL_MINUTES")); err == nil && minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return 15 * time.Minute
+}
+
+// refreshTokenTTL is how long a session survives without being refreshed
+// (REFRESH_TOKEN_TTL_DAYS)
+func refreshTokenTTL() time.Duration {
+	if days, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_TTL_DAYS")); err == nil && days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return 30 * 24 * time.Hour
+}
+
+var errSessionNotFound = errors.New("session expired or revoked")
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RefreshResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // Seconds until token expires
+}
+
+// Only a hash of each refresh token is stored, so a database leak can't be
+// replayed as logins
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession records a new login and returns its access and refresh tokens
+func (h *AuthHandler) startSession(r *http.Request, userID int) (string, string, error) {
+	sessionID := generateRandomString(16)
+	refreshToken := generateRandomString(32)
+	_, err := h.db.Exec(`
+		INSERT INTO sessions (id, user_id, refresh_token_hash, user_agent, ip_address, last_used_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP, $6)`,
+		sessionID, userID, hashRefreshToken(refreshToken), r.UserAgent(), r.RemoteAddr, time.Now().Add(refreshTokenTTL()),
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := h.generateJWT(userID, sessionID)
+	return accessToken, refreshToken, err
+}
+
+// loginCodeTTL is how long the frontend has to exchange an OAuth login code
+const loginCodeTTL = time.Minute
+
+// issueLoginCode returns a one-time code the frontend trades for a session
+// with POST /auth/exchange, so OAuth redirects don't carry tokens
+func issueLoginCode(q execer, userID int) (string, error) {
+	code := generateRandomString(32)
+	_, err := q.Exec(
+		"INSERT INTO login_codes (code_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		hashRefreshToken(code), userID, time.Now().Add(loginCodeTTL),
+	)
+	return code, err
+}
+
+type LoginCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// handleExchangeLoginCode starts a session for a login code from an OAuth
+// redirect. Each code works once and only for an active account.
+func (h *AuthHandler) handleExchangeLoginCode(w http.ResponseWriter, r *http.Request) {
+	var req LoginCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	err := h.db.QueryRow(`
+		DELETE FROM login_codes c
+		USING users u
+		WHERE c.code_hash = $1 AND u.id = c.user_id AND u.status = 'active'
+		  AND c.expires_at > CURRENT_TIMESTAMP
+		RETURNING c.user_id`,
+		hashRefreshToken(req.Code),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Login code is invalid or has expired", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error exchanging login code", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := h.getUserByID(userID)
+	if err != nil {
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+	token, refreshToken, err := h.startSession(r, userID)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuthResponse{
+		Token:                token,
+		RefreshToken:         refreshToken,
+		ExpiresIn:            int(accessTokenTTL().Seconds()),
+		User:                 *user,
+		ReactivationRequired: user.DeactivatedAt != nil,
+	})
+}
+
+// rotateRefreshToken swaps a refresh token for a new one, extending its
+// session. Presenting a token that was already rotated out means someone
+// else has a copy, so the session is revoked for everyone holding it.
+func (h *AuthHandler) rotateRefreshToken(r *http.Request, refreshToken string) (userID int, sessionID, newToken string, err error) {
+	hash := hashRefreshToken(refreshToken)
+	newToken = generateRandomString(32)
+	err = h.db.QueryRow(`
+		UPDATE sessions s
+		SET refresh_token_hash = $2, previous_token_hash = s.refresh_token_hash,
+		    last_used_at = CURRENT_TIMESTAMP, expires_at = $3, ip_address = $4
+		FROM users u
+		WHERE s.refresh_token_hash = $1 AND u.id = s.user_id AND u.status = 'active'
+		  AND s.revoked_at IS NULL AND s.expires_at > CURRENT_TIMESTAMP
+		RETURNING s.user_id, s.id`,
+		hash, hashRefreshToken(newToken), time.Now().Add(refreshTokenTTL()), r.RemoteAddr,
+	).Scan(&userID, &sessionID)
+	if err == sql.ErrNoRows {
+		_, err = h.db.Exec(`
+			UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, expires_at = LEAST(expires_at, CURRENT_TIMESTAMP)
+			WHERE previous_token_hash = $1 AND revoked_at IS NULL`,
+			hash,
+		)
+		if err == nil {
+			err = errSessionNotFound
+		}
+	}
+	return userID, sessionID, newToken, err
+}
+
+// revokeSession logs one session out. Its expiry is pulled in too, so the
+// expired_sessions retention purge cleans it up.
+func revokeSession(q execer, sessionID string) error {
+	_, err := q.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, expires_at = LEAST(expires_at, CURRENT_TIMESTAMP)
+		WHERE id = $1 AND revoked_at IS NULL`,
+		sessionID,
+	)
+	return err
+}
+
+// revokeUserSessions logs a user out everywhere
+func revokeUserSessions(q execer, userID int) error {
+	_, err := q.Exec(`
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP, expires_at = LEAST(expires_at, CURRENT_TIMESTAMP)
+		WHERE user_id = $1 AND revoked_at IS NULL`,
+		userID,
+	)
+	return err
+}
+
+// handleRefresh trades a refresh token for a new access token and a new
+// refresh token. The old refresh token stops working.
+func (h *AuthHandler) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	userID, sessionID, refreshToken, err := h.rotateRefreshToken(r, req.RefreshToken)
+	if err == errSessionNotFound {
+		http.Error(w, "Session expired or revoked", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error refreshing session", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := h.generateJWT(userID, sessionID)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RefreshResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL().Seconds()),
+	})
+}
+
+// handleLogout ends the session behind the request's access token, or the
+// one a refresh_token in the body belongs to when the access token has
+// already expired. ?all=true ends every session the user has.
+func (h *AuthHandler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	json.NewDecoder(r.Body).Decode(&req) // The body is optional
+
+	userID, sessionID, err := sessionFromRequest(r, h.db)
+	if err != nil && req.RefreshToken != "" {
+		err = h.db.QueryRow(
+			"SELECT user_id, id FROM sessions WHERE refresh_token_hash = $1 AND revoked_at IS NULL",
+			hashRefreshToken(req.RefreshToken),
+		).Scan(&userID, &sessionID)
+	}
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Query().Get("all") == "true" {
+		err = revokeUserSessions(h.db, userID)
+	} else {
+		err = revokeSession(h.db, sessionID)
+	}
+	if err != nil {
+		http.Error(w, "Error logging out", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminRevokeSessions force-logs-out a user on every device
+func (h *AuthHandler) handleAdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := revokeUserSessions(h.db, userID); err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -566,4 +566,105 @@ func TestAuthHandler_LoginStatusCheck(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestAuthHandler_RefreshSessions(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	handler := NewAuthHandler(db.DB)
+	userID := db.CreateTestUserWithPassword(t, "sessions@example.com", "Session", "User", "password123")
+
+	login := func() AuthResponse {
+		body, _ := json.Marshal(LoginRequest{Email: "sessions@example.com", Password: "password123"})
+		w := httptest.NewRecorder()
+		handler.handleLogin(w, httptest.NewRequest("POST", "/api/v1/auth/login", bytes.NewBuffer(body)))
+		var response AuthResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if w.Code != http.StatusOK || response.RefreshToken == "" {
+			t.Fatalf("Expected a login with a refresh token, got %d: %s", w.Code, w.Body.String())
+		}
+		return response
+	}
+	authenticates := func(token string) bool {
+		req := httptest.NewRequest("GET", "/api/v1/users/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		id, err := getUserIDFromRequest(req, db.DB)
+		return err == nil && id == userID
+	}
+	refresh := func(refreshToken string) (*httptest.ResponseRecorder, RefreshResponse) {
+		body, _ := json.Marshal(RefreshRequest{RefreshToken: refreshToken})
+		w := httptest.NewRecorder()
+		handler.handleRefresh(w, httptest.NewRequest("POST", "/api/v1/auth/refresh", bytes.NewBuffer(body)))
+		var response RefreshResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	first := login()
+	if !authenticates(first.Token) {
+		t.Fatal("Expected the access token to authenticate")
+	}
+
+	w, rotated := refresh(first.RefreshToken)
+	if w.Code != http.StatusOK || rotated.RefreshToken == first.RefreshToken || !authenticates(rotated.Token) {
+		t.Fatalf("Expected a rotated token pair, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Replaying the rotated-out token looks like theft and ends the session
+	if w, _ := refresh(first.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a reused refresh token to be refused, got %d", w.Code)
+	}
+	if authenticates(rotated.Token) {
+		t.Error("Expected reuse to revoke the session")
+	}
+
+	// Changing the password logs out other sessions but keeps this one going
+	other := login()
+	current := login()
+	body, _ := json.Marshal(ChangePasswordRequest{CurrentPassword: "password123", NewPassword: "newpassword456"})
+	req := httptest.NewRequest("POST", "/api/v1/auth/change-password", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+current.Token)
+	w = httptest.NewRecorder()
+	handler.handleChangePassword(w, req)
+	var changed RefreshResponse
+	json.Unmarshal(w.Body.Bytes(), &changed)
+	if w.Code != http.StatusOK || !authenticates(changed.Token) {
+		t.Fatalf("Expected a fresh session after changing password, got %d: %s", w.Code, w.Body.String())
+	}
+	if authenticates(other.Token) || authenticates(current.Token) {
+		t.Error("Expected sessions from before the password change to be revoked")
+	}
+	if w, _ := refresh(other.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an old refresh token to be refused, got %d", w.Code)
+	}
+
+	// An OAuth login code is traded for a session once
+	code, err := issueLoginCode(db.DB, userID)
+	if err != nil {
+		t.Fatalf("Failed to issue login code: %v", err)
+	}
+	exchange := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(LoginCodeRequest{Code: code})
+		w := httptest.NewRecorder()
+		handler.handleExchangeLoginCode(w, httptest.NewRequest("POST", "/api/v1/auth/exchange", bytes.NewBuffer(body)))
+		return w
+	}
+	w = exchange()
+	var exchanged AuthResponse
+	json.Unmarshal(w.Body.Bytes(), &exchanged)
+	if w.Code != http.StatusOK || exchanged.RefreshToken == "" || !authenticates(exchanged.Token) {
+		t.Fatalf("Expected the login code to start a session, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := exchange(); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a used login code to be refused, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/v1/auth/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+changed.Token)
+	w = httptest.NewRecorder()
+	handler.handleLogout(w, req)
+	if w.Code != http.StatusNoContent || authenticates(changed.Token) {
+		t.Errorf("Expected logout to end the session, got %d", w.Code)
+	}
+}
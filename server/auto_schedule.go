@@ -0,0 +1,347 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	autoScheduledNotificationType = "pickup_scheduled"
+	// maxAutoSchedulePauseDays keeps a pause from quietly turning into a
+	// cancellation
+	maxAutoSchedulePauseDays = 90
+)
+
+type AutoScheduleStatus struct {
+	Enabled        bool     `json:"auto_schedule_enabled"`
+	PausedUntil    *string  `json:"paused_until,omitempty"`
+	SkippedDates   []string `json:"skipped_dates"`
+	NextPickupDate *string  `json:"next_pickup_date,omitempty"`
+}
+
+type SkipPickupRequest struct {
+	PickupDate string `json:"pickup_date"`
+}
+
+type PauseAutoScheduleRequest struct {
+	// Until is the last day no pickups are scheduled for (YYYY-MM-DD)
+	Until string `json:"until"`
+}
+
+// pickupDateSkipped reports whether a customer skipped their pickup on date
+func pickupDateSkipped(q queryRower, userID int, date time.Time) (bool, error) {
+	var skipped bool
+	err := q.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM auto_schedule_skips WHERE user_id = $1 AND pickup_date = $2)",
+		userID, date.Format("2006-01-02"),
+	).Scan(&skipped)
+	return skipped, err
+}
+
+// cancelAutoScheduledOrders cancels the orders the scheduler made for a
+// customer with pickups from through through, as long as nothing has
+// happened to them yet, and takes them off drivers' routes. It returns the
+// cancelled order IDs.
+func cancelAutoScheduledOrders(tx *sql.Tx, userID int, from, through, reason string) ([]int, error) {
+	rows, err := tx.Query(`
+		UPDATE orders SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND auto_scheduled AND status = 'pending'
+		  AND pickup_date BETWEEN $2 AND $3
+		RETURNING id`,
+		userID, from, through,
+	)
+	if err != nil {
+		return nil, err
+	}
+	cancelled := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		cancelled = append(cancelled, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(cancelled) == 0 {
+		return cancelled, nil
+	}
+	_, err = tx.Exec(`
+		INSERT INTO order_status_history (order_id, status, notes, updated_by)
+		SELECT id, 'cancelled', $2, $3 FROM UNNEST($1::int[]) AS id`,
+		pq.Array(cancelled), reason, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	// Drivers shouldn't turn up for them
+	if _, err := tx.Exec("DELETE FROM route_orders WHERE order_id = ANY($1) AND status = 'pending'", pq.Array(cancelled)); err != nil {
+		return nil, err
+	}
+	return cancelled, nil
+}
+
+// notifyAutoScheduledOrder tells a customer the scheduler booked a pickup,
+// so an unwanted one can be skipped before the driver shows up
+func (s *AutoScheduler) notifyAutoScheduledOrder(user ScheduleableUser, orderID int, pickupDate time.Time) {
+	message := fmt.Sprintf("We scheduled your pickup for %s, %s. Not needed this time? You can skip it from your subscription settings.",
+		pickupDate.Format("Monday, January 2"), user.PreferredPickupTimeSlot)
+	_, err := s.db.Exec(`
+		INSERT INTO notifications (user_id, order_id, type, title, message)
+		VALUES ($1, $2, $3, $4, $5)`,
+		user.UserID, orderID, autoScheduledNotificationType, "Pickup scheduled", message,
+	)
+	if err != nil {
+		log.Printf("Failed to record auto-scheduled order notification for order %d: %v", orderID, err)
+	}
+	if s.realtime != nil {
+		s.realtime.PublishOrderUpdate(user.UserID, orderID, "pending", message, map[string]interface{}{
+			"auto_scheduled": true,
+			"pickup_date":    pickupDate.Format("2006-01-02"),
+		})
+	}
+}
+
+// parseUpcomingDate parses a YYYY-MM-DD date that must not be in the past
+func parseUpcomingDate(value string) (time.Time, error) {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("date must be YYYY-MM-DD")
+	}
+	if date.Before(time.Now().UTC().Truncate(24 * time.Hour)) {
+		return time.Time{}, fmt.Errorf("date is in the past")
+	}
+	return date, nil
+}
+
+// handleGetAutoSchedule returns the caller's pause and upcoming skipped
+// pickups along with the next date the scheduler will book
+func (h *SubscriptionHandler) handleGetAutoSchedule(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	status := AutoScheduleStatus{SkippedDates: []string{}}
+	var pickupDay string
+	var leadTimeDays int
+	var pausedUntil sql.NullTime
+	err = h.db.QueryRow(`
+		SELECT auto_schedule_enabled, auto_schedule_paused_until, preferred_pickup_day, lead_time_days
+		FROM subscription_preferences WHERE user_id = $1`,
+		userID,
+	).Scan(&status.Enabled, &pausedUntil, &pickupDay, &leadTimeDays)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Failed to fetch auto-schedule", http.StatusInternalServerError)
+		return
+	}
+	if pausedUntil.Valid && !pausedUntil.Time.Before(time.Now().UTC().Truncate(24*time.Hour)) {
+		until := pausedUntil.Time.Format("2006-01-02")
+		status.PausedUntil = &until
+	}
+	if status.Enabled {
+		next := (&AutoScheduler{}).getNextPickupDate(pickupDay, leadTimeDays).Format("2006-01-02")
+		status.NextPickupDate = &next
+	}
+
+	rows, err := h.db.Query(`
+		SELECT TO_CHAR(pickup_date, 'YYYY-MM-DD') FROM auto_schedule_skips
+		WHERE user_id = $1 AND pickup_date >= CURRENT_DATE
+		ORDER BY pickup_date`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch auto-schedule", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var date string
+		if err := rows.Scan(&date); err != nil {
+			http.Error(w, "Failed to fetch auto-schedule", http.StatusInternalServerError)
+			return
+		}
+		status.SkippedDates = append(status.SkippedDates, date)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleSkipAutoSchedule skips one pickup date, cancelling the order the
+// scheduler already booked for it if the pickup hasn't happened
+func (h *SubscriptionHandler) handleSkipAutoSchedule(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req SkipPickupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	date, err := parseUpcomingDate(req.PickupDate)
+	if err != nil {
+		http.Error(w, "pickup_date: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	day := date.Format("2006-01-02")
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT INTO auto_schedule_skips (user_id, pickup_date) VALUES ($1, $2)
+		ON CONFLICT (user_id, pickup_date) DO NOTHING`,
+		userID, day,
+	); err != nil {
+		http.Error(w, "Failed to skip pickup", http.StatusInternalServerError)
+		return
+	}
+	cancelled, err := cancelAutoScheduledOrders(tx, userID, day, day, "Pickup skipped by customer")
+	if err != nil {
+		http.Error(w, "Failed to skip pickup", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to skip pickup", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pickup_date":         day,
+		"cancelled_order_ids": cancelled,
+	})
+}
+
+// handleUnskipAutoSchedule undoes a skip. The scheduler books the pickup
+// again on its next run if the date is still ahead.
+func (h *SubscriptionHandler) handleUnskipAutoSchedule(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	date, err := time.Parse("2006-01-02", mux.Vars(r)["date"])
+	if err != nil {
+		http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec(
+		"DELETE FROM auto_schedule_skips WHERE user_id = $1 AND pickup_date = $2",
+		userID, date.Format("2006-01-02"),
+	)
+	if err != nil {
+		http.Error(w, "Failed to remove skip", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Skipped pickup not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePauseAutoSchedule stops the scheduler booking pickups through the
+// given date and cancels the untouched ones it already booked
+func (h *SubscriptionHandler) handlePauseAutoSchedule(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req PauseAutoScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	until, err := parseUpcomingDate(req.Until)
+	if err != nil {
+		http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if until.After(time.Now().UTC().AddDate(0, 0, maxAutoSchedulePauseDays)) {
+		http.Error(w, fmt.Sprintf("Auto-scheduling can be paused for at most %d days", maxAutoSchedulePauseDays), http.StatusBadRequest)
+		return
+	}
+	day := until.Format("2006-01-02")
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE subscription_preferences SET auto_schedule_paused_until = $1 WHERE user_id = $2",
+		day, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to pause auto-scheduling", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Set up your subscription preferences first", http.StatusNotFound)
+		return
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	cancelled, err := cancelAutoScheduledOrders(tx, userID, today, day, "Auto-scheduling paused by customer")
+	if err != nil {
+		http.Error(w, "Failed to pause auto-scheduling", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to pause auto-scheduling", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"paused_until":        day,
+		"cancelled_order_ids": cancelled,
+	})
+}
+
+// handleResumeAutoSchedule lifts a pause early
+func (h *SubscriptionHandler) handleResumeAutoSchedule(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := h.db.Exec(
+		"UPDATE subscription_preferences SET auto_schedule_paused_until = NULL WHERE user_id = $1",
+		userID,
+	); err != nil {
+		http.Error(w, "Failed to resume auto-scheduling", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
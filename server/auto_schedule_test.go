@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAutoScheduleSkipAndPause(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "auto-schedule@example.com", "Auto", "Schedule")
+	addressID := db.CreateTestAddress(t, userID)
+	db.Exec(`
+		INSERT INTO subscription_preferences (user_id, default_pickup_address_id, default_delivery_address_id, preferred_pickup_day)
+		VALUES ($1, $2, $2, 'wednesday')`,
+		userID, addressID,
+	)
+
+	realtime := NewMockRealtimeHandler()
+	scheduler := &AutoScheduler{db: db.DB, realtime: realtime}
+	user := ScheduleableUser{
+		UserID:                   userID,
+		DefaultPickupAddressID:   &addressID,
+		DefaultDeliveryAddressID: &addressID,
+		PreferredPickupTimeSlot:  "8:00 AM - 12:00 PM",
+		PreferredPickupDay:       "wednesday",
+		LeadTimeDays:             1,
+		PickupsRemaining:         4,
+	}
+	nextPickup := scheduler.getNextPickupDate("wednesday", 1).Format("2006-01-02")
+
+	handler := &SubscriptionHandler{db: db.DB, getUserID: CreateAuthMock(userID).getUserIDFromRequest}
+	call := func(fn http.HandlerFunc, method, body string, vars map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/subscriptions/auto-schedule", strings.NewReader(body))
+		if vars != nil {
+			req = mux.SetURLVars(req, vars)
+		}
+		w := httptest.NewRecorder()
+		fn(w, req)
+		return w
+	}
+	schedule := func() {
+		// Reload the pause the way the scheduler would see it
+		var pausedUntil *time.Time
+		db.QueryRow("SELECT auto_schedule_paused_until FROM subscription_preferences WHERE user_id = $1", userID).Scan(&pausedUntil)
+		user.PausedUntil = pausedUntil
+		if err := scheduler.createOrderForUser(user); err != nil {
+			t.Fatalf("Failed to auto-schedule: %v", err)
+		}
+	}
+	activeOrders := func() int {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM orders WHERE user_id = $1 AND status != 'cancelled'", userID).Scan(&n)
+		return n
+	}
+
+	if w := call(handler.handleSkipAutoSchedule, "POST", `{"pickup_date": "2000-01-01"}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d skipping a past date, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// A skipped date isn't booked
+	if w := call(handler.handleSkipAutoSchedule, "POST", `{"pickup_date": "`+nextPickup+`"}`, nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	schedule()
+	if n := activeOrders(); n != 0 {
+		t.Errorf("Expected no order on a skipped date, got %d", n)
+	}
+
+	// Once unskipped, the order is booked and the customer told about it
+	if w := call(handler.handleUnskipAutoSchedule, "DELETE", "", map[string]string{"date": nextPickup}); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	schedule()
+	var orderID int
+	var autoScheduled bool
+	db.QueryRow("SELECT id, auto_scheduled FROM orders WHERE user_id = $1 AND status = 'pending'", userID).Scan(&orderID, &autoScheduled)
+	if orderID == 0 || !autoScheduled {
+		t.Fatalf("Expected an auto-scheduled order, got %d", orderID)
+	}
+	if len(realtime.PublishedUpdates) != 1 || realtime.PublishedUpdates[0].OrderID != orderID {
+		t.Errorf("Expected a realtime update for order %d, got %+v", orderID, realtime.PublishedUpdates)
+	}
+	var notifications int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE order_id = $1 AND type = 'pickup_scheduled'", orderID).Scan(&notifications)
+	if notifications != 1 {
+		t.Errorf("Expected a pickup_scheduled notification, got %d", notifications)
+	}
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, $2, 'pickup', 'planned') RETURNING id`, userID, nextPickup).Scan(&routeID)
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number, status) VALUES ($1, $2, 1, 'pending')", routeID, orderID)
+
+	// Skipping a booked date cancels the order and takes it off the route
+	w := call(handler.handleSkipAutoSchedule, "POST", `{"pickup_date": "`+nextPickup+`"}`, nil)
+	var skip struct {
+		CancelledOrderIDs []int `json:"cancelled_order_ids"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &skip)
+	if len(skip.CancelledOrderIDs) != 1 || skip.CancelledOrderIDs[0] != orderID {
+		t.Errorf("Expected order %d to be cancelled, got %s", orderID, w.Body.String())
+	}
+	var stops int
+	db.QueryRow("SELECT COUNT(*) FROM route_orders WHERE order_id = $1", orderID).Scan(&stops)
+	if stops != 0 {
+		t.Errorf("Expected the cancelled order off the route, got %d stops", stops)
+	}
+	call(handler.handleUnskipAutoSchedule, "DELETE", "", map[string]string{"date": nextPickup})
+
+	// A pause covering the date holds off booking until it's lifted
+	if w := call(handler.handlePauseAutoSchedule, "POST", `{"until": "`+nextPickup+`"}`, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	schedule()
+	if n := activeOrders(); n != 0 {
+		t.Errorf("Expected no order while paused, got %d", n)
+	}
+
+	w = call(handler.handleGetAutoSchedule, "GET", "", nil)
+	var status AutoScheduleStatus
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.PausedUntil == nil || *status.PausedUntil != nextPickup || len(status.SkippedDates) != 0 {
+		t.Errorf("Unexpected auto-schedule status: %s", w.Body.String())
+	}
+
+	call(handler.handleResumeAutoSchedule, "DELETE", "", nil)
+
+	// A full slot isn't overbooked by the scheduler
+	db.Exec(`
+		INSERT INTO pickup_time_slots (time_slot, capacity) VALUES ('8:00 AM - 12:00 PM', 0)
+		ON CONFLICT (time_slot) DO UPDATE SET capacity = 0, is_active = true`)
+	schedule()
+	if n := activeOrders(); n != 0 {
+		t.Errorf("Expected no order in a full slot, got %d", n)
+	}
+	db.Exec("UPDATE pickup_time_slots SET capacity = 10 WHERE time_slot = '8:00 AM - 12:00 PM'")
+
+	schedule()
+	if n := activeOrders(); n != 1 {
+		t.Errorf("Expected the order to be booked after resuming, got %d", n)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/robfig/cron/v3"
+)
+
+// BackupVerifier restores the newest database backup into a scratch database
+// and compares it against production, so we have routine proof that backups work
+type BackupVerifier struct {
+	db     *sql.DB
+	alerts AdminAlertPublisher
+	config BackupVerifierConfig
+	cron   *cron.Cron
+	// running is set while a verification is restoring into the scratch database
+	running atomic.Bool
+}
+
+type BackupVerifierConfig struct {
+	BackupDir      string        // Directory pg_dump writes .dump/.sql files to
+	ScratchDBName  string        // Database the backup is restored into
+	Schedule       string        // Cron schedule for the verification run
+	RestoreTimeout time.Duration // Upper bound for a single restore
+}
+
+// BackupVerification is the recorded outcome of one verification run
+type BackupVerification struct {
+	ID                int                 `json:"id"`
+	BackupFile        string              `json:"backup_file"`
+	BackupTakenAt     *time.Time          `json:"backup_taken_at,omitempty"`
+	Status            string              `json:"status"` // passed, warning, failed
+	RestoreDurationMs int64               `json:"restore_duration_ms"`
+	Tables            []TableVerification `json:"tables"`
+	Error             *string             `json:"error,omitempty"`
+	CreatedAt         time.Time           `json:"created_at"`
+}
+
+// TableVerification compares one table between the restored backup and the
+// live database, limited to rows that existed when the backup was taken
+type TableVerification struct {
+	Table            string `json:"table"`
+	RestoredRows     int    `json:"restored_rows"`
+	LiveRows         int    `json:"live_rows"`
+	RestoredChecksum string `json:"restored_checksum"`
+	LiveChecksum     string `json:"live_checksum"`
+	Matches          bool   `json:"matches"`
+}
+
+// verifiedTables are compared after every restore
+var verifiedTables = []string{
+	"users",
+	"addresses",
+	"subscriptions",
+	"orders",
+	"order_items",
+	"payments",
+}
+
+var scratchDBNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// backupVerifierConfigFromEnv reads the verifier configuration. The job is
+// disabled when BACKUP_DIR is not set.
+func backupVerifierConfigFromEnv() BackupVerifierConfig {
+	config := BackupVerifierConfig{
+		BackupDir:      os.Getenv("BACKUP_DIR"),
+		ScratchDBName:  os.Getenv("BACKUP_VERIFY_DB"),
+		Schedule:       os.Getenv("BACKUP_VERIFY_SCHEDULE"),
+		RestoreTimeout: 30 * time.Minute,
+	}
+	if config.ScratchDBName == "" {
+		config.ScratchDBName = "tumble_restore_check"
+	}
+	if config.Schedule == "" {
+		config.Schedule = "30 4 * * *" // Daily at 4:30 UTC, after the nightly dump
+	}
+	return config
+}
+
+func NewBackupVerifier(db *sql.DB, alerts AdminAlertPublisher, config BackupVerifierConfig) *BackupVerifier {
+	return &BackupVerifier{
+		db:     db,
+		alerts: alerts,
+		config: config,
+		cron:   cron.New(cron.WithLocation(time.UTC)),
+	}
+}
+
+func (v *BackupVerifier) Start() error {
+	if v.config.BackupDir == "" {
+		log.Println("Backup verification disabled - BACKUP_DIR not set")
+		return nil
+	}
+	if !scratchDBNamePattern.MatchString(v.config.ScratchDBName) {
+		return fmt.Errorf("invalid scratch database name %q", v.config.ScratchDBName)
+	}
+
+	if _, err := v.cron.AddFunc(v.config.Schedule, func() { v.Verify() }); err != nil {
+		return fmt.Errorf("invalid backup verification schedule: %v", err)
+	}
+	v.cron.Start()
+	log.Printf("Backup verifier started - schedule %q", v.config.Schedule)
+	return nil
+}
+
+func (v *BackupVerifier) Stop() {
+	v.cron.Stop()
+}
+
+// latestBackupFile returns the most recently modified backup in dir
+func latestBackupFile(dir string) (string, time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	type backup struct {
+		path    string
+		modTime time.Time
+	}
+	var backups []backup
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(entry.Name())
+		if ext != ".dump" && ext != ".sql" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{filepath.Join(dir, entry.Name()), info.ModTime()})
+	}
+
+	if len(backups) == 0 {
+		return "", time.Time{}, fmt.Errorf("no backups found in %s", dir)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].modTime.After(backups[j].modTime)
+	})
+	return backups[0].path, backups[0].modTime, nil
+}
+
+// verificationStatus summarizes table comparisons. Mismatches are warnings
+// rather than failures since rows can legitimately be changed or deleted
+// after a backup.
+func verificationStatus(tables []TableVerification) string {
+	for _, table := range tables {
+		if !table.Matches {
+			return "warning"
+		}
+	}
+	return "passed"
+}
+
+// Verify runs one restore-and-compare cycle, records it, and alerts admins.
+// Only one runs at a time since they share the scratch database; it returns
+// nil without running when another is in progress.
+func (v *BackupVerifier) Verify() *BackupVerification {
+	if !v.running.CompareAndSwap(false, true) {
+		log.Println("Backup verification already running, skipping")
+		return nil
+	}
+	defer v.running.Store(false)
+
+	result := &BackupVerification{Tables: []TableVerification{}}
+	started := time.Now()
+
+	err := v.restoreAndCompare(result)
+	result.RestoreDurationMs = time.Since(started).Milliseconds()
+	if err != nil {
+		message := err.Error()
+		result.Error = &message
+		result.Status = "failed"
+	} else {
+		result.Status = verificationStatus(result.Tables)
+	}
+
+	tablesJSON, _ := json.Marshal(result.Tables)
+	err = v.db.QueryRow(`
+		INSERT INTO backup_verifications (backup_file, backup_taken_at, status, restore_duration_ms, tables, error)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`,
+		result.BackupFile, result.BackupTakenAt, result.Status, result.RestoreDurationMs, tablesJSON, result.Error,
+	).Scan(&result.ID, &result.CreatedAt)
+	if err != nil {
+		log.Printf("Error recording backup verification: %v", err)
+	}
+
+	log.Printf("Backup verification %s for %s (%dms)", result.Status, result.BackupFile, result.RestoreDurationMs)
+	if result.Status != "passed" {
+		severity, message := "warning", fmt.Sprintf("Restoring %s did not match the live database", result.BackupFile)
+		if result.Error != nil {
+			severity, message = "critical", *result.Error
+		}
+		logAdminAlert(v.db, AdminAlert{
+			Type:      "backup_verification",
+			Severity:  severity,
+			Title:     fmt.Sprintf("Backup verification %s", result.Status),
+			Message:   message,
+			DedupeKey: fmt.Sprintf("backup_verification:%d", result.ID),
+			Data:      result,
+		})
+	}
+	if v.alerts != nil {
+		message := fmt.Sprintf("Backup verification %s", result.Status)
+		if result.Error != nil {
+			message += ": " + *result.Error
+		}
+		if err := v.alerts.PublishAdminAlert("backup_verification", message, result); err != nil {
+			log.Printf("Error publishing backup verification alert: %v", err)
+		}
+	}
+
+	return result
+}
+
+func (v *BackupVerifier) restoreAndCompare(result *BackupVerification) error {
+	backupFile, takenAt, err := latestBackupFile(v.config.BackupDir)
+	if err != nil {
+		return err
+	}
+	result.BackupFile = filepath.Base(backupFile)
+	result.BackupTakenAt = &takenAt
+
+	scratch := pq.QuoteIdentifier(v.config.ScratchDBName)
+	if _, err := v.db.Exec("DROP DATABASE IF EXISTS " + scratch); err != nil {
+		return fmt.Errorf("failed to drop scratch database: %v", err)
+	}
+	if _, err := v.db.Exec("CREATE DATABASE " + scratch); err != nil {
+		return fmt.Errorf("failed to create scratch database: %v", err)
+	}
+	defer v.db.Exec("DROP DATABASE IF EXISTS " + scratch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), v.config.RestoreTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if strings.HasSuffix(backupFile, ".sql") {
+		cmd = exec.CommandContext(ctx, "psql", "-q", "-v", "ON_ERROR_STOP=1", "-d", v.config.ScratchDBName, "-f", backupFile)
+	} else {
+		cmd = exec.CommandContext(ctx, "pg_restore", "--no-owner", "--no-privileges", "--exit-on-error", "-d", v.config.ScratchDBName, backupFile)
+	}
+	cmd.Env = append(os.Environ(),
+		"PGHOST="+os.Getenv("DB_HOST"),
+		"PGPORT="+os.Getenv("DB_PORT"),
+		"PGUSER="+os.Getenv("DB_USER"),
+		"PGPASSWORD="+os.Getenv("DB_PASSWORD"),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("restore failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	restored, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), v.config.ScratchDBName))
+	if err != nil {
+		return fmt.Errorf("failed to connect to restored database: %v", err)
+	}
+	defer restored.Close()
+
+	for _, table := range verifiedTables {
+		tv, err := compareTable(v.db, restored, table)
+		if err != nil {
+			return fmt.Errorf("failed to verify %s: %v", table, err)
+		}
+		result.Tables = append(result.Tables, tv)
+	}
+
+	return nil
+}
+
+// compareTable checks the restored copy of a table against the live rows that
+// existed at backup time (ids up to the restored maximum). Whole rows are
+// hashed, so a restore that dropped or mangled column values doesn't match.
+func compareTable(live, restored *sql.DB, table string) (TableVerification, error) {
+	tv := TableVerification{Table: table}
+	quoted := pq.QuoteIdentifier(table)
+
+	var maxID int
+	err := restored.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*), COALESCE(MAX(t.id), 0), COALESCE(md5(string_agg(t::text, ',' ORDER BY t.id)), '')
+		FROM %s t`, quoted),
+	).Scan(&tv.RestoredRows, &maxID, &tv.RestoredChecksum)
+	if err != nil {
+		return tv, err
+	}
+
+	err = live.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*), COALESCE(md5(string_agg(t::text, ',' ORDER BY t.id)), '')
+		FROM %s t WHERE t.id <= $1`, quoted),
+		maxID,
+	).Scan(&tv.LiveRows, &tv.LiveChecksum)
+	if err != nil {
+		return tv, err
+	}
+
+	tv.Matches = tv.RestoredRows == tv.LiveRows && tv.RestoredChecksum == tv.LiveChecksum
+	return tv, nil
+}
+
+// handleGetBackupVerifications lists recent verification runs
+func (v *BackupVerifier) handleGetBackupVerifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := v.db.Query(`
+		SELECT id, backup_file, backup_taken_at, status, restore_duration_ms, tables, error, created_at
+		FROM backup_verifications
+		ORDER BY created_at DESC
+		LIMIT 30`)
+	if err != nil {
+		http.Error(w, "Failed to fetch backup verifications", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	verifications := []BackupVerification{}
+	for rows.Next() {
+		var bv BackupVerification
+		var tablesJSON []byte
+		err := rows.Scan(
+			&bv.ID, &bv.BackupFile, &bv.BackupTakenAt, &bv.Status,
+			&bv.RestoreDurationMs, &tablesJSON, &bv.Error, &bv.CreatedAt,
+		)
+		if err != nil {
+			http.Error(w, "Failed to parse backup verifications", http.StatusInternalServerError)
+			return
+		}
+		bv.Tables = []TableVerification{}
+		json.Unmarshal(tablesJSON, &bv.Tables)
+		verifications = append(verifications, bv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verifications)
+}
+
+// handleRunBackupVerification starts a verification in the background; a
+// restore can take longer than a request may stay open. The result shows up
+// in the verification list when it's done.
+func (v *BackupVerifier) handleRunBackupVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if v.config.BackupDir == "" {
+		http.Error(w, "Backup verification is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	if v.running.Load() {
+		http.Error(w, "A backup verification is already running", http.StatusConflict)
+		return
+	}
+	go v.Verify()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "running"})
+}
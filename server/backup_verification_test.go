@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLatestBackupFile(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	files := map[string]time.Time{
+		"tumble-2024-01-01.dump": now.Add(-48 * time.Hour),
+		"tumble-2024-01-02.sql":  now.Add(-24 * time.Hour),
+		"notes.txt":              now,
+	}
+	for name, modTime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("backup"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("Failed to set mtime on %s: %v", name, err)
+		}
+	}
+
+	path, _, err := latestBackupFile(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if filepath.Base(path) != "tumble-2024-01-02.sql" {
+		t.Errorf("Expected newest backup tumble-2024-01-02.sql, got %s", filepath.Base(path))
+	}
+
+	if _, _, err := latestBackupFile(t.TempDir()); err == nil {
+		t.Error("Expected error for directory without backups")
+	}
+}
+
+func TestVerificationStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		tables   []TableVerification
+		expected string
+	}{
+		{"All tables match", []TableVerification{{Table: "users", Matches: true}, {Table: "orders", Matches: true}}, "passed"},
+		{"One mismatch", []TableVerification{{Table: "users", Matches: true}, {Table: "orders", Matches: false}}, "warning"},
+		{"No tables", nil, "passed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verificationStatus(tt.tables); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBackupVerifierStart_Disabled(t *testing.T) {
+	verifier := NewBackupVerifier(nil, nil, BackupVerifierConfig{})
+	if err := verifier.Start(); err != nil {
+		t.Errorf("Expected disabled verifier to start cleanly, got %v", err)
+	}
+
+	verifier = NewBackupVerifier(nil, nil, BackupVerifierConfig{BackupDir: t.TempDir(), ScratchDBName: "bad-name; DROP", Schedule: "30 4 * * *"})
+	if err := verifier.Start(); err == nil {
+		t.Error("Expected invalid scratch database name to be rejected")
+	}
+}
+
+func TestHandleRunBackupVerification_AlreadyRunning(t *testing.T) {
+	verifier := NewBackupVerifier(nil, nil, BackupVerifierConfig{BackupDir: t.TempDir()})
+	verifier.running.Store(true)
+
+	w := httptest.NewRecorder()
+	verifier.handleRunBackupVerification(w, httptest.NewRequest("POST", "/api/v1/admin/backups/verify", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d while a verification runs, got %d", http.StatusConflict, w.Code)
+	}
+	if result := verifier.Verify(); result != nil {
+		t.Errorf("Expected an overlapping run to be skipped, got %+v", result)
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// BagPricingHandler serves the admin CRUD for per-market bag pricing
+type BagPricingHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewBagPricingHandler(db *sql.DB) *BagPricingHandler {
+	return &BagPricingHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// BagPricing is what a bag service costs in a market and how much it holds
+// before the overweight rate kicks in
+type BagPricing struct {
+	ID             int     `json:"id"`
+	ServiceID      int     `json:"service_id"`
+	ServiceName    string  `json:"service_name"`
+	Market         *string `json:"market"` // 3-digit ZIP prefix; nil is the default for every other market
+	SizeLabel      string  `json:"size_label"`
+	Price          float64 `json:"price"`
+	IncludedPounds float64 `json:"included_pounds"`
+	OverweightRate float64 `json:"overweight_rate"` // Per pound over the included weight
+	IsActive       bool    `json:"is_active"`
+}
+
+// overweightCents is the charge for a line of bags weighing weight pounds
+// together. Each started pound over the included weight is charged.
+func overweightCents(weight float64, quantity int, includedPounds float64, centsPerPound int) int {
+	over := math.Round((weight-float64(quantity)*includedPounds)*100) / 100
+	if over <= 0 || centsPerPound <= 0 {
+		return 0
+	}
+	return int(math.Ceil(over)) * centsPerPound
+}
+
+// validateBagPricing checks a pricing row from the admin API
+func validateBagPricing(p BagPricing) error {
+	if p.ServiceID <= 0 {
+		return fmt.Errorf("service_id is required")
+	}
+	if p.Market != nil && !isMarket(*p.Market) {
+		return fmt.Errorf("market must be a 3-digit ZIP prefix")
+	}
+	if p.SizeLabel == "" {
+		return fmt.Errorf("size_label is required")
+	}
+	if p.Price < 0 {
+		return fmt.Errorf("price cannot be negative")
+	}
+	if p.IncludedPounds <= 0 || p.IncludedPounds > 200 {
+		return fmt.Errorf("included_pounds must be between 0 and 200")
+	}
+	if p.OverweightRate < 0 {
+		return fmt.Errorf("overweight_rate cannot be negative")
+	}
+	return nil
+}
+
+const bagPricingColumns = `bp.id, bp.service_id, s.name, bp.market, bp.size_label, bp.price_cents,
+	bp.included_pounds, bp.overweight_cents_per_pound, bp.is_active`
+
+func scanBagPricing(scanner interface{ Scan(...interface{}) error }) (BagPricing, error) {
+	var p BagPricing
+	var market sql.NullString
+	var priceCents, overweightCents int
+	err := scanner.Scan(&p.ID, &p.ServiceID, &p.ServiceName, &market, &p.SizeLabel, &priceCents,
+		&p.IncludedPounds, &overweightCents, &p.IsActive)
+	if err != nil {
+		return p, err
+	}
+	if market.Valid {
+		p.Market = &market.String
+	}
+	p.Price = centsToDollars(priceCents)
+	p.OverweightRate = centsToDollars(overweightCents)
+	return p, nil
+}
+
+func queryBagPricing(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, query string, args ...interface{}) ([]BagPricing, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pricing := []BagPricing{}
+	for rows.Next() {
+		p, err := scanBagPricing(rows)
+		if err != nil {
+			return nil, err
+		}
+		pricing = append(pricing, p)
+	}
+	return pricing, rows.Err()
+}
+
+// bagPricingByService returns the active bag pricing for a ZIP code's market
+// by service ID, falling back to the default pricing for services the market
+// doesn't set
+func bagPricingByService(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, zipCode string) (map[int]BagPricing, error) {
+	pricing, err := queryBagPricing(q, `
+		SELECT DISTINCT ON (bp.service_id) `+bagPricingColumns+`
+		FROM bag_pricing bp
+		JOIN services s ON s.id = bp.service_id
+		WHERE bp.is_active AND (bp.market IS NULL OR bp.market = $1)
+		ORDER BY bp.service_id, bp.market NULLS LAST`,
+		marketForZip(zipCode),
+	)
+	if err != nil {
+		return nil, err
+	}
+	byService := make(map[int]BagPricing, len(pricing))
+	for _, p := range pricing {
+		byService[p.ServiceID] = p
+	}
+	return byService, nil
+}
+
+// writeBagPricingError maps constraint failures to client errors
+func writeBagPricingError(w http.ResponseWriter, err error, action string) {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "23505":
+			http.Error(w, "This bag already has pricing in that market", http.StatusConflict)
+			return
+		case "23503":
+			http.Error(w, "Unknown service", http.StatusBadRequest)
+			return
+		}
+	}
+	http.Error(w, "Failed to "+action+" bag pricing", http.StatusInternalServerError)
+}
+
+// handleGetBagPricing lists bag pricing for every market, or for one with
+// ?market= (its own rows and the defaults)
+func (h *BagPricingHandler) handleGetBagPricing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	where, args := "", []interface{}{}
+	if market := r.URL.Query().Get("market"); market != "" {
+		if !isMarket(market) {
+			http.Error(w, "market must be a 3-digit ZIP prefix", http.StatusBadRequest)
+			return
+		}
+		where, args = "WHERE bp.market IS NULL OR bp.market = $1", append(args, market)
+	}
+
+	pricing, err := queryBagPricing(h.db, `
+		SELECT `+bagPricingColumns+`
+		FROM bag_pricing bp
+		JOIN services s ON s.id = bp.service_id
+		`+where+`
+		ORDER BY bp.market NULLS FIRST, s.name`,
+		args...,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch bag pricing", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pricing)
+}
+
+// handleCreateBagPricing sets a bag's pricing for a market, or the default
+func (h *BagPricingHandler) handleCreateBagPricing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := BagPricing{IsActive: true}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateBagPricing(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	row := h.db.QueryRow(`
+		WITH bp AS (
+			INSERT INTO bag_pricing (service_id, market, size_label, price_cents, included_pounds, overweight_cents_per_pound, is_active)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING *
+		)
+		SELECT `+bagPricingColumns+` FROM bp JOIN services s ON s.id = bp.service_id`,
+		req.ServiceID, req.Market, req.SizeLabel, dollarsToCents(req.Price), req.IncludedPounds,
+		dollarsToCents(req.OverweightRate), req.IsActive,
+	)
+	pricing, err := scanBagPricing(row)
+	if err != nil {
+		writeBagPricingError(w, err, "create")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pricing)
+}
+
+// handleUpdateBagPricing replaces a pricing row. Bags already sold keep the
+// price and included weight they were sold with.
+func (h *BagPricingHandler) handleUpdateBagPricing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pricingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid bag pricing ID", http.StatusBadRequest)
+		return
+	}
+
+	var req BagPricing
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateBagPricing(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	row := h.db.QueryRow(`
+		WITH bp AS (
+			UPDATE bag_pricing
+			SET service_id = $1, market = $2, size_label = $3, price_cents = $4, included_pounds = $5,
+			    overweight_cents_per_pound = $6, is_active = $7, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $8
+			RETURNING *
+		)
+		SELECT `+bagPricingColumns+` FROM bp JOIN services s ON s.id = bp.service_id`,
+		req.ServiceID, req.Market, req.SizeLabel, dollarsToCents(req.Price), req.IncludedPounds,
+		dollarsToCents(req.OverweightRate), req.IsActive, pricingID,
+	)
+	pricing, err := scanBagPricing(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Bag pricing not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBagPricingError(w, err, "update")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pricing)
+}
+
+// handleDeleteBagPricing removes a pricing row; a market's bag then falls
+// back to the default
+func (h *BagPricingHandler) handleDeleteBagPricing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pricingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid bag pricing ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM bag_pricing WHERE id = $1", pricingID)
+	if err != nil {
+		http.Error(w, "Failed to delete bag pricing", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Bag pricing not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BagWeight is the weight the driver measured for one line of an order's bags
+type BagWeight struct {
+	OrderItemID int     `json:"order_item_id"`
+	Weight      float64 `json:"weight"` // Pounds, all of the line's bags together
+}
+
+// BagWeightResult is an order's weight and overweight charge after weighing
+type BagWeightResult struct {
+	OrderID          int     `json:"order_id"`
+	TotalWeight      float64 `json:"total_weight"`
+	IncludedPounds   float64 `json:"included_pounds"`
+	OverweightCharge float64 `json:"overweight_charge"`
+}
+
+// maxBagLineWeight guards against typos on the scale reading
+const maxBagLineWeight = 500
+
+// repriceOrderWeight totals an order's weighed lines, including ones weighed
+// earlier, and sets its weight and overweight charge from the terms each bag
+// was sold with. The charge replaces any earlier one in the order's subtotal
+// and total, so it's collected with the order's payment.
+func repriceOrderWeight(tx *sql.Tx, orderID int) (BagWeightResult, error) {
+	result := BagWeightResult{OrderID: orderID}
+	rows, err := tx.Query(`
+		SELECT quantity, weight, included_pounds, overweight_cents_per_pound
+		FROM order_items
+		WHERE order_id = $1 AND weight IS NOT NULL`,
+		orderID,
+	)
+	if err != nil {
+		return result, err
+	}
+	overweight := 0
+	for rows.Next() {
+		var quantity int
+		var weight float64
+		var includedPounds sql.NullFloat64
+		var centsPerPound sql.NullInt64
+		if err := rows.Scan(&quantity, &weight, &includedPounds, &centsPerPound); err != nil {
+			rows.Close()
+			return result, err
+		}
+		result.TotalWeight += weight
+		if includedPounds.Valid {
+			result.IncludedPounds += float64(quantity) * includedPounds.Float64
+			overweight += overweightCents(weight, quantity, includedPounds.Float64, int(centsPerPound.Int64))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	result.OverweightCharge = centsToDollars(overweight)
+
+	_, err = tx.Exec(`
+		UPDATE orders
+		SET total_weight = $1, overweight_cents = $2,
+		    subtotal_cents = subtotal_cents - overweight_cents + $2,
+		    total_cents = total_cents - overweight_cents + $2,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3`,
+		result.TotalWeight, overweight, orderID,
+	)
+	return result, err
+}
+
+// handleRecordBagWeights records the bag weights for a pickup stop and works
+// out the overweight charge from the terms each bag was sold with. Weighing
+// again replaces the earlier readings.
+func (h *DriverRouteHandler) handleRecordBagWeights(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	routeOrderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Bags []BagWeight `json:"bags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Bags) == 0 {
+		http.Error(w, "At least one bag weight is required", http.StatusBadRequest)
+		return
+	}
+	for _, bag := range req.Bags {
+		if bag.Weight <= 0 || bag.Weight > maxBagLineWeight {
+			http.Error(w, fmt.Sprintf("Bag weights must be between 0 and %d pounds", maxBagLineWeight), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var orderID, routeDriverID int
+	var routeType, routeStatus string
+	err = h.db.QueryRow(`
+		SELECT ro.order_id, dr.driver_id, dr.route_type, dr.status
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		WHERE ro.id = $1`,
+		routeOrderID,
+	).Scan(&orderID, &routeDriverID, &routeType, &routeStatus)
+	if err == sql.ErrNoRows || (err == nil && routeDriverID != driverID) {
+		http.Error(w, "Route order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch route order", http.StatusInternalServerError)
+		return
+	}
+	if isClosedRouteStatus(routeStatus) {
+		http.Error(w, "Route is closed", http.StatusForbidden)
+		return
+	}
+	if routeType != "pickup" {
+		http.Error(w, "Bags are weighed on pickup stops", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, bag := range req.Bags {
+		result, err := tx.Exec("UPDATE order_items SET weight = $1 WHERE id = $2 AND order_id = $3", bag.Weight, bag.OrderItemID, orderID)
+		if err != nil {
+			http.Error(w, "Failed to record bag weights", http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			http.Error(w, fmt.Sprintf("Order item %d is not on this order", bag.OrderItemID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := repriceOrderWeight(tx, orderID)
+	if err != nil {
+		http.Error(w, "Failed to record bag weights", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to record bag weights", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
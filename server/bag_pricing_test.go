@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOverweightCents(t *testing.T) {
+	tests := []struct {
+		name           string
+		weight         float64
+		quantity       int
+		includedPounds float64
+		centsPerPound  int
+		expected       int
+	}{
+		{"Under the allowance", 18, 1, 20, 150, 0},
+		{"Exactly the allowance", 40, 2, 20, 150, 0},
+		{"Started pounds are charged", 22.3, 1, 20, 150, 450},
+		{"Allowance is per bag", 45, 2, 20, 150, 750},
+		{"No rate set", 30, 1, 20, 0, 0},
+		{"Float noise isn't a pound", 20.0000001, 1, 20, 150, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overweightCents(tt.weight, tt.quantity, tt.includedPounds, tt.centsPerPound); got != tt.expected {
+				t.Errorf("overweightCents = %d, expected %d", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidateBagPricing(t *testing.T) {
+	market, badMarket := "941", "94"
+	valid := BagPricing{ServiceID: 1, Market: &market, SizeLabel: "Standard bag", Price: 32, IncludedPounds: 20, OverweightRate: 1.5}
+	if err := validateBagPricing(valid); err != nil {
+		t.Errorf("Expected valid pricing, got %v", err)
+	}
+
+	invalid := []func(p *BagPricing){
+		func(p *BagPricing) { p.ServiceID = 0 },
+		func(p *BagPricing) { p.Market = &badMarket },
+		func(p *BagPricing) { p.SizeLabel = "" },
+		func(p *BagPricing) { p.Price = -1 },
+		func(p *BagPricing) { p.IncludedPounds = 0 },
+		func(p *BagPricing) { p.OverweightRate = -0.5 },
+	}
+	for i, breakIt := range invalid {
+		p := valid
+		breakIt(&p)
+		if err := validateBagPricing(p); err == nil {
+			t.Errorf("Case %d: expected an error for %+v", i, p)
+		}
+	}
+}
+
+func TestBagPricing_MarketPricingAndWeighing(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+	defer db.Exec("DELETE FROM bag_pricing WHERE market IS NOT NULL")
+
+	standardBagID := db.GetServiceID(t, "standard_bag")
+	admin := NewBagPricingHandler(db.DB)
+	body, _ := json.Marshal(BagPricing{
+		ServiceID: standardBagID, Market: func() *string { m := "123"; return &m }(),
+		SizeLabel: "Standard bag", Price: 35, IncludedPounds: 18, OverweightRate: 2,
+	})
+	w := httptest.NewRecorder()
+	admin.handleCreateBagPricing(w, httptest.NewRequest("POST", "/api/v1/admin/bag-pricing", bytes.NewBuffer(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	admin.handleCreateBagPricing(w, httptest.NewRequest("POST", "/api/v1/admin/bag-pricing", bytes.NewBuffer(body)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a second row in the market, got %d", http.StatusConflict, w.Code)
+	}
+
+	// The services endpoint shows the market's price; other markets get the default
+	services := func(zip string) map[string]Service {
+		w := httptest.NewRecorder()
+		NewServiceHandler(db.DB).handleGetServices(w, httptest.NewRequest("GET", "/api/v1/services?zip_code="+zip, nil))
+		var list []Service
+		json.Unmarshal(w.Body.Bytes(), &list)
+		byName := map[string]Service{}
+		for _, s := range list {
+			byName[s.Name] = s
+		}
+		return byName
+	}
+	if bag := services("12345")["standard_bag"]; bag.BasePrice != 35 || bag.BagPricing == nil || bag.BagPricing.IncludedPounds != 18 {
+		t.Errorf("Expected the market's bag pricing, got %+v", bag)
+	}
+	if bag := services("02139")["standard_bag"]; bag.BasePrice != 30 || bag.BagPricing == nil || bag.BagPricing.Market != nil {
+		t.Errorf("Expected the default bag pricing, got %+v", bag)
+	}
+
+	// Orders in the market are priced from it, whatever the client sent
+	userID := db.CreateTestUser(t, "bag-pricing@example.com", "Bag", "Pricing")
+	addressID := db.CreateTestAddress(t, userID)
+	orders := &OrderHandler{
+		db:        db.DB,
+		realtime:  NewMockRealtimeHandler(),
+		getUserID: func(r *http.Request, db *sql.DB) (int, error) { return userID, nil },
+	}
+	body, _ = json.Marshal(CreateOrderRequest{
+		PickupAddressID:   addressID,
+		DeliveryAddressID: addressID,
+		PickupDate:        "2024-02-01",
+		DeliveryDate:      "2024-02-03",
+		PickupTimeSlot:    "9am-12pm",
+		DeliveryTimeSlot:  "9am-12pm",
+		Items:             []OrderItem{{ServiceID: standardBagID, Quantity: 2, Price: 30.00}},
+	})
+	w = httptest.NewRecorder()
+	orders.handleCreateOrder(w, httptest.NewRequest("POST", "/api/v1/orders/create", bytes.NewBuffer(body)))
+	var order Order
+	json.Unmarshal(w.Body.Bytes(), &order)
+	if order.ID == 0 {
+		t.Fatalf("Failed to create order: %d %s", w.Code, w.Body.String())
+	}
+	var bagItemID, priceCents int
+	db.QueryRow(`
+		SELECT id, price_cents FROM order_items WHERE order_id = $1 AND service_id = $2`,
+		order.ID, standardBagID,
+	).Scan(&bagItemID, &priceCents)
+	if priceCents != 3500 {
+		t.Errorf("Expected bags at the market price of 3500 cents, got %d", priceCents)
+	}
+
+	// The driver weighs the bags at pickup
+	driverID := db.CreateTestUser(t, "bag-driver@example.com", "Bag", "Driver")
+	var routeID, routeOrderID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'in_progress') RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	db.QueryRow(`
+		INSERT INTO route_orders (route_id, order_id, sequence_number, status)
+		VALUES ($1, $2, 1, 'pending') RETURNING id`,
+		routeID, order.ID,
+	).Scan(&routeOrderID)
+
+	driverRoutes := &DriverRouteHandler{db: db.DB}
+	weigh := func(asDriver int, bags []BagWeight) *httptest.ResponseRecorder {
+		driverRoutes.getUserID = func(r *http.Request, db *sql.DB) (int, error) { return asDriver, nil }
+		body, _ := json.Marshal(map[string]interface{}{"bags": bags})
+		req := mux.SetURLVars(httptest.NewRequest("PUT", "/api/v1/driver/route-orders/x/weights", bytes.NewBuffer(body)),
+			map[string]string{"id": fmt.Sprint(routeOrderID)})
+		w := httptest.NewRecorder()
+		driverRoutes.handleRecordBagWeights(w, req)
+		return w
+	}
+	if w := weigh(userID, []BagWeight{{OrderItemID: bagItemID, Weight: 40}}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for another driver, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := weigh(driverID, []BagWeight{{OrderItemID: bagItemID, Weight: 900}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an impossible weight, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Sold with 18 lb included per bag, so 40.5 lb over two bags is 5 started pounds over
+	w = weigh(driverID, []BagWeight{{OrderItemID: bagItemID, Weight: 40.5}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var result BagWeightResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.TotalWeight != 40.5 || result.IncludedPounds != 36 || result.OverweightCharge != 10 {
+		t.Errorf("Unexpected weighing result %+v", result)
+	}
+
+	// Changing the market's pricing later doesn't change what the bags were sold with
+	db.Exec("UPDATE bag_pricing SET included_pounds = 30 WHERE market = '123'")
+	weigh(driverID, []BagWeight{{OrderItemID: bagItemID, Weight: 40.5}})
+	var overweight int
+	var totalWeight float64
+	db.QueryRow("SELECT overweight_cents, total_weight FROM orders WHERE id = $1", order.ID).Scan(&overweight, &totalWeight)
+	if overweight != 1000 || totalWeight != 40.5 {
+		t.Errorf("Expected 1000 cents over at 40.5 lb, got %d at %.1f", overweight, totalWeight)
+	}
+
+	// The charge is billed once with the order, however often the bags are weighed
+	charged, err := getOrder(db.DB, order.ID)
+	if err != nil {
+		t.Fatalf("Failed to get order: %v", err)
+	}
+	if charged.OverweightCharge != 10 || charged.Subtotal == nil || *charged.Subtotal != *order.Subtotal+10 {
+		t.Errorf("Expected the overweight charge added to the subtotal once, got %+v", charged)
+	}
+	if issues, _ := findOrderTotalIssues(db.DB, []int{order.ID}); len(issues) != 0 {
+		t.Errorf("Expected the re-priced totals to pass the integrity check, got %+v", issues)
+	}
+}
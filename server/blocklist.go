@@ -0,0 +1,570 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// The blocklist keeps customers and addresses that aren't safe for drivers
+// from booking orders. Blocks usually come from a driver's safety report but
+// admins can also add them directly.
+//
+// Appeals: a blocked customer sees the block under GET /account/blocks,
+// without the report behind it, and can appeal it once with
+// POST /account/blocks/{id}/appeal. The appeal lands in the admin inbox and
+// is decided under /admin/blocklist/appeals/{id}; approving it lifts the
+// block, and either way the customer gets a notification with the response.
+// A denied appeal is final, though admins can still lift the block later.
+
+// BlocklistHandler manages blocks on customers and addresses and the appeals
+// against them
+type BlocklistHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewBlocklistHandler(db *sql.DB) *BlocklistHandler {
+	return &BlocklistHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// errOrderBlocked is shown when an order is refused because of a block
+const errOrderBlocked = "We can't take orders for this account or address. See your account's blocks to appeal."
+
+// addressKeyExpr is the SQL expression that identifies the physical location
+// of an address in the given table alias: its normalized street and 5-digit
+// ZIP. Address blocks match on it so they apply to any account saving the
+// same place.
+func addressKeyExpr(alias string) string {
+	return fmt.Sprintf(`LOWER(REGEXP_REPLACE(TRIM(%[1]s.street_address), '\s+', ' ', 'g')) || '|' || LEFT(TRIM(%[1]s.zip_code), 5)`, alias)
+}
+
+// activeBlockFor returns the ID of an active block on the customer or any of
+// the addresses, or 0 if there is none
+func activeBlockFor(q queryRower, userID int, addressIDs ...int) (int, error) {
+	var entryID int
+	err := q.QueryRow(`
+		SELECT b.id FROM blocklist_entries b
+		WHERE b.lifted_at IS NULL
+			AND (b.user_id = $1 OR b.address_key IN (
+				SELECT `+addressKeyExpr("a")+` FROM addresses a WHERE a.id = ANY($2)
+			))
+		ORDER BY b.id
+		LIMIT 1`,
+		userID, pq.Array(addressIDs),
+	).Scan(&entryID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return entryID, err
+}
+
+type BlocklistEntry struct {
+	ID           int        `json:"id"`
+	UserID       *int       `json:"user_id,omitempty"`
+	UserEmail    *string    `json:"user_email,omitempty"`
+	AddressKey   *string    `json:"address_key,omitempty"`
+	AddressLabel *string    `json:"address_label,omitempty"`
+	Reason       string     `json:"reason"`
+	ReportID     *int       `json:"report_id,omitempty"`
+	CreatedBy    *int       `json:"created_by"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LiftedBy     *int       `json:"lifted_by,omitempty"`
+	LiftedAt     *time.Time `json:"lifted_at,omitempty"`
+	LiftReason   *string    `json:"lift_reason,omitempty"`
+}
+
+const blocklistEntryColumns = `b.id, b.user_id, u.email, b.address_key, b.address_label, b.reason, b.report_id,
+	b.created_by, b.created_at, b.lifted_by, b.lifted_at, b.lift_reason`
+
+func scanBlocklistEntry(scanner interface{ Scan(...interface{}) error }) (BlocklistEntry, error) {
+	var e BlocklistEntry
+	err := scanner.Scan(&e.ID, &e.UserID, &e.UserEmail, &e.AddressKey, &e.AddressLabel, &e.Reason, &e.ReportID,
+		&e.CreatedBy, &e.CreatedAt, &e.LiftedBy, &e.LiftedAt, &e.LiftReason)
+	return e, err
+}
+
+func getBlocklistEntry(q queryRower, id int) (BlocklistEntry, error) {
+	return scanBlocklistEntry(q.QueryRow(
+		"SELECT "+blocklistEntryColumns+" FROM blocklist_entries b LEFT JOIN users u ON u.id = b.user_id WHERE b.id = $1", id,
+	))
+}
+
+// addressKeyFor returns the location key of a saved address
+func addressKeyFor(q queryRower, addressID int) (string, error) {
+	var key string
+	err := q.QueryRow("SELECT "+addressKeyExpr("a")+" FROM addresses a WHERE a.id = $1", addressID).Scan(&key)
+	return key, err
+}
+
+// addBlock blocks a customer, an address key, or both. The address is
+// labelled from any saved address at that location, if there still is one.
+func addBlock(tx *sql.Tx, userID *int, addressKey *string, reason string, reportID *int, adminID int) (int, error) {
+	var addressLabel *string
+	if addressKey != nil {
+		var label string
+		err := tx.QueryRow(`
+			SELECT a.street_address || ', ' || a.city || ', ' || a.state || ' ' || a.zip_code
+			FROM addresses a WHERE `+addressKeyExpr("a")+` = $1
+			ORDER BY a.id
+			LIMIT 1`,
+			*addressKey,
+		).Scan(&label)
+		if err == nil {
+			addressLabel = &label
+		} else if err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+
+	var entryID int
+	err := tx.QueryRow(`
+		INSERT INTO blocklist_entries (user_id, address_key, address_label, reason, report_id, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`,
+		userID, addressKey, addressLabel, reason, reportID, adminID,
+	).Scan(&entryID)
+	return entryID, err
+}
+
+// liftBlock lifts an active block, returning sql.ErrNoRows if it's already
+// lifted or doesn't exist
+func liftBlock(q queryRower, entryID, adminID int, reason string) error {
+	var id int
+	return q.QueryRow(`
+		UPDATE blocklist_entries
+		SET lifted_by = $2, lifted_at = CURRENT_TIMESTAMP, lift_reason = $3
+		WHERE id = $1 AND lifted_at IS NULL
+		RETURNING id`,
+		entryID, adminID, reason,
+	).Scan(&id)
+}
+
+// handleGetBlocklist lists active blocks, or every block with ?include_lifted=true
+func (h *BlocklistHandler) handleGetBlocklist(w http.ResponseWriter, r *http.Request) {
+	includeLifted := r.URL.Query().Get("include_lifted") == "true"
+	rows, err := h.db.Query(`
+		SELECT `+blocklistEntryColumns+`
+		FROM blocklist_entries b LEFT JOIN users u ON u.id = b.user_id
+		WHERE $1 OR b.lifted_at IS NULL
+		ORDER BY b.created_at DESC, b.id DESC`,
+		includeLifted,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch blocklist", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []BlocklistEntry{}
+	for rows.Next() {
+		e, err := scanBlocklistEntry(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch blocklist", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+type CreateBlockRequest struct {
+	UserID    *int   `json:"user_id,omitempty"`
+	AddressID *int   `json:"address_id,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// handleCreateBlock blocks a customer and/or an address directly, without a
+// safety report
+func (h *BlocklistHandler) handleCreateBlock(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateBlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == nil && req.AddressID == nil {
+		http.Error(w, "A user_id or address_id is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var addressKey *string
+	if req.AddressID != nil {
+		key, err := addressKeyFor(tx, *req.AddressID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Address not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to create block", http.StatusInternalServerError)
+			return
+		}
+		addressKey = &key
+	}
+
+	entryID, err := addBlock(tx, req.UserID, addressKey, req.Reason, nil, adminID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to create block", http.StatusInternalServerError)
+		return
+	}
+	entry, err := getBlocklistEntry(tx, entryID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to create block", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// handleLiftBlock lifts a block with a reason for the record
+func (h *BlocklistHandler) handleLiftBlock(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	entryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid block ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	err = liftBlock(h.db, entryID, adminID, req.Reason)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Active block not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to lift block", http.StatusInternalServerError)
+		return
+	}
+	entry, err := getBlocklistEntry(h.db, entryID)
+	if err != nil {
+		http.Error(w, "Failed to fetch block", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// CustomerBlock is a block as its customer sees it. The reason and report
+// behind it are kept from them so drivers can report safely.
+type CustomerBlock struct {
+	ID           int              `json:"id"`
+	Scope        string           `json:"scope"` // account or address
+	AddressLabel *string          `json:"address_label,omitempty"`
+	CreatedAt    time.Time        `json:"created_at"`
+	Appeal       *BlocklistAppeal `json:"appeal,omitempty"`
+}
+
+type BlocklistAppeal struct {
+	ID         int        `json:"id"`
+	EntryID    int        `json:"entry_id"`
+	UserID     int        `json:"user_id"`
+	Message    string     `json:"message"`
+	Status     string     `json:"status"` // pending, approved, denied
+	Response   *string    `json:"response,omitempty"`
+	ReviewedBy *int       `json:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+const blocklistAppealColumns = "id, entry_id, user_id, message, status, response, reviewed_by, reviewed_at, created_at"
+
+func scanBlocklistAppeal(scanner interface{ Scan(...interface{}) error }) (BlocklistAppeal, error) {
+	var a BlocklistAppeal
+	err := scanner.Scan(&a.ID, &a.EntryID, &a.UserID, &a.Message, &a.Status, &a.Response, &a.ReviewedBy, &a.ReviewedAt, &a.CreatedAt)
+	return a, err
+}
+
+// customerBlocksQuery finds the active blocks on a customer or on any of
+// their saved addresses
+var customerBlocksQuery = `
+	SELECT b.id, b.user_id IS NOT NULL, b.address_label, b.created_at
+	FROM blocklist_entries b
+	WHERE b.lifted_at IS NULL
+		AND (b.user_id = $1 OR b.address_key IN (
+			SELECT ` + addressKeyExpr("a") + ` FROM addresses a WHERE a.user_id = $1
+		))`
+
+// handleGetMyBlocks lists the blocks affecting the customer with any appeal
+// they've made
+func (h *BlocklistHandler) handleGetMyBlocks(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := h.db.Query(customerBlocksQuery+" ORDER BY b.created_at DESC", userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch blocks", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	blocks := []CustomerBlock{}
+	for rows.Next() {
+		var b CustomerBlock
+		var onAccount bool
+		if err := rows.Scan(&b.ID, &onAccount, &b.AddressLabel, &b.CreatedAt); err != nil {
+			http.Error(w, "Failed to fetch blocks", http.StatusInternalServerError)
+			return
+		}
+		b.Scope = "address"
+		if onAccount {
+			b.Scope = "account"
+			b.AddressLabel = nil
+		}
+		blocks = append(blocks, b)
+	}
+	rows.Close()
+
+	for i := range blocks {
+		appeal, err := scanBlocklistAppeal(h.db.QueryRow(
+			"SELECT "+blocklistAppealColumns+" FROM blocklist_appeals WHERE entry_id = $1 AND user_id = $2", blocks[i].ID, userID,
+		))
+		if err == nil {
+			appeal.ReviewedBy = nil
+			blocks[i].Appeal = &appeal
+		} else if err != sql.ErrNoRows {
+			http.Error(w, "Failed to fetch blocks", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// handleAppealBlock files the customer's one appeal against a block
+func (h *BlocklistHandler) handleAppealBlock(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	entryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid block ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" || len(req.Message) > 2000 {
+		http.Error(w, "A message of up to 2000 characters is required", http.StatusBadRequest)
+		return
+	}
+
+	var affected bool
+	err = h.db.QueryRow("SELECT EXISTS("+customerBlocksQuery+" AND b.id = $2)", userID, entryID).Scan(&affected)
+	if err != nil {
+		http.Error(w, "Failed to fetch block", http.StatusInternalServerError)
+		return
+	}
+	if !affected {
+		http.Error(w, "Block not found", http.StatusNotFound)
+		return
+	}
+
+	appeal, err := scanBlocklistAppeal(h.db.QueryRow(`
+		INSERT INTO blocklist_appeals (entry_id, user_id, message)
+		VALUES ($1, $2, $3)
+		RETURNING `+blocklistAppealColumns,
+		entryID, userID, req.Message,
+	))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "This block has already been appealed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to file appeal", http.StatusInternalServerError)
+		return
+	}
+
+	logAdminAlert(h.db, AdminAlert{
+		Type:      "block_appeal",
+		Severity:  "info",
+		Title:     fmt.Sprintf("Blocklist appeal for block #%d", entryID),
+		Message:   req.Message,
+		DedupeKey: fmt.Sprintf("block_appeal:%d", appeal.ID),
+		Data:      map[string]int{"appeal_id": appeal.ID, "entry_id": entryID, "user_id": userID},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(appeal)
+}
+
+// handleGetAppeals lists appeals for admins, pending ones by default
+// (?status=pending|approved|denied|all)
+func (h *BlocklistHandler) handleGetAppeals(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending"
+	}
+	rows, err := h.db.Query(`
+		SELECT `+blocklistAppealColumns+` FROM blocklist_appeals
+		WHERE $1 = 'all' OR status = $1
+		ORDER BY created_at ASC, id ASC`,
+		status,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch appeals", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	appeals := []BlocklistAppeal{}
+	for rows.Next() {
+		a, err := scanBlocklistAppeal(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch appeals", http.StatusInternalServerError)
+			return
+		}
+		appeals = append(appeals, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(appeals)
+}
+
+// handleDecideAppeal approves or denies a pending appeal. Approving lifts the
+// block. The customer is notified with the response either way.
+func (h *BlocklistHandler) handleDecideAppeal(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	appealID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid appeal ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Approve  bool   `json:"approve"`
+		Response string `json:"response"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Response = strings.TrimSpace(req.Response)
+	if req.Response == "" {
+		http.Error(w, "A response to the customer is required", http.StatusBadRequest)
+		return
+	}
+	status := "denied"
+	if req.Approve {
+		status = "approved"
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	appeal, err := scanBlocklistAppeal(tx.QueryRow(`
+		UPDATE blocklist_appeals
+		SET status = $2, response = $3, reviewed_by = $4, reviewed_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'pending'
+		RETURNING `+blocklistAppealColumns,
+		appealID, status, req.Response, adminID,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Pending appeal not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to decide appeal", http.StatusInternalServerError)
+		return
+	}
+
+	title := "Your appeal was denied"
+	if req.Approve {
+		title = "Your appeal was approved"
+		// The block may have been lifted while the appeal waited
+		if err := liftBlock(tx, appeal.EntryID, adminID, "Appeal approved: "+req.Response); err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Failed to lift block", http.StatusInternalServerError)
+			return
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO notifications (user_id, type, title, message)
+		VALUES ($1, 'block_appeal', $2, $3)`,
+		appeal.UserID, title, req.Response,
+	)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to decide appeal", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(appeal)
+}
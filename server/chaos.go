@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Chaos mode injects random latency and failures into database, Redis and
+// Stripe calls, and optionally API requests, so retry, timeout and recovery
+// paths get exercised before a real incident does it for us. It is for
+// development stacks only and needs both CHAOS_MODE=true and
+// GO_ENV=development; the server refuses it anywhere else.
+//
+//	CHAOS_FAILURE_RATE    fraction of calls that fail, 0-1 (default 0.05)
+//	CHAOS_LATENCY_RATE    fraction of calls that are delayed, 0-1 (default 0.2)
+//	CHAOS_MAX_LATENCY_MS  upper bound on injected delay (default 2000)
+//	CHAOS_TARGETS         comma-separated subset of db,redis,stripe,http
+//	                      (default db,redis,stripe)
+
+// chaosTargets are the places faults can be injected
+var chaosTargets = []string{"db", "redis", "stripe", "http"}
+
+// errChaosInjected is returned, wrapped, from every injected failure so logs
+// and tests can tell them apart from real ones
+var errChaosInjected = errors.New("chaos: injected failure")
+
+type ChaosConfig struct {
+	Enabled     bool
+	FailureRate float64
+	LatencyRate float64
+	MaxLatency  time.Duration
+	Targets     map[string]bool
+}
+
+// chaosConfigFromEnv reads the chaos settings. A config that asks for chaos
+// outside development, or with rates out of range, is an error rather than
+// silently ignored.
+func chaosConfigFromEnv() (ChaosConfig, error) {
+	config := ChaosConfig{
+		FailureRate: 0.05,
+		LatencyRate: 0.2,
+		MaxLatency:  2 * time.Second,
+		Targets:     map[string]bool{"db": true, "redis": true, "stripe": true},
+	}
+	config.Enabled, _ = strconv.ParseBool(os.Getenv("CHAOS_MODE"))
+	if !config.Enabled {
+		return config, nil
+	}
+	if os.Getenv("GO_ENV") != "development" {
+		return ChaosConfig{}, fmt.Errorf("CHAOS_MODE requires GO_ENV=development")
+	}
+
+	for _, rate := range []struct {
+		env   string
+		value *float64
+	}{
+		{"CHAOS_FAILURE_RATE", &config.FailureRate},
+		{"CHAOS_LATENCY_RATE", &config.LatencyRate},
+	} {
+		raw := os.Getenv(rate.env)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || value < 0 || value > 1 {
+			return ChaosConfig{}, fmt.Errorf("%s must be between 0 and 1", rate.env)
+		}
+		*rate.value = value
+	}
+	if raw := os.Getenv("CHAOS_MAX_LATENCY_MS"); raw != "" {
+		ms, err := strconv.Atoi(raw)
+		if err != nil || ms < 0 {
+			return ChaosConfig{}, fmt.Errorf("CHAOS_MAX_LATENCY_MS must be a non-negative number")
+		}
+		config.MaxLatency = time.Duration(ms) * time.Millisecond
+	}
+	if raw := os.Getenv("CHAOS_TARGETS"); raw != "" {
+		config.Targets = map[string]bool{}
+		for _, target := range strings.Split(raw, ",") {
+			target = strings.TrimSpace(target)
+			if !isChaosTarget(target) {
+				return ChaosConfig{}, fmt.Errorf("unknown CHAOS_TARGETS entry %q", target)
+			}
+			config.Targets[target] = true
+		}
+	}
+	return config, nil
+}
+
+func isChaosTarget(target string) bool {
+	for _, t := range chaosTargets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// ChaosInjector decides, call by call, whether to delay or fail. A nil or
+// disabled injector never does either, and neither does one that hasn't been
+// started, so migrations and startup checks run clean.
+type ChaosInjector struct {
+	config ChaosConfig
+	armed  atomic.Bool
+	mu     sync.Mutex
+	rand   *rand.Rand
+	sleep  func(time.Duration)
+}
+
+func NewChaosInjector(config ChaosConfig) *ChaosInjector {
+	return &ChaosInjector{
+		config: config,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		sleep:  time.Sleep,
+	}
+}
+
+func (c *ChaosInjector) targets(target string) bool {
+	return c != nil && c.config.Enabled && c.armed.Load() && c.config.Targets[target]
+}
+
+// inject maybe sleeps, then maybe returns an error, for one call to target
+func (c *ChaosInjector) inject(target, operation string) error {
+	if !c.targets(target) {
+		return nil
+	}
+
+	c.mu.Lock()
+	delayed := c.rand.Float64() < c.config.LatencyRate
+	var delay time.Duration
+	if delayed && c.config.MaxLatency > 0 {
+		delay = time.Duration(c.rand.Int63n(int64(c.config.MaxLatency)))
+	}
+	failed := c.rand.Float64() < c.config.FailureRate
+	c.mu.Unlock()
+
+	if delay > 0 {
+		c.sleep(delay)
+	}
+	if failed {
+		return fmt.Errorf("%s %s: %w", target, operation, errChaosInjected)
+	}
+	return nil
+}
+
+// Start arms the injector once the server is ready to take traffic. The
+// hooks are installed as each client is set up and stay inert until now.
+func (c *ChaosInjector) Start() {
+	if c == nil || !c.config.Enabled {
+		return
+	}
+	c.armed.Store(true)
+	var targets []string
+	for _, target := range chaosTargets {
+		if c.config.Targets[target] {
+			targets = append(targets, target)
+		}
+	}
+	log.Printf("CHAOS MODE ENABLED - targets %s, %.0f%% failures, %.0f%% delayed up to %v",
+		strings.Join(targets, ","), c.config.FailureRate*100, c.config.LatencyRate*100, c.config.MaxLatency)
+}
+
+// Middleware fails or delays API requests when the http target is on. Health
+// checks are left alone so orchestration doesn't restart the server.
+func (c *ChaosInjector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.targets("http") && strings.HasPrefix(r.URL.Path, APIPrefix+"/") {
+			if err := c.inject("http", r.Method+" "+r.URL.Path); err != nil {
+				w.Header().Set("X-Chaos-Injected", "true")
+				http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// chaosRoundTripper sits under the Stripe client, so injected failures look
+// like network errors and go through stripe-go's own retries
+type chaosRoundTripper struct {
+	chaos *ChaosInjector
+	next  http.RoundTripper
+}
+
+func (t *chaosRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.chaos.inject("stripe", req.Method+" "+req.URL.Path); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// stripeTransport wraps next with fault injection when stripe is targeted
+func (c *ChaosInjector) stripeTransport(next http.RoundTripper) http.RoundTripper {
+	if c != nil && c.config.Enabled && c.config.Targets["stripe"] {
+		return &chaosRoundTripper{chaos: c, next: next}
+	}
+	return next
+}
+
+// chaosRedisHook injects faults into every Redis command and pipeline
+type chaosRedisHook struct {
+	chaos *ChaosInjector
+}
+
+func (h chaosRedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err := h.chaos.inject("redis", "dial"); err != nil {
+			return nil, err
+		}
+		return next(ctx, network, addr)
+	}
+}
+
+func (h chaosRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if err := h.chaos.inject("redis", cmd.Name()); err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h chaosRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if err := h.chaos.inject("redis", "pipeline"); err != nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(err)
+			}
+			return err
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// instrumentRedis adds the fault hook to a Redis client when redis is targeted
+func (c *ChaosInjector) instrumentRedis(client *redis.Client) {
+	if c != nil && c.config.Enabled && c.config.Targets["redis"] {
+		client.AddHook(chaosRedisHook{chaos: c})
+	}
+}
+
+// sqlDriver wraps next with fault injection when db is targeted. Every
+// handler shares the one *sql.DB, so this covers all queries without
+// touching call sites.
+func (c *ChaosInjector) sqlDriver(next driver.Driver) driver.Driver {
+	if c == nil || !c.config.Enabled || !c.config.Targets["db"] {
+		return next
+	}
+	return &chaosDriver{chaos: c, next: next}
+}
+
+type chaosDriver struct {
+	chaos *ChaosInjector
+	next  driver.Driver
+}
+
+func (d *chaosDriver) Open(name string) (driver.Conn, error) {
+	if err := d.chaos.inject("db", "connect"); err != nil {
+		return nil, err
+	}
+	conn, err := d.next.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &chaosConn{chaos: d.chaos, Conn: conn}, nil
+}
+
+// chaosConn wraps a pq connection. Statements, transactions and queries all
+// pass through inject; everything else is delegated untouched.
+type chaosConn struct {
+	driver.Conn
+	chaos *ChaosInjector
+}
+
+func (c *chaosConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.chaos.inject("db", "prepare"); err != nil {
+		return nil, err
+	}
+	if prep, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return prep.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *chaosConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.chaos.inject("db", "begin"); err != nil {
+		return nil, err
+	}
+	if begin, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return begin.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *chaosConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := c.chaos.inject("db", "query"); err != nil {
+		return nil, err
+	}
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c *chaosConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	if err := c.chaos.inject("db", "exec"); err != nil {
+		return nil, err
+	}
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *chaosConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *chaosConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *chaosConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
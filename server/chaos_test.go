@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChaosConfigFromEnv(t *testing.T) {
+	t.Setenv("CHAOS_MODE", "")
+	if config, err := chaosConfigFromEnv(); err != nil || config.Enabled {
+		t.Fatalf("Expected chaos off by default, got %+v, %v", config, err)
+	}
+
+	t.Setenv("CHAOS_MODE", "true")
+	t.Setenv("GO_ENV", "production")
+	if _, err := chaosConfigFromEnv(); err == nil {
+		t.Error("Expected chaos to be refused outside development")
+	}
+
+	t.Setenv("GO_ENV", "development")
+	t.Setenv("CHAOS_FAILURE_RATE", "0.5")
+	t.Setenv("CHAOS_MAX_LATENCY_MS", "250")
+	t.Setenv("CHAOS_TARGETS", "db, http")
+	config, err := chaosConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.Enabled || config.FailureRate != 0.5 || config.LatencyRate != 0.2 || config.MaxLatency != 250*time.Millisecond {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if !config.Targets["db"] || !config.Targets["http"] || config.Targets["redis"] || config.Targets["stripe"] {
+		t.Errorf("Expected only db and http targeted, got %v", config.Targets)
+	}
+
+	for env, value := range map[string]string{
+		"CHAOS_FAILURE_RATE":   "1.5",
+		"CHAOS_MAX_LATENCY_MS": "soon",
+		"CHAOS_TARGETS":        "db,kafka",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := chaosConfigFromEnv(); err == nil {
+				t.Errorf("Expected %s=%s to be rejected", env, value)
+			}
+		})
+	}
+}
+
+func TestChaosInjector_Inject(t *testing.T) {
+	chaos := NewChaosInjector(ChaosConfig{
+		Enabled:     true,
+		FailureRate: 1,
+		LatencyRate: 1,
+		MaxLatency:  time.Second,
+		Targets:     map[string]bool{"db": true},
+	})
+	var slept []time.Duration
+	chaos.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	if err := chaos.inject("db", "query"); err != nil {
+		t.Errorf("Expected no faults before Start, got %v", err)
+	}
+	chaos.Start()
+	if err := chaos.inject("db", "query"); !errors.Is(err, errChaosInjected) {
+		t.Errorf("Expected an injected failure, got %v", err)
+	}
+	if len(slept) != 1 || slept[0] >= time.Second {
+		t.Errorf("Expected one delay under the max latency, got %v", slept)
+	}
+	if err := chaos.inject("redis", "GET"); err != nil {
+		t.Errorf("Expected untargeted calls to pass, got %v", err)
+	}
+
+	var disabled *ChaosInjector
+	if err := disabled.inject("db", "query"); err != nil {
+		t.Errorf("Expected a nil injector to be inert, got %v", err)
+	}
+}
+
+func TestChaosInjector_Middleware(t *testing.T) {
+	chaos := NewChaosInjector(ChaosConfig{Enabled: true, FailureRate: 1, Targets: map[string]bool{"http": true}})
+	chaos.Start()
+	handler := chaos.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/orders", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("X-Chaos-Injected") != "true" {
+		t.Errorf("Expected an injected 503 on API routes, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected health checks to be left alone, got %d", w.Code)
+	}
+}
+
+// chaosTestDriver is a stand-in database that accepts every statement
+type chaosTestDriver struct{}
+
+func (chaosTestDriver) Open(name string) (driver.Conn, error) { return chaosTestConn{}, nil }
+
+type chaosTestConn struct{}
+
+func (chaosTestConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (chaosTestConn) Close() error              { return nil }
+func (chaosTestConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+func (chaosTestConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func TestChaosDriver(t *testing.T) {
+	chaos := NewChaosInjector(ChaosConfig{Enabled: true, FailureRate: 1, Targets: map[string]bool{"db": true}})
+	sql.Register("chaos-test", &chaosDriver{chaos: chaos, next: chaosTestDriver{}})
+	db, err := sql.Open("chaos-test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("UPDATE orders SET status = 'cancelled'"); err != nil {
+		t.Fatalf("Expected statements to pass through before Start, got %v", err)
+	}
+	chaos.Start()
+	if _, err := db.Exec("UPDATE orders SET status = 'cancelled'"); !errors.Is(err, errChaosInjected) {
+		t.Errorf("Expected an injected failure, got %v", err)
+	}
+}
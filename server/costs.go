@@ -0,0 +1,423 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CostHandler manages the unit costs used to estimate what each order costs
+// to fulfil, and reports margins built from those estimates
+type CostHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewCostHandler(db *sql.DB) *CostHandler {
+	return &CostHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type CostRate struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Cost        float64   `json:"cost"`
+	UpdatedBy   *int      `json:"updated_by,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type UpdateCostRateRequest struct {
+	Cost *float64 `json:"cost"`
+}
+
+// orderCostInputs is what an order's cost estimate is built from. Bags are
+// counted the way add-on pricing counts them, as the quantity across all
+// service items.
+type orderCostInputs struct {
+	TotalCents     int
+	TaxCents       int
+	PlanShareCents int
+	Bags           int
+	Garments       int
+	Rush           bool
+}
+
+type orderCostEstimate struct {
+	OrderType      string
+	RevenueCents   int
+	DriverPayCents int
+	FacilityCents  int
+	SuppliesCents  int
+}
+
+func (e orderCostEstimate) totalCostCents() int {
+	return e.DriverPayCents + e.FacilityCents + e.SuppliesCents
+}
+
+// estimateOrderCost prices an order's fulfilment at the given rates. Revenue
+// excludes tax, which we only collect on the state's behalf, and includes the
+// order's share of its subscription fee so plan orders aren't shown as pure
+// loss. Driver pay follows the commission drivers see in their earnings.
+func estimateOrderCost(in orderCostInputs, rates map[string]int) orderCostEstimate {
+	orderType := "standard"
+	if in.Garments > 0 {
+		orderType = "dry_cleaning"
+	} else if in.Rush {
+		orderType = "rush"
+	}
+	return orderCostEstimate{
+		OrderType:      orderType,
+		RevenueCents:   in.TotalCents - in.TaxCents + in.PlanShareCents,
+		DriverPayCents: driverCommissionCents(in.TotalCents),
+		FacilityCents:  in.Bags*rates["facility_per_bag"] + in.Garments*rates["facility_per_garment"],
+		SuppliesCents:  in.Bags*rates["supplies_per_bag"] + in.Garments*rates["supplies_per_garment"],
+	}
+}
+
+// planShareCents spreads a plan's monthly price evenly across its pickups
+func planShareCents(pricePerMonthCents, pickupsPerMonth int) int {
+	if pickupsPerMonth <= 0 {
+		return 0
+	}
+	return (pricePerMonthCents + pickupsPerMonth/2) / pickupsPerMonth
+}
+
+func loadCostRates(db *sql.DB) (map[string]int, error) {
+	rows, err := db.Query("SELECT name, cost_cents FROM cost_rates")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := map[string]int{}
+	for rows.Next() {
+		var name string
+		var cents int
+		if err := rows.Scan(&name, &cents); err != nil {
+			return nil, err
+		}
+		rates[name] = cents
+	}
+	return rates, rows.Err()
+}
+
+// recordMissingOrderCosts estimates and stores costs for delivered orders
+// that haven't been costed yet, at today's rates. Orders already costed keep
+// their snapshot.
+func recordMissingOrderCosts(db *sql.DB) (int, error) {
+	rates, err := loadCostRates(db)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT o.id, COALESCE(o.total_cents, 0), COALESCE(o.tax_cents, 0),
+		       COALESCE(sp.price_per_month_cents, 0), COALESCE(sp.pickups_per_month, 0),
+		       (SELECT COALESCE(SUM(oi.quantity), 0) FROM order_items oi WHERE oi.order_id = o.id),
+		       (SELECT COALESCE(SUM(og.quantity), 0) FROM order_garments og WHERE og.order_id = o.id),
+		       EXISTS (
+		           SELECT 1 FROM order_items oi JOIN services s ON oi.service_id = s.id
+		           WHERE oi.order_id = o.id AND s.name = 'rush_bag'
+		       )
+		FROM orders o
+		LEFT JOIN order_costs oc ON oc.order_id = o.id
+		LEFT JOIN subscriptions sub ON o.subscription_id = sub.id
+		LEFT JOIN subscription_plans sp ON sub.plan_id = sp.id
+		WHERE o.status = 'delivered' AND oc.order_id IS NULL
+		ORDER BY o.id`,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	type pending struct {
+		orderID  int
+		estimate orderCostEstimate
+	}
+	var orders []pending
+	for rows.Next() {
+		var orderID, planPrice, planPickups int
+		var in orderCostInputs
+		if err := rows.Scan(&orderID, &in.TotalCents, &in.TaxCents, &planPrice, &planPickups,
+			&in.Bags, &in.Garments, &in.Rush); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		in.PlanShareCents = planShareCents(planPrice, planPickups)
+		orders = append(orders, pending{orderID, estimateOrderCost(in, rates)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	recorded := 0
+	for _, o := range orders {
+		result, err := db.Exec(`
+			INSERT INTO order_costs (order_id, order_type, revenue_cents, driver_pay_cents, facility_cents, supplies_cents, total_cost_cents)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (order_id) DO NOTHING`,
+			o.orderID, o.estimate.OrderType, o.estimate.RevenueCents, o.estimate.DriverPayCents,
+			o.estimate.FacilityCents, o.estimate.SuppliesCents, o.estimate.totalCostCents(),
+		)
+		if err != nil {
+			return recorded, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			recorded++
+		}
+	}
+	return recorded, nil
+}
+
+// processOrderCosts costs orders delivered since the last run
+func (s *AutoScheduler) processOrderCosts() {
+	recorded, err := recordMissingOrderCosts(s.db)
+	if err != nil {
+		log.Printf("Error recording order costs: %v", err)
+		return
+	}
+	if recorded > 0 {
+		log.Printf("Recorded cost estimates for %d delivered orders", recorded)
+	}
+}
+
+// MarginRow is revenue against estimated cost for one slice of orders
+type MarginRow struct {
+	Key           string  `json:"key"`
+	Orders        int     `json:"orders"`
+	Revenue       float64 `json:"revenue"`
+	DriverPay     float64 `json:"driver_pay"`
+	Facility      float64 `json:"facility"`
+	Supplies      float64 `json:"supplies"`
+	TotalCost     float64 `json:"total_cost"`
+	Margin        float64 `json:"margin"`
+	MarginPercent float64 `json:"margin_percent"`
+}
+
+type MarginReport struct {
+	Start       string      `json:"start"`
+	End         string      `json:"end"`
+	Totals      MarginRow   `json:"totals"`
+	ByZone      []MarginRow `json:"by_zone"`
+	ByPlan      []MarginRow `json:"by_plan"`
+	ByOrderType []MarginRow `json:"by_order_type"`
+}
+
+// marginGroupings are the SQL expressions orders are sliced by. Zones are
+// pickup ZIP codes, as on the route optimization screen.
+var marginGroupings = map[string]string{
+	"zone":       "COALESCE(a.zip_code, 'unknown')",
+	"plan":       "COALESCE(sp.name, 'Pay per order')",
+	"order_type": "oc.order_type",
+	"total":      "'all'",
+}
+
+func newMarginRow(key string, orders, revenue, driverPay, facility, supplies, cost int) MarginRow {
+	row := MarginRow{
+		Key:       key,
+		Orders:    orders,
+		Revenue:   centsToDollars(revenue),
+		DriverPay: centsToDollars(driverPay),
+		Facility:  centsToDollars(facility),
+		Supplies:  centsToDollars(supplies),
+		TotalCost: centsToDollars(cost),
+		Margin:    centsToDollars(revenue - cost),
+	}
+	if revenue != 0 {
+		row.MarginPercent = math.Round(float64(revenue-cost)/float64(revenue)*1000) / 10
+	}
+	return row
+}
+
+func (h *CostHandler) getMargins(grouping, start, end string) ([]MarginRow, error) {
+	rows, err := h.db.Query(`
+		SELECT `+marginGroupings[grouping]+` AS key, COUNT(*),
+		       SUM(oc.revenue_cents), SUM(oc.driver_pay_cents), SUM(oc.facility_cents),
+		       SUM(oc.supplies_cents), SUM(oc.total_cost_cents)
+		FROM order_costs oc
+		JOIN orders o ON oc.order_id = o.id
+		LEFT JOIN addresses a ON o.pickup_address_id = a.id
+		LEFT JOIN subscriptions sub ON o.subscription_id = sub.id
+		LEFT JOIN subscription_plans sp ON sub.plan_id = sp.id
+		WHERE COALESCE(o.delivery_date, o.created_at::date) BETWEEN $1::date AND $2::date
+		GROUP BY key
+		ORDER BY SUM(oc.revenue_cents) - SUM(oc.total_cost_cents) DESC, key`,
+		start, end,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	margins := []MarginRow{}
+	for rows.Next() {
+		var row MarginRow
+		var revenue, driverPay, facility, supplies, cost int
+		if err := rows.Scan(&row.Key, &row.Orders, &revenue, &driverPay, &facility, &supplies, &cost); err != nil {
+			return nil, err
+		}
+		margins = append(margins, newMarginRow(row.Key, row.Orders, revenue, driverPay, facility, supplies, cost))
+	}
+	return margins, rows.Err()
+}
+
+// handleGetMargins reports revenue against estimated cost by zone, plan and
+// order type for orders delivered between start and end (default: the last
+// 30 days). Delivered orders not yet costed are estimated first.
+func (h *CostHandler) handleGetMargins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	end := time.Now().UTC()
+	start := end.AddDate(0, 0, -30)
+	for param, value := range map[string]*time.Time{"start": &start, "end": &end} {
+		if raw := r.URL.Query().Get(param); raw != "" {
+			parsed, err := time.Parse("2006-01-02", raw)
+			if err != nil {
+				http.Error(w, "Invalid date format, use YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			*value = parsed
+		}
+	}
+	if start.After(end) {
+		http.Error(w, "start must be before end", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := recordMissingOrderCosts(h.db); err != nil {
+		log.Printf("Error recording order costs: %v", err)
+		http.Error(w, "Failed to estimate order costs", http.StatusInternalServerError)
+		return
+	}
+
+	report := MarginReport{
+		Start:  start.Format("2006-01-02"),
+		End:    end.Format("2006-01-02"),
+		Totals: MarginRow{Key: "all"},
+	}
+	for grouping, dest := range map[string]*[]MarginRow{
+		"zone":       &report.ByZone,
+		"plan":       &report.ByPlan,
+		"order_type": &report.ByOrderType,
+	} {
+		margins, err := h.getMargins(grouping, report.Start, report.End)
+		if err != nil {
+			http.Error(w, "Failed to fetch margins", http.StatusInternalServerError)
+			return
+		}
+		*dest = margins
+	}
+	totals, err := h.getMargins("total", report.Start, report.End)
+	if err != nil {
+		http.Error(w, "Failed to fetch margins", http.StatusInternalServerError)
+		return
+	}
+	if len(totals) > 0 {
+		report.Totals = totals[0]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (h *CostHandler) getRates(name string) ([]CostRate, error) {
+	query := "SELECT name, description, cost_cents, updated_by, updated_at FROM cost_rates"
+	args := []interface{}{}
+	if name != "" {
+		query += " WHERE name = $1"
+		args = append(args, name)
+	}
+	rows, err := h.db.Query(query+" ORDER BY name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := []CostRate{}
+	for rows.Next() {
+		var rate CostRate
+		var cents int
+		var updatedBy sql.NullInt64
+		if err := rows.Scan(&rate.Name, &rate.Description, &cents, &updatedBy, &rate.UpdatedAt); err != nil {
+			return nil, err
+		}
+		rate.Cost = centsToDollars(cents)
+		if updatedBy.Valid {
+			id := int(updatedBy.Int64)
+			rate.UpdatedBy = &id
+		}
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+// handleGetCostRates lists the unit costs order estimates are built from
+func (h *CostHandler) handleGetCostRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := h.getRates("")
+	if err != nil {
+		http.Error(w, "Failed to fetch cost rates", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+// handleUpdateCostRate changes a unit cost. Only orders costed from now on
+// use the new rate.
+func (h *CostHandler) handleUpdateCostRate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req UpdateCostRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Cost == nil || *req.Cost < 0 {
+		http.Error(w, "cost must be zero or more", http.StatusBadRequest)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	result, err := h.db.Exec(
+		"UPDATE cost_rates SET cost_cents = $1, updated_by = $2 WHERE name = $3",
+		dollarsToCents(*req.Cost), adminID, name,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update cost rate", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Cost rate not found", http.StatusNotFound)
+		return
+	}
+
+	rates, err := h.getRates(name)
+	if err != nil || len(rates) == 0 {
+		http.Error(w, "Failed to fetch cost rate", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates[0])
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestEstimateOrderCost(t *testing.T) {
+	rates := map[string]int{
+		"facility_per_bag":     900,
+		"facility_per_garment": 250,
+		"supplies_per_bag":     150,
+		"supplies_per_garment": 60,
+	}
+
+	tests := []struct {
+		name     string
+		in       orderCostInputs
+		expected orderCostEstimate
+	}{
+		{
+			name: "pay per order bags",
+			in:   orderCostInputs{TotalCents: 7000, TaxCents: 400, Bags: 2},
+			expected: orderCostEstimate{
+				OrderType: "standard", RevenueCents: 6600, DriverPayCents: 4900,
+				FacilityCents: 1800, SuppliesCents: 300,
+			},
+		},
+		{
+			name: "subscription pickup covered by the plan",
+			in:   orderCostInputs{PlanShareCents: planShareCents(13000, 6), Bags: 1},
+			expected: orderCostEstimate{
+				OrderType: "standard", RevenueCents: 2167, DriverPayCents: 0,
+				FacilityCents: 900, SuppliesCents: 150,
+			},
+		},
+		{
+			name: "rush",
+			in:   orderCostInputs{TotalCents: 4000, Bags: 1, Rush: true},
+			expected: orderCostEstimate{
+				OrderType: "rush", RevenueCents: 4000, DriverPayCents: 2800,
+				FacilityCents: 900, SuppliesCents: 150,
+			},
+		},
+		{
+			name: "garments make it dry cleaning even with a rush bag",
+			in:   orderCostInputs{TotalCents: 2000, Garments: 3, Rush: true},
+			expected: orderCostEstimate{
+				OrderType: "dry_cleaning", RevenueCents: 2000, DriverPayCents: 1400,
+				FacilityCents: 750, SuppliesCents: 180,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateOrderCost(tt.in, rates); got != tt.expected {
+				t.Errorf("estimateOrderCost() = %+v, want %+v", got, tt.expected)
+			}
+		})
+	}
+
+	if share := planShareCents(4800, 0); share != 0 {
+		t.Errorf("Expected no share for a plan without pickups, got %d", share)
+	}
+}
+
+func TestMargins(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "margins-admin@example.com", "Margins", "Admin")
+	userID := db.CreateTestUser(t, "margins@example.com", "Margins", "Customer")
+	addressID := db.CreateTestAddress(t, userID)
+	standardBag := db.GetServiceID(t, "standard_bag")
+
+	delivered := db.CreateTestOrder(t, userID, addressID)
+	pending := db.CreateTestOrder(t, userID, addressID)
+	db.Exec(`
+		UPDATE orders SET status = 'delivered', delivery_date = CURRENT_DATE,
+		       subtotal_cents = 6000, tax_cents = 360, tip_cents = 0, total_cents = 6360
+		WHERE id = $1`,
+		delivered,
+	)
+	for _, orderID := range []int{delivered, pending} {
+		db.Exec("INSERT INTO order_items (order_id, service_id, quantity, price_cents) VALUES ($1, $2, 2, 3000)", orderID, standardBag)
+	}
+
+	handler := NewCostHandler(db.DB)
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return adminID, nil
+	}
+
+	getMargins := func() MarginReport {
+		req := httptest.NewRequest("GET", "/api/v1/admin/analytics/margins", nil)
+		w := httptest.NewRecorder()
+		handler.handleGetMargins(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var report MarginReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return report
+	}
+
+	// Revenue 60.00 after tax; costs are 70% driver pay on 63.60 plus two
+	// bags of facility and supplies
+	report := getMargins()
+	if report.Totals.Orders != 1 || report.Totals.Revenue != 60 || report.Totals.DriverPay != 44.52 || report.Totals.TotalCost != 65.52 {
+		t.Errorf("Unexpected totals %+v", report.Totals)
+	}
+	if report.Totals.Margin != -5.52 || report.Totals.MarginPercent != -9.2 {
+		t.Errorf("Expected a -5.52 (-9.2%%) margin, got %+v", report.Totals)
+	}
+	if len(report.ByZone) != 1 || report.ByZone[0].Key != "12345" {
+		t.Errorf("Expected one zone for the test address ZIP, got %+v", report.ByZone)
+	}
+	if len(report.ByPlan) != 1 || report.ByPlan[0].Key != "Pay per order" {
+		t.Errorf("Expected the order under pay per order, got %+v", report.ByPlan)
+	}
+	if len(report.ByOrderType) != 1 || report.ByOrderType[0].Key != "standard" {
+		t.Errorf("Expected a standard order, got %+v", report.ByOrderType)
+	}
+
+	// Raising a rate doesn't restate orders that were already costed
+	body, _ := json.Marshal(UpdateCostRateRequest{Cost: func() *float64 { v := 20.0; return &v }()})
+	req := httptest.NewRequest("PUT", "/api/v1/admin/costs/rates/facility_per_bag", bytes.NewBuffer(body))
+	req = mux.SetURLVars(req, map[string]string{"name": "facility_per_bag"})
+	w := httptest.NewRecorder()
+	handler.handleUpdateCostRate(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if report := getMargins(); report.Totals.TotalCost != 65.52 {
+		t.Errorf("Expected the costed order to keep its snapshot, got %+v", report.Totals)
+	}
+
+	req = httptest.NewRequest("PUT", "/api/v1/admin/costs/rates/fuel", bytes.NewBuffer(body))
+	req = mux.SetURLVars(req, map[string]string{"name": "fuel"})
+	w = httptest.NewRecorder()
+	handler.handleUpdateCostRate(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown rate, got %d", http.StatusNotFound, w.Code)
+	}
+}
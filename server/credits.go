@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tumble-backend/money"
+
+	"github.com/gorilla/mux"
+)
+
+// maxCreditGrantCents keeps a typo in an admin grant from handing out far
+// too much credit
+const maxCreditGrantCents = 50000
+
+var errInsufficientCredit = errors.New("adjustment would make the credit balance negative")
+
+type CreditHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewCreditHandler(db *sql.DB) *CreditHandler {
+	return &CreditHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type CreditLedgerEntry struct {
+	ID            int       `json:"id"`
+	Amount        float64   `json:"amount"`
+	EntryType     string    `json:"entry_type"`
+	OrderID       *int      `json:"order_id,omitempty"`
+	ResolutionID  *int      `json:"resolution_id,omitempty"`
+	Reason        string    `json:"reason"`
+	CreatedBy     *int      `json:"created_by,omitempty"`
+	CreatedByName *string   `json:"created_by_name,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type CreditBalanceResponse struct {
+	Balance float64             `json:"balance"`
+	Entries []CreditLedgerEntry `json:"entries"`
+}
+
+type CreditAdjustmentRequest struct {
+	// Positive amounts grant credit, negative ones take it back
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+// creditBalance returns a user's available credit in cents
+func creditBalance(q queryRower, userID int) (int, error) {
+	var balance int
+	err := q.QueryRow(
+		"SELECT COALESCE(SUM(amount_cents), 0) FROM customer_credit_ledger WHERE user_id = $1",
+		userID,
+	).Scan(&balance)
+	return balance, err
+}
+
+// lockCreditBalance serializes balance changes for a user until tx ends, so
+// two checkouts can't both spend the same credit
+func lockCreditBalance(tx *sql.Tx, userID int) (int, error) {
+	if _, err := tx.Exec("SELECT id FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		return 0, err
+	}
+	return creditBalance(tx, userID)
+}
+
+// addCredit appends a ledger entry. Entries that take credit away fail with
+// errInsufficientCredit instead of overdrawing the balance.
+func addCredit(tx *sql.Tx, userID, amountCents int, entryType, reason string, createdBy, orderID, resolutionID *int) (int, error) {
+	balance, err := lockCreditBalance(tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if balance+amountCents < 0 {
+		return 0, errInsufficientCredit
+	}
+
+	var entryID int
+	err = tx.QueryRow(`
+		INSERT INTO customer_credit_ledger (user_id, amount_cents, entry_type, order_id, resolution_id, reason, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`,
+		userID, amountCents, entryType, orderID, resolutionID, reason, createdBy,
+	).Scan(&entryID)
+	return entryID, err
+}
+
+// redeemCredits spends up to maxCents of a user's credit on an order and
+// returns how much was applied
+func redeemCredits(tx *sql.Tx, userID, orderID, maxCents int) (int, error) {
+	balance, err := lockCreditBalance(tx, userID)
+	if err != nil || balance <= 0 || maxCents <= 0 {
+		return 0, err
+	}
+
+	applied := balance
+	if applied > maxCents {
+		applied = maxCents
+	}
+	_, err = tx.Exec(`
+		INSERT INTO customer_credit_ledger (user_id, amount_cents, entry_type, order_id, reason)
+		VALUES ($1, $2, 'redemption', $3, $4)`,
+		userID, -applied, orderID, fmt.Sprintf("Applied to order #%d", orderID),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return applied, nil
+}
+
+// orderCreditCents returns the credit currently applied to an order, net of
+// any reversals
+func orderCreditCents(q queryRower, orderID int) (int, error) {
+	var applied int
+	err := q.QueryRow(`
+		SELECT COALESCE(-SUM(amount_cents), 0) FROM customer_credit_ledger
+		WHERE order_id = $1 AND entry_type IN ('redemption', 'reversal')`,
+		orderID,
+	).Scan(&applied)
+	return applied, err
+}
+
+// reverseOrderCredits gives back the credit spent on an order, e.g. when its
+// payment couldn't be set up
+func reverseOrderCredits(db execer, orderID int, reason string) error {
+	_, err := db.Exec(`
+		INSERT INTO customer_credit_ledger (user_id, amount_cents, entry_type, order_id, reason)
+		SELECT user_id, -SUM(amount_cents), 'reversal', order_id, $2
+		FROM customer_credit_ledger
+		WHERE order_id = $1 AND entry_type IN ('redemption', 'reversal')
+		GROUP BY user_id, order_id
+		HAVING SUM(amount_cents) < 0`,
+		orderID, reason,
+	)
+	return err
+}
+
+func (h *CreditHandler) creditLedger(userID int) (CreditBalanceResponse, error) {
+	resp := CreditBalanceResponse{Entries: []CreditLedgerEntry{}}
+
+	rows, err := h.db.Query(`
+		SELECT l.id, l.amount_cents, l.entry_type, l.order_id, l.resolution_id, l.reason,
+		       l.created_by, a.first_name || ' ' || a.last_name, l.created_at
+		FROM customer_credit_ledger l
+		LEFT JOIN users a ON l.created_by = a.id
+		WHERE l.user_id = $1
+		ORDER BY l.created_at DESC, l.id DESC`,
+		userID,
+	)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	balanceCents := 0
+	for rows.Next() {
+		var e CreditLedgerEntry
+		var amountCents int
+		if err := rows.Scan(&e.ID, &amountCents, &e.EntryType, &e.OrderID, &e.ResolutionID, &e.Reason,
+			&e.CreatedBy, &e.CreatedByName, &e.CreatedAt); err != nil {
+			return resp, err
+		}
+		e.Amount = centsToDollars(amountCents)
+		balanceCents += amountCents
+		resp.Entries = append(resp.Entries, e)
+	}
+	resp.Balance = centsToDollars(balanceCents)
+	return resp, rows.Err()
+}
+
+// handleGetCredits returns the caller's credit balance and ledger
+func (h *CreditHandler) handleGetCredits(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resp, err := h.creditLedger(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch credits", http.StatusInternalServerError)
+		return
+	}
+	// Customers see who issued credit only as "Tumble"
+	for i := range resp.Entries {
+		resp.Entries[i].CreatedBy = nil
+		resp.Entries[i].CreatedByName = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAdminGetCredits returns a user's credit balance and full ledger
+// including which admin made each manual entry
+func (h *CreditHandler) handleAdminGetCredits(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.creditLedger(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch credits", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAdminAdjustCredits grants a user credit, or takes it back with a
+// negative amount. A reason is required for the audit trail.
+func (h *CreditHandler) handleAdminAdjustCredits(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req CreditAdjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	amountCents := dollarsToCents(req.Amount)
+	if amountCents == 0 || amountCents > maxCreditGrantCents || amountCents < -maxCreditGrantCents {
+		http.Error(w, fmt.Sprintf("amount must be non-zero and at most %s either way", money.Format(maxCreditGrantCents)), http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists); err != nil || !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	entryType := "grant"
+	if amountCents < 0 {
+		entryType = "adjustment"
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := addCredit(tx, userID, amountCents, entryType, req.Reason, &adminID, nil, nil); err == errInsufficientCredit {
+		http.Error(w, "Adjustment is larger than the user's credit balance", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to adjust credit", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to adjust credit", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := h.creditLedger(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch credits", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
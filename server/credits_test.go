@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCreditLedger(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "credit-admin@example.com", "Credit", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	customerID := db.CreateTestUser(t, "credit-customer@example.com", "Credit", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+
+	admin := &CreditHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	adjust := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/admin/users/"+strconv.Itoa(customerID)+"/credits", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(customerID)})
+		w := httptest.NewRecorder()
+		admin.handleAdminAdjustCredits(w, req)
+		return w
+	}
+
+	if w := adjust(`{"amount": 10}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without a reason, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := adjust(`{"amount": 5000, "reason": "Typo"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d over the grant cap, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := adjust(`{"amount": 15, "reason": "Late delivery"}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if w := adjust(`{"amount": -20, "reason": "Clawback"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d overdrawing the balance, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Redemption is capped at what the order costs and can be reversed
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	applied, err := redeemCredits(tx, customerID, orderID, 1000)
+	if err != nil {
+		t.Fatalf("Failed to redeem credits: %v", err)
+	}
+	tx.Commit()
+	if applied != 1000 {
+		t.Errorf("Expected 1000 cents applied, got %d", applied)
+	}
+	if balance, _ := creditBalance(db.DB, customerID); balance != 500 {
+		t.Errorf("Expected 500 cents left, got %d", balance)
+	}
+
+	if err := reverseOrderCredits(db.DB, orderID, "Payment failed"); err != nil {
+		t.Fatalf("Failed to reverse credits: %v", err)
+	}
+	if err := reverseOrderCredits(db.DB, orderID, "Payment failed"); err != nil {
+		t.Fatalf("Failed to reverse credits twice: %v", err)
+	}
+	if balance, _ := creditBalance(db.DB, customerID); balance != 1500 {
+		t.Errorf("Expected the reversal to restore 1500 cents once, got %d", balance)
+	}
+	if onOrder, _ := orderCreditCents(db.DB, orderID); onOrder != 0 {
+		t.Errorf("Expected no credit left on the order, got %d", onOrder)
+	}
+
+	// Customers see their ledger without who issued each entry
+	customer := &CreditHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest}
+	w := httptest.NewRecorder()
+	customer.handleGetCredits(w, httptest.NewRequest("GET", "/api/v1/payments/credits", nil))
+	var resp CreditBalanceResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Balance != 15 || len(resp.Entries) != 3 {
+		t.Fatalf("Expected $15 across 3 entries, got %s", w.Body.String())
+	}
+	for _, e := range resp.Entries {
+		if e.CreatedBy != nil || e.CreatedByName != nil {
+			t.Errorf("Expected the issuing admin to be hidden, got %+v", e)
+		}
+	}
+}
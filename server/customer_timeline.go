@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultTimelineLimit = 100
+	maxTimelineLimit     = 500
+)
+
+// timelineKinds are the sources merged into a customer's timeline, and the
+// query that reads each one for user $1. Every query returns the same
+// columns: type, source ID, time, summary, detail, status, order ID, amount
+// in cents and the acting user.
+var timelineKinds = []struct {
+	kind  string
+	query string
+}{
+	{"orders", `
+		SELECT 'order_created', o.id, o.created_at, 'Order #' || o.id || ' placed',
+		       'Pickup ' || o.pickup_date || ' ' || o.pickup_time_slot, o.status, o.id, o.total_cents, o.user_id
+		FROM orders o WHERE o.user_id = $1
+		UNION ALL
+		SELECT 'status_changed', h.id, h.created_at, 'Order #' || h.order_id || ' ' || REPLACE(h.status, '_', ' '),
+		       h.notes, h.status, h.order_id, NULL::int, h.updated_by
+		FROM (
+			SELECT sh.*, LAG(sh.status) OVER (PARTITION BY sh.order_id ORDER BY sh.created_at, sh.id) AS previous_status
+			FROM order_status_history sh JOIN orders o ON sh.order_id = o.id
+			WHERE o.user_id = $1
+		) h
+		WHERE h.previous_status IS DISTINCT FROM h.status`},
+	// Notes are status history rows that didn't change the status
+	{"notes", `
+		SELECT 'order_note', h.id, h.created_at, 'Note on order #' || h.order_id,
+		       h.notes, h.status, h.order_id, NULL::int, h.updated_by
+		FROM (
+			SELECT sh.*, LAG(sh.status) OVER (PARTITION BY sh.order_id ORDER BY sh.created_at, sh.id) AS previous_status
+			FROM order_status_history sh JOIN orders o ON sh.order_id = o.id
+			WHERE o.user_id = $1
+		) h
+		WHERE h.previous_status = h.status AND COALESCE(h.notes, '') <> ''`},
+	{"payments", `
+		SELECT 'payment', p.id, p.created_at, INITCAP(REPLACE(COALESCE(p.payment_type, 'payment'), '_', ' ')) || ' payment',
+		       NULL, p.status, p.order_id, p.amount_cents, NULL::int
+		FROM payments p WHERE p.user_id = $1
+		UNION ALL
+		SELECT 'refund', rf.id, rf.created_at, 'Refund' || COALESCE(' on order #' || rf.order_id, ''),
+		       rf.reason, rf.status, rf.order_id, rf.amount_cents, rf.created_by
+		FROM refunds rf WHERE rf.user_id = $1
+		UNION ALL
+		SELECT 'credit', c.id, c.created_at, 'Account credit ' || c.entry_type,
+		       NULLIF(c.reason, ''), NULL, c.order_id, c.amount_cents, c.created_by
+		FROM customer_credit_ledger c WHERE c.user_id = $1`},
+	{"subscriptions", `
+		SELECT 'subscription_started', s.id, s.created_at, 'Subscribed to ' || sp.name,
+		       NULL, s.status, NULL::int, sp.price_per_month_cents, NULL::int
+		FROM subscriptions s JOIN subscription_plans sp ON s.plan_id = sp.id
+		WHERE s.user_id = $1
+		UNION ALL
+		SELECT 'subscription_' || s.status, s.id, s.updated_at, 'Subscription to ' || sp.name || ' ' || s.status,
+		       NULL, s.status, NULL::int, NULL::int, NULL::int
+		FROM subscriptions s JOIN subscription_plans sp ON s.plan_id = sp.id
+		WHERE s.user_id = $1 AND s.status IN ('paused', 'cancelled')
+		UNION ALL
+		SELECT 'plan_migrated', pms.id, pms.migrated_at, 'Moved from ' || fp.name || ' to ' || tp.name,
+		       NULL, pms.status, NULL::int, tp.price_per_month_cents, pm.created_by
+		FROM plan_migration_subscribers pms
+		JOIN plan_migrations pm ON pms.migration_id = pm.id
+		JOIN subscription_plans fp ON pm.from_plan_id = fp.id
+		JOIN subscription_plans tp ON pm.to_plan_id = tp.id
+		WHERE pms.user_id = $1 AND pms.status = 'migrated'
+		UNION ALL
+		SELECT 'subscription_adjusted', sa.id, sa.created_at,
+		       CASE WHEN sa.adjustment_type = 'credit' THEN 'Subscription credited'
+		            ELSE 'Subscription extended ' || sa.extend_days || ' days' END,
+		       sa.incident_key, sa.status, NULL::int, sa.credit_cents, NULL::int
+		FROM subscription_adjustments sa WHERE sa.user_id = $1 AND sa.status = 'applied'`},
+	{"claims", `
+		SELECT 'resolution', r.id, r.created_at, 'Order #' || r.order_id || ' resolved: ' || REPLACE(r.resolution_type, '_', ' '),
+		       r.notes, r.resolution_type, r.order_id,
+		       (COALESCE(r.refund_amount, r.credit_amount) * 100)::int, r.resolved_by
+		FROM order_resolutions r JOIN orders o ON r.order_id = o.id
+		WHERE o.user_id = $1`},
+	{"account", `
+		SELECT h.entity_type || '_' || h.change_type, h.id, h.created_at,
+		       INITCAP(h.entity_type) || ' ' || h.change_type,
+		       NULLIF(ARRAY_TO_STRING(h.changed_fields, ', '), ''), NULL, NULL::int, NULL::int, h.changed_by
+		FROM account_change_history h WHERE h.user_id = $1`},
+	{"notifications", `
+		SELECT n.type, n.id, n.created_at, n.title, n.message,
+		       CASE WHEN n.is_read THEN 'read' ELSE 'unread' END, n.order_id, NULL::int, NULL::int
+		FROM notifications n WHERE n.user_id = $1`},
+}
+
+// TimelineEvent is one thing that happened on a customer's account
+type TimelineEvent struct {
+	Kind        string    `json:"kind"` // orders, notes, payments, subscriptions, claims, account, notifications
+	Type        string    `json:"type"`
+	SourceID    int       `json:"source_id"` // Row ID within the kind's own table
+	OccurredAt  time.Time `json:"occurred_at"`
+	Summary     string    `json:"summary"`
+	Detail      *string   `json:"detail,omitempty"`
+	Status      *string   `json:"status,omitempty"`
+	OrderID     *int      `json:"order_id,omitempty"`
+	AmountCents *int      `json:"amount_cents,omitempty"`
+	ActorID     *int      `json:"actor_id,omitempty"`
+	ActorName   *string   `json:"actor_name,omitempty"`
+}
+
+type CustomerTimeline struct {
+	Events []TimelineEvent `json:"events"`
+	// NextBefore is what to pass as before for the next page; it's empty
+	// once the start of the account has been reached
+	NextBefore string `json:"next_before,omitempty"`
+}
+
+// customerTimeline merges the requested kinds for a user, newest first,
+// returning events strictly before the given time
+func customerTimeline(db *sql.DB, userID int, kinds []string, before *time.Time, limit int) (CustomerTimeline, error) {
+	var parts []string
+	for _, k := range timelineKinds {
+		for _, want := range kinds {
+			if k.kind == want {
+				parts = append(parts, "SELECT '"+k.kind+"' AS kind, * FROM ("+k.query+") AS "+k.kind+"_events")
+			}
+		}
+	}
+
+	// One extra row tells us whether there's another page
+	rows, err := db.Query(`
+		SELECT e.*, u.first_name || ' ' || u.last_name
+		FROM (`+strings.Join(parts, " UNION ALL ")+`) AS e (kind, type, source_id, occurred_at, summary, detail, status, order_id, amount_cents, actor_id)
+		LEFT JOIN users u ON u.id = e.actor_id
+		WHERE e.occurred_at IS NOT NULL AND ($2::timestamptz IS NULL OR e.occurred_at < $2)
+		ORDER BY e.occurred_at DESC, e.kind, e.source_id DESC
+		LIMIT $3`,
+		userID, before, limit+1,
+	)
+	if err != nil {
+		return CustomerTimeline{}, err
+	}
+	defer rows.Close()
+
+	timeline := CustomerTimeline{Events: []TimelineEvent{}}
+	for rows.Next() {
+		var e TimelineEvent
+		if err := rows.Scan(&e.Kind, &e.Type, &e.SourceID, &e.OccurredAt, &e.Summary, &e.Detail, &e.Status,
+			&e.OrderID, &e.AmountCents, &e.ActorID, &e.ActorName); err != nil {
+			return CustomerTimeline{}, err
+		}
+		timeline.Events = append(timeline.Events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return CustomerTimeline{}, err
+	}
+
+	if len(timeline.Events) > limit {
+		timeline.Events = timeline.Events[:limit]
+		// The cursor is a timestamp, so events sharing the page's last
+		// timestamp are left for the next page rather than split across two.
+		// A page made entirely of one timestamp is returned as is, and any
+		// further events at that instant are skipped.
+		last := timeline.Events[len(timeline.Events)-1].OccurredAt
+		trimmed := len(timeline.Events)
+		for trimmed > 0 && timeline.Events[trimmed-1].OccurredAt.Equal(last) {
+			trimmed--
+		}
+		if trimmed > 0 {
+			timeline.Events = timeline.Events[:trimmed]
+			last = timeline.Events[trimmed-1].OccurredAt
+		}
+		timeline.NextBefore = last.Format(time.RFC3339Nano)
+	}
+	return timeline, nil
+}
+
+// handleGetCustomerTimeline returns everything that has happened on one
+// customer's account in a single list, newest first, so support can see
+// orders, payments, subscription changes, claims, notes and notifications
+// together. ?kinds=orders,payments narrows it; ?before and ?limit page it.
+// Payments are left out for staff without payments.read.
+func (h *AdminHandler) handleGetCustomerTimeline(w http.ResponseWriter, r *http.Request) {
+	staffID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultTimelineLimit
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxTimelineLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxTimelineLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	var before *time.Time
+	if b := query.Get("before"); b != "" {
+		t, err := time.Parse(time.RFC3339Nano, b)
+		if err != nil {
+			http.Error(w, "before must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		before = &t
+	}
+
+	var kinds []string
+	if k := query.Get("kinds"); k != "" {
+		for _, kind := range strings.Split(k, ",") {
+			kinds = append(kinds, strings.TrimSpace(kind))
+		}
+	} else {
+		for _, k := range timelineKinds {
+			kinds = append(kinds, k.kind)
+		}
+	}
+	canSeePayments, err := userHasPermission(h.db, staffID, "payments.read")
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	allowed := kinds[:0]
+	for _, kind := range kinds {
+		known := false
+		for _, k := range timelineKinds {
+			known = known || k.kind == kind
+		}
+		if !known {
+			http.Error(w, "Unknown kind: "+kind, http.StatusBadRequest)
+			return
+		}
+		if kind != "payments" || canSeePayments {
+			allowed = append(allowed, kind)
+		}
+	}
+	if len(allowed) == 0 {
+		http.Error(w, "Forbidden - payments.read permission required", http.StatusForbidden)
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	timeline, err := customerTimeline(h.db, userID, allowed, before, limit)
+	if err != nil {
+		LogRequest("customer_timeline", r.Method, r.URL.Path, staffID).Error("Failed to build timeline", "error", err, "user_id", userID)
+		http.Error(w, "Failed to fetch timeline", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(timeline)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCustomerTimeline(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "timeline-admin@example.com", "Timeline", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	supportID := db.CreateTestUser(t, "timeline-support@example.com", "Timeline", "Support")
+	db.Exec("INSERT INTO roles (name) VALUES ('support')")
+	db.Exec("INSERT INTO role_permissions (role, permission) VALUES ('support', 'users.read')")
+	db.Exec("UPDATE users SET role = 'support' WHERE id = $1", supportID)
+	customerID := db.CreateTestUser(t, "timeline-customer@example.com", "Timeline", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	// A note under the same status, a status change, a payment and a notification
+	db.Exec("INSERT INTO order_status_history (order_id, status, notes, updated_by, created_at) VALUES ($1, 'scheduled', 'Gate code 1234', $2, NOW() + INTERVAL '1 minute')", orderID, adminID)
+	db.Exec("INSERT INTO order_status_history (order_id, status, updated_by, created_at) VALUES ($1, 'picked_up', $2, NOW() + INTERVAL '2 minutes')", orderID, adminID)
+	db.Exec("INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, created_at) VALUES ($1, $2, 4500, 'extra_order', 'completed', NOW() + INTERVAL '3 minutes')", customerID, orderID)
+	db.Exec("INSERT INTO notifications (user_id, order_id, type, title, message, created_at) VALUES ($1, $2, 'order_picked_up', 'Picked up', 'Your laundry is on its way', NOW() + INTERVAL '4 minutes')", customerID, orderID)
+
+	get := func(staffID int, query string) (CustomerTimeline, int) {
+		handler := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(staffID).getUserIDFromRequest}
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/admin/users/timeline"+query, nil),
+			map[string]string{"id": fmt.Sprint(customerID)})
+		w := httptest.NewRecorder()
+		handler.handleGetCustomerTimeline(w, req)
+		var timeline CustomerTimeline
+		json.Unmarshal(w.Body.Bytes(), &timeline)
+		return timeline, w.Code
+	}
+
+	timeline, code := get(adminID, "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	var types []string
+	for _, e := range timeline.Events {
+		types = append(types, e.Type)
+	}
+	expected := []string{"order_picked_up", "payment", "status_changed", "order_note", "status_changed", "order_created"}
+	if fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Errorf("Expected events %v newest first, got %v", expected, types)
+	}
+	for _, e := range timeline.Events {
+		if e.Type == "order_note" && (e.ActorName == nil || *e.ActorName != "Timeline Admin") {
+			t.Errorf("Expected the note to name its author, got %+v", e)
+		}
+	}
+
+	// Paging picks up where the last page stopped
+	page, _ := get(adminID, "?limit=2")
+	if len(page.Events) != 2 || page.NextBefore == "" {
+		t.Fatalf("Expected a first page of two, got %+v", page)
+	}
+	rest, _ := get(adminID, "?before="+page.NextBefore)
+	if len(page.Events)+len(rest.Events) != len(timeline.Events) || rest.NextBefore != "" {
+		t.Errorf("Expected the second page to hold the remaining events, got %d", len(rest.Events))
+	}
+
+	// Support staff without payments.read don't see payments
+	timeline, _ = get(supportID, "")
+	for _, e := range timeline.Events {
+		if e.Kind == "payments" {
+			t.Errorf("Expected payments to be hidden, got %+v", e)
+		}
+	}
+	if _, code := get(supportID, "?kinds=payments"); code != http.StatusForbidden {
+		t.Errorf("Expected status %d asking only for payments, got %d", http.StatusForbidden, code)
+	}
+	if _, code := get(adminID, "?kinds=tickets"); code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unknown kind, got %d", http.StatusBadRequest, code)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tumble-backend/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const maxSignatureUploadBytes = 1 << 20
+
+// allowedSignatureContentTypes are the sniffed types accepted for signature
+// images captured by the driver app
+var allowedSignatureContentTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+}
+
+// DeliverySignature is the signature taken at a pickup or delivery stop, the
+// proof of delivery on accounts that require one
+type DeliverySignature struct {
+	ID           int             `json:"id"`
+	RouteOrderID int             `json:"route_order_id"`
+	OrderID      int             `json:"order_id"`
+	SignerName   string          `json:"signer_name"`
+	ContentType  string          `json:"content_type"`
+	Strokes      json.RawMessage `json:"strokes,omitempty"`
+	URL          string          `json:"url,omitempty"` // Signed image link, valid for 15 minutes
+	SignedAt     time.Time       `json:"signed_at"`
+	storageKey   string
+}
+
+const deliverySignatureColumns = "id, route_order_id, order_id, signer_name, content_type, strokes, signed_at, storage_key"
+
+func scanDeliverySignature(scanner interface{ Scan(...interface{}) error }) (DeliverySignature, error) {
+	var s DeliverySignature
+	var strokes []byte
+	err := scanner.Scan(&s.ID, &s.RouteOrderID, &s.OrderID, &s.SignerName, &s.ContentType, &strokes, &s.SignedAt, &s.storageKey)
+	if len(strokes) > 0 {
+		s.Strokes = strokes
+	}
+	return s, err
+}
+
+// orderDeliverySignature returns the signature taken when the order was
+// delivered, with a signed link to the image when a store is given. It
+// returns nil when no signature was taken.
+func orderDeliverySignature(ctx context.Context, q queryRower, store storage.Store, orderID int) (*DeliverySignature, error) {
+	return orderStopSignature(ctx, q, store, orderID, "delivery")
+}
+
+// orderStopSignature returns the latest signature taken on the order's pickup
+// or delivery stop, or nil when none was taken
+func orderStopSignature(ctx context.Context, q queryRower, store storage.Store, orderID int, routeType string) (*DeliverySignature, error) {
+	s, err := scanDeliverySignature(q.QueryRow(`
+		SELECT ds.id, ds.route_order_id, ds.order_id, ds.signer_name, ds.content_type, ds.strokes, ds.signed_at, ds.storage_key
+		FROM delivery_signatures ds
+		JOIN route_orders ro ON ds.route_order_id = ro.id
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		WHERE ds.order_id = $1 AND dr.route_type = $2
+		ORDER BY ds.signed_at DESC, ds.id DESC
+		LIMIT 1`,
+		orderID, routeType,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if store != nil {
+		if s.URL, err = store.SignedURL(ctx, s.storageKey, fileURLExpiry); err != nil {
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+// signatureRequired reports whether completing a delivery stop needs a
+// signature captured first. Nobody is there to sign for a locker delivery.
+func signatureRequired(q queryRower, routeOrderID int) (bool, error) {
+	var required bool
+	err := q.QueryRow(`
+		SELECT dr.route_type = 'delivery' AND u.requires_delivery_signature
+			AND NOT EXISTS(SELECT 1 FROM delivery_signatures ds WHERE ds.route_order_id = ro.id)
+			AND NOT EXISTS(SELECT 1 FROM locker_reservations lr WHERE lr.order_id = o.id AND lr.status = 'reserved')
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		JOIN orders o ON ro.order_id = o.id
+		JOIN users u ON o.user_id = u.id
+		WHERE ro.id = $1`,
+		routeOrderID,
+	).Scan(&required)
+	return required, err
+}
+
+// handleCaptureSignature stores the signature for a pickup or delivery stop. The image
+// is sent as the "signature" field of a multipart form, with the signer's
+// name in "signer_name" and, optionally, the raw pen strokes as a JSON array
+// in "strokes". Signing again replaces the previous signature, unless the
+// order's account is under legal hold.
+func (h *DriverRouteHandler) handleCaptureSignature(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	routeOrderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route order ID", http.StatusBadRequest)
+		return
+	}
+
+	var orderID, routeDriverID int
+	var routeStatus string
+	err = h.db.QueryRow(`
+		SELECT ro.order_id, dr.driver_id, dr.status
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		WHERE ro.id = $1`,
+		routeOrderID,
+	).Scan(&orderID, &routeDriverID, &routeStatus)
+	if err == sql.ErrNoRows || (err == nil && routeDriverID != driverID) {
+		http.Error(w, "Route order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch route order", http.StatusInternalServerError)
+		return
+	}
+	if isClosedRouteStatus(routeStatus) {
+		http.Error(w, "Route is closed", http.StatusForbidden)
+		return
+	}
+	var replacingHeld bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM delivery_signatures WHERE route_order_id = $1)
+		   AND NOT `+notOnLegalHold("o.user_id")+`
+		FROM orders o WHERE o.id = $2`,
+		routeOrderID, orderID,
+	).Scan(&replacingHeld)
+	if err != nil {
+		http.Error(w, "Failed to fetch route order", http.StatusInternalServerError)
+		return
+	}
+	if replacingHeld {
+		http.Error(w, "This signature is under legal hold and cannot be replaced", http.StatusConflict)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSignatureUploadBytes+64<<10)
+	file, _, err := r.FormFile("signature")
+	if err != nil {
+		http.Error(w, "Signature image is required (max 1MB)", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	signerName := strings.TrimSpace(r.FormValue("signer_name"))
+	if signerName == "" || len(signerName) > 255 {
+		http.Error(w, "Signer name is required", http.StatusBadRequest)
+		return
+	}
+	var strokes interface{}
+	if raw := r.FormValue("strokes"); raw != "" {
+		var points []json.RawMessage
+		if err := json.Unmarshal([]byte(raw), &points); err != nil {
+			http.Error(w, "Strokes must be a JSON array", http.StatusBadRequest)
+			return
+		}
+		strokes = raw
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxSignatureUploadBytes+1))
+	if err != nil {
+		http.Error(w, "Signature image is too large", http.StatusBadRequest)
+		return
+	}
+	contentType, ext, err := storage.Validate(data, maxSignatureUploadBytes, allowedSignatureContentTypes)
+	if errors.Is(err, storage.ErrTooLarge) {
+		http.Error(w, "Signature image is too large (max 1MB)", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Signature must be a PNG, JPEG or WebP image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	key := fmt.Sprintf("signatures/%d/%d-%s%s", orderID, routeOrderID, generateRandomString(8), ext)
+	if err := h.store.Put(r.Context(), key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		LogRequest("capture_signature", r.Method, r.URL.Path, driverID).Error("Failed to store signature", "error", err)
+		http.Error(w, "Failed to store signature", http.StatusInternalServerError)
+		return
+	}
+
+	var oldKey sql.NullString
+	h.db.QueryRow("SELECT storage_key FROM delivery_signatures WHERE route_order_id = $1", routeOrderID).Scan(&oldKey)
+
+	signature, err := scanDeliverySignature(h.db.QueryRow(`
+		INSERT INTO delivery_signatures (route_order_id, order_id, driver_id, signer_name, storage_key, content_type, size_bytes, strokes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (route_order_id) DO UPDATE SET
+			driver_id = EXCLUDED.driver_id,
+			signer_name = EXCLUDED.signer_name,
+			storage_key = EXCLUDED.storage_key,
+			content_type = EXCLUDED.content_type,
+			size_bytes = EXCLUDED.size_bytes,
+			strokes = EXCLUDED.strokes,
+			signed_at = CURRENT_TIMESTAMP
+		RETURNING `+deliverySignatureColumns,
+		routeOrderID, orderID, driverID, signerName, key, contentType, len(data), strokes,
+	))
+	if err != nil {
+		h.store.Delete(r.Context(), key)
+		http.Error(w, "Failed to store signature", http.StatusInternalServerError)
+		return
+	}
+	if oldKey.Valid && oldKey.String != key {
+		if err := h.store.Delete(r.Context(), oldKey.String); err != nil {
+			log.Printf("Failed to delete replaced signature %s: %v", oldKey.String, err)
+		}
+	}
+
+	if signature.URL, err = h.store.SignedURL(r.Context(), key, fileURLExpiry); err != nil {
+		http.Error(w, "Failed to sign signature URL", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(signature)
+}
+
+// handleSetSignatureRequirement turns the delivery signature requirement on
+// or off for a commercial account
+func (h *AdminHandler) handleSetSignatureRequirement(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Required bool `json:"required"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec(
+		"UPDATE users SET requires_delivery_signature = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		req.Required, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":                     userID,
+		"requires_delivery_signature": req.Required,
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tumble-backend/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDeliverySignatureRequired(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "signature-driver@example.com", "Sign", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "signature-business@example.com", "Acme", "Offices")
+	db.Exec("UPDATE users SET requires_delivery_signature = true WHERE id = $1", customerID)
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	db.Exec("UPDATE orders SET status = 'out_for_delivery' WHERE id = $1", orderID)
+
+	var routeID, routeOrderID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'delivery', 'in_progress')
+		RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	db.QueryRow("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1) RETURNING id", routeID, orderID).Scan(&routeOrderID)
+
+	store := storage.NewLocal(t.TempDir(), "https://tumble.test/api/v1/storage", []byte("secret"))
+	handler := NewDriverRouteHandler(db.DB, NewMockRealtimeHandler())
+	handler.getUserID = CreateAuthMock(driverID).getUserIDFromRequest
+	handler.store = store
+
+	complete := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", fmt.Sprintf("/api/v1/driver/route-orders/status?id=%d", routeOrderID), strings.NewReader(`{"status": "completed"}`))
+		w := httptest.NewRecorder()
+		handler.handleUpdateRouteOrderStatus(w, req)
+		return w
+	}
+	sign := func(image []byte, signerName, strokes string) *httptest.ResponseRecorder {
+		var form bytes.Buffer
+		writer := multipart.NewWriter(&form)
+		part, _ := writer.CreateFormFile("signature", "signature.png")
+		part.Write(image)
+		writer.WriteField("signer_name", signerName)
+		if strokes != "" {
+			writer.WriteField("strokes", strokes)
+		}
+		writer.Close()
+
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/v1/driver/route-orders/%d/signature", routeOrderID), &form)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(routeOrderID)})
+		w := httptest.NewRecorder()
+		handler.handleCaptureSignature(w, req)
+		return w
+	}
+
+	if w := complete(); w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d completing an unsigned delivery, got %d", http.StatusConflict, w.Code)
+	}
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+	if w := sign([]byte("not an image"), "Pat Reception", ""); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status %d for a non-image, got %d", http.StatusUnsupportedMediaType, w.Code)
+	}
+	if w := sign(png, "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without a signer name, got %d", http.StatusBadRequest, w.Code)
+	}
+	w := sign(png, "Pat Reception", `[[{"x":1,"y":2,"t":0}]]`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var signature DeliverySignature
+	json.Unmarshal(w.Body.Bytes(), &signature)
+	if signature.SignerName != "Pat Reception" || signature.URL == "" || len(signature.Strokes) == 0 {
+		t.Errorf("Unexpected signature: %s", w.Body.String())
+	}
+
+	// A signature on an account under legal hold isn't replaced
+	db.Exec("INSERT INTO legal_holds (user_id, reason) VALUES ($1, 'Dispute')", customerID)
+	if w := sign(png, "Someone Else", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d replacing a held signature, got %d", http.StatusConflict, w.Code)
+	}
+	db.Exec("UPDATE legal_holds SET released_at = CURRENT_TIMESTAMP WHERE user_id = $1", customerID)
+
+	if w := complete(); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d once signed, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var status string
+	db.QueryRow("SELECT status FROM orders WHERE id = $1", orderID).Scan(&status)
+	if status != "delivered" {
+		t.Errorf("Expected the order to be delivered, got %s", status)
+	}
+
+	// The signature is attached to the customer's receipt
+	orders := &OrderHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest, fileStore: store}
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/orders/%d/receipt", orderID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(orderID)})
+	w = httptest.NewRecorder()
+	orders.handleGetOrderReceipt(w, req)
+	var receipt OrderReceipt
+	json.Unmarshal(w.Body.Bytes(), &receipt)
+	if receipt.DeliverySignature == nil || receipt.DeliverySignature.SignerName != "Pat Reception" || receipt.DeliverySignature.URL == "" {
+		t.Errorf("Expected the receipt to carry the delivery signature, got %s", w.Body.String())
+	}
+}
@@ -6,8 +6,18 @@ import (
 	"fmt"
 	"net/http"
 	"time"
+
+	"tumble-backend/money"
 )
 
+// driverCommissionPercent is the share of completed order value a driver earns
+const driverCommissionPercent = 70
+
+// driverCommissionCents is a driver's cut of an order value, in cents
+func driverCommissionCents(orderValueCents int) int {
+	return money.Percent(orderValueCents, driverCommissionPercent)
+}
+
 type DriverEarningsHandler struct {
 	db        *sql.DB
 	getUserID func(*http.Request, *sql.DB) (int, error)
@@ -29,6 +39,12 @@ type EarningsData struct {
 	AveragePerOrder float64 `json:"averagePerOrder"`
 	HoursWorked     float64 `json:"hoursWorked"`
 	HourlyRate      float64 `json:"hourlyRate"`
+	Expenses        float64 `json:"expenses"` // Reimbursable mileage and tolls
+	MilesDriven     float64 `json:"milesDriven"`
+	// UnpaidBalance is stop pay and tips earned but not yet transferred
+	UnpaidBalance float64             `json:"unpaidBalance"`
+	PayoutAccount DriverPayoutAccount `json:"payoutAccount"`
+	Payouts       []DriverPayout      `json:"payouts"` // The last 12 weeks
 }
 
 type EarningsHistory struct {
@@ -36,6 +52,8 @@ type EarningsHistory struct {
 	Orders   int     `json:"orders"`
 	Earnings float64 `json:"earnings"`
 	Hours    float64 `json:"hours"`
+	Expenses float64 `json:"expenses"`
+	Miles    float64 `json:"miles"`
 }
 
 // requireDriver middleware
@@ -74,28 +92,25 @@ func (h *DriverEarningsHandler) handleGetDriverEarnings(w http.ResponseWriter, r
 	// Calculate earnings based on completed route orders with 70% commission
 	earnings := &EarningsData{}
 
-	// Simple 70% commission structure
-	const driverCommissionRate = 0.70 // 70% of order value
-
 	// Get today's earnings
 	todayEarnings := h.calculateEarningsForPeriod(driverID, "today")
-	earnings.Today = todayEarnings
+	earnings.Today = centsToDollars(todayEarnings)
 
 	// Get this week's earnings
 	weekEarnings := h.calculateEarningsForPeriod(driverID, "week")
-	earnings.ThisWeek = weekEarnings
+	earnings.ThisWeek = centsToDollars(weekEarnings)
 
 	// Get this month's earnings
 	monthEarnings := h.calculateEarningsForPeriod(driverID, "month")
-	earnings.ThisMonth = monthEarnings
+	earnings.ThisMonth = centsToDollars(monthEarnings)
 
 	// Get total earnings and completed orders
 	totalEarnings, totalOrders := h.calculateTotalEarnings(driverID)
-	earnings.Total = totalEarnings
+	earnings.Total = centsToDollars(totalEarnings)
 	earnings.CompletedOrders = totalOrders
 	
 	if totalOrders > 0 {
-		earnings.AveragePerOrder = earnings.Total / float64(totalOrders)
+		earnings.AveragePerOrder = centsToDollars((totalEarnings + totalOrders/2) / totalOrders)
 	}
 
 	// Calculate actual hours worked based on route durations
@@ -105,12 +120,33 @@ func (h *DriverEarningsHandler) handleGetDriverEarnings(w http.ResponseWriter, r
 		earnings.HourlyRate = earnings.Total / earnings.HoursWorked
 	}
 
+	// Logged mileage and tolls are reimbursed on top of commission
+	earnings.Expenses, earnings.MilesDriven = driverExpenseTotals(h.db, driverID, "")
+
+	// Weekly payouts are stop pay plus tips, sent through Stripe Connect
+	unpaidCents, err := driverUnpaidCents(h.db, driverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch payouts", http.StatusInternalServerError)
+		return
+	}
+	earnings.UnpaidBalance = centsToDollars(unpaidCents)
+	if earnings.PayoutAccount, _, err = getDriverPayoutAccount(h.db, driverID); err != nil {
+		http.Error(w, "Failed to fetch payouts", http.StatusInternalServerError)
+		return
+	}
+	earnings.Payouts, err = listDriverPayouts(h.db,
+		"p.driver_id = $1 AND p.period_start >= CURRENT_DATE - INTERVAL '12 weeks'", driverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch payouts", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(earnings)
 }
 
-// calculateEarningsForPeriod calculates earnings for a specific time period
-func (h *DriverEarningsHandler) calculateEarningsForPeriod(driverID int, period string) float64 {
+// calculateEarningsForPeriod returns a driver's commission in cents for today, this week or this month
+func (h *DriverEarningsHandler) calculateEarningsForPeriod(driverID int, period string) int {
 	var dateCondition string
 	switch period {
 	case "today":
@@ -120,12 +156,12 @@ func (h *DriverEarningsHandler) calculateEarningsForPeriod(driverID int, period
 	case "month":
 		dateCondition = "DATE(dr.route_date) >= DATE_TRUNC('month', CURRENT_DATE) AND DATE(dr.route_date) <= CURRENT_DATE"
 	default:
-		return 0.0
+		return 0
 	}
 
 	query := fmt.Sprintf(`
 		SELECT 
-			COALESCE(SUM(o.total), 0) as order_value_total
+			COALESCE(SUM(o.total_cents), 0) as order_value_total
 		FROM route_orders ro
 		JOIN driver_routes dr ON ro.route_id = dr.id
 		JOIN orders o ON ro.order_id = o.id
@@ -134,23 +170,22 @@ func (h *DriverEarningsHandler) calculateEarningsForPeriod(driverID int, period
 		AND %s
 	`, dateCondition)
 
-	var orderValueTotal float64
+	var orderValueTotal int
 	
 	err := h.db.QueryRow(query, driverID).Scan(&orderValueTotal)
 	if err != nil && err != sql.ErrNoRows {
-		return 0.0
+		return 0
 	}
 
-	// Simple 70% commission of total order value
-	return orderValueTotal * 0.70
+	return driverCommissionCents(orderValueTotal)
 }
 
-// calculateTotalEarnings calculates total lifetime earnings
-func (h *DriverEarningsHandler) calculateTotalEarnings(driverID int) (float64, int) {
+// calculateTotalEarnings calculates total lifetime earnings in cents
+func (h *DriverEarningsHandler) calculateTotalEarnings(driverID int) (int, int) {
 	query := `
 		SELECT 
 			COUNT(ro.id) as order_count,
-			COALESCE(SUM(o.total), 0) as order_value_total
+			COALESCE(SUM(o.total_cents), 0) as order_value_total
 		FROM route_orders ro
 		JOIN driver_routes dr ON ro.route_id = dr.id
 		JOIN orders o ON ro.order_id = o.id
@@ -159,16 +194,14 @@ func (h *DriverEarningsHandler) calculateTotalEarnings(driverID int) (float64, i
 	`
 
 	var orderCount int
-	var orderValueTotal float64
+	var orderValueTotal int
 	
 	err := h.db.QueryRow(query, driverID).Scan(&orderCount, &orderValueTotal)
 	if err != nil && err != sql.ErrNoRows {
-		return 0.0, 0
+		return 0, 0
 	}
 
-	// Simple 70% commission of total order value
-	totalEarnings := orderValueTotal * 0.70
-	return totalEarnings, orderCount
+	return driverCommissionCents(orderValueTotal), orderCount
 }
 
 
@@ -301,14 +334,11 @@ func (h *DriverEarningsHandler) handleGetDriverEarningsHistory(w http.ResponseWr
 		daysBack = 7
 	}
 
-	// Simple 70% commission structure
-	const driverCommissionRate = 0.70
-
 	query := `
 		SELECT 
 			DATE(dr.route_date) as work_date,
 			COUNT(ro.id) as completed_orders,
-			COALESCE(SUM(o.total), 0) as order_value_total
+			COALESCE(SUM(o.total_cents), 0) as order_value_total
 		FROM route_orders ro
 		JOIN driver_routes dr ON ro.route_id = dr.id
 		JOIN orders o ON ro.order_id = o.id
@@ -332,24 +362,26 @@ func (h *DriverEarningsHandler) handleGetDriverEarningsHistory(w http.ResponseWr
 	for rows.Next() {
 		var workDate time.Time
 		var completedOrders int
-		var orderValueTotal float64
+		var orderValueTotal int
 
 		err := rows.Scan(&workDate, &completedOrders, &orderValueTotal)
 		if err != nil {
 			continue
 		}
 
-		// Simple 70% commission of order value
-		totalEarnings := orderValueTotal * driverCommissionRate
+		totalEarnings := centsToDollars(driverCommissionCents(orderValueTotal))
 		
 		// Calculate hours for this specific date
 		hours := h.calculateHoursForDate(driverID, workDate.Format("2006-01-02"))
+		expenses, miles := driverExpenseTotals(h.db, driverID, workDate.Format("2006-01-02"))
 
 		history = append(history, EarningsHistory{
 			Date:     workDate.Format("2006-01-02"),
 			Orders:   completedOrders,
 			Earnings: totalEarnings,
 			Hours:    hours,
+			Expenses: expenses,
+			Miles:    miles,
 		})
 	}
 
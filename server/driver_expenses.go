@@ -0,0 +1,510 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Default mileage reimbursement, matching the IRS standard business rate
+	defaultMileageRateCents = 70
+	maxReceiptUploadBytes   = 10 << 20
+)
+
+// allowedReceiptContentTypes are the sniffed types accepted for receipt photos
+var allowedReceiptContentTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+// DriverExpenseHandler lets drivers log mileage and tolls against their routes
+type DriverExpenseHandler struct {
+	db               *sql.DB
+	getUserID        func(*http.Request, *sql.DB) (int, error)
+	uploadDir        string
+	mileageRateCents int
+}
+
+func NewDriverExpenseHandler(db *sql.DB) *DriverExpenseHandler {
+	uploadDir := os.Getenv("RECEIPT_UPLOAD_DIR")
+	if uploadDir == "" {
+		uploadDir = filepath.Join("uploads", "receipts")
+	}
+	mileageRateCents := defaultMileageRateCents
+	if rate, err := strconv.Atoi(os.Getenv("DRIVER_MILEAGE_RATE_CENTS")); err == nil && rate > 0 {
+		mileageRateCents = rate
+	}
+	return &DriverExpenseHandler{
+		db:               db,
+		getUserID:        getUserIDFromRequest,
+		uploadDir:        uploadDir,
+		mileageRateCents: mileageRateCents,
+	}
+}
+
+type DriverExpense struct {
+	ID          int       `json:"id"`
+	RouteID     int       `json:"route_id"`
+	ExpenseType string    `json:"expense_type"` // mileage or toll
+	Miles       *float64  `json:"miles,omitempty"`
+	RatePerMile *float64  `json:"rate_per_mile,omitempty"`
+	Amount      float64   `json:"amount"`
+	Description *string   `json:"description,omitempty"`
+	HasReceipt  bool      `json:"has_receipt"`
+	IncurredOn  string    `json:"incurred_on"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type CreateDriverExpenseRequest struct {
+	RouteID     int     `json:"route_id"`
+	ExpenseType string  `json:"expense_type"`
+	Miles       float64 `json:"miles,omitempty"`  // Mileage
+	Amount      float64 `json:"amount,omitempty"` // Tolls
+	Description *string `json:"description,omitempty"`
+}
+
+// expenseAmountCents works out what an expense is worth. Mileage is
+// reimbursed at the per-mile rate; tolls at the amount paid.
+func expenseAmountCents(req CreateDriverExpenseRequest, rateCentsPerMile int) (int, error) {
+	switch req.ExpenseType {
+	case "mileage":
+		if req.Miles <= 0 || req.Miles > 1000 {
+			return 0, fmt.Errorf("miles must be between 0 and 1000")
+		}
+		return int(math.Round(req.Miles * float64(rateCentsPerMile))), nil
+	case "toll":
+		if req.Amount <= 0 || req.Amount > 200 {
+			return 0, fmt.Errorf("toll amount must be between $0 and $200")
+		}
+		return dollarsToCents(req.Amount), nil
+	default:
+		return 0, fmt.Errorf("expense_type must be mileage or toll")
+	}
+}
+
+const driverExpenseColumns = `id, route_id, expense_type, miles, rate_cents_per_mile, amount_cents,
+	description, receipt_path IS NOT NULL, incurred_on, created_at`
+
+func scanDriverExpense(scanner interface{ Scan(...interface{}) error }) (DriverExpense, error) {
+	var e DriverExpense
+	var rateCents sql.NullInt64
+	var amountCents int
+	var incurredOn time.Time
+	err := scanner.Scan(&e.ID, &e.RouteID, &e.ExpenseType, &e.Miles, &rateCents, &amountCents,
+		&e.Description, &e.HasReceipt, &incurredOn, &e.CreatedAt)
+	if err != nil {
+		return e, err
+	}
+	if rateCents.Valid {
+		rate := centsToDollars(int(rateCents.Int64))
+		e.RatePerMile = &rate
+	}
+	e.Amount = centsToDollars(amountCents)
+	e.IncurredOn = incurredOn.Format("2006-01-02")
+	return e, nil
+}
+
+// handleCreateExpense logs a mileage or toll expense on one of the driver's routes
+func (h *DriverExpenseHandler) handleCreateExpense(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateDriverExpenseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	amountCents, err := expenseAmountCents(req, h.mileageRateCents)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var routeDate time.Time
+	err = h.db.QueryRow(
+		"SELECT route_date FROM driver_routes WHERE id = $1 AND driver_id = $2",
+		req.RouteID, driverID,
+	).Scan(&routeDate)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify route", http.StatusInternalServerError)
+		return
+	}
+
+	var miles *float64
+	var rateCents *int
+	if req.ExpenseType == "mileage" {
+		miles = &req.Miles
+		rateCents = &h.mileageRateCents
+	}
+
+	row := h.db.QueryRow(`
+		INSERT INTO driver_route_expenses
+			(driver_id, route_id, expense_type, miles, rate_cents_per_mile, amount_cents, description, incurred_on)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING `+driverExpenseColumns,
+		driverID, req.RouteID, req.ExpenseType, miles, rateCents, amountCents, req.Description, routeDate,
+	)
+	expense, err := scanDriverExpense(row)
+	if err != nil {
+		http.Error(w, "Failed to log expense", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(expense)
+}
+
+// handleGetExpenses lists the driver's expenses, optionally for one route
+// (?route_id=) or date range (?start=&end=)
+func (h *DriverExpenseHandler) handleGetExpenses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := "SELECT " + driverExpenseColumns + " FROM driver_route_expenses WHERE driver_id = $1"
+	args := []interface{}{driverID}
+	if routeID := r.URL.Query().Get("route_id"); routeID != "" {
+		args = append(args, routeID)
+		query += fmt.Sprintf(" AND route_id = $%d", len(args))
+	}
+	if start := r.URL.Query().Get("start"); start != "" {
+		args = append(args, start)
+		query += fmt.Sprintf(" AND incurred_on >= $%d::date", len(args))
+	}
+	if end := r.URL.Query().Get("end"); end != "" {
+		args = append(args, end)
+		query += fmt.Sprintf(" AND incurred_on <= $%d::date", len(args))
+	}
+	query += " ORDER BY incurred_on DESC, id DESC"
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch expenses", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	expenses := []DriverExpense{}
+	totalCents := 0
+	totalMiles := 0.0
+	for rows.Next() {
+		expense, err := scanDriverExpense(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse expenses", http.StatusInternalServerError)
+			return
+		}
+		totalCents += dollarsToCents(expense.Amount)
+		if expense.Miles != nil {
+			totalMiles += *expense.Miles
+		}
+		expenses = append(expenses, expense)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"expenses": expenses,
+		"total":    centsToDollars(totalCents),
+		"miles":    math.Round(totalMiles*10) / 10,
+	})
+}
+
+// handleDeleteExpense removes one of the driver's expenses and its receipt
+func (h *DriverExpenseHandler) handleDeleteExpense(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	expenseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid expense ID", http.StatusBadRequest)
+		return
+	}
+
+	var receiptPath sql.NullString
+	err = h.db.QueryRow(`
+		DELETE FROM driver_route_expenses
+		WHERE id = $1 AND driver_id = $2
+		RETURNING receipt_path`,
+		expenseID, driverID,
+	).Scan(&receiptPath)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Expense not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete expense", http.StatusInternalServerError)
+		return
+	}
+	if receiptPath.Valid {
+		os.Remove(receiptPath.String)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUploadReceipt attaches a receipt photo to an expense. The photo is
+// sent as the "receipt" field of a multipart form and replaces any existing one.
+func (h *DriverExpenseHandler) handleUploadReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	expenseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid expense ID", http.StatusBadRequest)
+		return
+	}
+
+	var oldPath sql.NullString
+	err = h.db.QueryRow(
+		"SELECT receipt_path FROM driver_route_expenses WHERE id = $1 AND driver_id = $2",
+		expenseID, driverID,
+	).Scan(&oldPath)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Expense not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch expense", http.StatusInternalServerError)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxReceiptUploadBytes)
+	file, _, err := r.FormFile("receipt")
+	if err != nil {
+		http.Error(w, "Receipt file is required (max 10MB)", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Receipt file is too large", http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := allowedReceiptContentTypes[contentType]
+	if !ok {
+		http.Error(w, "Receipt must be a JPEG, PNG, WebP or PDF", http.StatusBadRequest)
+		return
+	}
+
+	dir := filepath.Join(h.uploadDir, strconv.Itoa(driverID))
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		http.Error(w, "Failed to store receipt", http.StatusInternalServerError)
+		return
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d-%s%s", expenseID, generateRandomString(8), ext))
+	if err := os.WriteFile(path, data, 0o640); err != nil {
+		http.Error(w, "Failed to store receipt", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE driver_route_expenses
+		SET receipt_path = $1, receipt_content_type = $2
+		WHERE id = $3`,
+		path, contentType, expenseID,
+	)
+	if err != nil {
+		os.Remove(path)
+		http.Error(w, "Failed to store receipt", http.StatusInternalServerError)
+		return
+	}
+	if oldPath.Valid {
+		os.Remove(oldPath.String)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"expense_id":   expenseID,
+		"content_type": contentType,
+		"size":         len(data),
+	})
+}
+
+// handleGetReceipt serves an expense's receipt photo to the driver who logged it
+func (h *DriverExpenseHandler) handleGetReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	expenseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid expense ID", http.StatusBadRequest)
+		return
+	}
+
+	var path, contentType sql.NullString
+	err = h.db.QueryRow(
+		"SELECT receipt_path, receipt_content_type FROM driver_route_expenses WHERE id = $1 AND driver_id = $2",
+		expenseID, driverID,
+	).Scan(&path, &contentType)
+	if err != nil || !path.Valid {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType.String)
+	http.ServeFile(w, r, path.String)
+}
+
+// handleExportExpenses downloads a year of expenses as CSV for tax filing
+// (?year=, defaults to the current year)
+func (h *DriverExpenseHandler) handleExportExpenses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	year := time.Now().UTC().Year()
+	if yearStr := r.URL.Query().Get("year"); yearStr != "" {
+		year, err = strconv.Atoi(yearStr)
+		if err != nil || year < 2000 || year > 9999 {
+			http.Error(w, "Invalid year", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := h.db.Query(`
+		SELECT e.incurred_on, e.route_id, dr.route_type, e.expense_type, e.miles,
+		       e.rate_cents_per_mile, e.amount_cents, COALESCE(e.description, ''), e.receipt_path IS NOT NULL
+		FROM driver_route_expenses e
+		JOIN driver_routes dr ON e.route_id = dr.id
+		WHERE e.driver_id = $1 AND EXTRACT(YEAR FROM e.incurred_on) = $2
+		ORDER BY e.incurred_on, e.id`,
+		driverID, year,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch expenses", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"tumble-expenses-%d.csv\"", year))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"date", "route_id", "route_type", "expense_type", "miles", "rate_per_mile", "amount", "description", "receipt"})
+
+	var totalCents int
+	var totalMiles float64
+	for rows.Next() {
+		var incurredOn time.Time
+		var routeID, amountCents int
+		var routeType, expenseType, description string
+		var miles sql.NullFloat64
+		var rateCents sql.NullInt64
+		var hasReceipt bool
+		err := rows.Scan(&incurredOn, &routeID, &routeType, &expenseType, &miles,
+			&rateCents, &amountCents, &description, &hasReceipt)
+		if err != nil {
+			continue
+		}
+
+		milesCell, rateCell := "", ""
+		if miles.Valid {
+			milesCell = strconv.FormatFloat(miles.Float64, 'f', 1, 64)
+			totalMiles += miles.Float64
+		}
+		if rateCents.Valid {
+			rateCell = fmt.Sprintf("%.2f", centsToDollars(int(rateCents.Int64)))
+		}
+		receipt := "no"
+		if hasReceipt {
+			receipt = "yes"
+		}
+		totalCents += amountCents
+
+		writer.Write([]string{
+			incurredOn.Format("2006-01-02"), strconv.Itoa(routeID), routeType, expenseType,
+			milesCell, rateCell, fmt.Sprintf("%.2f", centsToDollars(amountCents)), description, receipt,
+		})
+	}
+
+	writer.Write([]string{"total", "", "", "", strconv.FormatFloat(totalMiles, 'f', 1, 64), "",
+		fmt.Sprintf("%.2f", centsToDollars(totalCents)), "", ""})
+	writer.Flush()
+}
+
+// driverExpenseTotals returns the reimbursable total and miles logged by a
+// driver, optionally limited to a single day
+func driverExpenseTotals(db *sql.DB, driverID int, date string) (float64, float64) {
+	query := `
+		SELECT COALESCE(SUM(amount_cents), 0), COALESCE(SUM(miles), 0)
+		FROM driver_route_expenses
+		WHERE driver_id = $1`
+	args := []interface{}{driverID}
+	if date != "" {
+		query += " AND incurred_on = $2"
+		args = append(args, date)
+	}
+
+	var amountCents int
+	var miles float64
+	if err := db.QueryRow(query, args...).Scan(&amountCents, &miles); err != nil {
+		return 0, 0
+	}
+	return centsToDollars(amountCents), miles
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestExpenseAmountCents(t *testing.T) {
+	tests := []struct {
+		name          string
+		req           CreateDriverExpenseRequest
+		expectedCents int
+		wantErr       bool
+	}{
+		{"Mileage at rate", CreateDriverExpenseRequest{ExpenseType: "mileage", Miles: 12.5}, 875, false},
+		{"Toll", CreateDriverExpenseRequest{ExpenseType: "toll", Amount: 6.50}, 650, false},
+		{"Zero miles", CreateDriverExpenseRequest{ExpenseType: "mileage"}, 0, true},
+		{"Negative toll", CreateDriverExpenseRequest{ExpenseType: "toll", Amount: -1}, 0, true},
+		{"Unknown type", CreateDriverExpenseRequest{ExpenseType: "meals", Amount: 10}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cents, err := expenseAmountCents(tt.req, 70)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if cents != tt.expectedCents {
+				t.Errorf("Expected %d cents, got %d", tt.expectedCents, cents)
+			}
+		})
+	}
+}
+
+func TestDriverExpenseHandler_LogUploadAndExport(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "expenses@example.com", "Expense", "Driver")
+	otherDriverID := db.CreateTestUser(t, "other@example.com", "Other", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id IN ($1, $2)", driverID, otherDriverID)
+
+	var routeID int
+	err := db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'completed')
+		RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	if err != nil {
+		t.Fatalf("Failed to create test route: %v", err)
+	}
+
+	handler := NewDriverExpenseHandler(db.DB)
+	handler.uploadDir = t.TempDir()
+	handler.mileageRateCents = 70
+	asDriver := func(id int) {
+		handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+			return id, nil
+		}
+	}
+
+	logExpense := func(req CreateDriverExpenseRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		handler.handleCreateExpense(w, httptest.NewRequest("POST", "/api/v1/driver/expenses", bytes.NewBuffer(body)))
+		return w
+	}
+
+	// Another driver can't log against this route
+	asDriver(otherDriverID)
+	if w := logExpense(CreateDriverExpenseRequest{RouteID: routeID, ExpenseType: "toll", Amount: 5}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for another driver's route, got %d", http.StatusNotFound, w.Code)
+	}
+
+	asDriver(driverID)
+	w := logExpense(CreateDriverExpenseRequest{RouteID: routeID, ExpenseType: "mileage", Miles: 42})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	w = logExpense(CreateDriverExpenseRequest{RouteID: routeID, ExpenseType: "toll", Amount: 6.50})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var toll DriverExpense
+	json.Unmarshal(w.Body.Bytes(), &toll)
+
+	// Upload a receipt photo for the toll
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, _ := writer.CreateFormFile("receipt", "toll.png")
+	part.Write(png)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", fmt.Sprintf("/api/v1/driver/expenses/%d/receipt", toll.ID), &form)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(toll.ID)})
+	w = httptest.NewRecorder()
+	handler.handleUploadReceipt(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/api/v1/driver/expenses/%d/receipt", toll.ID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(toll.ID)})
+	w = httptest.NewRecorder()
+	handler.handleGetReceipt(w, req)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), png) {
+		t.Errorf("Expected stored receipt to be served back, got status %d", w.Code)
+	}
+
+	expenses, miles := driverExpenseTotals(db.DB, driverID, "")
+	if expenses != 35.90 || miles != 42 {
+		t.Errorf("Expected $35.90 over 42 miles, got $%.2f over %.1f miles", expenses, miles)
+	}
+
+	// Tax export
+	req = httptest.NewRequest("GET", fmt.Sprintf("/api/v1/driver/expenses/export?year=%d", time.Now().UTC().Year()), nil)
+	w = httptest.NewRecorder()
+	handler.handleExportExpenses(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+	// Header, two expenses and a totals row
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 CSV rows, got %d", len(records))
+	}
+	if total := records[3][6]; total != "35.90" {
+		t.Errorf("Expected export total 35.90, got %s", total)
+	}
+	if receipt := records[2][8]; receipt != "yes" {
+		t.Errorf("Expected toll row to note its receipt, got %s", receipt)
+	}
+}
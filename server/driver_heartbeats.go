@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// driverHeartbeatInterval is how often the driver app is asked to check in
+const driverHeartbeatInterval = time.Minute
+
+// driverHeartbeatTimeout is how long a driver on an active route can go
+// silent before dispatch is alerted (DRIVER_HEARTBEAT_TIMEOUT_MINUTES)
+func driverHeartbeatTimeout() time.Duration {
+	if minutes, err := strconv.Atoi(os.Getenv("DRIVER_HEARTBEAT_TIMEOUT_MINUTES")); err == nil && minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return 5 * time.Minute
+}
+
+type DriverHeartbeatHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewDriverHeartbeatHandler(db *sql.DB) *DriverHeartbeatHandler {
+	return &DriverHeartbeatHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type DriverHeartbeatRequest struct {
+	RouteID    *int     `json:"route_id,omitempty"`
+	Latitude   *float64 `json:"latitude,omitempty"`
+	Longitude  *float64 `json:"longitude,omitempty"`
+	AppVersion *string  `json:"app_version,omitempty"`
+}
+
+type RouteBoardStop struct {
+	RouteOrderID   int     `json:"route_order_id"`
+	OrderID        int     `json:"order_id"`
+	SequenceNumber int     `json:"sequence_number"`
+	EstimatedTime  *string `json:"estimated_time,omitempty"`
+	Status         string  `json:"status"`
+	AtRisk         bool    `json:"at_risk"`
+}
+
+type RouteBoardEntry struct {
+	RouteID     int              `json:"route_id"`
+	DriverID    int              `json:"driver_id"`
+	DriverName  string           `json:"driver_name"`
+	RouteType   string           `json:"route_type"`
+	Status      string           `json:"status"`
+	LastSeenAt  *time.Time       `json:"last_seen_at,omitempty"`
+	Latitude    *float64         `json:"latitude,omitempty"`
+	Longitude   *float64         `json:"longitude,omitempty"`
+	StaleSince  *time.Time       `json:"stale_since,omitempty"`
+	Stops       []RouteBoardStop `json:"stops"`
+	AtRiskStops int              `json:"at_risk_stops"`
+}
+
+// recordDriverHeartbeat notes that the driver's app is alive and clears the
+// stale flag on any route they're driving
+func recordDriverHeartbeat(q execer, driverID int, req DriverHeartbeatRequest) error {
+	_, err := q.Exec(`
+		INSERT INTO driver_heartbeats (driver_id, route_id, latitude, longitude, app_version, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
+		ON CONFLICT (driver_id) DO UPDATE SET
+			route_id = COALESCE(EXCLUDED.route_id, driver_heartbeats.route_id),
+			latitude = COALESCE(EXCLUDED.latitude, driver_heartbeats.latitude),
+			longitude = COALESCE(EXCLUDED.longitude, driver_heartbeats.longitude),
+			app_version = COALESCE(EXCLUDED.app_version, driver_heartbeats.app_version),
+			last_seen_at = CURRENT_TIMESTAMP`,
+		driverID, req.RouteID, req.Latitude, req.Longitude, req.AppVersion,
+	)
+	if err != nil {
+		return err
+	}
+
+	// A driver coming back closes out the alert raised when they went silent
+	_, err = q.Exec(`
+		UPDATE admin_inbox_items
+		SET status = 'resolved', resolved_at = CURRENT_TIMESTAMP, resolution_note = 'Driver app reconnected'
+		WHERE status <> 'resolved' AND dedupe_key IN (
+			SELECT 'driver_silent:' || id FROM driver_routes
+			WHERE driver_id = $1 AND stale_since IS NOT NULL
+		)`,
+		driverID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`
+		UPDATE driver_routes SET stale_since = NULL
+		WHERE driver_id = $1 AND stale_since IS NOT NULL`,
+		driverID,
+	)
+	return err
+}
+
+// processStaleDriverSessions flags in-progress routes whose driver's app has
+// stopped checking in and alerts dispatch
+func (s *AutoScheduler) processStaleDriverSessions() {
+	timeout := driverHeartbeatTimeout()
+
+	rows, err := s.db.Query(`
+		UPDATE driver_routes dr
+		SET stale_since = CURRENT_TIMESTAMP
+		FROM driver_heartbeats hb, users u
+		WHERE hb.driver_id = dr.driver_id
+		  AND u.id = dr.driver_id
+		  AND dr.status = 'in_progress'
+		  AND dr.stale_since IS NULL
+		  AND hb.last_seen_at < $1
+		RETURNING dr.id, dr.driver_id, u.first_name || ' ' || u.last_name, hb.last_seen_at,
+			(SELECT COUNT(*) FROM route_orders ro WHERE ro.route_id = dr.id AND ro.status = 'pending')`,
+		time.Now().Add(-timeout),
+	)
+	if err != nil {
+		log.Printf("Error checking for stale driver sessions: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var routeID, driverID, pendingStops int
+		var driverName string
+		var lastSeen time.Time
+		if err := rows.Scan(&routeID, &driverID, &driverName, &lastSeen, &pendingStops); err != nil {
+			continue
+		}
+		log.Printf("Driver %d went silent on route %d", driverID, routeID)
+		logAdminAlert(s.db, AdminAlert{
+			Type:     "driver_silent",
+			Severity: "critical",
+			Title:    fmt.Sprintf("Lost contact with %s", driverName),
+			Message: fmt.Sprintf("No heartbeat from the driver app since %s; %d stops on route %d are at risk",
+				lastSeen.Format(time.Kitchen), pendingStops, routeID),
+			DedupeKey: fmt.Sprintf("driver_silent:%d", routeID),
+			Data:      map[string]int{"route_id": routeID, "driver_id": driverID, "pending_stops": pendingStops},
+		})
+	}
+}
+
+// handleHeartbeat records a check-in from the driver app
+func (h *DriverHeartbeatHandler) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// The app may send an empty ping
+	var req DriverHeartbeatRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.RouteID != nil {
+		var routeDriverID int
+		err := h.db.QueryRow("SELECT driver_id FROM driver_routes WHERE id = $1", *req.RouteID).Scan(&routeDriverID)
+		if err != nil || routeDriverID != driverID {
+			http.Error(w, "Route not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := recordDriverHeartbeat(tx, driverID, req); err != nil {
+		http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_time":            time.Now().UTC(),
+		"next_heartbeat_seconds": int(driverHeartbeatInterval.Seconds()),
+	})
+}
+
+// handleGetRouteBoard shows dispatch every route for ?date= (default today)
+// with driver liveness and which stops are at risk
+func (h *DriverHeartbeatHandler) handleGetRouteBoard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = time.Now().Format("2006-01-02")
+	} else if _, err := time.Parse("2006-01-02", date); err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT dr.id, dr.driver_id, u.first_name || ' ' || u.last_name, dr.route_type, dr.status,
+		       hb.last_seen_at, hb.latitude, hb.longitude, dr.stale_since
+		FROM driver_routes dr
+		JOIN users u ON dr.driver_id = u.id
+		LEFT JOIN driver_heartbeats hb ON hb.driver_id = dr.driver_id
+		WHERE dr.route_date = $1
+		ORDER BY dr.stale_since IS NULL, dr.id`,
+		date,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch routes", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	board := []RouteBoardEntry{}
+	index := map[int]int{}
+	for rows.Next() {
+		var entry RouteBoardEntry
+		if err := rows.Scan(&entry.RouteID, &entry.DriverID, &entry.DriverName, &entry.RouteType, &entry.Status,
+			&entry.LastSeenAt, &entry.Latitude, &entry.Longitude, &entry.StaleSince); err != nil {
+			http.Error(w, "Failed to fetch routes", http.StatusInternalServerError)
+			return
+		}
+		entry.Stops = []RouteBoardStop{}
+		index[entry.RouteID] = len(board)
+		board = append(board, entry)
+	}
+
+	stops, err := h.db.Query(`
+		SELECT ro.route_id, ro.id, ro.order_id, ro.sequence_number, ro.estimated_time::text, ro.status
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		WHERE dr.route_date = $1
+		ORDER BY ro.route_id, ro.sequence_number`,
+		date,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch route stops", http.StatusInternalServerError)
+		return
+	}
+	defer stops.Close()
+
+	for stops.Next() {
+		var routeID int
+		var stop RouteBoardStop
+		if err := stops.Scan(&routeID, &stop.RouteOrderID, &stop.OrderID, &stop.SequenceNumber, &stop.EstimatedTime, &stop.Status); err != nil {
+			http.Error(w, "Failed to fetch route stops", http.StatusInternalServerError)
+			return
+		}
+		i, ok := index[routeID]
+		if !ok {
+			continue
+		}
+		stop.AtRisk = board[i].StaleSince != nil && stop.Status == "pending"
+		if stop.AtRisk {
+			board[i].AtRiskStops++
+		}
+		board[i].Stops = append(board[i].Stops, stop)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(board)
+}
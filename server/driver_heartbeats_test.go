@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDriverHeartbeat_StaleSessionAndRecovery(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "heartbeat@example.com", "Silent", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "heartbeat-customer@example.com", "Route", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	var routeID int
+	err := db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'in_progress') RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	if err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1)", routeID, orderID)
+
+	// Last heard from well past the timeout
+	db.Exec(`
+		INSERT INTO driver_heartbeats (driver_id, route_id, last_seen_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP - INTERVAL '1 hour')`,
+		driverID, routeID,
+	)
+
+	scheduler := &AutoScheduler{db: db.DB}
+	scheduler.processStaleDriverSessions()
+	// A second run must not raise a duplicate alert
+	scheduler.processStaleDriverSessions()
+
+	var alerts int
+	db.QueryRow("SELECT COUNT(*) FROM admin_inbox_items WHERE alert_type = 'driver_silent' AND status = 'open'").Scan(&alerts)
+	if alerts != 1 {
+		t.Fatalf("Expected 1 open driver_silent alert, got %d", alerts)
+	}
+
+	handler := NewDriverHeartbeatHandler(db.DB)
+	req := httptest.NewRequest("GET", "/api/v1/admin/routes/board", nil)
+	w := httptest.NewRecorder()
+	handler.handleGetRouteBoard(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var board []RouteBoardEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &board); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(board) != 1 || board[0].StaleSince == nil || board[0].AtRiskStops != 1 || !board[0].Stops[0].AtRisk {
+		t.Fatalf("Expected stale route with 1 at-risk stop, got %+v", board)
+	}
+
+	// The driver app checking back in clears the flag and the alert
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return driverID, nil
+	}
+	body, _ := json.Marshal(DriverHeartbeatRequest{RouteID: &routeID})
+	req = httptest.NewRequest("POST", "/api/v1/driver/heartbeat", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	handler.handleHeartbeat(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var staleSince sql.NullTime
+	db.QueryRow("SELECT stale_since FROM driver_routes WHERE id = $1", routeID).Scan(&staleSince)
+	if staleSince.Valid {
+		t.Error("Expected heartbeat to clear the stale flag")
+	}
+	db.QueryRow("SELECT COUNT(*) FROM admin_inbox_items WHERE alert_type = 'driver_silent' AND status = 'resolved'").Scan(&alerts)
+	if alerts != 1 {
+		t.Errorf("Expected driver_silent alert to be resolved, got %d resolved", alerts)
+	}
+}
+
+func TestDriverHeartbeat_RejectsOtherDriversRoute(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "heartbeat-a@example.com", "Driver", "A")
+	otherDriverID := db.CreateTestUser(t, "heartbeat-b@example.com", "Driver", "B")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id IN ($1, $2)", driverID, otherDriverID)
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'delivery', 'in_progress') RETURNING id`,
+		otherDriverID,
+	).Scan(&routeID)
+
+	handler := NewDriverHeartbeatHandler(db.DB)
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return driverID, nil
+	}
+	body, _ := json.Marshal(DriverHeartbeatRequest{RouteID: &routeID})
+	req := httptest.NewRequest("POST", "/api/v1/driver/heartbeat", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	handler.handleHeartbeat(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// driverLocationInterval is how often the driver app is asked to send a fix
+// while on a route
+const driverLocationInterval = 10 * time.Second
+
+// driverLocationTTL is how long a position is shown before it's treated as
+// gone (DRIVER_LOCATION_TTL_SECONDS)
+func driverLocationTTL() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("DRIVER_LOCATION_TTL_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 2 * time.Minute
+}
+
+// DriverLocation is the latest GPS fix from a driver on a route
+type DriverLocation struct {
+	DriverID       int       `json:"driver_id"`
+	DriverName     string    `json:"driver_name,omitempty"`
+	RouteID        int       `json:"route_id"`
+	Latitude       float64   `json:"latitude"`
+	Longitude      float64   `json:"longitude"`
+	Heading        *float64  `json:"heading,omitempty"`
+	SpeedMPS       *float64  `json:"speed_mps,omitempty"`
+	AccuracyMeters *float64  `json:"accuracy_m,omitempty"`
+	RecordedAt     time.Time `json:"recorded_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// DriverLocationStore keeps only each driver's latest position, and only
+// until it expires
+type DriverLocationStore interface {
+	Put(ctx context.Context, location DriverLocation) error
+	// Get returns a driver's position, or nil once it has expired
+	Get(ctx context.Context, driverID int) (*DriverLocation, error)
+	// List returns every unexpired position
+	List(ctx context.Context) ([]DriverLocation, error)
+}
+
+// RedisDriverLocationStore keeps a key per driver that expires with the
+// position, plus a sorted set of drivers scored by expiry so admins can list
+// them without scanning keys
+type RedisDriverLocationStore struct {
+	client *redis.Client
+}
+
+func NewRedisDriverLocationStore(client *redis.Client) *RedisDriverLocationStore {
+	return &RedisDriverLocationStore{client: client}
+}
+
+const activeDriverLocationsKey = "driver_locations"
+
+func driverLocationKey(driverID int) string {
+	return fmt.Sprintf("driver_location:%d", driverID)
+}
+
+func (s *RedisDriverLocationStore) Put(ctx context.Context, location DriverLocation) error {
+	payload, err := json.Marshal(location)
+	if err != nil {
+		return err
+	}
+
+	pipe := s.client.TxPipeline()
+	pipe.Set(ctx, driverLocationKey(location.DriverID), payload, time.Until(location.ExpiresAt))
+	pipe.ZAdd(ctx, activeDriverLocationsKey, redis.Z{
+		Score:  float64(location.ExpiresAt.UnixMilli()),
+		Member: location.DriverID,
+	})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisDriverLocationStore) Get(ctx context.Context, driverID int) (*DriverLocation, error) {
+	payload, err := s.client.Get(ctx, driverLocationKey(driverID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var location DriverLocation
+	if err := json.Unmarshal(payload, &location); err != nil {
+		return nil, err
+	}
+	return &location, nil
+}
+
+func (s *RedisDriverLocationStore) List(ctx context.Context) ([]DriverLocation, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err := s.client.ZRemRangeByScore(ctx, activeDriverLocationsKey, "-inf", now).Err(); err != nil {
+		return nil, err
+	}
+	driverIDs, err := s.client.ZRange(ctx, activeDriverLocationsKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	locations := []DriverLocation{}
+	if len(driverIDs) == 0 {
+		return locations, nil
+	}
+	keys := make([]string, len(driverIDs))
+	for i, id := range driverIDs {
+		keys[i] = "driver_location:" + id
+	}
+	payloads, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, payload := range payloads {
+		data, ok := payload.(string)
+		if !ok {
+			continue // Expired between the two reads
+		}
+		var location DriverLocation
+		if err := json.Unmarshal([]byte(data), &location); err == nil {
+			locations = append(locations, location)
+		}
+	}
+	return locations, nil
+}
+
+// FallbackDriverLocationStore reads and writes Redis, falling through to the
+// driver's heartbeat row in Postgres when Redis errors or has nothing. The
+// heartbeat only keeps the coordinates, so heading and speed are lost while
+// Redis is down.
+type FallbackDriverLocationStore struct {
+	primary     DriverLocationStore
+	db          *sql.DB
+	degradation *RedisDegradation
+}
+
+func NewFallbackDriverLocationStore(primary DriverLocationStore, db *sql.DB, degradation *RedisDegradation) *FallbackDriverLocationStore {
+	return &FallbackDriverLocationStore{primary: primary, db: db, degradation: degradation}
+}
+
+func (s *FallbackDriverLocationStore) Put(ctx context.Context, location DriverLocation) error {
+	if err := s.primary.Put(ctx, location); err != nil {
+		s.degradation.Fail(degradedDriverLocations, err)
+		return recordDriverHeartbeat(s.db, location.DriverID, DriverHeartbeatRequest{
+			RouteID:   &location.RouteID,
+			Latitude:  &location.Latitude,
+			Longitude: &location.Longitude,
+		})
+	}
+	s.degradation.Recover(degradedDriverLocations)
+	return nil
+}
+
+func (s *FallbackDriverLocationStore) Get(ctx context.Context, driverID int) (*DriverLocation, error) {
+	location, err := s.primary.Get(ctx, driverID)
+	if err != nil {
+		s.degradation.Fail(degradedDriverLocations, err)
+	} else if location != nil {
+		s.degradation.Recover(degradedDriverLocations)
+		return location, nil
+	}
+	locations, err := heartbeatDriverLocations(s.db, &driverID)
+	if err != nil || len(locations) == 0 {
+		return nil, err
+	}
+	return &locations[0], nil
+}
+
+func (s *FallbackDriverLocationStore) List(ctx context.Context) ([]DriverLocation, error) {
+	locations, err := s.primary.List(ctx)
+	if err == nil {
+		s.degradation.Recover(degradedDriverLocations)
+		return locations, nil
+	}
+	s.degradation.Fail(degradedDriverLocations, err)
+	return heartbeatDriverLocations(s.db, nil)
+}
+
+// heartbeatDriverLocations returns the last heartbeat position of drivers on
+// a route in progress, for one driver or all of them, if it's recent enough
+// to still be shown
+func heartbeatDriverLocations(db *sql.DB, driverID *int) ([]DriverLocation, error) {
+	ttl := driverLocationTTL()
+	rows, err := db.Query(`
+		SELECT hb.driver_id, hb.route_id, hb.latitude, hb.longitude, hb.last_seen_at
+		FROM driver_heartbeats hb
+		JOIN driver_routes dr ON dr.id = hb.route_id AND dr.status = 'in_progress'
+		WHERE hb.latitude IS NOT NULL AND hb.longitude IS NOT NULL
+		  AND hb.last_seen_at > $1
+		  AND ($2::int IS NULL OR hb.driver_id = $2)
+		ORDER BY hb.driver_id`,
+		time.Now().Add(-ttl), driverID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := []DriverLocation{}
+	for rows.Next() {
+		var location DriverLocation
+		err := rows.Scan(&location.DriverID, &location.RouteID, &location.Latitude, &location.Longitude, &location.RecordedAt)
+		if err != nil {
+			return nil, err
+		}
+		location.ExpiresAt = location.RecordedAt.Add(ttl)
+		locations = append(locations, location)
+	}
+	return locations, rows.Err()
+}
+
+// DriverLocationPublisher pushes a driver's position to a customer's order channel
+type DriverLocationPublisher interface {
+	SendDriverLocationUpdate(userID, orderID int, lat, lng float64, estimatedArrival string) error
+}
+
+type DriverLocationHandler struct {
+	db        *sql.DB
+	locations DriverLocationStore
+	realtime  DriverLocationPublisher
+	// push tells the next stop's customer the driver is arriving; nil skips it
+	push      *PushDispatcher
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewDriverLocationHandler(db *sql.DB, locations DriverLocationStore, realtime DriverLocationPublisher) *DriverLocationHandler {
+	return &DriverLocationHandler{
+		db:        db,
+		locations: locations,
+		realtime:  realtime,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type DriverLocationRequest struct {
+	Latitude       *float64 `json:"latitude"`
+	Longitude      *float64 `json:"longitude"`
+	Heading        *float64 `json:"heading,omitempty"`
+	SpeedMPS       *float64 `json:"speed_mps,omitempty"`
+	AccuracyMeters *float64 `json:"accuracy_m,omitempty"`
+}
+
+// handleUpdateLocation takes a GPS fix from the driver app and shows it to
+// every customer whose stop on the driver's current route is still to come
+func (h *DriverLocationHandler) handleUpdateLocation(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req DriverLocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Latitude == nil || req.Longitude == nil ||
+		*req.Latitude < -90 || *req.Latitude > 90 || *req.Longitude < -180 || *req.Longitude > 180 {
+		http.Error(w, "A valid latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+
+	// Drivers are only tracked while they're out on a route
+	var routeID int
+	err = h.db.QueryRow(`
+		SELECT id FROM driver_routes
+		WHERE driver_id = $1 AND status = 'in_progress'
+		ORDER BY route_date DESC, id DESC
+		LIMIT 1`,
+		driverID,
+	).Scan(&routeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No route in progress", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch route", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	location := DriverLocation{
+		DriverID:       driverID,
+		RouteID:        routeID,
+		Latitude:       *req.Latitude,
+		Longitude:      *req.Longitude,
+		Heading:        req.Heading,
+		SpeedMPS:       req.SpeedMPS,
+		AccuracyMeters: req.AccuracyMeters,
+		RecordedAt:     now,
+		ExpiresAt:      now.Add(driverLocationTTL()),
+	}
+	if err := h.locations.Put(r.Context(), location); err != nil {
+		http.Error(w, "Failed to store location", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT o.user_id, o.id, COALESCE(TO_CHAR(ro.estimated_time, 'HH24:MI'), '')
+		FROM route_orders ro
+		JOIN orders o ON ro.order_id = o.id
+		WHERE ro.route_id = $1 AND ro.status = 'pending'
+		ORDER BY ro.sequence_number`,
+		routeID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch route stops", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	notified := 0
+	for rows.Next() {
+		var userID, orderID int
+		var eta string
+		if err := rows.Scan(&userID, &orderID, &eta); err != nil {
+			continue
+		}
+		if h.realtime == nil {
+			continue
+		}
+		if err := h.realtime.SendDriverLocationUpdate(userID, orderID, location.Latitude, location.Longitude, eta); err != nil {
+			log.Printf("Failed to publish driver location for order %d: %v", orderID, err)
+			continue
+		}
+		notified++
+	}
+	rows.Close()
+
+	if err := h.notifyArrival(routeID, location); err != nil {
+		log.Printf("Failed to check driver arrival on route %d: %v", routeID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"route_id":            routeID,
+		"notified_orders":     notified,
+		"expires_at":          location.ExpiresAt,
+		"next_update_seconds": int(driverLocationInterval.Seconds()),
+	})
+}
+
+// notifyArrival pushes to the customer at the route's next stop once the
+// driver is within driverArrivalRadiusKm of it. Each stop is told once.
+func (h *DriverLocationHandler) notifyArrival(routeID int, location DriverLocation) error {
+	if h.push == nil {
+		return nil
+	}
+
+	var routeOrderID, userID, orderID int
+	var routeType string
+	var stop LatLng
+	err := h.db.QueryRow(`
+		SELECT ro.id, o.user_id, o.id, dr.route_type, a.latitude, a.longitude
+		FROM route_orders ro
+		JOIN driver_routes dr ON dr.id = ro.route_id
+		JOIN orders o ON o.id = ro.order_id
+		JOIN addresses a ON a.id = CASE WHEN dr.route_type = 'pickup' THEN o.pickup_address_id ELSE o.delivery_address_id END
+		WHERE ro.route_id = $1 AND ro.status = 'pending'
+		  AND ro.arrival_notified_at IS NULL AND a.latitude IS NOT NULL
+		ORDER BY ro.sequence_number
+		LIMIT 1`,
+		routeID,
+	).Scan(&routeOrderID, &userID, &orderID, &routeType, &stop.Latitude, &stop.Longitude)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if haversineKm(LatLng{Latitude: location.Latitude, Longitude: location.Longitude}, stop) > driverArrivalRadiusKm {
+		return nil
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE route_orders SET arrival_notified_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND arrival_notified_at IS NULL`,
+		routeOrderID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	body := "Your driver is almost there to collect your laundry"
+	if routeType != "pickup" {
+		body = "Your driver is almost there with your clean laundry"
+	}
+	err = h.push.Queue(tx, PushNotification{
+		UserID:   userID,
+		Category: pushDriverArrival,
+		OrderID:  &orderID,
+		Title:    "Your driver is arriving",
+		Body:     body,
+		Data:     map[string]string{"type": "driver_arrival", "order_id": fmt.Sprint(orderID)},
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// handleGetActiveDriverLocations shows dispatch every driver with a live position
+func (h *DriverLocationHandler) handleGetActiveDriverLocations(w http.ResponseWriter, r *http.Request) {
+	locations, err := h.locations.List(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to fetch driver locations", http.StatusInternalServerError)
+		return
+	}
+
+	if len(locations) > 0 {
+		driverIDs := make([]int, len(locations))
+		for i, location := range locations {
+			driverIDs[i] = location.DriverID
+		}
+		rows, err := h.db.Query(
+			"SELECT id, first_name || ' ' || last_name FROM users WHERE id = ANY($1)",
+			pq.Array(driverIDs),
+		)
+		if err != nil {
+			http.Error(w, "Failed to fetch drivers", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		names := map[int]string{}
+		for rows.Next() {
+			var id int
+			var name string
+			if err := rows.Scan(&id, &name); err == nil {
+				names[id] = name
+			}
+		}
+		for i := range locations {
+			locations[i].DriverName = names[locations[i].DriverID]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"drivers": locations,
+		"count":   len(locations),
+	})
+}
+
+// driverLocationForOrder returns where the driver heading to an order is,
+// or nil when the order isn't an upcoming stop on a route being driven
+func driverLocationForOrder(ctx context.Context, q queryRower, locations DriverLocationStore, orderID int) (*DriverLocation, error) {
+	if locations == nil {
+		return nil, nil
+	}
+
+	var driverID int
+	err := q.QueryRow(`
+		SELECT dr.driver_id
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		WHERE ro.order_id = $1 AND ro.status = 'pending' AND dr.status = 'in_progress'
+		LIMIT 1`,
+		orderID,
+	).Scan(&driverID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return locations.Get(ctx, driverID)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// memoryDriverLocationStore stands in for Redis in tests
+type memoryDriverLocationStore struct {
+	mu        sync.Mutex
+	locations map[int]DriverLocation
+	failing   bool
+}
+
+func newMemoryDriverLocationStore() *memoryDriverLocationStore {
+	return &memoryDriverLocationStore{locations: map[int]DriverLocation{}}
+}
+
+func (s *memoryDriverLocationStore) Put(ctx context.Context, location DriverLocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return errors.New("redis unavailable")
+	}
+	s.locations[location.DriverID] = location
+	return nil
+}
+
+func (s *memoryDriverLocationStore) Get(ctx context.Context, driverID int) (*DriverLocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return nil, errors.New("redis unavailable")
+	}
+	location, ok := s.locations[driverID]
+	if !ok || !location.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &location, nil
+}
+
+func (s *memoryDriverLocationStore) List(ctx context.Context) ([]DriverLocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return nil, errors.New("redis unavailable")
+	}
+	locations := []DriverLocation{}
+	for _, location := range s.locations {
+		if location.ExpiresAt.After(time.Now()) {
+			locations = append(locations, location)
+		}
+	}
+	return locations, nil
+}
+
+// recordingLocationPublisher remembers which orders were sent a position
+type recordingLocationPublisher struct {
+	orderIDs []int
+}
+
+func (p *recordingLocationPublisher) SendDriverLocationUpdate(userID, orderID int, lat, lng float64, estimatedArrival string) error {
+	p.orderIDs = append(p.orderIDs, orderID)
+	return nil
+}
+
+func TestDriverLocations(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "gps-driver@example.com", "Gps", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "gps-customer@example.com", "Gps", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	doneOrderID := db.CreateTestOrder(t, customerID, addressID)
+	nextOrderID := db.CreateTestOrder(t, customerID, addressID)
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'planned') RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number, status) VALUES ($1, $2, 1, 'completed')", routeID, doneOrderID)
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 2)", routeID, nextOrderID)
+
+	store := newMemoryDriverLocationStore()
+	publisher := &recordingLocationPublisher{}
+	handler := NewDriverLocationHandler(db.DB, store, publisher)
+	handler.getUserID = CreateAuthMock(driverID).getUserIDFromRequest
+	postLocation := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.handleUpdateLocation(w, httptest.NewRequest("POST", "/api/v1/driver/location", strings.NewReader(body)))
+		return w
+	}
+
+	if w := postLocation(`{"latitude": 40.71, "longitude": -74.0}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d before the route starts, got %d", http.StatusConflict, w.Code)
+	}
+	db.Exec("UPDATE driver_routes SET status = 'in_progress' WHERE id = $1", routeID)
+
+	if w := postLocation(`{"latitude": 140.71, "longitude": -74.0}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an impossible latitude, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w := postLocation(`{"latitude": 40.71, "longitude": -74.0, "heading": 90}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	// Only the customer still waiting on the driver sees them move
+	if len(publisher.orderIDs) != 1 || publisher.orderIDs[0] != nextOrderID {
+		t.Errorf("Expected a location update for order %d only, got %v", nextOrderID, publisher.orderIDs)
+	}
+
+	orders := &OrderHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest, driverLocations: store}
+	trackingFor := func(orderID int) map[string]interface{} {
+		req := httptest.NewRequest("GET", "/api/v1/orders/"+strconv.Itoa(orderID)+"/tracking", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(orderID)})
+		w := httptest.NewRecorder()
+		orders.handleGetOrderTracking(w, req)
+		var tracking map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &tracking)
+		return tracking
+	}
+	if location, ok := trackingFor(nextOrderID)["driverLocation"].(map[string]interface{}); !ok || location["latitude"] != 40.71 {
+		t.Errorf("Expected the driver's position on the upcoming order, got %v", location)
+	}
+	if _, ok := trackingFor(doneOrderID)["driverLocation"]; ok {
+		t.Error("Expected no driver position once the stop is done")
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleGetActiveDriverLocations(w, httptest.NewRequest("GET", "/api/v1/admin/drivers/locations", nil))
+	var active struct {
+		Drivers []DriverLocation `json:"drivers"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &active)
+	if len(active.Drivers) != 1 || active.Drivers[0].DriverName != "Gps Driver" || active.Drivers[0].RouteID != routeID {
+		t.Errorf("Unexpected active drivers %s", w.Body.String())
+	}
+}
+
+func TestFallbackDriverLocationStore(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "fallback-driver@example.com", "Fallback", "Driver")
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'in_progress') RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+
+	redis := newMemoryDriverLocationStore()
+	degradation := NewRedisDegradation()
+	store := NewFallbackDriverLocationStore(redis, db.DB, degradation)
+	ctx := context.Background()
+	now := time.Now().UTC()
+	location := DriverLocation{DriverID: driverID, RouteID: routeID, Latitude: 40.71, Longitude: -74.0, RecordedAt: now, ExpiresAt: now.Add(time.Minute)}
+
+	// With Redis down the position lands on the heartbeat row instead
+	redis.failing = true
+	if err := store.Put(ctx, location); err != nil {
+		t.Fatalf("Expected the position stored in Postgres, got %v", err)
+	}
+	got, err := store.Get(ctx, driverID)
+	if err != nil || got == nil || got.Latitude != 40.71 || got.RouteID != routeID {
+		t.Fatalf("Expected the heartbeat position, got %+v, %v", got, err)
+	}
+	if locations, err := store.List(ctx); err != nil || len(locations) != 1 {
+		t.Errorf("Expected one active driver from Postgres, got %+v, %v", locations, err)
+	}
+	if degraded := degradation.Degraded(); len(degraded) != 1 || degraded[0].Feature != degradedDriverLocations {
+		t.Errorf("Expected driver locations reported degraded, got %+v", degraded)
+	}
+
+	// Once Redis is back a miss still falls through to Postgres
+	redis.failing = false
+	if got, _ := store.Get(ctx, driverID); got == nil || got.Longitude != -74.0 {
+		t.Errorf("Expected a Redis miss to fall through, got %+v", got)
+	}
+	location.Latitude = 40.72
+	store.Put(ctx, location)
+	if got, _ := store.Get(ctx, driverID); got == nil || got.Latitude != 40.72 || len(degradation.Degraded()) != 0 {
+		t.Errorf("Expected Redis to serve the position again, got %+v with %+v degraded", got, degradation.Degraded())
+	}
+
+	// Positions from a finished route aren't shown
+	db.Exec("UPDATE driver_routes SET status = 'completed' WHERE id = $1", routeID)
+	redis.failing = true
+	if got, err := store.Get(ctx, driverID); got != nil || err != nil {
+		t.Errorf("Expected no position off route, got %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// DriverOnboardingHandler tracks the checklist approved drivers complete
+// before they can be assigned routes
+type DriverOnboardingHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewDriverOnboardingHandler(db *sql.DB) *DriverOnboardingHandler {
+	return &DriverOnboardingHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type OnboardingStep struct {
+	Step        string     `json:"step"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Owner       string     `json:"owner"` // driver or admin
+	Completed   bool       `json:"completed"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	CompletedBy *int       `json:"completed_by,omitempty"`
+	Notes       *string    `json:"notes,omitempty"`
+}
+
+type DriverOnboarding struct {
+	DriverID       int              `json:"driver_id"`
+	DriverName     string           `json:"driver_name"`
+	Email          string           `json:"email"`
+	ApprovedAt     *time.Time       `json:"approved_at,omitempty"`
+	Steps          []OnboardingStep `json:"steps"`
+	CompletedSteps int              `json:"completed_steps"`
+	TotalSteps     int              `json:"total_steps"`
+	IsComplete     bool             `json:"is_complete"`
+}
+
+type CompleteOnboardingStepRequest struct {
+	Notes *string `json:"notes"`
+}
+
+// pendingOnboardingSteps lists the checklist steps a driver hasn't finished
+func pendingOnboardingSteps(q queryRower, driverID int) ([]string, error) {
+	var pending []string
+	err := q.QueryRow(`
+		SELECT COALESCE(array_agg(s.step ORDER BY s.sort_order), '{}')
+		FROM driver_onboarding_steps s
+		LEFT JOIN driver_onboarding_progress p ON p.step = s.step AND p.driver_id = $1
+		WHERE p.id IS NULL`,
+		driverID,
+	).Scan(pq.Array(&pending))
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// getDriverOnboardings loads checklists for every driver, or just one
+func (h *DriverOnboardingHandler) getDriverOnboardings(driverID int) ([]DriverOnboarding, error) {
+	rows, err := h.db.Query(`
+		SELECT u.id, u.first_name || ' ' || u.last_name, u.email,
+		       (SELECT MAX(reviewed_at) FROM driver_applications
+		        WHERE user_id = u.id AND status = 'approved'),
+		       s.step, s.title, s.description, s.owner,
+		       p.completed_at, p.completed_by, p.notes
+		FROM users u
+		CROSS JOIN driver_onboarding_steps s
+		LEFT JOIN driver_onboarding_progress p ON p.driver_id = u.id AND p.step = s.step
+		WHERE u.role = 'driver' AND ($1 = 0 OR u.id = $1)
+		ORDER BY u.id, s.sort_order`,
+		driverID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	onboardings := []DriverOnboarding{}
+	for rows.Next() {
+		var id int
+		var name, email string
+		var approvedAt, completedAt sql.NullTime
+		var completedBy sql.NullInt64
+		var notes sql.NullString
+		var step OnboardingStep
+		if err := rows.Scan(&id, &name, &email, &approvedAt, &step.Step, &step.Title, &step.Description,
+			&step.Owner, &completedAt, &completedBy, &notes); err != nil {
+			return nil, err
+		}
+
+		if len(onboardings) == 0 || onboardings[len(onboardings)-1].DriverID != id {
+			onboarding := DriverOnboarding{DriverID: id, DriverName: name, Email: email, Steps: []OnboardingStep{}}
+			if approvedAt.Valid {
+				onboarding.ApprovedAt = &approvedAt.Time
+			}
+			onboardings = append(onboardings, onboarding)
+		}
+		onboarding := &onboardings[len(onboardings)-1]
+
+		if completedAt.Valid {
+			step.Completed = true
+			step.CompletedAt = &completedAt.Time
+			onboarding.CompletedSteps++
+		}
+		if completedBy.Valid {
+			by := int(completedBy.Int64)
+			step.CompletedBy = &by
+		}
+		if notes.Valid {
+			step.Notes = &notes.String
+		}
+		onboarding.Steps = append(onboarding.Steps, step)
+		onboarding.TotalSteps++
+		onboarding.IsComplete = onboarding.CompletedSteps == onboarding.TotalSteps
+	}
+	return onboardings, rows.Err()
+}
+
+// completeStep marks a step done. asAdmin lets admins complete any step;
+// drivers can only tick off the steps they own.
+func (h *DriverOnboardingHandler) completeStep(w http.ResponseWriter, r *http.Request, driverID, actorID int, asAdmin bool) {
+	var req CompleteOnboardingStepRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	step := mux.Vars(r)["step"]
+	var owner string
+	err := h.db.QueryRow("SELECT owner FROM driver_onboarding_steps WHERE step = $1", step).Scan(&owner)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Onboarding step not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch onboarding step", http.StatusInternalServerError)
+		return
+	}
+	if !asAdmin && owner != "driver" {
+		http.Error(w, "This step is completed by an admin", http.StatusForbidden)
+		return
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO driver_onboarding_progress (driver_id, step, completed_by, notes)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (driver_id, step) DO NOTHING`,
+		driverID, step, actorID, req.Notes,
+	)
+	if err != nil {
+		http.Error(w, "Failed to complete onboarding step", http.StatusInternalServerError)
+		return
+	}
+
+	h.respondWithOnboarding(w, driverID)
+}
+
+func (h *DriverOnboardingHandler) respondWithOnboarding(w http.ResponseWriter, driverID int) {
+	onboardings, err := h.getDriverOnboardings(driverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch onboarding", http.StatusInternalServerError)
+		return
+	}
+	if len(onboardings) == 0 {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(onboardings[0])
+}
+
+// handleGetMyOnboarding returns the signed-in driver's checklist
+func (h *DriverOnboardingHandler) handleGetMyOnboarding(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.respondWithOnboarding(w, driverID)
+}
+
+// handleCompleteMyOnboardingStep lets a driver complete one of their own
+// steps, such as acknowledging the training video
+func (h *DriverOnboardingHandler) handleCompleteMyOnboardingStep(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.completeStep(w, r, driverID, driverID, false)
+}
+
+// handleGetOnboardingDashboard lists every driver's onboarding progress.
+// ?status=incomplete narrows it to drivers who can't be assigned yet.
+func (h *DriverOnboardingHandler) handleGetOnboardingDashboard(w http.ResponseWriter, r *http.Request) {
+	onboardings, err := h.getDriverOnboardings(0)
+	if err != nil {
+		http.Error(w, "Failed to fetch onboarding", http.StatusInternalServerError)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "complete" && status != "incomplete" {
+		http.Error(w, "status must be complete or incomplete", http.StatusBadRequest)
+		return
+	}
+	filtered := []DriverOnboarding{}
+	complete := 0
+	for _, onboarding := range onboardings {
+		if onboarding.IsComplete {
+			complete++
+		}
+		if status == "" || onboarding.IsComplete == (status == "complete") {
+			filtered = append(filtered, onboarding)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"drivers":    filtered,
+		"complete":   complete,
+		"incomplete": len(onboardings) - complete,
+	})
+}
+
+// handleGetDriverOnboarding returns one driver's checklist for admins
+func (h *DriverOnboardingHandler) handleGetDriverOnboarding(w http.ResponseWriter, r *http.Request) {
+	driverID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid driver ID", http.StatusBadRequest)
+		return
+	}
+	h.respondWithOnboarding(w, driverID)
+}
+
+// handleCompleteDriverOnboardingStep records an admin confirming a step,
+// e.g. that the driver's bag kit was handed over
+func (h *DriverOnboardingHandler) handleCompleteDriverOnboardingStep(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	driverID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid driver ID", http.StatusBadRequest)
+		return
+	}
+
+	var role string
+	err = h.db.QueryRow("SELECT role FROM users WHERE id = $1", driverID).Scan(&role)
+	if err == sql.ErrNoRows || (err == nil && role != "driver") {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch driver", http.StatusInternalServerError)
+		return
+	}
+
+	h.completeStep(w, r, driverID, adminID, true)
+}
+
+// handleResetDriverOnboardingStep reopens a step, e.g. when a kit is
+// returned or a shadow route was logged against the wrong driver
+func (h *DriverOnboardingHandler) handleResetDriverOnboardingStep(w http.ResponseWriter, r *http.Request) {
+	driverID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid driver ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec(
+		"DELETE FROM driver_onboarding_progress WHERE driver_id = $1 AND step = $2",
+		driverID, mux.Vars(r)["step"],
+	)
+	if err != nil {
+		http.Error(w, "Failed to reset onboarding step", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Onboarding step not completed", http.StatusNotFound)
+		return
+	}
+
+	h.respondWithOnboarding(w, driverID)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDriverOnboarding(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "onboarding-admin@example.com", "Onboarding", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	driverID := db.CreateTestUser(t, "onboarding-driver@example.com", "Onboarding", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+
+	handler := NewDriverOnboardingHandler(db.DB)
+	actingAs := driverID
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return actingAs, nil
+	}
+
+	complete := func(h http.HandlerFunc, step string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/driver/onboarding/"+step+"/complete", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(driverID), "step": step})
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+
+	// Drivers can acknowledge the training video but not confirm their own kit
+	if w := complete(handler.handleCompleteMyOnboardingStep, "training_video"); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := complete(handler.handleCompleteMyOnboardingStep, "bag_kit_issued"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for an admin step, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := complete(handler.handleCompleteMyOnboardingStep, "background_check"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown step, got %d", http.StatusNotFound, w.Code)
+	}
+
+	pending, err := pendingOnboardingSteps(db.DB, driverID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0] != "bag_kit_issued" || pending[1] != "shadow_route" {
+		t.Errorf("Expected kit and shadow route pending, got %v", pending)
+	}
+
+	getDashboard := func(status string) map[string]json.RawMessage {
+		req := httptest.NewRequest("GET", "/api/v1/admin/drivers/onboarding?status="+status, nil)
+		w := httptest.NewRecorder()
+		handler.handleGetOnboardingDashboard(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var body map[string]json.RawMessage
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return body
+	}
+
+	var drivers []DriverOnboarding
+	json.Unmarshal(getDashboard("incomplete")["drivers"], &drivers)
+	if len(drivers) != 1 || drivers[0].DriverID != driverID || drivers[0].CompletedSteps != 1 || drivers[0].TotalSteps != 3 {
+		t.Errorf("Expected the driver one step in, got %+v", drivers)
+	}
+
+	// Admins finish the rest
+	actingAs = adminID
+	for _, step := range []string{"bag_kit_issued", "shadow_route"} {
+		w := complete(handler.handleCompleteDriverOnboardingStep, step)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if step == "shadow_route" {
+			var onboarding DriverOnboarding
+			json.Unmarshal(w.Body.Bytes(), &onboarding)
+			if !onboarding.IsComplete || *onboarding.Steps[1].CompletedBy != adminID {
+				t.Errorf("Expected onboarding complete with the kit signed off by the admin, got %+v", onboarding)
+			}
+		}
+	}
+	json.Unmarshal(getDashboard("complete")["drivers"], &drivers)
+	if len(drivers) != 1 {
+		t.Errorf("Expected the driver on the complete list, got %+v", drivers)
+	}
+
+	// Resetting a step puts the driver back on the blocked list
+	req := httptest.NewRequest("DELETE", "/api/v1/admin/drivers/"+strconv.Itoa(driverID)+"/onboarding/shadow_route", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(driverID), "step": "shadow_route"})
+	w := httptest.NewRecorder()
+	handler.handleResetDriverOnboardingStep(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if pending, _ := pendingOnboardingSteps(db.DB, driverID); len(pending) != 1 || pending[0] != "shadow_route" {
+		t.Errorf("Expected the shadow route pending again, got %v", pending)
+	}
+}
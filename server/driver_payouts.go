@@ -0,0 +1,626 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"tumble-backend/money"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/account"
+	"github.com/stripe/stripe-go/v82/accountlink"
+	"github.com/stripe/stripe-go/v82/transfer"
+)
+
+// driverStopPayCents is what a driver is paid for each completed stop
+const driverStopPayCents = 600
+
+// DriverPayoutHandler connects drivers to Stripe Connect Express and pays
+// them weekly for their stops plus the tips on orders they delivered
+type DriverPayoutHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+	transfer  func(DriverPayoutTransfer) (string, error)
+}
+
+func NewDriverPayoutHandler(db *sql.DB) *DriverPayoutHandler {
+	return &DriverPayoutHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+		transfer:  stripeDriverTransfer,
+	}
+}
+
+// DriverPayoutAccount is a driver's Stripe Connect account as last seen
+type DriverPayoutAccount struct {
+	Connected        bool `json:"connected"`
+	DetailsSubmitted bool `json:"details_submitted"`
+	PayoutsEnabled   bool `json:"payouts_enabled"`
+}
+
+// DriverPayout is one week of a driver's pay
+type DriverPayout struct {
+	ID               int        `json:"id"`
+	DriverID         int        `json:"driver_id"`
+	DriverName       string     `json:"driver_name,omitempty"`
+	PeriodStart      string     `json:"period_start"`
+	PeriodEnd        string     `json:"period_end"` // Exclusive
+	StopCount        int        `json:"stop_count"`
+	StopPay          float64    `json:"stop_pay"`
+	Tips             float64    `json:"tips"`
+	Amount           float64    `json:"amount"`
+	Status           string     `json:"status"` // pending, processing, paid, failed
+	StripeTransferID *string    `json:"stripe_transfer_id,omitempty"`
+	FailureReason    *string    `json:"failure_reason,omitempty"`
+	PaidAt           *time.Time `json:"paid_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// DriverPayoutTransfer is a payout ready to send to a connected account
+type DriverPayoutTransfer struct {
+	PayoutID    int
+	DriverID    int
+	AccountID   string
+	AmountCents int
+	PeriodStart string
+	// Attempt counts sends of this payout. Retries reuse the payout's
+	// idempotency key, so a transfer Stripe made before the response was lost
+	// isn't made again.
+	Attempt int
+}
+
+// payoutItem is a completed stop, or the tip on a delivered order, that
+// hasn't been paid out yet
+type payoutItem struct {
+	DriverID     int
+	Kind         string // stop or tip
+	RouteOrderID int
+	OrderID      int
+	AmountCents  int
+}
+
+// payoutTotals sums a driver's payout items
+type payoutTotals struct {
+	StopCount    int
+	StopPayCents int
+	TipCents     int
+	AmountCents  int
+	Items        []payoutItem
+}
+
+// payoutWeekStart is the Monday (UTC) starting the payout week t falls in
+func payoutWeekStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// groupPayoutItems totals unpaid items by driver
+func groupPayoutItems(items []payoutItem) map[int]*payoutTotals {
+	byDriver := map[int]*payoutTotals{}
+	for _, item := range items {
+		totals := byDriver[item.DriverID]
+		if totals == nil {
+			totals = &payoutTotals{}
+			byDriver[item.DriverID] = totals
+		}
+		switch item.Kind {
+		case "stop":
+			totals.StopCount++
+			totals.StopPayCents += item.AmountCents
+		case "tip":
+			totals.TipCents += item.AmountCents
+		}
+		totals.AmountCents += item.AmountCents
+		totals.Items = append(totals.Items, item)
+	}
+	return byDriver
+}
+
+// unpaidPayoutItems lists stops completed on routes before the given date,
+// and tips on orders delivered by then and paid for, that no payout covers
+// yet. Sandbox orders are never paid out. driverID limits it to one driver;
+// 0 means every driver.
+func unpaidPayoutItems(db *sql.DB, before time.Time, driverID int) ([]payoutItem, error) {
+	rows, err := db.Query(`
+		SELECT dr.driver_id, 'stop', ro.id, ro.order_id, $2::int
+		FROM route_orders ro
+		JOIN driver_routes dr ON dr.id = ro.route_id
+		JOIN orders o ON o.id = ro.order_id
+		WHERE ro.status = 'completed'
+		  AND NOT o.is_sandbox
+		  AND dr.driver_id IS NOT NULL
+		  AND dr.route_date < $1
+		  AND ($3 = 0 OR dr.driver_id = $3)
+		  AND NOT EXISTS (SELECT 1 FROM driver_payout_items pi WHERE pi.kind = 'stop' AND pi.route_order_id = ro.id)
+		UNION ALL
+		(SELECT DISTINCT ON (ro.order_id) dr.driver_id, 'tip', ro.id, ro.order_id, o.tip_cents
+		 FROM route_orders ro
+		 JOIN driver_routes dr ON dr.id = ro.route_id
+		 JOIN orders o ON o.id = ro.order_id
+		 WHERE ro.status = 'completed'
+		   AND dr.route_type = 'delivery'
+		   AND NOT o.is_sandbox
+		   AND dr.driver_id IS NOT NULL
+		   AND dr.route_date < $1
+		   AND ($3 = 0 OR dr.driver_id = $3)
+		   AND COALESCE(o.tip_cents, 0) > 0
+		   AND EXISTS (
+		       SELECT 1 FROM payments p
+		       WHERE p.order_id = o.id AND p.status IN ('completed', 'partially_refunded')
+		   )
+		   AND NOT EXISTS (SELECT 1 FROM driver_payout_items pi WHERE pi.kind = 'tip' AND pi.order_id = o.id)
+		 ORDER BY ro.order_id, ro.actual_time DESC NULLS LAST, ro.id DESC)`,
+		before.Format("2006-01-02"), driverStopPayCents, driverID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []payoutItem
+	for rows.Next() {
+		var item payoutItem
+		if err := rows.Scan(&item.DriverID, &item.Kind, &item.RouteOrderID, &item.OrderID, &item.AmountCents); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// runDriverPayouts adds everything earned before the end of the week
+// starting periodStart to that week's payouts, then sends every payout
+// that's due to drivers who can receive transfers. Items earned after a
+// week's payout was sent roll into the next one.
+func runDriverPayouts(db *sql.DB, send func(DriverPayoutTransfer) (string, error), periodStart time.Time) error {
+	periodStart = payoutWeekStart(periodStart)
+	periodEnd := periodStart.AddDate(0, 0, 7)
+
+	items, err := unpaidPayoutItems(db, periodEnd, 0)
+	if err != nil {
+		return err
+	}
+	for driverID, totals := range groupPayoutItems(items) {
+		if err := addToDriverPayout(db, driverID, periodStart, periodEnd, totals); err != nil {
+			return fmt.Errorf("driver %d: %v", driverID, err)
+		}
+	}
+
+	return sendDueDriverPayouts(db, send)
+}
+
+// addToDriverPayout records items on a driver's payout for the week and
+// retotals it, unless a transfer has already been tried for it. A payout's
+// amount is frozen from its first attempt, so every retry sends the same
+// transfer; items earned since roll into the next week's payout.
+func addToDriverPayout(db *sql.DB, driverID int, periodStart, periodEnd time.Time, totals *payoutTotals) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var payoutID int
+	var status string
+	err = tx.QueryRow(`
+		INSERT INTO driver_payouts (driver_id, period_start, period_end)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (driver_id, period_start) DO UPDATE SET updated_at = CURRENT_TIMESTAMP
+		RETURNING id, status`,
+		driverID, periodStart.Format("2006-01-02"), periodEnd.Format("2006-01-02"),
+	).Scan(&payoutID, &status)
+	if err != nil {
+		return err
+	}
+	if status != "pending" {
+		return nil
+	}
+
+	for _, item := range totals.Items {
+		// Another run may have claimed the item since it was listed
+		_, err := tx.Exec(`
+			INSERT INTO driver_payout_items (payout_id, kind, route_order_id, order_id, amount_cents)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`,
+			payoutID, item.Kind, item.RouteOrderID, item.OrderID, item.AmountCents,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE driver_payouts p
+		SET stop_count = t.stop_count, stop_pay_cents = t.stop_pay_cents, tip_cents = t.tip_cents,
+		    amount_cents = t.stop_pay_cents + t.tip_cents, updated_at = CURRENT_TIMESTAMP
+		FROM (
+			SELECT COUNT(*) FILTER (WHERE kind = 'stop') AS stop_count,
+			       COALESCE(SUM(amount_cents) FILTER (WHERE kind = 'stop'), 0) AS stop_pay_cents,
+			       COALESCE(SUM(amount_cents) FILTER (WHERE kind = 'tip'), 0) AS tip_cents
+			FROM driver_payout_items WHERE payout_id = $1
+		) t
+		WHERE p.id = $1`,
+		payoutID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sendDueDriverPayouts transfers pending and failed payouts to drivers whose
+// connected accounts can receive them. The rest wait for the driver to
+// finish onboarding.
+func sendDueDriverPayouts(db *sql.DB, send func(DriverPayoutTransfer) (string, error)) error {
+	rows, err := db.Query(`
+		SELECT p.id, p.driver_id, u.stripe_connect_account_id, p.amount_cents, TO_CHAR(p.period_start, 'YYYY-MM-DD')
+		FROM driver_payouts p
+		JOIN users u ON u.id = p.driver_id
+		WHERE p.status IN ('pending', 'failed')
+		  AND p.amount_cents > 0
+		  AND u.stripe_connect_account_id IS NOT NULL
+		  AND u.stripe_connect_payouts_enabled = true
+		ORDER BY p.period_start, p.id`)
+	if err != nil {
+		return err
+	}
+	var due []DriverPayoutTransfer
+	for rows.Next() {
+		var t DriverPayoutTransfer
+		if err := rows.Scan(&t.PayoutID, &t.DriverID, &t.AccountID, &t.AmountCents, &t.PeriodStart); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, t := range due {
+		// Claim the payout so an overlapping run can't send it twice
+		err := db.QueryRow(`
+			UPDATE driver_payouts SET status = 'processing', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND status IN ('pending', 'failed')
+			RETURNING attempts`,
+			t.PayoutID,
+		).Scan(&t.Attempt)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		transferID, sendErr := send(t)
+		if sendErr != nil {
+			log.Printf("Failed to pay out driver payout %d: %v", t.PayoutID, sendErr)
+			if _, err := db.Exec(`
+				UPDATE driver_payouts SET status = 'failed', failure_reason = $2, updated_at = CURRENT_TIMESTAMP
+				WHERE id = $1`,
+				t.PayoutID, sendErr.Error(),
+			); err != nil {
+				return err
+			}
+			logAdminAlert(db, AdminAlert{
+				Type:      "driver_payout_failed",
+				Severity:  "warning",
+				Title:     "Driver payout could not be sent",
+				Message:   fmt.Sprintf("Payout #%d of %s to driver %d failed: %v", t.PayoutID, money.Format(t.AmountCents), t.DriverID, sendErr),
+				DedupeKey: fmt.Sprintf("driver_payout_failed:%d", t.PayoutID),
+			})
+			continue
+		}
+
+		if _, err := db.Exec(`
+			UPDATE driver_payouts
+			SET status = 'paid', stripe_transfer_id = $2, failure_reason = NULL,
+			    paid_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1`,
+			t.PayoutID, transferID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripeDriverTransfer moves a payout to the driver's connected account
+func stripeDriverTransfer(t DriverPayoutTransfer) (string, error) {
+	params := &stripe.TransferParams{
+		Amount:        stripe.Int64(int64(t.AmountCents)),
+		Currency:      stripe.String(string(stripe.CurrencyUSD)),
+		Destination:   stripe.String(t.AccountID),
+		Description:   stripe.String("Tumble driver pay for the week of " + t.PeriodStart),
+		TransferGroup: stripe.String("driver-payouts-" + t.PeriodStart),
+		Metadata: map[string]string{
+			"payout_id": strconv.Itoa(t.PayoutID),
+			"driver_id": strconv.Itoa(t.DriverID),
+		},
+	}
+	params.SetIdempotencyKey(fmt.Sprintf("driver-payout-%d", t.PayoutID))
+	tr, err := transfer.New(params)
+	if err != nil {
+		return "", err
+	}
+	return tr.ID, nil
+}
+
+// processDriverPayouts pays out the week that just ended
+func (s *AutoScheduler) processDriverPayouts() {
+	periodStart := payoutWeekStart(time.Now()).AddDate(0, 0, -7)
+	log.Printf("Running driver payouts for the week of %s...", periodStart.Format("2006-01-02"))
+	if err := runDriverPayouts(s.db, stripeDriverTransfer, periodStart); err != nil {
+		log.Printf("Error running driver payouts: %v", err)
+	}
+}
+
+// listDriverPayouts returns payouts, newest week first
+func listDriverPayouts(db *sql.DB, where string, args ...interface{}) ([]DriverPayout, error) {
+	query := `
+		SELECT p.id, p.driver_id, u.first_name || ' ' || u.last_name,
+		       TO_CHAR(p.period_start, 'YYYY-MM-DD'), TO_CHAR(p.period_end, 'YYYY-MM-DD'),
+		       p.stop_count, p.stop_pay_cents, p.tip_cents, p.amount_cents, p.status,
+		       p.stripe_transfer_id, p.failure_reason, p.paid_at, p.created_at
+		FROM driver_payouts p
+		JOIN users u ON u.id = p.driver_id`
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY p.period_start DESC, p.id DESC LIMIT 200"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payouts := []DriverPayout{}
+	for rows.Next() {
+		var p DriverPayout
+		var stopPayCents, tipCents, amountCents int
+		err := rows.Scan(&p.ID, &p.DriverID, &p.DriverName, &p.PeriodStart, &p.PeriodEnd,
+			&p.StopCount, &stopPayCents, &tipCents, &amountCents, &p.Status,
+			&p.StripeTransferID, &p.FailureReason, &p.PaidAt, &p.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		p.StopPay = centsToDollars(stopPayCents)
+		p.Tips = centsToDollars(tipCents)
+		p.Amount = centsToDollars(amountCents)
+		payouts = append(payouts, p)
+	}
+	return payouts, rows.Err()
+}
+
+// getDriverPayoutAccount returns the Connect account status stored for a driver
+func getDriverPayoutAccount(q queryRower, driverID int) (DriverPayoutAccount, string, error) {
+	var acct DriverPayoutAccount
+	var accountID sql.NullString
+	err := q.QueryRow(`
+		SELECT stripe_connect_account_id, stripe_connect_details_submitted, stripe_connect_payouts_enabled
+		FROM users WHERE id = $1`,
+		driverID,
+	).Scan(&accountID, &acct.DetailsSubmitted, &acct.PayoutsEnabled)
+	acct.Connected = accountID.Valid
+	return acct, accountID.String, err
+}
+
+// recordConnectAccount copies a connected account's onboarding state from
+// Stripe onto the driver it belongs to
+func recordConnectAccount(db execer, acct *stripe.Account) error {
+	_, err := db.Exec(`
+		UPDATE users
+		SET stripe_connect_details_submitted = $2, stripe_connect_payouts_enabled = $3
+		WHERE stripe_connect_account_id = $1`,
+		acct.ID, acct.DetailsSubmitted, acct.PayoutsEnabled,
+	)
+	return err
+}
+
+// handleStartPayoutOnboarding creates the driver's Express account if they
+// don't have one and returns a Stripe-hosted onboarding link for it
+func (h *DriverPayoutHandler) handleStartPayoutOnboarding(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var email string
+	var accountID sql.NullString
+	err = h.db.QueryRow("SELECT email, stripe_connect_account_id FROM users WHERE id = $1", driverID).Scan(&email, &accountID)
+	if err != nil {
+		http.Error(w, "Failed to load driver", http.StatusInternalServerError)
+		return
+	}
+
+	if !accountID.Valid {
+		acct, err := account.New(&stripe.AccountParams{
+			Type:         stripe.String(string(stripe.AccountTypeExpress)),
+			Country:      stripe.String("US"),
+			Email:        stripe.String(email),
+			BusinessType: stripe.String(string(stripe.AccountBusinessTypeIndividual)),
+			Capabilities: &stripe.AccountCapabilitiesParams{
+				Transfers: &stripe.AccountCapabilitiesTransfersParams{Requested: stripe.Bool(true)},
+			},
+			Metadata: map[string]string{"driver_id": strconv.Itoa(driverID)},
+		})
+		if err != nil {
+			log.Printf("Failed to create Connect account for driver %d: %v", driverID, err)
+			http.Error(w, "Failed to set up payout account", http.StatusBadGateway)
+			return
+		}
+		// A concurrent request may have stored an account first; use that one
+		err = h.db.QueryRow(`
+			UPDATE users SET stripe_connect_account_id = COALESCE(stripe_connect_account_id, $1)
+			WHERE id = $2
+			RETURNING stripe_connect_account_id`,
+			acct.ID, driverID,
+		).Scan(&accountID)
+		if err != nil {
+			http.Error(w, "Failed to save payout account", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	frontendURL := os.Getenv("FRONTEND_URL")
+	link, err := accountlink.New(&stripe.AccountLinkParams{
+		Account:    stripe.String(accountID.String),
+		RefreshURL: stripe.String(frontendURL + "/driver/earnings?payouts=refresh"),
+		ReturnURL:  stripe.String(frontendURL + "/driver/earnings?payouts=complete"),
+		Type:       stripe.String("account_onboarding"),
+	})
+	if err != nil {
+		log.Printf("Failed to create onboarding link for driver %d: %v", driverID, err)
+		http.Error(w, "Failed to create onboarding link", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":        link.URL,
+		"expires_at": time.Unix(link.ExpiresAt, 0).UTC(),
+	})
+}
+
+// handleGetPayoutAccount returns the driver's payout account, refreshed from
+// Stripe so it's current when they return from onboarding
+func (h *DriverPayoutHandler) handleGetPayoutAccount(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	payoutAccount, accountID, err := getDriverPayoutAccount(h.db, driverID)
+	if err != nil {
+		http.Error(w, "Failed to load payout account", http.StatusInternalServerError)
+		return
+	}
+	if payoutAccount.Connected {
+		if acct, err := account.GetByID(accountID, nil); err != nil {
+			log.Printf("Failed to refresh Connect account for driver %d: %v", driverID, err)
+		} else if err := recordConnectAccount(h.db, acct); err != nil {
+			log.Printf("Failed to save Connect account for driver %d: %v", driverID, err)
+		} else {
+			payoutAccount.DetailsSubmitted = acct.DetailsSubmitted
+			payoutAccount.PayoutsEnabled = acct.PayoutsEnabled
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payoutAccount)
+}
+
+// handleGetDriverPayouts lists payouts for admins, filtered by ?status=,
+// ?driver_id= and ?week= (any date in the payout week)
+func (h *DriverPayoutHandler) handleGetDriverPayouts(w http.ResponseWriter, r *http.Request) {
+	where := "TRUE"
+	args := []interface{}{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		args = append(args, status)
+		where += fmt.Sprintf(" AND p.status = $%d", len(args))
+	}
+	if driverID := r.URL.Query().Get("driver_id"); driverID != "" {
+		id, err := strconv.Atoi(driverID)
+		if err != nil {
+			http.Error(w, "Invalid driver ID", http.StatusBadRequest)
+			return
+		}
+		args = append(args, id)
+		where += fmt.Sprintf(" AND p.driver_id = $%d", len(args))
+	}
+	if week := r.URL.Query().Get("week"); week != "" {
+		date, err := time.Parse("2006-01-02", week)
+		if err != nil {
+			http.Error(w, "Invalid week, use YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		args = append(args, payoutWeekStart(date).Format("2006-01-02"))
+		where += fmt.Sprintf(" AND p.period_start = $%d", len(args))
+	}
+
+	payouts, err := listDriverPayouts(h.db, where, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch driver payouts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payouts)
+}
+
+// handleRunDriverPayouts runs payouts for {"week_start"} (any date in the
+// week; default last week) now instead of waiting for Monday's job
+func (h *DriverPayoutHandler) handleRunDriverPayouts(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		WeekStart string `json:"week_start"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	periodStart := payoutWeekStart(time.Now()).AddDate(0, 0, -7)
+	if req.WeekStart != "" {
+		date, err := time.Parse("2006-01-02", req.WeekStart)
+		if err != nil {
+			http.Error(w, "Invalid week_start, use YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		periodStart = payoutWeekStart(date)
+	}
+	if !periodStart.AddDate(0, 0, 7).Before(time.Now()) {
+		http.Error(w, "The week hasn't ended yet", http.StatusBadRequest)
+		return
+	}
+
+	if err := runDriverPayouts(h.db, h.transfer, periodStart); err != nil {
+		log.Printf("Error running driver payouts for %s: %v", periodStart.Format("2006-01-02"), err)
+		http.Error(w, "Failed to run driver payouts", http.StatusInternalServerError)
+		return
+	}
+
+	payouts, err := listDriverPayouts(h.db, "p.period_start = $1", periodStart.Format("2006-01-02"))
+	if err != nil {
+		http.Error(w, "Failed to fetch driver payouts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payouts)
+}
+
+// driverUnpaidCents is what a driver has earned and not yet been sent:
+// payouts still waiting plus work no payout covers yet
+func driverUnpaidCents(db *sql.DB, driverID int) (int, error) {
+	var owedCents int
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(amount_cents), 0) FROM driver_payouts
+		WHERE driver_id = $1 AND status != 'paid'`,
+		driverID,
+	).Scan(&owedCents)
+	if err != nil {
+		return 0, err
+	}
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1)
+	items, err := unpaidPayoutItems(db, tomorrow, driverID)
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		owedCents += item.AmountCents
+	}
+	return owedCents, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPayoutWeekStart(t *testing.T) {
+	tests := []struct {
+		date     string
+		expected string
+	}{
+		{"2026-10-12", "2026-10-12"}, // Monday
+		{"2026-10-16", "2026-10-12"},
+		{"2026-10-18", "2026-10-12"}, // Sunday
+		{"2026-10-19", "2026-10-19"},
+	}
+	for _, tt := range tests {
+		date, _ := time.Parse("2006-01-02", tt.date)
+		if got := payoutWeekStart(date.Add(15 * time.Hour)).Format("2006-01-02"); got != tt.expected {
+			t.Errorf("payoutWeekStart(%s) = %s, expected %s", tt.date, got, tt.expected)
+		}
+	}
+}
+
+func TestGroupPayoutItems(t *testing.T) {
+	totals := groupPayoutItems([]payoutItem{
+		{DriverID: 1, Kind: "stop", RouteOrderID: 10, OrderID: 100, AmountCents: 600},
+		{DriverID: 1, Kind: "stop", RouteOrderID: 11, OrderID: 101, AmountCents: 600},
+		{DriverID: 1, Kind: "tip", RouteOrderID: 11, OrderID: 101, AmountCents: 350},
+		{DriverID: 2, Kind: "stop", RouteOrderID: 12, OrderID: 100, AmountCents: 600},
+	})
+
+	first := totals[1]
+	if first == nil || first.StopCount != 2 || first.StopPayCents != 1200 || first.TipCents != 350 || first.AmountCents != 1550 {
+		t.Errorf("Expected 2 stops and a tip totalling 1550 cents, got %+v", first)
+	}
+	if second := totals[2]; second == nil || second.AmountCents != 600 || second.TipCents != 0 {
+		t.Errorf("Expected one stop of 600 cents, got %+v", second)
+	}
+}
+
+func TestRunDriverPayouts(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	customerID := db.CreateTestUser(t, "payout-customer@example.com", "Payout", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	db.Exec("UPDATE orders SET tip_cents = 500 WHERE id = $1", orderID)
+	db.Exec(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id)
+		VALUES ($1, $2, 3000, 'extra_order', 'completed', 'pi_payout_test')`,
+		customerID, orderID)
+
+	// One driver picks the order up and another delivers it last week
+	pickupDriverID := db.CreateTestUser(t, "payout-pickup@example.com", "Pickup", "Driver")
+	deliveryDriverID := db.CreateTestUser(t, "payout-delivery@example.com", "Delivery", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id IN ($1, $2)", pickupDriverID, deliveryDriverID)
+	db.Exec(`
+		UPDATE users SET stripe_connect_account_id = 'acct_delivery', stripe_connect_payouts_enabled = true
+		WHERE id = $1`,
+		deliveryDriverID)
+
+	lastWeek := payoutWeekStart(time.Now()).AddDate(0, 0, -7)
+	addStop := func(driverID int, routeType string, day time.Time) {
+		var routeID int
+		err := db.QueryRow(`
+			INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+			VALUES ($1, $2, $3, 'completed') RETURNING id`,
+			driverID, day.Format("2006-01-02"), routeType,
+		).Scan(&routeID)
+		if err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		db.Exec(`
+			INSERT INTO route_orders (route_id, order_id, sequence_number, status, actual_time)
+			VALUES ($1, $2, 1, 'completed', $3)`,
+			routeID, orderID, day)
+	}
+	addStop(pickupDriverID, "pickup", lastWeek)
+	addStop(deliveryDriverID, "delivery", lastWeek.AddDate(0, 0, 2))
+
+	var sent []DriverPayoutTransfer
+	send := func(tr DriverPayoutTransfer) (string, error) {
+		sent = append(sent, tr)
+		return "tr_test", nil
+	}
+	if err := runDriverPayouts(db.DB, send, lastWeek); err != nil {
+		t.Fatalf("Failed to run payouts: %v", err)
+	}
+
+	payouts, err := listDriverPayouts(db.DB, "p.period_start = $1", lastWeek.Format("2006-01-02"))
+	if err != nil || len(payouts) != 2 {
+		t.Fatalf("Expected two payouts, got %d (%v)", len(payouts), err)
+	}
+	for _, p := range payouts {
+		switch p.DriverID {
+		case deliveryDriverID:
+			if p.Status != "paid" || p.StopCount != 1 || p.Tips != 5.00 || p.Amount != centsToDollars(driverStopPayCents)+5.00 {
+				t.Errorf("Expected the delivery driver paid one stop plus the tip, got %+v", p)
+			}
+		case pickupDriverID:
+			// No payout account yet, so it waits
+			if p.Status != "pending" || p.Tips != 0 || p.Amount != centsToDollars(driverStopPayCents) {
+				t.Errorf("Expected the pickup driver's stop pending, got %+v", p)
+			}
+		}
+	}
+	if len(sent) != 1 || sent[0].AccountID != "acct_delivery" {
+		t.Fatalf("Expected one transfer to the delivery driver, got %+v", sent)
+	}
+
+	// Running again pays nothing twice, and a failed transfer is retried once
+	// the pickup driver can be paid
+	db.Exec(`
+		UPDATE users SET stripe_connect_account_id = 'acct_pickup', stripe_connect_payouts_enabled = true
+		WHERE id = $1`,
+		pickupDriverID)
+	failing := func(tr DriverPayoutTransfer) (string, error) {
+		sent = append(sent, tr)
+		return "", errors.New("insufficient platform balance")
+	}
+	if err := runDriverPayouts(db.DB, failing, lastWeek); err != nil {
+		t.Fatalf("Failed to rerun payouts: %v", err)
+	}
+	if len(sent) != 2 || sent[1].AccountID != "acct_pickup" || sent[1].Attempt != 1 {
+		t.Fatalf("Expected only the pickup driver's payout attempted, got %+v", sent)
+	}
+
+	// A stop found after the failed attempt doesn't change the amount retried
+	addStop(pickupDriverID, "pickup", lastWeek.AddDate(0, 0, 3))
+	if err := runDriverPayouts(db.DB, send, lastWeek); err != nil {
+		t.Fatalf("Failed to retry payouts: %v", err)
+	}
+	if len(sent) != 3 || sent[2].Attempt != 2 || sent[2].PayoutID != sent[1].PayoutID || sent[2].AmountCents != sent[1].AmountCents {
+		t.Fatalf("Expected the failed payout retried unchanged, got %+v", sent)
+	}
+
+	owed, err := driverUnpaidCents(db.DB, pickupDriverID)
+	if err != nil || owed != driverStopPayCents {
+		t.Errorf("Expected the later stop still owed to the pickup driver, got %d (%v)", owed, err)
+	}
+
+	// It rolls into the next week's payout
+	if err := runDriverPayouts(db.DB, send, lastWeek.AddDate(0, 0, 7)); err != nil {
+		t.Fatalf("Failed to run next week's payouts: %v", err)
+	}
+	if len(sent) != 4 || sent[3].AmountCents != driverStopPayCents {
+		t.Fatalf("Expected the later stop paid the next week, got %+v", sent)
+	}
+	owed, err = driverUnpaidCents(db.DB, pickupDriverID)
+	if err != nil || owed != 0 {
+		t.Errorf("Expected nothing left owed to the pickup driver, got %d (%v)", owed, err)
+	}
+}
+
+func TestUnpaidPayoutItemsSkipSandbox(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	customerID := db.CreateTestUser(t, "payout-sandbox@example.com", "Sandbox", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	db.Exec("UPDATE orders SET is_sandbox = true, tip_cents = 500 WHERE id = $1", orderID)
+	db.Exec(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id)
+		VALUES ($1, $2, 3000, 'extra_order', 'completed', 'pi_sandbox_payout')`,
+		customerID, orderID)
+
+	driverID := db.CreateTestUser(t, "payout-sandbox-driver@example.com", "Sandbox", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE - 7, 'delivery', 'completed') RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	db.Exec(`
+		INSERT INTO route_orders (route_id, order_id, sequence_number, status, actual_time)
+		VALUES ($1, $2, 1, 'completed', NOW() - INTERVAL '7 days')`,
+		routeID, orderID)
+
+	items, err := unpaidPayoutItems(db.DB, time.Now(), 0)
+	if err != nil {
+		t.Fatalf("Failed to list payout items: %v", err)
+	}
+	if len(items) != 0 {
+		t.Errorf("Expected the sandbox stop and tip left unpaid, got %+v", items)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	driverStatsDefaultWeeks = 8
+	driverStatsMaxWeeks     = 26
+)
+
+// DriverPerformance is the driver app's dashboard: lifetime totals plus a
+// week-by-week trend. On-time uses the scorecard's definition.
+type DriverPerformance struct {
+	CompletedStops      int                 `json:"completedStops"`
+	OnTimePercent       *float64            `json:"onTimePercent"` // nil until a stop has been attempted
+	TotalTips           float64             `json:"totalTips"`
+	AverageRouteMinutes *float64            `json:"averageRouteMinutes"` // nil until a route has been timed
+	Weeks               []DriverWeeklyStats `json:"weeks"`               // Oldest first
+}
+
+// DriverWeeklyStats is one Monday-to-Sunday week of a driver's work. Earnings
+// are the same commission /driver/earnings reports; tips are on top.
+type DriverWeeklyStats struct {
+	WeekStart           string   `json:"weekStart"`
+	CompletedStops      int      `json:"completedStops"`
+	OnTimePercent       *float64 `json:"onTimePercent"`
+	Earnings            float64  `json:"earnings"`
+	Tips                float64  `json:"tips"`
+	AverageRouteMinutes *float64 `json:"averageRouteMinutes"`
+}
+
+// driverStopTotals is what the stats query adds up for a set of stops
+type driverStopTotals struct {
+	Completed       int
+	Attempted       int
+	OnTime          int
+	OrderValueCents int
+	TipCents        int
+	RouteMinutes    sql.NullFloat64
+}
+
+func (t driverStopTotals) onTimePercent() *float64 {
+	if t.Attempted == 0 {
+		return nil
+	}
+	percent := float64(t.OnTime) / float64(t.Attempted) * 100
+	return &percent
+}
+
+func (t driverStopTotals) averageRouteMinutes() *float64 {
+	if !t.RouteMinutes.Valid {
+		return nil
+	}
+	minutes := t.RouteMinutes.Float64
+	return &minutes
+}
+
+// driverStatsQuery totals a driver's stops ($1) from $2 on, grouped by %s.
+// Tips go to whoever completed the order's last delivery stop, as with payouts.
+const driverStatsQuery = `
+	WITH stops AS (
+		SELECT dr.id AS route_id, dr.route_date, ro.status,
+		       ro.status = 'completed' AND (
+		           ro.estimated_time IS NULL OR ro.actual_time IS NULL OR
+		           ro.actual_time <= dr.route_date + ro.estimated_time + $3::interval
+		       ) AS on_time,
+		       CASE WHEN ro.status = 'completed' THEN COALESCE(o.total_cents, 0) ELSE 0 END AS order_value_cents,
+		       CASE WHEN ro.status = 'completed' AND dr.route_type = 'delivery' AND NOT EXISTS (
+		           SELECT 1 FROM route_orders later
+		           JOIN driver_routes ldr ON later.route_id = ldr.id
+		           WHERE later.order_id = ro.order_id AND later.status = 'completed'
+		             AND ldr.route_type = 'delivery' AND later.actual_time > ro.actual_time
+		       ) THEN COALESCE(o.tip_cents, 0) ELSE 0 END AS tip_cents
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		JOIN orders o ON ro.order_id = o.id
+		WHERE dr.driver_id = $1 AND dr.route_date >= $2
+	),
+	routes AS (
+		SELECT route_date, EXTRACT(EPOCH FROM (actual_end_time - actual_start_time)) / 60 AS minutes
+		FROM driver_routes
+		WHERE driver_id = $1 AND route_date >= $2 AND status = 'completed'
+		  AND actual_start_time IS NOT NULL AND actual_end_time > actual_start_time
+	)
+	SELECT s.period,
+	       COUNT(*) FILTER (WHERE s.status = 'completed'),
+	       COUNT(*) FILTER (WHERE s.status IN ('completed', 'failed')),
+	       COUNT(*) FILTER (WHERE s.on_time),
+	       COALESCE(SUM(s.order_value_cents), 0),
+	       COALESCE(SUM(s.tip_cents), 0),
+	       (SELECT AVG(r.minutes) FROM routes r WHERE %[1]s = s.period)
+	FROM (SELECT %[2]s AS period, stops.* FROM stops) s
+	GROUP BY s.period`
+
+// getDriverStopTotals runs driverStatsQuery. With weekly set the totals are
+// keyed by week start (YYYY-MM-DD); otherwise there's one "all" entry.
+func getDriverStopTotals(db *sql.DB, driverID int, since time.Time, weekly bool) (map[string]driverStopTotals, error) {
+	routePeriod, stopPeriod := "'all'", "'all'"
+	if weekly {
+		routePeriod = "TO_CHAR(DATE_TRUNC('week', r.route_date), 'YYYY-MM-DD')"
+		stopPeriod = "TO_CHAR(DATE_TRUNC('week', route_date), 'YYYY-MM-DD')"
+	}
+	rows, err := db.Query(fmt.Sprintf(driverStatsQuery, routePeriod, stopPeriod),
+		driverID, since.Format("2006-01-02"), fmt.Sprintf("%d minutes", int(scorecardOnTimeGrace.Minutes())),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]driverStopTotals{}
+	for rows.Next() {
+		var period string
+		var t driverStopTotals
+		err := rows.Scan(&period, &t.Completed, &t.Attempted, &t.OnTime, &t.OrderValueCents, &t.TipCents, &t.RouteMinutes)
+		if err != nil {
+			return nil, err
+		}
+		totals[period] = t
+	}
+	return totals, rows.Err()
+}
+
+// driverWeeklyTrend lays weekly totals out over the last n weeks, ending with
+// the week containing now, so weeks without work show as zeros
+func driverWeeklyTrend(totals map[string]driverStopTotals, now time.Time, n int) []DriverWeeklyStats {
+	weeks := make([]DriverWeeklyStats, 0, n)
+	start := payoutWeekStart(now).AddDate(0, 0, -7*(n-1))
+	for i := 0; i < n; i++ {
+		weekStart := start.AddDate(0, 0, 7*i).Format("2006-01-02")
+		t := totals[weekStart]
+		weeks = append(weeks, DriverWeeklyStats{
+			WeekStart:           weekStart,
+			CompletedStops:      t.Completed,
+			OnTimePercent:       t.onTimePercent(),
+			Earnings:            centsToDollars(driverCommissionCents(t.OrderValueCents)),
+			Tips:                centsToDollars(t.TipCents),
+			AverageRouteMinutes: t.averageRouteMinutes(),
+		})
+	}
+	return weeks
+}
+
+// handleGetDriverStats returns the signed-in driver's performance dashboard,
+// with ?weeks= weeks of trend (default 8)
+func (h *DriverEarningsHandler) handleGetDriverStats(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	weeks := driverStatsDefaultWeeks
+	if value := r.URL.Query().Get("weeks"); value != "" {
+		weeks, err = strconv.Atoi(value)
+		if err != nil || weeks < 1 || weeks > driverStatsMaxWeeks {
+			http.Error(w, fmt.Sprintf("weeks must be between 1 and %d", driverStatsMaxWeeks), http.StatusBadRequest)
+			return
+		}
+	}
+
+	lifetime, err := getDriverStopTotals(h.db, driverID, time.Time{}, false)
+	if err != nil {
+		http.Error(w, "Failed to fetch driver stats", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	weekly, err := getDriverStopTotals(h.db, driverID, payoutWeekStart(now).AddDate(0, 0, -7*(weeks-1)), true)
+	if err != nil {
+		http.Error(w, "Failed to fetch driver stats", http.StatusInternalServerError)
+		return
+	}
+
+	all := lifetime["all"]
+	stats := DriverPerformance{
+		CompletedStops:      all.Completed,
+		OnTimePercent:       all.onTimePercent(),
+		TotalTips:           centsToDollars(all.TipCents),
+		AverageRouteMinutes: all.averageRouteMinutes(),
+		Weeks:               driverWeeklyTrend(weekly, now, weeks),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
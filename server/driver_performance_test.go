@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDriverWeeklyTrend(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC) // a Friday
+	weeks := driverWeeklyTrend(map[string]driverStopTotals{
+		"2026-10-05": {Completed: 4, Attempted: 5, OnTime: 4, OrderValueCents: 10000, TipCents: 300},
+	}, now, 3)
+
+	if len(weeks) != 3 || weeks[0].WeekStart != "2026-09-28" || weeks[2].WeekStart != "2026-10-12" {
+		t.Fatalf("Expected the three weeks ending this week, got %+v", weeks)
+	}
+	if weeks[0].CompletedStops != 0 || weeks[0].OnTimePercent != nil {
+		t.Errorf("Expected an empty week with no on-time rate, got %+v", weeks[0])
+	}
+	worked := weeks[1]
+	if worked.CompletedStops != 4 || worked.OnTimePercent == nil || *worked.OnTimePercent != 80 ||
+		worked.Earnings != 70.00 || worked.Tips != 3.00 {
+		t.Errorf("Expected 4 stops, 80%% on time, 70.00 earned and 3.00 in tips, got %+v", worked)
+	}
+}
+
+func TestDriverStats(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	customerID := db.CreateTestUser(t, "stats-customer@example.com", "Stats", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	db.Exec("UPDATE orders SET tip_cents = 500 WHERE id = $1", orderID)
+	var orderTotalCents int
+	db.QueryRow("SELECT total_cents FROM orders WHERE id = $1", orderID).Scan(&orderTotalCents)
+
+	driverID := db.CreateTestUser(t, "stats-driver@example.com", "Stats", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+
+	thisWeek := payoutWeekStart(time.Now().UTC())
+	lastWeek := thisWeek.AddDate(0, 0, -7)
+	addRoute := func(day time.Time, routeType string, hours int) int {
+		var routeID int
+		err := db.QueryRow(`
+			INSERT INTO driver_routes (driver_id, route_date, route_type, status, actual_start_time, actual_end_time)
+			VALUES ($1, $2, $3, 'completed', $4, $5) RETURNING id`,
+			driverID, day.Format("2006-01-02"), routeType, day.Add(9*time.Hour), day.Add(time.Duration(9+hours)*time.Hour),
+		).Scan(&routeID)
+		if err != nil {
+			t.Fatalf("Failed to create route: %v", err)
+		}
+		return routeID
+	}
+	addStop := func(routeID int, status string, actual time.Time) {
+		db.Exec(`
+			INSERT INTO route_orders (route_id, order_id, sequence_number, status, estimated_time, actual_time)
+			VALUES ($1, $2, 1, $3, '10:00', $4)`,
+			routeID, orderID, status, actual)
+	}
+
+	// Picked up on time last week; delivered late this week after a failed attempt
+	pickupRoute := addRoute(lastWeek, "pickup", 2)
+	addStop(pickupRoute, "completed", lastWeek.Add(10*time.Hour+10*time.Minute))
+	deliveryRoute := addRoute(thisWeek, "delivery", 1)
+	addStop(deliveryRoute, "failed", thisWeek.Add(10*time.Hour))
+	addStop(deliveryRoute, "completed", thisWeek.Add(15*time.Hour))
+
+	handler := NewDriverEarningsHandler(db.DB)
+	handler.getUserID = CreateAuthMock(driverID).getUserIDFromRequest
+	w := httptest.NewRecorder()
+	handler.handleGetDriverStats(w, httptest.NewRequest("GET", "/api/v1/driver/stats?weeks=2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var stats DriverPerformance
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if stats.CompletedStops != 2 || stats.TotalTips != 5.00 {
+		t.Errorf("Expected 2 completed stops and 5.00 in tips, got %+v", stats)
+	}
+	if stats.OnTimePercent == nil || int(*stats.OnTimePercent) != 33 {
+		t.Errorf("Expected one of three attempted stops on time, got %v", stats.OnTimePercent)
+	}
+	if stats.AverageRouteMinutes == nil || *stats.AverageRouteMinutes != 90 {
+		t.Errorf("Expected routes to average 90 minutes, got %v", stats.AverageRouteMinutes)
+	}
+
+	if len(stats.Weeks) != 2 {
+		t.Fatalf("Expected 2 weeks of trend, got %d", len(stats.Weeks))
+	}
+	last, current := stats.Weeks[0], stats.Weeks[1]
+	if last.CompletedStops != 1 || last.OnTimePercent == nil || *last.OnTimePercent != 100 || last.Tips != 0 {
+		t.Errorf("Expected last week's pickup on time with no tip, got %+v", last)
+	}
+	if current.CompletedStops != 1 || current.OnTimePercent == nil || *current.OnTimePercent != 0 || current.Tips != 5.00 ||
+		current.Earnings != centsToDollars(driverCommissionCents(orderTotalCents)) {
+		t.Errorf("Expected this week's late delivery with the tip, got %+v", current)
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleGetDriverStats(w, httptest.NewRequest("GET", "/api/v1/driver/stats?weeks=100", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for too many weeks, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	driverPreferenceFavorite = "favorite"
+	driverPreferenceBlocked  = "blocked"
+
+	// Customers can block only a few drivers, so a market's schedule can
+	// always be staffed
+	maxBlockedDrivers = 3
+	// Block rates are over customers served this far back
+	driverBlockRateWindow = 90 * 24 * time.Hour
+)
+
+// DriverPreferenceHandler lets customers favorite or block the drivers
+// who've served them
+type DriverPreferenceHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewDriverPreferenceHandler(db *sql.DB) *DriverPreferenceHandler {
+	return &DriverPreferenceHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// ServedDriver is a driver who made one of the customer's stops. Customers
+// see first names and last initials only.
+type ServedDriver struct {
+	DriverID     int       `json:"driver_id"`
+	DriverName   string    `json:"driver_name"`
+	Stops        int       `json:"stops"`
+	LastServedAt time.Time `json:"last_served_at"`
+	Preference   *string   `json:"preference"`
+	Reason       *string   `json:"reason,omitempty"`
+}
+
+type DriverPreferences struct {
+	Drivers    []ServedDriver `json:"drivers"`
+	MaxBlocked int            `json:"max_blocked"`
+}
+
+// handleGetDriverPreferences lists the drivers who've served the customer
+// and how they feel about each
+func (h *DriverPreferenceHandler) handleGetDriverPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT u.id, u.first_name || ' ' || LEFT(u.last_name, 1) || '.',
+		       COUNT(*), MAX(COALESCE(ro.actual_time, ro.created_at)), p.preference, p.reason
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		JOIN orders o ON ro.order_id = o.id
+		JOIN users u ON u.id = dr.driver_id
+		LEFT JOIN driver_preferences p ON p.user_id = o.user_id AND p.driver_id = u.id
+		WHERE o.user_id = $1 AND ro.status = 'completed'
+		GROUP BY u.id, u.first_name, u.last_name, p.preference, p.reason
+		ORDER BY MAX(COALESCE(ro.actual_time, ro.created_at)) DESC`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch drivers", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	prefs := DriverPreferences{Drivers: []ServedDriver{}, MaxBlocked: maxBlockedDrivers}
+	for rows.Next() {
+		var d ServedDriver
+		var preference, reason sql.NullString
+		if err := rows.Scan(&d.DriverID, &d.DriverName, &d.Stops, &d.LastServedAt, &preference, &reason); err != nil {
+			http.Error(w, "Failed to fetch drivers", http.StatusInternalServerError)
+			return
+		}
+		if preference.Valid {
+			d.Preference = &preference.String
+		}
+		if reason.Valid {
+			d.Reason = &reason.String
+		}
+		prefs.Drivers = append(prefs.Drivers, d)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to fetch drivers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+type SetDriverPreferenceRequest struct {
+	Preference string  `json:"preference"` // "favorite" or "blocked"
+	Reason     *string `json:"reason,omitempty"`
+}
+
+// handleSetDriverPreference favorites or blocks a driver who has served the
+// customer. Blocking a driver already routed to one of their stops raises
+// it for dispatch to swap.
+func (h *DriverPreferenceHandler) handleSetDriverPreference(w http.ResponseWriter, r *http.Request) {
+	driverID, err := strconv.Atoi(mux.Vars(r)["driverId"])
+	if err != nil {
+		http.Error(w, "Invalid driver ID", http.StatusBadRequest)
+		return
+	}
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req SetDriverPreferenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Preference != driverPreferenceFavorite && req.Preference != driverPreferenceBlocked {
+		http.Error(w, "preference must be favorite or blocked", http.StatusBadRequest)
+		return
+	}
+	if req.Reason != nil {
+		trimmed := strings.TrimSpace(*req.Reason)
+		req.Reason = &trimmed
+		if trimmed == "" {
+			req.Reason = nil
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Serialize a customer's changes so the block limit holds
+	if _, err := tx.Exec("SELECT id FROM users WHERE id = $1 FOR UPDATE", userID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var served bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM route_orders ro
+			JOIN driver_routes dr ON ro.route_id = dr.id
+			JOIN orders o ON ro.order_id = o.id
+			WHERE o.user_id = $1 AND dr.driver_id = $2 AND ro.status = 'completed'
+		)`,
+		userID, driverID,
+	).Scan(&served)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !served {
+		http.Error(w, "You can only choose drivers who have served you", http.StatusNotFound)
+		return
+	}
+
+	if req.Preference == driverPreferenceBlocked {
+		var blocked int
+		err := tx.QueryRow(`
+			SELECT COUNT(*) FROM driver_preferences
+			WHERE user_id = $1 AND driver_id <> $2 AND preference = 'blocked'`,
+			userID, driverID,
+		).Scan(&blocked)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if blocked >= maxBlockedDrivers {
+			http.Error(w, fmt.Sprintf("You can block at most %d drivers", maxBlockedDrivers), http.StatusConflict)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO driver_preferences (user_id, driver_id, preference, reason)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, driver_id) DO UPDATE
+		SET preference = EXCLUDED.preference, reason = EXCLUDED.reason, updated_at = CURRENT_TIMESTAMP`,
+		userID, driverID, req.Preference, req.Reason,
+	)
+	if err != nil {
+		http.Error(w, "Failed to save preference", http.StatusInternalServerError)
+		return
+	}
+
+	var routed []int
+	if req.Preference == driverPreferenceBlocked {
+		if routed, err = routedOrdersBlockingDriver(tx, userID, driverID); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to save preference", http.StatusInternalServerError)
+		return
+	}
+
+	for _, orderID := range routed {
+		logAdminAlert(h.db, AdminAlert{
+			Type:      "blocked_driver_routed",
+			Severity:  "warning",
+			Title:     fmt.Sprintf("Order #%d is routed to a driver its customer blocked", orderID),
+			Message:   "The customer blocked the driver on this order's upcoming stop; reassign the stop or the route",
+			OrderID:   &orderID,
+			DedupeKey: fmt.Sprintf("blocked_driver_routed:%d:%d", orderID, driverID),
+			Data:      map[string]interface{}{"driver_id": driverID, "user_id": userID},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"driver_id":  driverID,
+		"preference": req.Preference,
+		"reason":     req.Reason,
+	})
+}
+
+// handleDeleteDriverPreference clears a favorite or block
+func (h *DriverPreferenceHandler) handleDeleteDriverPreference(w http.ResponseWriter, r *http.Request) {
+	driverID, err := strconv.Atoi(mux.Vars(r)["driverId"])
+	if err != nil {
+		http.Error(w, "Invalid driver ID", http.StatusBadRequest)
+		return
+	}
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM driver_preferences WHERE user_id = $1 AND driver_id = $2", userID, driverID)
+	if err != nil {
+		http.Error(w, "Failed to clear preference", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Preference not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// routedOrdersBlockingDriver returns the customer's orders with a pending
+// stop on one of the driver's open routes
+func routedOrdersBlockingDriver(q queryer, userID, driverID int) ([]int, error) {
+	rows, err := q.Query(`
+		SELECT DISTINCT o.id FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		JOIN orders o ON ro.order_id = o.id
+		WHERE o.user_id = $1 AND dr.driver_id = $2 AND ro.status = 'pending'
+		  AND dr.status <> ALL($3)
+		ORDER BY o.id`,
+		userID, driverID, pq.Array(closedRouteStatuses),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var orderIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		orderIDs = append(orderIDs, id)
+	}
+	return orderIDs, rows.Err()
+}
+
+// ordersBlockingDriver returns which of orderIDs belong to customers who've
+// blocked the driver. Routes are never given a driver with any.
+func ordersBlockingDriver(q queryer, driverID int, orderIDs []int) ([]int, error) {
+	rows, err := q.Query(`
+		SELECT o.id FROM orders o
+		JOIN driver_preferences p ON p.user_id = o.user_id AND p.driver_id = $1 AND p.preference = 'blocked'
+		WHERE o.id = ANY($2)
+		ORDER BY o.id`,
+		driverID, pq.Array(orderIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var blocked []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		blocked = append(blocked, id)
+	}
+	return blocked, rows.Err()
+}
+
+// DriverPreferenceStats is how customers feel about a driver. A high block
+// rate is a quality signal worth a closer look.
+type DriverPreferenceStats struct {
+	DriverID        int      `json:"driver_id"`
+	DriverName      string   `json:"driver_name"`
+	CustomersServed int      `json:"customers_served"`
+	FavoritedBy     int      `json:"favorited_by"`
+	BlockedBy       int      `json:"blocked_by"`
+	BlockRate       *float64 `json:"block_rate"`
+	// RecentBlockReasons are the latest reasons customers gave
+	RecentBlockReasons []string `json:"recent_block_reasons"`
+}
+
+// handleGetDriverPreferenceStats reports each driver's favorites and blocks
+// against the customers they served recently, highest block rate first
+func (h *AdminHandler) handleGetDriverPreferenceStats(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT u.id, u.first_name || ' ' || u.last_name,
+		       (SELECT COUNT(DISTINCT o.user_id) FROM route_orders ro
+		        JOIN driver_routes dr ON ro.route_id = dr.id
+		        JOIN orders o ON ro.order_id = o.id
+		        WHERE dr.driver_id = u.id AND ro.status = 'completed' AND dr.route_date >= $1),
+		       COUNT(p.user_id) FILTER (WHERE p.preference = 'favorite'),
+		       COUNT(p.user_id) FILTER (WHERE p.preference = 'blocked'),
+		       ARRAY(SELECT reason FROM driver_preferences
+		             WHERE driver_id = u.id AND preference = 'blocked' AND reason IS NOT NULL
+		             ORDER BY updated_at DESC LIMIT 5)
+		FROM users u
+		LEFT JOIN driver_preferences p ON p.driver_id = u.id
+		WHERE u.role = 'driver'
+		GROUP BY u.id, u.first_name, u.last_name
+		ORDER BY u.id`,
+		time.Now().Add(-driverBlockRateWindow).Format("2006-01-02"),
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch driver preferences", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	stats := []DriverPreferenceStats{}
+	for rows.Next() {
+		var s DriverPreferenceStats
+		var reasons pq.StringArray
+		if err := rows.Scan(&s.DriverID, &s.DriverName, &s.CustomersServed, &s.FavoritedBy, &s.BlockedBy, &reasons); err != nil {
+			http.Error(w, "Failed to fetch driver preferences", http.StatusInternalServerError)
+			return
+		}
+		if s.CustomersServed > 0 {
+			rate := float64(s.BlockedBy) / float64(s.CustomersServed)
+			s.BlockRate = &rate
+		}
+		s.RecentBlockReasons = []string(reasons)
+		if s.RecentBlockReasons == nil {
+			s.RecentBlockReasons = []string{}
+		}
+		stats = append(stats, s)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to fetch driver preferences", http.StatusInternalServerError)
+		return
+	}
+
+	rate := func(s DriverPreferenceStats) float64 {
+		if s.BlockRate == nil {
+			return -1
+		}
+		return *s.BlockRate
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return rate(stats[i]) > rate(stats[j]) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
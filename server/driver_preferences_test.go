@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDriverPreferences(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "prefs-admin@example.com", "Prefs", "Admin")
+	customerID := db.CreateTestUser(t, "prefs-customer@example.com", "Prefs", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	driver := func(email, first string) int {
+		id := db.CreateTestUser(t, email, first, "Driver")
+		db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", id)
+		db.CompleteTestDriverOnboarding(t, id)
+		return id
+	}
+	blockedID := driver("blocked-driver@example.com", "Blocked")
+	favoriteID := driver("favorite-driver@example.com", "Favorite")
+	strangerID := driver("stranger-driver@example.com", "Stranger")
+
+	// Both drivers have made one of the customer's stops
+	for _, driverID := range []int{blockedID, favoriteID} {
+		var routeID int
+		db.QueryRow(`
+			INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+			VALUES ($1, CURRENT_DATE - 7, 'pickup', 'completed') RETURNING id`, driverID).Scan(&routeID)
+		db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number, status) VALUES ($1, $2, 1, 'completed')",
+			routeID, db.CreateTestOrder(t, customerID, addressID))
+	}
+
+	prefs := &DriverPreferenceHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest}
+	set := func(driverID int, preference string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		prefs.handleSetDriverPreference(w, mux.SetURLVars(
+			httptest.NewRequest("PUT", "/api/v1/driver-preferences/x", strings.NewReader(`{"preference": "`+preference+`", "reason": "Left bags in the rain"}`)),
+			map[string]string{"driverId": fmt.Sprint(driverID)},
+		))
+		return w
+	}
+	if w := set(strangerID, driverPreferenceBlocked); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d blocking a driver who never served the customer, got %d", http.StatusNotFound, w.Code)
+	}
+	for driverID, preference := range map[int]string{blockedID: driverPreferenceBlocked, favoriteID: driverPreferenceFavorite} {
+		if w := set(driverID, preference); w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	prefs.handleGetDriverPreferences(w, httptest.NewRequest("GET", "/api/v1/driver-preferences", nil))
+	var listed DriverPreferences
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed.Drivers) != 2 || listed.Drivers[0].Preference == nil {
+		t.Fatalf("Expected both drivers listed with preferences, got %s", w.Body.String())
+	}
+
+	// The next order's route never goes to the blocked driver
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	suggestions, err := suggestDrivers(db.DB, []int{orderID}, "2026-11-02", "pickup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suggestions) != 2 || suggestions[0].DriverID != favoriteID || suggestions[0].FavoritedBy != 1 {
+		t.Errorf("Expected the favorite first and the blocked driver left out, got %+v", suggestions)
+	}
+	admin := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	body, _ := json.Marshal(map[string]interface{}{
+		"driver_id": blockedID, "order_ids": []int{orderID}, "route_date": "2026-11-02", "route_type": "pickup",
+	})
+	w = httptest.NewRecorder()
+	admin.handleAssignDriverToRoute(w, httptest.NewRequest("POST", "/api/v1/admin/routes/assign", bytes.NewBuffer(body)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d assigning a blocked driver, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	admin.handleGetDriverPreferenceStats(w, httptest.NewRequest("GET", "/api/v1/admin/drivers/preferences", nil))
+	var stats []DriverPreferenceStats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if len(stats) == 0 || stats[0].DriverID != blockedID || stats[0].BlockRate == nil || *stats[0].BlockRate != 1 ||
+		len(stats[0].RecentBlockReasons) != 1 {
+		t.Errorf("Expected the blocked driver first with a full block rate, got %s", w.Body.String())
+	}
+}
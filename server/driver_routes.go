@@ -4,15 +4,22 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
+
+	"tumble-backend/storage"
+
+	"github.com/lib/pq"
 )
 
 type DriverRouteHandler struct {
 	db        *sql.DB
 	realtime  RealtimeInterface
 	getUserID func(*http.Request, *sql.DB) (int, error)
+	// store keeps delivery signatures
+	store storage.Store
 }
 
 func NewDriverRouteHandler(db *sql.DB, realtime RealtimeInterface) *DriverRouteHandler {
@@ -30,10 +37,26 @@ type DriverRoute struct {
 	RouteType    string                 `json:"route_type"`
 	Status       string                 `json:"status"`
 	Orders       []RouteOrder           `json:"orders"`
+	Breaks       []RouteBreak           `json:"breaks"`
 	CreatedAt    time.Time              `json:"created_at"`
 	UpdatedAt    time.Time              `json:"updated_at"`
 }
 
+// closedRouteStatuses are route statuses after which drivers lose access to
+// customer details on the route's stops
+var closedRouteStatuses = []string{"completed", "cancelled"}
+
+func isClosedRouteStatus(status string) bool {
+	for _, s := range closedRouteStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteOrder is a stop as seen by the driver. Customer details are only
+// populated while the route is active and are blank once it closes.
 type RouteOrder struct {
 	ID             int     `json:"id"`
 	OrderID        int     `json:"order_id"`
@@ -43,8 +66,24 @@ type RouteOrder struct {
 	CustomerPhone  string  `json:"customer_phone"`
 	Address        string  `json:"address"`
 	SpecialInstructions *string `json:"special_instructions,omitempty"`
+	DeliveryInstructions *string `json:"delivery_instructions,omitempty"`
 	PickupTimeSlot *string `json:"pickup_time_slot,omitempty"`
 	DeliveryTimeSlot *string `json:"delivery_time_slot,omitempty"`
+	EstimatedTime  *string `json:"estimated_time,omitempty"`
+	// RequiresSignature is set on delivery stops for accounts that need a
+	// signature captured before the stop can be completed
+	RequiresSignature bool `json:"requires_signature"`
+	Signed         bool    `json:"signed"`
+	PhotoCount     int     `json:"photo_count"`
+	// SafetyAlert is set when a driver has reported this stop's address and
+	// the report wasn't dismissed
+	SafetyAlert bool `json:"safety_alert"`
+	// Locker is the locker or pickup point a delivery goes to instead of
+	// the customer's address
+	Locker *string `json:"locker,omitempty"`
+	// CareOptions are the customer's laundry preferences per order line,
+	// e.g. "Bedding: hang dry, cold wash"
+	CareOptions []string `json:"care_options,omitempty"`
 }
 
 // requireDriver middleware
@@ -125,6 +164,10 @@ func (h *DriverRouteHandler) handleGetDriverRoutes(w http.ResponseWriter, r *htt
 
 		// Get orders for this route
 		route.Orders, _ = h.getRouteOrders(route.ID)
+		route.Breaks, err = getRouteBreaks(h.db, route.ID)
+		if err != nil {
+			route.Breaks = []RouteBreak{}
+		}
 		routes = append(routes, route)
 	}
 
@@ -132,14 +175,16 @@ func (h *DriverRouteHandler) handleGetDriverRoutes(w http.ResponseWriter, r *htt
 	json.NewEncoder(w).Encode(routes)
 }
 
-// getRouteOrders fetches orders for a specific route
+// getRouteOrders fetches orders for a specific route. Customer details are
+// redacted in the query itself once the route is completed or cancelled.
 func (h *DriverRouteHandler) getRouteOrders(routeID int) ([]RouteOrder, error) {
 	query := `
 		SELECT 
 			ro.id, ro.order_id, ro.sequence_number, ro.status,
-			u.first_name || ' ' || u.last_name as customer_name,
-			COALESCE(u.phone, '') as customer_phone,
+			CASE WHEN dr.status = ANY($2) THEN '' ELSE u.first_name || ' ' || u.last_name END as customer_name,
+			CASE WHEN dr.status = ANY($2) THEN '' ELSE COALESCE(u.phone, '') END as customer_phone,
 			CASE 
+				WHEN dr.status = ANY($2) THEN ''
 				WHEN o.pickup_address_id IS NOT NULL THEN 
 					(SELECT street_address || ', ' || city || ', ' || state || ' ' || zip_code 
 					 FROM addresses WHERE id = o.pickup_address_id)
@@ -147,17 +192,32 @@ func (h *DriverRouteHandler) getRouteOrders(routeID int) ([]RouteOrder, error) {
 					(SELECT street_address || ', ' || city || ', ' || state || ' ' || zip_code 
 					 FROM addresses WHERE id = o.delivery_address_id)
 			END as address,
-			o.special_instructions,
+			CASE WHEN dr.status = ANY($2) THEN NULL ELSE o.special_instructions END,
+			CASE WHEN dr.status = ANY($2) THEN NULL ELSE o.delivery_instructions END,
 			o.pickup_time_slot,
-			o.delivery_time_slot
+			o.delivery_time_slot,
+			TO_CHAR(ro.estimated_time, 'HH24:MI'),
+			dr.route_type = 'delivery' AND u.requires_delivery_signature
+				AND NOT EXISTS(SELECT 1 FROM locker_reservations lr WHERE lr.order_id = o.id AND lr.status = 'reserved'),
+			EXISTS(SELECT 1 FROM delivery_signatures ds WHERE ds.route_order_id = ro.id),
+			(SELECT COUNT(*) FROM stop_photos sp WHERE sp.route_order_id = ro.id),
+			EXISTS(
+				SELECT 1 FROM safety_reports sr
+				WHERE sr.status != 'dismissed' AND sr.address_key = `+addressKeyExpr("sa")+`
+			),
+			(SELECT pl.name || ', ' || pl.street_address || ', ' || pl.city
+			 FROM locker_reservations lr JOIN pickup_locations pl ON lr.location_id = pl.id
+			 WHERE lr.order_id = o.id AND dr.route_type = 'delivery' AND lr.status IN `+activeLockerStatuses+`)
 		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
 		JOIN orders o ON ro.order_id = o.id
 		JOIN users u ON o.user_id = u.id
+		LEFT JOIN addresses sa ON sa.id = CASE WHEN dr.route_type = 'pickup' THEN o.pickup_address_id ELSE o.delivery_address_id END
 		WHERE ro.route_id = $1
 		ORDER BY ro.sequence_number ASC
 	`
 
-	rows, err := h.db.Query(query, routeID)
+	rows, err := h.db.Query(query, routeID, pq.Array(closedRouteStatuses))
 	if err != nil {
 		return nil, err
 	}
@@ -169,7 +229,9 @@ func (h *DriverRouteHandler) getRouteOrders(routeID int) ([]RouteOrder, error) {
 		err := rows.Scan(
 			&order.ID, &order.OrderID, &order.SequenceNumber, &order.Status,
 			&order.CustomerName, &order.CustomerPhone, &order.Address,
-			&order.SpecialInstructions, &order.PickupTimeSlot, &order.DeliveryTimeSlot,
+			&order.SpecialInstructions, &order.DeliveryInstructions, &order.PickupTimeSlot, &order.DeliveryTimeSlot,
+			&order.EstimatedTime, &order.RequiresSignature, &order.Signed, &order.PhotoCount, &order.SafetyAlert,
+			&order.Locker,
 		)
 		if err != nil {
 			// Log error for debugging - likely NULL values in optional fields
@@ -178,6 +240,18 @@ func (h *DriverRouteHandler) getRouteOrders(routeID int) ([]RouteOrder, error) {
 		orders = append(orders, order)
 	}
 
+	orderIDs := make([]int, len(orders))
+	for i, order := range orders {
+		orderIDs[i] = order.OrderID
+	}
+	care, err := orderCareOptions(h.db, orderIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range orders {
+		orders[i].CareOptions = care[orders[i].OrderID]
+	}
+
 	return orders, nil
 }
 
@@ -216,27 +290,20 @@ func (h *DriverRouteHandler) handleUpdateRouteOrderStatus(w http.ResponseWriter,
 	}
 
 	// Validate status (must match database constraint)
-	validStatuses := []string{"pending", "completed", "failed"}
-	isValid := false
-	for _, status := range validStatuses {
-		if req.Status == status {
-			isValid = true
-			break
-		}
-	}
-	if !isValid {
+	if !isValidRouteOrderStatus(req.Status) {
 		http.Error(w, "Invalid status", http.StatusBadRequest)
 		return
 	}
 
 	// Verify this route order belongs to the driver
 	var routeDriverID int
+	var routeStatus string
 	err = h.db.QueryRow(`
-		SELECT dr.driver_id 
+		SELECT dr.driver_id, dr.status
 		FROM route_orders ro 
 		JOIN driver_routes dr ON ro.route_id = dr.id 
 		WHERE ro.id = $1
-	`, routeOrderID).Scan(&routeDriverID)
+	`, routeOrderID).Scan(&routeDriverID, &routeStatus)
 
 	if err != nil {
 		http.Error(w, "Route order not found", http.StatusNotFound)
@@ -248,6 +315,23 @@ func (h *DriverRouteHandler) handleUpdateRouteOrderStatus(w http.ResponseWriter,
 		return
 	}
 
+	if isClosedRouteStatus(routeStatus) {
+		http.Error(w, "Route is closed", http.StatusForbidden)
+		return
+	}
+
+	if req.Status == "completed" {
+		required, err := signatureRequired(h.db, routeOrderID)
+		if err != nil {
+			http.Error(w, "Failed to check signature", http.StatusInternalServerError)
+			return
+		}
+		if required {
+			http.Error(w, "A signature is required before this delivery can be completed", http.StatusConflict)
+			return
+		}
+	}
+
 	// Begin transaction
 	tx, err := h.db.Begin()
 	if err != nil {
@@ -257,7 +341,13 @@ func (h *DriverRouteHandler) handleUpdateRouteOrderStatus(w http.ResponseWriter,
 	defer tx.Rollback()
 
 	// Update route order status
-	_, err = tx.Exec("UPDATE route_orders SET status = $1 WHERE id = $2", req.Status, routeOrderID)
+	// Record when the stop was finished so on-time performance can be scored
+	_, err = tx.Exec(`
+		UPDATE route_orders
+		SET status = $1, actual_time = CASE WHEN $3 THEN NULL ELSE CURRENT_TIMESTAMP END
+		WHERE id = $2`,
+		req.Status, routeOrderID, req.Status == "pending",
+	)
 	if err != nil {
 		http.Error(w, "Failed to update status", http.StatusInternalServerError)
 		return
@@ -290,18 +380,37 @@ func (h *DriverRouteHandler) handleUpdateRouteOrderStatus(w http.ResponseWriter,
 				return
 			}
 
+			// Orders left in a locker get their access code now
+			if newOrderStatus == "delivered" {
+				if _, err := dropOffLocker(tx, orderID); err != nil {
+					http.Error(w, "Failed to record locker drop-off", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			if newOrderStatus == "failed" {
+				err = raiseAdminAlert(tx, AdminAlert{
+					Type:      "order_failed",
+					Severity:  "warning",
+					Title:     fmt.Sprintf("Order #%d failed %s", orderID, routeType),
+					Message:   fmt.Sprintf("The driver marked order #%d's %s stop as failed", orderID, routeType),
+					OrderID:   &orderID,
+					DedupeKey: fmt.Sprintf("order_failed:%d", orderID),
+				})
+				if err != nil {
+					http.Error(w, "Failed to update order status", http.StatusInternalServerError)
+					return
+				}
+			}
+
 			// Send real-time update
 			if h.realtime != nil {
 				// Get user ID for the order
 				var orderUserID int
 				err = tx.QueryRow("SELECT user_id FROM orders WHERE id = $1", orderID).Scan(&orderUserID)
 				if err == nil {
-					statusMessage := fmt.Sprintf("Order status updated to %s", newOrderStatus)
-					if req.Status == "failed" {
-						statusMessage = "Pickup/delivery failed - our team will contact you to resolve this issue"
-					}
-					h.realtime.PublishOrderUpdate(orderUserID, orderID, newOrderStatus, 
-						statusMessage, nil)
+					h.realtime.PublishOrderUpdate(orderUserID, orderID, newOrderStatus,
+						orderStatusMessage(newOrderStatus), nil)
 				}
 			}
 		}
@@ -357,14 +466,94 @@ func (h *DriverRouteHandler) handleStartRoute(w http.ResponseWriter, r *http.Req
 	}
 
 	// Update route status to in_progress
-	_, err = h.db.Exec("UPDATE driver_routes SET status = 'in_progress' WHERE id = $1", routeID)
+	_, err = h.db.Exec(`
+		UPDATE driver_routes SET status = 'in_progress', actual_start_time = COALESCE(actual_start_time, CURRENT_TIMESTAMP)
+		WHERE id = $1`,
+		routeID,
+	)
 	if err != nil {
 		http.Error(w, "Failed to start route", http.StatusInternalServerError)
 		return
 	}
 
+	// Starting a route counts as a heartbeat, so silence is measured from here
+	if err := recordDriverHeartbeat(h.db, driverID, DriverHeartbeatRequest{RouteID: &routeID}); err != nil {
+		log.Printf("Error recording heartbeat for driver %d: %v", driverID, err)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "Route started successfully",
 	})
-}
\ No newline at end of file
+}
+// handleCompleteRoute closes a route once all of its stops are finished.
+// After this the driver can no longer see customer details for its stops.
+func (h *DriverRouteHandler) handleCompleteRoute(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	routeID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	// Verify this route belongs to the driver
+	var routeDriverID int
+	var routeStatus string
+	err = h.db.QueryRow("SELECT driver_id, status FROM driver_routes WHERE id = $1", routeID).Scan(&routeDriverID, &routeStatus)
+	if err != nil {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+
+	if routeDriverID != driverID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if isClosedRouteStatus(routeStatus) {
+		http.Error(w, "Route is already closed", http.StatusConflict)
+		return
+	}
+
+	var pendingStops int
+	err = h.db.QueryRow("SELECT COUNT(*) FROM route_orders WHERE route_id = $1 AND status = 'pending'", routeID).Scan(&pendingStops)
+	if err != nil {
+		http.Error(w, "Failed to check route stops", http.StatusInternalServerError)
+		return
+	}
+	if pendingStops > 0 {
+		http.Error(w, "Route still has pending stops", http.StatusConflict)
+		return
+	}
+
+	// The shift ends here, including any break the driver forgot to end
+	_, err = h.db.Exec(`
+		WITH ended AS (
+			UPDATE route_breaks SET actual_end = CURRENT_TIMESTAMP
+			WHERE route_id = $1 AND actual_start IS NOT NULL AND actual_end IS NULL
+		)
+		UPDATE driver_routes SET status = 'completed', actual_end_time = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		routeID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to complete route", http.StatusInternalServerError)
+		return
+	}
+	refreshDriverStatsAfter(h.db, driverID, "route completion")
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Route completed successfully",
+	})
+}
@@ -8,6 +8,8 @@ import (
 	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
 func TestDriverRouteHandler_RequireDriver(t *testing.T) {
@@ -421,4 +423,153 @@ func TestDriverRouteHandler_GetRouteOrders(t *testing.T) {
 	if orders[0].CustomerName == "" {
 		t.Error("Expected customer name to be populated")
 	}
-}
\ No newline at end of file
+}
+
+func TestDriverRouteHandler_ClosedRouteRedaction(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverUserID := db.CreateTestUser(t, "driver@example.com", "Driver", "User")
+	_, err := db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverUserID)
+	if err != nil {
+		t.Fatalf("Failed to create driver user: %v", err)
+	}
+
+	userID := db.CreateTestUser(t, "user@example.com", "Test", "User")
+	addressID := db.CreateTestAddress(t, userID)
+	orderID := db.CreateTestOrder(t, userID, addressID)
+
+	handler := NewDriverRouteHandler(db.DB, NewMockRealtimeHandler())
+	authMock := CreateAuthMock(driverUserID)
+	handler.getUserID = authMock.getUserIDFromRequest
+
+	today := time.Now().Format("2006-01-02")
+	var routeID, routeOrderID int
+	err = db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, $2, 'pickup', 'in_progress')
+		RETURNING id
+	`, driverUserID, today).Scan(&routeID)
+	if err != nil {
+		t.Fatalf("Failed to create test route: %v", err)
+	}
+	err = db.QueryRow(`
+		INSERT INTO route_orders (route_id, order_id, sequence_number, status)
+		VALUES ($1, $2, 1, 'pending')
+		RETURNING id
+	`, routeID, orderID).Scan(&routeOrderID)
+	if err != nil {
+		t.Fatalf("Failed to create route order: %v", err)
+	}
+
+	completeRoute := func() int {
+		req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/driver/routes/complete?id=%d", routeID), nil)
+		w := httptest.NewRecorder()
+		handler.handleCompleteRoute(w, req)
+		return w.Code
+	}
+
+	// Route can't be completed while stops are pending
+	if code := completeRoute(); code != http.StatusConflict {
+		t.Errorf("Expected status %d with pending stops, got %d", http.StatusConflict, code)
+	}
+
+	// Customer details are visible while the route is active
+	orders, err := handler.getRouteOrders(routeID)
+	if err != nil || len(orders) != 1 {
+		t.Fatalf("Failed to get route orders: %v", err)
+	}
+	if orders[0].CustomerName == "" || orders[0].Address == "" {
+		t.Error("Expected customer details on an active route")
+	}
+
+	if _, err := db.Exec("UPDATE route_orders SET status = 'completed' WHERE id = $1", routeOrderID); err != nil {
+		t.Fatalf("Failed to complete stop: %v", err)
+	}
+	if code := completeRoute(); code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+
+	// Customer details are redacted once the route is closed
+	orders, err = handler.getRouteOrders(routeID)
+	if err != nil || len(orders) != 1 {
+		t.Fatalf("Failed to get route orders: %v", err)
+	}
+	if orders[0].CustomerName != "" || orders[0].CustomerPhone != "" || orders[0].Address != "" || orders[0].SpecialInstructions != nil {
+		t.Errorf("Expected customer details to be redacted, got %+v", orders[0])
+	}
+
+	// Stops on a closed route can no longer be updated
+	body, _ := json.Marshal(map[string]string{"status": "failed"})
+	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/driver/routes/orders/status?id=%d", routeOrderID), bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	handler.handleUpdateRouteOrderStatus(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d on closed route, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestRouteManifestHandler_ClosedRouteRedaction(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverUserID := db.CreateTestUser(t, "manifest-driver@example.com", "Driver", "User")
+	if _, err := db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverUserID); err != nil {
+		t.Fatalf("Failed to create driver user: %v", err)
+	}
+	userID := db.CreateTestUser(t, "manifest-customer@example.com", "Test", "User")
+	addressID := db.CreateTestAddress(t, userID)
+	orderID := db.CreateTestOrder(t, userID, addressID)
+	if _, err := db.Exec("UPDATE orders SET special_instructions = 'Gate code 1234' WHERE id = $1", orderID); err != nil {
+		t.Fatalf("Failed to set instructions: %v", err)
+	}
+
+	var routeID int
+	err := db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'in_progress')
+		RETURNING id
+	`, driverUserID).Scan(&routeID)
+	if err != nil {
+		t.Fatalf("Failed to create test route: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number, status) VALUES ($1, $2, 1, 'completed')", routeID, orderID); err != nil {
+		t.Fatalf("Failed to create route order: %v", err)
+	}
+
+	handler := NewRouteManifestHandler(db.DB)
+	handler.getUserID = CreateAuthMock(driverUserID).getUserIDFromRequest
+	getManifest := func() RouteManifest {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/driver/routes/%d/manifest", routeID), nil)
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(routeID)})
+		w := httptest.NewRecorder()
+		handler.handleGetDriverRouteManifest(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var manifest RouteManifest
+		json.NewDecoder(w.Body).Decode(&manifest)
+		if len(manifest.Stops) != 1 {
+			t.Fatalf("Expected 1 stop, got %d", len(manifest.Stops))
+		}
+		return manifest
+	}
+
+	// Customer details are on the manifest while the route is active
+	stop := getManifest().Stops[0]
+	if stop.CustomerName == "" || stop.Address == "" || len(stop.Instructions) == 0 || stop.Navigation == nil {
+		t.Errorf("Expected customer details on an active route, got %+v", stop)
+	}
+
+	if _, err := db.Exec("UPDATE driver_routes SET status = 'completed' WHERE id = $1", routeID); err != nil {
+		t.Fatalf("Failed to complete route: %v", err)
+	}
+
+	// They're redacted once the route is closed
+	manifest := getManifest()
+	stop = manifest.Stops[0]
+	if stop.CustomerName != "" || stop.Phone != "" || stop.Address != "" || len(stop.Instructions) != 0 ||
+		stop.Navigation != nil || manifest.Navigation != "" {
+		t.Errorf("Expected customer details to be redacted, got %+v", manifest)
+	}
+}
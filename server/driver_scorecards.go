@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type DriverScorecardHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewDriverScorecardHandler(db *sql.DB) *DriverScorecardHandler {
+	return &DriverScorecardHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// DriverScorecard summarizes a driver's performance for one week. Metrics that
+// have no data yet (no ratings or photos collected) are nil and left out of the score.
+type DriverScorecard struct {
+	DriverID        int      `json:"driver_id"`
+	DriverName      string   `json:"driver_name"`
+	WeekStart       string   `json:"week_start"`
+	StopsAttempted  int      `json:"stops_attempted"`
+	StopsCompleted  int      `json:"stops_completed"`
+	OnTimeRate      *float64 `json:"on_time_rate"`
+	Rating          *float64 `json:"rating"`
+	PhotoCompliance *float64 `json:"photo_compliance"`
+	ClaimsRate      *float64 `json:"claims_rate"`
+	Score           float64  `json:"score"`
+	Tier            string   `json:"tier"`
+	RoutePriority   int      `json:"route_priority"`
+}
+
+// Scorecard weights; missing metrics are dropped and the rest renormalized
+const (
+	scorecardOnTimeWeight = 0.5
+	scorecardRatingWeight = 0.2
+	scorecardPhotoWeight  = 0.1
+	scorecardClaimsWeight = 0.2
+	// Drivers need this many stops in a week before they're ranked into a tier
+	scorecardMinStops = 5
+	// Stops finished this long after their estimated time still count as on time
+	scorecardOnTimeGrace = 30 * time.Minute
+)
+
+// scorecardTiers map minimum scores to tiers. Lower route priority numbers
+// are offered routes first.
+var scorecardTiers = []struct {
+	MinScore      float64
+	Tier          string
+	RoutePriority int
+}{
+	{0.95, "platinum", 1},
+	{0.90, "gold", 2},
+	{0.80, "silver", 3},
+	{0, "bronze", 4},
+}
+
+// computeScorecardScore combines the available metrics into a 0-1 score
+func computeScorecardScore(card DriverScorecard) float64 {
+	var total, weights float64
+	if card.OnTimeRate != nil {
+		total += *card.OnTimeRate * scorecardOnTimeWeight
+		weights += scorecardOnTimeWeight
+	}
+	if card.Rating != nil {
+		// Ratings are 1-5 stars
+		total += (*card.Rating / 5) * scorecardRatingWeight
+		weights += scorecardRatingWeight
+	}
+	if card.PhotoCompliance != nil {
+		total += *card.PhotoCompliance * scorecardPhotoWeight
+		weights += scorecardPhotoWeight
+	}
+	if card.ClaimsRate != nil {
+		total += (1 - *card.ClaimsRate) * scorecardClaimsWeight
+		weights += scorecardClaimsWeight
+	}
+	if weights == 0 {
+		return 0
+	}
+	return total / weights
+}
+
+// scorecardTier returns the tier and route priority for a score. Drivers with
+// too few stops are unranked and get the lowest priority.
+func scorecardTier(score float64, stopsAttempted int) (string, int) {
+	if stopsAttempted < scorecardMinStops {
+		return "unranked", len(scorecardTiers) + 1
+	}
+	for _, t := range scorecardTiers {
+		if score >= t.MinScore {
+			return t.Tier, t.RoutePriority
+		}
+	}
+	return "unranked", len(scorecardTiers) + 1
+}
+
+// weekStartFor returns the Monday of the week requested via ?week=YYYY-MM-DD,
+// defaulting to the current week
+func weekStartFor(r *http.Request) (time.Time, error) {
+	day := time.Now()
+	if week := r.URL.Query().Get("week"); week != "" {
+		parsed, err := time.Parse("2006-01-02", week)
+		if err != nil {
+			return time.Time{}, err
+		}
+		day = parsed
+	}
+	offset := (int(day.Weekday()) + 6) % 7 // days since Monday
+	return time.Date(day.Year(), day.Month(), day.Day()-offset, 0, 0, 0, 0, time.UTC), nil
+}
+
+// getScorecards computes scorecards for the week starting at weekStart. When
+// driverID is non-zero only that driver is included.
+func getScorecards(db *sql.DB, weekStart time.Time, driverID int) ([]DriverScorecard, error) {
+	weekEnd := weekStart.AddDate(0, 0, 7)
+
+	rows, err := db.Query(`
+		SELECT
+			u.id, u.first_name || ' ' || u.last_name,
+			COUNT(ro.id) FILTER (WHERE ro.status IN ('completed', 'failed')) as attempted,
+			COUNT(ro.id) FILTER (WHERE ro.status = 'completed') as completed,
+			COUNT(ro.id) FILTER (WHERE ro.status = 'completed' AND (
+				ro.estimated_time IS NULL OR ro.actual_time IS NULL OR
+				ro.actual_time <= dr.route_date + ro.estimated_time + $3::interval
+			)) as on_time,
+			COUNT(ro.id) FILTER (WHERE EXISTS (
+				SELECT 1 FROM order_resolutions res
+				WHERE res.order_id = ro.order_id
+				  AND res.resolution_type IN ('partial_refund', 'full_refund', 'credit')
+			)) as claims,
+			COUNT(ro.id) FILTER (WHERE ro.status = 'completed' AND EXISTS (
+				SELECT 1 FROM stop_photos sp WHERE sp.route_order_id = ro.id
+			)) as photographed,
+			COUNT(ro.id) FILTER (WHERE ro.status = 'completed' AND EXISTS (
+				SELECT 1 FROM stop_photos sp WHERE sp.route_order_id = ro.id AND sp.quality_issues = '{}'
+			)) as photo_compliant,
+			(SELECT AVG(COALESCE(rt.driver_rating, rt.rating)) FROM order_ratings rt
+			 WHERE rt.driver_id = u.id AND rt.hidden_at IS NULL
+			   AND rt.created_at >= $1 AND rt.created_at < $2) as rating
+		FROM users u
+		LEFT JOIN driver_routes dr ON u.id = dr.driver_id
+			AND dr.route_date >= $1 AND dr.route_date < $2
+		LEFT JOIN route_orders ro ON dr.id = ro.route_id
+		WHERE u.role = 'driver' AND ($4 = 0 OR u.id = $4)
+		GROUP BY u.id, u.first_name, u.last_name`,
+		weekStart, weekEnd, fmt.Sprintf("%d minutes", int(scorecardOnTimeGrace.Minutes())), driverID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []DriverScorecard{}
+	for rows.Next() {
+		var card DriverScorecard
+		var onTime, claims, photographed, photoCompliant int
+		err := rows.Scan(
+			&card.DriverID, &card.DriverName,
+			&card.StopsAttempted, &card.StopsCompleted, &onTime, &claims, &photographed, &photoCompliant, &card.Rating,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		card.WeekStart = weekStart.Format("2006-01-02")
+		if card.StopsAttempted > 0 {
+			onTimeRate := float64(onTime) / float64(card.StopsAttempted)
+			claimsRate := float64(claims) / float64(card.StopsAttempted)
+			card.OnTimeRate = &onTimeRate
+			card.ClaimsRate = &claimsRate
+		}
+		// Share of photographed stops with at least one photo that passed the checks
+		if photographed > 0 {
+			photoCompliance := float64(photoCompliant) / float64(photographed)
+			card.PhotoCompliance = &photoCompliance
+		}
+		card.Score = computeScorecardScore(card)
+		card.Tier, card.RoutePriority = scorecardTier(card.Score, card.StopsAttempted)
+
+		cards = append(cards, card)
+	}
+
+	return cards, nil
+}
+
+// handleGetDriverScorecard returns the authenticated driver's weekly scorecard
+func (h *DriverScorecardHandler) handleGetDriverScorecard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	weekStart, err := weekStartFor(r)
+	if err != nil {
+		http.Error(w, "Invalid week format, use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	cards, err := getScorecards(h.db, weekStart, driverID)
+	if err != nil {
+		http.Error(w, "Failed to compute scorecard", http.StatusInternalServerError)
+		return
+	}
+	if len(cards) == 0 {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cards[0])
+}
+
+// handleGetLeaderboard returns all drivers' scorecards for a week, best first.
+// The order doubles as the route priority list for dispatch.
+func (h *DriverScorecardHandler) handleGetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	weekStart, err := weekStartFor(r)
+	if err != nil {
+		http.Error(w, "Invalid week format, use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	cards, err := getScorecards(h.db, weekStart, 0)
+	if err != nil {
+		http.Error(w, "Failed to compute leaderboard", http.StatusInternalServerError)
+		return
+	}
+
+	sort.SliceStable(cards, func(i, j int) bool {
+		if cards[i].RoutePriority != cards[j].RoutePriority {
+			return cards[i].RoutePriority < cards[j].RoutePriority
+		}
+		return cards[i].Score > cards[j].Score
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"week_start": weekStart.Format("2006-01-02"),
+		"drivers":    cards,
+	})
+}
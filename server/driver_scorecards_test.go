@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestComputeScorecardScore(t *testing.T) {
+	floatPtr := func(f float64) *float64 { return &f }
+
+	tests := []struct {
+		name     string
+		card     DriverScorecard
+		expected float64
+	}{
+		{
+			name:     "No data scores zero",
+			card:     DriverScorecard{},
+			expected: 0,
+		},
+		{
+			name: "Perfect on-time with no claims",
+			card: DriverScorecard{
+				OnTimeRate: floatPtr(1),
+				ClaimsRate: floatPtr(0),
+			},
+			expected: 1,
+		},
+		{
+			name: "Missing metrics are renormalized",
+			card: DriverScorecard{
+				OnTimeRate: floatPtr(0.8),
+				ClaimsRate: floatPtr(0.1),
+			},
+			// (0.8*0.5 + 0.9*0.2) / 0.7
+			expected: 0.58 / 0.7,
+		},
+		{
+			name: "Ratings are scaled from five stars",
+			card: DriverScorecard{
+				OnTimeRate:      floatPtr(1),
+				Rating:          floatPtr(4),
+				PhotoCompliance: floatPtr(1),
+				ClaimsRate:      floatPtr(0),
+			},
+			expected: 0.5 + 0.8*0.2 + 0.1 + 0.2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score := computeScorecardScore(tt.card)
+			if diff := score - tt.expected; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("Expected score %f, got %f", tt.expected, score)
+			}
+		})
+	}
+}
+
+func TestScorecardTier(t *testing.T) {
+	tests := []struct {
+		name             string
+		score            float64
+		stops            int
+		expectedTier     string
+		expectedPriority int
+	}{
+		{"Platinum", 0.97, 20, "platinum", 1},
+		{"Gold boundary", 0.90, 20, "gold", 2},
+		{"Silver", 0.85, 20, "silver", 3},
+		{"Bronze", 0.4, 20, "bronze", 4},
+		{"Too few stops", 1.0, scorecardMinStops - 1, "unranked", 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tier, priority := scorecardTier(tt.score, tt.stops)
+			if tier != tt.expectedTier || priority != tt.expectedPriority {
+				t.Errorf("Expected %s/%d, got %s/%d", tt.expectedTier, tt.expectedPriority, tier, priority)
+			}
+		})
+	}
+}
+
+func TestWeekStartFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+		wantErr  bool
+	}{
+		{"Wednesday rolls back to Monday", "?week=2025-01-08", "2025-01-06", false},
+		{"Monday stays", "?week=2025-01-06", "2025-01-06", false},
+		{"Sunday belongs to previous week", "?week=2025-01-12", "2025-01-06", false},
+		{"Invalid date", "?week=next-week", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/driver/scorecard"+tt.query, nil)
+			weekStart, err := weekStartFor(req)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error for invalid week")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := weekStart.Format("2006-01-02"); got != tt.expected {
+				t.Errorf("Expected week start %s, got %s", tt.expected, got)
+			}
+			if weekStart.Weekday() != time.Monday {
+				t.Errorf("Expected Monday, got %v", weekStart.Weekday())
+			}
+		})
+	}
+}
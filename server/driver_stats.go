@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// driverStatsRefreshQuery recomputes driver_stats_summary for one driver, or
+// every driver when $1 is 0. Delivery time is the gap between a completed
+// stop and the one before it (or the route start for the first stop).
+// Ratings leave out reviews an admin has hidden.
+const driverStatsRefreshQuery = `
+	WITH stops AS (
+		SELECT dr.driver_id, ro.order_id, dr.route_date,
+		       ro.actual_time - COALESCE(
+		           LAG(ro.actual_time) OVER (PARTITION BY ro.route_id ORDER BY ro.actual_time),
+		           dr.actual_start_time
+		       ) AS stop_duration
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		WHERE ro.status = 'completed' AND ($1 = 0 OR dr.driver_id = $1)
+	)
+	INSERT INTO driver_stats_summary (
+		driver_id, total_deliveries, today_deliveries, avg_delivery_minutes,
+		rating, rating_count, order_rating, expense_cents_this_month, miles_this_month,
+		stats_date, refreshed_at
+	)
+	SELECT u.id, COALESCE(d.total, 0), COALESCE(d.today, 0), d.avg_minutes,
+	       rt.rating, COALESCE(rt.ratings, 0), rt.order_rating, COALESCE(e.cents, 0), COALESCE(e.miles, 0),
+	       CURRENT_DATE, CURRENT_TIMESTAMP
+	FROM users u
+	LEFT JOIN (
+		SELECT driver_id,
+		       COUNT(DISTINCT order_id) AS total,
+		       COUNT(DISTINCT order_id) FILTER (WHERE route_date = CURRENT_DATE) AS today,
+		       AVG(EXTRACT(EPOCH FROM stop_duration) / 60) FILTER (WHERE stop_duration > INTERVAL '0') AS avg_minutes
+		FROM stops GROUP BY driver_id
+	) d ON d.driver_id = u.id
+	LEFT JOIN (
+		SELECT driver_id, AVG(COALESCE(driver_rating, rating)) AS rating, COUNT(*) AS ratings,
+		       AVG(rating) AS order_rating
+		FROM order_ratings WHERE hidden_at IS NULL GROUP BY driver_id
+	) rt ON rt.driver_id = u.id
+	LEFT JOIN (
+		SELECT driver_id, SUM(amount_cents) AS cents, SUM(miles) AS miles
+		FROM driver_route_expenses
+		WHERE incurred_on >= DATE_TRUNC('month', CURRENT_DATE)
+		GROUP BY driver_id
+	) e ON e.driver_id = u.id
+	WHERE u.role = 'driver' AND ($1 = 0 OR u.id = $1)
+	ON CONFLICT (driver_id) DO UPDATE SET
+		total_deliveries = EXCLUDED.total_deliveries,
+		today_deliveries = EXCLUDED.today_deliveries,
+		avg_delivery_minutes = EXCLUDED.avg_delivery_minutes,
+		rating = EXCLUDED.rating,
+		rating_count = EXCLUDED.rating_count,
+		order_rating = EXCLUDED.order_rating,
+		expense_cents_this_month = EXCLUDED.expense_cents_this_month,
+		miles_this_month = EXCLUDED.miles_this_month,
+		stats_date = EXCLUDED.stats_date,
+		refreshed_at = EXCLUDED.refreshed_at`
+
+// refreshDriverStats recomputes the stats summary for a driver, or for all
+// drivers when driverID is 0
+func refreshDriverStats(q execer, driverID int) error {
+	_, err := q.Exec(driverStatsRefreshQuery, driverID)
+	return err
+}
+
+// refreshDriverStatsAfter refreshes a driver's stats after something that
+// changes them. A failure only leaves the stats stale until the next
+// background refresh, so it's logged rather than returned.
+func refreshDriverStatsAfter(q execer, driverID int, event string) {
+	if err := refreshDriverStats(q, driverID); err != nil {
+		log.Printf("Failed to refresh stats for driver %d after %s: %v", driverID, event, err)
+	}
+}
+
+// processDriverStats refreshes every driver's stats summary
+func (s *AutoScheduler) processDriverStats() {
+	started := time.Now()
+	if err := refreshDriverStats(s.db, 0); err != nil {
+		log.Printf("Error refreshing driver stats: %v", err)
+		return
+	}
+	log.Printf("Refreshed driver stats in %s", time.Since(started).Round(time.Millisecond))
+}
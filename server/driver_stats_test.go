@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDriverStatsSummary(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "stats-driver@example.com", "Stats", "Driver")
+	idleDriverID := db.CreateTestUser(t, "idle-driver@example.com", "Idle", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id IN ($1, $2)", driverID, idleDriverID)
+	customerID := db.CreateTestUser(t, "stats-customer@example.com", "Stats", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+
+	// Two stops 20 and 30 minutes apart from the route start
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status, actual_start_time)
+		VALUES ($1, CURRENT_DATE, 'delivery', 'in_progress', CURRENT_TIMESTAMP - INTERVAL '1 hour')
+		RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	firstOrderID := db.CreateTestOrder(t, customerID, addressID)
+	secondOrderID := db.CreateTestOrder(t, customerID, addressID)
+	db.Exec(`
+		INSERT INTO route_orders (route_id, order_id, sequence_number, status, actual_time)
+		VALUES ($1, $2, 1, 'completed', CURRENT_TIMESTAMP - INTERVAL '40 minutes'),
+		       ($1, $3, 2, 'completed', CURRENT_TIMESTAMP - INTERVAL '10 minutes')`,
+		routeID, firstOrderID, secondOrderID,
+	)
+	db.Exec("UPDATE orders SET status = 'delivered' WHERE id = $1", firstOrderID)
+
+	orders := &OrderHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest}
+	rate := func(orderID int, body string) int {
+		req := httptest.NewRequest("POST", "/api/v1/orders/"+strconv.Itoa(orderID)+"/rating", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(orderID)})
+		w := httptest.NewRecorder()
+		orders.handleRateOrder(w, req)
+		return w.Code
+	}
+
+	if code := rate(secondOrderID, `{"rating": 5}`); code != http.StatusConflict {
+		t.Errorf("Expected status %d rating an undelivered order, got %d", http.StatusConflict, code)
+	}
+	if code := rate(firstOrderID, `{"rating": 6}`); code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a 6 star rating, got %d", http.StatusBadRequest, code)
+	}
+	if code := rate(firstOrderID, `{"rating": 4, "comment": "Folded nicely"}`); code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, code)
+	}
+	if code := rate(firstOrderID, `{"rating": 1}`); code != http.StatusConflict {
+		t.Errorf("Expected status %d rating twice, got %d", http.StatusConflict, code)
+	}
+
+	// Completing the route refreshes the summary too
+	routes := &DriverRouteHandler{db: db.DB, getUserID: CreateAuthMock(driverID).getUserIDFromRequest}
+	w := httptest.NewRecorder()
+	routes.handleCompleteRoute(w, httptest.NewRequest("PUT", "/api/v1/driver/routes/complete?id="+strconv.Itoa(routeID), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	admin := &AdminHandler{db: db.DB}
+	w = httptest.NewRecorder()
+	admin.handleGetDriverStats(w, httptest.NewRequest("GET", "/api/v1/admin/drivers/stats", nil))
+	var stats []DriverStats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if len(stats) != 2 {
+		t.Fatalf("Expected two drivers, got %s", w.Body.String())
+	}
+
+	busy, idle := stats[0], stats[1]
+	if busy.DriverID != driverID || busy.TotalDeliveries != 2 || busy.TodayDeliveries != 2 || busy.StatsRefreshedAt == nil {
+		t.Errorf("Unexpected stats for the busy driver: %+v", busy)
+	}
+	if busy.AvgDeliveryTime == nil || *busy.AvgDeliveryTime != 25 {
+		t.Errorf("Expected a 25 minute average stop, got %v", busy.AvgDeliveryTime)
+	}
+	if busy.Rating == nil || *busy.Rating != 4 || busy.RatingCount != 1 {
+		t.Errorf("Expected one 4 star rating, got %v from %d", busy.Rating, busy.RatingCount)
+	}
+
+	// Unrated drivers report no rating instead of zero, and have no summary
+	// until the background refresh runs
+	if idle.Rating != nil || idle.AvgDeliveryTime != nil || idle.StatsRefreshedAt != nil {
+		t.Errorf("Expected empty stats for the idle driver, got %+v", idle)
+	}
+	scheduler := &AutoScheduler{db: db.DB}
+	scheduler.processDriverStats()
+	var summaries int
+	db.QueryRow("SELECT COUNT(*) FROM driver_stats_summary WHERE driver_id IN ($1, $2)", driverID, idleDriverID).Scan(&summaries)
+	if summaries != 2 {
+		t.Errorf("Expected the background refresh to summarize both drivers, got %d", summaries)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Suggestion weights; missing metrics are dropped and the rest renormalized
+const (
+	suggestionProximityWeight   = 0.4
+	suggestionLoadWeight        = 0.35
+	suggestionPerformanceWeight = 0.25
+	// Only counted on routes where some customer has a favorite driver
+	suggestionFavoriteWeight = 0.3
+	// Drivers this far from the stops score half on proximity
+	suggestionHalfScoreKm = 10.0
+	// Drivers with this many stops already on the date score zero on load
+	suggestionFullLoadStops = 30
+	// Zone history looks back this far, and needs this many stops to count
+	suggestionHistoryWindow = 90 * 24 * time.Hour
+	suggestionMinZoneStops  = 5
+	maxDriverSuggestions    = 5
+)
+
+// DriverSuggestion is a driver ranked for a route that's being assigned
+type DriverSuggestion struct {
+	DriverID   int    `json:"driver_id"`
+	DriverName string `json:"driver_name"`
+	// DistanceKm is from the driver's home base to the middle of the stops;
+	// nil when either isn't known
+	DistanceKm   *float64 `json:"distance_km"`
+	RoutesOnDate int      `json:"routes_on_date"`
+	StopsOnDate  int      `json:"stops_on_date"`
+	// Zone history covers stops in the same markets as this route
+	ZoneStops          int      `json:"zone_stops"`
+	ZoneCompletionRate *float64 `json:"zone_completion_rate"`
+	// FavoritedBy is how many of the route's customers favorite the driver
+	FavoritedBy int `json:"favorited_by"`
+	// Tier and RoutePriority are from the driver's scorecard for last week
+	Tier          string  `json:"tier"`
+	RoutePriority int     `json:"route_priority"`
+	Score         float64 `json:"score"`
+	// Load is the driver's day with this route added; drivers it would put
+	// over capacity are ranked after the ones with room
+	Load *RouteLoad `json:"load"`
+	// routeFavorites is how many of the route's customers favorite anyone
+	routeFavorites int
+}
+
+// driverSuggestionScore combines the available metrics into a 0-1 score
+func driverSuggestionScore(s DriverSuggestion) float64 {
+	var total, weights float64
+	if s.DistanceKm != nil {
+		total += suggestionHalfScoreKm / (suggestionHalfScoreKm + *s.DistanceKm) * suggestionProximityWeight
+		weights += suggestionProximityWeight
+	}
+	load := 1 - float64(s.StopsOnDate)/suggestionFullLoadStops
+	if load < 0 {
+		load = 0
+	}
+	total += load * suggestionLoadWeight
+	weights += suggestionLoadWeight
+	if s.ZoneCompletionRate != nil {
+		total += *s.ZoneCompletionRate * suggestionPerformanceWeight
+		weights += suggestionPerformanceWeight
+	}
+	if s.routeFavorites > 0 {
+		total += float64(s.FavoritedBy) / float64(s.routeFavorites) * suggestionFavoriteWeight
+		weights += suggestionFavoriteWeight
+	}
+	return total / weights
+}
+
+// routeStopArea returns the middle of a route's geocoded stops and the
+// markets they're in
+func routeStopArea(q *sql.DB, orderIDs []int, routeType string) (*LatLng, []string, error) {
+	rows, err := q.Query(`
+		SELECT a.latitude, a.longitude, a.zip_code
+		FROM orders o
+		JOIN addresses a ON a.id = CASE WHEN $2 = 'pickup' THEN o.pickup_address_id ELSE o.delivery_address_id END
+		WHERE o.id = ANY($1)`,
+		pq.Array(orderIDs), routeType,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var sum LatLng
+	geocoded := 0
+	markets := []string{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		var lat, lng sql.NullFloat64
+		var zipCode string
+		if err := rows.Scan(&lat, &lng, &zipCode); err != nil {
+			return nil, nil, err
+		}
+		if lat.Valid && lng.Valid {
+			sum.Latitude += lat.Float64
+			sum.Longitude += lng.Float64
+			geocoded++
+		}
+		if market := marketForZip(zipCode); market != "" && !seen[market] {
+			seen[market] = true
+			markets = append(markets, market)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if geocoded == 0 {
+		return nil, markets, nil
+	}
+	return &LatLng{Latitude: sum.Latitude / float64(geocoded), Longitude: sum.Longitude / float64(geocoded)}, markets, nil
+}
+
+// suggestDrivers ranks the active, onboarded drivers for a route on
+// routeDate covering orderIDs, best first. Drivers with room for the route
+// come first, then those whose scorecard tier gives them route priority.
+// Within a tier it favours drivers based near the stops, with a light load
+// that day, who have done well in the same markets, so work spreads beyond
+// whoever dispatch picked last time. Drivers the route's customers favorite
+// rank higher, and ones any of them blocked aren't suggested.
+func suggestDrivers(db *sql.DB, orderIDs []int, routeDate, routeType string) ([]DriverSuggestion, error) {
+	center, markets, err := routeStopArea(db, orderIDs, routeType)
+	if err != nil {
+		return nil, err
+	}
+	var routeBags int
+	err = db.QueryRow(
+		"SELECT COALESCE(SUM("+fmt.Sprintf(orderBagsSQL, "ids.order_id")+"), 0) FROM unnest($1::int[]) AS ids(order_id)",
+		pq.Array(orderIDs),
+	).Scan(&routeBags)
+	if err != nil {
+		return nil, err
+	}
+	var routeFavorites int
+	err = db.QueryRow(`
+		SELECT COUNT(DISTINCT p.user_id) FROM driver_preferences p
+		JOIN orders o ON o.user_id = p.user_id
+		WHERE o.id = ANY($1) AND p.preference = 'favorite'`,
+		pq.Array(orderIDs),
+	).Scan(&routeFavorites)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT u.id, u.first_name || ' ' || u.last_name,
+		       u.home_base_latitude, u.home_base_longitude,
+		       u.route_max_bags, u.route_max_minutes,
+		       (SELECT COUNT(*) FROM driver_routes dr
+		        WHERE dr.driver_id = u.id AND dr.route_date = $1 AND dr.status != 'cancelled'),
+		       (SELECT COUNT(*) FROM route_orders ro JOIN driver_routes dr ON ro.route_id = dr.id
+		        WHERE dr.driver_id = u.id AND dr.route_date = $1 AND dr.status != 'cancelled'),
+		       (SELECT COALESCE(SUM(`+fmt.Sprintf(orderBagsSQL, "ro.order_id")+`), 0)
+		        FROM route_orders ro JOIN driver_routes dr ON ro.route_id = dr.id
+		        WHERE dr.driver_id = u.id AND dr.route_date = $1 AND dr.status != 'cancelled'),
+		       zone.attempted, zone.completed,
+		       (SELECT COUNT(DISTINCT p.user_id) FROM driver_preferences p
+		        JOIN orders o ON o.user_id = p.user_id
+		        WHERE p.driver_id = u.id AND p.preference = 'favorite' AND o.id = ANY($4))
+		FROM users u
+		LEFT JOIN LATERAL (
+			SELECT COUNT(*) FILTER (WHERE ro.status IN ('completed', 'failed')) AS attempted,
+			       COUNT(*) FILTER (WHERE ro.status = 'completed') AS completed
+			FROM driver_routes dr
+			JOIN route_orders ro ON ro.route_id = dr.id
+			JOIN orders o ON ro.order_id = o.id
+			JOIN addresses a ON a.id = CASE WHEN dr.route_type = 'pickup' THEN o.pickup_address_id ELSE o.delivery_address_id END
+			WHERE dr.driver_id = u.id AND dr.route_date >= $2 AND LEFT(a.zip_code, 3) = ANY($3)
+		) zone ON true
+		WHERE u.role = 'driver' AND COALESCE(u.status, 'active') = 'active'
+		  AND NOT EXISTS (
+			SELECT 1 FROM driver_onboarding_steps s
+			WHERE NOT EXISTS (
+				SELECT 1 FROM driver_onboarding_progress p WHERE p.step = s.step AND p.driver_id = u.id
+			)
+		  )
+		  AND NOT EXISTS (
+			SELECT 1 FROM driver_preferences p
+			JOIN orders o ON o.user_id = p.user_id
+			WHERE p.driver_id = u.id AND p.preference = 'blocked' AND o.id = ANY($4)
+		  )
+		  AND NOT EXISTS (
+			SELECT 1 FROM orders o
+			JOIN addresses a ON a.id = o.pickup_address_id
+			JOIN market_zip_prefixes mz ON mz.zip_prefix = LEFT(a.zip_code, 3)
+			WHERE o.id = ANY($4) AND mz.market_id != u.home_market_id
+		  )`,
+		routeDate, time.Now().Add(-suggestionHistoryWindow).Format("2006-01-02"), pq.Array(markets), pq.Array(orderIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []DriverSuggestion{}
+	for rows.Next() {
+		var s DriverSuggestion
+		var homeLat, homeLng sql.NullFloat64
+		var maxBags, maxMinutes sql.NullInt64
+		var bagsOnDate, attempted, completed int
+		err := rows.Scan(&s.DriverID, &s.DriverName, &homeLat, &homeLng, &maxBags, &maxMinutes,
+			&s.RoutesOnDate, &s.StopsOnDate, &bagsOnDate, &attempted, &completed, &s.FavoritedBy)
+		if err != nil {
+			return nil, err
+		}
+		s.Load = &RouteLoad{
+			DriverID:  s.DriverID,
+			RouteDate: routeDate,
+			Stops:     s.StopsOnDate + len(orderIDs),
+			Bags:      bagsOnDate + routeBags,
+			Capacity:  routeCapacityFor(maxBags, maxMinutes),
+		}
+		s.Load.measure()
+		if center != nil && homeLat.Valid && homeLng.Valid {
+			km := haversineKm(LatLng{Latitude: homeLat.Float64, Longitude: homeLng.Float64}, *center)
+			s.DistanceKm = &km
+		}
+		s.ZoneStops = attempted
+		if attempted >= suggestionMinZoneStops {
+			rate := float64(completed) / float64(attempted)
+			s.ZoneCompletionRate = &rate
+		}
+		s.routeFavorites = routeFavorites
+		s.Score = driverSuggestionScore(s)
+		suggestions = append(suggestions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Tiers come from the last full week, so they don't shift as this one fills in
+	cards, err := getScorecards(db, payoutWeekStart(time.Now()).AddDate(0, 0, -7), 0)
+	if err != nil {
+		return nil, err
+	}
+	tiers := map[int]DriverScorecard{}
+	for _, card := range cards {
+		tiers[card.DriverID] = card
+	}
+	for i := range suggestions {
+		card, ok := tiers[suggestions[i].DriverID]
+		if !ok {
+			card.Tier, card.RoutePriority = scorecardTier(0, 0)
+		}
+		suggestions[i].Tier, suggestions[i].RoutePriority = card.Tier, card.RoutePriority
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if over := suggestions[i].Load.Overloaded(); over != suggestions[j].Load.Overloaded() {
+			return !over
+		}
+		if suggestions[i].RoutePriority != suggestions[j].RoutePriority {
+			return suggestions[i].RoutePriority < suggestions[j].RoutePriority
+		}
+		if suggestions[i].Score != suggestions[j].Score {
+			return suggestions[i].Score > suggestions[j].Score
+		}
+		return suggestions[i].StopsOnDate < suggestions[j].StopsOnDate
+	})
+	if len(suggestions) > maxDriverSuggestions {
+		suggestions = suggestions[:maxDriverSuggestions]
+	}
+	return suggestions, nil
+}
+
+// handleSetDriverHomeBase sets where a driver starts their day. Sending null
+// coordinates clears it.
+func (h *AdminHandler) handleSetDriverHomeBase(w http.ResponseWriter, r *http.Request) {
+	driverID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid driver ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Latitude  *float64 `json:"latitude"`
+		Longitude *float64 `json:"longitude"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if (req.Latitude == nil) != (req.Longitude == nil) {
+		http.Error(w, "latitude and longitude must be set together", http.StatusBadRequest)
+		return
+	}
+	if req.Latitude != nil && (*req.Latitude < -90 || *req.Latitude > 90 || *req.Longitude < -180 || *req.Longitude > 180) {
+		http.Error(w, "Coordinates are out of range", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE users SET home_base_latitude = $1, home_base_longitude = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3 AND role = 'driver'`,
+		req.Latitude, req.Longitude, driverID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update driver", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"driver_id": driverID,
+		"latitude":  req.Latitude,
+		"longitude": req.Longitude,
+	})
+}
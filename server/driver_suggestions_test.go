@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDriverSuggestionScore(t *testing.T) {
+	km := func(v float64) *float64 { return &v }
+
+	near := driverSuggestionScore(DriverSuggestion{DistanceKm: km(1)})
+	far := driverSuggestionScore(DriverSuggestion{DistanceKm: km(40)})
+	if near <= far {
+		t.Errorf("Expected a nearby driver to score higher, got %.3f vs %.3f", near, far)
+	}
+
+	idle := driverSuggestionScore(DriverSuggestion{DistanceKm: km(5)})
+	busy := driverSuggestionScore(DriverSuggestion{DistanceKm: km(5), StopsOnDate: 20})
+	if idle <= busy {
+		t.Errorf("Expected a lighter load to score higher, got %.3f vs %.3f", idle, busy)
+	}
+
+	// With nothing but load known, an idle driver scores full marks
+	if got := driverSuggestionScore(DriverSuggestion{}); math.Abs(got-1) > 1e-9 {
+		t.Errorf("Expected 1 for an idle driver with no other metrics, got %.3f", got)
+	}
+	if got := driverSuggestionScore(DriverSuggestion{StopsOnDate: 100}); got != 0 {
+		t.Errorf("Expected an overloaded driver to bottom out at 0, got %.3f", got)
+	}
+
+	reliable := driverSuggestionScore(DriverSuggestion{DistanceKm: km(5), ZoneCompletionRate: km(1)})
+	unreliable := driverSuggestionScore(DriverSuggestion{DistanceKm: km(5), ZoneCompletionRate: km(0.5)})
+	if reliable <= unreliable {
+		t.Errorf("Expected a better zone record to score higher, got %.3f vs %.3f", reliable, unreliable)
+	}
+
+	// Favorites only count on routes where customers have them
+	favorite := driverSuggestionScore(DriverSuggestion{DistanceKm: km(20), FavoritedBy: 1, routeFavorites: 1})
+	closer := driverSuggestionScore(DriverSuggestion{DistanceKm: km(5), routeFavorites: 1})
+	if favorite <= closer {
+		t.Errorf("Expected a favorite driver to outrank a closer one, got %.3f vs %.3f", favorite, closer)
+	}
+}
+
+func TestAssignDriverToRouteSuggestions(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "admin@example.com", "Admin", "User")
+	handler := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+
+	driver := func(email string, lat, lng float64) int {
+		id := db.CreateTestUser(t, email, "Driver", "User")
+		db.Exec("UPDATE users SET role = 'driver', home_base_latitude = $1, home_base_longitude = $2 WHERE id = $3", lat, lng, id)
+		db.CompleteTestDriverOnboarding(t, id)
+		return id
+	}
+	nearID := driver("near@example.com", 40.7130, -74.0060)
+	farID := driver("far@example.com", 41.5, -73.0)
+	onboardingID := db.CreateTestUser(t, "onboarding@example.com", "New", "Driver")
+	db.Exec("UPDATE users SET role = 'driver', home_base_latitude = 40.7128, home_base_longitude = -74.0060 WHERE id = $1", onboardingID)
+
+	customerID := db.CreateTestUser(t, "customer@example.com", "Customer", "User")
+	addressID := db.CreateTestAddress(t, customerID)
+	db.Exec("UPDATE addresses SET latitude = 40.7128, longitude = -74.0060 WHERE id = $1", addressID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"order_ids":  []int{orderID},
+		"route_date": "2026-11-02",
+		"route_type": "pickup",
+	})
+	req := httptest.NewRequest("POST", "/api/v1/admin/routes/assign", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.handleAssignDriverToRoute(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var response struct {
+		SuggestedDrivers []DriverSuggestion `json:"suggested_drivers"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if len(response.SuggestedDrivers) != 2 {
+		t.Fatalf("Expected the two onboarded drivers, got %s", w.Body.String())
+	}
+	if response.SuggestedDrivers[0].DriverID != nearID || response.SuggestedDrivers[1].DriverID != farID {
+		t.Errorf("Expected the nearer driver first, got %s", w.Body.String())
+	}
+
+	var routes int
+	db.QueryRow("SELECT COUNT(*) FROM driver_routes").Scan(&routes)
+	if routes != 0 {
+		t.Errorf("Expected no route created when only asking for suggestions, found %d", routes)
+	}
+
+	// A spotless week last week puts the far driver in the top tier, ahead
+	// of the nearer unranked one
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, $2, 'pickup', 'completed') RETURNING id`,
+		farID, payoutWeekStart(time.Now()).AddDate(0, 0, -7),
+	).Scan(&routeID)
+	for i := 1; i <= scorecardMinStops; i++ {
+		db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number, status) VALUES ($1, $2, $3, 'completed')",
+			routeID, db.CreateTestOrder(t, customerID, addressID), i)
+	}
+	suggestions, err := suggestDrivers(db.DB, []int{orderID}, "2026-11-02", "pickup")
+	if err != nil {
+		t.Fatalf("Failed to suggest drivers: %v", err)
+	}
+	if len(suggestions) != 2 || suggestions[0].DriverID != farID || suggestions[0].Tier != "platinum" || suggestions[1].Tier != "unranked" {
+		t.Errorf("Expected the platinum driver first, got %+v", suggestions)
+	}
+}
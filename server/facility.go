@@ -0,0 +1,578 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// The facility workflow: staff scan each bag in when it arrives, move it
+// through washing, drying and folding, weigh it on the facility scale and
+// mark the order ready for delivery once every bag is folded. The order's
+// status history records each step so customers can follow along.
+
+// facilityStages are the stages a bag goes through, in order. Bags can skip
+// stages (hang-dry bags skip the dryer) but never go back.
+var facilityStages = []string{"received", "washing", "drying", "folding", "folded"}
+
+func facilityStageIndex(stage string) int {
+	for i, s := range facilityStages {
+		if s == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+// FacilityHandler serves the facility's bag intake and processing endpoints
+type FacilityHandler struct {
+	db        *sql.DB
+	realtime  RealtimeInterface
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewFacilityHandler(db *sql.DB, realtime RealtimeInterface) *FacilityHandler {
+	return &FacilityHandler{
+		db:        db,
+		realtime:  realtime,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// FacilityBag is a bag being processed at the facility
+type FacilityBag struct {
+	ID             int        `json:"id"`
+	OrderID        int        `json:"order_id"`
+	OrderNumber    string     `json:"order_number"`
+	OrderItemID    *int       `json:"order_item_id,omitempty"`
+	BagCode        string     `json:"bag_code"`
+	Stage          string     `json:"stage"`
+	Weight         *float64   `json:"weight,omitempty"` // Pounds
+	ReceivedAt     time.Time  `json:"received_at"`
+	StageUpdatedAt time.Time  `json:"stage_updated_at"`
+	ReleasedAt     *time.Time `json:"released_at,omitempty"`
+	// CareOptions are the customer's laundry preferences for the order
+	CareOptions []string `json:"care_options"`
+}
+
+const facilityBagColumns = `
+	b.id, b.order_id, CONCAT('TUM-', EXTRACT(YEAR FROM o.created_at), '-', LPAD(o.id::text, 3, '0')),
+	b.order_item_id, b.bag_code, b.stage, b.weight, b.received_at, b.stage_updated_at, b.released_at`
+
+func queryFacilityBags(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, where string, args ...interface{}) ([]FacilityBag, error) {
+	rows, err := q.Query(`
+		SELECT `+facilityBagColumns+`
+		FROM facility_bags b
+		JOIN orders o ON b.order_id = o.id
+		`+where+`
+		ORDER BY b.received_at, b.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bags := []FacilityBag{}
+	var orderIDs []int
+	for rows.Next() {
+		var bag FacilityBag
+		err := rows.Scan(&bag.ID, &bag.OrderID, &bag.OrderNumber, &bag.OrderItemID, &bag.BagCode,
+			&bag.Stage, &bag.Weight, &bag.ReceivedAt, &bag.StageUpdatedAt, &bag.ReleasedAt)
+		if err != nil {
+			return nil, err
+		}
+		bags = append(bags, bag)
+		orderIDs = append(orderIDs, bag.OrderID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	care, err := orderCareOptions(q, orderIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range bags {
+		bags[i].CareOptions = care[bags[i].OrderID]
+		if bags[i].CareOptions == nil {
+			bags[i].CareOptions = []string{}
+		}
+	}
+	return bags, nil
+}
+
+// openFacilityBag finds the bag still being processed with a tag code
+func openFacilityBag(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, code string) (*FacilityBag, error) {
+	bags, err := queryFacilityBags(q, "WHERE b.bag_code = $1 AND b.released_at IS NULL", code)
+	if err != nil || len(bags) == 0 {
+		return nil, err
+	}
+	return &bags[0], nil
+}
+
+// addFacilityHistory notes a facility step in the order's status history
+func addFacilityHistory(tx *sql.Tx, orderID int, status, notes string, staffID int) error {
+	_, err := tx.Exec(`
+		INSERT INTO order_status_history (order_id, status, notes, updated_by)
+		VALUES ($1, $2, $3, $4)`,
+		orderID, status, notes, staffID,
+	)
+	return err
+}
+
+// handleGetFacilityBags lists the bags still being processed, oldest first.
+// ?stage= narrows it to one stage and ?order_id= to one order.
+func (h *FacilityHandler) handleGetFacilityBags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	where := []string{"b.released_at IS NULL"}
+	var args []interface{}
+	if stage := r.URL.Query().Get("stage"); stage != "" {
+		if facilityStageIndex(stage) < 0 {
+			http.Error(w, "stage must be one of "+strings.Join(facilityStages, ", "), http.StatusBadRequest)
+			return
+		}
+		args = append(args, stage)
+		where = append(where, fmt.Sprintf("b.stage = $%d", len(args)))
+	}
+	if orderIDStr := r.URL.Query().Get("order_id"); orderIDStr != "" {
+		orderID, err := strconv.Atoi(orderIDStr)
+		if err != nil {
+			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			return
+		}
+		// An order's bags are listed after it's released too
+		where = []string{"b.order_id = $1"}
+		args = []interface{}{orderID}
+	}
+
+	bags, err := queryFacilityBags(h.db, "WHERE "+strings.Join(where, " AND "), args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch bags", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bags)
+}
+
+type FacilityIntakeRequest struct {
+	OrderID int    `json:"order_id"`
+	BagCode string `json:"bag_code"`
+	// OrderItemID is the line the bag was sold on. It can be left out when
+	// the order has only one line of bags.
+	OrderItemID *int `json:"order_item_id,omitempty"`
+}
+
+// handleScanBagIntake scans a bag into the facility. The order's first bag
+// moves it from picked up to in process.
+func (h *FacilityHandler) handleScanBagIntake(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	staffID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req FacilityIntakeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.BagCode = strings.TrimSpace(req.BagCode)
+	if req.BagCode == "" || len(req.BagCode) > 50 {
+		http.Error(w, "bag_code is required and must be at most 50 characters", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	var userID int
+	err = tx.QueryRow("SELECT status, user_id FROM orders WHERE id = $1 FOR UPDATE", req.OrderID).Scan(&status, &userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if status != "picked_up" && status != "in_process" {
+		http.Error(w, fmt.Sprintf("Only picked up orders can be scanned in, this one is %s", status), http.StatusConflict)
+		return
+	}
+
+	// Weighing re-prices the line, so the bag has to be tied to one
+	orderItemID := req.OrderItemID
+	if orderItemID == nil {
+		var lines []int
+		err := tx.QueryRow(`
+			SELECT ARRAY(SELECT id FROM order_items WHERE order_id = $1 AND included_pounds IS NOT NULL ORDER BY id)`,
+			req.OrderID,
+		).Scan(pq.Array(&lines))
+		if err != nil {
+			http.Error(w, "Failed to fetch order items", http.StatusInternalServerError)
+			return
+		}
+		if len(lines) > 1 {
+			http.Error(w, "order_item_id is required for orders with more than one line of bags", http.StatusBadRequest)
+			return
+		}
+		if len(lines) == 1 {
+			orderItemID = &lines[0]
+		}
+	} else {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM order_items WHERE id = $1 AND order_id = $2)", *orderItemID, req.OrderID).Scan(&exists)
+		if err != nil {
+			http.Error(w, "Failed to fetch order items", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("Order item %d is not on this order", *orderItemID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var bagID int
+	err = tx.QueryRow(`
+		INSERT INTO facility_bags (order_id, order_item_id, bag_code, received_by, stage_updated_by)
+		VALUES ($1, $2, $3, $4, $4)
+		RETURNING id`,
+		req.OrderID, orderItemID, req.BagCode, staffID,
+	).Scan(&bagID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "A bag with this code is already being processed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to scan bag", http.StatusInternalServerError)
+		return
+	}
+
+	if status == "picked_up" {
+		if _, err := tx.Exec("UPDATE orders SET status = 'in_process', updated_at = CURRENT_TIMESTAMP WHERE id = $1", req.OrderID); err != nil {
+			http.Error(w, "Failed to update order", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := addFacilityHistory(tx, req.OrderID, "in_process", fmt.Sprintf("Bag %s received at the facility", req.BagCode), staffID); err != nil {
+		http.Error(w, "Failed to update status history", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to scan bag", http.StatusInternalServerError)
+		return
+	}
+
+	if status == "picked_up" && h.realtime != nil {
+		go h.realtime.PublishOrderUpdate(userID, req.OrderID, "in_process", orderStatusMessage("in_process"), nil)
+	}
+
+	bags, err := queryFacilityBags(h.db, "WHERE b.id = $1", bagID)
+	if err != nil || len(bags) == 0 {
+		http.Error(w, "Failed to fetch bag", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bags[0])
+}
+
+// handleUpdateBagStage moves a scanned bag on to a later stage
+func (h *FacilityHandler) handleUpdateBagStage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	staffID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Stage string `json:"stage"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if facilityStageIndex(req.Stage) < 0 {
+		http.Error(w, "stage must be one of "+strings.Join(facilityStages, ", "), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	bag, err := openFacilityBag(tx, mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, "Failed to fetch bag", http.StatusInternalServerError)
+		return
+	}
+	if bag == nil {
+		http.Error(w, "Bag not found", http.StatusNotFound)
+		return
+	}
+	if facilityStageIndex(req.Stage) <= facilityStageIndex(bag.Stage) {
+		http.Error(w, fmt.Sprintf("Bag is already %s", bag.Stage), http.StatusConflict)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE facility_bags SET stage = $1, stage_updated_by = $2, stage_updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3`,
+		req.Stage, staffID, bag.ID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update bag", http.StatusInternalServerError)
+		return
+	}
+	if err := addFacilityHistory(tx, bag.OrderID, "in_process", fmt.Sprintf("Bag %s %s", bag.BagCode, req.Stage), staffID); err != nil {
+		http.Error(w, "Failed to update status history", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update bag", http.StatusInternalServerError)
+		return
+	}
+
+	bags, err := queryFacilityBags(h.db, "WHERE b.id = $1", bag.ID)
+	if err != nil || len(bags) == 0 {
+		http.Error(w, "Failed to fetch bag", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bags[0])
+}
+
+// handleRecordFacilityWeight records a bag's weight on the facility scale.
+// The facility's readings replace the driver's for the bag's line, and the
+// order's overweight charge is worked out again from them.
+func (h *FacilityHandler) handleRecordFacilityWeight(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	staffID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Weight float64 `json:"weight"` // Pounds
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Weight <= 0 || req.Weight > maxBagLineWeight {
+		http.Error(w, fmt.Sprintf("Bag weight must be between 0 and %d pounds", maxBagLineWeight), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	bag, err := openFacilityBag(tx, mux.Vars(r)["code"])
+	if err != nil {
+		http.Error(w, "Failed to fetch bag", http.StatusInternalServerError)
+		return
+	}
+	if bag == nil {
+		http.Error(w, "Bag not found", http.StatusNotFound)
+		return
+	}
+
+	var previousCents int
+	if err := tx.QueryRow("SELECT overweight_cents FROM orders WHERE id = $1 FOR UPDATE", bag.OrderID).Scan(&previousCents); err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE facility_bags SET weight = $1 WHERE id = $2", req.Weight, bag.ID); err != nil {
+		http.Error(w, "Failed to record bag weight", http.StatusInternalServerError)
+		return
+	}
+	if bag.OrderItemID != nil {
+		_, err = tx.Exec(`
+			UPDATE order_items
+			SET weight = (SELECT SUM(weight) FROM facility_bags WHERE order_item_id = $1 AND weight IS NOT NULL)
+			WHERE id = $1`,
+			*bag.OrderItemID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to record bag weight", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	result, err := repriceOrderWeight(tx, bag.OrderID)
+	if err != nil {
+		http.Error(w, "Failed to re-price order", http.StatusInternalServerError)
+		return
+	}
+	if cents := dollarsToCents(result.OverweightCharge); cents != previousCents {
+		notes := fmt.Sprintf("Reweighed at the facility: %.2f lb, overweight charge $%.2f", result.TotalWeight, result.OverweightCharge)
+		if err := addFacilityHistory(tx, bag.OrderID, "in_process", notes, staffID); err != nil {
+			http.Error(w, "Failed to update status history", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to record bag weight", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleMarkOrderReady marks an order ready for delivery once every bag
+// scanned in for it is folded, and releases the bags' tags for reuse
+func (h *FacilityHandler) handleMarkOrderReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	staffID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Notes string `json:"notes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var status string
+	var userID int
+	err = tx.QueryRow("SELECT status, user_id FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&status, &userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if status != "in_process" {
+		http.Error(w, fmt.Sprintf("Cannot mark an order that is %s ready for delivery", status), http.StatusConflict)
+		return
+	}
+
+	var bags, unfolded int
+	err = tx.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE stage != 'folded')
+		FROM facility_bags WHERE order_id = $1 AND released_at IS NULL`,
+		orderID,
+	).Scan(&bags, &unfolded)
+	if err != nil {
+		http.Error(w, "Failed to fetch bags", http.StatusInternalServerError)
+		return
+	}
+	if bags == 0 {
+		http.Error(w, "No bags have been scanned in for this order", http.StatusConflict)
+		return
+	}
+	if unfolded > 0 {
+		http.Error(w, fmt.Sprintf("%d of the order's %d bags aren't folded yet", unfolded, bags), http.StatusConflict)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE orders SET status = 'ready', updated_at = CURRENT_TIMESTAMP WHERE id = $1", orderID); err != nil {
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE facility_bags SET released_at = CURRENT_TIMESTAMP WHERE order_id = $1 AND released_at IS NULL", orderID); err != nil {
+		http.Error(w, "Failed to release bags", http.StatusInternalServerError)
+		return
+	}
+	notes := req.Notes
+	if notes == "" {
+		notes = fmt.Sprintf("All %d bags processed at the facility", bags)
+	}
+	if err := addFacilityHistory(tx, orderID, "ready", notes, staffID); err != nil {
+		http.Error(w, "Failed to update status history", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to mark order ready", http.StatusInternalServerError)
+		return
+	}
+
+	if h.realtime != nil {
+		go h.realtime.PublishOrderUpdate(userID, orderID, "ready", orderStatusMessage("ready"), nil)
+	}
+
+	order, err := getOrder(h.db, orderID)
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFacilityProcessing(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	staffID := db.CreateTestUser(t, "facility-staff@example.com", "Facility", "Staff")
+	db.Exec("UPDATE users SET role = 'facility' WHERE id = $1", staffID)
+	customerID := db.CreateTestUser(t, "facility-customer@example.com", "Facility", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	if ok, _ := userHasPermission(db.DB, staffID, "facility.manage"); !ok {
+		t.Error("Expected facility staff to hold facility.manage")
+	}
+
+	// Two bags sold with 20 lb included each at 50 cents a pound over
+	var bagItemID int
+	db.QueryRow(`
+		INSERT INTO order_items (order_id, service_id, quantity, price_cents, included_pounds, overweight_cents_per_pound)
+		VALUES ($1, $2, 2, 3000, 20, 50) RETURNING id`,
+		orderID, db.GetServiceID(t, "standard_bag"),
+	).Scan(&bagItemID)
+
+	handler := &FacilityHandler{db: db.DB, getUserID: CreateAuthMock(staffID).getUserIDFromRequest}
+	send := func(handle http.HandlerFunc, method string, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		handle(w, mux.SetURLVars(httptest.NewRequest(method, "/api/v1/admin/facility", bytes.NewBuffer(encoded)), vars))
+		return w
+	}
+	scan := func(code string) *httptest.ResponseRecorder {
+		return send(handler.handleScanBagIntake, "POST", nil, FacilityIntakeRequest{OrderID: orderID, BagCode: code})
+	}
+
+	if w := scan("TAG-1"); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d scanning an order not yet picked up, got %d", http.StatusConflict, w.Code)
+	}
+	db.Exec("UPDATE orders SET status = 'picked_up' WHERE id = $1", orderID)
+
+	w := scan("TAG-1")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var bag FacilityBag
+	json.Unmarshal(w.Body.Bytes(), &bag)
+	if bag.Stage != "received" || bag.OrderItemID == nil || *bag.OrderItemID != bagItemID {
+		t.Errorf("Expected the bag received on the order's only bag line, got %s", w.Body.String())
+	}
+	if w := scan("TAG-1"); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a tag already in the facility, got %d", http.StatusConflict, w.Code)
+	}
+	scan("TAG-2")
+
+	var status string
+	db.QueryRow("SELECT status FROM orders WHERE id = $1", orderID).Scan(&status)
+	if status != "in_process" {
+		t.Errorf("Expected the first bag to put the order in process, got %s", status)
+	}
+
+	// Bags move forward only, and the order can't be ready until they're all folded
+	tag1 := map[string]string{"code": "TAG-1"}
+	if w := send(handler.handleUpdateBagStage, "PUT", tag1, map[string]string{"stage": "folded"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := send(handler.handleUpdateBagStage, "PUT", tag1, map[string]string{"stage": "washing"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d moving a bag back, got %d", http.StatusConflict, w.Code)
+	}
+	ready := map[string]string{"id": fmt.Sprint(orderID)}
+	if w := send(handler.handleMarkOrderReady, "POST", ready, nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d with a bag still washing, got %d", http.StatusConflict, w.Code)
+	}
+
+	// 46 lb over two bags is 6 pounds over
+	send(handler.handleRecordFacilityWeight, "PUT", tag1, map[string]float64{"weight": 25})
+	w = send(handler.handleRecordFacilityWeight, "PUT", map[string]string{"code": "TAG-2"}, map[string]float64{"weight": 21})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var result BagWeightResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.TotalWeight != 46 || result.OverweightCharge != 3 {
+		t.Errorf("Unexpected re-pricing %+v", result)
+	}
+
+	send(handler.handleUpdateBagStage, "PUT", map[string]string{"code": "TAG-2"}, map[string]string{"stage": "folded"})
+	w = send(handler.handleMarkOrderReady, "POST", ready, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var order Order
+	json.Unmarshal(w.Body.Bytes(), &order)
+	if order.Status != "ready" {
+		t.Errorf("Expected the order ready for delivery, got %s", order.Status)
+	}
+	var facilityNotes int
+	db.QueryRow(`
+		SELECT COUNT(*) FROM order_status_history
+		WHERE order_id = $1 AND updated_by = $2`,
+		orderID, staffID,
+	).Scan(&facilityNotes)
+	if facilityNotes != 6 {
+		t.Errorf("Expected intake, stages, reweigh and ready in the history, got %d entries", facilityNotes)
+	}
+
+	// Released tags can be scanned in on the next order
+	if bags, _ := openFacilityBag(db.DB, "TAG-1"); bags != nil {
+		t.Errorf("Expected the tag released, got %+v", bags)
+	}
+}
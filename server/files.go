@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tumble-backend/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxFileUploadBytes = 10 << 20
+	fileURLExpiry      = 15 * time.Minute
+)
+
+// allowedFileContentTypes are the sniffed types accepted by /files
+var allowedFileContentTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+// defaultFileQuotas is how much each role can keep stored at once.
+// FILE_QUOTA_<ROLE>_MB overrides them. Roles not listed, like custom staff
+// roles, get the customer quota.
+var defaultFileQuotas = map[string]int64{
+	"customer": 100 << 20,
+	"driver":   500 << 20,
+	"admin":    5 << 30,
+}
+
+// storageConfigFromEnv reads the storage settings, filling in what local
+// development needs: signed download links are served by this API, and are
+// signed with the JWT secret unless a storage key is set.
+func storageConfigFromEnv() storage.Config {
+	config := storage.ConfigFromEnv()
+	if config.PublicURL == "" {
+		config.PublicURL = os.Getenv("FRONTEND_URL") + APIPrefix + "/storage"
+	}
+	if config.SigningKey == "" {
+		config.SigningKey = os.Getenv("JWT_SECRET")
+	}
+	if config.SigningKey == "" && (config.Backend == "" || config.Backend == "local") {
+		key := make([]byte, 32)
+		rand.Read(key)
+		config.SigningKey = hex.EncodeToString(key)
+		log.Printf("STORAGE_SIGNING_KEY not set; file links will stop working on restart")
+	}
+	return config
+}
+
+func fileQuotasFromEnv() map[string]int64 {
+	quotas := map[string]int64{}
+	for role, quota := range defaultFileQuotas {
+		quotas[role] = quota
+		if mb, err := strconv.ParseInt(os.Getenv("FILE_QUOTA_"+strings.ToUpper(role)+"_MB"), 10, 64); err == nil && mb >= 0 {
+			quotas[role] = mb << 20
+		}
+	}
+	return quotas
+}
+
+// FileHandler stores user uploads in the object store and enforces per-role
+// quotas on them
+type FileHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+	store     storage.Store
+	quotas    map[string]int64
+}
+
+func NewFileHandler(db *sql.DB, store storage.Store) *FileHandler {
+	return &FileHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+		store:     store,
+		quotas:    fileQuotasFromEnv(),
+	}
+}
+
+type File struct {
+	ID          int       `json:"id"`
+	OwnerID     int       `json:"owner_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	URL         string    `json:"url"` // Signed download link, valid for 15 minutes
+	CreatedAt   time.Time `json:"created_at"`
+	storageKey  string
+}
+
+const fileColumns = "id, owner_id, filename, content_type, size_bytes, created_at, storage_key"
+
+func scanFile(scanner interface{ Scan(...interface{}) error }) (File, error) {
+	var f File
+	err := scanner.Scan(&f.ID, &f.OwnerID, &f.Filename, &f.ContentType, &f.Size, &f.CreatedAt, &f.storageKey)
+	return f, err
+}
+
+func (h *FileHandler) withURL(r *http.Request, f File) (File, error) {
+	url, err := h.store.SignedURL(r.Context(), f.storageKey, fileURLExpiry)
+	f.URL = url
+	return f, err
+}
+
+// quota returns how much a role can keep stored, falling back to the
+// customer quota for roles without one of their own
+func (h *FileHandler) quota(role string) int64 {
+	if quota, ok := h.quotas[role]; ok {
+		return quota
+	}
+	return h.quotas["customer"]
+}
+
+// accessibleFile loads a file the user owns, or any file if their role
+// grants the permission
+func (h *FileHandler) accessibleFile(w http.ResponseWriter, r *http.Request, permission string) (File, bool) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return File{}, false
+	}
+	fileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return File{}, false
+	}
+
+	f, err := scanFile(h.db.QueryRow(`
+		SELECT `+fileColumns+` FROM files WHERE id = $1`,
+		fileID,
+	))
+	if err == nil && f.OwnerID != userID {
+		var allowed bool
+		allowed, err = userHasPermission(h.db, userID, permission)
+		if err == nil && !allowed {
+			err = sql.ErrNoRows
+		}
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return File{}, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch file", http.StatusInternalServerError)
+		return File{}, false
+	}
+	return f, true
+}
+
+// handleUploadFile stores the "file" field of a multipart form. It's
+// rejected if it's too big, of a type we don't accept, or would take the
+// user over their role's quota.
+func (h *FileHandler) handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileUploadBytes+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "File is required (max 10MB)", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxFileUploadBytes+1))
+	if err != nil {
+		http.Error(w, "File is too large", http.StatusBadRequest)
+		return
+	}
+	contentType, ext, err := storage.Validate(data, maxFileUploadBytes, allowedFileContentTypes)
+	if errors.Is(err, storage.ErrTooLarge) {
+		http.Error(w, "File is too large (max 10MB)", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "File must be a JPEG, PNG, WebP or PDF", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Lock the user's row so concurrent uploads can't both squeeze under the quota
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var role string
+	var usedBytes int64
+	err = tx.QueryRow("SELECT role FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&role)
+	if err == nil {
+		err = tx.QueryRow("SELECT COALESCE(SUM(size_bytes), 0) FROM files WHERE owner_id = $1", userID).Scan(&usedBytes)
+	}
+	if err != nil {
+		http.Error(w, "Failed to check storage quota", http.StatusInternalServerError)
+		return
+	}
+	if usedBytes+int64(len(data)) > h.quota(role) {
+		http.Error(w, "Storage quota exceeded; delete some files and try again", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	key := fmt.Sprintf("users/%d/%s%s", userID, generateRandomString(16), ext)
+	if err := h.store.Put(r.Context(), key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		LogRequest("upload_file", r.Method, r.URL.Path, userID).Error("Failed to store file", "error", err)
+		http.Error(w, "Failed to store file", http.StatusInternalServerError)
+		return
+	}
+
+	filename := filepath.Base(header.Filename)
+	if filename == "." || filename == "/" || len(filename) > 255 {
+		filename = "upload" + ext
+	}
+	f, err := scanFile(tx.QueryRow(`
+		INSERT INTO files (owner_id, storage_key, filename, content_type, size_bytes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+fileColumns,
+		userID, key, filename, contentType, len(data),
+	))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		h.store.Delete(r.Context(), key)
+		http.Error(w, "Failed to store file", http.StatusInternalServerError)
+		return
+	}
+
+	if f, err = h.withURL(r, f); err != nil {
+		http.Error(w, "Failed to sign file URL", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f)
+}
+
+// handleGetFiles lists the user's files with how much of their quota is used
+func (h *FileHandler) handleGetFiles(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var role string
+	if err := h.db.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role); err != nil {
+		http.Error(w, "Failed to fetch files", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := h.db.Query("SELECT "+fileColumns+" FROM files WHERE owner_id = $1 ORDER BY created_at DESC, id DESC", userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch files", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	files := []File{}
+	var usedBytes int64
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err == nil {
+			f, err = h.withURL(r, f)
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch files", http.StatusInternalServerError)
+			return
+		}
+		usedBytes += f.Size
+		files = append(files, f)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files":       files,
+		"used_bytes":  usedBytes,
+		"quota_bytes": h.quota(role),
+	})
+}
+
+// handleGetFile returns a file's details with a fresh download link
+func (h *FileHandler) handleGetFile(w http.ResponseWriter, r *http.Request) {
+	f, ok := h.accessibleFile(w, r, "users.read")
+	if !ok {
+		return
+	}
+	f, err := h.withURL(r, f)
+	if err != nil {
+		http.Error(w, "Failed to sign file URL", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// handleDeleteFile removes a file and frees its quota. Files on an account
+// under legal hold are kept.
+func (h *FileHandler) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	f, ok := h.accessibleFile(w, r, "users.manage")
+	if !ok {
+		return
+	}
+	onHold, err := isOnLegalHold(h.db, f.OwnerID)
+	if err != nil {
+		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+		return
+	}
+	if onHold {
+		http.Error(w, "This file is under legal hold and cannot be deleted", http.StatusConflict)
+		return
+	}
+
+	if _, err := h.db.Exec("DELETE FROM files WHERE id = $1", f.ID); err != nil {
+		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+		return
+	}
+	// An orphaned object only costs storage, so a failed delete isn't the user's problem
+	if err := h.store.Delete(r.Context(), f.storageKey); err != nil {
+		log.Printf("Failed to delete stored file %s: %v", f.storageKey, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleServeStoredFile serves signed download links when files are kept on
+// local disk. Cloud backends sign links to the bucket directly, so this 404s
+// for them.
+func (h *FileHandler) handleServeStoredFile(w http.ResponseWriter, r *http.Request) {
+	local, ok := h.store.(*storage.Local)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	if !local.Verify(key, r.URL.Query()) {
+		http.Error(w, "Link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+
+	var contentType, filename string
+	err := h.db.QueryRow("SELECT content_type, filename FROM files WHERE storage_key = $1", key).Scan(&contentType, &filename)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := local.Get(r.Context(), key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, body)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"tumble-backend/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func newFileUploadRequest(t *testing.T, filename string, data []byte) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/v1/files", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestFiles(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	ownerID := db.CreateTestUser(t, "files@example.com", "Files", "Owner")
+	otherID := db.CreateTestUser(t, "other-files@example.com", "Other", "Customer")
+
+	store := storage.NewLocal(t.TempDir(), "https://tumble.test/api/v1/storage", []byte("secret"))
+	handler := NewFileHandler(db.DB, store)
+	handler.quotas = map[string]int64{"customer": 100}
+	actingAs := ownerID
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return actingAs, nil
+	}
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 52)...)
+
+	w := httptest.NewRecorder()
+	handler.handleUploadFile(w, newFileUploadRequest(t, "../../bag-tag.png", png))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var uploaded File
+	json.Unmarshal(w.Body.Bytes(), &uploaded)
+	if uploaded.Filename != "bag-tag.png" || uploaded.ContentType != "image/png" || uploaded.Size != 60 {
+		t.Errorf("Unexpected file %+v", uploaded)
+	}
+
+	tests := []struct {
+		name           string
+		filename       string
+		data           []byte
+		expectedStatus int
+	}{
+		{"disallowed type", "page.html", []byte("<html><body>hi</body></html>"), http.StatusUnsupportedMediaType},
+		{"over quota", "second.png", png, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.handleUploadFile(w, newFileUploadRequest(t, tt.filename, tt.data))
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+
+	// The signed link downloads the file without auth, but only unaltered
+	link, _ := url.Parse(uploaded.URL)
+	key := strings.TrimPrefix(link.Path, "/api/v1/storage/")
+	serve := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", link.Path+"?"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"key": key})
+		w := httptest.NewRecorder()
+		handler.handleServeStoredFile(w, req)
+		return w
+	}
+	if w := serve(link.RawQuery); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), png) || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Expected the PNG from the signed link, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if w := serve(strings.Replace(link.RawQuery, "expires=", "expires=9", 1)); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a tampered link to be refused, got %d", w.Code)
+	}
+
+	fileRequest := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/files/"+strconv.Itoa(uploaded.ID), nil)
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(uploaded.ID)})
+		w := httptest.NewRecorder()
+		if method == "DELETE" {
+			handler.handleDeleteFile(w, req)
+		} else {
+			handler.handleGetFile(w, req)
+		}
+		return w
+	}
+
+	actingAs = otherID
+	if w := fileRequest("GET"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected other users not to see the file, got %d", w.Code)
+	}
+
+	// Staff see other users' files through their role's permissions, and
+	// roles without a quota of their own get the customer quota
+	db.Exec("INSERT INTO roles (name) VALUES ('support')")
+	db.Exec("INSERT INTO role_permissions (role, permission) VALUES ('support', 'users.read')")
+	db.Exec("UPDATE users SET role = 'support' WHERE id = $1", otherID)
+	if w := fileRequest("GET"); w.Code != http.StatusOK {
+		t.Errorf("Expected support staff to see the file, got %d", w.Code)
+	}
+	if w := fileRequest("DELETE"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected support staff without users.manage not to delete the file, got %d", w.Code)
+	}
+	if quota := handler.quota("support"); quota != 100 {
+		t.Errorf("Expected the customer quota for a custom role, got %d", quota)
+	}
+
+	// Files on an account under legal hold are kept
+	actingAs = ownerID
+	db.Exec("INSERT INTO legal_holds (user_id, reason) VALUES ($1, 'Dispute')", ownerID)
+	if w := fileRequest("DELETE"); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d deleting a held file, got %d", http.StatusConflict, w.Code)
+	}
+	db.Exec("UPDATE legal_holds SET released_at = CURRENT_TIMESTAMP WHERE user_id = $1", ownerID)
+
+	if w := fileRequest("DELETE"); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if w := serve(link.RawQuery); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the deleted file to be gone, got %d", w.Code)
+	}
+
+	// Deleting freed the quota
+	w = httptest.NewRecorder()
+	handler.handleUploadFile(w, newFileUploadRequest(t, "second.png", png))
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected the upload to fit after deleting, got %d", w.Code)
+	}
+}
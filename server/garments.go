@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// GarmentHandler serves the dry-cleaning garment catalog and facility check-in
+type GarmentHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewGarmentHandler(db *sql.DB) *GarmentHandler {
+	return &GarmentHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type GarmentType struct {
+	ID          int     `json:"id"`
+	Name        string  `json:"name"`
+	DisplayName string  `json:"display_name"`
+	Price       float64 `json:"price"` // Per piece
+}
+
+// OrderGarment is an itemized, per-piece priced line on an order
+type OrderGarment struct {
+	ID               int        `json:"id"`
+	GarmentTypeID    int        `json:"garment_type_id"`
+	GarmentName      string     `json:"garment_name"`
+	Quantity         int        `json:"quantity"`
+	UnitPrice        float64    `json:"unit_price"`
+	CareFlags        []string   `json:"care_flags"`
+	Notes            *string    `json:"notes,omitempty"`
+	ReceivedQuantity *int       `json:"received_quantity,omitempty"`
+	CheckedInAt      *time.Time `json:"checked_in_at,omitempty"`
+	// AddedAtPickup lines were found by the driver and aren't charged
+	AddedAtPickup   bool `json:"added_at_pickup"`
+	DamagedQuantity int  `json:"damaged_quantity"`
+}
+
+// OrderGarmentRequest is a garment line submitted with a new order. Prices
+// always come from the catalog, never the client.
+type OrderGarmentRequest struct {
+	GarmentTypeID int      `json:"garment_type_id"`
+	Quantity      int      `json:"quantity"`
+	CareFlags     []string `json:"care_flags,omitempty"`
+	Notes         *string  `json:"notes,omitempty"`
+}
+
+// validGarmentCareFlags are the special care instructions the facility handles
+var validGarmentCareFlags = map[string]bool{
+	"light_starch": true,
+	"heavy_starch": true,
+	"no_starch":    true,
+	"delicate":     true,
+	"stain":        true,
+	"press_only":   true,
+	"hang_dry":     true,
+	"box_fold":     true,
+}
+
+// validateGarmentRequests checks quantities and care flags before anything is written
+func validateGarmentRequests(garments []OrderGarmentRequest) error {
+	for _, g := range garments {
+		if g.GarmentTypeID <= 0 {
+			return fmt.Errorf("garment_type_id is required")
+		}
+		if g.Quantity <= 0 {
+			return fmt.Errorf("garment quantity must be positive")
+		}
+		for _, flag := range g.CareFlags {
+			if !validGarmentCareFlags[flag] {
+				return fmt.Errorf("unknown care flag %q", flag)
+			}
+		}
+	}
+	return nil
+}
+
+var errUnknownGarmentType = errors.New("unknown garment type")
+
+// insertOrderGarments adds garment lines at catalog prices and returns their
+// combined cost in cents
+func insertOrderGarments(tx *sql.Tx, orderID int, garments []OrderGarmentRequest) (int, error) {
+	totalCents := 0
+	for _, g := range garments {
+		var priceCents int
+		err := tx.QueryRow(
+			"SELECT price_cents FROM garment_types WHERE id = $1 AND is_active = true",
+			g.GarmentTypeID,
+		).Scan(&priceCents)
+		if err == sql.ErrNoRows {
+			return 0, errUnknownGarmentType
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		careFlags := g.CareFlags
+		if careFlags == nil {
+			careFlags = []string{}
+		}
+		_, err = tx.Exec(`
+			INSERT INTO order_garments (order_id, garment_type_id, quantity, unit_price_cents, care_flags, notes)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			orderID, g.GarmentTypeID, g.Quantity, priceCents, pq.Array(careFlags), g.Notes,
+		)
+		if err != nil {
+			return 0, err
+		}
+		totalCents += priceCents * g.Quantity
+	}
+	return totalCents, nil
+}
+
+// getOrderGarments returns the garment lines on an order
+func getOrderGarments(db *sql.DB, orderID int) ([]OrderGarment, error) {
+	rows, err := db.Query(`
+		SELECT og.id, og.garment_type_id, gt.display_name, og.quantity, og.unit_price_cents,
+		       og.care_flags, og.notes, og.received_quantity, og.checked_in_at,
+		       og.added_at_pickup, og.damaged_quantity
+		FROM order_garments og
+		JOIN garment_types gt ON og.garment_type_id = gt.id
+		WHERE og.order_id = $1
+		ORDER BY og.id`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	garments := []OrderGarment{}
+	for rows.Next() {
+		var g OrderGarment
+		var unitPriceCents int
+		err := rows.Scan(&g.ID, &g.GarmentTypeID, &g.GarmentName, &g.Quantity, &unitPriceCents,
+			pq.Array(&g.CareFlags), &g.Notes, &g.ReceivedQuantity, &g.CheckedInAt,
+			&g.AddedAtPickup, &g.DamagedQuantity)
+		if err != nil {
+			return nil, err
+		}
+		g.UnitPrice = centsToDollars(unitPriceCents)
+		if g.CareFlags == nil {
+			g.CareFlags = []string{}
+		}
+		garments = append(garments, g)
+	}
+	return garments, nil
+}
+
+// handleGetGarmentTypes returns the active garment catalog
+func (h *GarmentHandler) handleGetGarmentTypes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, name, display_name, price_cents
+		FROM garment_types
+		WHERE is_active = true
+		ORDER BY price_cents, name`)
+	if err != nil {
+		http.Error(w, "Failed to fetch garment types", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	types := []GarmentType{}
+	for rows.Next() {
+		var gt GarmentType
+		var priceCents int
+		if err := rows.Scan(&gt.ID, &gt.Name, &gt.DisplayName, &priceCents); err != nil {
+			http.Error(w, "Failed to parse garment types", http.StatusInternalServerError)
+			return
+		}
+		gt.Price = centsToDollars(priceCents)
+		types = append(types, gt)
+	}
+
+	careFlags := []string{}
+	for flag := range validGarmentCareFlags {
+		careFlags = append(careFlags, flag)
+	}
+	sort.Strings(careFlags)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"garment_types": types,
+		"care_flags":    careFlags,
+	})
+}
+
+type GarmentCheckInRequest struct {
+	Garments []struct {
+		ID               int      `json:"id"`
+		ReceivedQuantity int      `json:"received_quantity"`
+		CareFlags        []string `json:"care_flags,omitempty"` // Replaces flags when set
+		Notes            *string  `json:"notes,omitempty"`
+	} `json:"garments"`
+}
+
+// handleCheckInGarments records what the facility actually received for each
+// garment line and reports lines that don't match what the customer declared
+func (h *GarmentHandler) handleCheckInGarments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	staffID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req GarmentCheckInRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Garments) == 0 {
+		http.Error(w, "No garments specified", http.StatusBadRequest)
+		return
+	}
+	for _, g := range req.Garments {
+		if g.ReceivedQuantity < 0 {
+			http.Error(w, "received_quantity cannot be negative", http.StatusBadRequest)
+			return
+		}
+		for _, flag := range g.CareFlags {
+			if !validGarmentCareFlags[flag] {
+				http.Error(w, fmt.Sprintf("Unknown care flag %q", flag), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, g := range req.Garments {
+		var careFlags interface{}
+		if g.CareFlags != nil {
+			careFlags = pq.Array(g.CareFlags)
+		}
+		result, err := tx.Exec(`
+			UPDATE order_garments
+			SET received_quantity = $1,
+			    care_flags = COALESCE($2, care_flags),
+			    notes = COALESCE($3, notes),
+			    checked_in_at = CURRENT_TIMESTAMP,
+			    checked_in_by = $4
+			WHERE id = $5 AND order_id = $6`,
+			g.ReceivedQuantity, careFlags, g.Notes, staffID, g.ID, orderID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to check in garments", http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			http.Error(w, fmt.Sprintf("Garment %d not found on order", g.ID), http.StatusNotFound)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to check in garments", http.StatusInternalServerError)
+		return
+	}
+
+	garments, err := getOrderGarments(h.db, orderID)
+	if err != nil {
+		http.Error(w, "Failed to fetch garments", http.StatusInternalServerError)
+		return
+	}
+
+	discrepancies := []OrderGarment{}
+	for _, g := range garments {
+		if g.ReceivedQuantity != nil && *g.ReceivedQuantity != g.Quantity {
+			discrepancies = append(discrepancies, g)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"garments":      garments,
+		"discrepancies": discrepancies,
+	})
+}
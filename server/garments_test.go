@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidateGarmentRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		garments []OrderGarmentRequest
+		wantErr  bool
+	}{
+		{"No garments", nil, false},
+		{"Valid garment", []OrderGarmentRequest{{GarmentTypeID: 1, Quantity: 3, CareFlags: []string{"light_starch"}}}, false},
+		{"Missing type", []OrderGarmentRequest{{Quantity: 1}}, true},
+		{"Zero quantity", []OrderGarmentRequest{{GarmentTypeID: 1, Quantity: 0}}, true},
+		{"Unknown care flag", []OrderGarmentRequest{{GarmentTypeID: 1, Quantity: 1, CareFlags: []string{"bleach"}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateGarmentRequests(tt.garments)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBuildOrderReceipt(t *testing.T) {
+	subtotal, tip, total := 46.00, 5.00, 51.00
+	pickupNote := "Pickup Service (Included)"
+	received := 2
+	order := &Order{
+		ID:       7,
+		Status:   "in_process",
+		Subtotal: &subtotal,
+		Tip:      &tip,
+		Total:    &total,
+		Items: []OrderItem{
+			{ServiceName: "pickup_service", Quantity: 1, Price: 0, Notes: &pickupNote},
+			{ServiceName: "standard_bag", Quantity: 1, Price: 30.00},
+		},
+		Garments: []OrderGarment{
+			{GarmentName: "Dress Shirt", Quantity: 4, UnitPrice: 4.00, CareFlags: []string{"light_starch"}, ReceivedQuantity: &received},
+		},
+	}
+
+	receipt := buildOrderReceipt(order)
+
+	if len(receipt.Lines) != 3 {
+		t.Fatalf("Expected 3 receipt lines, got %d", len(receipt.Lines))
+	}
+	if receipt.Lines[0].Description != pickupNote {
+		t.Errorf("Expected line notes to be used as description, got %s", receipt.Lines[0].Description)
+	}
+	garmentLine := receipt.Lines[2]
+	if garmentLine.Category != "garment" || garmentLine.LineTotal != 16.00 {
+		t.Errorf("Expected garment line totalling 16.00, got %+v", garmentLine)
+	}
+	if garmentLine.ReceivedQuantity == nil || *garmentLine.ReceivedQuantity != 2 {
+		t.Error("Expected received quantity on garment line")
+	}
+	if receipt.Total != 51.00 || receipt.Tax != 0 {
+		t.Errorf("Expected total 51.00 and no tax, got %.2f / %.2f", receipt.Total, receipt.Tax)
+	}
+}
+
+func TestGarmentHandler_CheckIn(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	staffID := db.CreateTestUser(t, "staff@example.com", "Staff", "User")
+	userID := db.CreateTestUser(t, "customer@example.com", "Customer", "User")
+	addressID := db.CreateTestAddress(t, userID)
+	orderID := db.CreateTestOrder(t, userID, addressID)
+
+	var shirtID int
+	if err := db.QueryRow("SELECT id FROM garment_types WHERE name = 'shirt'").Scan(&shirtID); err != nil {
+		t.Fatalf("Failed to get garment type: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	if _, err := insertOrderGarments(tx, orderID, []OrderGarmentRequest{{GarmentTypeID: 99999, Quantity: 1}}); err != errUnknownGarmentType {
+		t.Errorf("Expected unknown garment type error, got %v", err)
+	}
+	tx.Rollback()
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	garmentCents, err := insertOrderGarments(tx, orderID, []OrderGarmentRequest{{GarmentTypeID: shirtID, Quantity: 5}})
+	if err != nil {
+		t.Fatalf("Failed to insert garments: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit garments: %v", err)
+	}
+	if garmentCents != 2000 {
+		t.Errorf("Expected garments to cost 2000 cents at catalog price, got %d", garmentCents)
+	}
+
+	garments, err := getOrderGarments(db.DB, orderID)
+	if err != nil || len(garments) != 1 {
+		t.Fatalf("Failed to get garments: %v", err)
+	}
+
+	handler := NewGarmentHandler(db.DB)
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return staffID, nil
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"garments": []map[string]interface{}{
+			{"id": garments[0].ID, "received_quantity": 4, "care_flags": []string{"stain"}},
+		},
+	})
+	req := httptest.NewRequest("POST", fmt.Sprintf("/api/v1/admin/orders/%d/garments/check-in", orderID), bytes.NewBuffer(body))
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprintf("%d", orderID)})
+	w := httptest.NewRecorder()
+	handler.handleCheckInGarments(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Garments      []OrderGarment `json:"garments"`
+		Discrepancies []OrderGarment `json:"discrepancies"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(response.Discrepancies) != 1 {
+		t.Errorf("Expected 1 discrepancy, got %d", len(response.Discrepancies))
+	}
+	if len(response.Garments[0].CareFlags) != 1 || response.Garments[0].CareFlags[0] != "stain" {
+		t.Errorf("Expected care flags to be updated, got %v", response.Garments[0].CareFlags)
+	}
+}
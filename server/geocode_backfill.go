@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxGeocodeBackfillBatch bounds how many addresses one run geocodes;
+	// the rest wait for the next run
+	maxGeocodeBackfillBatch     = 500
+	defaultGeocodeBackfillBatch = 100
+	// geocodeBackfillPause spaces requests out to stay under the geocoder's
+	// rate limit
+	geocodeBackfillPause = 100 * time.Millisecond
+	// geocodeRecheckAge is how old a geocode is before a recheck run places
+	// the address again to catch geocoder corrections
+	geocodeRecheckAge = 90 * 24 * time.Hour
+
+	defaultGeocodeDriftLimit = 50
+	maxGeocodeDriftLimit     = 200
+)
+
+// geocodeDriftThresholdKm is how far a new geocode can land from the old one
+// before it's reported (GEOCODE_DRIFT_THRESHOLD_KM)
+func geocodeDriftThresholdKm() float64 {
+	if km, err := strconv.ParseFloat(os.Getenv("GEOCODE_DRIFT_THRESHOLD_KM"), 64); err == nil && km > 0 {
+		return km
+	}
+	return 1.0
+}
+
+// AddressGeocodeDrift is an address whose new geocode landed far from the
+// old one
+type AddressGeocodeDrift struct {
+	ID         int        `json:"id"`
+	AddressID  int        `json:"address_id"`
+	UserID     *int       `json:"user_id,omitempty"`
+	Address    string     `json:"address,omitempty"`
+	Reason     string     `json:"reason"` // edited, recheck
+	Previous   LatLng     `json:"previous"`
+	Location   LatLng     `json:"location"`
+	DistanceKm float64    `json:"distance_km"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+	ReviewedBy *int       `json:"reviewed_by,omitempty"`
+	ReviewNote *string    `json:"review_note,omitempty"`
+	DetectedAt time.Time  `json:"detected_at"`
+}
+
+// GeocodeBackfillRun is the outcome of one backfill run
+type GeocodeBackfillRun struct {
+	ID          int                   `json:"id"`
+	Recheck     bool                  `json:"recheck"`
+	Candidates  int                   `json:"candidates"`
+	Geocoded    int                   `json:"geocoded"`
+	NotFound    int                   `json:"not_found"`
+	Failed      int                   `json:"failed"`
+	Drifted     int                   `json:"drifted"`
+	DurationMs  int64                 `json:"duration_ms"`
+	TriggeredBy *int                  `json:"triggered_by,omitempty"`
+	CreatedAt   time.Time             `json:"created_at"`
+	Drifts      []AddressGeocodeDrift `json:"drifts"`
+}
+
+type RunGeocodeBackfillRequest struct {
+	Limit int `json:"limit,omitempty"`
+	// Also geocode addresses placed more than 90 days ago
+	Recheck bool `json:"recheck,omitempty"`
+}
+
+type ReviewGeocodeDriftRequest struct {
+	Note *string `json:"note,omitempty"`
+}
+
+// markGeocodeFailed records that the geocoder couldn't place an address, so
+// the backfill stops asking until it's edited
+func markGeocodeFailed(db *sql.DB, addressID int) error {
+	_, err := db.Exec("UPDATE addresses SET geocode_failed_at = CURRENT_TIMESTAMP WHERE id = $1", addressID)
+	return err
+}
+
+// saveAddressGeocode stores an address's coordinates. When it had a pin
+// before, from before an edit or from an earlier geocode, and the new one is
+// further away than the drift threshold, the move is recorded and returned.
+func saveAddressGeocode(db *sql.DB, addressID int, location LatLng) (*AddressGeocodeDrift, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var lat, lng, prevLat, prevLng sql.NullFloat64
+	err = tx.QueryRow(`
+		SELECT latitude, longitude, previous_latitude, previous_longitude
+		FROM addresses WHERE id = $1 FOR UPDATE`,
+		addressID,
+	).Scan(&lat, &lng, &prevLat, &prevLng)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE addresses SET latitude = $1, longitude = $2, geocoded_at = CURRENT_TIMESTAMP,
+			previous_latitude = NULL, previous_longitude = NULL, geocode_failed_at = NULL
+		WHERE id = $3`,
+		location.Latitude, location.Longitude, addressID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var drift *AddressGeocodeDrift
+	reason, previous := "recheck", LatLng{Latitude: lat.Float64, Longitude: lng.Float64}
+	if !lat.Valid || !lng.Valid {
+		reason, previous = "edited", LatLng{Latitude: prevLat.Float64, Longitude: prevLng.Float64}
+	}
+	hadPin := (lat.Valid && lng.Valid) || (prevLat.Valid && prevLng.Valid)
+	if distance := haversineKm(previous, location); hadPin && distance >= geocodeDriftThresholdKm() {
+		drift = &AddressGeocodeDrift{
+			AddressID:  addressID,
+			Reason:     reason,
+			Previous:   previous,
+			Location:   location,
+			DistanceKm: distance,
+		}
+		err = tx.QueryRow(`
+			INSERT INTO address_geocode_drifts
+				(address_id, reason, previous_latitude, previous_longitude, latitude, longitude, distance_km)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id, detected_at`,
+			addressID, reason, previous.Latitude, previous.Longitude, location.Latitude, location.Longitude, distance,
+		).Scan(&drift.ID, &drift.DetectedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if drift != nil {
+		log.Printf("Address %d geocode moved %.2f km (%s)", addressID, drift.DistanceKm, reason)
+	}
+	return drift, nil
+}
+
+// runGeocodeBackfill geocodes addresses without coordinates, oldest first,
+// then with recheck set ones placed more than geocodeRecheckAge ago. Each
+// address is one geocoder call; failures are counted and left for the next
+// run. The run is recorded whatever happens to individual addresses.
+func runGeocodeBackfill(ctx context.Context, db *sql.DB, geocoder Geocoder, limit int, recheck bool, pause time.Duration, triggeredBy *int) (GeocodeBackfillRun, error) {
+	started := time.Now()
+	run := GeocodeBackfillRun{Recheck: recheck, TriggeredBy: triggeredBy, Drifts: []AddressGeocodeDrift{}}
+
+	type candidate struct {
+		id                       int
+		street, city, state, zip string
+	}
+	rows, err := db.Query(`
+		SELECT id, street_address, city, state, zip_code FROM addresses
+		WHERE (latitude IS NULL AND geocode_failed_at IS NULL)
+			OR ($2 AND latitude IS NOT NULL AND geocoded_at < $3)
+		ORDER BY latitude IS NOT NULL, geocoded_at, id
+		LIMIT $1`,
+		limit, recheck, started.Add(-geocodeRecheckAge),
+	)
+	if err != nil {
+		return run, err
+	}
+	candidates := []candidate{}
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.id, &c.street, &c.city, &c.state, &c.zip); err != nil {
+			rows.Close()
+			return run, err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return run, err
+	}
+	run.Candidates = len(candidates)
+
+	for i, c := range candidates {
+		if i > 0 && pause > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(pause):
+			}
+		}
+		if ctx.Err() != nil {
+			// Whatever's left waits for the next run
+			run.Failed += len(candidates) - i
+			break
+		}
+
+		location, err := geocoder.Geocode(ctx, geocodeQuery(c.street, c.city, c.state, c.zip))
+		if err == errAddressNotFound {
+			run.NotFound++
+			if err := markGeocodeFailed(db, c.id); err != nil {
+				log.Printf("Failed to mark address %d ungeocodable: %v", c.id, err)
+			}
+			continue
+		}
+		if err != nil {
+			run.Failed++
+			log.Printf("Failed to geocode address %d: %v", c.id, err)
+			continue
+		}
+		drift, err := saveAddressGeocode(db, c.id, location)
+		if err != nil {
+			run.Failed++
+			log.Printf("Failed to save geocode for address %d: %v", c.id, err)
+			continue
+		}
+		run.Geocoded++
+		if drift != nil {
+			run.Drifted++
+			run.Drifts = append(run.Drifts, *drift)
+		}
+	}
+
+	run.DurationMs = time.Since(started).Milliseconds()
+	err = db.QueryRow(`
+		INSERT INTO geocode_backfill_runs (recheck, candidates, geocoded, not_found, failed, drifted, duration_ms, triggered_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at`,
+		run.Recheck, run.Candidates, run.Geocoded, run.NotFound, run.Failed, run.Drifted, run.DurationMs, run.TriggeredBy,
+	).Scan(&run.ID, &run.CreatedAt)
+	return run, err
+}
+
+// processGeocodeBackfill is the nightly backfill. It also rechecks old
+// geocodes, and flags any addresses that moved in the admin inbox.
+func (s *AutoScheduler) processGeocodeBackfill() {
+	if s.geocoder == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	run, err := runGeocodeBackfill(ctx, s.db, s.geocoder, maxGeocodeBackfillBatch, true, geocodeBackfillPause, nil)
+	if err != nil {
+		log.Printf("Error running geocode backfill: %v", err)
+		return
+	}
+	log.Printf("Geocode backfill: %d geocoded, %d not found, %d failed, %d moved", run.Geocoded, run.NotFound, run.Failed, run.Drifted)
+
+	if run.Drifted > 0 {
+		addressIDs := make([]int, len(run.Drifts))
+		for i, drift := range run.Drifts {
+			addressIDs[i] = drift.AddressID
+		}
+		logAdminAlert(s.db, AdminAlert{
+			Type:      "geocode_drift",
+			Severity:  "warning",
+			Title:     "Address geocodes moved",
+			Message:   fmt.Sprintf("%d addresses geocoded more than %.1f km from where they were; check for bad edits", run.Drifted, geocodeDriftThresholdKm()),
+			DedupeKey: "geocode_drift:" + time.Now().Format("2006-01-02"),
+			Data:      map[string]interface{}{"run_id": run.ID, "address_ids": addressIDs},
+		})
+	}
+}
+
+// handleRunGeocodeBackfill runs the backfill now instead of waiting for the
+// nightly job
+func (h *AdminHandler) handleRunGeocodeBackfill(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if h.geocoder == nil {
+		http.Error(w, "No geocoder is configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req RunGeocodeBackfillRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultGeocodeBackfillBatch
+	}
+	if req.Limit < 1 || req.Limit > maxGeocodeBackfillBatch {
+		http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxGeocodeBackfillBatch), http.StatusBadRequest)
+		return
+	}
+
+	run, err := runGeocodeBackfill(r.Context(), h.db, h.geocoder, req.Limit, req.Recheck, geocodeBackfillPause, &adminID)
+	if err != nil {
+		http.Error(w, "Failed to run geocode backfill", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// handleGetGeocodeDrifts lists addresses whose geocode moved, newest first.
+// ?reviewed=true|false filters on review; ?limit= caps the list.
+func (h *AdminHandler) handleGetGeocodeDrifts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var reviewed *bool
+	if v := query.Get("reviewed"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid reviewed", http.StatusBadRequest)
+			return
+		}
+		reviewed = &b
+	}
+	limit := defaultGeocodeDriftLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxGeocodeDriftLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxGeocodeDriftLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := h.db.Query(`
+		SELECT d.id, d.address_id, a.user_id, a.street_address, a.city, a.state, a.zip_code, d.reason,
+			d.previous_latitude, d.previous_longitude, d.latitude, d.longitude, d.distance_km,
+			d.reviewed_at, d.reviewed_by, d.review_note, d.detected_at
+		FROM address_geocode_drifts d
+		JOIN addresses a ON a.id = d.address_id
+		WHERE $1::boolean IS NULL OR (d.reviewed_at IS NOT NULL) = $1
+		ORDER BY d.detected_at DESC, d.id DESC
+		LIMIT $2`,
+		reviewed, limit,
+	)
+	if err != nil {
+		http.Error(w, "Failed to load geocode drift", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	drifts := []AddressGeocodeDrift{}
+	for rows.Next() {
+		var d AddressGeocodeDrift
+		var street, city, state, zip string
+		if err := rows.Scan(
+			&d.ID, &d.AddressID, &d.UserID, &street, &city, &state, &zip, &d.Reason,
+			&d.Previous.Latitude, &d.Previous.Longitude, &d.Location.Latitude, &d.Location.Longitude, &d.DistanceKm,
+			&d.ReviewedAt, &d.ReviewedBy, &d.ReviewNote, &d.DetectedAt,
+		); err != nil {
+			http.Error(w, "Failed to load geocode drift", http.StatusInternalServerError)
+			return
+		}
+		d.Address = geocodeQuery(street, city, state, zip)
+		drifts = append(drifts, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drifts)
+}
+
+// handleReviewGeocodeDrift marks a moved geocode as checked. A bad edit is
+// fixed on the address itself, which puts it back in the backfill.
+func (h *AdminHandler) handleReviewGeocodeDrift(w http.ResponseWriter, r *http.Request) {
+	driftID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid drift ID", http.StatusBadRequest)
+		return
+	}
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReviewGeocodeDriftRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Note != nil {
+		if note := strings.TrimSpace(*req.Note); note != "" {
+			req.Note = &note
+		} else {
+			req.Note = nil
+		}
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE address_geocode_drifts SET reviewed_at = CURRENT_TIMESTAMP, reviewed_by = $2, review_note = $3
+		WHERE id = $1 AND reviewed_at IS NULL`,
+		driftID, adminID, req.Note,
+	)
+	if err != nil {
+		http.Error(w, "Failed to review geocode drift", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Geocode drift not found or already reviewed", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGeocodeBackfill(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "geocode-backfill@example.com", "Geocode", "Backfill")
+	newID := db.CreateTestAddress(t, userID)
+	movedID := db.CreateTestAddress(t, userID)
+	db.Exec("UPDATE addresses SET street_address = '9 Old Rd', latitude = 40.70, longitude = -74.00, geocoded_at = CURRENT_TIMESTAMP WHERE id = $1", movedID)
+	lostID := db.CreateTestAddress(t, userID)
+	db.Exec("UPDATE addresses SET street_address = '0 Nowhere Ln' WHERE id = $1", lostID)
+
+	// The customer edits the street; the old pin is kept to compare against
+	req := httptest.NewRequest("PUT", fmt.Sprintf("/api/v1/addresses/%d", movedID), strings.NewReader(`{"street_address": "9 New Rd"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(movedID)})
+	addresses := NewAddressHandler(db.DB)
+	addresses.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+	w := httptest.NewRecorder()
+	addresses.handleUpdateAddress(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	geocoder := &stubGeocoder{locations: map[string]LatLng{
+		"123 Test St, Test City, CA 12345": {40.71, -74.01},
+		"9 New Rd, Test City, CA 12345":    {40.80, -74.00}, // About 11 km north
+	}}
+	run, err := runGeocodeBackfill(context.Background(), db.DB, geocoder, 10, false, 0, nil)
+	if err != nil {
+		t.Fatalf("Backfill failed: %v", err)
+	}
+	if run.Candidates != 3 || run.Geocoded != 2 || run.NotFound != 1 || run.Drifted != 1 || run.ID == 0 {
+		t.Errorf("Unexpected run: %+v", run)
+	}
+	if len(run.Drifts) != 1 || run.Drifts[0].AddressID != movedID || run.Drifts[0].Reason != "edited" || run.Drifts[0].DistanceKm < 10 {
+		t.Errorf("Expected the edited address reported as moved, got %+v", run.Drifts)
+	}
+
+	var lat float64
+	db.QueryRow("SELECT latitude FROM addresses WHERE id = $1", newID).Scan(&lat)
+	if lat != 40.71 {
+		t.Errorf("Expected the new address placed, got latitude %f", lat)
+	}
+
+	// Nothing is left to do, and the ungeocodable address isn't retried
+	calls := geocoder.calls
+	if run, _ := runGeocodeBackfill(context.Background(), db.DB, geocoder, 10, false, 0, nil); run.Candidates != 0 || geocoder.calls != calls {
+		t.Errorf("Expected an empty second run, got %+v after %d geocoder calls", run, geocoder.calls-calls)
+	}
+
+	// A recheck of an old geocode that hasn't moved isn't reported
+	db.Exec("UPDATE addresses SET geocoded_at = CURRENT_TIMESTAMP - INTERVAL '120 days' WHERE id = $1", newID)
+	if run, _ := runGeocodeBackfill(context.Background(), db.DB, geocoder, 10, true, 0, nil); run.Candidates != 1 || run.Geocoded != 1 || run.Drifted != 0 {
+		t.Errorf("Expected the stale geocode rechecked without drift, got %+v", run)
+	}
+
+	admin := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(userID).getUserIDFromRequest}
+	w = httptest.NewRecorder()
+	admin.handleGetGeocodeDrifts(w, httptest.NewRequest("GET", "/api/v1/admin/addresses/geocode-drift?reviewed=false", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "9 New Rd, Test City") {
+		t.Errorf("Expected the drift listed with its address, got %d: %s", w.Code, w.Body.String())
+	}
+
+	review := func() int {
+		req := httptest.NewRequest("POST", "/api/v1/admin/addresses/geocode-drift/x/review", strings.NewReader(`{"note": "Customer moved"}`))
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(run.Drifts[0].ID)})
+		w := httptest.NewRecorder()
+		admin.handleReviewGeocodeDrift(w, req)
+		return w.Code
+	}
+	if code := review(); code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, code)
+	}
+	if code := review(); code != http.StatusNotFound {
+		t.Errorf("Expected status %d reviewing twice, got %d", http.StatusNotFound, code)
+	}
+}
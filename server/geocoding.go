@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LatLng is a point on the map
+type LatLng struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+var errAddressNotFound = errors.New("address not found by geocoder")
+
+// Geocoder turns a postal address into coordinates
+type Geocoder interface {
+	Geocode(ctx context.Context, address string) (LatLng, error)
+}
+
+// TravelTimeEstimator returns driving times between every pair of points;
+// matrix[i][j] is the time from points[i] to points[j]
+type TravelTimeEstimator interface {
+	TravelTimes(ctx context.Context, points []LatLng) ([][]time.Duration, error)
+}
+
+// MapboxGeocoder uses the Mapbox geocoding API
+type MapboxGeocoder struct {
+	token  string
+	client *http.Client
+}
+
+func NewMapboxGeocoder(token string) *MapboxGeocoder {
+	return &MapboxGeocoder{token: token, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (g *MapboxGeocoder) Geocode(ctx context.Context, address string) (LatLng, error) {
+	endpoint := "https://api.mapbox.com/geocoding/v5/mapbox.places/" + url.PathEscape(address) + ".json?" + url.Values{
+		"access_token": {g.token},
+		"country":      {"us"},
+		"types":        {"address"},
+		"limit":        {"1"},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return LatLng{}, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return LatLng{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return LatLng{}, fmt.Errorf("mapbox geocoding returned %s", resp.Status)
+	}
+
+	var body struct {
+		Features []struct {
+			Center []float64 `json:"center"` // [longitude, latitude]
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return LatLng{}, err
+	}
+	if len(body.Features) == 0 || len(body.Features[0].Center) != 2 {
+		return LatLng{}, errAddressNotFound
+	}
+	return LatLng{Latitude: body.Features[0].Center[1], Longitude: body.Features[0].Center[0]}, nil
+}
+
+// OSRMTravelTimes uses an OSRM server's table service
+type OSRMTravelTimes struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewOSRMTravelTimes(baseURL string) *OSRMTravelTimes {
+	return &OSRMTravelTimes{baseURL: strings.TrimRight(baseURL, "/"), client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (o *OSRMTravelTimes) TravelTimes(ctx context.Context, points []LatLng) ([][]time.Duration, error) {
+	coords := make([]string, len(points))
+	for i, p := range points {
+		coords[i] = strconv.FormatFloat(p.Longitude, 'f', 6, 64) + "," + strconv.FormatFloat(p.Latitude, 'f', 6, 64)
+	}
+	endpoint := o.baseURL + "/table/v1/driving/" + strings.Join(coords, ";") + "?annotations=duration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Code      string       `json:"code"`
+		Durations [][]*float64 `json:"durations"` // Seconds; null when unroutable
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Code != "Ok" || len(body.Durations) != len(points) {
+		return nil, fmt.Errorf("osrm table returned %q", body.Code)
+	}
+
+	matrix := make([][]time.Duration, len(points))
+	for i, row := range body.Durations {
+		if len(row) != len(points) {
+			return nil, fmt.Errorf("osrm table returned a short row")
+		}
+		matrix[i] = make([]time.Duration, len(points))
+		for j, seconds := range row {
+			if seconds == nil {
+				// No road between them; fall back to the straight-line estimate
+				matrix[i][j] = estimatedTravelTime(points[i], points[j])
+				continue
+			}
+			matrix[i][j] = time.Duration(*seconds * float64(time.Second))
+		}
+	}
+	return matrix, nil
+}
+
+const (
+	earthRadiusKm = 6371.0
+	// Straight-line estimates assume city driving with roads ~30% longer
+	// than the crow flies
+	estimatedSpeedKmh   = 35.0
+	estimatedDetourRate = 1.3
+)
+
+// haversineKm is the great-circle distance between two points
+func haversineKm(a, b LatLng) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Latitude - a.Latitude)
+	dLng := toRad(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Latitude))*math.Cos(toRad(b.Latitude))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// estimatedTravelTime guesses a driving time from the straight-line distance
+func estimatedTravelTime(a, b LatLng) time.Duration {
+	hours := haversineKm(a, b) * estimatedDetourRate / estimatedSpeedKmh
+	return time.Duration(hours * float64(time.Hour)).Round(time.Second)
+}
+
+// estimatedTravelTimes is the straight-line matrix used without a routing
+// provider, or when it fails
+func estimatedTravelTimes(points []LatLng) [][]time.Duration {
+	matrix := make([][]time.Duration, len(points))
+	for i := range points {
+		matrix[i] = make([]time.Duration, len(points))
+		for j := range points {
+			matrix[i][j] = estimatedTravelTime(points[i], points[j])
+		}
+	}
+	return matrix
+}
+
+// geocoderFromEnv returns the Mapbox geocoder when MAPBOX_ACCESS_TOKEN is
+// set. Without one, only addresses that already have coordinates are routed.
+func geocoderFromEnv() Geocoder {
+	if token := os.Getenv("MAPBOX_ACCESS_TOKEN"); token != "" {
+		return NewMapboxGeocoder(token)
+	}
+	return nil
+}
+
+// travelTimesFromEnv returns the OSRM client when OSRM_URL is set. Without
+// one, travel times are estimated from straight-line distance.
+func travelTimesFromEnv() TravelTimeEstimator {
+	if baseURL := os.Getenv("OSRM_URL"); baseURL != "" {
+		return NewOSRMTravelTimes(baseURL)
+	}
+	return nil
+}
+
+// routeDepotFromEnv is where routes start when the request doesn't say,
+// from ROUTE_DEPOT_LATITUDE and ROUTE_DEPOT_LONGITUDE
+func routeDepotFromEnv() *LatLng {
+	lat, latErr := strconv.ParseFloat(os.Getenv("ROUTE_DEPOT_LATITUDE"), 64)
+	lng, lngErr := strconv.ParseFloat(os.Getenv("ROUTE_DEPOT_LONGITUDE"), 64)
+	if latErr != nil || lngErr != nil {
+		return nil
+	}
+	return &LatLng{Latitude: lat, Longitude: lng}
+}
+
+// addressLocation returns an address's stored coordinates, geocoding and
+// saving them first if it has none, and whether the geocoder was asked. The
+// location is nil without an error when the address can't be placed.
+func addressLocation(ctx context.Context, db *sql.DB, geocoder Geocoder, addressID int) (*LatLng, bool, error) {
+	var lat, lng sql.NullFloat64
+	var street, city, state, zip string
+	err := db.QueryRow(`
+		SELECT latitude, longitude, street_address, city, state, zip_code
+		FROM addresses WHERE id = $1`,
+		addressID,
+	).Scan(&lat, &lng, &street, &city, &state, &zip)
+	if err != nil {
+		return nil, false, err
+	}
+	if lat.Valid && lng.Valid {
+		return &LatLng{Latitude: lat.Float64, Longitude: lng.Float64}, false, nil
+	}
+	if geocoder == nil {
+		return nil, false, nil
+	}
+
+	location, err := geocoder.Geocode(ctx, geocodeQuery(street, city, state, zip))
+	if err == errAddressNotFound {
+		return nil, true, markGeocodeFailed(db, addressID)
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	if _, err := saveAddressGeocode(db, addressID, location); err != nil {
+		return nil, true, err
+	}
+	return &location, true, nil
+}
+
+// geocodeQuery is the one-line form of an address sent to the geocoder
+func geocodeQuery(street, city, state, zip string) string {
+	return fmt.Sprintf("%s, %s, %s %s", street, city, state, zip)
+}
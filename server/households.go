@@ -0,0 +1,459 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type HouseholdHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+// Household is a consumer account that shares its addresses and billing with
+// invited members
+type Household struct {
+	ID        int               `json:"id"`
+	OwnerID   int               `json:"owner_id"`
+	Name      string            `json:"name"`
+	IsOwner   bool              `json:"is_owner"`
+	Members   []HouseholdMember `json:"members"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+type HouseholdMember struct {
+	ID          int        `json:"id"`
+	HouseholdID int        `json:"household_id"`
+	UserID      *int       `json:"user_id,omitempty"`
+	Email       string     `json:"email"`
+	Permission  string     `json:"permission"`
+	Status      string     `json:"status"`
+	InviteToken *string    `json:"invite_token,omitempty"`
+	InvitedAt   time.Time  `json:"invited_at"`
+	AcceptedAt  *time.Time `json:"accepted_at,omitempty"`
+}
+
+type InviteHouseholdMemberRequest struct {
+	Email      string `json:"email"`
+	Permission string `json:"permission"`
+	Name       string `json:"name,omitempty"`
+}
+
+// validHouseholdPermissions are the per-member permission levels. 'schedule'
+// lets a member book orders billed to the owner; 'manage_payment' also lets
+// them manage the owner's saved payment methods.
+var validHouseholdPermissions = map[string]bool{
+	"schedule":       true,
+	"manage_payment": true,
+}
+
+func NewHouseholdHandler(db *sql.DB) *HouseholdHandler {
+	return &HouseholdHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// householdOwnerFor returns the owner of the household the user is an active
+// member of, provided the member holds the required permission. Owners are
+// returned as their own household owner.
+func householdOwnerFor(db *sql.DB, userID int, permission string) (int, error) {
+	var ownerID int
+	err := db.QueryRow("SELECT owner_id FROM households WHERE owner_id = $1", userID).Scan(&ownerID)
+	if err == nil {
+		return ownerID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var memberPermission string
+	err = db.QueryRow(`
+		SELECT h.owner_id, hm.permission
+		FROM household_members hm
+		JOIN households h ON hm.household_id = h.id
+		WHERE hm.user_id = $1 AND hm.status = 'active'`,
+		userID,
+	).Scan(&ownerID, &memberPermission)
+	if err != nil {
+		return 0, err
+	}
+
+	// manage_payment is a superset of schedule
+	if permission == "manage_payment" && memberPermission != "manage_payment" {
+		return 0, fmt.Errorf("household permission %s required", permission)
+	}
+
+	return ownerID, nil
+}
+
+// handleGetHousehold returns the household the user owns or belongs to
+func (h *HouseholdHandler) handleGetHousehold(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var household Household
+	err = h.db.QueryRow(`
+		SELECT h.id, h.owner_id, h.name, h.created_at
+		FROM households h
+		WHERE h.owner_id = $1
+		   OR h.id = (SELECT household_id FROM household_members WHERE user_id = $1 AND status = 'active')`,
+		userID,
+	).Scan(&household.ID, &household.OwnerID, &household.Name, &household.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Household not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch household", http.StatusInternalServerError)
+		return
+	}
+	household.IsOwner = household.OwnerID == userID
+
+	household.Members, err = h.getMembers(household.ID, household.IsOwner)
+	if err != nil {
+		http.Error(w, "Failed to fetch household members", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(household)
+}
+
+// getMembers lists non-removed members. Invite tokens are only exposed to the owner.
+func (h *HouseholdHandler) getMembers(householdID int, includeTokens bool) ([]HouseholdMember, error) {
+	rows, err := h.db.Query(`
+		SELECT id, household_id, user_id, email, permission, status, invite_token, invited_at, accepted_at
+		FROM household_members
+		WHERE household_id = $1 AND status != 'removed'
+		ORDER BY invited_at ASC`,
+		householdID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []HouseholdMember{}
+	for rows.Next() {
+		var member HouseholdMember
+		err := rows.Scan(
+			&member.ID, &member.HouseholdID, &member.UserID, &member.Email,
+			&member.Permission, &member.Status, &member.InviteToken,
+			&member.InvitedAt, &member.AcceptedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if !includeTokens {
+			member.InviteToken = nil
+		}
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+// handleInviteMember invites someone to the user's household, creating the
+// household on first invite
+func (h *HouseholdHandler) handleInviteMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req InviteHouseholdMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if req.Email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+	if req.Permission == "" {
+		req.Permission = "schedule"
+	}
+	if !validHouseholdPermissions[req.Permission] {
+		http.Error(w, "Invalid permission", http.StatusBadRequest)
+		return
+	}
+
+	// Members of another household can't start their own
+	var isMember bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM household_members WHERE user_id = $1 AND status = 'active')`,
+		userID,
+	).Scan(&isMember)
+	if err != nil {
+		http.Error(w, "Failed to check household membership", http.StatusInternalServerError)
+		return
+	}
+	if isMember {
+		http.Error(w, "Only household owners can invite members", http.StatusForbidden)
+		return
+	}
+
+	var ownerEmail string
+	if err := h.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&ownerEmail); err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	if strings.EqualFold(ownerEmail, req.Email) {
+		http.Error(w, "You can't invite yourself", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	name := req.Name
+	if name == "" {
+		name = "My Household"
+	}
+	var householdID int
+	err = tx.QueryRow(`
+		INSERT INTO households (owner_id, name) VALUES ($1, $2)
+		ON CONFLICT (owner_id) DO UPDATE SET owner_id = EXCLUDED.owner_id
+		RETURNING id`,
+		userID, name,
+	).Scan(&householdID)
+	if err != nil {
+		http.Error(w, "Failed to create household", http.StatusInternalServerError)
+		return
+	}
+
+	// Re-inviting a removed member resets their invite
+	var member HouseholdMember
+	err = tx.QueryRow(`
+		INSERT INTO household_members (household_id, email, permission, invite_token)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (household_id, email) DO UPDATE SET
+			permission = EXCLUDED.permission,
+			invite_token = EXCLUDED.invite_token,
+			status = 'invited',
+			user_id = NULL,
+			invited_at = CURRENT_TIMESTAMP,
+			accepted_at = NULL
+		WHERE household_members.status = 'removed'
+		RETURNING id, household_id, user_id, email, permission, status, invite_token, invited_at, accepted_at`,
+		householdID, req.Email, req.Permission, generateRandomString(32),
+	).Scan(
+		&member.ID, &member.HouseholdID, &member.UserID, &member.Email,
+		&member.Permission, &member.Status, &member.InviteToken,
+		&member.InvitedAt, &member.AcceptedAt,
+	)
+	if err == sql.ErrNoRows {
+		http.Error(w, "This email has already been invited", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to invite member", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to complete invite", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(member)
+}
+
+// handleAcceptInvite joins the household an invite token belongs to. The
+// invite must have been sent to the accepting user's email.
+func (h *HouseholdHandler) handleAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var memberID, ownerID int
+	var inviteEmail, userEmail string
+	err = h.db.QueryRow(`
+		SELECT hm.id, hm.email, h.owner_id
+		FROM household_members hm
+		JOIN households h ON hm.household_id = h.id
+		WHERE hm.invite_token = $1 AND hm.status = 'invited'`,
+		req.Token,
+	).Scan(&memberID, &inviteEmail, &ownerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch invite", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&userEmail); err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	if !strings.EqualFold(inviteEmail, userEmail) || ownerID == userID {
+		http.Error(w, "This invite was sent to a different account", http.StatusForbidden)
+		return
+	}
+
+	// Owners can't join another household while they have one of their own
+	var ownsHousehold bool
+	h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM households WHERE owner_id = $1)", userID).Scan(&ownsHousehold)
+	if ownsHousehold {
+		http.Error(w, "Leave or close your own household before joining another", http.StatusConflict)
+		return
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE household_members
+		SET user_id = $1, status = 'active', invite_token = NULL, accepted_at = CURRENT_TIMESTAMP
+		WHERE id = $2`,
+		userID, memberID,
+	)
+	if err != nil {
+		// The partial unique index rejects membership in a second household
+		http.Error(w, "You are already a member of a household", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Joined household successfully"})
+}
+
+// handleUpdateMember changes a member's permission; owner only
+func (h *HouseholdHandler) handleUpdateMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	memberID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid member ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validHouseholdPermissions[req.Permission] {
+		http.Error(w, "Invalid permission", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE household_members hm
+		SET permission = $1
+		FROM households h
+		WHERE hm.household_id = h.id AND hm.id = $2 AND h.owner_id = $3 AND hm.status != 'removed'`,
+		req.Permission, memberID, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update member", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Member updated successfully"})
+}
+
+// handleRemoveMember removes a member. Owners can remove anyone; members can
+// remove themselves to leave the household.
+func (h *HouseholdHandler) handleRemoveMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	memberID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid member ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE household_members hm
+		SET status = 'removed', invite_token = NULL
+		FROM households h
+		WHERE hm.household_id = h.id AND hm.id = $1 AND hm.status != 'removed'
+		  AND (h.owner_id = $2 OR hm.user_id = $2)`,
+		memberID, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Member removed successfully"})
+}
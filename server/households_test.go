@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestHouseholdHandler_InviteAndAccept(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	ownerID := db.CreateTestUser(t, "owner@example.com", "Owner", "User")
+	memberID := db.CreateTestUser(t, "member@example.com", "Member", "User")
+	strangerID := db.CreateTestUser(t, "stranger@example.com", "Stranger", "User")
+
+	handler := NewHouseholdHandler(db.DB)
+	asUser := func(userID int) {
+		handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+			return userID, nil
+		}
+	}
+
+	// Owner invites a member
+	asUser(ownerID)
+	body, _ := json.Marshal(InviteHouseholdMemberRequest{Email: "Member@Example.com", Permission: "schedule"})
+	req := httptest.NewRequest("POST", "/api/v1/households/invite", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	handler.handleInviteMember(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var invited HouseholdMember
+	if err := json.Unmarshal(w.Body.Bytes(), &invited); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if invited.Email != "member@example.com" {
+		t.Errorf("Expected normalized email, got %s", invited.Email)
+	}
+	if invited.InviteToken == nil {
+		t.Fatal("Expected invite token to be returned to the owner")
+	}
+
+	// Inviting the same email twice conflicts
+	req = httptest.NewRequest("POST", "/api/v1/households/invite", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	handler.handleInviteMember(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for duplicate invite, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Someone else can't accept the invite
+	asUser(strangerID)
+	acceptBody, _ := json.Marshal(map[string]string{"token": *invited.InviteToken})
+	req = httptest.NewRequest("POST", "/api/v1/households/accept", bytes.NewBuffer(acceptBody))
+	w = httptest.NewRecorder()
+	handler.handleAcceptInvite(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for wrong account, got %d", http.StatusForbidden, w.Code)
+	}
+
+	// The invited member accepts
+	asUser(memberID)
+	req = httptest.NewRequest("POST", "/api/v1/households/accept", bytes.NewBuffer(acceptBody))
+	w = httptest.NewRecorder()
+	handler.handleAcceptInvite(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// Member sees the household without invite tokens
+	req = httptest.NewRequest("GET", "/api/v1/households/mine", nil)
+	w = httptest.NewRecorder()
+	handler.handleGetHousehold(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var household Household
+	if err := json.Unmarshal(w.Body.Bytes(), &household); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if household.IsOwner {
+		t.Error("Expected member not to be reported as owner")
+	}
+	if len(household.Members) != 1 || household.Members[0].Status != "active" {
+		t.Errorf("Expected one active member, got %+v", household.Members)
+	}
+
+	// Schedule permission resolves to the owner but doesn't allow payment management
+	if owner, err := householdOwnerFor(db.DB, memberID, "schedule"); err != nil || owner != ownerID {
+		t.Errorf("Expected owner %d, got %d (err: %v)", ownerID, owner, err)
+	}
+	if _, err := householdOwnerFor(db.DB, memberID, "manage_payment"); err == nil {
+		t.Error("Expected schedule-only member to be denied payment management")
+	}
+}
+
+func TestHouseholdHandler_UpdateAndRemoveMember(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	ownerID := db.CreateTestUser(t, "owner@example.com", "Owner", "User")
+	memberUserID := db.CreateTestUser(t, "member@example.com", "Member", "User")
+
+	var householdID, memberID int
+	err := db.QueryRow("INSERT INTO households (owner_id) VALUES ($1) RETURNING id", ownerID).Scan(&householdID)
+	if err != nil {
+		t.Fatalf("Failed to create household: %v", err)
+	}
+	err = db.QueryRow(`
+		INSERT INTO household_members (household_id, user_id, email, status, accepted_at)
+		VALUES ($1, $2, $3, 'active', CURRENT_TIMESTAMP)
+		RETURNING id`,
+		householdID, memberUserID, "member@example.com",
+	).Scan(&memberID)
+	if err != nil {
+		t.Fatalf("Failed to create household member: %v", err)
+	}
+
+	handler := NewHouseholdHandler(db.DB)
+
+	tests := []struct {
+		name           string
+		userID         int
+		permission     string
+		expectedStatus int
+	}{
+		{"Owner grants payment management", ownerID, "manage_payment", http.StatusOK},
+		{"Invalid permission", ownerID, "admin", http.StatusBadRequest},
+		{"Member can't change own permission", memberUserID, "manage_payment", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+				return tt.userID, nil
+			}
+
+			body, _ := json.Marshal(map[string]string{"permission": tt.permission})
+			req := httptest.NewRequest("PUT", fmt.Sprintf("/api/v1/households/members/%d", memberID), bytes.NewBuffer(body))
+			req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprintf("%d", memberID)})
+			w := httptest.NewRecorder()
+
+			handler.handleUpdateMember(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d. Response: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if owner, err := householdOwnerFor(db.DB, memberUserID, "manage_payment"); err != nil || owner != ownerID {
+		t.Errorf("Expected member to manage owner's payments, got %d (err: %v)", owner, err)
+	}
+
+	// Member leaves the household
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return memberUserID, nil
+	}
+	req := httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/households/members/%d", memberID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprintf("%d", memberID)})
+	w := httptest.NewRecorder()
+	handler.handleRemoveMember(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if _, err := householdOwnerFor(db.DB, memberUserID, "schedule"); err == nil {
+		t.Error("Expected removed member to lose household access")
+	}
+}
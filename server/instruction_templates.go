@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxInstructionTemplateName   = 100
+	maxInstructionTemplateLength = 500
+)
+
+// InstructionTemplateHandler manages a customer's saved delivery instructions,
+// which they pick from at checkout instead of retyping them per order
+type InstructionTemplateHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+type InstructionTemplate struct {
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	Instructions string    `json:"instructions"`
+	IsDefault    bool      `json:"is_default"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type InstructionTemplateRequest struct {
+	Name         string `json:"name"`
+	Instructions string `json:"instructions"`
+	IsDefault    bool   `json:"is_default"`
+}
+
+func NewInstructionTemplateHandler(db *sql.DB) *InstructionTemplateHandler {
+	return &InstructionTemplateHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// validateInstructionTemplate trims the request and returns a message for the
+// first invalid field, or "" when it's fine
+func validateInstructionTemplate(req *InstructionTemplateRequest) string {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Instructions = strings.TrimSpace(req.Instructions)
+	switch {
+	case req.Name == "":
+		return "Name is required"
+	case len(req.Name) > maxInstructionTemplateName:
+		return "Name is too long"
+	case req.Instructions == "":
+		return "Instructions are required"
+	case len(req.Instructions) > maxInstructionTemplateLength:
+		return "Instructions are too long"
+	}
+	return ""
+}
+
+// instructionTemplateText returns the instructions of one of the user's
+// templates, or sql.ErrNoRows if it isn't theirs
+func instructionTemplateText(q queryRower, userID, templateID int) (string, error) {
+	var instructions string
+	err := q.QueryRow(`
+		SELECT instructions FROM delivery_instruction_templates
+		WHERE id = $1 AND user_id = $2`,
+		templateID, userID,
+	).Scan(&instructions)
+	return instructions, err
+}
+
+func (h *InstructionTemplateHandler) getTemplate(templateID, userID int) (*InstructionTemplate, error) {
+	var t InstructionTemplate
+	err := h.db.QueryRow(`
+		SELECT id, name, instructions, is_default, created_at, updated_at
+		FROM delivery_instruction_templates
+		WHERE id = $1 AND user_id = $2`,
+		templateID, userID,
+	).Scan(&t.ID, &t.Name, &t.Instructions, &t.IsDefault, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// nameTaken reports whether the user already has another template with this name
+func (h *InstructionTemplateHandler) nameTaken(userID int, name string, excludeID int) (bool, error) {
+	var exists bool
+	err := h.db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM delivery_instruction_templates
+			WHERE user_id = $1 AND name = $2 AND id != $3
+		)`,
+		userID, name, excludeID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// handleGetInstructionTemplates lists the user's templates, default first
+func (h *InstructionTemplateHandler) handleGetInstructionTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, name, instructions, is_default, created_at, updated_at
+		FROM delivery_instruction_templates
+		WHERE user_id = $1
+		ORDER BY is_default DESC, name ASC`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch instruction templates", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	templates := []InstructionTemplate{}
+	for rows.Next() {
+		var t InstructionTemplate
+		if err := rows.Scan(&t.ID, &t.Name, &t.Instructions, &t.IsDefault, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			http.Error(w, "Failed to parse instruction templates", http.StatusInternalServerError)
+			return
+		}
+		templates = append(templates, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// handleCreateInstructionTemplate saves a new named instruction set
+func (h *InstructionTemplateHandler) handleCreateInstructionTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req InstructionTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if msg := validateInstructionTemplate(&req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if taken, err := h.nameTaken(userID, req.Name, 0); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	} else if taken {
+		http.Error(w, "A template with this name already exists", http.StatusConflict)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if req.IsDefault {
+		_, err = tx.Exec(`
+			UPDATE delivery_instruction_templates SET is_default = false
+			WHERE user_id = $1 AND is_default = true`,
+			userID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to update defaults", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var templateID int
+	err = tx.QueryRow(`
+		INSERT INTO delivery_instruction_templates (user_id, name, instructions, is_default)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`,
+		userID, req.Name, req.Instructions, req.IsDefault,
+	).Scan(&templateID)
+	if err != nil {
+		http.Error(w, "Failed to create instruction template", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create instruction template", http.StatusInternalServerError)
+		return
+	}
+
+	template, err := h.getTemplate(templateID, userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch created instruction template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(template)
+}
+
+// handleUpdateInstructionTemplate renames or rewrites a template. Orders
+// already placed keep the instructions they were placed with.
+func (h *InstructionTemplateHandler) handleUpdateInstructionTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	templateID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req InstructionTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if msg := validateInstructionTemplate(&req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if taken, err := h.nameTaken(userID, req.Name, templateID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	} else if taken {
+		http.Error(w, "A template with this name already exists", http.StatusConflict)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if req.IsDefault {
+		_, err = tx.Exec(`
+			UPDATE delivery_instruction_templates SET is_default = false
+			WHERE user_id = $1 AND is_default = true AND id != $2`,
+			userID, templateID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to update defaults", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	result, err := tx.Exec(`
+		UPDATE delivery_instruction_templates
+		SET name = $1, instructions = $2, is_default = $3
+		WHERE id = $4 AND user_id = $5`,
+		req.Name, req.Instructions, req.IsDefault, templateID, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update instruction template", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Instruction template not found", http.StatusNotFound)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update instruction template", http.StatusInternalServerError)
+		return
+	}
+
+	template, err := h.getTemplate(templateID, userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch updated instruction template", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+// handleDeleteInstructionTemplate removes a template. Orders that used it keep
+// their copy of the instructions.
+func (h *InstructionTemplateHandler) handleDeleteInstructionTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	templateID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid template ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := h.db.Exec(`
+		DELETE FROM delivery_instruction_templates
+		WHERE id = $1 AND user_id = $2`,
+		templateID, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to delete instruction template", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Instruction template not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
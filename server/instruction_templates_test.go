@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidateInstructionTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     InstructionTemplateRequest
+		wantErr bool
+	}{
+		{"Valid", InstructionTemplateRequest{Name: " Weekday ", Instructions: "Leave with doorman"}, false},
+		{"Blank name", InstructionTemplateRequest{Name: "  ", Instructions: "Ring bell"}, true},
+		{"Blank instructions", InstructionTemplateRequest{Name: "Weekend", Instructions: ""}, true},
+		{"Name too long", InstructionTemplateRequest{Name: strings.Repeat("a", 101), Instructions: "Ring bell"}, true},
+		{"Instructions too long", InstructionTemplateRequest{Name: "Weekend", Instructions: strings.Repeat("a", 501)}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := validateInstructionTemplate(&tt.req)
+			if (msg != "") != tt.wantErr {
+				t.Errorf("Expected error %v, got %q", tt.wantErr, msg)
+			}
+		})
+	}
+}
+
+func TestInstructionTemplates_CRUD(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "templates@example.com", "Template", "User")
+	otherID := db.CreateTestUser(t, "templates-other@example.com", "Other", "User")
+
+	handler := NewInstructionTemplateHandler(db.DB)
+	currentUser := userID
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return currentUser, nil
+	}
+
+	create := func(name, instructions string, isDefault bool) (int, InstructionTemplate) {
+		body, _ := json.Marshal(InstructionTemplateRequest{Name: name, Instructions: instructions, IsDefault: isDefault})
+		req := httptest.NewRequest("POST", "/api/v1/account/instruction-templates", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		handler.handleCreateInstructionTemplate(w, req)
+		var template InstructionTemplate
+		json.Unmarshal(w.Body.Bytes(), &template)
+		return w.Code, template
+	}
+
+	code, weekday := create("Weekday", "Leave with doorman", true)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, code)
+	}
+	code, weekend := create("Weekend", "Ring bell", true)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, code)
+	}
+	if code, _ := create("Weekday", "Side door", false); code != http.StatusConflict {
+		t.Errorf("Expected status %d for a duplicate name, got %d", http.StatusConflict, code)
+	}
+
+	// Only the newest default stays default
+	req := httptest.NewRequest("GET", "/api/v1/account/instruction-templates", nil)
+	w := httptest.NewRecorder()
+	handler.handleGetInstructionTemplates(w, req)
+	var templates []InstructionTemplate
+	json.Unmarshal(w.Body.Bytes(), &templates)
+	if len(templates) != 2 || templates[0].ID != weekend.ID || templates[1].IsDefault {
+		t.Fatalf("Expected Weekend as the only default, got %+v", templates)
+	}
+
+	// Another customer can't edit or delete it
+	currentUser = otherID
+	body, _ := json.Marshal(InstructionTemplateRequest{Name: "Mine", Instructions: "Take it"})
+	req = httptest.NewRequest("PUT", fmt.Sprintf("/api/v1/account/instruction-templates/%d", weekday.ID), bytes.NewBuffer(body))
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(weekday.ID)})
+	w = httptest.NewRecorder()
+	handler.handleUpdateInstructionTemplate(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/account/instruction-templates/%d", weekday.ID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(weekday.ID)})
+	w = httptest.NewRecorder()
+	handler.handleDeleteInstructionTemplate(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	currentUser = userID
+	body, _ = json.Marshal(InstructionTemplateRequest{Name: "Weekday", Instructions: "Leave at the front desk"})
+	req = httptest.NewRequest("PUT", fmt.Sprintf("/api/v1/account/instruction-templates/%d", weekday.ID), bytes.NewBuffer(body))
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(weekday.ID)})
+	w = httptest.NewRecorder()
+	handler.handleUpdateInstructionTemplate(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var updated InstructionTemplate
+	json.Unmarshal(w.Body.Bytes(), &updated)
+	if updated.Instructions != "Leave at the front desk" {
+		t.Errorf("Expected updated instructions, got %q", updated.Instructions)
+	}
+
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/account/instruction-templates/%d", weekend.ID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(weekend.ID)})
+	w = httptest.NewRecorder()
+	handler.handleDeleteInstructionTemplate(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+}
+
+func TestInstructionTemplates_AttachedToOrder(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "checkout-templates@example.com", "Checkout", "User")
+	otherID := db.CreateTestUser(t, "checkout-other@example.com", "Other", "User")
+	addressID := db.CreateTestAddress(t, userID)
+	serviceID := db.GetServiceID(t, "standard_bag")
+
+	var templateID, otherTemplateID int
+	db.QueryRow(`
+		INSERT INTO delivery_instruction_templates (user_id, name, instructions)
+		VALUES ($1, 'Weekday', 'Leave with doorman') RETURNING id`,
+		userID,
+	).Scan(&templateID)
+	db.QueryRow(`
+		INSERT INTO delivery_instruction_templates (user_id, name, instructions)
+		VALUES ($1, 'Theirs', 'Not yours') RETURNING id`,
+		otherID,
+	).Scan(&otherTemplateID)
+
+	handler := &OrderHandler{
+		db:       db.DB,
+		realtime: NewMockRealtimeHandler(),
+		getUserID: func(r *http.Request, db *sql.DB) (int, error) {
+			return userID, nil
+		},
+	}
+
+	placeOrder := func(templateID int) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(CreateOrderRequest{
+			PickupAddressID:       addressID,
+			DeliveryAddressID:     addressID,
+			PickupDate:            "2024-02-01",
+			DeliveryDate:          "2024-02-03",
+			PickupTimeSlot:        "9am-12pm",
+			DeliveryTimeSlot:      "9am-12pm",
+			InstructionTemplateID: &templateID,
+			Items:                 []OrderItem{{ServiceID: serviceID, Quantity: 1, Price: 45.00}},
+		})
+		req := httptest.NewRequest("POST", "/api/v1/orders/create", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		handler.handleCreateOrder(w, req)
+		return w
+	}
+
+	if w := placeOrder(otherTemplateID); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for another customer's template, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w := placeOrder(templateID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var order Order
+	json.Unmarshal(w.Body.Bytes(), &order)
+
+	// Editing the template afterwards doesn't change what the driver sees
+	db.Exec("UPDATE delivery_instruction_templates SET instructions = 'Ring bell' WHERE id = $1", templateID)
+
+	var instructions string
+	db.QueryRow("SELECT delivery_instructions FROM orders WHERE id = $1", order.ID).Scan(&instructions)
+	if instructions != "Leave with doorman" {
+		t.Errorf("Expected the order to keep its instructions, got %q", instructions)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Soft launch: a market (3-digit ZIP prefix, as with add-ons) can be marked
+// invite-only, and then registering with a ZIP in it needs an invite code.
+// Codes can be tied to a market, capped and expired, and every user records
+// the code they signed up with so launches can be measured per code.
+
+// inviteCodeAlphabet leaves out 0/O and 1/I so codes survive being read aloud
+const inviteCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const (
+	inviteCodeLength   = 8
+	maxInviteCodeBatch = 500
+)
+
+var errInvalidInviteCode = errors.New("invalid or expired invite code")
+
+// InviteCodeHandler manages launch markets and invite codes for admins
+type InviteCodeHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewInviteCodeHandler(db *sql.DB) *InviteCodeHandler {
+	return &InviteCodeHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type LaunchMarket struct {
+	Market     string    `json:"market"`
+	InviteOnly bool      `json:"invite_only"`
+	Signups    int       `json:"signups"` // Users who signed up with a ZIP in the market
+	Invited    int       `json:"invited"` // ...of which used an invite code
+	LaunchedOn string    `json:"launched_on"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type InviteCode struct {
+	ID            int        `json:"id"`
+	Code          string     `json:"code"`
+	Market        *string    `json:"market"`
+	Label         *string    `json:"label"`
+	MaxUses       *int       `json:"max_uses"`
+	UseCount      int        `json:"use_count"`
+	OrderingUsers int        `json:"ordering_users"` // Signups who have placed an order
+	ExpiresAt     *time.Time `json:"expires_at"`
+	IsActive      bool       `json:"is_active"`
+	CreatedBy     *int       `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type CreateInviteCodesRequest struct {
+	Code      string     `json:"code"`  // Optional vanity code; only with count 1
+	Count     int        `json:"count"` // Defaults to 1
+	Market    *string    `json:"market"`
+	Label     *string    `json:"label"`
+	MaxUses   *int       `json:"max_uses"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type UpdateInviteCodeRequest struct {
+	IsActive  *bool      `json:"is_active"`
+	MaxUses   *int       `json:"max_uses"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type InvitedUser struct {
+	ID         int       `json:"id"`
+	Email      string    `json:"email"`
+	FirstName  string    `json:"first_name"`
+	LastName   string    `json:"last_name"`
+	SignupZip  *string   `json:"signup_zip"`
+	OrderCount int       `json:"order_count"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// isMarket reports whether s is a 3-digit ZIP prefix
+func isMarket(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// marketForZip returns the market a ZIP code belongs to, or "" if it's too
+// short or malformed to tell
+func marketForZip(zipCode string) string {
+	if len(zipCode) < 3 || !isMarket(zipCode[:3]) {
+		return ""
+	}
+	return zipCode[:3]
+}
+
+func normalizeInviteCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func generateInviteCode() (string, error) {
+	code := make([]byte, inviteCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(inviteCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = inviteCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// inviteRequired reports whether signing up from zipCode needs an invite code
+func inviteRequired(q queryRower, zipCode string) (bool, error) {
+	var required bool
+	err := q.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM launch_markets WHERE market = $1 AND invite_only)",
+		marketForZip(zipCode),
+	).Scan(&required)
+	return required, err
+}
+
+// requireInvite stops customers who signed up without an invite code, such
+// as through Google or without giving a ZIP, from adding an address in an
+// invite-only market. Customers who already have an address there keep
+// access. It writes the error and returns false when the address isn't
+// allowed.
+func requireInvite(w http.ResponseWriter, q queryRower, userID int, zipCode string) bool {
+	market := marketForZip(strings.TrimSpace(zipCode))
+	if market == "" {
+		return true
+	}
+	var blocked bool
+	err := q.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM launch_markets WHERE market = $2 AND invite_only)
+		   AND u.role = 'customer' AND u.invite_code_id IS NULL
+		   AND NOT EXISTS(SELECT 1 FROM addresses a WHERE a.user_id = u.id AND LEFT(a.zip_code, 3) = $2)
+		FROM users u WHERE u.id = $1`,
+		userID, market,
+	).Scan(&blocked)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Error checking invite requirement", http.StatusInternalServerError)
+		return false
+	}
+	if blocked {
+		http.Error(w, "An invite code is required to sign up in your area", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// redeemInviteCode uses up one redemption of a code for a signup from zipCode
+// and returns its ID. It runs in the registration transaction so a failed
+// signup doesn't burn a use.
+func redeemInviteCode(tx *sql.Tx, code, zipCode string) (int, error) {
+	var codeID int
+	err := tx.QueryRow(`
+		UPDATE invite_codes SET use_count = use_count + 1
+		WHERE code = $1 AND is_active
+		  AND (max_uses IS NULL OR use_count < max_uses)
+		  AND (expires_at IS NULL OR expires_at > NOW())
+		  AND (market IS NULL OR market = $2)
+		RETURNING id`,
+		normalizeInviteCode(code), marketForZip(zipCode),
+	).Scan(&codeID)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidInviteCode
+	}
+	return codeID, err
+}
+
+// handleGetLaunchMarkets lists soft-launch markets with their signup counts
+func (h *InviteCodeHandler) handleGetLaunchMarkets(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT m.market, m.invite_only, COUNT(u.id), COUNT(u.invite_code_id),
+		       TO_CHAR(m.launched_on, 'YYYY-MM-DD'), m.created_at, m.updated_at
+		FROM launch_markets m
+		LEFT JOIN users u ON LEFT(u.signup_zip, 3) = m.market
+		GROUP BY m.market
+		ORDER BY m.market`)
+	if err != nil {
+		http.Error(w, "Failed to fetch launch markets", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	markets := []LaunchMarket{}
+	for rows.Next() {
+		var m LaunchMarket
+		if err := rows.Scan(&m.Market, &m.InviteOnly, &m.Signups, &m.Invited, &m.LaunchedOn, &m.CreatedAt, &m.UpdatedAt); err != nil {
+			http.Error(w, "Failed to fetch launch markets", http.StatusInternalServerError)
+			return
+		}
+		markets = append(markets, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(markets)
+}
+
+// handleSetLaunchMarket adds a market or flips it between invite-only and
+// open. Opening a market keeps it listed so its signups can still be tracked.
+// launched_on defaults to today for a new market and is otherwise kept.
+func (h *InviteCodeHandler) handleSetLaunchMarket(w http.ResponseWriter, r *http.Request) {
+	market := mux.Vars(r)["market"]
+	if !isMarket(market) {
+		http.Error(w, "market must be a 3-digit ZIP prefix", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		InviteOnly *bool   `json:"invite_only"`
+		LaunchedOn *string `json:"launched_on,omitempty"` // YYYY-MM-DD
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.InviteOnly == nil {
+		http.Error(w, "invite_only is required", http.StatusBadRequest)
+		return
+	}
+	if req.LaunchedOn != nil {
+		if _, err := time.Parse("2006-01-02", *req.LaunchedOn); err != nil {
+			http.Error(w, "launched_on must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var m LaunchMarket
+	err := h.db.QueryRow(`
+		INSERT INTO launch_markets (market, invite_only, launched_on) VALUES ($1, $2, COALESCE($3::date, CURRENT_DATE))
+		ON CONFLICT (market) DO UPDATE SET invite_only = EXCLUDED.invite_only,
+		    launched_on = COALESCE($3::date, launch_markets.launched_on)
+		RETURNING market, invite_only, TO_CHAR(launched_on, 'YYYY-MM-DD'), created_at, updated_at`,
+		market, *req.InviteOnly, req.LaunchedOn,
+	).Scan(&m.Market, &m.InviteOnly, &m.LaunchedOn, &m.CreatedAt, &m.UpdatedAt)
+	if err != nil {
+		http.Error(w, "Failed to update launch market", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// handleDeleteLaunchMarket stops tracking a market, which opens it
+func (h *InviteCodeHandler) handleDeleteLaunchMarket(w http.ResponseWriter, r *http.Request) {
+	result, err := h.db.Exec("DELETE FROM launch_markets WHERE market = $1", mux.Vars(r)["market"])
+	if err != nil {
+		http.Error(w, "Failed to delete launch market", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Launch market not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+const inviteCodeColumns = `c.id, c.code, c.market, c.label, c.max_uses, c.use_count,
+	(SELECT COUNT(DISTINCT u.id) FROM users u JOIN orders o ON o.user_id = u.id WHERE u.invite_code_id = c.id),
+	c.expires_at, c.is_active, c.created_by, c.created_at`
+
+func scanInviteCode(scanner interface{ Scan(...interface{}) error }) (InviteCode, error) {
+	var c InviteCode
+	err := scanner.Scan(&c.ID, &c.Code, &c.Market, &c.Label, &c.MaxUses, &c.UseCount,
+		&c.OrderingUsers, &c.ExpiresAt, &c.IsActive, &c.CreatedBy, &c.CreatedAt)
+	return c, err
+}
+
+// handleGetInviteCodes lists codes, optionally for one market (?market=941)
+// or campaign (?label=)
+func (h *InviteCodeHandler) handleGetInviteCodes(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT `+inviteCodeColumns+`
+		FROM invite_codes c
+		WHERE ($1 = '' OR c.market = $1) AND ($2 = '' OR c.label = $2)
+		ORDER BY c.created_at DESC, c.id DESC`,
+		r.URL.Query().Get("market"), r.URL.Query().Get("label"),
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch invite codes", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	codes := []InviteCode{}
+	for rows.Next() {
+		c, err := scanInviteCode(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch invite codes", http.StatusInternalServerError)
+			return
+		}
+		codes = append(codes, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(codes)
+}
+
+// handleCreateInviteCodes generates a batch of codes sharing one market,
+// label and limits, or a single vanity code
+func (h *InviteCodeHandler) handleCreateInviteCodes(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateInviteCodesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Count == 0 {
+		req.Count = 1
+	}
+	req.Code = normalizeInviteCode(req.Code)
+	switch {
+	case req.Count < 0 || req.Count > maxInviteCodeBatch:
+		http.Error(w, "count must be between 1 and "+strconv.Itoa(maxInviteCodeBatch), http.StatusBadRequest)
+		return
+	case req.Code != "" && req.Count != 1:
+		http.Error(w, "A custom code can only be created one at a time", http.StatusBadRequest)
+		return
+	case req.Code != "" && (len(req.Code) < 4 || len(req.Code) > 32):
+		http.Error(w, "code must be 4 to 32 characters", http.StatusBadRequest)
+		return
+	case req.Market != nil && !isMarket(*req.Market):
+		http.Error(w, "market must be a 3-digit ZIP prefix", http.StatusBadRequest)
+		return
+	case req.MaxUses != nil && *req.MaxUses <= 0:
+		http.Error(w, "max_uses must be positive", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	codes := []InviteCode{}
+	for len(codes) < req.Count {
+		code := req.Code
+		if code == "" {
+			if code, err = generateInviteCode(); err != nil {
+				http.Error(w, "Failed to generate invite code", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		var codeID int
+		err = tx.QueryRow(`
+			INSERT INTO invite_codes (code, market, label, max_uses, expires_at, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (code) DO NOTHING
+			RETURNING id`,
+			code, req.Market, req.Label, req.MaxUses, req.ExpiresAt, adminID,
+		).Scan(&codeID)
+		if err == sql.ErrNoRows {
+			if req.Code != "" {
+				http.Error(w, "Invite code already exists", http.StatusConflict)
+				return
+			}
+			continue // Generated a duplicate; roll again
+		}
+		if err != nil {
+			http.Error(w, "Failed to create invite codes", http.StatusInternalServerError)
+			return
+		}
+
+		c, err := scanInviteCode(tx.QueryRow("SELECT "+inviteCodeColumns+" FROM invite_codes c WHERE c.id = $1", codeID))
+		if err != nil {
+			http.Error(w, "Failed to create invite codes", http.StatusInternalServerError)
+			return
+		}
+		codes = append(codes, c)
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create invite codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(codes)
+}
+
+// handleUpdateInviteCode deactivates a code or changes its limits. Lowering
+// max_uses below use_count just stops further signups.
+func (h *InviteCodeHandler) handleUpdateInviteCode(w http.ResponseWriter, r *http.Request) {
+	codeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid invite code ID", http.StatusBadRequest)
+		return
+	}
+
+	var req UpdateInviteCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.MaxUses != nil && *req.MaxUses <= 0 {
+		http.Error(w, "max_uses must be positive", http.StatusBadRequest)
+		return
+	}
+
+	row := h.db.QueryRow(`
+		UPDATE invite_codes c
+		SET is_active = COALESCE($1, c.is_active),
+		    max_uses = COALESCE($2, c.max_uses),
+		    expires_at = COALESCE($3, c.expires_at)
+		WHERE c.id = $4
+		RETURNING `+inviteCodeColumns,
+		req.IsActive, req.MaxUses, req.ExpiresAt, codeID,
+	)
+	c, err := scanInviteCode(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invite code not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update invite code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// handleGetInviteCodeUsers lists the users a code brought in
+func (h *InviteCodeHandler) handleGetInviteCodeUsers(w http.ResponseWriter, r *http.Request) {
+	codeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid invite code ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT u.id, u.email, u.first_name, u.last_name, u.signup_zip, COUNT(o.id), u.created_at
+		FROM users u
+		LEFT JOIN orders o ON o.user_id = u.id
+		WHERE u.invite_code_id = $1
+		GROUP BY u.id
+		ORDER BY u.created_at`,
+		codeID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch invited users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []InvitedUser{}
+	for rows.Next() {
+		var u InvitedUser
+		if err := rows.Scan(&u.ID, &u.Email, &u.FirstName, &u.LastName, &u.SignupZip, &u.OrderCount, &u.CreatedAt); err != nil {
+			http.Error(w, "Failed to fetch invited users", http.StatusInternalServerError)
+			return
+		}
+		users = append(users, u)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
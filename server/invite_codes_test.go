@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMarketForZip(t *testing.T) {
+	tests := map[string]string{
+		"94107":      "941",
+		"94107-1234": "941",
+		"02139":      "021",
+		"94":         "",
+		"SW1A 1AA":   "",
+	}
+	for zip, expected := range tests {
+		if got := marketForZip(zip); got != expected {
+			t.Errorf("marketForZip(%q) = %q, want %q", zip, got, expected)
+		}
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != inviteCodeLength || normalizeInviteCode(code) != code {
+		t.Errorf("Expected an %d character upper-case code, got %q", inviteCodeLength, code)
+	}
+}
+
+func TestSoftLaunchRegistration(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+	defer db.Exec("DELETE FROM launch_markets")
+
+	adminID := db.CreateTestUser(t, "launch-admin@example.com", "Launch", "Admin")
+	handler := NewInviteCodeHandler(db.DB)
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return adminID, nil
+	}
+
+	// Put 941 into soft launch and issue a two-use code for it
+	req := httptest.NewRequest("PUT", "/api/v1/admin/launch-markets/941", bytes.NewBufferString(`{"invite_only": true}`))
+	req = mux.SetURLVars(req, map[string]string{"market": "941"})
+	w := httptest.NewRecorder()
+	handler.handleSetLaunchMarket(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	body, _ := json.Marshal(CreateInviteCodesRequest{
+		Code:    "sf-friends",
+		Market:  func() *string { m := "941"; return &m }(),
+		Label:   func() *string { l := "Friends and family"; return &l }(),
+		MaxUses: func() *int { n := 2; return &n }(),
+	})
+	req = httptest.NewRequest("POST", "/api/v1/admin/invite-codes", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	handler.handleCreateInviteCodes(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var codes []InviteCode
+	json.Unmarshal(w.Body.Bytes(), &codes)
+	if len(codes) != 1 || codes[0].Code != "SF-FRIENDS" {
+		t.Fatalf("Expected the vanity code upper-cased, got %+v", codes)
+	}
+
+	auth := NewAuthHandler(db.DB)
+	register := func(email, zip, code string) int {
+		body, _ := json.Marshal(RegisterRequest{
+			Email: email, Password: "password123", FirstName: "Soft", LastName: "Launch",
+			ZipCode: zip, InviteCode: code,
+		})
+		w := httptest.NewRecorder()
+		auth.handleRegister(w, httptest.NewRequest("POST", "/api/v1/auth/register", bytes.NewBuffer(body)))
+		return w.Code
+	}
+
+	tests := []struct {
+		name           string
+		email, zip     string
+		code           string
+		expectedStatus int
+	}{
+		{"open market needs no code", "open@example.com", "02139", "", http.StatusOK},
+		{"invite-only market without a code", "nocode@example.com", "94107", "", http.StatusForbidden},
+		{"code from another market", "wrongzip@example.com", "02139", "SF-FRIENDS", http.StatusBadRequest},
+		{"first use", "first@example.com", "94107", "sf-friends", http.StatusOK},
+		{"second use", "second@example.com", "94110", "SF-FRIENDS", http.StatusOK},
+		{"code used up", "third@example.com", "94110", "SF-FRIENDS", http.StatusBadRequest},
+		{"malformed ZIP", "badzip@example.com", "9", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := register(tt.email, tt.zip, tt.code); status != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, status)
+			}
+		})
+	}
+
+	// Leaving the ZIP out at signup doesn't get around the invite: the
+	// address can't be added in the invite-only market afterwards
+	if status := register("nozip@example.com", "", ""); status != http.StatusOK {
+		t.Fatalf("Expected a signup without a ZIP to succeed, got %d", status)
+	}
+	addAddress := func(email string) int {
+		var userID int
+		db.QueryRow("SELECT id FROM users WHERE email = $1", email).Scan(&userID)
+		addresses := &AddressHandler{db: db.DB, getUserID: CreateAuthMock(userID).getUserIDFromRequest}
+		body, _ := json.Marshal(CreateAddressRequest{StreetAddress: "1 Market St", City: "San Francisco", State: "CA", ZipCode: "94107"})
+		w := httptest.NewRecorder()
+		addresses.handleCreateAddress(w, httptest.NewRequest("POST", "/api/v1/addresses", bytes.NewBuffer(body)))
+		return w.Code
+	}
+	if status := addAddress("nozip@example.com"); status != http.StatusForbidden {
+		t.Errorf("Expected status %d adding an invite-only address without an invite, got %d", http.StatusForbidden, status)
+	}
+	if status := addAddress("first@example.com"); status == http.StatusForbidden {
+		t.Error("Expected an invited customer to be able to add their address")
+	}
+
+	// Attribution: both signups show up against the code
+	req = httptest.NewRequest("GET", "/api/v1/admin/invite-codes/"+strconv.Itoa(codes[0].ID)+"/users", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(codes[0].ID)})
+	w = httptest.NewRecorder()
+	handler.handleGetInviteCodeUsers(w, req)
+	var users []InvitedUser
+	json.Unmarshal(w.Body.Bytes(), &users)
+	if len(users) != 2 || users[0].Email != "first@example.com" || *users[0].SignupZip != "94107" {
+		t.Errorf("Expected both invited users attributed to the code, got %+v", users)
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleGetLaunchMarkets(w, httptest.NewRequest("GET", "/api/v1/admin/launch-markets", nil))
+	var markets []LaunchMarket
+	json.Unmarshal(w.Body.Bytes(), &markets)
+	if len(markets) != 1 || markets[0].Signups != 2 || markets[0].Invited != 2 {
+		t.Errorf("Expected two invited signups in 941, got %+v", markets)
+	}
+}
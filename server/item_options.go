@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ItemOptions are a customer's laundry preferences for one order line.
+// Empty and false fields leave the line to the facility's defaults.
+type ItemOptions struct {
+	Detergent        string `json:"detergent,omitempty"`         // standard, free_clear, sensitive or eco
+	WaterTemperature string `json:"water_temperature,omitempty"` // cold, warm or hot
+	HangDry          bool   `json:"hang_dry,omitempty"`
+	FoldStyle        string `json:"fold_style,omitempty"` // standard, rolled or hung
+	AllergySafe      bool   `json:"allergy_safe,omitempty"`
+}
+
+var (
+	validDetergents        = []string{"standard", "free_clear", "sensitive", "eco"}
+	validWaterTemperatures = []string{"cold", "warm", "hot"}
+	validFoldStyles        = []string{"standard", "rolled", "hung"}
+)
+
+func (o *ItemOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Detergent != "" && !containsString(validDetergents, o.Detergent) {
+		return fmt.Errorf("detergent must be one of %s", strings.Join(validDetergents, ", "))
+	}
+	if o.WaterTemperature != "" && !containsString(validWaterTemperatures, o.WaterTemperature) {
+		return fmt.Errorf("water_temperature must be one of %s", strings.Join(validWaterTemperatures, ", "))
+	}
+	if o.FoldStyle != "" && !containsString(validFoldStyles, o.FoldStyle) {
+		return fmt.Errorf("fold_style must be one of %s", strings.Join(validFoldStyles, ", "))
+	}
+	return nil
+}
+
+func (o *ItemOptions) isZero() bool {
+	return o == nil || *o == ItemOptions{}
+}
+
+// keys returns the add-on item_option keys the options are priced under,
+// e.g. "hang_dry" or "detergent:sensitive"
+func (o *ItemOptions) keys() []string {
+	if o == nil {
+		return nil
+	}
+	var keys []string
+	if o.Detergent != "" {
+		keys = append(keys, "detergent:"+o.Detergent)
+	}
+	if o.WaterTemperature != "" {
+		keys = append(keys, "water_temperature:"+o.WaterTemperature)
+	}
+	if o.HangDry {
+		keys = append(keys, "hang_dry")
+	}
+	if o.FoldStyle != "" {
+		keys = append(keys, "fold_style:"+o.FoldStyle)
+	}
+	if o.AllergySafe {
+		keys = append(keys, "allergy_safe")
+	}
+	return keys
+}
+
+// labels describes the options for processing staff, e.g. "hang dry"
+func (o *ItemOptions) labels() []string {
+	if o == nil {
+		return nil
+	}
+	var labels []string
+	if o.Detergent != "" && o.Detergent != "standard" {
+		labels = append(labels, strings.ReplaceAll(o.Detergent, "_", " ")+" detergent")
+	}
+	if o.WaterTemperature != "" {
+		labels = append(labels, o.WaterTemperature+" wash")
+	}
+	if o.HangDry {
+		labels = append(labels, "hang dry")
+	}
+	if o.FoldStyle != "" && o.FoldStyle != "standard" {
+		labels = append(labels, o.FoldStyle+" fold")
+	}
+	if o.AllergySafe {
+		labels = append(labels, "allergy-safe")
+	}
+	return labels
+}
+
+// validItemOption reports whether key is an option an add-on can price
+func validItemOption(key string) bool {
+	switch key {
+	case "hang_dry", "allergy_safe":
+		return true
+	}
+	name, value, ok := strings.Cut(key, ":")
+	if !ok {
+		return false
+	}
+	switch name {
+	case "detergent":
+		return containsString(validDetergents, value)
+	case "water_temperature":
+		return containsString(validWaterTemperatures, value)
+	case "fold_style":
+		return containsString(validFoldStyles, value)
+	}
+	return false
+}
+
+// priceItemOptions prices a line's options in cents from the active add-ons
+// that carry them. Per-bag add-ons charge per unit on the line and percent
+// add-ons take a share of the line's price. Options no add-on prices are
+// free.
+func priceItemOptions(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, opts *ItemOptions, quantity, lineCents int, zipCode string) (int, error) {
+	keys := opts.keys()
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	addOns, err := queryAddOns(q, "WHERE is_active = true AND item_option = ANY($1)", pq.Array(keys))
+	if err != nil {
+		return 0, err
+	}
+	totalCents := 0
+	for _, addOn := range addOns {
+		if !addOnAvailableIn(addOn.Markets, zipCode) {
+			return 0, errAddOnUnavailable
+		}
+		units, unitCents := priceAddOn(addOn, quantity, lineCents)
+		totalCents += units * unitCents
+	}
+	return totalCents, nil
+}
+
+const itemOptionColumns = `COALESCE(oi.detergent, ''), COALESCE(oi.water_temperature, ''),
+	oi.hang_dry, COALESCE(oi.fold_style, ''), oi.allergy_safe`
+
+// setOptions fills in a line's options read from itemOptionColumns,
+// leaving them off lines that have none
+func (item *OrderItem) setOptions(opts ItemOptions, optionsCents int) {
+	if !opts.isZero() {
+		item.Options = &opts
+	}
+	item.OptionsPrice = centsToDollars(optionsCents)
+}
+
+// orderCareOptions returns each order's item options as labels for the
+// driver and facility views, e.g. "Bedding: hang dry, cold wash". Orders
+// with no options are left out.
+func orderCareOptions(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, orderIDs []int) (map[int][]string, error) {
+	care := map[int][]string{}
+	if len(orderIDs) == 0 {
+		return care, nil
+	}
+
+	rows, err := q.Query(`
+		SELECT oi.order_id, COALESCE(s.description, s.name), `+itemOptionColumns+`
+		FROM order_items oi
+		JOIN services s ON oi.service_id = s.id
+		WHERE oi.order_id = ANY($1)
+		ORDER BY oi.order_id, oi.id`,
+		pq.Array(orderIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int
+		var serviceName string
+		var opts ItemOptions
+		err := rows.Scan(&orderID, &serviceName,
+			&opts.Detergent, &opts.WaterTemperature, &opts.HangDry, &opts.FoldStyle, &opts.AllergySafe)
+		if err != nil {
+			return nil, err
+		}
+		if labels := opts.labels(); len(labels) > 0 {
+			care[orderID] = append(care[orderID], serviceName+": "+strings.Join(labels, ", "))
+		}
+	}
+	return care, rows.Err()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestItemOptions(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "options-admin@example.com", "Options", "Admin")
+	customerID := db.CreateTestUser(t, "options-customer@example.com", "Options", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	var zipCode string
+	db.QueryRow("SELECT zip_code FROM addresses WHERE id = $1", addressID).Scan(&zipCode)
+
+	if err := (&ItemOptions{Detergent: "bleach"}).validate(); err == nil {
+		t.Error("Expected an unknown detergent to be rejected")
+	}
+
+	// Two bags hang dried with sensitive detergent, washed cold for free
+	opts := &ItemOptions{Detergent: "sensitive", WaterTemperature: "cold", HangDry: true}
+	cents, err := priceItemOptions(db.DB, opts, 2, 6000, zipCode)
+	if err != nil {
+		t.Fatalf("Failed to price item options: %v", err)
+	}
+	if cents != 1600 {
+		t.Errorf("Expected 2 bags of hang dry and sensitive detergent to cost 1600 cents, got %d", cents)
+	}
+
+	db.Exec("UPDATE service_add_ons SET markets = '{945}' WHERE item_option = 'hang_dry'")
+	if _, err := priceItemOptions(db.DB, opts, 2, 6000, zipCode); err != errAddOnUnavailable {
+		t.Errorf("Expected hang dry to be unavailable in this market, got %v", err)
+	}
+
+	// Item option add-ons aren't sold at checkout
+	handler := &AddOnHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	w := httptest.NewRecorder()
+	handler.handleGetAddOns(w, httptest.NewRequest("GET", "/api/v1/add-ons", nil))
+	var catalog []ServiceAddOn
+	json.Unmarshal(w.Body.Bytes(), &catalog)
+	for _, addOn := range catalog {
+		if addOn.ItemOption != "" {
+			t.Errorf("Expected item option add-ons left out of the checkout catalog, got %s", addOn.Name)
+		}
+	}
+
+	body, _ := json.Marshal(ServiceAddOn{Name: "cheap_hang_dry", DisplayName: "Hang Dry", PricingType: "flat", Price: 1, ItemOption: "hang_dry", IsActive: true})
+	w = httptest.NewRecorder()
+	handler.handleAdminCreateAddOn(w, httptest.NewRequest("POST", "/api/v1/admin/add-ons", bytes.NewBuffer(body)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for an option already priced, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Drivers and the facility see the options on the order
+	serviceID := db.GetServiceID(t, "bedding")
+	db.Exec(`
+		INSERT INTO order_items (order_id, service_id, quantity, price_cents, water_temperature, hang_dry, options_price_cents)
+		VALUES ($1, $2, 1, 2500, 'cold', true, 500)`,
+		orderID, serviceID,
+	)
+	care, err := orderCareOptions(db.DB, []int{orderID})
+	if err != nil {
+		t.Fatalf("Failed to get care options: %v", err)
+	}
+	if len(care[orderID]) != 1 || care[orderID][0] != "Bedding: cold wash, hang dry" {
+		t.Errorf("Unexpected care options: %v", care[orderID])
+	}
+
+	order, err := getOrder(db.DB, orderID)
+	if err != nil {
+		t.Fatalf("Failed to get order: %v", err)
+	}
+	found := false
+	for _, item := range order.Items {
+		if item.Options != nil && item.Options.HangDry && item.OptionsPrice == 5 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the line's options on the order, got %+v", order.Items)
+	}
+}
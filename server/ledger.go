@@ -0,0 +1,709 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Ledger accounts. Money held at Stripe is the one asset; everything owed to
+// customers or drivers is a liability until it's spent or paid out.
+const (
+	ledgerStripeBalance  = "stripe_balance"
+	ledgerRevenue        = "revenue"
+	ledgerRefunds        = "refunds"
+	ledgerCreditsIssued  = "credits_issued"
+	ledgerProcessingFees = "processing_fees"
+	ledgerDriverPay      = "driver_pay"
+	ledgerCustomerCredit = "customer_credit"
+	ledgerTipsPayable    = "tips_payable"
+	ledgerDriverPayable  = "driver_payable"
+)
+
+// LedgerAccount is an account in the chart. Assets, expenses and refunds
+// (which reduce revenue) carry debit balances; the rest carry credit balances.
+type LedgerAccount struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+var ledgerAccounts = []LedgerAccount{
+	{ledgerStripeBalance, "asset", "Money collected and held at Stripe"},
+	{ledgerCustomerCredit, "liability", "Account credit customers haven't spent"},
+	{ledgerTipsPayable, "liability", "Tips collected but not yet earned by a driver"},
+	{ledgerDriverPayable, "liability", "Driver pay earned but not yet paid out"},
+	{ledgerRevenue, "revenue", "Orders and subscriptions, including credit spent on them"},
+	{ledgerRefunds, "contra_revenue", "Money and cancellation credit returned to customers"},
+	{ledgerCreditsIssued, "expense", "Goodwill and resolution credit granted"},
+	{ledgerProcessingFees, "expense", "Stripe fees"},
+	{ledgerDriverPay, "expense", "Per-stop driver pay"},
+}
+
+// ledgerDebitNormal reports whether an account's balance is debits less credits
+func ledgerDebitNormal(accountType string) bool {
+	return accountType == "asset" || accountType == "expense" || accountType == "contra_revenue"
+}
+
+var errUnbalancedLedger = errors.New("ledger transaction debits and credits don't match")
+
+type ledgerLine struct {
+	account     string
+	debitCents  int
+	creditCents int
+}
+
+func ledgerDebit(account string, cents int) ledgerLine {
+	return ledgerLine{account: account, debitCents: cents}
+}
+
+func ledgerCredit(account string, cents int) ledgerLine {
+	return ledgerLine{account: account, creditCents: cents}
+}
+
+// ledgerPosting is a transaction waiting to be posted. Source and SourceRef
+// name the row it came from, so posting the same row twice does nothing.
+type ledgerPosting struct {
+	Source      string
+	SourceRef   string
+	Description string
+	UserID      *int
+	OrderID     *int
+	OccurredAt  time.Time
+	Lines       []ledgerLine
+}
+
+// balanced checks the posting has entries, each one a positive debit or
+// credit, and that they net to zero. Zero-amount lines are dropped.
+func (p *ledgerPosting) balanced() error {
+	lines := p.Lines[:0]
+	debits, credits := 0, 0
+	for _, l := range p.Lines {
+		if l.debitCents == 0 && l.creditCents == 0 {
+			continue
+		}
+		if l.debitCents < 0 || l.creditCents < 0 || (l.debitCents > 0 && l.creditCents > 0) {
+			return fmt.Errorf("invalid %s entry in %s %s", l.account, p.Source, p.SourceRef)
+		}
+		debits += l.debitCents
+		credits += l.creditCents
+		lines = append(lines, l)
+	}
+	p.Lines = lines
+	if len(lines) == 0 || debits != credits {
+		return errUnbalancedLedger
+	}
+	return nil
+}
+
+// postLedger records a posting and reports whether it was new
+func postLedger(db *sql.DB, p ledgerPosting) (bool, error) {
+	if err := p.balanced(); err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var transactionID int
+	err = tx.QueryRow(`
+		INSERT INTO ledger_transactions (source, source_ref, description, user_id, order_id, occurred_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (source, source_ref) DO NOTHING
+		RETURNING id`,
+		p.Source, p.SourceRef, p.Description, p.UserID, p.OrderID, p.OccurredAt,
+	).Scan(&transactionID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, l := range p.Lines {
+		_, err := tx.Exec(`
+			INSERT INTO ledger_entries (transaction_id, account, debit_cents, credit_cents)
+			VALUES ($1, $2, $3, $4)`,
+			transactionID, l.account, l.debitCents, l.creditCents,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// ledgerSourceRow is a money movement found in its own table and not yet posted
+type ledgerSourceRow struct {
+	Ref         string
+	UserID      *int
+	OrderID     *int
+	AmountCents int
+	// SplitCents is the tip part of a payment
+	SplitCents  int
+	Kind        string
+	Description string
+	OccurredAt  time.Time
+}
+
+// ledgerSource finds unposted rows of one kind of movement and turns each
+// into entries. Sandbox money stays out of the books.
+type ledgerSource struct {
+	name  string
+	query string
+	args  []interface{}
+	lines func(row ledgerSourceRow) []ledgerLine
+}
+
+// creditLines posts a customer credit ledger entry. Credit spent on an order
+// (or given back when the order fails) is revenue; credit handed out for a
+// cancellation stands in for a refund; anything else is goodwill.
+func creditLines(row ledgerSourceRow) []ledgerLine {
+	counter := ledgerCreditsIssued
+	switch row.Kind {
+	case "redemption", "reversal":
+		counter = ledgerRevenue
+	case "cancellation":
+		counter = ledgerRefunds
+	}
+	if row.AmountCents > 0 {
+		return []ledgerLine{ledgerDebit(counter, row.AmountCents), ledgerCredit(ledgerCustomerCredit, row.AmountCents)}
+	}
+	return []ledgerLine{ledgerDebit(ledgerCustomerCredit, -row.AmountCents), ledgerCredit(counter, -row.AmountCents)}
+}
+
+var ledgerSources = []ledgerSource{
+	{
+		// Captured payments; the tip is held for the driver who delivers
+		name: "payment",
+		args: []interface{}{sandboxPaymentPrefix},
+		query: `
+			SELECT p.id::text, p.user_id, p.order_id, p.amount_cents,
+			       LEAST(COALESCE(o.tip_cents, 0), p.amount_cents), COALESCE(p.payment_type, ''),
+			       'Payment #' || p.id, p.created_at
+			FROM payments p
+			LEFT JOIN orders o ON p.order_id = o.id
+			WHERE p.status IN ('completed', 'partially_refunded', 'refunded') AND p.amount_cents > 0
+			  AND COALESCE(p.stripe_payment_intent_id, '') NOT LIKE $1 || '%'
+			  AND NOT EXISTS (SELECT 1 FROM ledger_transactions lt WHERE lt.source = 'payment' AND lt.source_ref = p.id::text)`,
+		lines: func(row ledgerSourceRow) []ledgerLine {
+			return []ledgerLine{
+				ledgerDebit(ledgerStripeBalance, row.AmountCents),
+				ledgerCredit(ledgerTipsPayable, row.SplitCents),
+				ledgerCredit(ledgerRevenue, row.AmountCents-row.SplitCents),
+			}
+		},
+	},
+	{
+		// Stripe's fee, once reconciliation has recorded it
+		name: "stripe_fee",
+		args: []interface{}{sandboxPaymentPrefix},
+		query: `
+			SELECT p.id::text, p.user_id, p.order_id, p.stripe_fee_cents, 0, '',
+			       'Stripe fee on payment #' || p.id, p.created_at
+			FROM payments p
+			WHERE p.stripe_fee_cents > 0
+			  AND COALESCE(p.stripe_payment_intent_id, '') NOT LIKE $1 || '%'
+			  AND NOT EXISTS (SELECT 1 FROM ledger_transactions lt WHERE lt.source = 'stripe_fee' AND lt.source_ref = p.id::text)`,
+		lines: func(row ledgerSourceRow) []ledgerLine {
+			return []ledgerLine{ledgerDebit(ledgerProcessingFees, row.AmountCents), ledgerCredit(ledgerStripeBalance, row.AmountCents)}
+		},
+	},
+	{
+		name: "refund",
+		args: []interface{}{sandboxPaymentPrefix},
+		query: `
+			SELECT r.id::text, r.user_id, r.order_id, r.amount_cents, 0, '',
+			       'Refund #' || r.id || ' of payment #' || r.payment_id, r.updated_at
+			FROM refunds r
+			WHERE r.status = 'succeeded'
+			  AND COALESCE(r.stripe_refund_id, '') NOT LIKE $1 || '%'
+			  AND NOT EXISTS (SELECT 1 FROM ledger_transactions lt WHERE lt.source = 'refund' AND lt.source_ref = r.id::text)`,
+		lines: func(row ledgerSourceRow) []ledgerLine {
+			return []ledgerLine{ledgerDebit(ledgerRefunds, row.AmountCents), ledgerCredit(ledgerStripeBalance, row.AmountCents)}
+		},
+	},
+	{
+		name: "credit",
+		query: `
+			SELECT c.id::text, c.user_id, c.order_id, c.amount_cents, 0, c.entry_type,
+			       'Credit ' || c.entry_type || COALESCE(': ' || NULLIF(c.reason, ''), ''), c.created_at
+			FROM customer_credit_ledger c
+			JOIN users u ON c.user_id = u.id
+			WHERE NOT u.is_sandbox
+			  AND NOT EXISTS (SELECT 1 FROM ledger_transactions lt WHERE lt.source = 'credit' AND lt.source_ref = c.id::text)`,
+		lines: creditLines,
+	},
+	{
+		// Stops and tips become owed to the driver once they're on a payout
+		name: "driver_earning",
+		query: `
+			SELECT i.id::text, p.driver_id, i.order_id, i.amount_cents, 0, i.kind,
+			       'Driver ' || i.kind || ' pay for the week of ' || TO_CHAR(p.period_start, 'YYYY-MM-DD'), i.created_at
+			FROM driver_payout_items i
+			JOIN driver_payouts p ON i.payout_id = p.id
+			WHERE i.amount_cents > 0
+			  AND NOT EXISTS (SELECT 1 FROM ledger_transactions lt WHERE lt.source = 'driver_earning' AND lt.source_ref = i.id::text)`,
+		lines: func(row ledgerSourceRow) []ledgerLine {
+			expense := ledgerDriverPay
+			if row.Kind == "tip" {
+				expense = ledgerTipsPayable
+			}
+			return []ledgerLine{ledgerDebit(expense, row.AmountCents), ledgerCredit(ledgerDriverPayable, row.AmountCents)}
+		},
+	},
+	{
+		name: "driver_payout",
+		query: `
+			SELECT p.id::text, p.driver_id, NULL::int, p.amount_cents, 0, '',
+			       'Payout #' || p.id || ' for the week of ' || TO_CHAR(p.period_start, 'YYYY-MM-DD'), COALESCE(p.paid_at, p.created_at)
+			FROM driver_payouts p
+			WHERE p.status = 'paid' AND p.amount_cents > 0
+			  AND NOT EXISTS (SELECT 1 FROM ledger_transactions lt WHERE lt.source = 'driver_payout' AND lt.source_ref = p.id::text)`,
+		lines: func(row ledgerSourceRow) []ledgerLine {
+			return []ledgerLine{ledgerDebit(ledgerDriverPayable, row.AmountCents), ledgerCredit(ledgerStripeBalance, row.AmountCents)}
+		},
+	},
+}
+
+// syncLedger posts every money movement not yet in the ledger and returns how
+// many transactions it added
+func syncLedger(db *sql.DB) (int, error) {
+	posted := 0
+	for _, source := range ledgerSources {
+		rows, err := db.Query(source.query, source.args...)
+		if err != nil {
+			return posted, fmt.Errorf("failed to find unposted %s rows: %v", source.name, err)
+		}
+		var pending []ledgerSourceRow
+		for rows.Next() {
+			var row ledgerSourceRow
+			var userID, orderID sql.NullInt64
+			err := rows.Scan(&row.Ref, &userID, &orderID, &row.AmountCents, &row.SplitCents,
+				&row.Kind, &row.Description, &row.OccurredAt)
+			if err != nil {
+				rows.Close()
+				return posted, err
+			}
+			if userID.Valid {
+				id := int(userID.Int64)
+				row.UserID = &id
+			}
+			if orderID.Valid {
+				id := int(orderID.Int64)
+				row.OrderID = &id
+			}
+			pending = append(pending, row)
+		}
+		rows.Close()
+
+		for _, row := range pending {
+			added, err := postLedger(db, ledgerPosting{
+				Source:      source.name,
+				SourceRef:   row.Ref,
+				Description: row.Description,
+				UserID:      row.UserID,
+				OrderID:     row.OrderID,
+				OccurredAt:  row.OccurredAt,
+				Lines:       source.lines(row),
+			})
+			if err != nil {
+				return posted, fmt.Errorf("failed to post %s %s: %v", source.name, row.Ref, err)
+			}
+			if added {
+				posted++
+			}
+		}
+	}
+	return posted, nil
+}
+
+// postInvoiceToLedger records a paid subscription invoice. Invoices have no
+// table of their own, so they're posted from the webhook.
+func postInvoiceToLedger(db *sql.DB, invoice *stripe.Invoice, stripeSubscriptionID string) error {
+	if invoice.AmountPaid <= 0 {
+		return nil
+	}
+	var userID *int
+	var id int
+	err := db.QueryRow("SELECT user_id FROM subscriptions WHERE stripe_subscription_id = $1", stripeSubscriptionID).Scan(&id)
+	if err == nil {
+		userID = &id
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	amount := int(invoice.AmountPaid)
+	_, err = postLedger(db, ledgerPosting{
+		Source:      "invoice",
+		SourceRef:   invoice.ID,
+		Description: "Subscription invoice " + invoice.ID,
+		UserID:      userID,
+		OccurredAt:  time.Now(),
+		Lines:       []ledgerLine{ledgerDebit(ledgerStripeBalance, amount), ledgerCredit(ledgerRevenue, amount)},
+	})
+	return err
+}
+
+// LedgerMismatch is an account whose ledger balance disagrees with the table
+// it's posted from
+type LedgerMismatch struct {
+	Account  string  `json:"account"`
+	Ledger   float64 `json:"ledger"`
+	Expected float64 `json:"expected"`
+}
+
+// LedgerCheck is the result of checking the ledger's invariants
+type LedgerCheck struct {
+	OK                     bool             `json:"ok"`
+	TotalDebits            float64          `json:"total_debits"`
+	TotalCredits           float64          `json:"total_credits"`
+	UnbalancedTransactions []int            `json:"unbalanced_transactions"`
+	Mismatches             []LedgerMismatch `json:"mismatches"`
+}
+
+// checkLedger verifies every transaction balances, so the books do as a
+// whole, and that the credit and driver liabilities match what the credit
+// ledger and unpaid payouts say is owed. Run it after syncLedger; rows posted
+// since then show up as mismatches.
+func checkLedger(db *sql.DB) (*LedgerCheck, error) {
+	check := &LedgerCheck{UnbalancedTransactions: []int{}, Mismatches: []LedgerMismatch{}}
+
+	var debits, credits int
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(debit_cents), 0), COALESCE(SUM(credit_cents), 0) FROM ledger_entries`,
+	).Scan(&debits, &credits)
+	if err != nil {
+		return nil, err
+	}
+	check.TotalDebits, check.TotalCredits = centsToDollars(debits), centsToDollars(credits)
+
+	rows, err := db.Query(`
+		SELECT t.id FROM ledger_transactions t
+		LEFT JOIN ledger_entries e ON e.transaction_id = t.id
+		GROUP BY t.id
+		HAVING COALESCE(SUM(e.debit_cents), 0) <> COALESCE(SUM(e.credit_cents), 0) OR COUNT(e.id) = 0
+		ORDER BY t.id`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		check.UnbalancedTransactions = append(check.UnbalancedTransactions, id)
+	}
+	rows.Close()
+
+	liabilities := []struct {
+		account  string
+		expected string
+	}{
+		{ledgerCustomerCredit, `
+			SELECT COALESCE(SUM(c.amount_cents), 0) FROM customer_credit_ledger c
+			JOIN users u ON c.user_id = u.id WHERE NOT u.is_sandbox`},
+		{ledgerDriverPayable, `
+			SELECT COALESCE(SUM(i.amount_cents), 0) FROM driver_payout_items i
+			JOIN driver_payouts p ON i.payout_id = p.id WHERE p.status <> 'paid'`},
+	}
+	for _, l := range liabilities {
+		var ledger, expected int
+		err := db.QueryRow(`
+			SELECT COALESCE(SUM(credit_cents - debit_cents), 0) FROM ledger_entries WHERE account = $1`,
+			l.account,
+		).Scan(&ledger)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.QueryRow(l.expected).Scan(&expected); err != nil {
+			return nil, err
+		}
+		if ledger != expected {
+			check.Mismatches = append(check.Mismatches, LedgerMismatch{
+				Account:  l.account,
+				Ledger:   centsToDollars(ledger),
+				Expected: centsToDollars(expected),
+			})
+		}
+	}
+
+	check.OK = debits == credits && len(check.UnbalancedTransactions) == 0 && len(check.Mismatches) == 0
+	return check, nil
+}
+
+// processLedger posts new money movements and raises an alert if the books
+// stop balancing
+func (s *AutoScheduler) processLedger() {
+	posted, err := syncLedger(s.db)
+	if err != nil {
+		log.Printf("Error syncing ledger: %v", err)
+		return
+	}
+	check, err := checkLedger(s.db)
+	if err != nil {
+		log.Printf("Error checking ledger: %v", err)
+		return
+	}
+	if posted > 0 {
+		log.Printf("Posted %d ledger transactions", posted)
+	}
+	if !check.OK {
+		logAdminAlert(s.db, AdminAlert{
+			Type:     "ledger_imbalance",
+			Severity: "critical",
+			Title:    "Ledger doesn't balance",
+			Message: fmt.Sprintf("%d unbalanced transactions and %d liability mismatches (debits %.2f, credits %.2f)",
+				len(check.UnbalancedTransactions), len(check.Mismatches), check.TotalDebits, check.TotalCredits),
+			DedupeKey: "ledger_imbalance:" + time.Now().UTC().Format("2006-01-02"),
+			Data:      check,
+		})
+	}
+}
+
+type LedgerHandler struct {
+	db *sql.DB
+}
+
+func NewLedgerHandler(db *sql.DB) *LedgerHandler {
+	return &LedgerHandler{db: db}
+}
+
+type LedgerEntry struct {
+	Account string  `json:"account"`
+	Debit   float64 `json:"debit"`
+	Credit  float64 `json:"credit"`
+}
+
+type LedgerTransaction struct {
+	ID          int           `json:"id"`
+	Source      string        `json:"source"`
+	SourceRef   string        `json:"source_ref"`
+	Description string        `json:"description"`
+	UserID      *int          `json:"user_id,omitempty"`
+	OrderID     *int          `json:"order_id,omitempty"`
+	OccurredAt  time.Time     `json:"occurred_at"`
+	Entries     []LedgerEntry `json:"entries"`
+}
+
+// ledgerDateRange adds ?from= and ?to= (inclusive YYYY-MM-DD dates) to a filter
+func ledgerDateRange(r *http.Request, where string, args []interface{}) (string, []interface{}, error) {
+	if from := r.URL.Query().Get("from"); from != "" {
+		date, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, date)
+		where += fmt.Sprintf(" AND t.occurred_at >= $%d", len(args))
+	}
+	if to := r.URL.Query().Get("to"); to != "" {
+		date, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, date.AddDate(0, 0, 1))
+		where += fmt.Sprintf(" AND t.occurred_at < $%d", len(args))
+	}
+	return where, args, nil
+}
+
+// handleGetLedgerTransactions lists ledger transactions, newest first,
+// filtered by ?source=, ?account=, ?user_id=, ?order_id=, ?from= and ?to=
+func (h *LedgerHandler) handleGetLedgerTransactions(w http.ResponseWriter, r *http.Request) {
+	where := "TRUE"
+	args := []interface{}{}
+	query := r.URL.Query()
+	if source := query.Get("source"); source != "" {
+		args = append(args, source)
+		where += fmt.Sprintf(" AND t.source = $%d", len(args))
+	}
+	if account := query.Get("account"); account != "" {
+		args = append(args, account)
+		where += fmt.Sprintf(" AND EXISTS (SELECT 1 FROM ledger_entries e WHERE e.transaction_id = t.id AND e.account = $%d)", len(args))
+	}
+	for _, filter := range []struct{ param, column string }{{"user_id", "t.user_id"}, {"order_id", "t.order_id"}} {
+		if value := query.Get(filter.param); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "Invalid "+filter.param, http.StatusBadRequest)
+				return
+			}
+			args = append(args, id)
+			where += fmt.Sprintf(" AND %s = $%d", filter.column, len(args))
+		}
+	}
+	where, args, err := ledgerDateRange(r, where, args)
+	if err != nil {
+		http.Error(w, "Invalid date, use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	args = append(args, limit)
+
+	rows, err := h.db.Query(fmt.Sprintf(`
+		SELECT t.id, t.source, t.source_ref, t.description, t.user_id, t.order_id, t.occurred_at
+		FROM ledger_transactions t
+		WHERE %s
+		ORDER BY t.occurred_at DESC, t.id DESC
+		LIMIT $%d`, where, len(args)),
+		args...,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch ledger", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	transactions := []LedgerTransaction{}
+	index := map[int]int{}
+	ids := []int64{}
+	for rows.Next() {
+		var t LedgerTransaction
+		var userID, orderID sql.NullInt64
+		if err := rows.Scan(&t.ID, &t.Source, &t.SourceRef, &t.Description, &userID, &orderID, &t.OccurredAt); err != nil {
+			http.Error(w, "Failed to parse ledger", http.StatusInternalServerError)
+			return
+		}
+		if userID.Valid {
+			id := int(userID.Int64)
+			t.UserID = &id
+		}
+		if orderID.Valid {
+			id := int(orderID.Int64)
+			t.OrderID = &id
+		}
+		t.Entries = []LedgerEntry{}
+		index[t.ID] = len(transactions)
+		ids = append(ids, int64(t.ID))
+		transactions = append(transactions, t)
+	}
+	rows.Close()
+
+	entryRows, err := h.db.Query(`
+		SELECT transaction_id, account, debit_cents, credit_cents FROM ledger_entries
+		WHERE transaction_id = ANY($1)
+		ORDER BY id`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch ledger", http.StatusInternalServerError)
+		return
+	}
+	defer entryRows.Close()
+	for entryRows.Next() {
+		var transactionID, debitCents, creditCents int
+		var entry LedgerEntry
+		if err := entryRows.Scan(&transactionID, &entry.Account, &debitCents, &creditCents); err != nil {
+			http.Error(w, "Failed to parse ledger", http.StatusInternalServerError)
+			return
+		}
+		entry.Debit, entry.Credit = centsToDollars(debitCents), centsToDollars(creditCents)
+		t := &transactions[index[transactionID]]
+		t.Entries = append(t.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transactions)
+}
+
+type LedgerAccountBalance struct {
+	LedgerAccount
+	Debits  float64 `json:"debits"`
+	Credits float64 `json:"credits"`
+	Balance float64 `json:"balance"`
+}
+
+type TrialBalance struct {
+	Accounts     []LedgerAccountBalance `json:"accounts"`
+	TotalDebits  float64                `json:"total_debits"`
+	TotalCredits float64                `json:"total_credits"`
+}
+
+// handleGetLedgerBalances returns each account's activity and balance, over
+// ?from= and ?to= if given
+func (h *LedgerHandler) handleGetLedgerBalances(w http.ResponseWriter, r *http.Request) {
+	where, args, err := ledgerDateRange(r, "TRUE", []interface{}{})
+	if err != nil {
+		http.Error(w, "Invalid date, use YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.db.Query(fmt.Sprintf(`
+		SELECT e.account, SUM(e.debit_cents), SUM(e.credit_cents)
+		FROM ledger_entries e
+		JOIN ledger_transactions t ON e.transaction_id = t.id
+		WHERE %s
+		GROUP BY e.account`, where),
+		args...,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch ledger balances", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	totals := map[string][2]int{}
+	for rows.Next() {
+		var account string
+		var debits, credits int
+		if err := rows.Scan(&account, &debits, &credits); err != nil {
+			http.Error(w, "Failed to parse ledger balances", http.StatusInternalServerError)
+			return
+		}
+		totals[account] = [2]int{debits, credits}
+	}
+
+	balances := TrialBalance{Accounts: []LedgerAccountBalance{}}
+	totalDebits, totalCredits := 0, 0
+	for _, account := range ledgerAccounts {
+		t := totals[account.Name]
+		balance := t[1] - t[0]
+		if ledgerDebitNormal(account.Type) {
+			balance = -balance
+		}
+		balances.Accounts = append(balances.Accounts, LedgerAccountBalance{
+			LedgerAccount: account,
+			Debits:        centsToDollars(t[0]),
+			Credits:       centsToDollars(t[1]),
+			Balance:       centsToDollars(balance),
+		})
+		totalDebits += t[0]
+		totalCredits += t[1]
+	}
+	balances.TotalDebits, balances.TotalCredits = centsToDollars(totalDebits), centsToDollars(totalCredits)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(balances)
+}
+
+// handleCheckLedger brings the ledger up to date and checks its invariants
+func (h *LedgerHandler) handleCheckLedger(w http.ResponseWriter, r *http.Request) {
+	if _, err := syncLedger(h.db); err != nil {
+		log.Printf("Failed to sync ledger: %v", err)
+		http.Error(w, "Failed to sync ledger", http.StatusInternalServerError)
+		return
+	}
+	check, err := checkLedger(h.db)
+	if err != nil {
+		http.Error(w, "Failed to check ledger", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLedgerPostingBalanced(t *testing.T) {
+	p := ledgerPosting{Lines: []ledgerLine{
+		ledgerDebit(ledgerStripeBalance, 2500),
+		ledgerCredit(ledgerTipsPayable, 0),
+		ledgerCredit(ledgerRevenue, 2500),
+	}}
+	if err := p.balanced(); err != nil {
+		t.Fatalf("Expected a balanced posting, got %v", err)
+	}
+	if len(p.Lines) != 2 {
+		t.Errorf("Expected the zero tip line dropped, got %d lines", len(p.Lines))
+	}
+
+	unbalanced := ledgerPosting{Lines: []ledgerLine{ledgerDebit(ledgerStripeBalance, 2500), ledgerCredit(ledgerRevenue, 2000)}}
+	if err := unbalanced.balanced(); err != errUnbalancedLedger {
+		t.Errorf("Expected errUnbalancedLedger, got %v", err)
+	}
+	if err := (&ledgerPosting{}).balanced(); err != errUnbalancedLedger {
+		t.Errorf("Expected an empty posting rejected, got %v", err)
+	}
+	negative := ledgerPosting{Lines: []ledgerLine{ledgerDebit(ledgerStripeBalance, -100), ledgerCredit(ledgerRevenue, -100)}}
+	if err := negative.balanced(); err == nil {
+		t.Error("Expected negative amounts rejected")
+	}
+}
+
+func TestCreditLines(t *testing.T) {
+	tests := []struct {
+		kind           string
+		amountCents    int
+		debitAccount   string
+		creditAccount  string
+		expectedAmount int
+	}{
+		{"grant", 1000, ledgerCreditsIssued, ledgerCustomerCredit, 1000},
+		{"adjustment", -400, ledgerCustomerCredit, ledgerCreditsIssued, 400},
+		{"redemption", -1500, ledgerCustomerCredit, ledgerRevenue, 1500},
+		{"reversal", 1500, ledgerRevenue, ledgerCustomerCredit, 1500},
+		{"cancellation", 2000, ledgerRefunds, ledgerCustomerCredit, 2000},
+	}
+	for _, tt := range tests {
+		lines := creditLines(ledgerSourceRow{Kind: tt.kind, AmountCents: tt.amountCents})
+		if len(lines) != 2 || lines[0].account != tt.debitAccount || lines[1].account != tt.creditAccount ||
+			lines[0].debitCents != tt.expectedAmount || lines[1].creditCents != tt.expectedAmount {
+			t.Errorf("%s of %d: expected %s debited and %s credited %d, got %+v",
+				tt.kind, tt.amountCents, tt.debitAccount, tt.creditAccount, tt.expectedAmount, lines)
+		}
+	}
+}
+
+func TestSyncLedger(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	customerID := db.CreateTestUser(t, "ledger@example.com", "Ledger", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	db.Exec("UPDATE orders SET tip_cents = 500 WHERE id = $1", orderID)
+
+	var paymentID int
+	db.QueryRow(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id, stripe_fee_cents)
+		VALUES ($1, $2, 4000, 'extra_order', 'partially_refunded', 'pi_ledger_test', 146)
+		RETURNING id`,
+		customerID, orderID,
+	).Scan(&paymentID)
+	db.Exec(`
+		INSERT INTO refunds (payment_id, order_id, user_id, amount_cents, reason, status, stripe_refund_id)
+		VALUES ($1, $2, $3, 1000, 'Damaged item', 'succeeded', 're_ledger_test')`,
+		paymentID, orderID, customerID)
+	db.Exec(`
+		INSERT INTO customer_credit_ledger (user_id, amount_cents, entry_type, reason)
+		VALUES ($1, 1500, 'grant', 'Welcome back'), ($1, -700, 'redemption', 'Applied')`,
+		customerID)
+	// Sandbox money stays out of the books
+	db.Exec(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id)
+		VALUES ($1, $2, 9999, 'extra_order', 'completed', $3)`,
+		customerID, orderID, sandboxPaymentPrefix+"pi_ledger")
+
+	posted, err := syncLedger(db.DB)
+	if err != nil {
+		t.Fatalf("Failed to sync ledger: %v", err)
+	}
+	// Payment, fee, refund and two credit entries
+	if posted != 5 {
+		t.Errorf("Expected 5 transactions posted, got %d", posted)
+	}
+	if posted, _ := syncLedger(db.DB); posted != 0 {
+		t.Errorf("Expected nothing posted twice, got %d", posted)
+	}
+
+	check, err := checkLedger(db.DB)
+	if err != nil {
+		t.Fatalf("Failed to check ledger: %v", err)
+	}
+	if !check.OK || check.TotalDebits != check.TotalCredits {
+		t.Errorf("Expected the ledger to balance, got %+v", check)
+	}
+
+	w := httptest.NewRecorder()
+	NewLedgerHandler(db.DB).handleGetLedgerBalances(w, httptest.NewRequest("GET", "/api/v1/admin/ledger/balances", nil))
+	var balances TrialBalance
+	json.Unmarshal(w.Body.Bytes(), &balances)
+	expected := map[string]float64{
+		ledgerStripeBalance:  40.00 - 1.46 - 10.00,
+		ledgerTipsPayable:    5.00,
+		ledgerRevenue:        35.00 + 7.00,
+		ledgerRefunds:        10.00,
+		ledgerProcessingFees: 1.46,
+		ledgerCreditsIssued:  15.00,
+		ledgerCustomerCredit: 8.00,
+	}
+	for _, account := range balances.Accounts {
+		if want, ok := expected[account.Name]; ok && account.Balance != want {
+			t.Errorf("Expected %s balance %.2f, got %.2f", account.Name, want, account.Balance)
+		}
+	}
+
+	// A credit entry that never reaches the ledger shows up as a mismatch
+	db.Exec("INSERT INTO customer_credit_ledger (user_id, amount_cents, entry_type) VALUES ($1, 200, 'grant')", customerID)
+	if check, _ := checkLedger(db.DB); check.OK || len(check.Mismatches) != 1 || check.Mismatches[0].Account != ledgerCustomerCredit {
+		t.Errorf("Expected a customer credit mismatch, got %+v", check)
+	}
+
+	w = httptest.NewRecorder()
+	NewLedgerHandler(db.DB).handleGetLedgerTransactions(w, httptest.NewRequest("GET", "/api/v1/admin/ledger/transactions?source=payment", nil))
+	var transactions []LedgerTransaction
+	json.Unmarshal(w.Body.Bytes(), &transactions)
+	if len(transactions) != 1 || len(transactions[0].Entries) != 3 {
+		t.Errorf("Expected one payment with three entries, got %+v", transactions)
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tumble-backend/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// LegalHoldHandler places accounts under legal hold and exports everything
+// we hold on them for subpoenas and disputes. Holds, releases and exports
+// are all written to legal_hold_audit.
+type LegalHoldHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+	store     storage.Store
+}
+
+func NewLegalHoldHandler(db *sql.DB, store storage.Store) *LegalHoldHandler {
+	return &LegalHoldHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+		store:     store,
+	}
+}
+
+type LegalHold struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	UserEmail  string     `json:"user_email"`
+	UserName   string     `json:"user_name"`
+	Reason     string     `json:"reason"`
+	PlacedBy   *int       `json:"placed_by"`
+	PlacedAt   time.Time  `json:"placed_at"`
+	ReleasedBy *int       `json:"released_by,omitempty"`
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+}
+
+type LegalHoldAuditEntry struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	HoldID    *int      `json:"hold_id"`
+	Action    string    `json:"action"` // placed, released, exported
+	ActorID   *int      `json:"actor_id"`
+	Details   *string   `json:"details"`
+	IPAddress *string   `json:"ip_address"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PlaceLegalHoldRequest struct {
+	Reason string `json:"reason"`
+}
+
+// notOnLegalHold is a SQL condition that's true when the account in
+// userColumn isn't under legal hold. Retention purges AND it into their
+// WHERE clauses.
+func notOnLegalHold(userColumn string) string {
+	return "NOT EXISTS (SELECT 1 FROM legal_holds lh WHERE lh.user_id = " + userColumn + " AND lh.released_at IS NULL)"
+}
+
+func isOnLegalHold(q queryRower, userID int) (bool, error) {
+	var onHold bool
+	err := q.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM legal_holds WHERE user_id = $1 AND released_at IS NULL)",
+		userID,
+	).Scan(&onHold)
+	return onHold, err
+}
+
+func recordLegalHoldAudit(db execer, r *http.Request, userID int, holdID *int, action string, actorID int, details string) error {
+	_, err := db.Exec(`
+		INSERT INTO legal_hold_audit (user_id, hold_id, action, actor_id, details, ip_address)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)`,
+		userID, holdID, action, actorID, details, r.RemoteAddr,
+	)
+	return err
+}
+
+const legalHoldColumns = `h.id, h.user_id, u.email, u.first_name || ' ' || u.last_name, h.reason,
+	h.placed_by, h.placed_at, h.released_by, h.released_at`
+
+func scanLegalHold(scanner interface{ Scan(...interface{}) error }) (LegalHold, error) {
+	var hold LegalHold
+	err := scanner.Scan(&hold.ID, &hold.UserID, &hold.UserEmail, &hold.UserName, &hold.Reason,
+		&hold.PlacedBy, &hold.PlacedAt, &hold.ReleasedBy, &hold.ReleasedAt)
+	return hold, err
+}
+
+// handleGetLegalHolds lists active holds, or every hold ever placed with
+// ?include_released=true
+func (h *LegalHoldHandler) handleGetLegalHolds(w http.ResponseWriter, r *http.Request) {
+	includeReleased := r.URL.Query().Get("include_released") == "true"
+	rows, err := h.db.Query(`
+		SELECT `+legalHoldColumns+`
+		FROM legal_holds h JOIN users u ON u.id = h.user_id
+		WHERE $1 OR h.released_at IS NULL
+		ORDER BY h.placed_at DESC`,
+		includeReleased,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch legal holds", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	holds := []LegalHold{}
+	for rows.Next() {
+		hold, err := scanLegalHold(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch legal holds", http.StatusInternalServerError)
+			return
+		}
+		holds = append(holds, hold)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(holds)
+}
+
+// handlePlaceLegalHold puts an account under hold. The reason should name
+// the case or dispute so the hold can be traced later.
+func (h *LegalHoldHandler) handlePlaceLegalHold(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req PlaceLegalHoldRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var holdID int
+	err = tx.QueryRow(`
+		INSERT INTO legal_holds (user_id, reason, placed_by)
+		SELECT id, $2, $3 FROM users WHERE id = $1
+		RETURNING id`,
+		userID, req.Reason, adminID,
+	).Scan(&holdID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "User is already under legal hold", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to place legal hold", http.StatusInternalServerError)
+		return
+	}
+	if err := recordLegalHoldAudit(tx, r, userID, &holdID, "placed", adminID, req.Reason); err != nil {
+		http.Error(w, "Failed to place legal hold", http.StatusInternalServerError)
+		return
+	}
+
+	hold, err := scanLegalHold(tx.QueryRow(
+		"SELECT "+legalHoldColumns+" FROM legal_holds h JOIN users u ON u.id = h.user_id WHERE h.id = $1", holdID,
+	))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to place legal hold", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hold)
+}
+
+// handleReleaseLegalHold lifts an account's active hold. Retention picks its
+// data up again on the next scheduled run.
+func (h *LegalHoldHandler) handleReleaseLegalHold(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var holdID int
+	err = tx.QueryRow(`
+		UPDATE legal_holds SET released_by = $2, released_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND released_at IS NULL
+		RETURNING id`,
+		userID, adminID,
+	).Scan(&holdID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User is not under legal hold", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to release legal hold", http.StatusInternalServerError)
+		return
+	}
+	if err := recordLegalHoldAudit(tx, r, userID, &holdID, "released", adminID, ""); err != nil {
+		http.Error(w, "Failed to release legal hold", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to release legal hold", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetLegalHoldAudit returns the audit trail for an account
+func (h *LegalHoldHandler) handleGetLegalHoldAudit(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, user_id, hold_id, action, actor_id, details, ip_address, created_at
+		FROM legal_hold_audit WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch audit trail", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []LegalHoldAuditEntry{}
+	for rows.Next() {
+		var e LegalHoldAuditEntry
+		if err := rows.Scan(&e.ID, &e.UserID, &e.HoldID, &e.Action, &e.ActorID, &e.Details, &e.IPAddress, &e.CreatedAt); err != nil {
+			http.Error(w, "Failed to fetch audit trail", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// accountOrders selects the IDs of an account's orders for export queries
+const accountOrders = "(SELECT id FROM orders WHERE user_id = $1)"
+
+// legalExportSections are the JSON files in an export bundle. Each query
+// returns one JSON array of whole rows, so columns added later are exported
+// without touching this list. Password hashes are left out.
+var legalExportSections = []struct {
+	name  string
+	query string
+}{
+	{"account", "SELECT COALESCE(json_agg(to_jsonb(u) - 'password_hash'), '[]') FROM users u WHERE u.id = $1"},
+	{"addresses", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM addresses t WHERE t.user_id = $1"},
+	{"subscriptions", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM subscriptions t WHERE t.user_id = $1"},
+	{"orders", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM orders t WHERE t.user_id = $1"},
+	{"order_items", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM order_items t WHERE t.order_id IN " + accountOrders},
+	{"order_add_ons", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM order_add_ons t WHERE t.order_id IN " + accountOrders},
+	{"order_garments", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM order_garments t WHERE t.order_id IN " + accountOrders},
+	{"order_status_history", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM order_status_history t WHERE t.order_id IN " + accountOrders},
+	{"order_resolutions", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM order_resolutions t WHERE t.order_id IN " + accountOrders},
+	{"order_messages", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM order_messages t WHERE t.order_id IN " + accountOrders},
+	{"payments", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM payments t WHERE t.user_id = $1"},
+	{"messages", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM notifications t WHERE t.user_id = $1"},
+	{"account_change_history", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM account_change_history t WHERE t.user_id = $1"},
+	{"stop_photos", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM stop_photos t WHERE t.order_id IN " + accountOrders},
+	{"delivery_signatures", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM delivery_signatures t WHERE t.order_id IN " + accountOrders},
+	{"files", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM files t WHERE t.owner_id = $1"},
+	{"legal_holds", "SELECT COALESCE(json_agg(t ORDER BY t.id), '[]') FROM legal_holds t WHERE t.user_id = $1"},
+}
+
+// LegalExportManifest is manifest.json in an export bundle
+type LegalExportManifest struct {
+	UserID       int            `json:"user_id"`
+	HoldID       int            `json:"hold_id"`
+	HoldReason   string         `json:"hold_reason"`
+	GeneratedBy  int            `json:"generated_by"`
+	GeneratedAt  time.Time      `json:"generated_at"`
+	Sections     map[string]int `json:"sections"` // Rows per JSON file
+	Files        int            `json:"files"`
+	MissingFiles []string       `json:"missing_files,omitempty"` // Uploads whose bytes weren't in storage
+}
+
+// legalExportObjects lists the stored objects in an export bundle with the
+// path each is written to: the account's uploads, and the stop photos and
+// delivery signatures on its orders
+const legalExportObjects = `
+	SELECT 'files/' || id || '-' || filename, storage_key FROM files WHERE owner_id = $1
+	UNION ALL
+	SELECT 'stop_photos/' || id || '-' || regexp_replace(storage_key, '^.*/', ''), storage_key
+	FROM stop_photos WHERE order_id IN ` + accountOrders + `
+	UNION ALL
+	SELECT 'delivery_signatures/' || id || '-' || regexp_replace(storage_key, '^.*/', ''), storage_key
+	FROM delivery_signatures WHERE order_id IN ` + accountOrders + `
+	ORDER BY 1`
+
+// writeLegalExport writes an account's export bundle as a zip: a JSON file
+// per section, the stored objects from legalExportObjects, and a manifest
+func writeLegalExport(ctx context.Context, db *sql.DB, store storage.Store, manifest *LegalExportManifest, out io.Writer) error {
+	archive := zip.NewWriter(out)
+	manifest.Sections = map[string]int{}
+
+	for _, section := range legalExportSections {
+		var data json.RawMessage
+		if err := db.QueryRow(section.query, manifest.UserID).Scan(&data); err != nil {
+			return fmt.Errorf("export %s: %w", section.name, err)
+		}
+		var rows []json.RawMessage
+		if err := json.Unmarshal(data, &rows); err != nil {
+			return fmt.Errorf("export %s: %w", section.name, err)
+		}
+		manifest.Sections[section.name] = len(rows)
+
+		f, err := archive.Create(section.name + ".json")
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Query(legalExportObjects, manifest.UserID)
+	if err != nil {
+		return fmt.Errorf("export files: %w", err)
+	}
+	type upload struct {
+		path, key string
+	}
+	var uploads []upload
+	for rows.Next() {
+		var u upload
+		if err := rows.Scan(&u.path, &u.key); err != nil {
+			rows.Close()
+			return err
+		}
+		uploads = append(uploads, u)
+	}
+	rows.Close()
+
+	for _, u := range uploads {
+		body, err := store.Get(ctx, u.key)
+		if errors.Is(err, storage.ErrNotFound) {
+			manifest.MissingFiles = append(manifest.MissingFiles, u.key)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("export %s: %w", u.path, err)
+		}
+		f, err := archive.Create(u.path)
+		if err == nil {
+			_, err = io.Copy(f, body)
+		}
+		body.Close()
+		if err != nil {
+			return err
+		}
+		manifest.Files++
+	}
+
+	f, err := archive.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// handleExportAccount downloads a zip of everything held on an account.
+// Only accounts under legal hold can be exported, and every export is
+// audited before any data leaves.
+func (h *LegalHoldHandler) handleExportAccount(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	manifest := LegalExportManifest{UserID: userID, GeneratedBy: adminID, GeneratedAt: time.Now().UTC()}
+	err = h.db.QueryRow(
+		"SELECT id, reason FROM legal_holds WHERE user_id = $1 AND released_at IS NULL", userID,
+	).Scan(&manifest.HoldID, &manifest.HoldReason)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Only accounts under legal hold can be exported", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch legal hold", http.StatusInternalServerError)
+		return
+	}
+	if err := recordLegalHoldAudit(h.db, r, userID, &manifest.HoldID, "exported", adminID, "Full account export"); err != nil {
+		http.Error(w, "Failed to record export", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="account-%d-export-%s.zip"`, userID, manifest.GeneratedAt.Format("20060102-150405")))
+	w.Header().Set("Cache-Control", "no-store")
+	if err := writeLegalExport(r.Context(), h.db, h.store, &manifest, w); err != nil {
+		// Headers are gone by now; a truncated zip won't open, which is the signal
+		LogRequest("legal_export", r.Method, r.URL.Path, adminID).Error("Account export failed", "user_id", userID, "error", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"tumble-backend/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLegalHold(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+	db.Exec("DELETE FROM legal_hold_audit")
+
+	adminID := db.CreateTestUser(t, "legal-admin@example.com", "Legal", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	userID := db.CreateTestUser(t, "disputed@example.com", "Disputed", "Customer")
+	addressID := db.CreateTestAddress(t, userID)
+
+	// Data retention would otherwise purge
+	draftID := db.CreateTestOrder(t, userID, addressID)
+	db.Exec("UPDATE orders SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP - INTERVAL '30 days' WHERE id = $1", draftID)
+	db.Exec(`
+		INSERT INTO notifications (user_id, type, title, message, created_at)
+		VALUES ($1, 'usage_alert', 'Old', 'Old', CURRENT_TIMESTAMP - INTERVAL '120 days')`,
+		userID,
+	)
+
+	store := storage.NewLocal(t.TempDir(), "https://tumble.test/api/v1/storage", []byte("secret"))
+	store.Put(context.Background(), "users/1/photo.png", strings.NewReader("\x89PNG"), 4, "image/png")
+	var fileID int
+	db.QueryRow(`
+		INSERT INTO files (owner_id, storage_key, filename, content_type, size_bytes)
+		VALUES ($1, 'users/1/photo.png', 'damage.png', 'image/png', 4)
+		RETURNING id`,
+		userID,
+	).Scan(&fileID)
+
+	// Proof of delivery on the account's orders is exported with it
+	store.Put(context.Background(), "orders/1/door.jpg", strings.NewReader("JPEG"), 4, "image/jpeg")
+	store.Put(context.Background(), "orders/1/signature.png", strings.NewReader("SIGN"), 4, "image/png")
+	var routeID, routeOrderID, photoID, signatureID int
+	db.QueryRow("INSERT INTO driver_routes (driver_id, route_date, route_type, status) VALUES ($1, CURRENT_DATE, 'delivery', 'completed') RETURNING id", adminID).Scan(&routeID)
+	db.QueryRow("INSERT INTO route_orders (route_id, order_id, sequence_number, status) VALUES ($1, $2, 1, 'completed') RETURNING id", routeID, draftID).Scan(&routeOrderID)
+	db.QueryRow(`
+		INSERT INTO stop_photos (route_order_id, order_id, storage_key, content_type, size_bytes)
+		VALUES ($1, $2, 'orders/1/door.jpg', 'image/jpeg', 4) RETURNING id`,
+		routeOrderID, draftID,
+	).Scan(&photoID)
+	db.QueryRow(`
+		INSERT INTO delivery_signatures (route_order_id, order_id, signer_name, storage_key, content_type, size_bytes)
+		VALUES ($1, $2, 'Pat', 'orders/1/signature.png', 'image/png', 4) RETURNING id`,
+		routeOrderID, draftID,
+	).Scan(&signatureID)
+
+	handler := NewLegalHoldHandler(db.DB, store)
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return adminID, nil
+	}
+	userRequest := func(method, path, body string) *http.Request {
+		req := httptest.NewRequest(method, "/api/v1/admin/users/"+strconv.Itoa(userID)+path, strings.NewReader(body))
+		return mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(userID)})
+	}
+
+	// Exports need an active hold
+	w := httptest.NewRecorder()
+	handler.handleExportAccount(w, userRequest("GET", "/legal-export", ""))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d exporting without a hold, got %d", http.StatusConflict, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.handlePlaceLegalHold(w, userRequest("POST", "/legal-hold", `{"reason": "Chargeback dispute #4471"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handler.handlePlaceLegalHold(w, userRequest("POST", "/legal-hold", `{"reason": "Again"}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a second hold, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Retention and account deletion leave the account alone
+	db.Exec(`
+		INSERT INTO order_messages (order_id, sender_id, sender_role, body, created_at)
+		VALUES ($1, $2, 'customer', 'Gate code is 1234', CURRENT_TIMESTAMP - INTERVAL '200 days')`,
+		draftID, userID,
+	)
+	scheduler := &AutoScheduler{db: db.DB}
+	scheduler.processRetentionPurges()
+	var orders, notifications, messages int
+	db.QueryRow("SELECT COUNT(*) FROM orders WHERE id = $1", draftID).Scan(&orders)
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1", userID).Scan(&notifications)
+	db.QueryRow("SELECT COUNT(*) FROM order_messages WHERE order_id = $1 AND redacted_at IS NULL", draftID).Scan(&messages)
+	if orders != 1 || notifications != 1 || messages != 1 {
+		t.Errorf("Expected held data to survive retention, got %d orders, %d notifications and %d chat messages", orders, notifications, messages)
+	}
+
+	admin := &AdminHandler{db: db.DB, getUserID: handler.getUserID}
+	w = httptest.NewRecorder()
+	admin.handleDeleteUser(w, userRequest("DELETE", "", ""))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d deleting a held account, got %d", http.StatusConflict, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleExportAccount(w, userRequest("GET", "/legal-export", ""))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected a zip, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string][]byte{}
+	for _, f := range archive.File {
+		rc, _ := f.Open()
+		contents[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	var manifest LegalExportManifest
+	json.Unmarshal(contents["manifest.json"], &manifest)
+	if manifest.HoldReason != "Chargeback dispute #4471" || manifest.Sections["orders"] != 1 || manifest.Sections["messages"] != 1 || manifest.Files != 3 ||
+		manifest.Sections["stop_photos"] != 1 || manifest.Sections["delivery_signatures"] != 1 {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+	if string(contents["files/"+strconv.Itoa(fileID)+"-damage.png"]) != "\x89PNG" {
+		t.Error("Expected the uploaded photo in the bundle")
+	}
+	if string(contents["stop_photos/"+strconv.Itoa(photoID)+"-door.jpg"]) != "JPEG" ||
+		string(contents["delivery_signatures/"+strconv.Itoa(signatureID)+"-signature.png"]) != "SIGN" {
+		t.Error("Expected the stop photo and delivery signature in the bundle")
+	}
+	if strings.Contains(string(contents["account.json"]), "password_hash") {
+		t.Error("Expected the password hash to be left out of the export")
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleReleaseLegalHold(w, userRequest("DELETE", "/legal-hold", ""))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleGetLegalHoldAudit(w, userRequest("GET", "/legal-hold/audit", ""))
+	var audit []LegalHoldAuditEntry
+	json.Unmarshal(w.Body.Bytes(), &audit)
+	actions := []string{}
+	for _, entry := range audit {
+		actions = append(actions, entry.Action)
+	}
+	if strings.Join(actions, ",") != "released,exported,placed" {
+		t.Errorf("Expected placed, exported and released in the audit trail, got %v", actions)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ListenConfig controls how the API is served. By default it's plain HTTP on
+// a TCP port behind a reverse proxy; small deployments can instead terminate
+// TLS here, or sit behind a proxy on the same host over a Unix socket.
+//
+//	GO_BACKEND_PORT        TCP port (default 8082, or 443 with autocert)
+//	LISTEN_SOCKET          serve on this Unix socket instead of a port
+//	LISTEN_SOCKET_MODE     octal permissions for the socket (default 0660)
+//	TLS_CERT_FILE          certificate chain to serve TLS with
+//	TLS_KEY_FILE           private key for TLS_CERT_FILE
+//	TLS_AUTOCERT_DOMAINS   comma-separated hosts to get Let's Encrypt certificates for
+//	TLS_AUTOCERT_CACHE_DIR where issued certificates are kept (default certs)
+//	TLS_AUTOCERT_EMAIL     contact address for the ACME account
+//	TLS_AUTOCERT_HTTP_ADDR address for ACME challenges and HTTPS redirects (default :80)
+//	HTTP2_CLEARTEXT        also accept HTTP/2 without TLS (h2c), for proxies that speak it
+//
+// HTTP/2 is always offered over TLS.
+type ListenConfig struct {
+	Port             string
+	SocketPath       string
+	SocketMode       os.FileMode
+	TLSCertFile      string
+	TLSKeyFile       string
+	AutocertDomains  []string
+	AutocertCacheDir string
+	AutocertEmail    string
+	AutocertHTTPAddr string
+	H2C              bool
+}
+
+func listenConfigFromEnv() (ListenConfig, error) {
+	config := ListenConfig{
+		Port:             os.Getenv("GO_BACKEND_PORT"),
+		SocketPath:       os.Getenv("LISTEN_SOCKET"),
+		SocketMode:       0o660,
+		TLSCertFile:      os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:       os.Getenv("TLS_KEY_FILE"),
+		AutocertCacheDir: os.Getenv("TLS_AUTOCERT_CACHE_DIR"),
+		AutocertEmail:    os.Getenv("TLS_AUTOCERT_EMAIL"),
+		AutocertHTTPAddr: os.Getenv("TLS_AUTOCERT_HTTP_ADDR"),
+		H2C:              os.Getenv("HTTP2_CLEARTEXT") == "true",
+	}
+	if mode := os.Getenv("LISTEN_SOCKET_MODE"); mode != "" {
+		parsed, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || parsed > 0o777 {
+			return config, fmt.Errorf("LISTEN_SOCKET_MODE must be octal permissions like 0660")
+		}
+		config.SocketMode = os.FileMode(parsed)
+	}
+	for _, domain := range strings.Split(os.Getenv("TLS_AUTOCERT_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			config.AutocertDomains = append(config.AutocertDomains, domain)
+		}
+	}
+	if config.Port == "" {
+		config.Port = "8082"
+		if len(config.AutocertDomains) > 0 {
+			config.Port = "443"
+		}
+	}
+	if config.AutocertCacheDir == "" {
+		config.AutocertCacheDir = "certs"
+	}
+	if config.AutocertHTTPAddr == "" {
+		config.AutocertHTTPAddr = ":80"
+	}
+	return config, config.validate()
+}
+
+func (c ListenConfig) validate() error {
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.TLSCertFile != "" && len(c.AutocertDomains) > 0 {
+		return errors.New("set either TLS_CERT_FILE or TLS_AUTOCERT_DOMAINS, not both")
+	}
+	// Let's Encrypt has to reach us on a public port to validate the domain
+	if c.SocketPath != "" && len(c.AutocertDomains) > 0 {
+		return errors.New("TLS_AUTOCERT_DOMAINS can't be used with LISTEN_SOCKET")
+	}
+	return nil
+}
+
+func (c ListenConfig) usesTLS() bool {
+	return c.TLSCertFile != "" || len(c.AutocertDomains) > 0
+}
+
+// newHTTPServer builds the server for a config. HTTP/2 is offered over TLS
+// and, if enabled, in cleartext.
+func newHTTPServer(c ListenConfig, handler http.Handler) *http.Server {
+	srv := &http.Server{Handler: handler, Protocols: new(http.Protocols)}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(c.H2C)
+	if c.usesTLS() {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return srv
+}
+
+// listen opens the socket or port the config asks for. A socket file left
+// behind by a previous run is removed first.
+func (c ListenConfig) listen() (net.Listener, error) {
+	if c.SocketPath == "" {
+		return net.Listen("tcp", ":"+c.Port)
+	}
+
+	if info, err := os.Lstat(c.SocketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", c.SocketPath)
+		}
+		if err := os.Remove(c.SocketPath); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", c.SocketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(c.SocketPath, c.SocketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveHTTP serves handler as the config describes until the server fails
+func serveHTTP(c ListenConfig, handler http.Handler) error {
+	srv := newHTTPServer(c, handler)
+
+	if len(c.AutocertDomains) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(c.AutocertCacheDir),
+			HostPolicy: autocert.HostWhitelist(c.AutocertDomains...),
+			Email:      c.AutocertEmail,
+		}
+		srv.TLSConfig = manager.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+
+		// Answer HTTP-01 challenges and send everything else to HTTPS
+		go func() {
+			log.Printf("Serving ACME challenges on %s", c.AutocertHTTPAddr)
+			if err := http.ListenAndServe(c.AutocertHTTPAddr, manager.HTTPHandler(nil)); err != nil {
+				log.Printf("ACME challenge listener stopped: %v", err)
+			}
+		}()
+	}
+
+	listener, err := c.listen()
+	if err != nil {
+		return err
+	}
+	if c.SocketPath != "" {
+		defer os.Remove(c.SocketPath)
+	}
+
+	scheme := "http"
+	if c.usesTLS() {
+		scheme = "https"
+	}
+	log.Printf("Server starting on %s (%s)", listener.Addr(), scheme)
+
+	if c.usesTLS() {
+		// Certificates come from TLSConfig when autocert is on
+		return srv.ServeTLS(listener, c.TLSCertFile, c.TLSKeyFile)
+	}
+	return srv.Serve(listener)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+		check   func(ListenConfig) bool
+	}{
+		{"defaults", nil, false, func(c ListenConfig) bool {
+			return c.Port == "8082" && c.SocketPath == "" && !c.usesTLS() && c.SocketMode == 0o660
+		}},
+		{"autocert defaults to 443", map[string]string{"TLS_AUTOCERT_DOMAINS": "a.example.com, b.example.com"}, false, func(c ListenConfig) bool {
+			return c.Port == "443" && len(c.AutocertDomains) == 2 && c.AutocertDomains[1] == "b.example.com" && c.usesTLS()
+		}},
+		{"socket mode", map[string]string{"LISTEN_SOCKET": "/run/tumble.sock", "LISTEN_SOCKET_MODE": "0600"}, false, func(c ListenConfig) bool {
+			return c.SocketPath == "/run/tumble.sock" && c.SocketMode == 0o600
+		}},
+		{"bad socket mode", map[string]string{"LISTEN_SOCKET_MODE": "rw"}, true, nil},
+		{"cert without key", map[string]string{"TLS_CERT_FILE": "cert.pem"}, true, nil},
+		{"cert and autocert", map[string]string{"TLS_CERT_FILE": "cert.pem", "TLS_KEY_FILE": "key.pem", "TLS_AUTOCERT_DOMAINS": "a.example.com"}, true, nil},
+		{"autocert on a socket", map[string]string{"LISTEN_SOCKET": "/run/tumble.sock", "TLS_AUTOCERT_DOMAINS": "a.example.com"}, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"GO_BACKEND_PORT", "LISTEN_SOCKET", "LISTEN_SOCKET_MODE", "TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_AUTOCERT_DOMAINS", "HTTP2_CLEARTEXT"} {
+				t.Setenv(key, tt.env[key])
+			}
+			config, err := listenConfigFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.check != nil && !tt.check(config) {
+				t.Errorf("Unexpected config: %+v", config)
+			}
+		})
+	}
+}
+
+func TestServeHTTPOnUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tumble.sock")
+	// A socket left over from a crashed run is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	config := ListenConfig{SocketPath: socket, SocketMode: 0o600}
+	go serveHTTP(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var resp *http.Response
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if resp, err = client.Get("http://tumble/health"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Failed to reach the server over its socket: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("Expected an HTTP/1.1 response, got %q", body)
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("Failed to stat socket: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the socket to be mode 0600, got %v", info.Mode().Perm())
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -10,9 +11,12 @@ import (
 	"os"
 	"time"
 
+	"tumble-backend/storage"
+
 	"github.com/centrifugal/centrifuge"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -23,21 +27,77 @@ var (
 )
 
 type Server struct {
-	db             *sql.DB
-	redis          *redis.Client
-	centNode       *centrifuge.Node
-	realtime       *RealtimeHandler
-	auth           *AuthHandler
-	orders         *OrderHandler
-	subscriptions  *SubscriptionHandler
-	addresses      *AddressHandler
-	services       *ServiceHandler
-	admin          *AdminHandler
-	payments       *PaymentHandler
-	driverApps     *DriverApplicationHandler
-	driverRoutes   *DriverRouteHandler
-	driverEarnings *DriverEarningsHandler
-	scheduler      *AutoScheduler
+	db               *sql.DB
+	redis            *redis.Client
+	degradation      *RedisDegradation
+	chaos            *ChaosInjector
+	tracer           *Tracer
+	queryMetrics     *QueryMetrics
+	centNode         *centrifuge.Node
+	realtime         *RealtimeHandler
+	auth             *AuthHandler
+	orders           *OrderHandler
+	subscriptions    *SubscriptionHandler
+	addresses        *AddressHandler
+	services         *ServiceHandler
+	admin            *AdminHandler
+	payments         *PaymentHandler
+	driverApps       *DriverApplicationHandler
+	driverRoutes     *DriverRouteHandler
+	driverEarnings   *DriverEarningsHandler
+	driverPayouts    *DriverPayoutHandler
+	households       *HouseholdHandler
+	scorecards       *DriverScorecardHandler
+	planMigrations   *PlanMigrationHandler
+	planOffers       *PlanOfferHandler
+	ledger           *LedgerHandler
+	reconciliation   *ReconciliationHandler
+	garments         *GarmentHandler
+	pickupReminders  *PickupReminderHandler
+	addOns           *AddOnHandler
+	slotPricing      *SlotPricingHandler
+	slotCapacity     *SlotCapacityHandler
+	serviceAreas     *ServiceAreaHandler
+	pickupLocations  *PickupLocationHandler
+	bagPricing       *BagPricingHandler
+	driverExpenses   *DriverExpenseHandler
+	accountHistory   *AccountHistoryHandler
+	adminInbox       *AdminInboxHandler
+	driverHeartbeats *DriverHeartbeatHandler
+	driverLocations  *DriverLocationHandler
+	adjustments      *SubscriptionAdjustmentHandler
+	integrity        *OrderIntegrityHandler
+	instructions     *InstructionTemplateHandler
+	deactivation     *AccountDeactivationHandler
+	retention        *RetentionHandler
+	manifests        *RouteManifestHandler
+	userSync         *UserSyncHandler
+	costs            *CostHandler
+	onboarding       *DriverOnboardingHandler
+	inviteCodes      *InviteCodeHandler
+	orderFeed        *OrderFeedHandler
+	files            *FileHandler
+	legalHolds       *LegalHoldHandler
+	proofOfDelivery  *ProofOfDeliveryHandler
+	routeBreaks      *RouteBreakHandler
+	pickupSlots      *PickupSlotHandler
+	widget           *WidgetHandler
+	rateLimits       *RateLimiter
+	credits          *CreditHandler
+	safetyReports    *SafetyReportHandler
+	roles            *RoleHandler
+	blocklist        *BlocklistHandler
+	orderChat        *OrderChatHandler
+	itemEvents       *OrderItemEventHandler
+	webhooks         *WebhookHandler
+	driverPrefs      *DriverPreferenceHandler
+	markets          *MarketHandler
+	recovery         *RecoveryHandler
+	facility         *FacilityHandler
+	push             *PushDispatcher
+	pushDevices      *PushHandler
+	scheduler        *AutoScheduler
+	backups          *BackupVerifier
 }
 
 type HealthResponse struct {
@@ -56,6 +116,29 @@ func main() {
 
 	server := &Server{}
 
+	// Fault injection for resilience testing, off unless explicitly enabled
+	chaosConfig, err := chaosConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid chaos configuration: %v", err)
+	}
+	server.chaos = NewChaosInjector(chaosConfig)
+
+	// Distributed tracing, off unless an OTLP endpoint is configured
+	tracingConfig, err := tracingConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid tracing configuration: %v", err)
+	}
+	server.tracer = NewTracer(tracingConfig)
+	server.tracer.Start()
+	instrumentStripe(server.tracer.stripeTransport(server.chaos.stripeTransport(http.DefaultTransport)))
+
+	// Query durations for /metrics, and slow-query logging
+	queryMetricsConfig, err := queryMetricsConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid query metrics configuration: %v", err)
+	}
+	server.queryMetrics = NewQueryMetrics(queryMetricsConfig, prometheus.DefaultRegisterer)
+
 	// Initialize database connection
 	if err := server.initDB(); err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
@@ -67,9 +150,11 @@ func main() {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
 
-	// Initialize Redis connection
+	// Initialize Redis connection. Everything using it has a fallback, so an
+	// outage starts the server degraded rather than stopping it.
+	server.degradation = NewRedisDegradation()
 	if err := server.initRedis(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Printf("Redis unavailable, starting degraded: %v", err)
 	}
 	defer server.redis.Close()
 
@@ -80,6 +165,11 @@ func main() {
 
 	// Initialize handlers
 	server.realtime = NewRealtimeHandler(server.db, server.centNode)
+	server.realtime.retries = NewRealtimeRetryQueue(NewRedisRealtimeRetryStore(server.redis), func(channel string, data []byte) error {
+		_, err := server.centNode.Publish(channel, data)
+		return err
+	})
+	server.realtime.retries.Start()
 	server.auth = NewAuthHandler(server.db)
 	server.orders = NewOrderHandler(server.db, server.realtime)
 	server.subscriptions = NewSubscriptionHandler(server.db)
@@ -90,48 +180,170 @@ func main() {
 	server.driverApps = NewDriverApplicationHandler(server.db)
 	server.driverRoutes = NewDriverRouteHandler(server.db, server.realtime)
 	server.driverEarnings = NewDriverEarningsHandler(server.db)
+	server.driverPayouts = NewDriverPayoutHandler(server.db)
+	server.households = NewHouseholdHandler(server.db)
+	server.scorecards = NewDriverScorecardHandler(server.db)
+	server.planMigrations = NewPlanMigrationHandler(server.db)
+	server.planOffers = NewPlanOfferHandler(server.db)
+	server.ledger = NewLedgerHandler(server.db)
+	server.reconciliation = NewReconciliationHandler(server.db)
+	server.credits = NewCreditHandler(server.db)
+	server.safetyReports = NewSafetyReportHandler(server.db)
+	server.roles = NewRoleHandler(server.db)
+	server.blocklist = NewBlocklistHandler(server.db)
+	server.garments = NewGarmentHandler(server.db)
+	server.pickupReminders = NewPickupReminderHandler(server.db)
+	server.addOns = NewAddOnHandler(server.db)
+	server.slotPricing = NewSlotPricingHandler(server.db)
+	server.slotCapacity = NewSlotCapacityHandler(server.db)
+	server.serviceAreas = NewServiceAreaHandler(server.db)
+	server.pickupLocations = NewPickupLocationHandler(server.db)
+	server.bagPricing = NewBagPricingHandler(server.db)
+	server.driverExpenses = NewDriverExpenseHandler(server.db)
+	server.accountHistory = NewAccountHistoryHandler(server.db)
+	server.adminInbox = NewAdminInboxHandler(server.db)
+	server.driverHeartbeats = NewDriverHeartbeatHandler(server.db)
+	server.adjustments = NewSubscriptionAdjustmentHandler(server.db)
+	server.integrity = NewOrderIntegrityHandler(server.db)
+	server.instructions = NewInstructionTemplateHandler(server.db)
+	server.deactivation = NewAccountDeactivationHandler(server.db)
+	server.retention = NewRetentionHandler(server.db)
+	server.manifests = NewRouteManifestHandler(server.db)
+	server.userSync = NewUserSyncHandler(server.db, userSyncConfigFromEnv())
+	server.admin.userSync = server.userSync
+	server.costs = NewCostHandler(server.db)
+	server.onboarding = NewDriverOnboardingHandler(server.db)
+	server.inviteCodes = NewInviteCodeHandler(server.db)
+	server.orderFeed = NewOrderFeedHandler(server.db)
+	fileStore, err := storage.New(storageConfigFromEnv())
+	if err != nil {
+		log.Fatalf("Invalid storage configuration: %v", err)
+	}
+	server.files = NewFileHandler(server.db, fileStore)
+	server.legalHolds = NewLegalHoldHandler(server.db, fileStore)
+	server.proofOfDelivery = NewProofOfDeliveryHandler(server.db, fileStore)
+	server.driverRoutes.store = fileStore
+	server.orders.fileStore = fileStore
+	server.routeBreaks = NewRouteBreakHandler(server.db)
+	server.routeBreaks.realtime = server.realtime
+	slotHolds := NewRedisSlotHoldStore(server.redis)
+	server.pickupSlots = NewPickupSlotHandler(server.db, slotHolds)
+	server.widget = NewWidgetHandler(server.db, slotHolds)
+	server.pickupSlots.degradation = server.degradation
+	server.orders.slotHolds = slotHolds
+	driverLocations := NewFallbackDriverLocationStore(NewRedisDriverLocationStore(server.redis), server.db, server.degradation)
+	server.driverLocations = NewDriverLocationHandler(server.db, driverLocations, server.realtime)
+	server.orders.driverLocations = driverLocations
+	server.orderChat = NewOrderChatHandler(server.db, server.realtime)
+	server.itemEvents = NewOrderItemEventHandler(server.db, server.realtime)
+	server.webhooks = NewWebhookHandler(server.db)
+	server.driverPrefs = NewDriverPreferenceHandler(server.db)
+	server.markets = NewMarketHandler(server.db)
+	server.recovery = NewRecoveryHandler(server.db, server.payments, server.degradation)
+	server.facility = NewFacilityHandler(server.db, server.realtime)
+
+	// Push notifications for iOS and Android; platforms without credentials get none
+	pushSenders, err := pushSendersFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid push notification configuration: %v", err)
+	}
+	server.push = NewPushDispatcher(server.db, pushSenders)
+	server.pushDevices = NewPushHandler(server.db)
+	server.realtime.push = server.push
+	server.payments.push = server.push
+	server.driverLocations.push = server.push
+	server.rateLimits = NewRateLimiter(server.db, NewRedisRateLimitStore(server.redis))
+	server.rateLimits.degradation = server.degradation
 
 	// Initialize and start auto-scheduler
 	server.scheduler = NewAutoScheduler(server.db)
+	server.scheduler.realtime = server.realtime
+	server.scheduler.geocoder = server.admin.geocoder
+	server.scheduler.weather = weatherFromEnv()
+	server.scheduler.push = server.push
+	server.scheduler.webhooks = NewWebhookDispatcher(server.db)
+	server.scheduler.slotHolds = slotHolds
 	server.scheduler.Start()
 
+	// Initialize and start backup verification (no-op unless BACKUP_DIR is set)
+	server.backups = NewBackupVerifier(server.db, server.realtime, backupVerifierConfigFromEnv())
+	if err := server.backups.Start(); err != nil {
+		log.Printf("Failed to start backup verifier: %v", err)
+	}
+
 	// Set up HTTP routes with Gorilla Mux
 	r := mux.NewRouter()
 
 	// Add middleware
+	r.Use(server.tracer.Middleware)
 	r.Use(CORSMiddleware)
 	r.Use(LoggingMiddleware)
+	r.Use(server.chaos.Middleware)
 
 	// Basic routes
 	r.HandleFunc("/", server.handleHome)
 	r.HandleFunc("/health", server.handleHealth)
+	r.HandleFunc("/readyz", server.handleReadyz).Methods("GET")
+	r.Handle("/metrics", server.queryMetrics.Handler()).Methods("GET")
 	r.Handle("/connection/websocket", centrifuge.NewWebsocketHandler(server.centNode, centrifuge.WebsocketConfig{}))
 
 	// API subrouter
 	api := r.PathPrefix(APIPrefix).Subrouter()
+	api.Use(server.rateLimits.Middleware)
 
 	// Auth routes (Go backend auth for NextAuth)
-	api.HandleFunc("/auth/register", server.auth.handleRegister)
-	api.HandleFunc("/auth/login", server.auth.handleLogin)
-	api.HandleFunc("/auth/change-password", server.auth.handleChangePassword)
+	api.HandleFunc("/auth/register", server.rateLimits.limit("register", server.auth.handleRegister))
+	api.HandleFunc("/auth/login", server.rateLimits.limit("login", server.auth.handleLogin))
+	api.HandleFunc("/auth/change-password", server.rateLimits.limit("change_password", server.auth.handleChangePassword))
+	api.HandleFunc("/auth/refresh", server.auth.handleRefresh).Methods("POST")
+	api.HandleFunc("/auth/logout", server.auth.handleLogout).Methods("POST")
 	api.HandleFunc("/auth/google", server.auth.handleGoogleLogin)
 	api.HandleFunc("/auth/google/callback", server.auth.handleGoogleCallback)
+	api.HandleFunc("/auth/exchange", server.rateLimits.limit("login", server.auth.handleExchangeLoginCode)).Methods("POST")
+	api.HandleFunc("/auth/sync", server.userSync.handleUserSync).Methods("POST")
+
+	// Coverage checks and the waitlist are open to visitors before sign-up
+	api.HandleFunc("/service-areas/check", server.serviceAreas.handleCheckServiceArea).Methods("GET")
+	api.HandleFunc("/pickup-locations", server.pickupLocations.handleGetPickupLocations).Methods("GET")
+	api.HandleFunc("/service-areas/waitlist", server.rateLimits.limit("waitlist", server.serviceAreas.handleJoinWaitlist)).Methods("POST")
+
+	// Booking widget on partner sites, by publishable key from its origins
+	api.HandleFunc("/widget/quote", server.widget.authorize(server.rateLimits.limit("widget", server.widget.handleWidgetQuote))).Methods("POST", "OPTIONS")
+	api.HandleFunc("/widget/availability", server.widget.authorize(server.rateLimits.limit("widget", server.widget.handleWidgetAvailability))).Methods("GET", "OPTIONS")
+	api.HandleFunc("/widget/drafts", server.widget.authorize(server.rateLimits.limit("widget_draft", server.widget.handleCreateWidgetDraft))).Methods("POST", "OPTIONS")
+	api.HandleFunc("/booking-drafts/{token}", server.widget.handleClaimWidgetDraft).Methods("GET")
 
 	// Order routes
 	api.HandleFunc("/orders", server.orders.handleGetOrders)
-	api.HandleFunc("/orders/create", server.orders.handleCreateOrder)
+	api.HandleFunc("/orders/create", server.rateLimits.limit("create_order", server.orders.handleCreateOrder))
 	api.HandleFunc("/orders/{id}", server.orders.handleGetOrder)
 	api.HandleFunc("/orders/{id}/status", server.orders.handleUpdateOrderStatus)
 	api.HandleFunc("/orders/{id}/tracking", server.orders.handleGetOrderTracking)
+	api.HandleFunc("/orders/{id}/rating", server.orders.handleRateOrder).Methods("POST")
+	api.HandleFunc("/orders/{id}/review", server.orders.handleRateOrder).Methods("POST")
+	api.HandleFunc("/orders/{id}/receipt", server.orders.handleGetOrderReceipt).Methods("GET")
+	api.HandleFunc("/orders/{id}/cancel", server.orders.handleCancelOrder).Methods("POST")
+	api.HandleFunc("/orders/{id}/messages", server.orderChat.handleGetOrderMessages).Methods("GET")
+	api.HandleFunc("/orders/{id}/messages", server.orderChat.handleSendOrderMessage).Methods("POST")
+	api.HandleFunc("/orders/{id}/messages/read", server.orderChat.handleMarkOrderMessagesRead).Methods("POST")
 
 	// Subscription routes (specific routes before wildcard routes)
 	api.HandleFunc("/subscriptions/plans", server.subscriptions.handleGetPlans).Methods("GET")
 	api.HandleFunc("/subscriptions/current", server.subscriptions.handleGetSubscription).Methods("GET")
 	api.HandleFunc("/subscriptions/create", server.subscriptions.handleCreateSubscription).Methods("POST")
 	api.HandleFunc("/subscriptions/usage", server.subscriptions.handleGetSubscriptionUsage).Methods("GET")
+	api.HandleFunc("/subscriptions/overages", server.subscriptions.handleGetSubscriptionOverages).Methods("GET")
+	api.HandleFunc("/subscriptions/overages", server.subscriptions.handleUpdateSubscriptionOverages).Methods("PUT")
 	api.HandleFunc("/subscriptions/preview-change", server.subscriptions.handlePreviewSubscriptionChange).Methods("POST")
 	api.HandleFunc("/subscriptions/preferences", server.subscriptions.handleGetSubscriptionPreferences).Methods("GET")
 	api.HandleFunc("/subscriptions/preferences", server.subscriptions.handleCreateOrUpdateSubscriptionPreferences).Methods("POST", "PUT")
+	api.HandleFunc("/subscriptions/auto-schedule", server.subscriptions.handleGetAutoSchedule).Methods("GET")
+	api.HandleFunc("/subscriptions/auto-schedule/skips", server.subscriptions.handleSkipAutoSchedule).Methods("POST")
+	api.HandleFunc("/subscriptions/auto-schedule/skips/{date}", server.subscriptions.handleUnskipAutoSchedule).Methods("DELETE")
+	api.HandleFunc("/subscriptions/auto-schedule/pause", server.subscriptions.handlePauseAutoSchedule).Methods("POST")
+	api.HandleFunc("/subscriptions/auto-schedule/pause", server.subscriptions.handleResumeAutoSchedule).Methods("DELETE")
+	api.HandleFunc("/subscriptions/plan-migration", server.planMigrations.handleGetMyPlanMigration).Methods("GET")
+	api.HandleFunc("/subscriptions/plan-migration/opt-out", server.planMigrations.handleOptOutPlanMigration).Methods("POST")
 	api.HandleFunc("/subscriptions/{id}", server.subscriptions.handleUpdateSubscription).Methods("PUT", "PATCH")
 	api.HandleFunc("/subscriptions/{id}/cancel", server.subscriptions.handleCancelSubscription).Methods("POST")
 
@@ -140,26 +352,256 @@ func main() {
 	api.HandleFunc("/addresses/create", server.addresses.handleCreateAddress)
 	api.HandleFunc("/addresses/{id}", server.addresses.handleUpdateAddress).Methods("PUT", "PATCH")
 	api.HandleFunc("/addresses/{id}", server.addresses.handleDeleteAddress).Methods("DELETE")
+	api.HandleFunc("/addresses/{id}/reassign", server.addresses.handleReassignAddress).Methods("POST")
+	api.HandleFunc("/driver-preferences", server.driverPrefs.handleGetDriverPreferences).Methods("GET")
+	api.HandleFunc("/driver-preferences/{driverId}", server.driverPrefs.handleSetDriverPreference).Methods("PUT")
+	api.HandleFunc("/driver-preferences/{driverId}", server.driverPrefs.handleDeleteDriverPreference).Methods("DELETE")
+
+	// File routes. /storage serves signed links when files are on local disk.
+	api.HandleFunc("/files", server.files.handleGetFiles).Methods("GET")
+	api.HandleFunc("/files", server.files.handleUploadFile).Methods("POST")
+	api.HandleFunc("/files/{id}", server.files.handleGetFile).Methods("GET")
+	api.HandleFunc("/files/{id}", server.files.handleDeleteFile).Methods("DELETE")
+	api.HandleFunc("/storage/{key:.+}", server.files.handleServeStoredFile).Methods("GET")
+
+	// Account routes
+	api.HandleFunc("/account/history", server.accountHistory.handleGetAccountHistory).Methods("GET")
+	api.HandleFunc("/account/permissions", server.roles.handleGetMyPermissions).Methods("GET")
+	api.HandleFunc("/account/deactivate", server.deactivation.handleDeactivateAccount).Methods("POST")
+	api.HandleFunc("/account/reactivate", server.deactivation.handleReactivateAccount).Methods("POST")
+	api.HandleFunc("/account/push-devices", server.pushDevices.handleRegisterDevice).Methods("POST")
+	api.HandleFunc("/account/push-devices/{token}", server.pushDevices.handleUnregisterDevice).Methods("DELETE")
+	api.HandleFunc("/account/push-preferences", server.pushDevices.handleGetPushPreferences).Methods("GET")
+	api.HandleFunc("/account/push-preferences", server.pushDevices.handleUpdatePushPreferences).Methods("PUT")
+	api.HandleFunc("/account/blocks", server.blocklist.handleGetMyBlocks).Methods("GET")
+	api.HandleFunc("/account/blocks/{id}/appeal", server.blocklist.handleAppealBlock).Methods("POST")
+	api.HandleFunc("/account/instruction-templates", server.instructions.handleGetInstructionTemplates).Methods("GET")
+	api.HandleFunc("/account/instruction-templates", server.instructions.handleCreateInstructionTemplate).Methods("POST")
+	api.HandleFunc("/account/instruction-templates/{id}", server.instructions.handleUpdateInstructionTemplate).Methods("PUT", "PATCH")
+	api.HandleFunc("/account/instruction-templates/{id}", server.instructions.handleDeleteInstructionTemplate).Methods("DELETE")
+
+	// Household routes
+	api.HandleFunc("/households/mine", server.households.handleGetHousehold).Methods("GET")
+	api.HandleFunc("/households/invite", server.households.handleInviteMember).Methods("POST")
+	api.HandleFunc("/households/accept", server.households.handleAcceptInvite).Methods("POST")
+	api.HandleFunc("/households/members/{id}", server.households.handleUpdateMember).Methods("PUT", "PATCH")
+	api.HandleFunc("/households/members/{id}", server.households.handleRemoveMember).Methods("DELETE")
 
 	// Service routes
 	api.HandleFunc("/services", server.services.handleGetServices)
-
-	// Admin routes (all require admin role)
-	api.HandleFunc("/admin/users", server.admin.requireAdmin(server.admin.handleGetUsers)).Methods("GET")
-	api.HandleFunc("/admin/users", server.admin.requireAdmin(server.admin.handleCreateUser)).Methods("POST")
-	api.HandleFunc("/admin/users/{id}", server.admin.requireAdmin(server.admin.handleUpdateUser)).Methods("PUT")
-	api.HandleFunc("/admin/users/{id}", server.admin.requireAdmin(server.admin.handleDeleteUser)).Methods("DELETE")
-	api.HandleFunc("/admin/users/{id}/role", server.admin.requireAdmin(server.admin.handleUpdateUserRole))
-	api.HandleFunc("/admin/users/{id}/status", server.admin.requireAdmin(server.admin.handleUpdateUserStatus)).Methods("POST")
-	api.HandleFunc("/admin/orders/summary", server.admin.requireAdmin(server.admin.handleGetOrdersSummary))
-	api.HandleFunc("/admin/orders", server.admin.requireAdmin(server.admin.handleGetAllOrders))
-	api.HandleFunc("/admin/analytics/revenue", server.admin.requireAdmin(server.admin.handleGetRevenueAnalytics))
-	api.HandleFunc("/admin/drivers/stats", server.admin.requireAdmin(server.admin.handleGetDriverStats))
-	api.HandleFunc("/admin/routes/assign", server.admin.requireAdmin(server.admin.handleAssignDriverToRoute))
-	api.HandleFunc("/admin/orders/bulk-status", server.admin.requireAdmin(server.admin.handleBulkOrderStatusUpdate))
-	api.HandleFunc("/admin/routes/optimization-suggestions", server.admin.requireAdmin(server.admin.handleGetRouteOptimizationSuggestions))
-	api.HandleFunc("/admin/orders/resolution", server.admin.requireAdmin(server.admin.handleCreateOrderResolution)).Methods("POST")
-	api.HandleFunc("/admin/orders/{orderId}/resolutions", server.admin.requireAdmin(server.admin.handleGetOrderResolutions)).Methods("GET")
+	api.HandleFunc("/market", server.markets.handleGetMyMarket).Methods("GET")
+	api.HandleFunc("/garment-types", server.garments.handleGetGarmentTypes).Methods("GET")
+	api.HandleFunc("/add-ons", server.addOns.handleGetAddOns).Methods("GET")
+	api.HandleFunc("/add-ons/quote", server.addOns.handleQuoteAddOns).Methods("POST")
+
+	// Pickup reminder links (token authenticated)
+	api.HandleFunc("/pickup-slots", server.pickupSlots.handleGetPickupSlots).Methods("GET")
+	api.HandleFunc("/pickup-slots/reserve", server.pickupSlots.handleReserveSlot).Methods("POST")
+	api.HandleFunc("/pickup-slots/reservations/{token}", server.pickupSlots.handleReleaseSlot).Methods("DELETE")
+	api.HandleFunc("/availability", server.pickupSlots.handleGetAvailability).Methods("GET")
+	api.HandleFunc("/pickup-reminders/{token}", server.pickupReminders.handleGetPickupReminder).Methods("GET")
+	api.HandleFunc("/pickup-reminders/{token}/confirm", server.pickupReminders.handleConfirmPickup).Methods("POST")
+	api.HandleFunc("/pickup-reminders/{token}/reschedule", server.pickupReminders.handleReschedulePickup).Methods("POST")
+
+	// Metadata routes
+	api.HandleFunc("/meta/order-statuses", server.handleGetOrderStatuses).Methods("GET")
+	api.HandleFunc("/schemas", server.handleGetEventSchemas).Methods("GET")
+	api.HandleFunc("/schemas/{event}", server.handleGetEventSchema).Methods("GET")
+
+	// Admin routes, each gated on a permission. The admin role holds them all;
+	// custom staff roles hold the ones granted to them. Only admins manage roles.
+	api.HandleFunc("/admin/audit-log", server.admin.requirePermission("audit.read", server.admin.handleGetAuditLog)).Methods("GET")
+	api.HandleFunc("/admin/permissions", server.admin.requireAdmin(server.roles.handleGetPermissions)).Methods("GET")
+	api.HandleFunc("/admin/roles", server.admin.requireAdmin(server.roles.handleGetRoles)).Methods("GET")
+	api.HandleFunc("/admin/roles", server.admin.requireAdmin(server.roles.handleCreateRole)).Methods("POST")
+	api.HandleFunc("/admin/roles/{name}", server.admin.requireAdmin(server.roles.handleUpdateRole)).Methods("PUT")
+	api.HandleFunc("/admin/roles/{name}", server.admin.requireAdmin(server.roles.handleDeleteRole)).Methods("DELETE")
+	api.HandleFunc("/admin/users", server.admin.requirePermission("users.read", server.admin.handleGetUsers)).Methods("GET")
+	api.HandleFunc("/admin/users", server.admin.requirePermission("users.manage", server.admin.handleCreateUser)).Methods("POST")
+	api.HandleFunc("/admin/users/{id}", server.admin.requirePermission("users.manage", server.admin.handleUpdateUser)).Methods("PUT")
+	api.HandleFunc("/admin/users/{id}", server.admin.requirePermission("users.manage", server.admin.handleDeleteUser)).Methods("DELETE")
+	api.HandleFunc("/admin/users/{id}/role", server.admin.requirePermission("users.manage", server.admin.handleUpdateUserRole))
+	api.HandleFunc("/admin/users/{id}/timeline", server.admin.requirePermission("users.read", server.admin.handleGetCustomerTimeline)).Methods("GET")
+	api.HandleFunc("/admin/users/{id}/history", server.admin.requirePermission("users.read", server.accountHistory.handleAdminGetUserHistory)).Methods("GET")
+	api.HandleFunc("/admin/users/{id}/status", server.admin.requirePermission("users.manage", server.admin.handleUpdateUserStatus)).Methods("POST")
+	api.HandleFunc("/admin/users/{id}/sandbox", server.admin.requirePermission("users.manage", server.admin.handleSetUserSandbox)).Methods("PUT")
+	api.HandleFunc("/admin/users/{id}/legal-hold", server.admin.requirePermission("legal.manage", server.legalHolds.handlePlaceLegalHold)).Methods("POST")
+	api.HandleFunc("/admin/users/{id}/legal-hold", server.admin.requirePermission("legal.manage", server.legalHolds.handleReleaseLegalHold)).Methods("DELETE")
+	api.HandleFunc("/admin/users/{id}/legal-hold/audit", server.admin.requirePermission("legal.manage", server.legalHolds.handleGetLegalHoldAudit)).Methods("GET")
+	api.HandleFunc("/admin/users/{id}/legal-export", server.admin.requirePermission("legal.manage", server.legalHolds.handleExportAccount)).Methods("GET")
+	api.HandleFunc("/admin/legal-holds", server.admin.requirePermission("legal.manage", server.legalHolds.handleGetLegalHolds)).Methods("GET")
+	api.HandleFunc("/admin/safety-reports", server.admin.requirePermission("safety.manage", server.safetyReports.handleGetSafetyReports)).Methods("GET")
+	api.HandleFunc("/admin/safety-reports/{id}/review", server.admin.requirePermission("safety.manage", server.safetyReports.handleReviewSafetyReport)).Methods("POST")
+	api.HandleFunc("/admin/blocklist", server.admin.requirePermission("safety.manage", server.blocklist.handleGetBlocklist)).Methods("GET")
+	api.HandleFunc("/admin/blocklist", server.admin.requirePermission("safety.manage", server.blocklist.handleCreateBlock)).Methods("POST")
+	api.HandleFunc("/admin/blocklist/appeals", server.admin.requirePermission("safety.manage", server.blocklist.handleGetAppeals)).Methods("GET")
+	api.HandleFunc("/admin/blocklist/appeals/{id}", server.admin.requirePermission("safety.manage", server.blocklist.handleDecideAppeal)).Methods("POST")
+	api.HandleFunc("/admin/blocklist/{id}/lift", server.admin.requirePermission("safety.manage", server.blocklist.handleLiftBlock)).Methods("POST")
+	api.HandleFunc("/admin/users/{id}/sessions", server.admin.requirePermission("users.manage", server.auth.handleAdminRevokeSessions)).Methods("DELETE")
+	api.HandleFunc("/admin/users/{id}/credits", server.admin.requirePermission("payments.read", server.credits.handleAdminGetCredits)).Methods("GET")
+	api.HandleFunc("/admin/users/{id}/credits", server.admin.requirePermission("payments.manage", server.credits.handleAdminAdjustCredits)).Methods("POST")
+	api.HandleFunc("/admin/users/{id}/delivery-signature", server.admin.requirePermission("users.manage", server.admin.handleSetSignatureRequirement)).Methods("PUT")
+	api.HandleFunc("/admin/orders/summary", server.admin.requirePermission("orders.read", server.admin.handleGetOrdersSummary))
+	api.HandleFunc("/admin/orders/reviews", server.admin.requirePermission("orders.read", server.orders.handleGetOrderReviews)).Methods("GET")
+	api.HandleFunc("/admin/orders/{id}/review/approve", server.admin.requirePermission("orders.manage", server.orders.handleApproveOrderReview)).Methods("POST")
+	api.HandleFunc("/admin/orders/{id}/review/reject", server.admin.requirePermission("orders.manage", server.orders.handleRejectOrderReview)).Methods("POST")
+	api.HandleFunc("/admin/orders/feed", server.admin.requirePermission("orders.read", server.orderFeed.handleGetOrderFeed)).Methods("GET")
+	api.HandleFunc("/admin/orders", server.admin.requirePermission("orders.read", server.admin.handleGetAllOrders))
+	api.HandleFunc("/admin/analytics/revenue", server.admin.requirePermission("payments.read", server.admin.handleGetRevenueAnalytics))
+	api.HandleFunc("/admin/analytics/trials", server.admin.requirePermission("payments.read", server.planOffers.handleGetTrialAnalytics)).Methods("GET")
+	api.HandleFunc("/admin/analytics/markets", server.admin.requirePermission("payments.read", server.inviteCodes.handleGetMarketAnalytics)).Methods("GET")
+	api.HandleFunc("/admin/analytics/margins", server.admin.requirePermission("payments.read", server.costs.handleGetMargins)).Methods("GET")
+	api.HandleFunc("/admin/analytics/realtime-deliveries", server.admin.requirePermission("orders.read", server.admin.handleGetRealtimeDeliveryStats)).Methods("GET")
+	api.HandleFunc("/admin/analytics/realtime-publish-failures", server.admin.requirePermission("orders.read", server.realtime.retries.handleGetRealtimeRetryStats)).Methods("GET")
+	api.HandleFunc("/admin/costs/rates", server.admin.requirePermission("payments.read", server.costs.handleGetCostRates)).Methods("GET")
+	api.HandleFunc("/admin/costs/rates/{name}", server.admin.requirePermission("payments.manage", server.costs.handleUpdateCostRate)).Methods("PUT", "PATCH")
+	api.HandleFunc("/admin/drivers/stats", server.admin.requirePermission("drivers.read", server.admin.handleGetDriverStats))
+	api.HandleFunc("/admin/reviews", server.admin.requirePermission("drivers.read", server.admin.handleListReviews)).Methods("GET")
+	api.HandleFunc("/admin/reviews/{id}/moderation", server.admin.requirePermission("drivers.manage", server.admin.handleModerateReview)).Methods("PUT")
+	api.HandleFunc("/admin/drivers/leaderboard", server.admin.requirePermission("drivers.read", server.scorecards.handleGetLeaderboard)).Methods("GET")
+	api.HandleFunc("/admin/drivers/onboarding", server.admin.requirePermission("drivers.read", server.onboarding.handleGetOnboardingDashboard)).Methods("GET")
+	api.HandleFunc("/admin/drivers/preferences", server.admin.requirePermission("drivers.read", server.admin.handleGetDriverPreferenceStats)).Methods("GET")
+	api.HandleFunc("/admin/drivers/{id}/home-base", server.admin.requirePermission("drivers.manage", server.admin.handleSetDriverHomeBase)).Methods("PUT")
+	api.HandleFunc("/admin/drivers/{id}/capacity", server.admin.requirePermission("drivers.manage", server.admin.handleSetDriverCapacity)).Methods("PUT")
+	api.HandleFunc("/admin/drivers/{id}/market", server.admin.requirePermission("drivers.manage", server.markets.handleSetDriverMarket)).Methods("PUT")
+	api.HandleFunc("/admin/drivers/{id}/onboarding", server.admin.requirePermission("drivers.read", server.onboarding.handleGetDriverOnboarding)).Methods("GET")
+	api.HandleFunc("/admin/drivers/{id}/onboarding/{step}/complete", server.admin.requirePermission("drivers.manage", server.onboarding.handleCompleteDriverOnboardingStep)).Methods("POST")
+	api.HandleFunc("/admin/drivers/{id}/onboarding/{step}", server.admin.requirePermission("drivers.manage", server.onboarding.handleResetDriverOnboardingStep)).Methods("DELETE")
+	api.HandleFunc("/admin/subscription-plans/{id}/offer", server.admin.requirePermission("payments.manage", server.planOffers.handleUpdatePlanOffer)).Methods("PUT")
+	api.HandleFunc("/admin/subscription-plans/{id}/market", server.admin.requirePermission("payments.manage", server.markets.handleSetPlanMarket)).Methods("PUT")
+	api.HandleFunc("/admin/plan-migrations", server.admin.requirePermission("payments.read", server.planMigrations.handleGetPlanMigrations)).Methods("GET")
+	api.HandleFunc("/admin/plan-migrations", server.admin.requirePermission("payments.manage", server.planMigrations.handleCreatePlanMigration)).Methods("POST")
+	api.HandleFunc("/admin/plan-migrations/{id}/cancel", server.admin.requirePermission("payments.manage", server.planMigrations.handleCancelPlanMigration)).Methods("POST")
+	api.HandleFunc("/admin/subscriptions/bulk-adjustments", server.admin.requirePermission("payments.read", server.adjustments.handleGetBulkAdjustments)).Methods("GET")
+	api.HandleFunc("/admin/subscriptions/bulk-adjustments", server.admin.requirePermission("payments.manage", server.adjustments.handleApplyBulkAdjustment)).Methods("POST")
+	api.HandleFunc("/admin/subscriptions/bulk-adjustments/preview", server.admin.requirePermission("payments.manage", server.adjustments.handlePreviewBulkAdjustment)).Methods("POST")
+	api.HandleFunc("/admin/subscriptions/bulk-adjustments/{id}", server.admin.requirePermission("payments.read", server.adjustments.handleGetBulkAdjustment)).Methods("GET")
+	api.HandleFunc("/admin/finance/reconciliation", server.admin.requirePermission("payments.read", server.reconciliation.handleGetReconciliation)).Methods("GET")
+	api.HandleFunc("/admin/ledger/transactions", server.admin.requirePermission("payments.read", server.ledger.handleGetLedgerTransactions)).Methods("GET")
+	api.HandleFunc("/admin/ledger/balances", server.admin.requirePermission("payments.read", server.ledger.handleGetLedgerBalances)).Methods("GET")
+	api.HandleFunc("/admin/ledger/check", server.admin.requirePermission("payments.read", server.ledger.handleCheckLedger)).Methods("GET")
+	api.HandleFunc("/admin/driver-payouts", server.admin.requirePermission("payments.read", server.driverPayouts.handleGetDriverPayouts)).Methods("GET")
+	api.HandleFunc("/admin/payments/webhook-events", server.admin.requirePermission("payments.read", server.payments.handleGetStripeWebhookEvents)).Methods("GET")
+	api.HandleFunc("/admin/payments/webhook-events/{id}/replay", server.admin.requirePermission("payments.manage", server.payments.handleReplayStripeWebhookEvent)).Methods("POST")
+	api.HandleFunc("/admin/driver-payouts/run", server.admin.requirePermission("payments.manage", server.driverPayouts.handleRunDriverPayouts)).Methods("POST")
+	api.HandleFunc("/admin/backups/verifications", server.admin.requirePermission("settings.manage", server.backups.handleGetBackupVerifications)).Methods("GET")
+	api.HandleFunc("/admin/backups/verify", server.admin.requirePermission("settings.manage", server.backups.handleRunBackupVerification)).Methods("POST")
+	api.HandleFunc("/admin/widget-keys", server.admin.requirePermission("settings.manage", server.widget.handleGetWidgetKeys)).Methods("GET")
+	api.HandleFunc("/admin/widget-keys", server.admin.requirePermission("settings.manage", server.widget.handleCreateWidgetKey)).Methods("POST")
+	api.HandleFunc("/admin/widget-keys/{id}", server.admin.requirePermission("settings.manage", server.widget.handleUpdateWidgetKey)).Methods("PUT")
+	api.HandleFunc("/admin/webhooks", server.admin.requirePermission("settings.manage", server.webhooks.handleGetWebhookEndpoints)).Methods("GET")
+	api.HandleFunc("/admin/webhooks", server.admin.requirePermission("settings.manage", server.webhooks.handleCreateWebhookEndpoint)).Methods("POST")
+	api.HandleFunc("/admin/webhooks/{id}", server.admin.requirePermission("settings.manage", server.webhooks.handleUpdateWebhookEndpoint)).Methods("PUT")
+	api.HandleFunc("/admin/webhooks/{id}", server.admin.requirePermission("settings.manage", server.webhooks.handleDeleteWebhookEndpoint)).Methods("DELETE")
+	api.HandleFunc("/admin/webhooks/{id}/deliveries", server.admin.requirePermission("settings.manage", server.webhooks.handleGetWebhookDeliveries)).Methods("GET")
+	api.HandleFunc("/admin/add-ons", server.admin.requirePermission("settings.manage", server.addOns.handleAdminGetAddOns)).Methods("GET")
+	api.HandleFunc("/admin/add-ons", server.admin.requirePermission("settings.manage", server.addOns.handleAdminCreateAddOn)).Methods("POST")
+	api.HandleFunc("/admin/add-ons/{id}", server.admin.requirePermission("settings.manage", server.addOns.handleAdminUpdateAddOn)).Methods("PUT")
+	api.HandleFunc("/admin/add-ons/{id}", server.admin.requirePermission("settings.manage", server.addOns.handleAdminDeleteAddOn)).Methods("DELETE")
+	api.HandleFunc("/admin/slot-pricing", server.admin.requirePermission("settings.manage", server.slotPricing.handleGetSlotPriceRules)).Methods("GET")
+	api.HandleFunc("/admin/slot-pricing", server.admin.requirePermission("settings.manage", server.slotPricing.handleCreateSlotPriceRule)).Methods("POST")
+	api.HandleFunc("/admin/slot-pricing/{id}", server.admin.requirePermission("settings.manage", server.slotPricing.handleUpdateSlotPriceRule)).Methods("PUT")
+	api.HandleFunc("/admin/slot-pricing/{id}", server.admin.requirePermission("settings.manage", server.slotPricing.handleDeleteSlotPriceRule)).Methods("DELETE")
+	api.HandleFunc("/admin/slot-capacities", server.admin.requirePermission("settings.manage", server.slotCapacity.handleGetSlotCapacities)).Methods("GET")
+	api.HandleFunc("/admin/slot-capacities", server.admin.requirePermission("settings.manage", server.slotCapacity.handleCreateSlotCapacity)).Methods("POST")
+	api.HandleFunc("/admin/slot-capacities/{id}", server.admin.requirePermission("settings.manage", server.slotCapacity.handleUpdateSlotCapacity)).Methods("PUT")
+	api.HandleFunc("/admin/slot-capacities/{id}", server.admin.requirePermission("settings.manage", server.slotCapacity.handleDeleteSlotCapacity)).Methods("DELETE")
+	api.HandleFunc("/admin/service-zones", server.admin.requirePermission("settings.manage", server.serviceAreas.handleGetServiceZones)).Methods("GET")
+	api.HandleFunc("/admin/service-zones", server.admin.requirePermission("settings.manage", server.serviceAreas.handleCreateServiceZone)).Methods("POST")
+	api.HandleFunc("/admin/service-zones/{id}", server.admin.requirePermission("settings.manage", server.serviceAreas.handleUpdateServiceZone)).Methods("PUT")
+	api.HandleFunc("/admin/service-zones/{id}", server.admin.requirePermission("settings.manage", server.serviceAreas.handleDeleteServiceZone)).Methods("DELETE")
+	api.HandleFunc("/admin/service-areas", server.admin.requirePermission("settings.manage", server.serviceAreas.handleGetServiceAreas)).Methods("GET")
+	api.HandleFunc("/admin/service-areas", server.admin.requirePermission("settings.manage", server.serviceAreas.handleSetServiceAreas)).Methods("POST")
+	api.HandleFunc("/admin/service-areas/waitlist", server.admin.requirePermission("settings.manage", server.serviceAreas.handleGetWaitlist)).Methods("GET")
+	api.HandleFunc("/admin/service-areas/{zip}", server.admin.requirePermission("settings.manage", server.serviceAreas.handleDeleteServiceArea)).Methods("DELETE")
+	api.HandleFunc("/admin/pickup-locations", server.admin.requirePermission("settings.manage", server.pickupLocations.handleAdminGetPickupLocations)).Methods("GET")
+	api.HandleFunc("/admin/pickup-locations", server.admin.requirePermission("settings.manage", server.pickupLocations.handleAdminCreatePickupLocation)).Methods("POST")
+	api.HandleFunc("/admin/pickup-locations/{id}", server.admin.requirePermission("settings.manage", server.pickupLocations.handleAdminUpdatePickupLocation)).Methods("PUT")
+	api.HandleFunc("/admin/pickup-locations/{id}", server.admin.requirePermission("settings.manage", server.pickupLocations.handleAdminDeletePickupLocation)).Methods("DELETE")
+	api.HandleFunc("/admin/pickup-locations/{id}/collect", server.admin.requirePermission("orders.manage", server.pickupLocations.handleCollectLocker)).Methods("POST")
+	api.HandleFunc("/admin/bag-pricing", server.admin.requirePermission("settings.manage", server.bagPricing.handleGetBagPricing)).Methods("GET")
+	api.HandleFunc("/admin/bag-pricing", server.admin.requirePermission("settings.manage", server.bagPricing.handleCreateBagPricing)).Methods("POST")
+	api.HandleFunc("/admin/bag-pricing/{id}", server.admin.requirePermission("settings.manage", server.bagPricing.handleUpdateBagPricing)).Methods("PUT")
+	api.HandleFunc("/admin/bag-pricing/{id}", server.admin.requirePermission("settings.manage", server.bagPricing.handleDeleteBagPricing)).Methods("DELETE")
+	api.HandleFunc("/admin/recovery/intake-pauses", server.admin.requirePermission("recovery.manage", server.recovery.handleGetIntakePauses)).Methods("GET")
+	api.HandleFunc("/admin/recovery/intake-pauses", server.admin.requirePermission("recovery.manage", server.recovery.handlePauseIntake)).Methods("POST")
+	api.HandleFunc("/admin/recovery/intake-pauses/{id}/resume", server.admin.requirePermission("recovery.manage", server.recovery.handleResumeIntake)).Methods("POST")
+	api.HandleFunc("/admin/recovery/markets/{market}/drain", server.admin.requirePermission("recovery.manage", server.recovery.handleDrainMarket)).Methods("POST")
+	api.HandleFunc("/admin/recovery/redrive", server.admin.requirePermission("recovery.manage", server.recovery.handleRedriveQueues)).Methods("POST")
+	api.HandleFunc("/admin/recovery/snapshots", server.admin.requirePermission("recovery.manage", server.recovery.handleGetIncidentSnapshots)).Methods("GET")
+	api.HandleFunc("/admin/recovery/snapshots", server.admin.requirePermission("recovery.manage", server.recovery.handleCreateIncidentSnapshot)).Methods("POST")
+	api.HandleFunc("/admin/recovery/snapshots/{id}", server.admin.requirePermission("recovery.manage", server.recovery.handleGetIncidentSnapshot)).Methods("GET")
+	api.HandleFunc("/admin/facility/bags", server.admin.requirePermission("facility.manage", server.facility.handleGetFacilityBags)).Methods("GET")
+	api.HandleFunc("/admin/facility/intake", server.admin.requirePermission("facility.manage", server.facility.handleScanBagIntake)).Methods("POST")
+	api.HandleFunc("/admin/facility/bags/{code}/stage", server.admin.requirePermission("facility.manage", server.facility.handleUpdateBagStage)).Methods("PUT")
+	api.HandleFunc("/admin/facility/bags/{code}/weight", server.admin.requirePermission("facility.manage", server.facility.handleRecordFacilityWeight)).Methods("PUT")
+	api.HandleFunc("/admin/facility/orders/{id}/ready", server.admin.requirePermission("facility.manage", server.facility.handleMarkOrderReady)).Methods("POST")
+	api.HandleFunc("/admin/markets", server.admin.requirePermission("settings.manage", server.markets.handleGetMarkets)).Methods("GET")
+	api.HandleFunc("/admin/markets", server.admin.requirePermission("settings.manage", server.markets.handleCreateMarket)).Methods("POST")
+	api.HandleFunc("/admin/markets/{id}", server.admin.requirePermission("settings.manage", server.markets.handleUpdateMarket)).Methods("PUT")
+	api.HandleFunc("/admin/services/{id}/market", server.admin.requirePermission("settings.manage", server.markets.handleSetServiceMarket)).Methods("PUT")
+	api.HandleFunc("/admin/launch-markets", server.admin.requirePermission("settings.manage", server.inviteCodes.handleGetLaunchMarkets)).Methods("GET")
+	api.HandleFunc("/admin/launch-markets/{market}", server.admin.requirePermission("settings.manage", server.inviteCodes.handleSetLaunchMarket)).Methods("PUT")
+	api.HandleFunc("/admin/launch-markets/{market}", server.admin.requirePermission("settings.manage", server.inviteCodes.handleDeleteLaunchMarket)).Methods("DELETE")
+	api.HandleFunc("/admin/invite-codes", server.admin.requirePermission("settings.manage", server.inviteCodes.handleGetInviteCodes)).Methods("GET")
+	api.HandleFunc("/admin/invite-codes", server.admin.requirePermission("settings.manage", server.inviteCodes.handleCreateInviteCodes)).Methods("POST")
+	api.HandleFunc("/admin/invite-codes/{id}", server.admin.requirePermission("settings.manage", server.inviteCodes.handleUpdateInviteCode)).Methods("PUT")
+	api.HandleFunc("/admin/invite-codes/{id}/users", server.admin.requirePermission("settings.manage", server.inviteCodes.handleGetInviteCodeUsers)).Methods("GET")
+	api.HandleFunc("/admin/inbox", server.admin.requirePermission("inbox.read", server.adminInbox.handleGetInbox)).Methods("GET")
+	api.HandleFunc("/admin/inbox/counts", server.admin.requirePermission("inbox.read", server.adminInbox.handleGetInboxCounts)).Methods("GET")
+	api.HandleFunc("/admin/inbox/read", server.admin.requirePermission("inbox.manage", server.adminInbox.handleMarkInboxRead)).Methods("POST")
+	api.HandleFunc("/admin/inbox/{id}/read", server.admin.requirePermission("inbox.manage", server.adminInbox.handleMarkInboxRead)).Methods("POST")
+	api.HandleFunc("/admin/inbox/{id}/assign", server.admin.requirePermission("inbox.manage", server.adminInbox.handleAssignInboxItem)).Methods("PUT")
+	api.HandleFunc("/admin/inbox/{id}/acknowledge", server.admin.requirePermission("inbox.manage", server.adminInbox.handleAcknowledgeInboxItem)).Methods("POST")
+	api.HandleFunc("/admin/inbox/{id}/resolve", server.admin.requirePermission("inbox.manage", server.adminInbox.handleResolveInboxItem)).Methods("POST")
+	api.HandleFunc("/admin/retention/policies", server.admin.requirePermission("settings.manage", server.retention.handleGetRetentionPolicies)).Methods("GET")
+	api.HandleFunc("/admin/retention/policies/{name}", server.admin.requirePermission("settings.manage", server.retention.handleUpdateRetentionPolicy)).Methods("PUT", "PATCH")
+	api.HandleFunc("/admin/retention/run", server.admin.requirePermission("settings.manage", server.retention.handleRunRetentionPurge)).Methods("POST")
+	api.HandleFunc("/admin/retention/report", server.admin.requirePermission("settings.manage", server.retention.handleGetRetentionReport)).Methods("GET")
+	api.HandleFunc("/admin/sandbox/purge", server.admin.requirePermission("settings.manage", server.admin.handlePurgeSandboxData)).Methods("POST")
+	api.HandleFunc("/admin/dispatch/pickup-confirmations", server.admin.requirePermission("routes.read", server.pickupReminders.handleGetPickupConfirmations)).Methods("GET")
+	api.HandleFunc("/admin/routes/board", server.admin.requirePermission("routes.read", server.driverHeartbeats.handleGetRouteBoard)).Methods("GET")
+	api.HandleFunc("/admin/drivers/locations", server.admin.requirePermission("routes.read", server.driverLocations.handleGetActiveDriverLocations)).Methods("GET")
+	api.HandleFunc("/admin/routes/{id}/manifest.pdf", server.admin.requirePermission("routes.read", server.manifests.handleGetRouteManifest)).Methods("GET")
+	api.HandleFunc("/admin/routes/{id}/closeout", server.admin.requirePermission("routes.read", server.manifests.handleGetRouteCloseout)).Methods("GET")
+	api.HandleFunc("/admin/routes/{id}/closeout.pdf", server.admin.requirePermission("routes.read", server.manifests.handleGetRouteCloseoutPDF)).Methods("GET")
+	api.HandleFunc("/admin/routes/assign", server.admin.requirePermission("routes.assign", server.admin.handleAssignDriverToRoute))
+	api.HandleFunc("/admin/routes/break-compliance", server.admin.requirePermission("routes.read", server.routeBreaks.handleGetBreakCompliance)).Methods("GET")
+	api.HandleFunc("/admin/routes/{id}/schedule", server.admin.requirePermission("routes.read", server.routeBreaks.handleGetRouteSchedule)).Methods("GET")
+	api.HandleFunc("/admin/routes/{id}/schedule", server.admin.requirePermission("routes.assign", server.routeBreaks.handleScheduleRoute)).Methods("POST")
+	api.HandleFunc("/admin/routes/{id}/sequence", server.admin.requirePermission("routes.assign", server.admin.handleResequenceRoute)).Methods("PUT")
+	api.HandleFunc("/admin/routes/{id}/driver", server.admin.requirePermission("routes.assign", server.admin.handleReassignRoute)).Methods("PUT")
+	api.HandleFunc("/admin/routes/{id}/breaks", server.admin.requirePermission("routes.assign", server.routeBreaks.handleAddRouteBreak)).Methods("POST")
+	api.HandleFunc("/admin/routes/{id}/breaks/{breakId}", server.admin.requirePermission("routes.assign", server.routeBreaks.handleDeleteRouteBreak)).Methods("DELETE")
+	api.HandleFunc("/admin/break-policies", server.admin.requirePermission("routes.read", server.routeBreaks.handleGetBreakPolicies)).Methods("GET")
+	api.HandleFunc("/admin/break-policies/{jurisdiction}", server.admin.requirePermission("routes.assign", server.routeBreaks.handleSetBreakPolicy)).Methods("PUT")
+	api.HandleFunc("/admin/orders/{id}/proof-of-delivery", server.admin.requirePermission("orders.read", server.proofOfDelivery.handleAdminGetProofOfDelivery)).Methods("GET")
+	api.HandleFunc("/admin/stop-photos/flagged", server.admin.requirePermission("drivers.read", server.proofOfDelivery.handleGetFlaggedStopPhotos)).Methods("GET")
+	api.HandleFunc("/admin/orders/{id}/messages", server.admin.requirePermission("orders.read", server.orderChat.handleAdminGetOrderMessages)).Methods("GET")
+	api.HandleFunc("/admin/orders/{id}/messages", server.admin.requirePermission("orders.manage", server.orderChat.handleAdminSendOrderMessage)).Methods("POST")
+	api.HandleFunc("/admin/orders/{id}/messages/read", server.admin.requirePermission("orders.read", server.orderChat.handleAdminMarkOrderMessagesRead)).Methods("POST")
+	api.HandleFunc("/admin/conversations", server.admin.requirePermission("orders.read", server.orderChat.handleListConversations)).Methods("GET")
+	api.HandleFunc("/admin/orders/{id}/address-history", server.admin.requirePermission("orders.read", server.accountHistory.handleAdminGetOrderAddressHistory)).Methods("GET")
+	api.HandleFunc("/admin/orders/{id}/garments/check-in", server.admin.requirePermission("orders.manage", server.garments.handleCheckInGarments)).Methods("POST")
+	api.HandleFunc("/admin/orders/{id}/garments/{garmentId}/damage", server.admin.requirePermission("orders.manage", server.itemEvents.handleFlagDamagedItems)).Methods("POST")
+	api.HandleFunc("/admin/orders/{id}/garments/{garmentId}/substitute", server.admin.requirePermission("orders.manage", server.itemEvents.handleSubstituteItem)).Methods("POST")
+	api.HandleFunc("/admin/orders/{id}/item-events", server.admin.requirePermission("orders.read", server.itemEvents.handleGetOrderItemEvents)).Methods("GET")
+	api.HandleFunc("/admin/orders/integrity", server.admin.requirePermission("orders.read", server.integrity.handleGetOrderIntegrity)).Methods("GET")
+	api.HandleFunc("/admin/orders/integrity/fix", server.admin.requirePermission("orders.manage", server.integrity.handleFixOrderIntegrity)).Methods("POST")
+	api.HandleFunc("/admin/orders/bulk-status", server.admin.requirePermission("orders.manage", server.admin.handleBulkOrderStatusUpdate))
+	api.HandleFunc("/admin/batch", server.admin.requirePermission("orders.manage", server.admin.handleAdminBatch)).Methods("POST")
+	api.HandleFunc("/admin/addresses/geocode-backfill", server.admin.requirePermission("routes.assign", server.admin.handleRunGeocodeBackfill)).Methods("POST")
+	api.HandleFunc("/admin/addresses/geocode-drift", server.admin.requirePermission("routes.read", server.admin.handleGetGeocodeDrifts)).Methods("GET")
+	api.HandleFunc("/admin/addresses/geocode-drift/{id}/review", server.admin.requirePermission("routes.assign", server.admin.handleReviewGeocodeDrift)).Methods("POST")
+	api.HandleFunc("/admin/weather/advisories", server.admin.requirePermission("routes.read", server.admin.handleGetWeatherAdvisories)).Methods("GET")
+	api.HandleFunc("/admin/weather/advisories/{id}/reschedule", server.admin.requirePermission("routes.assign", server.admin.handleRescheduleWeatherRoutes)).Methods("POST")
+	api.HandleFunc("/admin/routes/optimization-suggestions", server.admin.requirePermission("routes.read", server.admin.handleGetRouteOptimizationSuggestions))
+	api.HandleFunc("/admin/orders/resolution", server.admin.requirePermission("orders.manage", server.admin.handleCreateOrderResolution)).Methods("POST")
+	api.HandleFunc("/admin/orders/{orderId}/resolutions", server.admin.requirePermission("orders.read", server.admin.handleGetOrderResolutions)).Methods("GET")
+	api.HandleFunc("/admin/orders/{id}/refunds", server.admin.requirePermission("payments.read", server.admin.handleGetOrderRefunds)).Methods("GET")
+	api.HandleFunc("/admin/orders/{id}/refunds", server.admin.requirePermission("payments.manage", server.admin.handleCreateRefund)).Methods("POST")
+	// After the fixed /admin/orders/... paths so {id} doesn't swallow them
+	api.HandleFunc("/admin/orders/{id}", server.admin.requirePermission("orders.read", server.admin.handleGetAdminOrder)).Methods("GET")
 
 	// Payment routes
 	api.HandleFunc("/payments/setup-intent", server.payments.handleCreateSetupIntent)
@@ -167,6 +609,7 @@ func main() {
 	api.HandleFunc("/payments/methods/default", server.payments.handleSetDefaultPaymentMethod)
 	api.HandleFunc("/payments/methods/{id}", server.payments.handleDeletePaymentMethod)
 	api.HandleFunc("/payments/subscription", server.payments.handleCreateSubscriptionPayment)
+	api.HandleFunc("/payments/credits", server.credits.handleGetCredits).Methods("GET")
 	api.HandleFunc("/payments/order", server.payments.handleCreateOrderPayment)
 	api.HandleFunc("/payments/payment-intent/{id}", server.payments.handleGetPaymentIntent)
 	api.HandleFunc("/payments/history", server.payments.handleGetPaymentHistory)
@@ -175,30 +618,62 @@ func main() {
 	// Driver application routes
 	api.HandleFunc("/driver-applications/submit", server.driverApps.handleSubmitDriverApplication)
 	api.HandleFunc("/driver-applications/mine", server.driverApps.handleGetUserApplication)
-	api.HandleFunc("/admin/driver-applications", server.driverApps.requireAdmin(server.driverApps.handleGetAllApplications))
-	api.HandleFunc("/admin/driver-applications/review", server.driverApps.requireAdmin(server.driverApps.handleReviewApplication))
+	api.HandleFunc("/admin/driver-applications", server.admin.requirePermission("drivers.read", server.driverApps.handleGetAllApplications))
+	api.HandleFunc("/admin/driver-applications/review", server.admin.requirePermission("drivers.manage", server.driverApps.handleReviewApplication))
 
 	// Driver route management routes
 	api.HandleFunc("/driver/routes", server.driverRoutes.requireDriver(server.driverRoutes.handleGetDriverRoutes))
 	api.HandleFunc("/driver/routes/start", server.driverRoutes.requireDriver(server.driverRoutes.handleStartRoute))
+	api.HandleFunc("/driver/routes/complete", server.driverRoutes.requireDriver(server.driverRoutes.handleCompleteRoute)).Methods("PUT")
+	api.HandleFunc("/driver/routes/{id}/close-out", server.driverRoutes.requireDriver(server.driverRoutes.handleCloseOutRoute)).Methods("POST")
+	api.HandleFunc("/driver/heartbeat", server.driverRoutes.requireDriver(server.driverHeartbeats.handleHeartbeat)).Methods("POST")
+	api.HandleFunc("/driver/location", server.driverRoutes.requireDriver(server.driverLocations.handleUpdateLocation)).Methods("POST")
 	api.HandleFunc("/driver/route-orders/status", server.driverRoutes.requireDriver(server.driverRoutes.handleUpdateRouteOrderStatus))
+	api.HandleFunc("/driver/safety-reports", server.driverRoutes.requireDriver(server.safetyReports.handleGetMySafetyReports)).Methods("GET")
+	api.HandleFunc("/driver/safety-reports", server.driverRoutes.requireDriver(server.safetyReports.handleCreateSafetyReport)).Methods("POST")
+	api.HandleFunc("/driver/route-orders/{id}/signature", server.driverRoutes.requireDriver(server.driverRoutes.handleCaptureSignature)).Methods("POST")
+	api.HandleFunc("/driver/route-orders/{id}/photos", server.driverRoutes.requireDriver(server.driverRoutes.handleUploadStopPhoto)).Methods("POST")
+	api.HandleFunc("/driver/route-orders/{id}/weights", server.driverRoutes.requireDriver(server.driverRoutes.handleRecordBagWeights)).Methods("PUT")
+	api.HandleFunc("/driver/route-orders/{id}/items", server.driverRoutes.requireDriver(server.itemEvents.handleAddPickupItems)).Methods("POST")
+	api.HandleFunc("/driver/routes/{id}/manifest", server.driverRoutes.requireDriver(server.manifests.handleGetDriverRouteManifest)).Methods("GET")
+	api.HandleFunc("/driver/routes/{id}/breaks/start", server.driverRoutes.requireDriver(server.routeBreaks.handleStartBreak)).Methods("POST")
+	api.HandleFunc("/driver/routes/{id}/breaks/end", server.driverRoutes.requireDriver(server.routeBreaks.handleEndBreak)).Methods("POST")
 
 	// Driver earnings routes
 	api.HandleFunc("/driver/earnings", server.driverEarnings.requireDriver(server.driverEarnings.handleGetDriverEarnings))
 	api.HandleFunc("/driver/earnings/history", server.driverEarnings.requireDriver(server.driverEarnings.handleGetDriverEarningsHistory))
+	api.HandleFunc("/driver/stats", server.driverEarnings.requireDriver(server.driverEarnings.handleGetDriverStats)).Methods("GET")
+	api.HandleFunc("/driver/reviews", server.driverEarnings.requireDriver(server.driverEarnings.handleGetDriverReviews)).Methods("GET")
+	api.HandleFunc("/driver/payouts/onboarding", server.driverEarnings.requireDriver(server.driverPayouts.handleStartPayoutOnboarding)).Methods("POST")
+	api.HandleFunc("/driver/payouts/account", server.driverEarnings.requireDriver(server.driverPayouts.handleGetPayoutAccount)).Methods("GET")
+
+	// Driver expense routes
+	api.HandleFunc("/driver/expenses", server.driverRoutes.requireDriver(server.driverExpenses.handleGetExpenses)).Methods("GET")
+	api.HandleFunc("/driver/expenses", server.driverRoutes.requireDriver(server.driverExpenses.handleCreateExpense)).Methods("POST")
+	api.HandleFunc("/driver/expenses/export", server.driverRoutes.requireDriver(server.driverExpenses.handleExportExpenses)).Methods("GET")
+	api.HandleFunc("/driver/expenses/{id}", server.driverRoutes.requireDriver(server.driverExpenses.handleDeleteExpense)).Methods("DELETE")
+	api.HandleFunc("/driver/expenses/{id}/receipt", server.driverRoutes.requireDriver(server.driverExpenses.handleUploadReceipt)).Methods("POST")
+	api.HandleFunc("/driver/expenses/{id}/receipt", server.driverRoutes.requireDriver(server.driverExpenses.handleGetReceipt)).Methods("GET")
+
+	// Driver scorecard routes
+	api.HandleFunc("/driver/scorecard", server.driverRoutes.requireDriver(server.scorecards.handleGetDriverScorecard)).Methods("GET")
+
+	// Driver onboarding checklist routes
+	api.HandleFunc("/driver/onboarding", server.driverRoutes.requireDriver(server.onboarding.handleGetMyOnboarding)).Methods("GET")
+	api.HandleFunc("/driver/onboarding/{step}/complete", server.driverRoutes.requireDriver(server.onboarding.handleCompleteMyOnboardingStep)).Methods("POST")
 
 	// Start Centrifuge node
 	if err := server.centNode.Run(); err != nil {
 		log.Fatalf("Failed to run Centrifuge node: %v", err)
 	}
 
-	port := os.Getenv("GO_BACKEND_PORT")
-	if port == "" {
-		port = "8082"
+	listenConfig, err := listenConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid listen configuration: %v", err)
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := http.ListenAndServe(":"+port, r); err != nil {
+	server.chaos.Start()
+	if err := serveHTTP(listenConfig, r); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
@@ -213,16 +688,30 @@ func (s *Server) initDB() error {
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		dbHost, dbPort, dbUser, dbPassword, dbName)
 
-	var err error
-	s.db, err = sql.Open("postgres", connStr)
-	if err != nil {
-		return err
-	}
+	s.db = sql.OpenDB(driverConnector{
+		dsn:    connStr,
+		driver: s.queryMetrics.sqlDriver(s.tracer.sqlDriver(s.chaos.sqlDriver(&pq.Driver{}))),
+	})
 
 	// Ping database to verify connection
 	return s.db.Ping()
 }
 
+// driverConnector opens connections to dsn with driver, so the database can
+// be opened through the metrics, tracing and chaos wrappers without registering them
+type driverConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c driverConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c driverConnector) Driver() driver.Driver {
+	return c.driver
+}
+
 func (s *Server) initRedis() error {
 	redisHost := os.Getenv("REDIS_HOST")
 	redisPort := os.Getenv("REDIS_PORT")
@@ -230,6 +719,8 @@ func (s *Server) initRedis() error {
 	s.redis = redis.NewClient(&redis.Options{
 		Addr: fmt.Sprintf("%s:%s", redisHost, redisPort),
 	})
+	s.tracer.instrumentRedis(s.redis)
+	s.chaos.instrumentRedis(s.redis)
 
 	// Ping Redis to verify connection
 	ctx := context.Background()
@@ -310,6 +801,51 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(health)
 }
 
+// ReadinessResponse tells the load balancer whether to send traffic. Only the
+// database is required; without Redis the server runs degraded.
+type ReadinessResponse struct {
+	Status   string            `json:"status"` // ready, degraded or unavailable
+	Checks   map[string]string `json:"checks"`
+	Degraded []DegradedFeature `json:"degraded"`
+}
+
+// readiness checks the database and Redis. Features still on their fallback
+// keep the server degraded until they next reach Redis.
+func readiness(pingDB, pingRedis func() error, degradation *RedisDegradation) (ReadinessResponse, int) {
+	ready := ReadinessResponse{
+		Status:   "ready",
+		Checks:   map[string]string{"database": "healthy", "redis": "healthy"},
+		Degraded: degradation.Degraded(),
+	}
+	if err := pingRedis(); err != nil {
+		ready.Checks["redis"] = "unhealthy"
+		ready.Status = "degraded"
+	}
+	if len(ready.Degraded) > 0 {
+		ready.Status = "degraded"
+	}
+	if err := pingDB(); err != nil {
+		ready.Checks["database"] = "unhealthy"
+		ready.Status = "unavailable"
+		return ready, http.StatusServiceUnavailable
+	}
+	return ready, http.StatusOK
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	ready, status := readiness(
+		func() error { return s.db.PingContext(ctx) },
+		func() error { return s.redis.Ping(ctx).Err() },
+		s.degradation,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ready)
+}
+
 // CORS middleware
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
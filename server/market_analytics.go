@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// marketCapacityWindowDays is how far back capacity utilization looks, so a
+// market's slow first weeks don't drag its current number down forever
+const marketCapacityWindowDays = 28
+
+// MarketAnalytics compares a soft-launch market against the others from the
+// day it launched
+type MarketAnalytics struct {
+	Market      string             `json:"market"`
+	InviteOnly  bool               `json:"invite_only"`
+	LaunchedOn  string             `json:"launched_on"`
+	DaysLive    int                `json:"days_live"`
+	Orders      MarketOrderStats   `json:"orders"`
+	Acquisition []MarketChannel    `json:"acquisition"`
+	Capacity    MarketCapacityStat `json:"capacity"`
+}
+
+// MarketOrderStats counts orders picked up in the market since launch
+type MarketOrderStats struct {
+	Total             int     `json:"total"`
+	LastSevenDays     int     `json:"last_seven_days"`
+	PerWeek           float64 `json:"per_week"`
+	Customers         int     `json:"customers"`
+	RepeatCustomers   int     `json:"repeat_customers"` // Customers with two or more orders
+	RetentionRate     float64 `json:"retention_rate"`   // Percent of customers who ordered again
+	ActiveSubscribers int     `json:"active_subscribers"`
+}
+
+// MarketChannel is the signups one invite code label brought into a market,
+// or "organic" for those without a code. Acquisition cost is the promo credit
+// granted to the channel's signups per customer who went on to order; we
+// don't track ad spend.
+type MarketChannel struct {
+	Channel            string  `json:"channel"`
+	Signups            int     `json:"signups"`
+	Customers          int     `json:"customers"` // Signups who placed an order
+	ConversionRate     float64 `json:"conversion_rate"`
+	Promos             int     `json:"promos"` // Signups who took a trial or intro price
+	CreditGrantedCents int     `json:"credit_granted_cents"`
+	CACCents           int     `json:"cac_cents"`
+}
+
+// MarketCapacityStat is how full pickup slots were for the market over the
+// last marketCapacityWindowDays. A market without its own capacity shares the
+// default, so Booked counts every pickup drawing on the same capacity.
+type MarketCapacityStat struct {
+	From            string  `json:"from"`
+	To              string  `json:"to"`
+	Capacity        int     `json:"capacity"`
+	Booked          int     `json:"booked"`
+	MarketPickups   int     `json:"market_pickups"`
+	DedicatedSlots  int     `json:"dedicated_slots"` // Slot-days held to the market's own capacity
+	UtilizationRate float64 `json:"utilization_rate"`
+}
+
+// marketCapacityUtilization sums capacity and bookings for pickups in market
+// across every active slot from start to end inclusive
+func marketCapacityUtilization(capacities *slotCapacities, bookings map[slotBookingKey]int, market string, start, end time.Time) MarketCapacityStat {
+	stat := MarketCapacityStat{From: start.Format("2006-01-02"), To: end.Format("2006-01-02")}
+	for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+		day := date.Format("2006-01-02")
+		for _, timeSlot := range capacities.slots {
+			limit, _ := capacities.limit(date.Weekday(), market, timeSlot)
+			stat.Capacity += limit.Capacity
+			stat.Booked += capacities.booked(bookings, date, timeSlot, limit)
+			stat.MarketPickups += bookings[slotBookingKey{Date: day, TimeSlot: timeSlot, Market: market}]
+			if limit.Market != "" {
+				stat.DedicatedSlots++
+			}
+		}
+	}
+	if stat.Capacity > 0 {
+		stat.UtilizationRate = float64(stat.Booked) / float64(stat.Capacity) * 100
+	}
+	return stat
+}
+
+// handleGetMarketAnalytics reports order volume, acquisition, retention and
+// capacity for every launch market, or just ?market=
+func (h *InviteCodeHandler) handleGetMarketAnalytics(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT market, invite_only, launched_on FROM launch_markets
+		WHERE $1 = '' OR market = $1
+		ORDER BY launched_on, market`,
+		r.URL.Query().Get("market"),
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch market analytics", http.StatusInternalServerError)
+		return
+	}
+	markets := []MarketAnalytics{}
+	launches := []time.Time{}
+	for rows.Next() {
+		var m MarketAnalytics
+		var launchedOn time.Time
+		if err := rows.Scan(&m.Market, &m.InviteOnly, &launchedOn); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to fetch market analytics", http.StatusInternalServerError)
+			return
+		}
+		m.LaunchedOn = launchedOn.Format("2006-01-02")
+		markets = append(markets, m)
+		launches = append(launches, launchedOn)
+	}
+	rows.Close()
+
+	capacities, err := loadSlotCapacities(h.db)
+	if err != nil {
+		http.Error(w, "Failed to fetch market analytics", http.StatusInternalServerError)
+		return
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	windowStart := today.AddDate(0, 0, -(marketCapacityWindowDays - 1))
+	bookings, err := bookedPickups(h.db, windowStart.Format("2006-01-02"), today.Format("2006-01-02"))
+	if err != nil {
+		http.Error(w, "Failed to fetch market analytics", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range markets {
+		m := &markets[i]
+		launchedOn := launches[i]
+		if days := int(today.Sub(launchedOn).Hours() / 24); days > 0 {
+			m.DaysLive = days
+		}
+
+		if m.Orders, err = marketOrderStats(h.db, m.Market, launchedOn); err != nil {
+			http.Error(w, "Failed to fetch market analytics", http.StatusInternalServerError)
+			return
+		}
+		if m.DaysLive > 0 {
+			m.Orders.PerWeek = float64(m.Orders.Total) / (float64(m.DaysLive) / 7)
+		}
+		if m.Acquisition, err = marketChannels(h.db, m.Market, launchedOn); err != nil {
+			http.Error(w, "Failed to fetch market analytics", http.StatusInternalServerError)
+			return
+		}
+
+		start := windowStart
+		if launchedOn.After(start) {
+			start = launchedOn
+		}
+		m.Capacity = marketCapacityUtilization(capacities, bookings, m.Market, start, today)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(markets)
+}
+
+func marketOrderStats(db *sql.DB, market string, launchedOn time.Time) (MarketOrderStats, error) {
+	var stats MarketOrderStats
+	err := db.QueryRow(`
+		WITH market_orders AS (
+			SELECT o.user_id, o.created_at
+			FROM orders o
+			JOIN addresses a ON a.id = o.pickup_address_id
+			WHERE LEFT(a.zip_code, 3) = $1 AND o.status <> 'cancelled' AND o.created_at >= $2
+		), customers AS (
+			SELECT user_id, COUNT(*) AS orders FROM market_orders GROUP BY user_id
+		)
+		SELECT (SELECT COUNT(*) FROM market_orders),
+		       (SELECT COUNT(*) FROM market_orders WHERE created_at >= CURRENT_TIMESTAMP - INTERVAL '7 days'),
+		       (SELECT COUNT(*) FROM customers),
+		       (SELECT COUNT(*) FROM customers WHERE orders >= 2),
+		       (SELECT COUNT(DISTINCT s.user_id) FROM subscriptions s
+		        JOIN customers c ON c.user_id = s.user_id
+		        WHERE s.status = 'active')`,
+		market, launchedOn,
+	).Scan(&stats.Total, &stats.LastSevenDays, &stats.Customers, &stats.RepeatCustomers, &stats.ActiveSubscribers)
+	if stats.Customers > 0 {
+		stats.RetentionRate = float64(stats.RepeatCustomers) / float64(stats.Customers) * 100
+	}
+	return stats, err
+}
+
+func marketChannels(db *sql.DB, market string, launchedOn time.Time) ([]MarketChannel, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(c.label, c.code, 'organic'),
+		       COUNT(*),
+		       COUNT(*) FILTER (WHERE EXISTS (
+		           SELECT 1 FROM orders o WHERE o.user_id = u.id AND o.status <> 'cancelled')),
+		       COUNT(*) FILTER (WHERE EXISTS (
+		           SELECT 1 FROM subscriptions s
+		           WHERE s.user_id = u.id AND (s.trial_ends_at IS NOT NULL OR s.intro_price_cents IS NOT NULL))),
+		       COALESCE(SUM(g.granted), 0)
+		FROM users u
+		LEFT JOIN invite_codes c ON c.id = u.invite_code_id
+		LEFT JOIN LATERAL (
+		    SELECT SUM(amount_cents) AS granted FROM customer_credit_ledger l
+		    WHERE l.user_id = u.id AND l.entry_type = 'grant'
+		) g ON true
+		WHERE LEFT(u.signup_zip, 3) = $1 AND u.created_at >= $2
+		GROUP BY 1
+		ORDER BY 2 DESC, 1`,
+		market, launchedOn,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []MarketChannel{}
+	for rows.Next() {
+		var c MarketChannel
+		if err := rows.Scan(&c.Channel, &c.Signups, &c.Customers, &c.Promos, &c.CreditGrantedCents); err != nil {
+			return nil, err
+		}
+		if c.Signups > 0 {
+			c.ConversionRate = float64(c.Customers) / float64(c.Signups) * 100
+		}
+		if c.Customers > 0 {
+			c.CACCents = c.CreditGrantedCents / c.Customers
+		}
+		channels = append(channels, c)
+	}
+	return channels, rows.Err()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMarketCapacityUtilization(t *testing.T) {
+	market := "123"
+	capacities := &slotCapacities{
+		slots:     []string{"9am-12pm", "1pm-4pm"},
+		defaults:  map[string]int{"9am-12pm": 20, "1pm-4pm": 20},
+		overrides: []SlotCapacity{{Market: &market, TimeSlot: "9am-12pm", Capacity: 5}},
+	}
+	bookings := map[slotBookingKey]int{
+		{Date: "2026-10-19", TimeSlot: "9am-12pm", Market: "123"}: 4,
+		{Date: "2026-10-19", TimeSlot: "1pm-4pm", Market: "123"}:  2,
+		{Date: "2026-10-19", TimeSlot: "1pm-4pm", Market: "456"}:  8,
+		{Date: "2026-10-20", TimeSlot: "9am-12pm", Market: "123"}: 1,
+	}
+	start := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+
+	stat := marketCapacityUtilization(capacities, bookings, "123", start, start.AddDate(0, 0, 1))
+	// Mornings are the market's own 5 a day; afternoons share the default 20
+	// with 456, whose pickups count towards how full they are
+	expected := MarketCapacityStat{
+		From:            "2026-10-19",
+		To:              "2026-10-20",
+		Capacity:        50,
+		Booked:          15,
+		MarketPickups:   7,
+		DedicatedSlots:  2,
+		UtilizationRate: 30,
+	}
+	if stat != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stat)
+	}
+}
+
+func TestMarketAnalytics(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+	defer db.Exec("DELETE FROM launch_markets")
+
+	launchedOn := time.Now().UTC().AddDate(0, 0, -14).Format("2006-01-02")
+	db.Exec("INSERT INTO launch_markets (market, invite_only, launched_on) VALUES ('123', true, $1)", launchedOn)
+	var codeID int
+	db.QueryRow("INSERT INTO invite_codes (code, market, label) VALUES ('FRIENDS1', '123', 'Friends') RETURNING id").Scan(&codeID)
+
+	// Two invited signups, one of whom orders twice on $10 of promo credit,
+	// and an organic signup who orders once
+	invited := db.CreateTestUser(t, "market-invited@example.com", "Market", "Invited")
+	idle := db.CreateTestUser(t, "market-idle@example.com", "Market", "Idle")
+	organic := db.CreateTestUser(t, "market-organic@example.com", "Market", "Organic")
+	db.Exec("UPDATE users SET signup_zip = '12345', invite_code_id = $1 WHERE id IN ($2, $3)", codeID, invited, idle)
+	db.Exec("UPDATE users SET signup_zip = '12345' WHERE id = $1", organic)
+	db.Exec("INSERT INTO customer_credit_ledger (user_id, amount_cents, entry_type, reason) VALUES ($1, 1000, 'grant', 'Launch promo')", invited)
+
+	invitedAddress := db.CreateTestAddress(t, invited)
+	db.CreateTestOrder(t, invited, invitedAddress)
+	db.CreateTestOrder(t, invited, invitedAddress)
+	db.CreateTestOrder(t, organic, db.CreateTestAddress(t, organic))
+
+	handler := NewInviteCodeHandler(db.DB)
+	req := httptest.NewRequest("GET", "/api/v1/admin/analytics/markets?market=123", nil)
+	w := httptest.NewRecorder()
+	handler.handleGetMarketAnalytics(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var markets []MarketAnalytics
+	if err := json.Unmarshal(w.Body.Bytes(), &markets); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(markets) != 1 {
+		t.Fatalf("Expected one market, got %d", len(markets))
+	}
+	m := markets[0]
+	if m.LaunchedOn != launchedOn || m.DaysLive != 14 {
+		t.Errorf("Expected launch on %s 14 days ago, got %s and %d days", launchedOn, m.LaunchedOn, m.DaysLive)
+	}
+	if m.Orders.Total != 3 || m.Orders.Customers != 2 || m.Orders.RepeatCustomers != 1 || m.Orders.RetentionRate != 50 {
+		t.Errorf("Unexpected order stats %+v", m.Orders)
+	}
+
+	expected := []MarketChannel{
+		{Channel: "Friends", Signups: 2, Customers: 1, ConversionRate: 50, CreditGrantedCents: 1000, CACCents: 1000},
+		{Channel: "organic", Signups: 1, Customers: 1, ConversionRate: 100},
+	}
+	if len(m.Acquisition) != len(expected) {
+		t.Fatalf("Expected channels %+v, got %+v", expected, m.Acquisition)
+	}
+	for i := range expected {
+		if m.Acquisition[i] != expected[i] {
+			t.Errorf("Expected channel %+v, got %+v", expected[i], m.Acquisition[i])
+		}
+	}
+
+	// Tomorrow's pickups are ahead of the window
+	if m.Capacity.To != time.Now().UTC().Format("2006-01-02") || m.Capacity.MarketPickups != 0 {
+		t.Errorf("Unexpected capacity %+v", m.Capacity)
+	}
+}
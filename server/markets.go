@@ -0,0 +1,544 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Markets are the cities we operate in. Each covers whole 3-digit ZIP
+// prefixes (see marketForZip), and services, plans and drivers can be tied
+// to one. An order belongs to the market of its pickup address; a customer
+// to the market of their default address. Anything not tied to a market is
+// shared by all of them, which is how everything started out.
+
+// MarketHandler serves the customer's market and the admin market CRUD
+type MarketHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewMarketHandler(db *sql.DB) *MarketHandler {
+	return &MarketHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type Market struct {
+	ID          int       `json:"id"`
+	Slug        string    `json:"slug"`
+	Name        string    `json:"name"`
+	IsActive    bool      `json:"is_active"`
+	ZipPrefixes []string  `json:"zip_prefixes"`
+	Customers   int       `json:"customers"` // Customers whose default address is in the market
+	Drivers     int       `json:"drivers"`
+	Services    int       `json:"services"` // Services and plans sold only here
+	Plans       int       `json:"plans"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+var marketSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// marketIDForZip returns the active market a ZIP code is in, or nil when
+// its prefix isn't in one
+func marketIDForZip(q queryRower, zipCode string) (*int, error) {
+	prefix := marketForZip(zipCode)
+	if prefix == "" {
+		return nil, nil
+	}
+	var marketID int
+	err := q.QueryRow(`
+		SELECT m.id FROM market_zip_prefixes mz
+		JOIN markets m ON m.id = mz.market_id
+		WHERE mz.zip_prefix = $1 AND m.is_active`,
+		prefix,
+	).Scan(&marketID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &marketID, nil
+}
+
+// customerMarketID infers a customer's market from their default address,
+// falling back to the ZIP they signed up with before they've saved one
+func customerMarketID(q queryRower, userID int) (*int, error) {
+	var zipCode sql.NullString
+	err := q.QueryRow(`
+		SELECT COALESCE(
+			(SELECT zip_code FROM addresses WHERE user_id = $1 ORDER BY is_default DESC, created_at DESC LIMIT 1),
+			(SELECT signup_zip FROM users WHERE id = $1))`,
+		userID,
+	).Scan(&zipCode)
+	if err != nil || !zipCode.Valid {
+		return nil, err
+	}
+	return marketIDForZip(q, zipCode.String)
+}
+
+// requestMarketID is the market a catalog request is for: that of
+// ?zip_code= when given, else the signed-in customer's. Visitors who give
+// neither see the shared catalog.
+func requestMarketID(r *http.Request, db *sql.DB, getUserID func(*http.Request, *sql.DB) (int, error)) (*int, error) {
+	if zipCode := r.URL.Query().Get("zip_code"); zipCode != "" {
+		return marketIDForZip(db, zipCode)
+	}
+	if r.Header.Get("Authorization") == "" {
+		return nil, nil
+	}
+	userID, err := getUserID(r, db)
+	if err != nil {
+		return nil, nil
+	}
+	return customerMarketID(db, userID)
+}
+
+// soldInMarketSQL limits a services or subscription_plans query to what's
+// sold in the market given as the placeholder: the shared catalog plus the
+// market's own. A NULL market gets only the shared catalog.
+const soldInMarketSQL = "(%[1]s.market_id IS NULL OR %[1]s.market_id = %[2]s)"
+
+// zipInMarket is a condition that the ZIP column is in the market given as
+// the placeholder, or true when it's NULL for all markets
+func zipInMarket(column, placeholder string) string {
+	return fmt.Sprintf("(%[2]s::int IS NULL OR LEFT(%[1]s, 3) IN (SELECT zip_prefix FROM market_zip_prefixes WHERE market_id = %[2]s))",
+		column, placeholder)
+}
+
+// orderInMarket is a condition that the order, by its alias or table name,
+// is picked up in the market given as the placeholder, or true when that's
+// NULL for all markets
+func orderInMarket(order, placeholder string) string {
+	return zipInMarket(fmt.Sprintf("(SELECT zip_code FROM addresses WHERE id = %s.pickup_address_id)", order), placeholder)
+}
+
+// marketIDBySelector looks a market up by slug or ID
+func marketIDBySelector(q queryRower, selector string) (int, error) {
+	var marketID int
+	err := q.QueryRow("SELECT id FROM markets WHERE slug = $1 OR id::text = $1", selector).Scan(&marketID)
+	return marketID, err
+}
+
+// adminMarketFilter reads the admin market selector, ?market= by slug or
+// ID. It returns nil for all markets, and writes the error itself for an
+// unknown one.
+func adminMarketFilter(w http.ResponseWriter, r *http.Request, q queryRower) (*int, bool) {
+	selector := strings.TrimSpace(r.URL.Query().Get("market"))
+	if selector == "" {
+		return nil, true
+	}
+	marketID, err := marketIDBySelector(q, selector)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Unknown market %q", selector), http.StatusBadRequest)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to look up market", http.StatusInternalServerError)
+		return nil, false
+	}
+	return &marketID, true
+}
+
+// servicesNotSoldInMarket returns which of serviceIDs can't be ordered in
+// the market: inactive, unknown, or sold only in another market
+func servicesNotSoldInMarket(q queryer, serviceIDs []int, marketID *int) ([]int, error) {
+	rows, err := q.Query(`
+		SELECT DISTINCT ids.id FROM unnest($1::int[]) AS ids(id)
+		WHERE NOT EXISTS (
+			SELECT 1 FROM services s
+			WHERE s.id = ids.id AND s.is_active AND `+fmt.Sprintf(soldInMarketSQL, "s", "$2")+`
+		)
+		ORDER BY ids.id`,
+		pq.Array(serviceIDs), marketID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	unavailable := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		unavailable = append(unavailable, id)
+	}
+	return unavailable, rows.Err()
+}
+
+// ordersOutsideDriverMarket returns the orders a driver can't be routed to
+// because they're picked up in a market other than the driver's. Drivers
+// without a home market go anywhere.
+func ordersOutsideDriverMarket(q queryer, driverID int, orderIDs []int) ([]int, error) {
+	rows, err := q.Query(`
+		SELECT o.id FROM orders o
+		JOIN addresses a ON a.id = o.pickup_address_id
+		JOIN market_zip_prefixes mz ON mz.zip_prefix = LEFT(a.zip_code, 3)
+		JOIN users d ON d.id = $1
+		WHERE o.id = ANY($2) AND d.home_market_id IS NOT NULL AND mz.market_id != d.home_market_id
+		ORDER BY o.id`,
+		driverID, pq.Array(orderIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	outside := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		outside = append(outside, id)
+	}
+	return outside, rows.Err()
+}
+
+const marketColumns = `
+	m.id, m.slug, m.name, m.is_active,
+	COALESCE((SELECT array_agg(zip_prefix ORDER BY zip_prefix) FROM market_zip_prefixes WHERE market_id = m.id), '{}'),
+	(SELECT COUNT(DISTINCT a.user_id) FROM addresses a
+	 JOIN market_zip_prefixes mz ON mz.zip_prefix = LEFT(a.zip_code, 3)
+	 WHERE mz.market_id = m.id AND a.is_default),
+	(SELECT COUNT(*) FROM users WHERE home_market_id = m.id AND role = 'driver'),
+	(SELECT COUNT(*) FROM services WHERE market_id = m.id),
+	(SELECT COUNT(*) FROM subscription_plans WHERE market_id = m.id),
+	m.created_at, m.updated_at`
+
+func scanMarket(row interface{ Scan(...interface{}) error }) (Market, error) {
+	var m Market
+	err := row.Scan(&m.ID, &m.Slug, &m.Name, &m.IsActive, pq.Array(&m.ZipPrefixes),
+		&m.Customers, &m.Drivers, &m.Services, &m.Plans, &m.CreatedAt, &m.UpdatedAt)
+	return m, err
+}
+
+func getMarket(q queryRower, marketID int) (Market, error) {
+	return scanMarket(q.QueryRow("SELECT "+marketColumns+" FROM markets m WHERE m.id = $1", marketID))
+}
+
+// handleGetMyMarket returns the signed-in customer's market, or null when
+// they're served from the shared catalog
+func (h *MarketHandler) handleGetMyMarket(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	marketID, err := customerMarketID(h.db, userID)
+	if err != nil {
+		http.Error(w, "Failed to look up market", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if marketID == nil {
+		w.Write([]byte("null\n"))
+		return
+	}
+	var market struct {
+		ID   int    `json:"id"`
+		Slug string `json:"slug"`
+		Name string `json:"name"`
+	}
+	err = h.db.QueryRow("SELECT id, slug, name FROM markets WHERE id = $1", *marketID).Scan(&market.ID, &market.Slug, &market.Name)
+	if err != nil {
+		http.Error(w, "Failed to look up market", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(market)
+}
+
+// handleGetMarkets lists markets with their ZIP prefixes and what's tied
+// to each
+func (h *MarketHandler) handleGetMarkets(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query("SELECT " + marketColumns + " FROM markets m ORDER BY m.name")
+	if err != nil {
+		http.Error(w, "Failed to fetch markets", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	markets := []Market{}
+	for rows.Next() {
+		m, err := scanMarket(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch markets", http.StatusInternalServerError)
+			return
+		}
+		markets = append(markets, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(markets)
+}
+
+type MarketRequest struct {
+	Slug        *string  `json:"slug"`
+	Name        *string  `json:"name"`
+	IsActive    *bool    `json:"is_active"`
+	ZipPrefixes []string `json:"zip_prefixes"` // Replaces the market's prefixes when set
+}
+
+// validate checks the fields that are set; creating needs slug and name
+func (req *MarketRequest) validate(creating bool) error {
+	if creating && (req.Slug == nil || req.Name == nil) {
+		return fmt.Errorf("slug and name are required")
+	}
+	if req.Slug != nil && !marketSlugPattern.MatchString(*req.Slug) {
+		return fmt.Errorf("slug must be lowercase letters, digits and dashes")
+	}
+	if req.Name != nil {
+		trimmed := strings.TrimSpace(*req.Name)
+		if trimmed == "" {
+			return fmt.Errorf("name can't be empty")
+		}
+		req.Name = &trimmed
+	}
+	for _, prefix := range req.ZipPrefixes {
+		if !isMarket(prefix) {
+			return fmt.Errorf("%q isn't a 3-digit ZIP prefix", prefix)
+		}
+	}
+	return nil
+}
+
+// setMarketZipPrefixes replaces the market's prefixes. A prefix can only be
+// in one market, so taking one from another market is a conflict rather than
+// a silent move.
+func setMarketZipPrefixes(tx *sql.Tx, marketID int, prefixes []string) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT mz.zip_prefix FROM market_zip_prefixes mz
+		WHERE mz.zip_prefix = ANY($1) AND mz.market_id != $2
+		ORDER BY mz.zip_prefix`,
+		pq.Array(prefixes), marketID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	taken := []string{}
+	for rows.Next() {
+		var prefix string
+		if err := rows.Scan(&prefix); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		taken = append(taken, prefix)
+	}
+	rows.Close()
+	if len(taken) > 0 {
+		return taken, nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM market_zip_prefixes WHERE market_id = $1 AND NOT (zip_prefix = ANY($2))", marketID, pq.Array(prefixes)); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO market_zip_prefixes (zip_prefix, market_id)
+		SELECT DISTINCT prefix, $2 FROM unnest($1::text[]) AS prefix
+		ON CONFLICT (zip_prefix) DO NOTHING`,
+		pq.Array(prefixes), marketID,
+	)
+	return nil, err
+}
+
+// writeMarketError maps constraint failures to client errors
+func writeMarketError(w http.ResponseWriter, err error, action string) {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "A market with this slug already exists", http.StatusConflict)
+		return
+	}
+	http.Error(w, "Failed to "+action, http.StatusInternalServerError)
+}
+
+// handleCreateMarket adds a market, optionally with its ZIP prefixes
+func (h *MarketHandler) handleCreateMarket(w http.ResponseWriter, r *http.Request) {
+	var req MarketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var marketID int
+	err = tx.QueryRow(
+		"INSERT INTO markets (slug, name, is_active) VALUES ($1, $2, $3) RETURNING id",
+		*req.Slug, *req.Name, isActive,
+	).Scan(&marketID)
+	if err != nil {
+		writeMarketError(w, err, "create market")
+		return
+	}
+	if !h.applyZipPrefixes(w, tx, marketID, req.ZipPrefixes) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create market", http.StatusInternalServerError)
+		return
+	}
+
+	market, err := getMarket(h.db, marketID)
+	if err != nil {
+		http.Error(w, "Failed to fetch market", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(market)
+}
+
+// applyZipPrefixes sets the market's prefixes when the request gave any,
+// writing the error itself
+func (h *MarketHandler) applyZipPrefixes(w http.ResponseWriter, tx *sql.Tx, marketID int, prefixes []string) bool {
+	if prefixes == nil {
+		return true
+	}
+	taken, err := setMarketZipPrefixes(tx, marketID, prefixes)
+	if err != nil {
+		http.Error(w, "Failed to update ZIP prefixes", http.StatusInternalServerError)
+		return false
+	}
+	if len(taken) > 0 {
+		http.Error(w, fmt.Sprintf("ZIP prefixes %s are already in another market", strings.Join(taken, ", ")), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// handleUpdateMarket renames a market, opens or closes it, or replaces its
+// ZIP prefixes. Closing a market sends its customers back to the shared
+// catalog without touching their orders or subscriptions.
+func (h *MarketHandler) handleUpdateMarket(w http.ResponseWriter, r *http.Request) {
+	marketID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid market ID", http.StatusBadRequest)
+		return
+	}
+	var req MarketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE markets SET slug = COALESCE($2, slug), name = COALESCE($3, name), is_active = COALESCE($4, is_active)
+		WHERE id = $1`,
+		marketID, req.Slug, req.Name, req.IsActive,
+	)
+	if err != nil {
+		writeMarketError(w, err, "update market")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Market not found", http.StatusNotFound)
+		return
+	}
+	if !h.applyZipPrefixes(w, tx, marketID, req.ZipPrefixes) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update market", http.StatusInternalServerError)
+		return
+	}
+
+	market, err := getMarket(h.db, marketID)
+	if err != nil {
+		http.Error(w, "Failed to fetch market", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(market)
+}
+
+// marketAssignment is the body for tying a driver, service or plan to a
+// market; a null market_id unties it
+type marketAssignment struct {
+	MarketID *int `json:"market_id"`
+}
+
+// assignMarket runs update, which ties row $1 to market $2, and writes the
+// response. label names the row in errors.
+func (h *MarketHandler) assignMarket(w http.ResponseWriter, r *http.Request, update, label string) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid "+label+" ID", http.StatusBadRequest)
+		return
+	}
+	var req marketAssignment
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec(update, id, req.MarketID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		http.Error(w, "Unknown market", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update "+label, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, strings.ToUpper(label[:1])+label[1:]+" not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "market_id": req.MarketID})
+}
+
+// handleSetDriverMarket sets the market a driver works. Suggestions and
+// route assignment keep them to orders picked up there.
+func (h *MarketHandler) handleSetDriverMarket(w http.ResponseWriter, r *http.Request) {
+	h.assignMarket(w, r, `
+		UPDATE users SET home_market_id = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND role = 'driver'`, "driver")
+}
+
+// handleSetServiceMarket sells a service in one market only, or everywhere
+func (h *MarketHandler) handleSetServiceMarket(w http.ResponseWriter, r *http.Request) {
+	h.assignMarket(w, r, "UPDATE services SET market_id = $2 WHERE id = $1", "service")
+}
+
+// handleSetPlanMarket sells a plan in one market only, or everywhere.
+// Existing subscribers keep their plan wherever they are.
+func (h *MarketHandler) handleSetPlanMarket(w http.ResponseWriter, r *http.Request) {
+	h.assignMarket(w, r, "UPDATE subscription_plans SET market_id = $2 WHERE id = $1", "plan")
+}
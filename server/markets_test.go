@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMarkets(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "markets-admin@example.com", "Markets", "Admin")
+	customerID := db.CreateTestUser(t, "markets-customer@example.com", "Markets", "Customer")
+	addressID := db.CreateTestAddress(t, customerID) // ZIP 12345
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	markets := &MarketHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	createMarket := func(req MarketRequest) (*httptest.ResponseRecorder, Market) {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		markets.handleCreateMarket(w, httptest.NewRequest("POST", "/api/v1/admin/markets", bytes.NewBuffer(body)))
+		var market Market
+		json.Unmarshal(w.Body.Bytes(), &market)
+		return w, market
+	}
+	strPtr := func(s string) *string { return &s }
+
+	w, home := createMarket(MarketRequest{Slug: strPtr("test-city"), Name: strPtr("Test City"), ZipPrefixes: []string{"123"}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if home.Customers != 1 || len(home.ZipPrefixes) != 1 {
+		t.Errorf("Expected the market to count the customer, got %+v", home)
+	}
+	if w, _ := createMarket(MarketRequest{Slug: strPtr("overlap"), Name: strPtr("Overlap"), ZipPrefixes: []string{"123"}}); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a prefix in another market, got %d", http.StatusConflict, w.Code)
+	}
+	_, other := createMarket(MarketRequest{Slug: strPtr("elsewhere"), Name: strPtr("Elsewhere"), ZipPrefixes: []string{"945"}})
+
+	// Bedding is sold only elsewhere, so the customer doesn't see it
+	bedding := db.GetServiceID(t, "bedding")
+	db.Exec("UPDATE services SET market_id = $1 WHERE id = $2", other.ID, bedding)
+	services := &ServiceHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest}
+	req := httptest.NewRequest("GET", "/api/v1/services", nil)
+	req.Header.Set("Authorization", "Bearer "+CreateTestJWTToken(customerID))
+	w = httptest.NewRecorder()
+	services.handleGetServices(w, req)
+	var catalog []Service
+	json.Unmarshal(w.Body.Bytes(), &catalog)
+	for _, service := range catalog {
+		if service.ID == bedding {
+			t.Error("Expected the other market's service left out of the customer's catalog")
+		}
+	}
+	if len(catalog) == 0 {
+		t.Errorf("Expected the shared catalog, got %s", w.Body.String())
+	}
+
+	customerMarkets := &MarketHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest}
+	w = httptest.NewRecorder()
+	customerMarkets.handleGetMyMarket(w, httptest.NewRequest("GET", "/api/v1/market", nil))
+	var mine Market
+	json.Unmarshal(w.Body.Bytes(), &mine)
+	if mine.Slug != "test-city" {
+		t.Errorf("Expected the market inferred from the default address, got %s", w.Body.String())
+	}
+
+	admin := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	for market, expected := range map[string]int{"test-city": 1, "elsewhere": 0} {
+		w := httptest.NewRecorder()
+		admin.handleGetAllOrders(w, httptest.NewRequest("GET", "/api/v1/admin/orders?market="+market, nil))
+		var orders []Order
+		json.Unmarshal(w.Body.Bytes(), &orders)
+		if len(orders) != expected || (expected == 1 && orders[0].ID != orderID) {
+			t.Errorf("Expected %d orders in %s, got %s", expected, market, w.Body.String())
+		}
+	}
+	w = httptest.NewRecorder()
+	admin.handleGetAllOrders(w, httptest.NewRequest("GET", "/api/v1/admin/orders?market=nowhere", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unknown market, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -79,10 +80,17 @@ func (rw *responseWriter) WriteHeader(code int) {
 func CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
+
+		// The booking widget answers CORS for its keys' origins only
+		if strings.HasPrefix(r.URL.Path, APIPrefix+"/widget/") {
+			next.ServeHTTP(w, r)
+			return
+		}
 		
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", rateLimitHeaders)
 		
 		if r.Method == "OPTIONS" {
 			Logger.Debug("CORS preflight request",
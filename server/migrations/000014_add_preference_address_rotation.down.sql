@@ -0,0 +1,4 @@
+-- Remove multi-stop subscription address columns
+ALTER TABLE subscription_preferences DROP COLUMN IF EXISTS rotation_index;
+ALTER TABLE subscription_preferences DROP COLUMN IF EXISTS weekday_addresses;
+ALTER TABLE subscription_preferences DROP COLUMN IF EXISTS address_rotation;
@@ -0,0 +1,6 @@
+-- Multi-stop subscription addresses for subscribers who alternate pickup locations
+-- address_rotation: ordered array of {"pickup_address_id", "delivery_address_id"} stops
+-- weekday_addresses: object keyed by weekday name ('monday', ...) with the same stop shape
+ALTER TABLE subscription_preferences ADD COLUMN address_rotation JSONB DEFAULT '[]'::jsonb NOT NULL;
+ALTER TABLE subscription_preferences ADD COLUMN weekday_addresses JSONB DEFAULT '{}'::jsonb NOT NULL;
+ALTER TABLE subscription_preferences ADD COLUMN rotation_index INTEGER DEFAULT 0 NOT NULL;
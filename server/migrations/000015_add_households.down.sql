@@ -0,0 +1,4 @@
+-- Remove household sharing
+ALTER TABLE orders DROP COLUMN IF EXISTS billed_user_id;
+DROP TABLE IF EXISTS household_members;
+DROP TABLE IF EXISTS households;
@@ -0,0 +1,32 @@
+-- Households let a consumer share addresses and billing with family members
+CREATE TABLE households (
+    id SERIAL PRIMARY KEY,
+    owner_id INTEGER NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL DEFAULT 'My Household',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Household members; user_id is set once the invite is accepted
+CREATE TABLE household_members (
+    id SERIAL PRIMARY KEY,
+    household_id INTEGER NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    permission VARCHAR(20) NOT NULL DEFAULT 'schedule' CHECK (permission IN ('schedule', 'manage_payment')),
+    status VARCHAR(20) NOT NULL DEFAULT 'invited' CHECK (status IN ('invited', 'active', 'removed')),
+    invite_token VARCHAR(64) UNIQUE,
+    invited_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    accepted_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE(household_id, email)
+);
+
+-- A user can be an active member of at most one household
+CREATE UNIQUE INDEX idx_household_members_active_user ON household_members(user_id) WHERE status = 'active';
+CREATE INDEX idx_household_members_household_id ON household_members(household_id);
+
+-- Orders scheduled by a member can be billed to the household owner
+ALTER TABLE orders ADD COLUMN billed_user_id INTEGER REFERENCES users(id);
+
+CREATE TRIGGER update_households_updated_at BEFORE UPDATE ON households
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
@@ -0,0 +1,2 @@
+-- Remove backup verification history
+DROP TABLE IF EXISTS backup_verifications;
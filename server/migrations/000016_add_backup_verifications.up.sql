@@ -0,0 +1,13 @@
+-- Record results of scheduled backup restore verification
+CREATE TABLE IF NOT EXISTS backup_verifications (
+    id SERIAL PRIMARY KEY,
+    backup_file VARCHAR(255) NOT NULL DEFAULT '',
+    backup_taken_at TIMESTAMP,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('passed', 'warning', 'failed')),
+    restore_duration_ms BIGINT NOT NULL DEFAULT 0,
+    tables JSONB NOT NULL DEFAULT '[]',
+    error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_backup_verifications_created_at ON backup_verifications(created_at DESC);
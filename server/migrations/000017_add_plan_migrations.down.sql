@@ -0,0 +1,3 @@
+-- Remove scheduled plan migrations
+DROP TABLE IF EXISTS plan_migration_subscribers;
+DROP TABLE IF EXISTS plan_migrations;
@@ -0,0 +1,27 @@
+-- Scheduled bulk moves of subscribers from a legacy plan to a new one at renewal
+CREATE TABLE plan_migrations (
+    id SERIAL PRIMARY KEY,
+    from_plan_id INTEGER NOT NULL REFERENCES subscription_plans(id),
+    to_plan_id INTEGER NOT NULL REFERENCES subscription_plans(id),
+    notice_days INTEGER NOT NULL DEFAULT 14 CHECK (notice_days >= 0),
+    status VARCHAR(20) NOT NULL DEFAULT 'scheduled' CHECK (status IN ('scheduled', 'completed', 'cancelled')),
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (from_plan_id != to_plan_id)
+);
+
+CREATE TABLE plan_migration_subscribers (
+    id SERIAL PRIMARY KEY,
+    migration_id INTEGER NOT NULL REFERENCES plan_migrations(id) ON DELETE CASCADE,
+    subscription_id INTEGER NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    renewal_date DATE NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'notified', 'migrated', 'opted_out', 'skipped', 'failed')),
+    notified_at TIMESTAMP WITH TIME ZONE,
+    migrated_at TIMESTAMP WITH TIME ZONE,
+    error TEXT,
+    UNIQUE (migration_id, subscription_id)
+);
+
+CREATE INDEX idx_plan_migration_subscribers_status ON plan_migration_subscribers(status, renewal_date);
+CREATE INDEX idx_plan_migration_subscribers_user ON plan_migration_subscribers(user_id);
@@ -0,0 +1,6 @@
+-- Remove payment reconciliation
+DROP TABLE IF EXISTS payment_reconciliation_items;
+DROP TABLE IF EXISTS payment_reconciliations;
+DROP INDEX IF EXISTS idx_payments_stripe_charge_id;
+ALTER TABLE payments DROP COLUMN IF EXISTS stripe_fee_cents;
+ALTER TABLE payments DROP COLUMN IF EXISTS stripe_balance_transaction_id;
@@ -0,0 +1,33 @@
+-- Ledger fields copied from Stripe balance transactions during reconciliation
+ALTER TABLE payments ADD COLUMN stripe_balance_transaction_id VARCHAR(255);
+ALTER TABLE payments ADD COLUMN stripe_fee_cents INTEGER;
+CREATE INDEX idx_payments_stripe_charge_id ON payments(stripe_charge_id);
+
+-- Daily reconciliation of local payments against Stripe
+CREATE TABLE payment_reconciliations (
+    id SERIAL PRIMARY KEY,
+    reconciliation_date DATE NOT NULL UNIQUE,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('balanced', 'mismatched', 'failed')),
+    local_total_cents INTEGER NOT NULL DEFAULT 0,
+    stripe_gross_cents INTEGER NOT NULL DEFAULT 0,
+    stripe_fee_cents INTEGER NOT NULL DEFAULT 0,
+    stripe_net_cents INTEGER NOT NULL DEFAULT 0,
+    refund_cents INTEGER NOT NULL DEFAULT 0,
+    payout_cents INTEGER NOT NULL DEFAULT 0,
+    mismatch_count INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE payment_reconciliation_items (
+    id SERIAL PRIMARY KEY,
+    reconciliation_id INTEGER NOT NULL REFERENCES payment_reconciliations(id) ON DELETE CASCADE,
+    payment_id INTEGER REFERENCES payments(id) ON DELETE SET NULL,
+    stripe_balance_transaction_id VARCHAR(255),
+    stripe_charge_id VARCHAR(255),
+    issue VARCHAR(30) NOT NULL CHECK (issue IN ('missing_in_stripe', 'missing_locally', 'amount_mismatch')),
+    local_amount_cents INTEGER,
+    stripe_amount_cents INTEGER
+);
+
+CREATE INDEX idx_payment_reconciliation_items_reconciliation ON payment_reconciliation_items(reconciliation_id);
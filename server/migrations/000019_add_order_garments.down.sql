@@ -0,0 +1,3 @@
+-- Remove itemized garments
+DROP TABLE IF EXISTS order_garments;
+DROP TABLE IF EXISTS garment_types;
@@ -0,0 +1,36 @@
+-- Itemized garments for dry cleaning, priced per piece alongside bag-based items
+CREATE TABLE garment_types (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    display_name VARCHAR(100) NOT NULL,
+    price_cents INTEGER NOT NULL CHECK (price_cents >= 0), -- Per piece, in cents
+    is_active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO garment_types (name, display_name, price_cents) VALUES
+('shirt', 'Dress Shirt', 400),
+('blouse', 'Blouse', 700),
+('pants', 'Pants', 800),
+('skirt', 'Skirt', 800),
+('sweater', 'Sweater', 900),
+('dress', 'Dress', 1400),
+('suit_2pc', 'Suit (2-piece)', 1800),
+('coat', 'Coat', 2200),
+('tie', 'Tie', 500);
+
+CREATE TABLE order_garments (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    garment_type_id INTEGER NOT NULL REFERENCES garment_types(id),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    unit_price_cents INTEGER NOT NULL, -- Price at time of order, in cents
+    care_flags TEXT[] NOT NULL DEFAULT '{}',
+    notes TEXT,
+    received_quantity INTEGER CHECK (received_quantity >= 0), -- Set at facility check-in
+    checked_in_at TIMESTAMP WITH TIME ZONE,
+    checked_in_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_order_garments_order_id ON order_garments(order_id);
@@ -0,0 +1,14 @@
+-- Evening-before pickup reminders with tokenized confirm/reschedule links
+CREATE TABLE pickup_reminders (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    pickup_date DATE NOT NULL, -- The pickup this reminder was sent for
+    token VARCHAR(64) NOT NULL UNIQUE,
+    status VARCHAR(20) NOT NULL DEFAULT 'sent' CHECK (status IN ('sent', 'confirmed', 'rescheduled')),
+    sent_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    responded_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (order_id, pickup_date)
+);
+
+CREATE INDEX idx_pickup_reminders_pickup_date ON pickup_reminders(pickup_date, status);
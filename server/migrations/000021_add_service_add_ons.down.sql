@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS order_add_ons;
+DROP TABLE IF EXISTS service_add_ons;
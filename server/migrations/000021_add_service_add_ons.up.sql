@@ -0,0 +1,36 @@
+-- Optional extras customers can add to an order at checkout
+CREATE TABLE service_add_ons (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    display_name VARCHAR(100) NOT NULL,
+    description TEXT,
+    pricing_type VARCHAR(20) NOT NULL CHECK (pricing_type IN ('flat', 'per_bag', 'percent')),
+    price_cents INTEGER NOT NULL DEFAULT 0, -- Flat and per-bag add-ons
+    percent INTEGER NOT NULL DEFAULT 0 CHECK (percent >= 0 AND percent <= 100), -- Percent-of-subtotal add-ons
+    markets TEXT[] NOT NULL DEFAULT '{}', -- 3-digit ZIP prefixes; empty means every market
+    is_active BOOLEAN DEFAULT TRUE,
+    sort_order INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_service_add_ons_updated_at BEFORE UPDATE ON service_add_ons
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+INSERT INTO service_add_ons (name, display_name, description, pricing_type, price_cents, percent, sort_order) VALUES
+('hang_dry', 'Hang Dry', 'Delicates hung to dry instead of tumble dried', 'per_bag', 500, 0, 1),
+('scent_free', 'Scent-Free', 'Fragrance-free detergent and no dryer sheets', 'flat', 300, 0, 2),
+('rush', 'Rush Service', 'Next-day turnaround', 'percent', 0, 50, 3);
+
+-- Add-ons on an order, priced when the order was placed
+CREATE TABLE order_add_ons (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    add_on_id INTEGER NOT NULL REFERENCES service_add_ons(id),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    unit_price_cents INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (order_id, add_on_id)
+);
+
+CREATE INDEX idx_order_add_ons_order_id ON order_add_ons(order_id);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS driver_route_expenses;
@@ -0,0 +1,18 @@
+-- Mileage and tolls drivers log against their routes
+CREATE TABLE driver_route_expenses (
+    id SERIAL PRIMARY KEY,
+    driver_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    route_id INTEGER NOT NULL REFERENCES driver_routes(id) ON DELETE CASCADE,
+    expense_type VARCHAR(20) NOT NULL CHECK (expense_type IN ('mileage', 'toll')),
+    miles DECIMAL(8,1), -- Mileage entries only
+    rate_cents_per_mile INTEGER, -- Reimbursement rate when the mileage was logged
+    amount_cents INTEGER NOT NULL CHECK (amount_cents >= 0),
+    description TEXT,
+    receipt_path TEXT,
+    receipt_content_type VARCHAR(100),
+    incurred_on DATE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_driver_route_expenses_driver ON driver_route_expenses(driver_id, incurred_on);
+CREATE INDEX idx_driver_route_expenses_route ON driver_route_expenses(route_id);
@@ -0,0 +1,17 @@
+-- Versioned history of customer addresses and profile fields
+CREATE TABLE account_change_history (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- Account the data belongs to
+    entity_type VARCHAR(20) NOT NULL CHECK (entity_type IN ('address', 'profile')),
+    entity_id INTEGER NOT NULL,
+    change_type VARCHAR(20) NOT NULL CHECK (change_type IN ('created', 'updated', 'deleted')),
+    changed_fields TEXT[] NOT NULL DEFAULT '{}',
+    before_data JSONB,
+    after_data JSONB,
+    changed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    changed_by_role VARCHAR(20), -- Editor's role at the time of the change
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_account_change_history_user ON account_change_history(user_id, created_at DESC);
+CREATE INDEX idx_account_change_history_entity ON account_change_history(entity_type, entity_id, created_at);
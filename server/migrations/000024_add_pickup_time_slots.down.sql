@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_orders_pickup_slot;
+DROP TABLE IF EXISTS pickup_time_slots;
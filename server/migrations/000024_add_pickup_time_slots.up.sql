@@ -0,0 +1,15 @@
+-- Pickup windows and how many pickups each can take per day. Orders for
+-- windows not listed here aren't capacity limited.
+CREATE TABLE pickup_time_slots (
+    time_slot VARCHAR(50) PRIMARY KEY, -- Matches orders.pickup_time_slot
+    capacity INTEGER NOT NULL CHECK (capacity >= 0),
+    sort_order INTEGER NOT NULL DEFAULT 0,
+    is_active BOOLEAN DEFAULT TRUE
+);
+
+INSERT INTO pickup_time_slots (time_slot, capacity, sort_order) VALUES
+('9am-12pm', 20, 1),
+('12pm-3pm', 20, 2),
+('3pm-6pm', 20, 3);
+
+CREATE INDEX idx_orders_pickup_slot ON orders(pickup_date, pickup_time_slot) WHERE status != 'cancelled';
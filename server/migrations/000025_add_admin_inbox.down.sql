@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS admin_inbox_reads;
+DROP TABLE IF EXISTS admin_inbox_items;
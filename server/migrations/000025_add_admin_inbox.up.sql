@@ -0,0 +1,36 @@
+-- Operational alerts that need an admin to look at them
+CREATE TABLE admin_inbox_items (
+    id SERIAL PRIMARY KEY,
+    alert_type VARCHAR(50) NOT NULL, -- 'order_failed', 'payment_dispute', 'stuck_webhook', 'driver_no_show', etc.
+    severity VARCHAR(20) NOT NULL DEFAULT 'warning' CHECK (severity IN ('info', 'warning', 'critical')),
+    title VARCHAR(255) NOT NULL,
+    message TEXT NOT NULL,
+    data JSONB,
+    order_id INTEGER REFERENCES orders(id) ON DELETE SET NULL,
+    -- The same event raised twice while still unresolved is only kept once
+    dedupe_key VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'acknowledged', 'resolved')),
+    assigned_to INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    acknowledged_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    acknowledged_at TIMESTAMP WITH TIME ZONE,
+    resolved_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    resolution_note TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Read state is per admin so each one has their own unread count
+CREATE TABLE admin_inbox_reads (
+    item_id INTEGER REFERENCES admin_inbox_items(id) ON DELETE CASCADE,
+    admin_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    read_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (item_id, admin_id)
+);
+
+CREATE UNIQUE INDEX idx_admin_inbox_items_dedupe ON admin_inbox_items(dedupe_key) WHERE status <> 'resolved';
+CREATE INDEX idx_admin_inbox_items_status ON admin_inbox_items(status, created_at DESC);
+CREATE INDEX idx_admin_inbox_items_assigned_to ON admin_inbox_items(assigned_to) WHERE status <> 'resolved';
+
+CREATE TRIGGER update_admin_inbox_items_updated_at BEFORE UPDATE ON admin_inbox_items
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
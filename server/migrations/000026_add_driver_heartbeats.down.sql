@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_driver_routes_in_progress;
+ALTER TABLE driver_routes DROP COLUMN IF EXISTS stale_since;
+DROP TABLE IF EXISTS driver_heartbeats;
@@ -0,0 +1,14 @@
+-- Last sign of life from each driver's app
+CREATE TABLE driver_heartbeats (
+    driver_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    route_id INTEGER REFERENCES driver_routes(id) ON DELETE SET NULL,
+    latitude DECIMAL(10, 8),
+    longitude DECIMAL(11, 8),
+    app_version VARCHAR(50),
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Set while an in-progress route's driver has gone silent; its pending stops are at risk
+ALTER TABLE driver_routes ADD COLUMN stale_since TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX idx_driver_routes_in_progress ON driver_routes(driver_id) WHERE status = 'in_progress';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS subscription_adjustments;
+DROP TABLE IF EXISTS subscription_adjustment_batches;
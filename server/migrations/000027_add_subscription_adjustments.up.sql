@@ -0,0 +1,40 @@
+-- One admin run of the bulk adjustment tool, e.g. crediting everyone hit by an outage
+CREATE TABLE subscription_adjustment_batches (
+    id SERIAL PRIMARY KEY,
+    incident_key VARCHAR(100) NOT NULL,
+    reason TEXT NOT NULL,
+    adjustment_type VARCHAR(20) NOT NULL CHECK (adjustment_type IN ('credit', 'extend_period')),
+    credit_cents INTEGER,
+    extend_days INTEGER,
+    filter JSONB NOT NULL, -- The order filter used to pick subscribers
+    affected_count INTEGER NOT NULL DEFAULT 0,
+    applied_count INTEGER NOT NULL DEFAULT 0,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    skipped_count INTEGER NOT NULL DEFAULT 0,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- What happened to each subscription in a batch
+CREATE TABLE subscription_adjustments (
+    id SERIAL PRIMARY KEY,
+    batch_id INTEGER NOT NULL REFERENCES subscription_adjustment_batches(id) ON DELETE CASCADE,
+    incident_key VARCHAR(100) NOT NULL,
+    subscription_id INTEGER NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    adjustment_type VARCHAR(20) NOT NULL CHECK (adjustment_type IN ('credit', 'extend_period')),
+    credit_cents INTEGER,
+    extend_days INTEGER,
+    previous_period_end DATE,
+    new_period_end DATE,
+    stripe_balance_transaction_id VARCHAR(255),
+    status VARCHAR(20) NOT NULL CHECK (status IN ('pending', 'applied', 'failed', 'skipped')),
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A subscriber is only compensated once per incident; failed attempts can be retried
+CREATE UNIQUE INDEX idx_subscription_adjustments_once_per_incident
+    ON subscription_adjustments(incident_key, subscription_id) WHERE status IN ('pending', 'applied');
+CREATE INDEX idx_subscription_adjustments_batch_id ON subscription_adjustments(batch_id);
+CREATE INDEX idx_subscription_adjustments_user_id ON subscription_adjustments(user_id);
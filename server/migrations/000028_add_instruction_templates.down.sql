@@ -0,0 +1,5 @@
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS instruction_template_id,
+    DROP COLUMN IF EXISTS delivery_instructions;
+
+DROP TABLE IF EXISTS delivery_instruction_templates;
@@ -0,0 +1,23 @@
+-- Named delivery instruction sets a customer can pick at checkout,
+-- e.g. "Weekday: leave with doorman" or "Weekend: ring bell"
+CREATE TABLE delivery_instruction_templates (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    instructions TEXT NOT NULL,
+    is_default BOOLEAN DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, name)
+);
+
+CREATE INDEX idx_delivery_instruction_templates_user ON delivery_instruction_templates(user_id);
+
+CREATE TRIGGER update_delivery_instruction_templates_updated_at BEFORE UPDATE ON delivery_instruction_templates
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- The chosen template's text is copied onto the order so later edits don't
+-- change what the driver sees for orders already placed
+ALTER TABLE orders
+    ADD COLUMN delivery_instructions TEXT,
+    ADD COLUMN instruction_template_id INTEGER REFERENCES delivery_instruction_templates(id) ON DELETE SET NULL;
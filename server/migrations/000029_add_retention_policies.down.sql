@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS retention_purge_runs;
+DROP TABLE IF EXISTS retention_policies;
@@ -0,0 +1,36 @@
+-- How long each kind of personal or transient data is kept. The purge each
+-- policy performs is defined in code (retention.go); only the window and
+-- whether it runs are configurable.
+CREATE TABLE retention_policies (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT NOT NULL,
+    retain_days INTEGER NOT NULL CHECK (retain_days > 0),
+    is_enabled BOOLEAN NOT NULL DEFAULT true,
+    updated_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_retention_policies_updated_at BEFORE UPDATE ON retention_policies
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+INSERT INTO retention_policies (name, description, retain_days) VALUES
+    ('driver_locations', 'Clear the last reported GPS position of drivers who have not checked in since', 30),
+    ('notifications', 'Delete customer notifications', 90),
+    ('cancelled_drafts', 'Delete cancelled orders that were never paid for or picked up', 7),
+    ('expired_sessions', 'Delete login sessions after they expire', 7);
+
+-- One row per policy per purge run; the admin retention report and
+-- per-policy metrics are read from here
+CREATE TABLE retention_purge_runs (
+    id SERIAL PRIMARY KEY,
+    policy_name VARCHAR(50) NOT NULL REFERENCES retention_policies(name) ON DELETE CASCADE,
+    cutoff TIMESTAMP WITH TIME ZONE NOT NULL,
+    purged_count INTEGER NOT NULL DEFAULT 0,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('succeeded', 'failed')),
+    error TEXT,
+    triggered_by INTEGER REFERENCES users(id) ON DELETE SET NULL, -- NULL for the scheduled job
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_retention_purge_runs_policy ON retention_purge_runs(policy_name, created_at DESC);
@@ -0,0 +1,7 @@
+-- Nonces from signed user sync requests, kept just long enough to reject replays
+CREATE TABLE user_sync_nonces (
+    nonce VARCHAR(100) PRIMARY KEY,
+    received_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_user_sync_nonces_received_at ON user_sync_nonces(received_at);
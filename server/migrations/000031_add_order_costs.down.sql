@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS order_costs;
+DROP TABLE IF EXISTS cost_rates;
@@ -0,0 +1,33 @@
+-- Unit costs used to estimate what an order costs us to fulfil. Driver pay
+-- is not here: it follows the driver commission defined in code.
+CREATE TABLE cost_rates (
+    name VARCHAR(50) PRIMARY KEY,
+    description TEXT NOT NULL,
+    cost_cents INTEGER NOT NULL CHECK (cost_cents >= 0),
+    updated_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_cost_rates_updated_at BEFORE UPDATE ON cost_rates
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+INSERT INTO cost_rates (name, description, cost_cents) VALUES
+    ('facility_per_bag', 'Facility labor, water and energy to wash, dry and fold one bag', 900),
+    ('facility_per_garment', 'Facility cost to dry clean and press one garment', 250),
+    ('supplies_per_bag', 'Detergent, softener and a replacement bag liner', 150),
+    ('supplies_per_garment', 'Hanger, poly cover and cleaning solvent per garment', 60);
+
+-- Estimated costs per delivered order, snapshotted at the rates in effect
+-- when it was costed so later rate changes don't rewrite history
+CREATE TABLE order_costs (
+    order_id INTEGER PRIMARY KEY REFERENCES orders(id) ON DELETE CASCADE,
+    order_type VARCHAR(20) NOT NULL CHECK (order_type IN ('standard', 'rush', 'dry_cleaning')),
+    revenue_cents INTEGER NOT NULL,
+    driver_pay_cents INTEGER NOT NULL,
+    facility_cents INTEGER NOT NULL,
+    supplies_cents INTEGER NOT NULL,
+    total_cost_cents INTEGER NOT NULL,
+    computed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_order_costs_order_type ON order_costs(order_type);
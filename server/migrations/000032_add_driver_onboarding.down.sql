@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS driver_onboarding_progress;
+DROP TABLE IF EXISTS driver_onboarding_steps;
@@ -0,0 +1,33 @@
+-- Checklist every new driver works through before they can be put on a
+-- route. owner is who marks the step done: the driver themselves, or an
+-- admin confirming it happened.
+CREATE TABLE driver_onboarding_steps (
+    step VARCHAR(50) PRIMARY KEY,
+    title VARCHAR(100) NOT NULL,
+    description TEXT NOT NULL,
+    owner VARCHAR(20) NOT NULL CHECK (owner IN ('driver', 'admin')),
+    sort_order INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO driver_onboarding_steps (step, title, description, owner, sort_order) VALUES
+    ('training_video', 'Watch the training video', 'Watch the driver training video and acknowledge the handling and safety guidelines', 'driver', 1),
+    ('bag_kit_issued', 'Bag kit issued', 'Collect a starter kit of bags, tags and a manifest clipboard from the facility', 'admin', 2),
+    ('shadow_route', 'Shadow route completed', 'Ride along on one full route with an experienced driver', 'admin', 3);
+
+CREATE TABLE driver_onboarding_progress (
+    id SERIAL PRIMARY KEY,
+    driver_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    step VARCHAR(50) NOT NULL REFERENCES driver_onboarding_steps(step) ON DELETE CASCADE,
+    completed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    notes TEXT,
+    completed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(driver_id, step)
+);
+
+CREATE INDEX idx_driver_onboarding_progress_driver_id ON driver_onboarding_progress(driver_id);
+
+-- Drivers already on the road are grandfathered in
+INSERT INTO driver_onboarding_progress (driver_id, step, notes)
+SELECT u.id, s.step, 'Onboarded before the checklist existed'
+FROM users u CROSS JOIN driver_onboarding_steps s
+WHERE u.role = 'driver';
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_users_invite_code_id;
+ALTER TABLE users DROP COLUMN IF EXISTS signup_zip;
+ALTER TABLE users DROP COLUMN IF EXISTS invite_code_id;
+DROP TABLE IF EXISTS invite_codes;
+DROP TABLE IF EXISTS launch_markets;
@@ -0,0 +1,36 @@
+-- Markets in soft launch. Signing up with a ZIP in an invite-only market
+-- needs an invite code; markets not listed here are open.
+CREATE TABLE launch_markets (
+    market VARCHAR(3) PRIMARY KEY, -- 3-digit ZIP prefix
+    invite_only BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_launch_markets_updated_at BEFORE UPDATE ON launch_markets
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE invite_codes (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(32) NOT NULL UNIQUE,
+    market VARCHAR(3), -- NULL means the code works in any market
+    label VARCHAR(100), -- Campaign or partner the code was handed to
+    max_uses INTEGER CHECK (max_uses > 0), -- NULL means unlimited
+    use_count INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_invite_codes_market ON invite_codes(market);
+
+CREATE TRIGGER update_invite_codes_updated_at BEFORE UPDATE ON invite_codes
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Which code brought each user in, and the ZIP they signed up from
+ALTER TABLE users ADD COLUMN invite_code_id INTEGER REFERENCES invite_codes(id) ON DELETE SET NULL;
+ALTER TABLE users ADD COLUMN signup_zip VARCHAR(10);
+
+CREATE INDEX idx_users_invite_code_id ON users(invite_code_id);
@@ -0,0 +1,3 @@
+-- Covers the ops wallboard feed (id > $1 ORDER BY id) so each poll is an
+-- index-only scan that never touches the heap
+CREATE INDEX idx_order_status_history_feed ON order_status_history (id) INCLUDE (order_id, status, created_at);
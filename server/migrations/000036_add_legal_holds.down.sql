@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS legal_hold_audit;
+DROP TABLE IF EXISTS legal_holds;
@@ -0,0 +1,28 @@
+-- Accounts under legal hold are skipped by retention purges and can't be
+-- deleted until the hold is released. Released holds are kept for the record.
+CREATE TABLE legal_holds (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    reason TEXT NOT NULL, -- Case, subpoena or dispute reference
+    placed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    placed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    released_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    released_at TIMESTAMP WITH TIME ZONE
+);
+
+-- One active hold per account
+CREATE UNIQUE INDEX idx_legal_holds_active ON legal_holds(user_id) WHERE released_at IS NULL;
+
+-- Every hold placed or released and every export taken
+CREATE TABLE legal_hold_audit (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL, -- No FK so the trail outlives the account
+    hold_id INTEGER REFERENCES legal_holds(id) ON DELETE SET NULL,
+    action VARCHAR(20) NOT NULL CHECK (action IN ('placed', 'released', 'exported')),
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    details TEXT,
+    ip_address VARCHAR(64),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_legal_hold_audit_user ON legal_hold_audit(user_id, created_at DESC);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS route_breaks;
+ALTER TABLE driver_routes DROP COLUMN IF EXISTS jurisdiction;
+DROP TABLE IF EXISTS break_policies;
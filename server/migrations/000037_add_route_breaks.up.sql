@@ -0,0 +1,40 @@
+-- Labor rules for driver breaks, per jurisdiction. Route schedules place
+-- breaks to satisfy them and the compliance report checks shifts against them.
+CREATE TABLE break_policies (
+    jurisdiction VARCHAR(20) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    max_continuous_minutes INTEGER NOT NULL CHECK (max_continuous_minutes > 0), -- Longest stretch of work without a rest break
+    rest_break_minutes INTEGER NOT NULL CHECK (rest_break_minutes > 0),
+    meal_after_minutes INTEGER NOT NULL CHECK (meal_after_minutes > 0), -- A meal break must start within this much work
+    meal_break_minutes INTEGER NOT NULL CHECK (meal_break_minutes > 0),
+    max_shift_minutes INTEGER NOT NULL CHECK (max_shift_minutes > 0),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_break_policies_updated_at BEFORE UPDATE ON break_policies
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+INSERT INTO break_policies (jurisdiction, name, max_continuous_minutes, rest_break_minutes, meal_after_minutes, meal_break_minutes, max_shift_minutes) VALUES
+    ('default', 'Company default', 240, 15, 300, 30, 600),
+    ('CA', 'California', 240, 10, 300, 30, 720);
+
+-- Routes without a jurisdiction use the default policy
+ALTER TABLE driver_routes ADD COLUMN jurisdiction VARCHAR(20) REFERENCES break_policies(jurisdiction);
+
+CREATE TABLE route_breaks (
+    id SERIAL PRIMARY KEY,
+    route_id INTEGER NOT NULL REFERENCES driver_routes(id) ON DELETE CASCADE,
+    after_sequence INTEGER NOT NULL CHECK (after_sequence >= 0), -- Taken after this stop; 0 is before the first
+    break_type VARCHAR(10) NOT NULL CHECK (break_type IN ('rest', 'meal')),
+    duration_minutes INTEGER NOT NULL CHECK (duration_minutes > 0),
+    auto_inserted BOOLEAN NOT NULL DEFAULT FALSE, -- Placed by the scheduler, and replaced when it reruns
+    estimated_start TIME,
+    actual_start TIMESTAMP WITH TIME ZONE,
+    actual_end TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_route_breaks_route_id ON route_breaks(route_id);
+-- A driver can only be on one break at a time
+CREATE UNIQUE INDEX idx_route_breaks_open ON route_breaks(route_id) WHERE actual_start IS NOT NULL AND actual_end IS NULL;
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_sessions_previous_token_hash;
+DROP INDEX IF EXISTS idx_sessions_user_id;
+ALTER TABLE sessions DROP CONSTRAINT IF EXISTS sessions_user_id_fkey;
+ALTER TABLE sessions DROP COLUMN IF EXISTS revoked_at;
+ALTER TABLE sessions DROP COLUMN IF EXISTS last_used_at;
+ALTER TABLE sessions DROP COLUMN IF EXISTS ip_address;
+ALTER TABLE sessions DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE sessions DROP COLUMN IF EXISTS previous_token_hash;
+ALTER TABLE sessions DROP COLUMN IF EXISTS refresh_token_hash;
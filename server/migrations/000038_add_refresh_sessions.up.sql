@@ -0,0 +1,15 @@
+-- Login sessions. Each login starts one; its refresh token rotates on every
+-- use and the access tokens it issues carry the session's id, so revoking
+-- the session logs that device out.
+ALTER TABLE sessions ADD COLUMN refresh_token_hash VARCHAR(64) UNIQUE; -- SHA-256 of the current refresh token
+ALTER TABLE sessions ADD COLUMN previous_token_hash VARCHAR(64); -- The token it replaced; seeing it again means it leaked
+ALTER TABLE sessions ADD COLUMN user_agent TEXT;
+ALTER TABLE sessions ADD COLUMN ip_address VARCHAR(64);
+ALTER TABLE sessions ADD COLUMN last_used_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE sessions ADD COLUMN revoked_at TIMESTAMP WITH TIME ZONE;
+
+DELETE FROM sessions WHERE user_id NOT IN (SELECT id FROM users);
+ALTER TABLE sessions ADD CONSTRAINT sessions_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX idx_sessions_previous_token_hash ON sessions(previous_token_hash);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS driver_stats_summary;
+DROP TABLE IF EXISTS order_ratings;
@@ -0,0 +1,29 @@
+-- Customer ratings of delivered orders, credited to the driver who made the
+-- last completed stop for the order
+CREATE TABLE order_ratings (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL UNIQUE REFERENCES orders(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    driver_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    rating SMALLINT NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    comment TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_order_ratings_driver_id ON order_ratings(driver_id);
+
+-- Per-driver stats for the admin dashboard, refreshed in the background and
+-- whenever a route is completed or an order rated. stats_date is the day
+-- today_deliveries and the monthly expense totals were counted for.
+CREATE TABLE driver_stats_summary (
+    driver_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    total_deliveries INTEGER NOT NULL DEFAULT 0,
+    today_deliveries INTEGER NOT NULL DEFAULT 0,
+    avg_delivery_minutes DECIMAL(8,2),
+    rating DECIMAL(3,2),
+    rating_count INTEGER NOT NULL DEFAULT 0,
+    expense_cents_this_month INTEGER NOT NULL DEFAULT 0,
+    miles_this_month DECIMAL(10,2) NOT NULL DEFAULT 0,
+    stats_date DATE NOT NULL DEFAULT CURRENT_DATE,
+    refreshed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,18 @@
+-- Append-only ledger of customer credit. The balance is the sum of a user's
+-- entries: grants and resolution credits are positive, redemptions at
+-- checkout and downward adjustments negative. created_by is the admin behind
+-- manual entries, which makes the ledger its own audit trail.
+CREATE TABLE customer_credit_ledger (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount_cents INTEGER NOT NULL CHECK (amount_cents <> 0),
+    entry_type VARCHAR(20) NOT NULL CHECK (entry_type IN ('grant', 'adjustment', 'resolution', 'redemption', 'reversal')),
+    order_id INTEGER REFERENCES orders(id) ON DELETE SET NULL,
+    resolution_id INTEGER REFERENCES order_resolutions(id) ON DELETE SET NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_customer_credit_ledger_user_id ON customer_credit_ledger(user_id, created_at DESC);
+CREATE INDEX idx_customer_credit_ledger_order_id ON customer_credit_ledger(order_id);
@@ -0,0 +1,6 @@
+UPDATE payments SET status = 'completed' WHERE status = 'partially_refunded';
+ALTER TABLE payments DROP CONSTRAINT payments_status_check;
+ALTER TABLE payments ADD CONSTRAINT payments_status_check
+    CHECK (status IN ('pending', 'completed', 'failed', 'refunded'));
+
+DROP TABLE IF EXISTS refunds;
@@ -0,0 +1,27 @@
+-- Stripe refunds issued against payments. A row is written as 'pending'
+-- before Stripe is called so a refund can't be issued twice, then follows
+-- the Stripe refund's status via webhooks.
+CREATE TABLE refunds (
+    id SERIAL PRIMARY KEY,
+    payment_id INTEGER NOT NULL REFERENCES payments(id) ON DELETE CASCADE,
+    order_id INTEGER REFERENCES orders(id) ON DELETE SET NULL,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    resolution_id INTEGER REFERENCES order_resolutions(id) ON DELETE SET NULL,
+    amount_cents INTEGER NOT NULL CHECK (amount_cents > 0),
+    reason TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN (
+        'pending', 'requires_action', 'succeeded', 'failed', 'canceled'
+    )),
+    stripe_refund_id VARCHAR(255) UNIQUE,
+    failure_reason TEXT,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_refunds_payment_id ON refunds(payment_id);
+CREATE INDEX idx_refunds_order_id ON refunds(order_id);
+
+ALTER TABLE payments DROP CONSTRAINT payments_status_check;
+ALTER TABLE payments ADD CONSTRAINT payments_status_check
+    CHECK (status IN ('pending', 'completed', 'failed', 'refunded', 'partially_refunded'));
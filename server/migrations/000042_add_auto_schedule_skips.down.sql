@@ -0,0 +1,3 @@
+ALTER TABLE orders DROP COLUMN IF EXISTS auto_scheduled;
+ALTER TABLE subscription_preferences DROP COLUMN IF EXISTS auto_schedule_paused_until;
+DROP TABLE IF EXISTS auto_schedule_skips;
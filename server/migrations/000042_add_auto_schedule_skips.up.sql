@@ -0,0 +1,14 @@
+-- Let customers skip single auto-scheduled pickups or pause auto-scheduling
+-- until a date, without turning it off and losing their preferences
+CREATE TABLE auto_schedule_skips (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    pickup_date DATE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, pickup_date)
+);
+
+ALTER TABLE subscription_preferences ADD COLUMN auto_schedule_paused_until DATE;
+
+-- Orders the scheduler created, so skipping a date can cancel the one it made
+ALTER TABLE orders ADD COLUMN auto_scheduled BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS delivery_signatures;
+ALTER TABLE users DROP COLUMN IF EXISTS requires_delivery_signature;
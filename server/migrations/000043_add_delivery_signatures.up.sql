@@ -0,0 +1,18 @@
+-- Commercial accounts can require a signature on delivery. The signature is
+-- the stop's proof of delivery and is shown on the order's receipt.
+ALTER TABLE users ADD COLUMN requires_delivery_signature BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE delivery_signatures (
+    id SERIAL PRIMARY KEY,
+    route_order_id INTEGER NOT NULL UNIQUE REFERENCES route_orders(id) ON DELETE CASCADE,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    driver_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    signer_name VARCHAR(255) NOT NULL,
+    storage_key VARCHAR(512) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    strokes JSONB,
+    signed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_delivery_signatures_order_id ON delivery_signatures(order_id);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS blocklist_appeals;
+DROP TABLE IF EXISTS blocklist_entries;
+DROP TABLE IF EXISTS safety_reports;
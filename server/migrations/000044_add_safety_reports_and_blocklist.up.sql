@@ -0,0 +1,53 @@
+-- Drivers report unsafe situations at a stop; admins review them and can
+-- block the customer or the address from future orders
+CREATE TABLE safety_reports (
+    id SERIAL PRIMARY KEY,
+    driver_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    route_order_id INTEGER REFERENCES route_orders(id) ON DELETE SET NULL,
+    order_id INTEGER REFERENCES orders(id) ON DELETE SET NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL, -- The customer at the stop
+    address_key VARCHAR(400),
+    category VARCHAR(30) NOT NULL CHECK (category IN ('aggressive_person', 'dangerous_animal', 'unsafe_premises', 'harassment', 'other')),
+    description TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'dismissed', 'actioned')),
+    review_notes TEXT,
+    reviewed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reviewed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_safety_reports_status ON safety_reports(status, created_at DESC);
+
+-- A block covers a customer, a physical address (matched on the normalized
+-- street and ZIP so it applies whoever saves it), or both. Lifted blocks are
+-- kept for the record.
+CREATE TABLE blocklist_entries (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    address_key VARCHAR(400),
+    address_label VARCHAR(400),
+    reason TEXT NOT NULL,
+    report_id INTEGER REFERENCES safety_reports(id) ON DELETE SET NULL,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    lifted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    lifted_at TIMESTAMP WITH TIME ZONE,
+    lift_reason TEXT,
+    CHECK (user_id IS NOT NULL OR address_key IS NOT NULL)
+);
+
+CREATE INDEX idx_blocklist_entries_user ON blocklist_entries(user_id) WHERE lifted_at IS NULL;
+CREATE INDEX idx_blocklist_entries_address ON blocklist_entries(address_key) WHERE lifted_at IS NULL;
+
+-- Customers can appeal a block once; an approved appeal lifts it
+CREATE TABLE blocklist_appeals (
+    id SERIAL PRIMARY KEY,
+    entry_id INTEGER NOT NULL UNIQUE REFERENCES blocklist_entries(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    message TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'denied')),
+    response TEXT,
+    reviewed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reviewed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
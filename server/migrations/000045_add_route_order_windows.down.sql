@@ -0,0 +1,2 @@
+ALTER TABLE route_orders DROP COLUMN IF EXISTS window_end;
+ALTER TABLE route_orders DROP COLUMN IF EXISTS window_start;
@@ -0,0 +1,4 @@
+-- The arrival window the customer was last told for each stop, so
+-- rescheduling a route only notifies customers whose window moved
+ALTER TABLE route_orders ADD COLUMN window_start TIME;
+ALTER TABLE route_orders ADD COLUMN window_end TIME;
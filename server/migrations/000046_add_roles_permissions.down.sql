@@ -0,0 +1,6 @@
+ALTER TABLE users DROP CONSTRAINT users_role_fkey;
+UPDATE users SET role = 'customer' WHERE role NOT IN ('customer', 'driver', 'admin');
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('customer', 'driver', 'admin'));
+
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,25 @@
+-- Roles are now rows rather than a fixed list. The built-in customer, driver
+-- and admin roles can't be edited or removed; admins get every permission
+-- implicitly, while custom staff roles (dispatcher, support agent, ...) get
+-- only the permissions granted to them.
+CREATE TABLE roles (
+    name VARCHAR(20) PRIMARY KEY CHECK (name ~ '^[a-z][a-z0-9_]*$'),
+    description TEXT NOT NULL DEFAULT '',
+    built_in BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO roles (name, description, built_in) VALUES
+    ('customer', 'Places and manages their own orders', TRUE),
+    ('driver', 'Runs pickup and delivery routes', TRUE),
+    ('admin', 'Full access to everything', TRUE);
+
+CREATE TABLE role_permissions (
+    role VARCHAR(20) NOT NULL REFERENCES roles(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    permission VARCHAR(50) NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+
+ALTER TABLE users DROP CONSTRAINT users_role_check;
+ALTER TABLE users ADD CONSTRAINT users_role_fkey FOREIGN KEY (role) REFERENCES roles(name) ON UPDATE CASCADE;
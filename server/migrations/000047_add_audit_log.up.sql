@@ -0,0 +1,23 @@
+-- Every write made through an admin route, successful or not. Targets are
+-- stored as text rather than foreign keys so the trail outlives them.
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    actor_role VARCHAR(20), -- Actor's role at the time
+    action VARCHAR(200) NOT NULL, -- Method and route, e.g. 'PUT /admin/users/{id}/role'
+    path TEXT NOT NULL,
+    target_type VARCHAR(50),
+    target_id VARCHAR(100),
+    status_code INTEGER NOT NULL,
+    request_body JSONB, -- Secrets are redacted
+    before_data JSONB,
+    after_data JSONB,
+    changed_fields TEXT[] NOT NULL DEFAULT '{}',
+    ip_address VARCHAR(64),
+    user_agent TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_audit_log_created_at ON audit_log(created_at DESC);
+CREATE INDEX idx_audit_log_actor ON audit_log(actor_id, created_at DESC);
+CREATE INDEX idx_audit_log_target ON audit_log(target_type, target_id, created_at DESC);
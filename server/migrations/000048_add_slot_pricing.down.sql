@@ -0,0 +1,7 @@
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS slot_adjustment_cents,
+    DROP COLUMN IF EXISTS slot_multiplier_percent,
+    DROP COLUMN IF EXISTS slot_price_label,
+    DROP COLUMN IF EXISTS slot_price_rule_id;
+
+DROP TABLE IF EXISTS slot_price_rules;
@@ -0,0 +1,25 @@
+-- Peak and off-peak pricing by pickup slot and day of week. The multiplier
+-- applies to an order's services and garments; add-ons and tips are left
+-- alone. When several rules match, the most specific one wins.
+CREATE TABLE slot_price_rules (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL, -- Shown on receipts, e.g. "Sunday evening peak"
+    day_of_week SMALLINT CHECK (day_of_week BETWEEN 0 AND 6), -- 0 = Sunday; NULL matches every day
+    time_slot VARCHAR(50) REFERENCES pickup_time_slots(time_slot) ON UPDATE CASCADE ON DELETE CASCADE, -- NULL matches every slot
+    multiplier_percent INTEGER NOT NULL CHECK (multiplier_percent > 0 AND multiplier_percent <= 300 AND multiplier_percent != 100),
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (day_of_week IS NOT NULL OR time_slot IS NOT NULL)
+);
+
+-- Only one active rule per day/slot combination so the match is unambiguous
+CREATE UNIQUE INDEX idx_slot_price_rules_match ON slot_price_rules (COALESCE(day_of_week, -1), COALESCE(time_slot, ''))
+    WHERE is_active = true;
+
+-- The adjustment an order was sold with, kept even if the rule changes later
+ALTER TABLE orders
+    ADD COLUMN slot_price_rule_id INTEGER REFERENCES slot_price_rules(id) ON DELETE SET NULL,
+    ADD COLUMN slot_price_label VARCHAR(100),
+    ADD COLUMN slot_multiplier_percent INTEGER,
+    ADD COLUMN slot_adjustment_cents INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,19 @@
+-- Critical order updates published over Centrifuge, so we can tell whether
+-- the customer's app received them. Updates not acknowledged in time are
+-- sent again as a notification.
+CREATE TABLE realtime_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    event_id VARCHAR(64) NOT NULL UNIQUE, -- Sent as event_id; the app acks it back over RPC
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE,
+    status VARCHAR(50) NOT NULL,
+    message TEXT NOT NULL,
+    published_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    acked_at TIMESTAMP WITH TIME ZONE,
+    fallback_at TIMESTAMP WITH TIME ZONE,
+    fallback_notification_id INTEGER REFERENCES notifications(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_realtime_deliveries_unacked ON realtime_deliveries(published_at)
+    WHERE acked_at IS NULL AND fallback_at IS NULL;
+CREATE INDEX idx_realtime_deliveries_published_at ON realtime_deliveries(published_at);
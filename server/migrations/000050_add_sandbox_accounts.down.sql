@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS set_notification_test ON notifications;
+DROP TRIGGER IF EXISTS set_order_sandbox ON orders;
+DROP FUNCTION IF EXISTS set_notification_test();
+DROP FUNCTION IF EXISTS set_order_sandbox();
+ALTER TABLE notifications DROP COLUMN IF EXISTS is_test;
+ALTER TABLE orders DROP COLUMN IF EXISTS is_sandbox;
+ALTER TABLE users DROP COLUMN IF EXISTS is_sandbox;
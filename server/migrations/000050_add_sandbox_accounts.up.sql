@@ -0,0 +1,32 @@
+-- Sandbox accounts are for demos, QA and partner integration testing. Their
+-- orders never reach Stripe and everything they generate can be purged.
+ALTER TABLE users ADD COLUMN is_sandbox BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE orders ADD COLUMN is_sandbox BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE notifications ADD COLUMN is_test BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX idx_users_sandbox ON users(id) WHERE is_sandbox;
+CREATE INDEX idx_orders_sandbox ON orders(id) WHERE is_sandbox;
+CREATE INDEX idx_notifications_test ON notifications(id) WHERE is_test;
+
+-- Orders and notifications are created in many places; stamp them from the
+-- account on insert so none of them can forget
+CREATE OR REPLACE FUNCTION set_order_sandbox()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.is_sandbox = COALESCE((SELECT is_sandbox FROM users WHERE id = NEW.user_id), false);
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE FUNCTION set_notification_test()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.is_test = COALESCE((SELECT is_sandbox FROM users WHERE id = NEW.user_id), false);
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE TRIGGER set_order_sandbox BEFORE INSERT ON orders
+    FOR EACH ROW EXECUTE FUNCTION set_order_sandbox();
+CREATE TRIGGER set_notification_test BEFORE INSERT ON notifications
+    FOR EACH ROW EXECUTE FUNCTION set_notification_test();
@@ -0,0 +1,3 @@
+ALTER TABLE addresses DROP COLUMN IF EXISTS geocoded_at;
+ALTER TABLE addresses DROP COLUMN IF EXISTS longitude;
+ALTER TABLE addresses DROP COLUMN IF EXISTS latitude;
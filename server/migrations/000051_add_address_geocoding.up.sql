@@ -0,0 +1,5 @@
+-- Coordinates for route optimization, filled in by the geocoder the first
+-- time an address is routed and cleared whenever the address is edited
+ALTER TABLE addresses ADD COLUMN latitude DECIMAL(10, 8);
+ALTER TABLE addresses ADD COLUMN longitude DECIMAL(11, 8);
+ALTER TABLE addresses ADD COLUMN geocoded_at TIMESTAMP WITH TIME ZONE;
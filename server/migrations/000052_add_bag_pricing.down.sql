@@ -0,0 +1,8 @@
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS overweight_cents;
+
+ALTER TABLE order_items
+    DROP COLUMN IF EXISTS overweight_cents_per_pound,
+    DROP COLUMN IF EXISTS included_pounds;
+
+DROP TABLE IF EXISTS bag_pricing;
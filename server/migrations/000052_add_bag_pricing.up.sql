@@ -0,0 +1,33 @@
+-- Bag sizes with their price, included weight and overweight rate, per
+-- market (3-digit ZIP prefix, as with add-ons). A row without a market is the
+-- default for markets that don't have their own.
+CREATE TABLE bag_pricing (
+    id SERIAL PRIMARY KEY,
+    service_id INTEGER NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+    market VARCHAR(3) CHECK (market ~ '^[0-9]{3}$'), -- NULL is the default
+    size_label VARCHAR(100) NOT NULL, -- Shown to customers, e.g. "Standard bag (22x33)"
+    price_cents INTEGER NOT NULL CHECK (price_cents >= 0),
+    included_pounds DECIMAL(6,2) NOT NULL CHECK (included_pounds > 0),
+    overweight_cents_per_pound INTEGER NOT NULL DEFAULT 0 CHECK (overweight_cents_per_pound >= 0),
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX idx_bag_pricing_market ON bag_pricing (service_id, COALESCE(market, ''));
+
+-- Today's bags become the defaults, at their current price with no
+-- overweight charge until one is set
+INSERT INTO bag_pricing (service_id, size_label, price_cents, included_pounds)
+SELECT id, 'Standard bag (22"x33")', base_price_cents, 20
+FROM services WHERE name IN ('standard_bag', 'additional_bag');
+
+-- The terms a bag was sold with, so weighing it later uses them even if the
+-- market's pricing has changed since
+ALTER TABLE order_items
+    ADD COLUMN included_pounds DECIMAL(6,2),
+    ADD COLUMN overweight_cents_per_pound INTEGER;
+
+-- Set once the driver weighs the bags at pickup
+ALTER TABLE orders
+    ADD COLUMN overweight_cents INTEGER NOT NULL DEFAULT 0;
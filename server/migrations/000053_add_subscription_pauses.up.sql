@@ -0,0 +1,16 @@
+-- Each time a subscription is paused, closed when it's resumed or cancelled,
+-- so customers can see their pause history
+CREATE TABLE subscription_pauses (
+    id SERIAL PRIMARY KEY,
+    subscription_id INTEGER NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    paused_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    resumed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_subscription_pauses_subscription ON subscription_pauses(subscription_id, paused_at);
+-- At most one open pause per subscription
+CREATE UNIQUE INDEX idx_subscription_pauses_open ON subscription_pauses(subscription_id) WHERE resumed_at IS NULL;
+
+-- Subscriptions paused today started their pause at their last update
+INSERT INTO subscription_pauses (subscription_id, paused_at)
+SELECT id, updated_at FROM subscriptions WHERE status = 'paused';
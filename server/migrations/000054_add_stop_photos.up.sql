@@ -0,0 +1,15 @@
+-- Photos a driver takes at a pickup or delivery stop as proof of service.
+-- Customers see them on the order's tracking page and admins on the order.
+CREATE TABLE stop_photos (
+    id SERIAL PRIMARY KEY,
+    route_order_id INTEGER NOT NULL REFERENCES route_orders(id) ON DELETE CASCADE,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    driver_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    storage_key VARCHAR(512) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    taken_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_stop_photos_order_id ON stop_photos(order_id);
+CREATE INDEX idx_stop_photos_route_order_id ON stop_photos(route_order_id);
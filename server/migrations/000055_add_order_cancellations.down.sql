@@ -0,0 +1,6 @@
+DELETE FROM customer_credit_ledger WHERE entry_type = 'cancellation';
+ALTER TABLE customer_credit_ledger DROP CONSTRAINT customer_credit_ledger_entry_type_check;
+ALTER TABLE customer_credit_ledger ADD CONSTRAINT customer_credit_ledger_entry_type_check
+    CHECK (entry_type IN ('grant', 'adjustment', 'resolution', 'redemption', 'reversal'));
+
+DROP TABLE IF EXISTS order_cancellations;
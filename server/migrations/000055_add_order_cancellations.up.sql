@@ -0,0 +1,15 @@
+-- Customer cancellations and how they were settled. Cancelling before the
+-- cutoff refunds the payment; a late cancellation is paid back as credit.
+CREATE TABLE order_cancellations (
+    order_id INTEGER PRIMARY KEY REFERENCES orders(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    late BOOLEAN NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    refund_id INTEGER REFERENCES refunds(id) ON DELETE SET NULL,
+    credit_cents INTEGER NOT NULL DEFAULT 0,
+    cancelled_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE customer_credit_ledger DROP CONSTRAINT customer_credit_ledger_entry_type_check;
+ALTER TABLE customer_credit_ledger ADD CONSTRAINT customer_credit_ledger_entry_type_check
+    CHECK (entry_type IN ('grant', 'adjustment', 'resolution', 'redemption', 'reversal', 'cancellation'));
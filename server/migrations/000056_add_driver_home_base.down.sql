@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS home_base_longitude;
+ALTER TABLE users DROP COLUMN IF EXISTS home_base_latitude;
@@ -0,0 +1,4 @@
+-- Where a driver starts their day, used to suggest drivers for routes close
+-- to them
+ALTER TABLE users ADD COLUMN home_base_latitude DECIMAL(10, 8);
+ALTER TABLE users ADD COLUMN home_base_longitude DECIMAL(11, 8);
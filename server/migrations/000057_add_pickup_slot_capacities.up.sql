@@ -0,0 +1,17 @@
+-- Capacity overrides for pickup slots by market (first three digits of the
+-- pickup ZIP), day of week, or both. The most specific match wins over
+-- pickup_time_slots.capacity. A market with its own capacity is counted on
+-- its own; the default capacity covers pickups everywhere else.
+CREATE TABLE pickup_slot_capacities (
+    id SERIAL PRIMARY KEY,
+    market VARCHAR(3), -- NULL matches every market
+    day_of_week SMALLINT CHECK (day_of_week BETWEEN 0 AND 6), -- 0 = Sunday; NULL matches every day
+    time_slot VARCHAR(50) NOT NULL REFERENCES pickup_time_slots(time_slot) ON UPDATE CASCADE ON DELETE CASCADE,
+    capacity INTEGER NOT NULL CHECK (capacity >= 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (market IS NOT NULL OR day_of_week IS NOT NULL)
+);
+
+CREATE UNIQUE INDEX idx_pickup_slot_capacities_match
+    ON pickup_slot_capacities (COALESCE(market, ''), COALESCE(day_of_week, -1), time_slot);
@@ -0,0 +1,4 @@
+-- The pricing an order was sold with: plan terms, line prices and catalog
+-- names, slot pricing, totals and credit applied. Written once when the order
+-- is placed; NULL for orders placed before snapshots were kept.
+ALTER TABLE orders ADD COLUMN pricing_snapshot JSONB;
@@ -0,0 +1,7 @@
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS zone_surcharge_cents,
+    DROP COLUMN IF EXISTS service_zone_name;
+
+DROP TABLE IF EXISTS service_area_waitlist;
+DROP TABLE IF EXISTS service_areas;
+DROP TABLE IF EXISTS service_zones;
@@ -0,0 +1,38 @@
+-- Zones group covered ZIP codes and can carry a surcharge for far-out areas
+CREATE TABLE service_zones (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE,
+    surcharge_cents INTEGER NOT NULL DEFAULT 0 CHECK (surcharge_cents >= 0),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- ZIP codes we pick up from and deliver to. Until any are active every ZIP
+-- is served, so coverage can be set up without turning customers away.
+CREATE TABLE service_areas (
+    zip_code VARCHAR(5) PRIMARY KEY,
+    zone_id INTEGER REFERENCES service_zones(id) ON DELETE SET NULL,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_service_areas_zone ON service_areas(zone_id);
+
+-- People outside coverage who want to hear when we reach them
+CREATE TABLE service_area_waitlist (
+    id SERIAL PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    zip_code VARCHAR(5) NOT NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    notified_at TIMESTAMP,
+    UNIQUE (email, zip_code)
+);
+
+CREATE INDEX idx_service_area_waitlist_zip ON service_area_waitlist(zip_code) WHERE notified_at IS NULL;
+
+-- The zone surcharge an order was sold with
+ALTER TABLE orders
+    ADD COLUMN service_zone_name VARCHAR(100),
+    ADD COLUMN zone_surcharge_cents INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS driver_payout_items;
+DROP TABLE IF EXISTS driver_payouts;
+
+ALTER TABLE users DROP COLUMN IF EXISTS stripe_connect_payouts_enabled;
+ALTER TABLE users DROP COLUMN IF EXISTS stripe_connect_details_submitted;
+ALTER TABLE users DROP COLUMN IF EXISTS stripe_connect_account_id;
@@ -0,0 +1,46 @@
+-- Stripe Connect Express accounts drivers are paid through. The flags are
+-- copied from Stripe when the driver returns from onboarding and on
+-- account.updated.
+ALTER TABLE users ADD COLUMN stripe_connect_account_id VARCHAR(255) UNIQUE;
+ALTER TABLE users ADD COLUMN stripe_connect_details_submitted BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN stripe_connect_payouts_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- One payout per driver per week (weeks start Monday, UTC). It stays
+-- pending until the driver can receive transfers, and failed ones are
+-- retried on the next run.
+CREATE TABLE driver_payouts (
+    id SERIAL PRIMARY KEY,
+    driver_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    period_start DATE NOT NULL,
+    period_end DATE NOT NULL,
+    stop_count INTEGER NOT NULL DEFAULT 0,
+    stop_pay_cents INTEGER NOT NULL DEFAULT 0,
+    tip_cents INTEGER NOT NULL DEFAULT 0,
+    amount_cents INTEGER NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'processing', 'paid', 'failed')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    stripe_transfer_id VARCHAR(255),
+    failure_reason TEXT,
+    paid_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (driver_id, period_start)
+);
+
+CREATE INDEX idx_driver_payouts_status ON driver_payouts(status) WHERE status != 'paid';
+
+-- What each payout covers. A completed stop is paid once and an order's tip
+-- once, to the driver who delivered it.
+CREATE TABLE driver_payout_items (
+    id SERIAL PRIMARY KEY,
+    payout_id INTEGER NOT NULL REFERENCES driver_payouts(id) ON DELETE CASCADE,
+    kind VARCHAR(10) NOT NULL CHECK (kind IN ('stop', 'tip')),
+    route_order_id INTEGER REFERENCES route_orders(id) ON DELETE SET NULL,
+    order_id INTEGER REFERENCES orders(id) ON DELETE SET NULL,
+    amount_cents INTEGER NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (kind, route_order_id)
+);
+
+CREATE UNIQUE INDEX idx_driver_payout_items_tip ON driver_payout_items(order_id) WHERE kind = 'tip';
+CREATE INDEX idx_driver_payout_items_payout ON driver_payout_items(payout_id);
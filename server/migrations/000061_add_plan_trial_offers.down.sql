@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS idx_subscriptions_trial_ends;
+
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS converted_at;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS trial_reminder_sent_at;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS intro_discount_applied_at;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS intro_price_cents;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS trial_ends_at;
+
+ALTER TABLE subscription_plans DROP COLUMN IF EXISTS intro_price_cents;
+ALTER TABLE subscription_plans DROP COLUMN IF EXISTS trial_days;
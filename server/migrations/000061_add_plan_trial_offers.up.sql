@@ -0,0 +1,14 @@
+-- Offers for a customer's first subscription: free trial days, then an
+-- optional discounted first paid month
+ALTER TABLE subscription_plans ADD COLUMN trial_days INTEGER NOT NULL DEFAULT 0 CHECK (trial_days BETWEEN 0 AND 90);
+ALTER TABLE subscription_plans ADD COLUMN intro_price_cents INTEGER CHECK (intro_price_cents > 0);
+
+-- The offer a subscription started with. converted_at is set by the first
+-- paid invoice after the trial.
+ALTER TABLE subscriptions ADD COLUMN trial_ends_at DATE;
+ALTER TABLE subscriptions ADD COLUMN intro_price_cents INTEGER;
+ALTER TABLE subscriptions ADD COLUMN intro_discount_applied_at TIMESTAMP;
+ALTER TABLE subscriptions ADD COLUMN trial_reminder_sent_at TIMESTAMP;
+ALTER TABLE subscriptions ADD COLUMN converted_at TIMESTAMP;
+
+CREATE INDEX idx_subscriptions_trial_ends ON subscriptions(trial_ends_at) WHERE trial_ends_at IS NOT NULL;
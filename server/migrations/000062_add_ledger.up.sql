@@ -0,0 +1,46 @@
+-- Double-entry record of every money movement. Transactions are posted from
+-- the rows that record the movement (payments, refunds, credits, driver
+-- payouts), and each source row is posted once.
+CREATE TABLE ledger_transactions (
+    id SERIAL PRIMARY KEY,
+    source VARCHAR(30) NOT NULL,
+    source_ref VARCHAR(255) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    order_id INTEGER REFERENCES orders(id) ON DELETE SET NULL,
+    occurred_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (source, source_ref)
+);
+
+CREATE INDEX idx_ledger_transactions_occurred_at ON ledger_transactions(occurred_at);
+CREATE INDEX idx_ledger_transactions_user_id ON ledger_transactions(user_id);
+CREATE INDEX idx_ledger_transactions_order_id ON ledger_transactions(order_id);
+
+-- Each entry is a debit or a credit, never both
+CREATE TABLE ledger_entries (
+    id SERIAL PRIMARY KEY,
+    transaction_id INTEGER NOT NULL REFERENCES ledger_transactions(id) ON DELETE CASCADE,
+    account VARCHAR(30) NOT NULL,
+    debit_cents INTEGER NOT NULL DEFAULT 0 CHECK (debit_cents >= 0),
+    credit_cents INTEGER NOT NULL DEFAULT 0 CHECK (credit_cents >= 0),
+    CHECK ((debit_cents = 0) <> (credit_cents = 0))
+);
+
+CREATE INDEX idx_ledger_entries_transaction ON ledger_entries(transaction_id);
+CREATE INDEX idx_ledger_entries_account ON ledger_entries(account);
+
+-- A transaction's debits must equal its credits by the time it commits
+CREATE OR REPLACE FUNCTION check_ledger_transaction_balanced()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF (SELECT SUM(debit_cents) - SUM(credit_cents) FROM ledger_entries WHERE transaction_id = NEW.transaction_id) <> 0 THEN
+        RAISE EXCEPTION 'ledger transaction % does not balance', NEW.transaction_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ language 'plpgsql';
+
+CREATE CONSTRAINT TRIGGER ledger_entries_balanced AFTER INSERT OR UPDATE ON ledger_entries
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION check_ledger_transaction_balanced();
@@ -0,0 +1,8 @@
+ALTER TABLE driver_stats_summary DROP COLUMN IF EXISTS order_rating;
+
+DROP INDEX IF EXISTS idx_order_ratings_created_at;
+
+ALTER TABLE order_ratings DROP COLUMN IF EXISTS hidden_reason;
+ALTER TABLE order_ratings DROP COLUMN IF EXISTS hidden_by;
+ALTER TABLE order_ratings DROP COLUMN IF EXISTS hidden_at;
+ALTER TABLE order_ratings DROP COLUMN IF EXISTS driver_rating;
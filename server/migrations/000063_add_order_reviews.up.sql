@@ -0,0 +1,11 @@
+-- Reviews rate the driver separately from the order. Admins can hide a
+-- review, which takes it out of the driver's averages.
+ALTER TABLE order_ratings ADD COLUMN driver_rating SMALLINT CHECK (driver_rating BETWEEN 1 AND 5);
+ALTER TABLE order_ratings ADD COLUMN hidden_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE order_ratings ADD COLUMN hidden_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE order_ratings ADD COLUMN hidden_reason TEXT;
+
+CREATE INDEX idx_order_ratings_created_at ON order_ratings(created_at DESC);
+
+-- rating is now the driver rating; order_rating averages the orders they served
+ALTER TABLE driver_stats_summary ADD COLUMN order_rating DECIMAL(3,2);
@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS idx_stop_photos_flagged;
+DROP INDEX IF EXISTS idx_stop_photos_device_hash;
+DROP INDEX IF EXISTS idx_stop_photos_content_hash;
+
+ALTER TABLE stop_photos DROP COLUMN IF EXISTS quality_issues;
+ALTER TABLE stop_photos DROP COLUMN IF EXISTS device_hash;
+ALTER TABLE stop_photos DROP COLUMN IF EXISTS content_hash;
+ALTER TABLE stop_photos DROP COLUMN IF EXISTS captured_at;
+ALTER TABLE stop_photos DROP COLUMN IF EXISTS brightness;
+ALTER TABLE stop_photos DROP COLUMN IF EXISTS height;
+ALTER TABLE stop_photos DROP COLUMN IF EXISTS width;
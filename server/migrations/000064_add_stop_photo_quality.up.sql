@@ -0,0 +1,13 @@
+-- What the upload checks found in a stop photo. quality_issues is empty for
+-- a compliant photo; photos taken before the checks have NULL dimensions.
+ALTER TABLE stop_photos ADD COLUMN width INTEGER;
+ALTER TABLE stop_photos ADD COLUMN height INTEGER;
+ALTER TABLE stop_photos ADD COLUMN brightness SMALLINT;
+ALTER TABLE stop_photos ADD COLUMN captured_at TIMESTAMP;
+ALTER TABLE stop_photos ADD COLUMN content_hash CHAR(64);
+ALTER TABLE stop_photos ADD COLUMN device_hash CHAR(64);
+ALTER TABLE stop_photos ADD COLUMN quality_issues TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX idx_stop_photos_content_hash ON stop_photos(content_hash);
+CREATE INDEX idx_stop_photos_device_hash ON stop_photos(device_hash) WHERE device_hash IS NOT NULL;
+CREATE INDEX idx_stop_photos_flagged ON stop_photos(taken_at DESC) WHERE quality_issues <> '{}';
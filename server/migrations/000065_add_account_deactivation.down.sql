@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_users_deactivated_at;
+
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS paused_by_deactivation;
+
+ALTER TABLE users DROP COLUMN IF EXISTS deactivation_reason;
+ALTER TABLE users DROP COLUMN IF EXISTS deactivated_at;
@@ -0,0 +1,11 @@
+-- Customers can pause their own account without cancelling. Unlike the
+-- admin-set inactive status, a deactivated customer can still sign in,
+-- which is how they reactivate.
+ALTER TABLE users ADD COLUMN deactivated_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE users ADD COLUMN deactivation_reason TEXT;
+
+-- Subscriptions the deactivation paused, so reactivating resumes only those
+-- and not ones the customer had paused themselves
+ALTER TABLE subscriptions ADD COLUMN paused_by_deactivation BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX idx_users_deactivated_at ON users(deactivated_at) WHERE deactivated_at IS NOT NULL;
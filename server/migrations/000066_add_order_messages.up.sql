@@ -0,0 +1,22 @@
+-- In-app chat on an order between the customer, the drivers on its routes
+-- and support. Messages are kept with the order.
+CREATE TABLE order_messages (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    sender_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    sender_role VARCHAR(20) NOT NULL CHECK (sender_role IN ('customer', 'driver', 'support')),
+    body TEXT NOT NULL CHECK (char_length(body) BETWEEN 1 AND 2000),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_order_messages_order ON order_messages(order_id, id);
+CREATE INDEX idx_order_messages_created_at ON order_messages(created_at);
+
+-- Read receipts: how far each participant has read an order's conversation
+CREATE TABLE order_message_reads (
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    last_read_message_id INTEGER NOT NULL,
+    read_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (order_id, user_id)
+);
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS geocode_backfill_runs;
+DROP TABLE IF EXISTS address_geocode_drifts;
+
+DROP INDEX IF EXISTS idx_addresses_ungeocoded;
+
+ALTER TABLE addresses DROP COLUMN IF EXISTS geocode_failed_at;
+ALTER TABLE addresses DROP COLUMN IF EXISTS previous_longitude;
+ALTER TABLE addresses DROP COLUMN IF EXISTS previous_latitude;
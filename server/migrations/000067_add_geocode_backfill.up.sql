@@ -0,0 +1,41 @@
+-- Where an address was placed before an edit cleared its coordinates, so the
+-- next geocode can tell how far it moved
+ALTER TABLE addresses ADD COLUMN previous_latitude DECIMAL(10, 8);
+ALTER TABLE addresses ADD COLUMN previous_longitude DECIMAL(11, 8);
+-- Set when the geocoder couldn't place the address; the backfill skips it
+-- until the address is edited
+ALTER TABLE addresses ADD COLUMN geocode_failed_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX idx_addresses_ungeocoded ON addresses(id) WHERE latitude IS NULL;
+
+-- Addresses whose new geocode landed far from the old one: a customer who
+-- moved, or an edit that put the pin somewhere wrong
+CREATE TABLE address_geocode_drifts (
+    id SERIAL PRIMARY KEY,
+    address_id INTEGER NOT NULL REFERENCES addresses(id) ON DELETE CASCADE,
+    reason VARCHAR(20) NOT NULL CHECK (reason IN ('edited', 'recheck')),
+    previous_latitude DECIMAL(10, 8) NOT NULL,
+    previous_longitude DECIMAL(11, 8) NOT NULL,
+    latitude DECIMAL(10, 8) NOT NULL,
+    longitude DECIMAL(11, 8) NOT NULL,
+    distance_km DECIMAL(10, 3) NOT NULL,
+    reviewed_at TIMESTAMP WITH TIME ZONE,
+    reviewed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    review_note TEXT,
+    detected_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_address_geocode_drifts_unreviewed ON address_geocode_drifts(detected_at) WHERE reviewed_at IS NULL;
+
+CREATE TABLE geocode_backfill_runs (
+    id SERIAL PRIMARY KEY,
+    recheck BOOLEAN NOT NULL DEFAULT false,
+    candidates INTEGER NOT NULL DEFAULT 0,
+    geocoded INTEGER NOT NULL DEFAULT 0,
+    not_found INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    drifted INTEGER NOT NULL DEFAULT 0,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    triggered_by INTEGER REFERENCES users(id) ON DELETE SET NULL, -- NULL for the nightly job
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,7 @@
+DELETE FROM retention_policies WHERE name = 'push_deliveries';
+
+ALTER TABLE route_orders DROP COLUMN IF EXISTS arrival_notified_at;
+
+DROP TABLE IF EXISTS push_deliveries;
+DROP TABLE IF EXISTS push_preferences;
+DROP TABLE IF EXISTS device_tokens;
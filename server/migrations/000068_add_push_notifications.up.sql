@@ -0,0 +1,52 @@
+-- Mobile devices registered for push notifications. A token belongs to
+-- whoever registered it last; invalidated_at is set when APNs or FCM reports
+-- it's no longer valid, and nothing more is sent to it.
+CREATE TABLE device_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    platform VARCHAR(10) NOT NULL CHECK (platform IN ('ios', 'android')),
+    token TEXT NOT NULL UNIQUE,
+    app_version VARCHAR(50),
+    last_seen_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    invalidated_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_device_tokens_user ON device_tokens(user_id) WHERE invalidated_at IS NULL;
+
+-- Which kinds of push a customer wants; no row means all of them
+CREATE TABLE push_preferences (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    order_updates BOOLEAN NOT NULL DEFAULT true,
+    driver_arrival BOOLEAN NOT NULL DEFAULT true,
+    payment_issues BOOLEAN NOT NULL DEFAULT true,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- One row per push per device. The dispatcher sends pending rows when
+-- they're due and retries failures with backoff.
+CREATE TABLE push_deliveries (
+    id SERIAL PRIMARY KEY,
+    device_token_id INTEGER NOT NULL REFERENCES device_tokens(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    category VARCHAR(30) NOT NULL CHECK (category IN ('order_updates', 'driver_arrival', 'payment_issues')),
+    order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE,
+    title VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    data JSONB NOT NULL DEFAULT '{}',
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'sent', 'failed', 'invalid_token')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    sent_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_push_deliveries_due ON push_deliveries(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX idx_push_deliveries_created_at ON push_deliveries(created_at);
+
+-- A stop's customer is told their driver is close once
+ALTER TABLE route_orders ADD COLUMN arrival_notified_at TIMESTAMP WITH TIME ZONE;
+
+INSERT INTO retention_policies (name, description, retain_days) VALUES
+    ('push_deliveries', 'Delete finished push deliveries and device tokens reported invalid', 30);
@@ -0,0 +1,9 @@
+DELETE FROM retention_policies WHERE name = 'webhook_deliveries';
+
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_endpoints;
+DROP TABLE IF EXISTS order_item_events;
+
+ALTER TABLE order_garments
+    DROP COLUMN IF EXISTS damaged_quantity,
+    DROP COLUMN IF EXISTS added_at_pickup;
@@ -0,0 +1,59 @@
+-- Garment lines a driver adds at pickup are recorded for reconciliation but
+-- aren't part of the order's charged subtotal. damaged_quantity is how many
+-- of a line's pieces the facility has flagged as damaged.
+ALTER TABLE order_garments
+    ADD COLUMN added_at_pickup BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN damaged_quantity INTEGER NOT NULL DEFAULT 0 CHECK (damaged_quantity >= 0);
+
+-- Item-level changes to an order's garments, in the order they happened
+CREATE TABLE order_item_events (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    order_garment_id INTEGER NOT NULL REFERENCES order_garments(id) ON DELETE CASCADE,
+    event VARCHAR(30) NOT NULL CHECK (event IN ('item.added', 'item.damaged', 'item.substituted')),
+    garment_type_id INTEGER NOT NULL REFERENCES garment_types(id),
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    previous_garment_type_id INTEGER REFERENCES garment_types(id), -- Set on substitutions
+    notes TEXT,
+    recorded_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_order_item_events_order ON order_item_events(order_id, id);
+
+-- Partner endpoints that receive item events. An endpoint scoped to a user
+-- only hears about that customer's orders; an unscoped one hears about all.
+CREATE TABLE webhook_endpoints (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    secret VARCHAR(100) NOT NULL,
+    events TEXT[] NOT NULL,
+    description VARCHAR(255),
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- One row per event per endpoint. The dispatcher posts pending rows when
+-- they're due and retries failures with backoff.
+CREATE TABLE webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    endpoint_id INTEGER NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+    item_event_id INTEGER NOT NULL REFERENCES order_item_events(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    response_status INTEGER,
+    last_error TEXT,
+    delivered_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (endpoint_id, item_event_id)
+);
+
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX idx_webhook_deliveries_created_at ON webhook_deliveries(created_at);
+
+INSERT INTO retention_policies (name, description, retain_days) VALUES
+    ('webhook_deliveries', 'Delete finished partner webhook deliveries', 30);
@@ -0,0 +1,3 @@
+DELETE FROM retention_policies WHERE name = 'processed_webhook_events';
+
+DROP TABLE IF EXISTS processed_webhook_events;
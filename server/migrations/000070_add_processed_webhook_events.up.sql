@@ -0,0 +1,22 @@
+-- Every Stripe event we've received, so a redelivered event isn't applied
+-- twice. An event that failed part way keeps its payload for a replay.
+-- A 'processing' row older than a few minutes is from a request that died
+-- and may be claimed again.
+CREATE TABLE processed_webhook_events (
+    event_id VARCHAR(255) PRIMARY KEY,
+    event_type VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'processing' CHECK (status IN ('processing', 'processed', 'failed')),
+    attempts INTEGER NOT NULL DEFAULT 1,
+    last_error TEXT,
+    replayed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    received_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    processed_at TIMESTAMP WITH TIME ZONE,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_processed_webhook_events_failed ON processed_webhook_events(received_at) WHERE status <> 'processed';
+CREATE INDEX idx_processed_webhook_events_received_at ON processed_webhook_events(received_at);
+
+INSERT INTO retention_policies (name, description, retain_days) VALUES
+    ('processed_webhook_events', 'Delete Stripe events that were applied; Stripe stops redelivering after 3 days', 30);
@@ -0,0 +1 @@
+ALTER TABLE launch_markets DROP COLUMN IF EXISTS launched_on;
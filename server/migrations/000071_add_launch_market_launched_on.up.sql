@@ -0,0 +1,5 @@
+-- The day a market opened, which market analytics count from. Markets added
+-- before this take the day they were listed.
+ALTER TABLE launch_markets ADD COLUMN launched_on DATE NOT NULL DEFAULT CURRENT_DATE;
+
+UPDATE launch_markets SET launched_on = created_at::date WHERE created_at IS NOT NULL;
@@ -0,0 +1,18 @@
+DROP TABLE IF EXISTS order_reviews;
+
+UPDATE orders SET status = 'cancelled' WHERE status = 'pending_review';
+
+ALTER TABLE orders DROP CONSTRAINT orders_status_check;
+
+ALTER TABLE orders ADD CONSTRAINT orders_status_check
+CHECK (status IN (
+    'pending',
+    'scheduled',
+    'picked_up',
+    'in_process',
+    'ready',
+    'out_for_delivery',
+    'delivered',
+    'failed',
+    'cancelled'
+));
@@ -0,0 +1,32 @@
+-- Orders over ORDER_REVIEW_THRESHOLD_CENTS wait in pending_review until an
+-- admin approves or rejects them
+ALTER TABLE orders DROP CONSTRAINT orders_status_check;
+
+ALTER TABLE orders ADD CONSTRAINT orders_status_check
+CHECK (status IN (
+    'pending',
+    'pending_review',
+    'scheduled',
+    'picked_up',
+    'in_process',
+    'ready',
+    'out_for_delivery',
+    'delivered',
+    'failed',
+    'cancelled'
+));
+
+-- One row per held order; decision stays NULL until it's reviewed
+CREATE TABLE order_reviews (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL UNIQUE REFERENCES orders(id) ON DELETE CASCADE,
+    total_cents INTEGER NOT NULL,
+    threshold_cents INTEGER NOT NULL,
+    decision VARCHAR(20) CHECK (decision IN ('approved', 'rejected')),
+    notes TEXT,
+    reviewed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reviewed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_order_reviews_undecided ON order_reviews(created_at) WHERE decision IS NULL;
@@ -0,0 +1,3 @@
+DELETE FROM retention_policies WHERE name = 'widget_drafts';
+DROP TABLE IF EXISTS widget_drafts;
+DROP TABLE IF EXISTS widget_keys;
@@ -0,0 +1,35 @@
+-- Publishable keys for the booking widget partners embed on their sites. The
+-- key is public, so it only works from the key's allowed origins and only
+-- reaches quotes, availability and drafts, never account data.
+CREATE TABLE widget_keys (
+    id SERIAL PRIMARY KEY,
+    publishable_key VARCHAR(64) NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    allowed_origins TEXT[] NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A booking started in the widget. The visitor finishes it on our site after
+-- signing in, which is when it's claimed by their account.
+CREATE TABLE widget_drafts (
+    id SERIAL PRIMARY KEY,
+    token VARCHAR(64) NOT NULL UNIQUE,
+    widget_key_id INTEGER NOT NULL REFERENCES widget_keys(id) ON DELETE CASCADE,
+    zip_code VARCHAR(10) NOT NULL,
+    pickup_date DATE NOT NULL,
+    pickup_time_slot VARCHAR(50) NOT NULL,
+    bags INTEGER NOT NULL CHECK (bags > 0),
+    quoted_cents INTEGER NOT NULL,
+    claimed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    claimed_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_widget_drafts_expires_at ON widget_drafts(expires_at);
+
+INSERT INTO retention_policies (name, description, retain_days) VALUES
+    ('widget_drafts', 'Delete booking widget drafts this long after they expire', 7);
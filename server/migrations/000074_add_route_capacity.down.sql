@@ -0,0 +1,5 @@
+ALTER TABLE driver_routes DROP COLUMN IF EXISTS overload_accepted_by;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS route_max_bags,
+    DROP COLUMN IF EXISTS route_max_minutes;
@@ -0,0 +1,10 @@
+-- What a driver can take on in a day: bags their vehicle holds and minutes
+-- of driving and stops. NULL falls back to ROUTE_MAX_BAGS and
+-- ROUTE_MAX_MINUTES.
+ALTER TABLE users
+    ADD COLUMN route_max_bags INTEGER CHECK (route_max_bags > 0),
+    ADD COLUMN route_max_minutes INTEGER CHECK (route_max_minutes > 0);
+
+-- Set when an admin created or grew a route past its driver's capacity
+ALTER TABLE driver_routes
+    ADD COLUMN overload_accepted_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
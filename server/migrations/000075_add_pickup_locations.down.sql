@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS locker_reservations;
+DROP TABLE IF EXISTS pickup_locations;
@@ -0,0 +1,42 @@
+-- Lockers and staffed pickup points customers can have orders delivered to
+-- instead of their door. Lockers hold one order per compartment; pickup
+-- points (compartments NULL) take any number.
+CREATE TABLE pickup_locations (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    location_type VARCHAR(20) NOT NULL CHECK (location_type IN ('locker', 'pickup_point')),
+    street_address VARCHAR(255) NOT NULL,
+    city VARCHAR(100) NOT NULL,
+    state VARCHAR(50) NOT NULL,
+    zip_code VARCHAR(10) NOT NULL,
+    compartments INTEGER CHECK (compartments > 0),
+    -- How long an order waits to be collected before the space is released
+    hold_hours INTEGER NOT NULL DEFAULT 72 CHECK (hold_hours > 0),
+    instructions TEXT,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK (location_type = 'pickup_point' OR compartments IS NOT NULL)
+);
+
+-- A space held for an order from checkout until it's collected or released.
+-- The access code is issued when the driver drops the order off.
+CREATE TABLE locker_reservations (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    location_id INTEGER NOT NULL REFERENCES pickup_locations(id),
+    status VARCHAR(20) NOT NULL DEFAULT 'reserved' CHECK (status IN ('reserved', 'occupied', 'collected', 'released')),
+    access_code VARCHAR(10),
+    dropped_off_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    collected_at TIMESTAMP WITH TIME ZONE,
+    released_at TIMESTAMP WITH TIME ZONE,
+    release_reason VARCHAR(20) CHECK (release_reason IN ('cancelled', 'expired')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- An order holds at most one space at a time
+CREATE UNIQUE INDEX idx_locker_reservations_active_order ON locker_reservations(order_id)
+    WHERE status IN ('reserved', 'occupied');
+CREATE INDEX idx_locker_reservations_location ON locker_reservations(location_id, status);
+CREATE INDEX idx_locker_reservations_expires ON locker_reservations(expires_at) WHERE status = 'occupied';
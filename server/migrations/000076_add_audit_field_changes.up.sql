@@ -0,0 +1,2 @@
+-- Each audited write's field-level diff, old and new value per field
+ALTER TABLE audit_log ADD COLUMN field_changes JSONB NOT NULL DEFAULT '[]';
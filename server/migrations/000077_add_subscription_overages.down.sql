@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS subscription_overages;
+
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS overage_billing;
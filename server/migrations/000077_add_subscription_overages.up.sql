@@ -0,0 +1,27 @@
+-- How a subscriber pays for pickups past their quota: on each order, or
+-- added up and put on the next monthly invoice
+ALTER TABLE subscriptions
+    ADD COLUMN overage_billing VARCHAR(20) NOT NULL DEFAULT 'per_order'
+        CHECK (overage_billing IN ('per_order', 'period_end'));
+
+-- Over-quota fees waiting for the period's invoice. An overage whose order
+-- is cancelled before it's billed is voided.
+CREATE TABLE subscription_overages (
+    id SERIAL PRIMARY KEY,
+    subscription_id INTEGER NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    amount_cents INTEGER NOT NULL CHECK (amount_cents > 0),
+    description TEXT NOT NULL,
+    -- End of the billing period the pickup counted against
+    period_end DATE NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'invoiced', 'voided')),
+    stripe_invoice_item_id VARCHAR(255),
+    stripe_invoice_id VARCHAR(255),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    invoiced_at TIMESTAMP WITH TIME ZONE,
+    voided_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE UNIQUE INDEX idx_subscription_overages_order ON subscription_overages(order_id);
+CREATE INDEX idx_subscription_overages_pending ON subscription_overages(subscription_id, period_end) WHERE status = 'pending';
@@ -0,0 +1,22 @@
+-- Forecast days with weather severe enough to disrupt pickups and
+-- deliveries, one per market and date. Refreshed as forecasts change; an
+-- advisory that was acted on is kept when the risk passes.
+CREATE TABLE weather_advisories (
+    id SERIAL PRIMARY KEY,
+    market VARCHAR(3) NOT NULL,
+    advisory_date DATE NOT NULL,
+    severity VARCHAR(20) NOT NULL CHECK (severity IN ('moderate', 'severe')),
+    summary TEXT NOT NULL,
+    weather_code INTEGER,
+    precipitation_mm DECIMAL(6, 1),
+    snowfall_cm DECIMAL(6, 1),
+    wind_gust_kmh DECIMAL(6, 1),
+    fetched_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    rescheduled_to DATE,
+    rescheduled_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    rescheduled_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (market, advisory_date)
+);
+
+CREATE INDEX idx_weather_advisories_date ON weather_advisories(advisory_date);
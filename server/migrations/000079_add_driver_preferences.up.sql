@@ -0,0 +1,13 @@
+-- Drivers a customer wants again or never wants again. Routing ranks
+-- favorites higher and never puts a blocked driver on the customer's stops.
+CREATE TABLE driver_preferences (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    driver_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    preference VARCHAR(20) NOT NULL CHECK (preference IN ('favorite', 'blocked')),
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, driver_id)
+);
+
+CREATE INDEX idx_driver_preferences_driver ON driver_preferences(driver_id, preference);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS route_cash_tips;
+DROP TABLE IF EXISTS route_closeout_items;
+DROP TABLE IF EXISTS route_closeouts;
+
+ALTER TABLE driver_routes DROP COLUMN IF EXISTS closed_out_at;
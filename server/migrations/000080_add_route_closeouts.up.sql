@@ -0,0 +1,40 @@
+-- A driver's end-of-day close-out of a route. Once closed out the route is
+-- locked and its report is kept as it was at close-out.
+ALTER TABLE driver_routes ADD COLUMN closed_out_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE route_closeouts (
+    id SERIAL PRIMARY KEY,
+    route_id INTEGER NOT NULL UNIQUE REFERENCES driver_routes(id) ON DELETE CASCADE,
+    driver_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    -- Bags on the route's completed stops, and how many go back to the
+    -- facility: failed deliveries plus anything reported left over
+    bags_expected INTEGER NOT NULL DEFAULT 0,
+    bags_returned INTEGER NOT NULL DEFAULT 0,
+    all_bags_confirmed BOOLEAN NOT NULL,
+    cash_tips_cents INTEGER NOT NULL DEFAULT 0,
+    notes TEXT,
+    report JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Items a driver still had at close-out instead of handing them over
+CREATE TABLE route_closeout_items (
+    id SERIAL PRIMARY KEY,
+    closeout_id INTEGER NOT NULL REFERENCES route_closeouts(id) ON DELETE CASCADE,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    bags INTEGER NOT NULL DEFAULT 0 CHECK (bags >= 0),
+    description TEXT NOT NULL
+);
+
+CREATE INDEX idx_route_closeout_items_closeout ON route_closeout_items(closeout_id);
+
+-- Cash tips customers handed the driver, reconciled at close-out
+CREATE TABLE route_cash_tips (
+    id SERIAL PRIMARY KEY,
+    route_id INTEGER NOT NULL REFERENCES driver_routes(id) ON DELETE CASCADE,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    driver_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    amount_cents INTEGER NOT NULL CHECK (amount_cents > 0),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (route_id, order_id)
+);
@@ -0,0 +1,5 @@
+ALTER TABLE users DROP COLUMN IF EXISTS home_market_id;
+ALTER TABLE subscription_plans DROP COLUMN IF EXISTS market_id;
+ALTER TABLE services DROP COLUMN IF EXISTS market_id;
+DROP TABLE IF EXISTS market_zip_prefixes;
+DROP TABLE IF EXISTS markets;
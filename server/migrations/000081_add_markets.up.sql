@@ -0,0 +1,28 @@
+-- Cities we operate in. A market covers whole 3-digit ZIP prefixes, the same
+-- unit slot capacity, bag pricing and add-ons are set per; a prefix in no
+-- market is served with the shared catalog.
+CREATE TABLE markets (
+    id SERIAL PRIMARY KEY,
+    slug VARCHAR(50) NOT NULL UNIQUE CHECK (slug ~ '^[a-z0-9]+(-[a-z0-9]+)*$'),
+    name VARCHAR(100) NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TRIGGER update_markets_updated_at BEFORE UPDATE ON markets
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TABLE market_zip_prefixes (
+    zip_prefix VARCHAR(3) PRIMARY KEY CHECK (zip_prefix ~ '^[0-9]{3}$'),
+    market_id INTEGER NOT NULL REFERENCES markets(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_market_zip_prefixes_market ON market_zip_prefixes(market_id);
+
+-- Services and plans sold in one market only; NULL is sold everywhere
+ALTER TABLE services ADD COLUMN market_id INTEGER REFERENCES markets(id);
+ALTER TABLE subscription_plans ADD COLUMN market_id INTEGER REFERENCES markets(id);
+
+-- The market a driver works; NULL drivers can be routed anywhere
+ALTER TABLE users ADD COLUMN home_market_id INTEGER REFERENCES markets(id) ON DELETE SET NULL;
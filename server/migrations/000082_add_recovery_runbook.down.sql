@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS incident_snapshots;
+DROP TABLE IF EXISTS intake_pauses;
@@ -0,0 +1,28 @@
+-- While a pause is open, new orders aren't taken: customers are turned away
+-- and auto-scheduling skips them. A pause without a market covers all of
+-- them.
+CREATE TABLE intake_pauses (
+    id SERIAL PRIMARY KEY,
+    market_id INTEGER REFERENCES markets(id) ON DELETE CASCADE,
+    reason TEXT NOT NULL,
+    paused_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    paused_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    resumed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    resumed_at TIMESTAMP WITH TIME ZONE
+);
+
+-- One open pause per market, and one for everywhere
+CREATE UNIQUE INDEX idx_intake_pauses_open ON intake_pauses(COALESCE(market_id, 0)) WHERE resumed_at IS NULL;
+
+-- The state of things when someone took a snapshot during an incident,
+-- kept for the postmortem
+CREATE TABLE incident_snapshots (
+    id SERIAL PRIMARY KEY,
+    incident VARCHAR(255) NOT NULL,
+    notes TEXT,
+    data JSONB NOT NULL,
+    taken_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_incident_snapshots_created_at ON incident_snapshots(created_at);
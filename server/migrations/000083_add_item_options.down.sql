@@ -0,0 +1,11 @@
+DELETE FROM service_add_ons WHERE item_option IS NOT NULL
+    AND NOT EXISTS (SELECT 1 FROM order_add_ons WHERE add_on_id = service_add_ons.id);
+DROP INDEX IF EXISTS idx_service_add_ons_item_option;
+ALTER TABLE service_add_ons DROP COLUMN IF EXISTS item_option;
+ALTER TABLE order_items
+    DROP COLUMN IF EXISTS options_price_cents,
+    DROP COLUMN IF EXISTS allergy_safe,
+    DROP COLUMN IF EXISTS fold_style,
+    DROP COLUMN IF EXISTS hang_dry,
+    DROP COLUMN IF EXISTS water_temperature,
+    DROP COLUMN IF EXISTS detergent;
@@ -0,0 +1,24 @@
+-- A customer's laundry preferences for one line of an order. NULL and false
+-- leave it to the facility's defaults. options_price_cents is what the
+-- options added to the line, priced from add-ons when the order was placed.
+ALTER TABLE order_items
+    ADD COLUMN detergent VARCHAR(20) CHECK (detergent IN ('standard', 'free_clear', 'sensitive', 'eco')),
+    ADD COLUMN water_temperature VARCHAR(10) CHECK (water_temperature IN ('cold', 'warm', 'hot')),
+    ADD COLUMN hang_dry BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN fold_style VARCHAR(20) CHECK (fold_style IN ('standard', 'rolled', 'hung')),
+    ADD COLUMN allergy_safe BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN options_price_cents INTEGER NOT NULL DEFAULT 0 CHECK (options_price_cents >= 0);
+
+-- An add-on with an item option prices that option on order lines instead
+-- of being offered at checkout, e.g. 'hang_dry' or 'detergent:sensitive'.
+-- Options no active add-on prices are free.
+ALTER TABLE service_add_ons ADD COLUMN item_option VARCHAR(40);
+
+CREATE UNIQUE INDEX idx_service_add_ons_item_option ON service_add_ons(item_option)
+    WHERE item_option IS NOT NULL AND is_active;
+
+INSERT INTO service_add_ons (name, display_name, description, pricing_type, price_cents, percent, sort_order, item_option) VALUES
+('item_hang_dry', 'Hang Dry', 'Hung to dry instead of tumble dried', 'per_bag', 500, 0, 10, 'hang_dry'),
+('item_allergy_safe', 'Allergy-Safe', 'Washed in a rinsed-out machine with dye- and fragrance-free detergent', 'per_bag', 400, 0, 11, 'allergy_safe'),
+('item_sensitive_detergent', 'Sensitive Skin Detergent', 'Hypoallergenic detergent', 'per_bag', 300, 0, 12, 'detergent:sensitive'),
+('item_eco_detergent', 'Eco Detergent', 'Plant-based detergent', 'per_bag', 200, 0, 13, 'detergent:eco');
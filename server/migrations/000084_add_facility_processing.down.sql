@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS facility_bags;
+UPDATE users SET role = 'customer' WHERE role = 'facility';
+DELETE FROM roles WHERE name = 'facility';
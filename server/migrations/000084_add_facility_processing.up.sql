@@ -0,0 +1,27 @@
+-- Staff who process laundry at the facility
+INSERT INTO roles (name, description) VALUES
+    ('facility', 'Scans bags in at the facility, tracks washing and weighs bags');
+INSERT INTO role_permissions (role, permission) VALUES
+    ('facility', 'facility.manage'),
+    ('facility', 'orders.read');
+
+-- Bags scanned into the facility, by the code on their tag. Tags are reused,
+-- so a code only has to be unique among bags still being processed; a bag is
+-- released when its order is marked ready for delivery.
+CREATE TABLE facility_bags (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    order_item_id INTEGER REFERENCES order_items(id) ON DELETE SET NULL, -- The line the bag was sold on
+    bag_code VARCHAR(50) NOT NULL,
+    stage VARCHAR(20) NOT NULL DEFAULT 'received'
+        CHECK (stage IN ('received', 'washing', 'drying', 'folding', 'folded')),
+    weight DECIMAL(6,2) CHECK (weight > 0), -- Pounds, from the facility scale
+    received_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    stage_updated_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    stage_updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    released_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE UNIQUE INDEX idx_facility_bags_open_code ON facility_bags(bag_code) WHERE released_at IS NULL;
+CREATE INDEX idx_facility_bags_order_id ON facility_bags(order_id);
@@ -0,0 +1,3 @@
+ALTER TABLE subscription_adjustments
+    DROP COLUMN IF EXISTS stripe_trial_end,
+    DROP COLUMN IF EXISTS stripe_subscription_id;
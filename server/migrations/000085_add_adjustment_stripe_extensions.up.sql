@@ -0,0 +1,5 @@
+-- Period extensions are pushed to Stripe as a trial until the new period end,
+-- so the subscriber isn't billed before then
+ALTER TABLE subscription_adjustments
+    ADD COLUMN stripe_subscription_id VARCHAR(255),
+    ADD COLUMN stripe_trial_end TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,2 @@
+DELETE FROM retention_policies WHERE name = 'order_messages';
+ALTER TABLE order_messages DROP COLUMN IF EXISTS redacted_at;
@@ -0,0 +1,6 @@
+-- Old order chat is redacted rather than deleted so the conversation's shape
+-- stays for support history
+ALTER TABLE order_messages ADD COLUMN redacted_at TIMESTAMP WITH TIME ZONE;
+
+INSERT INTO retention_policies (name, description, retain_days) VALUES
+    ('order_messages', 'Redact the text of order chat messages after this many days', 180);
@@ -0,0 +1,10 @@
+-- One-time codes the OAuth callback redirects to the frontend with, so tokens
+-- never appear in a URL. Only a hash of each code is stored.
+CREATE TABLE login_codes (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_login_codes_expires_at ON login_codes(expires_at);
@@ -0,0 +1,98 @@
+// Package money holds the integer-cents helpers every price, total and
+// Stripe amount goes through. Amounts are int cents everywhere; float
+// dollars only exist at the JSON boundary, converted once on the way in
+// (FromDollars) and once on the way out (ToDollars).
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// ToDollars converts cents to dollars for JSON responses
+func ToDollars(cents int) float64 {
+	return float64(cents) / 100
+}
+
+// FromDollars converts a dollar amount from a request to cents. It works from
+// the shortest decimal form of the float, so 1.005 is 101 cents rather than
+// the 100 that math.Round(1.005 * 100) gives. Fractions of a cent round half
+// away from zero.
+func FromDollars(dollars float64) int {
+	if math.IsNaN(dollars) || math.IsInf(dollars, 0) {
+		return 0
+	}
+	cents, err := Parse(strconv.FormatFloat(dollars, 'f', -1, 64))
+	if err != nil {
+		return int(math.Round(dollars * 100))
+	}
+	return cents
+}
+
+// Parse reads a decimal dollar string like "12.34", "-0.5" or "$1,200" into
+// cents, rounding fractions of a cent half away from zero
+func Parse(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	s = strings.TrimPrefix(s, "$")
+	s = strings.ReplaceAll(s, ",", "")
+
+	whole, fraction, _ := strings.Cut(s, ".")
+	if whole == "" && fraction == "" {
+		return 0, ErrInvalidAmount
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	for _, part := range []string{whole, fraction} {
+		for _, r := range part {
+			if r < '0' || r > '9' {
+				return 0, ErrInvalidAmount
+			}
+		}
+	}
+
+	dollars, err := strconv.Atoi(whole)
+	if err != nil || dollars > math.MaxInt/100-1 {
+		return 0, ErrInvalidAmount
+	}
+	fraction += "000"
+	cents := dollars*100 + int(fraction[0]-'0')*10 + int(fraction[1]-'0')
+	if fraction[2] >= '5' {
+		cents++
+	}
+	if negative {
+		cents = -cents
+	}
+	return cents, nil
+}
+
+// Format renders cents as "$12.34", or "-$12.34" for credits and refunds
+func Format(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, cents/100, cents%100)
+}
+
+// Percent returns percent% of cents, rounded half away from zero. Use it for
+// tax, commission and percentage pricing instead of multiplying by a float.
+func Percent(cents, percent int) int {
+	return divRound(cents*percent, 100)
+}
+
+// divRound divides n by a positive d, rounding half away from zero
+func divRound(n, d int) int {
+	if n < 0 {
+		return -((-n + d/2) / d)
+	}
+	return (n + d/2) / d
+}
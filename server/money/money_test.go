@@ -0,0 +1,148 @@
+package money
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// maxCents keeps generated amounts in the range a float64 holds exactly to
+// the cent, far beyond any real order
+const maxCents = 1 << 40
+
+func boundedCents(n int64) int {
+	return int(n % maxCents)
+}
+
+func TestFromDollars_RoundTripsEveryCent(t *testing.T) {
+	property := func(n int64) bool {
+		cents := boundedCents(n)
+		return FromDollars(ToDollars(cents)) == cents
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFromDollars_SumsNeverDrift(t *testing.T) {
+	// Line items converted to dollars for JSON and back always add up to the
+	// same total as adding the cents directly
+	property := func(lines []uint16, quantities []uint8) bool {
+		sum, roundTripped := 0, 0
+		for i, line := range lines {
+			quantity := 1
+			if i < len(quantities) {
+				quantity = int(quantities[i]%10) + 1
+			}
+			unit := int(line)
+			sum += unit * quantity
+			roundTripped += FromDollars(ToDollars(unit)) * quantity
+		}
+		return FromDollars(ToDollars(sum)) == sum && roundTripped == sum
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFromDollars_RoundsHalfAwayFromZero(t *testing.T) {
+	tests := []struct {
+		dollars float64
+		cents   int
+	}{
+		{0, 0},
+		{0.1 + 0.2, 30},
+		{1.005, 101},
+		{2.675, 268},
+		{19.99, 1999},
+		{-1.005, -101},
+		{0.004, 0},
+		{-0.004, 0},
+		{1e-7, 0},
+	}
+	for _, tt := range tests {
+		if got := FromDollars(tt.dollars); got != tt.cents {
+			t.Errorf("FromDollars(%v) = %d, want %d", tt.dollars, got, tt.cents)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input   string
+		cents   int
+		wantErr bool
+	}{
+		{"12.34", 1234, false},
+		{"$1,200", 120000, false},
+		{"-0.5", -50, false},
+		{".99", 99, false},
+		{"7.", 700, false},
+		{"0.125", 13, false},
+		{"", 0, true},
+		{"-", 0, true},
+		{"1.2.3", 0, true},
+		{"12a", 0, true},
+		{"99999999999999999999", 0, true},
+	}
+	for _, tt := range tests {
+		cents, err := Parse(tt.input)
+		if (err != nil) != tt.wantErr || cents != tt.cents {
+			t.Errorf("Parse(%q) = %d, %v; want %d, error %v", tt.input, cents, err, tt.cents, tt.wantErr)
+		}
+	}
+}
+
+func TestFormat_ParsesBack(t *testing.T) {
+	property := func(n int64) bool {
+		cents := boundedCents(n)
+		parsed, err := Parse(Format(cents))
+		return err == nil && parsed == cents
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+
+	if got := Format(-1205); got != "-$12.05" {
+		t.Errorf("Format(-1205) = %q", got)
+	}
+}
+
+func TestPercent(t *testing.T) {
+	config := &quick.Config{
+		MaxCount: 10000,
+		Values: func(args []reflect.Value, r *rand.Rand) {
+			args[0] = reflect.ValueOf(r.Intn(maxCents))
+			args[1] = reflect.ValueOf(r.Intn(101))
+		},
+	}
+
+	// Never more than the whole, never off by more than half a cent, and the
+	// two sides of a split always add back up to within a cent
+	property := func(cents, percent int) bool {
+		part := Percent(cents, percent)
+		rest := Percent(cents, 100-percent)
+		exact := float64(cents) * float64(percent) / 100
+		return part >= 0 && part <= cents &&
+			float64(part)-exact <= 0.5 && exact-float64(part) <= 0.5 &&
+			part+rest >= cents-1 && part+rest <= cents+1
+	}
+	if err := quick.Check(property, config); err != nil {
+		t.Error(err)
+	}
+
+	tests := []struct{ cents, percent, want int }{
+		{6000, 50, 3000},
+		{1999, 6, 120}, // 119.94
+		{25, 50, 13},   // 12.5 rounds up
+		{-25, 50, -13}, // and refunds mirror it
+		{1000, 100, 1000},
+		{1000, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := Percent(tt.cents, tt.percent); got != tt.want {
+			t.Errorf("Percent(%d, %d) = %d, want %d", tt.cents, tt.percent, got, tt.want)
+		}
+	}
+}
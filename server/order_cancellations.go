@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // The runtime image ships without a zoneinfo database
+
+	"github.com/gorilla/mux"
+)
+
+// freeCancellationWindow is how long before the pickup window opens an order
+// can still be cancelled for a refund (ORDER_FREE_CANCEL_HOURS). Later
+// cancellations are paid back as account credit instead.
+func freeCancellationWindow() time.Duration {
+	if hours, err := strconv.Atoi(os.Getenv("ORDER_FREE_CANCEL_HOURS")); err == nil && hours >= 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// defaultBusinessTimezone is where pickup dates and slot times are read when
+// BUSINESS_TIMEZONE isn't set
+const defaultBusinessTimezone = "America/New_York"
+
+// businessLocation is the timezone pickup slots are offered in
+// (BUSINESS_TIMEZONE). A slot labelled "9am" opens at 9am there, not in UTC.
+func businessLocation() *time.Location {
+	name := os.Getenv("BUSINESS_TIMEZONE")
+	if name == "" {
+		name = defaultBusinessTimezone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Invalid BUSINESS_TIMEZONE %q, using %s: %v", name, defaultBusinessTimezone, err)
+		loc, _ = time.LoadLocation(defaultBusinessTimezone)
+	}
+	return loc
+}
+
+// timeSlotStartPattern reads the start of a slot label such as "9am-12pm" or
+// "8:00 AM - 12:00 PM"
+var timeSlotStartPattern = regexp.MustCompile(`(?i)^\s*(\d{1,2})(?::(\d{2}))?\s*(am|pm)?`)
+
+// pickupWindowStart returns when an order's pickup window opens, reading the
+// date and slot in loc. Slots that can't be read are taken to start at
+// midnight, the earliest they could.
+func pickupWindowStart(pickupDate time.Time, timeSlot string, loc *time.Location) time.Time {
+	day := time.Date(pickupDate.Year(), pickupDate.Month(), pickupDate.Day(), 0, 0, 0, 0, loc)
+	m := timeSlotStartPattern.FindStringSubmatch(timeSlot)
+	if m == nil {
+		return day
+	}
+	hour, _ := strconv.Atoi(m[1])
+	minute, _ := strconv.Atoi(m[2])
+	switch strings.ToLower(m[3]) {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+	if hour > 23 || minute > 59 {
+		return day
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc)
+}
+
+// OrderCancellation is the outcome of a customer cancelling an order
+type OrderCancellation struct {
+	OrderID int  `json:"order_id"`
+	Late    bool `json:"late"` // Cancelled inside the free cancellation window
+	// FreeUntil is the last moment the order could be cancelled for a refund
+	FreeUntil time.Time `json:"free_until"`
+	Refund    *Refund   `json:"refund,omitempty"`
+	// CreditAmount is what was paid, returned as account credit on a late cancellation
+	CreditAmount float64 `json:"credit_amount"`
+	// CreditsReturned is credit spent on the order and given back
+	CreditsReturned float64   `json:"credits_returned"`
+	CancelledAt     time.Time `json:"cancelled_at"`
+}
+
+// orderRefundableCents returns what's been paid on an order and not yet
+// refunded or promised back
+func orderRefundableCents(q queryRower, orderID int) (int, error) {
+	var remaining int
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(p.amount_cents - COALESCE((
+			SELECT SUM(r.amount_cents) FROM refunds r
+			WHERE r.payment_id = p.id AND r.status IN ('pending', 'requires_action', 'succeeded')
+		), 0)), 0)
+		FROM payments p
+		WHERE p.order_id = $1 AND p.status IN ('completed', 'partially_refunded')`,
+		orderID,
+	).Scan(&remaining)
+	return remaining, err
+}
+
+// CancelOrder cancels one of a customer's orders before pickup. Up to the
+// free cancellation window the payment is refunded to the card; after it
+// the payment comes back as account credit. Either way credit spent on the
+// order is returned, the pickup no longer counts against the subscription's
+// quota, and the order is taken off any route it was planned on.
+func (s *OrderService) CancelOrder(ctx context.Context, userID, orderID int, reason string) (*OrderCancellation, error) {
+	reason = strings.TrimSpace(reason)
+	if len(reason) > 500 {
+		return nil, serviceError(ErrInvalid, "Reason must be 500 characters or fewer")
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var pickupDate time.Time
+	var pickupTimeSlot sql.NullString
+	err = tx.QueryRow(
+		"SELECT status, pickup_date, pickup_time_slot FROM orders WHERE id = $1 AND user_id = $2 FOR UPDATE",
+		orderID, userID,
+	).Scan(&status, &pickupDate, &pickupTimeSlot)
+	if err == sql.ErrNoRows {
+		return nil, serviceError(ErrNotFound, "Order not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status == "cancelled" || !canTransitionOrderStatus(status, "cancelled") {
+		return nil, serviceError(ErrConflict, "A %s order can't be cancelled", strings.ReplaceAll(status, "_", " "))
+	}
+
+	now := time.Now().UTC()
+	cancellation := &OrderCancellation{
+		OrderID:     orderID,
+		FreeUntil:   pickupWindowStart(pickupDate, pickupTimeSlot.String, businessLocation()).Add(-freeCancellationWindow()),
+		CancelledAt: now,
+	}
+	// A pickup we failed to make can always be cancelled for a refund
+	cancellation.Late = status != "failed" && now.After(cancellation.FreeUntil)
+
+	notes := "Cancelled by customer"
+	if reason != "" {
+		notes += ": " + reason
+	}
+	if _, err := tx.Exec("UPDATE orders SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP WHERE id = $1", orderID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO order_status_history (order_id, status, notes, updated_by)
+		VALUES ($1, 'cancelled', $2, $3)`,
+		orderID, notes, userID,
+	); err != nil {
+		return nil, err
+	}
+
+	// Drivers shouldn't turn up for it
+	if _, err := tx.Exec("DELETE FROM route_orders WHERE order_id = $1 AND status = 'pending'", orderID); err != nil {
+		return nil, err
+	}
+	if err := releaseOrderLocker(tx, orderID, "cancelled"); err != nil {
+		return nil, err
+	}
+
+	creditsReturned, err := orderCreditCents(tx, orderID)
+	if err == nil && creditsReturned > 0 {
+		err = reverseOrderCredits(tx, orderID, fmt.Sprintf("Order #%d cancelled", orderID))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("returning credit: %w", err)
+	}
+	cancellation.CreditsReturned = centsToDollars(creditsReturned)
+
+	// Household orders are paid by the account owner, so late-cancellation
+	// credit goes back to them rather than the member who placed the order
+	var payerID int
+	if err := tx.QueryRow("SELECT COALESCE(billed_user_id, user_id) FROM orders WHERE id = $1", orderID).Scan(&payerID); err != nil {
+		return nil, err
+	}
+
+	var refundID *int
+	creditCents := 0
+	if cancellation.Late {
+		if creditCents, err = orderRefundableCents(tx, orderID); err != nil {
+			return nil, err
+		}
+		if creditCents > 0 {
+			_, err = addCredit(tx, payerID, creditCents, "cancellation",
+				fmt.Sprintf("Order #%d cancelled after the free cancellation window", orderID), nil, &orderID, nil)
+			if err != nil {
+				return nil, fmt.Errorf("issuing credit: %w", err)
+			}
+		}
+	} else {
+		id, _, err := reserveRefund(tx, orderID, 0, "Order cancelled by customer", nil, nil)
+		if err != nil && err != errNoRefundablePayment {
+			return nil, fmt.Errorf("refunding order: %w", err)
+		}
+		if err == nil {
+			refundID = &id
+		}
+	}
+	cancellation.CreditAmount = centsToDollars(creditCents)
+
+	if _, err := tx.Exec(`
+		INSERT INTO order_cancellations (order_id, user_id, late, reason, refund_id, credit_cents, cancelled_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		orderID, userID, cancellation.Late, reason, refundID, creditCents, now,
+	); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// The cancellation stands even if Stripe turns the refund down; a failed
+	// refund is flagged for an admin
+	if refundID != nil {
+		if cancellation.Refund, err = submitRefund(s.db, *refundID); err != nil {
+			log.Printf("Failed to record refund %d for cancelled order %d: %v", *refundID, orderID, err)
+		}
+	}
+
+	if s.realtime != nil {
+		go s.realtime.PublishOrderUpdate(userID, orderID, "cancelled", orderStatusMessage("cancelled"), nil)
+	}
+	return cancellation, nil
+}
+
+// handleCancelOrder cancels one of the customer's orders; see CancelOrder
+func (h *OrderHandler) handleCancelOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cancellation, err := h.orders().CancelOrder(r.Context(), userID, orderID, req.Reason)
+	if err != nil {
+		writeServiceError(w, err, "Failed to cancel order")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cancellation)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPickupWindowStart(t *testing.T) {
+	day := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		slot     string
+		expected string
+	}{
+		{"9am-12pm", "09:00"},
+		{"12pm-3pm", "12:00"},
+		{"3pm-6pm", "15:00"},
+		{"8:00 AM - 12:00 PM", "08:00"},
+		{"12:30 am - 2:00 am", "00:30"},
+		{"17:00-19:00", "17:00"},
+		{"anytime", "00:00"},
+		{"", "00:00"},
+	}
+	for _, tt := range tests {
+		if got := pickupWindowStart(day, tt.slot, time.UTC).Format("15:04"); got != tt.expected {
+			t.Errorf("pickupWindowStart(%q) = %s, expected %s", tt.slot, got, tt.expected)
+		}
+	}
+}
+
+func TestPickupWindowStart_BusinessTimezone(t *testing.T) {
+	t.Setenv("BUSINESS_TIMEZONE", "America/Los_Angeles")
+	loc := businessLocation()
+
+	// A 9am slot in Los Angeles opens at 16:00 UTC during daylight time and
+	// 17:00 UTC after the clocks go back
+	summer := pickupWindowStart(time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC), "9am-12pm", loc)
+	if got := summer.UTC().Format("2006-01-02 15:04"); got != "2026-07-01 16:00" {
+		t.Errorf("Expected the summer slot to open at 16:00 UTC, got %s", got)
+	}
+	winter := pickupWindowStart(time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC), "9am-12pm", loc)
+	if got := winter.UTC().Format("2006-01-02 15:04"); got != "2026-12-01 17:00" {
+		t.Errorf("Expected the winter slot to open at 17:00 UTC, got %s", got)
+	}
+
+	// So a day's notice runs to 16:00 UTC the day before; reading the slot
+	// as UTC would have ended it at 09:00
+	freeUntil := summer.Add(-24 * time.Hour)
+	if now := time.Date(2026, 6, 30, 10, 0, 0, 0, time.UTC); now.After(freeUntil) {
+		t.Errorf("Expected %s to be inside the free window ending %s", now, freeUntil)
+	}
+
+	t.Setenv("BUSINESS_TIMEZONE", "Not/AZone")
+	if got := businessLocation().String(); got != defaultBusinessTimezone {
+		t.Errorf("Expected an invalid timezone to fall back to %s, got %s", defaultBusinessTimezone, got)
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	// The orders below label their slots in UTC
+	t.Setenv("BUSINESS_TIMEZONE", "UTC")
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	customerID := db.CreateTestUser(t, "cancel@example.com", "Cancel", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	handler := &OrderHandler{
+		db:        db.DB,
+		realtime:  NewMockRealtimeHandler(),
+		getUserID: CreateAuthMock(customerID).getUserIDFromRequest,
+	}
+
+	// paidOrder is picked up pickupIn from now and paid through the sandbox
+	paidOrder := func(pickupIn time.Duration) int {
+		orderID := db.CreateTestOrder(t, customerID, addressID)
+		pickup := time.Now().UTC().Add(pickupIn)
+		db.Exec("UPDATE orders SET status = 'scheduled', pickup_date = $1, pickup_time_slot = $2 WHERE id = $3",
+			pickup.Format("2006-01-02"), fmt.Sprintf("%d:%02d-23:59", pickup.Hour(), pickup.Minute()), orderID)
+		db.Exec(`
+			INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id)
+			VALUES ($1, $2, 4000, 'extra_order', 'completed', $3)`,
+			customerID, orderID, fmt.Sprintf("%spi_cancel_%d", sandboxPaymentPrefix, orderID))
+		return orderID
+	}
+	cancel := func(orderID int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/v1/orders/%d/cancel", orderID), strings.NewReader(`{"reason": "Going away"}`))
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(orderID)})
+		w := httptest.NewRecorder()
+		handler.handleCancelOrder(w, req)
+		return w
+	}
+
+	// Cancelling well ahead of pickup refunds the card and takes it off the route
+	early := paidOrder(72 * time.Hour)
+	var routeID int
+	db.QueryRow("INSERT INTO driver_routes (driver_id, route_date, route_type) VALUES ($1, CURRENT_DATE + 3, 'pickup') RETURNING id", customerID).Scan(&routeID)
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1)", routeID, early)
+
+	w := cancel(early)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var result OrderCancellation
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.Late || result.Refund == nil || result.Refund.Amount != 40 || result.Refund.Status != "succeeded" || result.CreditAmount != 0 {
+		t.Errorf("Expected a full refund, got %s", w.Body.String())
+	}
+	var stops int
+	db.QueryRow("SELECT COUNT(*) FROM route_orders WHERE order_id = $1", early).Scan(&stops)
+	if stops != 0 {
+		t.Errorf("Expected the order off its route, found %d stops", stops)
+	}
+	if w := cancel(early); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d cancelling twice, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Inside the window the payment comes back as credit instead
+	late := paidOrder(2 * time.Hour)
+	w = cancel(late)
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if w.Code != http.StatusOK || !result.Late || result.Refund != nil || result.CreditAmount != 40 {
+		t.Errorf("Expected a late cancellation paid as credit, got %d %s", w.Code, w.Body.String())
+	}
+	if balance, _ := creditBalance(db.DB, customerID); balance != 4000 {
+		t.Errorf("Expected 4000 cents of credit, got %d", balance)
+	}
+
+	// A household member's late cancellation credits the owner who paid
+	ownerID := db.CreateTestUser(t, "cancel-owner@example.com", "Cancel", "Owner")
+	household := paidOrder(2 * time.Hour)
+	db.Exec("UPDATE orders SET billed_user_id = $1 WHERE id = $2", ownerID, household)
+	db.Exec("UPDATE payments SET user_id = $1 WHERE order_id = $2", ownerID, household)
+	if w := cancel(household); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if balance, _ := creditBalance(db.DB, ownerID); balance != 4000 {
+		t.Errorf("Expected the owner credited 4000 cents, got %d", balance)
+	}
+	if balance, _ := creditBalance(db.DB, customerID); balance != 4000 {
+		t.Errorf("Expected the member's credit unchanged at 4000 cents, got %d", balance)
+	}
+
+	// Once picked up it's too late to cancel
+	pickedUp := paidOrder(-time.Hour)
+	db.Exec("UPDATE orders SET status = 'picked_up' WHERE id = $1", pickedUp)
+	if w := cancel(pickedUp); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a picked up order, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Other customers' orders aren't found
+	handler.getUserID = CreateAuthMock(customerID + 1000).getUserIDFromRequest
+	if w := cancel(pickedUp); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for another customer's order, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxOrderMessageLength = 2000
+	// maxOrderMessages is how much of a conversation one fetch returns
+	maxOrderMessages = 500
+
+	defaultConversationLimit = 50
+	maxConversationLimit     = 200
+)
+
+// OrderChatPublisher pushes chat messages and read receipts to an order's
+// conversation channel
+type OrderChatPublisher interface {
+	PublishOrderChat(orderID int, event OrderUpdateMessage) error
+}
+
+// OrderChatHandler is the in-app chat on an order. The customer and the
+// drivers whose routes include the order take part while it's under way;
+// support can read and post in any order's conversation through the admin
+// routes.
+type OrderChatHandler struct {
+	db        *sql.DB
+	realtime  OrderChatPublisher
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewOrderChatHandler(db *sql.DB, realtime OrderChatPublisher) *OrderChatHandler {
+	return &OrderChatHandler{
+		db:        db,
+		realtime:  realtime,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// OrderMessage is one message in an order's conversation
+type OrderMessage struct {
+	ID         int       `json:"id"`
+	OrderID    int       `json:"order_id"`
+	SenderID   *int      `json:"sender_id"` // Nil once the sender's account is deleted
+	SenderRole string    `json:"sender_role"`
+	SenderName string    `json:"sender_name"`
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// OrderMessageRead is how far one participant has read a conversation
+type OrderMessageRead struct {
+	OrderID           int       `json:"order_id"`
+	UserID            int       `json:"user_id"`
+	Role              string    `json:"role"`
+	LastReadMessageID int       `json:"last_read_message_id"`
+	ReadAt            time.Time `json:"read_at"`
+}
+
+// OrderChatTyping says a participant started or stopped typing. It's
+// published as it happens and never stored.
+type OrderChatTyping struct {
+	OrderID int    `json:"order_id"`
+	UserID  int    `json:"user_id"`
+	Role    string `json:"role"`
+	Typing  bool   `json:"typing"`
+}
+
+// OrderConversation is an order's chat as the caller sees it
+type OrderConversation struct {
+	OrderID  int                `json:"order_id"`
+	Channel  string             `json:"channel"` // Centrifuge channel new messages arrive on
+	Role     string             `json:"role"`    // The caller's part in the conversation
+	CanSend  bool               `json:"can_send"`
+	Unread   int                `json:"unread"`
+	Messages []OrderMessage     `json:"messages"`
+	Reads    []OrderMessageRead `json:"reads"`
+}
+
+// ConversationSummary is an order's conversation in the support queue
+type ConversationSummary struct {
+	OrderID       int          `json:"order_id"`
+	OrderStatus   string       `json:"order_status"`
+	CustomerID    int          `json:"customer_id"`
+	CustomerName  string       `json:"customer_name"`
+	Messages      int          `json:"messages"`
+	LastMessage   OrderMessage `json:"last_message"`
+	AwaitingReply bool         `json:"awaiting_reply"` // The last message isn't from support
+}
+
+type SendOrderMessageRequest struct {
+	Body string `json:"body"`
+}
+
+type MarkOrderMessagesReadRequest struct {
+	// Defaults to the latest message
+	LastReadMessageID int `json:"last_read_message_id,omitempty"`
+}
+
+// orderMessageColumns selects an OrderMessage from order_messages m joined
+// to its sender u. Support staff are shown by team rather than by name.
+const orderMessageColumns = `
+	m.id, m.order_id, m.sender_id, m.sender_role,
+	CASE WHEN m.sender_role = 'support' THEN 'Tumble Support' ELSE COALESCE(u.first_name, '') END,
+	m.body, m.created_at`
+
+func scanOrderMessage(row interface{ Scan(...interface{}) error }) (OrderMessage, error) {
+	var msg OrderMessage
+	err := row.Scan(&msg.ID, &msg.OrderID, &msg.SenderID, &msg.SenderRole, &msg.SenderName, &msg.Body, &msg.CreatedAt)
+	return msg, err
+}
+
+// orderChatRole works out a user's part in an order's conversation: its
+// customer, or a driver with the order on one of their open routes. Drivers
+// drop out once their route is completed or cancelled, like the rest of the
+// customer's details. open is false once the order is delivered or
+// cancelled. sql.ErrNoRows means the user isn't part of it.
+func orderChatRole(q queryRower, orderID, userID int) (role string, open bool, err error) {
+	var customer, driver bool
+	err = q.QueryRow(`
+		SELECT o.user_id = $2,
+			EXISTS (
+				SELECT 1 FROM route_orders ro
+				JOIN driver_routes dr ON dr.id = ro.route_id
+				WHERE ro.order_id = o.id AND dr.driver_id = $2 AND dr.status <> ALL($3)
+			),
+			o.status NOT IN ('delivered', 'cancelled')
+		FROM orders o WHERE o.id = $1`,
+		orderID, userID, pq.Array(closedRouteStatuses),
+	).Scan(&customer, &driver, &open)
+	switch {
+	case err != nil:
+		return "", false, err
+	case customer:
+		return "customer", open, nil
+	case driver:
+		return "driver", open, nil
+	}
+	return "", false, sql.ErrNoRows
+}
+
+// participant resolves the calling customer or driver and their role in the
+// order's conversation, writing the error response when there isn't one
+func (h *OrderChatHandler) participant(w http.ResponseWriter, r *http.Request) (orderID, userID int, role string, open bool, ok bool) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	orderID, err = strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	role, open, err = orderChatRole(h.db, orderID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load conversation", http.StatusInternalServerError)
+		return
+	}
+	return orderID, userID, role, open, true
+}
+
+// supportParticipant resolves the calling admin joining an order's
+// conversation as support
+func (h *OrderChatHandler) supportParticipant(w http.ResponseWriter, r *http.Request) (orderID, userID int, ok bool) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	orderID, err = strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM orders WHERE id = $1)", orderID).Scan(&exists); err != nil {
+		http.Error(w, "Failed to load conversation", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	return orderID, userID, true
+}
+
+// handleGetOrderMessages returns an order's conversation to its customer or driver
+func (h *OrderChatHandler) handleGetOrderMessages(w http.ResponseWriter, r *http.Request) {
+	orderID, userID, role, open, ok := h.participant(w, r)
+	if !ok {
+		return
+	}
+	h.writeConversation(w, r, orderID, userID, role, open)
+}
+
+// handleSendOrderMessage posts a customer or driver message. The chat closes
+// once the order is delivered or cancelled.
+func (h *OrderChatHandler) handleSendOrderMessage(w http.ResponseWriter, r *http.Request) {
+	orderID, userID, role, open, ok := h.participant(w, r)
+	if !ok {
+		return
+	}
+	if !open {
+		http.Error(w, "This order's chat is closed", http.StatusConflict)
+		return
+	}
+	h.sendMessage(w, r, orderID, userID, role)
+}
+
+// handleMarkOrderMessagesRead records a customer or driver read receipt
+func (h *OrderChatHandler) handleMarkOrderMessagesRead(w http.ResponseWriter, r *http.Request) {
+	orderID, userID, role, _, ok := h.participant(w, r)
+	if !ok {
+		return
+	}
+	h.markRead(w, r, orderID, userID, role)
+}
+
+// handleAdminGetOrderMessages returns any order's conversation to support
+func (h *OrderChatHandler) handleAdminGetOrderMessages(w http.ResponseWriter, r *http.Request) {
+	orderID, userID, ok := h.supportParticipant(w, r)
+	if !ok {
+		return
+	}
+	h.writeConversation(w, r, orderID, userID, "support", true)
+}
+
+// handleAdminSendOrderMessage joins an order's conversation as support. Support
+// can post after the order is closed, e.g. to follow up on a complaint.
+func (h *OrderChatHandler) handleAdminSendOrderMessage(w http.ResponseWriter, r *http.Request) {
+	orderID, userID, ok := h.supportParticipant(w, r)
+	if !ok {
+		return
+	}
+	h.sendMessage(w, r, orderID, userID, "support")
+}
+
+// handleAdminMarkOrderMessagesRead records a support read receipt
+func (h *OrderChatHandler) handleAdminMarkOrderMessagesRead(w http.ResponseWriter, r *http.Request) {
+	orderID, userID, ok := h.supportParticipant(w, r)
+	if !ok {
+		return
+	}
+	h.markRead(w, r, orderID, userID, "support")
+}
+
+// writeConversation responds with an order's latest messages, or those after
+// the after query parameter when the app is catching up
+func (h *OrderChatHandler) writeConversation(w http.ResponseWriter, r *http.Request, orderID, userID int, role string, canSend bool) {
+	after := 0
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.Atoi(v); err != nil || after < 0 {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conversation := OrderConversation{
+		OrderID:  orderID,
+		Channel:  orderChatChannel(orderID),
+		Role:     role,
+		CanSend:  canSend,
+		Messages: []OrderMessage{},
+		Reads:    []OrderMessageRead{},
+	}
+
+	rows, err := h.db.Query(`
+		SELECT * FROM (
+			SELECT `+orderMessageColumns+`
+			FROM order_messages m
+			LEFT JOIN users u ON u.id = m.sender_id
+			WHERE m.order_id = $1 AND m.id > $2
+			ORDER BY m.id DESC
+			LIMIT $3
+		) latest ORDER BY id`,
+		orderID, after, maxOrderMessages,
+	)
+	if err != nil {
+		http.Error(w, "Failed to load messages", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg, err := scanOrderMessage(rows)
+		if err != nil {
+			http.Error(w, "Failed to load messages", http.StatusInternalServerError)
+			return
+		}
+		conversation.Messages = append(conversation.Messages, msg)
+	}
+	rows.Close()
+
+	// A reader who isn't the customer or a driver on the order is support
+	rows, err = h.db.Query(`
+		SELECT r.order_id, r.user_id,
+			CASE
+				WHEN r.user_id = o.user_id THEN 'customer'
+				WHEN EXISTS (
+					SELECT 1 FROM route_orders ro
+					JOIN driver_routes dr ON dr.id = ro.route_id
+					WHERE ro.order_id = o.id AND dr.driver_id = r.user_id
+				) THEN 'driver'
+				ELSE 'support'
+			END,
+			r.last_read_message_id, r.read_at
+		FROM order_message_reads r
+		JOIN orders o ON o.id = r.order_id
+		WHERE r.order_id = $1
+		ORDER BY r.user_id`,
+		orderID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to load read receipts", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var read OrderMessageRead
+		if err := rows.Scan(&read.OrderID, &read.UserID, &read.Role, &read.LastReadMessageID, &read.ReadAt); err != nil {
+			http.Error(w, "Failed to load read receipts", http.StatusInternalServerError)
+			return
+		}
+		conversation.Reads = append(conversation.Reads, read)
+	}
+
+	err = h.db.QueryRow(`
+		SELECT COUNT(*) FROM order_messages m
+		WHERE m.order_id = $1 AND m.sender_id IS DISTINCT FROM $2
+			AND m.id > COALESCE((SELECT last_read_message_id FROM order_message_reads WHERE order_id = $1 AND user_id = $2), 0)`,
+		orderID, userID,
+	).Scan(&conversation.Unread)
+	if err != nil {
+		http.Error(w, "Failed to load conversation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversation)
+}
+
+// sendMessage stores a message, marks the conversation read up to it for the
+// sender and publishes it to the order's chat channel
+func (h *OrderChatHandler) sendMessage(w http.ResponseWriter, r *http.Request, orderID, userID int, role string) {
+	var req SendOrderMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" {
+		http.Error(w, "body is required", http.StatusBadRequest)
+		return
+	}
+	if len([]rune(req.Body)) > maxOrderMessageLength {
+		http.Error(w, "body must be at most "+strconv.Itoa(maxOrderMessageLength)+" characters", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	msg, err := scanOrderMessage(tx.QueryRow(`
+		WITH m AS (
+			INSERT INTO order_messages (order_id, sender_id, sender_role, body)
+			VALUES ($1, $2, $3, $4)
+			RETURNING *
+		)
+		SELECT `+orderMessageColumns+`
+		FROM m LEFT JOIN users u ON u.id = m.sender_id`,
+		orderID, userID, role, req.Body,
+	))
+	if err != nil {
+		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		return
+	}
+	if _, _, err := recordOrderMessageRead(tx, orderID, userID, msg.ID); err != nil {
+		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		return
+	}
+
+	if h.realtime != nil {
+		if err := h.realtime.PublishOrderChat(orderID, orderChatMessage(msg)); err != nil {
+			log.Printf("Failed to publish chat message %d on order %d: %v", msg.ID, orderID, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// markRead moves the caller's read receipt forward and tells the other
+// participants. Receipts never move backwards.
+func (h *OrderChatHandler) markRead(w http.ResponseWriter, r *http.Request, orderID, userID int, role string) {
+	var req MarkOrderMessagesReadRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.LastReadMessageID < 0 {
+		http.Error(w, "Invalid last_read_message_id", http.StatusBadRequest)
+		return
+	}
+
+	// Only messages in this conversation count, so a receipt can't run ahead of it
+	var lastID int
+	err := h.db.QueryRow(`
+		SELECT COALESCE(MAX(id), 0) FROM order_messages
+		WHERE order_id = $1 AND ($2 = 0 OR id <= $2)`,
+		orderID, req.LastReadMessageID,
+	).Scan(&lastID)
+	if err != nil {
+		http.Error(w, "Failed to mark messages read", http.StatusInternalServerError)
+		return
+	}
+	if lastID == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	receipt := OrderMessageRead{OrderID: orderID, UserID: userID, Role: role}
+	advanced, readAt, err := recordOrderMessageRead(h.db, orderID, userID, lastID)
+	if err != nil {
+		http.Error(w, "Failed to mark messages read", http.StatusInternalServerError)
+		return
+	}
+	if !advanced {
+		err = h.db.QueryRow(`
+			SELECT last_read_message_id, read_at FROM order_message_reads
+			WHERE order_id = $1 AND user_id = $2`,
+			orderID, userID,
+		).Scan(&receipt.LastReadMessageID, &receipt.ReadAt)
+		if err != nil {
+			http.Error(w, "Failed to mark messages read", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		receipt.LastReadMessageID, receipt.ReadAt = lastID, readAt
+		if h.realtime != nil {
+			if err := h.realtime.PublishOrderChat(orderID, orderChatReadMessage(receipt)); err != nil {
+				log.Printf("Failed to publish read receipt on order %d: %v", orderID, err)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// recordOrderMessageRead moves a read receipt up to messageID. advanced is
+// false when the receipt was already there or further on.
+func recordOrderMessageRead(q queryRower, orderID, userID, messageID int) (advanced bool, readAt time.Time, err error) {
+	err = q.QueryRow(`
+		INSERT INTO order_message_reads (order_id, user_id, last_read_message_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (order_id, user_id) DO UPDATE SET
+			last_read_message_id = EXCLUDED.last_read_message_id,
+			read_at = CURRENT_TIMESTAMP
+		WHERE order_message_reads.last_read_message_id < EXCLUDED.last_read_message_id
+		RETURNING read_at`,
+		orderID, userID, messageID,
+	).Scan(&readAt)
+	if err == sql.ErrNoRows {
+		return false, readAt, nil
+	}
+	return err == nil, readAt, err
+}
+
+// handleListConversations is the support queue: orders with a conversation,
+// most recently active first. awaiting_reply=true keeps only those where the
+// customer or driver spoke last.
+func (h *OrderChatHandler) handleListConversations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	awaitingOnly := query.Get("awaiting_reply") == "true"
+	limit := defaultConversationLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxConversationLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxConversationLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := h.db.Query(`
+		WITH latest AS (
+			SELECT DISTINCT ON (order_id) id, order_id
+			FROM order_messages
+			ORDER BY order_id, id DESC
+		)
+		SELECT o.id, o.status, o.user_id, TRIM(c.first_name || ' ' || c.last_name),
+			(SELECT COUNT(*) FROM order_messages WHERE order_id = o.id),
+			`+orderMessageColumns+`
+		FROM latest
+		JOIN orders o ON o.id = latest.order_id
+		JOIN users c ON c.id = o.user_id
+		JOIN order_messages m ON m.id = latest.id
+		LEFT JOIN users u ON u.id = m.sender_id
+		WHERE NOT $1 OR m.sender_role <> 'support'
+		ORDER BY m.id DESC
+		LIMIT $2`,
+		awaitingOnly, limit,
+	)
+	if err != nil {
+		http.Error(w, "Failed to load conversations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	conversations := []ConversationSummary{}
+	for rows.Next() {
+		var c ConversationSummary
+		m := &c.LastMessage
+		if err := rows.Scan(
+			&c.OrderID, &c.OrderStatus, &c.CustomerID, &c.CustomerName, &c.Messages,
+			&m.ID, &m.OrderID, &m.SenderID, &m.SenderRole, &m.SenderName, &m.Body, &m.CreatedAt,
+		); err != nil {
+			http.Error(w, "Failed to load conversations", http.StatusInternalServerError)
+			return
+		}
+		c.AwaitingReply = m.SenderRole != "support"
+		conversations = append(conversations, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conversations)
+}
+
+// chatTypingRPCMethod is the Centrifuge RPC the app calls when the user starts
+// or stops typing in an order's chat, with {"order_id": N, "typing": true}
+const chatTypingRPCMethod = "chat_typing"
+
+// sendChatTyping tells an order's conversation that the connected user is
+// typing. Customers and drivers can only while the chat is open; staff who
+// can reply in order chats show as support.
+func (h *RealtimeHandler) sendChatTyping(connUserID string, data []byte) ([]byte, error) {
+	userID, err := strconv.Atoi(connUserID)
+	if err != nil || userID <= 0 {
+		return nil, centrifuge.ErrorPermissionDenied
+	}
+	var req struct {
+		OrderID int  `json:"order_id"`
+		Typing  bool `json:"typing"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil || req.OrderID <= 0 {
+		return nil, centrifuge.ErrorBadRequest
+	}
+
+	role, open, err := orderChatRole(h.db, req.OrderID, userID)
+	if err == sql.ErrNoRows {
+		if allowed, err := userHasPermission(h.db, userID, "orders.manage"); err != nil {
+			log.Printf("Failed to check orders.manage for user %d: %v", userID, err)
+			return nil, centrifuge.ErrorInternal
+		} else if !allowed {
+			return nil, centrifuge.ErrorPermissionDenied
+		}
+		role, open, err = "support", true, nil
+	}
+	if err != nil {
+		log.Printf("Failed to resolve chat role: user=%d, order=%d: %v", userID, req.OrderID, err)
+		return nil, centrifuge.ErrorInternal
+	}
+	if !open {
+		return nil, centrifuge.ErrorPermissionDenied
+	}
+
+	typing := OrderChatTyping{OrderID: req.OrderID, UserID: userID, Role: role, Typing: req.Typing}
+	if err := h.PublishOrderChat(req.OrderID, orderChatTypingMessage(typing)); err != nil {
+		log.Printf("Failed to publish typing on order %d: %v", req.OrderID, err)
+		return nil, centrifuge.ErrorInternal
+	}
+	return json.Marshal(typing)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/centrifugal/centrifuge"
+	"github.com/gorilla/mux"
+)
+
+// recordingChatPublisher remembers the chat events sent per order
+type recordingChatPublisher struct {
+	events []OrderUpdateMessage
+}
+
+func (p *recordingChatPublisher) PublishOrderChat(orderID int, event OrderUpdateMessage) error {
+	p.events = append(p.events, event)
+	return nil
+}
+
+func TestOrderChat(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	customerID := db.CreateTestUser(t, "chat-customer@example.com", "Chat", "Customer")
+	driverID := db.CreateTestUser(t, "chat-driver@example.com", "Chat", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	strangerID := db.CreateTestUser(t, "chat-stranger@example.com", "Chat", "Stranger")
+	adminID := db.CreateTestUser(t, "chat-admin@example.com", "Chat", "Admin")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'in_progress') RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1)", routeID, orderID)
+
+	publisher := &recordingChatPublisher{}
+	handler := NewOrderChatHandler(db.DB, publisher)
+	call := func(userID int, fn http.HandlerFunc, method, query, body string) *httptest.ResponseRecorder {
+		handler.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+		req := httptest.NewRequest(method, fmt.Sprintf("/api/v1/orders/%d/messages%s", orderID, query), strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(orderID)})
+		w := httptest.NewRecorder()
+		fn(w, req)
+		return w
+	}
+	conversation := func(userID int, fn http.HandlerFunc, query string) OrderConversation {
+		w := call(userID, fn, "GET", query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var c OrderConversation
+		json.Unmarshal(w.Body.Bytes(), &c)
+		return c
+	}
+
+	w := call(customerID, handler.handleSendOrderMessage, "POST", "", `{"body": "  Gate code is 1234  "}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var gateCode OrderMessage
+	json.Unmarshal(w.Body.Bytes(), &gateCode)
+	if gateCode.Body != "Gate code is 1234" || gateCode.SenderRole != "customer" || gateCode.SenderName != "Chat" {
+		t.Errorf("Unexpected message: %s", w.Body.String())
+	}
+	if len(publisher.events) != 1 || publisher.events[0].Type != "order_message" || publisher.events[0].Message != gateCode.Body {
+		t.Errorf("Expected the message published to the order's chat, got %+v", publisher.events)
+	}
+
+	// The driver on the route sees it unread; someone else's order is invisible
+	c := conversation(driverID, handler.handleGetOrderMessages, "")
+	if c.Role != "driver" || !c.CanSend || c.Unread != 1 || len(c.Messages) != 1 || c.Channel != orderChatChannel(orderID) {
+		t.Errorf("Unexpected driver conversation: %+v", c)
+	}
+	if w := call(strangerID, handler.handleGetOrderMessages, "GET", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a stranger, got %d", http.StatusNotFound, w.Code)
+	}
+	for _, body := range []string{`{"body": "   "}`, fmt.Sprintf(`{"body": %q}`, strings.Repeat("a", maxOrderMessageLength+1))} {
+		if w := call(driverID, handler.handleSendOrderMessage, "POST", "", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for an invalid body, got %d", http.StatusBadRequest, w.Code)
+		}
+	}
+
+	if w := call(driverID, handler.handleMarkOrderMessagesRead, "POST", "", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if last := publisher.events[len(publisher.events)-1]; last.Type != "order_message_read" {
+		t.Errorf("Expected a read receipt published, got %s", last.Type)
+	}
+	// Reading again doesn't move the receipt or publish another one
+	published := len(publisher.events)
+	call(driverID, handler.handleMarkOrderMessagesRead, "POST", "", `{"last_read_message_id": 1}`)
+	if len(publisher.events) != published {
+		t.Error("Expected no receipt for a read that didn't advance")
+	}
+	c = conversation(customerID, handler.handleGetOrderMessages, "")
+	if len(c.Reads) != 2 || c.Unread != 0 {
+		t.Errorf("Expected customer and driver receipts, got %+v", c)
+	}
+
+	// Support joins any conversation, and only new messages come back with after
+	w = call(adminID, handler.handleAdminSendOrderMessage, "POST", "", `{"body": "We've passed it on"}`)
+	var reply OrderMessage
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	if w.Code != http.StatusCreated || reply.SenderRole != "support" || reply.SenderName != "Tumble Support" {
+		t.Errorf("Unexpected support reply %d: %s", w.Code, w.Body.String())
+	}
+	c = conversation(customerID, handler.handleGetOrderMessages, fmt.Sprintf("?after=%d", gateCode.ID))
+	if len(c.Messages) != 1 || c.Messages[0].ID != reply.ID || c.Unread != 1 {
+		t.Errorf("Expected only the support reply after the first message, got %+v", c)
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleListConversations(w, httptest.NewRequest("GET", "/api/v1/admin/conversations?awaiting_reply=true", nil))
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("Expected no conversations awaiting support, got %s", w.Body.String())
+	}
+
+	// The pickup driver drops out of the conversation once their route closes
+	db.Exec("UPDATE driver_routes SET status = 'completed' WHERE id = $1", routeID)
+	if w := call(driverID, handler.handleGetOrderMessages, "GET", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a driver whose route closed, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := call(driverID, handler.handleSendOrderMessage, "POST", "", `{"body": "Still here"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d posting after the route closed, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Once delivered only support can post
+	db.Exec("UPDATE orders SET status = 'delivered' WHERE id = $1", orderID)
+	if w := call(customerID, handler.handleSendOrderMessage, "POST", "", `{"body": "Thanks"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d after delivery, got %d", http.StatusConflict, w.Code)
+	}
+	if w := call(adminID, handler.handleAdminSendOrderMessage, "POST", "", `{"body": "How was everything?"}`); w.Code != http.StatusCreated {
+		t.Errorf("Expected support to post after delivery, got %d", w.Code)
+	}
+}
+
+func TestOrderChat_Typing(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	customerID := db.CreateTestUser(t, "typing-customer@example.com", "Typing", "Customer")
+	strangerID := db.CreateTestUser(t, "typing-stranger@example.com", "Typing", "Stranger")
+	adminID := db.CreateTestUser(t, "typing-admin@example.com", "Typing", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	orderID := db.CreateTestOrder(t, customerID, db.CreateTestAddress(t, customerID))
+
+	handler := &RealtimeHandler{db: db.DB, node: setupCentrifugeNode(t)}
+	typing := func(userID interface{}, body string) (OrderChatTyping, error) {
+		var result OrderChatTyping
+		var rpcErr error
+		handler.handleRPC(fmt.Sprint(userID), centrifuge.RPCEvent{Method: chatTypingRPCMethod, Data: []byte(body)},
+			func(reply centrifuge.RPCReply, err error) {
+				rpcErr = err
+				json.Unmarshal(reply.Data, &result)
+			})
+		return result, rpcErr
+	}
+	body := fmt.Sprintf(`{"order_id": %d, "typing": true}`, orderID)
+
+	if result, err := typing(customerID, body); err != nil || result.Role != "customer" || !result.Typing {
+		t.Errorf("Expected the customer's typing sent, got %+v (%v)", result, err)
+	}
+	if result, err := typing(adminID, body); err != nil || result.Role != "support" {
+		t.Errorf("Expected staff to type as support, got %+v (%v)", result, err)
+	}
+	if _, err := typing(strangerID, body); err != centrifuge.ErrorPermissionDenied {
+		t.Errorf("Expected a stranger refused, got %v", err)
+	}
+	if _, err := typing("anonymous-client-id", body); err != centrifuge.ErrorPermissionDenied {
+		t.Errorf("Expected an anonymous connection refused, got %v", err)
+	}
+	if _, err := typing(customerID, `{"typing": true}`); err != centrifuge.ErrorBadRequest {
+		t.Errorf("Expected a missing order refused, got %v", err)
+	}
+
+	// The customer can't type into a closed conversation
+	db.Exec("UPDATE orders SET status = 'delivered' WHERE id = $1", orderID)
+	if _, err := typing(customerID, body); err != centrifuge.ErrorPermissionDenied {
+		t.Errorf("Expected typing refused after delivery, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultOrderFeedLimit = 50
+	maxOrderFeedLimit     = 200
+)
+
+// OrderFeedHandler serves the ops wallboard's live feed of order events.
+// The wallboard polls every few seconds, so the query is kept to columns
+// covered by idx_order_status_history_feed and never joins. An event whose
+// transaction commits after a higher ID has been read is skipped, which is
+// fine for a wallboard but not for anything that must see every event.
+type OrderFeedHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewOrderFeedHandler(db *sql.DB) *OrderFeedHandler {
+	return &OrderFeedHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// OrderFeedEvent is one order status change
+type OrderFeedEvent struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrderFeed struct {
+	Events []OrderFeedEvent `json:"events"`
+	// NextAfterID is what to pass as after_id on the next poll. It stays put
+	// when nothing new has happened.
+	NextAfterID int `json:"next_after_id"`
+	// HasMore means the page was full and the client should poll again
+	// straight away rather than waiting
+	HasMore bool `json:"has_more"`
+}
+
+// getOrderFeed returns up to limit events after afterID in ascending ID
+// order. With no afterID it returns the most recent events, still
+// ascending, so a wallboard that just loaded has something to show.
+func getOrderFeed(db *sql.DB, afterID, limit int) (OrderFeed, error) {
+	var rows *sql.Rows
+	var err error
+	if afterID > 0 {
+		rows, err = db.Query(`
+			SELECT id, order_id, status, created_at
+			FROM order_status_history
+			WHERE id > $1
+			ORDER BY id
+			LIMIT $2`,
+			afterID, limit,
+		)
+	} else {
+		rows, err = db.Query(`
+			SELECT id, order_id, status, created_at FROM (
+				SELECT id, order_id, status, created_at
+				FROM order_status_history
+				ORDER BY id DESC
+				LIMIT $1
+			) latest
+			ORDER BY id`,
+			limit,
+		)
+	}
+	if err != nil {
+		return OrderFeed{}, err
+	}
+	defer rows.Close()
+
+	feed := OrderFeed{Events: []OrderFeedEvent{}, NextAfterID: afterID}
+	for rows.Next() {
+		var e OrderFeedEvent
+		if err := rows.Scan(&e.ID, &e.OrderID, &e.Status, &e.CreatedAt); err != nil {
+			return OrderFeed{}, err
+		}
+		feed.Events = append(feed.Events, e)
+		feed.NextAfterID = e.ID
+	}
+	feed.HasMore = afterID > 0 && len(feed.Events) == limit
+	return feed, rows.Err()
+}
+
+// handleGetOrderFeed returns order events after ?after_id=, oldest first.
+// ?limit= caps the page (default 50, max 200).
+func (h *OrderFeedHandler) handleGetOrderFeed(w http.ResponseWriter, r *http.Request) {
+	afterID := 0
+	if raw := r.URL.Query().Get("after_id"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			http.Error(w, "after_id must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		afterID = parsed
+	}
+
+	limit := defaultOrderFeedLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if parsed < maxOrderFeedLimit {
+			limit = parsed
+		} else {
+			limit = maxOrderFeedLimit
+		}
+	}
+
+	feed, err := getOrderFeed(h.db, afterID, limit)
+	if err != nil {
+		http.Error(w, "Failed to fetch order feed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(feed)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestOrderFeed(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "feed@example.com", "Feed", "Customer")
+	addressID := db.CreateTestAddress(t, userID)
+	orderIDs := []int{}
+	for i := 0; i < 3; i++ {
+		orderIDs = append(orderIDs, db.CreateTestOrder(t, userID, addressID))
+	}
+
+	handler := NewOrderFeedHandler(db.DB)
+	getFeed := func(query string) OrderFeed {
+		w := httptest.NewRecorder()
+		handler.handleGetOrderFeed(w, httptest.NewRequest("GET", "/api/v1/admin/orders/feed"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var feed OrderFeed
+		json.Unmarshal(w.Body.Bytes(), &feed)
+		return feed
+	}
+
+	// A fresh wallboard gets the latest events, oldest first
+	feed := getFeed("?limit=2")
+	if len(feed.Events) != 2 || feed.Events[0].OrderID != orderIDs[1] || feed.Events[1].OrderID != orderIDs[2] {
+		t.Fatalf("Expected the last two orders in ID order, got %+v", feed.Events)
+	}
+	if feed.NextAfterID != feed.Events[1].ID || feed.HasMore {
+		t.Errorf("Unexpected cursor %+v", feed)
+	}
+
+	// Polling from the cursor sees nothing until something happens
+	cursor := feed.NextAfterID
+	if feed := getFeed("?after_id=" + strconv.Itoa(cursor)); len(feed.Events) != 0 || feed.NextAfterID != cursor {
+		t.Errorf("Expected an empty poll that keeps the cursor, got %+v", feed)
+	}
+	db.Exec("INSERT INTO order_status_history (order_id, status) VALUES ($1, 'picked_up')", orderIDs[0])
+	latest := getFeed("?after_id=" + strconv.Itoa(cursor))
+	if len(latest.Events) != 1 || latest.Events[0].OrderID != orderIDs[0] || latest.Events[0].Status != "picked_up" {
+		t.Errorf("Expected the new pickup, got %+v", latest.Events)
+	}
+
+	// A full page tells the wallboard to catch up without waiting
+	page := getFeed("?after_id=" + strconv.Itoa(feed.Events[0].ID-1) + "&limit=2")
+	if len(page.Events) != 2 || !page.HasMore || page.Events[0].ID != feed.Events[0].ID {
+		t.Errorf("Expected a full page from the cursor, got %+v", page)
+	}
+
+	w := httptest.NewRecorder()
+	handler.handleGetOrderFeed(w, httptest.NewRequest("GET", "/api/v1/admin/orders/feed?after_id=latest", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a bad cursor, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"tumble-backend/money"
+
+	"github.com/lib/pq"
+)
+
+// OrderIntegrityHandler finds orders whose stored cents columns disagree with
+// their line items, mostly left over from the dollars to cents migration
+type OrderIntegrityHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewOrderIntegrityHandler(db *sql.DB) *OrderIntegrityHandler {
+	return &OrderIntegrityHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type OrderTotalIssue struct {
+	OrderID          int      `json:"order_id"`
+	UserID           int      `json:"user_id"`
+	Status           string   `json:"status"`
+	StoredSubtotal   *float64 `json:"stored_subtotal"`
+	ExpectedSubtotal float64  `json:"expected_subtotal"`
+	StoredTotal      *float64 `json:"stored_total"`
+	ExpectedTotal    float64  `json:"expected_total"`
+	Problems         []string `json:"problems"`
+	// LikelyCause is set when the stored value looks like dollars saved as cents
+	LikelyCause           *string `json:"likely_cause,omitempty"`
+	storedSubtotalCents   *int
+	expectedSubtotalCents int
+	storedTotalCents      *int
+	expectedTotalCents    int
+}
+
+type FixOrderTotalsRequest struct {
+	OrderIDs []int `json:"order_ids,omitempty"` // Empty fixes every flagged order
+}
+
+// orderTotalProblems compares stored totals with recomputed ones
+func orderTotalProblems(issue *OrderTotalIssue) {
+	issue.Problems = []string{}
+	if issue.storedSubtotalCents == nil || issue.storedTotalCents == nil {
+		issue.Problems = append(issue.Problems, "missing_totals")
+	}
+	if issue.storedSubtotalCents != nil && *issue.storedSubtotalCents != issue.expectedSubtotalCents {
+		issue.Problems = append(issue.Problems, "subtotal_mismatch")
+	}
+	if issue.storedTotalCents != nil && *issue.storedTotalCents != issue.expectedTotalCents {
+		issue.Problems = append(issue.Problems, "total_mismatch")
+	}
+
+	// A value 100x too small was written in dollars after the switch to cents
+	stored := issue.storedSubtotalCents
+	if stored != nil && *stored != issue.expectedSubtotalCents && *stored*100 == issue.expectedSubtotalCents {
+		cause := "stored_in_dollars"
+		issue.LikelyCause = &cause
+	}
+}
+
+// findOrderTotalIssues recomputes every order's subtotal from its items,
+// garments, add-ons, zone surcharge, slot pricing and overweight charge and
+// returns those that don't match what's stored.
+// When orderIDs is non-empty only those orders are checked.
+func findOrderTotalIssues(db *sql.DB, orderIDs []int) ([]OrderTotalIssue, error) {
+	rows, err := db.Query(`
+		WITH expected AS (
+			SELECT o.id,
+				COALESCE((SELECT SUM(oi.price_cents * oi.quantity + oi.options_price_cents) FROM order_items oi WHERE oi.order_id = o.id), 0)
+				+ COALESCE((SELECT SUM(og.unit_price_cents * og.quantity) FROM order_garments og WHERE og.order_id = o.id AND NOT og.added_at_pickup), 0)
+				+ COALESCE((SELECT SUM(oa.unit_price_cents * oa.quantity) FROM order_add_ons oa WHERE oa.order_id = o.id), 0)
+				+ o.zone_surcharge_cents + o.slot_adjustment_cents + o.overweight_cents
+				AS subtotal_cents
+			FROM orders o
+			WHERE cardinality($1::int[]) = 0 OR o.id = ANY($1)
+		)
+		SELECT o.id, o.user_id, o.status, o.subtotal_cents, o.total_cents,
+		       e.subtotal_cents, e.subtotal_cents + COALESCE(o.tax_cents, 0) + COALESCE(o.tip_cents, 0)
+		FROM orders o
+		JOIN expected e ON e.id = o.id
+		WHERE o.subtotal_cents IS NULL OR o.total_cents IS NULL
+		   OR o.subtotal_cents != e.subtotal_cents
+		   OR o.total_cents != e.subtotal_cents + COALESCE(o.tax_cents, 0) + COALESCE(o.tip_cents, 0)
+		ORDER BY o.id`,
+		pq.Array(append([]int{}, orderIDs...)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	issues := []OrderTotalIssue{}
+	for rows.Next() {
+		var issue OrderTotalIssue
+		if err := rows.Scan(&issue.OrderID, &issue.UserID, &issue.Status,
+			&issue.storedSubtotalCents, &issue.storedTotalCents,
+			&issue.expectedSubtotalCents, &issue.expectedTotalCents); err != nil {
+			return nil, err
+		}
+		if issue.storedSubtotalCents != nil {
+			subtotal := centsToDollars(*issue.storedSubtotalCents)
+			issue.StoredSubtotal = &subtotal
+		}
+		if issue.storedTotalCents != nil {
+			total := centsToDollars(*issue.storedTotalCents)
+			issue.StoredTotal = &total
+		}
+		issue.ExpectedSubtotal = centsToDollars(issue.expectedSubtotalCents)
+		issue.ExpectedTotal = centsToDollars(issue.expectedTotalCents)
+		orderTotalProblems(&issue)
+		issues = append(issues, issue)
+	}
+	return issues, rows.Err()
+}
+
+func formatStoredCents(cents *int) string {
+	if cents == nil {
+		return "none"
+	}
+	return money.Format(*cents)
+}
+
+// fixOrderTotals overwrites an order's stored totals with the recomputed ones
+// and notes the correction in its status history. fixedBy is nil for the
+// scheduled job.
+func fixOrderTotals(db *sql.DB, issue OrderTotalIssue, fixedBy *int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only fix the order if it still holds the values we checked
+	result, err := tx.Exec(`
+		UPDATE orders SET subtotal_cents = $1, total_cents = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+		  AND subtotal_cents IS NOT DISTINCT FROM $4
+		  AND total_cents IS NOT DISTINCT FROM $5`,
+		issue.expectedSubtotalCents, issue.expectedTotalCents, issue.OrderID,
+		issue.storedSubtotalCents, issue.storedTotalCents,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("order %d changed while being checked", issue.OrderID)
+	}
+
+	note := fmt.Sprintf("Totals corrected by integrity check: subtotal %s -> %s, total %s -> %s",
+		formatStoredCents(issue.storedSubtotalCents), money.Format(issue.expectedSubtotalCents),
+		formatStoredCents(issue.storedTotalCents), money.Format(issue.expectedTotalCents))
+	_, err = tx.Exec(`
+		INSERT INTO order_status_history (order_id, status, notes, updated_by)
+		VALUES ($1, $2, $3, $4)`,
+		issue.OrderID, issue.Status, note, fixedBy,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// processOrderIntegrity flags orders with bad totals for admins, and fixes
+// them when ORDER_INTEGRITY_AUTOFIX=true
+func (s *AutoScheduler) processOrderIntegrity() {
+	issues, err := findOrderTotalIssues(s.db, nil)
+	if err != nil {
+		log.Printf("Error checking order totals: %v", err)
+		return
+	}
+	if len(issues) == 0 {
+		return
+	}
+
+	autoFix, _ := strconv.ParseBool(os.Getenv("ORDER_INTEGRITY_AUTOFIX"))
+	fixed := 0
+	if autoFix {
+		for _, issue := range issues {
+			if err := fixOrderTotals(s.db, issue, nil); err != nil {
+				log.Printf("Error fixing totals for order %d: %v", issue.OrderID, err)
+				continue
+			}
+			fixed++
+		}
+	}
+	log.Printf("Order integrity check found %d orders with bad totals, fixed %d", len(issues), fixed)
+
+	if fixed < len(issues) {
+		logAdminAlert(s.db, AdminAlert{
+			Type:      "order_integrity",
+			Severity:  "warning",
+			Title:     "Orders with inconsistent totals",
+			Message:   fmt.Sprintf("%d orders have stored totals that don't match their line items", len(issues)-fixed),
+			DedupeKey: "order_integrity:" + time.Now().Format("2006-01-02"),
+		})
+	}
+}
+
+// handleGetOrderIntegrity lists orders whose stored totals disagree with their line items
+func (h *OrderIntegrityHandler) handleGetOrderIntegrity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	issues, err := findOrderTotalIssues(h.db, nil)
+	if err != nil {
+		http.Error(w, "Failed to check order totals", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"checked_at": time.Now().UTC(),
+		"count":      len(issues),
+		"orders":     issues,
+	})
+}
+
+// handleFixOrderIntegrity corrects flagged orders, or just the listed ones
+func (h *OrderIntegrityHandler) handleFixOrderIntegrity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req FixOrderTotalsRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	issues, err := findOrderTotalIssues(h.db, req.OrderIDs)
+	if err != nil {
+		http.Error(w, "Failed to check order totals", http.StatusInternalServerError)
+		return
+	}
+
+	fixed := []int{}
+	failed := map[int]string{}
+	for _, issue := range issues {
+		if err := fixOrderTotals(h.db, issue, &adminID); err != nil {
+			failed[issue.OrderID] = err.Error()
+			continue
+		}
+		fixed = append(fixed, issue.OrderID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"fixed":  fixed,
+		"failed": failed,
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOrderTotalProblems(t *testing.T) {
+	cents := func(v int) *int { return &v }
+
+	tests := []struct {
+		name          string
+		issue         OrderTotalIssue
+		expected      []string
+		expectDollars bool
+	}{
+		{
+			"Missing totals",
+			OrderTotalIssue{expectedSubtotalCents: 3000, expectedTotalCents: 3000},
+			[]string{"missing_totals"}, false,
+		},
+		{
+			"Subtotal stored in dollars",
+			OrderTotalIssue{storedSubtotalCents: cents(30), storedTotalCents: cents(30), expectedSubtotalCents: 3000, expectedTotalCents: 3000},
+			[]string{"subtotal_mismatch", "total_mismatch"}, true,
+		},
+		{
+			"Total off by the tip",
+			OrderTotalIssue{storedSubtotalCents: cents(3000), storedTotalCents: cents(3000), expectedSubtotalCents: 3000, expectedTotalCents: 3500},
+			[]string{"total_mismatch"}, false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orderTotalProblems(&tt.issue)
+			if len(tt.issue.Problems) != len(tt.expected) {
+				t.Fatalf("Expected problems %v, got %v", tt.expected, tt.issue.Problems)
+			}
+			for i, problem := range tt.expected {
+				if tt.issue.Problems[i] != problem {
+					t.Errorf("Expected problems %v, got %v", tt.expected, tt.issue.Problems)
+				}
+			}
+			if (tt.issue.LikelyCause != nil) != tt.expectDollars {
+				t.Errorf("Expected stored_in_dollars cause %v, got %v", tt.expectDollars, tt.issue.LikelyCause)
+			}
+		})
+	}
+}
+
+func TestOrderIntegrity_FindAndFix(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "integrity-admin@example.com", "Integrity", "Admin")
+	userID := db.CreateTestUser(t, "integrity@example.com", "Integrity", "Customer")
+	addressID := db.CreateTestAddress(t, userID)
+	goodOrderID := db.CreateTestOrder(t, userID, addressID)
+	badOrderID := db.CreateTestOrder(t, userID, addressID)
+
+	serviceID := db.GetServiceID(t, "standard_bag")
+	for _, orderID := range []int{goodOrderID, badOrderID} {
+		db.Exec(`
+			INSERT INTO order_items (order_id, service_id, quantity, price_cents)
+			VALUES ($1, $2, 2, 3000)`,
+			orderID, serviceID,
+		)
+	}
+	db.Exec("UPDATE orders SET subtotal_cents = 6000, tax_cents = 0, tip_cents = 500, total_cents = 6500 WHERE id = $1", goodOrderID)
+	// Written in dollars by the old code path
+	db.Exec("UPDATE orders SET subtotal_cents = 60, tax_cents = 0, tip_cents = 500, total_cents = 560 WHERE id = $1", badOrderID)
+
+	handler := NewOrderIntegrityHandler(db.DB)
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return adminID, nil
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/admin/orders/integrity", nil)
+	w := httptest.NewRecorder()
+	handler.handleGetOrderIntegrity(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var report struct {
+		Count  int               `json:"count"`
+		Orders []OrderTotalIssue `json:"orders"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.Count != 1 || report.Orders[0].OrderID != badOrderID || report.Orders[0].ExpectedTotal != 65 {
+		t.Fatalf("Expected only order %d flagged with a $65.00 total, got %+v", badOrderID, report)
+	}
+	if report.Orders[0].LikelyCause == nil || *report.Orders[0].LikelyCause != "stored_in_dollars" {
+		t.Errorf("Expected stored_in_dollars cause, got %v", report.Orders[0].LikelyCause)
+	}
+
+	body, _ := json.Marshal(FixOrderTotalsRequest{OrderIDs: []int{badOrderID}})
+	req = httptest.NewRequest("POST", "/api/v1/admin/orders/integrity/fix", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	handler.handleFixOrderIntegrity(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var subtotalCents, totalCents int
+	db.QueryRow("SELECT subtotal_cents, total_cents FROM orders WHERE id = $1", badOrderID).Scan(&subtotalCents, &totalCents)
+	if subtotalCents != 6000 || totalCents != 6500 {
+		t.Errorf("Expected corrected totals 6000/6500, got %d/%d", subtotalCents, totalCents)
+	}
+
+	var corrections int
+	db.QueryRow(`
+		SELECT COUNT(*) FROM order_status_history
+		WHERE order_id = $1 AND updated_by = $2 AND notes LIKE 'Totals corrected%'`,
+		badOrderID, adminID,
+	).Scan(&corrections)
+	if corrections != 1 {
+		t.Errorf("Expected the correction in status history, got %d entries", corrections)
+	}
+
+	issues, err := findOrderTotalIssues(db.DB, nil)
+	if err != nil || len(issues) != 0 {
+		t.Errorf("Expected no remaining issues, got %v (err %v)", issues, err)
+	}
+}
+
+func TestOrderIntegrity_SlotPricing(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "integrity-slot@example.com", "Integrity", "Slot")
+	addressID := db.CreateTestAddress(t, userID)
+	orderID := db.CreateTestOrder(t, userID, addressID)
+
+	db.Exec(`
+		INSERT INTO order_items (order_id, service_id, quantity, price_cents)
+		VALUES ($1, $2, 2, 3000)`,
+		orderID, db.GetServiceID(t, "standard_bag"),
+	)
+	// A 20% peak surcharge on the $60.00 of bags
+	db.Exec(`
+		UPDATE orders
+		SET slot_price_label = 'Saturday morning', slot_multiplier_percent = 120, slot_adjustment_cents = 1200,
+		    subtotal_cents = 7200, tax_cents = 0, tip_cents = 0, total_cents = 7200
+		WHERE id = $1`,
+		orderID,
+	)
+
+	issues, err := findOrderTotalIssues(db.DB, []int{orderID})
+	if err != nil || len(issues) != 0 {
+		t.Errorf("Expected the peak order's totals to check out, got %v (err %v)", issues, err)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Item-level events on an order's garments. Partners tracking linen counts
+// subscribe to these through webhook endpoints.
+const (
+	itemEventAdded       = "item.added"
+	itemEventDamaged     = "item.damaged"
+	itemEventSubstituted = "item.substituted"
+)
+
+var itemEventNames = []string{itemEventAdded, itemEventDamaged, itemEventSubstituted}
+
+func isItemEvent(name string) bool {
+	for _, event := range itemEventNames {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderItemEvent is one change to a garment line on an order
+type OrderItemEvent struct {
+	ID             int    `json:"id"`
+	OrderID        int    `json:"order_id"`
+	OrderGarmentID int    `json:"order_garment_id"`
+	Event          string `json:"event"`
+	GarmentTypeID  int    `json:"garment_type_id"`
+	GarmentName    string `json:"garment_name"`
+	// Quantity is the pieces added or damaged, or the line's quantity when
+	// it was substituted
+	Quantity              int       `json:"quantity"`
+	PreviousGarmentTypeID *int      `json:"previous_garment_type_id,omitempty"`
+	PreviousGarmentName   *string   `json:"previous_garment_name,omitempty"`
+	Notes                 *string   `json:"notes,omitempty"`
+	RecordedBy            *int      `json:"recorded_by,omitempty"`
+	CreatedAt             time.Time `json:"created_at"`
+}
+
+// OrderItemPublisher tells an order's customer about item events as they
+// happen
+type OrderItemPublisher interface {
+	PublishOrderItemEvent(userID int, event OrderItemEvent) error
+}
+
+// OrderItemEventHandler records garments a driver adds at pickup and ones
+// the facility finds damaged or has to substitute
+type OrderItemEventHandler struct {
+	db        *sql.DB
+	realtime  OrderItemPublisher
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewOrderItemEventHandler(db *sql.DB, realtime OrderItemPublisher) *OrderItemEventHandler {
+	return &OrderItemEventHandler{
+		db:        db,
+		realtime:  realtime,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+const orderItemEventColumns = `
+	e.id, e.order_id, e.order_garment_id, e.event, e.garment_type_id, gt.display_name, e.quantity,
+	e.previous_garment_type_id, pgt.display_name, e.notes, e.recorded_by, e.created_at`
+
+const orderItemEventJoins = `
+	JOIN garment_types gt ON e.garment_type_id = gt.id
+	LEFT JOIN garment_types pgt ON e.previous_garment_type_id = pgt.id`
+
+func scanOrderItemEvent(scanner interface{ Scan(...interface{}) error }) (OrderItemEvent, error) {
+	var e OrderItemEvent
+	err := scanner.Scan(&e.ID, &e.OrderID, &e.OrderGarmentID, &e.Event, &e.GarmentTypeID, &e.GarmentName, &e.Quantity,
+		&e.PreviousGarmentTypeID, &e.PreviousGarmentName, &e.Notes, &e.RecordedBy, &e.CreatedAt)
+	return e, err
+}
+
+// recordOrderItemEvent stores an item event and queues it for every active
+// webhook endpoint that wants it, in the caller's transaction so a rolled
+// back change sends nothing
+func recordOrderItemEvent(tx *sql.Tx, e OrderItemEvent) (OrderItemEvent, error) {
+	var id int
+	err := tx.QueryRow(`
+		INSERT INTO order_item_events (order_id, order_garment_id, event, garment_type_id, quantity,
+			previous_garment_type_id, notes, recorded_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`,
+		e.OrderID, e.OrderGarmentID, e.Event, e.GarmentTypeID, e.Quantity,
+		e.PreviousGarmentTypeID, e.Notes, e.RecordedBy,
+	).Scan(&id)
+	if err != nil {
+		return e, err
+	}
+
+	// Endpoints scoped to a customer hear about orders they own or pay for
+	_, err = tx.Exec(`
+		INSERT INTO webhook_deliveries (endpoint_id, item_event_id)
+		SELECT w.id, $1
+		FROM webhook_endpoints w, orders o
+		WHERE o.id = $2 AND w.is_active = true AND $3 = ANY(w.events)
+		  AND (w.user_id IS NULL OR w.user_id = o.user_id OR w.user_id = o.billed_user_id)`,
+		id, e.OrderID, e.Event,
+	)
+	if err != nil {
+		return e, err
+	}
+
+	return scanOrderItemEvent(tx.QueryRow(`
+		SELECT `+orderItemEventColumns+`
+		FROM order_item_events e`+orderItemEventJoins+`
+		WHERE e.id = $1`,
+		id,
+	))
+}
+
+// getOrderItemEvents returns an order's item events, oldest first
+func getOrderItemEvents(db *sql.DB, orderID int) ([]OrderItemEvent, error) {
+	rows, err := db.Query(`
+		SELECT `+orderItemEventColumns+`
+		FROM order_item_events e`+orderItemEventJoins+`
+		WHERE e.order_id = $1
+		ORDER BY e.id`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []OrderItemEvent{}
+	for rows.Next() {
+		e, err := scanOrderItemEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// publishItemEvents tells the order's customer about events that were just
+// committed. A failed publish is logged; webhooks are delivered regardless.
+func (h *OrderItemEventHandler) publishItemEvents(orderID int, events []OrderItemEvent) {
+	if h.realtime == nil || len(events) == 0 {
+		return
+	}
+	var userID int
+	if err := h.db.QueryRow("SELECT user_id FROM orders WHERE id = $1", orderID).Scan(&userID); err != nil {
+		log.Printf("Failed to look up order %d for item events: %v", orderID, err)
+		return
+	}
+	for _, e := range events {
+		if err := h.realtime.PublishOrderItemEvent(userID, e); err != nil {
+			log.Printf("Failed to publish item event %d for order %d: %v", e.ID, orderID, err)
+		}
+	}
+}
+
+// AddPickupItemsRequest lists garments the driver found at pickup that the
+// customer didn't declare
+type AddPickupItemsRequest struct {
+	Garments []OrderGarmentRequest `json:"garments"`
+}
+
+// handleAddPickupItems adds garments found at a pickup stop to the order.
+// They're recorded at catalog price for reference but aren't charged.
+func (h *OrderItemEventHandler) handleAddPickupItems(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	routeOrderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req AddPickupItemsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Garments) == 0 {
+		http.Error(w, "At least one garment is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateGarmentRequests(req.Garments); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var orderID, routeDriverID int
+	var routeType, routeStatus string
+	err = h.db.QueryRow(`
+		SELECT ro.order_id, dr.driver_id, dr.route_type, dr.status
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		WHERE ro.id = $1`,
+		routeOrderID,
+	).Scan(&orderID, &routeDriverID, &routeType, &routeStatus)
+	if err == sql.ErrNoRows || (err == nil && routeDriverID != driverID) {
+		http.Error(w, "Route order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch route order", http.StatusInternalServerError)
+		return
+	}
+	if isClosedRouteStatus(routeStatus) {
+		http.Error(w, "Route is closed", http.StatusForbidden)
+		return
+	}
+	if routeType != "pickup" {
+		http.Error(w, "Items are added on pickup stops", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	events := []OrderItemEvent{}
+	for _, g := range req.Garments {
+		var priceCents int
+		err := tx.QueryRow(
+			"SELECT price_cents FROM garment_types WHERE id = $1 AND is_active = true",
+			g.GarmentTypeID,
+		).Scan(&priceCents)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Unknown garment type %d", g.GarmentTypeID), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to add items", http.StatusInternalServerError)
+			return
+		}
+
+		careFlags := g.CareFlags
+		if careFlags == nil {
+			careFlags = []string{}
+		}
+		var garmentID int
+		err = tx.QueryRow(`
+			INSERT INTO order_garments (order_id, garment_type_id, quantity, unit_price_cents, care_flags, notes, added_at_pickup)
+			VALUES ($1, $2, $3, $4, $5, $6, true)
+			RETURNING id`,
+			orderID, g.GarmentTypeID, g.Quantity, priceCents, pq.Array(careFlags), g.Notes,
+		).Scan(&garmentID)
+		if err != nil {
+			http.Error(w, "Failed to add items", http.StatusInternalServerError)
+			return
+		}
+
+		event, err := recordOrderItemEvent(tx, OrderItemEvent{
+			OrderID:        orderID,
+			OrderGarmentID: garmentID,
+			Event:          itemEventAdded,
+			GarmentTypeID:  g.GarmentTypeID,
+			Quantity:       g.Quantity,
+			Notes:          g.Notes,
+			RecordedBy:     &driverID,
+		})
+		if err != nil {
+			http.Error(w, "Failed to add items", http.StatusInternalServerError)
+			return
+		}
+		events = append(events, event)
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to add items", http.StatusInternalServerError)
+		return
+	}
+	h.publishItemEvents(orderID, events)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(events)
+}
+
+// lockOrderGarment reads a garment line on an order for update
+func lockOrderGarment(tx *sql.Tx, orderID, garmentID int) (garmentTypeID, quantity, damaged int, err error) {
+	err = tx.QueryRow(`
+		SELECT garment_type_id, quantity, damaged_quantity
+		FROM order_garments
+		WHERE id = $1 AND order_id = $2
+		FOR UPDATE`,
+		garmentID, orderID,
+	).Scan(&garmentTypeID, &quantity, &damaged)
+	return
+}
+
+// garmentRouteIDs reads the order and garment line IDs from the route
+func garmentRouteIDs(r *http.Request) (orderID, garmentID int, err error) {
+	vars := mux.Vars(r)
+	if orderID, err = strconv.Atoi(vars["id"]); err != nil {
+		return
+	}
+	garmentID, err = strconv.Atoi(vars["garmentId"])
+	return
+}
+
+type FlagDamagedItemsRequest struct {
+	Quantity int     `json:"quantity"`
+	Notes    *string `json:"notes,omitempty"`
+}
+
+// handleFlagDamagedItems records pieces of a garment line the facility found
+// damaged. A line can't have more pieces damaged than it holds.
+func (h *OrderItemEventHandler) handleFlagDamagedItems(w http.ResponseWriter, r *http.Request) {
+	staffID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	orderID, garmentID, err := garmentRouteIDs(r)
+	if err != nil {
+		http.Error(w, "Invalid order or garment ID", http.StatusBadRequest)
+		return
+	}
+
+	var req FlagDamagedItemsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity <= 0 {
+		http.Error(w, "quantity must be positive", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	garmentTypeID, quantity, damaged, err := lockOrderGarment(tx, orderID, garmentID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Garment not found on order", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to flag damaged items", http.StatusInternalServerError)
+		return
+	}
+	if damaged+req.Quantity > quantity {
+		http.Error(w, fmt.Sprintf("Only %d of this line's %d pieces aren't already flagged", quantity-damaged, quantity), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE order_garments SET damaged_quantity = damaged_quantity + $1 WHERE id = $2", req.Quantity, garmentID); err != nil {
+		http.Error(w, "Failed to flag damaged items", http.StatusInternalServerError)
+		return
+	}
+	event, err := recordOrderItemEvent(tx, OrderItemEvent{
+		OrderID:        orderID,
+		OrderGarmentID: garmentID,
+		Event:          itemEventDamaged,
+		GarmentTypeID:  garmentTypeID,
+		Quantity:       req.Quantity,
+		Notes:          req.Notes,
+		RecordedBy:     &staffID,
+	})
+	if err != nil {
+		http.Error(w, "Failed to flag damaged items", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to flag damaged items", http.StatusInternalServerError)
+		return
+	}
+	h.publishItemEvents(orderID, []OrderItemEvent{event})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
+
+type SubstituteItemRequest struct {
+	GarmentTypeID int     `json:"garment_type_id"`
+	Notes         *string `json:"notes,omitempty"`
+}
+
+// handleSubstituteItem records that a garment line is a different type than
+// declared, e.g. pillowcases checked in as sheets. The line keeps the price
+// it was sold at.
+func (h *OrderItemEventHandler) handleSubstituteItem(w http.ResponseWriter, r *http.Request) {
+	staffID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	orderID, garmentID, err := garmentRouteIDs(r)
+	if err != nil {
+		http.Error(w, "Invalid order or garment ID", http.StatusBadRequest)
+		return
+	}
+
+	var req SubstituteItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.GarmentTypeID <= 0 {
+		http.Error(w, "garment_type_id is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	previousTypeID, quantity, _, err := lockOrderGarment(tx, orderID, garmentID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Garment not found on order", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to substitute item", http.StatusInternalServerError)
+		return
+	}
+	if previousTypeID == req.GarmentTypeID {
+		http.Error(w, "Garment is already that type", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM garment_types WHERE id = $1 AND is_active = true)", req.GarmentTypeID).Scan(&exists); err != nil {
+		http.Error(w, "Failed to substitute item", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Unknown garment type", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE order_garments SET garment_type_id = $1 WHERE id = $2", req.GarmentTypeID, garmentID); err != nil {
+		http.Error(w, "Failed to substitute item", http.StatusInternalServerError)
+		return
+	}
+	event, err := recordOrderItemEvent(tx, OrderItemEvent{
+		OrderID:               orderID,
+		OrderGarmentID:        garmentID,
+		Event:                 itemEventSubstituted,
+		GarmentTypeID:         req.GarmentTypeID,
+		Quantity:              quantity,
+		PreviousGarmentTypeID: &previousTypeID,
+		Notes:                 req.Notes,
+		RecordedBy:            &staffID,
+	})
+	if err != nil {
+		http.Error(w, "Failed to substitute item", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to substitute item", http.StatusInternalServerError)
+		return
+	}
+	h.publishItemEvents(orderID, []OrderItemEvent{event})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
+
+// handleGetOrderItemEvents returns an order's item events for support
+func (h *OrderItemEventHandler) handleGetOrderItemEvents(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	events, err := getOrderItemEvents(h.db, orderID)
+	if err != nil {
+		http.Error(w, "Failed to fetch item events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// recordingItemPublisher keeps the item events published to customers
+type recordingItemPublisher struct {
+	events []OrderItemEvent
+}
+
+func (p *recordingItemPublisher) PublishOrderItemEvent(userID int, event OrderItemEvent) error {
+	p.events = append(p.events, event)
+	return nil
+}
+
+func TestOrderItemEvents(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	customerID := db.CreateTestUser(t, "linen-partner@example.com", "Linen", "Partner")
+	otherID := db.CreateTestUser(t, "linen-other@example.com", "Linen", "Other")
+	driverID := db.CreateTestUser(t, "linen-driver@example.com", "Linen", "Driver")
+	staffID := db.CreateTestUser(t, "linen-staff@example.com", "Linen", "Staff")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	orderID := db.CreateTestOrder(t, customerID, db.CreateTestAddress(t, customerID))
+
+	var routeID, routeOrderID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'in_progress') RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	db.QueryRow(`
+		INSERT INTO route_orders (route_id, order_id, sequence_number, status)
+		VALUES ($1, $2, 1, 'pending') RETURNING id`,
+		routeID, orderID,
+	).Scan(&routeOrderID)
+
+	var sheetID, pillowcaseID int
+	db.QueryRow("SELECT id FROM garment_types WHERE is_active = true ORDER BY id LIMIT 1").Scan(&sheetID)
+	db.QueryRow("SELECT id FROM garment_types WHERE is_active = true AND id != $1 ORDER BY id LIMIT 1", sheetID).Scan(&pillowcaseID)
+
+	// The partner's receiver checks each delivery's signature
+	received := make(chan WebhookEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var secret string
+		db.QueryRow("SELECT secret FROM webhook_endpoints WHERE url LIKE 'http://127.0.0.1%'").Scan(&secret)
+		expected := signUserSync(secret, r.Header.Get(userSyncTimestampHeader), r.Header.Get(userSyncNonceHeader), body)
+		if r.Header.Get(userSyncSignatureHeader) != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event WebhookEvent
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer receiver.Close()
+	db.Exec(`
+		INSERT INTO webhook_endpoints (user_id, url, secret, events)
+		VALUES ($1, $2, 'whsec_partner', ARRAY['item.added', 'item.substituted']),
+		       ($3, 'https://other.example.com/hooks', 'whsec_other', ARRAY['item.added', 'item.damaged', 'item.substituted'])`,
+		customerID, receiver.URL, otherID)
+
+	publisher := &recordingItemPublisher{}
+	handler := NewOrderItemEventHandler(db.DB, publisher)
+	call := func(userID int, fn http.HandlerFunc, vars map[string]string, body string) *httptest.ResponseRecorder {
+		handler.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+		req := httptest.NewRequest("POST", "/api/v1/test", strings.NewReader(body))
+		req = mux.SetURLVars(req, vars)
+		w := httptest.NewRecorder()
+		fn(w, req)
+		return w
+	}
+	stop := map[string]string{"id": fmt.Sprint(routeOrderID)}
+
+	// The driver finds four pillowcases nobody declared
+	w := call(driverID, handler.handleAddPickupItems, stop, fmt.Sprintf(`{"garments": [{"garment_type_id": %d, "quantity": 4}]}`, pillowcaseID))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var added []OrderItemEvent
+	json.Unmarshal(w.Body.Bytes(), &added)
+	if len(added) != 1 || added[0].Event != itemEventAdded || added[0].Quantity != 4 || added[0].RecordedBy == nil || *added[0].RecordedBy != driverID {
+		t.Fatalf("Expected one item.added event, got %+v", added)
+	}
+	garmentID := added[0].OrderGarmentID
+	if w := call(otherID, handler.handleAddPickupItems, stop, fmt.Sprintf(`{"garments": [{"garment_type_id": %d, "quantity": 1}]}`, sheetID)); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for another driver's stop, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Pickup additions aren't charged, so the order's totals still add up
+	if issues, err := findOrderTotalIssues(db.DB, []int{orderID}); err != nil || len(issues) != 0 {
+		t.Errorf("Expected the added line left out of the subtotal, got %+v (%v)", issues, err)
+	}
+
+	garment := map[string]string{"id": fmt.Sprint(orderID), "garmentId": fmt.Sprint(garmentID)}
+	if w := call(staffID, handler.handleFlagDamagedItems, garment, `{"quantity": 5}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d flagging more pieces than the line holds, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := call(staffID, handler.handleFlagDamagedItems, garment, `{"quantity": 1, "notes": "Torn hem"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := call(staffID, handler.handleFlagDamagedItems, map[string]string{"id": fmt.Sprint(orderID + 1), "garmentId": fmt.Sprint(garmentID)}, `{"quantity": 1}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a garment on another order, got %d", http.StatusNotFound, w.Code)
+	}
+
+	w = call(staffID, handler.handleSubstituteItem, garment, fmt.Sprintf(`{"garment_type_id": %d}`, sheetID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var substituted OrderItemEvent
+	json.Unmarshal(w.Body.Bytes(), &substituted)
+	if substituted.PreviousGarmentTypeID == nil || *substituted.PreviousGarmentTypeID != pillowcaseID || substituted.GarmentTypeID != sheetID || substituted.Quantity != 4 {
+		t.Errorf("Expected the pillowcases substituted with sheets, got %+v", substituted)
+	}
+	if w := call(staffID, handler.handleSubstituteItem, garment, fmt.Sprintf(`{"garment_type_id": %d}`, sheetID)); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d substituting the same type, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	garments, _ := getOrderGarments(db.DB, orderID)
+	if len(garments) != 1 || !garments[0].AddedAtPickup || garments[0].DamagedQuantity != 1 || garments[0].GarmentTypeID != sheetID {
+		t.Errorf("Unexpected garment line %+v", garments)
+	}
+	if len(publisher.events) != 3 {
+		t.Errorf("Expected the customer told about 3 item events, got %d", len(publisher.events))
+	}
+
+	// Only the partner's endpoint hears about its order, and only the events it asked for
+	var queued int
+	db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries").Scan(&queued)
+	if queued != 2 {
+		t.Fatalf("Expected the added and substituted events queued for the partner, got %d", queued)
+	}
+	delivered, failed, err := NewWebhookDispatcher(db.DB).Dispatch(context.Background())
+	if err != nil || delivered != 2 || failed != 0 {
+		t.Fatalf("Expected both deliveries posted, got %d/%d (%v)", delivered, failed, err)
+	}
+	close(received)
+	events := []string{}
+	for event := range received {
+		if event.Data.OrderID != orderID {
+			t.Errorf("Unexpected delivery %+v", event)
+		}
+		events = append(events, event.Event)
+	}
+	if strings.Join(events, ",") != "item.added,item.substituted" {
+		t.Errorf("Expected the added and substituted events in order, got %v", events)
+	}
+}
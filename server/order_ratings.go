@@ -0,0 +1,347 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+type RateOrderRequest struct {
+	Rating int `json:"rating"`
+	// DriverRating rates the driver on their own; without it the order
+	// rating counts for the driver too
+	DriverRating *int    `json:"driver_rating,omitempty"`
+	Comment      *string `json:"comment,omitempty"`
+}
+
+type OrderRating struct {
+	OrderID      int       `json:"order_id"`
+	Rating       int       `json:"rating"`
+	DriverRating *int      `json:"driver_rating,omitempty"`
+	Comment      *string   `json:"comment,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// handleRateOrder lets a customer review a delivered order once. The review
+// counts toward the driver who made the order's last stop.
+func (h *OrderHandler) handleRateOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RateOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Rating < 1 || req.Rating > 5 {
+		http.Error(w, "rating must be between 1 and 5", http.StatusBadRequest)
+		return
+	}
+	if req.DriverRating != nil && (*req.DriverRating < 1 || *req.DriverRating > 5) {
+		http.Error(w, "driver_rating must be between 1 and 5", http.StatusBadRequest)
+		return
+	}
+
+	var status string
+	err = h.db.QueryRow("SELECT status FROM orders WHERE id = $1 AND user_id = $2", orderID, userID).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if status != "delivered" {
+		http.Error(w, "Only delivered orders can be rated", http.StatusConflict)
+		return
+	}
+
+	var driverID sql.NullInt64
+	err = h.db.QueryRow(`
+		SELECT dr.driver_id
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		WHERE ro.order_id = $1 AND ro.status = 'completed'
+		ORDER BY ro.actual_time DESC NULLS LAST, ro.id DESC
+		LIMIT 1`,
+		orderID,
+	).Scan(&driverID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	rating := OrderRating{OrderID: orderID, Rating: req.Rating, DriverRating: req.DriverRating, Comment: req.Comment}
+	err = h.db.QueryRow(`
+		INSERT INTO order_ratings (order_id, user_id, driver_id, rating, driver_rating, comment)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at`,
+		orderID, userID, driverID, req.Rating, req.DriverRating, req.Comment,
+	).Scan(&rating.CreatedAt)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "Order has already been rated", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to save rating", http.StatusInternalServerError)
+		return
+	}
+
+	if driverID.Valid {
+		refreshDriverStatsAfter(h.db, int(driverID.Int64), "a rating")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rating)
+}
+
+const (
+	defaultReviewLimit = 100
+	maxReviewLimit     = 500
+)
+
+// OrderReview is a rating as admins see it, with who left it and whether it
+// has been hidden
+type OrderReview struct {
+	ID           int        `json:"id"`
+	OrderID      int        `json:"order_id"`
+	CustomerID   int        `json:"customer_id"`
+	CustomerName string     `json:"customer_name"`
+	DriverID     *int       `json:"driver_id"`
+	DriverName   *string    `json:"driver_name"`
+	Rating       int        `json:"rating"`
+	DriverRating *int       `json:"driver_rating,omitempty"`
+	Comment      *string    `json:"comment,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	HiddenAt     *time.Time `json:"hidden_at,omitempty"`
+	HiddenBy     *int       `json:"hidden_by,omitempty"`
+	HiddenReason *string    `json:"hidden_reason,omitempty"`
+}
+
+type ModerateReviewRequest struct {
+	Hidden bool    `json:"hidden"`
+	Reason *string `json:"reason,omitempty"`
+}
+
+const orderReviewColumns = `
+	r.id, r.order_id, r.user_id, c.first_name || ' ' || c.last_name,
+	r.driver_id, d.first_name || ' ' || d.last_name,
+	r.rating, r.driver_rating, r.comment, r.created_at,
+	r.hidden_at, r.hidden_by, r.hidden_reason`
+
+func scanOrderReview(row interface{ Scan(...interface{}) error }) (OrderReview, error) {
+	var rv OrderReview
+	err := row.Scan(
+		&rv.ID, &rv.OrderID, &rv.CustomerID, &rv.CustomerName,
+		&rv.DriverID, &rv.DriverName,
+		&rv.Rating, &rv.DriverRating, &rv.Comment, &rv.CreatedAt,
+		&rv.HiddenAt, &rv.HiddenBy, &rv.HiddenReason,
+	)
+	return rv, err
+}
+
+// handleListReviews returns reviews newest first. Filters: driver_id,
+// max_rating (the driver rating, to find bad reviews) and hidden=true|false.
+func (h *AdminHandler) handleListReviews(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var driverID, maxRating int
+	var err error
+	if v := query.Get("driver_id"); v != "" {
+		if driverID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid driver_id", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("max_rating"); v != "" {
+		if maxRating, err = strconv.Atoi(v); err != nil || maxRating < 1 || maxRating > 5 {
+			http.Error(w, "max_rating must be between 1 and 5", http.StatusBadRequest)
+			return
+		}
+	}
+	hidden := query.Get("hidden")
+	if hidden != "" && hidden != "true" && hidden != "false" {
+		http.Error(w, "hidden must be true or false", http.StatusBadRequest)
+		return
+	}
+	limit := defaultReviewLimit
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxReviewLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxReviewLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := h.db.Query(`
+		SELECT `+orderReviewColumns+`
+		FROM order_ratings r
+		JOIN users c ON r.user_id = c.id
+		LEFT JOIN users d ON r.driver_id = d.id
+		WHERE ($1 = 0 OR r.driver_id = $1)
+		  AND ($2 = 0 OR COALESCE(r.driver_rating, r.rating) <= $2)
+		  AND ($3 = '' OR (r.hidden_at IS NOT NULL) = ($3 = 'true'))
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT $4`,
+		driverID, maxRating, hidden, limit,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch reviews", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reviews := []OrderReview{}
+	for rows.Next() {
+		rv, err := scanOrderReview(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch reviews", http.StatusInternalServerError)
+			return
+		}
+		reviews = append(reviews, rv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// handleModerateReview hides a review, or restores a hidden one. Hidden
+// reviews no longer count toward the driver's ratings.
+func (h *AdminHandler) handleModerateReview(w http.ResponseWriter, r *http.Request) {
+	reviewID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid review ID", http.StatusBadRequest)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ModerateReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var hiddenBy *int
+	reason := req.Reason
+	if req.Hidden {
+		hiddenBy = &adminID
+	} else {
+		reason = nil
+	}
+
+	// Hiding an already hidden review keeps who hid it first
+	row := h.db.QueryRow(`
+		WITH updated AS (
+			UPDATE order_ratings SET
+				hidden_at = CASE WHEN $2 THEN COALESCE(hidden_at, CURRENT_TIMESTAMP) END,
+				hidden_by = CASE WHEN $2 THEN COALESCE(hidden_by, $3) END,
+				hidden_reason = $4
+			WHERE id = $1
+			RETURNING *
+		)
+		SELECT `+orderReviewColumns+`
+		FROM updated r
+		JOIN users c ON r.user_id = c.id
+		LEFT JOIN users d ON r.driver_id = d.id`,
+		reviewID, req.Hidden, hiddenBy, reason,
+	)
+	review, err := scanOrderReview(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Review not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update review", http.StatusInternalServerError)
+		return
+	}
+
+	if review.DriverID != nil {
+		refreshDriverStatsAfter(h.db, *review.DriverID, "review moderation")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+// DriverReviews is what a driver sees of their reviews: the averages and the
+// visible reviews, without who left them
+type DriverReviews struct {
+	Rating      *float64       `json:"rating"` // nil until the driver is rated
+	RatingCount int            `json:"ratingCount"`
+	Reviews     []DriverReview `json:"reviews"`
+}
+
+type DriverReview struct {
+	OrderID   int       `json:"orderId"`
+	Rating    int       `json:"rating"`
+	Comment   *string   `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// handleGetDriverReviews returns the signed-in driver's most recent reviews.
+// Rating is the driver rating, falling back to the order rating.
+func (h *DriverEarningsHandler) handleGetDriverReviews(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result := DriverReviews{Reviews: []DriverReview{}}
+	err = h.db.QueryRow(`
+		SELECT AVG(COALESCE(driver_rating, rating)), COUNT(*)
+		FROM order_ratings
+		WHERE driver_id = $1 AND hidden_at IS NULL`,
+		driverID,
+	).Scan(&result.Rating, &result.RatingCount)
+	if err != nil {
+		http.Error(w, "Failed to fetch reviews", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT order_id, COALESCE(driver_rating, rating), comment, created_at
+		FROM order_ratings
+		WHERE driver_id = $1 AND hidden_at IS NULL
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`,
+		driverID, defaultReviewLimit,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch reviews", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rv DriverReview
+		if err := rows.Scan(&rv.OrderID, &rv.Rating, &rv.Comment, &rv.CreatedAt); err != nil {
+			http.Error(w, "Failed to fetch reviews", http.StatusInternalServerError)
+			return
+		}
+		result.Reviews = append(result.Reviews, rv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOrderReviewModeration(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "review-driver@example.com", "Review", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	adminID := db.CreateTestUser(t, "review-admin@example.com", "Review", "Admin")
+	customerID := db.CreateTestUser(t, "review-customer@example.com", "Review", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'delivery', 'completed') RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	orders := &OrderHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest}
+	review := func(body string) int {
+		orderID := db.CreateTestOrder(t, customerID, addressID)
+		db.Exec("UPDATE orders SET status = 'delivered' WHERE id = $1", orderID)
+		db.Exec(`
+			INSERT INTO route_orders (route_id, order_id, sequence_number, status, actual_time)
+			VALUES ($1, $2, 1, 'completed', CURRENT_TIMESTAMP)`,
+			routeID, orderID)
+		req := httptest.NewRequest("POST", "/api/v1/orders/"+strconv.Itoa(orderID)+"/review", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(orderID)})
+		w := httptest.NewRecorder()
+		orders.handleRateOrder(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		return orderID
+	}
+
+	if code := func() int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/v1/orders/1/review", strings.NewReader(`{"rating": 5, "driver_rating": 0}`))
+		orders.handleRateOrder(w, mux.SetURLVars(req, map[string]string{"id": "1"}))
+		return w.Code
+	}(); code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a 0 star driver rating, got %d", http.StatusBadRequest, code)
+	}
+
+	// The driver rating counts for the driver; the order rating stands in without one
+	review(`{"rating": 3, "driver_rating": 5, "comment": "Late but friendly"}`)
+	review(`{"rating": 5}`)
+	abusiveOrderID := review(`{"rating": 1, "driver_rating": 1, "comment": "Abusive comment"}`)
+
+	admin := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	driverStats := func() DriverStats {
+		w := httptest.NewRecorder()
+		admin.handleGetDriverStats(w, httptest.NewRequest("GET", "/api/v1/admin/drivers/stats", nil))
+		var stats []DriverStats
+		json.Unmarshal(w.Body.Bytes(), &stats)
+		for _, s := range stats {
+			if s.DriverID == driverID {
+				return s
+			}
+		}
+		t.Fatalf("Driver missing from stats: %s", w.Body.String())
+		return DriverStats{}
+	}
+	if s := driverStats(); s.RatingCount != 3 || s.Rating == nil || int(*s.Rating*100) != 366 || s.OrderRating == nil || *s.OrderRating != 3 {
+		t.Errorf("Expected a 3.67 driver rating and 3.00 order rating from 3 reviews, got %+v", s)
+	}
+
+	w := httptest.NewRecorder()
+	admin.handleListReviews(w, httptest.NewRequest("GET", "/api/v1/admin/reviews?max_rating=2", nil))
+	var reviews []OrderReview
+	json.Unmarshal(w.Body.Bytes(), &reviews)
+	if len(reviews) != 1 || reviews[0].OrderID != abusiveOrderID || reviews[0].CustomerName != "Review Customer" {
+		t.Fatalf("Expected the one bad review, got %s", w.Body.String())
+	}
+
+	moderate := func(id int, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/v1/admin/reviews/moderation", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(id)})
+		w := httptest.NewRecorder()
+		admin.handleModerateReview(w, req)
+		return w
+	}
+	if w := moderate(999999, `{"hidden": true}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a missing review, got %d", http.StatusNotFound, w.Code)
+	}
+	w = moderate(reviews[0].ID, `{"hidden": true, "reason": "Abusive language"}`)
+	var hidden OrderReview
+	json.Unmarshal(w.Body.Bytes(), &hidden)
+	if w.Code != http.StatusOK || hidden.HiddenAt == nil || hidden.HiddenBy == nil || *hidden.HiddenBy != adminID {
+		t.Fatalf("Expected the review hidden by the admin, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Hidden reviews drop out of the averages and the driver's own view
+	if s := driverStats(); s.RatingCount != 2 || s.Rating == nil || *s.Rating != 5 {
+		t.Errorf("Expected a 5.00 rating from 2 visible reviews, got %+v", s)
+	}
+	drivers := NewDriverEarningsHandler(db.DB)
+	drivers.getUserID = CreateAuthMock(driverID).getUserIDFromRequest
+	w = httptest.NewRecorder()
+	drivers.handleGetDriverReviews(w, httptest.NewRequest("GET", "/api/v1/driver/reviews", nil))
+	var own DriverReviews
+	json.Unmarshal(w.Body.Bytes(), &own)
+	if own.RatingCount != 2 || len(own.Reviews) != 2 {
+		t.Errorf("Expected the driver to see 2 reviews, got %s", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "Review Customer") {
+		t.Error("Expected reviews without the customer's name")
+	}
+
+	if w := moderate(reviews[0].ID, `{"hidden": false}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d restoring the review, got %d", http.StatusOK, w.Code)
+	}
+	if s := driverStats(); s.RatingCount != 3 {
+		t.Errorf("Expected the restored review counted again, got %+v", s)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const orderReviewNotificationType = "order_review"
+
+var errOrderNotPendingReview = errors.New("order is not pending review")
+
+// orderReviewThresholdCents is the order total above which an admin has to
+// confirm the order before it's scheduled (ORDER_REVIEW_THRESHOLD_CENTS).
+// "0" turns review off.
+func orderReviewThresholdCents() int {
+	if cents, err := strconv.Atoi(os.Getenv("ORDER_REVIEW_THRESHOLD_CENTS")); err == nil && cents >= 0 {
+		return cents
+	}
+	return 30000
+}
+
+// holdOrderForReview puts a new order in pending_review. It keeps its pickup
+// slot meanwhile but isn't charged or routed.
+func holdOrderForReview(tx *sql.Tx, orderID, totalCents, thresholdCents int) error {
+	if _, err := tx.Exec("UPDATE orders SET status = 'pending_review' WHERE id = $1", orderID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO order_reviews (order_id, total_cents, threshold_cents)
+		VALUES ($1, $2, $3)`,
+		orderID, totalCents, thresholdCents,
+	)
+	return err
+}
+
+// ordersPendingReview returns which of orderIDs are still waiting on review
+func ordersPendingReview(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, orderIDs []int) ([]int, error) {
+	rows, err := q.Query("SELECT id FROM orders WHERE id = ANY($1) AND status = 'pending_review' ORDER BY id", pq.Array(orderIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	held := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		held = append(held, id)
+	}
+	return held, rows.Err()
+}
+
+// HeldOrder is an order held for an admin to confirm
+type HeldOrder struct {
+	OrderID        int        `json:"order_id"`
+	UserID         int        `json:"user_id"`
+	CustomerName   string     `json:"customer_name"`
+	CustomerEmail  string     `json:"customer_email"`
+	TotalCents     int        `json:"total_cents"`
+	ThresholdCents int        `json:"threshold_cents"`
+	PickupDate     string     `json:"pickup_date"`
+	PickupTimeSlot *string    `json:"pickup_time_slot,omitempty"`
+	AccountCreated time.Time  `json:"account_created_at"`
+	PriorOrders    int        `json:"prior_orders"` // Earlier orders that weren't cancelled
+	Decision       *string    `json:"decision,omitempty"`
+	Notes          *string    `json:"notes,omitempty"`
+	ReviewedBy     *int       `json:"reviewed_by,omitempty"`
+	ReviewedAt     *time.Time `json:"reviewed_at,omitempty"`
+	HeldAt         time.Time  `json:"held_at"`
+}
+
+type OrderReviewDecisionRequest struct {
+	Notes string `json:"notes"` // Required to reject; shown to the customer
+}
+
+// handleGetOrderReviews lists orders waiting on review, oldest first, with
+// enough about the customer to decide
+func (h *OrderHandler) handleGetOrderReviews(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT o.id, o.user_id, u.first_name || ' ' || u.last_name, u.email,
+		       rv.total_cents, rv.threshold_cents, TO_CHAR(o.pickup_date, 'YYYY-MM-DD'), o.pickup_time_slot,
+		       u.created_at,
+		       (SELECT COUNT(*) FROM orders prior
+		        WHERE prior.user_id = o.user_id AND prior.id < o.id AND prior.status <> 'cancelled'),
+		       rv.decision, rv.notes, rv.reviewed_by, rv.reviewed_at, rv.created_at
+		FROM order_reviews rv
+		JOIN orders o ON o.id = rv.order_id
+		JOIN users u ON u.id = o.user_id
+		WHERE o.status = 'pending_review'
+		ORDER BY rv.created_at`)
+	if err != nil {
+		http.Error(w, "Failed to fetch order reviews", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reviews := []HeldOrder{}
+	for rows.Next() {
+		var rv HeldOrder
+		err := rows.Scan(&rv.OrderID, &rv.UserID, &rv.CustomerName, &rv.CustomerEmail,
+			&rv.TotalCents, &rv.ThresholdCents, &rv.PickupDate, &rv.PickupTimeSlot,
+			&rv.AccountCreated, &rv.PriorOrders,
+			&rv.Decision, &rv.Notes, &rv.ReviewedBy, &rv.ReviewedAt, &rv.HeldAt)
+		if err != nil {
+			http.Error(w, "Failed to fetch order reviews", http.StatusInternalServerError)
+			return
+		}
+		reviews = append(reviews, rv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// decideOrderReview records the decision on a held order and moves it to
+// status, telling the customer why. It returns the customer's ID.
+func decideOrderReview(tx *sql.Tx, orderID, adminID int, decision, status, notes, title, message string) (int, error) {
+	var userID int
+	var current string
+	err := tx.QueryRow("SELECT user_id, status FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&userID, &current)
+	if err != nil {
+		return 0, err
+	}
+	if current != "pending_review" {
+		return 0, errOrderNotPendingReview
+	}
+
+	if _, err := tx.Exec("UPDATE orders SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", status, orderID); err != nil {
+		return 0, err
+	}
+	historyNotes := fmt.Sprintf("Review %s", decision)
+	if notes != "" {
+		historyNotes += ": " + notes
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO order_status_history (order_id, status, notes, updated_by)
+		VALUES ($1, $2, $3, $4)`,
+		orderID, status, historyNotes, adminID,
+	); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		UPDATE order_reviews
+		SET decision = $1, notes = NULLIF($2, ''), reviewed_by = $3, reviewed_at = CURRENT_TIMESTAMP
+		WHERE order_id = $4`,
+		decision, notes, adminID, orderID,
+	); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO notifications (user_id, order_id, type, title, message)
+		VALUES ($1, $2, $3, $4, $5)`,
+		userID, orderID, orderReviewNotificationType, title, message,
+	)
+	return userID, err
+}
+
+func writeOrderReviewError(w http.ResponseWriter, err error) {
+	switch err {
+	case sql.ErrNoRows:
+		http.Error(w, "Order not found", http.StatusNotFound)
+	case errOrderNotPendingReview:
+		http.Error(w, "Order is not pending review", http.StatusConflict)
+	default:
+		http.Error(w, "Failed to review order", http.StatusInternalServerError)
+	}
+}
+
+// handleApproveOrderReview schedules a held order and charges it the way
+// checkout would have
+func (h *OrderHandler) handleApproveOrderReview(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	var req OrderReviewDecisionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	req.Notes = strings.TrimSpace(req.Notes)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	message := "Your order is confirmed and your pickup is scheduled."
+	userID, err := decideOrderReview(tx, orderID, adminID, "approved", "scheduled", req.Notes, "Order confirmed", message)
+	if err != nil {
+		writeOrderReviewError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to review order", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"order_id": orderID, "status": "scheduled"}
+
+	// Charge it now it's confirmed. The approval stands if that fails; the
+	// customer can still pay from the order.
+	var payerID, subtotalCents, tipCents int
+	err = h.db.QueryRow(
+		"SELECT COALESCE(billed_user_id, user_id), subtotal_cents, tip_cents FROM orders WHERE id = $1", orderID,
+	).Scan(&payerID, &subtotalCents, &tipCents)
+	var creditCents int
+	if err == nil {
+		creditCents, err = orderCreditCents(h.db, orderID)
+	}
+	if err == nil && (subtotalCents > creditCents || tipCents > 0) {
+		var checkoutURL string
+		if checkoutURL, _, _, err = h.payments().CreateOrderPaymentIntent(payerID, orderID, subtotalCents, tipCents, creditCents); err == nil {
+			response["checkout_url"] = checkoutURL
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to set up payment for approved order %d: %v", orderID, err)
+		response["payment_error"] = "Payment could not be set up; the customer can pay from the order"
+	}
+
+	if h.realtime != nil {
+		go h.realtime.PublishOrderUpdate(userID, orderID, "scheduled", message, nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleRejectOrderReview cancels a held order, returns any credit spent on
+// it and tells the customer why
+func (h *OrderHandler) handleRejectOrderReview(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	var req OrderReviewDecisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Notes = strings.TrimSpace(req.Notes)
+	if req.Notes == "" || len(req.Notes) > 500 {
+		http.Error(w, "notes are required, up to 500 characters", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	message := "We couldn't confirm your order and it has been cancelled: " + req.Notes
+	userID, err := decideOrderReview(tx, orderID, adminID, "rejected", "cancelled", req.Notes, "Order cancelled", message)
+	if err != nil {
+		writeOrderReviewError(w, err)
+		return
+	}
+
+	creditsReturned, err := orderCreditCents(tx, orderID)
+	if err == nil && creditsReturned > 0 {
+		err = reverseOrderCredits(tx, orderID, fmt.Sprintf("Order #%d cancelled after review", orderID))
+	}
+	if err != nil {
+		http.Error(w, "Failed to return credit", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to review order", http.StatusInternalServerError)
+		return
+	}
+
+	if h.realtime != nil {
+		go h.realtime.PublishOrderUpdate(userID, orderID, "cancelled", message, nil)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id":         orderID,
+		"status":           "cancelled",
+		"credits_returned": centsToDollars(creditsReturned),
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOrderReviews_HoldApproveAndReject(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+	t.Setenv("ORDER_REVIEW_THRESHOLD_CENTS", "5000")
+
+	adminID := db.CreateTestUser(t, "reviewer@example.com", "Order", "Reviewer")
+	userID := db.CreateTestUser(t, "big-order@example.com", "Big", "Order")
+	// Sandbox accounts settle checkout locally, so approval doesn't reach Stripe
+	db.Exec("UPDATE users SET is_sandbox = true WHERE id = $1", userID)
+	addressID := db.CreateTestAddress(t, userID)
+	standardBagID := db.GetServiceID(t, "standard_bag")
+
+	handler := NewOrderHandler(db.DB, nil)
+	createOrder := func(bags int) (int, bool, bool) {
+		handler.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+		body, _ := json.Marshal(CreateOrderRequest{
+			PickupAddressID:   addressID,
+			DeliveryAddressID: addressID,
+			PickupDate:        time.Now().UTC().AddDate(0, 0, 2).Format("2006-01-02"),
+			DeliveryDate:      time.Now().UTC().AddDate(0, 0, 4).Format("2006-01-02"),
+			PickupTimeSlot:    "9am-12pm",
+			DeliveryTimeSlot:  "9am-12pm",
+			Items:             []OrderItem{{ServiceID: standardBagID, Quantity: bags, Price: 30.00}},
+		})
+		w := httptest.NewRecorder()
+		handler.handleCreateOrder(w, httptest.NewRequest("POST", "/api/v1/orders", bytes.NewBuffer(body)))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		var response struct {
+			Order           Order `json:"order"`
+			RequiresPayment bool  `json:"requires_payment"`
+			PendingReview   bool  `json:"pending_review"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response.Order.ID, response.RequiresPayment, response.PendingReview
+	}
+	decide := func(action string, orderID int, body string) *httptest.ResponseRecorder {
+		handler.getUserID = CreateAuthMock(adminID).getUserIDFromRequest
+		req := mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/admin/orders/x/review/"+action, bytes.NewBufferString(body)),
+			map[string]string{"id": fmt.Sprint(orderID)})
+		w := httptest.NewRecorder()
+		if action == "approve" {
+			handler.handleApproveOrderReview(w, req)
+		} else {
+			handler.handleRejectOrderReview(w, req)
+		}
+		return w
+	}
+
+	approvedID, requiresPayment, pendingReview := createOrder(3)
+	if !pendingReview || requiresPayment {
+		t.Fatalf("Expected a $90 order to be held without payment, got pending_review %v requires_payment %v", pendingReview, requiresPayment)
+	}
+	rejectedID, _, _ := createOrder(4)
+	var payments int
+	db.QueryRow("SELECT COUNT(*) FROM payments WHERE order_id IN ($1, $2)", approvedID, rejectedID).Scan(&payments)
+	if payments != 0 {
+		t.Errorf("Expected held orders not to be charged, got %d payments", payments)
+	}
+
+	w := httptest.NewRecorder()
+	handler.handleGetOrderReviews(w, httptest.NewRequest("GET", "/api/v1/admin/orders/reviews", nil))
+	var held []HeldOrder
+	json.Unmarshal(w.Body.Bytes(), &held)
+	if len(held) != 2 || held[0].OrderID != approvedID || held[0].TotalCents != 9000 || held[0].ThresholdCents != 5000 {
+		t.Fatalf("Expected both orders waiting on review, got %+v", held)
+	}
+	if held[1].PriorOrders != 1 {
+		t.Errorf("Expected the second order to count the first, got %d", held[1].PriorOrders)
+	}
+
+	if w := decide("approve", approvedID, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var status string
+	db.QueryRow("SELECT status FROM orders WHERE id = $1", approvedID).Scan(&status)
+	db.QueryRow("SELECT COUNT(*) FROM payments WHERE order_id = $1", approvedID).Scan(&payments)
+	if status != "scheduled" || payments != 1 {
+		t.Errorf("Expected the approved order scheduled and charged, got %s with %d payments", status, payments)
+	}
+	if w := decide("approve", approvedID, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d approving twice, got %d", http.StatusConflict, w.Code)
+	}
+
+	if w := decide("reject", rejectedID, `{"notes": ""}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d rejecting without notes, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := decide("reject", rejectedID, `{"notes": "We couldn't verify the pickup address"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var decision, message string
+	db.QueryRow("SELECT o.status, rv.decision FROM orders o JOIN order_reviews rv ON rv.order_id = o.id WHERE o.id = $1", rejectedID).Scan(&status, &decision)
+	db.QueryRow("SELECT message FROM notifications WHERE order_id = $1 AND type = $2", rejectedID, orderReviewNotificationType).Scan(&message)
+	if status != "cancelled" || decision != "rejected" || message == "" {
+		t.Errorf("Expected the rejected order cancelled with a notice, got %s %s %q", status, decision, message)
+	}
+
+	if w := decide("approve", 999999, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown order, got %d", http.StatusNotFound, w.Code)
+	}
+}
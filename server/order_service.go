@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ServiceErrorKind is what went wrong with a request to a service, for each
+// surface (HTTP now, others later) to map to its own status
+type ServiceErrorKind int
+
+const (
+	ErrInvalid ServiceErrorKind = iota
+	ErrNotFound
+	ErrConflict
+)
+
+// ServiceError is a failure caused by the request rather than the system,
+// so its message is safe to show the caller. Anything else a service
+// returns is an internal error.
+type ServiceError struct {
+	Kind    ServiceErrorKind
+	Message string
+}
+
+func (e *ServiceError) Error() string { return e.Message }
+
+func serviceError(kind ServiceErrorKind, format string, args ...interface{}) error {
+	return &ServiceError{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeServiceError writes a service's error as an HTTP response. Internal
+// errors are reported as failed, without their details.
+func writeServiceError(w http.ResponseWriter, err error, failed string) {
+	var serviceErr *ServiceError
+	if !errors.As(err, &serviceErr) {
+		http.Error(w, failed, http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusBadRequest
+	switch serviceErr.Kind {
+	case ErrNotFound:
+		status = http.StatusNotFound
+	case ErrConflict:
+		status = http.StatusConflict
+	}
+	http.Error(w, serviceErr.Message, status)
+}
+
+// OrderService is the order operations handlers and other surfaces share.
+// Its methods take plain arguments and return results and ServiceErrors,
+// leaving request parsing and responses to the caller.
+type OrderService struct {
+	db       *sql.DB
+	realtime RealtimeInterface
+	repo     OrderRepo
+}
+
+func NewOrderService(db *sql.DB, realtime RealtimeInterface) *OrderService {
+	return &OrderService{db: db, realtime: realtime, repo: pgOrderRepo{db: db}}
+}
+
+// orders returns the service behind the handler's order operations
+func (h *OrderHandler) orders() *OrderService {
+	s := NewOrderService(h.db, h.realtime)
+	if h.orderRepo != nil {
+		s.repo = h.orderRepo
+	}
+	return s
+}
+
+// GetOrder returns one of a customer's orders. Other customers' orders are
+// reported as not found so their IDs can't be probed.
+func (s *OrderService) GetOrder(ctx context.Context, userID, orderID int) (*Order, error) {
+	order, err := s.repo.Get(ctx, orderID)
+	if err == sql.ErrNoRows || (err == nil && order.UserID != userID) {
+		return nil, serviceError(ErrNotFound, "Order not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return order, nil
+}
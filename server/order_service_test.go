@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteServiceError(t *testing.T) {
+	tests := []struct {
+		err     error
+		status  int
+		message string
+	}{
+		{serviceError(ErrInvalid, "Reason must be %d characters or fewer", 500), http.StatusBadRequest, "Reason must be 500 characters or fewer"},
+		{serviceError(ErrNotFound, "Order not found"), http.StatusNotFound, "Order not found"},
+		{fmt.Errorf("cancelling: %w", serviceError(ErrConflict, "A delivered order can't be cancelled")), http.StatusConflict, "A delivered order can't be cancelled"},
+		// Internal errors don't leak their details
+		{errors.New("pq: deadlock detected"), http.StatusInternalServerError, "Failed to cancel order"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeServiceError(w, tt.err, "Failed to cancel order")
+		if w.Code != tt.status || strings.TrimSpace(w.Body.String()) != tt.message {
+			t.Errorf("%v: expected %d %q, got %d %q", tt.err, tt.status, tt.message, w.Code, w.Body.String())
+		}
+	}
+}
+
+// fakeOrderRepo serves orders from memory
+type fakeOrderRepo struct {
+	orders map[int]*Order
+	err    error
+}
+
+func (f *fakeOrderRepo) Get(ctx context.Context, orderID int) (*Order, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	order, ok := f.orders[orderID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return order, nil
+}
+
+func TestOrderService_GetOrder(t *testing.T) {
+	repo := &fakeOrderRepo{orders: map[int]*Order{7: {ID: 7, UserID: 1, Status: "scheduled"}}}
+	service := &OrderService{repo: repo}
+
+	order, err := service.GetOrder(context.Background(), 1, 7)
+	if err != nil || order.ID != 7 {
+		t.Fatalf("Expected the customer's order, got %v %v", order, err)
+	}
+
+	// Someone else's order looks the same as one that doesn't exist
+	var serviceErr *ServiceError
+	for _, orderID := range []int{7, 8} {
+		_, err := service.GetOrder(context.Background(), 2, orderID)
+		if !errors.As(err, &serviceErr) || serviceErr.Kind != ErrNotFound {
+			t.Errorf("Expected order %d not found, got %v", orderID, err)
+		}
+	}
+
+	repo.err = errors.New("connection reset")
+	if _, err := service.GetOrder(context.Background(), 1, 7); err == nil || errors.As(err, &serviceErr) {
+		t.Errorf("Expected the repository's error returned as internal, got %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// OrderStatusDefinition describes one order status. This table is the single
+// source of truth for statuses; it must stay in sync with orders_status_check.
+type OrderStatusDefinition struct {
+	Status          string   `json:"status"`
+	Label           string   `json:"label"`
+	CustomerMessage string   `json:"customer_message"`
+	Terminal        bool     `json:"terminal"`
+	Transitions     []string `json:"transitions"`
+	// PickupAhead and DeliveryAhead mark orders whose pickup or delivery is
+	// still to come, so it can be reminded about or moved to another address
+	PickupAhead   bool `json:"pickup_ahead"`
+	DeliveryAhead bool `json:"delivery_ahead"`
+}
+
+// orderStatuses lists statuses in lifecycle order
+var orderStatuses = []OrderStatusDefinition{
+	{
+		Status:          "pending",
+		Label:           "Pending",
+		CustomerMessage: "Order received",
+		Transitions:     []string{"scheduled", "cancelled"},
+		PickupAhead:     true,
+		DeliveryAhead:   true,
+	},
+	{
+		// Held for an admin to approve before it's scheduled; only the
+		// review endpoints move it on, apart from the customer cancelling
+		Status:          "pending_review",
+		Label:           "Pending Review",
+		CustomerMessage: "Order received - we're confirming a few details before scheduling your pickup",
+		Transitions:     []string{"cancelled"},
+	},
+	{
+		Status:          "scheduled",
+		Label:           "Scheduled",
+		CustomerMessage: "Order scheduled for pickup",
+		Transitions:     []string{"picked_up", "failed", "cancelled"},
+		PickupAhead:     true,
+		DeliveryAhead:   true,
+	},
+	{
+		Status:          "picked_up",
+		Label:           "Picked Up",
+		CustomerMessage: "Laundry picked up by driver",
+		Transitions:     []string{"in_process", "failed"},
+		DeliveryAhead:   true,
+	},
+	{
+		Status:          "in_process",
+		Label:           "In Process",
+		CustomerMessage: "Laundry being processed",
+		Transitions:     []string{"ready"},
+		DeliveryAhead:   true,
+	},
+	{
+		Status:          "ready",
+		Label:           "Ready for Delivery",
+		CustomerMessage: "Laundry ready for delivery",
+		Transitions:     []string{"out_for_delivery"},
+		DeliveryAhead:   true,
+	},
+	{
+		Status:          "out_for_delivery",
+		Label:           "Out for Delivery",
+		CustomerMessage: "Out for delivery",
+		Transitions:     []string{"delivered", "failed"},
+	},
+	{
+		Status:          "delivered",
+		Label:           "Delivered",
+		CustomerMessage: "Delivered successfully",
+		Terminal:        true,
+		Transitions:     []string{},
+	},
+	{
+		Status:          "failed",
+		Label:           "Failed",
+		CustomerMessage: "Pickup/delivery failed - our team will contact you to resolve this issue",
+		Transitions:     []string{"scheduled", "cancelled"},
+	},
+	{
+		Status:          "cancelled",
+		Label:           "Cancelled",
+		CustomerMessage: "Order cancelled",
+		Terminal:        true,
+		Transitions:     []string{},
+	},
+}
+
+// routeOrderStatuses are the statuses of a stop on a driver route
+// (must match the route_orders database constraint)
+var routeOrderStatuses = []string{"pending", "completed", "failed"}
+
+// orderStatusDefinition looks up a status in the vocabulary
+func orderStatusDefinition(status string) (OrderStatusDefinition, bool) {
+	for _, def := range orderStatuses {
+		if def.Status == status {
+			return def, true
+		}
+	}
+	return OrderStatusDefinition{}, false
+}
+
+func isValidOrderStatus(status string) bool {
+	_, ok := orderStatusDefinition(status)
+	return ok
+}
+
+// terminalOrderStatuses lists the statuses an order never leaves
+func terminalOrderStatuses() []string {
+	var statuses []string
+	for _, def := range orderStatuses {
+		if def.Terminal {
+			statuses = append(statuses, def.Status)
+		}
+	}
+	return statuses
+}
+
+// pickupAheadOrderStatuses lists the statuses whose pickup is still to come
+func pickupAheadOrderStatuses() []string {
+	var statuses []string
+	for _, def := range orderStatuses {
+		if def.PickupAhead {
+			statuses = append(statuses, def.Status)
+		}
+	}
+	return statuses
+}
+
+// deliveryAheadOrderStatuses lists the statuses whose delivery is still to come
+func deliveryAheadOrderStatuses() []string {
+	var statuses []string
+	for _, def := range orderStatuses {
+		if def.DeliveryAhead {
+			statuses = append(statuses, def.Status)
+		}
+	}
+	return statuses
+}
+
+func isValidRouteOrderStatus(status string) bool {
+	for _, s := range routeOrderStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// canTransitionOrderStatus reports whether an order may move from one status
+// to another. Re-applying the current status is always allowed.
+func canTransitionOrderStatus(from, to string) bool {
+	if from == to {
+		return isValidOrderStatus(to)
+	}
+	def, ok := orderStatusDefinition(from)
+	if !ok {
+		return false
+	}
+	for _, next := range def.Transitions {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// orderStatusMessage returns the customer-facing message for a status
+func orderStatusMessage(status string) string {
+	if def, ok := orderStatusDefinition(status); ok && def.CustomerMessage != "" {
+		return def.CustomerMessage
+	}
+	return "Order status updated"
+}
+
+// handleGetOrderStatuses exposes the status vocabulary to the frontend
+func (s *Server) handleGetOrderStatuses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_statuses":       orderStatuses,
+		"route_order_statuses": routeOrderStatuses,
+	})
+}
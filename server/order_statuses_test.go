@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanTransitionOrderStatus(t *testing.T) {
+	tests := []struct {
+		from     string
+		to       string
+		expected bool
+	}{
+		{"scheduled", "picked_up", true},
+		{"picked_up", "in_process", true},
+		{"out_for_delivery", "delivered", true},
+		{"out_for_delivery", "failed", true},
+		{"failed", "scheduled", true},
+		{"scheduled", "scheduled", true},
+		{"scheduled", "delivered", false},
+		{"delivered", "scheduled", false},
+		{"cancelled", "pending", false},
+		{"unknown", "scheduled", false},
+		{"scheduled", "unknown", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			if got := canTransitionOrderStatus(tt.from, tt.to); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestOrderStatusVocabulary(t *testing.T) {
+	for _, def := range orderStatuses {
+		if def.Label == "" || def.CustomerMessage == "" {
+			t.Errorf("Status %s is missing a label or customer message", def.Status)
+		}
+		if def.Terminal && len(def.Transitions) > 0 {
+			t.Errorf("Terminal status %s should not have transitions", def.Status)
+		}
+		for _, next := range def.Transitions {
+			if !isValidOrderStatus(next) {
+				t.Errorf("Status %s transitions to unknown status %s", def.Status, next)
+			}
+		}
+		if (def.PickupAhead && !def.DeliveryAhead) || (def.Terminal && def.DeliveryAhead) {
+			t.Errorf("Status %s has a pickup or delivery ahead out of order", def.Status)
+		}
+	}
+
+	if orderStatusMessage("not_a_status") != "Order status updated" {
+		t.Error("Expected fallback message for unknown status")
+	}
+}
+
+func TestHandleGetOrderStatuses(t *testing.T) {
+	server := &Server{}
+	req := httptest.NewRequest("GET", "/api/v1/meta/order-statuses", nil)
+	w := httptest.NewRecorder()
+
+	server.handleGetOrderStatuses(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response struct {
+		OrderStatuses      []OrderStatusDefinition `json:"order_statuses"`
+		RouteOrderStatuses []string                `json:"route_order_statuses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(response.OrderStatuses) != len(orderStatuses) {
+		t.Errorf("Expected %d statuses, got %d", len(orderStatuses), len(response.OrderStatuses))
+	}
+	if len(response.RouteOrderStatuses) != len(routeOrderStatuses) {
+		t.Errorf("Expected %d route order statuses, got %d", len(routeOrderStatuses), len(response.RouteOrderStatuses))
+	}
+}
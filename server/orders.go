@@ -4,27 +4,25 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"math"
+	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
+	"tumble-backend/money"
+	"tumble-backend/storage"
+
 	"github.com/gorilla/mux"
-	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/checkout/session"
-	"github.com/stripe/stripe-go/v82/customer"
-	"github.com/stripe/stripe-go/v82/price"
-	"github.com/stripe/stripe-go/v82/product"
 )
 
-// Helper functions to convert between cents and dollars
+// Helper functions to convert between cents and dollars at the JSON
+// boundary. All arithmetic on amounts is done in cents; see the money package.
 func centsToDollars(cents int) float64 {
-	return float64(cents) / 100.0
+	return money.ToDollars(cents)
 }
 
 func dollarsToCents(dollars float64) int {
-	return int(math.Round(dollars * 100))
+	return money.FromDollars(dollars)
 }
 
 type RealtimeInterface interface {
@@ -36,6 +34,34 @@ type OrderHandler struct {
 	db       *sql.DB
 	realtime RealtimeInterface
 	getUserID func(*http.Request, *sql.DB) (int, error)
+	// slotHolds is nil in tests; capacity is then checked against orders only
+	slotHolds SlotHoldStore
+	// driverLocations is nil in tests; tracking then has no driver pin
+	driverLocations DriverLocationStore
+	// fileStore is nil in tests; receipts then omit the signature image link
+	fileStore storage.Store
+	// quota is nil unless a test injects one; quotas are then read from db
+	quota *QuotaService
+	// orderRepo and userRepo are nil unless a test injects them; orders and
+	// accounts are then read from db
+	orderRepo OrderRepo
+	userRepo  UserRepo
+}
+
+// quotas returns the service subscribers' quotas are worked out with
+func (h *OrderHandler) quotas() *QuotaService {
+	if h.quota != nil {
+		return h.quota
+	}
+	return NewQuotaService(pgSubscriptionRepo{db: h.db})
+}
+
+// users returns the repository customers' accounts are read from
+func (h *OrderHandler) users() UserRepo {
+	if h.userRepo != nil {
+		return h.userRepo
+	}
+	return pgUserRepo{db: h.db}
 }
 
 type Order struct {
@@ -50,14 +76,30 @@ type Order struct {
 	Tax                  *float64  `json:"tax,omitempty"`      // Convert from cents for JSON
 	Tip                  *float64  `json:"tip,omitempty"`      // Convert from cents for JSON
 	Total                *float64  `json:"total,omitempty"`    // Convert from cents for JSON
+	// OverweightCharge is charged for bags weighed over their included pounds
+	OverweightCharge     float64   `json:"overweight_charge,omitempty"`
 	SpecialInstructions  *string   `json:"special_instructions,omitempty"`
+	// DeliveryInstructions is copied from the instruction template chosen at checkout
+	DeliveryInstructions  *string  `json:"delivery_instructions,omitempty"`
+	InstructionTemplateID *int     `json:"instruction_template_id,omitempty"`
 	PickupDate           string    `json:"pickup_date"`
 	DeliveryDate         string    `json:"delivery_date"`
 	PickupTimeSlot       string    `json:"pickup_time_slot"`
 	DeliveryTimeSlot     string    `json:"delivery_time_slot"`
 	CreatedAt            time.Time `json:"created_at"`
 	UpdatedAt            time.Time `json:"updated_at"`
+	BilledUserID         *int      `json:"billed_user_id,omitempty"`
 	Items                []OrderItem `json:"items,omitempty"`
+	Garments             []OrderGarment `json:"garments,omitempty"`
+	AddOns               []OrderAddOn `json:"add_ons,omitempty"`
+	// SlotAdjustment is the peak or off-peak pricing for the pickup slot, if any
+	SlotAdjustment       *OrderSlotAdjustment `json:"slot_adjustment,omitempty"`
+	// ZoneSurcharge is the pickup service zone's surcharge, if any
+	ZoneSurcharge        *OrderZoneSurcharge `json:"zone_surcharge,omitempty"`
+	// Pricing is what the order was sold with; nil for older orders
+	Pricing              *OrderPricingSnapshot `json:"pricing,omitempty"`
+	// Locker is where the order is delivered instead of an address, if anywhere
+	Locker               *LockerReservation `json:"locker,omitempty"`
 	StatusHistory        []OrderStatus `json:"status_history,omitempty"`
 }
 
@@ -70,6 +112,9 @@ type OrderItem struct {
 	Weight    *float64 `json:"weight,omitempty"`
 	Price     float64  `json:"price"` // Convert from cents for JSON
 	Notes     *string  `json:"notes,omitempty"`
+	Options   *ItemOptions `json:"options,omitempty"`
+	// OptionsPrice is what the options added to the line in total, priced from add-ons
+	OptionsPrice float64 `json:"options_price,omitempty"`
 }
 
 type OrderStatus struct {
@@ -89,8 +134,21 @@ type CreateOrderRequest struct {
 	PickupTimeSlot      string      `json:"pickup_time_slot"`
 	DeliveryTimeSlot    string      `json:"delivery_time_slot"`
 	SpecialInstructions *string     `json:"special_instructions,omitempty"`
+	// InstructionTemplateID picks one of the customer's saved delivery instructions
+	InstructionTemplateID *int      `json:"instruction_template_id,omitempty"`
 	Items               []OrderItem `json:"items"`
+	// Garments are itemized dry-cleaning pieces priced from the garment catalog
+	Garments            []OrderGarmentRequest `json:"garments,omitempty"`
+	// AddOnIDs are checkout extras, priced server-side from the add-on catalog
+	AddOnIDs            []int       `json:"add_on_ids,omitempty"`
+	// ReservationToken is the pickup slot hold taken at the payment step
+	ReservationToken    string      `json:"reservation_token,omitempty"`
 	Tip                 float64     `json:"tip,omitempty"`
+	// BillToHousehold charges the order to the household owner's payment method
+	BillToHousehold bool `json:"bill_to_household,omitempty"`
+	// DeliveryLocationID delivers to a locker or pickup point, holding a
+	// space there from checkout
+	DeliveryLocationID *int `json:"delivery_location_id,omitempty"`
 }
 
 func NewOrderHandler(db *sql.DB, realtime RealtimeInterface) *OrderHandler {
@@ -108,6 +166,9 @@ func (h *OrderHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Queries made with ctx show up in the request's trace
+	ctx := r.Context()
+
 	// Get user ID from auth token
 	userID, err := h.getUserID(r, h.db)
 	if err != nil {
@@ -121,191 +182,280 @@ func (h *OrderHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Check for active subscription and calculate current usage dynamically
+	if err := validateGarmentRequests(req.Garments); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid garments: %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, item := range req.Items {
+		if err := item.Options.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid item options: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Household members can bill orders to the owner, using either's addresses
+	billingUserID := userID
+	var billedUserID *int
+	if req.BillToHousehold {
+		ownerID, err := householdOwnerFor(h.db, userID, "schedule")
+		if err != nil || ownerID == userID {
+			http.Error(w, "You are not a member of a household", http.StatusForbidden)
+			return
+		}
+		var validAddresses int
+		err = h.db.QueryRowContext(ctx, `
+			SELECT COUNT(DISTINCT id) FROM addresses
+			WHERE id IN ($1, $2) AND user_id IN ($3, $4)`,
+			req.PickupAddressID, req.DeliveryAddressID, userID, ownerID,
+		).Scan(&validAddresses)
+		expectedAddresses := 2
+		if req.PickupAddressID == req.DeliveryAddressID {
+			expectedAddresses = 1
+		}
+		if err != nil || validAddresses != expectedAddresses {
+			http.Error(w, "Invalid address for household order", http.StatusBadRequest)
+			return
+		}
+		billingUserID = ownerID
+		billedUserID = &ownerID
+	}
+
+	blockID, err := activeBlockFor(h.db, userID, req.PickupAddressID, req.DeliveryAddressID)
+	if err == nil && blockID == 0 && billingUserID != userID {
+		blockID, err = activeBlockFor(h.db, billingUserID)
+	}
+	if err != nil {
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
+	}
+	if blockID != 0 {
+		http.Error(w, errOrderBlocked, http.StatusForbidden)
+		return
+	}
+
+	// Subscribers' pickups and standard bags are covered up to their plan's quota
+	quota, err := h.quotas().Quota(ctx, userID, true)
+	if err != nil {
+		http.Error(w, "Failed to check subscription usage", http.StatusInternalServerError)
+		return
+	}
 	var subscriptionID *int
-	var pickupsUsed, pickupsAllowed int
-	var bagsUsed, bagsAllowed int
-	var subscription struct {
-		ID                 int
-		PickupsPerMonth    int
-		CurrentPeriodStart string
-		CurrentPeriodEnd   string
+	if quota != nil {
+		subscriptionID = &quota.Period.SubscriptionID
 	}
-	
-	err = h.db.QueryRow(`
-		SELECT s.id, p.pickups_per_month, s.current_period_start, s.current_period_end
-		FROM subscriptions s
-		JOIN subscription_plans p ON s.plan_id = p.id
-		WHERE s.user_id = $1 AND s.status = 'active'
-		ORDER BY s.created_at DESC
-		LIMIT 1`,
-		userID,
-	).Scan(&subscription.ID, &subscription.PickupsPerMonth, 
-		&subscription.CurrentPeriodStart, &subscription.CurrentPeriodEnd)
-	
-	if err == nil {
-		// User has active subscription - calculate current usage dynamically
-		subscriptionID = &subscription.ID
-		pickupsAllowed = subscription.PickupsPerMonth
-		bagsAllowed = subscription.PickupsPerMonth // Same as pickups in current plans
-		
-		// Count actual pickups (orders) in current period
-		err = h.db.QueryRow(`
-			SELECT COUNT(DISTINCT o.id)
-			FROM orders o
-			WHERE o.user_id = $1 
-			AND o.subscription_id = $2
-			AND o.pickup_date >= $3::date 
-			AND o.pickup_date < $4::date
-			AND o.status != 'cancelled'`,
-			userID, subscription.ID, subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd,
-		).Scan(&pickupsUsed)
-		
-		if err != nil {
-			pickupsUsed = 0 // Default to 0 if query fails
+
+	var deliveryInstructions *string
+	if req.InstructionTemplateID != nil {
+		instructions, err := instructionTemplateText(h.db, userID, *req.InstructionTemplateID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid instruction template", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
-		
-		// Count actual standard bags covered by subscription in current period
-		// Only count bags that were covered (price = 0)
-		err = h.db.QueryRow(`
-			SELECT COALESCE(SUM(oi.quantity), 0)
-			FROM orders o
-			JOIN order_items oi ON o.id = oi.order_id
-			JOIN services s ON oi.service_id = s.id
-			WHERE o.user_id = $1 
-			AND o.subscription_id = $2
-			AND o.pickup_date >= $3::date 
-			AND o.pickup_date < $4::date
-			AND o.status != 'cancelled'
-			AND s.name = 'standard_bag'
-			AND oi.price_cents = 0`,
-			userID, subscription.ID, subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd,
-		).Scan(&bagsUsed)
-		
-		if err != nil {
-			bagsUsed = 0 // Default to 0 if query fails
+		deliveryInstructions = &instructions
+	}
+
+	// The customer's own slot hold doesn't count against them
+	holdToken := ""
+	if req.ReservationToken != "" && h.slotHolds != nil {
+		hold, err := h.slotHolds.Get(ctx, req.ReservationToken)
+		if err == nil && hold != nil && hold.UserID == userID &&
+			hold.Date == req.PickupDate && hold.TimeSlot == req.PickupTimeSlot {
+			holdToken = hold.Token
 		}
 	}
+	pickupDate, err := time.Parse("2006-01-02", req.PickupDate)
+	if err != nil {
+		http.Error(w, "Invalid pickup date", http.StatusBadRequest)
+		return
+	}
+	// Capacity and bag pricing both depend on the pickup market
+	var pickupZip string
+	if err := h.db.QueryRowContext(ctx, "SELECT zip_code FROM addresses WHERE id = $1", req.PickupAddressID).Scan(&pickupZip); err != nil {
+		http.Error(w, "Invalid pickup address", http.StatusBadRequest)
+		return
+	}
+	// Both ends of the order must be somewhere we serve; the pickup zone's
+	// surcharge applies
+	pickupArea, ok := requireServiceArea(w, h.db, pickupZip)
+	if !ok {
+		return
+	}
+	if req.DeliveryAddressID != req.PickupAddressID {
+		var deliveryZip string
+		if err := h.db.QueryRowContext(ctx, "SELECT zip_code FROM addresses WHERE id = $1", req.DeliveryAddressID).Scan(&deliveryZip); err != nil {
+			http.Error(w, "Invalid delivery address", http.StatusBadRequest)
+			return
+		}
+		if _, ok := requireServiceArea(w, h.db, deliveryZip); !ok {
+			return
+		}
+	}
+	// Services sold in one market can only be ordered there
+	pickupMarketID, err := marketIDForZip(h.db, pickupZip)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Intake may be paused while we recover from an outage
+	pause, err := activeIntakePause(h.db, pickupMarketID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if pause != nil {
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "We're not taking new orders here right now. Please try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	serviceIDs := make([]int, 0, len(req.Items))
+	for _, item := range req.Items {
+		serviceIDs = append(serviceIDs, item.ServiceID)
+	}
+	unavailable, err := servicesNotSoldInMarket(h.db, serviceIDs, pickupMarketID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(unavailable) > 0 {
+		http.Error(w, fmt.Sprintf("Services %v aren't offered at the pickup address", unavailable), http.StatusBadRequest)
+		return
+	}
 	
 	// Begin transaction
-	tx, err := h.db.Begin()
+	tx, err := h.db.BeginTx(ctx, nil)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	defer tx.Rollback()
 
+	// The slot stays locked until the order commits
+	_, capacitySpan := StartSpan(ctx, "checkSlotCapacity")
+	err = checkSlotCapacity(tx, h.slotHolds, pickupDate, marketForZip(pickupZip), req.PickupTimeSlot, holdToken)
+	capacitySpan.End(err)
+	if err == errSlotFull {
+		writeSlotFull(w, r, h.db, h.slotHolds, pickupDate, marketForZip(pickupZip), req.PickupTimeSlot)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	// Create order with placeholder totals (will update later)
 	var orderID int
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
 		INSERT INTO orders (
 			user_id, subscription_id, pickup_address_id, delivery_address_id, 
 			status, subtotal_cents, tax_cents, tip_cents, total_cents,
 			special_instructions, pickup_date, delivery_date,
-			pickup_time_slot, delivery_time_slot
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+			pickup_time_slot, delivery_time_slot, billed_user_id,
+			delivery_instructions, instruction_template_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 		RETURNING id`,
 		userID, subscriptionID, req.PickupAddressID, req.DeliveryAddressID,
 		"scheduled", 0, 0, dollarsToCents(req.Tip), 0, // Placeholder totals in cents
 		req.SpecialInstructions, req.PickupDate, req.DeliveryDate,
-		req.PickupTimeSlot, req.DeliveryTimeSlot,
+		req.PickupTimeSlot, req.DeliveryTimeSlot, billedUserID,
+		deliveryInstructions, req.InstructionTemplateID,
 	).Scan(&orderID)
 	if err != nil {
 		http.Error(w, "Failed to create order", http.StatusInternalServerError)
 		return
 	}
 
+	if req.DeliveryLocationID != nil {
+		err = reserveLocker(tx, orderID, *req.DeliveryLocationID)
+		if err == errPickupLocationUnavailable {
+			http.Error(w, "Invalid delivery location", http.StatusBadRequest)
+			return
+		} else if err == errLockerFull {
+			http.Error(w, "That locker is full. Choose another location or delivery to an address.", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to reserve locker", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Get pickup service ID
 	var pickupServiceID int
-	err = tx.QueryRow("SELECT id FROM services WHERE name = 'pickup_service'").Scan(&pickupServiceID)
+	err = tx.QueryRowContext(ctx, "SELECT id FROM services WHERE name = 'pickup_service'").Scan(&pickupServiceID)
 	if err != nil {
 		http.Error(w, "Failed to get pickup service", http.StatusInternalServerError)
 		return
 	}
 	
 	// Add pickup service as a line item
-	// For pay-as-you-go: pickup is included in bag price (no separate fee)
-	// For subscribers: pickup is free within quota, $10 if over quota
-	pickupPrice := 0.0
-	pickupNote := "Pickup Service"
-	
-	if subscriptionID != nil {
-		// Subscriber - check if they're over quota
-		if pickupsUsed >= pickupsAllowed {
-			// Over quota - charge pickup fee
-			pickupPrice = 10.0
-			pickupNote = "Pickup Service (Over Quota)"
-		} else {
-			// Within quota - free
-			pickupNote = "Pickup Service (Included)"
-		}
-	} else {
-		// Pay-as-you-go - pickup included in bag price
-		pickupNote = "Pickup Service (Included)"
-	}
-	
-	_, err = tx.Exec(`
+	pickupPriceCents, pickupNote := quota.pickupCharge()
+
+	_, err = tx.ExecContext(ctx, `
 		INSERT INTO order_items (order_id, service_id, quantity, weight, price_cents, notes)
 		VALUES ($1, $2, $3, $4, $5, $6)`,
-		orderID, pickupServiceID, 1, nil, dollarsToCents(pickupPrice), pickupNote,
+		orderID, pickupServiceID, 1, nil, pickupPriceCents, pickupNote,
 	)
 	if err != nil {
 		http.Error(w, "Failed to create pickup service item", http.StatusInternalServerError)
 		return
 	}
+	// Subscribers billed at period end get the over-quota fee on their invoice
+	if cents := quota.deferredOverageCents(); cents > 0 {
+		if err := recordSubscriptionOverage(tx, quota, userID, orderID, cents); err != nil {
+			http.Error(w, "Failed to record subscription overage", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// Insert bag items with separate coverage tracking
-	remainingBagCoverage := 0
-	if subscriptionID != nil {
-		// Calculate how many standard bags can be covered (separate from pickup coverage)
-		remainingBagCoverage = bagsAllowed - bagsUsed
+	// Bags are priced from the pickup market's bag pricing when it sets one
+	bagPricing, err := bagPricingByService(tx, pickupZip)
+	if err != nil {
+		http.Error(w, "Failed to price bags", http.StatusInternalServerError)
+		return
 	}
-	
+
 	for _, item := range req.Items {
-		// Check if this is a standard bag that can be covered
 		var serviceName string
-		tx.QueryRow("SELECT name FROM services WHERE id = $1", item.ServiceID).Scan(&serviceName)
-		
-		if serviceName == "standard_bag" && remainingBagCoverage > 0 {
-			// Calculate how many bags from this item can be covered
-			bagsCovered := item.Quantity
-			if bagsCovered > remainingBagCoverage {
-				bagsCovered = remainingBagCoverage
+		tx.QueryRowContext(ctx, "SELECT name FROM services WHERE id = $1", item.ServiceID).Scan(&serviceName)
+
+		// The included weight and overweight rate are kept on the line for weighing at pickup
+		priceCents := dollarsToCents(item.Price)
+		var includedPounds *float64
+		var overweightRate *int
+		if pricing, ok := bagPricing[item.ServiceID]; ok {
+			priceCents = dollarsToCents(pricing.Price)
+			rateCents := dollarsToCents(pricing.OverweightRate)
+			includedPounds, overweightRate = &pricing.IncludedPounds, &rateCents
+		}
+
+		opts := item.Options
+		if opts == nil {
+			opts = &ItemOptions{}
+		}
+
+		// Bags the plan covers go on their own $0 line
+		covered, charged := quota.coverBags(serviceName, item.Quantity)
+		for _, line := range []struct{ quantity, priceCents int }{{covered, 0}, {charged, priceCents}} {
+			if line.quantity == 0 {
+				continue
 			}
-			
-			// Insert covered bags as separate line item with $0 price
-			if bagsCovered > 0 {
-				_, err = tx.Exec(`
-					INSERT INTO order_items (order_id, service_id, quantity, weight, price_cents, notes)
-					VALUES ($1, $2, $3, $4, $5, $6)`,
-					orderID, item.ServiceID, bagsCovered, item.Weight, 0, item.Notes,
-				)
-				if err != nil {
-					http.Error(w, "Failed to create covered order items", http.StatusInternalServerError)
-					return
-				}
-				remainingBagCoverage -= bagsCovered
+			// The plan covers the bags but not the extras asked for on them
+			optionsCents, err := priceItemOptions(tx, opts, line.quantity, line.priceCents*line.quantity, pickupZip)
+			if err == errAddOnUnavailable {
+				http.Error(w, "Invalid item options: an option isn't offered at the pickup address", http.StatusBadRequest)
+				return
 			}
-			
-			// Insert remaining bags at full price if any
-			remainingBags := item.Quantity - bagsCovered
-			if remainingBags > 0 {
-				_, err = tx.Exec(`
-					INSERT INTO order_items (order_id, service_id, quantity, weight, price_cents, notes)
-					VALUES ($1, $2, $3, $4, $5, $6)`,
-					orderID, item.ServiceID, remainingBags, item.Weight, dollarsToCents(item.Price), item.Notes,
-				)
-				if err != nil {
-					http.Error(w, "Failed to create charged order items", http.StatusInternalServerError)
-					return
-				}
+			if err != nil {
+				http.Error(w, "Failed to price item options", http.StatusInternalServerError)
+				return
 			}
-		} else {
-			// Non-standard bags or no coverage available - insert at full price
-			_, err = tx.Exec(`
-				INSERT INTO order_items (order_id, service_id, quantity, weight, price_cents, notes)
-				VALUES ($1, $2, $3, $4, $5, $6)`,
-				orderID, item.ServiceID, item.Quantity, item.Weight, dollarsToCents(item.Price), item.Notes,
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO order_items (order_id, service_id, quantity, weight, price_cents, notes, included_pounds, overweight_cents_per_pound,
+				                         detergent, water_temperature, hang_dry, fold_style, allergy_safe, options_price_cents)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, ''), $11, NULLIF($12, ''), $13, $14)`,
+				orderID, item.ServiceID, line.quantity, item.Weight, line.priceCents, item.Notes, includedPounds, overweightRate,
+				opts.Detergent, opts.WaterTemperature, opts.HangDry, opts.FoldStyle, opts.AllergySafe, optionsCents,
 			)
 			if err != nil {
 				http.Error(w, "Failed to create order items", http.StatusInternalServerError)
@@ -314,21 +464,23 @@ func (h *OrderHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	// Add initial status history
-	_, err = tx.Exec(`
-		INSERT INTO order_status_history (order_id, status, notes, updated_by)
-		VALUES ($1, $2, $3, $4)`,
-		orderID, "scheduled", "Order created", userID,
-	)
+	// Add itemized garments at catalog prices
+	_, garmentSpan := StartSpan(ctx, "insertOrderGarments")
+	garmentCents, err := insertOrderGarments(tx, orderID, req.Garments)
+	garmentSpan.End(err)
+	if err == errUnknownGarmentType {
+		http.Error(w, "Invalid garments: unknown garment type", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to create status history", http.StatusInternalServerError)
+		http.Error(w, "Failed to create order garments", http.StatusInternalServerError)
 		return
 	}
 
-	// Calculate final totals based on inserted items
-	var subtotalCents int
-	rows, err := tx.Query(`
-		SELECT price_cents, quantity FROM order_items WHERE order_id = $1`,
+	// Calculate final totals based on inserted items and garments
+	subtotalCents := garmentCents
+	rows, err := tx.QueryContext(ctx, `
+		SELECT price_cents, quantity, options_price_cents FROM order_items WHERE order_id = $1`,
 		orderID,
 	)
 	if err != nil {
@@ -340,19 +492,74 @@ func (h *OrderHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 	for rows.Next() {
 		var priceCents int
 		var quantity int
-		if err := rows.Scan(&priceCents, &quantity); err != nil {
+		var optionsCents int
+		if err := rows.Scan(&priceCents, &quantity, &optionsCents); err != nil {
 			http.Error(w, "Failed to calculate order totals", http.StatusInternalServerError)
 			return
 		}
-		subtotalCents += priceCents * quantity
+		subtotalCents += priceCents*quantity + optionsCents
 	}
-	
+
+	slotRule, err := slotPriceRuleFor(tx, pickupDate, req.PickupTimeSlot)
+	if err != nil {
+		http.Error(w, "Failed to price pickup slot", http.StatusInternalServerError)
+		return
+	}
+	slotAdjustmentCents := slotRule.adjustmentCents(subtotalCents)
+
+	// Add-ons are priced against the bags and subtotal above
+	if len(req.AddOnIDs) > 0 {
+		bagCount := 0
+		for _, item := range req.Items {
+			bagCount += item.Quantity
+		}
+		_, addOnSpan := StartSpan(ctx, "insertOrderAddOns")
+		addOnCents, err := insertOrderAddOns(tx, orderID, req.AddOnIDs, pickupZip, bagCount, subtotalCents)
+		addOnSpan.End(err)
+		if err == errUnknownAddOn || err == errAddOnUnavailable {
+			http.Error(w, fmt.Sprintf("Invalid add-ons: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to create order add-ons", http.StatusInternalServerError)
+			return
+		}
+		subtotalCents += addOnCents
+	}
+
+	// Peak or off-peak slot pricing scales the services and garments, not the add-ons
+	if slotRule != nil {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE orders
+			SET slot_price_rule_id = $1, slot_price_label = $2, slot_multiplier_percent = $3, slot_adjustment_cents = $4
+			WHERE id = $5`,
+			slotRule.ID, slotRule.Name, slotRule.MultiplierPercent, slotAdjustmentCents, orderID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to apply slot pricing", http.StatusInternalServerError)
+			return
+		}
+		subtotalCents += slotAdjustmentCents
+	}
+
+	if pickupArea.Zone != nil && pickupArea.surchargeCents > 0 {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE orders SET service_zone_name = $1, zone_surcharge_cents = $2 WHERE id = $3",
+			*pickupArea.Zone, pickupArea.surchargeCents, orderID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to apply zone surcharge", http.StatusInternalServerError)
+			return
+		}
+		subtotalCents += pickupArea.surchargeCents
+	}
+
 	tipCents := dollarsToCents(req.Tip)
 	// Note: tax will be calculated by Stripe automatically, so we store subtotal + tip for now
 	totalCents := subtotalCents + tipCents
 
 	// Update the order with subtotal and tip (tax will be handled by Stripe)
-	_, err = tx.Exec(`
+	_, err = tx.ExecContext(ctx, `
 		UPDATE orders 
 		SET subtotal_cents = $1, tip_cents = $2, total_cents = $3
 		WHERE id = $4`,
@@ -363,20 +570,71 @@ func (h *OrderHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Credit on the paying account covers the laundry; tips are still charged
+	_, creditSpan := StartSpan(ctx, "redeemCredits")
+	creditCents, err := redeemCredits(tx, billingUserID, orderID, subtotalCents)
+	creditSpan.End(err)
+	if err != nil {
+		http.Error(w, "Failed to apply account credit", http.StatusInternalServerError)
+		return
+	}
+
+	_, snapshotSpan := StartSpan(ctx, "captureOrderPricingSnapshot")
+	err = captureOrderPricingSnapshot(tx, orderID, creditCents)
+	snapshotSpan.End(err)
+	if err != nil {
+		http.Error(w, "Failed to record order pricing", http.StatusInternalServerError)
+		return
+	}
+
+	// Large orders wait for an admin before they're scheduled or charged
+	status, statusNotes := "scheduled", "Order created"
+	if threshold := orderReviewThresholdCents(); threshold > 0 && totalCents > threshold {
+		if err := holdOrderForReview(tx, orderID, totalCents, threshold); err != nil {
+			http.Error(w, "Failed to hold order for review", http.StatusInternalServerError)
+			return
+		}
+		status, statusNotes = "pending_review", "Order created; held for review"
+	}
+
+	// Add initial status history
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO order_status_history (order_id, status, notes, updated_by)
+		VALUES ($1, $2, $3, $4)`,
+		orderID, status, statusNotes, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to create status history", http.StatusInternalServerError)
+		return
+	}
+
 	// Commit transaction first to ensure order exists
 	if err := tx.Commit(); err != nil {
 		http.Error(w, "Failed to complete order creation", http.StatusInternalServerError)
 		return
 	}
 
-	// Process payment if there's a charge (after order is committed)
+	// The order now holds the slot itself
+	if holdToken != "" {
+		if err := h.slotHolds.Release(ctx, holdToken); err != nil {
+			log.Printf("Failed to release pickup slot hold for order %d: %v", orderID, err)
+		}
+	}
+
+	// Process payment if there's a charge (after order is committed). An
+	// order held for review is charged once it's approved.
 	var paymentIntentID *string
-	subtotalDollars := centsToDollars(subtotalCents)
-	tipDollars := centsToDollars(tipCents)
-	if subtotalCents > 0 || tipCents > 0 {
+	if status == "scheduled" && (subtotalCents > creditCents || tipCents > 0) {
 		// Create payment intent for the order (Stripe will calculate tax automatically)
-		paymentID, _, _, err := h.createOrderPaymentIntent(userID, orderID, subtotalDollars, tipDollars)
+		_, paymentSpan := StartSpan(ctx, "createOrderPaymentIntent")
+		paymentID, _, _, err := h.payments().CreateOrderPaymentIntent(billingUserID, orderID, subtotalCents, tipCents, creditCents)
+		paymentSpan.End(err)
 		if err != nil {
+			if creditCents > 0 {
+				if err := reverseOrderCredits(h.db, orderID, "Payment could not be set up"); err != nil {
+					log.Printf("Failed to restore credit for order %d: %v", orderID, err)
+				}
+			}
 			http.Error(w, fmt.Sprintf("Payment processing failed: %v", err), http.StatusPaymentRequired)
 			return
 		}
@@ -391,11 +649,11 @@ func (h *OrderHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 
 	// Send real-time notification
 	if h.realtime != nil {
-		go h.realtime.PublishOrderUpdate(
-			userID, orderID, "scheduled",
-			"Order created successfully",
-			nil,
-		)
+		message := "Order created successfully"
+		if status == "pending_review" {
+			message = orderStatusMessage(status)
+		}
+		go h.realtime.PublishOrderUpdate(userID, orderID, status, message, nil)
 	}
 
 	// Fetch the created order
@@ -408,7 +666,9 @@ func (h *OrderHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]interface{}{
 		"order": order,
-		"requires_payment": totalCents > 0,
+		"requires_payment": status == "scheduled" && totalCents > creditCents,
+		"credit_applied": centsToDollars(creditCents),
+		"pending_review": status == "pending_review",
 	}
 	
 	if paymentIntentID != nil {
@@ -419,98 +679,6 @@ func (h *OrderHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(response)
 }
 
-// createOrderPaymentIntent creates a Stripe payment intent for the order with automatic tax calculation
-func (h *OrderHandler) createOrderPaymentIntent(userID, orderID int, subtotal, tip float64) (string, float64, float64, error) {
-	// Initialize Stripe
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
-	
-	// Get or create Stripe customer ID
-	stripeCustomerID, err := h.getOrCreateStripeCustomer(userID)
-	if err != nil {
-		return "", 0, 0, fmt.Errorf("failed to get/create customer: %v", err)
-	}
-	
-	// Get order items from database to create proper line items
-	orderItems, err := h.getOrderItemsForStripe(orderID)
-	if err != nil {
-		return "", 0, 0, fmt.Errorf("failed to get order items: %v", err)
-	}
-	
-	// Create line items from actual order items
-	var lineItems []*stripe.CheckoutSessionLineItemParams
-	
-	for _, item := range orderItems {
-		// Get or create Stripe price for this service
-		priceID, err := h.getOrCreateStripePriceForService(item.ServiceName, item.Price)
-		if err != nil {
-			return "", 0, 0, fmt.Errorf("failed to create Stripe price for %s: %v", item.ServiceName, err)
-		}
-		
-		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
-			Price:    stripe.String(priceID),
-			Quantity: stripe.Int64(int64(item.Quantity)),
-		})
-	}
-	
-	// Add tip as a separate line item if there's a tip
-	// Use a single tip product with dynamic pricing to avoid duplicate products
-	if tip > 0 {
-		tipPriceID, err := h.getOrCreateTipPrice(tip)
-		if err != nil {
-			return "", 0, 0, fmt.Errorf("failed to create Stripe tip price: %v", err)
-		}
-		
-		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
-			Price:    stripe.String(tipPriceID),
-			Quantity: stripe.Int64(1),
-		})
-	}
-	
-	// Create checkout session with automatic tax
-	checkoutParams := &stripe.CheckoutSessionParams{
-		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
-		LineItems:          lineItems,
-		Mode:               stripe.String(string(stripe.CheckoutSessionModePayment)),
-		SuccessURL:         stripe.String("https://tumble.royer.app/dashboard/orders/" + strconv.Itoa(orderID) + "?success=true"),
-		CancelURL:          stripe.String("https://tumble.royer.app/dashboard/schedule?canceled=true"),
-		BillingAddressCollection: stripe.String("required"),
-		AutomaticTax: &stripe.CheckoutSessionAutomaticTaxParams{
-			Enabled: stripe.Bool(true),
-		},
-		Metadata: map[string]string{
-			"order_id": strconv.Itoa(orderID),
-			"user_id":  strconv.Itoa(userID),
-		},
-	}
-	
-	// Add customer if available
-	if stripeCustomerID != "" {
-		checkoutParams.Customer = stripe.String(stripeCustomerID)
-		// Customer address will be automatically populated from Stripe customer record
-	}
-	
-	checkoutSession, err := session.New(checkoutParams)
-	if err != nil {
-		return "", 0, 0, fmt.Errorf("failed to create checkout session: %v", err)
-	}
-	
-	// Log successful checkout session creation
-	fmt.Printf("Created checkout session %s with automatic tax enabled and customer %s\n", checkoutSession.ID, stripeCustomerID)
-	
-	// Store payment record in database (Stripe will calculate final amount with tax)
-	_, err = h.db.Exec(`
-		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id)
-		VALUES ($1, $2, $3, 'extra_order', 'pending', $4)
-	`, userID, orderID, dollarsToCents(subtotal + tip), checkoutSession.ID)
-	
-	if err != nil {
-		return "", 0, 0, fmt.Errorf("failed to record payment: %v", err)
-	}
-	
-	// Return checkout session URL - Stripe will calculate final tax and total automatically
-	return checkoutSession.URL, 0, subtotal + tip, nil
-}
-
 // handleGetOrders returns all orders for the authenticated user
 func (h *OrderHandler) handleGetOrders(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -548,9 +716,9 @@ func (h *OrderHandler) handleGetOrders(w http.ResponseWriter, r *http.Request) {
 			o.id, o.user_id, o.subscription_id, o.pickup_address_id, o.delivery_address_id,
 			o.status, o.total_weight, 
 			o.subtotal_cents, o.tax_cents, o.tip_cents, o.total_cents,
-			o.special_instructions,
+			o.special_instructions, o.delivery_instructions, o.instruction_template_id,
 			o.pickup_date, o.delivery_date, o.pickup_time_slot, o.delivery_time_slot,
-			o.created_at, o.updated_at
+			o.created_at, o.updated_at, o.billed_user_id
 		FROM orders o
 		WHERE o.user_id = $1`
 	
@@ -583,9 +751,10 @@ func (h *OrderHandler) handleGetOrders(w http.ResponseWriter, r *http.Request) {
 			&order.PickupAddressID, &order.DeliveryAddressID,
 			&order.Status, &order.TotalWeight, &subtotalCents,
 			&taxCents, &tipCents, &totalCents, &order.SpecialInstructions,
+			&order.DeliveryInstructions, &order.InstructionTemplateID,
 			&order.PickupDate, &order.DeliveryDate,
 			&order.PickupTimeSlot, &order.DeliveryTimeSlot,
-			&order.CreatedAt, &order.UpdatedAt,
+			&order.CreatedAt, &order.UpdatedAt, &order.BilledUserID,
 		)
 		if err != nil {
 			http.Error(w, "Failed to parse orders", http.StatusInternalServerError)
@@ -612,7 +781,8 @@ func (h *OrderHandler) handleGetOrders(w http.ResponseWriter, r *http.Request) {
 
 		// Fetch order items for each order
 		itemRows, err := h.db.Query(`
-			SELECT oi.id, oi.order_id, oi.service_id, s.name, oi.quantity, oi.weight, oi.price_cents, oi.notes
+			SELECT oi.id, oi.order_id, oi.service_id, s.name, oi.quantity, oi.weight, oi.price_cents, oi.notes,
+			       `+itemOptionColumns+`, oi.options_price_cents
 			FROM order_items oi
 			JOIN services s ON oi.service_id = s.id
 			WHERE oi.order_id = $1`,
@@ -622,14 +792,17 @@ func (h *OrderHandler) handleGetOrders(w http.ResponseWriter, r *http.Request) {
 			order.Items = []OrderItem{}
 			for itemRows.Next() {
 				var item OrderItem
-				var priceCents int
+				var priceCents, optionsCents int
+				var opts ItemOptions
 				err := itemRows.Scan(
 					&item.ID, &item.OrderID, &item.ServiceID, &item.ServiceName,
 					&item.Quantity, &item.Weight, &priceCents, &item.Notes,
+					&opts.Detergent, &opts.WaterTemperature, &opts.HangDry, &opts.FoldStyle, &opts.AllergySafe, &optionsCents,
 				)
 				if err == nil {
 					// Convert cents to dollars for JSON response
 					item.Price = centsToDollars(priceCents)
+					item.setOptions(opts, optionsCents)
 					order.Items = append(order.Items, item)
 				}
 			}
@@ -665,13 +838,9 @@ func (h *OrderHandler) handleGetOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	order, err := h.getOrderByID(orderID, userID)
+	order, err := h.orders().GetOrder(r.Context(), userID, orderID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Order not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
-		}
+		writeServiceError(w, err, "Failed to fetch order")
 		return
 	}
 
@@ -711,18 +880,15 @@ func (h *OrderHandler) handleUpdateOrderStatus(w http.ResponseWriter, r *http.Re
 	}
 
 	// Validate status
-	validStatuses := []string{"pending", "scheduled", "picked_up", "in_process", "ready", "out_for_delivery", "delivered", "cancelled"}
-	isValid := false
-	for _, s := range validStatuses {
-		if req.Status == s {
-			isValid = true
-			break
-		}
-	}
-	if !isValid {
+	if !isValidOrderStatus(req.Status) {
 		http.Error(w, "Invalid status", http.StatusBadRequest)
 		return
 	}
+	// Cancelling goes through the cancellation policy
+	if req.Status == "cancelled" {
+		http.Error(w, "Use POST /orders/{id}/cancel to cancel an order", http.StatusBadRequest)
+		return
+	}
 
 	// Begin transaction
 	tx, err := h.db.Begin()
@@ -732,8 +898,27 @@ func (h *OrderHandler) handleUpdateOrderStatus(w http.ResponseWriter, r *http.Re
 	}
 	defer tx.Rollback()
 
+	// Make sure the order exists and can move to the requested status
+	var currentStatus string
+	err = tx.QueryRow(
+		"SELECT status FROM orders WHERE id = $1 AND user_id = $2 FOR UPDATE",
+		orderID, userID,
+	).Scan(&currentStatus)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if !canTransitionOrderStatus(currentStatus, req.Status) {
+		http.Error(w, fmt.Sprintf("Cannot change order status from %s to %s", currentStatus, req.Status), http.StatusConflict)
+		return
+	}
+
 	// Update order status
-	result, err := tx.Exec(`
+	_, err = tx.Exec(`
 		UPDATE orders 
 		SET status = $1, updated_at = CURRENT_TIMESTAMP
 		WHERE id = $2 AND user_id = $3`,
@@ -744,12 +929,6 @@ func (h *OrderHandler) handleUpdateOrderStatus(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		http.Error(w, "Order not found", http.StatusNotFound)
-		return
-	}
-
 	// Add status history
 	_, err = tx.Exec(`
 		INSERT INTO order_status_history (order_id, status, notes, updated_by)
@@ -769,22 +948,7 @@ func (h *OrderHandler) handleUpdateOrderStatus(w http.ResponseWriter, r *http.Re
 
 	// Send real-time notification for status change
 	if h.realtime != nil {
-		statusMessages := map[string]string{
-			"scheduled":        "Order scheduled for pickup",
-			"picked_up":        "Laundry picked up by driver",
-			"in_process":       "Laundry being processed",
-			"ready":            "Laundry ready for delivery",
-			"out_for_delivery": "Out for delivery",
-			"delivered":        "Delivered successfully",
-			"cancelled":        "Order cancelled",
-		}
-		
-		message := statusMessages[req.Status]
-		if message == "" {
-			message = "Order status updated"
-		}
-		
-		go h.realtime.PublishOrderUpdate(userID, orderID, req.Status, message, nil)
+		go h.realtime.PublishOrderUpdate(userID, orderID, req.Status, orderStatusMessage(req.Status), nil)
 		
 		// Send special notifications for certain statuses
 		if req.Status == "delivered" {
@@ -803,26 +967,42 @@ func (h *OrderHandler) handleUpdateOrderStatus(w http.ResponseWriter, r *http.Re
 	json.NewEncoder(w).Encode(order)
 }
 
-// getOrderByID fetches a complete order with items and status history
+// getOrderByID fetches a complete order with items and status history,
+// as long as it belongs to the user
 func (h *OrderHandler) getOrderByID(orderID, userID int) (*Order, error) {
+	order, err := getOrder(h.db, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.UserID != userID {
+		return nil, sql.ErrNoRows
+	}
+	return order, nil
+}
+
+// getOrder fetches a complete order with items and status history
+func getOrder(db *sql.DB, orderID int) (*Order, error) {
 	var order Order
 	var subtotalCents, taxCents, tipCents, totalCents sql.NullInt64
-	err := h.db.QueryRow(`
+	var overweightCents int
+	err := db.QueryRow(`
 		SELECT id, user_id, subscription_id, pickup_address_id, delivery_address_id,
-			   status, total_weight, subtotal_cents, tax_cents, tip_cents, total_cents, special_instructions,
+			   status, total_weight, subtotal_cents, tax_cents, tip_cents, total_cents, overweight_cents, special_instructions,
+			   delivery_instructions, instruction_template_id,
 			   pickup_date, delivery_date, pickup_time_slot, delivery_time_slot,
-			   created_at, updated_at
+			   created_at, updated_at, billed_user_id
 		FROM orders
-		WHERE id = $1 AND user_id = $2`,
-		orderID, userID,
+		WHERE id = $1`,
+		orderID,
 	).Scan(
 		&order.ID, &order.UserID, &order.SubscriptionID,
 		&order.PickupAddressID, &order.DeliveryAddressID,
 		&order.Status, &order.TotalWeight, &subtotalCents,
-		&taxCents, &tipCents, &totalCents, &order.SpecialInstructions,
+		&taxCents, &tipCents, &totalCents, &overweightCents, &order.SpecialInstructions,
+		&order.DeliveryInstructions, &order.InstructionTemplateID,
 		&order.PickupDate, &order.DeliveryDate,
 		&order.PickupTimeSlot, &order.DeliveryTimeSlot,
-		&order.CreatedAt, &order.UpdatedAt,
+		&order.CreatedAt, &order.UpdatedAt, &order.BilledUserID,
 	)
 	if err != nil {
 		return nil, err
@@ -845,10 +1025,12 @@ func (h *OrderHandler) getOrderByID(orderID, userID int) (*Order, error) {
 		total := centsToDollars(int(totalCents.Int64))
 		order.Total = &total
 	}
+	order.OverweightCharge = centsToDollars(overweightCents)
 
 	// Fetch order items
-	itemRows, err := h.db.Query(`
-		SELECT oi.id, oi.order_id, oi.service_id, s.name, oi.quantity, oi.weight, oi.price_cents, oi.notes
+	itemRows, err := db.Query(`
+		SELECT oi.id, oi.order_id, oi.service_id, s.name, oi.quantity, oi.weight, oi.price_cents, oi.notes,
+		       `+itemOptionColumns+`, oi.options_price_cents
 		FROM order_items oi
 		JOIN services s ON oi.service_id = s.id
 		WHERE oi.order_id = $1`,
@@ -862,21 +1044,24 @@ func (h *OrderHandler) getOrderByID(orderID, userID int) (*Order, error) {
 	order.Items = []OrderItem{}
 	for itemRows.Next() {
 		var item OrderItem
-		var priceCents int
+		var priceCents, optionsCents int
+		var opts ItemOptions
 		err := itemRows.Scan(
 			&item.ID, &item.OrderID, &item.ServiceID, &item.ServiceName,
 			&item.Quantity, &item.Weight, &priceCents, &item.Notes,
+			&opts.Detergent, &opts.WaterTemperature, &opts.HangDry, &opts.FoldStyle, &opts.AllergySafe, &optionsCents,
 		)
 		if err != nil {
 			return nil, err
 		}
 		// Convert cents to dollars for JSON response
 		item.Price = centsToDollars(priceCents)
+		item.setOptions(opts, optionsCents)
 		order.Items = append(order.Items, item)
 	}
 
 	// Fetch status history
-	statusRows, err := h.db.Query(`
+	statusRows, err := db.Query(`
 		SELECT id, order_id, status, notes, updated_by, created_at
 		FROM order_status_history
 		WHERE order_id = $1
@@ -901,137 +1086,40 @@ func (h *OrderHandler) getOrderByID(orderID, userID int) (*Order, error) {
 		order.StatusHistory = append(order.StatusHistory, status)
 	}
 
-	return &order, nil
-}
-
-// getOrCreateStripeProduct creates or retrieves a Stripe product for laundry services
-func (h *OrderHandler) getOrCreateStripeProduct(name, description string) (string, error) {
-	// Create product
-	productParams := &stripe.ProductParams{
-		Name: stripe.String(name),
-		Description: stripe.String(description),
-		Type: stripe.String("service"),
-	}
-	
-	prod, err := product.New(productParams)
+	order.Garments, err = getOrderGarments(db, orderID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return prod.ID, nil
-}
-
-// getOrderItemsForStripe gets order items with their details for Stripe checkout
-func (h *OrderHandler) getOrderItemsForStripe(orderID int) ([]struct {
-	ServiceName string
-	Quantity    int
-	Price       float64
-}, error) {
-	rows, err := h.db.Query(`
-		SELECT s.description, oi.quantity, oi.price_cents
-		FROM order_items oi
-		JOIN services s ON oi.service_id = s.id
-		WHERE oi.order_id = $1 AND oi.price_cents > 0`,
-		orderID,
-	)
+	order.AddOns, err = getOrderAddOns(db, orderID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var items []struct {
-		ServiceName string
-		Quantity    int
-		Price       float64
-	}
 
-	for rows.Next() {
-		var item struct {
-			ServiceName string
-			Quantity    int
-			Price       float64
-		}
-		var priceCents int
-		err := rows.Scan(&item.ServiceName, &item.Quantity, &priceCents)
-		if err != nil {
-			return nil, err
-		}
-		item.Price = centsToDollars(priceCents)
-		items = append(items, item)
+	order.SlotAdjustment, err = getOrderSlotAdjustment(db, orderID)
+	if err != nil {
+		return nil, err
 	}
 
-	return items, nil
-}
-
-// getOrCreateStripePriceForService creates a Stripe price for a specific service and amount
-func (h *OrderHandler) getOrCreateStripePriceForService(serviceName string, amount float64) (string, error) {
-	// Service name is already the description from the query, so use it directly
-	productName := "Tumble " + serviceName
-	amountCents := int64(math.Round(amount * 100))
-	
-	// Use metadata to find existing products reliably
-	serviceKey := serviceName // Use service name as unique key
-	productSearchParams := &stripe.ProductSearchParams{
-		SearchParams: stripe.SearchParams{
-			Query: `metadata["service_key"]:"` + serviceKey + `"`,
-			Limit: stripe.Int64(1),
-		},
-	}
-	
-	searchResult := product.Search(productSearchParams)
-	var prod *stripe.Product
-	
-	// If product exists, use it
-	if searchResult.Next() {
-		prod = searchResult.Product()
-	} else {
-		// Create new product with metadata for reliable identification
-		productParams := &stripe.ProductParams{
-			Name:    stripe.String(productName),
-			TaxCode: stripe.String("txcd_20090012"), // Linen Services - Laundry only
-			Metadata: map[string]string{
-				"service_key": serviceKey,
-				"type":        "tumble_service",
-			},
-		}
-		
-		var err error
-		prod, err = product.New(productParams)
-		if err != nil {
-			return "", err
-		}
+	order.ZoneSurcharge, err = getOrderZoneSurcharge(db, orderID)
+	if err != nil {
+		return nil, err
 	}
 
-	// Look for existing price with the same amount using List API
-	priceListParams := &stripe.PriceListParams{
-		Product: stripe.String(prod.ID),
+	pricing, err := getOrderPricingSnapshot(db, orderID)
+	if err != nil {
+		return nil, err
 	}
-	priceListParams.Limit = stripe.Int64(10) // List a few prices to find matching amount
-	
-	priceList := price.List(priceListParams)
-	
-	// Check if any existing price has the same amount
-	for priceList.Next() {
-		existingPrice := priceList.Price()
-		if existingPrice.UnitAmount == amountCents {
-			return existingPrice.ID, nil
-		}
+	if pricing != nil {
+		pricing.applyTo(&order)
 	}
 
-	// Create new price
-	priceParams := &stripe.PriceParams{
-		Product:     stripe.String(prod.ID),
-		UnitAmount:  stripe.Int64(amountCents),
-		Currency:    stripe.String("usd"),
-		TaxBehavior: stripe.String("exclusive"), // Tax is calculated on top of the price
-	}
-
-	p, err := price.New(priceParams)
+	order.Locker, err = getOrderLocker(db, orderID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return p.ID, nil
+	return &order, nil
 }
 
 // handleGetOrderTracking returns real-time tracking info for an order
@@ -1129,177 +1217,26 @@ func (h *OrderHandler) handleGetOrderTracking(w http.ResponseWriter, r *http.Req
 		"trackingEvents": events,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-// getOrCreateStripeCustomer creates or retrieves a Stripe customer for the user
-func (h *OrderHandler) getOrCreateStripeCustomer(userID int) (string, error) {
-	// Check if customer already exists
-	var stripeCustomerID sql.NullString
-	var email, firstName, lastName string
-	
-	err := h.db.QueryRow(`
-		SELECT stripe_customer_id, email, first_name, last_name 
-		FROM users WHERE id = $1
-	`, userID).Scan(&stripeCustomerID, &email, &firstName, &lastName)
-	
+	// Photos the drivers took at pickup and delivery
+	photos, err := orderStopPhotos(r.Context(), h.db, h.fileStore, orderID)
 	if err != nil {
-		return "", fmt.Errorf("error querying user %d from database: %v", userID, err)
-	}
-
-	// If customer exists, check if it has an address and update if needed
-	if stripeCustomerID.Valid && stripeCustomerID.String != "" {
-		// Get user's default address
-		var streetAddress, city, state, zipCode sql.NullString
-		err = h.db.QueryRow(`
-			SELECT street_address, city, state, zip_code 
-			FROM addresses 
-			WHERE user_id = $1 AND is_default = true
-			LIMIT 1
-		`, userID).Scan(&streetAddress, &city, &state, &zipCode)
-		
-		// If we have a valid address, try to update the existing Stripe customer
-		if err == nil && streetAddress.Valid && city.Valid && state.Valid && zipCode.Valid {
-			updateParams := &stripe.CustomerParams{
-				Address: &stripe.AddressParams{
-					Line1:      stripe.String(streetAddress.String),
-					City:       stripe.String(city.String),
-					State:      stripe.String(state.String),
-					PostalCode: stripe.String(zipCode.String),
-					Country:    stripe.String("US"),
-				},
-			}
-			_, updateErr := customer.Update(stripeCustomerID.String, updateParams)
-			if updateErr != nil {
-				// Customer doesn't exist in Stripe, clear the stale ID and create new one
-				h.db.Exec("UPDATE users SET stripe_customer_id = NULL WHERE id = $1", userID)
-				// Fall through to create new customer
-			} else {
-				return stripeCustomerID.String, nil
-			}
-		} else {
-			// Try to verify customer exists by fetching it
-			_, fetchErr := customer.Get(stripeCustomerID.String, nil)
-			if fetchErr != nil {
-				// Customer doesn't exist, clear stale ID and create new one
-				h.db.Exec("UPDATE users SET stripe_customer_id = NULL WHERE id = $1", userID)
-				// Fall through to create new customer
-			} else {
-				return stripeCustomerID.String, nil
-			}
+		log.Printf("Failed to fetch stop photos for order %d: %v", orderID, err)
+	} else {
+		// Quality flags are for drivers and admins
+		for i := range photos {
+			photos[i].QualityIssues = nil
 		}
+		response["photos"] = photos
 	}
 
-	// Get user's default address for new customer creation
-	var streetAddress, city, state, zipCode sql.NullString
-	err = h.db.QueryRow(`
-		SELECT street_address, city, state, zip_code 
-		FROM addresses 
-		WHERE user_id = $1 AND is_default = true
-		LIMIT 1
-	`, userID).Scan(&streetAddress, &city, &state, &zipCode)
-
-	// Check if user has a valid default address
-	if err == sql.ErrNoRows || !streetAddress.Valid || !city.Valid || !state.Valid || !zipCode.Valid {
-		return "", fmt.Errorf("no_default_address")
-	}
-
-	// Create new Stripe customer with address for tax calculation
-	params := &stripe.CustomerParams{
-		Email: stripe.String(email),
-		Name:  stripe.String(firstName + " " + lastName),
-		Address: &stripe.AddressParams{
-			Line1:      stripe.String(streetAddress.String),
-			City:       stripe.String(city.String),
-			State:      stripe.String(state.String),
-			PostalCode: stripe.String(zipCode.String),
-			Country:    stripe.String("US"),
-		},
-		Metadata: map[string]string{
-			"user_id": strconv.Itoa(userID),
-		},
-	}
-
-	c, err := customer.New(params)
-	if err != nil {
-		return "", fmt.Errorf("error creating Stripe customer for user %d: %v", userID, err)
-	}
-
-	// Save Stripe customer ID
-	_, err = h.db.Exec(`
-		UPDATE users SET stripe_customer_id = $1 WHERE id = $2
-	`, c.ID, userID)
-	
+	// Live position of the driver on the way, pushed over the order channel after this
+	driverLocation, err := driverLocationForOrder(r.Context(), h.db, h.driverLocations, orderID)
 	if err != nil {
-		return "", err
+		log.Printf("Failed to fetch driver location for order %d: %v", orderID, err)
+	} else if driverLocation != nil {
+		response["driverLocation"] = driverLocation
 	}
 
-	return c.ID, nil
-}
-
-// getOrCreateTipPrice creates a one-time price for tips, reusing a single tip product
-func (h *OrderHandler) getOrCreateTipPrice(tipAmount float64) (string, error) {
-	tipAmountCents := int64(math.Round(tipAmount * 100))
-	
-	// Get or create a single "Driver Tip" product 
-	tipProductID, err := h.getOrCreateTipProduct()
-	if err != nil {
-		return "", err
-	}
-	
-	// Create a one-time price for this specific tip amount
-	// We don't need to search for existing tip prices since tips are usually unique amounts
-	priceParams := &stripe.PriceParams{
-		Product:     stripe.String(tipProductID),
-		UnitAmount:  stripe.Int64(tipAmountCents),
-		Currency:    stripe.String("usd"),
-		TaxBehavior: stripe.String("inclusive"), // Tips are usually not taxed
-		Metadata: map[string]string{
-			"type": "driver_tip",
-		},
-	}
-
-	p, err := price.New(priceParams)
-	if err != nil {
-		return "", err
-	}
-	
-	return p.ID, nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
-
-// getOrCreateTipProduct gets or creates a single reusable "Driver Tip" product
-func (h *OrderHandler) getOrCreateTipProduct() (string, error) {
-	// Search for existing tip product using metadata
-	productSearchParams := &stripe.ProductSearchParams{
-		SearchParams: stripe.SearchParams{
-			Query: `metadata["type"]:"driver_tip"`,
-			Limit: stripe.Int64(1),
-		},
-	}
-	
-	searchResult := product.Search(productSearchParams)
-	
-	// If tip product exists, use it
-	if searchResult.Next() {
-		prod := searchResult.Product()
-		return prod.ID, nil
-	}
-	
-	// Create single tip product that can be reused with different prices
-	productParams := &stripe.ProductParams{
-		Name:        stripe.String("Driver Tip"),
-		Description: stripe.String("Gratuity for Tumble drivers"),
-		Metadata: map[string]string{
-			"type": "driver_tip",
-		},
-		// Tips usually don't have tax codes since they're gratuity
-	}
-	
-	prod, err := product.New(productParams)
-	if err != nil {
-		return "", err
-	}
-	
-	return prod.ID, nil
-}
\ No newline at end of file
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/paymentmethod"
+)
+
+// maxStoredPaymentMethods caps how many distinct cards an account keeps on
+// file (MAX_STORED_PAYMENT_METHODS)
+func maxStoredPaymentMethods() int {
+	if max, err := strconv.Atoi(os.Getenv("MAX_STORED_PAYMENT_METHODS")); err == nil && max > 0 {
+		return max
+	}
+	return 5
+}
+
+var errPaymentMethodLimit = errors.New("payment method limit reached")
+
+func paymentMethodLimitMessage() string {
+	return fmt.Sprintf("You can store up to %d payment methods. Remove one before adding another.", maxStoredPaymentMethods())
+}
+
+// cardFingerprint identifies the physical card behind a payment method.
+// Stripe gives every copy of the same card number the same fingerprint.
+func cardFingerprint(pm *stripe.PaymentMethod) string {
+	if pm.Card == nil || pm.Card.Fingerprint == "" {
+		return pm.ID // Nothing to match on, so it counts as its own card
+	}
+	return pm.Card.Fingerprint
+}
+
+// dedupeCards keeps one payment method per card, in the order given. The
+// default method wins when it's one of the copies; otherwise the first copy
+// does, which is the newest since Stripe lists newest first.
+func dedupeCards(methods []*stripe.PaymentMethod, defaultID string) (kept, duplicates []*stripe.PaymentMethod) {
+	chosen := map[string]*stripe.PaymentMethod{}
+	for _, pm := range methods {
+		fingerprint := cardFingerprint(pm)
+		if _, ok := chosen[fingerprint]; !ok || pm.ID == defaultID {
+			chosen[fingerprint] = pm
+		}
+	}
+	for _, pm := range methods {
+		if chosen[cardFingerprint(pm)] == pm {
+			kept = append(kept, pm)
+		} else {
+			duplicates = append(duplicates, pm)
+		}
+	}
+	return kept, duplicates
+}
+
+// storedCard returns the stored copy of the card behind pm, if there is one
+func storedCard(stored []*stripe.PaymentMethod, pm *stripe.PaymentMethod) *stripe.PaymentMethod {
+	fingerprint := cardFingerprint(pm)
+	for _, existing := range stored {
+		if existing.ID == pm.ID || cardFingerprint(existing) == fingerprint {
+			return existing
+		}
+	}
+	return nil
+}
+
+func listCardPaymentMethods(customerID string) ([]*stripe.PaymentMethod, error) {
+	i := paymentmethod.List(&stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+		Type:     stripe.String(string(stripe.PaymentMethodTypeCard)),
+	})
+	methods := []*stripe.PaymentMethod{}
+	for i.Next() {
+		methods = append(methods, i.PaymentMethod())
+	}
+	return methods, i.Err()
+}
+
+// checkRoomForPaymentMethod returns errPaymentMethodLimit when the customer
+// already has as many distinct cards as they're allowed
+func checkRoomForPaymentMethod(customerID string) error {
+	stored, err := listCardPaymentMethods(customerID)
+	if err != nil {
+		return err
+	}
+	kept, _ := dedupeCards(stored, "")
+	if len(kept) >= maxStoredPaymentMethods() {
+		return errPaymentMethodLimit
+	}
+	return nil
+}
+
+// resolvePaymentMethodForAttach is called before a card the customer just
+// entered is attached. If the same card is already on file its stored copy
+// is returned instead; otherwise the new card is returned if there's room.
+// attach is false when the returned method already belongs to the customer.
+func resolvePaymentMethodForAttach(customerID, paymentMethodID string) (id string, attach bool, err error) {
+	pm, err := paymentmethod.Get(paymentMethodID, nil)
+	if err != nil {
+		return "", false, err
+	}
+	if pm.Customer != nil && pm.Customer.ID == customerID {
+		return pm.ID, false, nil
+	}
+
+	stored, err := listCardPaymentMethods(customerID)
+	if err != nil {
+		return "", false, err
+	}
+	if existing := storedCard(stored, pm); existing != nil {
+		return existing.ID, false, nil
+	}
+	kept, _ := dedupeCards(stored, "")
+	if len(kept) >= maxStoredPaymentMethods() {
+		return "", false, errPaymentMethodLimit
+	}
+	return pm.ID, true, nil
+}
+
+// collapseDuplicatePaymentMethods detaches extra copies of cards a customer
+// saved more than once, keeping their default. Cards saved past the limit,
+// e.g. by two setup intents racing, are detached too.
+func (h *PaymentHandler) collapseDuplicatePaymentMethods(customerID, newPaymentMethodID string) error {
+	var userID int
+	var defaultID string
+	err := h.db.QueryRow(
+		"SELECT id, COALESCE(default_payment_method_id, '') FROM users WHERE stripe_customer_id = $1",
+		customerID,
+	).Scan(&userID, &defaultID)
+	if err != nil {
+		return err
+	}
+
+	stored, err := listCardPaymentMethods(customerID)
+	if err != nil {
+		return err
+	}
+	kept, duplicates := dedupeCards(stored, defaultID)
+	if len(kept) > maxStoredPaymentMethods() {
+		for _, pm := range kept {
+			if pm.ID == newPaymentMethodID {
+				duplicates = append(duplicates, pm)
+			}
+		}
+	}
+
+	for _, pm := range duplicates {
+		if _, err := paymentmethod.Detach(pm.ID, nil); err != nil {
+			return err
+		}
+		log.Printf("Detached duplicate payment method %s for user %d", pm.ID, userID)
+	}
+	return nil
+}
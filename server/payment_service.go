@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/checkout/session"
+	"github.com/stripe/stripe-go/v82/coupon"
+	"github.com/stripe/stripe-go/v82/customer"
+	"github.com/stripe/stripe-go/v82/price"
+	"github.com/stripe/stripe-go/v82/product"
+)
+
+// PaymentService is the payment operations handlers and other surfaces
+// share: charging orders through Stripe Checkout and refunding them
+type PaymentService struct {
+	db    *sql.DB
+	users UserRepo
+}
+
+func NewPaymentService(db *sql.DB, users UserRepo) *PaymentService {
+	return &PaymentService{db: db, users: users}
+}
+
+// payments returns the service behind the handler's checkouts
+func (h *OrderHandler) payments() *PaymentService {
+	return NewPaymentService(h.db, h.users())
+}
+
+// payments returns the service behind the handler's refunds
+func (h *AdminHandler) payments() *PaymentService {
+	return NewPaymentService(h.db, pgUserRepo{db: h.db})
+}
+
+// RefundOrder refunds amountCents of an order's payment, or all that's left
+// of it when amountCents is 0. The refund is reserved before it's sent so
+// two refunds can't both take the same money. A refund Stripe turns down is
+// returned with status failed rather than as an error.
+func (s *PaymentService) RefundOrder(ctx context.Context, orderID, amountCents int, reason string, createdBy *int) (*Refund, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	refundID, _, err := reserveRefund(tx, orderID, amountCents, reason, createdBy, nil)
+	if err == errNoRefundablePayment || err == errRefundTooLarge {
+		return nil, serviceError(ErrConflict, "%s", err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return submitRefund(s.db, refundID)
+}
+
+// CreateOrderPaymentIntent creates a Stripe payment intent for the order with automatic tax calculation
+// Amounts are in cents, as are the tax and total it returns. creditCents of
+// account credit is taken off as a one-time coupon.
+func (s *PaymentService) CreateOrderPaymentIntent(userID, orderID int, subtotalCents, tipCents, creditCents int) (string, int, int, error) {
+	// Sandbox orders never reach Stripe; they're paid on the spot
+	sandbox, err := isSandboxOrder(s.db, orderID)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to get order: %v", err)
+	}
+	if sandbox {
+		if _, err := recordSandboxPayment(s.db, userID, orderID, subtotalCents+tipCents-creditCents); err != nil {
+			return "", 0, 0, fmt.Errorf("failed to record payment: %v", err)
+		}
+		return sandboxCheckoutURL(orderID), 0, subtotalCents + tipCents - creditCents, nil
+	}
+
+	// Initialize Stripe
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+	// Get or create Stripe customer ID
+	stripeCustomerID, err := s.getOrCreateStripeCustomer(userID)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to get/create customer: %v", err)
+	}
+
+	// Get order items from database to create proper line items
+	orderItems, err := s.getOrderItemsForStripe(orderID)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to get order items: %v", err)
+	}
+
+	// Create line items from actual order items
+	var lineItems []*stripe.CheckoutSessionLineItemParams
+
+	for _, item := range orderItems {
+		// Get or create Stripe price for this service
+		priceID, err := s.getOrCreateStripePriceForService(item.ServiceName, item.PriceCents)
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("failed to create Stripe price for %s: %v", item.ServiceName, err)
+		}
+
+		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
+			Price:    stripe.String(priceID),
+			Quantity: stripe.Int64(int64(item.Quantity)),
+		})
+	}
+
+	// Add tip as a separate line item if there's a tip
+	// Use a single tip product with dynamic pricing to avoid duplicate products
+	if tipCents > 0 {
+		tipPriceID, err := s.getOrCreateTipPrice(tipCents)
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("failed to create Stripe tip price: %v", err)
+		}
+
+		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
+			Price:    stripe.String(tipPriceID),
+			Quantity: stripe.Int64(1),
+		})
+	}
+
+	// Create checkout session with automatic tax
+	checkoutParams := &stripe.CheckoutSessionParams{
+		PaymentMethodTypes:       stripe.StringSlice([]string{"card"}),
+		LineItems:                lineItems,
+		Mode:                     stripe.String(string(stripe.CheckoutSessionModePayment)),
+		SuccessURL:               stripe.String("https://tumble.royer.app/dashboard/orders/" + strconv.Itoa(orderID) + "?success=true"),
+		CancelURL:                stripe.String("https://tumble.royer.app/dashboard/schedule?canceled=true"),
+		BillingAddressCollection: stripe.String("required"),
+		AutomaticTax: &stripe.CheckoutSessionAutomaticTaxParams{
+			Enabled: stripe.Bool(true),
+		},
+		Metadata: map[string]string{
+			"order_id": strconv.Itoa(orderID),
+			"user_id":  strconv.Itoa(userID),
+		},
+	}
+
+	// Off-peak slot discounts can't be a negative line item, so they ride
+	// along on the same one-time coupon as account credit
+	var slotDiscountCents int
+	var slotLabel sql.NullString
+	err = s.db.QueryRow(`
+		SELECT -LEAST(slot_adjustment_cents, 0), slot_price_label FROM orders WHERE id = $1`,
+		orderID,
+	).Scan(&slotDiscountCents, &slotLabel)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to get slot pricing: %v", err)
+	}
+
+	if discountCents := creditCents + slotDiscountCents; discountCents > 0 {
+		couponName := "Tumble account credit"
+		if slotDiscountCents > 0 && creditCents > 0 {
+			couponName = slotLabel.String + " + account credit"
+		} else if slotDiscountCents > 0 {
+			couponName = slotLabel.String
+		}
+		c, err := coupon.New(&stripe.CouponParams{
+			AmountOff:      stripe.Int64(int64(discountCents)),
+			Currency:       stripe.String(string(stripe.CurrencyUSD)),
+			Duration:       stripe.String(string(stripe.CouponDurationOnce)),
+			MaxRedemptions: stripe.Int64(1),
+			Name:           stripe.String(couponName),
+		})
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("failed to apply account credit: %v", err)
+		}
+		checkoutParams.Discounts = []*stripe.CheckoutSessionDiscountParams{{Coupon: stripe.String(c.ID)}}
+	}
+
+	// Add customer if available
+	if stripeCustomerID != "" {
+		checkoutParams.Customer = stripe.String(stripeCustomerID)
+		// Customer address will be automatically populated from Stripe customer record
+	}
+
+	checkoutSession, err := session.New(checkoutParams)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to create checkout session: %v", err)
+	}
+
+	// Log successful checkout session creation
+	fmt.Printf("Created checkout session %s with automatic tax enabled and customer %s\n", checkoutSession.ID, stripeCustomerID)
+
+	// Store payment record in database (Stripe will calculate final amount with tax)
+	_, err = s.db.Exec(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id)
+		VALUES ($1, $2, $3, 'extra_order', 'pending', $4)
+	`, userID, orderID, subtotalCents+tipCents-creditCents, checkoutSession.ID)
+
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to record payment: %v", err)
+	}
+
+	// Return checkout session URL - Stripe will calculate final tax and total automatically
+	return checkoutSession.URL, 0, subtotalCents + tipCents - creditCents, nil
+}
+
+// getOrCreateStripeProduct creates or retrieves a Stripe product for laundry services
+func (s *PaymentService) getOrCreateStripeProduct(name, description string) (string, error) {
+	// Create product
+	productParams := &stripe.ProductParams{
+		Name:        stripe.String(name),
+		Description: stripe.String(description),
+		Type:        stripe.String("service"),
+	}
+
+	prod, err := product.New(productParams)
+	if err != nil {
+		return "", err
+	}
+
+	return prod.ID, nil
+}
+
+// getOrderItemsForStripe gets order items with their details for Stripe checkout
+func (s *PaymentService) getOrderItemsForStripe(orderID int) ([]struct {
+	ServiceName string
+	Quantity    int
+	PriceCents  int
+}, error) {
+	rows, err := s.db.Query(`
+		SELECT s.description, oi.quantity, oi.price_cents
+		FROM order_items oi
+		JOIN services s ON oi.service_id = s.id
+		WHERE oi.order_id = $1 AND oi.price_cents > 0
+		UNION ALL
+		SELECT s.description || ' - laundry options', 1, oi.options_price_cents
+		FROM order_items oi
+		JOIN services s ON oi.service_id = s.id
+		WHERE oi.order_id = $1 AND oi.options_price_cents > 0
+		UNION ALL
+		SELECT 'Dry Cleaning - ' || gt.display_name, og.quantity, og.unit_price_cents
+		FROM order_garments og
+		JOIN garment_types gt ON og.garment_type_id = gt.id
+		WHERE og.order_id = $1 AND og.unit_price_cents > 0 AND NOT og.added_at_pickup
+		UNION ALL
+		SELECT sa.display_name, oa.quantity, oa.unit_price_cents
+		FROM order_add_ons oa
+		JOIN service_add_ons sa ON oa.add_on_id = sa.id
+		WHERE oa.order_id = $1 AND oa.unit_price_cents > 0
+		UNION ALL
+		SELECT slot_price_label, 1, slot_adjustment_cents
+		FROM orders
+		WHERE id = $1 AND slot_adjustment_cents > 0
+		UNION ALL
+		SELECT service_zone_name || ' service area', 1, zone_surcharge_cents
+		FROM orders
+		WHERE id = $1 AND zone_surcharge_cents > 0
+		UNION ALL
+		SELECT 'Overweight bags', 1, overweight_cents
+		FROM orders
+		WHERE id = $1 AND overweight_cents > 0`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []struct {
+		ServiceName string
+		Quantity    int
+		PriceCents  int
+	}
+
+	for rows.Next() {
+		var item struct {
+			ServiceName string
+			Quantity    int
+			PriceCents  int
+		}
+		err := rows.Scan(&item.ServiceName, &item.Quantity, &item.PriceCents)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// getOrCreateStripePriceForService creates a Stripe price for a specific service and amount in cents
+func (s *PaymentService) getOrCreateStripePriceForService(serviceName string, priceCents int) (string, error) {
+	// Service name is already the description from the query, so use it directly
+	productName := "Tumble " + serviceName
+	amountCents := int64(priceCents)
+
+	// Use metadata to find existing products reliably
+	serviceKey := serviceName // Use service name as unique key
+	productSearchParams := &stripe.ProductSearchParams{
+		SearchParams: stripe.SearchParams{
+			Query: `metadata["service_key"]:"` + serviceKey + `"`,
+			Limit: stripe.Int64(1),
+		},
+	}
+
+	searchResult := product.Search(productSearchParams)
+	var prod *stripe.Product
+
+	// If product exists, use it
+	if searchResult.Next() {
+		prod = searchResult.Product()
+	} else {
+		// Create new product with metadata for reliable identification
+		productParams := &stripe.ProductParams{
+			Name:    stripe.String(productName),
+			TaxCode: stripe.String("txcd_20090012"), // Linen Services - Laundry only
+			Metadata: map[string]string{
+				"service_key": serviceKey,
+				"type":        "tumble_service",
+			},
+		}
+
+		var err error
+		prod, err = product.New(productParams)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Look for existing price with the same amount using List API
+	priceListParams := &stripe.PriceListParams{
+		Product: stripe.String(prod.ID),
+	}
+	priceListParams.Limit = stripe.Int64(10) // List a few prices to find matching amount
+
+	priceList := price.List(priceListParams)
+
+	// Check if any existing price has the same amount
+	for priceList.Next() {
+		existingPrice := priceList.Price()
+		if existingPrice.UnitAmount == amountCents {
+			return existingPrice.ID, nil
+		}
+	}
+
+	// Create new price
+	priceParams := &stripe.PriceParams{
+		Product:     stripe.String(prod.ID),
+		UnitAmount:  stripe.Int64(amountCents),
+		Currency:    stripe.String("usd"),
+		TaxBehavior: stripe.String("exclusive"), // Tax is calculated on top of the price
+	}
+
+	p, err := price.New(priceParams)
+	if err != nil {
+		return "", err
+	}
+
+	return p.ID, nil
+}
+
+// getOrCreateStripeCustomer creates or retrieves a Stripe customer for the user
+func (s *PaymentService) getOrCreateStripeCustomer(userID int) (string, error) {
+	ctx := context.Background()
+	users := s.users
+	user, err := users.Get(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("error querying user %d from database: %v", userID, err)
+	}
+	// Check if customer already exists
+	stripeCustomerID, err := users.StripeCustomerID(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("error querying user %d from database: %v", userID, err)
+	}
+
+	// If customer exists, check if it has an address and update if needed
+	if stripeCustomerID != "" {
+		// Get user's default address
+		var streetAddress, city, state, zipCode sql.NullString
+		err = s.db.QueryRow(`
+			SELECT street_address, city, state, zip_code 
+			FROM addresses 
+			WHERE user_id = $1 AND is_default = true
+			LIMIT 1
+		`, userID).Scan(&streetAddress, &city, &state, &zipCode)
+
+		// If we have a valid address, try to update the existing Stripe customer
+		if err == nil && streetAddress.Valid && city.Valid && state.Valid && zipCode.Valid {
+			updateParams := &stripe.CustomerParams{
+				Address: &stripe.AddressParams{
+					Line1:      stripe.String(streetAddress.String),
+					City:       stripe.String(city.String),
+					State:      stripe.String(state.String),
+					PostalCode: stripe.String(zipCode.String),
+					Country:    stripe.String("US"),
+				},
+			}
+			_, updateErr := customer.Update(stripeCustomerID, updateParams)
+			if updateErr != nil {
+				// Customer doesn't exist in Stripe, clear the stale ID and create new one
+				users.SetStripeCustomerID(ctx, userID, "")
+				// Fall through to create new customer
+			} else {
+				return stripeCustomerID, nil
+			}
+		} else {
+			// Try to verify customer exists by fetching it
+			_, fetchErr := customer.Get(stripeCustomerID, nil)
+			if fetchErr != nil {
+				// Customer doesn't exist, clear stale ID and create new one
+				users.SetStripeCustomerID(ctx, userID, "")
+				// Fall through to create new customer
+			} else {
+				return stripeCustomerID, nil
+			}
+		}
+	}
+
+	// Get user's default address for new customer creation
+	var streetAddress, city, state, zipCode sql.NullString
+	err = s.db.QueryRow(`
+		SELECT street_address, city, state, zip_code 
+		FROM addresses 
+		WHERE user_id = $1 AND is_default = true
+		LIMIT 1
+	`, userID).Scan(&streetAddress, &city, &state, &zipCode)
+
+	// Check if user has a valid default address
+	if err == sql.ErrNoRows || !streetAddress.Valid || !city.Valid || !state.Valid || !zipCode.Valid {
+		return "", fmt.Errorf("no_default_address")
+	}
+
+	// Create new Stripe customer with address for tax calculation
+	params := &stripe.CustomerParams{
+		Email: stripe.String(user.Email),
+		Name:  stripe.String(user.FirstName + " " + user.LastName),
+		Address: &stripe.AddressParams{
+			Line1:      stripe.String(streetAddress.String),
+			City:       stripe.String(city.String),
+			State:      stripe.String(state.String),
+			PostalCode: stripe.String(zipCode.String),
+			Country:    stripe.String("US"),
+		},
+		Metadata: map[string]string{
+			"user_id": strconv.Itoa(userID),
+		},
+	}
+
+	c, err := customer.New(params)
+	if err != nil {
+		return "", fmt.Errorf("error creating Stripe customer for user %d: %v", userID, err)
+	}
+
+	// Save Stripe customer ID
+	if err := users.SetStripeCustomerID(ctx, userID, c.ID); err != nil {
+		return "", err
+	}
+
+	return c.ID, nil
+}
+
+// getOrCreateTipPrice creates a one-time price for tips, reusing a single tip product
+func (s *PaymentService) getOrCreateTipPrice(tipCents int) (string, error) {
+	tipAmountCents := int64(tipCents)
+
+	// Get or create a single "Driver Tip" product
+	tipProductID, err := s.getOrCreateTipProduct()
+	if err != nil {
+		return "", err
+	}
+
+	// Create a one-time price for this specific tip amount
+	// We don't need to search for existing tip prices since tips are usually unique amounts
+	priceParams := &stripe.PriceParams{
+		Product:     stripe.String(tipProductID),
+		UnitAmount:  stripe.Int64(tipAmountCents),
+		Currency:    stripe.String("usd"),
+		TaxBehavior: stripe.String("inclusive"), // Tips are usually not taxed
+		Metadata: map[string]string{
+			"type": "driver_tip",
+		},
+	}
+
+	p, err := price.New(priceParams)
+	if err != nil {
+		return "", err
+	}
+
+	return p.ID, nil
+}
+
+// getOrCreateTipProduct gets or creates a single reusable "Driver Tip" product
+func (s *PaymentService) getOrCreateTipProduct() (string, error) {
+	// Search for existing tip product using metadata
+	productSearchParams := &stripe.ProductSearchParams{
+		SearchParams: stripe.SearchParams{
+			Query: `metadata["type"]:"driver_tip"`,
+			Limit: stripe.Int64(1),
+		},
+	}
+
+	searchResult := product.Search(productSearchParams)
+
+	// If tip product exists, use it
+	if searchResult.Next() {
+		prod := searchResult.Product()
+		return prod.ID, nil
+	}
+
+	// Create single tip product that can be reused with different prices
+	productParams := &stripe.ProductParams{
+		Name:        stripe.String("Driver Tip"),
+		Description: stripe.String("Gratuity for Tumble drivers"),
+		Metadata: map[string]string{
+			"type": "driver_tip",
+		},
+		// Tips usually don't have tax codes since they're gratuity
+	}
+
+	prod, err := product.New(productParams)
+	if err != nil {
+		return "", err
+	}
+
+	return prod.ID, nil
+}
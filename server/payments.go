@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,6 +12,8 @@ import (
 	"strconv"
 	"time"
 
+	"tumble-backend/money"
+
 	"github.com/gorilla/mux"
 	"github.com/stripe/stripe-go/v82"
 	"github.com/stripe/stripe-go/v82/customer"
@@ -27,6 +30,11 @@ type PaymentHandler struct {
 	db        *sql.DB
 	realtime  RealtimeInterface
 	getUserID func(*http.Request, *sql.DB) (int, error)
+	// push tells customers when a payment fails; nil skips it
+	push *PushDispatcher
+	// addInvoiceItem and createInvoice bill subscription overages; nil uses Stripe
+	addInvoiceItem func(*stripe.InvoiceItemParams) (*stripe.InvoiceItem, error)
+	createInvoice  func(*stripe.InvoiceParams) (*stripe.Invoice, error)
 }
 
 func NewPaymentHandler(db *sql.DB, realtime RealtimeInterface) *PaymentHandler {
@@ -76,6 +84,15 @@ func (h *PaymentHandler) handleCreateSetupIntent(w http.ResponseWriter, r *http.
 		return
 	}
 
+	// Refuse up front rather than after the customer has typed in a card
+	if err := checkRoomForPaymentMethod(customerID); err == errPaymentMethodLimit {
+		http.Error(w, paymentMethodLimitMessage(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to fetch payment methods", http.StatusInternalServerError)
+		return
+	}
+
 	// Create setup intent
 	params := &stripe.SetupIntentParams{
 		Customer: stripe.String(customerID),
@@ -109,6 +126,12 @@ func (h *PaymentHandler) handleGetPaymentMethods(w http.ResponseWriter, r *http.
 		return
 	}
 
+	userID, err = h.paymentAccountFor(r, userID)
+	if err != nil {
+		http.Error(w, "Forbidden - Household payment access required", http.StatusForbidden)
+		return
+	}
+
 	// Get Stripe customer ID
 	var stripeCustomerID string
 	err = h.db.QueryRow(`
@@ -123,13 +146,13 @@ func (h *PaymentHandler) handleGetPaymentMethods(w http.ResponseWriter, r *http.
 	}
 
 	// List payment methods from Stripe
-	params := &stripe.PaymentMethodListParams{
-		Customer: stripe.String(stripeCustomerID),
-		Type:     stripe.String(string(stripe.PaymentMethodTypeCard)),
+	stored, err := listCardPaymentMethods(stripeCustomerID)
+	if err != nil {
+		http.Error(w, "Failed to fetch payment methods", http.StatusInternalServerError)
+		return
 	}
 
 	methods := []PaymentMethodResponse{}
-	i := paymentmethod.List(params)
 	
 	// Get default payment method
 	var defaultMethodID string
@@ -137,8 +160,9 @@ func (h *PaymentHandler) handleGetPaymentMethods(w http.ResponseWriter, r *http.
 		SELECT default_payment_method_id FROM users WHERE id = $1
 	`, userID).Scan(&defaultMethodID)
 
-	for i.Next() {
-		pm := i.PaymentMethod()
+	// A card saved twice is shown once
+	kept, _ := dedupeCards(stored, defaultMethodID)
+	for _, pm := range kept {
 		method := PaymentMethodResponse{
 			ID:        pm.ID,
 			Type:      string(pm.Type),
@@ -161,6 +185,16 @@ func (h *PaymentHandler) handleGetPaymentMethods(w http.ResponseWriter, r *http.
 	json.NewEncoder(w).Encode(methods)
 }
 
+// paymentAccountFor returns the user whose payment methods the request acts on.
+// With ?household=true, members holding the manage_payment permission act on
+// the household owner's account.
+func (h *PaymentHandler) paymentAccountFor(r *http.Request, userID int) (int, error) {
+	if r.URL.Query().Get("household") != "true" {
+		return userID, nil
+	}
+	return householdOwnerFor(h.db, userID, "manage_payment")
+}
+
 // handleSetDefaultPaymentMethod sets a payment method as default
 func (h *PaymentHandler) handleSetDefaultPaymentMethod(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
@@ -174,6 +208,12 @@ func (h *PaymentHandler) handleSetDefaultPaymentMethod(w http.ResponseWriter, r
 		return
 	}
 
+	userID, err = h.paymentAccountFor(r, userID)
+	if err != nil {
+		http.Error(w, "Forbidden - Household payment access required", http.StatusForbidden)
+		return
+	}
+
 	var req struct {
 		PaymentMethodID string `json:"payment_method_id"`
 	}
@@ -277,6 +317,12 @@ func (h *PaymentHandler) handleCreateSubscriptionPayment(w http.ResponseWriter,
 		return
 	}
 
+	offer, err := planOfferFor(h.db, userID, req.PlanID)
+	if err != nil {
+		http.Error(w, "Failed to check plan offer", http.StatusInternalServerError)
+		return
+	}
+
 	// Get or create Stripe customer
 	customerID, err := h.getOrCreateStripeCustomer(userID)
 	if err != nil {
@@ -288,14 +334,28 @@ func (h *PaymentHandler) handleCreateSubscriptionPayment(w http.ResponseWriter,
 		return
 	}
 
-	// Attach payment method to customer
-	_, err = paymentmethod.Attach(req.PaymentMethodID, &stripe.PaymentMethodAttachParams{
-		Customer: stripe.String(customerID),
-	})
+	// Reuse the stored copy if this card is already on file
+	paymentMethodID, attach, err := resolvePaymentMethodForAttach(customerID, req.PaymentMethodID)
+	if err == errPaymentMethodLimit {
+		http.Error(w, paymentMethodLimitMessage(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to attach payment method", http.StatusBadRequest)
 		return
 	}
+	req.PaymentMethodID = paymentMethodID
+
+	// Attach payment method to customer
+	if attach {
+		_, err = paymentmethod.Attach(req.PaymentMethodID, &stripe.PaymentMethodAttachParams{
+			Customer: stripe.String(customerID),
+		})
+		if err != nil {
+			http.Error(w, "Failed to attach payment method", http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Set as default payment method
 	_, err = customer.Update(customerID, &stripe.CustomerParams{
@@ -331,6 +391,28 @@ func (h *PaymentHandler) handleCreateSubscriptionPayment(w http.ResponseWriter,
 		Expand: stripe.StringSlice([]string{"latest_invoice.payment_intent"}),
 	}
 
+	// The intro discount goes on the first invoice straight away without a
+	// trial; with one, the scheduler attaches it as the trial ends
+	now := time.Now()
+	var introAppliedAt *time.Time
+	if offer.TrialDays > 0 {
+		params.TrialPeriodDays = stripe.Int64(int64(offer.TrialDays))
+	} else if offer.IntroPriceCents != nil {
+		couponID, err := newIntroCoupon(planName, pricePerMonthCents, *offer.IntroPriceCents)
+		if err != nil {
+			log.Printf("Failed to create intro coupon for user %d: %v", userID, err)
+			http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+			return
+		}
+		params.Discounts = []*stripe.SubscriptionDiscountParams{{Coupon: stripe.String(couponID)}}
+		introAppliedAt = &now
+	}
+	var trialEndsAt *string
+	if end := offer.trialEnd(now); end != nil {
+		date := end.Format("2006-01-02")
+		trialEndsAt = &date
+	}
+
 	sub, err := subscription.New(params)
 	if err != nil {
 		log.Printf("Failed to create Stripe subscription for user %d: %v", userID, err)
@@ -348,9 +430,13 @@ func (h *PaymentHandler) handleCreateSubscriptionPayment(w http.ResponseWriter,
 	
 	// Create subscription record in database
 	_, err = h.db.Exec(`
-		INSERT INTO subscriptions (user_id, plan_id, status, current_period_start, current_period_end, stripe_subscription_id)
-		VALUES ($1, $2, $3, CURRENT_DATE, CURRENT_DATE + INTERVAL '1 month', $4)
-	`, userID, req.PlanID, dbStatus, sub.ID)
+		INSERT INTO subscriptions (
+			user_id, plan_id, status, current_period_start, current_period_end, stripe_subscription_id,
+			trial_ends_at, intro_price_cents, intro_discount_applied_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, userID, req.PlanID, dbStatus, now.Format("2006-01-02"), offer.periodEnd(now).Format("2006-01-02"), sub.ID,
+		trialEndsAt, offer.IntroPriceCents, introAppliedAt)
 	
 	if err != nil {
 		log.Printf("Failed to create subscription record in database for user %d: %v", userID, err)
@@ -410,17 +496,50 @@ func (h *PaymentHandler) handleCreateOrderPayment(w http.ResponseWriter, r *http
 	}
 
 	// Get order details and verify ownership
-	var orderTotal float64
+	var orderTotalCents int
 	var orderUserID int
 	err = h.db.QueryRow(`
-		SELECT user_id, total FROM orders WHERE id = $1
-	`, req.OrderID).Scan(&orderUserID, &orderTotal)
+		SELECT user_id, COALESCE(total_cents, 0) FROM orders WHERE id = $1
+	`, req.OrderID).Scan(&orderUserID, &orderTotalCents)
 	
 	if err != nil || orderUserID != userID {
 		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
 
+	// Credit already spent on the order at checkout isn't charged again
+	creditCents, err := orderCreditCents(h.db, req.OrderID)
+	if err != nil {
+		http.Error(w, "Failed to fetch order credit", http.StatusInternalServerError)
+		return
+	}
+	orderTotalCents -= creditCents
+	if orderTotalCents <= 0 {
+		http.Error(w, "Order is fully covered by account credit", http.StatusConflict)
+		return
+	}
+
+	sandbox, err := isSandboxOrder(h.db, req.OrderID)
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if sandbox {
+		paymentID, err := recordSandboxPayment(h.db, userID, req.OrderID, orderTotalCents)
+		if err != nil {
+			http.Error(w, "Failed to record payment", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"payment_intent_id": paymentID,
+			"client_secret":     "",
+			"status":            stripe.PaymentIntentStatusSucceeded,
+			"sandbox":           true,
+		})
+		return
+	}
+
 	// Get or create Stripe customer
 	customerID, err := h.getOrCreateStripeCustomer(userID)
 	if err != nil {
@@ -434,7 +553,7 @@ func (h *PaymentHandler) handleCreateOrderPayment(w http.ResponseWriter, r *http
 
 	// Create payment intent
 	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(int64(orderTotal * 100)), // Convert to cents
+		Amount:   stripe.Int64(int64(orderTotalCents)),
 		Currency: stripe.String("usd"),
 		Customer: stripe.String(customerID),
 		Metadata: map[string]string{
@@ -467,9 +586,9 @@ func (h *PaymentHandler) handleCreateOrderPayment(w http.ResponseWriter, r *http
 
 	// Create payment record
 	_, err = h.db.Exec(`
-		INSERT INTO payments (user_id, order_id, amount, payment_type, status, stripe_payment_intent_id)
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id)
 		VALUES ($1, $2, $3, 'extra_order', 'pending', $4)
-	`, userID, req.OrderID, orderTotal, pi.ID)
+	`, userID, req.OrderID, orderTotalCents, pi.ID)
 	
 	if err != nil {
 		http.Error(w, "Failed to record payment", http.StatusInternalServerError)
@@ -508,58 +627,103 @@ func (h *PaymentHandler) handleStripeWebhook(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Handle the event
+	// Stripe retries until it gets a 2xx, and may deliver an event more than
+	// once; each is applied at most once, and a failure is left for Stripe's
+	// retry or an admin replay
+	applied, err := h.processStripeEvent(event, payload)
+	if errors.Is(err, errStripeEventPayload) {
+		http.Error(w, "Error parsing webhook JSON", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to process Stripe event %s (%s): %v", event.ID, event.Type, err)
+		http.Error(w, "Failed to process event", http.StatusInternalServerError)
+		return
+	}
+	if !applied {
+		log.Printf("Skipping Stripe event %s (%s) already processed", event.ID, event.Type)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// applyStripeEvent updates our records from one Stripe event. Events we
+// don't act on are ignored.
+func (h *PaymentHandler) applyStripeEvent(event stripe.Event) error {
 	switch event.Type {
 	case "setup_intent.succeeded":
 		var si stripe.SetupIntent
 		if err := json.Unmarshal(event.Data.Raw, &si); err != nil {
-			http.Error(w, "Error parsing webhook JSON", http.StatusBadRequest)
-			return
+			return fmt.Errorf("%w: %v", errStripeEventPayload, err)
 		}
-		h.handleSetupIntentSucceeded(&si)
+		return h.handleSetupIntentSucceeded(&si)
 
 	case "payment_intent.succeeded":
 		var pi stripe.PaymentIntent
 		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
-			http.Error(w, "Error parsing webhook JSON", http.StatusBadRequest)
-			return
+			return fmt.Errorf("%w: %v", errStripeEventPayload, err)
 		}
-		h.handlePaymentIntentSucceeded(&pi)
+		return h.handlePaymentIntentSucceeded(&pi)
 
 	case "payment_intent.payment_failed":
 		var pi stripe.PaymentIntent
 		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
-			http.Error(w, "Error parsing webhook JSON", http.StatusBadRequest)
-			return
+			return fmt.Errorf("%w: %v", errStripeEventPayload, err)
+		}
+		return h.handlePaymentIntentFailed(&pi)
+
+	case "charge.dispute.created":
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return fmt.Errorf("%w: %v", errStripeEventPayload, err)
 		}
-		h.handlePaymentIntentFailed(&pi)
+		return h.handleDisputeCreated(&dispute)
 
 	case "customer.subscription.updated":
 		var sub stripe.Subscription
 		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
-			http.Error(w, "Error parsing webhook JSON", http.StatusBadRequest)
-			return
+			return fmt.Errorf("%w: %v", errStripeEventPayload, err)
 		}
-		h.handleSubscriptionUpdated(&sub)
+		return h.handleSubscriptionUpdated(&sub)
 
 	case "customer.subscription.deleted":
 		var sub stripe.Subscription
 		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
-			http.Error(w, "Error parsing webhook JSON", http.StatusBadRequest)
-			return
+			return fmt.Errorf("%w: %v", errStripeEventPayload, err)
+		}
+		return h.handleSubscriptionDeleted(&sub)
+
+	case "refund.created", "refund.updated", "refund.failed":
+		var re stripe.Refund
+		if err := json.Unmarshal(event.Data.Raw, &re); err != nil {
+			return fmt.Errorf("%w: %v", errStripeEventPayload, err)
+		}
+		return h.handleRefundUpdated(&re)
+
+	case "invoice.created":
+		var invoice stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			return fmt.Errorf("%w: %v", errStripeEventPayload, err)
 		}
-		h.handleSubscriptionDeleted(&sub)
+		return h.handleInvoiceCreated(&invoice)
 
 	case "invoice.payment_succeeded":
 		var invoice stripe.Invoice
 		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
-			http.Error(w, "Error parsing webhook JSON", http.StatusBadRequest)
-			return
+			return fmt.Errorf("%w: %v", errStripeEventPayload, err)
 		}
-		h.handleInvoicePaymentSucceeded(&invoice)
-	}
+		return h.handleInvoicePaymentSucceeded(&invoice)
 
-	w.WriteHeader(http.StatusOK)
+	case "account.updated":
+		var acct stripe.Account
+		if err := json.Unmarshal(event.Data.Raw, &acct); err != nil {
+			return fmt.Errorf("%w: %v", errStripeEventPayload, err)
+		}
+		if err := recordConnectAccount(h.db, &acct); err != nil {
+			return fmt.Errorf("failed to record Connect account %s: %v", acct.ID, err)
+		}
+	}
+	return nil
 }
 
 // Helper functions
@@ -699,7 +863,7 @@ func (h *PaymentHandler) getOrCreateStripePrice(planName string, amountCents int
 	for priceList.Next() {
 		existingPrice := priceList.Price()
 		if existingPrice.UnitAmount == amountCents {
-			log.Printf("Found existing Stripe price: %s (%s)", existingPrice.ID, fmt.Sprintf("$%.2f", float64(existingPrice.UnitAmount)/100))
+			log.Printf("Found existing Stripe price: %s (%s)", existingPrice.ID, money.Format(int(existingPrice.UnitAmount)))
 			return existingPrice.ID, nil
 		}
 	}
@@ -720,11 +884,11 @@ func (h *PaymentHandler) getOrCreateStripePrice(planName string, amountCents int
 		return "", err
 	}
 	
-	log.Printf("Created new Stripe price: %s (%s)", p.ID, fmt.Sprintf("$%.2f", float64(p.UnitAmount)/100))
+	log.Printf("Created new Stripe price: %s (%s)", p.ID, money.Format(int(p.UnitAmount)))
 	return p.ID, nil
 }
 
-func (h *PaymentHandler) handlePaymentIntentSucceeded(pi *stripe.PaymentIntent) {
+func (h *PaymentHandler) handlePaymentIntentSucceeded(pi *stripe.PaymentIntent) error {
 	// Update payment status
 	_, err := h.db.Exec(`
 		UPDATE payments 
@@ -733,7 +897,7 @@ func (h *PaymentHandler) handlePaymentIntentSucceeded(pi *stripe.PaymentIntent)
 	`, pi.LatestCharge.ID, pi.ID)
 	
 	if err != nil {
-		return
+		return err
 	}
 
 	// Update order status if this was an order payment
@@ -748,18 +912,78 @@ func (h *PaymentHandler) handlePaymentIntentSucceeded(pi *stripe.PaymentIntent)
 			h.realtime.PublishOrderUpdate(userID, orderID, "scheduled", "Payment successful - pickup confirmed", nil)
 		}
 	}
+	return nil
 }
 
-func (h *PaymentHandler) handlePaymentIntentFailed(pi *stripe.PaymentIntent) {
+func (h *PaymentHandler) handlePaymentIntentFailed(pi *stripe.PaymentIntent) error {
 	// Update payment status
-	h.db.Exec(`
+	_, err := h.db.Exec(`
 		UPDATE payments 
 		SET status = 'failed'
 		WHERE stripe_payment_intent_id = $1
 	`, pi.ID)
+	if err != nil {
+		return err
+	}
+
+	var orderID *int
+	if orderIDStr, ok := pi.Metadata["order_id"]; ok {
+		if id, err := strconv.Atoi(orderIDStr); err == nil {
+			orderID = &id
+		}
+	}
+	message := fmt.Sprintf("Payment %s for %s failed", pi.ID, money.Format(int(pi.Amount)))
+	if pi.LastPaymentError != nil && pi.LastPaymentError.Msg != "" {
+		message += ": " + pi.LastPaymentError.Msg
+	}
+	logAdminAlert(h.db, AdminAlert{
+		Type:      "payment_failed",
+		Severity:  "warning",
+		Title:     "Order payment failed",
+		Message:   message,
+		OrderID:   orderID,
+		DedupeKey: "payment_failed:" + pi.ID,
+	})
+
+	if userID, err := strconv.Atoi(pi.Metadata["user_id"]); err == nil && orderID != nil {
+		err := h.push.Queue(h.db, PushNotification{
+			UserID:   userID,
+			Category: pushPaymentIssues,
+			OrderID:  orderID,
+			Title:    "Payment failed",
+			Body:     fmt.Sprintf("We couldn't charge your card for order #%d. Update your payment method to keep your pickup.", *orderID),
+			Data:     map[string]string{"type": "payment_failed", "order_id": fmt.Sprint(*orderID)},
+		})
+		if err != nil {
+			log.Printf("Failed to queue payment failure push for order %d: %v", *orderID, err)
+		}
+	}
+	return nil
+}
+
+// handleDisputeCreated puts chargebacks in front of an admin, since they have
+// a response deadline
+func (h *PaymentHandler) handleDisputeCreated(dispute *stripe.Dispute) error {
+	var orderID *int
+	if dispute.PaymentIntent != nil {
+		h.db.QueryRow(`
+			SELECT order_id FROM payments WHERE stripe_payment_intent_id = $1`,
+			dispute.PaymentIntent.ID,
+		).Scan(&orderID)
+	}
+
+	logAdminAlert(h.db, AdminAlert{
+		Type:      "payment_dispute",
+		Severity:  "critical",
+		Title:     "Customer disputed a charge",
+		Message:   fmt.Sprintf("Dispute %s for %s (%s)", dispute.ID, money.Format(int(dispute.Amount)), dispute.Reason),
+		OrderID:   orderID,
+		DedupeKey: "payment_dispute:" + dispute.ID,
+	})
+	return nil
 }
 
-func (h *PaymentHandler) handleSubscriptionUpdated(sub *stripe.Subscription) {
+func (h *PaymentHandler) handleSubscriptionUpdated(sub *stripe.Subscription) error {
 	// Update subscription status
 	status := "active"
 	if sub.Status == "canceled" || sub.Status == "unpaid" {
@@ -768,32 +992,68 @@ func (h *PaymentHandler) handleSubscriptionUpdated(sub *stripe.Subscription) {
 		status = "paused"
 	}
 
-	// Update subscription without period end for now
-	// Note: Period handling would be done differently in real implementation
+	// Keep the local period in step with Stripe's, which moves on each renewal
+	if start, end, ok := stripeSubscriptionPeriod(sub); ok {
+		if _, err := syncSubscriptionPeriod(h.db, sub.ID, start, end); err != nil {
+			return err
+		}
+	}
 
-	h.db.Exec(`
+	var userID int
+	err := h.db.QueryRow(`
 		UPDATE subscriptions 
 		SET status = $1
-		WHERE stripe_subscription_id = $2
-	`, status, sub.ID)
+		WHERE stripe_subscription_id = $2 AND status <> $1
+		RETURNING user_id
+	`, status, sub.ID).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// Tell the customer the first time a renewal fails, not on every retry
+	if err == nil && sub.Status == "past_due" {
+		err := h.push.Queue(h.db, PushNotification{
+			UserID:   userID,
+			Category: pushPaymentIssues,
+			Title:    "Subscription payment failed",
+			Body:     "We couldn't renew your subscription, so pickups are paused. Update your payment method to resume.",
+			Data:     map[string]string{"type": "subscription_past_due"},
+		})
+		if err != nil {
+			log.Printf("Failed to queue past due push for user %d: %v", userID, err)
+		}
+	}
+	return nil
 }
 
-func (h *PaymentHandler) handleSubscriptionDeleted(sub *stripe.Subscription) {
+func (h *PaymentHandler) handleSubscriptionDeleted(sub *stripe.Subscription) error {
 	// Cancel subscription
-	h.db.Exec(`
+	_, err := h.db.Exec(`
 		UPDATE subscriptions 
 		SET status = 'cancelled'
 		WHERE stripe_subscription_id = $1
 	`, sub.ID)
+	if err != nil {
+		return err
+	}
+	return h.billOveragesOnCancellation(sub)
 }
 
-func (h *PaymentHandler) handleSetupIntentSucceeded(si *stripe.SetupIntent) {
+func (h *PaymentHandler) handleSetupIntentSucceeded(si *stripe.SetupIntent) error {
 	log.Printf("Setup intent succeeded: %s", si.ID)
+
+	// Saving a card that's already on file leaves two copies; keep one
+	if si.Customer != nil && si.PaymentMethod != nil {
+		if err := h.collapseDuplicatePaymentMethods(si.Customer.ID, si.PaymentMethod.ID); err != nil {
+			log.Printf("Failed to dedupe payment methods for customer %s: %v", si.Customer.ID, err)
+		}
+	}
 	// Note: Actual subscription activation happens when payment method is used
 	// The frontend will handle creating the subscription after setup intent succeeds
+	return nil
 }
 
-func (h *PaymentHandler) handleInvoicePaymentSucceeded(invoice *stripe.Invoice) {
+func (h *PaymentHandler) handleInvoicePaymentSucceeded(invoice *stripe.Invoice) error {
 	log.Printf("Invoice payment succeeded: %s", invoice.ID)
 	
 	// For subscription invoices, we can check if there are line items with subscription references
@@ -803,17 +1063,34 @@ func (h *PaymentHandler) handleInvoicePaymentSucceeded(invoice *stripe.Invoice)
 			// Check if this line item has a subscription reference
 			if line.Subscription != nil {
 				subscriptionID := line.Subscription.ID
-				h.db.Exec(`
+				_, err := h.db.Exec(`
 					UPDATE subscriptions 
 					SET status = 'active'
 					WHERE stripe_subscription_id = $1
 				`, subscriptionID)
+				if err != nil {
+					return err
+				}
 				
 				log.Printf("Subscription activated via invoice payment: %s", subscriptionID)
+
+				if start, end, ok := invoiceSubscriptionPeriod(invoice, subscriptionID); ok {
+					if _, err := syncSubscriptionPeriod(h.db, subscriptionID, start, end); err != nil {
+						return err
+					}
+				}
+
+				if err := recordTrialConversion(h.db, subscriptionID, invoice.AmountPaid); err != nil {
+					log.Printf("Failed to record trial conversion for subscription %s: %v", subscriptionID, err)
+				}
+				if err := postInvoiceToLedger(h.db, invoice, subscriptionID); err != nil {
+					return fmt.Errorf("failed to post invoice %s to the ledger: %v", invoice.ID, err)
+				}
 				break // Only need to activate once
 			}
 		}
 	}
+	return nil
 }
 
 // handleGetPaymentHistory returns payment history for a user
@@ -845,16 +1122,18 @@ func (h *PaymentHandler) handleGetPaymentHistory(w http.ResponseWriter, r *http.
 	}
 
 	type PaymentHistory struct {
-		ID          int       `json:"id"`
-		OrderID     *int      `json:"order_id,omitempty"`
-		Amount      float64   `json:"amount"`
-		PaymentType string    `json:"payment_type"`
-		Status      string    `json:"status"`
-		CreatedAt   time.Time `json:"created_at"`
+		ID             int       `json:"id"`
+		OrderID        *int      `json:"order_id,omitempty"`
+		Amount         float64   `json:"amount"`
+		RefundedAmount float64   `json:"refunded_amount"`
+		PaymentType    string    `json:"payment_type"`
+		Status         string    `json:"status"`
+		Refunds        []Refund  `json:"refunds"`
+		CreatedAt      time.Time `json:"created_at"`
 	}
 
 	query := `
-		SELECT id, order_id, amount, payment_type, status, created_at
+		SELECT id, order_id, amount_cents, payment_type, status, created_at
 		FROM payments
 		WHERE user_id = $1
 		ORDER BY created_at DESC
@@ -869,13 +1148,38 @@ func (h *PaymentHandler) handleGetPaymentHistory(w http.ResponseWriter, r *http.
 	defer rows.Close()
 
 	payments := []PaymentHistory{}
+	paymentIDs := []int{}
 	for rows.Next() {
 		var p PaymentHistory
-		err := rows.Scan(&p.ID, &p.OrderID, &p.Amount, &p.PaymentType, &p.Status, &p.CreatedAt)
+		var amountCents int
+		err := rows.Scan(&p.ID, &p.OrderID, &amountCents, &p.PaymentType, &p.Status, &p.CreatedAt)
 		if err != nil {
 			continue
 		}
+		p.Amount = centsToDollars(amountCents)
 		payments = append(payments, p)
+		paymentIDs = append(paymentIDs, p.ID)
+	}
+
+	refunds, err := refundsForPayments(h.db, paymentIDs)
+	if err != nil {
+		http.Error(w, "Failed to fetch payment history", http.StatusInternalServerError)
+		return
+	}
+	for i := range payments {
+		payments[i].Refunds = refunds[payments[i].ID]
+		if payments[i].Refunds == nil {
+			payments[i].Refunds = []Refund{}
+		}
+		refundedCents := 0
+		for j, rf := range payments[i].Refunds {
+			// Customers don't need to know which admin issued the refund
+			payments[i].Refunds[j].CreatedBy = nil
+			if rf.Status == "succeeded" {
+				refundedCents += dollarsToCents(rf.Amount)
+			}
+		}
+		payments[i].RefundedAmount = centsToDollars(refundedCents)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -8,7 +8,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/stripe/stripe-go/v82"
 )
 
 func TestPaymentHandler_CreateSetupIntent(t *testing.T) {
@@ -397,4 +400,43 @@ func TestPaymentHandler_MethodValidation(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestDedupeCards(t *testing.T) {
+	card := func(id, fingerprint string) *stripe.PaymentMethod {
+		return &stripe.PaymentMethod{ID: id, Card: &stripe.PaymentMethodCard{Fingerprint: fingerprint}}
+	}
+	ids := func(methods []*stripe.PaymentMethod) []string {
+		out := []string{}
+		for _, pm := range methods {
+			out = append(out, pm.ID)
+		}
+		return out
+	}
+
+	// Newest first, as Stripe lists them
+	stored := []*stripe.PaymentMethod{card("pm_new_visa", "visa"), card("pm_amex", "amex"), card("pm_old_visa", "visa")}
+
+	kept, duplicates := dedupeCards(stored, "")
+	if fmt.Sprint(ids(kept)) != "[pm_new_visa pm_amex]" || fmt.Sprint(ids(duplicates)) != "[pm_old_visa]" {
+		t.Errorf("Expected the newest visa to be kept, got kept %v and duplicates %v", ids(kept), ids(duplicates))
+	}
+
+	kept, duplicates = dedupeCards(stored, "pm_old_visa")
+	if fmt.Sprint(ids(kept)) != "[pm_amex pm_old_visa]" || fmt.Sprint(ids(duplicates)) != "[pm_new_visa]" {
+		t.Errorf("Expected the default visa to be kept, got kept %v and duplicates %v", ids(kept), ids(duplicates))
+	}
+
+	if existing := storedCard(stored, card("pm_entered", "amex")); existing == nil || existing.ID != "pm_amex" {
+		t.Errorf("Expected the entered card to match the stored amex, got %v", existing)
+	}
+	if existing := storedCard(stored, card("pm_entered", "mastercard")); existing != nil {
+		t.Errorf("Expected a new card not to match, got %s", existing.ID)
+	}
+
+	os.Setenv("MAX_STORED_PAYMENT_METHODS", "2")
+	defer os.Unsetenv("MAX_STORED_PAYMENT_METHODS")
+	if maxStoredPaymentMethods() != 2 || !strings.Contains(paymentMethodLimitMessage(), "up to 2 payment methods") {
+		t.Errorf("Expected a limit of 2, got %d (%q)", maxStoredPaymentMethods(), paymentMethodLimitMessage())
+	}
+}
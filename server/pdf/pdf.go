@@ -0,0 +1,189 @@
+// Package pdf writes simple printable documents: text in the built-in
+// Helvetica faces and straight rules on US Letter pages. It covers what
+// manifests and slips need without pulling in a layout engine; there are no
+// images, embedded fonts or compression.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Page dimensions in points for US Letter
+const (
+	PageWidth  = 612.0
+	PageHeight = 792.0
+)
+
+// Document is a PDF being built page by page. Coordinates are in points from
+// the top-left corner of the page, unlike raw PDF which measures from the
+// bottom-left.
+type Document struct {
+	title string
+	pages []*bytes.Buffer
+	page  int
+}
+
+// New starts an empty document with the given title in its metadata
+func New(title string) *Document {
+	return &Document{title: title}
+}
+
+// AddPage starts a new page; later drawing calls go onto it
+func (d *Document) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.page = len(d.pages) - 1
+}
+
+// PageCount is the number of pages added so far
+func (d *Document) PageCount() int {
+	return len(d.pages)
+}
+
+// SetPage moves drawing back to an earlier page, e.g. to add "page x of y"
+// footers once the page count is known. Pages are numbered from 1.
+func (d *Document) SetPage(n int) {
+	if n >= 1 && n <= len(d.pages) {
+		d.page = n - 1
+	}
+}
+
+func (d *Document) current() *bytes.Buffer {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+	return d.pages[d.page]
+}
+
+// Text draws s with its baseline at (x, y) in Helvetica, or Helvetica-Bold
+func (d *Document) Text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.current(), "BT /%s %s Tf %s %s Td (%s) Tj ET\n",
+		font, num(size), num(x), num(PageHeight-y), escape(s))
+}
+
+// Line draws a rule from (x1, y1) to (x2, y2)
+func (d *Document) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(d.current(), "%s w %s %s m %s %s l S\n",
+		num(width), num(x1), num(PageHeight-y1), num(x2), num(PageHeight-y2))
+}
+
+// Wrap splits s into lines of at most maxChars characters, breaking on spaces
+// where it can. Helvetica is proportional, so callers should size maxChars
+// for the widest text they expect rather than the average.
+func Wrap(s string, maxChars int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(s, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for len([]rune(word)) > maxChars {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				runes := []rune(word)
+				lines = append(lines, string(runes[:maxChars]))
+				word = string(runes[maxChars:])
+			}
+			switch {
+			case line == "":
+				line = word
+			case len([]rune(line))+1+len([]rune(word)) <= maxChars:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Bytes renders the finished document
+func (d *Document) Bytes() []byte {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Objects 1-4 are the catalog, page tree, fonts and info; each page is
+	// then a page object followed by its content stream
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /F1 << /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >> " +
+		"/F2 << /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >> >>")
+	object(fmt.Sprintf("<< /Title (%s) /Producer (Tumble) >>", escape(d.title)))
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font 3 0 R >> /Contents %d 0 R >>",
+			num(PageWidth), num(PageHeight), 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 4 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// winAnsiExtras are the WinAnsi characters outside Latin-1 that show up in
+// typed text, mostly from phones substituting smart punctuation
+var winAnsiExtras = map[rune]byte{
+	'€': 0x80, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94,
+	'•': 0x95, '–': 0x96, '—': 0x97,
+}
+
+// escape makes s safe inside a PDF string literal. Other characters with no
+// glyph in the standard fonts print as '?'.
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n' || r == '\r' || r == '\t':
+			b.WriteByte(' ')
+		case r < 0x20 || (r >= 0x7f && r < 0xa0):
+			// Control characters are dropped
+		case r < 0x80:
+			b.WriteRune(r)
+		case r < 0x100:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case winAnsiExtras[r] != 0:
+			fmt.Fprintf(&b, "\\%03o", winAnsiExtras[r])
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// num formats a coordinate without trailing zeros
+func num(f float64) string {
+	s := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.2f", f), "0"), ".")
+	if s == "" || s == "-0" {
+		return "0"
+	}
+	return s
+}
@@ -0,0 +1,92 @@
+package pdf
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBytes_XrefPointsAtObjects(t *testing.T) {
+	doc := New("Manifest (test)")
+	doc.Text(40, 50, 12, true, "Route #1")
+	doc.AddPage()
+	doc.Line(40, 60, 300, 60, 0.5)
+	doc.SetPage(1)
+	doc.Text(40, 760, 8, false, "Page 1 of 2")
+	out := doc.Bytes()
+
+	if !bytes.HasPrefix(out, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(out, []byte("%%EOF\n")) {
+		t.Fatalf("Missing PDF header or trailer:\n%s", out)
+	}
+
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(out)
+	if startxref == nil {
+		t.Fatal("Missing startxref")
+	}
+	xref, _ := strconv.Atoi(string(startxref[1]))
+	if !bytes.HasPrefix(out[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d doesn't point at the xref table", xref)
+	}
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(out[xref:], -1)
+	if len(entries) != 8 {
+		t.Fatalf("Expected 8 objects for a two page document, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		want := strconv.Itoa(i+1) + " 0 obj\n"
+		if !bytes.HasPrefix(out[offset:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q", i+1, out[offset:offset+10])
+		}
+	}
+
+	// The footer drawn after SetPage(1) lands in the first page's stream
+	first := bytes.Index(out, []byte("(Route #1)"))
+	footer := bytes.Index(out, []byte("(Page 1 of 2)"))
+	rule := bytes.Index(out, []byte(" l S"))
+	if first < 0 || footer < first || rule < footer {
+		t.Error("Expected the footer in the first page's content stream")
+	}
+	if !bytes.Contains(out, []byte(`/Title (Manifest \(test\))`)) {
+		t.Error("Expected the title to be escaped in the document info")
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"Gate code (1234)", `Gate code \(1234\)`},
+		{`C:\path`, `C:\\path`},
+		{"Leave at door\nRing bell", "Leave at door Ring bell"},
+		{"Café", `Caf\351`},
+		{"Don’t knock", `Don\222t knock`},
+		{"Bell \x07", "Bell "},
+		{"🐕 inside", "? inside"},
+	}
+	for _, tt := range tests {
+		if got := escape(tt.input); got != tt.want {
+			t.Errorf("escape(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	lines := Wrap("Leave bags with the front desk if nobody answers\nCall first", 20)
+	want := []string{"Leave bags with the", "front desk if nobody", "answers", "Call first"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("Wrap = %q, want %q", lines, want)
+	}
+
+	for _, line := range Wrap("Code: "+strings.Repeat("9", 45), 20) {
+		if len(line) > 20 {
+			t.Errorf("Line %q is longer than 20 characters", line)
+		}
+	}
+	if lines := Wrap("   ", 20); len(lines) != 0 {
+		t.Errorf("Expected no lines for blank text, got %q", lines)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Permission is one grantable capability. Admin routes each require one.
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// permissionCatalog lists every permission a custom role can be granted.
+// The built-in admin role holds all of them, including ones added later.
+var permissionCatalog = []Permission{
+	{"users.read", "View customer and staff accounts and their change history"},
+	{"users.manage", "Create, edit, suspend and delete accounts and change their roles"},
+	{"orders.read", "View orders, the order feed, order history and order chats"},
+	{"orders.manage", "Update order statuses, check in garments, record resolutions and reply in order chats"},
+	{"payments.read", "View payments, refunds, credits, revenue and reconciliation"},
+	{"payments.manage", "Issue refunds, adjust credits, costs and subscription pricing"},
+	{"routes.read", "View routes, driver locations, schedules, manifests and address geocode drift"},
+	{"routes.assign", "Assign drivers, resequence and schedule routes and breaks, and run the geocode backfill"},
+	{"drivers.read", "View driver stats, scorecards, reviews, onboarding and applications"},
+	{"drivers.manage", "Review driver applications, complete onboarding steps and moderate reviews"},
+	{"inbox.read", "View the admin inbox"},
+	{"inbox.manage", "Acknowledge, assign and resolve admin inbox items"},
+	{"safety.manage", "Review safety reports and manage the blocklist"},
+	{"legal.manage", "Place legal holds and export account data"},
+	{"audit.read", "View the audit log of admin changes"},
+	{"settings.manage", "Manage add-ons, launch markets, invite codes, retention, backups and partner webhooks"},
+	{"recovery.manage", "Pause order intake, drain a market's routes, re-drive queues and take incident snapshots"},
+	{"facility.manage", "Scan bags in at the facility, track washing, drying and folding, weigh bags and mark orders ready for delivery"},
+}
+
+func allPermissions() []string {
+	names := make([]string, len(permissionCatalog))
+	for i, p := range permissionCatalog {
+		names[i] = p.Name
+	}
+	return names
+}
+
+func isPermission(name string) bool {
+	for _, p := range permissionCatalog {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// builtInRoles can't be edited or deleted. Customers and drivers hold no
+// admin permissions; drivers are still gated by requireDriver.
+var builtInRoles = map[string]bool{"customer": true, "driver": true, "admin": true}
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,19}$`)
+
+// userPermissions returns the user's role and the permissions it grants
+func userPermissions(q queryRower, userID int) (string, []string, error) {
+	var role string
+	var granted []string
+	err := q.QueryRow(`
+		SELECT u.role, ARRAY(SELECT permission FROM role_permissions WHERE role = u.role ORDER BY permission)
+		FROM users u WHERE u.id = $1`,
+		userID,
+	).Scan(&role, pq.Array(&granted))
+	if err != nil {
+		return "", nil, err
+	}
+	if role == "admin" {
+		granted = allPermissions()
+	}
+	return role, granted, nil
+}
+
+func userHasPermission(q queryRower, userID int, permission string) (bool, error) {
+	var ok bool
+	err := q.QueryRow(`
+		SELECT u.role = 'admin' OR EXISTS (
+			SELECT 1 FROM role_permissions rp WHERE rp.role = u.role AND rp.permission = $2
+		)
+		FROM users u WHERE u.id = $1`,
+		userID, permission,
+	).Scan(&ok)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return ok, err
+}
+
+func roleExists(q queryRower, name string) (bool, error) {
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM roles WHERE name = $1)", name).Scan(&exists)
+	return exists, err
+}
+
+// requirePermission allows the request through only if the user's role
+// grants the permission
+func (h *AdminHandler) requirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := h.getUserID(r, h.db)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ok, err := userHasPermission(h.db, userID, permission)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Forbidden - "+permission+" permission required", http.StatusForbidden)
+			return
+		}
+
+		h.audited(userID, next)(w, r)
+	}
+}
+
+// checkAdminGrant stops staff who aren't admins from promoting anyone to
+// admin or changing an existing admin's account. It writes the error and
+// returns false when the change isn't allowed.
+func (h *AdminHandler) checkAdminGrant(w http.ResponseWriter, r *http.Request, newRole string, targetUserID int) bool {
+	if newRole != "admin" && targetUserID == 0 {
+		return true
+	}
+	callerID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	var callerIsAdmin, targetIsAdmin bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND role = 'admin'),
+		       EXISTS(SELECT 1 FROM users WHERE id = $2 AND role = 'admin')`,
+		callerID, targetUserID,
+	).Scan(&callerIsAdmin, &targetIsAdmin)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if !callerIsAdmin && (newRole == "admin" || targetIsAdmin) {
+		http.Error(w, "Forbidden - Only admins can grant or change the admin role", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// RoleHandler manages roles and the permissions they grant
+type RoleHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewRoleHandler(db *sql.DB) *RoleHandler {
+	return &RoleHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type Role struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	BuiltIn     bool      `json:"built_in"`
+	Permissions []string  `json:"permissions"`
+	UserCount   int       `json:"user_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+const roleColumns = `r.name, r.description, r.built_in,
+	ARRAY(SELECT permission FROM role_permissions WHERE role = r.name ORDER BY permission),
+	(SELECT COUNT(*) FROM users WHERE role = r.name), r.created_at, r.updated_at`
+
+func scanRole(scanner interface{ Scan(...interface{}) error }) (Role, error) {
+	var role Role
+	err := scanner.Scan(&role.Name, &role.Description, &role.BuiltIn, pq.Array(&role.Permissions),
+		&role.UserCount, &role.CreatedAt, &role.UpdatedAt)
+	if role.Name == "admin" {
+		role.Permissions = allPermissions()
+	} else if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+	return role, err
+}
+
+func getRole(q queryRower, name string) (Role, error) {
+	return scanRole(q.QueryRow("SELECT "+roleColumns+" FROM roles r WHERE r.name = $1", name))
+}
+
+// handleGetPermissions lists every permission that can be granted
+func (h *RoleHandler) handleGetPermissions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(permissionCatalog)
+}
+
+// handleGetRoles lists built-in and custom roles with their permissions
+func (h *RoleHandler) handleGetRoles(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query("SELECT " + roleColumns + " FROM roles r ORDER BY r.built_in DESC, r.name")
+	if err != nil {
+		http.Error(w, "Failed to fetch roles", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch roles", http.StatusInternalServerError)
+			return
+		}
+		roles = append(roles, role)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+type RoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func (req *RoleRequest) validatePermissions() error {
+	seen := map[string]bool{}
+	for _, p := range req.Permissions {
+		if !isPermission(p) {
+			return fmt.Errorf("Unknown permission: %s", p)
+		}
+		if seen[p] {
+			return fmt.Errorf("Duplicate permission: %s", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+func setRolePermissions(tx *sql.Tx, role string, permissions []string) error {
+	if _, err := tx.Exec("DELETE FROM role_permissions WHERE role = $1", role); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO role_permissions (role, permission)
+		SELECT $1, unnest($2::text[])`,
+		role, pq.Array(permissions),
+	)
+	return err
+}
+
+// handleCreateRole adds a custom staff role, e.g. a dispatcher who can see
+// orders and assign routes but not payments
+func (h *RoleHandler) handleCreateRole(w http.ResponseWriter, r *http.Request) {
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.ToLower(strings.TrimSpace(req.Name))
+	req.Description = strings.TrimSpace(req.Description)
+	if !roleNamePattern.MatchString(req.Name) {
+		http.Error(w, "Role name must be 2-20 lowercase letters, digits or underscores, starting with a letter", http.StatusBadRequest)
+		return
+	}
+	if err := req.validatePermissions(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO roles (name, description) VALUES ($1, $2)", req.Name, req.Description)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "A role with that name already exists", http.StatusConflict)
+		return
+	}
+	if err == nil {
+		err = setRolePermissions(tx, req.Name, req.Permissions)
+	}
+	var role Role
+	if err == nil {
+		role, err = getRole(tx, req.Name)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to create role", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(role)
+}
+
+// handleUpdateRole replaces a custom role's description and permissions.
+// Users holding the role pick up the change on their next request.
+func (h *RoleHandler) handleUpdateRole(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if builtInRoles[name] {
+		http.Error(w, "Built-in roles can't be changed", http.StatusForbidden)
+		return
+	}
+
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.validatePermissions(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE roles SET description = $2, updated_at = CURRENT_TIMESTAMP WHERE name = $1",
+		name, strings.TrimSpace(req.Description),
+	)
+	if err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+
+	err = setRolePermissions(tx, name, req.Permissions)
+	var role Role
+	if err == nil {
+		role, err = getRole(tx, name)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+// handleDeleteRole removes a custom role nobody holds any more
+func (h *RoleHandler) handleDeleteRole(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if builtInRoles[name] {
+		http.Error(w, "Built-in roles can't be deleted", http.StatusForbidden)
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM roles WHERE name = $1", name)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		http.Error(w, "Role is still assigned to users; move them to another role first", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete role", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetMyPermissions tells the client which admin areas to show
+func (h *RoleHandler) handleGetMyPermissions(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	role, permissions, err := userPermissions(h.db, userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch permissions", http.StatusInternalServerError)
+		return
+	}
+	if permissions == nil {
+		permissions = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"role":        role,
+		"permissions": permissions,
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRoleRequestValidatePermissions(t *testing.T) {
+	tests := []struct {
+		permissions []string
+		valid       bool
+	}{
+		{nil, true},
+		{[]string{"orders.read", "routes.assign"}, true},
+		{[]string{"orders.read", "orders.read"}, false},
+		{[]string{"orders.delete"}, false},
+	}
+	for _, tt := range tests {
+		req := RoleRequest{Permissions: tt.permissions}
+		if err := req.validatePermissions(); (err == nil) != tt.valid {
+			t.Errorf("validatePermissions(%v) = %v, expected valid=%v", tt.permissions, err, tt.valid)
+		}
+	}
+}
+
+func TestCustomRolePermissions(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "roles-admin@example.com", "Roles", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	staffID := db.CreateTestUser(t, "roles-dispatcher@example.com", "Roles", "Dispatcher")
+	customerID := db.CreateTestUser(t, "roles-customer@example.com", "Roles", "Customer")
+
+	roles := &RoleHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	w := httptest.NewRecorder()
+	roles.handleCreateRole(w, httptest.NewRequest("POST", "/api/v1/admin/roles", strings.NewReader(
+		`{"name": "Dispatcher", "description": "Sees orders and runs routes", "permissions": ["orders.read", "routes.assign"]}`,
+	)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var role Role
+	json.Unmarshal(w.Body.Bytes(), &role)
+	if role.Name != "dispatcher" || len(role.Permissions) != 2 {
+		t.Errorf("Unexpected role: %+v", role)
+	}
+
+	// Assigning the role goes through the usual role endpoint
+	admin := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	req := mux.SetURLVars(httptest.NewRequest("PUT", "/api/v1/admin/users/role", strings.NewReader(`{"role": "dispatcher"}`)),
+		map[string]string{"id": fmt.Sprint(staffID)})
+	w = httptest.NewRecorder()
+	admin.handleUpdateUserRole(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	staff := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(staffID).getUserIDFromRequest}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	for permission, expected := range map[string]int{
+		"orders.read":   http.StatusOK,
+		"routes.assign": http.StatusOK,
+		"payments.read": http.StatusForbidden,
+		"users.manage":  http.StatusForbidden,
+	} {
+		w = httptest.NewRecorder()
+		staff.requirePermission(permission, ok)(w, httptest.NewRequest("GET", "/api/v1/admin/x", nil))
+		if w.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", permission, expected, w.Code)
+		}
+	}
+
+	// Customers hold no admin permissions; admins hold all of them
+	w = httptest.NewRecorder()
+	(&AdminHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest}).requirePermission("orders.read", ok)(w, httptest.NewRequest("GET", "/api/v1/admin/x", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected customers to be forbidden, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	admin.requirePermission("settings.manage", ok)(w, httptest.NewRequest("GET", "/api/v1/admin/x", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected admins to be allowed, got %d", w.Code)
+	}
+
+	// Staff with users.manage still can't hand out the admin role
+	roles.handleUpdateRole(httptest.NewRecorder(), mux.SetURLVars(httptest.NewRequest("PUT", "/api/v1/admin/roles/dispatcher", strings.NewReader(
+		`{"description": "Sees orders, runs routes, edits customers", "permissions": ["orders.read", "routes.assign", "users.manage"]}`,
+	)), map[string]string{"name": "dispatcher"}))
+	req = mux.SetURLVars(httptest.NewRequest("PUT", "/api/v1/admin/users/role", strings.NewReader(`{"role": "admin"}`)),
+		map[string]string{"id": fmt.Sprint(customerID)})
+	w = httptest.NewRecorder()
+	staff.handleUpdateUserRole(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d promoting to admin, got %d", http.StatusForbidden, w.Code)
+	}
+
+	roles.getUserID = CreateAuthMock(staffID).getUserIDFromRequest
+	w = httptest.NewRecorder()
+	roles.handleGetMyPermissions(w, httptest.NewRequest("GET", "/api/v1/account/permissions", nil))
+	if !strings.Contains(w.Body.String(), `"users.manage"`) {
+		t.Errorf("Expected the updated permissions, got %s", w.Body.String())
+	}
+
+	// Built-in roles are fixed, and roles in use can't be deleted
+	w = httptest.NewRecorder()
+	roles.handleDeleteRole(w, mux.SetURLVars(httptest.NewRequest("DELETE", "/api/v1/admin/roles/admin", nil), map[string]string{"name": "admin"}))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d deleting a built-in role, got %d", http.StatusForbidden, w.Code)
+	}
+	w = httptest.NewRecorder()
+	roles.handleDeleteRole(w, mux.SetURLVars(httptest.NewRequest("DELETE", "/api/v1/admin/roles/dispatcher", nil), map[string]string{"name": "dispatcher"}))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d deleting a role in use, got %d", http.StatusConflict, w.Code)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Stop photo quality thresholds. Photos outside them are still stored, since
+// a poor photo beats none, but flagged to admins and the driver.
+const (
+	minStopPhotoShortSide = 480
+	minStopPhotoLongSide  = 640
+	// Mean luma on a 0-255 scale
+	minStopPhotoBrightness = 40
+	maxStopPhotoBrightness = 235
+	// EXIF times carry no zone, so any UTC offset is allowed for
+	stopPhotoClockSkew = 14 * time.Hour
+	// A photo taken longer than this before upload wasn't taken at the stop
+	maxStopPhotoAge = 2 * time.Hour
+
+	defaultFlaggedPhotoLimit = 100
+	maxFlaggedPhotoLimit     = 500
+)
+
+const (
+	photoIssueUnreadable      = "unreadable"
+	photoIssueLowResolution   = "low_resolution"
+	photoIssueTooDark         = "too_dark"
+	photoIssueOverexposed     = "overexposed"
+	photoIssueStaleTimestamp  = "stale_timestamp"
+	photoIssueFutureTimestamp = "future_timestamp"
+	photoIssueDuplicate       = "duplicate"
+)
+
+// photoQuality is what the upload checks measured. Brightness is only known
+// for formats the server can decode (PNG and JPEG).
+type photoQuality struct {
+	Width       int
+	Height      int
+	Brightness  *int
+	CapturedAt  *time.Time
+	ContentHash string
+	Issues      []string
+}
+
+// analyzeStopPhoto runs the checks that need only the image itself. Checks
+// against earlier photos (duplicates) are up to the caller.
+func analyzeStopPhoto(data []byte, contentType string, now time.Time) photoQuality {
+	sum := sha256.Sum256(data)
+	q := photoQuality{ContentHash: hex.EncodeToString(sum[:]), Issues: []string{}}
+
+	var img image.Image
+	var err error
+	switch contentType {
+	case "image/jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	case "image/png":
+		img, err = png.Decode(bytes.NewReader(data))
+	case "image/webp":
+		q.Width, q.Height, err = webpSize(data)
+	}
+	if err != nil {
+		q.Issues = append(q.Issues, photoIssueUnreadable)
+		return q
+	}
+	if img != nil {
+		bounds := img.Bounds()
+		q.Width, q.Height = bounds.Dx(), bounds.Dy()
+		brightness := meanBrightness(img)
+		q.Brightness = &brightness
+	}
+
+	short, long := q.Width, q.Height
+	if short > long {
+		short, long = long, short
+	}
+	if short < minStopPhotoShortSide || long < minStopPhotoLongSide {
+		q.Issues = append(q.Issues, photoIssueLowResolution)
+	}
+	if q.Brightness != nil && *q.Brightness < minStopPhotoBrightness {
+		q.Issues = append(q.Issues, photoIssueTooDark)
+	}
+	if q.Brightness != nil && *q.Brightness > maxStopPhotoBrightness {
+		q.Issues = append(q.Issues, photoIssueOverexposed)
+	}
+
+	if contentType == "image/jpeg" {
+		q.CapturedAt = exifCaptureTime(data)
+	}
+	if q.CapturedAt != nil {
+		// The wall clock time is compared as if it were UTC
+		if q.CapturedAt.Before(now.Add(-maxStopPhotoAge - stopPhotoClockSkew)) {
+			q.Issues = append(q.Issues, photoIssueStaleTimestamp)
+		} else if q.CapturedAt.After(now.Add(stopPhotoClockSkew)) {
+			q.Issues = append(q.Issues, photoIssueFutureTimestamp)
+		}
+	}
+	return q
+}
+
+// meanBrightness averages the luma of up to about 64x64 evenly spaced pixels
+func meanBrightness(img image.Image) int {
+	bounds := img.Bounds()
+	stepX, stepY := bounds.Dx()/64, bounds.Dy()/64
+	if stepX < 1 {
+		stepX = 1
+	}
+	if stepY < 1 {
+		stepY = 1
+	}
+
+	var total, samples int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			total += int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			samples++
+		}
+	}
+	if samples == 0 {
+		return 0
+	}
+	return total / samples
+}
+
+// webpSize reads a WebP image's dimensions from its header. There's no WebP
+// decoder in the standard library, so brightness isn't checked for them.
+func webpSize(data []byte) (int, int, error) {
+	if len(data) < 30 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, 0, fmt.Errorf("not a WebP image")
+	}
+	switch string(data[12:16]) {
+	case "VP8X":
+		width := int(data[24]) | int(data[25])<<8 | int(data[26])<<16
+		height := int(data[27]) | int(data[28])<<8 | int(data[29])<<16
+		return width + 1, height + 1, nil
+	case "VP8 ":
+		if !bytes.Equal(data[23:26], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, fmt.Errorf("bad VP8 frame")
+		}
+		return int(binary.LittleEndian.Uint16(data[26:]) & 0x3fff), int(binary.LittleEndian.Uint16(data[28:]) & 0x3fff), nil
+	case "VP8L":
+		if data[20] != 0x2f {
+			return 0, 0, fmt.Errorf("bad VP8L signature")
+		}
+		bits := binary.LittleEndian.Uint32(data[21:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	}
+	return 0, 0, fmt.Errorf("unknown WebP chunk")
+}
+
+// exifCaptureTime returns when a JPEG says it was taken: DateTimeOriginal,
+// falling back to DateTime. The time is the camera's wall clock, labelled UTC.
+func exifCaptureTime(data []byte) *time.Time {
+	tiff := jpegExif(data)
+	if len(tiff) < 8 {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil
+	}
+	ifd0 := order.Uint32(tiff[4:])
+
+	var value string
+	if entry := exifEntry(tiff, order, ifd0, 0x8769); entry != nil {
+		if entry := exifEntry(tiff, order, order.Uint32(entry[8:]), 0x9003); entry != nil {
+			value = exifASCII(tiff, order, entry)
+		}
+	}
+	if value == "" {
+		if entry := exifEntry(tiff, order, ifd0, 0x0132); entry != nil {
+			value = exifASCII(tiff, order, entry)
+		}
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// jpegExif returns the TIFF data of a JPEG's Exif segment, if it has one
+func jpegExif(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return nil
+		}
+		marker := data[i+1]
+		// Start of scan: the metadata segments are all before it
+		if marker == 0xda || marker == 0xd9 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		segment := data[i+4 : end]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i = end
+	}
+	return nil
+}
+
+// exifEntry finds a tag's 12 byte entry in the IFD at offset
+func exifEntry(tiff []byte, order binary.ByteOrder, offset uint32, tag uint16) []byte {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			return nil
+		}
+		if order.Uint16(tiff[start:]) == tag {
+			return tiff[start : start+12]
+		}
+	}
+	return nil
+}
+
+// exifASCII reads a string tag's value, stored inline when it fits in 4 bytes
+func exifASCII(tiff []byte, order binary.ByteOrder, entry []byte) string {
+	count := order.Uint32(entry[4:])
+	var value []byte
+	if count <= 4 {
+		value = entry[8 : 8+count]
+	} else {
+		offset := order.Uint32(entry[8:])
+		if uint64(offset)+uint64(count) > uint64(len(tiff)) {
+			return ""
+		}
+		value = tiff[offset : offset+count]
+	}
+	return strings.TrimRight(string(value), "\x00 ")
+}
+
+// validDeviceHash reports whether a hash sent by the driver app looks like
+// a hex SHA-256 of the photo as taken
+func validDeviceHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// stopPhotoDuplicated reports whether the same image was already uploaded for
+// another stop. The device hash catches photos the app re-encoded.
+func stopPhotoDuplicated(q queryRower, routeOrderID int, contentHash string, deviceHash *string) (bool, error) {
+	var duplicated bool
+	err := q.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM stop_photos
+			WHERE route_order_id <> $1 AND (content_hash = $2 OR device_hash = $3)
+		)`,
+		routeOrderID, contentHash, deviceHash,
+	).Scan(&duplicated)
+	return duplicated, err
+}
+
+// describePhotoIssues turns issue codes into a readable list
+func describePhotoIssues(issues []string) string {
+	described := make([]string, len(issues))
+	for i, issue := range issues {
+		described[i] = strings.ReplaceAll(issue, "_", " ")
+	}
+	return strings.Join(described, ", ")
+}
+
+// FlaggedStopPhoto is a stop photo that failed a quality check, with what the
+// checks measured
+type FlaggedStopPhoto struct {
+	StopPhoto
+	DriverID   *int       `json:"driver_id"`
+	DriverName *string    `json:"driver_name"`
+	Width      *int       `json:"width"`
+	Height     *int       `json:"height"`
+	Brightness *int       `json:"brightness"`
+	CapturedAt *time.Time `json:"captured_at"`
+}
+
+// handleGetFlaggedStopPhotos lists non-compliant stop photos, newest first,
+// optionally for one driver_id
+func (h *ProofOfDeliveryHandler) handleGetFlaggedStopPhotos(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var driverID int
+	var err error
+	if v := query.Get("driver_id"); v != "" {
+		if driverID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid driver_id", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultFlaggedPhotoLimit
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxFlaggedPhotoLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxFlaggedPhotoLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT sp.id, sp.route_order_id, sp.order_id, dr.route_type, sp.content_type, sp.taken_at, sp.storage_key,
+		       sp.quality_issues, sp.driver_id, u.first_name || ' ' || u.last_name,
+		       sp.width, sp.height, sp.brightness, sp.captured_at
+		FROM stop_photos sp
+		JOIN route_orders ro ON sp.route_order_id = ro.id
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		LEFT JOIN users u ON sp.driver_id = u.id
+		WHERE sp.quality_issues <> '{}' AND ($1 = 0 OR sp.driver_id = $1)
+		ORDER BY sp.taken_at DESC, sp.id DESC
+		LIMIT $2`,
+		driverID, limit,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch photos", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	photos := []FlaggedStopPhoto{}
+	for rows.Next() {
+		var p FlaggedStopPhoto
+		err := rows.Scan(
+			&p.ID, &p.RouteOrderID, &p.OrderID, &p.StopType, &p.ContentType, &p.TakenAt, &p.storageKey,
+			pq.Array(&p.QualityIssues), &p.DriverID, &p.DriverName,
+			&p.Width, &p.Height, &p.Brightness, &p.CapturedAt,
+		)
+		if err != nil {
+			http.Error(w, "Failed to fetch photos", http.StatusInternalServerError)
+			return
+		}
+		photos = append(photos, p)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to fetch photos", http.StatusInternalServerError)
+		return
+	}
+
+	if h.store != nil {
+		for i := range photos {
+			if photos[i].URL, err = h.store.SignedURL(r.Context(), photos[i].storageKey, fileURLExpiry); err != nil {
+				http.Error(w, "Failed to sign photo URL", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(photos)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tumble-backend/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// testPhoto draws a flat grey image of the given size and luma
+func testPhoto(width, height int, luma uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = luma
+	}
+	return img
+}
+
+// testJPEG encodes img, with an Exif DateTimeOriginal when taken is set
+func testJPEG(t *testing.T, img image.Image, taken *time.Time) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+	if taken == nil {
+		return buf.Bytes()
+	}
+
+	// IFD0 points at an Exif IFD holding DateTimeOriginal
+	tiff := []byte("II\x2a\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = append(tiff, 0x69, 0x87, 4, 0, 1, 0, 0, 0, 26, 0, 0, 0, 0, 0, 0, 0)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = append(tiff, 0x03, 0x90, 2, 0, 20, 0, 0, 0, 44, 0, 0, 0, 0, 0, 0, 0)
+	tiff = append(tiff, taken.Format("2006:01:02 15:04:05")+"\x00"...)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := binary.BigEndian.AppendUint16([]byte{0xff, 0xe1}, uint16(len(segment)+2))
+	data := append([]byte{0xff, 0xd8}, app1...)
+	data = append(data, segment...)
+	return append(data, buf.Bytes()[2:]...)
+}
+
+func TestAnalyzeStopPhoto(t *testing.T) {
+	now := time.Date(2026, 10, 16, 18, 0, 0, 0, time.UTC)
+	recent := now.Add(-5 * time.Hour) // A driver at UTC-5 a few minutes ago
+	old := now.AddDate(0, 0, -3)
+
+	var darkPNG bytes.Buffer
+	png.Encode(&darkPNG, testPhoto(800, 600, 10))
+
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		issues      []string
+	}{
+		{"good photo", testJPEG(t, testPhoto(800, 600, 120), &recent), "image/jpeg", nil},
+		{"no exif", testJPEG(t, testPhoto(600, 800, 120), nil), "image/jpeg", nil},
+		{"night shot", darkPNG.Bytes(), "image/png", []string{photoIssueTooDark}},
+		{"thumbnail", testJPEG(t, testPhoto(320, 240, 250), nil), "image/jpeg", []string{photoIssueLowResolution, photoIssueOverexposed}},
+		{"old photo", testJPEG(t, testPhoto(800, 600, 120), &old), "image/jpeg", []string{photoIssueStaleTimestamp}},
+		{"corrupt", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), "image/jpeg", []string{photoIssueUnreadable}},
+	}
+	for _, tt := range tests {
+		q := analyzeStopPhoto(tt.data, tt.contentType, now)
+		if fmt.Sprint(q.Issues) != fmt.Sprint(append([]string{}, tt.issues...)) {
+			t.Errorf("%s: expected issues %v, got %v", tt.name, tt.issues, q.Issues)
+		}
+		if len(q.ContentHash) != 64 {
+			t.Errorf("%s: expected a SHA-256 content hash, got %q", tt.name, q.ContentHash)
+		}
+	}
+
+	q := analyzeStopPhoto(testJPEG(t, testPhoto(800, 600, 120), &recent), "image/jpeg", now)
+	if q.Width != 800 || q.Height != 600 || q.Brightness == nil || q.CapturedAt == nil || !q.CapturedAt.Equal(recent) {
+		t.Errorf("Unexpected measurements: %+v", q)
+	}
+}
+
+func TestWebPSize(t *testing.T) {
+	header := func(chunk string, payload ...byte) []byte {
+		data := []byte("RIFF\x00\x00\x00\x00WEBP" + chunk + "\x00\x00\x00\x00")
+		return append(data, append(payload, make([]byte, 16)...)...)
+	}
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+	}{
+		// Canvas size minus one, 24 bits each
+		{"extended", header("VP8X", 0, 0, 0, 0, 0x1f, 0x03, 0x00, 0x57, 0x02, 0x00), 800, 600},
+		{"lossy", header("VP8 ", 0, 0, 0, 0x9d, 0x01, 0x2a, 0x20, 0x03, 0x58, 0x02), 800, 600},
+		// 14 bits of width minus one then 14 of height minus one
+		{"lossless", header("VP8L", 0x2f, 0x1f, 0xc3, 0x95, 0x00), 800, 600},
+	}
+	for _, tt := range tests {
+		width, height, err := webpSize(tt.data)
+		if err != nil || width != tt.width || height != tt.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d (%v)", tt.name, tt.width, tt.height, width, height, err)
+		}
+	}
+	if _, _, err := webpSize([]byte("RIFF")); err == nil {
+		t.Error("Expected a truncated header rejected")
+	}
+}
+
+func TestStopPhotoQualityFlags(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "quality-driver@example.com", "Quality", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "quality-customer@example.com", "Quality", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'delivery', 'in_progress') RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	addStop := func() int {
+		var routeOrderID int
+		orderID := db.CreateTestOrder(t, customerID, addressID)
+		db.QueryRow("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1) RETURNING id", routeID, orderID).Scan(&routeOrderID)
+		return routeOrderID
+	}
+
+	store := storage.NewLocal(t.TempDir(), "https://tumble.test/api/v1/storage", []byte("secret"))
+	handler := NewDriverRouteHandler(db.DB, NewMockRealtimeHandler())
+	handler.store = store
+	handler.getUserID = CreateAuthMock(driverID).getUserIDFromRequest
+	upload := func(routeOrderID int, image []byte, hash string) StopPhoto {
+		var form bytes.Buffer
+		writer := multipart.NewWriter(&form)
+		part, _ := writer.CreateFormFile("photo", "stop.jpg")
+		part.Write(image)
+		if hash != "" {
+			writer.WriteField("hash", hash)
+		}
+		writer.Close()
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/v1/driver/route-orders/%d/photos", routeOrderID), &form)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(routeOrderID)})
+		w := httptest.NewRecorder()
+		handler.handleUploadStopPhoto(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+		var photo StopPhoto
+		json.Unmarshal(w.Body.Bytes(), &photo)
+		return photo
+	}
+
+	now := time.Now().UTC()
+	good := testJPEG(t, testPhoto(800, 600, 120), &now)
+	deviceHash := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	firstStop, secondStop := addStop(), addStop()
+	if photo := upload(firstStop, good, deviceHash); len(photo.QualityIssues) != 0 {
+		t.Errorf("Expected a compliant photo, got %v", photo.QualityIssues)
+	}
+	// A retake at the same stop is fine; reusing it at another stop isn't, even re-encoded
+	if photo := upload(firstStop, good, ""); len(photo.QualityIssues) != 0 {
+		t.Errorf("Expected a second photo of the same stop allowed, got %v", photo.QualityIssues)
+	}
+	reencoded := testJPEG(t, testPhoto(800, 600, 121), &now)
+	if photo := upload(secondStop, reencoded, deviceHash); fmt.Sprint(photo.QualityIssues) != fmt.Sprint([]string{photoIssueDuplicate}) {
+		t.Errorf("Expected the reused photo flagged as a duplicate, got %v", photo.QualityIssues)
+	}
+	dark := upload(secondStop, testJPEG(t, testPhoto(800, 600, 5), &now), "")
+	if fmt.Sprint(dark.QualityIssues) != fmt.Sprint([]string{photoIssueTooDark}) {
+		t.Errorf("Expected the black photo flagged as too dark, got %v", dark.QualityIssues)
+	}
+
+	var alerts int
+	db.QueryRow("SELECT COUNT(*) FROM admin_inbox_items WHERE dedupe_key = $1", fmt.Sprintf("stop_photo_quality:%d", secondStop)).Scan(&alerts)
+	if alerts != 1 {
+		t.Errorf("Expected one admin alert for the stop, got %d", alerts)
+	}
+
+	w := httptest.NewRecorder()
+	NewProofOfDeliveryHandler(db.DB, store).handleGetFlaggedStopPhotos(w,
+		httptest.NewRequest("GET", fmt.Sprintf("/api/v1/admin/stop-photos/flagged?driver_id=%d", driverID), nil))
+	var flagged []FlaggedStopPhoto
+	json.Unmarshal(w.Body.Bytes(), &flagged)
+	if len(flagged) != 2 || flagged[0].ID != dark.ID || flagged[0].URL == "" ||
+		flagged[0].Brightness == nil || *flagged[0].Brightness > minStopPhotoBrightness || flagged[0].DriverName == nil {
+		t.Errorf("Expected both flagged photos, newest first, got %s", w.Body.String())
+	}
+
+	// Half the photographed stops have a compliant photo
+	db.Exec("UPDATE route_orders SET status = 'completed' WHERE route_id = $1", routeID)
+	cards, err := getScorecards(db.DB, payoutWeekStart(now), driverID)
+	if err != nil || len(cards) != 1 || cards[0].PhotoCompliance == nil || *cards[0].PhotoCompliance != 0.5 {
+		t.Errorf("Expected 50%% photo compliance, got %+v (%v)", cards, err)
+	}
+
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	lockerReadyNotificationType    = "locker_ready"
+	lockerReleasedNotificationType = "locker_released"
+	lockerExpiredAlertType         = "locker_expired"
+	lockerAccessCodeLength         = 6
+)
+
+var (
+	errPickupLocationUnavailable = errors.New("pickup location is not available")
+	errLockerFull                = errors.New("every compartment at this locker is taken")
+)
+
+// activeLockerStatuses are reservations still holding a space
+const activeLockerStatuses = "('reserved', 'occupied')"
+
+// PickupLocationHandler serves the locker and pickup point registry and
+// collections at them
+type PickupLocationHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewPickupLocationHandler(db *sql.DB) *PickupLocationHandler {
+	return &PickupLocationHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// PickupLocation is a locker or staffed pickup point orders can be
+// delivered to. Lockers have a fixed number of compartments; pickup points
+// take any number of orders.
+type PickupLocation struct {
+	ID            int     `json:"id"`
+	Name          string  `json:"name"`
+	LocationType  string  `json:"location_type"` // locker or pickup_point
+	StreetAddress string  `json:"street_address"`
+	City          string  `json:"city"`
+	State         string  `json:"state"`
+	ZipCode       string  `json:"zip_code"`
+	Compartments  *int    `json:"compartments,omitempty"`
+	HoldHours     int     `json:"hold_hours"`
+	Instructions  *string `json:"instructions,omitempty"`
+	IsActive      bool    `json:"is_active"`
+	// Available is the compartments not held by an order; unset for pickup points
+	Available *int      `json:"available,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const pickupLocationColumns = `id, name, location_type, street_address, city, state, zip_code, compartments,
+	hold_hours, instructions, is_active, created_at,
+	compartments - (SELECT COUNT(*) FROM locker_reservations lr
+		WHERE lr.location_id = pickup_locations.id AND lr.status IN ` + activeLockerStatuses + `)`
+
+func scanPickupLocation(scanner interface{ Scan(...interface{}) error }) (PickupLocation, error) {
+	var l PickupLocation
+	err := scanner.Scan(&l.ID, &l.Name, &l.LocationType, &l.StreetAddress, &l.City, &l.State, &l.ZipCode,
+		&l.Compartments, &l.HoldHours, &l.Instructions, &l.IsActive, &l.CreatedAt, &l.Available)
+	return l, err
+}
+
+func validatePickupLocation(l PickupLocation) error {
+	if strings.TrimSpace(l.Name) == "" || strings.TrimSpace(l.StreetAddress) == "" ||
+		strings.TrimSpace(l.City) == "" || strings.TrimSpace(l.State) == "" {
+		return errors.New("name, street_address, city and state are required")
+	}
+	if _, ok := normalizeZipCode(l.ZipCode); !ok {
+		return errors.New("invalid zip_code")
+	}
+	switch l.LocationType {
+	case "locker":
+		if l.Compartments == nil || *l.Compartments < 1 {
+			return errors.New("lockers need at least one compartment")
+		}
+	case "pickup_point":
+		if l.Compartments != nil {
+			return errors.New("pickup points don't have compartments")
+		}
+	default:
+		return errors.New("location_type must be locker or pickup_point")
+	}
+	if l.HoldHours < 1 {
+		return errors.New("hold_hours must be at least 1")
+	}
+	return nil
+}
+
+// LockerReservation is the space an order holds at a pickup location. The
+// access code is issued when the order is dropped off.
+type LockerReservation struct {
+	ID            int        `json:"id"`
+	OrderID       int        `json:"order_id"`
+	LocationID    int        `json:"location_id"`
+	LocationName  string     `json:"location_name"`
+	Address       string     `json:"address"`
+	Status        string     `json:"status"` // reserved, occupied, collected, released
+	AccessCode    *string    `json:"access_code,omitempty"`
+	DroppedOffAt  *time.Time `json:"dropped_off_at,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	CollectedAt   *time.Time `json:"collected_at,omitempty"`
+	ReleasedAt    *time.Time `json:"released_at,omitempty"`
+	ReleaseReason *string    `json:"release_reason,omitempty"`
+}
+
+const lockerReservationColumns = `lr.id, lr.order_id, lr.location_id, pl.name,
+	pl.street_address || ', ' || pl.city || ', ' || pl.state || ' ' || pl.zip_code,
+	lr.status, lr.access_code, lr.dropped_off_at, lr.expires_at, lr.collected_at, lr.released_at, lr.release_reason`
+
+func scanLockerReservation(scanner interface{ Scan(...interface{}) error }) (LockerReservation, error) {
+	var lr LockerReservation
+	err := scanner.Scan(&lr.ID, &lr.OrderID, &lr.LocationID, &lr.LocationName, &lr.Address, &lr.Status,
+		&lr.AccessCode, &lr.DroppedOffAt, &lr.ExpiresAt, &lr.CollectedAt, &lr.ReleasedAt, &lr.ReleaseReason)
+	return lr, err
+}
+
+// getOrderLocker returns the order's latest locker reservation, or nil when
+// it's delivered to an address
+func getOrderLocker(q queryRower, orderID int) (*LockerReservation, error) {
+	lr, err := scanLockerReservation(q.QueryRow(`
+		SELECT `+lockerReservationColumns+`
+		FROM locker_reservations lr
+		JOIN pickup_locations pl ON lr.location_id = pl.id
+		WHERE lr.order_id = $1
+		ORDER BY lr.created_at DESC, lr.id DESC
+		LIMIT 1`,
+		orderID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lr, nil
+}
+
+// reserveLocker holds a space at the location for a new order. The location
+// row is locked so two checkouts can't take the last compartment.
+func reserveLocker(tx *sql.Tx, orderID, locationID int) error {
+	var compartments sql.NullInt64
+	var active bool
+	err := tx.QueryRow("SELECT compartments, is_active FROM pickup_locations WHERE id = $1 FOR UPDATE", locationID).
+		Scan(&compartments, &active)
+	if err == sql.ErrNoRows || (err == nil && !active) {
+		return errPickupLocationUnavailable
+	}
+	if err != nil {
+		return err
+	}
+
+	if compartments.Valid {
+		var held int64
+		if err := tx.QueryRow(
+			"SELECT COUNT(*) FROM locker_reservations WHERE location_id = $1 AND status IN "+activeLockerStatuses,
+			locationID,
+		).Scan(&held); err != nil {
+			return err
+		}
+		if held >= compartments.Int64 {
+			return errLockerFull
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO locker_reservations (order_id, location_id) VALUES ($1, $2)", orderID, locationID)
+	return err
+}
+
+// releaseOrderLocker gives up the space an order was holding before drop-off
+func releaseOrderLocker(q execer, orderID int, reason string) error {
+	_, err := q.Exec(`
+		UPDATE locker_reservations
+		SET status = 'released', release_reason = $2, released_at = CURRENT_TIMESTAMP
+		WHERE order_id = $1 AND status = 'reserved'`,
+		orderID, reason,
+	)
+	return err
+}
+
+func generateLockerAccessCode() (string, error) {
+	code := make([]byte, lockerAccessCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+	return string(code), nil
+}
+
+// dropOffLocker marks the order's reserved space occupied when the driver
+// completes its delivery, and sends the customer the access code. It
+// returns nil when the order isn't going to a locker.
+func dropOffLocker(tx *sql.Tx, orderID int) (*LockerReservation, error) {
+	var reservationID, locationID int
+	err := tx.QueryRow(
+		"SELECT id, location_id FROM locker_reservations WHERE order_id = $1 AND status = 'reserved' FOR UPDATE",
+		orderID,
+	).Scan(&reservationID, &locationID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Codes only need to be unique among the orders waiting at one location
+	var code string
+	for taken := true; taken; {
+		if code, err = generateLockerAccessCode(); err != nil {
+			return nil, err
+		}
+		if err := tx.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM locker_reservations WHERE location_id = $1 AND status = 'occupied' AND access_code = $2)",
+			locationID, code,
+		).Scan(&taken); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE locker_reservations lr
+		SET status = 'occupied', access_code = $2, dropped_off_at = CURRENT_TIMESTAMP,
+		    expires_at = CURRENT_TIMESTAMP + pl.hold_hours * INTERVAL '1 hour'
+		FROM pickup_locations pl
+		WHERE lr.location_id = pl.id AND lr.id = $1`,
+		reservationID, code,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	reservation, err := getOrderLocker(tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	message := fmt.Sprintf("Your laundry is waiting at %s, %s. Your access code is %s. Please collect it by %s.",
+		reservation.LocationName, reservation.Address, code, reservation.ExpiresAt.Format("Monday, January 2 at 3:04 PM MST"))
+	_, err = tx.Exec(`
+		INSERT INTO notifications (user_id, order_id, type, title, message)
+		SELECT user_id, id, $2, 'Ready for collection', $3 FROM orders WHERE id = $1`,
+		orderID, lockerReadyNotificationType, message,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// processLockerReleases frees spaces nobody will use: reservations for
+// cancelled orders, and dropped-off orders not collected within the
+// location's hold window. Ops is alerted to retrieve the uncollected ones.
+func (s *AutoScheduler) processLockerReleases() {
+	// Customers' own cancellations release straight away; this catches the rest
+	_, err := s.db.Exec(`
+		UPDATE locker_reservations
+		SET status = 'released', release_reason = 'cancelled', released_at = CURRENT_TIMESTAMP
+		WHERE status = 'reserved' AND order_id IN (SELECT id FROM orders WHERE status = 'cancelled')`)
+	if err != nil {
+		log.Printf("Error releasing lockers for cancelled orders: %v", err)
+	}
+
+	rows, err := s.db.Query(`
+		UPDATE locker_reservations lr
+		SET status = 'released', release_reason = 'expired', released_at = CURRENT_TIMESTAMP
+		FROM pickup_locations pl, orders o
+		WHERE lr.location_id = pl.id AND lr.order_id = o.id
+		  AND lr.status = 'occupied' AND lr.expires_at < CURRENT_TIMESTAMP
+		RETURNING lr.order_id, o.user_id, pl.name`)
+	if err != nil {
+		log.Printf("Error releasing expired lockers: %v", err)
+		return
+	}
+	type expiredLocker struct {
+		orderID, userID int
+		location        string
+	}
+	var expired []expiredLocker
+	for rows.Next() {
+		var e expiredLocker
+		if err := rows.Scan(&e.orderID, &e.userID, &e.location); err != nil {
+			log.Printf("Error scanning expired locker: %v", err)
+			continue
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+
+	for _, e := range expired {
+		orderID := e.orderID
+		_, err := s.db.Exec(`
+			INSERT INTO notifications (user_id, order_id, type, title, message)
+			VALUES ($1, $2, $3, 'Collection window ended', $4)`,
+			e.userID, orderID, lockerReleasedNotificationType,
+			fmt.Sprintf("Your laundry wasn't collected from %s in time, so we've taken it back. We'll be in touch to arrange delivery.", e.location),
+		)
+		if err != nil {
+			log.Printf("Error notifying customer of expired locker for order %d: %v", orderID, err)
+		}
+		logAdminAlert(s.db, AdminAlert{
+			Type:      lockerExpiredAlertType,
+			Severity:  "warning",
+			Title:     fmt.Sprintf("Order #%d not collected from %s", orderID, e.location),
+			Message:   fmt.Sprintf("Order #%d's collection window at %s ended. Retrieve it and arrange redelivery.", orderID, e.location),
+			OrderID:   &orderID,
+			DedupeKey: fmt.Sprintf("%s:%d", lockerExpiredAlertType, orderID),
+		})
+	}
+	if len(expired) > 0 {
+		log.Printf("Released %d uncollected lockers", len(expired))
+	}
+}
+
+// handleGetPickupLocations lists the active lockers and pickup points,
+// nearest zip codes first when ?zip= is given
+func (h *PickupLocationHandler) handleGetPickupLocations(w http.ResponseWriter, r *http.Request) {
+	h.writePickupLocations(w, r.URL.Query().Get("zip"), true)
+}
+
+// handleAdminGetPickupLocations lists every location, including inactive ones
+func (h *PickupLocationHandler) handleAdminGetPickupLocations(w http.ResponseWriter, r *http.Request) {
+	h.writePickupLocations(w, "", false)
+}
+
+func (h *PickupLocationHandler) writePickupLocations(w http.ResponseWriter, zip string, activeOnly bool) {
+	rows, err := h.db.Query(`
+		SELECT `+pickupLocationColumns+`
+		FROM pickup_locations
+		WHERE is_active OR NOT $1
+		ORDER BY zip_code = $2 DESC, LEFT(zip_code, 3) = LEFT($2, 3) DESC, name`,
+		activeOnly, zip,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch pickup locations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	locations := []PickupLocation{}
+	for rows.Next() {
+		l, err := scanPickupLocation(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch pickup locations", http.StatusInternalServerError)
+			return
+		}
+		locations = append(locations, l)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(locations)
+}
+
+// handleAdminCreatePickupLocation adds a locker or pickup point
+func (h *PickupLocationHandler) handleAdminCreatePickupLocation(w http.ResponseWriter, r *http.Request) {
+	req := PickupLocation{IsActive: true, HoldHours: 72}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validatePickupLocation(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.ZipCode, _ = normalizeZipCode(req.ZipCode)
+
+	location, err := scanPickupLocation(h.db.QueryRow(`
+		INSERT INTO pickup_locations (name, location_type, street_address, city, state, zip_code,
+			compartments, hold_hours, instructions, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING `+pickupLocationColumns,
+		req.Name, req.LocationType, req.StreetAddress, req.City, req.State, req.ZipCode,
+		req.Compartments, req.HoldHours, req.Instructions, req.IsActive,
+	))
+	if err != nil {
+		http.Error(w, "Failed to create pickup location", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(location)
+}
+
+// handleAdminUpdatePickupLocation replaces a location's details. Shrinking a
+// locker doesn't cancel reservations already holding its compartments.
+func (h *PickupLocationHandler) handleAdminUpdatePickupLocation(w http.ResponseWriter, r *http.Request) {
+	locationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+
+	var req PickupLocation
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validatePickupLocation(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.ZipCode, _ = normalizeZipCode(req.ZipCode)
+
+	location, err := scanPickupLocation(h.db.QueryRow(`
+		UPDATE pickup_locations
+		SET name = $1, location_type = $2, street_address = $3, city = $4, state = $5, zip_code = $6,
+		    compartments = $7, hold_hours = $8, instructions = $9, is_active = $10, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $11
+		RETURNING `+pickupLocationColumns,
+		req.Name, req.LocationType, req.StreetAddress, req.City, req.State, req.ZipCode,
+		req.Compartments, req.HoldHours, req.Instructions, req.IsActive, locationID,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Pickup location not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update pickup location", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(location)
+}
+
+// handleAdminDeletePickupLocation stops offering a location. It's
+// deactivated rather than deleted because reservations reference it, and
+// orders already headed there still arrive.
+func (h *PickupLocationHandler) handleAdminDeletePickupLocation(w http.ResponseWriter, r *http.Request) {
+	locationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec("UPDATE pickup_locations SET is_active = false, updated_at = CURRENT_TIMESTAMP WHERE id = $1", locationID)
+	if err != nil {
+		http.Error(w, "Failed to delete pickup location", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Pickup location not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCollectLocker records a customer collecting their order with its
+// access code, at the locker's terminal or a pickup point's counter, and
+// frees the space
+func (h *PickupLocationHandler) handleCollectLocker(w http.ResponseWriter, r *http.Request) {
+	locationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid location ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		AccessCode string `json:"access_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.AccessCode) == "" {
+		http.Error(w, "access_code is required", http.StatusBadRequest)
+		return
+	}
+
+	var orderID int
+	err = h.db.QueryRow(`
+		UPDATE locker_reservations
+		SET status = 'collected', collected_at = CURRENT_TIMESTAMP
+		WHERE location_id = $1 AND access_code = $2 AND status = 'occupied'
+		RETURNING order_id`,
+		locationID, strings.TrimSpace(req.AccessCode),
+	).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No order waiting here with that access code", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to record collection", http.StatusInternalServerError)
+		return
+	}
+	setAuditTarget(r, h.db, "orders", orderID)
+
+	reservation, err := getOrderLocker(h.db, orderID)
+	if err != nil {
+		http.Error(w, "Failed to record collection", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservation)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidatePickupLocation(t *testing.T) {
+	two := 2
+	locker := PickupLocation{Name: "Main St Lockers", LocationType: "locker", StreetAddress: "1 Main St",
+		City: "Springfield", State: "IL", ZipCode: "62701", Compartments: &two, HoldHours: 72}
+	if err := validatePickupLocation(locker); err != nil {
+		t.Errorf("Expected a valid locker, got %v", err)
+	}
+
+	noCompartments := locker
+	noCompartments.Compartments = nil
+	counter := locker
+	counter.LocationType = "pickup_point"
+	noHold := locker
+	noHold.HoldHours = 0
+	for name, l := range map[string]PickupLocation{
+		"locker without compartments":    noCompartments,
+		"pickup point with compartments": counter,
+		"no hold window":                 noHold,
+	} {
+		if err := validatePickupLocation(l); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+}
+
+func TestLockerDelivery(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "locker-admin@example.com", "Locker", "Admin")
+	locations := &PickupLocationHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	w := httptest.NewRecorder()
+	locations.handleAdminCreatePickupLocation(w, httptest.NewRequest("POST", "/api/v1/admin/pickup-locations", strings.NewReader(
+		`{"name": "Station Lockers", "location_type": "locker", "street_address": "2 Station Rd", "city": "Springfield", "state": "IL", "zip_code": "62701", "compartments": 1, "hold_hours": 24}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var location PickupLocation
+	json.Unmarshal(w.Body.Bytes(), &location)
+
+	driverID := db.CreateTestUser(t, "locker-driver@example.com", "Locker", "Driver")
+	db.Exec("UPDATE users SET role = 'driver', requires_delivery_signature = true WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "locker-customer@example.com", "Locker", "Customer")
+	db.Exec("UPDATE users SET requires_delivery_signature = true WHERE id = $1", customerID)
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	otherOrderID := db.CreateTestOrder(t, customerID, addressID)
+
+	// The locker's one compartment goes to the first order
+	reserve := func(orderID int) error {
+		tx, _ := db.Begin()
+		defer tx.Rollback()
+		if err := reserveLocker(tx, orderID, location.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if err := reserve(orderID); err != nil {
+		t.Fatalf("Expected the compartment reserved, got %v", err)
+	}
+	if err := reserve(otherOrderID); err != errLockerFull {
+		t.Errorf("Expected the locker full, got %v", err)
+	}
+
+	// Completing the delivery needs no signature and issues the access code
+	var routeID, routeOrderID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'delivery', 'in_progress') RETURNING id`, driverID).Scan(&routeID)
+	db.QueryRow("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1) RETURNING id", routeID, orderID).Scan(&routeOrderID)
+	driver := NewDriverRouteHandler(db.DB, NewMockRealtimeHandler())
+	driver.getUserID = CreateAuthMock(driverID).getUserIDFromRequest
+	w = httptest.NewRecorder()
+	driver.handleUpdateRouteOrderStatus(w, httptest.NewRequest("PUT", fmt.Sprintf("/api/v1/driver/route-orders/status?id=%d", routeOrderID), strings.NewReader(`{"status": "completed"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	reservation, err := getOrderLocker(db.DB, orderID)
+	if err != nil || reservation == nil || reservation.Status != "occupied" || reservation.AccessCode == nil || reservation.ExpiresAt == nil {
+		t.Fatalf("Expected an occupied locker with an access code, got %+v %v", reservation, err)
+	}
+	var notified int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE order_id = $1 AND type = $2 AND message LIKE '%' || $3 || '%'",
+		orderID, lockerReadyNotificationType, *reservation.AccessCode).Scan(&notified)
+	if notified != 1 {
+		t.Errorf("Expected the customer sent the access code, got %d notifications", notified)
+	}
+
+	collect := func(code string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		locations.handleCollectLocker(w, mux.SetURLVars(
+			httptest.NewRequest("POST", "/api/v1/admin/pickup-locations/x/collect", bytes.NewBufferString(`{"access_code": "`+code+`"}`)),
+			map[string]string{"id": fmt.Sprint(location.ID)},
+		))
+		return w
+	}
+	if w := collect("not-the-code"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a wrong code, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Left uncollected past the hold window, the space is released and ops alerted
+	db.Exec("UPDATE locker_reservations SET expires_at = NOW() - INTERVAL '1 minute' WHERE order_id = $1", orderID)
+	(&AutoScheduler{db: db.DB}).processLockerReleases()
+	reservation, _ = getOrderLocker(db.DB, orderID)
+	var alerts int
+	db.QueryRow("SELECT COUNT(*) FROM admin_inbox_items WHERE alert_type = $1 AND order_id = $2", lockerExpiredAlertType, orderID).Scan(&alerts)
+	if reservation.Status != "released" || reservation.ReleaseReason == nil || *reservation.ReleaseReason != "expired" || alerts != 1 {
+		t.Errorf("Expected the locker released as expired and raised, got %+v and %d alerts", reservation, alerts)
+	}
+	if w := collect(*reservation.AccessCode); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a released locker's code to stop working, got %d", w.Code)
+	}
+	if err := reserve(otherOrderID); err != nil {
+		t.Errorf("Expected the freed compartment reservable, got %v", err)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	pickupReminderNotificationType = "pickup_reminder"
+	// Customers can push a pickup out at most this far from the original date
+	pickupRescheduleMaxDays = 14
+)
+
+// remindableOrderStatuses are the order statuses that still have a pickup ahead
+var remindableOrderStatuses = pickupAheadOrderStatuses()
+
+// PickupReminderHandler serves the tokenized confirm/reschedule links sent
+// with pickup reminders and the dispatch view of unconfirmed pickups
+type PickupReminderHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewPickupReminderHandler(db *sql.DB) *PickupReminderHandler {
+	return &PickupReminderHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type PickupReminder struct {
+	OrderID        int        `json:"order_id"`
+	Status         string     `json:"status"`
+	PickupDate     string     `json:"pickup_date"`
+	PickupTimeSlot string     `json:"pickup_time_slot"`
+	Address        string     `json:"address"`
+	RespondedAt    *time.Time `json:"responded_at,omitempty"`
+}
+
+// pickupReminderLinks builds the one-tap links included in a reminder
+func pickupReminderLinks(token string) (confirmURL, rescheduleURL string) {
+	frontendURL := os.Getenv("FRONTEND_URL")
+	confirmURL = fmt.Sprintf("%s/pickups/confirm?token=%s", frontendURL, token)
+	rescheduleURL = fmt.Sprintf("%s/pickups/reschedule?token=%s", frontendURL, token)
+	return confirmURL, rescheduleURL
+}
+
+// processPickupReminders reminds customers with a pickup tomorrow to put their
+// bags out. Each pickup date gets at most one reminder per order.
+func (s *AutoScheduler) processPickupReminders() {
+	log.Println("Processing pickup reminders...")
+
+	rows, err := s.db.Query(`
+		SELECT o.id, o.user_id, o.pickup_date, COALESCE(o.pickup_time_slot, '')
+		FROM orders o
+		WHERE o.pickup_date = CURRENT_DATE + 1
+		  AND o.status = ANY($1)
+		  AND NOT EXISTS (
+			SELECT 1 FROM pickup_reminders pr
+			WHERE pr.order_id = o.id AND pr.pickup_date = o.pickup_date
+		  )`,
+		pq.Array(remindableOrderStatuses),
+	)
+	if err != nil {
+		log.Printf("Error fetching orders for pickup reminders: %v", err)
+		return
+	}
+
+	type upcomingPickup struct {
+		OrderID    int
+		UserID     int
+		PickupDate time.Time
+		TimeSlot   string
+	}
+	var pickups []upcomingPickup
+	for rows.Next() {
+		var p upcomingPickup
+		if err := rows.Scan(&p.OrderID, &p.UserID, &p.PickupDate, &p.TimeSlot); err != nil {
+			log.Printf("Error scanning pickup reminder order: %v", err)
+			continue
+		}
+		pickups = append(pickups, p)
+	}
+	rows.Close()
+
+	sent := 0
+	for _, p := range pickups {
+		if err := s.sendPickupReminder(p.OrderID, p.UserID, p.PickupDate, p.TimeSlot); err != nil {
+			log.Printf("Error sending pickup reminder for order %d: %v", p.OrderID, err)
+			continue
+		}
+		sent++
+	}
+
+	log.Printf("Sent %d pickup reminders", sent)
+}
+
+func (s *AutoScheduler) sendPickupReminder(orderID, userID int, pickupDate time.Time, timeSlot string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	token := generateRandomString(32)
+	_, err = tx.Exec(`
+		INSERT INTO pickup_reminders (order_id, user_id, pickup_date, token)
+		VALUES ($1, $2, $3, $4)`,
+		orderID, userID, pickupDate, token,
+	)
+	if err != nil {
+		return err
+	}
+
+	window := ""
+	if timeSlot != "" {
+		window = fmt.Sprintf(" between %s", timeSlot)
+	}
+	confirmURL, rescheduleURL := pickupReminderLinks(token)
+	message := fmt.Sprintf("Your pickup is tomorrow, %s%s. Please have your bags out and confirm here: %s. "+
+		"Need a different day? Reschedule here: %s",
+		pickupDate.Format("Monday, January 2"), window, confirmURL, rescheduleURL)
+	_, err = tx.Exec(`
+		INSERT INTO notifications (user_id, order_id, type, title, message)
+		VALUES ($1, $2, $3, $4, $5)`,
+		userID, orderID, pickupReminderNotificationType, "Pickup tomorrow", message,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// loadPickupReminder resolves a reminder token. Tokens only work while the
+// pickup they were sent for is still ahead; a rescheduled or completed pickup
+// expires them.
+func (h *PickupReminderHandler) loadPickupReminder(tx *sql.Tx, token string) (id, orderID, userID int, err error) {
+	var status string
+	err = tx.QueryRow(`
+		SELECT pr.id, pr.order_id, pr.user_id, o.status
+		FROM pickup_reminders pr
+		JOIN orders o ON pr.order_id = o.id
+		WHERE pr.token = $1
+		  AND o.pickup_date = pr.pickup_date
+		  AND pr.pickup_date >= CURRENT_DATE
+		FOR UPDATE OF o`,
+		token,
+	).Scan(&id, &orderID, &userID, &status)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if !isRemindableStatus(status) {
+		return 0, 0, 0, sql.ErrNoRows
+	}
+	return id, orderID, userID, nil
+}
+
+func isRemindableStatus(status string) bool {
+	for _, s := range remindableOrderStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGetPickupReminder shows what a reminder link refers to. It needs no
+// login; the token is the credential.
+func (h *PickupReminderHandler) handleGetPickupReminder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reminder PickupReminder
+	err := h.db.QueryRow(`
+		SELECT o.id, pr.status, o.pickup_date, COALESCE(o.pickup_time_slot, ''),
+		       a.street_address || ', ' || a.city, pr.responded_at
+		FROM pickup_reminders pr
+		JOIN orders o ON pr.order_id = o.id
+		JOIN addresses a ON o.pickup_address_id = a.id
+		WHERE pr.token = $1
+		  AND o.pickup_date = pr.pickup_date
+		  AND pr.pickup_date >= CURRENT_DATE
+		  AND o.status = ANY($2)`,
+		mux.Vars(r)["token"], pq.Array(remindableOrderStatuses),
+	).Scan(&reminder.OrderID, &reminder.Status, &reminder.PickupDate, &reminder.PickupTimeSlot,
+		&reminder.Address, &reminder.RespondedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "This reminder link has expired", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch pickup", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reminder)
+}
+
+// handleConfirmPickup records that the customer's bags will be out
+func (h *PickupReminderHandler) handleConfirmPickup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	reminderID, orderID, _, err := h.loadPickupReminder(tx, mux.Vars(r)["token"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "This reminder link has expired", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to confirm pickup", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE pickup_reminders
+		SET status = 'confirmed', responded_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		reminderID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to confirm pickup", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to confirm pickup", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id": orderID,
+		"status":   "confirmed",
+		"message":  "Thanks! Your pickup is confirmed.",
+	})
+}
+
+type ReschedulePickupRequest struct {
+	PickupDate     string `json:"pickup_date"`                // YYYY-MM-DD
+	PickupTimeSlot string `json:"pickup_time_slot,omitempty"` // Keeps the current slot when empty
+}
+
+// handleReschedulePickup moves the pickup to a new day. The delivery date
+// moves by the same number of days so turnaround is unchanged.
+func (h *PickupReminderHandler) handleReschedulePickup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ReschedulePickupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	newDate, err := time.Parse("2006-01-02", req.PickupDate)
+	if err != nil {
+		http.Error(w, "Invalid pickup_date", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	reminderID, orderID, userID, err := h.loadPickupReminder(tx, mux.Vars(r)["token"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "This reminder link has expired", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reschedule pickup", http.StatusInternalServerError)
+		return
+	}
+
+	var currentDate time.Time
+	if err := tx.QueryRow("SELECT pickup_date FROM orders WHERE id = $1", orderID).Scan(&currentDate); err != nil {
+		http.Error(w, "Failed to reschedule pickup", http.StatusInternalServerError)
+		return
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	shiftDays := int(newDate.Sub(currentDate).Hours() / 24)
+	if !newDate.After(today) {
+		http.Error(w, "Pickups can only be moved to a future day", http.StatusBadRequest)
+		return
+	}
+	if shiftDays == 0 {
+		http.Error(w, "Pickup is already scheduled for that day", http.StatusBadRequest)
+		return
+	}
+	if shiftDays > pickupRescheduleMaxDays {
+		http.Error(w, fmt.Sprintf("Pickups can be moved at most %d days", pickupRescheduleMaxDays), http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE orders
+		SET pickup_date = $1,
+		    delivery_date = delivery_date + $2::int,
+		    pickup_time_slot = COALESCE(NULLIF($3, ''), pickup_time_slot),
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $4`,
+		req.PickupDate, shiftDays, req.PickupTimeSlot, orderID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to reschedule pickup", http.StatusInternalServerError)
+		return
+	}
+
+	// The order's route stop no longer applies to the new day
+	_, err = tx.Exec(`
+		DELETE FROM route_orders
+		WHERE order_id = $1 AND status = 'pending'
+		  AND route_id IN (SELECT id FROM driver_routes WHERE route_type = 'pickup')`,
+		orderID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to reschedule pickup", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE pickup_reminders
+		SET status = 'rescheduled', responded_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		reminderID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to reschedule pickup", http.StatusInternalServerError)
+		return
+	}
+
+	var status string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = $1", orderID).Scan(&status); err != nil {
+		http.Error(w, "Failed to reschedule pickup", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO order_status_history (order_id, status, notes, updated_by)
+		VALUES ($1, $2, $3, $4)`,
+		orderID, status, fmt.Sprintf("Pickup rescheduled by customer to %s", newDate.Format("2006-01-02")), userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to reschedule pickup", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to reschedule pickup", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id":    orderID,
+		"status":      "rescheduled",
+		"pickup_date": newDate.Format("2006-01-02"),
+		"message":     fmt.Sprintf("Your pickup has been moved to %s.", newDate.Format("Monday, January 2")),
+	})
+}
+
+type PickupConfirmation struct {
+	OrderID        int        `json:"order_id"`
+	CustomerName   string     `json:"customer_name"`
+	PickupTimeSlot string     `json:"pickup_time_slot"`
+	Address        string     `json:"address"`
+	ZipCode        string     `json:"zip_code"`
+	RouteID        *int       `json:"route_id,omitempty"`
+	Confirmation   string     `json:"confirmation"` // confirmed, unconfirmed or not_sent
+	ReminderSentAt *time.Time `json:"reminder_sent_at,omitempty"`
+}
+
+// handleGetPickupConfirmations lists a day's pickups with their reminder
+// status so dispatch can drop or resequence unconfirmed stops
+func (h *PickupReminderHandler) handleGetPickupConfirmations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02")
+	} else if _, err := time.Parse("2006-01-02", date); err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT o.id, u.first_name || ' ' || u.last_name, COALESCE(o.pickup_time_slot, ''),
+		       a.street_address || ', ' || a.city, a.zip_code,
+		       (SELECT ro.route_id FROM route_orders ro
+		        JOIN driver_routes dr ON ro.route_id = dr.id
+		        WHERE ro.order_id = o.id AND dr.route_type = 'pickup'
+		        ORDER BY ro.id DESC LIMIT 1),
+		       CASE
+		           WHEN pr.id IS NULL THEN 'not_sent'
+		           WHEN pr.status = 'confirmed' THEN 'confirmed'
+		           ELSE 'unconfirmed'
+		       END,
+		       pr.sent_at
+		FROM orders o
+		JOIN users u ON o.user_id = u.id
+		JOIN addresses a ON o.pickup_address_id = a.id
+		LEFT JOIN pickup_reminders pr ON pr.order_id = o.id AND pr.pickup_date = o.pickup_date
+		WHERE o.pickup_date = $1 AND o.status = ANY($2)
+		ORDER BY (pr.status = 'confirmed') NULLS FIRST, a.zip_code, o.id`,
+		date, pq.Array(remindableOrderStatuses),
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch pickups", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	pickups := []PickupConfirmation{}
+	counts := map[string]int{"confirmed": 0, "unconfirmed": 0, "not_sent": 0}
+	for rows.Next() {
+		var p PickupConfirmation
+		err := rows.Scan(&p.OrderID, &p.CustomerName, &p.PickupTimeSlot, &p.Address, &p.ZipCode,
+			&p.RouteID, &p.Confirmation, &p.ReminderSentAt)
+		if err != nil {
+			http.Error(w, "Failed to parse pickups", http.StatusInternalServerError)
+			return
+		}
+		counts[p.Confirmation]++
+		pickups = append(pickups, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"date":    date,
+		"pickups": pickups,
+		"counts":  counts,
+	})
+}
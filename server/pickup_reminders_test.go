@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPickupReminders_ConfirmAndDispatchView(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "reminder@example.com", "Reminder", "User")
+	addressID := db.CreateTestAddress(t, userID)
+	confirmedOrderID := db.CreateTestOrder(t, userID, addressID)
+	unconfirmedOrderID := db.CreateTestOrder(t, userID, addressID)
+
+	scheduler := &AutoScheduler{db: db.DB}
+	scheduler.processPickupReminders()
+	// A second run must not send duplicates
+	scheduler.processPickupReminders()
+
+	var reminderCount int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND type = $2",
+		userID, pickupReminderNotificationType).Scan(&reminderCount)
+	if reminderCount != 2 {
+		t.Fatalf("Expected 2 reminder notifications, got %d", reminderCount)
+	}
+
+	var token string
+	if err := db.QueryRow("SELECT token FROM pickup_reminders WHERE order_id = $1", confirmedOrderID).Scan(&token); err != nil {
+		t.Fatalf("Failed to get reminder token: %v", err)
+	}
+
+	handler := NewPickupReminderHandler(db.DB)
+
+	req := httptest.NewRequest("POST", "/api/v1/pickup-reminders/"+token+"/confirm", nil)
+	req = mux.SetURLVars(req, map[string]string{"token": token})
+	w := httptest.NewRecorder()
+	handler.handleConfirmPickup(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/pickup-reminders/not-a-token", nil)
+	req = mux.SetURLVars(req, map[string]string{"token": "not-a-token"})
+	w = httptest.NewRecorder()
+	handler.handleGetPickupReminder(w, req)
+	if w.Code != http.StatusGone {
+		t.Errorf("Expected status %d for unknown token, got %d", http.StatusGone, w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/admin/dispatch/pickup-confirmations", nil)
+	w = httptest.NewRecorder()
+	handler.handleGetPickupConfirmations(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Pickups []PickupConfirmation `json:"pickups"`
+		Counts  map[string]int       `json:"counts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if response.Counts["confirmed"] != 1 || response.Counts["unconfirmed"] != 1 {
+		t.Errorf("Expected 1 confirmed and 1 unconfirmed pickup, got %v", response.Counts)
+	}
+	if len(response.Pickups) != 2 || response.Pickups[0].OrderID != unconfirmedOrderID {
+		t.Errorf("Expected unconfirmed pickup to be listed first, got %+v", response.Pickups)
+	}
+}
+
+func TestPickupReminders_Reschedule(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "reschedule@example.com", "Reschedule", "User")
+	addressID := db.CreateTestAddress(t, userID)
+	orderID := db.CreateTestOrder(t, userID, addressID)
+
+	scheduler := &AutoScheduler{db: db.DB}
+	scheduler.processPickupReminders()
+
+	var token string
+	if err := db.QueryRow("SELECT token FROM pickup_reminders WHERE order_id = $1", orderID).Scan(&token); err != nil {
+		t.Fatalf("Failed to get reminder token: %v", err)
+	}
+
+	handler := NewPickupReminderHandler(db.DB)
+	reschedule := func(date string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(ReschedulePickupRequest{PickupDate: date, PickupTimeSlot: "12pm-3pm"})
+		req := httptest.NewRequest("POST", "/api/v1/pickup-reminders/"+token+"/reschedule", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"token": token})
+		w := httptest.NewRecorder()
+		handler.handleReschedulePickup(w, req)
+		return w
+	}
+
+	today := time.Now().UTC()
+	if w := reschedule(today.Format("2006-01-02")); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a same-day pickup, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	newDate := today.AddDate(0, 0, 3).Format("2006-01-02")
+	w := reschedule(newDate)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var pickupDate, deliveryDate time.Time
+	var timeSlot string
+	db.QueryRow("SELECT pickup_date, delivery_date, pickup_time_slot FROM orders WHERE id = $1", orderID).
+		Scan(&pickupDate, &deliveryDate, &timeSlot)
+	if pickupDate.Format("2006-01-02") != newDate {
+		t.Errorf("Expected pickup date %s, got %s", newDate, pickupDate.Format("2006-01-02"))
+	}
+	if days := int(deliveryDate.Sub(pickupDate).Hours() / 24); days != 2 {
+		t.Errorf("Expected turnaround to stay at 2 days, got %d", days)
+	}
+	if timeSlot != "12pm-3pm" {
+		t.Errorf("Expected time slot to be updated, got %s", timeSlot)
+	}
+
+	// The link was for the old pickup and no longer works
+	if w := reschedule(today.AddDate(0, 0, 4).Format("2006-01-02")); w.Code != http.StatusGone {
+		t.Errorf("Expected status %d after reschedule, got %d", http.StatusGone, w.Code)
+	}
+
+	var notes string
+	db.QueryRow("SELECT notes FROM order_status_history WHERE order_id = $1 ORDER BY id DESC LIMIT 1", orderID).Scan(&notes)
+	if notes != fmt.Sprintf("Pickup rescheduled by customer to %s", newDate) {
+		t.Errorf("Expected reschedule in status history, got %q", notes)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+)
+
+// slotHoldTTL is how long a checkout keeps its pickup slot before it's released
+const slotHoldTTL = 10 * time.Minute
+
+var errSlotFull = errors.New("pickup time slot is full")
+
+// SlotHold is a short-lived claim on one pickup in a slot, taken at the payment step
+type SlotHold struct {
+	Token    string `json:"token"`
+	UserID   int    `json:"user_id"`
+	Date     string `json:"date"`
+	TimeSlot string `json:"time_slot"`
+	// Market is set when the hold counts against a market's own capacity
+	Market    string    `json:"market,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SlotHoldStore tracks unexpired holds. Hold must be atomic so two checkouts
+// can't both take the last pickup in a slot.
+type SlotHoldStore interface {
+	// Hold adds the hold if fewer than limit holds are active for its slot,
+	// replacing any hold the same user already has.
+	Hold(ctx context.Context, hold SlotHold, limit int) (bool, error)
+	// Count returns active holds in a slot's pool (see slotPool), ignoring
+	// excludeToken
+	Count(ctx context.Context, date, pool, excludeToken string) (int, error)
+	// Get returns the hold for a token, or nil once it has expired
+	Get(ctx context.Context, token string) (*SlotHold, error)
+	Release(ctx context.Context, token string) error
+}
+
+// RedisSlotHoldStore keeps each slot's holds in a sorted set scored by expiry,
+// plus a key per token so holds can be looked up and released
+type RedisSlotHoldStore struct {
+	client *redis.Client
+}
+
+func NewRedisSlotHoldStore(client *redis.Client) *RedisSlotHoldStore {
+	return &RedisSlotHoldStore{client: client}
+}
+
+func slotHoldsKey(date, pool string) string {
+	return fmt.Sprintf("slot_holds:%s:%s", date, pool)
+}
+
+func slotHoldKey(token string) string {
+	return "slot_hold:" + token
+}
+
+func slotHoldUserKey(userID int) string {
+	return fmt.Sprintf("slot_hold_user:%d", userID)
+}
+
+// Drops expired holds, then adds this one only if there's still room
+var holdSlotScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[4]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[6])
+redis.call('SET', KEYS[2], ARGV[5], 'PX', ARGV[6])
+redis.call('SET', KEYS[3], ARGV[3], 'PX', ARGV[6])
+return 1
+`)
+
+func (s *RedisSlotHoldStore) Hold(ctx context.Context, hold SlotHold, limit int) (bool, error) {
+	// Customers going back and picking another slot shouldn't keep the old one
+	previous, err := s.client.Get(ctx, slotHoldUserKey(hold.UserID)).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	if previous != "" && previous != hold.Token {
+		if err := s.Release(ctx, previous); err != nil {
+			return false, err
+		}
+	}
+
+	payload, err := json.Marshal(hold)
+	if err != nil {
+		return false, err
+	}
+	ttl := time.Until(hold.ExpiresAt).Milliseconds()
+	if ttl <= 0 {
+		return false, nil
+	}
+
+	added, err := holdSlotScript.Run(ctx, s.client,
+		[]string{slotHoldsKey(hold.Date, slotPool(hold.Market, hold.TimeSlot)), slotHoldKey(hold.Token), slotHoldUserKey(hold.UserID)},
+		time.Now().UnixMilli(), hold.ExpiresAt.UnixMilli(), hold.Token, limit, payload, ttl,
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	return added == 1, nil
+}
+
+func (s *RedisSlotHoldStore) Count(ctx context.Context, date, pool, excludeToken string) (int, error) {
+	now := fmt.Sprintf("(%d", time.Now().UnixMilli())
+	tokens, err := s.client.ZRangeByScore(ctx, slotHoldsKey(date, pool), &redis.ZRangeBy{
+		Min: now,
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, token := range tokens {
+		if token != excludeToken {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *RedisSlotHoldStore) Get(ctx context.Context, token string) (*SlotHold, error) {
+	payload, err := s.client.Get(ctx, slotHoldKey(token)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hold SlotHold
+	if err := json.Unmarshal(payload, &hold); err != nil {
+		return nil, err
+	}
+	if !hold.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &hold, nil
+}
+
+func (s *RedisSlotHoldStore) Release(ctx context.Context, token string) error {
+	hold, err := s.Get(ctx, token)
+	if err != nil || hold == nil {
+		return err
+	}
+
+	pipe := s.client.TxPipeline()
+	pipe.ZRem(ctx, slotHoldsKey(hold.Date, slotPool(hold.Market, hold.TimeSlot)), token)
+	pipe.Del(ctx, slotHoldKey(token))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// checkSlotCapacity returns errSlotFull when booked orders plus other
+// customers' holds already fill the slot for a pickup in market. Holds are
+// skipped when Redis is unavailable so checkout isn't blocked by it. Called
+// with the order's transaction, it locks the slot until the order commits so
+// two checkouts can't both take its last place.
+func checkSlotCapacity(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, holds SlotHoldStore, date time.Time, market, timeSlot, reservationToken string) error {
+	if tx, ok := q.(*sql.Tx); ok {
+		_, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", "pickup_slot:"+date.Format("2006-01-02")+":"+timeSlot)
+		if err != nil {
+			return err
+		}
+	}
+	limit, booked, limited, err := pickupSlotLimit(q, date, market, timeSlot)
+	if err != nil || !limited {
+		return err
+	}
+
+	held := 0
+	if holds != nil {
+		held, err = holds.Count(context.Background(), date.Format("2006-01-02"), slotPool(limit.Market, timeSlot), reservationToken)
+		if err != nil {
+			log.Printf("Failed to count pickup slot holds: %v", err)
+			held = 0
+		}
+	}
+
+	if booked+held >= limit.Capacity {
+		return errSlotFull
+	}
+	return nil
+}
+
+type PickupSlotHandler struct {
+	db          *sql.DB
+	holds       SlotHoldStore
+	degradation *RedisDegradation
+	getUserID   func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewPickupSlotHandler(db *sql.DB, holds SlotHoldStore) *PickupSlotHandler {
+	return &PickupSlotHandler{
+		db:        db,
+		holds:     holds,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type PickupSlotAvailability struct {
+	TimeSlot  string `json:"time_slot"`
+	Capacity  int    `json:"capacity"`
+	Booked    int    `json:"booked"`
+	Held      int    `json:"held"`
+	Available int    `json:"available"`
+	// PriceLabel and PriceMultiplierPercent describe peak or off-peak pricing
+	// for the slot on this date; a multiplier of 100 is the regular price
+	PriceLabel             *string `json:"price_label,omitempty"`
+	PriceMultiplierPercent int     `json:"price_multiplier_percent"`
+}
+
+type ReserveSlotRequest struct {
+	Date     string `json:"date"`
+	TimeSlot string `json:"time_slot"`
+	// ZipCode is the pickup address's, so markets with their own capacity are
+	// held against it
+	ZipCode string `json:"zip_code,omitempty"`
+}
+
+// ReserveSlotResponse has no token when Redis is down and the slot can't be
+// held; checkout still goes ahead against booked orders alone
+type ReserveSlotResponse struct {
+	ReservationToken string    `json:"reservation_token"`
+	Date             string    `json:"date"`
+	TimeSlot         string    `json:"time_slot"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	Degraded         bool      `json:"degraded,omitempty"`
+}
+
+// handleGetPickupSlots returns remaining capacity per slot for ?date=, in the
+// market of ?zip_code= when given
+func (h *PickupSlotHandler) handleGetPickupSlots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := h.getUserID(r, h.db); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pickupDate, err := time.Parse("2006-01-02", r.URL.Query().Get("date"))
+	if err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	days, err := pickupAvailability(r.Context(), h.db, h.holds, pickupDate, pickupDate, marketForZip(r.URL.Query().Get("zip_code")))
+	if err != nil {
+		http.Error(w, "Failed to fetch pickup slots", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(days[0].Slots)
+}
+
+// handleReserveSlot holds a pickup for the customer while they pay
+func (h *PickupSlotHandler) handleReserveSlot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ReserveSlotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	pickupDate, err := time.Parse("2006-01-02", req.Date)
+	if err != nil || req.TimeSlot == "" {
+		http.Error(w, "Date and time slot are required", http.StatusBadRequest)
+		return
+	}
+	if pickupDate.Before(time.Now().Truncate(24 * time.Hour)) {
+		http.Error(w, "Pickup date has passed", http.StatusBadRequest)
+		return
+	}
+
+	if h.holds == nil {
+		http.Error(w, "Slot reservations are unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	slotLimit, booked, limited, err := pickupSlotLimit(h.db, pickupDate, marketForZip(req.ZipCode), req.TimeSlot)
+	if err != nil {
+		http.Error(w, "Failed to reserve slot", http.StatusInternalServerError)
+		return
+	}
+
+	hold := SlotHold{
+		Token:     generateRandomString(32),
+		UserID:    userID,
+		Date:      req.Date,
+		TimeSlot:  req.TimeSlot,
+		Market:    slotLimit.Market,
+		ExpiresAt: time.Now().Add(slotHoldTTL),
+	}
+
+	// Unconfigured slots have no cap, but still get a token so checkout is uniform
+	limit := int(^uint(0) >> 1)
+	if limited {
+		limit = slotLimit.Capacity - booked
+	}
+
+	held := false
+	if limit > 0 {
+		held, err = h.holds.Hold(r.Context(), hold, limit)
+		if err != nil {
+			// There's room going by booked orders, which is all checkout
+			// can count without Redis either
+			h.degradation.Fail(degradedSlotHolds, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(ReserveSlotResponse{
+				Date:      hold.Date,
+				TimeSlot:  hold.TimeSlot,
+				ExpiresAt: hold.ExpiresAt,
+				Degraded:  true,
+			})
+			return
+		}
+		h.degradation.Recover(degradedSlotHolds)
+	}
+	if !held {
+		writeSlotFull(w, r, h.db, h.holds, pickupDate, marketForZip(req.ZipCode), req.TimeSlot)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ReserveSlotResponse{
+		ReservationToken: hold.Token,
+		Date:             hold.Date,
+		TimeSlot:         hold.TimeSlot,
+		ExpiresAt:        hold.ExpiresAt,
+	})
+}
+
+// handleReleaseSlot gives a held slot back when the customer leaves checkout
+func (h *PickupSlotHandler) handleReleaseSlot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if h.holds == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	token := mux.Vars(r)["token"]
+	hold, err := h.holds.Get(r.Context(), token)
+	if err != nil {
+		http.Error(w, "Failed to release slot", http.StatusInternalServerError)
+		return
+	}
+	// Expired holds are already released
+	if hold == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if hold.UserID != userID {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.holds.Release(r.Context(), token); err != nil {
+		http.Error(w, "Failed to release slot", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// memorySlotHoldStore stands in for Redis in tests
+type memorySlotHoldStore struct {
+	mu    sync.Mutex
+	holds map[string]SlotHold
+}
+
+func newMemorySlotHoldStore() *memorySlotHoldStore {
+	return &memorySlotHoldStore{holds: map[string]SlotHold{}}
+}
+
+func (s *memorySlotHoldStore) Hold(ctx context.Context, hold SlotHold, limit int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := 0
+	for token, existing := range s.holds {
+		if existing.UserID == hold.UserID {
+			delete(s.holds, token)
+			continue
+		}
+		if existing.Date == hold.Date && slotPool(existing.Market, existing.TimeSlot) == slotPool(hold.Market, hold.TimeSlot) && existing.ExpiresAt.After(time.Now()) {
+			active++
+		}
+	}
+	if active >= limit {
+		return false, nil
+	}
+	s.holds[hold.Token] = hold
+	return true, nil
+}
+
+func (s *memorySlotHoldStore) Count(ctx context.Context, date, pool, excludeToken string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for token, hold := range s.holds {
+		if token != excludeToken && hold.Date == date && slotPool(hold.Market, hold.TimeSlot) == pool && hold.ExpiresAt.After(time.Now()) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memorySlotHoldStore) Get(ctx context.Context, token string) (*SlotHold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hold, ok := s.holds[token]
+	if !ok || !hold.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &hold, nil
+}
+
+func (s *memorySlotHoldStore) Release(ctx context.Context, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.holds, token)
+	return nil
+}
+
+func reserveSlot(handler *PickupSlotHandler, userID int, date, timeSlot string) *httptest.ResponseRecorder {
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return userID, nil
+	}
+	body, _ := json.Marshal(ReserveSlotRequest{Date: date, TimeSlot: timeSlot})
+	req := httptest.NewRequest("POST", "/api/v1/pickup-slots/reserve", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	handler.handleReserveSlot(w, req)
+	return w
+}
+
+func TestPickupSlots_ReserveLastSlot(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	date := time.Now().AddDate(0, 0, 2).Format("2006-01-02")
+	if _, err := db.Exec(`
+		INSERT INTO pickup_time_slots (time_slot, capacity) VALUES ('6pm-8pm', 1)
+		ON CONFLICT (time_slot) DO UPDATE SET capacity = 1, is_active = true`); err != nil {
+		t.Fatalf("Failed to configure slot: %v", err)
+	}
+
+	firstUserID := db.CreateTestUser(t, "first-slot@example.com", "First", "Customer")
+	secondUserID := db.CreateTestUser(t, "second-slot@example.com", "Second", "Customer")
+	addressID := db.CreateTestAddress(t, secondUserID)
+
+	holds := newMemorySlotHoldStore()
+	handler := NewPickupSlotHandler(db.DB, holds)
+
+	w := reserveSlot(handler, firstUserID, date, "6pm-8pm")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var reservation ReserveSlotResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &reservation); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+
+	// The second customer can't take the held slot, at reserve or at checkout
+	w = reserveSlot(handler, secondUserID, date, "6pm-8pm")
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a held slot, got %d", http.StatusConflict, w.Code)
+	}
+
+	orderHandler := NewOrderHandler(db.DB, nil)
+	orderHandler.slotHolds = holds
+	orderHandler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return secondUserID, nil
+	}
+	body, _ := json.Marshal(CreateOrderRequest{
+		PickupAddressID:   addressID,
+		DeliveryAddressID: addressID,
+		PickupDate:        date,
+		DeliveryDate:      time.Now().AddDate(0, 0, 4).Format("2006-01-02"),
+		PickupTimeSlot:    "6pm-8pm",
+		DeliveryTimeSlot:  "9am-12pm",
+	})
+	req := httptest.NewRequest("POST", "/api/v1/orders", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	orderHandler.handleCreateOrder(w, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d creating an order in a held slot, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Releasing the hold frees the slot
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return firstUserID, nil
+	}
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/pickup-slots/reservations/%s", reservation.ReservationToken), nil)
+	req = mux.SetURLVars(req, map[string]string{"token": reservation.ReservationToken})
+	w = httptest.NewRecorder()
+	handler.handleReleaseSlot(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	w = reserveSlot(handler, secondUserID, date, "6pm-8pm")
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected status %d after release, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+}
+
+func TestCheckSlotCapacity_LocksLastSlot(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	date := time.Now().AddDate(0, 0, 2)
+	if _, err := db.Exec(`
+		INSERT INTO pickup_time_slots (time_slot, capacity) VALUES ('6pm-8pm', 1)
+		ON CONFLICT (time_slot) DO UPDATE SET capacity = 1, is_active = true`); err != nil {
+		t.Fatalf("Failed to configure slot: %v", err)
+	}
+	userID := db.CreateTestUser(t, "locked-slot@example.com", "Locked", "Slot")
+	addressID := db.CreateTestAddress(t, userID)
+
+	// The first checkout takes the last place and holds the slot until it commits
+	first, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	defer first.Rollback()
+	if err := checkSlotCapacity(first, nil, date, "", "6pm-8pm", ""); err != nil {
+		t.Fatalf("Expected the first checkout to get the slot, got %v", err)
+	}
+	_, err = first.Exec(`
+		INSERT INTO orders (user_id, pickup_address_id, delivery_address_id, status, pickup_date, delivery_date, pickup_time_slot, delivery_time_slot)
+		VALUES ($1, $2, $2, 'scheduled', $3, $3, '6pm-8pm', '9am-12pm')`,
+		userID, addressID, date.Format("2006-01-02"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+
+	second := make(chan error, 1)
+	go func() {
+		tx, err := db.Begin()
+		if err != nil {
+			second <- err
+			return
+		}
+		defer tx.Rollback()
+		second <- checkSlotCapacity(tx, nil, date, "", "6pm-8pm", "")
+	}()
+
+	select {
+	case err := <-second:
+		t.Fatalf("Expected the second checkout to wait for the first, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := first.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if err := <-second; err != errSlotFull {
+		t.Errorf("Expected the second checkout to find the slot full, got %v", err)
+	}
+}
+
+func TestPickupSlots_Availability(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "slots@example.com", "Slot", "Viewer")
+	addressID := db.CreateTestAddress(t, userID)
+	db.CreateTestOrder(t, userID, addressID)
+
+	holds := newMemorySlotHoldStore()
+	holds.Hold(context.Background(), SlotHold{
+		Token:     "held",
+		UserID:    userID + 1,
+		Date:      time.Now().AddDate(0, 0, 1).Format("2006-01-02"),
+		TimeSlot:  "9am-12pm",
+		ExpiresAt: time.Now().Add(slotHoldTTL),
+	}, 10)
+
+	handler := NewPickupSlotHandler(db.DB, holds)
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return userID, nil
+	}
+
+	date := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	req := httptest.NewRequest("GET", "/api/v1/pickup-slots?date="+date, nil)
+	w := httptest.NewRecorder()
+	handler.handleGetPickupSlots(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var slots []PickupSlotAvailability
+	if err := json.Unmarshal(w.Body.Bytes(), &slots); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	for _, slot := range slots {
+		if slot.TimeSlot != "9am-12pm" {
+			continue
+		}
+		if slot.Booked != 1 || slot.Held != 1 || slot.Available != slot.Capacity-2 {
+			t.Errorf("Expected 1 booked and 1 held, got %+v", slot)
+		}
+		return
+	}
+	t.Error("Expected 9am-12pm slot in availability")
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"tumble-backend/money"
+
+	"github.com/gorilla/mux"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/subscription"
+)
+
+// PlanMigrationHandler manages bulk moves of subscribers off a legacy plan.
+// Subscribers are notified ahead of their renewal, may opt out (which cancels
+// at period end), and are switched to the new plan on renewal by the scheduler.
+type PlanMigrationHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewPlanMigrationHandler(db *sql.DB) *PlanMigrationHandler {
+	return &PlanMigrationHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type CreatePlanMigrationRequest struct {
+	FromPlanID int  `json:"from_plan_id"`
+	ToPlanID   int  `json:"to_plan_id"`
+	NoticeDays *int `json:"notice_days,omitempty"`
+	DryRun     bool `json:"dry_run"`
+}
+
+type PlanMigration struct {
+	ID           int            `json:"id"`
+	FromPlanID   int            `json:"from_plan_id"`
+	FromPlanName string         `json:"from_plan_name"`
+	ToPlanID     int            `json:"to_plan_id"`
+	ToPlanName   string         `json:"to_plan_name"`
+	NoticeDays   int            `json:"notice_days"`
+	Status       string         `json:"status"`
+	Subscribers  map[string]int `json:"subscribers"` // Counts by subscriber status
+	CreatedAt    time.Time      `json:"created_at"`
+}
+
+type PlanMigrationSubscriber struct {
+	SubscriptionID int    `json:"subscription_id"`
+	UserID         int    `json:"user_id"`
+	Email          string `json:"email"`
+	Name           string `json:"name"`
+	RenewalDate    string `json:"renewal_date"`
+}
+
+// PlanMigrationReport describes who a migration affects and what it does to revenue
+type PlanMigrationReport struct {
+	MigrationID           *int                      `json:"migration_id,omitempty"`
+	DryRun                bool                      `json:"dry_run"`
+	FromPlanID            int                       `json:"from_plan_id"`
+	ToPlanID              int                       `json:"to_plan_id"`
+	NoticeDays            int                       `json:"notice_days"`
+	SubscriberCount       int                       `json:"subscriber_count"`
+	CurrentMonthlyRevenue float64                   `json:"current_monthly_revenue"`
+	NewMonthlyRevenue     float64                   `json:"new_monthly_revenue"`
+	MonthlyRevenueDelta   float64                   `json:"monthly_revenue_delta"`
+	Subscribers           []PlanMigrationSubscriber `json:"subscribers"`
+}
+
+const (
+	planMigrationDefaultNoticeDays = 14
+	planMigrationNoticeType        = "plan_migration_notice"
+)
+
+// summarizePlanMigrationRevenue fills in the revenue figures for a report
+func summarizePlanMigrationRevenue(report *PlanMigrationReport, fromPriceCents, toPriceCents int) {
+	report.SubscriberCount = len(report.Subscribers)
+	report.CurrentMonthlyRevenue = centsToDollars(fromPriceCents * report.SubscriberCount)
+	report.NewMonthlyRevenue = centsToDollars(toPriceCents * report.SubscriberCount)
+	report.MonthlyRevenueDelta = centsToDollars((toPriceCents - fromPriceCents) * report.SubscriberCount)
+}
+
+// planMigrationSubscribersQuery selects subscribers on $1 that a migration
+// with $2 notice days would move. The renewal date is the first period end far
+// enough out to give the full notice.
+const planMigrationSubscribersQuery = `
+	SELECT s.id, s.user_id, u.email, u.first_name || ' ' || u.last_name,
+		CASE WHEN s.current_period_end >= CURRENT_DATE + $2::int
+			THEN s.current_period_end
+			ELSE (s.current_period_end + INTERVAL '1 month')::date
+		END as renewal_date
+	FROM subscriptions s
+	JOIN users u ON s.user_id = u.id
+	WHERE s.plan_id = $1 AND s.status IN ('active', 'paused')
+	  AND NOT EXISTS (
+		SELECT 1 FROM plan_migration_subscribers pms
+		JOIN plan_migrations pm ON pms.migration_id = pm.id
+		WHERE pms.subscription_id = s.id AND pm.status = 'scheduled'
+		  AND pms.status IN ('pending', 'notified')
+	  )
+	ORDER BY renewal_date, s.id`
+
+// handleCreatePlanMigration schedules a migration, or with dry_run just
+// reports the affected subscribers and revenue delta
+func (h *PlanMigrationHandler) handleCreatePlanMigration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreatePlanMigrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.FromPlanID == req.ToPlanID {
+		http.Error(w, "Source and target plans must differ", http.StatusBadRequest)
+		return
+	}
+	noticeDays := planMigrationDefaultNoticeDays
+	if req.NoticeDays != nil {
+		if *req.NoticeDays < 0 {
+			http.Error(w, "notice_days cannot be negative", http.StatusBadRequest)
+			return
+		}
+		noticeDays = *req.NoticeDays
+	}
+
+	var fromPriceCents, toPriceCents int
+	var toPlanActive bool
+	err = h.db.QueryRow("SELECT price_per_month_cents FROM subscription_plans WHERE id = $1", req.FromPlanID).Scan(&fromPriceCents)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Source plan not found", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch plans", http.StatusInternalServerError)
+		return
+	}
+	err = h.db.QueryRow("SELECT price_per_month_cents, is_active FROM subscription_plans WHERE id = $1", req.ToPlanID).Scan(&toPriceCents, &toPlanActive)
+	if err == sql.ErrNoRows || (err == nil && !toPlanActive) {
+		http.Error(w, "Target plan not found or inactive", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch plans", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	report := PlanMigrationReport{
+		DryRun:      req.DryRun,
+		FromPlanID:  req.FromPlanID,
+		ToPlanID:    req.ToPlanID,
+		NoticeDays:  noticeDays,
+		Subscribers: []PlanMigrationSubscriber{},
+	}
+
+	rows, err := tx.Query(planMigrationSubscribersQuery, req.FromPlanID, noticeDays)
+	if err != nil {
+		http.Error(w, "Failed to fetch affected subscribers", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var sub PlanMigrationSubscriber
+		var renewalDate time.Time
+		if err := rows.Scan(&sub.SubscriptionID, &sub.UserID, &sub.Email, &sub.Name, &renewalDate); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to parse affected subscribers", http.StatusInternalServerError)
+			return
+		}
+		sub.RenewalDate = renewalDate.Format("2006-01-02")
+		report.Subscribers = append(report.Subscribers, sub)
+	}
+	rows.Close()
+
+	summarizePlanMigrationRevenue(&report, fromPriceCents, toPriceCents)
+
+	if req.DryRun {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	var existing int
+	err = tx.QueryRow(
+		"SELECT COUNT(*) FROM plan_migrations WHERE from_plan_id = $1 AND status = 'scheduled'",
+		req.FromPlanID,
+	).Scan(&existing)
+	if err != nil {
+		http.Error(w, "Failed to check existing migrations", http.StatusInternalServerError)
+		return
+	}
+	if existing > 0 {
+		http.Error(w, "A migration is already scheduled for this plan", http.StatusConflict)
+		return
+	}
+
+	var migrationID int
+	err = tx.QueryRow(`
+		INSERT INTO plan_migrations (from_plan_id, to_plan_id, notice_days, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id`,
+		req.FromPlanID, req.ToPlanID, noticeDays, adminID,
+	).Scan(&migrationID)
+	if err != nil {
+		http.Error(w, "Failed to create plan migration", http.StatusInternalServerError)
+		return
+	}
+
+	for _, sub := range report.Subscribers {
+		_, err = tx.Exec(`
+			INSERT INTO plan_migration_subscribers (migration_id, subscription_id, user_id, renewal_date)
+			VALUES ($1, $2, $3, $4)`,
+			migrationID, sub.SubscriptionID, sub.UserID, sub.RenewalDate,
+		)
+		if err != nil {
+			http.Error(w, "Failed to enroll subscribers", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create plan migration", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin %d scheduled plan migration %d: plan %d -> %d for %d subscribers",
+		adminID, migrationID, req.FromPlanID, req.ToPlanID, report.SubscriberCount)
+
+	report.MigrationID = &migrationID
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleGetPlanMigrations lists migrations with subscriber progress
+func (h *PlanMigrationHandler) handleGetPlanMigrations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT pm.id, pm.from_plan_id, fp.name, pm.to_plan_id, tp.name, pm.notice_days, pm.status, pm.created_at
+		FROM plan_migrations pm
+		JOIN subscription_plans fp ON pm.from_plan_id = fp.id
+		JOIN subscription_plans tp ON pm.to_plan_id = tp.id
+		ORDER BY pm.created_at DESC`)
+	if err != nil {
+		http.Error(w, "Failed to fetch plan migrations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	migrations := []PlanMigration{}
+	for rows.Next() {
+		var pm PlanMigration
+		err := rows.Scan(&pm.ID, &pm.FromPlanID, &pm.FromPlanName, &pm.ToPlanID, &pm.ToPlanName,
+			&pm.NoticeDays, &pm.Status, &pm.CreatedAt)
+		if err != nil {
+			http.Error(w, "Failed to parse plan migrations", http.StatusInternalServerError)
+			return
+		}
+		pm.Subscribers = map[string]int{}
+		migrations = append(migrations, pm)
+	}
+	rows.Close()
+
+	for i := range migrations {
+		countRows, err := h.db.Query(`
+			SELECT status, COUNT(*) FROM plan_migration_subscribers
+			WHERE migration_id = $1 GROUP BY status`,
+			migrations[i].ID,
+		)
+		if err != nil {
+			continue
+		}
+		for countRows.Next() {
+			var status string
+			var count int
+			if countRows.Scan(&status, &count) == nil {
+				migrations[i].Subscribers[status] = count
+			}
+		}
+		countRows.Close()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(migrations)
+}
+
+// handleCancelPlanMigration stops a scheduled migration. Subscribers already
+// migrated stay on the new plan.
+func (h *PlanMigrationHandler) handleCancelPlanMigration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	migrationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid migration ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE plan_migrations SET status = 'cancelled' WHERE id = $1 AND status = 'scheduled'",
+		migrationID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to cancel plan migration", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Scheduled migration not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE plan_migration_subscribers SET status = 'skipped'
+		WHERE migration_id = $1 AND status IN ('pending', 'notified')`,
+		migrationID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to cancel plan migration", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to cancel plan migration", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Plan migration cancelled",
+	})
+}
+
+// handleGetMyPlanMigration returns the upcoming plan migration for the
+// authenticated subscriber, or null when there is none
+func (h *PlanMigrationHandler) handleGetMyPlanMigration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var renewalDate time.Time
+	var fromName, toName string
+	var fromCents, toCents int
+	err = h.db.QueryRow(`
+		SELECT pms.renewal_date, fp.name, fp.price_per_month_cents, tp.name, tp.price_per_month_cents
+		FROM plan_migration_subscribers pms
+		JOIN plan_migrations pm ON pms.migration_id = pm.id
+		JOIN subscription_plans fp ON pm.from_plan_id = fp.id
+		JOIN subscription_plans tp ON pm.to_plan_id = tp.id
+		WHERE pms.user_id = $1 AND pm.status = 'scheduled' AND pms.status IN ('pending', 'notified')
+		ORDER BY pms.renewal_date
+		LIMIT 1`,
+		userID,
+	).Scan(&renewalDate, &fromName, &fromCents, &toName, &toCents)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err == sql.ErrNoRows {
+		json.NewEncoder(w).Encode(nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch plan migration", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"effective_date":  renewalDate.Format("2006-01-02"),
+		"from_plan_name":  fromName,
+		"from_plan_price": centsToDollars(fromCents),
+		"to_plan_name":    toName,
+		"to_plan_price":   centsToDollars(toCents),
+	})
+}
+
+// handleOptOutPlanMigration lets a subscriber decline the new plan. Their
+// subscription is cancelled at the end of the current period instead.
+func (h *PlanMigrationHandler) handleOptOutPlanMigration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var entryID, subscriptionID int
+	var stripeSubscriptionID sql.NullString
+	err = h.db.QueryRow(`
+		SELECT pms.id, s.id, s.stripe_subscription_id
+		FROM plan_migration_subscribers pms
+		JOIN plan_migrations pm ON pms.migration_id = pm.id
+		JOIN subscriptions s ON pms.subscription_id = s.id
+		WHERE pms.user_id = $1 AND pm.status = 'scheduled' AND pms.status IN ('pending', 'notified')
+		ORDER BY pms.renewal_date
+		LIMIT 1`,
+		userID,
+	).Scan(&entryID, &subscriptionID, &stripeSubscriptionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No upcoming plan migration", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch plan migration", http.StatusInternalServerError)
+		return
+	}
+
+	// Cancel at period end in Stripe, same as a regular cancellation
+	if stripeSubscriptionID.Valid && stripeSubscriptionID.String != "" {
+		params := &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		}
+		if _, err := subscription.Update(stripeSubscriptionID.String, params); err != nil {
+			log.Printf("Failed to cancel Stripe subscription %s on plan migration opt-out: %v", stripeSubscriptionID.String, err)
+			http.Error(w, "Failed to cancel subscription in Stripe", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE plan_migration_subscribers SET status = 'opted_out' WHERE id = $1", entryID)
+	if err != nil {
+		http.Error(w, "Failed to record opt-out", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE subscriptions
+		SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND user_id = $2`,
+		subscriptionID, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update subscription status", http.StatusInternalServerError)
+		return
+	}
+	if err := recordSubscriptionStatusChange(tx, subscriptionID, "paused", "cancelled"); err != nil {
+		http.Error(w, "Failed to update subscription status", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to record opt-out", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "You've opted out of the plan change. Your subscription will end at the close of the current period.",
+	})
+}
+
+// processPlanMigrations sends advance notices and switches notified
+// subscribers to the new plan the day before their renewal
+func (s *AutoScheduler) processPlanMigrations() {
+	log.Println("Processing plan migrations...")
+
+	// Notices go out once the renewal is within the notice window
+	rows, err := s.db.Query(`
+		SELECT pms.id, pms.user_id, pms.renewal_date, fp.name, tp.name, tp.price_per_month_cents
+		FROM plan_migration_subscribers pms
+		JOIN plan_migrations pm ON pms.migration_id = pm.id
+		JOIN subscription_plans fp ON pm.from_plan_id = fp.id
+		JOIN subscription_plans tp ON pm.to_plan_id = tp.id
+		WHERE pm.status = 'scheduled' AND pms.status = 'pending'
+		  AND pms.renewal_date <= CURRENT_DATE + pm.notice_days`)
+	if err != nil {
+		log.Printf("Error fetching plan migration notices: %v", err)
+		return
+	}
+
+	type notice struct {
+		EntryID     int
+		UserID      int
+		RenewalDate time.Time
+		FromName    string
+		ToName      string
+		ToCents     int
+	}
+	var notices []notice
+	for rows.Next() {
+		var n notice
+		if err := rows.Scan(&n.EntryID, &n.UserID, &n.RenewalDate, &n.FromName, &n.ToName, &n.ToCents); err != nil {
+			log.Printf("Error scanning plan migration notice: %v", err)
+			continue
+		}
+		notices = append(notices, n)
+	}
+	rows.Close()
+
+	for _, n := range notices {
+		message := fmt.Sprintf("Your %s plan is being retired. On %s your subscription will move to the %s plan at %s/month. "+
+			"If you'd rather not continue, you can opt out and your subscription will end with the current period.",
+			n.FromName, n.RenewalDate.Format("January 2"), n.ToName, money.Format(n.ToCents))
+		_, err := s.db.Exec(`
+			INSERT INTO notifications (user_id, type, title, message)
+			VALUES ($1, $2, $3, $4)`,
+			n.UserID, planMigrationNoticeType, "Your plan is changing", message,
+		)
+		if err != nil {
+			log.Printf("Error creating plan migration notice for user %d: %v", n.UserID, err)
+			continue
+		}
+		s.db.Exec("UPDATE plan_migration_subscribers SET status = 'notified', notified_at = CURRENT_TIMESTAMP WHERE id = $1", n.EntryID)
+	}
+
+	// Switch plans the day before renewal so the renewal invoice uses the new price
+	rows, err = s.db.Query(`
+		SELECT pms.id, pms.subscription_id, pm.from_plan_id, pm.to_plan_id,
+		       sub.plan_id, sub.status, sub.stripe_subscription_id
+		FROM plan_migration_subscribers pms
+		JOIN plan_migrations pm ON pms.migration_id = pm.id
+		JOIN subscriptions sub ON pms.subscription_id = sub.id
+		WHERE pm.status = 'scheduled' AND pms.status = 'notified'
+		  AND pms.renewal_date <= CURRENT_DATE + 1`)
+	if err != nil {
+		log.Printf("Error fetching due plan migrations: %v", err)
+		return
+	}
+
+	type due struct {
+		EntryID              int
+		SubscriptionID       int
+		FromPlanID           int
+		ToPlanID             int
+		CurrentPlanID        int
+		Status               string
+		StripeSubscriptionID sql.NullString
+	}
+	var dues []due
+	for rows.Next() {
+		var d due
+		err := rows.Scan(&d.EntryID, &d.SubscriptionID, &d.FromPlanID, &d.ToPlanID,
+			&d.CurrentPlanID, &d.Status, &d.StripeSubscriptionID)
+		if err != nil {
+			log.Printf("Error scanning due plan migration: %v", err)
+			continue
+		}
+		dues = append(dues, d)
+	}
+	rows.Close()
+
+	subscriptions := &SubscriptionHandler{db: s.db}
+	migrated := 0
+	for _, d := range dues {
+		// Subscribers who cancelled or changed plans on their own are left alone
+		if d.Status == "cancelled" || d.CurrentPlanID != d.FromPlanID {
+			s.db.Exec("UPDATE plan_migration_subscribers SET status = 'skipped' WHERE id = $1", d.EntryID)
+			continue
+		}
+
+		if d.StripeSubscriptionID.Valid && d.StripeSubscriptionID.String != "" {
+			err := subscriptions.updateStripeSubscriptionPlan(d.StripeSubscriptionID.String, d.ToPlanID, "none")
+			if err != nil {
+				log.Printf("Error migrating subscription %d: %v", d.SubscriptionID, err)
+				s.db.Exec("UPDATE plan_migration_subscribers SET status = 'failed', error = $2 WHERE id = $1", d.EntryID, err.Error())
+				continue
+			}
+		}
+
+		_, err := s.db.Exec(`
+			UPDATE subscriptions SET plan_id = $1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $2`,
+			d.ToPlanID, d.SubscriptionID,
+		)
+		if err != nil {
+			log.Printf("Error migrating subscription %d: %v", d.SubscriptionID, err)
+			s.db.Exec("UPDATE plan_migration_subscribers SET status = 'failed', error = $2 WHERE id = $1", d.EntryID, err.Error())
+			continue
+		}
+		s.db.Exec("UPDATE plan_migration_subscribers SET status = 'migrated', migrated_at = CURRENT_TIMESTAMP WHERE id = $1", d.EntryID)
+		migrated++
+	}
+
+	// Migrations with nobody left to process are done
+	s.db.Exec(`
+		UPDATE plan_migrations pm SET status = 'completed'
+		WHERE pm.status = 'scheduled' AND NOT EXISTS (
+			SELECT 1 FROM plan_migration_subscribers pms
+			WHERE pms.migration_id = pm.id AND pms.status IN ('pending', 'notified')
+		)`)
+
+	log.Printf("Finished processing plan migrations - %d notices sent, %d subscriptions migrated", len(notices), migrated)
+}
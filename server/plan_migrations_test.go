@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSummarizePlanMigrationRevenue(t *testing.T) {
+	report := PlanMigrationReport{
+		Subscribers: []PlanMigrationSubscriber{{SubscriptionID: 1}, {SubscriptionID: 2}, {SubscriptionID: 3}},
+	}
+
+	summarizePlanMigrationRevenue(&report, 4800, 5500)
+
+	if report.SubscriberCount != 3 {
+		t.Errorf("Expected 3 subscribers, got %d", report.SubscriberCount)
+	}
+	if report.CurrentMonthlyRevenue != 144.00 {
+		t.Errorf("Expected current revenue 144.00, got %.2f", report.CurrentMonthlyRevenue)
+	}
+	if report.NewMonthlyRevenue != 165.00 {
+		t.Errorf("Expected new revenue 165.00, got %.2f", report.NewMonthlyRevenue)
+	}
+	if report.MonthlyRevenueDelta != 21.00 {
+		t.Errorf("Expected revenue delta 21.00, got %.2f", report.MonthlyRevenueDelta)
+	}
+}
+
+func TestPlanMigrationHandler_DryRunScheduleAndOptOut(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "admin@example.com", "Admin", "User")
+	firstID := db.CreateTestUser(t, "first@example.com", "First", "Subscriber")
+	secondID := db.CreateTestUser(t, "second@example.com", "Second", "Subscriber")
+
+	legacyPlanID := db.GetPlanID(t, "Fresh Start")
+	newPlanID := db.GetPlanID(t, "Family Fresh")
+	db.CreateTestSubscription(t, firstID, legacyPlanID)
+	db.CreateTestSubscription(t, secondID, legacyPlanID)
+
+	handler := NewPlanMigrationHandler(db.DB)
+	asUser := func(userID int) {
+		handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+			return userID, nil
+		}
+	}
+
+	createMigration := func(dryRun bool) (*httptest.ResponseRecorder, PlanMigrationReport) {
+		body, _ := json.Marshal(CreatePlanMigrationRequest{FromPlanID: legacyPlanID, ToPlanID: newPlanID, DryRun: dryRun})
+		req := httptest.NewRequest("POST", "/api/v1/admin/plan-migrations", bytes.NewBuffer(body))
+		w := httptest.NewRecorder()
+		handler.handleCreatePlanMigration(w, req)
+
+		var report PlanMigrationReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return w, report
+	}
+
+	asUser(adminID)
+
+	// Dry run reports affected subscribers without scheduling anything
+	w, report := createMigration(true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if report.SubscriberCount != 2 || report.MigrationID != nil {
+		t.Errorf("Expected 2 affected subscribers and no migration, got %+v", report)
+	}
+	if report.MonthlyRevenueDelta != 164.00 {
+		t.Errorf("Expected revenue delta 164.00, got %.2f", report.MonthlyRevenueDelta)
+	}
+
+	var migrations int
+	db.QueryRow("SELECT COUNT(*) FROM plan_migrations").Scan(&migrations)
+	if migrations != 0 {
+		t.Errorf("Expected dry run not to create a migration, found %d", migrations)
+	}
+
+	// Scheduling enrolls the subscribers
+	w, report = createMigration(false)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if report.MigrationID == nil || report.SubscriberCount != 2 {
+		t.Fatalf("Expected scheduled migration for 2 subscribers, got %+v", report)
+	}
+
+	// A second migration for the same plan conflicts
+	if w, _ := createMigration(false); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for duplicate migration, got %d", http.StatusConflict, w.Code)
+	}
+
+	// A subscriber opts out, cancelling their subscription
+	asUser(firstID)
+	req := httptest.NewRequest("POST", "/api/v1/subscriptions/plan-migration/opt-out", nil)
+	w = httptest.NewRecorder()
+	handler.handleOptOutPlanMigration(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var subscriptionStatus, entryStatus string
+	db.QueryRow("SELECT status FROM subscriptions WHERE user_id = $1", firstID).Scan(&subscriptionStatus)
+	db.QueryRow("SELECT status FROM plan_migration_subscribers WHERE user_id = $1", firstID).Scan(&entryStatus)
+	if subscriptionStatus != "cancelled" || entryStatus != "opted_out" {
+		t.Errorf("Expected cancelled subscription and opted_out entry, got %s / %s", subscriptionStatus, entryStatus)
+	}
+
+	// Opting out twice finds nothing
+	w = httptest.NewRecorder()
+	handler.handleOptOutPlanMigration(w, httptest.NewRequest("POST", "/api/v1/subscriptions/plan-migration/opt-out", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"tumble-backend/money"
+)
+
+// overQuotaPickupFeeCents is charged for a subscriber's pickups beyond their plan
+const overQuotaPickupFeeCents = 1000
+
+var errNoPricingSnapshot = errors.New("order has no pricing snapshot")
+
+// OrderPricingSnapshot is the pricing an order was sold with, copied when it
+// was placed so later catalog, plan and price changes never alter what the
+// order shows or what its lines refund for
+type OrderPricingSnapshot struct {
+	CapturedAt time.Time         `json:"captured_at"`
+	Plan       *PlanPricingTerms `json:"plan,omitempty"` // nil for pay-as-you-go orders
+	Lines      []PricedLine      `json:"lines"`
+	// SlotAdjustment scales the service and garment lines, not the add-ons
+	SlotAdjustment *OrderSlotAdjustment `json:"slot_adjustment,omitempty"`
+	ZoneSurcharge  *OrderZoneSurcharge  `json:"zone_surcharge,omitempty"`
+	Subtotal       float64              `json:"subtotal"`
+	Tax            float64              `json:"tax"`
+	Tip            float64              `json:"tip"`
+	Total          float64              `json:"total"`
+	// CreditApplied is account credit, such as referral or goodwill credit,
+	// spent on the order
+	CreditApplied float64 `json:"credit_applied"`
+}
+
+// PlanPricingTerms are the subscription terms an order was placed under
+type PlanPricingTerms struct {
+	PlanID             int     `json:"plan_id"`
+	Name               string  `json:"name"`
+	MonthlyPrice       float64 `json:"monthly_price"`
+	PickupsPerMonth    int     `json:"pickups_per_month"`
+	OverQuotaPickupFee float64 `json:"over_quota_pickup_fee"`
+}
+
+// PricedLine is one line of an order as it was sold
+type PricedLine struct {
+	Kind        string  `json:"kind"`    // service, item_options, garment or add_on
+	LineID      int     `json:"line_id"` // ID in order_items, order_garments or order_add_ons
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Quantity    int     `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+	// ListPrice is the catalog price before plan coverage and market pricing;
+	// add-ons priced as a percent of the order don't have one
+	ListPrice      *float64 `json:"list_price,omitempty"`
+	IncludedPounds *float64 `json:"included_pounds,omitempty"`
+	OverweightRate *float64 `json:"overweight_rate,omitempty"` // Per pound
+}
+
+// captureOrderPricingSnapshot freezes an order's pricing from the lines and
+// totals just written for it. Call it in the transaction that creates the
+// order, after the totals are set.
+func captureOrderPricingSnapshot(tx *sql.Tx, orderID, creditCents int) error {
+	snapshot := OrderPricingSnapshot{CapturedAt: time.Now(), Lines: []PricedLine{}, CreditApplied: centsToDollars(creditCents)}
+
+	var subscriptionID sql.NullInt64
+	var subtotalCents, taxCents, tipCents, totalCents int
+	err := tx.QueryRow(`
+		SELECT subscription_id, COALESCE(subtotal_cents, 0), COALESCE(tax_cents, 0),
+		       COALESCE(tip_cents, 0), COALESCE(total_cents, 0)
+		FROM orders WHERE id = $1`,
+		orderID,
+	).Scan(&subscriptionID, &subtotalCents, &taxCents, &tipCents, &totalCents)
+	if err != nil {
+		return err
+	}
+	snapshot.Subtotal = centsToDollars(subtotalCents)
+	snapshot.Tax = centsToDollars(taxCents)
+	snapshot.Tip = centsToDollars(tipCents)
+	snapshot.Total = centsToDollars(totalCents)
+
+	if subscriptionID.Valid {
+		var plan PlanPricingTerms
+		var priceCents int
+		err := tx.QueryRow(`
+			SELECT p.id, p.name, p.price_per_month_cents, p.pickups_per_month
+			FROM subscriptions s
+			JOIN subscription_plans p ON s.plan_id = p.id
+			WHERE s.id = $1`,
+			subscriptionID.Int64,
+		).Scan(&plan.PlanID, &plan.Name, &priceCents, &plan.PickupsPerMonth)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			plan.MonthlyPrice = centsToDollars(priceCents)
+			plan.OverQuotaPickupFee = centsToDollars(overQuotaPickupFeeCents)
+			snapshot.Plan = &plan
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT 'service', oi.id, s.name, COALESCE(s.description, ''), oi.quantity, oi.price_cents,
+		       s.base_price_cents, oi.included_pounds, oi.overweight_cents_per_pound, 1
+		FROM order_items oi
+		JOIN services s ON oi.service_id = s.id
+		WHERE oi.order_id = $1
+		UNION ALL
+		SELECT 'item_options', oi.id, s.name, '', 1, oi.options_price_cents, NULL, NULL, NULL, 1
+		FROM order_items oi
+		JOIN services s ON oi.service_id = s.id
+		WHERE oi.order_id = $1 AND oi.options_price_cents > 0
+		UNION ALL
+		SELECT 'garment', og.id, gt.display_name, '', og.quantity, og.unit_price_cents,
+		       gt.price_cents, NULL, NULL, 2
+		FROM order_garments og
+		JOIN garment_types gt ON og.garment_type_id = gt.id
+		WHERE og.order_id = $1
+		UNION ALL
+		SELECT 'add_on', oa.id, sa.display_name, COALESCE(sa.description, ''), oa.quantity, oa.unit_price_cents,
+		       CASE WHEN sa.pricing_type != 'percent' THEN sa.price_cents END, NULL, NULL, 3
+		FROM order_add_ons oa
+		JOIN service_add_ons sa ON oa.add_on_id = sa.id
+		WHERE oa.order_id = $1
+		ORDER BY 10, 2`,
+		orderID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line PricedLine
+		var unitPriceCents, position int
+		var listPriceCents, overweightCents sql.NullInt64
+		var includedPounds sql.NullFloat64
+		err := rows.Scan(&line.Kind, &line.LineID, &line.Name, &line.Description, &line.Quantity,
+			&unitPriceCents, &listPriceCents, &includedPounds, &overweightCents, &position)
+		if err != nil {
+			return err
+		}
+		line.UnitPrice = centsToDollars(unitPriceCents)
+		if listPriceCents.Valid {
+			listPrice := centsToDollars(int(listPriceCents.Int64))
+			line.ListPrice = &listPrice
+		}
+		if includedPounds.Valid {
+			line.IncludedPounds = &includedPounds.Float64
+		}
+		if overweightCents.Valid {
+			rate := centsToDollars(int(overweightCents.Int64))
+			line.OverweightRate = &rate
+		}
+		snapshot.Lines = append(snapshot.Lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if snapshot.SlotAdjustment, err = getOrderSlotAdjustment(tx, orderID); err != nil {
+		return err
+	}
+	if snapshot.ZoneSurcharge, err = getOrderZoneSurcharge(tx, orderID); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE orders SET pricing_snapshot = $1 WHERE id = $2", payload, orderID)
+	return err
+}
+
+// getOrderPricingSnapshot returns the pricing an order was sold with, or nil
+// for orders placed before snapshots were kept
+func getOrderPricingSnapshot(q queryRower, orderID int) (*OrderPricingSnapshot, error) {
+	var payload []byte
+	if err := q.QueryRow("SELECT pricing_snapshot FROM orders WHERE id = $1", orderID).Scan(&payload); err != nil {
+		return nil, err
+	}
+	if payload == nil {
+		return nil, nil
+	}
+	var snapshot OrderPricingSnapshot
+	if err := json.Unmarshal(payload, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// line returns one of the snapshot's lines, or nil
+func (s *OrderPricingSnapshot) line(kind string, lineID int) *PricedLine {
+	for i, line := range s.Lines {
+		if line.Kind == kind && line.LineID == lineID {
+			return &s.Lines[i]
+		}
+	}
+	return nil
+}
+
+// lineRefundCents is what quantity of a line was paid for, including its
+// share of any peak or off-peak slot pricing
+func (s *OrderPricingSnapshot) lineRefundCents(line *PricedLine, quantity int) int {
+	cents := dollarsToCents(line.UnitPrice) * quantity
+	if s.SlotAdjustment != nil && line.Kind != "add_on" {
+		cents = money.Percent(cents, s.SlotAdjustment.MultiplierPercent)
+	}
+	return cents
+}
+
+// applyTo shows an order's lines under the names they were sold with, so
+// renaming a catalog entry doesn't change past orders
+func (s *OrderPricingSnapshot) applyTo(order *Order) {
+	for i, item := range order.Items {
+		if line := s.line("service", item.ID); line != nil {
+			order.Items[i].ServiceName = line.Name
+		}
+	}
+	for i, garment := range order.Garments {
+		if line := s.line("garment", garment.ID); line != nil {
+			order.Garments[i].GarmentName = line.Name
+		}
+	}
+	for i, addOn := range order.AddOns {
+		if line := s.line("add_on", addOn.ID); line != nil {
+			order.AddOns[i].DisplayName = line.Name
+		}
+	}
+	if s.SlotAdjustment != nil {
+		order.SlotAdjustment = s.SlotAdjustment
+	}
+	if s.ZoneSurcharge != nil {
+		order.ZoneSurcharge = s.ZoneSurcharge
+	}
+	order.Pricing = s
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOrderPricingSnapshot(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "snapshot-admin@example.com", "Snapshot", "Admin")
+	userID := db.CreateTestUser(t, "snapshot@example.com", "Snapshot", "Customer")
+	addressID := db.CreateTestAddress(t, userID)
+	rushBagID := db.GetServiceID(t, "rush_bag")
+
+	handler := NewOrderHandler(db.DB, NewMockRealtimeHandler())
+	handler.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+	body, _ := json.Marshal(CreateOrderRequest{
+		PickupAddressID:   addressID,
+		DeliveryAddressID: addressID,
+		PickupDate:        "2024-12-01",
+		DeliveryDate:      "2024-12-03",
+		PickupTimeSlot:    "9am-12pm",
+		DeliveryTimeSlot:  "1pm-5pm",
+		Items:             []OrderItem{{ServiceID: rushBagID, Quantity: 2, Price: 10.00}},
+	})
+	w := httptest.NewRecorder()
+	handler.handleCreateOrder(w, httptest.NewRequest("POST", "/api/v1/orders/create", bytes.NewBuffer(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to create order: %d - %s", w.Code, w.Body.String())
+	}
+	var created Order
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	// Renaming and repricing the service afterwards doesn't change the order
+	db.Exec("UPDATE services SET name = 'express_bag', base_price_cents = base_price_cents + 500 WHERE id = $1", rushBagID)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/orders/%d", created.ID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(created.ID)})
+	w = httptest.NewRecorder()
+	handler.handleGetOrder(w, req)
+	var order Order
+	json.Unmarshal(w.Body.Bytes(), &order)
+	if order.Pricing == nil {
+		t.Fatalf("Expected a pricing snapshot, got %s", w.Body.String())
+	}
+
+	var bagLine *PricedLine
+	for i, line := range order.Pricing.Lines {
+		if line.Kind == "service" && line.Name == "rush_bag" {
+			bagLine = &order.Pricing.Lines[i]
+		}
+	}
+	if bagLine == nil || bagLine.Quantity != 2 || bagLine.ListPrice == nil {
+		t.Fatalf("Expected the rush bag line as sold, got %+v", order.Pricing.Lines)
+	}
+	for _, item := range order.Items {
+		if item.ServiceName == "express_bag" {
+			t.Errorf("Expected the item under the name it was sold with, got %s", item.ServiceName)
+		}
+	}
+	if order.Pricing.Subtotal != *order.Subtotal {
+		t.Errorf("Expected the snapshot subtotal %.2f to match the order's %.2f", order.Pricing.Subtotal, *order.Subtotal)
+	}
+
+	// One bag is refunded at the price it was sold for
+	db.Exec(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id)
+		VALUES ($1, $2, $3, 'extra_order', 'completed', $4)`,
+		userID, created.ID, dollarsToCents(*order.Total), sandboxPaymentPrefix+"pi_snapshot")
+
+	admin := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	refund := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/v1/admin/orders/%d/refunds", created.ID), strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(created.ID)})
+		w := httptest.NewRecorder()
+		admin.handleCreateRefund(w, req)
+		return w
+	}
+
+	w = refund(fmt.Sprintf(`{"reason": "Bag lost", "line_kind": "service", "line_id": %d, "quantity": 1}`, bagLine.LineID))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var rf Refund
+	json.Unmarshal(w.Body.Bytes(), &rf)
+	if rf.Amount != bagLine.UnitPrice {
+		t.Errorf("Expected a refund of %.2f, got %.2f", bagLine.UnitPrice, rf.Amount)
+	}
+
+	if w := refund(fmt.Sprintf(`{"reason": "Bag lost", "line_kind": "service", "line_id": %d, "quantity": 3}`, bagLine.LineID)); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d refunding more than the line, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxDeviceTokenLength = 4096
+	// maxPushAttempts is how many times a push is tried before it's dropped;
+	// a late order update is worse than none
+	maxPushAttempts = 4
+	// pushDispatchBatch bounds how many pushes one dispatch run sends
+	pushDispatchBatch = 200
+	// pushSendLease is how long a claimed push is left alone before another
+	// dispatch run may try it, should this one die mid-send
+	pushSendLease = 5 * time.Minute
+	// driverArrivalRadiusKm is how close the driver gets before the customer
+	// at the next stop is told they're arriving
+	driverArrivalRadiusKm = 0.5
+)
+
+// pushRetryBackoff is the wait before each retry of a failed push
+var pushRetryBackoff = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// Push categories; customers can turn each off in their push preferences
+const (
+	pushOrderUpdates  = "order_updates"
+	pushDriverArrival = "driver_arrival"
+	pushPaymentIssues = "payment_issues"
+)
+
+// errInvalidPushToken means the provider says the device token will never
+// work again: the app was uninstalled or the token was rotated
+var errInvalidPushToken = errors.New("push token is no longer valid")
+
+// PushMessage is what a device shows, plus data the app reads on tap
+type PushMessage struct {
+	Title string
+	Body  string
+	Data  map[string]string
+}
+
+// PushSender delivers a push to one device through APNs or FCM
+type PushSender interface {
+	Send(ctx context.Context, token string, msg PushMessage) error
+}
+
+// PushNotification is a push for every device a user has registered
+type PushNotification struct {
+	UserID   int
+	Category string
+	OrderID  *int
+	Title    string
+	Body     string
+	Data     map[string]string
+}
+
+// PushDispatcher queues pushes in push_deliveries and sends them. A nil
+// dispatcher, or one without senders, queues nothing.
+type PushDispatcher struct {
+	db      *sql.DB
+	senders map[string]PushSender // By device platform: ios, android
+}
+
+func NewPushDispatcher(db *sql.DB, senders map[string]PushSender) *PushDispatcher {
+	return &PushDispatcher{db: db, senders: senders}
+}
+
+func (d *PushDispatcher) platforms() []string {
+	platforms := []string{}
+	for platform := range d.senders {
+		platforms = append(platforms, platform)
+	}
+	return platforms
+}
+
+// Queue adds a push for each of the user's valid devices on a platform that
+// can be sent to, unless they've turned the category off. It runs in q so a
+// push can be queued in the transaction that caused it.
+func (d *PushDispatcher) Queue(q execer, n PushNotification) error {
+	if d == nil || len(d.senders) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(n.Data)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`
+		INSERT INTO push_deliveries (device_token_id, user_id, category, order_id, title, body, data)
+		SELECT t.id, t.user_id, $2, $3, $4, $5, $6
+		FROM device_tokens t
+		LEFT JOIN push_preferences p ON p.user_id = t.user_id
+		WHERE t.user_id = $1 AND t.invalidated_at IS NULL AND t.platform = ANY($7)
+		  AND CASE $2
+			WHEN 'order_updates' THEN COALESCE(p.order_updates, true)
+			WHEN 'driver_arrival' THEN COALESCE(p.driver_arrival, true)
+			WHEN 'payment_issues' THEN COALESCE(p.payment_issues, true)
+			ELSE false
+		  END`,
+		n.UserID, n.Category, n.OrderID, n.Title, n.Body, data, pq.Array(d.platforms()),
+	)
+	return err
+}
+
+// QueueOrderStatus pushes an order status update a customer has to see
+func (d *PushDispatcher) QueueOrderStatus(q execer, userID, orderID int, status, message string) error {
+	if !criticalOrderStatuses[status] {
+		return nil
+	}
+	title := status
+	if def, ok := orderStatusDefinition(status); ok {
+		title = def.Label
+	}
+	return d.Queue(q, PushNotification{
+		UserID:   userID,
+		Category: pushOrderUpdates,
+		OrderID:  &orderID,
+		Title:    title,
+		Body:     message,
+		Data:     map[string]string{"type": "order_status_update", "order_id": fmt.Sprint(orderID), "status": status},
+	})
+}
+
+// Dispatch sends pushes that are due. Each is claimed for pushSendLease
+// first, so the network calls happen outside any transaction.
+func (d *PushDispatcher) Dispatch(ctx context.Context) (sent, failed int, err error) {
+	rows, err := d.db.Query(`
+		UPDATE push_deliveries d SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+		FROM device_tokens t
+		WHERE t.id = d.device_token_id AND d.id IN (
+			SELECT id FROM push_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.device_token_id, t.platform, t.token, d.title, d.body, d.data, d.attempts`,
+		pushDispatchBatch, pushSendLease.Seconds(),
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	type claimed struct {
+		id, tokenID, attempts int
+		platform, token       string
+		msg                   PushMessage
+	}
+	batch := []claimed{}
+	for rows.Next() {
+		var c claimed
+		var data []byte
+		if err := rows.Scan(&c.id, &c.tokenID, &c.platform, &c.token, &c.msg.Title, &c.msg.Body, &data, &c.attempts); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		json.Unmarshal(data, &c.msg.Data)
+		batch = append(batch, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, c := range batch {
+		sender, ok := d.senders[c.platform]
+		sendErr := fmt.Errorf("no push sender for %s", c.platform)
+		if ok {
+			sendErr = sender.Send(ctx, c.token, c.msg)
+		}
+
+		switch {
+		case sendErr == nil:
+			sent++
+			_, err = d.db.Exec(`
+				UPDATE push_deliveries SET status = 'sent', attempts = attempts + 1, sent_at = CURRENT_TIMESTAMP, last_error = NULL
+				WHERE id = $1`,
+				c.id,
+			)
+		case errors.Is(sendErr, errInvalidPushToken):
+			failed++
+			err = invalidateDeviceToken(d.db, c.tokenID)
+		default:
+			failed++
+			if c.attempts+1 >= maxPushAttempts {
+				_, err = d.db.Exec(`
+					UPDATE push_deliveries SET status = 'failed', attempts = attempts + 1, last_error = $2
+					WHERE id = $1`,
+					c.id, sendErr.Error(),
+				)
+			} else {
+				_, err = d.db.Exec(`
+					UPDATE push_deliveries SET attempts = attempts + 1, last_error = $2,
+						next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $3)
+					WHERE id = $1`,
+					c.id, sendErr.Error(), pushRetryBackoff[c.attempts].Seconds(),
+				)
+			}
+		}
+		if err != nil {
+			return sent, failed, err
+		}
+	}
+	return sent, failed, nil
+}
+
+// invalidateDeviceToken stops sending to a token the provider rejected,
+// dropping everything still queued for it
+func invalidateDeviceToken(db *sql.DB, tokenID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE device_tokens SET invalidated_at = CURRENT_TIMESTAMP WHERE id = $1", tokenID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE push_deliveries SET status = 'invalid_token', last_error = $2
+		WHERE device_token_id = $1 AND status = 'pending'`,
+		tokenID, errInvalidPushToken.Error(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// processPushDeliveries sends queued pushes and retries failed ones
+func (s *AutoScheduler) processPushDeliveries() {
+	if s.push == nil || len(s.push.senders) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Second)
+	defer cancel()
+
+	sent, failed, err := s.push.Dispatch(ctx)
+	if err != nil {
+		log.Printf("Error dispatching push notifications: %v", err)
+	}
+	if sent > 0 || failed > 0 {
+		log.Printf("Sent %d push notifications, %d failed", sent, failed)
+	}
+}
+
+// PushHandler lets the mobile apps register devices and customers choose
+// which pushes they get
+type PushHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewPushHandler(db *sql.DB) *PushHandler {
+	return &PushHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type RegisterDeviceRequest struct {
+	Token      string `json:"token"`
+	Platform   string `json:"platform"` // ios, android
+	AppVersion string `json:"app_version,omitempty"`
+}
+
+// DeviceToken is a device registered for push
+type DeviceToken struct {
+	ID         int       `json:"id"`
+	Platform   string    `json:"platform"`
+	AppVersion *string   `json:"app_version,omitempty"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type PushPreferences struct {
+	OrderUpdates  bool `json:"order_updates"`
+	DriverArrival bool `json:"driver_arrival"`
+	PaymentIssues bool `json:"payment_issues"`
+}
+
+type UpdatePushPreferencesRequest struct {
+	OrderUpdates  *bool `json:"order_updates,omitempty"`
+	DriverArrival *bool `json:"driver_arrival,omitempty"`
+	PaymentIssues *bool `json:"payment_issues,omitempty"`
+}
+
+// handleRegisterDevice records the app's push token. The app calls it on
+// every launch; a token that moves to another account (someone else signs in
+// on the device) stops receiving the previous account's pushes.
+func (h *PushHandler) handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RegisterDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Token = strings.TrimSpace(req.Token)
+	if req.Token == "" || len(req.Token) > maxDeviceTokenLength {
+		http.Error(w, "A valid token is required", http.StatusBadRequest)
+		return
+	}
+	if req.Platform != "ios" && req.Platform != "android" {
+		http.Error(w, "platform must be ios or android", http.StatusBadRequest)
+		return
+	}
+	var appVersion *string
+	if v := strings.TrimSpace(req.AppVersion); v != "" {
+		appVersion = &v
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to register device", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	device := DeviceToken{Platform: req.Platform, AppVersion: appVersion}
+	var inserted bool
+	err = tx.QueryRow(`
+		INSERT INTO device_tokens (user_id, platform, token, app_version)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (token) DO UPDATE SET
+			user_id = EXCLUDED.user_id, platform = EXCLUDED.platform, app_version = EXCLUDED.app_version,
+			last_seen_at = CURRENT_TIMESTAMP, invalidated_at = NULL
+		RETURNING id, last_seen_at, created_at, xmax = 0`,
+		userID, req.Platform, req.Token, appVersion,
+	).Scan(&device.ID, &device.LastSeenAt, &device.CreatedAt, &inserted)
+	if err != nil {
+		http.Error(w, "Failed to register device", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE push_deliveries SET status = 'failed', last_error = 'Device registered to another account'
+		WHERE device_token_id = $1 AND user_id <> $2 AND status = 'pending'`,
+		device.ID, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to register device", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to register device", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if inserted {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(device)
+}
+
+// handleUnregisterDevice stops pushes to a device, e.g. when signing out
+func (h *PushHandler) handleUnregisterDevice(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM device_tokens WHERE token = $1 AND user_id = $2", mux.Vars(r)["token"], userID)
+	if err != nil {
+		http.Error(w, "Failed to unregister device", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getPushPreferences(q queryRower, userID int) (PushPreferences, error) {
+	prefs := PushPreferences{OrderUpdates: true, DriverArrival: true, PaymentIssues: true}
+	err := q.QueryRow(`
+		SELECT order_updates, driver_arrival, payment_issues
+		FROM push_preferences WHERE user_id = $1`,
+		userID,
+	).Scan(&prefs.OrderUpdates, &prefs.DriverArrival, &prefs.PaymentIssues)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return prefs, err
+}
+
+func (h *PushHandler) handleGetPushPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	prefs, err := getPushPreferences(h.db, userID)
+	if err != nil {
+		http.Error(w, "Failed to load push preferences", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// handleUpdatePushPreferences turns push categories on or off; fields left
+// out keep their current setting
+func (h *PushHandler) handleUpdatePushPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req UpdatePushPreferencesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	prefs, err := getPushPreferences(h.db, userID)
+	if err != nil {
+		http.Error(w, "Failed to update push preferences", http.StatusInternalServerError)
+		return
+	}
+	if req.OrderUpdates != nil {
+		prefs.OrderUpdates = *req.OrderUpdates
+	}
+	if req.DriverArrival != nil {
+		prefs.DriverArrival = *req.DriverArrival
+	}
+	if req.PaymentIssues != nil {
+		prefs.PaymentIssues = *req.PaymentIssues
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO push_preferences (user_id, order_updates, driver_arrival, payment_issues)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET
+			order_updates = EXCLUDED.order_updates, driver_arrival = EXCLUDED.driver_arrival,
+			payment_issues = EXCLUDED.payment_issues, updated_at = CURRENT_TIMESTAMP`,
+		userID, prefs.OrderUpdates, prefs.DriverArrival, prefs.PaymentIssues,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update push preferences", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
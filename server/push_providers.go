@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2/google"
+)
+
+// apnsTokenLifetime is how long an APNs provider token is reused. Apple
+// rejects tokens older than an hour and throttles ones refreshed too often.
+const apnsTokenLifetime = 50 * time.Minute
+
+// APNsSender sends to iOS devices with token-based APNs authentication
+type APNsSender struct {
+	keyID  string
+	teamID string
+	topic  string // The app's bundle ID
+	key    *ecdsa.PrivateKey
+	host   string
+	client *http.Client
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+func NewAPNsSender(keyID, teamID, topic string, keyPEM []byte, sandbox bool) (*APNsSender, error) {
+	key, err := jwt.ParseECPrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid APNs key: %v", err)
+	}
+	host := "https://api.push.apple.com"
+	if sandbox {
+		host = "https://api.sandbox.push.apple.com"
+	}
+	return &APNsSender{
+		keyID:  keyID,
+		teamID: teamID,
+		topic:  topic,
+		key:    key,
+		host:   host,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *APNsSender) providerToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Since(s.issuedAt) < apnsTokenLifetime {
+		return s.token, nil
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": s.teamID, "iat": now.Unix()})
+	token.Header["kid"] = s.keyID
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		return "", err
+	}
+	s.token, s.issuedAt = signed, now
+	return signed, nil
+}
+
+func (s *APNsSender) Send(ctx context.Context, deviceToken string, msg PushMessage) error {
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{"title": msg.Title, "body": msg.Body},
+			"sound": "default",
+		},
+	}
+	for key, value := range msg.Data {
+		payload[key] = value
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	providerToken, err := s.providerToken()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.host+"/3/device/"+deviceToken, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "bearer "+providerToken)
+	req.Header.Set("apns-topic", s.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var reply struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&reply)
+	if resp.StatusCode == http.StatusGone || reply.Reason == "BadDeviceToken" || reply.Reason == "DeviceTokenNotForTopic" {
+		return fmt.Errorf("%w: apns %s", errInvalidPushToken, reply.Reason)
+	}
+	return fmt.Errorf("apns returned %s: %s", resp.Status, reply.Reason)
+}
+
+// FCMSender sends to Android devices with the FCM HTTP v1 API, authorised
+// as a Google service account
+type FCMSender struct {
+	projectID string
+	endpoint  string
+	client    *http.Client // Adds and refreshes the OAuth access token
+}
+
+func NewFCMSender(serviceAccountJSON []byte) (*FCMSender, error) {
+	var account struct {
+		ProjectID string `json:"project_id"`
+	}
+	if err := json.Unmarshal(serviceAccountJSON, &account); err != nil || account.ProjectID == "" {
+		return nil, fmt.Errorf("invalid FCM service account: no project_id")
+	}
+	config, err := google.JWTConfigFromJSON(serviceAccountJSON, "https://www.googleapis.com/auth/firebase.messaging")
+	if err != nil {
+		return nil, fmt.Errorf("invalid FCM service account: %v", err)
+	}
+	client := config.Client(context.Background())
+	client.Timeout = 10 * time.Second
+	return &FCMSender{
+		projectID: account.ProjectID,
+		endpoint:  "https://fcm.googleapis.com/v1/projects/" + account.ProjectID + "/messages:send",
+		client:    client,
+	}, nil
+}
+
+func (s *FCMSender) Send(ctx context.Context, deviceToken string, msg PushMessage) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        deviceToken,
+			"notification": map[string]string{"title": msg.Title, "body": msg.Body},
+			"data":         msg.Data,
+			"android":      map[string]string{"priority": "high"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var reply struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 16384)).Decode(&reply)
+	for _, detail := range reply.Error.Details {
+		if detail.ErrorCode == "UNREGISTERED" {
+			return fmt.Errorf("%w: fcm unregistered", errInvalidPushToken)
+		}
+	}
+	// A malformed token is reported as a bad argument rather than by its own code
+	if resp.StatusCode == http.StatusNotFound ||
+		(reply.Error.Status == "INVALID_ARGUMENT" && strings.Contains(reply.Error.Message, "registration token")) {
+		return fmt.Errorf("%w: fcm %s", errInvalidPushToken, reply.Error.Message)
+	}
+	return fmt.Errorf("fcm returned %s: %s", resp.Status, reply.Error.Message)
+}
+
+// pushSendersFromEnv configures APNs from APNS_KEY_ID, APNS_TEAM_ID,
+// APNS_TOPIC and APNS_PRIVATE_KEY (the .p8 key's PEM; APNS_SANDBOX=true for
+// development builds), and FCM from FCM_SERVICE_ACCOUNT_JSON. A platform
+// left unconfigured gets no pushes.
+func pushSendersFromEnv() (map[string]PushSender, error) {
+	senders := map[string]PushSender{}
+	if keyID := os.Getenv("APNS_KEY_ID"); keyID != "" {
+		sender, err := NewAPNsSender(keyID, os.Getenv("APNS_TEAM_ID"), os.Getenv("APNS_TOPIC"),
+			[]byte(os.Getenv("APNS_PRIVATE_KEY")), os.Getenv("APNS_SANDBOX") == "true")
+		if err != nil {
+			return nil, err
+		}
+		senders["ios"] = sender
+	}
+	if account := os.Getenv("FCM_SERVICE_ACCOUNT_JSON"); account != "" {
+		sender, err := NewFCMSender([]byte(account))
+		if err != nil {
+			return nil, err
+		}
+		senders["android"] = sender
+	}
+	return senders, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// scriptedPushSender records pushes and fails the tokens it's told to
+type scriptedPushSender struct {
+	sent    []string
+	invalid map[string]bool
+	down    bool
+}
+
+func (s *scriptedPushSender) Send(ctx context.Context, token string, msg PushMessage) error {
+	if s.invalid[token] {
+		return fmt.Errorf("%w: test", errInvalidPushToken)
+	}
+	if s.down {
+		return errors.New("connection refused")
+	}
+	s.sent = append(s.sent, token+": "+msg.Title)
+	return nil
+}
+
+func TestPushNotifications(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "push-customer@example.com", "Push", "Customer")
+	otherID := db.CreateTestUser(t, "push-other@example.com", "Push", "Other")
+	orderID := db.CreateTestOrder(t, userID, db.CreateTestAddress(t, userID))
+
+	handler := NewPushHandler(db.DB)
+	call := func(userID int, fn http.HandlerFunc, method, token, body string) *httptest.ResponseRecorder {
+		handler.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+		req := httptest.NewRequest(method, "/api/v1/account/push-devices", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"token": token})
+		w := httptest.NewRecorder()
+		fn(w, req)
+		return w
+	}
+	for _, body := range []string{
+		`{"token": "ios-phone", "platform": "ios", "app_version": "2.4.0"}`,
+		`{"token": "android-tablet", "platform": "android"}`,
+		`{"token": "old-phone", "platform": "ios"}`,
+	} {
+		if w := call(userID, handler.handleRegisterDevice, "POST", "", body); w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+	if w := call(userID, handler.handleRegisterDevice, "POST", "", `{"token": "x", "platform": "web"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unknown platform, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := call(userID, handler.handleRegisterDevice, "POST", "", `{"token": "ios-phone", "platform": "ios"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d re-registering, got %d", http.StatusOK, w.Code)
+	}
+
+	// Only iOS is configured, so the Android device isn't queued
+	ios := &scriptedPushSender{invalid: map[string]bool{"old-phone": true}}
+	push := NewPushDispatcher(db.DB, map[string]PushSender{"ios": ios})
+	pending := func() int {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM push_deliveries WHERE user_id = $1 AND status = 'pending'", userID).Scan(&count)
+		return count
+	}
+	if err := push.QueueOrderStatus(db.DB, userID, orderID, "in_process", "Washing"); err != nil || pending() != 0 {
+		t.Errorf("Expected routine statuses not pushed, got %d (%v)", pending(), err)
+	}
+	if err := push.QueueOrderStatus(db.DB, userID, orderID, "out_for_delivery", "On its way"); err != nil || pending() != 2 {
+		t.Fatalf("Expected a push per iOS device, got %d (%v)", pending(), err)
+	}
+
+	// Turning payment pushes off stops them; order updates stay on
+	if w := call(userID, handler.handleUpdatePushPreferences, "PUT", "", `{"payment_issues": false}`); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), `"order_updates":true`) {
+		t.Errorf("Unexpected preferences %d: %s", w.Code, w.Body.String())
+	}
+	push.Queue(db.DB, PushNotification{UserID: userID, Category: pushPaymentIssues, Title: "Payment failed", Body: "Card declined"})
+	if pending() != 2 {
+		t.Errorf("Expected the payment push skipped, got %d pending", pending())
+	}
+
+	sent, failed, err := push.Dispatch(context.Background())
+	if err != nil || sent != 1 || failed != 1 || len(ios.sent) != 1 || ios.sent[0] != "ios-phone: Out for Delivery" {
+		t.Errorf("Expected one push sent and one rejected, got %d/%d %v (%v)", sent, failed, ios.sent, err)
+	}
+	var invalidated bool
+	db.QueryRow("SELECT invalidated_at IS NOT NULL FROM device_tokens WHERE token = 'old-phone'").Scan(&invalidated)
+	if !invalidated {
+		t.Error("Expected the rejected token invalidated")
+	}
+
+	// A provider outage is retried later rather than dropped
+	ios.down = true
+	push.QueueOrderStatus(db.DB, userID, orderID, "delivered", "Delivered")
+	if sent, failed, _ := push.Dispatch(context.Background()); sent != 0 || failed != 1 || pending() != 1 {
+		t.Errorf("Expected the failed push kept for retry, got %d/%d with %d pending", sent, failed, pending())
+	}
+	if sent, _, _ := push.Dispatch(context.Background()); sent != 0 {
+		t.Error("Expected the retry to wait for its backoff")
+	}
+
+	// Someone else signing in on the phone takes the token and its queue
+	if w := call(otherID, handler.handleRegisterDevice, "POST", "", `{"token": "ios-phone", "platform": "ios"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if pending() != 0 {
+		t.Errorf("Expected the previous account's pushes dropped, got %d pending", pending())
+	}
+	if w := call(userID, handler.handleUnregisterDevice, "DELETE", "ios-phone", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d unregistering another account's device, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := call(otherID, handler.handleUnregisterDevice, "DELETE", "ios-phone", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+}
+
+func TestDriverArrivalPush(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "arrival-driver@example.com", "Arrival", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "arrival-customer@example.com", "Arrival", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	db.Exec("UPDATE addresses SET latitude = 40.7500, longitude = -74.0000 WHERE id = $1", addressID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	db.Exec("INSERT INTO device_tokens (user_id, platform, token) VALUES ($1, 'android', 'customer-phone')", customerID)
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'in_progress') RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1)", routeID, orderID)
+
+	handler := NewDriverLocationHandler(db.DB, newMemoryDriverLocationStore(), &recordingLocationPublisher{})
+	handler.push = NewPushDispatcher(db.DB, map[string]PushSender{"android": &scriptedPushSender{}})
+	handler.getUserID = CreateAuthMock(driverID).getUserIDFromRequest
+	arrivals := func(lat float64) int {
+		w := httptest.NewRecorder()
+		handler.handleUpdateLocation(w, httptest.NewRequest("POST", "/api/v1/driver/location",
+			strings.NewReader(fmt.Sprintf(`{"latitude": %f, "longitude": -74.0}`, lat))))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM push_deliveries WHERE category = 'driver_arrival' AND order_id = $1", orderID).Scan(&count)
+		return count
+	}
+
+	if n := arrivals(40.70); n != 0 {
+		t.Errorf("Expected no arrival push 5 km out, got %d", n)
+	}
+	if n := arrivals(40.748); n != 1 {
+		t.Errorf("Expected an arrival push 200 m out, got %d", n)
+	}
+	if n := arrivals(40.749); n != 1 {
+		t.Errorf("Expected the customer told only once, got %d", n)
+	}
+}
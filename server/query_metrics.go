@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Query metrics time every query and exec, record them in a Prometheus
+// histogram per named query, and log the ones over their latency budget
+// with the code that made them, so slow admin queries can be found without
+// turning on Postgres statement logging.
+//
+//	SLOW_QUERY_THRESHOLD_MS  default budget; 0 turns slow-query logging off (default 500)
+//	QUERY_LATENCY_BUDGETS    per-query budgets, e.g. (*AdminHandler).handleGetOrders=200,order_search=1000
+//	METRICS_TOKEN            bearer token /metrics requires, when set
+//
+// A query is named by a leading "-- name: <name>" comment, or else by the
+// function that ran it. The log line also names the handler or scheduled
+// job further up the stack, when that's a different function.
+
+const (
+	defaultSlowQueryThreshold = 500 * time.Millisecond
+
+	// maxLoggedStatementLength and maxLoggedArgs keep one slow query from
+	// flooding the log
+	maxLoggedStatementLength = 500
+	maxLoggedArgs            = 20
+)
+
+// queryDurationBuckets run from a fast index lookup to a timed-out report
+var queryDurationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type QueryMetricsConfig struct {
+	SlowThreshold time.Duration
+	Budgets       map[string]time.Duration
+	MetricsToken  string
+}
+
+// queryMetricsConfigFromEnv reads the slow-query settings. A budget that
+// doesn't parse is an error rather than silently ignored.
+func queryMetricsConfigFromEnv() (QueryMetricsConfig, error) {
+	config := QueryMetricsConfig{
+		SlowThreshold: defaultSlowQueryThreshold,
+		Budgets:       map[string]time.Duration{},
+		MetricsToken:  os.Getenv("METRICS_TOKEN"),
+	}
+	if raw := os.Getenv("SLOW_QUERY_THRESHOLD_MS"); raw != "" {
+		ms, err := strconv.Atoi(raw)
+		if err != nil || ms < 0 {
+			return QueryMetricsConfig{}, fmt.Errorf("SLOW_QUERY_THRESHOLD_MS must be a non-negative number")
+		}
+		config.SlowThreshold = time.Duration(ms) * time.Millisecond
+	}
+	if raw := os.Getenv("QUERY_LATENCY_BUDGETS"); raw != "" {
+		for _, entry := range strings.Split(raw, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			ms, err := strconv.Atoi(strings.TrimSpace(value))
+			if !ok || strings.TrimSpace(name) == "" || err != nil || ms <= 0 {
+				return QueryMetricsConfig{}, fmt.Errorf("QUERY_LATENCY_BUDGETS entry %q must be name=milliseconds", entry)
+			}
+			config.Budgets[strings.TrimSpace(name)] = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return config, nil
+}
+
+// QueryMetrics records query durations. A nil QueryMetrics records nothing,
+// like a nil Tracer.
+type QueryMetrics struct {
+	config   QueryMetricsConfig
+	duration *prometheus.HistogramVec
+	slow     *prometheus.CounterVec
+	log      func(msg string, args ...any)
+}
+
+// NewQueryMetrics registers the query metrics with registerer
+func NewQueryMetrics(config QueryMetricsConfig, registerer prometheus.Registerer) *QueryMetrics {
+	m := &QueryMetrics{
+		config: config,
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tumble_db_query_duration_seconds",
+			Help:    "Time to run a database query or exec, by query name.",
+			Buckets: queryDurationBuckets,
+		}, []string{"query"}),
+		slow: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tumble_db_slow_queries_total",
+			Help: "Queries and execs that went over their latency budget, by query name.",
+		}, []string{"query"}),
+		log: slog.Warn,
+	}
+	registerer.MustRegister(m.duration, m.slow)
+	return m
+}
+
+// budget is how long the named query may take before it's logged
+func (m *QueryMetrics) budget(name string) time.Duration {
+	if budget, ok := m.config.Budgets[name]; ok {
+		return budget
+	}
+	return m.config.SlowThreshold
+}
+
+// observe records one query. Only slow ones pay for formatting their
+// statement and arguments.
+func (m *QueryMetrics) observe(caller queryCaller, query string, args []driver.NamedValue, elapsed time.Duration, err error) {
+	name := queryName(query, caller)
+	m.duration.WithLabelValues(name).Observe(elapsed.Seconds())
+
+	budget := m.budget(name)
+	if budget <= 0 || elapsed < budget {
+		return
+	}
+	m.slow.WithLabelValues(name).Inc()
+	attrs := []any{
+		"query", name,
+		"duration_ms", elapsed.Milliseconds(),
+		"budget_ms", budget.Milliseconds(),
+		"statement", truncateStatement(query, maxLoggedStatementLength),
+		"args", sanitizeQueryArgs(args),
+	}
+	if caller.handler != "" && caller.handler != caller.function {
+		attrs = append(attrs, "handler", caller.handler)
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err.Error())
+	}
+	m.log("Slow query", attrs...)
+}
+
+// Handler serves the Prometheus metrics, behind METRICS_TOKEN when it's set
+func (m *QueryMetrics) Handler() http.Handler {
+	metrics := promhttp.Handler()
+	token := ""
+	if m != nil {
+		token = m.config.MetricsToken
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+// queryNameComment matches the "-- name: order_search" a query can start with
+var queryNameComment = regexp.MustCompile(`^\s*--\s*name:\s*([\w.-]+)`)
+
+func queryName(query string, caller queryCaller) string {
+	if match := queryNameComment.FindStringSubmatch(query); match != nil {
+		return match[1]
+	}
+	if caller.function != "" {
+		return caller.function
+	}
+	return "unknown"
+}
+
+// queryCaller is where in our code a query came from: the function that ran
+// it, and the handler or scheduled job that function was called from
+type queryCaller struct {
+	function string
+	handler  string
+}
+
+// ourFunctionPrefix is how runtime names this package's functions: "main."
+// in the server, the module path in a test binary
+var ourFunctionPrefix = strings.TrimSuffix(runtime.FuncForPC(reflect.ValueOf(trimClosureSuffix).Pointer()).Name(), "trimClosureSuffix")
+
+// callerOfQuery walks up from the driver to the first function of ours.
+// Helpers that take a db are common, so it keeps going for the first
+// handle* or process* function above them.
+func callerOfQuery() queryCaller {
+	var pcs [32]uintptr
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs[:])])
+	var caller queryCaller
+	for {
+		frame, more := frames.Next()
+		if name, ok := strings.CutPrefix(frame.Function, ourFunctionPrefix); ok {
+			name = trimClosureSuffix(name)
+			if caller.function == "" {
+				caller.function = name
+			}
+			method := name[strings.LastIndex(name, ".")+1:]
+			if strings.HasPrefix(method, "handle") || strings.HasPrefix(method, "process") {
+				caller.handler = name
+				break
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return caller
+}
+
+// trimClosureSuffix names a closure after the function it's in, so
+// "processAdminAlerts.func1" and "processAdminAlerts.func2" share a series
+func trimClosureSuffix(name string) string {
+	for {
+		i := strings.LastIndex(name, ".func")
+		if i < 0 {
+			return name
+		}
+		if _, err := strconv.Atoi(strings.ReplaceAll(name[i+len(".func"):], ".", "")); err != nil {
+			return name
+		}
+		name = name[:i]
+	}
+}
+
+func truncateStatement(query string, limit int) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > limit {
+		query = query[:limit] + "..."
+	}
+	return query
+}
+
+// safeQueryArg matches strings that read like a status or type rather than
+// customer data: short, lowercase, no digits, no @
+var safeQueryArg = regexp.MustCompile(`^[a-z_ -]{1,32}$`)
+
+// sanitizeQueryArgs formats a query's arguments for the log. Numbers, dates
+// and enum-like strings are kept, since they're what explains a slow plan;
+// other strings and bytes are reduced to their length.
+func sanitizeQueryArgs(args []driver.NamedValue) []string {
+	sanitized := make([]string, 0, min(len(args), maxLoggedArgs))
+	for i, arg := range args {
+		if i == maxLoggedArgs {
+			sanitized = append(sanitized, fmt.Sprintf("... %d more", len(args)-maxLoggedArgs))
+			break
+		}
+		var value string
+		switch v := arg.Value.(type) {
+		case nil:
+			value = "NULL"
+		case int64, float64, bool:
+			value = fmt.Sprint(v)
+		case time.Time:
+			value = v.Format(time.RFC3339)
+		case string:
+			if safeQueryArg.MatchString(v) {
+				value = strconv.Quote(v)
+			} else {
+				value = fmt.Sprintf("<string, %d chars>", len(v))
+			}
+		case []byte:
+			value = fmt.Sprintf("<%d bytes>", len(v))
+		default:
+			value = fmt.Sprintf("<%T>", v)
+		}
+		sanitized = append(sanitized, fmt.Sprintf("$%d=%s", arg.Ordinal, value))
+	}
+	return sanitized
+}
+
+// sqlDriver wraps next so every query and exec is timed. Like tracing it
+// sees queries made through the *sql.DB and its transactions; statements
+// prepared by hand aren't timed.
+func (m *QueryMetrics) sqlDriver(next driver.Driver) driver.Driver {
+	if m == nil {
+		return next
+	}
+	return &queryMetricsDriver{metrics: m, next: next}
+}
+
+type queryMetricsDriver struct {
+	metrics *QueryMetrics
+	next    driver.Driver
+}
+
+func (d *queryMetricsDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.next.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &queryMetricsConn{Conn: conn, metrics: d.metrics}, nil
+}
+
+// queryMetricsConn wraps a connection, timing queries and execs and
+// delegating everything else untouched
+type queryMetricsConn struct {
+	driver.Conn
+	metrics *QueryMetrics
+}
+
+func (c *queryMetricsConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if prep, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return prep.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *queryMetricsConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if begin, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return begin.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// QueryContext times the query until its first rows are back; reading the
+// rest is the caller's time
+func (c *queryMetricsConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.metrics.observe(callerOfQuery(), query, args, time.Since(start), err)
+	}
+	return rows, err
+}
+
+func (c *queryMetricsConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.metrics.observe(callerOfQuery(), query, args, time.Since(start), err)
+	}
+	return result, err
+}
+
+func (c *queryMetricsConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *queryMetricsConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *queryMetricsConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQueryMetricsConfigFromEnv(t *testing.T) {
+	t.Setenv("SLOW_QUERY_THRESHOLD_MS", "")
+	t.Setenv("QUERY_LATENCY_BUDGETS", "")
+	if config, err := queryMetricsConfigFromEnv(); err != nil || config.SlowThreshold != defaultSlowQueryThreshold {
+		t.Fatalf("Expected the default threshold, got %+v, %v", config, err)
+	}
+
+	t.Setenv("SLOW_QUERY_THRESHOLD_MS", "200")
+	t.Setenv("QUERY_LATENCY_BUDGETS", "(*AdminHandler).handleGetOrders=50, order_search=1000")
+	config, err := queryMetricsConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.SlowThreshold != 200*time.Millisecond || config.Budgets["(*AdminHandler).handleGetOrders"] != 50*time.Millisecond ||
+		config.Budgets["order_search"] != time.Second {
+		t.Errorf("Unexpected config %+v", config)
+	}
+
+	for env, value := range map[string]string{
+		"SLOW_QUERY_THRESHOLD_MS": "slow",
+		"QUERY_LATENCY_BUDGETS":   "order_search",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := queryMetricsConfigFromEnv(); err == nil {
+				t.Errorf("Expected %s=%s to be rejected", env, value)
+			}
+		})
+	}
+}
+
+func TestSanitizeQueryArgs(t *testing.T) {
+	args := []driver.NamedValue{
+		{Ordinal: 1, Value: int64(42)},
+		{Ordinal: 2, Value: "completed"},
+		{Ordinal: 3, Value: "jane@example.com"},
+		{Ordinal: 4, Value: nil},
+		{Ordinal: 5, Value: []byte("secret")},
+	}
+	got := strings.Join(sanitizeQueryArgs(args), " ")
+	expected := `$1=42 $2="completed" $3=<string, 16 chars> $4=NULL $5=<6 bytes>`
+	if got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
+
+// slowQueryHelper stands in for a helper that runs queries for a handler
+func slowQueryHelper(db *sql.DB, query string, args ...interface{}) error {
+	_, err := db.Exec(query, args...)
+	return err
+}
+
+func (h *AdminHandler) handleSlowQueryTest(db *sql.DB) error {
+	return slowQueryHelper(db, "UPDATE orders\n\tSET status = $1 WHERE customer_email = $2", "cancelled", "jane@example.com")
+}
+
+func TestQueryMetricsDriver(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewQueryMetrics(QueryMetricsConfig{
+		SlowThreshold: time.Nanosecond,
+		Budgets:       map[string]time.Duration{"fast_enough": time.Hour},
+	}, registry)
+	var logged []string
+	metrics.log = func(msg string, args ...any) {
+		logged = append(logged, msg+" "+fmt.Sprintln(args...))
+	}
+	db := sql.OpenDB(driverConnector{driver: metrics.sqlDriver(chaosTestDriver{})})
+	defer db.Close()
+
+	if err := (&AdminHandler{}).handleSlowQueryTest(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("-- name: fast_enough\nUPDATE orders SET status = 'cancelled'"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logged) != 1 {
+		t.Fatalf("Expected only the query over its budget logged, got %v", logged)
+	}
+	for _, expected := range []string{
+		"query slowQueryHelper",
+		"handler (*AdminHandler).handleSlowQueryTest",
+		"statement UPDATE orders SET status = $1 WHERE customer_email = $2",
+		`$1="cancelled" $2=<string, 16 chars>`,
+	} {
+		if !strings.Contains(logged[0], expected) {
+			t.Errorf("Expected %q in the log line, got %s", expected, logged[0])
+		}
+	}
+	if strings.Contains(logged[0], "jane@example.com") {
+		t.Error("Expected the email left out of the log")
+	}
+
+	if n := testutil.CollectAndCount(metrics.duration); n != 2 {
+		t.Errorf("Expected a histogram for each named query, got %d", n)
+	}
+	if slow := testutil.ToFloat64(metrics.slow.WithLabelValues("slowQueryHelper")); slow != 1 {
+		t.Errorf("Expected one slow query counted, got %v", slow)
+	}
+}
+
+func TestQueryMetricsHandler(t *testing.T) {
+	metrics := &QueryMetrics{config: QueryMetricsConfig{MetricsToken: "scrape-token"}}
+	for header, expected := range map[string]int{
+		"":                    http.StatusUnauthorized,
+		"Bearer wrong":        http.StatusUnauthorized,
+		"Bearer scrape-token": http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Authorization %q: expected status %d, got %d", header, expected, w.Code)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SubscriptionPeriod is the billing period a subscriber's quota covers
+type SubscriptionPeriod struct {
+	SubscriptionID  int
+	PickupsPerMonth int
+	// The period runs from Start up to but not including End
+	Start string
+	End   string
+	// OverageBilling is per_order or period_end
+	OverageBilling string
+}
+
+// SubscriptionRepo is the subscription data quota decisions are made from,
+// so the decisions can be tested without a database
+type SubscriptionRepo interface {
+	// CurrentPeriod returns the customer's latest subscription's period, or
+	// only an active one's with activeOnly; sql.ErrNoRows when there's none
+	CurrentPeriod(ctx context.Context, userID int, activeOnly bool) (*SubscriptionPeriod, error)
+	// PeriodUsage counts the period's orders placed under the subscription
+	// and the standard bags the plan covered on them
+	PeriodUsage(ctx context.Context, userID int, period *SubscriptionPeriod) (pickups, coveredBags int, err error)
+}
+
+// pgSubscriptionRepo reads subscriptions from Postgres
+type pgSubscriptionRepo struct {
+	db *sql.DB
+}
+
+func (r pgSubscriptionRepo) CurrentPeriod(ctx context.Context, userID int, activeOnly bool) (*SubscriptionPeriod, error) {
+	var period SubscriptionPeriod
+	err := r.db.QueryRowContext(ctx, `
+		SELECT s.id, p.pickups_per_month, s.current_period_start, s.current_period_end, s.overage_billing
+		FROM subscriptions s
+		JOIN subscription_plans p ON s.plan_id = p.id
+		WHERE s.user_id = $1 AND (s.status = 'active' OR NOT $2)
+		ORDER BY s.created_at DESC
+		LIMIT 1`,
+		userID, activeOnly,
+	).Scan(&period.SubscriptionID, &period.PickupsPerMonth, &period.Start, &period.End, &period.OverageBilling)
+	if err != nil {
+		return nil, err
+	}
+	return &period, nil
+}
+
+func (r pgSubscriptionRepo) PeriodUsage(ctx context.Context, userID int, period *SubscriptionPeriod) (int, int, error) {
+	var pickups, coveredBags int
+	err := r.db.QueryRowContext(ctx, `
+		SELECT
+			COUNT(DISTINCT o.id),
+			COALESCE(SUM(CASE WHEN oi.price_cents = 0 AND s.name = 'standard_bag' THEN oi.quantity ELSE 0 END), 0)
+		FROM orders o
+		LEFT JOIN order_items oi ON o.id = oi.order_id
+		LEFT JOIN services s ON oi.service_id = s.id
+		WHERE o.user_id = $1
+		AND o.subscription_id = $2
+		AND o.pickup_date >= $3::date
+		AND o.pickup_date < $4::date
+		AND o.status != 'cancelled'`,
+		userID, period.SubscriptionID, period.Start, period.End,
+	).Scan(&pickups, &coveredBags)
+	return pickups, coveredBags, err
+}
+
+// SubscriptionQuota is what a subscriber has used of their plan this period.
+// A nil quota is a pay-as-you-go customer.
+type SubscriptionQuota struct {
+	Period      SubscriptionPeriod
+	PickupsUsed int
+	BagsUsed    int
+}
+
+// BagsAllowed is the standard bags the plan covers; current plans cover one
+// per pickup
+func (q *SubscriptionQuota) BagsAllowed() int {
+	return q.Period.PickupsPerMonth
+}
+
+// PickupsRemaining and BagsRemaining never go below zero
+func (q *SubscriptionQuota) PickupsRemaining() int {
+	return max(q.Period.PickupsPerMonth-q.PickupsUsed, 0)
+}
+
+func (q *SubscriptionQuota) BagsRemaining() int {
+	return max(q.BagsAllowed()-q.BagsUsed, 0)
+}
+
+// pickupCharge prices a new order's pickup line. Pickups are included in
+// pay-as-you-go bag prices and in a plan's quota; past the quota they're
+// charged the over-quota fee, unless it's left for the monthly invoice.
+func (q *SubscriptionQuota) pickupCharge() (int, string) {
+	if q.deferredOverageCents() > 0 {
+		return 0, "Pickup Service (Over Quota, billed with subscription)"
+	}
+	if q != nil && q.PickupsUsed >= q.Period.PickupsPerMonth {
+		return overQuotaPickupFeeCents, "Pickup Service (Over Quota)"
+	}
+	return 0, "Pickup Service (Included)"
+}
+
+// deferredOverageCents is the over-quota fee a new order adds to the
+// period's invoice instead of its own charge
+func (q *SubscriptionQuota) deferredOverageCents() int {
+	if q != nil && q.Period.OverageBilling == overageBillingPeriodEnd && q.PickupsUsed >= q.Period.PickupsPerMonth {
+		return overQuotaPickupFeeCents
+	}
+	return 0
+}
+
+// coverBags splits a line of a new order into the bags the plan covers and
+// the ones charged, using up the quota as it goes. Only standard bags are
+// covered.
+func (q *SubscriptionQuota) coverBags(serviceName string, quantity int) (covered, charged int) {
+	if q == nil || serviceName != "standard_bag" {
+		return 0, quantity
+	}
+	covered = min(quantity, q.BagsRemaining())
+	q.BagsUsed += covered
+	return covered, quantity - covered
+}
+
+// QuotaService works out subscribers' quotas for ordering and usage reports
+type QuotaService struct {
+	subscriptions SubscriptionRepo
+}
+
+func NewQuotaService(subscriptions SubscriptionRepo) *QuotaService {
+	return &QuotaService{subscriptions: subscriptions}
+}
+
+// Quota returns a customer's usage of their current subscription period, or
+// nil when they don't have a subscription (an active one, with activeOnly)
+func (s *QuotaService) Quota(ctx context.Context, userID int, activeOnly bool) (*SubscriptionQuota, error) {
+	period, err := s.subscriptions.CurrentPeriod(ctx, userID, activeOnly)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	quota := &SubscriptionQuota{Period: *period}
+	quota.PickupsUsed, quota.BagsUsed, err = s.subscriptions.PeriodUsage(ctx, userID, period)
+	if err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeSubscriptionRepo serves one customer's subscription from memory
+type fakeSubscriptionRepo struct {
+	period      *SubscriptionPeriod
+	active      bool
+	pickups     int
+	coveredBags int
+	err         error
+}
+
+func (f *fakeSubscriptionRepo) CurrentPeriod(ctx context.Context, userID int, activeOnly bool) (*SubscriptionPeriod, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.period == nil || (activeOnly && !f.active) {
+		return nil, sql.ErrNoRows
+	}
+	return f.period, nil
+}
+
+func (f *fakeSubscriptionRepo) PeriodUsage(ctx context.Context, userID int, period *SubscriptionPeriod) (int, int, error) {
+	return f.pickups, f.coveredBags, nil
+}
+
+func TestQuotaService_Quota(t *testing.T) {
+	period := &SubscriptionPeriod{SubscriptionID: 7, PickupsPerMonth: 4, Start: "2024-01-01", End: "2024-02-01"}
+	repo := &fakeSubscriptionRepo{period: period, pickups: 3, coveredBags: 6}
+	quotas := NewQuotaService(repo)
+
+	quota, err := quotas.Quota(context.Background(), 1, false)
+	if err != nil || quota == nil {
+		t.Fatalf("Expected a quota, got %v %v", quota, err)
+	}
+	if quota.PickupsRemaining() != 1 || quota.BagsRemaining() != 0 {
+		t.Errorf("Expected 1 pickup and no bags left (never negative), got %d and %d", quota.PickupsRemaining(), quota.BagsRemaining())
+	}
+
+	// A paused subscription doesn't cover new orders
+	if quota, err := quotas.Quota(context.Background(), 1, true); quota != nil || err != nil {
+		t.Errorf("Expected no quota without an active subscription, got %v %v", quota, err)
+	}
+
+	repo.err = errors.New("connection reset")
+	if _, err := quotas.Quota(context.Background(), 1, false); err == nil {
+		t.Error("Expected the repository's error returned")
+	}
+}
+
+func TestSubscriptionQuota_Pricing(t *testing.T) {
+	var payAsYouGo *SubscriptionQuota
+	if cents, note := payAsYouGo.pickupCharge(); cents != 0 || note != "Pickup Service (Included)" {
+		t.Errorf("Expected pay-as-you-go pickups included, got %d %q", cents, note)
+	}
+	if covered, charged := payAsYouGo.coverBags("standard_bag", 3); covered != 0 || charged != 3 {
+		t.Errorf("Expected pay-as-you-go bags charged, got %d covered %d charged", covered, charged)
+	}
+
+	quota := &SubscriptionQuota{Period: SubscriptionPeriod{PickupsPerMonth: 4}, PickupsUsed: 3, BagsUsed: 1}
+	if cents, _ := quota.pickupCharge(); cents != 0 {
+		t.Errorf("Expected a pickup within quota free, got %d", cents)
+	}
+	quota.PickupsUsed = 4
+	if cents, note := quota.pickupCharge(); cents != overQuotaPickupFeeCents || note != "Pickup Service (Over Quota)" {
+		t.Errorf("Expected the over-quota fee, got %d %q", cents, note)
+	}
+	// Billed at period end, the fee moves off the order
+	quota.Period.OverageBilling = overageBillingPeriodEnd
+	if cents, _ := quota.pickupCharge(); cents != 0 || quota.deferredOverageCents() != overQuotaPickupFeeCents {
+		t.Errorf("Expected the fee deferred to the invoice, got %d on the order", cents)
+	}
+	quota.Period.OverageBilling = overageBillingPerOrder
+
+	// Three bags are left to cover, across however many lines
+	if covered, charged := quota.coverBags("bedding", 2); covered != 0 || charged != 2 {
+		t.Errorf("Expected only standard bags covered, got %d covered %d charged", covered, charged)
+	}
+	if covered, charged := quota.coverBags("standard_bag", 2); covered != 2 || charged != 0 {
+		t.Errorf("Expected both bags covered, got %d covered %d charged", covered, charged)
+	}
+	if covered, charged := quota.coverBags("standard_bag", 2); covered != 1 || charged != 1 {
+		t.Errorf("Expected the last covered bag used up, got %d covered %d charged", covered, charged)
+	}
+}
+
+func TestSubscriptionHandler_UsageFromRepo(t *testing.T) {
+	repo := &fakeSubscriptionRepo{
+		period:      &SubscriptionPeriod{SubscriptionID: 7, PickupsPerMonth: 4, Start: "2024-01-01", End: "2024-02-01"},
+		pickups:     2,
+		coveredBags: 2,
+	}
+	handler := &SubscriptionHandler{getUserID: CreateAuthMock(1).getUserIDFromRequest, quota: NewQuotaService(repo)}
+
+	w := httptest.NewRecorder()
+	handler.handleGetSubscriptionUsage(w, httptest.NewRequest("GET", "/api/v1/subscriptions/usage", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var usage struct {
+		SubscriptionID   int `json:"subscription_id"`
+		PickupsRemaining int `json:"pickups_remaining"`
+		BagsRemaining    int `json:"bags_remaining"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &usage)
+	if usage.SubscriptionID != 7 || usage.PickupsRemaining != 2 || usage.BagsRemaining != 2 {
+		t.Errorf("Unexpected usage %s", w.Body.String())
+	}
+
+	repo.period = nil
+	w = httptest.NewRecorder()
+	handler.handleGetSubscriptionUsage(w, httptest.NewRequest("GET", "/api/v1/subscriptions/usage", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d without a subscription, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimit allows Limit requests per Window. A zero Limit turns the bucket off.
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// RateLimitPolicy is the per-IP and per-user buckets for one endpoint
+type RateLimitPolicy struct {
+	PerIP   RateLimit
+	PerUser RateLimit
+	// userKey names the account a request is for, or "" when it can't tell
+	userKey func(*RateLimiter, *http.Request) string
+}
+
+// defaultRateLimitPolicies are overridden per bucket with
+// RATE_LIMIT_<NAME>_IP and RATE_LIMIT_<NAME>_USER, e.g. "10/15m" or "0" to disable
+var defaultRateLimitPolicies = map[string]RateLimitPolicy{
+	"login": {
+		PerIP:   RateLimit{Limit: 20, Window: 15 * time.Minute},
+		PerUser: RateLimit{Limit: 10, Window: 15 * time.Minute},
+		userKey: rateLimitEmailKey,
+	},
+	"register": {
+		PerIP:   RateLimit{Limit: 10, Window: time.Hour},
+		PerUser: RateLimit{Limit: 5, Window: time.Hour},
+		userKey: rateLimitEmailKey,
+	},
+	"change_password": {
+		PerIP:   RateLimit{Limit: 20, Window: 15 * time.Minute},
+		PerUser: RateLimit{Limit: 5, Window: 15 * time.Minute},
+		userKey: rateLimitUserIDKey,
+	},
+	"create_order": {
+		PerIP:   RateLimit{Limit: 60, Window: time.Hour},
+		PerUser: RateLimit{Limit: 20, Window: time.Hour},
+		userKey: rateLimitUserIDKey,
+	},
+	"waitlist": {
+		PerIP:   RateLimit{Limit: 20, Window: time.Hour},
+		PerUser: RateLimit{Limit: 5, Window: time.Hour},
+		userKey: rateLimitEmailKey,
+	},
+	// Booking widget lookups, per visitor and per publishable key
+	"widget": {
+		PerIP:   RateLimit{Limit: 120, Window: time.Hour},
+		PerUser: RateLimit{Limit: 3000, Window: time.Hour},
+		userKey: rateLimitWidgetKey,
+	},
+	"widget_draft": {
+		PerIP:   RateLimit{Limit: 10, Window: time.Hour},
+		PerUser: RateLimit{Limit: 300, Window: time.Hour},
+		userKey: rateLimitWidgetKey,
+	},
+	// Every API request, on top of any endpoint policy above
+	"api": {
+		PerIP:   RateLimit{Limit: 1200, Window: time.Minute},
+		PerUser: RateLimit{Limit: 600, Window: time.Minute},
+		userKey: rateLimitUserIDKey,
+	},
+}
+
+// RateLimitStore counts requests in fixed windows. Hit must be atomic so
+// concurrent requests can't all slip under the limit.
+type RateLimitStore interface {
+	// Hit counts a request against key and returns the count so far in the
+	// current window and when that window ends
+	Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error)
+}
+
+// RedisRateLimitStore keeps one counter per bucket that expires with its window
+type RedisRateLimitStore struct {
+	client *redis.Client
+}
+
+func NewRedisRateLimitStore(client *redis.Client) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client}
+}
+
+// Starts the window on the first hit; a counter left without a TTL gets one
+var rateLimitHitScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+	ttl = tonumber(ARGV[1])
+end
+return {count, ttl}
+`)
+
+func (s *RedisRateLimitStore) Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	result, err := rateLimitHitScript.Run(ctx, s.client, []string{key}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return int(result[0]), time.Now().Add(time.Duration(result[1]) * time.Millisecond), nil
+}
+
+// RateLimiter wraps handlers with their endpoint's rate limit policy
+type RateLimiter struct {
+	db *sql.DB
+	// store is nil in tests; requests are then not limited
+	store       RateLimitStore
+	policies    map[string]RateLimitPolicy
+	degradation *RedisDegradation
+	getUserID   func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewRateLimiter(db *sql.DB, store RateLimitStore) *RateLimiter {
+	policies := map[string]RateLimitPolicy{}
+	for name, policy := range defaultRateLimitPolicies {
+		prefix := "RATE_LIMIT_" + strings.ToUpper(name)
+		policy.PerIP = rateLimitFromEnv(prefix+"_IP", policy.PerIP)
+		policy.PerUser = rateLimitFromEnv(prefix+"_USER", policy.PerUser)
+		policies[name] = policy
+	}
+	return &RateLimiter{
+		db:        db,
+		store:     store,
+		policies:  policies,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// parseRateLimit reads "<limit>/<window>" such as "10/15m", or "0" for no limit
+func parseRateLimit(value string) (RateLimit, error) {
+	if value == "0" {
+		return RateLimit{}, nil
+	}
+	limit, window, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("expected <limit>/<window>, got %q", value)
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 0 {
+		return RateLimit{}, fmt.Errorf("invalid limit %q", limit)
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d < time.Second {
+		return RateLimit{}, fmt.Errorf("invalid window %q", window)
+	}
+	return RateLimit{Limit: n, Window: d}, nil
+}
+
+func rateLimitFromEnv(name string, fallback RateLimit) RateLimit {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s: %v", name, err)
+		return fallback
+	}
+	return limit
+}
+
+// clientIP is the caller's address. X-Real-IP is only trusted from a proxy
+// on a private network (nginx sets it); otherwise anyone could pick their bucket.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || ip.IsPrivate()) {
+			return realIP
+		}
+	}
+	return host
+}
+
+// rateLimitEmailKey buckets unauthenticated auth requests by the email in the
+// body, so one account can't be guessed at from many addresses
+func rateLimitEmailKey(l *RateLimiter, r *http.Request) string {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var req struct {
+		Email string `json:"email"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(req.Email))
+}
+
+// rateLimitUserIDKey buckets authenticated requests by user
+func rateLimitUserIDKey(l *RateLimiter, r *http.Request) string {
+	userID, err := l.getUserID(r, l.db)
+	if err != nil {
+		return ""
+	}
+	return strconv.Itoa(userID)
+}
+
+// rateLimitHeaders are exposed to browser clients across origins
+const rateLimitHeaders = "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After"
+
+// rateLimitExemptPaths are never counted against the API-wide limit: Stripe
+// retries webhooks it can't deliver, so a 429 only delays them. Health
+// checks sit outside the API prefix and aren't limited either.
+var rateLimitExemptPaths = map[string]bool{
+	APIPrefix + "/payments/webhook": true,
+}
+
+// limit applies the named policy to a handler
+func (l *RateLimiter) limit(name string, next http.HandlerFunc) http.HandlerFunc {
+	policy, ok := l.policies[name]
+	if !ok {
+		panic("unknown rate limit policy " + name)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.allow(name, policy, w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// Middleware applies the "api" policy to every API request except the
+// exempt paths. Endpoints with their own policy are counted against both.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	policy := l.policies["api"]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExemptPaths[r.URL.Path] || l.allow("api", policy, w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// allow counts a request against a policy's buckets. Every response carries
+// the RateLimit-* headers of its tightest bucket; a rejected request gets a
+// 429 with Retry-After and allow returns false. Limits are skipped if Redis
+// fails, so an outage doesn't lock everyone out.
+func (l *RateLimiter) allow(name string, policy RateLimitPolicy, w http.ResponseWriter, r *http.Request) bool {
+	if l.store == nil || r.Method == http.MethodOptions {
+		return true
+	}
+
+	type bucket struct {
+		key   string
+		scope string
+		limit RateLimit
+	}
+	buckets := []bucket{}
+	if policy.PerIP.Limit > 0 {
+		buckets = append(buckets, bucket{fmt.Sprintf("rate_limit:%s:ip:%s", name, clientIP(r)), "ip", policy.PerIP})
+	}
+	if policy.PerUser.Limit > 0 && policy.userKey != nil {
+		if key := policy.userKey(l, r); key != "" {
+			buckets = append(buckets, bucket{fmt.Sprintf("rate_limit:%s:user:%s", name, key), "user", policy.PerUser})
+		}
+	}
+
+	var tightest, exceeded *bucket
+	remaining, resetAt := 0, time.Time{}
+	var retryAt time.Time
+	for i, b := range buckets {
+		count, windowEnd, err := l.store.Hit(r.Context(), b.key, b.limit.Window)
+		if err != nil {
+			l.degradation.Fail(degradedRateLimits, err)
+			return true
+		}
+		left := b.limit.Limit - count
+		if left < 0 {
+			left = 0
+			if windowEnd.After(retryAt) {
+				retryAt, exceeded = windowEnd, &buckets[i]
+			}
+		}
+		if tightest == nil || left < remaining {
+			tightest, remaining, resetAt = &buckets[i], left, windowEnd
+		}
+	}
+
+	l.degradation.Recover(degradedRateLimits)
+
+	if tightest != nil {
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(tightest.limit.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(secondsUntil(resetAt)))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", tightest.limit.Limit, int(tightest.limit.Window.Seconds())))
+	}
+	if exceeded == nil {
+		return true
+	}
+
+	retryAfter := secondsUntil(retryAt)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	log.Printf("Rate limit exceeded: policy=%s, scope=%s, ip=%s", name, exceeded.scope, clientIP(r))
+	writeRateLimited(w, name, exceeded.scope, retryAfter)
+	return false
+}
+
+// secondsUntil rounds up, and is at least 1 so clients never retry at once
+func secondsUntil(t time.Time) int {
+	return max(int(time.Until(t).Seconds()+0.999), 1)
+}
+
+// RateLimitError is the body of a 429. Code is stable for clients to branch
+// on; Scope says whether waiting or signing in as someone else would help.
+type RateLimitError struct {
+	Error      string `json:"error"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Policy     string `json:"policy"`
+	Scope      string `json:"scope"` // ip or user
+	RetryAfter int    `json:"retry_after"`
+}
+
+const (
+	rateLimitedIPCode   = "rate_limited_ip"
+	rateLimitedUserCode = "rate_limited_user"
+)
+
+func writeRateLimited(w http.ResponseWriter, policy, scope string, retryAfter int) {
+	code := rateLimitedIPCode
+	if scope == "user" {
+		code = rateLimitedUserCode
+	}
+	unit := "seconds"
+	if retryAfter == 1 {
+		unit = "second"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(RateLimitError{
+		Error:      "Too many requests",
+		Code:       code,
+		Message:    fmt.Sprintf("Too many requests. Try again in %d %s.", retryAfter, unit),
+		Policy:     policy,
+		Scope:      scope,
+		RetryAfter: retryAfter,
+	})
+}
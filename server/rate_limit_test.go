@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryRateLimitStore is an in-process RateLimitStore for tests
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	counts  map[string]int
+	resets  map[string]time.Time
+	failing bool
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{counts: map[string]int{}, resets: map[string]time.Time{}}
+}
+
+func (s *memoryRateLimitStore) Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return 0, time.Time{}, errors.New("redis unavailable")
+	}
+	if reset, ok := s.resets[key]; !ok || time.Now().After(reset) {
+		s.counts[key] = 0
+		s.resets[key] = time.Now().Add(window)
+	}
+	s.counts[key]++
+	return s.counts[key], s.resets[key], nil
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected RateLimit
+		valid    bool
+	}{
+		{"10/15m", RateLimit{Limit: 10, Window: 15 * time.Minute}, true},
+		{"100/1h", RateLimit{Limit: 100, Window: time.Hour}, true},
+		{"0", RateLimit{}, true},
+		{"10", RateLimit{}, false},
+		{"ten/1m", RateLimit{}, false},
+		{"10/100ms", RateLimit{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRateLimit(tt.value)
+		if (err == nil) != tt.valid || (tt.valid && got != tt.expected) {
+			t.Errorf("parseRateLimit(%q) = %+v, %v; expected %+v, valid=%v", tt.value, got, err, tt.expected, tt.valid)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		realIP     string
+		expected   string
+	}{
+		{"203.0.113.7:5555", "", "203.0.113.7"},
+		{"172.18.0.5:40000", "203.0.113.7", "203.0.113.7"},
+		{"198.51.100.2:5555", "203.0.113.7", "198.51.100.2"}, // Not from our proxy; header ignored
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/api/v1/auth/login", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := clientIP(req); got != tt.expected {
+			t.Errorf("clientIP(%s, %q) = %s, expected %s", tt.remoteAddr, tt.realIP, got, tt.expected)
+		}
+	}
+}
+
+func TestRateLimiter_Login(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	limiter := &RateLimiter{store: store, degradation: NewRedisDegradation(), policies: map[string]RateLimitPolicy{
+		"login": {
+			PerIP:   RateLimit{Limit: 5, Window: time.Minute},
+			PerUser: RateLimit{Limit: 3, Window: time.Minute},
+			userKey: rateLimitEmailKey,
+		},
+	}}
+
+	var bodies []string
+	handler := limiter.limit("login", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	login := func(ip, email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"email": "`+email+`", "password": "guess"}`))
+		req.RemoteAddr = ip + ":5555"
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := login("203.0.113.1", "victim@example.com"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected status %d, got %d", i+1, http.StatusUnauthorized, w.Code)
+		}
+	}
+	if bodies[0] != `{"email": "victim@example.com", "password": "guess"}` {
+		t.Errorf("Expected the handler to still see the body, got %q", bodies[0])
+	}
+
+	// The account's bucket is shared across addresses and case
+	w := login("198.51.100.9", "Victim@Example.com")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("RateLimit-Limit") != "3" ||
+		w.Header().Get("RateLimit-Policy") != "3;w=60" {
+		t.Errorf("Expected rate limit headers, got %v", w.Header())
+	}
+	var rateLimited RateLimitError
+	json.Unmarshal(w.Body.Bytes(), &rateLimited)
+	if rateLimited.Code != rateLimitedUserCode || rateLimited.Policy != "login" || rateLimited.RetryAfter < 1 {
+		t.Errorf("Expected a structured 429 for the account's bucket, got %s", w.Body.String())
+	}
+
+	// Spraying other accounts from one address runs into the IP bucket
+	w = login("203.0.113.1", "a@example.com")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("Expected one attempt left on the IP, got %d %v", w.Code, w.Header())
+	}
+	login("203.0.113.1", "b@example.com")
+	if w := login("203.0.113.1", "c@example.com"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d once the IP is out of attempts, got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	// A Redis outage doesn't lock anyone out
+	store.failing = true
+	if w := login("203.0.113.1", "victim@example.com"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected requests through while the store is down, got %d", w.Code)
+	}
+	if degraded := limiter.degradation.Degraded(); len(degraded) != 1 || degraded[0].Feature != degradedRateLimits {
+		t.Errorf("Expected rate limits reported degraded, got %+v", degraded)
+	}
+	store.failing = false
+	login("192.0.2.1", "someone@example.com")
+	if degraded := limiter.degradation.Degraded(); len(degraded) != 0 {
+		t.Errorf("Expected rate limits to recover, got %+v", degraded)
+	}
+}
+
+func TestRateLimiter_PerUser(t *testing.T) {
+	limiter := &RateLimiter{
+		store: newMemoryRateLimitStore(),
+		policies: map[string]RateLimitPolicy{
+			"create_order": {PerUser: RateLimit{Limit: 1, Window: time.Hour}, userKey: rateLimitUserIDKey},
+		},
+		getUserID: func(r *http.Request, db *sql.DB) (int, error) {
+			if r.Header.Get("Authorization") == "" {
+				return 0, errors.New("unauthorized")
+			}
+			return 42, nil
+		},
+	}
+	handler := limiter.limit("create_order", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) })
+
+	createOrder := func(auth string) int {
+		req := httptest.NewRequest("POST", "/api/v1/orders/create", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	if code := createOrder("Bearer a"); code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, code)
+	}
+	if code := createOrder("Bearer a"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, code)
+	}
+	// Unauthenticated requests have no user bucket and are left to the handler
+	if code := createOrder(""); code != http.StatusCreated {
+		t.Errorf("Expected the handler to see unauthenticated requests, got %d", code)
+	}
+}
+
+func TestRateLimiter_Middleware(t *testing.T) {
+	limiter := &RateLimiter{
+		store: newMemoryRateLimitStore(),
+		policies: map[string]RateLimitPolicy{
+			"api": {PerIP: RateLimit{Limit: 1, Window: time.Minute}},
+		},
+	}
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }))
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.RemoteAddr = "203.0.113.1:5555"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("/api/v1/orders"); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	w := request("/api/v1/services")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON 429 once the IP is out of requests, got %d %v", w.Code, w.Header())
+	}
+	var rateLimited RateLimitError
+	json.Unmarshal(w.Body.Bytes(), &rateLimited)
+	if rateLimited.Code != rateLimitedIPCode || rateLimited.Scope != "ip" {
+		t.Errorf("Expected the IP bucket named, got %s", w.Body.String())
+	}
+
+	// Stripe's webhooks are never turned away
+	if w := request("/api/v1/payments/webhook"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("Expected the webhook exempt, got %d %v", w.Code, w.Header())
+	}
+}
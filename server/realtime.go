@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
+	"time"
 
 	"github.com/centrifugal/centrifuge"
 )
@@ -13,6 +15,10 @@ import (
 type RealtimeHandler struct {
 	db   *sql.DB
 	node *centrifuge.Node
+	// retries queues order updates that failed to publish; nil disables retrying
+	retries *RealtimeRetryQueue
+	// push also sends critical updates to the customer's phone; nil skips it
+	push *PushDispatcher
 }
 
 type OrderUpdateMessage struct {
@@ -22,6 +28,10 @@ type OrderUpdateMessage struct {
 	Message   string      `json:"message"`
 	Timestamp string      `json:"timestamp"`
 	Data      interface{} `json:"data,omitempty"`
+	// EventID is set on critical updates; the app acks it with the ack_event RPC
+	EventID string `json:"event_id,omitempty"`
+	// Test is set on updates about a sandbox account's orders
+	Test bool `json:"test,omitempty"`
 }
 
 func NewRealtimeHandler(db *sql.DB, node *centrifuge.Node) *RealtimeHandler {
@@ -37,14 +47,23 @@ func NewRealtimeHandler(db *sql.DB, node *centrifuge.Node) *RealtimeHandler {
 	return handler
 }
 
-// handleConnecting validates the connection attempt
+// handleConnecting validates the connection attempt. A client that presents
+// its access token connects as that user and can subscribe to the channels
+// it's allowed; one without connects anonymously and can't subscribe.
 func (h *RealtimeHandler) handleConnecting(ctx context.Context, e centrifuge.ConnectEvent) (centrifuge.ConnectReply, error) {
-	// For now, allow all connections
-	// In production, you'd validate the JWT token here
+	if e.Token == "" {
+		return centrifuge.ConnectReply{
+			Credentials: &centrifuge.Credentials{
+				UserID: e.ClientID, // Anonymous; never a numeric user ID
+			},
+		}, nil
+	}
+	userID, _, err := sessionFromToken(e.Token, h.db)
+	if err != nil {
+		return centrifuge.ConnectReply{}, centrifuge.ErrorUnauthorized
+	}
 	return centrifuge.ConnectReply{
-		Credentials: &centrifuge.Credentials{
-			UserID: e.ClientID, // Use client ID as user ID for now
-		},
+		Credentials: &centrifuge.Credentials{UserID: strconv.Itoa(userID)},
 	}, nil
 }
 
@@ -52,23 +71,100 @@ func (h *RealtimeHandler) handleConnecting(ctx context.Context, e centrifuge.Con
 func (h *RealtimeHandler) handleConnect(client *centrifuge.Client) {
 	log.Printf("Client connected: %s", client.ID())
 	
+	client.OnRPC(func(e centrifuge.RPCEvent, cb centrifuge.RPCCallback) {
+		h.handleRPC(client.UserID(), e, cb)
+	})
+	client.OnSubscribe(func(e centrifuge.SubscribeEvent, cb centrifuge.SubscribeCallback) {
+		cb(centrifuge.SubscribeReply{}, h.authorizeChannel(client.UserID(), e.Channel))
+	})
+
 	// Send a welcome message
-	welcomeMsg := OrderUpdateMessage{
+	data, _ := json.Marshal(connectionMessage())
+	client.Send(data)
+}
+
+// authorizeChannel decides whether a connected user may subscribe to a
+// channel: their own order channels, the chat of an order they take part in
+// (or any order's, for staff who read orders), and the admin alerts for
+// staff who read the inbox. Anonymous connections get nothing.
+func (h *RealtimeHandler) authorizeChannel(connUserID, channel string) error {
+	userID, err := strconv.Atoi(connUserID)
+	if err != nil || userID <= 0 {
+		return centrifuge.ErrorPermissionDenied
+	}
+
+	var ownerID, orderID int
+	switch {
+	case channel == fmt.Sprintf("order:%d", userID):
+		return nil
+	case scanChannel(channel, "order:%d:%d", &ownerID, &orderID):
+		if ownerID != userID {
+			return centrifuge.ErrorPermissionDenied
+		}
+		return nil
+	case channel == adminAlertsChannel:
+		return h.requireChannelPermission(userID, "inbox.read")
+	case scanChannel(channel, "chat:order:%d", &orderID):
+		_, _, err := orderChatRole(h.db, orderID, userID)
+		if err == sql.ErrNoRows {
+			return h.requireChannelPermission(userID, "orders.read")
+		}
+		if err != nil {
+			log.Printf("Failed to authorize chat subscription: user=%d, order=%d: %v", userID, orderID, err)
+			return centrifuge.ErrorInternal
+		}
+		return nil
+	}
+	return centrifuge.ErrorPermissionDenied
+}
+
+func (h *RealtimeHandler) requireChannelPermission(userID int, permission string) error {
+	allowed, err := userHasPermission(h.db, userID, permission)
+	if err != nil {
+		log.Printf("Failed to check %s for user %d: %v", permission, userID, err)
+		return centrifuge.ErrorInternal
+	}
+	if !allowed {
+		return centrifuge.ErrorPermissionDenied
+	}
+	return nil
+}
+
+// scanChannel reports whether channel is exactly format filled in with
+// positive IDs
+func scanChannel(channel, format string, ids ...*int) bool {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	if n, err := fmt.Sscanf(channel, format, args...); err != nil || n != len(ids) {
+		return false
+	}
+	for _, id := range ids {
+		if *id <= 0 {
+			return false
+		}
+	}
+	values := make([]interface{}, len(ids))
+	for i, id := range ids {
+		values[i] = *id
+	}
+	return fmt.Sprintf(format, values...) == channel
+}
+
+// The message builders below produce every body sent over Centrifuge. Their
+// shapes are published in schemas.go; change both together.
+
+func connectionMessage() OrderUpdateMessage {
+	return OrderUpdateMessage{
 		Type:      "connection",
 		Message:   "Connected to Tumble real-time updates",
 		Timestamp: "now",
 	}
-	
-	data, _ := json.Marshal(welcomeMsg)
-	client.Send(data)
 }
 
-// Note: handleSubscribe is not available in newer Centrifuge versions
-// Channel validation would be done in the OnConnecting handler instead
-
-// PublishOrderUpdate sends real-time updates for an order
-func (h *RealtimeHandler) PublishOrderUpdate(userID, orderID int, status, message string, data interface{}) error {
-	update := OrderUpdateMessage{
+func orderUpdateMessage(orderID int, status, message string, data interface{}) OrderUpdateMessage {
+	return OrderUpdateMessage{
 		Type:      "order_status_update",
 		OrderID:   orderID,
 		Status:    status,
@@ -76,39 +172,174 @@ func (h *RealtimeHandler) PublishOrderUpdate(userID, orderID int, status, messag
 		Timestamp: "now",
 		Data:      data,
 	}
+}
+
+func pickupUpdateData(estimatedTime string) map[string]interface{} {
+	return map[string]interface{}{
+		"estimated_pickup_time": estimatedTime,
+		"driver_info": map[string]interface{}{
+			"name":  "John Driver",
+			"phone": "555-0123",
+		},
+	}
+}
+
+func deliveryUpdateData(estimatedTime string) map[string]interface{} {
+	return map[string]interface{}{
+		"estimated_delivery_time": estimatedTime,
+		"delivery_instructions":   "Please leave bags at front door if no one is home",
+	}
+}
+
+func completionUpdateData(orderID int, orderNumber string) map[string]interface{} {
+	return map[string]interface{}{
+		"order_number": orderNumber,
+		"rating_url":   fmt.Sprintf("/orders/%d/rate", orderID),
+	}
+}
+
+func driverLocationMessage(orderID int, lat, lng float64, estimatedArrival string) OrderUpdateMessage {
+	return OrderUpdateMessage{
+		Type:      "driver_location",
+		OrderID:   orderID,
+		Message:   "Driver location updated",
+		Timestamp: "now",
+		Data: map[string]interface{}{
+			"driver_location": map[string]interface{}{
+				"latitude":  lat,
+				"longitude": lng,
+			},
+			"estimated_arrival": estimatedArrival,
+		},
+	}
+}
+
+func adminAlertMessage(alertType, message string, data interface{}) OrderUpdateMessage {
+	return OrderUpdateMessage{
+		Type:      alertType,
+		Message:   message,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      data,
+	}
+}
+
+func orderChatMessage(msg OrderMessage) OrderUpdateMessage {
+	return OrderUpdateMessage{
+		Type:      "order_message",
+		OrderID:   msg.OrderID,
+		Message:   msg.Body,
+		Timestamp: msg.CreatedAt.UTC().Format(time.RFC3339),
+		Data: map[string]interface{}{
+			"id":          msg.ID,
+			"sender_id":   msg.SenderID,
+			"sender_role": msg.SenderRole,
+			"sender_name": msg.SenderName,
+		},
+	}
+}
+
+func orderChatTypingMessage(typing OrderChatTyping) OrderUpdateMessage {
+	return OrderUpdateMessage{
+		Type:      "order_typing",
+		OrderID:   typing.OrderID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data: map[string]interface{}{
+			"user_id": typing.UserID,
+			"role":    typing.Role,
+			"typing":  typing.Typing,
+		},
+	}
+}
+
+func orderItemEventMessage(e OrderItemEvent) OrderUpdateMessage {
+	return OrderUpdateMessage{
+		Type:      "order_item_event",
+		OrderID:   e.OrderID,
+		Timestamp: e.CreatedAt.UTC().Format(time.RFC3339),
+		Data: map[string]interface{}{
+			"id":                    e.ID,
+			"event":                 e.Event,
+			"order_garment_id":      e.OrderGarmentID,
+			"garment_name":          e.GarmentName,
+			"quantity":              e.Quantity,
+			"previous_garment_name": e.PreviousGarmentName,
+		},
+	}
+}
+
+func orderChatReadMessage(receipt OrderMessageRead) OrderUpdateMessage {
+	return OrderUpdateMessage{
+		Type:      "order_message_read",
+		OrderID:   receipt.OrderID,
+		Timestamp: receipt.ReadAt.UTC().Format(time.RFC3339),
+		Data: map[string]interface{}{
+			"user_id":              receipt.UserID,
+			"role":                 receipt.Role,
+			"last_read_message_id": receipt.LastReadMessageID,
+		},
+	}
+}
+
+// PublishOrderUpdate sends real-time updates for an order
+func (h *RealtimeHandler) PublishOrderUpdate(userID, orderID int, status, message string, data interface{}) error {
+	update := orderUpdateMessage(orderID, status, message, data)
+	update.Test = h.sandboxOrder(orderID)
+
+	// Critical updates are tracked so they can fall back to a notification if
+	// the app never acknowledges them. A failure here still publishes.
+	if criticalOrderStatuses[status] && h.db != nil {
+		eventID, err := recordRealtimeDelivery(h.db, userID, orderID, status, message)
+		if err != nil {
+			log.Printf("Failed to record realtime delivery: user=%d, order=%d: %v", userID, orderID, err)
+		} else {
+			update.EventID = eventID
+		}
+	}
+	if h.db != nil {
+		if err := h.push.QueueOrderStatus(h.db, userID, orderID, status, message); err != nil {
+			log.Printf("Failed to queue order push: user=%d, order=%d: %v", userID, orderID, err)
+		}
+	}
 
 	updateData, err := json.Marshal(update)
 	if err != nil {
 		return fmt.Errorf("failed to marshal update: %v", err)
 	}
 
-	// Publish to user's order channel
-	userChannel := fmt.Sprintf("order:%d", userID)
-	_, err = h.node.Publish(userChannel, updateData)
-	if err != nil {
-		return fmt.Errorf("failed to publish to user channel: %v", err)
+	// Publish to the user's channel and the order's own channel. Both are
+	// tried even if one fails; failures are queued for retry.
+	var publishErr error
+	for _, channel := range []string{fmt.Sprintf("order:%d", userID), fmt.Sprintf("order:%d:%d", userID, orderID)} {
+		if err := h.publishOrderChannel(channel, orderID, updateData); err != nil && publishErr == nil {
+			publishErr = fmt.Errorf("failed to publish to %s: %v", channel, err)
+		}
 	}
-
-	// Publish to specific order channel
-	orderChannel := fmt.Sprintf("order:%d:%d", userID, orderID)
-	_, err = h.node.Publish(orderChannel, updateData)
-	if err != nil {
-		return fmt.Errorf("failed to publish to order channel: %v", err)
+	if publishErr != nil {
+		return publishErr
 	}
 
 	log.Printf("Published order update: user=%d, order=%d, status=%s", userID, orderID, status)
 	return nil
 }
 
+// publishOrderChannel publishes an order update to one channel. A failure is
+// queued for retry; a success replaces any older update still queued.
+func (h *RealtimeHandler) publishOrderChannel(channel string, orderID int, data []byte) error {
+	_, err := h.node.Publish(channel, data)
+	if h.retries == nil {
+		return err
+	}
+	if err != nil {
+		h.retries.Enqueue(channel, orderID, data, err)
+		return err
+	}
+	h.retries.Supersede(channel, orderID)
+	return nil
+}
+
 // PublishOrderPickup sends pickup notifications
 func (h *RealtimeHandler) PublishOrderPickup(userID, orderID int, estimatedTime string) error {
-	data := map[string]interface{}{
-		"estimated_pickup_time": estimatedTime,
-		"driver_info": map[string]interface{}{
-			"name":  "John Driver",
-			"phone": "555-0123",
-		},
-	}
+	data := pickupUpdateData(estimatedTime)
 
 	return h.PublishOrderUpdate(
 		userID, 
@@ -121,10 +352,7 @@ func (h *RealtimeHandler) PublishOrderPickup(userID, orderID int, estimatedTime
 
 // PublishOrderDelivery sends delivery notifications
 func (h *RealtimeHandler) PublishOrderDelivery(userID, orderID int, estimatedTime string) error {
-	data := map[string]interface{}{
-		"estimated_delivery_time": estimatedTime,
-		"delivery_instructions":   "Please leave bags at front door if no one is home",
-	}
+	data := deliveryUpdateData(estimatedTime)
 
 	return h.PublishOrderUpdate(
 		userID,
@@ -148,10 +376,7 @@ func (h *RealtimeHandler) PublishOrderComplete(userID, orderID int) error {
 		orderNumber = fmt.Sprintf("TUM-%d", orderID)
 	}
 
-	data := map[string]interface{}{
-		"order_number": orderNumber,
-		"rating_url":   fmt.Sprintf("/orders/%d/rate", orderID),
-	}
+	data := completionUpdateData(orderID, orderNumber)
 
 	return h.PublishOrderUpdate(
 		userID,
@@ -174,21 +399,8 @@ func (h *RealtimeHandler) GetOrderSubscribers(userID, orderID int) int {
 
 // SendDriverLocationUpdate sends location updates for orders in transit
 func (h *RealtimeHandler) SendDriverLocationUpdate(userID, orderID int, lat, lng float64, estimatedArrival string) error {
-	data := map[string]interface{}{
-		"driver_location": map[string]interface{}{
-			"latitude":  lat,
-			"longitude": lng,
-		},
-		"estimated_arrival": estimatedArrival,
-	}
-
-	update := OrderUpdateMessage{
-		Type:      "driver_location",
-		OrderID:   orderID,
-		Message:   "Driver location updated",
-		Timestamp: "now",
-		Data:      data,
-	}
+	update := driverLocationMessage(orderID, lat, lng, estimatedArrival)
+	update.Test = h.sandboxOrder(orderID)
 
 	updateData, err := json.Marshal(update)
 	if err != nil {
@@ -203,4 +415,94 @@ func (h *RealtimeHandler) SendDriverLocationUpdate(userID, orderID int, lat, lng
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// PublishOrderItemEvent tells the customer watching an order that one of its
+// garments was added at pickup, flagged damaged or substituted
+func (h *RealtimeHandler) PublishOrderItemEvent(userID int, event OrderItemEvent) error {
+	update := orderItemEventMessage(event)
+	update.Test = h.sandboxOrder(event.OrderID)
+
+	updateData, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("failed to marshal item event: %v", err)
+	}
+
+	orderChannel := fmt.Sprintf("order:%d:%d", userID, event.OrderID)
+	if _, err := h.node.Publish(orderChannel, updateData); err != nil {
+		return fmt.Errorf("failed to publish item event: %v", err)
+	}
+	return nil
+}
+
+// AdminAlertPublisher delivers operational alerts to admins
+type AdminAlertPublisher interface {
+	PublishAdminAlert(alertType, message string, data interface{}) error
+}
+
+// adminAlertsChannel is the Centrifuge channel the admin dashboard listens on
+const adminAlertsChannel = "admin:alerts"
+
+// PublishAdminAlert broadcasts an operational alert to connected admins
+func (h *RealtimeHandler) PublishAdminAlert(alertType, message string, data interface{}) error {
+	alert := adminAlertMessage(alertType, message, data)
+
+	alertData, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to marshal admin alert: %v", err)
+	}
+
+	if _, err := h.node.Publish(adminAlertsChannel, alertData); err != nil {
+		return fmt.Errorf("failed to publish admin alert: %v", err)
+	}
+
+	log.Printf("Published admin alert: type=%s", alertType)
+	return nil
+}
+
+// orderChatChannel is the Centrifuge channel an order's conversation is
+// published on; the customer, its drivers and support all listen on it
+func orderChatChannel(orderID int) string {
+	return fmt.Sprintf("chat:order:%d", orderID)
+}
+
+// PublishOrderChat sends a chat message or read receipt to an order's conversation
+func (h *RealtimeHandler) PublishOrderChat(orderID int, event OrderUpdateMessage) error {
+	event.Test = h.sandboxOrder(orderID)
+
+	eventData, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chat event: %v", err)
+	}
+
+	if _, err := h.node.Publish(orderChatChannel(orderID), eventData); err != nil {
+		return fmt.Errorf("failed to publish chat event: %v", err)
+	}
+	return nil
+}
+
+// silentRealtime drops every notification. It stands in for the real publisher
+// when an admin correction is made with suppress_notifications set.
+type silentRealtime struct{}
+
+func (silentRealtime) PublishOrderUpdate(userID, orderID int, status, message string, data interface{}) error {
+	log.Printf("Suppressed order update: user=%d, order=%d, status=%s", userID, orderID, status)
+	return nil
+}
+
+func (silentRealtime) PublishOrderComplete(userID, orderID int) error {
+	log.Printf("Suppressed order completion: user=%d, order=%d", userID, orderID)
+	return nil
+}
+
+// notifierFor returns the publisher a mutation should notify through. When
+// suppress is set customers are not told about the change.
+func notifierFor(realtime RealtimeInterface, suppress bool) RealtimeInterface {
+	if realtime == nil {
+		return nil
+	}
+	if suppress {
+		return silentRealtime{}
+	}
+	return realtime
+}
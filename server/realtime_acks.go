@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/centrifugal/centrifuge"
+)
+
+// ackEventRPCMethod is the Centrifuge RPC the app calls with a critical
+// update's event_id once it has shown it
+const ackEventRPCMethod = "ack_event"
+
+// criticalOrderStatuses are the updates a customer has to see. They're
+// published with an event_id and fall back to a notification when the app
+// doesn't acknowledge them.
+var criticalOrderStatuses = map[string]bool{
+	"picked_up":        true,
+	"out_for_delivery": true,
+	"delivered":        true,
+	"failed":           true,
+	"cancelled":        true,
+}
+
+const defaultRealtimeAckTimeout = 2 * time.Minute
+
+// realtimeAckTimeout is how long an update can go unacknowledged before the
+// fallback is sent, from REALTIME_ACK_TIMEOUT_SECONDS
+func realtimeAckTimeout() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("REALTIME_ACK_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultRealtimeAckTimeout
+}
+
+// recordRealtimeDelivery stores a critical update before it's published and
+// returns the event_id the app should acknowledge
+func recordRealtimeDelivery(db *sql.DB, userID, orderID int, status, message string) (string, error) {
+	eventID := generateRandomString(32)
+	_, err := db.Exec(`
+		INSERT INTO realtime_deliveries (event_id, user_id, order_id, status, message)
+		VALUES ($1, $2, $3, $4, $5)`,
+		eventID, userID, orderID, status, message,
+	)
+	if err != nil {
+		return "", err
+	}
+	return eventID, nil
+}
+
+type ackEventRequest struct {
+	EventID string `json:"event_id"`
+}
+
+// ackRealtimeEvent marks an update as received. Acks that arrive after the
+// fallback went out are still recorded so late delivery shows in the stats.
+func ackRealtimeEvent(db *sql.DB, data []byte) ([]byte, error) {
+	var req ackEventRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.EventID == "" {
+		return nil, centrifuge.ErrorBadRequest
+	}
+
+	result, err := db.Exec(`
+		UPDATE realtime_deliveries SET acked_at = CURRENT_TIMESTAMP
+		WHERE event_id = $1 AND acked_at IS NULL`,
+		req.EventID,
+	)
+	if err != nil {
+		log.Printf("Failed to record realtime ack: %v", err)
+		return nil, centrifuge.ErrorInternal
+	}
+	acked, _ := result.RowsAffected()
+	return json.Marshal(map[string]bool{"acked": acked > 0})
+}
+
+// handleRPC serves RPC calls from connected clients. userID is the
+// connection's user, as set when it connected.
+func (h *RealtimeHandler) handleRPC(userID string, e centrifuge.RPCEvent, cb centrifuge.RPCCallback) {
+	switch e.Method {
+	case ackEventRPCMethod:
+		reply, err := ackRealtimeEvent(h.db, e.Data)
+		cb(centrifuge.RPCReply{Data: reply}, err)
+	case chatTypingRPCMethod:
+		reply, err := h.sendChatTyping(userID, e.Data)
+		cb(centrifuge.RPCReply{Data: reply}, err)
+	default:
+		cb(centrifuge.RPCReply{}, centrifuge.ErrorMethodNotFound)
+	}
+}
+
+// processRealtimeFallbacks sends critical updates nobody acknowledged in time
+// as in-app notifications, and pushes them to the customer's devices unless
+// the update's own push is already queued or sent
+func (s *AutoScheduler) processRealtimeFallbacks() {
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Printf("Error starting realtime fallback run: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, user_id, order_id, status, message
+		FROM realtime_deliveries
+		WHERE acked_at IS NULL AND fallback_at IS NULL
+		  AND published_at < NOW() - make_interval(secs => $1)
+		ORDER BY published_at
+		LIMIT 500
+		FOR UPDATE SKIP LOCKED`,
+		realtimeAckTimeout().Seconds(),
+	)
+	if err != nil {
+		log.Printf("Error fetching unacknowledged realtime updates: %v", err)
+		return
+	}
+
+	type pendingDelivery struct {
+		ID      int64
+		UserID  int
+		OrderID sql.NullInt64
+		Status  string
+		Message string
+	}
+	var pending []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.ID, &d.UserID, &d.OrderID, &d.Status, &d.Message); err != nil {
+			rows.Close()
+			log.Printf("Error scanning unacknowledged realtime update: %v", err)
+			return
+		}
+		pending = append(pending, d)
+	}
+	rows.Close()
+
+	for _, d := range pending {
+		title := d.Status
+		if def, ok := orderStatusDefinition(d.Status); ok {
+			title = def.Label
+		}
+		var notificationID int
+		err := tx.QueryRow(`
+			INSERT INTO notifications (user_id, order_id, type, title, message)
+			VALUES ($1, $2, 'order_status_update', $3, $4)
+			RETURNING id`,
+			d.UserID, d.OrderID, title, d.Message,
+		).Scan(&notificationID)
+		if err != nil {
+			log.Printf("Error sending realtime fallback for delivery %d: %v", d.ID, err)
+			return
+		}
+		if d.OrderID.Valid {
+			var pushed bool
+			err := tx.QueryRow(`
+				SELECT EXISTS(
+					SELECT 1 FROM push_deliveries
+					WHERE user_id = $1 AND order_id = $2 AND data->>'status' = $3 AND status IN ('pending', 'sent')
+				)`,
+				d.UserID, d.OrderID.Int64, d.Status,
+			).Scan(&pushed)
+			if err == nil && !pushed {
+				err = s.push.QueueOrderStatus(tx, d.UserID, int(d.OrderID.Int64), d.Status, d.Message)
+			}
+			if err != nil {
+				log.Printf("Error pushing realtime fallback for delivery %d: %v", d.ID, err)
+				return
+			}
+		}
+		_, err = tx.Exec(`
+			UPDATE realtime_deliveries SET fallback_at = CURRENT_TIMESTAMP, fallback_notification_id = $1
+			WHERE id = $2`,
+			notificationID, d.ID,
+		)
+		if err != nil {
+			log.Printf("Error recording realtime fallback for delivery %d: %v", d.ID, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing realtime fallbacks: %v", err)
+		return
+	}
+	if len(pending) > 0 {
+		log.Printf("Sent %d realtime fallbacks", len(pending))
+	}
+}
+
+// RealtimeDeliveryStats summarizes how critical updates of one status reached customers
+type RealtimeDeliveryStats struct {
+	Status       string   `json:"status"`
+	Published    int      `json:"published"`
+	Acked        int      `json:"acked"`
+	LateAcked    int      `json:"late_acked"` // Acked after the fallback went out
+	FellBack     int      `json:"fell_back"`
+	Pending      int      `json:"pending"` // Still inside the ack timeout
+	FallbackRate float64  `json:"fallback_rate"`
+	AvgAckSecs   *float64 `json:"avg_ack_seconds,omitempty"`
+}
+
+// handleGetRealtimeDeliveryStats reports ack and fallback rates by status
+// over the last ?days= (default 7, at most 90)
+func (h *AdminHandler) handleGetRealtimeDeliveryStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := 7
+	if d := r.URL.Query().Get("days"); d != "" {
+		parsed, err := strconv.Atoi(d)
+		if err != nil || parsed < 1 || parsed > 90 {
+			http.Error(w, "days must be between 1 and 90", http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+
+	rows, err := h.db.Query(`
+		SELECT status,
+		       COUNT(*),
+		       COUNT(acked_at),
+		       COUNT(*) FILTER (WHERE acked_at > fallback_at),
+		       COUNT(fallback_at),
+		       COUNT(*) FILTER (WHERE acked_at IS NULL AND fallback_at IS NULL),
+		       AVG(EXTRACT(EPOCH FROM acked_at - published_at)) FILTER (WHERE fallback_at IS NULL OR acked_at < fallback_at)
+		FROM realtime_deliveries
+		WHERE published_at >= NOW() - make_interval(days => $1)
+		GROUP BY status
+		ORDER BY status`,
+		days,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch realtime delivery stats", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	stats := []RealtimeDeliveryStats{}
+	for rows.Next() {
+		var s RealtimeDeliveryStats
+		var avgAck sql.NullFloat64
+		if err := rows.Scan(&s.Status, &s.Published, &s.Acked, &s.LateAcked, &s.FellBack, &s.Pending, &avgAck); err != nil {
+			http.Error(w, "Failed to fetch realtime delivery stats", http.StatusInternalServerError)
+			return
+		}
+		if settled := s.Published - s.Pending; settled > 0 {
+			s.FallbackRate = float64(s.FellBack) / float64(settled)
+		}
+		if avgAck.Valid {
+			s.AvgAckSecs = &avgAck.Float64
+		}
+		stats = append(stats, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/centrifugal/centrifuge"
+)
+
+func TestRealtimeHandler_RPCRejectsBadCalls(t *testing.T) {
+	handler := &RealtimeHandler{}
+
+	var rpcErr error
+	handler.handleRPC("", centrifuge.RPCEvent{Method: "delete_order"}, func(reply centrifuge.RPCReply, err error) { rpcErr = err })
+	if rpcErr != centrifuge.ErrorMethodNotFound {
+		t.Errorf("Expected an unknown method to be rejected, got %v", rpcErr)
+	}
+
+	handler.handleRPC("", centrifuge.RPCEvent{Method: ackEventRPCMethod, Data: []byte(`{}`)}, func(reply centrifuge.RPCReply, err error) { rpcErr = err })
+	if rpcErr != centrifuge.ErrorBadRequest {
+		t.Errorf("Expected an ack without an event_id to be rejected, got %v", rpcErr)
+	}
+}
+
+func TestRealtimeAcks_FallbackForUnackedUpdates(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	node := setupCentrifugeNode(t)
+	handler := NewRealtimeHandler(db.DB, node)
+
+	userID := db.CreateTestUser(t, "acks@example.com", "Ack", "User")
+	addressID := db.CreateTestAddress(t, userID)
+	orderID := db.CreateTestOrder(t, userID, addressID)
+
+	// Only critical updates are tracked
+	handler.PublishOrderUpdate(userID, orderID, "in_process", orderStatusMessage("in_process"), nil)
+	handler.PublishOrderUpdate(userID, orderID, "picked_up", orderStatusMessage("picked_up"), nil)
+	handler.PublishOrderUpdate(userID, orderID, "out_for_delivery", orderStatusMessage("out_for_delivery"), nil)
+
+	var tracked int
+	db.QueryRow("SELECT COUNT(*) FROM realtime_deliveries WHERE order_id = $1", orderID).Scan(&tracked)
+	if tracked != 2 {
+		t.Fatalf("Expected 2 critical updates tracked, got %d", tracked)
+	}
+
+	// The app acks the pickup; the delivery update goes unacknowledged
+	var pickupEventID string
+	db.QueryRow("SELECT event_id FROM realtime_deliveries WHERE order_id = $1 AND status = 'picked_up'", orderID).Scan(&pickupEventID)
+	var reply []byte
+	var rpcErr error
+	handler.handleRPC("", centrifuge.RPCEvent{Method: ackEventRPCMethod, Data: []byte(`{"event_id": "` + pickupEventID + `"}`)},
+		func(r centrifuge.RPCReply, err error) { reply, rpcErr = r.Data, err })
+	if rpcErr != nil || string(reply) != `{"acked":true}` {
+		t.Fatalf("Expected the ack to be recorded, got %s (%v)", reply, rpcErr)
+	}
+
+	db.Exec("UPDATE realtime_deliveries SET published_at = NOW() - INTERVAL '10 minutes' WHERE order_id = $1", orderID)
+	db.Exec("INSERT INTO device_tokens (user_id, token, platform) VALUES ($1, 'acks-phone', 'ios')", userID)
+	scheduler := NewAutoScheduler(db.DB)
+	scheduler.push = NewPushDispatcher(db.DB, map[string]PushSender{"ios": &scriptedPushSender{}})
+	scheduler.processRealtimeFallbacks()
+	scheduler.processRealtimeFallbacks()
+
+	var fallbacks int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE order_id = $1 AND type = 'order_status_update'", orderID).Scan(&fallbacks)
+	if fallbacks != 1 {
+		t.Errorf("Expected one fallback notification for the unacked update, got %d", fallbacks)
+	}
+	var pushes int
+	db.QueryRow("SELECT COUNT(*) FROM push_deliveries WHERE order_id = $1 AND data->>'status' = 'out_for_delivery'", orderID).Scan(&pushes)
+	if pushes != 1 {
+		t.Errorf("Expected the unacked update pushed once, got %d", pushes)
+	}
+
+	admin := &AdminHandler{db: db.DB}
+	w := httptest.NewRecorder()
+	admin.handleGetRealtimeDeliveryStats(w, httptest.NewRequest("GET", "/api/v1/admin/analytics/realtime-deliveries", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var stats []RealtimeDeliveryStats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	byStatus := map[string]RealtimeDeliveryStats{}
+	for _, s := range stats {
+		byStatus[s.Status] = s
+	}
+	if s := byStatus["out_for_delivery"]; s.FellBack != 1 || s.FallbackRate != 1 {
+		t.Errorf("Expected the delivery update to have fallen back, got %+v", s)
+	}
+	if s := byStatus["picked_up"]; s.Acked != 1 || s.FellBack != 0 || s.AvgAckSecs == nil {
+		t.Errorf("Expected the pickup update to be acked, got %+v", s)
+	}
+}
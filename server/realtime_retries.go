@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Failed publishes are retried after realtimeRetryBaseDelay, doubling each
+// attempt up to realtimeRetryMaxDelay
+const (
+	realtimeRetryBaseDelay = 2 * time.Second
+	realtimeRetryMaxDelay  = 2 * time.Minute
+	// realtimeRetryInterval is how often the queue is checked for due retries
+	realtimeRetryInterval = time.Second
+	realtimeRetryBatch    = 100
+)
+
+// realtimeRetryMaxAge is how long a failed update is retried before it's
+// dropped as too stale to show (REALTIME_RETRY_MAX_AGE_SECONDS)
+func realtimeRetryMaxAge() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("REALTIME_RETRY_MAX_AGE_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 15 * time.Minute
+}
+
+// realtimeRetryDelay is the wait before the next attempt after attempts failures
+func realtimeRetryDelay(attempts int) time.Duration {
+	delay := realtimeRetryBaseDelay
+	for i := 1; i < attempts && delay < realtimeRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > realtimeRetryMaxDelay {
+		return realtimeRetryMaxDelay
+	}
+	return delay
+}
+
+// RealtimeRetry is an order update that failed to publish to one channel.
+// Only the latest update per channel and order is kept; an older one would
+// show a stale status.
+type RealtimeRetry struct {
+	Key           string    `json:"key"`
+	Channel       string    `json:"channel"`
+	OrderID       int       `json:"order_id"`
+	Payload       string    `json:"payload"`
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error"`
+}
+
+func realtimeRetryKey(channel string, orderID int) string {
+	return channel + "|" + strconv.Itoa(orderID)
+}
+
+// RealtimeRetryStats counts publish failures and what became of them
+type RealtimeRetryStats struct {
+	Failed      int64 `json:"failed"`       // Publishes that failed and were queued
+	RetryFailed int64 `json:"retry_failed"` // Retries that failed again
+	Recovered   int64 `json:"recovered"`    // Updates delivered by a retry
+	Superseded  int64 `json:"superseded"`   // Queued updates replaced by a newer one
+	Dropped     int64 `json:"dropped"`      // Updates given up on past the max age
+	Pending     int64 `json:"pending"`
+}
+
+// RealtimeRetryStore holds failed publishes until they're due. Claim must be
+// atomic so two servers never retry the same update.
+type RealtimeRetryStore interface {
+	// Put queues a retry, replacing any pending one for the same key
+	Put(ctx context.Context, retry RealtimeRetry) (replaced bool, err error)
+	// Requeue puts a retry back unless a newer one was queued meanwhile
+	Requeue(ctx context.Context, retry RealtimeRetry) (bool, error)
+	// Claim removes and returns up to limit retries due by now
+	Claim(ctx context.Context, now time.Time, limit int) ([]RealtimeRetry, error)
+	// Remove drops the pending retry for key, if any
+	Remove(ctx context.Context, key string) (bool, error)
+	Incr(ctx context.Context, counter string) error
+	Stats(ctx context.Context) (RealtimeRetryStats, error)
+}
+
+// RedisRealtimeRetryStore keeps retries in a hash by key with a sorted set of
+// keys scored by when they're next due, and counters in a stats hash
+type RedisRealtimeRetryStore struct {
+	client *redis.Client
+}
+
+func NewRedisRealtimeRetryStore(client *redis.Client) *RedisRealtimeRetryStore {
+	return &RedisRealtimeRetryStore{client: client}
+}
+
+const (
+	realtimeRetryItemsKey = "realtime_retry:items"
+	realtimeRetryDueKey   = "realtime_retry:due"
+	realtimeRetryStatsKey = "realtime_retry:stats"
+)
+
+func (s *RedisRealtimeRetryStore) Put(ctx context.Context, retry RealtimeRetry) (bool, error) {
+	payload, err := json.Marshal(retry)
+	if err != nil {
+		return false, err
+	}
+	pipe := s.client.TxPipeline()
+	added := pipe.HSet(ctx, realtimeRetryItemsKey, retry.Key, payload)
+	pipe.ZAdd(ctx, realtimeRetryDueKey, redis.Z{Score: float64(retry.NextAttemptAt.UnixMilli()), Member: retry.Key})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return added.Val() == 0, nil
+}
+
+// Only puts the retry back if nothing took its key while it was out
+var requeueRealtimeRetryScript = redis.NewScript(`
+if redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+return 1
+`)
+
+func (s *RedisRealtimeRetryStore) Requeue(ctx context.Context, retry RealtimeRetry) (bool, error) {
+	payload, err := json.Marshal(retry)
+	if err != nil {
+		return false, err
+	}
+	added, err := requeueRealtimeRetryScript.Run(ctx, s.client,
+		[]string{realtimeRetryItemsKey, realtimeRetryDueKey},
+		retry.Key, payload, retry.NextAttemptAt.UnixMilli(),
+	).Int()
+	return added == 1, err
+}
+
+// Pops due keys and their retries in one step
+var claimRealtimeRetriesScript = redis.NewScript(`
+local claimed = {}
+local keys = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, key in ipairs(keys) do
+	redis.call('ZREM', KEYS[2], key)
+	local item = redis.call('HGET', KEYS[1], key)
+	if item then
+		redis.call('HDEL', KEYS[1], key)
+		table.insert(claimed, item)
+	end
+end
+return claimed
+`)
+
+func (s *RedisRealtimeRetryStore) Claim(ctx context.Context, now time.Time, limit int) ([]RealtimeRetry, error) {
+	payloads, err := claimRealtimeRetriesScript.Run(ctx, s.client,
+		[]string{realtimeRetryItemsKey, realtimeRetryDueKey},
+		now.UnixMilli(), limit,
+	).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	retries := make([]RealtimeRetry, 0, len(payloads))
+	for _, payload := range payloads {
+		var retry RealtimeRetry
+		if err := json.Unmarshal([]byte(payload), &retry); err != nil {
+			log.Printf("Skipping unreadable realtime retry: %v", err)
+			continue
+		}
+		retries = append(retries, retry)
+	}
+	return retries, nil
+}
+
+func (s *RedisRealtimeRetryStore) Remove(ctx context.Context, key string) (bool, error) {
+	pipe := s.client.TxPipeline()
+	removed := pipe.HDel(ctx, realtimeRetryItemsKey, key)
+	pipe.ZRem(ctx, realtimeRetryDueKey, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return removed.Val() > 0, nil
+}
+
+func (s *RedisRealtimeRetryStore) Incr(ctx context.Context, counter string) error {
+	return s.client.HIncrBy(ctx, realtimeRetryStatsKey, counter, 1).Err()
+}
+
+func (s *RedisRealtimeRetryStore) Stats(ctx context.Context) (RealtimeRetryStats, error) {
+	var stats RealtimeRetryStats
+	counters, err := s.client.HGetAll(ctx, realtimeRetryStatsKey).Result()
+	if err != nil {
+		return stats, err
+	}
+	count := func(name string) int64 {
+		n, _ := strconv.ParseInt(counters[name], 10, 64)
+		return n
+	}
+	stats.Failed = count("failed")
+	stats.RetryFailed = count("retry_failed")
+	stats.Recovered = count("recovered")
+	stats.Superseded = count("superseded")
+	stats.Dropped = count("dropped")
+	stats.Pending, err = s.client.HLen(ctx, realtimeRetryItemsKey).Result()
+	return stats, err
+}
+
+// RealtimeRetryQueue retries order updates Centrifuge failed to publish so a
+// transient outage doesn't permanently drop what the customer sees
+type RealtimeRetryQueue struct {
+	store   RealtimeRetryStore
+	publish func(channel string, data []byte) error
+	maxAge  time.Duration
+	now     func() time.Time
+	stop    chan struct{}
+}
+
+func NewRealtimeRetryQueue(store RealtimeRetryStore, publish func(channel string, data []byte) error) *RealtimeRetryQueue {
+	return &RealtimeRetryQueue{
+		store:   store,
+		publish: publish,
+		maxAge:  realtimeRetryMaxAge(),
+		now:     time.Now,
+	}
+}
+
+// Enqueue queues an update that failed to publish
+func (q *RealtimeRetryQueue) Enqueue(channel string, orderID int, data []byte, publishErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	now := q.now()
+	retry := RealtimeRetry{
+		Key:           realtimeRetryKey(channel, orderID),
+		Channel:       channel,
+		OrderID:       orderID,
+		Payload:       string(data),
+		Attempts:      1,
+		FirstFailedAt: now,
+		NextAttemptAt: now.Add(realtimeRetryDelay(1)),
+		LastError:     publishErr.Error(),
+	}
+	replaced, err := q.store.Put(ctx, retry)
+	if err != nil {
+		log.Printf("Failed to queue realtime retry for %s: %v", channel, err)
+		return
+	}
+	q.incr(ctx, "failed")
+	if replaced {
+		q.incr(ctx, "superseded")
+	}
+}
+
+// Supersede drops a queued update once a newer one for the same channel and
+// order has been published
+func (q *RealtimeRetryQueue) Supersede(channel string, orderID int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	removed, err := q.store.Remove(ctx, realtimeRetryKey(channel, orderID))
+	if err != nil {
+		log.Printf("Failed to clear realtime retry for %s: %v", channel, err)
+		return
+	}
+	if removed {
+		q.incr(ctx, "superseded")
+	}
+}
+
+// ProcessDue retries every update that's due and returns how many were
+// delivered
+func (q *RealtimeRetryQueue) ProcessDue(ctx context.Context) (int, error) {
+	now := q.now()
+	retries, err := q.store.Claim(ctx, now, realtimeRetryBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, retry := range retries {
+		if now.Sub(retry.FirstFailedAt) > q.maxAge {
+			log.Printf("Dropping realtime update for %s after %d attempts: %s", retry.Channel, retry.Attempts, retry.LastError)
+			q.incr(ctx, "dropped")
+			continue
+		}
+
+		if err := q.publish(retry.Channel, []byte(retry.Payload)); err != nil {
+			retry.Attempts++
+			retry.NextAttemptAt = now.Add(realtimeRetryDelay(retry.Attempts))
+			retry.LastError = err.Error()
+			q.incr(ctx, "retry_failed")
+			if _, err := q.store.Requeue(ctx, retry); err != nil {
+				log.Printf("Failed to requeue realtime retry for %s: %v", retry.Channel, err)
+			}
+			continue
+		}
+		q.incr(ctx, "recovered")
+		delivered++
+	}
+	return delivered, nil
+}
+
+func (q *RealtimeRetryQueue) incr(ctx context.Context, counter string) {
+	if err := q.store.Incr(ctx, counter); err != nil {
+		log.Printf("Failed to count realtime retry %s: %v", counter, err)
+	}
+}
+
+// Start checks for due retries every realtimeRetryInterval until Stop
+func (q *RealtimeRetryQueue) Start() {
+	q.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(realtimeRetryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				if _, err := q.ProcessDue(ctx); err != nil {
+					log.Printf("Failed to process realtime retries: %v", err)
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+func (q *RealtimeRetryQueue) Stop() {
+	if q.stop != nil {
+		close(q.stop)
+	}
+}
+
+// handleGetRealtimeRetryStats reports realtime publish failures and retries
+func (q *RealtimeRetryQueue) handleGetRealtimeRetryStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := q.store.Stats(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to fetch realtime retry stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
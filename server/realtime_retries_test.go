@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryRealtimeRetryStore stands in for Redis in tests
+type memoryRealtimeRetryStore struct {
+	mu       sync.Mutex
+	retries  map[string]RealtimeRetry
+	counters map[string]int64
+}
+
+func newMemoryRealtimeRetryStore() *memoryRealtimeRetryStore {
+	return &memoryRealtimeRetryStore{retries: map[string]RealtimeRetry{}, counters: map[string]int64{}}
+}
+
+func (s *memoryRealtimeRetryStore) Put(ctx context.Context, retry RealtimeRetry) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, replaced := s.retries[retry.Key]
+	s.retries[retry.Key] = retry
+	return replaced, nil
+}
+
+func (s *memoryRealtimeRetryStore) Requeue(ctx context.Context, retry RealtimeRetry) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.retries[retry.Key]; exists {
+		return false, nil
+	}
+	s.retries[retry.Key] = retry
+	return true, nil
+}
+
+func (s *memoryRealtimeRetryStore) Claim(ctx context.Context, now time.Time, limit int) ([]RealtimeRetry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	claimed := []RealtimeRetry{}
+	for key, retry := range s.retries {
+		if len(claimed) < limit && !retry.NextAttemptAt.After(now) {
+			claimed = append(claimed, retry)
+			delete(s.retries, key)
+		}
+	}
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].NextAttemptAt.Before(claimed[j].NextAttemptAt) })
+	return claimed, nil
+}
+
+func (s *memoryRealtimeRetryStore) Remove(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.retries[key]
+	delete(s.retries, key)
+	return exists, nil
+}
+
+func (s *memoryRealtimeRetryStore) Incr(ctx context.Context, counter string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[counter]++
+	return nil
+}
+
+func (s *memoryRealtimeRetryStore) Stats(ctx context.Context) (RealtimeRetryStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return RealtimeRetryStats{
+		Failed:      s.counters["failed"],
+		RetryFailed: s.counters["retry_failed"],
+		Recovered:   s.counters["recovered"],
+		Superseded:  s.counters["superseded"],
+		Dropped:     s.counters["dropped"],
+		Pending:     int64(len(s.retries)),
+	}, nil
+}
+
+func TestRealtimeRetryDelay(t *testing.T) {
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second}
+	for i, want := range expected {
+		if got := realtimeRetryDelay(i + 1); got != want {
+			t.Errorf("realtimeRetryDelay(%d) = %s, expected %s", i+1, got, want)
+		}
+	}
+	if got := realtimeRetryDelay(30); got != realtimeRetryMaxDelay {
+		t.Errorf("Expected the delay capped at %s, got %s", realtimeRetryMaxDelay, got)
+	}
+}
+
+func TestRealtimeRetryQueue(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryRealtimeRetryStore()
+	centrifugeDown := true
+	published := map[string]string{}
+	queue := NewRealtimeRetryQueue(store, func(channel string, data []byte) error {
+		if centrifugeDown {
+			return errors.New("broker unavailable")
+		}
+		published[channel] = string(data)
+		return nil
+	})
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	queue.now = func() time.Time { return now }
+	queue.maxAge = 10 * time.Minute
+
+	queue.Enqueue("order:1:10", 10, []byte(`{"status":"picked_up"}`), errors.New("broker unavailable"))
+
+	// Nothing is retried before its backoff is up
+	if delivered, _ := queue.ProcessDue(ctx); delivered != 0 || len(store.retries) != 1 {
+		t.Fatalf("Expected the retry to wait, delivered %d with %d queued", delivered, len(store.retries))
+	}
+
+	// A failed retry backs off further
+	now = now.Add(realtimeRetryDelay(1))
+	queue.ProcessDue(ctx)
+	retry := store.retries[realtimeRetryKey("order:1:10", 10)]
+	if retry.Attempts != 2 || !retry.NextAttemptAt.Equal(now.Add(realtimeRetryDelay(2))) {
+		t.Fatalf("Expected a second attempt %s out, got %+v", realtimeRetryDelay(2), retry)
+	}
+
+	// A newer update for the same order replaces the queued one
+	queue.Enqueue("order:1:10", 10, []byte(`{"status":"delivered"}`), errors.New("broker unavailable"))
+	if len(store.retries) != 1 || store.counters["superseded"] != 1 {
+		t.Errorf("Expected the newer update to replace the older, got %d queued", len(store.retries))
+	}
+
+	// Once Centrifuge is back the latest update goes out
+	centrifugeDown = false
+	now = now.Add(realtimeRetryDelay(1))
+	if delivered, _ := queue.ProcessDue(ctx); delivered != 1 || published["order:1:10"] != `{"status":"delivered"}` {
+		t.Errorf("Expected the latest update delivered, got %v", published)
+	}
+
+	// Updates that keep failing are dropped past the max age
+	centrifugeDown = true
+	queue.Enqueue("order:1", 11, []byte(`{"status":"picked_up"}`), errors.New("broker unavailable"))
+	now = now.Add(11 * time.Minute)
+	queue.ProcessDue(ctx)
+
+	// A later successful publish clears anything still queued for that order
+	queue.Enqueue("order:1", 12, []byte(`{"status":"picked_up"}`), errors.New("broker unavailable"))
+	queue.Supersede("order:1", 12)
+
+	stats, _ := store.Stats(ctx)
+	expected := RealtimeRetryStats{Failed: 4, RetryFailed: 1, Recovered: 1, Superseded: 2, Dropped: 1, Pending: 0}
+	if stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
 	"github.com/centrifugal/centrifuge"
@@ -192,6 +193,26 @@ func TestMockRealtimeHandler(t *testing.T) {
 	}
 }
 
+func TestNotifierFor_SuppressNotifications(t *testing.T) {
+	mock := NewMockRealtimeHandler()
+
+	if notifierFor(nil, false) != nil {
+		t.Error("Expected nil notifier when no realtime handler is configured")
+	}
+
+	notifierFor(mock, false).PublishOrderUpdate(1, 2, "ready", "Order ready", nil)
+	if len(mock.PublishedUpdates) != 1 {
+		t.Fatalf("Expected 1 published update, got %d", len(mock.PublishedUpdates))
+	}
+
+	suppressed := notifierFor(mock, true)
+	suppressed.PublishOrderUpdate(1, 2, "delivered", "Order delivered", nil)
+	suppressed.PublishOrderComplete(1, 2)
+	if len(mock.PublishedUpdates) != 1 {
+		t.Errorf("Expected suppressed notifier to publish nothing, got %d updates", len(mock.PublishedUpdates))
+	}
+}
+
 // Test connection handling (simplified since we can't easily test WebSocket connections)
 func TestRealtimeHandler_ConnectionHandling(t *testing.T) {
 	db := SetupTestDB(t)
@@ -215,6 +236,64 @@ func TestRealtimeHandler_ConnectionHandling(t *testing.T) {
 	}
 }
 
+func TestScanChannel(t *testing.T) {
+	var a, b int
+	tests := []struct {
+		channel, format string
+		ids             []*int
+		expected        bool
+	}{
+		{"order:5:12", "order:%d:%d", []*int{&a, &b}, true},
+		{"order:5", "order:%d:%d", []*int{&a, &b}, false},
+		{"order:5:12:1", "order:%d:%d", []*int{&a, &b}, false},
+		{"chat:order:12", "chat:order:%d", []*int{&a}, true},
+		{"chat:order:012", "chat:order:%d", []*int{&a}, false},
+		{"chat:order:-1", "chat:order:%d", []*int{&a}, false},
+		{"chat:order:x", "chat:order:%d", []*int{&a}, false},
+	}
+	for _, tt := range tests {
+		if got := scanChannel(tt.channel, tt.format, tt.ids...); got != tt.expected {
+			t.Errorf("scanChannel(%q, %q) = %v, expected %v", tt.channel, tt.format, got, tt.expected)
+		}
+	}
+}
+
+func TestRealtimeHandler_AuthorizeChannel(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	customerID := db.CreateTestUser(t, "subscribe-customer@example.com", "Sub", "Customer")
+	strangerID := db.CreateTestUser(t, "subscribe-stranger@example.com", "Sub", "Stranger")
+	adminID := db.CreateTestUser(t, "subscribe-admin@example.com", "Sub", "Admin")
+	db.Exec("UPDATE users SET role = 'admin' WHERE id = $1", adminID)
+	orderID := db.CreateTestOrder(t, customerID, db.CreateTestAddress(t, customerID))
+
+	handler := &RealtimeHandler{db: db.DB}
+	tests := []struct {
+		userID  string
+		channel string
+		allowed bool
+	}{
+		{fmt.Sprint(customerID), fmt.Sprintf("order:%d", customerID), true},
+		{fmt.Sprint(customerID), fmt.Sprintf("order:%d:%d", customerID, orderID), true},
+		{fmt.Sprint(customerID), orderChatChannel(orderID), true},
+		{fmt.Sprint(customerID), adminAlertsChannel, false},
+		{fmt.Sprint(strangerID), fmt.Sprintf("order:%d", customerID), false},
+		{fmt.Sprint(strangerID), fmt.Sprintf("order:%d:%d", customerID, orderID), false},
+		{fmt.Sprint(strangerID), orderChatChannel(orderID), false},
+		{fmt.Sprint(adminID), orderChatChannel(orderID), true},
+		{fmt.Sprint(adminID), adminAlertsChannel, true},
+		{"anonymous-client-id", orderChatChannel(orderID), false},
+		{fmt.Sprint(customerID), "news", false},
+	}
+	for _, tt := range tests {
+		err := handler.authorizeChannel(tt.userID, tt.channel)
+		if (err == nil) != tt.allowed {
+			t.Errorf("authorizeChannel(%s, %s) = %v, expected allowed=%v", tt.userID, tt.channel, err, tt.allowed)
+		}
+	}
+}
+
 // Performance test for realtime updates
 func BenchmarkRealtimeHandler_PublishOrderUpdate(b *testing.B) {
 	db := SetupTestDB(&testing.T{})
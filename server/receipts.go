@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// ReceiptLine is one itemized line on an order receipt
+type ReceiptLine struct {
+	Description      string   `json:"description"`
+	Category         string   `json:"category"` // service, garment, add_on, peak_pricing or overweight
+	Quantity         int      `json:"quantity"`
+	UnitPrice        float64  `json:"unit_price"`
+	LineTotal        float64  `json:"line_total"`
+	CareFlags        []string `json:"care_flags,omitempty"`
+	ReceivedQuantity *int     `json:"received_quantity,omitempty"`
+	Notes            *string  `json:"notes,omitempty"`
+}
+
+type OrderReceipt struct {
+	OrderID     int           `json:"order_id"`
+	OrderNumber string        `json:"order_number"`
+	Status      string        `json:"status"`
+	PickupDate  string        `json:"pickup_date"`
+	Lines       []ReceiptLine `json:"lines"`
+	Subtotal    float64       `json:"subtotal"`
+	Tax         float64       `json:"tax"`
+	Tip         float64       `json:"tip"`
+	Total       float64       `json:"total"`
+	// DeliverySignature is the proof of delivery for accounts that require one
+	DeliverySignature *DeliverySignature `json:"delivery_signature,omitempty"`
+}
+
+// buildOrderReceipt itemizes bag/service lines, garments, add-ons, any peak
+// or off-peak slot adjustment and any overweight charge for an order
+func buildOrderReceipt(order *Order) OrderReceipt {
+	receipt := OrderReceipt{
+		OrderID:     order.ID,
+		OrderNumber: fmt.Sprintf("TUM-%d-%03d", order.CreatedAt.Year(), order.ID),
+		Status:      order.Status,
+		PickupDate:  order.PickupDate,
+		Lines:       []ReceiptLine{},
+	}
+
+	for _, item := range order.Items {
+		description := item.ServiceName
+		if item.Notes != nil && *item.Notes != "" {
+			description = *item.Notes
+		}
+		receipt.Lines = append(receipt.Lines, ReceiptLine{
+			Description: description,
+			Category:    "service",
+			Quantity:    item.Quantity,
+			UnitPrice:   item.Price,
+			LineTotal:   centsToDollars(dollarsToCents(item.Price) * item.Quantity),
+		})
+	}
+
+	for _, garment := range order.Garments {
+		receipt.Lines = append(receipt.Lines, ReceiptLine{
+			Description:      garment.GarmentName,
+			Category:         "garment",
+			Quantity:         garment.Quantity,
+			UnitPrice:        garment.UnitPrice,
+			LineTotal:        centsToDollars(dollarsToCents(garment.UnitPrice) * garment.Quantity),
+			CareFlags:        garment.CareFlags,
+			ReceivedQuantity: garment.ReceivedQuantity,
+			Notes:            garment.Notes,
+		})
+	}
+
+	for _, addOn := range order.AddOns {
+		receipt.Lines = append(receipt.Lines, ReceiptLine{
+			Description: addOn.DisplayName,
+			Category:    "add_on",
+			Quantity:    addOn.Quantity,
+			UnitPrice:   addOn.UnitPrice,
+			LineTotal:   centsToDollars(dollarsToCents(addOn.UnitPrice) * addOn.Quantity),
+		})
+	}
+
+	if adjustment := order.SlotAdjustment; adjustment != nil && adjustment.Amount != 0 {
+		receipt.Lines = append(receipt.Lines, ReceiptLine{
+			Description: fmt.Sprintf("%s (%d%% of services)", adjustment.Label, adjustment.MultiplierPercent),
+			Category:    "peak_pricing",
+			Quantity:    1,
+			UnitPrice:   adjustment.Amount,
+			LineTotal:   adjustment.Amount,
+		})
+	}
+
+	if order.OverweightCharge > 0 {
+		receipt.Lines = append(receipt.Lines, ReceiptLine{
+			Description: "Overweight bags",
+			Category:    "overweight",
+			Quantity:    1,
+			UnitPrice:   order.OverweightCharge,
+			LineTotal:   order.OverweightCharge,
+		})
+	}
+
+	if order.Subtotal != nil {
+		receipt.Subtotal = *order.Subtotal
+	}
+	if order.Tax != nil {
+		receipt.Tax = *order.Tax
+	}
+	if order.Tip != nil {
+		receipt.Tip = *order.Tip
+	}
+	if order.Total != nil {
+		receipt.Total = *order.Total
+	}
+
+	return receipt
+}
+
+// handleGetOrderReceipt returns an itemized receipt for one of the user's orders
+func (h *OrderHandler) handleGetOrderReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	order, err := h.getOrderByID(orderID, userID)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	receipt := buildOrderReceipt(order)
+	receipt.DeliverySignature, err = orderDeliverySignature(r.Context(), h.db, h.fileStore, orderID)
+	if err != nil {
+		http.Error(w, "Failed to fetch delivery signature", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
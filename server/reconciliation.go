@@ -0,0 +1,445 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/balancetransaction"
+)
+
+// ReconciliationHandler serves the daily payment reconciliation used for
+// the accounting close
+type ReconciliationHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+	ledger    func(start, end time.Time) ([]StripeLedgerEntry, error)
+}
+
+func NewReconciliationHandler(db *sql.DB) *ReconciliationHandler {
+	return &ReconciliationHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+		ledger:    listStripeLedgerEntries,
+	}
+}
+
+// StripeLedgerEntry is the part of a Stripe balance transaction we reconcile against
+type StripeLedgerEntry struct {
+	ID          string
+	Type        string
+	SourceID    string // Charge ID for charges
+	AmountCents int
+	FeeCents    int
+	NetCents    int
+}
+
+// LedgerPayment is a local payments row in reconciliation scope
+type LedgerPayment struct {
+	ID          int
+	ChargeID    string
+	AmountCents int
+	// OnDate is false for rows pulled in only because Stripe reported their
+	// charge today; they aren't expected to appear in today's Stripe activity
+	OnDate bool
+}
+
+type PaymentReconciliation struct {
+	ID               int                  `json:"id"`
+	Date             string               `json:"date"`
+	Status           string               `json:"status"` // balanced, mismatched, failed
+	LocalTotal       float64              `json:"local_total"`
+	StripeGross      float64              `json:"stripe_gross"`
+	StripeFees       float64              `json:"stripe_fees"`
+	StripeNet        float64              `json:"stripe_net"`
+	Refunds          float64              `json:"refunds"`
+	Payouts          float64              `json:"payouts"`
+	MismatchCount    int                  `json:"mismatch_count"`
+	Error            *string              `json:"error,omitempty"`
+	Items            []ReconciliationItem `json:"items"`
+	CreatedAt        time.Time            `json:"created_at"`
+	localTotalCents  int
+	stripeGrossCents int
+	stripeFeeCents   int
+	stripeNetCents   int
+	refundCents      int
+	payoutCents      int
+	matchedFees      map[int]StripeLedgerEntry
+}
+
+type ReconciliationItem struct {
+	PaymentID                  *int     `json:"payment_id,omitempty"`
+	StripeBalanceTransactionID *string  `json:"stripe_balance_transaction_id,omitempty"`
+	StripeChargeID             *string  `json:"stripe_charge_id,omitempty"`
+	Issue                      string   `json:"issue"`
+	LocalAmount                *float64 `json:"local_amount,omitempty"`
+	StripeAmount               *float64 `json:"stripe_amount,omitempty"`
+}
+
+// listStripeLedgerEntries pages through Stripe balance transactions created in [start, end)
+func listStripeLedgerEntries(start, end time.Time) ([]StripeLedgerEntry, error) {
+	params := &stripe.BalanceTransactionListParams{
+		CreatedRange: &stripe.RangeQueryParams{
+			GreaterThanOrEqual: start.Unix(),
+			LesserThan:         end.Unix(),
+		},
+	}
+	params.Limit = stripe.Int64(100)
+
+	var entries []StripeLedgerEntry
+	i := balancetransaction.List(params)
+	for i.Next() {
+		bt := i.BalanceTransaction()
+		entry := StripeLedgerEntry{
+			ID:          bt.ID,
+			Type:        string(bt.Type),
+			AmountCents: int(bt.Amount),
+			FeeCents:    int(bt.Fee),
+			NetCents:    int(bt.Net),
+		}
+		if bt.Source != nil {
+			entry.SourceID = bt.Source.ID
+		}
+		entries = append(entries, entry)
+	}
+	return entries, i.Err()
+}
+
+// reconcileLedger compares local payments with Stripe balance transactions
+// and totals fees, refunds and payouts. Charges are matched on charge ID.
+func reconcileLedger(payments []LedgerPayment, entries []StripeLedgerEntry) *PaymentReconciliation {
+	rec := &PaymentReconciliation{
+		Items:       []ReconciliationItem{},
+		matchedFees: map[int]StripeLedgerEntry{},
+	}
+
+	byCharge := map[string]LedgerPayment{}
+	for _, p := range payments {
+		if p.OnDate {
+			rec.localTotalCents += p.AmountCents
+		}
+		if p.ChargeID != "" {
+			byCharge[p.ChargeID] = p
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, e := range entries {
+		rec.stripeFeeCents += e.FeeCents
+		rec.stripeNetCents += e.NetCents
+
+		switch e.Type {
+		case "charge", "payment":
+			rec.stripeGrossCents += e.AmountCents
+			entryID, chargeID, stripeAmount := e.ID, e.SourceID, centsToDollars(e.AmountCents)
+			p, ok := byCharge[e.SourceID]
+			if !ok {
+				rec.Items = append(rec.Items, ReconciliationItem{
+					StripeBalanceTransactionID: &entryID,
+					StripeChargeID:             &chargeID,
+					Issue:                      "missing_locally",
+					StripeAmount:               &stripeAmount,
+				})
+				continue
+			}
+			seen[e.SourceID] = true
+			rec.matchedFees[p.ID] = e
+			if p.AmountCents != e.AmountCents {
+				paymentID, localAmount := p.ID, centsToDollars(p.AmountCents)
+				rec.Items = append(rec.Items, ReconciliationItem{
+					PaymentID:                  &paymentID,
+					StripeBalanceTransactionID: &entryID,
+					StripeChargeID:             &chargeID,
+					Issue:                      "amount_mismatch",
+					LocalAmount:                &localAmount,
+					StripeAmount:               &stripeAmount,
+				})
+			}
+		case "refund", "payment_refund":
+			rec.refundCents -= e.AmountCents
+		case "payout":
+			rec.payoutCents -= e.AmountCents
+		}
+	}
+
+	for _, p := range payments {
+		if !p.OnDate || seen[p.ChargeID] {
+			continue
+		}
+		paymentID, localAmount := p.ID, centsToDollars(p.AmountCents)
+		item := ReconciliationItem{
+			PaymentID:   &paymentID,
+			Issue:       "missing_in_stripe",
+			LocalAmount: &localAmount,
+		}
+		if p.ChargeID != "" {
+			chargeID := p.ChargeID
+			item.StripeChargeID = &chargeID
+		}
+		rec.Items = append(rec.Items, item)
+	}
+
+	rec.MismatchCount = len(rec.Items)
+	rec.Status = "balanced"
+	if rec.MismatchCount > 0 {
+		rec.Status = "mismatched"
+	}
+	rec.LocalTotal = centsToDollars(rec.localTotalCents)
+	rec.StripeGross = centsToDollars(rec.stripeGrossCents)
+	rec.StripeFees = centsToDollars(rec.stripeFeeCents)
+	rec.StripeNet = centsToDollars(rec.stripeNetCents)
+	rec.Refunds = centsToDollars(rec.refundCents)
+	rec.Payouts = centsToDollars(rec.payoutCents)
+	return rec
+}
+
+// runPaymentReconciliation reconciles one UTC day and stores the result,
+// replacing any earlier run for the same date
+func runPaymentReconciliation(db *sql.DB, ledger func(start, end time.Time) ([]StripeLedgerEntry, error), date time.Time) (*PaymentReconciliation, error) {
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 1)
+
+	var rec *PaymentReconciliation
+	entries, err := ledger(start, end)
+	if err != nil {
+		message := err.Error()
+		rec = &PaymentReconciliation{Status: "failed", Error: &message, Items: []ReconciliationItem{}}
+	} else {
+		payments, err := loadLedgerPayments(db, start, end, entries)
+		if err != nil {
+			return nil, err
+		}
+		rec = reconcileLedger(payments, entries)
+	}
+	rec.Date = start.Format("2006-01-02")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM payment_reconciliations WHERE reconciliation_date = $1", rec.Date); err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(`
+		INSERT INTO payment_reconciliations (
+			reconciliation_date, status, local_total_cents, stripe_gross_cents, stripe_fee_cents,
+			stripe_net_cents, refund_cents, payout_cents, mismatch_count, error
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, created_at`,
+		rec.Date, rec.Status, rec.localTotalCents, rec.stripeGrossCents, rec.stripeFeeCents,
+		rec.stripeNetCents, rec.refundCents, rec.payoutCents, rec.MismatchCount, rec.Error,
+	).Scan(&rec.ID, &rec.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range rec.Items {
+		var localCents, stripeCents *int
+		if item.LocalAmount != nil {
+			cents := dollarsToCents(*item.LocalAmount)
+			localCents = &cents
+		}
+		if item.StripeAmount != nil {
+			cents := dollarsToCents(*item.StripeAmount)
+			stripeCents = &cents
+		}
+		_, err := tx.Exec(`
+			INSERT INTO payment_reconciliation_items (
+				reconciliation_id, payment_id, stripe_balance_transaction_id, stripe_charge_id,
+				issue, local_amount_cents, stripe_amount_cents
+			) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			rec.ID, item.PaymentID, item.StripeBalanceTransactionID, item.StripeChargeID,
+			item.Issue, localCents, stripeCents,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Copy Stripe's fee and balance transaction onto matched payments so the
+	// local ledger carries net amounts
+	for paymentID, entry := range rec.matchedFees {
+		_, err := tx.Exec(`
+			UPDATE payments SET stripe_balance_transaction_id = $1, stripe_fee_cents = $2
+			WHERE id = $3`,
+			entry.ID, entry.FeeCents, paymentID,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// loadLedgerPayments returns completed payments created in [start, end) plus
+// any older payments whose charges Stripe reported in the window. Sandbox
+// payments never went through Stripe and are left out.
+func loadLedgerPayments(db *sql.DB, start, end time.Time, entries []StripeLedgerEntry) ([]LedgerPayment, error) {
+	chargeIDs := []string{}
+	for _, e := range entries {
+		if e.SourceID != "" {
+			chargeIDs = append(chargeIDs, e.SourceID)
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT id, COALESCE(stripe_charge_id, ''), amount_cents, created_at >= $1 AND created_at < $2
+		FROM payments
+		WHERE ((status IN ('completed', 'partially_refunded', 'refunded') AND created_at >= $1 AND created_at < $2)
+		   OR stripe_charge_id = ANY($3))
+		  AND COALESCE(stripe_payment_intent_id, '') NOT LIKE $4 || '%'`,
+		start, end, pq.Array(chargeIDs), sandboxPaymentPrefix,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []LedgerPayment
+	for rows.Next() {
+		var p LedgerPayment
+		if err := rows.Scan(&p.ID, &p.ChargeID, &p.AmountCents, &p.OnDate); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// processPaymentReconciliation reconciles the previous UTC day
+func (s *AutoScheduler) processPaymentReconciliation() {
+	date := time.Now().UTC().AddDate(0, 0, -1)
+	log.Printf("Reconciling payments for %s...", date.Format("2006-01-02"))
+
+	rec, err := runPaymentReconciliation(s.db, listStripeLedgerEntries, date)
+	if err != nil {
+		log.Printf("Error reconciling payments: %v", err)
+		return
+	}
+	if rec.Status != "balanced" {
+		log.Printf("Payment reconciliation for %s is %s with %d mismatches", rec.Date, rec.Status, rec.MismatchCount)
+		logAdminAlert(s.db, AdminAlert{
+			Type:      "payment_reconciliation",
+			Severity:  "warning",
+			Title:     fmt.Sprintf("Payments for %s don't reconcile", rec.Date),
+			Message:   fmt.Sprintf("Reconciliation is %s with %d mismatches", rec.Status, rec.MismatchCount),
+			DedupeKey: "payment_reconciliation:" + rec.Date,
+		})
+		return
+	}
+	log.Printf("Payment reconciliation for %s balanced", rec.Date)
+}
+
+// handleGetReconciliation returns the reconciliation for ?date=YYYY-MM-DD
+// (default yesterday). It is computed on demand if the job hasn't run yet,
+// and ?refresh=true forces a re-run.
+func (h *ReconciliationHandler) handleGetReconciliation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	date := time.Now().UTC().AddDate(0, 0, -1)
+	if d := r.URL.Query().Get("date"); d != "" {
+		parsed, err := time.Parse("2006-01-02", d)
+		if err != nil {
+			http.Error(w, "Invalid date format, use YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		date = parsed
+	}
+	if date.After(time.Now().UTC()) {
+		http.Error(w, "Cannot reconcile a future date", http.StatusBadRequest)
+		return
+	}
+
+	rec, err := h.getReconciliation(date.Format("2006-01-02"))
+	if err != nil {
+		http.Error(w, "Failed to fetch reconciliation", http.StatusInternalServerError)
+		return
+	}
+	if rec == nil || r.URL.Query().Get("refresh") == "true" {
+		if rec, err = runPaymentReconciliation(h.db, h.ledger, date); err != nil {
+			log.Printf("Error reconciling payments for %s: %v", date.Format("2006-01-02"), err)
+			http.Error(w, "Failed to run reconciliation", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// getReconciliation loads a stored reconciliation, or nil if none exists
+func (h *ReconciliationHandler) getReconciliation(date string) (*PaymentReconciliation, error) {
+	var rec PaymentReconciliation
+	var reconciliationDate time.Time
+	var localCents, grossCents, feeCents, netCents, refundCents, payoutCents int
+	err := h.db.QueryRow(`
+		SELECT id, reconciliation_date, status, local_total_cents, stripe_gross_cents, stripe_fee_cents,
+		       stripe_net_cents, refund_cents, payout_cents, mismatch_count, error, created_at
+		FROM payment_reconciliations
+		WHERE reconciliation_date = $1`,
+		date,
+	).Scan(&rec.ID, &reconciliationDate, &rec.Status, &localCents, &grossCents, &feeCents,
+		&netCents, &refundCents, &payoutCents, &rec.MismatchCount, &rec.Error, &rec.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rec.Date = reconciliationDate.Format("2006-01-02")
+	rec.LocalTotal = centsToDollars(localCents)
+	rec.StripeGross = centsToDollars(grossCents)
+	rec.StripeFees = centsToDollars(feeCents)
+	rec.StripeNet = centsToDollars(netCents)
+	rec.Refunds = centsToDollars(refundCents)
+	rec.Payouts = centsToDollars(payoutCents)
+
+	rows, err := h.db.Query(`
+		SELECT payment_id, stripe_balance_transaction_id, stripe_charge_id, issue, local_amount_cents, stripe_amount_cents
+		FROM payment_reconciliation_items
+		WHERE reconciliation_id = $1
+		ORDER BY id`,
+		rec.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rec.Items = []ReconciliationItem{}
+	for rows.Next() {
+		var item ReconciliationItem
+		var localAmount, stripeAmount sql.NullInt64
+		err := rows.Scan(&item.PaymentID, &item.StripeBalanceTransactionID, &item.StripeChargeID,
+			&item.Issue, &localAmount, &stripeAmount)
+		if err != nil {
+			return nil, err
+		}
+		if localAmount.Valid {
+			amount := centsToDollars(int(localAmount.Int64))
+			item.LocalAmount = &amount
+		}
+		if stripeAmount.Valid {
+			amount := centsToDollars(int(stripeAmount.Int64))
+			item.StripeAmount = &amount
+		}
+		rec.Items = append(rec.Items, item)
+	}
+
+	return &rec, nil
+}
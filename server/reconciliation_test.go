@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReconcileLedger(t *testing.T) {
+	payments := []LedgerPayment{
+		{ID: 1, ChargeID: "ch_match", AmountCents: 5000, OnDate: true},
+		{ID: 2, ChargeID: "ch_wrong_amount", AmountCents: 3000, OnDate: true},
+		{ID: 3, ChargeID: "ch_not_in_stripe", AmountCents: 2000, OnDate: true},
+		{ID: 4, ChargeID: "ch_yesterday", AmountCents: 1000, OnDate: false},
+	}
+	entries := []StripeLedgerEntry{
+		{ID: "txn_1", Type: "charge", SourceID: "ch_match", AmountCents: 5000, FeeCents: 175, NetCents: 4825},
+		{ID: "txn_2", Type: "charge", SourceID: "ch_wrong_amount", AmountCents: 3250, FeeCents: 124, NetCents: 3126},
+		{ID: "txn_3", Type: "charge", SourceID: "ch_yesterday", AmountCents: 1000, FeeCents: 59, NetCents: 941},
+		{ID: "txn_4", Type: "charge", SourceID: "ch_unknown", AmountCents: 800, FeeCents: 53, NetCents: 747},
+		{ID: "txn_5", Type: "refund", SourceID: "re_1", AmountCents: -500, NetCents: -500},
+		{ID: "txn_6", Type: "payout", SourceID: "po_1", AmountCents: -9000, NetCents: -9000},
+	}
+
+	rec := reconcileLedger(payments, entries)
+
+	issues := map[string]int{}
+	for _, item := range rec.Items {
+		issues[item.Issue]++
+	}
+	if issues["amount_mismatch"] != 1 || issues["missing_in_stripe"] != 1 || issues["missing_locally"] != 1 {
+		t.Errorf("Unexpected issues: %v", issues)
+	}
+	if rec.Status != "mismatched" || rec.MismatchCount != 3 {
+		t.Errorf("Expected mismatched with 3 issues, got %s with %d", rec.Status, rec.MismatchCount)
+	}
+
+	if rec.LocalTotal != 100.00 {
+		t.Errorf("Expected local total 100.00, got %.2f", rec.LocalTotal)
+	}
+	if rec.StripeGross != 100.50 {
+		t.Errorf("Expected Stripe gross 100.50, got %.2f", rec.StripeGross)
+	}
+	if rec.StripeFees != 4.11 {
+		t.Errorf("Expected fees 4.11, got %.2f", rec.StripeFees)
+	}
+	if rec.Refunds != 5.00 || rec.Payouts != 90.00 {
+		t.Errorf("Expected refunds 5.00 and payouts 90.00, got %.2f and %.2f", rec.Refunds, rec.Payouts)
+	}
+	if len(rec.matchedFees) != 3 {
+		t.Errorf("Expected fees recorded for 3 matched payments, got %d", len(rec.matchedFees))
+	}
+}
+
+func TestReconcileLedger_Balanced(t *testing.T) {
+	rec := reconcileLedger(
+		[]LedgerPayment{{ID: 1, ChargeID: "ch_1", AmountCents: 2500, OnDate: true}},
+		[]StripeLedgerEntry{{ID: "txn_1", Type: "charge", SourceID: "ch_1", AmountCents: 2500, FeeCents: 103, NetCents: 2397}},
+	)
+
+	if rec.Status != "balanced" || len(rec.Items) != 0 {
+		t.Errorf("Expected balanced reconciliation, got %s with %+v", rec.Status, rec.Items)
+	}
+}
+
+func TestReconciliationHandler_GetReconciliation(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "payer@example.com", "Payer", "User")
+	date := time.Now().UTC().AddDate(0, 0, -1)
+
+	var paymentID int
+	err := db.QueryRow(`
+		INSERT INTO payments (user_id, amount_cents, payment_type, status, stripe_charge_id, created_at)
+		VALUES ($1, 4800, 'subscription', 'completed', 'ch_test', $2)
+		RETURNING id`,
+		userID, date,
+	).Scan(&paymentID)
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	handler := NewReconciliationHandler(db.DB)
+	handler.ledger = func(start, end time.Time) ([]StripeLedgerEntry, error) {
+		return []StripeLedgerEntry{
+			{ID: "txn_test", Type: "charge", SourceID: "ch_test", AmountCents: 4800, FeeCents: 169, NetCents: 4631},
+		}, nil
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/admin/finance/reconciliation?date="+date.Format("2006-01-02"), nil)
+	w := httptest.NewRecorder()
+	handler.handleGetReconciliation(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var rec PaymentReconciliation
+	if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if rec.Status != "balanced" || rec.StripeFees != 1.69 {
+		t.Errorf("Expected balanced reconciliation with 1.69 fees, got %+v", rec)
+	}
+
+	var feeCents int
+	db.QueryRow("SELECT stripe_fee_cents FROM payments WHERE id = $1", paymentID).Scan(&feeCents)
+	if feeCents != 169 {
+		t.Errorf("Expected fee to be recorded on payment, got %d", feeCents)
+	}
+
+	// Invalid dates are rejected
+	req = httptest.NewRequest("GET", "/api/v1/admin/finance/reconciliation?date=yesterday", nil)
+	w = httptest.NewRecorder()
+	handler.handleGetReconciliation(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// The recovery runbook, as endpoints: pause order intake, drain a market's
+// routes, re-drive the queues that backed up during an outage, and snapshot
+// the state of things for the postmortem. They all require recovery.manage
+// and are writes, so each run lands in the audit log with what it did.
+
+// defaultRedriveWindow is how far back a re-drive reaches when it isn't told
+const defaultRedriveWindow = 24 * time.Hour
+
+// redriveQueues are the queues a re-drive can replay
+var redriveQueues = []string{"webhooks", "push", "stripe"}
+
+type RecoveryHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+	// payments applies replayed Stripe events
+	payments *PaymentHandler
+	// degradation reports Redis-backed features on their fallback in
+	// snapshots; nil leaves them out
+	degradation *RedisDegradation
+}
+
+func NewRecoveryHandler(db *sql.DB, payments *PaymentHandler, degradation *RedisDegradation) *RecoveryHandler {
+	return &RecoveryHandler{
+		db:          db,
+		getUserID:   getUserIDFromRequest,
+		payments:    payments,
+		degradation: degradation,
+	}
+}
+
+// IntakePause is a stop on new orders, everywhere or in one market
+type IntakePause struct {
+	ID         int        `json:"id"`
+	MarketID   *int       `json:"market_id,omitempty"` // Unset for everywhere
+	MarketName *string    `json:"market_name,omitempty"`
+	Reason     string     `json:"reason"`
+	PausedBy   *int       `json:"paused_by,omitempty"`
+	PausedAt   time.Time  `json:"paused_at"`
+	ResumedBy  *int       `json:"resumed_by,omitempty"`
+	ResumedAt  *time.Time `json:"resumed_at,omitempty"`
+}
+
+const intakePauseColumns = `
+	p.id, p.market_id, (SELECT name FROM markets WHERE id = p.market_id), p.reason,
+	p.paused_by, p.paused_at, p.resumed_by, p.resumed_at`
+
+func scanIntakePause(scanner interface{ Scan(...interface{}) error }) (IntakePause, error) {
+	var p IntakePause
+	err := scanner.Scan(&p.ID, &p.MarketID, &p.MarketName, &p.Reason, &p.PausedBy, &p.PausedAt, &p.ResumedBy, &p.ResumedAt)
+	return p, err
+}
+
+// activeIntakePause returns the open pause covering the market, preferring
+// one for everywhere, or nil when orders are being taken. A nil market is
+// only covered by a pause for everywhere.
+func activeIntakePause(q queryRower, marketID *int) (*IntakePause, error) {
+	pause, err := scanIntakePause(q.QueryRow(`
+		SELECT `+intakePauseColumns+`
+		FROM intake_pauses p
+		WHERE p.resumed_at IS NULL AND (p.market_id IS NULL OR p.market_id = $1)
+		ORDER BY p.market_id NULLS FIRST
+		LIMIT 1`,
+		marketID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pause, nil
+}
+
+// intakePauseForAddress returns the open pause covering orders picked up
+// at the address
+func intakePauseForAddress(q queryRower, addressID int) (*IntakePause, error) {
+	var zipCode string
+	if err := q.QueryRow("SELECT zip_code FROM addresses WHERE id = $1", addressID).Scan(&zipCode); err != nil {
+		return nil, err
+	}
+	marketID, err := marketIDForZip(q, zipCode)
+	if err != nil {
+		return nil, err
+	}
+	return activeIntakePause(q, marketID)
+}
+
+// handleGetIntakePauses lists the open pauses
+func (h *RecoveryHandler) handleGetIntakePauses(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT ` + intakePauseColumns + `
+		FROM intake_pauses p
+		WHERE p.resumed_at IS NULL
+		ORDER BY p.paused_at`)
+	if err != nil {
+		http.Error(w, "Failed to fetch intake pauses", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	pauses := []IntakePause{}
+	for rows.Next() {
+		pause, err := scanIntakePause(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse intake pauses", http.StatusInternalServerError)
+			return
+		}
+		pauses = append(pauses, pause)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pauses)
+}
+
+type IntakePauseRequest struct {
+	Market string `json:"market,omitempty"` // Slug or ID; empty pauses everywhere
+	Reason string `json:"reason"`
+}
+
+// handlePauseIntake stops new orders until the pause is resumed. Customers
+// placing one are told to try again later, and auto-scheduling skips them.
+func (h *RecoveryHandler) handlePauseIntake(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req IntakePauseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+	var marketID *int
+	if req.Market != "" {
+		id, err := marketIDBySelector(h.db, req.Market)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Unknown market %q", req.Market), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to look up market", http.StatusInternalServerError)
+			return
+		}
+		marketID = &id
+	}
+
+	pause, err := scanIntakePause(h.db.QueryRow(`
+		WITH p AS (
+			INSERT INTO intake_pauses (market_id, reason, paused_by) VALUES ($1, $2, $3)
+			RETURNING *
+		)
+		SELECT `+intakePauseColumns+` FROM p`,
+		marketID, req.Reason, adminID,
+	))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "Intake is already paused there", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to pause intake", http.StatusInternalServerError)
+		return
+	}
+
+	where := "everywhere"
+	if pause.MarketName != nil {
+		where = "in " + *pause.MarketName
+	}
+	logAdminAlert(h.db, AdminAlert{
+		Type:      "intake_paused",
+		Severity:  "critical",
+		Title:     "Order intake paused " + where,
+		Message:   fmt.Sprintf("New orders aren't being taken %s: %s", where, pause.Reason),
+		DedupeKey: fmt.Sprintf("intake_paused:%d", pause.ID),
+		Data:      pause,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pause)
+}
+
+// handleResumeIntake closes a pause so orders are taken again
+func (h *RecoveryHandler) handleResumeIntake(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	pauseID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid pause ID", http.StatusBadRequest)
+		return
+	}
+
+	pause, err := scanIntakePause(h.db.QueryRow(`
+		WITH p AS (
+			UPDATE intake_pauses SET resumed_by = $2, resumed_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND resumed_at IS NULL
+			RETURNING *
+		)
+		SELECT `+intakePauseColumns+` FROM p`,
+		pauseID, adminID,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "No open intake pause with that ID", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to resume intake", http.StatusInternalServerError)
+		return
+	}
+	h.db.Exec(`
+		UPDATE admin_inbox_items SET status = 'resolved', resolved_by = $2, resolved_at = CURRENT_TIMESTAMP,
+			resolution_note = 'Intake resumed', updated_at = CURRENT_TIMESTAMP
+		WHERE dedupe_key = $1 AND status <> 'resolved'`,
+		fmt.Sprintf("intake_paused:%d", pause.ID), adminID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pause)
+}
+
+type DrainMarketRequest struct {
+	Date   string `json:"date,omitempty"` // YYYY-MM-DD; defaults to today
+	Reason string `json:"reason"`
+	// Confirm must repeat the market's slug, so a drain isn't run on the
+	// wrong market by a slip
+	Confirm string `json:"confirm"`
+}
+
+type DrainMarketResponse struct {
+	Market          string `json:"market"`
+	Date            string `json:"date"`
+	ReleasedOrders  []int  `json:"released_orders"`
+	CancelledRoutes []int  `json:"cancelled_routes"`
+	// TrimmedRoutes are under way or have stops elsewhere, and keep the
+	// stops that weren't released
+	TrimmedRoutes []int `json:"trimmed_routes"`
+}
+
+// handleDrainMarket takes a market's unfinished stops on a day off their
+// routes, so the orders can be routed again once the market's back. Routes
+// left with no stops that haven't started are cancelled; drivers already out
+// keep the stops they've finished.
+func (h *RecoveryHandler) handleDrainMarket(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req DrainMarketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+	date := req.Date
+	if date == "" {
+		// Routes are dated by the database's clock
+		if err := h.db.QueryRow("SELECT CURRENT_DATE::text").Scan(&date); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	} else if _, err := time.Parse("2006-01-02", date); err != nil {
+		http.Error(w, "Invalid date", http.StatusBadRequest)
+		return
+	}
+
+	var marketID int
+	var slug string
+	err = h.db.QueryRow("SELECT id, slug FROM markets WHERE slug = $1 OR id::text = $1", mux.Vars(r)["market"]).Scan(&marketID, &slug)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Market not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to look up market", http.StatusInternalServerError)
+		return
+	}
+	if req.Confirm != slug {
+		http.Error(w, fmt.Sprintf("confirm must be %q to drain this market", slug), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// A pickup stop is at the order's pickup address and a delivery stop at
+	// its delivery address, as for weather
+	rows, err := tx.Query(`
+		SELECT ro.id, ro.route_id, o.id, o.status FROM route_orders ro
+		JOIN driver_routes dr ON dr.id = ro.route_id
+		JOIN orders o ON o.id = ro.order_id
+		JOIN addresses a ON a.id = CASE WHEN dr.route_type = 'pickup' THEN o.pickup_address_id
+			ELSE COALESCE(o.delivery_address_id, o.pickup_address_id) END
+		JOIN market_zip_prefixes mz ON mz.zip_prefix = LEFT(a.zip_code, 3)
+		WHERE mz.market_id = $1 AND dr.route_date = $2 AND dr.status <> ALL($3) AND ro.status = 'pending'
+		ORDER BY ro.route_id, ro.sequence_number
+		FOR UPDATE OF ro`,
+		marketID, date, pq.Array(closedRouteStatuses),
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch route stops", http.StatusInternalServerError)
+		return
+	}
+	type stop struct {
+		id, routeID, orderID int
+		status               string
+	}
+	var stops []stop
+	stopIDs := []int{}
+	routeIDs := []int{}
+	for rows.Next() {
+		var s stop
+		if err := rows.Scan(&s.id, &s.routeID, &s.orderID, &s.status); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to fetch route stops", http.StatusInternalServerError)
+			return
+		}
+		stops = append(stops, s)
+		stopIDs = append(stopIDs, s.id)
+		if len(routeIDs) == 0 || routeIDs[len(routeIDs)-1] != s.routeID {
+			routeIDs = append(routeIDs, s.routeID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to fetch route stops", http.StatusInternalServerError)
+		return
+	}
+	if len(stops) == 0 {
+		http.Error(w, "No unfinished stops in this market on "+date, http.StatusConflict)
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM route_orders WHERE id = ANY($1)", pq.Array(stopIDs)); err != nil {
+		http.Error(w, "Failed to release route stops", http.StatusInternalServerError)
+		return
+	}
+	resp := DrainMarketResponse{Market: slug, Date: date, ReleasedOrders: []int{}, CancelledRoutes: []int{}, TrimmedRoutes: []int{}}
+	for _, s := range stops {
+		_, err := tx.Exec(`
+			INSERT INTO order_status_history (order_id, status, notes, updated_by)
+			VALUES ($1, $2, $3, $4)`,
+			s.orderID, s.status, fmt.Sprintf("Taken off route %d while draining %s: %s", s.routeID, slug, req.Reason), adminID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to record order history", http.StatusInternalServerError)
+			return
+		}
+		resp.ReleasedOrders = append(resp.ReleasedOrders, s.orderID)
+	}
+
+	rows, err = tx.Query(`
+		UPDATE driver_routes dr SET status = 'cancelled'
+		WHERE dr.id = ANY($1) AND dr.status = 'planned'
+		  AND NOT EXISTS (SELECT 1 FROM route_orders WHERE route_id = dr.id)
+		RETURNING dr.id`,
+		pq.Array(routeIDs),
+	)
+	if err != nil {
+		http.Error(w, "Failed to cancel routes", http.StatusInternalServerError)
+		return
+	}
+	cancelled := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to cancel routes", http.StatusInternalServerError)
+			return
+		}
+		cancelled[id] = true
+	}
+	rows.Close()
+	for _, id := range routeIDs {
+		if cancelled[id] {
+			resp.CancelledRoutes = append(resp.CancelledRoutes, id)
+		} else {
+			resp.TrimmedRoutes = append(resp.TrimmedRoutes, id)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to drain market", http.StatusInternalServerError)
+		return
+	}
+	setAuditChange(r, nil, resp)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type RedriveRequest struct {
+	Queues []string `json:"queues,omitempty"` // webhooks, push and stripe; empty is all three
+	Since  string   `json:"since,omitempty"`  // RFC 3339; defaults to a day ago
+}
+
+// QueueRedrive is what a re-drive did to one queue
+type QueueRedrive struct {
+	Queue string `json:"queue"`
+	// Requeued is how many deliveries are due again, or for Stripe how many
+	// events were applied
+	Requeued int `json:"requeued"`
+	// StillFailing is how many Stripe events failed again
+	StillFailing int `json:"still_failing,omitempty"`
+}
+
+// handleRedriveQueues replays what backed up during an outage. Failed and
+// backed-off partner webhooks and pushes since then are made due now with
+// their attempts reset, and the dispatchers pick them up on their next run;
+// failed Stripe events are applied again here. Driver arrival pushes are
+// left alone since they're stale by now.
+func (h *RecoveryHandler) handleRedriveQueues(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req RedriveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	since := time.Now().Add(-defaultRedriveWindow)
+	if req.Since != "" {
+		since, err = time.Parse(time.RFC3339, req.Since)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	queues := req.Queues
+	if len(queues) == 0 {
+		queues = redriveQueues
+	}
+	for _, queue := range queues {
+		if !containsString(redriveQueues, queue) {
+			http.Error(w, fmt.Sprintf("Unknown queue %q; queues are %s", queue, strings.Join(redriveQueues, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := []QueueRedrive{}
+	for _, queue := range queues {
+		result := QueueRedrive{Queue: queue}
+		var res sql.Result
+		switch queue {
+		case "webhooks":
+			res, err = h.db.Exec(`
+				UPDATE webhook_deliveries d SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP
+				FROM webhook_endpoints e
+				WHERE e.id = d.endpoint_id AND e.is_active AND d.created_at >= $1
+				  AND (d.status = 'failed' OR (d.status = 'pending' AND d.next_attempt_at > CURRENT_TIMESTAMP))`,
+				since,
+			)
+		case "push":
+			res, err = h.db.Exec(`
+				UPDATE push_deliveries d SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP
+				FROM device_tokens t
+				WHERE t.id = d.device_token_id AND t.invalidated_at IS NULL AND d.created_at >= $1
+				  AND d.category <> $2
+				  AND (d.status = 'failed' OR (d.status = 'pending' AND d.next_attempt_at > CURRENT_TIMESTAMP))`,
+				since, pushDriverArrival,
+			)
+		case "stripe":
+			if h.payments == nil {
+				continue
+			}
+			result.Requeued, result.StillFailing, err = h.payments.replayStripeEvents(since, adminID)
+		}
+		if err != nil {
+			log.Printf("Error re-driving %s: %v", queue, err)
+			http.Error(w, "Failed to re-drive "+queue, http.StatusInternalServerError)
+			return
+		}
+		if res != nil {
+			n, _ := res.RowsAffected()
+			result.Requeued = int(n)
+		}
+		results = append(results, result)
+	}
+	setAuditChange(r, nil, results)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// QueueBacklog is how far behind one queue is
+type QueueBacklog struct {
+	Queue           string     `json:"queue"`
+	Pending         int        `json:"pending"`
+	Failed          int        `json:"failed"`
+	OldestPendingAt *time.Time `json:"oldest_pending_at,omitempty"`
+}
+
+// SnapshotRoute is one of the day's open routes and where it's got to
+type SnapshotRoute struct {
+	RouteID    int    `json:"route_id"`
+	RouteType  string `json:"route_type"`
+	Status     string `json:"status"`
+	DriverID   *int   `json:"driver_id,omitempty"`
+	DriverName string `json:"driver_name,omitempty"`
+	Pending    int    `json:"pending"`
+	Completed  int    `json:"completed"`
+	Failed     int    `json:"failed"`
+}
+
+// IncidentSnapshotData is the state of things when a snapshot was taken
+type IncidentSnapshotData struct {
+	TakenAt          time.Time         `json:"taken_at"`
+	IntakePauses     []IntakePause     `json:"intake_pauses"`
+	DegradedFeatures []DegradedFeature `json:"degraded_features"`
+	OpenOrders       map[string]int    `json:"open_orders"` // By status
+	OrdersLastHour   int               `json:"orders_last_hour"`
+	Routes           []SnapshotRoute   `json:"routes"`
+	Queues           []QueueBacklog    `json:"queues"`
+	OpenAlerts       map[string]int    `json:"open_alerts"` // Unresolved inbox items by severity
+}
+
+type IncidentSnapshot struct {
+	ID        int                   `json:"id"`
+	Incident  string                `json:"incident"`
+	Notes     *string               `json:"notes,omitempty"`
+	TakenBy   *int                  `json:"taken_by,omitempty"`
+	CreatedAt time.Time             `json:"created_at"`
+	Data      *IncidentSnapshotData `json:"data,omitempty"` // Left out of lists
+}
+
+// countsBy runs a query of key, count rows into a map
+func countsBy(q queryer, query string, args ...interface{}) (map[string]int, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var key string
+		var n int
+		if err := rows.Scan(&key, &n); err != nil {
+			return nil, err
+		}
+		counts[key] = n
+	}
+	return counts, rows.Err()
+}
+
+// takeIncidentSnapshot reads what ops wants to know during an incident:
+// what's paused or degraded, open orders, the day's routes, queue backlogs
+// and open alerts
+func (h *RecoveryHandler) takeIncidentSnapshot() (IncidentSnapshotData, error) {
+	data := IncidentSnapshotData{
+		TakenAt:          time.Now(),
+		IntakePauses:     []IntakePause{},
+		DegradedFeatures: h.degradation.Degraded(),
+		Routes:           []SnapshotRoute{},
+	}
+
+	rows, err := h.db.Query("SELECT " + intakePauseColumns + " FROM intake_pauses p WHERE p.resumed_at IS NULL ORDER BY p.paused_at")
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		pause, err := scanIntakePause(rows)
+		if err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.IntakePauses = append(data.IntakePauses, pause)
+	}
+	rows.Close()
+
+	data.OpenOrders, err = countsBy(h.db, "SELECT status, COUNT(*) FROM orders WHERE status NOT IN ('delivered', 'cancelled') GROUP BY status")
+	if err != nil {
+		return data, err
+	}
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM orders WHERE created_at >= CURRENT_TIMESTAMP - INTERVAL '1 hour'").Scan(&data.OrdersLastHour); err != nil {
+		return data, err
+	}
+
+	rows, err = h.db.Query(`
+		SELECT dr.id, dr.route_type, dr.status, dr.driver_id, COALESCE(u.first_name || ' ' || u.last_name, ''),
+			COUNT(ro.id) FILTER (WHERE ro.status = 'pending'),
+			COUNT(ro.id) FILTER (WHERE ro.status = 'completed'),
+			COUNT(ro.id) FILTER (WHERE ro.status = 'failed')
+		FROM driver_routes dr
+		LEFT JOIN users u ON u.id = dr.driver_id
+		LEFT JOIN route_orders ro ON ro.route_id = dr.id
+		WHERE dr.route_date = CURRENT_DATE AND dr.status <> ALL($1)
+		GROUP BY dr.id, u.first_name, u.last_name
+		ORDER BY dr.id`,
+		pq.Array(closedRouteStatuses),
+	)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var route SnapshotRoute
+		if err := rows.Scan(&route.RouteID, &route.RouteType, &route.Status, &route.DriverID, &route.DriverName,
+			&route.Pending, &route.Completed, &route.Failed); err != nil {
+			rows.Close()
+			return data, err
+		}
+		data.Routes = append(data.Routes, route)
+	}
+	rows.Close()
+
+	for _, queue := range []struct{ name, query string }{
+		{"webhooks", `
+			SELECT COUNT(*) FILTER (WHERE status = 'pending'), COUNT(*) FILTER (WHERE status = 'failed'),
+				MIN(created_at) FILTER (WHERE status = 'pending')
+			FROM webhook_deliveries`},
+		{"push", `
+			SELECT COUNT(*) FILTER (WHERE status = 'pending'), COUNT(*) FILTER (WHERE status = 'failed'),
+				MIN(created_at) FILTER (WHERE status = 'pending')
+			FROM push_deliveries`},
+		{"stripe", fmt.Sprintf(`
+			SELECT COUNT(*) FILTER (WHERE status = 'processing' AND updated_at >= CURRENT_TIMESTAMP - make_interval(secs => %[1]v)),
+				COUNT(*) FILTER (WHERE status = 'failed' OR (status = 'processing' AND updated_at < CURRENT_TIMESTAMP - make_interval(secs => %[1]v))),
+				MIN(received_at) FILTER (WHERE status = 'processing')
+			FROM processed_webhook_events`, stripeEventLease.Seconds())},
+	} {
+		backlog := QueueBacklog{Queue: queue.name}
+		if err := h.db.QueryRow(queue.query).Scan(&backlog.Pending, &backlog.Failed, &backlog.OldestPendingAt); err != nil {
+			return data, err
+		}
+		data.Queues = append(data.Queues, backlog)
+	}
+
+	data.OpenAlerts, err = countsBy(h.db, "SELECT severity, COUNT(*) FROM admin_inbox_items WHERE status <> 'resolved' GROUP BY severity")
+	return data, err
+}
+
+type IncidentSnapshotRequest struct {
+	Incident string `json:"incident"` // What's going on, e.g. a ticket or a short name
+	Notes    string `json:"notes,omitempty"`
+}
+
+// handleCreateIncidentSnapshot takes a snapshot and keeps it
+func (h *RecoveryHandler) handleCreateIncidentSnapshot(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req IncidentSnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Incident = strings.TrimSpace(req.Incident)
+	if req.Incident == "" || len(req.Incident) > 255 {
+		http.Error(w, "incident is required and at most 255 characters", http.StatusBadRequest)
+		return
+	}
+
+	data, err := h.takeIncidentSnapshot()
+	if err != nil {
+		log.Printf("Error taking incident snapshot: %v", err)
+		http.Error(w, "Failed to take snapshot", http.StatusInternalServerError)
+		return
+	}
+	encoded, _ := json.Marshal(data)
+
+	snapshot := IncidentSnapshot{Incident: req.Incident, TakenBy: &adminID, Data: &data}
+	if req.Notes != "" {
+		snapshot.Notes = &req.Notes
+	}
+	err = h.db.QueryRow(`
+		INSERT INTO incident_snapshots (incident, notes, data, taken_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`,
+		snapshot.Incident, snapshot.Notes, encoded, adminID,
+	).Scan(&snapshot.ID, &snapshot.CreatedAt)
+	if err != nil {
+		http.Error(w, "Failed to save snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// handleGetIncidentSnapshots lists snapshots newest first, without their
+// data
+func (h *RecoveryHandler) handleGetIncidentSnapshots(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT id, incident, notes, taken_by, created_at
+		FROM incident_snapshots
+		ORDER BY created_at DESC
+		LIMIT 100`)
+	if err != nil {
+		http.Error(w, "Failed to fetch snapshots", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	snapshots := []IncidentSnapshot{}
+	for rows.Next() {
+		var s IncidentSnapshot
+		if err := rows.Scan(&s.ID, &s.Incident, &s.Notes, &s.TakenBy, &s.CreatedAt); err != nil {
+			http.Error(w, "Failed to parse snapshots", http.StatusInternalServerError)
+			return
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+func (h *RecoveryHandler) handleGetIncidentSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshotID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid snapshot ID", http.StatusBadRequest)
+		return
+	}
+
+	var s IncidentSnapshot
+	var data []byte
+	err = h.db.QueryRow(`
+		SELECT id, incident, notes, taken_by, created_at, data
+		FROM incident_snapshots WHERE id = $1`,
+		snapshotID,
+	).Scan(&s.ID, &s.Incident, &s.Notes, &s.TakenBy, &s.CreatedAt, &data)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch snapshot", http.StatusInternalServerError)
+		return
+	}
+	s.Data = &IncidentSnapshotData{}
+	if err := json.Unmarshal(data, s.Data); err != nil {
+		http.Error(w, "Failed to parse snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRecoveryRunbook(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "recovery-admin@example.com", "Recovery", "Admin")
+	driverID := db.CreateTestUser(t, "recovery-driver@example.com", "Recovery", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "recovery-customer@example.com", "Recovery", "Customer")
+	addressID := db.CreateTestAddress(t, customerID) // ZIP 12345
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	var marketID, routeID int
+	db.QueryRow("INSERT INTO markets (slug, name) VALUES ('test-city', 'Test City') RETURNING id").Scan(&marketID)
+	db.Exec("INSERT INTO market_zip_prefixes (zip_prefix, market_id) VALUES ('123', $1)", marketID)
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'planned') RETURNING id`, driverID).Scan(&routeID)
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1)", routeID, orderID)
+
+	handler := &RecoveryHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	post := func(handle http.HandlerFunc, vars map[string]string, body interface{}) *httptest.ResponseRecorder {
+		encoded, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		handle(w, mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/admin/recovery", bytes.NewBuffer(encoded)), vars))
+		return w
+	}
+
+	// Pausing the market stops orders picked up there
+	w := post(handler.handlePauseIntake, nil, IntakePauseRequest{Market: "test-city", Reason: "Facility flooded"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var pause IntakePause
+	json.Unmarshal(w.Body.Bytes(), &pause)
+	if w := post(handler.handlePauseIntake, nil, IntakePauseRequest{Market: "test-city", Reason: "Again"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d pausing twice, got %d", http.StatusConflict, w.Code)
+	}
+	if active, err := intakePauseForAddress(db.DB, addressID); err != nil || active == nil || active.ID != pause.ID {
+		t.Errorf("Expected the pickup address covered by the pause, got %+v, %v", active, err)
+	}
+	if active, _ := activeIntakePause(db.DB, nil); active != nil {
+		t.Errorf("Expected addresses outside the market still taking orders, got %+v", active)
+	}
+	if w := post(handler.handleResumeIntake, map[string]string{"id": fmt.Sprint(pause.ID)}, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d resuming, got %d", http.StatusOK, w.Code)
+	}
+	if active, _ := intakePauseForAddress(db.DB, addressID); active != nil {
+		t.Errorf("Expected intake resumed, got %+v", active)
+	}
+
+	// Draining takes the market's stops off the day's routes
+	vars := map[string]string{"market": "test-city"}
+	if w := post(handler.handleDrainMarket, vars, DrainMarketRequest{Reason: "Facility flooded", Confirm: "other"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without the market confirmed, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = post(handler.handleDrainMarket, vars, DrainMarketRequest{Reason: "Facility flooded", Confirm: "test-city"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var drained DrainMarketResponse
+	json.Unmarshal(w.Body.Bytes(), &drained)
+	if len(drained.ReleasedOrders) != 1 || drained.ReleasedOrders[0] != orderID ||
+		len(drained.CancelledRoutes) != 1 || drained.CancelledRoutes[0] != routeID {
+		t.Errorf("Unexpected drain: %s", w.Body.String())
+	}
+	var stops int
+	db.QueryRow("SELECT COUNT(*) FROM route_orders WHERE order_id = $1", orderID).Scan(&stops)
+	if stops != 0 {
+		t.Errorf("Expected the order off its route, got %d stops", stops)
+	}
+
+	// A snapshot is kept with what was going on
+	w = post(handler.handleCreateIncidentSnapshot, nil, IncidentSnapshotRequest{Incident: "Flood"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var snapshot IncidentSnapshot
+	json.Unmarshal(w.Body.Bytes(), &snapshot)
+	if snapshot.Data == nil || snapshot.Data.OpenOrders["scheduled"] < 1 || len(snapshot.Data.Queues) != 3 {
+		t.Errorf("Unexpected snapshot: %s", w.Body.String())
+	}
+}
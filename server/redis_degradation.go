@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Redis backs rate limits, pickup slot holds and live driver locations, but
+// none of them is worth an outage. Each falls back when Redis errors (limits
+// fail open, holds are skipped, locations are read from Postgres) and reports
+// it here, so /readyz can say what's running degraded.
+
+const (
+	degradedRateLimits      = "rate_limits"
+	degradedSlotHolds       = "slot_holds"
+	degradedDriverLocations = "driver_locations"
+)
+
+// DegradedFeature is a Redis-backed feature running on its fallback
+type DegradedFeature struct {
+	Feature   string    `json:"feature"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error"`
+}
+
+// RedisDegradation tracks which features are currently on their fallback.
+// A nil RedisDegradation only logs.
+type RedisDegradation struct {
+	mu       sync.Mutex
+	features map[string]DegradedFeature
+}
+
+func NewRedisDegradation() *RedisDegradation {
+	return &RedisDegradation{features: map[string]DegradedFeature{}}
+}
+
+// Fail records that feature fell back because of err. Only the first failure
+// is logged, so an outage doesn't log once per request.
+func (d *RedisDegradation) Fail(feature string, err error) {
+	if d == nil {
+		log.Printf("Redis unavailable for %s, falling back: %v", feature, err)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	degraded, ok := d.features[feature]
+	if !ok {
+		log.Printf("Redis unavailable for %s, falling back: %v", feature, err)
+		degraded = DegradedFeature{Feature: feature, Since: time.Now()}
+	}
+	degraded.LastError = err.Error()
+	d.features[feature] = degraded
+}
+
+// Recover records that feature reached Redis again
+func (d *RedisDegradation) Recover(feature string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if degraded, ok := d.features[feature]; ok {
+		log.Printf("Redis is back for %s after %s", feature, time.Since(degraded.Since).Round(time.Second))
+		delete(d.features, feature)
+	}
+}
+
+// Degraded lists the features on their fallback, by name
+func (d *RedisDegradation) Degraded() []DegradedFeature {
+	features := []DegradedFeature{}
+	if d == nil {
+		return features
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, degraded := range d.features {
+		features = append(features, degraded)
+	}
+	sort.Slice(features, func(i, j int) bool { return features[i].Feature < features[j].Feature })
+	return features
+}
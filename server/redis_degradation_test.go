@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	up := func() error { return nil }
+	down := func() error { return errors.New("connection refused") }
+
+	degradation := NewRedisDegradation()
+	if ready, status := readiness(up, up, degradation); status != http.StatusOK || ready.Status != "ready" {
+		t.Errorf("Expected ready, got %d %+v", status, ready)
+	}
+
+	// Redis down leaves the server serving
+	ready, status := readiness(up, down, degradation)
+	if status != http.StatusOK || ready.Status != "degraded" || ready.Checks["redis"] != "unhealthy" {
+		t.Errorf("Expected degraded with Redis down, got %d %+v", status, ready)
+	}
+
+	// A feature still on its fallback keeps it degraded until it recovers
+	degradation.Fail(degradedRateLimits, errors.New("i/o timeout"))
+	degradation.Fail(degradedRateLimits, errors.New("connection refused"))
+	ready, _ = readiness(up, up, degradation)
+	if ready.Status != "degraded" || len(ready.Degraded) != 1 || ready.Degraded[0].LastError != "connection refused" {
+		t.Errorf("Expected rate limits degraded with the latest error, got %+v", ready)
+	}
+	degradation.Recover(degradedRateLimits)
+	if ready, _ := readiness(up, up, degradation); ready.Status != "ready" {
+		t.Errorf("Expected ready once rate limits recover, got %+v", ready)
+	}
+
+	if ready, status := readiness(down, up, degradation); status != http.StatusServiceUnavailable || ready.Status != "unavailable" {
+		t.Errorf("Expected unavailable without the database, got %d %+v", status, ready)
+	}
+}
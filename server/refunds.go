@@ -0,0 +1,429 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tumble-backend/money"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/checkout/session"
+	"github.com/stripe/stripe-go/v82/refund"
+)
+
+var (
+	errNoRefundablePayment = errors.New("order has no payment left to refund")
+	errRefundTooLarge      = errors.New("refund is larger than what is left on the payment")
+)
+
+type Refund struct {
+	ID             int       `json:"id"`
+	PaymentID      int       `json:"payment_id"`
+	OrderID        *int      `json:"order_id,omitempty"`
+	ResolutionID   *int      `json:"resolution_id,omitempty"`
+	Amount         float64   `json:"amount"`
+	Reason         string    `json:"reason"`
+	Status         string    `json:"status"`
+	StripeRefundID *string   `json:"stripe_refund_id,omitempty"`
+	FailureReason  *string   `json:"failure_reason,omitempty"`
+	CreatedBy      *int      `json:"created_by,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+type CreateRefundRequest struct {
+	// Amount in dollars; leave it out to refund everything that's left
+	Amount *float64 `json:"amount,omitempty"`
+	Reason string   `json:"reason"`
+	// LineKind and LineID refund one line of the order at the price it was
+	// sold for instead of an amount, e.g. a damaged garment. Quantity
+	// defaults to the whole line.
+	LineKind string `json:"line_kind,omitempty"`
+	LineID   int    `json:"line_id,omitempty"`
+	Quantity int    `json:"quantity,omitempty"`
+}
+
+const refundColumns = `id, payment_id, order_id, resolution_id, amount_cents, reason, status,
+	stripe_refund_id, failure_reason, created_by, created_at, updated_at`
+
+func scanRefund(row interface{ Scan(...interface{}) error }) (Refund, error) {
+	var rf Refund
+	var amountCents int
+	err := row.Scan(&rf.ID, &rf.PaymentID, &rf.OrderID, &rf.ResolutionID, &amountCents, &rf.Reason, &rf.Status,
+		&rf.StripeRefundID, &rf.FailureReason, &rf.CreatedBy, &rf.CreatedAt, &rf.UpdatedAt)
+	rf.Amount = centsToDollars(amountCents)
+	return rf, err
+}
+
+func getRefund(q queryRower, refundID int) (*Refund, error) {
+	rf, err := scanRefund(q.QueryRow("SELECT "+refundColumns+" FROM refunds WHERE id = $1", refundID))
+	if err != nil {
+		return nil, err
+	}
+	return &rf, nil
+}
+
+// reserveRefund records a pending refund of amountCents against the order's
+// payment with the most left to refund, or of everything left when
+// amountCents is 0. Pending refunds count against the balance, so two
+// admins can't refund the same money. It returns the refund's ID and amount.
+func reserveRefund(tx *sql.Tx, orderID, amountCents int, reason string, createdBy, resolutionID *int) (int, int, error) {
+	if _, err := tx.Exec("SELECT id FROM payments WHERE order_id = $1 FOR UPDATE", orderID); err != nil {
+		return 0, 0, err
+	}
+
+	var paymentID, userID, remaining int
+	err := tx.QueryRow(`
+		SELECT p.id, p.user_id, p.amount_cents - COALESCE((
+			SELECT SUM(r.amount_cents) FROM refunds r
+			WHERE r.payment_id = p.id AND r.status IN ('pending', 'requires_action', 'succeeded')
+		), 0) AS remaining
+		FROM payments p
+		WHERE p.order_id = $1 AND p.status IN ('completed', 'partially_refunded')
+		ORDER BY remaining DESC, p.created_at DESC
+		LIMIT 1`,
+		orderID,
+	).Scan(&paymentID, &userID, &remaining)
+	if err == sql.ErrNoRows || (err == nil && remaining <= 0) {
+		return 0, 0, errNoRefundablePayment
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if amountCents == 0 {
+		amountCents = remaining
+	}
+	if amountCents > remaining {
+		return 0, 0, errRefundTooLarge
+	}
+
+	var refundID int
+	err = tx.QueryRow(`
+		INSERT INTO refunds (payment_id, order_id, user_id, resolution_id, amount_cents, reason, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`,
+		paymentID, orderID, userID, resolutionID, amountCents, reason, createdBy,
+	).Scan(&refundID)
+	return refundID, amountCents, err
+}
+
+// stripePaymentIntentID returns the PaymentIntent behind a payment record.
+// Checkout payments are recorded under their Checkout Session, which only
+// has a PaymentIntent once the customer has paid.
+func stripePaymentIntentID(stored string) (string, error) {
+	if !strings.HasPrefix(stored, "cs_") {
+		return stored, nil
+	}
+	s, err := session.Get(stored, nil)
+	if err != nil {
+		return "", err
+	}
+	if s.PaymentIntent == nil {
+		return "", fmt.Errorf("checkout session %s was never paid", stored)
+	}
+	return s.PaymentIntent.ID, nil
+}
+
+// submitRefund sends a reserved refund to Stripe. The refund ID is the
+// idempotency key, so retrying a refund can't pay it out twice. A refund
+// Stripe rejects is marked failed and flagged for an admin; the returned
+// error only covers reading and writing the refund itself.
+func submitRefund(db *sql.DB, refundID int) (*Refund, error) {
+	var amountCents int
+	var orderID *int
+	var storedID sql.NullString
+	err := db.QueryRow(`
+		SELECT r.amount_cents, r.order_id, p.stripe_payment_intent_id
+		FROM refunds r
+		JOIN payments p ON r.payment_id = p.id
+		WHERE r.id = $1`,
+		refundID,
+	).Scan(&amountCents, &orderID, &storedID)
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := func() (*stripe.Refund, error) {
+		if !storedID.Valid || storedID.String == "" {
+			return nil, errors.New("payment has no Stripe payment intent")
+		}
+		if strings.HasPrefix(storedID.String, sandboxPaymentPrefix) {
+			return sandboxRefund(refundID, amountCents), nil
+		}
+		paymentIntentID, err := stripePaymentIntentID(storedID.String)
+		if err != nil {
+			return nil, err
+		}
+		params := &stripe.RefundParams{
+			PaymentIntent: stripe.String(paymentIntentID),
+			Amount:        stripe.Int64(int64(amountCents)),
+			Metadata:      map[string]string{"refund_id": strconv.Itoa(refundID)},
+		}
+		if orderID != nil {
+			params.Metadata["order_id"] = strconv.Itoa(*orderID)
+		}
+		params.SetIdempotencyKey(fmt.Sprintf("refund-%d", refundID))
+		return refund.New(params)
+	}()
+	if err != nil {
+		if _, dbErr := db.Exec(`
+			UPDATE refunds SET status = 'failed', failure_reason = $2, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1`,
+			refundID, err.Error(),
+		); dbErr != nil {
+			return nil, dbErr
+		}
+		logAdminAlert(db, AdminAlert{
+			Type:      "refund_failed",
+			Severity:  "warning",
+			Title:     "Refund could not be issued",
+			Message:   fmt.Sprintf("Refund #%d for %s failed: %v", refundID, money.Format(amountCents), err),
+			OrderID:   orderID,
+			DedupeKey: fmt.Sprintf("refund_failed:%d", refundID),
+		})
+		return getRefund(db, refundID)
+	}
+
+	if err := recordStripeRefund(db, re); err != nil {
+		return nil, err
+	}
+	return getRefund(db, refundID)
+}
+
+// recordStripeRefund saves a Stripe refund's latest status, matching it by
+// Stripe ID or by the refund_id we set in its metadata. Refunds made in the
+// Stripe dashboard are recorded against their payment when it's one of ours.
+func recordStripeRefund(db *sql.DB, re *stripe.Refund) error {
+	localID, _ := strconv.Atoi(re.Metadata["refund_id"])
+	var paymentID int
+	err := db.QueryRow(`
+		UPDATE refunds
+		SET stripe_refund_id = $1, status = $2, failure_reason = NULLIF($3, ''), updated_at = CURRENT_TIMESTAMP
+		WHERE stripe_refund_id = $1 OR (id = $4 AND stripe_refund_id IS NULL)
+		RETURNING payment_id`,
+		re.ID, string(re.Status), string(re.FailureReason), localID,
+	).Scan(&paymentID)
+	if err == sql.ErrNoRows {
+		var paymentIntentID, chargeID string
+		if re.PaymentIntent != nil {
+			paymentIntentID = re.PaymentIntent.ID
+		}
+		if re.Charge != nil {
+			chargeID = re.Charge.ID
+		}
+		reason := "Issued in Stripe"
+		if re.Reason != "" {
+			reason += ": " + strings.ReplaceAll(string(re.Reason), "_", " ")
+		}
+		err = db.QueryRow(`
+			INSERT INTO refunds (payment_id, order_id, user_id, amount_cents, reason, status, stripe_refund_id, failure_reason)
+			SELECT id, order_id, user_id, $3, $4, $5, $6, NULLIF($7, '')
+			FROM payments
+			WHERE (stripe_payment_intent_id = $1 AND $1 <> '') OR (stripe_charge_id = $2 AND $2 <> '')
+			ORDER BY created_at DESC
+			LIMIT 1
+			ON CONFLICT (stripe_refund_id) DO UPDATE SET status = EXCLUDED.status
+			RETURNING payment_id`,
+			paymentIntentID, chargeID, re.Amount, reason, string(re.Status), re.ID, string(re.FailureReason),
+		).Scan(&paymentID)
+	}
+	if err != nil {
+		return err
+	}
+	return syncPaymentRefundStatus(db, paymentID)
+}
+
+// syncPaymentRefundStatus marks a paid payment refunded or partially
+// refunded from the refunds that have gone through
+func syncPaymentRefundStatus(q execer, paymentID int) error {
+	_, err := q.Exec(`
+		UPDATE payments p
+		SET status = CASE
+			WHEN r.refunded >= p.amount_cents THEN 'refunded'
+			WHEN r.refunded > 0 THEN 'partially_refunded'
+			ELSE 'completed'
+		END
+		FROM (
+			SELECT COALESCE(SUM(amount_cents), 0) AS refunded
+			FROM refunds WHERE payment_id = $1 AND status = 'succeeded'
+		) r
+		WHERE p.id = $1 AND p.status IN ('completed', 'partially_refunded', 'refunded')`,
+		paymentID,
+	)
+	return err
+}
+
+// refundsForPayments returns the refunds on each of the given payments,
+// newest first
+func refundsForPayments(q *sql.DB, paymentIDs []int) (map[int][]Refund, error) {
+	rows, err := q.Query("SELECT "+refundColumns+" FROM refunds WHERE payment_id = ANY($1) ORDER BY created_at DESC, id DESC", pq.Array(paymentIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := make(map[int][]Refund)
+	for rows.Next() {
+		rf, err := scanRefund(rows)
+		if err != nil {
+			return nil, err
+		}
+		refunds[rf.PaymentID] = append(refunds[rf.PaymentID], rf)
+	}
+	return refunds, rows.Err()
+}
+
+// handleRefundUpdated keeps refunds in step with Stripe, which settles most
+// of them after the API call returns
+func (h *PaymentHandler) handleRefundUpdated(re *stripe.Refund) error {
+	if err := recordStripeRefund(h.db, re); err == sql.ErrNoRows {
+		log.Printf("Ignoring refund %s for a payment we don't have", re.ID)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to record refund %s: %v", re.ID, err)
+	}
+
+	if re.Status == stripe.RefundStatusFailed {
+		var refundID int
+		var orderID *int
+		h.db.QueryRow("SELECT id, order_id FROM refunds WHERE stripe_refund_id = $1", re.ID).Scan(&refundID, &orderID)
+		logAdminAlert(h.db, AdminAlert{
+			Type:      "refund_failed",
+			Severity:  "warning",
+			Title:     "Refund could not be issued",
+			Message:   fmt.Sprintf("Refund %s for %s failed: %s", re.ID, money.Format(int(re.Amount)), re.FailureReason),
+			OrderID:   orderID,
+			DedupeKey: fmt.Sprintf("refund_failed:%d", refundID),
+		})
+	}
+	return nil
+}
+
+// handleGetOrderRefunds returns every refund made on an order
+func (h *AdminHandler) handleGetOrderRefunds(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.db.Query("SELECT "+refundColumns+" FROM refunds WHERE order_id = $1 ORDER BY created_at DESC, id DESC", orderID)
+	if err != nil {
+		http.Error(w, "Failed to fetch refunds", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	refunds := []Refund{}
+	for rows.Next() {
+		rf, err := scanRefund(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch refunds", http.StatusInternalServerError)
+			return
+		}
+		refunds = append(refunds, rf)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refunds)
+}
+
+// handleCreateRefund refunds some or all of an order's payment outside of a
+// failed-order resolution, e.g. for a damaged garment
+func (h *AdminHandler) handleCreateRefund(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var req CreateRefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	amountCents := 0
+	if req.Amount != nil {
+		amountCents = dollarsToCents(*req.Amount)
+		if amountCents <= 0 {
+			http.Error(w, "amount must be positive", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.LineKind != "" {
+		if req.Amount != nil {
+			http.Error(w, "Give either an amount or a line, not both", http.StatusBadRequest)
+			return
+		}
+		pricing, err := getOrderPricingSnapshot(h.db, orderID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch order pricing", http.StatusInternalServerError)
+			return
+		}
+		if pricing == nil {
+			http.Error(w, errNoPricingSnapshot.Error()+"; refund an amount instead", http.StatusConflict)
+			return
+		}
+		line := pricing.line(req.LineKind, req.LineID)
+		if line == nil {
+			http.Error(w, "Line not found on this order", http.StatusBadRequest)
+			return
+		}
+		quantity := req.Quantity
+		if quantity == 0 {
+			quantity = line.Quantity
+		}
+		if quantity < 0 || quantity > line.Quantity {
+			http.Error(w, fmt.Sprintf("quantity must be between 1 and %d", line.Quantity), http.StatusBadRequest)
+			return
+		}
+		if amountCents = pricing.lineRefundCents(line, quantity); amountCents <= 0 {
+			http.Error(w, "That line wasn't charged for", http.StatusConflict)
+			return
+		}
+		req.Reason = fmt.Sprintf("%s (%d x %s)", req.Reason, quantity, line.Name)
+	}
+
+	rf, err := h.payments().RefundOrder(r.Context(), orderID, amountCents, req.Reason, &adminID)
+	if err != nil {
+		writeServiceError(w, err, "Failed to create refund")
+		return
+	}
+	if rf.Status == "failed" {
+		message := "Stripe could not issue the refund"
+		if rf.FailureReason != nil {
+			message += ": " + *rf.FailureReason
+		}
+		http.Error(w, message, http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rf)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+func TestRefundLedger(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "refund-admin@example.com", "Refund", "Admin")
+	customerID := db.CreateTestUser(t, "refund-customer@example.com", "Refund", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	unpaidOrderID := db.CreateTestOrder(t, customerID, addressID)
+
+	var paymentID int
+	db.QueryRow(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id, stripe_charge_id)
+		VALUES ($1, $2, 5000, 'extra_order', 'completed', 'pi_refund_test', 'ch_refund_test')
+		RETURNING id`,
+		customerID, orderID,
+	).Scan(&paymentID)
+
+	reserve := func(orderID, amountCents int) (int, int, error) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("Failed to begin transaction: %v", err)
+		}
+		defer tx.Rollback()
+		refundID, reserved, err := reserveRefund(tx, orderID, amountCents, "Torn shirt", &adminID, nil)
+		if err == nil {
+			tx.Commit()
+		}
+		return refundID, reserved, err
+	}
+	paymentStatus := func() string {
+		var status string
+		db.QueryRow("SELECT status FROM payments WHERE id = $1", paymentID).Scan(&status)
+		return status
+	}
+
+	if _, _, err := reserve(unpaidOrderID, 0); err != errNoRefundablePayment {
+		t.Errorf("Expected errNoRefundablePayment for an unpaid order, got %v", err)
+	}
+	if _, _, err := reserve(orderID, 6000); err != errRefundTooLarge {
+		t.Errorf("Expected errRefundTooLarge, got %v", err)
+	}
+
+	partialID, _, err := reserve(orderID, 2000)
+	if err != nil {
+		t.Fatalf("Failed to reserve refund: %v", err)
+	}
+
+	// Stripe reports the refund through a webhook, matched by our metadata
+	err = recordStripeRefund(db.DB, &stripe.Refund{
+		ID:       "re_partial",
+		Amount:   2000,
+		Status:   stripe.RefundStatusSucceeded,
+		Metadata: map[string]string{"refund_id": strconv.Itoa(partialID)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to record refund: %v", err)
+	}
+	if status := paymentStatus(); status != "partially_refunded" {
+		t.Errorf("Expected the payment to be partially refunded, got %s", status)
+	}
+
+	// A pending refund holds the rest, so nothing more can be reserved
+	restID, rest, err := reserve(orderID, 0)
+	if err != nil || rest != 3000 {
+		t.Fatalf("Expected to reserve the remaining 3000 cents, got %d: %v", rest, err)
+	}
+	if _, _, err := reserve(orderID, 0); err != errNoRefundablePayment {
+		t.Errorf("Expected the pending refund to hold the balance, got %v", err)
+	}
+
+	// A failed refund releases its hold
+	recordStripeRefund(db.DB, &stripe.Refund{
+		ID:            "re_rest",
+		Amount:        3000,
+		Status:        stripe.RefundStatusFailed,
+		FailureReason: stripe.RefundFailureReasonExpiredOrCanceledCard,
+		Metadata:      map[string]string{"refund_id": strconv.Itoa(restID)},
+	})
+	if status := paymentStatus(); status != "partially_refunded" {
+		t.Errorf("Expected a failed refund to leave the payment partially refunded, got %s", status)
+	}
+
+	// Refunds made in the Stripe dashboard are picked up from the charge
+	err = recordStripeRefund(db.DB, &stripe.Refund{
+		ID:     "re_dashboard",
+		Amount: 3000,
+		Status: stripe.RefundStatusSucceeded,
+		Reason: stripe.RefundReasonRequestedByCustomer,
+		Charge: &stripe.Charge{ID: "ch_refund_test"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to record dashboard refund: %v", err)
+	}
+	if status := paymentStatus(); status != "refunded" {
+		t.Errorf("Expected the payment to be fully refunded, got %s", status)
+	}
+
+	// Customers see refunds in their payment history
+	handler := &PaymentHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest}
+	w := httptest.NewRecorder()
+	handler.handleGetPaymentHistory(w, httptest.NewRequest("GET", "/api/v1/payments/history", nil))
+	var history []struct {
+		Amount         float64  `json:"amount"`
+		RefundedAmount float64  `json:"refunded_amount"`
+		Refunds        []Refund `json:"refunds"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &history)
+	if len(history) != 1 || history[0].Amount != 50 || history[0].RefundedAmount != 50 || len(history[0].Refunds) != 3 {
+		t.Fatalf("Unexpected payment history: %s", w.Body.String())
+	}
+	for _, rf := range history[0].Refunds {
+		if rf.CreatedBy != nil {
+			t.Errorf("Expected the issuing admin to be hidden, got %+v", rf)
+		}
+	}
+}
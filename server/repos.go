@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// OrderRepo is the order data order operations are decided from, so the
+// decisions can be tested without a database
+type OrderRepo interface {
+	// Get returns a complete order with its lines and history;
+	// sql.ErrNoRows when there's none
+	Get(ctx context.Context, orderID int) (*Order, error)
+}
+
+// pgOrderRepo reads orders from Postgres
+type pgOrderRepo struct {
+	db *sql.DB
+}
+
+func (r pgOrderRepo) Get(ctx context.Context, orderID int) (*Order, error) {
+	return getOrder(r.db, orderID)
+}
+
+// UserRepo is the account data services work from
+type UserRepo interface {
+	// Get returns an account; sql.ErrNoRows when there's none
+	Get(ctx context.Context, userID int) (*User, error)
+	// StripeCustomerID returns the Stripe customer the account is billed
+	// as, or "" before one is created
+	StripeCustomerID(ctx context.Context, userID int) (string, error)
+	// SetStripeCustomerID records the account's Stripe customer; "" clears
+	// one Stripe no longer has
+	SetStripeCustomerID(ctx context.Context, userID int, customerID string) error
+}
+
+// pgUserRepo reads and writes accounts in Postgres
+type pgUserRepo struct {
+	db *sql.DB
+}
+
+func (r pgUserRepo) Get(ctx context.Context, userID int) (*User, error) {
+	user := &User{}
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, email, first_name, last_name, phone, role, status, google_id, avatar_url, email_verified_at,
+		       deactivated_at, created_at
+		FROM users WHERE id = $1`,
+		userID,
+	).Scan(
+		&user.ID, &user.Email, &user.FirstName, &user.LastName,
+		&user.Phone, &user.Role, &user.Status, &user.GoogleID, &user.AvatarURL,
+		&user.EmailVerifiedAt, &user.DeactivatedAt, &user.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r pgUserRepo) StripeCustomerID(ctx context.Context, userID int) (string, error) {
+	var customerID sql.NullString
+	err := r.db.QueryRowContext(ctx, "SELECT stripe_customer_id FROM users WHERE id = $1", userID).Scan(&customerID)
+	return customerID.String, err
+}
+
+func (r pgUserRepo) SetStripeCustomerID(ctx context.Context, userID int, customerID string) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE users SET stripe_customer_id = NULLIF($1, '') WHERE id = $2", customerID, userID)
+	return err
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// maxRetainDays caps how far out an admin can push a retention window
+const maxRetainDays = 3650
+
+// RetentionHandler lets admins tune data retention windows and see what the
+// purge jobs removed
+type RetentionHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewRetentionHandler(db *sql.DB) *RetentionHandler {
+	return &RetentionHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type RetentionPolicy struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	RetainDays  int                `json:"retain_days"`
+	IsEnabled   bool               `json:"is_enabled"`
+	UpdatedBy   *int               `json:"updated_by,omitempty"`
+	UpdatedAt   time.Time          `json:"updated_at"`
+	LastRun     *RetentionPurgeRun `json:"last_run,omitempty"`
+}
+
+type RetentionPurgeRun struct {
+	ID          int       `json:"id"`
+	PolicyName  string    `json:"policy_name"`
+	Cutoff      time.Time `json:"cutoff"`
+	PurgedCount int       `json:"purged_count"`
+	DurationMs  int       `json:"duration_ms"`
+	Status      string    `json:"status"` // succeeded, failed
+	Error       *string   `json:"error,omitempty"`
+	TriggeredBy *int      `json:"triggered_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type UpdateRetentionPolicyRequest struct {
+	RetainDays *int  `json:"retain_days,omitempty"`
+	IsEnabled  *bool `json:"is_enabled,omitempty"`
+}
+
+type RunRetentionPurgeRequest struct {
+	Policy string `json:"policy,omitempty"` // Empty runs every enabled policy
+}
+
+// RetentionReportEntry sums a policy's purge runs over the report window
+type RetentionReportEntry struct {
+	PolicyName    string     `json:"policy_name"`
+	Runs          int        `json:"runs"`
+	FailedRuns    int        `json:"failed_runs"`
+	TotalPurged   int        `json:"total_purged"`
+	AvgDurationMs int        `json:"avg_duration_ms"`
+	LastRunAt     *time.Time `json:"last_run_at,omitempty"`
+}
+
+// retentionPurge removes or redacts rows older than cutoff and returns how
+// many it touched
+type retentionPurge func(tx *sql.Tx, cutoff time.Time) (int64, error)
+
+// retentionPurges holds the purge for each policy in retention_policies. A
+// policy without an entry here is never run. Every purge must skip accounts
+// under legal hold; see notOnLegalHold.
+var retentionPurges = map[string]retentionPurge{
+	"driver_locations":         purgeDriverLocations,
+	"notifications":            purgeNotifications,
+	"order_messages":           purgeOrderMessages,
+	"cancelled_drafts":         purgeCancelledDrafts,
+	"expired_sessions":         purgeExpiredSessions,
+	"push_deliveries":          purgePushDeliveries,
+	"webhook_deliveries":       purgeWebhookDeliveries,
+	"processed_webhook_events": purgeProcessedWebhookEvents,
+	"widget_drafts":            purgeWidgetDrafts,
+}
+
+// purgeDriverLocations clears the last GPS fix of drivers who have been
+// silent since the cutoff. The heartbeat row itself is kept.
+func purgeDriverLocations(tx *sql.Tx, cutoff time.Time) (int64, error) {
+	result, err := tx.Exec(`
+		UPDATE driver_heartbeats SET latitude = NULL, longitude = NULL
+		WHERE last_seen_at < $1
+		  AND (latitude IS NOT NULL OR longitude IS NOT NULL)
+		  AND `+notOnLegalHold("driver_id"),
+		cutoff,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func purgeNotifications(tx *sql.Tx, cutoff time.Time) (int64, error) {
+	result, err := tx.Exec("DELETE FROM notifications WHERE created_at < $1 AND "+notOnLegalHold("user_id"), cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// purgeOrderMessages redacts the text of old order chat messages. Messages
+// are kept when the order's customer or the sender is under legal hold.
+func purgeOrderMessages(tx *sql.Tx, cutoff time.Time) (int64, error) {
+	result, err := tx.Exec(`
+		UPDATE order_messages m SET body = '[redacted]', redacted_at = CURRENT_TIMESTAMP
+		FROM orders o
+		WHERE o.id = m.order_id AND m.created_at < $1 AND m.redacted_at IS NULL
+		  AND `+notOnLegalHold("o.user_id")+`
+		  AND `+notOnLegalHold("m.sender_id"),
+		cutoff,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// purgeCancelledDrafts deletes cancelled orders that never reached a driver
+// and have no payment on record. Anything that was paid or picked up is kept
+// for bookkeeping.
+func purgeCancelledDrafts(tx *sql.Tx, cutoff time.Time) (int64, error) {
+	rows, err := tx.Query(`
+		SELECT o.id FROM orders o
+		WHERE o.status = 'cancelled' AND o.updated_at < $1
+		  AND NOT EXISTS (SELECT 1 FROM payments p WHERE p.order_id = o.id)
+		  AND NOT EXISTS (
+			SELECT 1 FROM order_status_history h
+			WHERE h.order_id = o.id AND h.status = 'picked_up'
+		  )
+		  AND `+notOnLegalHold("o.user_id")+`
+		FOR UPDATE OF o`,
+		cutoff,
+	)
+	if err != nil {
+		return 0, err
+	}
+	orderIDs := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		orderIDs = append(orderIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(orderIDs) == 0 {
+		return 0, nil
+	}
+
+	// Notifications don't cascade with their order
+	if _, err := tx.Exec("DELETE FROM notifications WHERE order_id = ANY($1)", pq.Array(orderIDs)); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM orders WHERE id = ANY($1)", pq.Array(orderIDs))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// purgeExpiredSessions deletes sessions and OAuth login codes that expired
+// before the cutoff
+func purgeExpiredSessions(tx *sql.Tx, cutoff time.Time) (int64, error) {
+	result, err := tx.Exec("DELETE FROM sessions WHERE expires_at < $1 AND "+notOnLegalHold("user_id"), cutoff)
+	if err != nil {
+		return 0, err
+	}
+	sessions, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	result, err = tx.Exec("DELETE FROM login_codes WHERE expires_at < $1 AND "+notOnLegalHold("user_id"), cutoff)
+	if err != nil {
+		return 0, err
+	}
+	codes, err := result.RowsAffected()
+	return sessions + codes, err
+}
+
+// purgePushDeliveries deletes pushes that are done with, sent or given up
+// on, and device tokens APNs or FCM rejected, along with their deliveries
+func purgePushDeliveries(tx *sql.Tx, cutoff time.Time) (int64, error) {
+	result, err := tx.Exec(`
+		DELETE FROM push_deliveries
+		WHERE status <> 'pending' AND created_at < $1 AND `+notOnLegalHold("user_id"),
+		cutoff,
+	)
+	if err != nil {
+		return 0, err
+	}
+	deliveries, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	result, err = tx.Exec("DELETE FROM device_tokens WHERE invalidated_at < $1 AND "+notOnLegalHold("user_id"), cutoff)
+	if err != nil {
+		return 0, err
+	}
+	tokens, err := result.RowsAffected()
+	return deliveries + tokens, err
+}
+
+// runRetentionPolicy purges one policy in its own transaction and records the
+// run, failed or not. triggeredBy is nil for the scheduled job.
+func runRetentionPolicy(db *sql.DB, name string, retainDays int, triggeredBy *int) (RetentionPurgeRun, error) {
+	run := RetentionPurgeRun{
+		PolicyName:  name,
+		Cutoff:      time.Now().UTC().AddDate(0, 0, -retainDays),
+		Status:      "succeeded",
+		TriggeredBy: triggeredBy,
+	}
+
+	purge, ok := retentionPurges[name]
+	if !ok {
+		return run, fmt.Errorf("no purge defined for retention policy %q", name)
+	}
+
+	started := time.Now()
+	purged, err := func() (int64, error) {
+		tx, err := db.Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+
+		purged, err := purge(tx, run.Cutoff)
+		if err != nil {
+			return 0, err
+		}
+		return purged, tx.Commit()
+	}()
+	run.DurationMs = int(time.Since(started).Milliseconds())
+	if err != nil {
+		message := err.Error()
+		run.Status = "failed"
+		run.Error = &message
+	} else {
+		run.PurgedCount = int(purged)
+	}
+
+	recordErr := db.QueryRow(`
+		INSERT INTO retention_purge_runs (policy_name, cutoff, purged_count, duration_ms, status, error, triggered_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`,
+		run.PolicyName, run.Cutoff, run.PurgedCount, run.DurationMs, run.Status, run.Error, run.TriggeredBy,
+	).Scan(&run.ID, &run.CreatedAt)
+	if recordErr != nil {
+		log.Printf("Error recording retention run for %s: %v", name, recordErr)
+	}
+	return run, err
+}
+
+// runRetentionPolicies runs every enabled policy, or just the named one
+func runRetentionPolicies(db *sql.DB, only string, triggeredBy *int) ([]RetentionPurgeRun, error) {
+	rows, err := db.Query(`
+		SELECT name, retain_days FROM retention_policies
+		WHERE is_enabled AND ($1 = '' OR name = $1)
+		ORDER BY name`,
+		only,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	type policyWindow struct {
+		name       string
+		retainDays int
+	}
+	policies := []policyWindow{}
+	for rows.Next() {
+		var p policyWindow
+		if err := rows.Scan(&p.name, &p.retainDays); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	runs := []RetentionPurgeRun{}
+	for _, p := range policies {
+		run, err := runRetentionPolicy(db, p.name, p.retainDays, triggeredBy)
+		if err != nil {
+			log.Printf("Retention purge %s failed: %v", p.name, err)
+		} else {
+			log.Printf("Retention purge %s removed %d rows older than %s", p.name, run.PurgedCount, run.Cutoff.Format("2006-01-02"))
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// processRetentionPurges enforces the retention policies and flags failed
+// purges in the admin inbox
+func (s *AutoScheduler) processRetentionPurges() {
+	runs, err := runRetentionPolicies(s.db, "", nil)
+	if err != nil {
+		log.Printf("Error loading retention policies: %v", err)
+		return
+	}
+
+	failed := []string{}
+	for _, run := range runs {
+		if run.Status == "failed" {
+			failed = append(failed, run.PolicyName)
+		}
+	}
+	if len(failed) > 0 {
+		logAdminAlert(s.db, AdminAlert{
+			Type:      "retention_purge_failed",
+			Severity:  "warning",
+			Title:     "Data retention purge failed",
+			Message:   fmt.Sprintf("Retention purges failed for: %v", failed),
+			DedupeKey: "retention_purge_failed:" + time.Now().Format("2006-01-02"),
+			Data:      map[string]interface{}{"policies": failed},
+		})
+	}
+}
+
+func (h *RetentionHandler) getPolicies(name string) ([]RetentionPolicy, error) {
+	rows, err := h.db.Query(`
+		SELECT p.name, p.description, p.retain_days, p.is_enabled, p.updated_by, p.updated_at,
+		       r.id, r.cutoff, r.purged_count, r.duration_ms, r.status, r.error, r.triggered_by, r.created_at
+		FROM retention_policies p
+		LEFT JOIN LATERAL (
+			SELECT * FROM retention_purge_runs
+			WHERE policy_name = p.name
+			ORDER BY created_at DESC, id DESC
+			LIMIT 1
+		) r ON true
+		WHERE $1 = '' OR p.name = $1
+		ORDER BY p.name`,
+		name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []RetentionPolicy{}
+	for rows.Next() {
+		var p RetentionPolicy
+		var runID, purgedCount, durationMs, triggeredBy sql.NullInt64
+		var cutoff, createdAt sql.NullTime
+		var status, runError sql.NullString
+		err := rows.Scan(
+			&p.Name, &p.Description, &p.RetainDays, &p.IsEnabled, &p.UpdatedBy, &p.UpdatedAt,
+			&runID, &cutoff, &purgedCount, &durationMs, &status, &runError, &triggeredBy, &createdAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if runID.Valid {
+			run := &RetentionPurgeRun{
+				ID:          int(runID.Int64),
+				PolicyName:  p.Name,
+				Cutoff:      cutoff.Time,
+				PurgedCount: int(purgedCount.Int64),
+				DurationMs:  int(durationMs.Int64),
+				Status:      status.String,
+				CreatedAt:   createdAt.Time,
+			}
+			if runError.Valid {
+				run.Error = &runError.String
+			}
+			if triggeredBy.Valid {
+				id := int(triggeredBy.Int64)
+				run.TriggeredBy = &id
+			}
+			p.LastRun = run
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// handleGetRetentionPolicies lists every policy with its most recent run
+func (h *RetentionHandler) handleGetRetentionPolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	policies, err := h.getPolicies("")
+	if err != nil {
+		http.Error(w, "Failed to fetch retention policies", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
+
+// handleUpdateRetentionPolicy changes a policy's window or turns it on or off
+func (h *RetentionHandler) handleUpdateRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req UpdateRetentionPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.RetainDays == nil && req.IsEnabled == nil {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+	if req.RetainDays != nil && (*req.RetainDays < 1 || *req.RetainDays > maxRetainDays) {
+		http.Error(w, fmt.Sprintf("retain_days must be between 1 and %d", maxRetainDays), http.StatusBadRequest)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	result, err := h.db.Exec(`
+		UPDATE retention_policies
+		SET retain_days = COALESCE($1, retain_days),
+		    is_enabled = COALESCE($2, is_enabled),
+		    updated_by = $3
+		WHERE name = $4`,
+		req.RetainDays, req.IsEnabled, adminID, name,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update retention policy", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Retention policy not found", http.StatusNotFound)
+		return
+	}
+
+	policies, err := h.getPolicies(name)
+	if err != nil || len(policies) == 0 {
+		http.Error(w, "Failed to fetch retention policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies[0])
+}
+
+// handleRunRetentionPurge runs the purges now instead of waiting for the
+// nightly job
+func (h *RetentionHandler) handleRunRetentionPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req RunRetentionPurgeRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	runs, err := runRetentionPolicies(h.db, req.Policy, &adminID)
+	if err != nil {
+		http.Error(w, "Failed to run retention purges", http.StatusInternalServerError)
+		return
+	}
+	if req.Policy != "" && len(runs) == 0 {
+		http.Error(w, "Retention policy not found or disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// handleGetRetentionReport sums purged counts per policy over the last
+// ?days= days (default 30)
+func (h *RetentionHandler) handleGetRetentionReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := 30
+	if d := r.URL.Query().Get("days"); d != "" {
+		parsed, err := strconv.Atoi(d)
+		if err != nil || parsed < 1 || parsed > 365 {
+			http.Error(w, "days must be between 1 and 365", http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days)
+
+	rows, err := h.db.Query(`
+		SELECT p.name,
+		       COUNT(r.id),
+		       COUNT(r.id) FILTER (WHERE r.status = 'failed'),
+		       COALESCE(SUM(r.purged_count), 0),
+		       COALESCE(AVG(r.duration_ms), 0)::int,
+		       MAX(r.created_at)
+		FROM retention_policies p
+		LEFT JOIN retention_purge_runs r ON r.policy_name = p.name AND r.created_at >= $1
+		GROUP BY p.name
+		ORDER BY p.name`,
+		since,
+	)
+	if err != nil {
+		http.Error(w, "Failed to build retention report", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []RetentionReportEntry{}
+	for rows.Next() {
+		var e RetentionReportEntry
+		if err := rows.Scan(&e.PolicyName, &e.Runs, &e.FailedRuns, &e.TotalPurged, &e.AvgDurationMs, &e.LastRunAt); err != nil {
+			http.Error(w, "Failed to parse retention report", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"since":    since,
+		"days":     days,
+		"policies": entries,
+	})
+}
+
+// purgeWebhookDeliveries deletes partner webhook deliveries that were
+// delivered or given up on. Endpoints aren't tied to one account, so there's
+// no legal hold to check.
+func purgeWebhookDeliveries(tx *sql.Tx, cutoff time.Time) (int64, error) {
+	result, err := tx.Exec("DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// purgeProcessedWebhookEvents only deletes events that were applied. Failed
+// ones are kept until someone replays them.
+func purgeProcessedWebhookEvents(tx *sql.Tx, cutoff time.Time) (int64, error) {
+	result, err := tx.Exec("DELETE FROM processed_webhook_events WHERE status = 'processed' AND received_at < $1", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// purgeWidgetDrafts deletes booking widget drafts that expired before the
+// cutoff. A claimed draft is only a prefilled form; the order is what's kept.
+func purgeWidgetDrafts(tx *sql.Tx, cutoff time.Time) (int64, error) {
+	result, err := tx.Exec("DELETE FROM widget_drafts WHERE expires_at < $1", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRetentionPurges(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "retention@example.com", "Retention", "Customer")
+	driverID := db.CreateTestUser(t, "retention-driver@example.com", "Retention", "Driver")
+	addressID := db.CreateTestAddress(t, userID)
+
+	// Cancelled weeks ago and never paid: purged along with its notification
+	draftID := db.CreateTestOrder(t, userID, addressID)
+	// Cancelled weeks ago after paying: kept for bookkeeping
+	paidID := db.CreateTestOrder(t, userID, addressID)
+	// Cancelled yesterday: still inside the window
+	recentID := db.CreateTestOrder(t, userID, addressID)
+	db.Exec("UPDATE orders SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP - INTERVAL '30 days' WHERE id IN ($1, $2)", draftID, paidID)
+	db.Exec("UPDATE orders SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP - INTERVAL '1 day' WHERE id = $1", recentID)
+	db.Exec(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status)
+		VALUES ($1, $2, 4500, 'extra_order', 'refunded')`,
+		userID, paidID,
+	)
+
+	db.Exec(`
+		INSERT INTO notifications (user_id, order_id, type, title, message, created_at) VALUES
+			($1, $2, 'pickup_scheduled', 'Old', 'Old', CURRENT_TIMESTAMP - INTERVAL '10 days'),
+			($1, NULL, 'usage_alert', 'Ancient', 'Ancient', CURRENT_TIMESTAMP - INTERVAL '120 days'),
+			($1, NULL, 'usage_alert', 'Fresh', 'Fresh', CURRENT_TIMESTAMP)`,
+		userID, draftID,
+	)
+	db.Exec(`
+		INSERT INTO driver_heartbeats (driver_id, latitude, longitude, last_seen_at)
+		VALUES ($1, 40.7128, -74.0060, CURRENT_TIMESTAMP - INTERVAL '45 days')`,
+		driverID,
+	)
+	db.Exec(`
+		INSERT INTO sessions (id, user_id, expires_at) VALUES
+			('expired', $1, CURRENT_TIMESTAMP - INTERVAL '8 days'),
+			('active', $1, CURRENT_TIMESTAMP + INTERVAL '1 day')`,
+		userID,
+	)
+
+	db.Exec(`
+		INSERT INTO order_messages (order_id, sender_id, sender_role, body, created_at) VALUES
+			($1, $2, 'customer', 'Gate code is 1234', CURRENT_TIMESTAMP - INTERVAL '200 days'),
+			($1, $2, 'customer', 'Thanks!', CURRENT_TIMESTAMP)`,
+		paidID, userID,
+	)
+
+	scheduler := &AutoScheduler{db: db.DB}
+	scheduler.processRetentionPurges()
+
+	var orders int
+	db.QueryRow("SELECT COUNT(*) FROM orders WHERE id IN ($1, $2, $3)", draftID, paidID, recentID).Scan(&orders)
+	if orders != 2 {
+		t.Errorf("Expected only the unpaid old draft to be purged, %d of 3 orders left", orders)
+	}
+	var notifications int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1", userID).Scan(&notifications)
+	if notifications != 1 {
+		t.Errorf("Expected only the fresh notification to remain, got %d", notifications)
+	}
+	var latitude sql.NullFloat64
+	db.QueryRow("SELECT latitude FROM driver_heartbeats WHERE driver_id = $1", driverID).Scan(&latitude)
+	if latitude.Valid {
+		t.Error("Expected the stale driver location to be cleared")
+	}
+	var sessions int
+	db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&sessions)
+	if sessions != 1 {
+		t.Errorf("Expected only the active session to remain, got %d", sessions)
+	}
+	var redacted int
+	db.QueryRow("SELECT COUNT(*) FROM order_messages WHERE order_id = $1 AND body = '[redacted]' AND redacted_at IS NOT NULL", paidID).Scan(&redacted)
+	if redacted != 1 {
+		t.Errorf("Expected only the old chat message to be redacted, got %d", redacted)
+	}
+
+	expected := map[string]int{"cancelled_drafts": 1, "driver_locations": 1, "expired_sessions": 1, "notifications": 1, "order_messages": 1, "processed_webhook_events": 0, "push_deliveries": 0, "webhook_deliveries": 0, "widget_drafts": 0}
+	handler := NewRetentionHandler(db.DB)
+	req := httptest.NewRequest("GET", "/api/v1/admin/retention/report", nil)
+	w := httptest.NewRecorder()
+	handler.handleGetRetentionReport(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var report struct {
+		Policies []RetentionReportEntry `json:"policies"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if len(report.Policies) != len(expected) {
+		t.Fatalf("Expected %d policies in the report, got %+v", len(expected), report.Policies)
+	}
+	for _, entry := range report.Policies {
+		if entry.Runs != 1 || entry.FailedRuns != 0 || entry.TotalPurged != expected[entry.PolicyName] {
+			t.Errorf("Unexpected report for %s: %+v", entry.PolicyName, entry)
+		}
+	}
+}
+
+func TestRetentionPolicy_UpdateAndDisable(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "retention-admin@example.com", "Retention", "Admin")
+	handler := NewRetentionHandler(db.DB)
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return adminID, nil
+	}
+
+	update := func(name string, body UpdateRetentionPolicyRequest) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest("PUT", "/api/v1/admin/retention/policies/"+name, bytes.NewBuffer(data))
+		req = mux.SetURLVars(req, map[string]string{"name": name})
+		w := httptest.NewRecorder()
+		handler.handleUpdateRetentionPolicy(w, req)
+		return w
+	}
+
+	zero, disabled := 0, false
+	if w := update("notifications", UpdateRetentionPolicyRequest{RetainDays: &zero}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a zero-day window, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := update("chat_messages", UpdateRetentionPolicyRequest{IsEnabled: &disabled}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown policy, got %d", http.StatusNotFound, w.Code)
+	}
+
+	w := update("notifications", UpdateRetentionPolicyRequest{IsEnabled: &disabled})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var policy RetentionPolicy
+	json.Unmarshal(w.Body.Bytes(), &policy)
+	if policy.IsEnabled || policy.RetainDays != 90 || policy.UpdatedBy == nil || *policy.UpdatedBy != adminID {
+		t.Errorf("Expected notifications disabled with its 90 day window kept, got %+v", policy)
+	}
+
+	// Disabled policies are skipped, and can't be run by hand
+	body, _ := json.Marshal(RunRetentionPurgeRequest{Policy: "notifications"})
+	req := httptest.NewRequest("POST", "/api/v1/admin/retention/run", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	handler.handleRunRetentionPurge(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a disabled policy, got %d", http.StatusNotFound, w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/v1/admin/retention/run", nil)
+	w = httptest.NewRecorder()
+	handler.handleRunRetentionPurge(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var runs []RetentionPurgeRun
+	json.Unmarshal(w.Body.Bytes(), &runs)
+	if len(runs) != len(retentionPurges)-1 {
+		t.Fatalf("Expected every enabled policy to run, got %+v", runs)
+	}
+	for _, run := range runs {
+		if run.PolicyName == "notifications" || run.TriggeredBy == nil || *run.TriggeredBy != adminID {
+			t.Errorf("Unexpected run %+v", run)
+		}
+	}
+}
@@ -0,0 +1,872 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Route scheduling assumes a fixed drive to each stop and time spent at it
+const (
+	routeLegMinutes     = 15
+	routeServiceMinutes = 10
+)
+
+const defaultBreakJurisdiction = "default"
+
+// RouteBreakHandler schedules driver breaks into routes under each
+// jurisdiction's labor rules and reports shifts that broke them
+type RouteBreakHandler struct {
+	db        *sql.DB
+	realtime  RealtimeInterface
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewRouteBreakHandler(db *sql.DB) *RouteBreakHandler {
+	return &RouteBreakHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+type BreakPolicy struct {
+	Jurisdiction         string    `json:"jurisdiction"`
+	Name                 string    `json:"name"`
+	MaxContinuousMinutes int       `json:"max_continuous_minutes"`
+	RestBreakMinutes     int       `json:"rest_break_minutes"`
+	MealAfterMinutes     int       `json:"meal_after_minutes"`
+	MealBreakMinutes     int       `json:"meal_break_minutes"`
+	MaxShiftMinutes      int       `json:"max_shift_minutes"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+type RouteBreak struct {
+	ID              int        `json:"id"`
+	RouteID         int        `json:"route_id"`
+	AfterSequence   int        `json:"after_sequence"` // Taken after this stop; 0 is before the first
+	BreakType       string     `json:"break_type"`     // rest or meal
+	DurationMinutes int        `json:"duration_minutes"`
+	AutoInserted    bool       `json:"auto_inserted"`
+	EstimatedStart  *string    `json:"estimated_start,omitempty"`
+	ActualStart     *time.Time `json:"actual_start,omitempty"`
+	ActualEnd       *time.Time `json:"actual_end,omitempty"`
+}
+
+type RouteScheduleStop struct {
+	RouteOrderID   int     `json:"route_order_id"`
+	SequenceNumber int     `json:"sequence_number"`
+	EstimatedTime  *string `json:"estimated_time,omitempty"`
+}
+
+type RouteSchedule struct {
+	RouteID      int                 `json:"route_id"`
+	Jurisdiction string              `json:"jurisdiction"`
+	StartTime    *string             `json:"start_time,omitempty"`
+	EndTime      *string             `json:"end_time,omitempty"`
+	Stops        []RouteScheduleStop `json:"stops"`
+	Breaks       []RouteBreak        `json:"breaks"`
+	// WindowChanges are the customers told their window moved
+	WindowChanges []StopWindowChange `json:"window_changes,omitempty"`
+}
+
+type ShiftViolation struct {
+	Rule    string `json:"rule"` // continuous_work, missed_meal or shift_length
+	Minutes int    `json:"minutes"`
+	Limit   int    `json:"limit"`
+}
+
+type ShiftCompliance struct {
+	RouteID      int              `json:"route_id"`
+	DriverID     int              `json:"driver_id"`
+	DriverName   string           `json:"driver_name"`
+	RouteDate    string           `json:"route_date"`
+	Jurisdiction string           `json:"jurisdiction"`
+	ShiftMinutes int              `json:"shift_minutes"`
+	BreakMinutes int              `json:"break_minutes"`
+	Violations   []ShiftViolation `json:"violations"`
+}
+
+const breakPolicyColumns = `jurisdiction, name, max_continuous_minutes, rest_break_minutes,
+	meal_after_minutes, meal_break_minutes, max_shift_minutes, updated_at`
+
+func scanBreakPolicy(scanner interface{ Scan(...interface{}) error }) (BreakPolicy, error) {
+	var p BreakPolicy
+	err := scanner.Scan(&p.Jurisdiction, &p.Name, &p.MaxContinuousMinutes, &p.RestBreakMinutes,
+		&p.MealAfterMinutes, &p.MealBreakMinutes, &p.MaxShiftMinutes, &p.UpdatedAt)
+	return p, err
+}
+
+const routeBreakColumns = `id, route_id, after_sequence, break_type, duration_minutes, auto_inserted,
+	TO_CHAR(estimated_start, 'HH24:MI'), actual_start, actual_end`
+
+func scanRouteBreak(scanner interface{ Scan(...interface{}) error }) (RouteBreak, error) {
+	var b RouteBreak
+	err := scanner.Scan(&b.ID, &b.RouteID, &b.AfterSequence, &b.BreakType, &b.DurationMinutes, &b.AutoInserted,
+		&b.EstimatedStart, &b.ActualStart, &b.ActualEnd)
+	return b, err
+}
+
+// getRouteBreaks loads a route's breaks in the order they're taken
+func getRouteBreaks(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, routeID int) ([]RouteBreak, error) {
+	rows, err := q.Query("SELECT "+routeBreakColumns+" FROM route_breaks WHERE route_id = $1 ORDER BY after_sequence, id", routeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	breaks := []RouteBreak{}
+	for rows.Next() {
+		b, err := scanRouteBreak(rows)
+		if err != nil {
+			return nil, err
+		}
+		breaks = append(breaks, b)
+	}
+	return breaks, rows.Err()
+}
+
+// routePolicy loads the break policy a route is held to
+func routePolicy(q queryRower, routeID int) (BreakPolicy, error) {
+	return scanBreakPolicy(q.QueryRow(`
+		SELECT `+breakPolicyColumns+` FROM break_policies
+		WHERE jurisdiction = (SELECT COALESCE(jurisdiction, $2) FROM driver_routes WHERE id = $1)`,
+		routeID, defaultBreakJurisdiction,
+	))
+}
+
+// jurisdictionPolicy loads a jurisdiction's break policy, or the default
+// policy when jurisdiction is empty
+func jurisdictionPolicy(q queryRower, jurisdiction string) (BreakPolicy, error) {
+	if jurisdiction == "" {
+		jurisdiction = defaultBreakJurisdiction
+	}
+	return scanBreakPolicy(q.QueryRow("SELECT "+breakPolicyColumns+" FROM break_policies WHERE jurisdiction = $1", jurisdiction))
+}
+
+// planRouteBreaks walks a route's stops and returns the breaks it needs on
+// top of the ones already scheduled: a rest break before any stop that would
+// take the driver past the continuous work limit, and a meal break before
+// the one that would take them past the meal deadline without one.
+func planRouteBreaks(policy BreakPolicy, sequences []int, existing []RouteBreak) []RouteBreak {
+	stopMinutes := make([]int, len(sequences))
+	for i := range stopMinutes {
+		stopMinutes[i] = routeLegMinutes + routeServiceMinutes
+	}
+	return planStopBreaks(policy, sequences, stopMinutes, existing)
+}
+
+// planStopBreaks is planRouteBreaks for stops that each take their own
+// time, the drive to the stop plus the time spent at it
+func planStopBreaks(policy BreakPolicy, sequences, stopMinutes []int, existing []RouteBreak) []RouteBreak {
+	var planned []RouteBreak
+	continuous, worked := 0, 0
+	hadMeal := false
+	next := 0
+	for i, seq := range sequences {
+		// Breaks already on the route count toward the rules too
+		for ; next < len(existing) && existing[next].AfterSequence < seq; next++ {
+			b := existing[next]
+			if b.DurationMinutes >= policy.RestBreakMinutes {
+				continuous = 0
+			}
+			if b.BreakType == "meal" && b.DurationMinutes >= policy.MealBreakMinutes {
+				hadMeal = true
+			}
+		}
+
+		if i > 0 {
+			needMeal := !hadMeal && worked+stopMinutes[i] > policy.MealAfterMinutes
+			if needMeal || continuous+stopMinutes[i] > policy.MaxContinuousMinutes {
+				b := RouteBreak{AfterSequence: sequences[i-1], BreakType: "rest", DurationMinutes: policy.RestBreakMinutes, AutoInserted: true}
+				if needMeal {
+					b.BreakType = "meal"
+					b.DurationMinutes = policy.MealBreakMinutes
+					hadMeal = true
+				}
+				planned = append(planned, b)
+				continuous = 0
+			}
+		}
+		continuous += stopMinutes[i]
+		worked += stopMinutes[i]
+	}
+	return planned
+}
+
+// estimateRouteTimes lays a route out from its start: the ETA at each stop,
+// the start of each break (breaks must be in the order they're taken), and
+// when the route ends. A break is taken after the last stop at or before its
+// after_sequence.
+func estimateRouteTimes(start time.Time, sequences []int, breaks []RouteBreak) ([]time.Time, []time.Time, time.Time) {
+	etas := make([]time.Time, len(sequences))
+	breakStarts := make([]time.Time, len(breaks))
+	t := start
+	next := 0
+	takeBreaks := func(upTo int, last bool) {
+		for next < len(breaks) && (last || breaks[next].AfterSequence < upTo) {
+			breakStarts[next] = t
+			t = t.Add(time.Duration(breaks[next].DurationMinutes) * time.Minute)
+			next++
+		}
+	}
+	for i, seq := range sequences {
+		takeBreaks(seq, false)
+		t = t.Add(routeLegMinutes * time.Minute)
+		etas[i] = t
+		t = t.Add(routeServiceMinutes * time.Minute)
+	}
+	takeBreaks(0, true)
+	return etas, breakStarts, t
+}
+
+// scheduleRoute rebuilds a route's schedule from start, or from its current
+// start time when start is nil. With planBreaks the breaks the scheduler
+// placed last time are replaced with a fresh plan; breaks added by hand are
+// always kept. Routes with no start time get breaks but no ETAs.
+func scheduleRoute(tx *sql.Tx, routeID int, start *time.Time, planBreaks bool) (*RouteSchedule, error) {
+	schedule := &RouteSchedule{RouteID: routeID, Stops: []RouteScheduleStop{}}
+	var currentStart sql.NullString
+	err := tx.QueryRow(`
+		SELECT COALESCE(jurisdiction, $2), TO_CHAR(estimated_start_time, 'HH24:MI')
+		FROM driver_routes WHERE id = $1 FOR UPDATE`,
+		routeID, defaultBreakJurisdiction,
+	).Scan(&schedule.Jurisdiction, &currentStart)
+	if err != nil {
+		return nil, err
+	}
+	if start == nil && currentStart.Valid {
+		parsed, err := time.Parse("15:04", currentStart.String)
+		if err != nil {
+			return nil, err
+		}
+		start = &parsed
+	}
+
+	policy, err := routePolicy(tx, routeID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query("SELECT id, sequence_number FROM route_orders WHERE route_id = $1 ORDER BY sequence_number, id", routeID)
+	if err != nil {
+		return nil, err
+	}
+	var sequences []int
+	for rows.Next() {
+		var stop RouteScheduleStop
+		if err := rows.Scan(&stop.RouteOrderID, &stop.SequenceNumber); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sequences = append(sequences, stop.SequenceNumber)
+		schedule.Stops = append(schedule.Stops, stop)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if planBreaks {
+		if _, err := tx.Exec("DELETE FROM route_breaks WHERE route_id = $1 AND auto_inserted AND actual_start IS NULL", routeID); err != nil {
+			return nil, err
+		}
+		existing, err := getRouteBreaks(tx, routeID)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range planRouteBreaks(policy, sequences, existing) {
+			_, err := tx.Exec(`
+				INSERT INTO route_breaks (route_id, after_sequence, break_type, duration_minutes, auto_inserted)
+				VALUES ($1, $2, $3, $4, TRUE)`,
+				routeID, b.AfterSequence, b.BreakType, b.DurationMinutes,
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if schedule.Breaks, err = getRouteBreaks(tx, routeID); err != nil {
+		return nil, err
+	}
+	if start == nil {
+		return schedule, nil
+	}
+
+	etas, breakStarts, end := estimateRouteTimes(*start, sequences, schedule.Breaks)
+	format := func(t time.Time) *string {
+		s := t.Format("15:04")
+		return &s
+	}
+	schedule.StartTime, schedule.EndTime = format(*start), format(end)
+	_, err = tx.Exec("UPDATE driver_routes SET estimated_start_time = $2, estimated_end_time = $3 WHERE id = $1",
+		routeID, *schedule.StartTime, *schedule.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	for i := range schedule.Stops {
+		schedule.Stops[i].EstimatedTime = format(etas[i])
+		if _, err := tx.Exec("UPDATE route_orders SET estimated_time = $2 WHERE id = $1",
+			schedule.Stops[i].RouteOrderID, *schedule.Stops[i].EstimatedTime); err != nil {
+			return nil, err
+		}
+	}
+	for i := range schedule.Breaks {
+		schedule.Breaks[i].EstimatedStart = format(breakStarts[i])
+		if _, err := tx.Exec("UPDATE route_breaks SET estimated_start = $2 WHERE id = $1",
+			schedule.Breaks[i].ID, *schedule.Breaks[i].EstimatedStart); err != nil {
+			return nil, err
+		}
+	}
+	if schedule.WindowChanges, err = updateStopWindows(tx, routeID); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+type breakPeriod struct {
+	start, end time.Time
+}
+
+// checkShiftCompliance checks a worked shift against a break policy. Only
+// breaks at least as long as the policy's rest break end a stretch of
+// continuous work, and only ones as long as its meal break count as a meal.
+func checkShiftCompliance(policy BreakPolicy, start, end time.Time, breaks []breakPeriod) []ShiftViolation {
+	sort.Slice(breaks, func(i, j int) bool { return breaks[i].start.Before(breaks[j].start) })
+	minutes := func(d time.Duration) int { return int(d.Minutes()) }
+
+	violations := []ShiftViolation{}
+	if shift := minutes(end.Sub(start)); shift > policy.MaxShiftMinutes {
+		violations = append(violations, ShiftViolation{Rule: "shift_length", Minutes: shift, Limit: policy.MaxShiftMinutes})
+	}
+
+	longest := 0
+	stretchStart := start
+	var worked, workedBeforeMeal time.Duration
+	cursor := start
+	hadMeal := false
+	for _, b := range breaks {
+		if b.end.After(end) {
+			b.end = end
+		}
+		if !b.start.After(cursor) && !b.end.After(cursor) {
+			continue
+		}
+		if b.start.Before(cursor) {
+			b.start = cursor
+		}
+		worked += b.start.Sub(cursor)
+		cursor = b.end
+		length := minutes(b.end.Sub(b.start))
+		if length >= policy.RestBreakMinutes {
+			if stretch := minutes(b.start.Sub(stretchStart)); stretch > longest {
+				longest = stretch
+			}
+			stretchStart = b.end
+		}
+		if !hadMeal && length >= policy.MealBreakMinutes {
+			hadMeal = true
+			workedBeforeMeal = worked
+		}
+	}
+	if stretch := minutes(end.Sub(stretchStart)); stretch > longest {
+		longest = stretch
+	}
+	worked += end.Sub(cursor)
+	if longest > policy.MaxContinuousMinutes {
+		violations = append(violations, ShiftViolation{Rule: "continuous_work", Minutes: longest, Limit: policy.MaxContinuousMinutes})
+	}
+
+	if !hadMeal {
+		workedBeforeMeal = worked
+	}
+	if minutes(workedBeforeMeal) > policy.MealAfterMinutes {
+		violations = append(violations, ShiftViolation{Rule: "missed_meal", Minutes: minutes(workedBeforeMeal), Limit: policy.MealAfterMinutes})
+	}
+	return violations
+}
+
+// handleGetBreakPolicies lists each jurisdiction's break rules
+func (h *RouteBreakHandler) handleGetBreakPolicies(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query("SELECT " + breakPolicyColumns + " FROM break_policies ORDER BY jurisdiction = 'default' DESC, jurisdiction")
+	if err != nil {
+		http.Error(w, "Failed to fetch break policies", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	policies := []BreakPolicy{}
+	for rows.Next() {
+		p, err := scanBreakPolicy(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch break policies", http.StatusInternalServerError)
+			return
+		}
+		policies = append(policies, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
+
+// handleSetBreakPolicy adds or replaces a jurisdiction's break rules.
+// Existing schedules keep their breaks until they're rescheduled.
+func (h *RouteBreakHandler) handleSetBreakPolicy(w http.ResponseWriter, r *http.Request) {
+	jurisdiction := mux.Vars(r)["jurisdiction"]
+	if jurisdiction == "" || len(jurisdiction) > 20 {
+		http.Error(w, "Invalid jurisdiction", http.StatusBadRequest)
+		return
+	}
+
+	var p BreakPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if p.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if p.MaxContinuousMinutes <= 0 || p.RestBreakMinutes <= 0 || p.MealAfterMinutes <= 0 ||
+		p.MealBreakMinutes <= 0 || p.MaxShiftMinutes <= 0 {
+		http.Error(w, "All limits must be positive numbers of minutes", http.StatusBadRequest)
+		return
+	}
+
+	p, err := scanBreakPolicy(h.db.QueryRow(`
+		INSERT INTO break_policies (jurisdiction, name, max_continuous_minutes, rest_break_minutes,
+			meal_after_minutes, meal_break_minutes, max_shift_minutes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (jurisdiction) DO UPDATE SET
+			name = EXCLUDED.name,
+			max_continuous_minutes = EXCLUDED.max_continuous_minutes,
+			rest_break_minutes = EXCLUDED.rest_break_minutes,
+			meal_after_minutes = EXCLUDED.meal_after_minutes,
+			meal_break_minutes = EXCLUDED.meal_break_minutes,
+			max_shift_minutes = EXCLUDED.max_shift_minutes
+		RETURNING `+breakPolicyColumns,
+		jurisdiction, p.Name, p.MaxContinuousMinutes, p.RestBreakMinutes,
+		p.MealAfterMinutes, p.MealBreakMinutes, p.MaxShiftMinutes,
+	))
+	if err != nil {
+		http.Error(w, "Failed to save break policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// respondWithSchedule runs scheduleRoute in its own transaction and writes
+// the result, telling customers whose windows moved
+func (h *RouteBreakHandler) respondWithSchedule(w http.ResponseWriter, routeID int, start *time.Time, planBreaks bool) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	schedule, err := scheduleRoute(tx, routeID, start, planBreaks)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to schedule route", http.StatusInternalServerError)
+		return
+	}
+	publishWindowChanges(h.realtime, schedule.WindowChanges)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// handleGetRouteSchedule returns a route's stops and breaks with their ETAs
+func (h *RouteBreakHandler) handleGetRouteSchedule(w http.ResponseWriter, r *http.Request) {
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Rolled back, so reading a schedule never changes it
+	defer tx.Rollback()
+
+	schedule, err := scheduleRoute(tx, routeID, nil, false)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch route schedule", http.StatusInternalServerError)
+		return
+	}
+	// Nothing was sent, since the transaction is rolled back
+	schedule.WindowChanges = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// handleScheduleRoute plans a route's breaks and ETAs from a start time
+// (HH:MM, defaulting to the route's current start). Setting jurisdiction
+// moves the route to that jurisdiction's rules first; plan_breaks=false keeps
+// the current breaks and only recalculates times.
+func (h *RouteBreakHandler) handleScheduleRoute(w http.ResponseWriter, r *http.Request) {
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		StartTime    string  `json:"start_time"`
+		Jurisdiction *string `json:"jurisdiction"`
+		PlanBreaks   *bool   `json:"plan_breaks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var start *time.Time
+	if req.StartTime != "" {
+		parsed, err := time.Parse("15:04", req.StartTime)
+		if err != nil {
+			http.Error(w, "start_time must be HH:MM", http.StatusBadRequest)
+			return
+		}
+		start = &parsed
+	}
+
+	if req.Jurisdiction != nil {
+		result, err := h.db.Exec(`
+			UPDATE driver_routes SET jurisdiction = NULLIF($2, '')
+			WHERE id = $1 AND (NULLIF($2, '') IS NULL OR EXISTS(SELECT 1 FROM break_policies WHERE jurisdiction = $2))`,
+			routeID, *req.Jurisdiction,
+		)
+		if err != nil {
+			http.Error(w, "Failed to update route", http.StatusInternalServerError)
+			return
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			http.Error(w, "Route or jurisdiction not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	h.respondWithSchedule(w, routeID, start, req.PlanBreaks == nil || *req.PlanBreaks)
+}
+
+// handleAddRouteBreak adds a break by hand and reschedules around it
+func (h *RouteBreakHandler) handleAddRouteBreak(w http.ResponseWriter, r *http.Request) {
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		AfterSequence   int    `json:"after_sequence"`
+		BreakType       string `json:"break_type"`
+		DurationMinutes int    `json:"duration_minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.BreakType != "rest" && req.BreakType != "meal" {
+		http.Error(w, "break_type must be rest or meal", http.StatusBadRequest)
+		return
+	}
+	if req.AfterSequence < 0 || req.DurationMinutes <= 0 {
+		http.Error(w, "after_sequence and duration_minutes are required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec(`
+		INSERT INTO route_breaks (route_id, after_sequence, break_type, duration_minutes)
+		SELECT id, $2, $3, $4 FROM driver_routes WHERE id = $1 AND status = 'planned'`,
+		routeID, req.AfterSequence, req.BreakType, req.DurationMinutes,
+	)
+	if err != nil {
+		http.Error(w, "Failed to add break", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Route not found or already started", http.StatusNotFound)
+		return
+	}
+
+	h.respondWithSchedule(w, routeID, nil, false)
+}
+
+// handleDeleteRouteBreak removes a break that hasn't been taken and
+// reschedules without it
+func (h *RouteBreakHandler) handleDeleteRouteBreak(w http.ResponseWriter, r *http.Request) {
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+	breakID, err := strconv.Atoi(mux.Vars(r)["breakId"])
+	if err != nil {
+		http.Error(w, "Invalid break ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM route_breaks WHERE id = $1 AND route_id = $2 AND actual_start IS NULL", breakID, routeID)
+	if err != nil {
+		http.Error(w, "Failed to delete break", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Break not found or already taken", http.StatusNotFound)
+		return
+	}
+
+	h.respondWithSchedule(w, routeID, nil, false)
+}
+
+// driverRoute checks the route in the URL belongs to the driver and is
+// underway, the only time breaks can be taken
+func (h *RouteBreakHandler) driverRoute(w http.ResponseWriter, r *http.Request) (int, bool) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return 0, false
+	}
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var routeDriverID int
+	var status string
+	err = h.db.QueryRow("SELECT driver_id, status FROM driver_routes WHERE id = $1", routeID).Scan(&routeDriverID, &status)
+	if err != nil {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return 0, false
+	}
+	if routeDriverID != driverID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return 0, false
+	}
+	if status != "in_progress" {
+		http.Error(w, "Breaks can only be taken on a route in progress", http.StatusConflict)
+		return 0, false
+	}
+	return routeID, true
+}
+
+// handleStartBreak starts a scheduled break (break_id), or an unscheduled one
+// of break_type after the stops finished so far
+func (h *RouteBreakHandler) handleStartBreak(w http.ResponseWriter, r *http.Request) {
+	routeID, ok := h.driverRoute(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		BreakID   *int   `json:"break_id"`
+		BreakType string `json:"break_type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var b RouteBreak
+	var err error
+	if req.BreakID != nil {
+		b, err = scanRouteBreak(h.db.QueryRow(`
+			UPDATE route_breaks SET actual_start = CURRENT_TIMESTAMP
+			WHERE id = $1 AND route_id = $2 AND actual_start IS NULL
+			RETURNING `+routeBreakColumns,
+			*req.BreakID, routeID,
+		))
+	} else {
+		if req.BreakType == "" {
+			req.BreakType = "rest"
+		}
+		if req.BreakType != "rest" && req.BreakType != "meal" {
+			http.Error(w, "break_type must be rest or meal", http.StatusBadRequest)
+			return
+		}
+		b, err = scanRouteBreak(h.db.QueryRow(`
+			INSERT INTO route_breaks (route_id, after_sequence, break_type, duration_minutes, actual_start)
+			SELECT $1, (SELECT COALESCE(MAX(sequence_number), 0) FROM route_orders WHERE route_id = $1 AND status <> 'pending'),
+			       $2, p.duration, CURRENT_TIMESTAMP
+			FROM (SELECT CASE WHEN $2 = 'meal' THEN meal_break_minutes ELSE rest_break_minutes END AS duration
+			      FROM break_policies
+			      WHERE jurisdiction = (SELECT COALESCE(jurisdiction, $3) FROM driver_routes WHERE id = $1)) p
+			RETURNING `+routeBreakColumns,
+			routeID, req.BreakType, defaultBreakJurisdiction,
+		))
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Break not found or already taken", http.StatusNotFound)
+		return
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "Already on a break", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to start break", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+// handleEndBreak ends the break the driver is on
+func (h *RouteBreakHandler) handleEndBreak(w http.ResponseWriter, r *http.Request) {
+	routeID, ok := h.driverRoute(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := scanRouteBreak(h.db.QueryRow(`
+		UPDATE route_breaks SET actual_end = CURRENT_TIMESTAMP
+		WHERE route_id = $1 AND actual_start IS NOT NULL AND actual_end IS NULL
+		RETURNING `+routeBreakColumns,
+		routeID,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not on a break", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to end break", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// handleGetBreakCompliance checks finished shifts between ?from= and ?to=
+// (default the last 7 days) against their jurisdiction's rules, listing the
+// ones that broke them, or every shift with ?all=true
+func (h *RouteBreakHandler) handleGetBreakCompliance(w http.ResponseWriter, r *http.Request) {
+	to := time.Now().Format("2006-01-02")
+	from := time.Now().AddDate(0, 0, -7).Format("2006-01-02")
+	for name, value := range map[string]*string{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(name); v != "" {
+			if _, err := time.Parse("2006-01-02", v); err != nil {
+				http.Error(w, "Invalid "+name+" date", http.StatusBadRequest)
+				return
+			}
+			*value = v
+		}
+	}
+	all := r.URL.Query().Get("all") == "true"
+
+	rows, err := h.db.Query(`
+		SELECT dr.id, dr.driver_id, u.first_name || ' ' || u.last_name, dr.route_date::text,
+		       dr.actual_start_time, dr.actual_end_time, `+breakPolicyColumns+`
+		FROM driver_routes dr
+		JOIN users u ON dr.driver_id = u.id
+		JOIN break_policies p ON p.jurisdiction = COALESCE(dr.jurisdiction, $3)
+		WHERE dr.route_date BETWEEN $1 AND $2
+		  AND dr.actual_start_time IS NOT NULL AND dr.actual_end_time IS NOT NULL
+		ORDER BY dr.route_date, dr.id`,
+		from, to, defaultBreakJurisdiction,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch shifts", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type shift struct {
+		report     ShiftCompliance
+		start, end time.Time
+		policy     BreakPolicy
+	}
+	var shifts []*shift
+	index := map[int]*shift{}
+	for rows.Next() {
+		s := &shift{}
+		var p BreakPolicy
+		err := rows.Scan(&s.report.RouteID, &s.report.DriverID, &s.report.DriverName, &s.report.RouteDate,
+			&s.start, &s.end, &p.Jurisdiction, &p.Name, &p.MaxContinuousMinutes, &p.RestBreakMinutes,
+			&p.MealAfterMinutes, &p.MealBreakMinutes, &p.MaxShiftMinutes, &p.UpdatedAt)
+		if err != nil {
+			http.Error(w, "Failed to fetch shifts", http.StatusInternalServerError)
+			return
+		}
+		s.policy = p
+		s.report.Jurisdiction = p.Jurisdiction
+		s.report.ShiftMinutes = int(s.end.Sub(s.start).Minutes())
+		shifts = append(shifts, s)
+		index[s.report.RouteID] = s
+	}
+
+	taken := map[int][]breakPeriod{}
+	breakRows, err := h.db.Query(`
+		SELECT b.route_id, b.actual_start, COALESCE(b.actual_end, dr.actual_end_time)
+		FROM route_breaks b
+		JOIN driver_routes dr ON b.route_id = dr.id
+		WHERE dr.route_date BETWEEN $1 AND $2 AND b.actual_start IS NOT NULL`,
+		from, to,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch breaks", http.StatusInternalServerError)
+		return
+	}
+	defer breakRows.Close()
+	for breakRows.Next() {
+		var routeID int
+		var b breakPeriod
+		if err := breakRows.Scan(&routeID, &b.start, &b.end); err != nil {
+			http.Error(w, "Failed to fetch breaks", http.StatusInternalServerError)
+			return
+		}
+		if s, ok := index[routeID]; ok {
+			taken[routeID] = append(taken[routeID], b)
+			s.report.BreakMinutes += int(b.end.Sub(b.start).Minutes())
+		}
+	}
+
+	reports := []ShiftCompliance{}
+	violating := 0
+	for _, s := range shifts {
+		s.report.Violations = checkShiftCompliance(s.policy, s.start, s.end, taken[s.report.RouteID])
+		if len(s.report.Violations) > 0 {
+			violating++
+		}
+		if all || len(s.report.Violations) > 0 {
+			reports = append(reports, s.report)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":             from,
+		"to":               to,
+		"shifts_checked":   len(shifts),
+		"shifts_violating": violating,
+		"shifts":           reports,
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var testBreakPolicy = BreakPolicy{
+	Jurisdiction:         "default",
+	MaxContinuousMinutes: 240,
+	RestBreakMinutes:     15,
+	MealAfterMinutes:     300,
+	MealBreakMinutes:     30,
+	MaxShiftMinutes:      600,
+}
+
+func stopSequences(n int) []int {
+	sequences := make([]int, n)
+	for i := range sequences {
+		sequences[i] = i + 1
+	}
+	return sequences
+}
+
+func TestPlanRouteBreaks(t *testing.T) {
+	describe := func(breaks []RouteBreak) string {
+		var parts []string
+		for _, b := range breaks {
+			parts = append(parts, fmt.Sprintf("%s@%d", b.BreakType, b.AfterSequence))
+		}
+		return strings.Join(parts, ",")
+	}
+
+	tests := []struct {
+		name     string
+		stops    int
+		existing []RouteBreak
+		expected string
+	}{
+		{"short route", 5, nil, ""},
+		{"rest before the continuous limit", 12, nil, "rest@9"},
+		{"meal before the meal deadline", 14, nil, "rest@9,meal@12"},
+		{"scheduled meal resets the clock", 14, []RouteBreak{{AfterSequence: 6, BreakType: "meal", DurationMinutes: 30}}, ""},
+		{"too-short break doesn't count", 12, []RouteBreak{{AfterSequence: 6, BreakType: "rest", DurationMinutes: 5}}, "rest@9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			planned := planRouteBreaks(testBreakPolicy, stopSequences(tt.stops), tt.existing)
+			if got := describe(planned); got != tt.expected {
+				t.Errorf("Expected breaks %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestEstimateRouteTimes(t *testing.T) {
+	start, _ := time.Parse("15:04", "08:00")
+	breaks := []RouteBreak{{AfterSequence: 1, DurationMinutes: 30}}
+	etas, breakStarts, end := estimateRouteTimes(start, []int{1, 2, 3}, breaks)
+
+	var got []string
+	for _, eta := range etas {
+		got = append(got, eta.Format("15:04"))
+	}
+	if strings.Join(got, ",") != "08:15,09:10,09:35" {
+		t.Errorf("Unexpected ETAs %v", got)
+	}
+	if breakStarts[0].Format("15:04") != "08:25" || end.Format("15:04") != "09:45" {
+		t.Errorf("Expected the break at 08:25 and the route to end at 09:45, got %s and %s",
+			breakStarts[0].Format("15:04"), end.Format("15:04"))
+	}
+}
+
+func TestCheckShiftCompliance(t *testing.T) {
+	start := time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	rules := func(violations []ShiftViolation) string {
+		var names []string
+		for _, v := range violations {
+			names = append(names, v.Rule)
+		}
+		return strings.Join(names, ",")
+	}
+
+	tests := []struct {
+		name     string
+		end      int
+		breaks   []breakPeriod
+		expected string
+	}{
+		{"short shift", 180, nil, ""},
+		{"rested and fed", 540, []breakPeriod{{at(120), at(135)}, {at(240), at(270)}, {at(400), at(415)}}, ""},
+		{"no breaks", 360, nil, "continuous_work,missed_meal"},
+		{"break too short to count", 300, []breakPeriod{{at(150), at(155)}}, "continuous_work"},
+		{"late meal", 480, []breakPeriod{{at(200), at(215)}, {at(330), at(360)}}, "missed_meal"},
+		{"long shift", 660, []breakPeriod{{at(120), at(135)}, {at(240), at(270)}, {at(420), at(435)}}, "shift_length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := checkShiftCompliance(testBreakPolicy, start, at(tt.end), tt.breaks)
+			if got := rules(violations); got != tt.expected {
+				t.Errorf("Expected violations %q, got %q (%+v)", tt.expected, got, violations)
+			}
+		})
+	}
+}
+
+func TestRouteBreaks(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "break-driver@example.com", "Break", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "break-customer@example.com", "Break", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+
+	today := time.Now().Format("2006-01-02")
+	var routeID int
+	if err := db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, $2, 'pickup', 'planned') RETURNING id`,
+		driverID, today,
+	).Scan(&routeID); err != nil {
+		t.Fatalf("Failed to create route: %v", err)
+	}
+	for seq := 1; seq <= 12; seq++ {
+		orderID := db.CreateTestOrder(t, customerID, addressID)
+		db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, $3)", routeID, orderID, seq)
+	}
+
+	handler := NewRouteBreakHandler(db.DB)
+	handler.getUserID = CreateAuthMock(driverID).getUserIDFromRequest
+	routeRequest := func(method, path, body string) *http.Request {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		return mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(routeID)})
+	}
+
+	// California allows 10 minute rests, and the schedule follows it
+	w := httptest.NewRecorder()
+	handler.handleScheduleRoute(w, routeRequest("POST", "/api/v1/admin/routes/1/schedule", `{"start_time": "08:00", "jurisdiction": "CA"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var schedule RouteSchedule
+	json.Unmarshal(w.Body.Bytes(), &schedule)
+	if len(schedule.Breaks) != 1 || schedule.Breaks[0].AfterSequence != 9 || schedule.Breaks[0].DurationMinutes != 10 {
+		t.Fatalf("Expected a 10 minute rest after stop 9, got %+v", schedule.Breaks)
+	}
+	if eta := schedule.Stops[9].EstimatedTime; eta == nil || *eta != "12:10" {
+		t.Errorf("Expected stop 10 to be pushed back to 12:10 by the break, got %v", eta)
+	}
+	var storedETA string
+	db.QueryRow("SELECT TO_CHAR(estimated_time, 'HH24:MI') FROM route_orders WHERE route_id = $1 AND sequence_number = 10", routeID).Scan(&storedETA)
+	if storedETA != "12:10" || *schedule.EndTime != "13:10" {
+		t.Errorf("Expected stored ETA 12:10 and end 13:10, got %s and %s", storedETA, *schedule.EndTime)
+	}
+
+	// Rescheduling replaces the planned break instead of adding another
+	w = httptest.NewRecorder()
+	handler.handleScheduleRoute(w, routeRequest("POST", "/api/v1/admin/routes/1/schedule", `{}`))
+	var breaks int
+	db.QueryRow("SELECT COUNT(*) FROM route_breaks WHERE route_id = $1", routeID).Scan(&breaks)
+	if w.Code != http.StatusOK || breaks != 1 {
+		t.Errorf("Expected one break after rescheduling, got %d (status %d)", breaks, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleStartBreak(w, routeRequest("POST", "/api/v1/driver/routes/1/breaks/start", `{}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a break before the route starts, got %d", http.StatusConflict, w.Code)
+	}
+
+	db.Exec("UPDATE driver_routes SET status = 'in_progress', actual_start_time = CURRENT_TIMESTAMP - INTERVAL '5 hours 30 minutes' WHERE id = $1", routeID)
+	w = httptest.NewRecorder()
+	handler.handleStartBreak(w, routeRequest("POST", "/api/v1/driver/routes/1/breaks/start", `{"break_type": "meal"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handler.handleStartBreak(w, routeRequest("POST", "/api/v1/driver/routes/1/breaks/start", `{}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d while already on a break, got %d", http.StatusConflict, w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.handleEndBreak(w, routeRequest("POST", "/api/v1/driver/routes/1/breaks/end", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	// The meal came five and a half hours in, which the report flags
+	db.Exec("UPDATE route_breaks SET actual_end = actual_start + INTERVAL '30 minutes' WHERE route_id = $1 AND actual_start IS NOT NULL", routeID)
+	db.Exec("UPDATE driver_routes SET status = 'completed', actual_end_time = CURRENT_TIMESTAMP + INTERVAL '1 hour' WHERE id = $1", routeID)
+	w = httptest.NewRecorder()
+	handler.handleGetBreakCompliance(w, httptest.NewRequest("GET", "/api/v1/admin/routes/break-compliance", nil))
+	var report struct {
+		ShiftsChecked int               `json:"shifts_checked"`
+		Shifts        []ShiftCompliance `json:"shifts"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.ShiftsChecked != 1 || len(report.Shifts) != 1 {
+		t.Fatalf("Expected one non-compliant shift, got %s", w.Body.String())
+	}
+	if got := report.Shifts[0]; got.Jurisdiction != "CA" || len(got.Violations) != 2 ||
+		got.Violations[0].Rule != "continuous_work" || got.Violations[1].Rule != "missed_meal" {
+		t.Errorf("Unexpected compliance report %+v", got)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const routeOverloadedAlertType = "route_overloaded"
+
+// RouteCapacity is how much a driver can take on in a day
+type RouteCapacity struct {
+	MaxBags    int `json:"max_bags"`
+	MaxMinutes int `json:"max_minutes"`
+}
+
+// defaultRouteCapacity is the capacity of drivers without their own
+// (ROUTE_MAX_BAGS and ROUTE_MAX_MINUTES)
+func defaultRouteCapacity() RouteCapacity {
+	capacity := RouteCapacity{MaxBags: 40, MaxMinutes: 480}
+	if bags, err := strconv.Atoi(os.Getenv("ROUTE_MAX_BAGS")); err == nil && bags > 0 {
+		capacity.MaxBags = bags
+	}
+	if minutes, err := strconv.Atoi(os.Getenv("ROUTE_MAX_MINUTES")); err == nil && minutes > 0 {
+		capacity.MaxMinutes = minutes
+	}
+	return capacity
+}
+
+// RouteLoad is the work a driver would have on a day: the stops already on
+// their routes plus the ones being assigned. Minutes follow the scheduler's
+// model of a fixed drive to each stop and time spent at it.
+type RouteLoad struct {
+	DriverID       int           `json:"driver_id"`
+	RouteDate      string        `json:"route_date"`
+	Stops          int           `json:"stops"`
+	Bags           int           `json:"bags"`
+	DriveMinutes   int           `json:"drive_minutes"`
+	ServiceMinutes int           `json:"service_minutes"`
+	TotalMinutes   int           `json:"total_minutes"`
+	Capacity       RouteCapacity `json:"capacity"`
+	// Warnings say which limits the day goes over; empty when it fits
+	Warnings []string `json:"warnings"`
+}
+
+// Overloaded reports whether the day goes over any of the driver's limits
+func (l *RouteLoad) Overloaded() bool {
+	return len(l.Warnings) > 0
+}
+
+// measure works out the day's minutes and checks them and the bags against
+// the driver's capacity
+func (l *RouteLoad) measure() {
+	l.DriveMinutes = l.Stops * routeLegMinutes
+	l.ServiceMinutes = l.Stops * routeServiceMinutes
+	l.TotalMinutes = l.DriveMinutes + l.ServiceMinutes
+	l.Warnings = []string{}
+	if l.Bags > l.Capacity.MaxBags {
+		l.Warnings = append(l.Warnings, fmt.Sprintf("%d bags is over the driver's limit of %d", l.Bags, l.Capacity.MaxBags))
+	}
+	if l.TotalMinutes > l.Capacity.MaxMinutes {
+		l.Warnings = append(l.Warnings, fmt.Sprintf("%d minutes of driving and stops is over the driver's budget of %d", l.TotalMinutes, l.Capacity.MaxMinutes))
+	}
+}
+
+// routeCapacityFor is a driver's capacity given their own limits, falling
+// back to the default for whichever isn't set
+func routeCapacityFor(maxBags, maxMinutes sql.NullInt64) RouteCapacity {
+	capacity := defaultRouteCapacity()
+	if maxBags.Valid {
+		capacity.MaxBags = int(maxBags.Int64)
+	}
+	if maxMinutes.Valid {
+		capacity.MaxMinutes = int(maxMinutes.Int64)
+	}
+	return capacity
+}
+
+// driverRouteCapacity looks up a driver's capacity
+func driverRouteCapacity(q queryRower, driverID int) (RouteCapacity, error) {
+	var maxBags, maxMinutes sql.NullInt64
+	err := q.QueryRow("SELECT route_max_bags, route_max_minutes FROM users WHERE id = $1", driverID).Scan(&maxBags, &maxMinutes)
+	if err != nil {
+		return RouteCapacity{}, err
+	}
+	return routeCapacityFor(maxBags, maxMinutes), nil
+}
+
+// orderBagsSQL counts an order's bags: its lines for bag services
+const orderBagsSQL = `(SELECT COALESCE(SUM(oi.quantity), 0) FROM order_items oi
+	WHERE oi.order_id = %s AND oi.service_id IN (SELECT service_id FROM bag_pricing))`
+
+// lockDriverLoad holds the driver until tx ends, so concurrent assignments
+// to their routes can't each pass the capacity check on a load that doesn't
+// count the other. Every path that adds stops to a driver's day takes it
+// before measuring the load. The driver's row is locked rather than their
+// routes so days with no routes yet are covered too.
+func lockDriverLoad(tx *sql.Tx, driverID int) error {
+	_, err := tx.Exec("SELECT id FROM users WHERE id = $1 FOR UPDATE", driverID)
+	return err
+}
+
+// driverDayLoad measures a driver's load on routeDate if they also took
+// orderIDs' stops. Stops on cancelled routes don't count.
+func driverDayLoad(q queryRower, driverID int, routeDate string, orderIDs []int) (*RouteLoad, error) {
+	capacity, err := driverRouteCapacity(q, driverID)
+	if err != nil {
+		return nil, err
+	}
+	load := &RouteLoad{DriverID: driverID, RouteDate: routeDate, Capacity: capacity}
+	err = q.QueryRow(`
+		WITH stops AS (
+			SELECT ro.order_id FROM route_orders ro
+			JOIN driver_routes dr ON ro.route_id = dr.id
+			WHERE dr.driver_id = $1 AND dr.route_date = $2 AND dr.status != 'cancelled'
+			UNION ALL
+			SELECT order_id FROM unnest($3::int[]) AS order_id
+		)
+		SELECT COUNT(*), COALESCE(SUM(`+fmt.Sprintf(orderBagsSQL, "stops.order_id")+`), 0)
+		FROM stops`,
+		driverID, routeDate, pq.Array(orderIDs),
+	).Scan(&load.Stops, &load.Bags)
+	if err != nil {
+		return nil, err
+	}
+	load.measure()
+	return load, nil
+}
+
+// writeRouteOverloaded rejects an assignment that would put a driver over
+// capacity; the admin can resend it with allow_overload to go ahead anyway
+func writeRouteOverloaded(w http.ResponseWriter, load *RouteLoad) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "Route exceeds the driver's capacity",
+		"message": "Move some stops to another driver, or send allow_overload to assign them anyway.",
+		"load":    load,
+	})
+}
+
+// alertRouteOverloaded puts an overloaded route an admin accepted in the
+// inbox, so dispatch can rebalance it before the day
+func alertRouteOverloaded(q execer, routeID int, load *RouteLoad) {
+	logAdminAlert(q, AdminAlert{
+		Type:      routeOverloadedAlertType,
+		Severity:  "warning",
+		Title:     fmt.Sprintf("Route #%d is over its driver's capacity", routeID),
+		Message:   fmt.Sprintf("Driver %d on %s: %s", load.DriverID, load.RouteDate, strings.Join(load.Warnings, "; ")),
+		DedupeKey: fmt.Sprintf("%s:%d", routeOverloadedAlertType, routeID),
+		Data:      map[string]interface{}{"route_id": routeID, "load": load},
+	})
+}
+
+// handleSetDriverCapacity sets how many bags and minutes a driver can take
+// on in a day. Sending null for either goes back to the default.
+func (h *AdminHandler) handleSetDriverCapacity(w http.ResponseWriter, r *http.Request) {
+	driverID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid driver ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		MaxBags    *int `json:"max_bags"`
+		MaxMinutes *int `json:"max_minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if (req.MaxBags != nil && *req.MaxBags <= 0) || (req.MaxMinutes != nil && *req.MaxMinutes <= 0) {
+		http.Error(w, "max_bags and max_minutes must be positive", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE users SET route_max_bags = $1, route_max_minutes = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3 AND role = 'driver'`,
+		req.MaxBags, req.MaxMinutes, driverID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update driver", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+
+	capacity, err := driverRouteCapacity(h.db, driverID)
+	if err != nil {
+		http.Error(w, "Failed to fetch driver", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capacity)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRouteLoadMeasure(t *testing.T) {
+	t.Setenv("ROUTE_MAX_BAGS", "")
+	t.Setenv("ROUTE_MAX_MINUTES", "")
+	if capacity := defaultRouteCapacity(); capacity.MaxBags != 40 || capacity.MaxMinutes != 480 {
+		t.Errorf("Unexpected default capacity %+v", capacity)
+	}
+
+	load := &RouteLoad{Stops: 4, Bags: 10, Capacity: RouteCapacity{MaxBags: 10, MaxMinutes: 100}}
+	load.measure()
+	if load.DriveMinutes != 4*routeLegMinutes || load.ServiceMinutes != 4*routeServiceMinutes || load.TotalMinutes != 100 {
+		t.Errorf("Unexpected minutes %+v", load)
+	}
+	if load.Overloaded() {
+		t.Errorf("Expected a day right at capacity to fit, got %v", load.Warnings)
+	}
+
+	load.Stops, load.Bags = 5, 11
+	load.measure()
+	if len(load.Warnings) != 2 {
+		t.Errorf("Expected both limits exceeded, got %v", load.Warnings)
+	}
+
+	t.Setenv("ROUTE_MAX_BAGS", "12")
+	t.Setenv("ROUTE_MAX_MINUTES", "-5")
+	if capacity := defaultRouteCapacity(); capacity.MaxBags != 12 || capacity.MaxMinutes != 480 {
+		t.Errorf("Expected ROUTE_MAX_BAGS used and a bad ROUTE_MAX_MINUTES ignored, got %+v", capacity)
+	}
+}
+
+func TestRouteCapacity_AssignAndBatch(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "dispatch@example.com", "Dispatch", "Admin")
+	handler := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	driverID := db.CreateTestUser(t, "small-van@example.com", "Small", "Van")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	db.CompleteTestDriverOnboarding(t, driverID)
+
+	w := httptest.NewRecorder()
+	handler.handleSetDriverCapacity(w, mux.SetURLVars(
+		httptest.NewRequest("PUT", "/api/v1/admin/drivers/x/capacity", bytes.NewBufferString(`{"max_bags": 5, "max_minutes": null}`)),
+		map[string]string{"id": fmt.Sprint(driverID)},
+	))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	customerID := db.CreateTestUser(t, "bags@example.com", "Many", "Bags")
+	addressID := db.CreateTestAddress(t, customerID)
+	standardBagID := db.GetServiceID(t, "standard_bag")
+	order := func(bags int) int {
+		orderID := db.CreateTestOrder(t, customerID, addressID)
+		db.Exec("INSERT INTO order_items (order_id, service_id, quantity, price_cents) VALUES ($1, $2, $3, 3000)", orderID, standardBagID, bags)
+		return orderID
+	}
+	first, second, third := order(2), order(2), order(3)
+
+	assign := func(orderIDs []int, allowOverload bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"driver_id":      driverID,
+			"order_ids":      orderIDs,
+			"route_date":     "2026-11-02",
+			"route_type":     "pickup",
+			"allow_overload": allowOverload,
+		})
+		w := httptest.NewRecorder()
+		handler.handleAssignDriverToRoute(w, httptest.NewRequest("POST", "/api/v1/admin/routes/assign", bytes.NewBuffer(body)))
+		return w
+	}
+
+	w = assign([]int{first, second}, false)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var created struct {
+		RouteID int       `json:"route_id"`
+		Load    RouteLoad `json:"load"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.Load.Bags != 4 || created.Load.Stops != 2 || created.Load.Capacity.MaxBags != 5 {
+		t.Errorf("Unexpected load %+v", created.Load)
+	}
+
+	// A batch can't push the route over the van's five bags
+	body, _ := json.Marshal(BatchRequest{Actions: []BatchAction{{Type: "assign_route", OrderID: third, RouteID: created.RouteID}}})
+	w = httptest.NewRecorder()
+	handler.handleAdminBatch(w, httptest.NewRequest("POST", "/api/v1/admin/batch", bytes.NewBuffer(body)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d adding bags past capacity, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+
+	// Neither can a second route the same day, unless dispatch accepts it
+	w = assign([]int{third}, false)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	var rejected struct {
+		Load RouteLoad `json:"load"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &rejected)
+	if rejected.Load.Bags != 7 || len(rejected.Load.Warnings) != 1 {
+		t.Errorf("Expected the day's seven bags reported, got %+v", rejected.Load)
+	}
+
+	w = assign([]int{third}, true)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	var acceptedBy, alerts int
+	db.QueryRow("SELECT overload_accepted_by FROM driver_routes WHERE id = $1", created.RouteID).Scan(&acceptedBy)
+	db.QueryRow("SELECT COUNT(*) FROM admin_inbox_items WHERE alert_type = $1", routeOverloadedAlertType).Scan(&alerts)
+	if acceptedBy != adminID || alerts != 1 {
+		t.Errorf("Expected the accepted overload recorded and raised, got accepted_by %d and %d alerts", acceptedBy, alerts)
+	}
+
+	// Suggestions rank a driver with room ahead of the full one
+	roomyID := db.CreateTestUser(t, "big-van@example.com", "Big", "Van")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", roomyID)
+	db.CompleteTestDriverOnboarding(t, roomyID)
+	suggestions, err := suggestDrivers(db.DB, []int{order(1)}, "2026-11-02", "pickup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suggestions) != 2 || suggestions[0].DriverID != roomyID || !suggestions[1].Load.Overloaded() {
+		t.Errorf("Expected the driver with room first, got %+v", suggestions)
+	}
+}
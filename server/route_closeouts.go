@@ -0,0 +1,581 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tumble-backend/pdf"
+
+	"github.com/gorilla/mux"
+)
+
+// A cash tip above this is more likely a typo than a tip
+const maxCashTip = 500.0
+
+// routeNotClosedOutAlertType is raised for routes worked on an earlier day
+// that nobody closed out
+const routeNotClosedOutAlertType = "route_not_closed_out"
+
+type RouteCloseoutRequest struct {
+	// BagsConfirmed says every bag on the route's completed stops was handed
+	// over: to customers on a delivery route, to the facility on a pickup one
+	BagsConfirmed  bool                 `json:"bags_confirmed"`
+	RemainingItems []RouteRemainingItem `json:"remaining_items,omitempty"`
+	CashTips       []RouteCashTip       `json:"cash_tips,omitempty"`
+	Notes          *string              `json:"notes,omitempty"`
+}
+
+// RouteRemainingItem is something the driver still had at close-out
+type RouteRemainingItem struct {
+	OrderID     int    `json:"order_id"`
+	Bags        int    `json:"bags"`
+	Description string `json:"description"`
+}
+
+// RouteCashTip is a tip a customer handed the driver in cash
+type RouteCashTip struct {
+	OrderID int     `json:"order_id"`
+	Amount  float64 `json:"amount"`
+}
+
+// CloseoutStop is a stop as the close-out report shows it
+type CloseoutStop struct {
+	OrderID     int     `json:"order_id"`
+	OrderNumber string  `json:"order_number"`
+	Status      string  `json:"status"`
+	Bags        int     `json:"bags"`
+	Notes       *string `json:"notes,omitempty"`
+}
+
+// RouteCloseoutReport is the facility and ops summary of a closed-out route
+type RouteCloseoutReport struct {
+	RouteID        int        `json:"route_id"`
+	RouteDate      string     `json:"route_date"`
+	RouteType      string     `json:"route_type"`
+	DriverID       int        `json:"driver_id"`
+	DriverName     string     `json:"driver_name"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	EndedAt        *time.Time `json:"ended_at,omitempty"`
+	ClosedAt       time.Time  `json:"closed_at"`
+	StopsCompleted int        `json:"stops_completed"`
+	StopsFailed    int        `json:"stops_failed"`
+	// BagsExpected is the bags on completed stops. BagsReturned come back to
+	// the facility: a failed delivery's bags plus anything left over.
+	BagsExpected        int                  `json:"bags_expected"`
+	BagsReturned        int                  `json:"bags_returned"`
+	BagsConfirmed       bool                 `json:"bags_confirmed"`
+	FailedStops         []CloseoutStop       `json:"failed_stops"`
+	RemainingItems      []RouteRemainingItem `json:"remaining_items"`
+	OnlineTips          float64              `json:"online_tips"`
+	CashTips            float64              `json:"cash_tips"`
+	CashTipsByOrder     []RouteCashTip       `json:"cash_tips_by_order"`
+	Notes               *string              `json:"notes,omitempty"`
+	NeedsFacilityReview bool                 `json:"needs_facility_review"`
+}
+
+// buildCloseoutReport summarizes a route's stops for close-out. Items and
+// tips are the driver's, already checked against the route.
+func buildCloseoutReport(q queryer, routeID int, remaining []RouteRemainingItem, cashTips []RouteCashTip) (*RouteCloseoutReport, map[int]CloseoutStop, error) {
+	rows, err := q.Query(`
+		SELECT dr.route_date::text, dr.route_type, dr.driver_id, u.first_name || ' ' || u.last_name,
+		       dr.actual_start_time, dr.actual_end_time,
+		       ro.status, o.id, CONCAT('TUM-', EXTRACT(YEAR FROM o.created_at), '-', LPAD(o.id::text, 3, '0')),
+		       (SELECT COALESCE(SUM(quantity), 0) FROM order_items WHERE order_id = o.id),
+		       ro.notes, COALESCE(o.tip_cents, 0)
+		FROM driver_routes dr
+		JOIN users u ON u.id = dr.driver_id
+		JOIN route_orders ro ON ro.route_id = dr.id
+		JOIN orders o ON o.id = ro.order_id
+		WHERE dr.id = $1
+		ORDER BY ro.sequence_number, ro.id`,
+		routeID,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	report := &RouteCloseoutReport{
+		RouteID:         routeID,
+		FailedStops:     []CloseoutStop{},
+		RemainingItems:  remaining,
+		CashTipsByOrder: cashTips,
+		ClosedAt:        time.Now(),
+	}
+	stops := map[int]CloseoutStop{}
+	onlineTipCents := 0
+	for rows.Next() {
+		var stop CloseoutStop
+		var startedAt, endedAt sql.NullTime
+		var notes sql.NullString
+		var tipCents int
+		if err := rows.Scan(&report.RouteDate, &report.RouteType, &report.DriverID, &report.DriverName,
+			&startedAt, &endedAt, &stop.Status, &stop.OrderID, &stop.OrderNumber, &stop.Bags, &notes, &tipCents); err != nil {
+			return nil, nil, err
+		}
+		if startedAt.Valid {
+			report.StartedAt = &startedAt.Time
+		}
+		if endedAt.Valid {
+			report.EndedAt = &endedAt.Time
+		}
+		if notes.Valid {
+			stop.Notes = &notes.String
+		}
+		stops[stop.OrderID] = stop
+
+		switch stop.Status {
+		case "completed":
+			report.StopsCompleted++
+			report.BagsExpected += stop.Bags
+			// Online tips go with the delivery, as in driver payouts
+			if report.RouteType == "delivery" {
+				onlineTipCents += tipCents
+			}
+		case "failed":
+			report.StopsFailed++
+			report.FailedStops = append(report.FailedStops, stop)
+			// Undelivered bags ride back to the facility
+			if report.RouteType == "delivery" {
+				report.BagsReturned += stop.Bags
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(stops) == 0 {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	cashTipCents := 0
+	for _, tip := range cashTips {
+		cashTipCents += dollarsToCents(tip.Amount)
+	}
+	for _, item := range remaining {
+		report.BagsReturned += item.Bags
+	}
+	report.OnlineTips = centsToDollars(onlineTipCents)
+	report.CashTips = centsToDollars(cashTipCents)
+	report.NeedsFacilityReview = len(remaining) > 0 || report.BagsReturned > 0
+	return report, stops, nil
+}
+
+// validateCloseout checks the driver's items and tips against the route's
+// stops. Tips can only be on stops the driver made.
+func validateCloseout(req *RouteCloseoutRequest, stops map[int]CloseoutStop) error {
+	if !req.BagsConfirmed && len(req.RemainingItems) == 0 {
+		return fmt.Errorf("List the items that weren't handed over, or confirm every bag was")
+	}
+	for i, item := range req.RemainingItems {
+		if _, ok := stops[item.OrderID]; !ok {
+			return fmt.Errorf("Order %d isn't on this route", item.OrderID)
+		}
+		req.RemainingItems[i].Description = strings.TrimSpace(item.Description)
+		if req.RemainingItems[i].Description == "" {
+			return fmt.Errorf("Describe what's left over from order %d", item.OrderID)
+		}
+		if item.Bags < 0 {
+			return fmt.Errorf("Bags can't be negative")
+		}
+	}
+	seen := map[int]bool{}
+	for _, tip := range req.CashTips {
+		stop, ok := stops[tip.OrderID]
+		if !ok || stop.Status != "completed" {
+			return fmt.Errorf("Order %d isn't a completed stop on this route", tip.OrderID)
+		}
+		if seen[tip.OrderID] {
+			return fmt.Errorf("Order %d has more than one cash tip", tip.OrderID)
+		}
+		seen[tip.OrderID] = true
+		if tip.Amount <= 0 || tip.Amount > maxCashTip {
+			return fmt.Errorf("Cash tips must be between $0 and $%.0f", maxCashTip)
+		}
+	}
+	return nil
+}
+
+// handleCloseOutRoute is the driver's end of day on a route: they confirm
+// the bags were handed over or say what's left, report cash tips, and the
+// route is completed and locked. The report goes to the facility and ops,
+// with an alert when there's something for the facility to check in.
+func (h *DriverRouteHandler) handleCloseOutRoute(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	var req RouteCloseoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Notes != nil {
+		trimmed := strings.TrimSpace(*req.Notes)
+		req.Notes = &trimmed
+		if trimmed == "" {
+			req.Notes = nil
+		}
+	}
+	if req.RemainingItems == nil {
+		req.RemainingItems = []RouteRemainingItem{}
+	}
+	if req.CashTips == nil {
+		req.CashTips = []RouteCashTip{}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var routeDriverID sql.NullInt64
+	var status string
+	var closedOutAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT driver_id, status, closed_out_at FROM driver_routes WHERE id = $1 FOR UPDATE`,
+		routeID,
+	).Scan(&routeDriverID, &status, &closedOutAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch route", http.StatusInternalServerError)
+		return
+	}
+	if !routeDriverID.Valid || int(routeDriverID.Int64) != driverID {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	if closedOutAt.Valid {
+		http.Error(w, "Route is already closed out", http.StatusConflict)
+		return
+	}
+	if status != "in_progress" && status != "completed" {
+		http.Error(w, fmt.Sprintf("A %s route can't be closed out", status), http.StatusConflict)
+		return
+	}
+
+	var pendingStops int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM route_orders WHERE route_id = $1 AND status = 'pending'", routeID).Scan(&pendingStops); err != nil {
+		http.Error(w, "Failed to check route stops", http.StatusInternalServerError)
+		return
+	}
+	if pendingStops > 0 {
+		http.Error(w, "Finish or fail every stop before closing out", http.StatusConflict)
+		return
+	}
+
+	_, stops, err := buildCloseoutReport(tx, routeID, nil, nil)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route has no stops", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to build close-out report", http.StatusInternalServerError)
+		return
+	}
+	if err := validateCloseout(&req, stops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Same as completing the route, including any break left running
+	_, err = tx.Exec(`
+		WITH ended AS (
+			UPDATE route_breaks SET actual_end = CURRENT_TIMESTAMP
+			WHERE route_id = $1 AND actual_start IS NOT NULL AND actual_end IS NULL
+		)
+		UPDATE driver_routes
+		SET status = 'completed', actual_end_time = COALESCE(actual_end_time, CURRENT_TIMESTAMP),
+		    closed_out_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		routeID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to close out route", http.StatusInternalServerError)
+		return
+	}
+
+	report, _, err := buildCloseoutReport(tx, routeID, req.RemainingItems, req.CashTips)
+	if err != nil {
+		http.Error(w, "Failed to build close-out report", http.StatusInternalServerError)
+		return
+	}
+	report.BagsConfirmed = req.BagsConfirmed
+	report.Notes = req.Notes
+	reportJSON, _ := json.Marshal(report)
+
+	var closeoutID int
+	err = tx.QueryRow(`
+		INSERT INTO route_closeouts (route_id, driver_id, bags_expected, bags_returned, all_bags_confirmed,
+			cash_tips_cents, notes, report)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`,
+		routeID, driverID, report.BagsExpected, report.BagsReturned, req.BagsConfirmed,
+		dollarsToCents(report.CashTips), req.Notes, reportJSON,
+	).Scan(&closeoutID)
+	if err != nil {
+		http.Error(w, "Failed to close out route", http.StatusInternalServerError)
+		return
+	}
+	for _, item := range req.RemainingItems {
+		if _, err := tx.Exec(`
+			INSERT INTO route_closeout_items (closeout_id, order_id, bags, description)
+			VALUES ($1, $2, $3, $4)`,
+			closeoutID, item.OrderID, item.Bags, item.Description,
+		); err != nil {
+			http.Error(w, "Failed to record remaining items", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO order_status_history (order_id, status, notes, updated_by)
+			SELECT id, status, $2, $3 FROM orders WHERE id = $1`,
+			item.OrderID, fmt.Sprintf("Driver still had %s at close-out: %s", pluralize(item.Bags, "bag"), item.Description), driverID,
+		); err != nil {
+			http.Error(w, "Failed to record remaining items", http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, tip := range req.CashTips {
+		if _, err := tx.Exec(`
+			INSERT INTO route_cash_tips (route_id, order_id, driver_id, amount_cents)
+			VALUES ($1, $2, $3, $4)`,
+			routeID, tip.OrderID, driverID, dollarsToCents(tip.Amount),
+		); err != nil {
+			http.Error(w, "Failed to record cash tips", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to close out route", http.StatusInternalServerError)
+		return
+	}
+	refreshDriverStatsAfter(h.db, driverID, "route close-out")
+
+	if report.NeedsFacilityReview {
+		severity := "info"
+		if len(req.RemainingItems) > 0 {
+			severity = "warning"
+		}
+		logAdminAlert(h.db, AdminAlert{
+			Type:     "route_closeout_returns",
+			Severity: severity,
+			Title:    fmt.Sprintf("Route #%d is bringing %s back", routeID, pluralize(report.BagsReturned, "bag")),
+			Message: fmt.Sprintf("%s from failed stops and %d left-over items to check in at the facility",
+				pluralize(report.StopsFailed, "stop"), len(req.RemainingItems)),
+			DedupeKey: fmt.Sprintf("route_closeout_returns:%d", routeID),
+			Data:      map[string]interface{}{"route_id": routeID, "closeout_id": closeoutID},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// getRouteCloseout loads the report saved when a route was closed out
+func getRouteCloseout(db *sql.DB, routeID int) (*RouteCloseoutReport, error) {
+	var reportJSON []byte
+	if err := db.QueryRow("SELECT report FROM route_closeouts WHERE route_id = $1", routeID).Scan(&reportJSON); err != nil {
+		return nil, err
+	}
+	var report RouteCloseoutReport
+	if err := json.Unmarshal(reportJSON, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// loadRouteCloseout fetches the close-out report for the route in the URL,
+// writing the error response itself when there isn't one
+func (h *RouteManifestHandler) loadRouteCloseout(w http.ResponseWriter, r *http.Request) (*RouteCloseoutReport, bool) {
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return nil, false
+	}
+	report, err := getRouteCloseout(h.db, routeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route hasn't been closed out", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch close-out report", http.StatusInternalServerError)
+		return nil, false
+	}
+	return report, true
+}
+
+func (h *RouteManifestHandler) handleGetRouteCloseout(w http.ResponseWriter, r *http.Request) {
+	report, ok := h.loadRouteCloseout(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleGetRouteCloseoutPDF is the close-out report printed for the facility
+func (h *RouteManifestHandler) handleGetRouteCloseoutPDF(w http.ResponseWriter, r *http.Request) {
+	report, ok := h.loadRouteCloseout(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"route-%d-closeout.pdf\"", report.RouteID))
+	w.Write(renderCloseoutReport(report))
+}
+
+// renderCloseoutReport prints the close-out for the facility: the totals,
+// then what's coming back and the cash tips, with lines to sign on check-in
+func renderCloseoutReport(report *RouteCloseoutReport) []byte {
+	title := fmt.Sprintf("Route #%d close-out", report.RouteID)
+	doc := pdf.New(title)
+	doc.AddPage()
+	right := pdf.PageWidth - manifestMargin
+
+	y := manifestMargin + 16
+	doc.Text(manifestMargin, y, 18, true, "Route Close-out")
+	doc.Text(manifestRightColX, y, 12, true, fmt.Sprintf("Route #%d", report.RouteID))
+	y += 20
+	doc.Text(manifestMargin, y, 10, false, fmt.Sprintf("%s route on %s  -  Driver: %s", titleCase(report.RouteType), report.RouteDate, report.DriverName))
+	doc.Text(manifestRightColX, y, 10, false, "Closed "+report.ClosedAt.Format("Jan 2 3:04 PM"))
+	y += 10
+	doc.Line(manifestMargin, y, right, y, 1)
+	y += 22
+
+	confirmed := "No"
+	if report.BagsConfirmed {
+		confirmed = "Yes"
+	}
+	for _, line := range []string{
+		fmt.Sprintf("Stops: %d completed, %d failed", report.StopsCompleted, report.StopsFailed),
+		fmt.Sprintf("Bags handed over: %d  -  Driver confirmed all: %s", report.BagsExpected, confirmed),
+		fmt.Sprintf("Bags coming back to the facility: %d", report.BagsReturned),
+		fmt.Sprintf("Tips: $%.2f online, $%.2f cash", report.OnlineTips, report.CashTips),
+	} {
+		doc.Text(manifestMargin, y, 11, false, line)
+		y += 16
+	}
+
+	section := func(heading string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		y += 10
+		if y+30 > manifestBottom {
+			doc.AddPage()
+			y = manifestMargin + 12
+		}
+		doc.Text(manifestMargin, y, 12, true, heading)
+		y += 16
+		for _, line := range lines {
+			for _, wrapped := range pdf.Wrap(line, manifestNoteChars) {
+				if y > manifestBottom {
+					doc.AddPage()
+					y = manifestMargin + 12
+				}
+				doc.Text(manifestMargin+16, y, 10, false, wrapped)
+				y += 13
+			}
+		}
+	}
+
+	var failed, remaining, tips []string
+	for _, stop := range report.FailedStops {
+		line := fmt.Sprintf("%s  -  %s", stop.OrderNumber, pluralize(stop.Bags, "bag"))
+		if stop.Notes != nil && *stop.Notes != "" {
+			line += "  -  " + *stop.Notes
+		}
+		failed = append(failed, line)
+	}
+	for _, item := range report.RemainingItems {
+		remaining = append(remaining, fmt.Sprintf("Order #%d  -  %s  -  %s", item.OrderID, pluralize(item.Bags, "bag"), item.Description))
+	}
+	for _, tip := range report.CashTipsByOrder {
+		tips = append(tips, fmt.Sprintf("Order #%d  -  $%.2f", tip.OrderID, tip.Amount))
+	}
+	section("Failed stops", failed)
+	section("Left over with the driver", remaining)
+	section("Cash tips", tips)
+	if report.Notes != nil {
+		section("Driver notes", []string{*report.Notes})
+	}
+
+	if y+manifestSignatureY+20 > manifestBottom {
+		doc.AddPage()
+		y = manifestMargin + 12
+	}
+	y += manifestSignatureY
+	doc.Line(manifestMargin, y, 300, y, 0.5)
+	doc.Line(320, y, right, y, 0.5)
+	y += 9
+	doc.Text(manifestMargin, y, 7, false, "Checked in by")
+	doc.Text(320, y, 7, false, "Bags received")
+
+	for page := 1; page <= doc.PageCount(); page++ {
+		doc.SetPage(page)
+		doc.Text(manifestRightColX, manifestFooterY, 8, false, fmt.Sprintf("Page %d of %d", page, doc.PageCount()))
+	}
+	return doc.Bytes()
+}
+
+// processRouteCloseoutReminders raises routes from before today that were
+// worked but never closed out, so they don't linger half-finished
+func (s *AutoScheduler) processRouteCloseoutReminders() {
+	rows, err := s.db.Query(`
+		SELECT dr.id, dr.route_date::text, dr.status, dr.driver_id
+		FROM driver_routes dr
+		WHERE dr.route_date < CURRENT_DATE AND dr.closed_out_at IS NULL
+		  AND (dr.status = 'in_progress' OR (dr.status = 'completed' AND dr.route_date >= CURRENT_DATE - 7))`,
+	)
+	if err != nil {
+		log.Printf("Error finding routes to close out: %v", err)
+		return
+	}
+	type lingering struct {
+		routeID  int
+		date     string
+		status   string
+		driverID sql.NullInt64
+	}
+	var routes []lingering
+	for rows.Next() {
+		var l lingering
+		if err := rows.Scan(&l.routeID, &l.date, &l.status, &l.driverID); err != nil {
+			rows.Close()
+			log.Printf("Error finding routes to close out: %v", err)
+			return
+		}
+		routes = append(routes, l)
+	}
+	rows.Close()
+
+	for _, l := range routes {
+		logAdminAlert(s.db, AdminAlert{
+			Type:      routeNotClosedOutAlertType,
+			Severity:  "warning",
+			Title:     fmt.Sprintf("Route #%d from %s was never closed out", l.routeID, l.date),
+			Message:   fmt.Sprintf("The route is %s with no close-out; its bags and cash tips haven't been reconciled", strings.ReplaceAll(l.status, "_", " ")),
+			DedupeKey: fmt.Sprintf("%s:%d", routeNotClosedOutAlertType, l.routeID),
+			Data:      map[string]interface{}{"route_id": l.routeID, "driver_id": l.driverID.Int64},
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRouteCloseout(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "closeout-driver@example.com", "Closeout", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "closeout-customer@example.com", "Closeout", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	delivered := db.CreateTestOrder(t, customerID, addressID)
+	failed := db.CreateTestOrder(t, customerID, addressID)
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status, actual_start_time)
+		VALUES ($1, CURRENT_DATE, 'delivery', 'in_progress', CURRENT_TIMESTAMP - INTERVAL '4 hours') RETURNING id`, driverID).Scan(&routeID)
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number, status) VALUES ($1, $2, 1, 'completed'), ($1, $3, 2, 'failed')",
+		routeID, delivered, failed)
+
+	handler := &DriverRouteHandler{db: db.DB, getUserID: CreateAuthMock(driverID).getUserIDFromRequest}
+	closeOut := func(req RouteCloseoutRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		handler.handleCloseOutRoute(w, mux.SetURLVars(
+			httptest.NewRequest("POST", "/api/v1/driver/routes/x/close-out", bytes.NewBuffer(body)),
+			map[string]string{"id": fmt.Sprint(routeID)},
+		))
+		return w
+	}
+
+	if w := closeOut(RouteCloseoutRequest{}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d with bags neither confirmed nor listed, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := closeOut(RouteCloseoutRequest{BagsConfirmed: true, CashTips: []RouteCashTip{{OrderID: failed, Amount: 5}}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a cash tip on a failed stop, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w := closeOut(RouteCloseoutRequest{
+		RemainingItems: []RouteRemainingItem{{OrderID: delivered, Bags: 1, Description: "  Duvet that didn't fit the bag  "}},
+		CashTips:       []RouteCashTip{{OrderID: delivered, Amount: 7.5}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var report RouteCloseoutReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.StopsCompleted != 1 || report.StopsFailed != 1 || report.CashTips != 7.5 ||
+		report.RemainingItems[0].Description != "Duvet that didn't fit the bag" || !report.NeedsFacilityReview {
+		t.Errorf("Unexpected close-out report: %s", w.Body.String())
+	}
+
+	var status string
+	var closed bool
+	db.QueryRow("SELECT status, closed_out_at IS NOT NULL FROM driver_routes WHERE id = $1", routeID).Scan(&status, &closed)
+	if status != "completed" || !closed {
+		t.Errorf("Expected the route completed and closed out, got %s (closed out: %v)", status, closed)
+	}
+	var alerts int
+	db.QueryRow("SELECT COUNT(*) FROM admin_inbox_items WHERE dedupe_key = $1", fmt.Sprintf("route_closeout_returns:%d", routeID)).Scan(&alerts)
+	if alerts != 1 {
+		t.Errorf("Expected one alert for the facility, got %d", alerts)
+	}
+	if w := closeOut(RouteCloseoutRequest{BagsConfirmed: true}); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d closing out twice, got %d", http.StatusConflict, w.Code)
+	}
+
+	manifests := &RouteManifestHandler{db: db.DB}
+	w = httptest.NewRecorder()
+	manifests.handleGetRouteCloseoutPDF(w, mux.SetURLVars(
+		httptest.NewRequest("GET", "/api/v1/admin/routes/x/closeout.pdf", nil),
+		map[string]string{"id": fmt.Sprint(routeID)},
+	))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "%PDF") {
+		t.Errorf("Expected the close-out PDF, got %d", w.Code)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"tumble-backend/pdf"
+
+	"github.com/gorilla/mux"
+)
+
+// RouteManifestHandler prints routes as paper manifests, a backup for drivers
+// whose phones die mid-route or who prefer working from a clipboard
+type RouteManifestHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewRouteManifestHandler(db *sql.DB) *RouteManifestHandler {
+	return &RouteManifestHandler{db: db, getUserID: getUserIDFromRequest}
+}
+
+// RouteManifest is a route's stops in driving order, printed for the
+// clipboard or served to the driver app as JSON
+type RouteManifest struct {
+	RouteID    int            `json:"route_id"`
+	RouteDate  string         `json:"route_date"`
+	RouteType  string         `json:"route_type"`
+	Status     string         `json:"status"`
+	DriverID   *int           `json:"-"`
+	DriverName string         `json:"driver_name"`
+	Stops      []ManifestStop `json:"stops"`
+	// Navigation opens Google Maps with the next stops still to do as waypoints
+	Navigation  string    `json:"navigation_url,omitempty"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// ManifestStop is one stop on a printed manifest. The order number doubles as
+// the code written on the customer's bags.
+type ManifestStop struct {
+	Sequence     int             `json:"sequence"`
+	RouteOrderID int             `json:"route_order_id"`
+	OrderID      int             `json:"order_id"`
+	OrderNumber  string          `json:"order_number"`
+	Status       string          `json:"status"`
+	CustomerName string          `json:"customer_name"`
+	Phone        string          `json:"phone"`
+	Address      string          `json:"address"`
+	Location     *LatLng         `json:"location,omitempty"` // Set once the address has been geocoded
+	TimeSlot     string          `json:"time_slot"`
+	ETA          string          `json:"eta,omitempty"` // HH:MM from the route schedule
+	Bags         int             `json:"bags"`
+	Garments     int             `json:"garments"`
+	Instructions []string        `json:"instructions"`
+	CareOptions  []string        `json:"care_options"` // Laundry preferences per line, e.g. "Bedding: hang dry"
+	Navigation   *StopNavigation `json:"navigation,omitempty"`
+}
+
+// StopNavigation deep-links a stop into the phone's maps apps
+type StopNavigation struct {
+	GoogleMaps string `json:"google_maps"`
+	AppleMaps  string `json:"apple_maps"`
+}
+
+// getRouteManifest loads a route and its stops in sequence order. Pickup
+// routes print the pickup address and window, delivery routes the delivery
+// ones, each falling back to the other when unset.
+func getRouteManifest(db *sql.DB, routeID int) (*RouteManifest, error) {
+	manifest := &RouteManifest{RouteID: routeID, GeneratedAt: time.Now()}
+	var driverName sql.NullString
+	err := db.QueryRow(`
+		SELECT dr.route_date::text, COALESCE(dr.route_type, ''), COALESCE(dr.status, ''),
+		       dr.driver_id, u.first_name || ' ' || u.last_name
+		FROM driver_routes dr
+		LEFT JOIN users u ON dr.driver_id = u.id
+		WHERE dr.id = $1`,
+		routeID,
+	).Scan(&manifest.RouteDate, &manifest.RouteType, &manifest.Status, &manifest.DriverID, &driverName)
+	if err != nil {
+		return nil, err
+	}
+	manifest.DriverName = driverName.String
+
+	rows, err := db.Query(`
+		SELECT ro.sequence_number, ro.id, o.id, ro.status,
+		       CONCAT('TUM-', EXTRACT(YEAR FROM o.created_at), '-', LPAD(o.id::text, 3, '0')),
+		       u.first_name || ' ' || u.last_name, COALESCE(u.phone, ''),
+		       COALESCE(a.street_address || ', ' || a.city || ', ' || a.state || ' ' || a.zip_code, ''),
+		       COALESCE(CASE WHEN $2 = 'delivery' THEN o.delivery_time_slot ELSE o.pickup_time_slot END, ''),
+		       (SELECT COALESCE(SUM(quantity), 0) FROM order_items WHERE order_id = o.id),
+		       (SELECT COALESCE(SUM(quantity), 0) FROM order_garments WHERE order_id = o.id),
+		       COALESCE(a.delivery_instructions, ''), COALESCE(o.special_instructions, ''),
+		       COALESCE(o.delivery_instructions, ''),
+		       a.latitude, a.longitude, COALESCE(TO_CHAR(ro.estimated_time, 'HH24:MI'), '')
+		FROM route_orders ro
+		JOIN orders o ON ro.order_id = o.id
+		JOIN users u ON o.user_id = u.id
+		LEFT JOIN addresses a ON a.id = CASE WHEN $2 = 'delivery'
+			THEN COALESCE(o.delivery_address_id, o.pickup_address_id)
+			ELSE COALESCE(o.pickup_address_id, o.delivery_address_id) END
+		WHERE ro.route_id = $1
+		ORDER BY ro.sequence_number`,
+		routeID, manifest.RouteType,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	manifest.Stops = []ManifestStop{}
+	for rows.Next() {
+		var stop ManifestStop
+		var addressNotes, specialInstructions, deliveryInstructions string
+		var lat, lng sql.NullFloat64
+		if err := rows.Scan(&stop.Sequence, &stop.RouteOrderID, &stop.OrderID, &stop.Status, &stop.OrderNumber,
+			&stop.CustomerName, &stop.Phone, &stop.Address, &stop.TimeSlot, &stop.Bags, &stop.Garments,
+			&addressNotes, &specialInstructions, &deliveryInstructions, &lat, &lng, &stop.ETA); err != nil {
+			return nil, err
+		}
+		if lat.Valid && lng.Valid {
+			stop.Location = &LatLng{Latitude: lat.Float64, Longitude: lng.Float64}
+		}
+		stop.Instructions = []string{}
+		for _, note := range []string{addressNotes, deliveryInstructions, specialInstructions} {
+			if note = strings.TrimSpace(note); note != "" {
+				stop.Instructions = append(stop.Instructions, note)
+			}
+		}
+		manifest.Stops = append(manifest.Stops, stop)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	orderIDs := make([]int, len(manifest.Stops))
+	for i, stop := range manifest.Stops {
+		orderIDs[i] = stop.OrderID
+	}
+	care, err := orderCareOptions(db, orderIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range manifest.Stops {
+		manifest.Stops[i].CareOptions = care[manifest.Stops[i].OrderID]
+		if manifest.Stops[i].CareOptions == nil {
+			manifest.Stops[i].CareOptions = []string{}
+		}
+	}
+	return manifest, nil
+}
+
+// redactCustomers blanks every stop's customer details and location
+func (m *RouteManifest) redactCustomers() {
+	for i := range m.Stops {
+		m.Stops[i].CustomerName = ""
+		m.Stops[i].Phone = ""
+		m.Stops[i].Address = ""
+		m.Stops[i].Location = nil
+		m.Stops[i].Instructions = []string{}
+		m.Stops[i].Navigation = nil
+	}
+	m.Navigation = ""
+}
+
+// maxNavigationWaypoints is how many stops Google Maps takes between the
+// origin and destination of a directions link
+const maxNavigationWaypoints = 9
+
+// stopDestination is what a maps app is asked to navigate to: the geocoded
+// point when there is one, which is exact, otherwise the address
+func stopDestination(stop ManifestStop) string {
+	if stop.Location != nil {
+		return strconv.FormatFloat(stop.Location.Latitude, 'f', 6, 64) + "," + strconv.FormatFloat(stop.Location.Longitude, 'f', 6, 64)
+	}
+	return stop.Address
+}
+
+// stopNavigation links a stop to driving directions in Google and Apple Maps
+func stopNavigation(stop ManifestStop) *StopNavigation {
+	destination := stopDestination(stop)
+	if destination == "" {
+		return nil
+	}
+	return &StopNavigation{
+		GoogleMaps: "https://www.google.com/maps/dir/?" + url.Values{
+			"api":         {"1"},
+			"destination": {destination},
+			"travelmode":  {"driving"},
+		}.Encode(),
+		AppleMaps: "https://maps.apple.com/?" + url.Values{
+			"daddr":  {destination},
+			"dirflg": {"d"},
+		}.Encode(),
+	}
+}
+
+// routeNavigationURL is a Google Maps directions link through the route's
+// pending stops in order, from the driver's current location. Routes longer
+// than Google allows get the next stretch; the link is rebuilt as stops are
+// completed.
+func routeNavigationURL(stops []ManifestStop) string {
+	var remaining []string
+	for _, stop := range stops {
+		if stop.Status != "pending" {
+			continue
+		}
+		if destination := stopDestination(stop); destination != "" {
+			remaining = append(remaining, destination)
+		}
+		if len(remaining) == maxNavigationWaypoints+1 {
+			break
+		}
+	}
+	if len(remaining) == 0 {
+		return ""
+	}
+	params := url.Values{
+		"api":         {"1"},
+		"destination": {remaining[len(remaining)-1]},
+		"travelmode":  {"driving"},
+	}
+	if len(remaining) > 1 {
+		params.Set("waypoints", strings.Join(remaining[:len(remaining)-1], "|"))
+	}
+	return "https://www.google.com/maps/dir/?" + params.Encode()
+}
+
+// Manifest layout, in points
+const (
+	manifestMargin     = 40.0
+	manifestFooterY    = pdf.PageHeight - 30
+	manifestBottom     = pdf.PageHeight - 60
+	manifestNoteChars  = 105
+	manifestRightColX  = 430.0
+	manifestSignatureY = 28.0
+)
+
+// renderRouteManifest lays the manifest out one block per stop, each with
+// check boxes and signature and time lines for the driver to fill in. Stops
+// never split across pages.
+func renderRouteManifest(m *RouteManifest) []byte {
+	title := fmt.Sprintf("Route #%d manifest", m.RouteID)
+	doc := pdf.New(title)
+	doc.AddPage()
+	right := pdf.PageWidth - manifestMargin
+
+	bags := 0
+	for _, stop := range m.Stops {
+		bags += stop.Bags
+	}
+
+	y := manifestMargin + 16
+	doc.Text(manifestMargin, y, 18, true, "Route Manifest")
+	doc.Text(manifestRightColX, y, 12, true, fmt.Sprintf("Route #%d", m.RouteID))
+	y += 20
+	driver := m.DriverName
+	if driver == "" {
+		driver = "Unassigned"
+	}
+	doc.Text(manifestMargin, y, 10, false, fmt.Sprintf("%s route on %s  -  Driver: %s", titleCase(m.RouteType), m.RouteDate, driver))
+	doc.Text(manifestRightColX, y, 10, false, fmt.Sprintf("Status: %s", m.Status))
+	y += 14
+	doc.Text(manifestMargin, y, 10, false, fmt.Sprintf("%d stops  -  %d bags total", len(m.Stops), bags))
+	y += 10
+	doc.Line(manifestMargin, y, right, y, 1)
+	y += 22
+
+	if len(m.Stops) == 0 {
+		doc.Text(manifestMargin, y, 11, false, "No stops on this route.")
+	}
+
+	for _, stop := range m.Stops {
+		var notes []string
+		for _, instruction := range stop.Instructions {
+			notes = append(notes, pdf.Wrap(instruction, manifestNoteChars)...)
+		}
+		for _, care := range stop.CareOptions {
+			notes = append(notes, pdf.Wrap("Care: "+care, manifestNoteChars)...)
+		}
+		height := 14 + 13 + 13 + 11*float64(len(notes)) + manifestSignatureY + 22
+		if stop.TimeSlot != "" {
+			height += 12
+		}
+		if y+height > manifestBottom {
+			doc.AddPage()
+			y = manifestMargin + 12
+			doc.Text(manifestMargin, y, 10, true, title+" (continued)")
+			y += 26
+		}
+
+		doc.Text(manifestMargin, y, 12, true, fmt.Sprintf("%d.  %s", stop.Sequence, stop.OrderNumber))
+		contents := pluralize(stop.Bags, "bag")
+		if stop.Garments > 0 {
+			contents += ", " + pluralize(stop.Garments, "garment")
+		}
+		doc.Text(manifestRightColX, y, 11, true, contents)
+		y += 14
+		customer := stop.CustomerName
+		if stop.Phone != "" {
+			customer += "  -  " + stop.Phone
+		}
+		doc.Text(manifestMargin+16, y, 10, false, customer)
+		doc.Text(manifestRightColX, y, 9, false, "[  ] Done    [  ] Failed")
+		y += 13
+		doc.Text(manifestMargin+16, y, 10, false, stop.Address)
+		y += 13
+		if stop.TimeSlot != "" {
+			doc.Text(manifestMargin+16, y, 9, false, "Window: "+stop.TimeSlot)
+			y += 12
+		}
+		for _, line := range notes {
+			doc.Text(manifestMargin+16, y, 9, false, line)
+			y += 11
+		}
+
+		y += manifestSignatureY - 10
+		doc.Line(manifestMargin+16, y, 300, y, 0.5)
+		doc.Line(320, y, 420, y, 0.5)
+		doc.Line(440, y, right, y, 0.5)
+		y += 9
+		doc.Text(manifestMargin+16, y, 7, false, "Signature")
+		doc.Text(320, y, 7, false, "Time")
+		doc.Text(440, y, 7, false, "Bags handed over")
+		y += 22
+	}
+
+	generated := m.GeneratedAt.Format("Jan 2, 2006 3:04 PM")
+	for page := 1; page <= doc.PageCount(); page++ {
+		doc.SetPage(page)
+		doc.Text(manifestMargin, manifestFooterY, 8, false, "Generated "+generated)
+		doc.Text(manifestRightColX, manifestFooterY, 8, false, fmt.Sprintf("Page %d of %d", page, doc.PageCount()))
+	}
+	return doc.Bytes()
+}
+
+func pluralize(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func titleCase(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// handleGetRouteManifest serves a printable PDF manifest for a route
+func (h *RouteManifestHandler) handleGetRouteManifest(w http.ResponseWriter, r *http.Request) {
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	manifest, err := getRouteManifest(h.db, routeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to build manifest", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"route-%d-manifest.pdf\"", routeID))
+	w.Write(renderRouteManifest(manifest))
+}
+
+// handleGetDriverRouteManifest serves one of the driver's routes with its
+// stops in order and everything needed to work them, including navigation
+// links, so the app doesn't have to piece it together
+func (h *RouteManifestHandler) handleGetDriverRouteManifest(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	manifest, err := getRouteManifest(h.db, routeID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to build manifest", http.StatusInternalServerError)
+		return
+	}
+	if manifest.DriverID == nil || *manifest.DriverID != driverID {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Drivers keep the outline of a closed route but not who or where its
+	// customers were, the same as the route list
+	if isClosedRouteStatus(manifest.Status) {
+		manifest.redactCustomers()
+	} else {
+		for i := range manifest.Stops {
+			manifest.Stops[i].Navigation = stopNavigation(manifest.Stops[i])
+		}
+		manifest.Navigation = routeNavigationURL(manifest.Stops)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRenderRouteManifest_Paginates(t *testing.T) {
+	manifest := &RouteManifest{
+		RouteID:     7,
+		RouteDate:   "2026-10-16",
+		RouteType:   "pickup",
+		Status:      "planned",
+		DriverName:  "Dana Driver",
+		GeneratedAt: time.Date(2026, 10, 16, 7, 30, 0, 0, time.UTC),
+	}
+	for i := 1; i <= 12; i++ {
+		manifest.Stops = append(manifest.Stops, ManifestStop{
+			Sequence:     i,
+			OrderNumber:  fmt.Sprintf("TUM-2026-%03d", i),
+			CustomerName: "Casey Customer",
+			Phone:        "555-0100",
+			Address:      "1 Main St, Springfield, IL 62701",
+			TimeSlot:     "9am-12pm",
+			Bags:         2,
+			Instructions: []string{"Gate code (4321). " + strings.Repeat("Leave by the side door. ", 8)},
+		})
+	}
+
+	out := renderRouteManifest(manifest)
+	if !bytes.HasPrefix(out, []byte("%PDF-")) {
+		t.Fatal("Expected a PDF document")
+	}
+	for _, stop := range manifest.Stops {
+		if !bytes.Contains(out, []byte(stop.OrderNumber)) {
+			t.Errorf("Stop %s missing from the manifest", stop.OrderNumber)
+		}
+	}
+	if !bytes.Contains(out, []byte("(12 stops  -  24 bags total)")) {
+		t.Error("Expected the bag total in the header")
+	}
+	if !bytes.Contains(out, []byte(`Gate code \(4321\)`)) {
+		t.Error("Expected escaped instructions on the manifest")
+	}
+
+	pages := bytes.Count(out, []byte("/Type /Page "))
+	if pages < 2 {
+		t.Fatalf("Expected 12 long stops to spill onto more than one page, got %d", pages)
+	}
+	if !bytes.Contains(out, []byte(fmt.Sprintf("(Page %d of %d)", pages, pages))) {
+		t.Errorf("Expected a page %d of %d footer", pages, pages)
+	}
+	if !bytes.Contains(out, []byte("(Route #7 manifest \\(continued\\))")) {
+		t.Error("Expected a continuation header on later pages")
+	}
+}
+
+func TestRouteNavigationURL(t *testing.T) {
+	stops := []ManifestStop{
+		{Sequence: 1, Status: "completed", Address: "1 Done St, Springfield, IL 62701"},
+		{Sequence: 2, Status: "pending", Address: "2 Next St, Springfield, IL 62701", Location: &LatLng{Latitude: 39.7817, Longitude: -89.6501}},
+		{Sequence: 3, Status: "pending", Address: "3 Last St, Springfield, IL 62701"},
+	}
+
+	nav := stopNavigation(stops[1])
+	if nav == nil || nav.GoogleMaps != "https://www.google.com/maps/dir/?api=1&destination=39.781700%2C-89.650100&travelmode=driving" {
+		t.Errorf("Expected a Google Maps link to the stop's coordinates, got %+v", nav)
+	}
+	if nav.AppleMaps != "https://maps.apple.com/?daddr=39.781700%2C-89.650100&dirflg=d" {
+		t.Errorf("Unexpected Apple Maps link %s", nav.AppleMaps)
+	}
+
+	expected := "https://www.google.com/maps/dir/?api=1&destination=3+Last+St%2C+Springfield%2C+IL+62701&travelmode=driving&waypoints=39.781700%2C-89.650100"
+	if got := routeNavigationURL(stops); got != expected {
+		t.Errorf("routeNavigationURL = %s, expected %s", got, expected)
+	}
+
+	for i := 0; i < 15; i++ {
+		stops = append(stops, ManifestStop{Status: "pending", Address: fmt.Sprintf("%d Far St", i)})
+	}
+	if got := routeNavigationURL(stops); strings.Count(got, "%7C") != maxNavigationWaypoints-1 {
+		t.Errorf("Expected the link capped at %d waypoints, got %s", maxNavigationWaypoints, got)
+	}
+	if got := routeNavigationURL(stops[:1]); got != "" {
+		t.Errorf("Expected no link once every stop is done, got %s", got)
+	}
+}
+
+func TestRouteManifest(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "manifest-driver@example.com", "Manifest", "Driver")
+	userID := db.CreateTestUser(t, "manifest@example.com", "Manifest", "Customer")
+	addressID := db.CreateTestAddress(t, userID)
+	orderID := db.CreateTestOrder(t, userID, addressID)
+	db.Exec("UPDATE orders SET special_instructions = 'Dog in yard' WHERE id = $1", orderID)
+	db.Exec(`
+		INSERT INTO order_items (order_id, service_id, quantity, price_cents)
+		VALUES ($1, $2, 3, 3000)`,
+		orderID, db.GetServiceID(t, "standard_bag"),
+	)
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'planned')
+		RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number, status) VALUES ($1, $2, 1, 'pending')", routeID, orderID)
+
+	manifest, err := getRouteManifest(db.DB, routeID)
+	if err != nil {
+		t.Fatalf("Failed to load manifest: %v", err)
+	}
+	if manifest.DriverName != "Manifest Driver" || len(manifest.Stops) != 1 {
+		t.Fatalf("Unexpected manifest %+v", manifest)
+	}
+	stop := manifest.Stops[0]
+	if stop.Bags != 3 || stop.CustomerName != "Manifest Customer" || stop.TimeSlot != "9am-12pm" || stop.Address == "" {
+		t.Errorf("Unexpected stop %+v", stop)
+	}
+	if len(stop.Instructions) == 0 || stop.Instructions[len(stop.Instructions)-1] != "Dog in yard" {
+		t.Errorf("Expected the order's special instructions on the stop, got %q", stop.Instructions)
+	}
+
+	handler := NewRouteManifestHandler(db.DB)
+	request := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/admin/routes/"+id+"/manifest.pdf", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		handler.handleGetRouteManifest(w, req)
+		return w
+	}
+
+	w := request(fmt.Sprintf("%d", routeID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "application/pdf" || !bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF-")) {
+		t.Error("Expected a PDF response")
+	}
+	if w := request("999999"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a missing route, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := request("abc"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a bad route ID, got %d", http.StatusBadRequest, w.Code)
+	}
+	// The driver app gets the same stops as JSON, with navigation links
+	driverRequest := func(asDriver int) *httptest.ResponseRecorder {
+		handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) { return asDriver, nil }
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/driver/routes/x/manifest", nil),
+			map[string]string{"id": fmt.Sprint(routeID)})
+		w := httptest.NewRecorder()
+		handler.handleGetDriverRouteManifest(w, req)
+		return w
+	}
+	if w := driverRequest(userID); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for another driver's route, got %d", http.StatusForbidden, w.Code)
+	}
+	w = driverRequest(driverID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var driverManifest RouteManifest
+	json.Unmarshal(w.Body.Bytes(), &driverManifest)
+	if len(driverManifest.Stops) != 1 || driverManifest.Stops[0].OrderID != orderID {
+		t.Fatalf("Unexpected driver manifest %+v", driverManifest)
+	}
+	if driverManifest.Stops[0].Navigation == nil || driverManifest.Navigation == "" {
+		t.Errorf("Expected navigation links, got %+v", driverManifest)
+	}
+}
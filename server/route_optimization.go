@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// OptimizedStop is one stop of a suggested route, in driving order
+type OptimizedStop struct {
+	Sequence  int    `json:"sequence"`
+	OrderID   int    `json:"order_id"`
+	AddressID int    `json:"address_id"`
+	Address   string `json:"address"`
+	LatLng
+	TravelMinutes int    `json:"travel_minutes"` // From the previous stop, or the depot
+	ETA           string `json:"eta"`            // HH:MM arrival
+}
+
+// OptimizedRoute is the suggested stop order for a set of orders
+type OptimizedRoute struct {
+	RouteType string          `json:"route_type"`
+	StartTime string          `json:"start_time"`
+	Start     *LatLng         `json:"start,omitempty"` // Depot; nil when the route starts at its first stop
+	Stops     []OptimizedStop `json:"stops"`
+	// TotalTravelMinutes is the driving time of the suggested order and
+	// BaselineTravelMinutes that of the orders as they were given
+	TotalTravelMinutes    int    `json:"total_travel_minutes"`
+	BaselineTravelMinutes int    `json:"baseline_travel_minutes"`
+	FinishTime            string `json:"finish_time"`
+	// Breaks the route's labor rules require, with the ETAs after them
+	// pushed back to match
+	Breaks           []RouteBreak `json:"breaks"`
+	TravelTimeSource string       `json:"travel_time_source"` // "osrm" or "estimated"
+	// Orders whose address couldn't be placed on the map aren't routed
+	UnlocatedOrderIDs []int `json:"unlocated_order_ids"`
+}
+
+// maxGeocodesPerRequest bounds how many addresses one optimization request
+// will send to the geocoder; the rest are placed by later requests
+const maxGeocodesPerRequest = 50
+
+// pathTime is the driving time of visiting tour in order, starting from point 0
+func pathTime(matrix [][]time.Duration, tour []int) time.Duration {
+	var total time.Duration
+	prev := 0
+	for _, stop := range tour {
+		total += matrix[prev][stop]
+		prev = stop
+	}
+	return total
+}
+
+// nearestNeighborTour visits points 1..n-1 starting from point 0, always
+// driving to the closest stop not yet visited
+func nearestNeighborTour(matrix [][]time.Duration) []int {
+	visited := make([]bool, len(matrix))
+	tour := make([]int, 0, len(matrix)-1)
+	current := 0
+	for len(tour) < len(matrix)-1 {
+		next := -1
+		for j := 1; j < len(matrix); j++ {
+			if !visited[j] && (next == -1 || matrix[current][j] < matrix[current][next]) {
+				next = j
+			}
+		}
+		visited[next] = true
+		tour = append(tour, next)
+		current = next
+	}
+	return tour
+}
+
+// twoOptTour improves a tour by reversing stretches of it while that makes
+// it shorter. Whole paths are compared since travel times needn't be
+// symmetric.
+func twoOptTour(matrix [][]time.Duration, tour []int) []int {
+	best := append([]int(nil), tour...)
+	bestTime := pathTime(matrix, best)
+	for pass := 0; pass < 50; pass++ {
+		improved := false
+		for i := 0; i < len(best)-1; i++ {
+			for k := i + 1; k < len(best); k++ {
+				candidate := append([]int(nil), best...)
+				for a, b := i, k; a < b; a, b = a+1, b-1 {
+					candidate[a], candidate[b] = candidate[b], candidate[a]
+				}
+				if t := pathTime(matrix, candidate); t < bestTime {
+					best, bestTime, improved = candidate, t, true
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	return best
+}
+
+// planStopOrder returns the order to visit points 1..n-1 in, starting from
+// point 0
+func planStopOrder(matrix [][]time.Duration) []int {
+	if len(matrix) <= 2 {
+		return nearestNeighborTour(matrix)
+	}
+	return twoOptTour(matrix, nearestNeighborTour(matrix))
+}
+
+// routeStopCandidate is an order's stop before it's been put in order
+type routeStopCandidate struct {
+	OrderID   int
+	AddressID int
+	Address   string
+}
+
+// travelMatrix returns driving times between the start and every stop. With
+// no start, point 0 is a free stand-in so the route can begin anywhere.
+func (h *AdminHandler) travelMatrix(ctx context.Context, start *LatLng, stops []LatLng) ([][]time.Duration, string) {
+	points := stops
+	if start != nil {
+		points = append([]LatLng{*start}, stops...)
+	}
+
+	matrix, source := [][]time.Duration(nil), "estimated"
+	if h.travelTimes != nil && len(points) > 1 {
+		var err error
+		matrix, err = h.travelTimes.TravelTimes(ctx, points)
+		if err != nil {
+			log.Printf("Travel time lookup failed, estimating instead: %v", err)
+			matrix = nil
+		} else {
+			source = "osrm"
+		}
+	}
+	if matrix == nil {
+		matrix = estimatedTravelTimes(points)
+	}
+
+	if start == nil {
+		withStart := make([][]time.Duration, len(points)+1)
+		withStart[0] = make([]time.Duration, len(points)+1)
+		for i, row := range matrix {
+			withStart[i+1] = append([]time.Duration{0}, row...)
+		}
+		matrix = withStart
+	}
+	return matrix, source
+}
+
+// optimizeRoute orders the given orders' pickup or delivery stops by driving
+// time and estimates when the driver reaches each one, taking the breaks
+// policy requires along the way
+func (h *AdminHandler) optimizeRoute(ctx context.Context, orderIDs []int, routeType string, startTime time.Time, start *LatLng, policy BreakPolicy) (*OptimizedRoute, error) {
+	addressColumn := "pickup_address_id"
+	if routeType == "delivery" {
+		addressColumn = "delivery_address_id"
+	}
+	rows, err := h.db.Query(`
+		SELECT o.id, a.id, a.street_address || ', ' || a.city || ' ' || a.zip_code
+		FROM unnest($1::int[]) WITH ORDINALITY AS ids(order_id, position)
+		JOIN orders o ON o.id = ids.order_id
+		JOIN addresses a ON a.id = o.`+addressColumn+`
+		ORDER BY ids.position`,
+		pq.Array(orderIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []routeStopCandidate
+	for rows.Next() {
+		var c routeStopCandidate
+		if err := rows.Scan(&c.OrderID, &c.AddressID, &c.Address); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	route := &OptimizedRoute{
+		RouteType:         routeType,
+		StartTime:         startTime.Format("15:04"),
+		Start:             start,
+		Stops:             []OptimizedStop{},
+		Breaks:            []RouteBreak{},
+		UnlocatedOrderIDs: []int{},
+	}
+
+	var located []routeStopCandidate
+	var points []LatLng
+	geocodes := 0
+	for _, c := range candidates {
+		geocoder := h.geocoder
+		if geocodes >= maxGeocodesPerRequest {
+			geocoder = nil
+		}
+		location, geocoded, err := addressLocation(ctx, h.db, geocoder, c.AddressID)
+		if err != nil {
+			log.Printf("Failed to geocode address %d: %v", c.AddressID, err)
+		}
+		if geocoded {
+			geocodes++
+		}
+		if location == nil {
+			route.UnlocatedOrderIDs = append(route.UnlocatedOrderIDs, c.OrderID)
+			continue
+		}
+		located = append(located, c)
+		points = append(points, *location)
+	}
+	if len(located) == 0 {
+		route.FinishTime = route.StartTime
+		return route, nil
+	}
+
+	matrix, source := h.travelMatrix(ctx, start, points)
+	route.TravelTimeSource = source
+
+	baseline := make([]int, len(located))
+	for i := range baseline {
+		baseline[i] = i + 1
+	}
+	tour := planStopOrder(matrix)
+	route.BaselineTravelMinutes = int(pathTime(matrix, baseline).Round(time.Minute).Minutes())
+
+	sequences := make([]int, len(tour))
+	stopMinutes := make([]int, len(tour))
+	prev := 0
+	for i, point := range tour {
+		sequences[i] = i + 1
+		stopMinutes[i] = int(matrix[prev][point].Round(time.Minute).Minutes()) + routeServiceMinutes
+		prev = point
+	}
+	route.Breaks = append(route.Breaks, planStopBreaks(policy, sequences, stopMinutes, nil)...)
+
+	t := startTime
+	prev = 0
+	next := 0
+	var travel time.Duration
+	for i, point := range tour {
+		for ; next < len(route.Breaks) && route.Breaks[next].AfterSequence < sequences[i]; next++ {
+			breakStart := t.Format("15:04")
+			route.Breaks[next].EstimatedStart = &breakStart
+			t = t.Add(time.Duration(route.Breaks[next].DurationMinutes) * time.Minute)
+		}
+		leg := matrix[prev][point]
+		travel += leg
+		t = t.Add(leg)
+		c := located[point-1]
+		route.Stops = append(route.Stops, OptimizedStop{
+			Sequence:      i + 1,
+			OrderID:       c.OrderID,
+			AddressID:     c.AddressID,
+			Address:       c.Address,
+			LatLng:        points[point-1],
+			TravelMinutes: int(leg.Round(time.Minute).Minutes()),
+			ETA:           t.Format("15:04"),
+		})
+		t = t.Add(routeServiceMinutes * time.Minute)
+		prev = point
+	}
+	route.TotalTravelMinutes = int(travel.Round(time.Minute).Minutes())
+	route.FinishTime = t.Format("15:04")
+	return route, nil
+}
+
+// parseRouteStartTime reads an HH:MM start time, defaulting to 08:00
+func parseRouteStartTime(value string) (time.Time, error) {
+	if value == "" {
+		value = "08:00"
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("start_time must be HH:MM")
+	}
+	return t, nil
+}
+
+// validRouteType reports whether routeType names a kind of route
+func validRouteType(routeType string) bool {
+	return routeType == "pickup" || routeType == "delivery"
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stubGeocoder places addresses from a fixed table
+type stubGeocoder struct {
+	locations map[string]LatLng
+	calls     int
+}
+
+func (g *stubGeocoder) Geocode(ctx context.Context, address string) (LatLng, error) {
+	g.calls++
+	location, ok := g.locations[address]
+	if !ok {
+		return LatLng{}, errAddressNotFound
+	}
+	return location, nil
+}
+
+// failingTravelTimes stands in for a routing provider that's down
+type failingTravelTimes struct{}
+
+func (failingTravelTimes) TravelTimes(ctx context.Context, points []LatLng) ([][]time.Duration, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestHaversineKm(t *testing.T) {
+	// Times Square to Prospect Park, roughly 9.6 km apart
+	got := haversineKm(LatLng{40.7580, -73.9855}, LatLng{40.6782, -73.9442})
+	if math.Abs(got-9.6) > 0.5 {
+		t.Errorf("haversineKm = %.2f, expected about 9.6", got)
+	}
+	if got := estimatedTravelTime(LatLng{40.7580, -73.9855}, LatLng{40.7580, -73.9855}); got != 0 {
+		t.Errorf("Expected no travel time to the same point, got %s", got)
+	}
+}
+
+func TestPlanStopOrder(t *testing.T) {
+	// Stops along a line, given out of order; the depot sits at one end
+	depot := LatLng{40.70, -74.00}
+	points := []LatLng{depot, {40.74, -74.00}, {40.71, -74.00}, {40.73, -74.00}, {40.72, -74.00}}
+	matrix := estimatedTravelTimes(points)
+
+	tour := planStopOrder(matrix)
+	if expected := []int{2, 4, 3, 1}; !reflect.DeepEqual(tour, expected) {
+		t.Errorf("planStopOrder = %v, expected %v", tour, expected)
+	}
+	if pathTime(matrix, tour) >= pathTime(matrix, []int{1, 2, 3, 4}) {
+		t.Error("Expected the planned order to beat the given order")
+	}
+}
+
+func TestTwoOptTour_ImprovesGreedyTour(t *testing.T) {
+	// Nearest neighbor from the depot grabs stop 1, then 2, and is left
+	// with the long leg out to 3; starting at 2 avoids it
+	matrix := [][]time.Duration{
+		{0, 1, 3, 4},
+		{1, 0, 1, 2},
+		{3, 1, 0, 10},
+		{4, 2, 10, 0},
+	}
+	for i := range matrix {
+		for j := range matrix[i] {
+			matrix[i][j] *= time.Minute
+		}
+	}
+	greedy := nearestNeighborTour(matrix)
+	if expected := []int{1, 2, 3}; !reflect.DeepEqual(greedy, expected) {
+		t.Fatalf("nearestNeighborTour = %v, expected %v", greedy, expected)
+	}
+	improved := twoOptTour(matrix, greedy)
+	if expected := []int{2, 1, 3}; !reflect.DeepEqual(improved, expected) {
+		t.Errorf("twoOptTour = %v, expected %v", improved, expected)
+	}
+	if pathTime(matrix, improved) != 6*time.Minute {
+		t.Errorf("Expected a 6 minute path, got %s", pathTime(matrix, improved))
+	}
+}
+
+func TestOSRMTravelTimes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/table/v1/driving/-74.000000,40.700000;-73.990000,40.710000" {
+			t.Errorf("Unexpected OSRM request path %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"code": "Ok", "durations": [[0, 300.5], [null, 0]]}`))
+	}))
+	defer server.Close()
+
+	points := []LatLng{{40.70, -74.00}, {40.71, -73.99}}
+	matrix, err := NewOSRMTravelTimes(server.URL+"/").TravelTimes(context.Background(), points)
+	if err != nil {
+		t.Fatalf("TravelTimes failed: %v", err)
+	}
+	if matrix[0][1] != 300500*time.Millisecond {
+		t.Errorf("Expected 300.5s, got %s", matrix[0][1])
+	}
+	if matrix[1][0] != estimatedTravelTime(points[1], points[0]) {
+		t.Errorf("Expected an unroutable pair to be estimated, got %s", matrix[1][0])
+	}
+}
+
+func TestRouteOptimization_OrdersStopsWithETAs(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "route-opt@example.com", "Route", "Opt")
+	far := db.CreateTestAddress(t, userID)
+	near := db.CreateTestAddress(t, userID)
+	lost := db.CreateTestAddress(t, userID)
+	db.Exec("UPDATE addresses SET street_address = '2 Far St' WHERE id = $1", far)
+	db.Exec("UPDATE addresses SET street_address = '1 Near St', latitude = 40.71, longitude = -74.00 WHERE id = $1", near)
+	db.Exec("UPDATE addresses SET street_address = '9 Nowhere Rd' WHERE id = $1", lost)
+	farOrder := db.CreateTestOrder(t, userID, far)
+	nearOrder := db.CreateTestOrder(t, userID, near)
+	lostOrder := db.CreateTestOrder(t, userID, lost)
+
+	var city, state, zip string
+	db.QueryRow("SELECT city, state, zip_code FROM addresses WHERE id = $1", far).Scan(&city, &state, &zip)
+	geocoder := &stubGeocoder{locations: map[string]LatLng{
+		"2 Far St, " + city + ", " + state + " " + zip: {40.75, -74.00},
+	}}
+	handler := &AdminHandler{
+		db:          db.DB,
+		geocoder:    geocoder,
+		travelTimes: failingTravelTimes{},
+		depot:       &LatLng{40.70, -74.00},
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"order_ids":  []int{farOrder, nearOrder, lostOrder},
+		"start_time": "09:00",
+	})
+	w := httptest.NewRecorder()
+	handler.handleGetRouteOptimizationSuggestions(w, httptest.NewRequest("POST", "/api/v1/admin/routes/optimization-suggestions", bytes.NewBuffer(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var response struct {
+		OptimizedRoute OptimizedRoute `json:"optimized_route"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	route := response.OptimizedRoute
+
+	if len(route.Stops) != 2 || route.Stops[0].OrderID != nearOrder || route.Stops[1].OrderID != farOrder {
+		t.Fatalf("Expected the near stop first, got %+v", route.Stops)
+	}
+	if !reflect.DeepEqual(route.UnlocatedOrderIDs, []int{lostOrder}) {
+		t.Errorf("Expected the unplaceable order reported, got %v", route.UnlocatedOrderIDs)
+	}
+	if route.TravelTimeSource != "estimated" || route.Stops[0].ETA <= "09:00" || route.FinishTime <= route.Stops[1].ETA {
+		t.Errorf("Unexpected route timing: %+v", route)
+	}
+
+	// Coordinates are saved, so the next request doesn't geocode again
+	var lat float64
+	db.QueryRow("SELECT latitude FROM addresses WHERE id = $1", far).Scan(&lat)
+	if lat != 40.75 {
+		t.Errorf("Expected the geocoded latitude stored, got %f", lat)
+	}
+	calls := geocoder.calls
+	handler.optimizeRoute(context.Background(), []int{farOrder}, "pickup", time.Date(0, 1, 1, 9, 0, 0, 0, time.UTC), nil, testBreakPolicy)
+	if geocoder.calls != calls {
+		t.Errorf("Expected stored coordinates to be reused, geocoder called %d more times", geocoder.calls-calls)
+	}
+
+	// A driver who can't work past the first stop rests before the second
+	if len(route.Breaks) != 0 {
+		t.Errorf("Expected no breaks on a short route, got %+v", route.Breaks)
+	}
+	strict := testBreakPolicy
+	strict.MaxContinuousMinutes = route.Stops[0].TravelMinutes + routeServiceMinutes
+	start := time.Date(0, 1, 1, 9, 0, 0, 0, time.UTC)
+	rested, err := handler.optimizeRoute(context.Background(), []int{farOrder, nearOrder}, "pickup", start, handler.depot, strict)
+	if err != nil {
+		t.Fatalf("Failed to optimize route: %v", err)
+	}
+	if len(rested.Breaks) != 1 || rested.Breaks[0].AfterSequence != 1 || rested.Breaks[0].EstimatedStart == nil {
+		t.Fatalf("Expected a rest break after the first stop, got %+v", rested.Breaks)
+	}
+	breakStart, _ := time.Parse("15:04", *rested.Breaks[0].EstimatedStart)
+	breakEnd := breakStart.Add(time.Duration(strict.RestBreakMinutes) * time.Minute).Format("15:04")
+	if *rested.Breaks[0].EstimatedStart < rested.Stops[0].ETA || rested.Stops[1].ETA <= breakEnd {
+		t.Errorf("Expected the second stop reached after the break ends at %s, got %+v", breakEnd, rested.Stops)
+	}
+}
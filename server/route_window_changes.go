@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Customers are told an hour-long window around their stop's ETA, starting
+// half an hour before it on a quarter-hour boundary
+const (
+	etaWindowMinutes = 60
+	etaWindowStep    = 15
+)
+
+// etaWindow returns the window customers are told for an ETA, as HH:MM times
+func etaWindow(eta time.Time) (string, string) {
+	start := eta.Hour()*60 + eta.Minute() - etaWindowMinutes/2
+	if start < 0 {
+		start = 0
+	}
+	start -= start % etaWindowStep
+	end := start + etaWindowMinutes
+	if end >= 24*60 {
+		end = 24*60 - 1
+	}
+	return fmt.Sprintf("%02d:%02d", start/60, start%60), fmt.Sprintf("%02d:%02d", end/60, end%60)
+}
+
+// formatWindow renders an HH:MM window the way customers see it
+func formatWindow(start, end string) string {
+	s, _ := time.Parse("15:04", start)
+	e, _ := time.Parse("15:04", end)
+	return s.Format("3:04 PM") + " - " + e.Format("3:04 PM")
+}
+
+// StopWindowChange is a customer whose arrival window moved when their
+// route was rescheduled
+type StopWindowChange struct {
+	RouteOrderID  int    `json:"route_order_id"`
+	OrderID       int    `json:"order_id"`
+	RouteType     string `json:"route_type"`
+	PreviousStart string `json:"previous_start"`
+	PreviousEnd   string `json:"previous_end"`
+	WindowStart   string `json:"window_start"`
+	WindowEnd     string `json:"window_end"`
+	userID        int
+	orderStatus   string
+}
+
+func (c StopWindowChange) message() string {
+	return fmt.Sprintf("Your %s window changed to %s (was %s)",
+		c.RouteType, formatWindow(c.WindowStart, c.WindowEnd), formatWindow(c.PreviousStart, c.PreviousEnd))
+}
+
+// updateStopWindows recomputes the windows of a route's pending stops from
+// their ETAs. A stop's first window is recorded quietly; when a later one
+// differs the customer is notified and the change goes in the order's
+// timeline. Realtime updates are left to the caller, after commit.
+func updateStopWindows(tx *sql.Tx, routeID int) ([]StopWindowChange, error) {
+	rows, err := tx.Query(`
+		SELECT ro.id, ro.order_id, o.user_id, o.status, dr.route_type,
+			TO_CHAR(ro.estimated_time, 'HH24:MI'),
+			COALESCE(TO_CHAR(ro.window_start, 'HH24:MI'), ''), COALESCE(TO_CHAR(ro.window_end, 'HH24:MI'), '')
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		JOIN orders o ON ro.order_id = o.id
+		WHERE ro.route_id = $1 AND ro.status = 'pending' AND ro.estimated_time IS NOT NULL
+			AND dr.status <> ALL($2)
+		ORDER BY ro.sequence_number, ro.id`,
+		routeID, pq.Array(closedRouteStatuses),
+	)
+	if err != nil {
+		return nil, err
+	}
+	type stop struct {
+		change StopWindowChange
+		eta    string
+	}
+	var stops []stop
+	for rows.Next() {
+		var s stop
+		c := &s.change
+		if err := rows.Scan(&c.RouteOrderID, &c.OrderID, &c.userID, &c.orderStatus, &c.RouteType,
+			&s.eta, &c.PreviousStart, &c.PreviousEnd); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stops = append(stops, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	changes := []StopWindowChange{}
+	for _, s := range stops {
+		c := s.change
+		eta, err := time.Parse("15:04", s.eta)
+		if err != nil {
+			return nil, err
+		}
+		c.WindowStart, c.WindowEnd = etaWindow(eta)
+		if c.WindowStart == c.PreviousStart && c.WindowEnd == c.PreviousEnd {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE route_orders SET window_start = $2, window_end = $3 WHERE id = $1",
+			c.RouteOrderID, c.WindowStart, c.WindowEnd); err != nil {
+			return nil, err
+		}
+		if c.PreviousStart == "" {
+			continue
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO notifications (user_id, order_id, type, title, message)
+			VALUES ($1, $2, 'window_changed', $3, $4)`,
+			c.userID, c.OrderID, fmt.Sprintf("Your %s window changed", c.RouteType), c.message(),
+		)
+		if err == nil {
+			_, err = tx.Exec(`
+				INSERT INTO order_status_history (order_id, status, notes)
+				VALUES ($1, $2, $3)`,
+				c.OrderID, c.orderStatus,
+				fmt.Sprintf("%s window changed from %s to %s",
+					strings.ToUpper(c.RouteType[:1])+c.RouteType[1:],
+					formatWindow(c.PreviousStart, c.PreviousEnd), formatWindow(c.WindowStart, c.WindowEnd)),
+			)
+		}
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// publishWindowChanges sends customers their new windows once the schedule
+// change is committed
+func publishWindowChanges(realtime RealtimeInterface, changes []StopWindowChange) {
+	if realtime == nil {
+		return
+	}
+	for _, c := range changes {
+		realtime.PublishOrderUpdate(c.userID, c.OrderID, c.orderStatus, c.message(), map[string]string{
+			"window_start": c.WindowStart,
+			"window_end":   c.WindowEnd,
+		})
+	}
+}
+
+// handleResequenceRoute puts a route's stops in a new order and reschedules
+// it. route_order_ids must list every stop on the route.
+func (h *AdminHandler) handleResequenceRoute(w http.ResponseWriter, r *http.Request) {
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		RouteOrderIDs []int `json:"route_order_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if !h.lockOpenRoute(w, tx, routeID) {
+		return
+	}
+
+	var stops int
+	var matched int
+	err = tx.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE id = ANY($2))
+		FROM route_orders WHERE route_id = $1`,
+		routeID, pq.Array(req.RouteOrderIDs),
+	).Scan(&stops, &matched)
+	if err != nil {
+		http.Error(w, "Failed to fetch route stops", http.StatusInternalServerError)
+		return
+	}
+	seen := map[int]bool{}
+	for _, id := range req.RouteOrderIDs {
+		seen[id] = true
+	}
+	if len(seen) != len(req.RouteOrderIDs) || matched != stops || len(req.RouteOrderIDs) != stops {
+		http.Error(w, "route_order_ids must list each of the route's stops once", http.StatusBadRequest)
+		return
+	}
+
+	for i, id := range req.RouteOrderIDs {
+		if _, err := tx.Exec("UPDATE route_orders SET sequence_number = $2 WHERE id = $1", id, i+1); err != nil {
+			http.Error(w, "Failed to resequence route", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.commitSchedule(w, tx, routeID, nil)
+}
+
+// handleReassignRoute hands a route to another driver, optionally with a new
+// start time (HH:MM), and reschedules it
+func (h *AdminHandler) handleReassignRoute(w http.ResponseWriter, r *http.Request) {
+	routeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		DriverID  int    `json:"driver_id"`
+		StartTime string `json:"start_time,omitempty"`
+		// Reassign even if the driver's day goes over their capacity
+		AllowOverload bool `json:"allow_overload,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var start *time.Time
+	if req.StartTime != "" {
+		parsed, err := time.Parse("15:04", req.StartTime)
+		if err != nil {
+			http.Error(w, "start_time must be HH:MM", http.StatusBadRequest)
+			return
+		}
+		start = &parsed
+	}
+
+	var role string
+	err = h.db.QueryRow("SELECT role FROM users WHERE id = $1", req.DriverID).Scan(&role)
+	if err != nil || role != "driver" {
+		http.Error(w, "Driver not found", http.StatusBadRequest)
+		return
+	}
+	pending, err := pendingOnboardingSteps(h.db, req.DriverID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(pending) > 0 {
+		http.Error(w, "Driver has not finished onboarding: "+strings.Join(pending, ", "), http.StatusConflict)
+		return
+	}
+
+	// The route's stops join whatever the driver already has that day
+	var currentDriverID int
+	var routeDate string
+	var orderIDs pq.Int64Array
+	err = h.db.QueryRow(`
+		SELECT dr.driver_id, TO_CHAR(dr.route_date, 'YYYY-MM-DD'),
+		       ARRAY(SELECT order_id FROM route_orders WHERE route_id = dr.id)
+		FROM driver_routes dr WHERE dr.id = $1`,
+		routeID,
+	).Scan(&currentDriverID, &routeDate, &orderIDs)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch route", http.StatusInternalServerError)
+		return
+	}
+	var adding []int
+	if currentDriverID != req.DriverID {
+		for _, id := range orderIDs {
+			adding = append(adding, int(id))
+		}
+	}
+	blocked, err := ordersBlockingDriver(h.db, req.DriverID, adding)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(blocked) > 0 {
+		http.Error(w, fmt.Sprintf("Driver is blocked by the customers of orders %v", blocked), http.StatusConflict)
+		return
+	}
+	outside, err := ordersOutsideDriverMarket(h.db, req.DriverID, adding)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(outside) > 0 {
+		http.Error(w, fmt.Sprintf("Orders %v are outside the driver's market", outside), http.StatusConflict)
+		return
+	}
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if !h.lockOpenRoute(w, tx, routeID) {
+		return
+	}
+	if err := lockDriverLoad(tx, req.DriverID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	load, err := driverDayLoad(tx, req.DriverID, routeDate, adding)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if load.Overloaded() && !req.AllowOverload {
+		writeRouteOverloaded(w, load)
+		return
+	}
+	var overloadAcceptedBy *int
+	if load.Overloaded() {
+		adminID, err := h.getUserID(r, h.db)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		overloadAcceptedBy = &adminID
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE driver_routes SET driver_id = $2, overload_accepted_by = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		routeID, req.DriverID, overloadAcceptedBy,
+	); err != nil {
+		http.Error(w, "Failed to reassign route", http.StatusInternalServerError)
+		return
+	}
+
+	if h.commitSchedule(w, tx, routeID, start) && load.Overloaded() {
+		alertRouteOverloaded(h.db, routeID, load)
+	}
+}
+
+// lockOpenRoute locks a route for changes, writing an error if it doesn't
+// exist or has closed
+func (h *AdminHandler) lockOpenRoute(w http.ResponseWriter, tx *sql.Tx, routeID int) bool {
+	var status string
+	err := tx.QueryRow("SELECT status FROM driver_routes WHERE id = $1 FOR UPDATE", routeID).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch route", http.StatusInternalServerError)
+		return false
+	}
+	if isClosedRouteStatus(status) {
+		http.Error(w, "Route is "+status, http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// commitSchedule reschedules a changed route, commits, and tells customers
+// whose windows moved. It reports whether the change was committed.
+func (h *AdminHandler) commitSchedule(w http.ResponseWriter, tx *sql.Tx, routeID int, start *time.Time) bool {
+	schedule, err := scheduleRoute(tx, routeID, start, true)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to schedule route", http.StatusInternalServerError)
+		return false
+	}
+	publishWindowChanges(h.realtime, schedule.WindowChanges)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+	return true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestEtaWindow(t *testing.T) {
+	tests := []struct {
+		eta, start, end string
+	}{
+		{"09:15", "08:45", "09:45"},
+		{"10:05", "09:30", "10:30"},
+		{"00:10", "00:00", "01:00"},
+		{"23:40", "23:00", "23:59"},
+	}
+	for _, tt := range tests {
+		eta, _ := time.Parse("15:04", tt.eta)
+		if start, end := etaWindow(eta); start != tt.start || end != tt.end {
+			t.Errorf("etaWindow(%s) = %s-%s, expected %s-%s", tt.eta, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestResequenceRouteNotifiesWindowChanges(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "window-admin@example.com", "Window", "Admin")
+	driverID := db.CreateTestUser(t, "window-driver@example.com", "Window", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "window-customer@example.com", "Window", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'delivery', 'planned')
+		RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	var stops, orders []int
+	for seq := 1; seq <= 3; seq++ {
+		orderID := db.CreateTestOrder(t, customerID, addressID)
+		var stopID int
+		db.QueryRow("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, $3) RETURNING id", routeID, orderID, seq).Scan(&stopID)
+		stops = append(stops, stopID)
+		orders = append(orders, orderID)
+	}
+
+	// The first schedule sets windows without notifying anyone
+	breaks := NewRouteBreakHandler(db.DB)
+	req := mux.SetURLVars(httptest.NewRequest("POST", "/api/v1/admin/routes/1/schedule", strings.NewReader(`{"start_time": "09:00"}`)),
+		map[string]string{"id": strconv.Itoa(routeID)})
+	w := httptest.NewRecorder()
+	breaks.handleScheduleRoute(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	notifications := func() int {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND type = 'window_changed'", customerID).Scan(&n)
+		return n
+	}
+	if n := notifications(); n != 0 {
+		t.Errorf("Expected no notifications for first windows, got %d", n)
+	}
+
+	// Reversing the route moves the first and last stops; the middle stays put
+	realtime := NewMockRealtimeHandler()
+	admin := &AdminHandler{db: db.DB, realtime: realtime, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	body := fmt.Sprintf(`{"route_order_ids": [%d, %d, %d]}`, stops[2], stops[1], stops[0])
+	req = mux.SetURLVars(httptest.NewRequest("PUT", "/api/v1/admin/routes/1/sequence", strings.NewReader(body)),
+		map[string]string{"id": strconv.Itoa(routeID)})
+	w = httptest.NewRecorder()
+	admin.handleResequenceRoute(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var schedule RouteSchedule
+	json.Unmarshal(w.Body.Bytes(), &schedule)
+	if len(schedule.WindowChanges) != 2 {
+		t.Fatalf("Expected two window changes, got %+v", schedule.WindowChanges)
+	}
+	if n := notifications(); n != 2 {
+		t.Errorf("Expected two window notifications, got %d", n)
+	}
+	if len(realtime.PublishedUpdates) != 2 {
+		t.Errorf("Expected two realtime updates, got %d", len(realtime.PublishedUpdates))
+	}
+
+	var note string
+	db.QueryRow("SELECT notes FROM order_status_history WHERE order_id = $1 ORDER BY id DESC LIMIT 1", orders[0]).Scan(&note)
+	if note != "Delivery window changed from 8:45 AM - 9:45 AM to 9:30 AM - 10:30 AM" {
+		t.Errorf("Unexpected timeline note %q", note)
+	}
+
+	// Every stop has to be listed
+	body = fmt.Sprintf(`{"route_order_ids": [%d, %d]}`, stops[0], stops[1])
+	req = mux.SetURLVars(httptest.NewRequest("PUT", "/api/v1/admin/routes/1/sequence", strings.NewReader(body)),
+		map[string]string{"id": strconv.Itoa(routeID)})
+	w = httptest.NewRecorder()
+	admin.handleResequenceRoute(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a partial sequence, got %d", http.StatusBadRequest, w.Code)
+	}
+}
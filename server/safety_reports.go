@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SafetyReportHandler lets drivers report unsafe situations at a stop and
+// admins act on them
+type SafetyReportHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewSafetyReportHandler(db *sql.DB) *SafetyReportHandler {
+	return &SafetyReportHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+var safetyReportCategories = map[string]bool{
+	"aggressive_person": true,
+	"dangerous_animal":  true,
+	"unsafe_premises":   true,
+	"harassment":        true,
+	"other":             true,
+}
+
+type SafetyReport struct {
+	ID           int        `json:"id"`
+	DriverID     *int       `json:"driver_id"`
+	RouteOrderID *int       `json:"route_order_id,omitempty"`
+	OrderID      *int       `json:"order_id,omitempty"`
+	UserID       *int       `json:"user_id,omitempty"`
+	AddressKey   *string    `json:"address_key,omitempty"`
+	Category     string     `json:"category"`
+	Description  string     `json:"description"`
+	Status       string     `json:"status"` // open, dismissed, actioned
+	ReviewNotes  *string    `json:"review_notes,omitempty"`
+	ReviewedBy   *int       `json:"reviewed_by,omitempty"`
+	ReviewedAt   *time.Time `json:"reviewed_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+const safetyReportColumns = `id, driver_id, route_order_id, order_id, user_id, address_key, category, description,
+	status, review_notes, reviewed_by, reviewed_at, created_at`
+
+func scanSafetyReport(scanner interface{ Scan(...interface{}) error }) (SafetyReport, error) {
+	var s SafetyReport
+	err := scanner.Scan(&s.ID, &s.DriverID, &s.RouteOrderID, &s.OrderID, &s.UserID, &s.AddressKey, &s.Category, &s.Description,
+		&s.Status, &s.ReviewNotes, &s.ReviewedBy, &s.ReviewedAt, &s.CreatedAt)
+	return s, err
+}
+
+type CreateSafetyReportRequest struct {
+	RouteOrderID int    `json:"route_order_id"`
+	Category     string `json:"category"`
+	Description  string `json:"description"`
+}
+
+// handleCreateSafetyReport files a report against one of the driver's stops.
+// The stop's customer and address are recorded with it, and admins are
+// alerted straight away.
+func (h *SafetyReportHandler) handleCreateSafetyReport(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateSafetyReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Description = strings.TrimSpace(req.Description)
+	if !safetyReportCategories[req.Category] {
+		http.Error(w, "Invalid category", http.StatusBadRequest)
+		return
+	}
+	if req.Description == "" || len(req.Description) > 4000 {
+		http.Error(w, "A description of up to 4000 characters is required", http.StatusBadRequest)
+		return
+	}
+
+	// The stop's address is where the driver was: pickup or delivery
+	report, err := scanSafetyReport(h.db.QueryRow(`
+		INSERT INTO safety_reports (driver_id, route_order_id, order_id, user_id, address_key, category, description)
+		SELECT dr.driver_id, ro.id, o.id, o.user_id, `+addressKeyExpr("a")+`, $3, $4
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		JOIN orders o ON ro.order_id = o.id
+		LEFT JOIN addresses a ON a.id = CASE WHEN dr.route_type = 'pickup' THEN o.pickup_address_id ELSE o.delivery_address_id END
+		WHERE ro.id = $1 AND dr.driver_id = $2
+		RETURNING `+safetyReportColumns,
+		req.RouteOrderID, driverID, req.Category, req.Description,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Route order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to file report", http.StatusInternalServerError)
+		return
+	}
+
+	logAdminAlert(h.db, AdminAlert{
+		Type:      "safety_report",
+		Severity:  "critical",
+		Title:     fmt.Sprintf("Driver safety report on order #%d", *report.OrderID),
+		Message:   fmt.Sprintf("%s: %s", strings.ReplaceAll(report.Category, "_", " "), report.Description),
+		OrderID:   report.OrderID,
+		DedupeKey: fmt.Sprintf("safety_report:%d", report.ID),
+		Data:      map[string]int{"report_id": report.ID},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleGetMySafetyReports lists the reports the driver has filed and how
+// they were handled
+func (h *SafetyReportHandler) handleGetMySafetyReports(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.writeReports(w, "WHERE driver_id = $1", driverID)
+}
+
+// handleGetSafetyReports lists reports for admins, open ones by default
+// (?status=open|dismissed|actioned|all)
+func (h *SafetyReportHandler) handleGetSafetyReports(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "open"
+	}
+	h.writeReports(w, "WHERE $1 = 'all' OR status = $1", status)
+}
+
+func (h *SafetyReportHandler) writeReports(w http.ResponseWriter, where string, arg interface{}) {
+	rows, err := h.db.Query("SELECT "+safetyReportColumns+" FROM safety_reports "+where+" ORDER BY created_at DESC, id DESC", arg)
+	if err != nil {
+		http.Error(w, "Failed to fetch reports", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reports := []SafetyReport{}
+	for rows.Next() {
+		report, err := scanSafetyReport(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch reports", http.StatusInternalServerError)
+			return
+		}
+		reports = append(reports, report)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+type ReviewSafetyReportRequest struct {
+	Action        string `json:"action"` // dismiss or block
+	BlockCustomer bool   `json:"block_customer"`
+	BlockAddress  bool   `json:"block_address"`
+	Notes         string `json:"notes"`
+}
+
+// handleReviewSafetyReport closes an open report, either dismissing it or
+// blocking the customer and/or address it was filed against
+func (h *SafetyReportHandler) handleReviewSafetyReport(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	reportID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ReviewSafetyReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Notes = strings.TrimSpace(req.Notes)
+	switch req.Action {
+	case "dismiss":
+	case "block":
+		if !req.BlockCustomer && !req.BlockAddress {
+			http.Error(w, "Choose to block the customer, the address or both", http.StatusBadRequest)
+			return
+		}
+		if req.Notes == "" {
+			http.Error(w, "Notes are required when blocking", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Action must be dismiss or block", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	report, err := scanSafetyReport(tx.QueryRow(
+		"SELECT "+safetyReportColumns+" FROM safety_reports WHERE id = $1 FOR UPDATE", reportID,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch report", http.StatusInternalServerError)
+		return
+	}
+	if report.Status != "open" {
+		http.Error(w, "Report has already been reviewed", http.StatusConflict)
+		return
+	}
+
+	status := "dismissed"
+	var entry *BlocklistEntry
+	if req.Action == "block" {
+		status = "actioned"
+		if req.BlockCustomer && report.UserID == nil || req.BlockAddress && report.AddressKey == nil {
+			http.Error(w, "The customer or address on this report no longer exists", http.StatusConflict)
+			return
+		}
+		var userID *int
+		var addressKey *string
+		if req.BlockCustomer {
+			userID = report.UserID
+		}
+		if req.BlockAddress {
+			addressKey = report.AddressKey
+		}
+		entryID, err := addBlock(tx, userID, addressKey, req.Notes, &report.ID, adminID)
+		if err == nil {
+			var e BlocklistEntry
+			e, err = getBlocklistEntry(tx, entryID)
+			entry = &e
+		}
+		if err != nil {
+			http.Error(w, "Failed to create block", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	report, err = scanSafetyReport(tx.QueryRow(`
+		UPDATE safety_reports
+		SET status = $2, review_notes = NULLIF($3, ''), reviewed_by = $4, reviewed_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+safetyReportColumns,
+		reportID, status, req.Notes, adminID,
+	))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to review report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"report": report,
+		"block":  entry,
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSafetyReportBlockAndAppeal(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "safety-admin@example.com", "Safety", "Admin")
+	driverID := db.CreateTestUser(t, "safety-driver@example.com", "Safety", "Driver")
+	customerID := db.CreateTestUser(t, "safety-customer@example.com", "Safety", "Customer")
+	neighbourID := db.CreateTestUser(t, "safety-neighbour@example.com", "Safety", "Neighbour")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	// Someone else saving the same place, written differently
+	var sameAddressID int
+	db.QueryRow(`
+		INSERT INTO addresses (user_id, street_address, city, state, zip_code)
+		VALUES ($1, '123  test st', 'Test City', 'CA', '12345-6789')
+		RETURNING id`,
+		neighbourID,
+	).Scan(&sameAddressID)
+
+	var routeID, routeOrderID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'in_progress')
+		RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	db.QueryRow("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1) RETURNING id", routeID, orderID).Scan(&routeOrderID)
+
+	reports := &SafetyReportHandler{db: db.DB, getUserID: CreateAuthMock(driverID).getUserIDFromRequest}
+	w := httptest.NewRecorder()
+	reports.handleCreateSafetyReport(w, httptest.NewRequest("POST", "/api/v1/driver/safety-reports", strings.NewReader(
+		fmt.Sprintf(`{"route_order_id": %d, "category": "dangerous_animal", "description": "Unleashed dog lunged at me"}`, routeOrderID),
+	)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var report SafetyReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if report.UserID == nil || *report.UserID != customerID || report.AddressKey == nil {
+		t.Errorf("Expected the report to carry the stop's customer and address, got %+v", report)
+	}
+
+	var alerts int
+	db.QueryRow("SELECT COUNT(*) FROM admin_inbox_items WHERE alert_type = 'safety_report' AND severity = 'critical'").Scan(&alerts)
+	if alerts != 1 {
+		t.Errorf("Expected a critical admin alert, got %d", alerts)
+	}
+
+	// Another driver's stop can't be reported
+	other := &SafetyReportHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	w = httptest.NewRecorder()
+	other.handleCreateSafetyReport(w, httptest.NewRequest("POST", "/api/v1/driver/safety-reports", strings.NewReader(
+		fmt.Sprintf(`{"route_order_id": %d, "category": "other", "description": "Not my stop"}`, routeOrderID),
+	)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// Blocking the address applies to anyone saving it
+	admin := &SafetyReportHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	req := httptest.NewRequest("POST", "/api/v1/admin/safety-reports/review", strings.NewReader(
+		`{"action": "block", "block_address": true, "notes": "Dog reported twice"}`,
+	))
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(report.ID)})
+	w = httptest.NewRecorder()
+	admin.handleReviewSafetyReport(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	orders := &OrderHandler{db: db.DB, getUserID: CreateAuthMock(neighbourID).getUserIDFromRequest}
+	w = httptest.NewRecorder()
+	orders.handleCreateOrder(w, httptest.NewRequest("POST", "/api/v1/orders", strings.NewReader(
+		fmt.Sprintf(`{"pickup_address_id": %d, "delivery_address_id": %d, "pickup_date": "2030-01-01", "pickup_time_slot": "8:00 AM - 12:00 PM"}`, sameAddressID, sameAddressID),
+	)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d ordering to a blocked address, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+
+	// The neighbour sees the block without the report behind it and appeals
+	blocklist := &BlocklistHandler{db: db.DB, getUserID: CreateAuthMock(neighbourID).getUserIDFromRequest}
+	w = httptest.NewRecorder()
+	blocklist.handleGetMyBlocks(w, httptest.NewRequest("GET", "/api/v1/account/blocks", nil))
+	var blocks []CustomerBlock
+	json.Unmarshal(w.Body.Bytes(), &blocks)
+	if len(blocks) != 1 || blocks[0].Scope != "address" || strings.Contains(w.Body.String(), "Dog") {
+		t.Fatalf("Unexpected blocks: %s", w.Body.String())
+	}
+
+	appeal := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/account/blocks/appeal", strings.NewReader(`{"message": "We rehomed the dog"}`))
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(blocks[0].ID)})
+		w := httptest.NewRecorder()
+		blocklist.handleAppealBlock(w, req)
+		return w
+	}
+	w = appeal()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var filed BlocklistAppeal
+	json.Unmarshal(w.Body.Bytes(), &filed)
+	if w := appeal(); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d appealing twice, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Approving the appeal lifts the block and tells the customer
+	blocklist.getUserID = CreateAuthMock(adminID).getUserIDFromRequest
+	req = httptest.NewRequest("POST", "/api/v1/admin/blocklist/appeals", strings.NewReader(`{"approve": true, "response": "Thanks, the block is lifted"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(filed.ID)})
+	w = httptest.NewRecorder()
+	blocklist.handleDecideAppeal(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if blockID, err := activeBlockFor(db.DB, neighbourID, sameAddressID); err != nil || blockID != 0 {
+		t.Errorf("Expected the block to be lifted, got block %d: %v", blockID, err)
+	}
+	var notifications int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND type = 'block_appeal'", neighbourID).Scan(&notifications)
+	if notifications != 1 {
+		t.Errorf("Expected the customer to be notified, got %d notifications", notifications)
+	}
+}
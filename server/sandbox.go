@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// sandboxPaymentPrefix starts the payment and refund IDs recorded for sandbox
+// orders in place of Stripe's, so nothing mistakes them for real charges
+const sandboxPaymentPrefix = "sandbox_"
+
+// isSandboxOrder reports whether an order belongs to a sandbox account. The
+// flag is copied from the account when the order is created.
+func isSandboxOrder(q queryRower, orderID int) (bool, error) {
+	var sandbox bool
+	err := q.QueryRow("SELECT is_sandbox FROM orders WHERE id = $1", orderID).Scan(&sandbox)
+	return sandbox, err
+}
+
+// sandboxOrder tags realtime updates; a failed lookup publishes them untagged
+func (h *RealtimeHandler) sandboxOrder(orderID int) bool {
+	if h.db == nil || orderID == 0 {
+		return false
+	}
+	sandbox, _ := isSandboxOrder(h.db, orderID)
+	return sandbox
+}
+
+// sandboxCheckoutURL is where a sandbox order's checkout lands, the same
+// page Stripe sends paid orders back to
+func sandboxCheckoutURL(orderID int) string {
+	return "https://tumble.royer.app/dashboard/orders/" + strconv.Itoa(orderID) + "?success=true&sandbox=true"
+}
+
+// recordSandboxPayment stands in for Stripe on a sandbox order. The payment
+// is recorded as completed straight away and its ID returned.
+func recordSandboxPayment(q queryRower, userID, orderID, amountCents int) (string, error) {
+	paymentID := sandboxPaymentPrefix + "pi_" + generateRandomString(24)
+	var id int
+	err := q.QueryRow(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id)
+		VALUES ($1, $2, $3, 'extra_order', 'completed', $4)
+		RETURNING id`,
+		userID, orderID, amountCents, paymentID,
+	).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Recorded sandbox payment %s for order %d", paymentID, orderID)
+	return paymentID, nil
+}
+
+// sandboxRefund is the refund Stripe would have returned for a sandbox payment
+func sandboxRefund(refundID, amountCents int) *stripe.Refund {
+	return &stripe.Refund{
+		ID:       sandboxPaymentPrefix + "re_" + generateRandomString(24),
+		Amount:   int64(amountCents),
+		Status:   stripe.RefundStatusSucceeded,
+		Metadata: map[string]string{"refund_id": strconv.Itoa(refundID)},
+	}
+}
+
+// handleSetUserSandbox turns an account into a sandbox account or back.
+// Real accounts with orders or payments can't be switched, so test data never
+// mixes with money that actually moved; a sandbox account has to be purged
+// before it goes back to being real.
+func (h *AdminHandler) handleSetUserSandbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		IsSandbox bool `json:"is_sandbox"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var current, hasOrders, hasPayments bool
+	err = h.db.QueryRow(`
+		SELECT is_sandbox,
+		       EXISTS(SELECT 1 FROM orders WHERE user_id = $1),
+		       EXISTS(SELECT 1 FROM payments WHERE user_id = $1)
+		FROM users WHERE id = $1`,
+		userID,
+	).Scan(&current, &hasOrders, &hasPayments)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	if req.IsSandbox != current && (hasOrders || hasPayments) {
+		if req.IsSandbox {
+			http.Error(w, "Accounts with real orders or payments can't be made sandbox accounts", http.StatusConflict)
+		} else {
+			http.Error(w, "Purge this account's sandbox data before making it a real account", http.StatusConflict)
+		}
+		return
+	}
+
+	if _, err := h.db.Exec("UPDATE users SET is_sandbox = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", req.IsSandbox, userID); err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+	h.userSync.notifyUser("user.updated", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":    userID,
+		"is_sandbox": req.IsSandbox,
+	})
+}
+
+// SandboxPurgeResult counts what a sandbox purge deleted
+type SandboxPurgeResult struct {
+	Orders        int64 `json:"orders"`
+	Payments      int64 `json:"payments"`
+	Notifications int64 `json:"notifications"`
+}
+
+// purgeSandboxData deletes sandbox orders with their payments and every test
+// notification, for one account or all of them when userID is 0. The
+// accounts themselves are kept so they can be reused.
+func purgeSandboxData(tx *sql.Tx, userID int) (SandboxPurgeResult, error) {
+	var result SandboxPurgeResult
+
+	rows, err := tx.Query(`
+		SELECT id FROM orders
+		WHERE is_sandbox AND ($1 = 0 OR user_id = $1)
+		FOR UPDATE`,
+		userID,
+	)
+	if err != nil {
+		return result, err
+	}
+	orderIDs := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return result, err
+		}
+		orderIDs = append(orderIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	// Payments and notifications don't cascade with their order
+	deleted, err := tx.Exec("DELETE FROM payments WHERE order_id = ANY($1)", pq.Array(orderIDs))
+	if err != nil {
+		return result, err
+	}
+	result.Payments, _ = deleted.RowsAffected()
+
+	deleted, err = tx.Exec(`
+		DELETE FROM notifications
+		WHERE order_id = ANY($1) OR (is_test AND ($2 = 0 OR user_id = $2))`,
+		pq.Array(orderIDs), userID,
+	)
+	if err != nil {
+		return result, err
+	}
+	result.Notifications, _ = deleted.RowsAffected()
+
+	deleted, err = tx.Exec("DELETE FROM orders WHERE id = ANY($1)", pq.Array(orderIDs))
+	if err != nil {
+		return result, err
+	}
+	result.Orders, _ = deleted.RowsAffected()
+
+	return result, nil
+}
+
+// handlePurgeSandboxData bulk-deletes sandbox data, for every sandbox account
+// or just the one named by ?user_id=
+func (h *AdminHandler) handlePurgeSandboxData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := 0
+	if u := r.URL.Query().Get("user_id"); u != "" {
+		parsed, err := strconv.Atoi(u)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		var sandbox bool
+		err = h.db.QueryRow("SELECT is_sandbox FROM users WHERE id = $1", parsed).Scan(&sandbox)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+			return
+		}
+		if !sandbox {
+			http.Error(w, "User is not a sandbox account", http.StatusConflict)
+			return
+		}
+		userID = parsed
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to purge sandbox data", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := purgeSandboxData(tx, userID)
+	if err != nil {
+		log.Printf("Failed to purge sandbox data: %v", err)
+		http.Error(w, "Failed to purge sandbox data", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to purge sandbox data", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Purged sandbox data: user=%d, orders=%d, payments=%d, notifications=%d",
+		userID, result.Orders, result.Payments, result.Notifications)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
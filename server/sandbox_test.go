@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSandboxRefund(t *testing.T) {
+	re := sandboxRefund(42, 1500)
+	if !strings.HasPrefix(re.ID, sandboxPaymentPrefix) || re.Amount != 1500 || re.Status != "succeeded" {
+		t.Errorf("Unexpected sandbox refund: %+v", re)
+	}
+	if re.Metadata["refund_id"] != "42" {
+		t.Errorf("Expected the refund to point back at refund 42, got %v", re.Metadata)
+	}
+}
+
+func TestSandbox_OrdersSkipStripeAndPurge(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	admin := &AdminHandler{db: db.DB}
+	setSandbox := func(userID int, sandbox bool) int {
+		body, _ := json.Marshal(map[string]bool{"is_sandbox": sandbox})
+		req := mux.SetURLVars(httptest.NewRequest("PUT", "/api/v1/admin/users/x/sandbox", bytes.NewBuffer(body)),
+			map[string]string{"id": fmt.Sprint(userID)})
+		w := httptest.NewRecorder()
+		admin.handleSetUserSandbox(w, req)
+		return w.Code
+	}
+
+	realID := db.CreateTestUser(t, "real@example.com", "Real", "Customer")
+	db.CreateTestOrder(t, realID, db.CreateTestAddress(t, realID))
+	if code := setSandbox(realID, true); code != http.StatusConflict {
+		t.Errorf("Expected status %d for an account with real orders, got %d", http.StatusConflict, code)
+	}
+
+	sandboxID := db.CreateTestUser(t, "partner-qa@example.com", "Partner", "QA")
+	if code := setSandbox(sandboxID, true); code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	orderID := db.CreateTestOrder(t, sandboxID, db.CreateTestAddress(t, sandboxID))
+	if sandbox, err := isSandboxOrder(db.DB, orderID); err != nil || !sandbox {
+		t.Fatalf("Expected the order to be flagged sandbox, got %v (%v)", sandbox, err)
+	}
+
+	// Checkout is settled locally instead of going to Stripe
+	payments := NewPaymentService(db.DB, pgUserRepo{db: db.DB})
+	url, _, total, err := payments.CreateOrderPaymentIntent(sandboxID, orderID, 4500, 500, 1000)
+	if err != nil {
+		t.Fatalf("Failed to check out sandbox order: %v", err)
+	}
+	if url != sandboxCheckoutURL(orderID) || total != 4000 {
+		t.Errorf("Expected the sandbox checkout URL for 4000 cents, got %s for %d", url, total)
+	}
+	var status, paymentIntentID string
+	db.QueryRow("SELECT status, stripe_payment_intent_id FROM payments WHERE order_id = $1", orderID).Scan(&status, &paymentIntentID)
+	if status != "completed" || !strings.HasPrefix(paymentIntentID, sandboxPaymentPrefix) {
+		t.Errorf("Expected a completed sandbox payment, got %s %s", status, paymentIntentID)
+	}
+
+	db.Exec(`INSERT INTO notifications (user_id, order_id, type, title, message) VALUES ($1, $2, 'order_status_update', 'Scheduled', 'Order created')`, sandboxID, orderID)
+	db.Exec(`INSERT INTO notifications (user_id, type, title, message) VALUES ($1, 'welcome', 'Welcome', 'Hi')`, realID)
+	var testNotifications int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE is_test").Scan(&testNotifications)
+	if testNotifications != 1 {
+		t.Errorf("Expected only the sandbox notification tagged as a test, got %d", testNotifications)
+	}
+
+	if code := setSandbox(sandboxID, false); code != http.StatusConflict {
+		t.Errorf("Expected status %d before the sandbox data is purged, got %d", http.StatusConflict, code)
+	}
+
+	w := httptest.NewRecorder()
+	admin.handlePurgeSandboxData(w, httptest.NewRequest("POST", "/api/v1/admin/sandbox/purge", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var result SandboxPurgeResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result != (SandboxPurgeResult{Orders: 1, Payments: 1, Notifications: 1}) {
+		t.Errorf("Unexpected purge result: %+v", result)
+	}
+
+	var realOrders int
+	db.QueryRow("SELECT COUNT(*) FROM orders WHERE user_id = $1", realID).Scan(&realOrders)
+	if realOrders != 1 {
+		t.Errorf("Expected the real account's order to be kept, got %d", realOrders)
+	}
+	if code := setSandbox(sandboxID, false); code != http.StatusOK {
+		t.Errorf("Expected status %d once purged, got %d", http.StatusOK, code)
+	}
+}
@@ -5,28 +5,47 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"tumble-backend/money"
+
 	"github.com/robfig/cron/v3"
 )
 
 type AutoScheduler struct {
 	db   *sql.DB
 	cron *cron.Cron
+	// realtime tells customers about orders the scheduler creates; nil skips it
+	realtime RealtimeInterface
+	// geocoder places addresses in the nightly backfill; nil skips it
+	geocoder Geocoder
+	// push sends queued push notifications; nil skips it
+	push *PushDispatcher
+	// webhooks posts queued item events to partner endpoints; nil skips it
+	webhooks *WebhookDispatcher
+	// weather flags bad-weather pickup days per market; nil skips it
+	weather WeatherForecaster
+	// slotHolds counts customers' checkout holds against slot capacity; nil in tests
+	slotHolds SlotHoldStore
 }
 
 type ScheduleableUser struct {
-	UserID                   int              `json:"user_id"`
-	DefaultPickupAddressID   *int             `json:"default_pickup_address_id"`
-	DefaultDeliveryAddressID *int             `json:"default_delivery_address_id"`
-	PreferredPickupTimeSlot  string           `json:"preferred_pickup_time_slot"`
-	PreferredDeliveryTimeSlot string          `json:"preferred_delivery_time_slot"`
-	PreferredPickupDay       string           `json:"preferred_pickup_day"`
-	DefaultServices          []ServiceRequest `json:"default_services"`
-	LeadTimeDays             int              `json:"lead_time_days"`
-	SpecialInstructions      string           `json:"special_instructions"`
-	SubscriptionID           *int             `json:"subscription_id"`
-	PickupsRemaining         int              `json:"pickups_remaining"`
+	UserID                    int                    `json:"user_id"`
+	DefaultPickupAddressID    *int                   `json:"default_pickup_address_id"`
+	DefaultDeliveryAddressID  *int                   `json:"default_delivery_address_id"`
+	PreferredPickupTimeSlot   string                 `json:"preferred_pickup_time_slot"`
+	PreferredDeliveryTimeSlot string                 `json:"preferred_delivery_time_slot"`
+	PreferredPickupDay        string                 `json:"preferred_pickup_day"`
+	DefaultServices           []ServiceRequest       `json:"default_services"`
+	LeadTimeDays              int                    `json:"lead_time_days"`
+	SpecialInstructions       string                 `json:"special_instructions"`
+	SubscriptionID            *int                   `json:"subscription_id"`
+	PickupsRemaining          int                    `json:"pickups_remaining"`
+	AddressRotation           []AddressStop          `json:"address_rotation"`
+	WeekdayAddresses          map[string]AddressStop `json:"weekday_addresses"`
+	RotationIndex             int                    `json:"rotation_index"`
+	PausedUntil               *time.Time             `json:"paused_until,omitempty"`
 }
 
 func NewAutoScheduler(db *sql.DB) *AutoScheduler {
@@ -41,10 +60,74 @@ func (s *AutoScheduler) Start() {
 	// Run every hour at minute 0 (e.g., 1:00, 2:00, 3:00, etc.)
 	s.cron.AddFunc("0 * * * *", s.processAutoScheduledOrders)
 	
+	// Check subscription usage pace once a day
+	s.cron.AddFunc("0 15 * * *", s.processUsageAlerts)
+	
+	// Remind subscribers their trial is ending and set up intro pricing
+	s.cron.AddFunc("0 16 * * *", s.processTrialReminders)
+	
+	// Send plan migration notices and switch plans ahead of renewal
+	s.cron.AddFunc("0 14 * * *", s.processPlanMigrations)
+	
+	// Reconcile the previous day's payments against Stripe
+	s.cron.AddFunc("0 6 * * *", s.processPaymentReconciliation)
+	
+	// Re-sync subscription billing periods from Stripe in case a webhook was missed
+	s.cron.AddFunc("30 6 * * *", s.processSubscriptionPeriodSync)
+	
+	// Flag (and optionally fix) orders whose stored totals disagree with their items
+	s.cron.AddFunc("0 5 * * *", s.processOrderIntegrity)
+	
+	// Purge data past its retention window
+	s.cron.AddFunc("0 3 * * *", s.processRetentionPurges)
+	
+	// Estimate fulfilment costs for newly delivered orders
+	s.cron.AddFunc("30 5 * * *", s.processOrderCosts)
+	
+	// Remind customers the evening before their pickup (22:00 UTC is early evening in the US)
+	s.cron.AddFunc("0 22 * * *", s.processPickupReminders)
+	
+	// Raise admin inbox alerts for driver no-shows and stuck payment webhooks
+	s.cron.AddFunc("*/15 * * * *", s.processAdminAlerts)
+	
+	// Flag active routes whose driver app has stopped checking in
+	s.cron.AddFunc("* * * * *", s.processStaleDriverSessions)
+	
+	// Send critical realtime updates the app didn't acknowledge as notifications
+	s.cron.AddFunc("* * * * *", s.processRealtimeFallbacks)
+	
+	// Send queued push notifications and retry failed ones
+	s.cron.AddFunc("* * * * *", s.processPushDeliveries)
+
+	// Post item events to partner webhooks and retry failed deliveries
+	s.cron.AddFunc("* * * * *", s.processWebhookDeliveries)
+	
+	// Post new money movements to the ledger and check it still balances
+	s.cron.AddFunc("*/15 * * * *", s.processLedger)
+	
+	// Pay drivers for the week that ended, Monday morning
+	s.cron.AddFunc("0 8 * * 1", s.processDriverPayouts)
+	
+	// Keep the admin driver stats current; completions and ratings also refresh them directly
+	s.cron.AddFunc("*/15 * * * *", s.processDriverStats)
+	
+	// Geocode new and edited addresses for routing and report any that moved
+	s.cron.AddFunc("0 4 * * *", s.processGeocodeBackfill)
+	
+	// Free lockers held for cancelled orders or not collected in time
+	s.cron.AddFunc("*/15 * * * *", s.processLockerReleases)
+	
+	// Flag bad-weather days from the latest forecasts and warn ops about affected routes
+	s.cron.AddFunc("15 */3 * * *", s.processWeatherAdvisories)
+	
+	// Flag routes from earlier days that were never closed out
+	s.cron.AddFunc("0 7 * * *", s.processRouteCloseoutReminders)
+	
 	// Also run once on startup for testing
 	go func() {
 		time.Sleep(5 * time.Second) // Give time for startup
 		s.processAutoScheduledOrders()
+		s.processDriverStats()
 	}()
 	
 	s.cron.Start()
@@ -90,6 +173,10 @@ func (s *AutoScheduler) getScheduleableUsers() ([]ScheduleableUser, error) {
 			sp.default_services,
 			sp.lead_time_days,
 			sp.special_instructions,
+			sp.address_rotation,
+			sp.weekday_addresses,
+			sp.rotation_index,
+			sp.auto_schedule_paused_until,
 			s.id as subscription_id,
 			COALESCE(
 				(sp_plan.pickups_per_month - 
@@ -105,8 +192,12 @@ func (s *AutoScheduler) getScheduleableUsers() ([]ScheduleableUser, error) {
 		JOIN subscriptions s ON sp.user_id = s.user_id AND s.status = 'active'
 		JOIN subscription_plans sp_plan ON s.plan_id = sp_plan.id
 		WHERE sp.auto_schedule_enabled = true
-		  AND sp.default_pickup_address_id IS NOT NULL
-		  AND sp.default_delivery_address_id IS NOT NULL
+		  AND `+notDeactivated("sp.user_id")+`
+		  AND (
+			(sp.default_pickup_address_id IS NOT NULL AND sp.default_delivery_address_id IS NOT NULL)
+			OR jsonb_array_length(sp.address_rotation) > 0
+			OR sp.weekday_addresses != '{}'::jsonb
+		  )
 	`
 	
 	rows, err := s.db.Query(query)
@@ -118,7 +209,7 @@ func (s *AutoScheduler) getScheduleableUsers() ([]ScheduleableUser, error) {
 	var users []ScheduleableUser
 	for rows.Next() {
 		var user ScheduleableUser
-		var defaultServicesJSON []byte
+		var defaultServicesJSON, addressRotationJSON, weekdayAddressesJSON []byte
 		
 		err := rows.Scan(
 			&user.UserID,
@@ -130,6 +221,10 @@ func (s *AutoScheduler) getScheduleableUsers() ([]ScheduleableUser, error) {
 			&defaultServicesJSON,
 			&user.LeadTimeDays,
 			&user.SpecialInstructions,
+			&addressRotationJSON,
+			&weekdayAddressesJSON,
+			&user.RotationIndex,
+			&user.PausedUntil,
 			&user.SubscriptionID,
 			&user.PickupsRemaining,
 		)
@@ -146,6 +241,16 @@ func (s *AutoScheduler) getScheduleableUsers() ([]ScheduleableUser, error) {
 			}
 		}
 		
+		// Parse multi-stop address preferences
+		if err := json.Unmarshal(addressRotationJSON, &user.AddressRotation); err != nil {
+			log.Printf("Error parsing address rotation for user %d: %v", user.UserID, err)
+			continue
+		}
+		if err := json.Unmarshal(weekdayAddressesJSON, &user.WeekdayAddresses); err != nil {
+			log.Printf("Error parsing weekday addresses for user %d: %v", user.UserID, err)
+			continue
+		}
+		
 		users = append(users, user)
 	}
 	
@@ -172,21 +277,92 @@ func (s *AutoScheduler) createOrderForUser(user ScheduleableUser) error {
 		return nil
 	}
 	
+	// Respect a pause or a skipped date
+	if user.PausedUntil != nil && nextPickupDate.Format("2006-01-02") <= user.PausedUntil.Format("2006-01-02") {
+		log.Printf("Auto-scheduling is paused for user %d until %s", user.UserID, user.PausedUntil.Format("2006-01-02"))
+		return nil
+	}
+	skipped, err := pickupDateSkipped(s.db, user.UserID, nextPickupDate)
+	if err != nil {
+		return fmt.Errorf("error checking skipped dates: %w", err)
+	}
+	if skipped {
+		log.Printf("User %d skipped the pickup on %s", user.UserID, nextPickupDate.Format("2006-01-02"))
+		return nil
+	}
+	
+	// Pick the stop for this pickup (weekday mapping, then rotation, then defaults)
+	pickupAddressID, deliveryAddressID, fromRotation := resolveAddressStop(user, nextPickupDate)
+	if pickupAddressID == nil || deliveryAddressID == nil {
+		log.Printf("User %d has no address configured for %s", user.UserID, nextPickupDate.Format("2006-01-02"))
+		return nil
+	}
+	blockID, err := activeBlockFor(s.db, user.UserID, *pickupAddressID, *deliveryAddressID)
+	if err != nil {
+		return fmt.Errorf("error checking blocklist: %w", err)
+	}
+	if blockID != 0 {
+		log.Printf("User %d is blocked from orders (block #%d)", user.UserID, blockID)
+		return nil
+	}
+	pause, err := intakePauseForAddress(s.db, *pickupAddressID)
+	if err != nil {
+		return fmt.Errorf("error checking intake pauses: %w", err)
+	}
+	if pause != nil {
+		log.Printf("Order intake is paused, skipping user %d (pause #%d)", user.UserID, pause.ID)
+		return nil
+	}
+	user.DefaultPickupAddressID = pickupAddressID
+	user.DefaultDeliveryAddressID = deliveryAddressID
+	
 	// Calculate delivery date (1-2 days after pickup)
 	deliveryDate := nextPickupDate.AddDate(0, 0, 2) // 2 days after pickup
 	
 	// Create the order
 	orderID, err := s.createOrder(user, nextPickupDate, deliveryDate)
+	if err == errSlotFull {
+		log.Printf("Pickup slot %s on %s is full, skipping user %d", user.PreferredPickupTimeSlot, nextPickupDate.Format("2006-01-02"), user.UserID)
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("error creating order: %w", err)
 	}
 	
+	// Advance the rotation so the next order goes to the following stop
+	if fromRotation {
+		_, err = s.db.Exec(`
+			UPDATE subscription_preferences SET rotation_index = $1 WHERE user_id = $2
+		`, (user.RotationIndex+1)%len(user.AddressRotation), user.UserID)
+		if err != nil {
+			return fmt.Errorf("error advancing address rotation: %w", err)
+		}
+	}
+	
 	log.Printf("Created auto-scheduled order %d for user %d (pickup: %s)", 
 		orderID, user.UserID, nextPickupDate.Format("2006-01-02"))
 	
+	s.notifyAutoScheduledOrder(user, orderID, nextPickupDate)
 	return nil
 }
 
+// resolveAddressStop picks the pickup and delivery addresses for an order on
+// pickupDate. A per-weekday mapping wins over the rotation, which wins over
+// the default addresses. fromRotation reports whether the rotation was used.
+func resolveAddressStop(user ScheduleableUser, pickupDate time.Time) (pickupAddressID, deliveryAddressID *int, fromRotation bool) {
+	weekday := strings.ToLower(pickupDate.Weekday().String())
+	if stop, ok := user.WeekdayAddresses[weekday]; ok {
+		return &stop.PickupAddressID, &stop.DeliveryAddressID, false
+	}
+	
+	if len(user.AddressRotation) > 0 {
+		stop := user.AddressRotation[user.RotationIndex%len(user.AddressRotation)]
+		return &stop.PickupAddressID, &stop.DeliveryAddressID, true
+	}
+	
+	return user.DefaultPickupAddressID, user.DefaultDeliveryAddressID, false
+}
+
 func (s *AutoScheduler) getNextPickupDate(preferredDay string, leadTimeDays int) time.Time {
 	now := time.Now()
 	targetDate := now.AddDate(0, 0, leadTimeDays)
@@ -234,14 +410,25 @@ func (s *AutoScheduler) createOrder(user ScheduleableUser, pickupDate, deliveryD
 	}
 	defer tx.Rollback()
 	
+	// Scheduled pickups count against the slot like any other order
+	var pickupZip string
+	err = tx.QueryRow("SELECT zip_code FROM addresses WHERE id = $1", *user.DefaultPickupAddressID).Scan(&pickupZip)
+	if err != nil {
+		return 0, err
+	}
+	err = checkSlotCapacity(tx, s.slotHolds, pickupDate, marketForZip(pickupZip), user.PreferredPickupTimeSlot, "")
+	if err != nil {
+		return 0, err
+	}
+	
 	// Create the order
 	var orderID int
 	err = tx.QueryRow(`
 		INSERT INTO orders (
 			user_id, subscription_id, pickup_address_id, delivery_address_id,
 			status, pickup_date, delivery_date, pickup_time_slot, delivery_time_slot,
-			special_instructions, created_at, updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+			special_instructions, auto_scheduled, created_at, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, true, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
 		RETURNING id
 	`, 
 		user.UserID, user.SubscriptionID, user.DefaultPickupAddressID, user.DefaultDeliveryAddressID,
@@ -256,8 +443,8 @@ func (s *AutoScheduler) createOrder(user ScheduleableUser, pickupDate, deliveryD
 	// Add order items
 	for _, service := range user.DefaultServices {
 		// Get service price
-		var price float64
-		err = tx.QueryRow("SELECT base_price FROM services WHERE id = $1", service.ServiceID).Scan(&price)
+		var priceCents int
+		err = tx.QueryRow("SELECT base_price_cents FROM services WHERE id = $1", service.ServiceID).Scan(&priceCents)
 		if err != nil {
 			continue // Skip invalid services
 		}
@@ -266,38 +453,60 @@ func (s *AutoScheduler) createOrder(user ScheduleableUser, pickupDate, deliveryD
 		var serviceName string
 		err = tx.QueryRow("SELECT name FROM services WHERE id = $1", service.ServiceID).Scan(&serviceName)
 		if err == nil && serviceName == "standard_bag" {
-			price = 0 // Covered by subscription
+			priceCents = 0 // Covered by subscription
 		}
 		
 		_, err = tx.Exec(`
-			INSERT INTO order_items (order_id, service_id, quantity, price, created_at)
+			INSERT INTO order_items (order_id, service_id, quantity, price_cents, created_at)
 			VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
-		`, orderID, service.ServiceID, service.Quantity, price)
+		`, orderID, service.ServiceID, service.Quantity, priceCents)
 		
 		if err != nil {
 			return 0, err
 		}
 	}
 	
-	// Calculate totals
-	var subtotal, tax, total float64
+	// Calculate totals in cents
+	var subtotalCents int
 	err = tx.QueryRow(`
-		SELECT COALESCE(SUM(price * quantity), 0) FROM order_items WHERE order_id = $1
-	`, orderID).Scan(&subtotal)
+		SELECT COALESCE(SUM(price_cents * quantity), 0) FROM order_items WHERE order_id = $1
+	`, orderID).Scan(&subtotalCents)
+	if err != nil {
+		return 0, err
+	}
+	
+	// Peak or off-peak slot pricing applies as it does at checkout
+	slotRule, err := slotPriceRuleFor(tx, pickupDate, user.PreferredPickupTimeSlot)
 	if err != nil {
 		return 0, err
 	}
+	if slotRule != nil {
+		slotAdjustmentCents := slotRule.adjustmentCents(subtotalCents)
+		_, err = tx.Exec(`
+			UPDATE orders
+			SET slot_price_rule_id = $1, slot_price_label = $2, slot_multiplier_percent = $3, slot_adjustment_cents = $4
+			WHERE id = $5
+		`, slotRule.ID, slotRule.Name, slotRule.MultiplierPercent, slotAdjustmentCents, orderID)
+		if err != nil {
+			return 0, err
+		}
+		subtotalCents += slotAdjustmentCents
+	}
 	
-	tax = subtotal * 0.06 // 6% tax
-	total = subtotal + tax
+	taxCents := money.Percent(subtotalCents, 6) // 6% tax
+	totalCents := subtotalCents + taxCents
 	
 	// Update order totals
 	_, err = tx.Exec(`
-		UPDATE orders SET subtotal = $1, tax = $2, total = $3 WHERE id = $4
-	`, subtotal, tax, total, orderID)
+		UPDATE orders SET subtotal_cents = $1, tax_cents = $2, tip_cents = 0, total_cents = $3 WHERE id = $4
+	`, subtotalCents, taxCents, totalCents, orderID)
 	if err != nil {
 		return 0, err
 	}
+
+	if err := captureOrderPricingSnapshot(tx, orderID, 0); err != nil {
+		return 0, err
+	}
 	
 	// Commit transaction
 	err = tx.Commit()
@@ -54,6 +54,77 @@ func TestGetNextPickupDate(t *testing.T) {
 	}
 }
 
+func TestResolveAddressStop(t *testing.T) {
+	homeID, officeID := 1, 2
+	friday := time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC)
+	monday := time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		user             ScheduleableUser
+		pickupDate       time.Time
+		expectedPickup   *int
+		expectedDelivery *int
+		expectedRotation bool
+	}{
+		{
+			name:             "Defaults when no multi-stop preferences",
+			user:             ScheduleableUser{DefaultPickupAddressID: &homeID, DefaultDeliveryAddressID: &homeID},
+			pickupDate:       monday,
+			expectedPickup:   &homeID,
+			expectedDelivery: &homeID,
+		},
+		{
+			name: "Rotation picks stop by index",
+			user: ScheduleableUser{
+				DefaultPickupAddressID: &homeID,
+				AddressRotation:        []AddressStop{{homeID, homeID}, {officeID, officeID}},
+				RotationIndex:          3,
+			},
+			pickupDate:       monday,
+			expectedPickup:   &officeID,
+			expectedDelivery: &officeID,
+			expectedRotation: true,
+		},
+		{
+			name: "Weekday mapping wins over rotation",
+			user: ScheduleableUser{
+				AddressRotation:  []AddressStop{{homeID, homeID}},
+				WeekdayAddresses: map[string]AddressStop{"friday": {officeID, homeID}},
+			},
+			pickupDate:       friday,
+			expectedPickup:   &officeID,
+			expectedDelivery: &homeID,
+		},
+		{
+			name: "Unmapped weekday falls back to defaults",
+			user: ScheduleableUser{
+				DefaultPickupAddressID:   &homeID,
+				DefaultDeliveryAddressID: &homeID,
+				WeekdayAddresses:         map[string]AddressStop{"friday": {officeID, officeID}},
+			},
+			pickupDate:       monday,
+			expectedPickup:   &homeID,
+			expectedDelivery: &homeID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pickup, delivery, fromRotation := resolveAddressStop(tt.user, tt.pickupDate)
+			if pickup == nil || *pickup != *tt.expectedPickup {
+				t.Errorf("Expected pickup address %d, got %v", *tt.expectedPickup, pickup)
+			}
+			if delivery == nil || *delivery != *tt.expectedDelivery {
+				t.Errorf("Expected delivery address %d, got %v", *tt.expectedDelivery, delivery)
+			}
+			if fromRotation != tt.expectedRotation {
+				t.Errorf("Expected fromRotation %v, got %v", tt.expectedRotation, fromRotation)
+			}
+		})
+	}
+}
+
 func TestCreateOrderForUser(t *testing.T) {
 	// This test requires a test database
 	if testing.Short() {
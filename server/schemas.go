@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// EventSchema is one published version of an event body's JSON Schema.
+// Partners and the frontend pin a version; a breaking change to a payload
+// gets a new version appended here rather than editing the old one.
+type EventSchema struct {
+	Event       string                 `json:"event"`
+	Version     int                    `json:"version"`
+	Description string                 `json:"description"`
+	Schema      map[string]interface{} `json:"-"`
+}
+
+// jsonSchemaDraft is the dialect every published schema declares
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// realtimeOrderStatuses are the statuses order_status_update can carry. The
+// pickup notification uses pickup_scheduled, which isn't an order status.
+func realtimeOrderStatuses() []interface{} {
+	statuses := []interface{}{}
+	for _, def := range orderStatuses {
+		statuses = append(statuses, def.Status)
+	}
+	return append(statuses, "pickup_scheduled")
+}
+
+// realtimeEnvelope is the OrderUpdateMessage shape shared by every event
+// sent over Centrifuge, with the given type, status, required fields and data schema
+func realtimeEnvelope(eventType, status map[string]interface{}, required []interface{}, data map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "object",
+		"required": append([]interface{}{"type", "order_id", "status", "message", "timestamp"}, required...),
+		"properties": map[string]interface{}{
+			"type":      eventType,
+			"order_id":  map[string]interface{}{"type": "integer"},
+			"status":    status,
+			"message":   map[string]interface{}{"type": "string"},
+			"timestamp": map[string]interface{}{"type": "string"},
+			"data":      data,
+		},
+		"additionalProperties": false,
+	}
+}
+
+// withOptional adds optional properties to an envelope. Later versions use it
+// for fields a client pinned to an older version would reject.
+func withOptional(envelope map[string]interface{}, extra ...map[string]interface{}) map[string]interface{} {
+	schema := map[string]interface{}{}
+	for key, value := range envelope {
+		schema[key] = value
+	}
+	properties := map[string]interface{}{}
+	for key, value := range envelope["properties"].(map[string]interface{}) {
+		properties[key] = value
+	}
+	for _, props := range extra {
+		for key, value := range props {
+			properties[key] = value
+		}
+	}
+	schema["properties"] = properties
+	return schema
+}
+
+// eventIDProperty is the event_id critical updates carry
+var eventIDProperty = map[string]interface{}{
+	"event_id": map[string]interface{}{"type": "string"},
+}
+
+// testProperty flags events about sandbox accounts' orders
+var testProperty = map[string]interface{}{
+	"test": map[string]interface{}{"type": "boolean"},
+}
+
+// orderStatusUpdateData is the data schema shared by every order_status_update version
+var orderStatusUpdateData = map[string]interface{}{
+	"type": []interface{}{"object", "null"},
+	"properties": map[string]interface{}{
+		"estimated_pickup_time":   map[string]interface{}{"type": "string"},
+		"estimated_delivery_time": map[string]interface{}{"type": "string"},
+		"delivery_instructions":   map[string]interface{}{"type": "string"},
+		"order_number":            map[string]interface{}{"type": "string"},
+		"rating_url":              map[string]interface{}{"type": "string"},
+		"driver_info": map[string]interface{}{
+			"type":     "object",
+			"required": []interface{}{"name", "phone"},
+			"properties": map[string]interface{}{
+				"name":  map[string]interface{}{"type": "string"},
+				"phone": map[string]interface{}{"type": "string"},
+			},
+			"additionalProperties": false,
+		},
+	},
+	"additionalProperties": false,
+}
+
+// driverLocationData is the data schema shared by every driver_location version
+var driverLocationData = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"driver_location", "estimated_arrival"},
+	"properties": map[string]interface{}{
+		"driver_location": map[string]interface{}{
+			"type":     "object",
+			"required": []interface{}{"latitude", "longitude"},
+			"properties": map[string]interface{}{
+				"latitude":  map[string]interface{}{"type": "number"},
+				"longitude": map[string]interface{}{"type": "number"},
+			},
+			"additionalProperties": false,
+		},
+		"estimated_arrival": map[string]interface{}{"type": "string"},
+	},
+	"additionalProperties": false,
+}
+
+// orderMessageData, orderMessageReadData and orderTypingData are the data
+// schemas of the order chat events
+var orderMessageData = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"id", "sender_id", "sender_role", "sender_name"},
+	"properties": map[string]interface{}{
+		"id":          map[string]interface{}{"type": "integer"},
+		"sender_id":   map[string]interface{}{"type": []interface{}{"integer", "null"}},
+		"sender_role": map[string]interface{}{"enum": []interface{}{"customer", "driver", "support"}},
+		"sender_name": map[string]interface{}{"type": "string"},
+	},
+	"additionalProperties": false,
+}
+
+var orderMessageReadData = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"user_id", "role", "last_read_message_id"},
+	"properties": map[string]interface{}{
+		"user_id":              map[string]interface{}{"type": "integer"},
+		"role":                 map[string]interface{}{"enum": []interface{}{"customer", "driver", "support"}},
+		"last_read_message_id": map[string]interface{}{"type": "integer"},
+	},
+	"additionalProperties": false,
+}
+
+var orderTypingData = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"user_id", "role", "typing"},
+	"properties": map[string]interface{}{
+		"user_id": map[string]interface{}{"type": "integer"},
+		"role":    map[string]interface{}{"enum": []interface{}{"customer", "driver", "support"}},
+		"typing":  map[string]interface{}{"type": "boolean"},
+	},
+	"additionalProperties": false,
+}
+
+// orderItemEventData is the data schema of order_item_event
+var orderItemEventData = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"id", "event", "order_garment_id", "garment_name", "quantity", "previous_garment_name"},
+	"properties": map[string]interface{}{
+		"id":                    map[string]interface{}{"type": "integer"},
+		"event":                 map[string]interface{}{"enum": []interface{}{itemEventAdded, itemEventDamaged, itemEventSubstituted}},
+		"order_garment_id":      map[string]interface{}{"type": "integer"},
+		"garment_name":          map[string]interface{}{"type": "string"},
+		"quantity":              map[string]interface{}{"type": "integer"},
+		"previous_garment_name": map[string]interface{}{"type": []interface{}{"string", "null"}},
+	},
+	"additionalProperties": false,
+}
+
+// userSyncClaimsData is the user object carried by user sync callbacks
+var userSyncClaimsData = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"user_id", "email", "first_name", "last_name", "role", "status"},
+	"properties": map[string]interface{}{
+		"user_id":    map[string]interface{}{"type": "integer"},
+		"email":      map[string]interface{}{"type": "string"},
+		"first_name": map[string]interface{}{"type": "string"},
+		"last_name":  map[string]interface{}{"type": "string"},
+		"role":       map[string]interface{}{"type": "string"},
+		"status":     map[string]interface{}{"type": "string"},
+	},
+	"additionalProperties": false,
+}
+
+// eventSchemas lists every published version, oldest first per event
+var eventSchemas = []EventSchema{
+	{
+		Event:       "connection",
+		Version:     1,
+		Description: "Sent to a client when its realtime connection opens",
+		Schema: realtimeEnvelope(
+			map[string]interface{}{"const": "connection"},
+			map[string]interface{}{"const": ""},
+			nil,
+			map[string]interface{}{"type": "null"},
+		),
+	},
+	{
+		Event:       "order_status_update",
+		Version:     1,
+		Description: "Published on order:{user_id} and order:{user_id}:{order_id} when an order changes status",
+		Schema: realtimeEnvelope(
+			map[string]interface{}{"const": "order_status_update"},
+			map[string]interface{}{"enum": realtimeOrderStatuses()},
+			nil,
+			orderStatusUpdateData,
+		),
+	},
+	{
+		Event:   "order_status_update",
+		Version: 2,
+		Description: "Published on order:{user_id} and order:{user_id}:{order_id} when an order changes status. " +
+			"Critical updates carry an event_id the app acknowledges with the " + ackEventRPCMethod + " RPC.",
+		Schema: withOptional(realtimeEnvelope(
+			map[string]interface{}{"const": "order_status_update"},
+			map[string]interface{}{"enum": realtimeOrderStatuses()},
+			nil,
+			orderStatusUpdateData,
+		), eventIDProperty),
+	},
+	{
+		Event:   "order_status_update",
+		Version: 3,
+		Description: "Published on order:{user_id} and order:{user_id}:{order_id} when an order changes status. " +
+			"Critical updates carry an event_id the app acknowledges with the " + ackEventRPCMethod + " RPC; " +
+			"updates about sandbox orders carry test: true.",
+		Schema: withOptional(realtimeEnvelope(
+			map[string]interface{}{"const": "order_status_update"},
+			map[string]interface{}{"enum": realtimeOrderStatuses()},
+			nil,
+			orderStatusUpdateData,
+		), eventIDProperty, testProperty),
+	},
+	{
+		Event:       "driver_location",
+		Version:     1,
+		Description: "Published on order:{user_id}:{order_id} while the driver is en route",
+		Schema: realtimeEnvelope(
+			map[string]interface{}{"const": "driver_location"},
+			map[string]interface{}{"const": ""},
+			[]interface{}{"data"},
+			driverLocationData,
+		),
+	},
+	{
+		Event:       "driver_location",
+		Version:     2,
+		Description: "Published on order:{user_id}:{order_id} while the driver is en route; sandbox orders carry test: true",
+		Schema: withOptional(realtimeEnvelope(
+			map[string]interface{}{"const": "driver_location"},
+			map[string]interface{}{"const": ""},
+			[]interface{}{"data"},
+			driverLocationData,
+		), testProperty),
+	},
+	{
+		Event:       "admin_alert",
+		Version:     1,
+		Description: "Published on " + adminAlertsChannel + "; type is the alert type and data depends on it",
+		Schema: realtimeEnvelope(
+			map[string]interface{}{"type": "string"},
+			map[string]interface{}{"const": ""},
+			nil,
+			map[string]interface{}{"type": []interface{}{"object", "null"}},
+		),
+	},
+	{
+		Event:       "order_message",
+		Version:     1,
+		Description: "Published on chat:order:{order_id} when the customer, a driver or support posts in the order's chat; message is the text",
+		Schema: withOptional(realtimeEnvelope(
+			map[string]interface{}{"const": "order_message"},
+			map[string]interface{}{"const": ""},
+			[]interface{}{"data"},
+			orderMessageData,
+		), testProperty),
+	},
+	{
+		Event:       "order_message_read",
+		Version:     1,
+		Description: "Published on chat:order:{order_id} when a participant reads the order's chat",
+		Schema: withOptional(realtimeEnvelope(
+			map[string]interface{}{"const": "order_message_read"},
+			map[string]interface{}{"const": ""},
+			[]interface{}{"data"},
+			orderMessageReadData,
+		), testProperty),
+	},
+	{
+		Event:   "order_typing",
+		Version: 1,
+		Description: "Published on chat:order:{order_id} when a participant starts or stops typing, " +
+			"sent with the " + chatTypingRPCMethod + " RPC",
+		Schema: withOptional(realtimeEnvelope(
+			map[string]interface{}{"const": "order_typing"},
+			map[string]interface{}{"const": ""},
+			[]interface{}{"data"},
+			orderTypingData,
+		), testProperty),
+	},
+	{
+		Event:   "order_item_event",
+		Version: 1,
+		Description: "Published on order:{user_id}:{order_id} when a driver adds garments at pickup or the facility " +
+			"flags pieces damaged or substitutes a garment type. Partner webhooks get the same events.",
+		Schema: withOptional(realtimeEnvelope(
+			map[string]interface{}{"const": "order_item_event"},
+			map[string]interface{}{"const": ""},
+			[]interface{}{"data"},
+			orderItemEventData,
+		), testProperty),
+	},
+	{
+		Event:   "user_sync",
+		Version: 1,
+		Description: "POSTed to USER_SYNC_WEBHOOK_URL when an admin changes a user, and returned by " +
+			"/api/v1/auth/sync as user.current; signed like every user sync request",
+		Schema: map[string]interface{}{
+			"type":     "object",
+			"required": []interface{}{"event", "user", "sent_at"},
+			"properties": map[string]interface{}{
+				"event":   map[string]interface{}{"enum": []interface{}{"user.created", "user.updated", "user.deleted", "user.current"}},
+				"user":    userSyncClaimsData,
+				"sent_at": map[string]interface{}{"type": "string"},
+			},
+			"additionalProperties": false,
+		},
+	},
+}
+
+// eventSchemaFor returns the requested version of an event's schema, or the
+// latest one when version is 0
+func eventSchemaFor(event string, version int) (EventSchema, bool) {
+	var found EventSchema
+	ok := false
+	for _, schema := range eventSchemas {
+		if schema.Event != event {
+			continue
+		}
+		if schema.Version == version {
+			return schema, true
+		}
+		if version == 0 && schema.Version > found.Version {
+			found, ok = schema, true
+		}
+	}
+	return found, ok
+}
+
+// document renders the schema as a standalone JSON Schema document
+func (s EventSchema) document() map[string]interface{} {
+	doc := map[string]interface{}{
+		"$schema":     jsonSchemaDraft,
+		"$id":         fmt.Sprintf("%s/schemas/%s?version=%d", APIPrefix, s.Event, s.Version),
+		"title":       s.Event,
+		"description": s.Description,
+		"version":     s.Version,
+	}
+	for key, value := range s.Schema {
+		doc[key] = value
+	}
+	return doc
+}
+
+// handleGetEventSchemas lists every published event schema and its versions
+func (s *Server) handleGetEventSchemas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(eventSchemas)
+}
+
+// handleGetEventSchema serves one event's JSON Schema, the latest version
+// unless ?version= pins an older one
+func (s *Server) handleGetEventSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		version = parsed
+	}
+
+	schema, ok := eventSchemaFor(mux.Vars(r)["event"], version)
+	if !ok {
+		http.Error(w, "Schema not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(schema.document())
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// validateAgainstSchema checks a decoded JSON value against the subset of
+// JSON Schema the registry uses: type, const, enum, required, properties and
+// additionalProperties: false
+func validateAgainstSchema(schema map[string]interface{}, value interface{}, path string) []string {
+	errs := []string{}
+
+	if t, ok := schema["type"]; ok {
+		types := []interface{}{t}
+		if list, ok := t.([]interface{}); ok {
+			types = list
+		}
+		matched := false
+		for _, t := range types {
+			if jsonTypeMatches(t.(string), value) {
+				matched = true
+			}
+		}
+		if !matched {
+			return append(errs, fmt.Sprintf("%s: expected type %v, got %T", path, t, value))
+		}
+	}
+	if c, ok := schema["const"]; ok && c != value {
+		errs = append(errs, fmt.Sprintf("%s: expected %v, got %v", path, c, value))
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if e == value {
+				found = true
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", path, value, enum))
+		}
+	}
+
+	object, isObject := value.(map[string]interface{})
+	if !isObject {
+		return errs
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, present := object[name.(string)]; !present {
+				errs = append(errs, fmt.Sprintf("%s: missing required %s", path, name))
+			}
+		}
+	}
+	for name, field := range object {
+		fieldSchema, known := properties[name].(map[string]interface{})
+		if !known {
+			if schema["additionalProperties"] == false {
+				errs = append(errs, fmt.Sprintf("%s: unexpected field %s", path, name))
+			}
+			continue
+		}
+		errs = append(errs, validateAgainstSchema(fieldSchema, field, path+"."+name)...)
+	}
+	return errs
+}
+
+func jsonTypeMatches(t string, value interface{}) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == float64(int64(n))
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+// roundTrip marshals a payload the way it goes over the wire and decodes it
+// back into generic JSON
+func roundTrip(t *testing.T, payload interface{}) interface{} {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("Failed to marshal payload: %v", err)
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		t.Fatalf("Failed to unmarshal payload: %v", err)
+	}
+	return value
+}
+
+func TestEventSchemas_OutgoingPayloadsMatch(t *testing.T) {
+	failedBackup := "pg_restore exited with status 1"
+	syncClaims := UserSyncClaims{UserID: 4, Email: "ada@example.com", FirstName: "Ada", LastName: "Lovelace", Role: "customer", Status: "active"}
+
+	tests := []struct {
+		event   string
+		payload interface{}
+	}{
+		{"connection", connectionMessage()},
+		{"order_status_update", orderUpdateMessage(12, "picked_up", orderStatusMessage("picked_up"), nil)},
+		{"order_status_update", orderUpdateMessage(12, "pickup_scheduled", "Your laundry pickup is scheduled", pickupUpdateData("10:30 AM"))},
+		{"order_status_update", orderUpdateMessage(12, "out_for_delivery", "Your clean laundry is out for delivery", deliveryUpdateData("2:00 PM"))},
+		{"order_status_update", orderUpdateMessage(12, "delivered", "Your laundry has been delivered successfully!", completionUpdateData(12, "TUM-2025-012"))},
+		{"order_status_update", OrderUpdateMessage{Type: "order_status_update", OrderID: 12, Status: "picked_up", Message: orderStatusMessage("picked_up"), Timestamp: "now", EventID: "abc123"}},
+		{"order_status_update", OrderUpdateMessage{Type: "order_status_update", OrderID: 12, Status: "scheduled", Message: "Order created successfully", Timestamp: "now", Test: true}},
+		{"driver_location", driverLocationMessage(12, 40.7128, -74.006, "5 minutes")},
+		{"driver_location", OrderUpdateMessage{Type: "driver_location", OrderID: 12, Message: "Driver location updated", Timestamp: "now", Test: true,
+			Data: driverLocationMessage(12, 40.7128, -74.006, "5 minutes").Data}},
+		{"admin_alert", adminAlertMessage("backup_verification", "Backup verification failed", BackupVerification{
+			ID: 3, BackupFile: "nightly.dump", Status: "failed", Error: &failedBackup, CreatedAt: time.Now(),
+		})},
+		{"order_message", orderChatMessage(OrderMessage{ID: 7, OrderID: 12, SenderRole: "customer", SenderName: "Ada", Body: "Gate code is 1234", CreatedAt: time.Now()})},
+		{"order_message", orderChatMessage(OrderMessage{ID: 8, OrderID: 12, SenderID: &[]int{4}[0], SenderRole: "support", SenderName: "Tumble Support", Body: "Thanks!", CreatedAt: time.Now()})},
+		{"order_message_read", orderChatReadMessage(OrderMessageRead{OrderID: 12, UserID: 4, Role: "driver", LastReadMessageID: 7, ReadAt: time.Now()})},
+		{"order_typing", orderChatTypingMessage(OrderChatTyping{OrderID: 12, UserID: 4, Role: "customer", Typing: true})},
+		{"order_item_event", orderItemEventMessage(OrderItemEvent{ID: 3, OrderID: 12, OrderGarmentID: 9, Event: itemEventAdded, GarmentName: "Pillowcase", Quantity: 4, CreatedAt: time.Now()})},
+		{"order_item_event", orderItemEventMessage(OrderItemEvent{ID: 4, OrderID: 12, OrderGarmentID: 9, Event: itemEventSubstituted, GarmentName: "Flat Sheet", Quantity: 4, PreviousGarmentName: &[]string{"Pillowcase"}[0], CreatedAt: time.Now()})},
+		{"user_sync", UserSyncEvent{Event: "user.created", User: syncClaims, SentAt: time.Now().UTC()}},
+		{"user_sync", UserSyncEvent{Event: "user.updated", User: syncClaims, SentAt: time.Now().UTC()}},
+		{"user_sync", UserSyncEvent{Event: "user.deleted", User: syncClaims, SentAt: time.Now().UTC()}},
+		{"user_sync", UserSyncEvent{Event: "user.current", User: syncClaims, SentAt: time.Now().UTC()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			schema, ok := eventSchemaFor(tt.event, 0)
+			if !ok {
+				t.Fatalf("No schema registered for %s", tt.event)
+			}
+			if errs := validateAgainstSchema(schema.Schema, roundTrip(t, tt.payload), tt.event); len(errs) > 0 {
+				t.Errorf("Payload doesn't match its published schema: %v", errs)
+			}
+		})
+	}
+}
+
+func TestEventSchemas_RejectUndocumentedFields(t *testing.T) {
+	schema, _ := eventSchemaFor("driver_location", 0)
+
+	payload := roundTrip(t, driverLocationMessage(12, 40.7128, -74.006, "5 minutes")).(map[string]interface{})
+	payload["data"].(map[string]interface{})["heading"] = 90.0
+	delete(payload, "timestamp")
+
+	errs := validateAgainstSchema(schema.Schema, payload, "driver_location")
+	sort.Strings(errs)
+	if len(errs) != 2 {
+		t.Errorf("Expected the missing timestamp and extra heading to be reported, got %v", errs)
+	}
+
+	status, _ := eventSchemaFor("order_status_update", 0)
+	if errs := validateAgainstSchema(status.Schema, roundTrip(t, orderUpdateMessage(12, "lost", "", nil)), "order_status_update"); len(errs) != 1 {
+		t.Errorf("Expected an unknown status to be rejected, got %v", errs)
+	}
+}
+
+func TestEventSchemas_Registry(t *testing.T) {
+	seen := map[string]bool{}
+	for _, schema := range eventSchemas {
+		key := fmt.Sprintf("%s@%d", schema.Event, schema.Version)
+		if seen[key] {
+			t.Errorf("Duplicate schema version %s", key)
+		}
+		seen[key] = true
+		if schema.Version < 1 || schema.Description == "" {
+			t.Errorf("Schema %s needs a version and description", key)
+		}
+	}
+}
+
+func TestHandleGetEventSchema(t *testing.T) {
+	server := &Server{}
+
+	tests := []struct {
+		name           string
+		event          string
+		query          string
+		expectedStatus int
+		version        int
+	}{
+		{"Latest version", "order_status_update", "", http.StatusOK, 3},
+		{"Pinned older version", "order_status_update", "?version=1", http.StatusOK, 1},
+		{"Pinned version", "driver_location", "?version=1", http.StatusOK, 1},
+		{"Unknown version", "driver_location", "?version=9", http.StatusNotFound, 0},
+		{"Invalid version", "driver_location", "?version=latest", http.StatusBadRequest, 0},
+		{"Unknown event", "order_exploded", "", http.StatusNotFound, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/schemas/"+tt.event+tt.query, nil)
+			req = mux.SetURLVars(req, map[string]string{"event": tt.event})
+			w := httptest.NewRecorder()
+			server.handleGetEventSchema(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var doc map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+				t.Fatalf("Failed to unmarshal schema: %v", err)
+			}
+			if doc["$schema"] != jsonSchemaDraft || doc["title"] != tt.event || doc["version"] != float64(tt.version) {
+				t.Errorf("Unexpected schema document header: %v", doc)
+			}
+			if doc["$id"] != fmt.Sprintf("/api/v1/schemas/%s?version=%d", tt.event, tt.version) {
+				t.Errorf("Unexpected $id %v", doc["$id"])
+			}
+		})
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// ServiceAreaHandler serves coverage checks, the waitlist for uncovered ZIP
+// codes, and the admin CRUD for zones and covered ZIPs
+type ServiceAreaHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewServiceAreaHandler(db *sql.DB) *ServiceAreaHandler {
+	return &ServiceAreaHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// ServiceAreaCheck says whether we serve a ZIP code
+type ServiceAreaCheck struct {
+	ZipCode string  `json:"zip_code"`
+	Covered bool    `json:"covered"`
+	Zone    *string `json:"zone,omitempty"`
+	// Surcharge is added once to each order picked up or delivered in the zone
+	Surcharge      float64 `json:"surcharge"`
+	surchargeCents int
+}
+
+// ServiceZone groups covered ZIP codes
+type ServiceZone struct {
+	ID        int     `json:"id"`
+	Name      string  `json:"name"`
+	Surcharge float64 `json:"surcharge"`
+	ZipCount  int     `json:"zip_count"`
+}
+
+// ServiceArea is one covered ZIP code
+type ServiceArea struct {
+	ZipCode   string  `json:"zip_code"`
+	ZoneID    *int    `json:"zone_id"`
+	ZoneName  *string `json:"zone_name,omitempty"`
+	Surcharge float64 `json:"surcharge"`
+	IsActive  bool    `json:"is_active"`
+	// WaitlistCount is people who signed up before the ZIP was covered and
+	// haven't been told yet
+	WaitlistCount int `json:"waitlist_count"`
+}
+
+// WaitlistEntry is someone waiting for us to cover their ZIP code
+type WaitlistEntry struct {
+	ID         int     `json:"id"`
+	Email      string  `json:"email"`
+	ZipCode    string  `json:"zip_code"`
+	UserID     *int    `json:"user_id,omitempty"`
+	CreatedAt  string  `json:"created_at"`
+	NotifiedAt *string `json:"notified_at,omitempty"`
+}
+
+// normalizeZipCode returns the five-digit ZIP from input such as
+// "12345-6789", or false when it isn't one
+func normalizeZipCode(zipCode string) (string, bool) {
+	zipCode = strings.TrimSpace(zipCode)
+	if i := strings.IndexByte(zipCode, '-'); i >= 0 {
+		zipCode = zipCode[:i]
+	}
+	if len(zipCode) != 5 {
+		return "", false
+	}
+	if _, err := strconv.Atoi(zipCode); err != nil {
+		return "", false
+	}
+	return zipCode, true
+}
+
+// checkServiceArea looks up coverage for a normalized ZIP. Every ZIP is
+// covered until at least one service area is active.
+func checkServiceArea(q queryRower, zipCode string) (ServiceAreaCheck, error) {
+	check := ServiceAreaCheck{ZipCode: zipCode}
+	var unrestricted, listed bool
+	var zone sql.NullString
+	err := q.QueryRow(`
+		SELECT NOT EXISTS (SELECT 1 FROM service_areas WHERE is_active = true),
+		       a.zip_code IS NOT NULL, z.name, COALESCE(z.surcharge_cents, 0)
+		FROM (SELECT 1) one
+		LEFT JOIN service_areas a ON a.zip_code = $1 AND a.is_active = true
+		LEFT JOIN service_zones z ON z.id = a.zone_id`,
+		zipCode,
+	).Scan(&unrestricted, &listed, &zone, &check.surchargeCents)
+	if err != nil {
+		return check, err
+	}
+	check.Covered = unrestricted || listed
+	if zone.Valid {
+		check.Zone = &zone.String
+	}
+	check.Surcharge = centsToDollars(check.surchargeCents)
+	return check, nil
+}
+
+// writeOutsideServiceArea turns away an address we don't serve, pointing the
+// customer at the waitlist
+func writeOutsideServiceArea(w http.ResponseWriter, zipCode string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":    "Outside service area",
+		"message":  fmt.Sprintf("We don't serve %s yet. Join the waitlist and we'll let you know when we do.", zipCode),
+		"zip_code": zipCode,
+		"waitlist": true,
+	})
+}
+
+// requireServiceArea checks the ZIP of an address being saved or ordered
+// to, writing the error and returning false when it's malformed or not
+// covered
+func requireServiceArea(w http.ResponseWriter, q queryRower, zipCode string) (ServiceAreaCheck, bool) {
+	zip, ok := normalizeZipCode(zipCode)
+	if !ok {
+		http.Error(w, "Invalid ZIP code", http.StatusBadRequest)
+		return ServiceAreaCheck{}, false
+	}
+	check, err := checkServiceArea(q, zip)
+	if err != nil {
+		http.Error(w, "Failed to check service area", http.StatusInternalServerError)
+		return check, false
+	}
+	if !check.Covered {
+		writeOutsideServiceArea(w, zip)
+		return check, false
+	}
+	return check, true
+}
+
+// OrderZoneSurcharge is the service zone surcharge an order was sold with
+type OrderZoneSurcharge struct {
+	Zone   string  `json:"zone"`
+	Amount float64 `json:"amount"`
+}
+
+// getOrderZoneSurcharge returns the zone surcharge on an order, or nil if it
+// didn't have one
+func getOrderZoneSurcharge(q queryRower, orderID int) (*OrderZoneSurcharge, error) {
+	var zone sql.NullString
+	var surchargeCents int
+	err := q.QueryRow(
+		"SELECT service_zone_name, zone_surcharge_cents FROM orders WHERE id = $1",
+		orderID,
+	).Scan(&zone, &surchargeCents)
+	if err != nil {
+		return nil, err
+	}
+	if !zone.Valid || surchargeCents == 0 {
+		return nil, nil
+	}
+	return &OrderZoneSurcharge{Zone: zone.String, Amount: centsToDollars(surchargeCents)}, nil
+}
+
+// handleCheckServiceArea tells anyone whether we serve ?zip=
+func (h *ServiceAreaHandler) handleCheckServiceArea(w http.ResponseWriter, r *http.Request) {
+	zipCode, ok := normalizeZipCode(r.URL.Query().Get("zip"))
+	if !ok {
+		http.Error(w, "Invalid ZIP code", http.StatusBadRequest)
+		return
+	}
+
+	check, err := checkServiceArea(h.db, zipCode)
+	if err != nil {
+		http.Error(w, "Failed to check service area", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check)
+}
+
+// handleJoinWaitlist signs someone up to hear when we reach their ZIP code.
+// Signed-in customers are linked to the entry; signing up twice is a no-op.
+func (h *ServiceAreaHandler) handleJoinWaitlist(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email   string `json:"email"`
+		ZipCode string `json:"zip_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if _, err := mail.ParseAddress(req.Email); err != nil || len(req.Email) > 255 {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	zipCode, ok := normalizeZipCode(req.ZipCode)
+	if !ok {
+		http.Error(w, "Invalid ZIP code", http.StatusBadRequest)
+		return
+	}
+
+	check, err := checkServiceArea(h.db, zipCode)
+	if err != nil {
+		http.Error(w, "Failed to check service area", http.StatusInternalServerError)
+		return
+	}
+	if check.Covered {
+		http.Error(w, "We already serve this ZIP code", http.StatusConflict)
+		return
+	}
+
+	var userID *int
+	if id, err := h.getUserID(r, h.db); err == nil {
+		userID = &id
+	}
+	_, err = h.db.Exec(`
+		INSERT INTO service_area_waitlist (email, zip_code, user_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (email, zip_code) DO UPDATE SET user_id = COALESCE(EXCLUDED.user_id, service_area_waitlist.user_id)`,
+		req.Email, zipCode, userID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to join waitlist", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"email":    req.Email,
+		"zip_code": zipCode,
+		"message":  "You're on the list. We'll email you when we start serving your area.",
+	})
+}
+
+// writeServiceAreaError maps constraint failures to client errors
+func writeServiceAreaError(w http.ResponseWriter, err error, action string) {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "23505":
+			http.Error(w, "A zone with this name already exists", http.StatusConflict)
+			return
+		case "23503":
+			http.Error(w, "Unknown zone", http.StatusBadRequest)
+			return
+		}
+	}
+	http.Error(w, "Failed to "+action, http.StatusInternalServerError)
+}
+
+// handleGetServiceZones lists zones with how many ZIPs each covers
+func (h *ServiceAreaHandler) handleGetServiceZones(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT z.id, z.name, z.surcharge_cents, COUNT(a.zip_code)
+		FROM service_zones z
+		LEFT JOIN service_areas a ON a.zone_id = z.id AND a.is_active = true
+		GROUP BY z.id
+		ORDER BY z.name`)
+	if err != nil {
+		http.Error(w, "Failed to fetch service zones", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	zones := []ServiceZone{}
+	for rows.Next() {
+		var zone ServiceZone
+		var surchargeCents int
+		if err := rows.Scan(&zone.ID, &zone.Name, &surchargeCents, &zone.ZipCount); err != nil {
+			http.Error(w, "Failed to fetch service zones", http.StatusInternalServerError)
+			return
+		}
+		zone.Surcharge = centsToDollars(surchargeCents)
+		zones = append(zones, zone)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zones)
+}
+
+// decodeServiceZone reads and checks a zone from the admin API
+func decodeServiceZone(r *http.Request) (name string, surchargeCents int, err error) {
+	var req struct {
+		Name      string  `json:"name"`
+		Surcharge float64 `json:"surcharge"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", 0, fmt.Errorf("Invalid request body")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		return "", 0, fmt.Errorf("name is required and must be 100 characters or fewer")
+	}
+	if req.Surcharge < 0 {
+		return "", 0, fmt.Errorf("surcharge can't be negative")
+	}
+	return req.Name, dollarsToCents(req.Surcharge), nil
+}
+
+// handleCreateServiceZone adds a zone
+func (h *ServiceAreaHandler) handleCreateServiceZone(w http.ResponseWriter, r *http.Request) {
+	name, surchargeCents, err := decodeServiceZone(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	zone := ServiceZone{Name: name, Surcharge: centsToDollars(surchargeCents)}
+	err = h.db.QueryRow(
+		"INSERT INTO service_zones (name, surcharge_cents) VALUES ($1, $2) RETURNING id",
+		name, surchargeCents,
+	).Scan(&zone.ID)
+	if err != nil {
+		writeServiceAreaError(w, err, "create service zone")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(zone)
+}
+
+// handleUpdateServiceZone renames a zone or changes its surcharge. Orders
+// already placed keep the surcharge they were sold with.
+func (h *ServiceAreaHandler) handleUpdateServiceZone(w http.ResponseWriter, r *http.Request) {
+	zoneID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid zone ID", http.StatusBadRequest)
+		return
+	}
+	name, surchargeCents, err := decodeServiceZone(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	zone := ServiceZone{ID: zoneID, Name: name, Surcharge: centsToDollars(surchargeCents)}
+	err = h.db.QueryRow(`
+		UPDATE service_zones SET name = $1, surcharge_cents = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+		RETURNING (SELECT COUNT(*) FROM service_areas WHERE zone_id = $3 AND is_active = true)`,
+		name, surchargeCents, zoneID,
+	).Scan(&zone.ZipCount)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Service zone not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeServiceAreaError(w, err, "update service zone")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zone)
+}
+
+// handleDeleteServiceZone removes a zone. Its ZIPs stay covered, without a
+// surcharge.
+func (h *ServiceAreaHandler) handleDeleteServiceZone(w http.ResponseWriter, r *http.Request) {
+	zoneID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid zone ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM service_zones WHERE id = $1", zoneID)
+	if err != nil {
+		http.Error(w, "Failed to delete service zone", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Service zone not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetServiceAreas lists covered ZIP codes, optionally for ?zone_id=
+func (h *ServiceAreaHandler) handleGetServiceAreas(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT a.zip_code, a.zone_id, z.name, COALESCE(z.surcharge_cents, 0), a.is_active,
+		       (SELECT COUNT(*) FROM service_area_waitlist wl WHERE wl.zip_code = a.zip_code AND wl.notified_at IS NULL)
+		FROM service_areas a
+		LEFT JOIN service_zones z ON z.id = a.zone_id`
+	marketID, ok := adminMarketFilter(w, r, h.db)
+	if !ok {
+		return
+	}
+	args := []interface{}{marketID}
+	query += " WHERE " + zipInMarket("a.zip_code", "$1")
+	if zoneID := r.URL.Query().Get("zone_id"); zoneID != "" {
+		id, err := strconv.Atoi(zoneID)
+		if err != nil {
+			http.Error(w, "Invalid zone ID", http.StatusBadRequest)
+			return
+		}
+		args = append(args, id)
+		query += " AND a.zone_id = $2"
+	}
+	query += " ORDER BY a.zip_code"
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch service areas", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	areas := []ServiceArea{}
+	for rows.Next() {
+		var area ServiceArea
+		var surchargeCents int
+		if err := rows.Scan(&area.ZipCode, &area.ZoneID, &area.ZoneName, &surchargeCents, &area.IsActive, &area.WaitlistCount); err != nil {
+			http.Error(w, "Failed to fetch service areas", http.StatusInternalServerError)
+			return
+		}
+		area.Surcharge = centsToDollars(surchargeCents)
+		areas = append(areas, area)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(areas)
+}
+
+// handleSetServiceAreas adds ZIP codes to coverage, or updates their zone and
+// whether they're active when they're already listed
+func (h *ServiceAreaHandler) handleSetServiceAreas(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ZipCodes []string `json:"zip_codes"`
+		ZoneID   *int     `json:"zone_id"`
+		IsActive *bool    `json:"is_active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.ZipCodes) == 0 || len(req.ZipCodes) > 1000 {
+		http.Error(w, "Between 1 and 1000 zip_codes are required", http.StatusBadRequest)
+		return
+	}
+	zipCodes := make([]string, 0, len(req.ZipCodes))
+	for _, raw := range req.ZipCodes {
+		zipCode, ok := normalizeZipCode(raw)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Invalid ZIP code %q", raw), http.StatusBadRequest)
+			return
+		}
+		zipCodes = append(zipCodes, zipCode)
+	}
+	isActive := true
+	if req.IsActive != nil {
+		isActive = *req.IsActive
+	}
+
+	_, err := h.db.Exec(`
+		INSERT INTO service_areas (zip_code, zone_id, is_active)
+		SELECT DISTINCT zip, $2::int, $3 FROM unnest($1::text[]) AS zip
+		ON CONFLICT (zip_code) DO UPDATE
+		SET zone_id = EXCLUDED.zone_id, is_active = EXCLUDED.is_active, updated_at = CURRENT_TIMESTAMP`,
+		pq.Array(zipCodes), req.ZoneID, isActive,
+	)
+	if err != nil {
+		writeServiceAreaError(w, err, "update service areas")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"zip_codes": zipCodes,
+		"zone_id":   req.ZoneID,
+		"is_active": isActive,
+	})
+}
+
+// handleDeleteServiceArea takes a ZIP code out of coverage. Existing
+// addresses and orders there are left alone.
+func (h *ServiceAreaHandler) handleDeleteServiceArea(w http.ResponseWriter, r *http.Request) {
+	zipCode, ok := normalizeZipCode(mux.Vars(r)["zip"])
+	if !ok {
+		http.Error(w, "Invalid ZIP code", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM service_areas WHERE zip_code = $1", zipCode)
+	if err != nil {
+		http.Error(w, "Failed to delete service area", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Service area not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetWaitlist lists waitlist signups, optionally for ?zip=
+func (h *ServiceAreaHandler) handleGetWaitlist(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT id, email, zip_code, user_id, TO_CHAR(created_at, 'YYYY-MM-DD"T"HH24:MI:SS'),
+		       TO_CHAR(notified_at, 'YYYY-MM-DD"T"HH24:MI:SS')
+		FROM service_area_waitlist`
+	args := []interface{}{}
+	if zip := r.URL.Query().Get("zip"); zip != "" {
+		zipCode, ok := normalizeZipCode(zip)
+		if !ok {
+			http.Error(w, "Invalid ZIP code", http.StatusBadRequest)
+			return
+		}
+		args = append(args, zipCode)
+		query += " WHERE zip_code = $1"
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT 500"
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch waitlist", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []WaitlistEntry{}
+	for rows.Next() {
+		var entry WaitlistEntry
+		if err := rows.Scan(&entry.ID, &entry.Email, &entry.ZipCode, &entry.UserID, &entry.CreatedAt, &entry.NotifiedAt); err != nil {
+			http.Error(w, "Failed to fetch waitlist", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
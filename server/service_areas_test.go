@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeZipCode(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{"12345", "12345", true},
+		{" 12345-6789 ", "12345", true},
+		{"1234", "", false},
+		{"abcde", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := normalizeZipCode(tt.input)
+		if got != tt.expected || ok != tt.valid {
+			t.Errorf("normalizeZipCode(%q) = %q, %v; expected %q, %v", tt.input, got, ok, tt.expected, tt.valid)
+		}
+	}
+}
+
+func TestServiceAreaCoverage(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+	defer db.Exec("DELETE FROM service_zones")
+	defer db.Exec("DELETE FROM service_areas")
+
+	areas := NewServiceAreaHandler(db.DB)
+	check := func(zip string) ServiceAreaCheck {
+		w := httptest.NewRecorder()
+		areas.handleCheckServiceArea(w, httptest.NewRequest("GET", "/api/v1/service-areas/check?zip="+zip, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d checking %s, got %d: %s", http.StatusOK, zip, w.Code, w.Body.String())
+		}
+		var result ServiceAreaCheck
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return result
+	}
+
+	// Everywhere is served until coverage is configured
+	if !check("99999").Covered {
+		t.Fatal("Expected every ZIP covered with no service areas")
+	}
+
+	w := httptest.NewRecorder()
+	areas.handleCreateServiceZone(w, httptest.NewRequest("POST", "/api/v1/admin/service-zones", strings.NewReader(`{"name": "Outer", "surcharge": 4.50}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var zone ServiceZone
+	json.Unmarshal(w.Body.Bytes(), &zone)
+
+	body, _ := json.Marshal(map[string]interface{}{"zip_codes": []string{"12345", "12346-0001"}, "zone_id": zone.ID})
+	w = httptest.NewRecorder()
+	areas.handleSetServiceAreas(w, httptest.NewRequest("POST", "/api/v1/admin/service-areas", bytes.NewBuffer(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if result := check("12346"); !result.Covered || result.Zone == nil || *result.Zone != "Outer" || result.Surcharge != 4.50 {
+		t.Errorf("Expected 12346 covered in Outer with a 4.50 surcharge, got %+v", result)
+	}
+	if check("99999").Covered {
+		t.Error("Expected 99999 not covered once service areas are set")
+	}
+
+	// Addresses outside coverage are turned away with a waitlist offer
+	userID := db.CreateTestUser(t, "coverage@example.com", "Coverage", "Customer")
+	addresses := NewAddressHandler(db.DB)
+	addresses.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+	body, _ = json.Marshal(CreateAddressRequest{
+		Type:          "home",
+		StreetAddress: "1 Far Away Rd",
+		City:          "Faraway",
+		State:         "CA",
+		ZipCode:       "99999",
+	})
+	w = httptest.NewRecorder()
+	addresses.handleCreateAddress(w, httptest.NewRequest("POST", "/api/v1/addresses", bytes.NewBuffer(body)))
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), `"waitlist":true`) {
+		t.Fatalf("Expected status %d with a waitlist offer, got %d: %s", http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	}
+
+	join := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		areas.handleJoinWaitlist(w, httptest.NewRequest("POST", "/api/v1/service-areas/waitlist", strings.NewReader(body)))
+		return w
+	}
+	if w := join(`{"email": "Coverage@Example.com", "zip_code": "99999"}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if w := join(`{"email": "coverage@example.com", "zip_code": "99999"}`); w.Code != http.StatusCreated {
+		t.Errorf("Expected signing up twice to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := join(`{"email": "coverage@example.com", "zip_code": "12345"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d joining the waitlist for a covered ZIP, got %d", http.StatusConflict, w.Code)
+	}
+
+	var waiting int
+	db.QueryRow("SELECT COUNT(*) FROM service_area_waitlist WHERE zip_code = '99999'").Scan(&waiting)
+	if waiting != 1 {
+		t.Errorf("Expected one waitlist entry, got %d", waiting)
+	}
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 )
 
 type ServiceHandler struct {
-	db *sql.DB
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
 }
 
 type Service struct {
@@ -16,23 +18,33 @@ type Service struct {
 	Description  string  `json:"description"`
 	BasePrice    float64 `json:"base_price"`
 	IsActive     bool    `json:"is_active"`
+	// BagPricing is the bag's size and weight allowance in the caller's market
+	BagPricing   *BagPricing `json:"bag_pricing,omitempty"`
 }
 
 func NewServiceHandler(db *sql.DB) *ServiceHandler {
-	return &ServiceHandler{db: db}
+	return &ServiceHandler{db: db, getUserID: getUserIDFromRequest}
 }
 
-// handleGetServices returns all available services
+// handleGetServices returns all available services. Bags are priced for the
+// market of ?zip_code=, or at the default pricing without one. Services sold
+// in one market only are listed for that market's ZIP codes and customers.
 func (h *ServiceHandler) handleGetServices(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	marketID, err := requestMarketID(r, h.db, h.getUserID)
+	if err != nil {
+		http.Error(w, "Failed to look up market", http.StatusInternalServerError)
+		return
+	}
+
 	rows, err := h.db.Query(`
 		SELECT id, name, description, base_price_cents, is_active
 		FROM services
-		WHERE is_active = true
+		WHERE is_active = true AND `+fmt.Sprintf(soldInMarketSQL, "services", "$1")+`
 		ORDER BY 
 			CASE 
 				WHEN name = 'standard_bag' THEN 1
@@ -41,13 +53,19 @@ func (h *ServiceHandler) handleGetServices(w http.ResponseWriter, r *http.Reques
 				WHEN name = 'bedding' THEN 4
 				ELSE 5
 			END,
-			name`)
+			name`, marketID)
 	if err != nil {
 		http.Error(w, "Failed to fetch services", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
+	bagPricing, err := bagPricingByService(h.db, r.URL.Query().Get("zip_code"))
+	if err != nil {
+		http.Error(w, "Failed to fetch bag pricing", http.StatusInternalServerError)
+		return
+	}
+
 	services := []Service{}
 	for rows.Next() {
 		var service Service
@@ -63,6 +81,10 @@ func (h *ServiceHandler) handleGetServices(w http.ResponseWriter, r *http.Reques
 		
 		// Convert cents to dollars for JSON response
 		service.BasePrice = centsToDollars(basePriceCents)
+		if pricing, ok := bagPricing[service.ID]; ok {
+			service.BasePrice = pricing.Price
+			service.BagPricing = &pricing
+		}
 		services = append(services, service)
 	}
 
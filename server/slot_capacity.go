@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	// maxAvailabilityDays is the longest range /availability returns
+	maxAvailabilityDays = 31
+	// A full slot suggests up to this many open slots, looking this many days ahead
+	maxSlotAlternatives    = 5
+	slotAlternativeDaysOut = 7
+)
+
+// SlotCapacityHandler serves the admin CRUD for pickup slot capacity overrides
+type SlotCapacityHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewSlotCapacityHandler(db *sql.DB) *SlotCapacityHandler {
+	return &SlotCapacityHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// SlotCapacity overrides how many pickups a slot takes in one market, on one
+// day of the week, or both
+type SlotCapacity struct {
+	ID        int     `json:"id"`
+	Market    *string `json:"market"`      // First three digits of the ZIP; nil matches every market
+	DayOfWeek *int    `json:"day_of_week"` // 0 = Sunday; nil matches every day
+	TimeSlot  string  `json:"time_slot"`
+	Capacity  int     `json:"capacity"`
+}
+
+// specificity ranks overrides so a market-and-day override beats a
+// market-only one, which beats a day-only one
+func (c SlotCapacity) specificity() int {
+	score := 0
+	if c.Market != nil {
+		score += 2
+	}
+	if c.DayOfWeek != nil {
+		score++
+	}
+	return score
+}
+
+// slotLimit is the capacity a pickup is held to. Market is set when it's the
+// market's own capacity, so only that market's pickups count against it.
+type slotLimit struct {
+	Capacity int
+	Market   string
+}
+
+// slotCapacities is the capacity configuration for every active pickup slot
+type slotCapacities struct {
+	slots     []string // Active slots in display order
+	defaults  map[string]int
+	overrides []SlotCapacity
+}
+
+// limit returns the capacity for a pickup in market on weekday; limited is
+// false for slots that aren't configured
+func (c *slotCapacities) limit(weekday time.Weekday, market, timeSlot string) (limit slotLimit, limited bool) {
+	capacity, ok := c.defaults[timeSlot]
+	if !ok {
+		return slotLimit{}, false
+	}
+
+	var match *SlotCapacity
+	for i, override := range c.overrides {
+		if override.TimeSlot != timeSlot {
+			continue
+		}
+		if override.Market != nil && *override.Market != market {
+			continue
+		}
+		if override.DayOfWeek != nil && *override.DayOfWeek != int(weekday) {
+			continue
+		}
+		if match == nil || override.specificity() > match.specificity() {
+			match = &c.overrides[i]
+		}
+	}
+
+	limit = slotLimit{Capacity: capacity}
+	if match != nil {
+		limit.Capacity = match.Capacity
+		if match.Market != nil {
+			limit.Market = *match.Market
+		}
+	}
+	return limit, true
+}
+
+// booked counts the pickups on date that count against limit
+func (c *slotCapacities) booked(bookings map[slotBookingKey]int, date time.Time, timeSlot string, limit slotLimit) int {
+	day := date.Format("2006-01-02")
+	if limit.Market != "" {
+		return bookings[slotBookingKey{Date: day, TimeSlot: timeSlot, Market: limit.Market}]
+	}
+
+	total := 0
+	for key, count := range bookings {
+		if key.Date != day || key.TimeSlot != timeSlot {
+			continue
+		}
+		// Markets with their own capacity are counted there instead
+		if own, _ := c.limit(date.Weekday(), key.Market, timeSlot); own.Market != "" {
+			continue
+		}
+		total += count
+	}
+	return total
+}
+
+// slotPool names the set of holds a slot's capacity covers: the slot itself,
+// or the slot within a market that has its own capacity
+func slotPool(market, timeSlot string) string {
+	if market == "" {
+		return timeSlot
+	}
+	return market + ":" + timeSlot
+}
+
+const slotCapacityColumns = `id, market, day_of_week, time_slot, capacity`
+
+func scanSlotCapacity(scanner interface{ Scan(...interface{}) error }) (SlotCapacity, error) {
+	var capacity SlotCapacity
+	var market sql.NullString
+	var dayOfWeek sql.NullInt64
+	err := scanner.Scan(&capacity.ID, &market, &dayOfWeek, &capacity.TimeSlot, &capacity.Capacity)
+	if err != nil {
+		return capacity, err
+	}
+	if market.Valid {
+		capacity.Market = &market.String
+	}
+	if dayOfWeek.Valid {
+		day := int(dayOfWeek.Int64)
+		capacity.DayOfWeek = &day
+	}
+	return capacity, nil
+}
+
+func querySlotCapacityOverrides(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}) ([]SlotCapacity, error) {
+	rows, err := q.Query("SELECT " + slotCapacityColumns + " FROM pickup_slot_capacities" +
+		" ORDER BY time_slot, market NULLS FIRST, day_of_week NULLS FIRST, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := []SlotCapacity{}
+	for rows.Next() {
+		override, err := scanSlotCapacity(rows)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, override)
+	}
+	return overrides, rows.Err()
+}
+
+func loadSlotCapacities(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}) (*slotCapacities, error) {
+	rows, err := q.Query(`
+		SELECT time_slot, capacity FROM pickup_time_slots
+		WHERE is_active = true
+		ORDER BY sort_order, time_slot`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	capacities := &slotCapacities{slots: []string{}, defaults: map[string]int{}}
+	for rows.Next() {
+		var timeSlot string
+		var capacity int
+		if err := rows.Scan(&timeSlot, &capacity); err != nil {
+			return nil, err
+		}
+		capacities.slots = append(capacities.slots, timeSlot)
+		capacities.defaults[timeSlot] = capacity
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if capacities.overrides, err = querySlotCapacityOverrides(q); err != nil {
+		return nil, err
+	}
+	return capacities, nil
+}
+
+type slotBookingKey struct {
+	Date     string
+	TimeSlot string
+	Market   string
+}
+
+// bookedPickups counts booked pickups per date, slot and market from start to
+// end inclusive
+func bookedPickups(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, start, end string) (map[slotBookingKey]int, error) {
+	rows, err := q.Query(`
+		SELECT o.pickup_date, o.pickup_time_slot, LEFT(COALESCE(a.zip_code, ''), 3), COUNT(*)
+		FROM orders o
+		LEFT JOIN addresses a ON a.id = o.pickup_address_id
+		WHERE o.pickup_date BETWEEN $1 AND $2 AND o.status != 'cancelled'
+		  AND o.pickup_time_slot IS NOT NULL
+		GROUP BY 1, 2, 3`,
+		start, end,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookings := map[slotBookingKey]int{}
+	for rows.Next() {
+		var date time.Time
+		var timeSlot, zipPrefix string
+		var count int
+		if err := rows.Scan(&date, &timeSlot, &zipPrefix, &count); err != nil {
+			return nil, err
+		}
+		bookings[slotBookingKey{Date: date.Format("2006-01-02"), TimeSlot: timeSlot, Market: marketForZip(zipPrefix)}] += count
+	}
+	return bookings, rows.Err()
+}
+
+// pickupSlotLimit returns the capacity a pickup on date in market is held to
+// and how many orders already count against it; limited is false for slots
+// that aren't configured
+func pickupSlotLimit(db interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, date time.Time, market, timeSlot string) (limit slotLimit, booked int, limited bool, err error) {
+	capacities, err := loadSlotCapacities(db)
+	if err != nil {
+		return slotLimit{}, 0, false, err
+	}
+	limit, limited = capacities.limit(date.Weekday(), market, timeSlot)
+	if !limited {
+		return limit, 0, false, nil
+	}
+	day := date.Format("2006-01-02")
+	bookings, err := bookedPickups(db, day, day)
+	if err != nil {
+		return slotLimit{}, 0, false, err
+	}
+	return limit, capacities.booked(bookings, date, timeSlot, limit), true, nil
+}
+
+// SlotDayAvailability is every active pickup slot on one date
+type SlotDayAvailability struct {
+	Date  string                   `json:"date"`
+	Slots []PickupSlotAvailability `json:"slots"`
+	// Weather is the market's advisory for the day, if it has one
+	Weather *DayWeatherRisk `json:"weather,omitempty"`
+}
+
+// pickupAvailability returns remaining capacity in every active slot on each
+// date from start to end, for pickups in market, with the market's weather
+// advisories. Holds and advisories are skipped when they can't be loaded.
+func pickupAvailability(ctx context.Context, db *sql.DB, holds SlotHoldStore, start, end time.Time, market string) ([]SlotDayAvailability, error) {
+	capacities, err := loadSlotCapacities(db)
+	if err != nil {
+		return nil, err
+	}
+	priceRules, err := querySlotPriceRules(db, "WHERE is_active = true")
+	if err != nil {
+		return nil, err
+	}
+	bookings, err := bookedPickups(db, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	var weather map[string]*DayWeatherRisk
+	if market != "" {
+		if weather, err = weatherRisksByDate(db, market, start, end); err != nil {
+			log.Printf("Failed to load weather advisories: %v", err)
+		}
+	}
+
+	days := []SlotDayAvailability{}
+	for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+		day := SlotDayAvailability{Date: date.Format("2006-01-02"), Slots: []PickupSlotAvailability{}}
+		day.Weather = weather[day.Date]
+		for _, timeSlot := range capacities.slots {
+			limit, _ := capacities.limit(date.Weekday(), market, timeSlot)
+			slot := PickupSlotAvailability{
+				TimeSlot: timeSlot,
+				Capacity: limit.Capacity,
+				Booked:   capacities.booked(bookings, date, timeSlot, limit),
+			}
+			if holds != nil {
+				held, err := holds.Count(ctx, day.Date, slotPool(limit.Market, timeSlot), "")
+				if err != nil {
+					log.Printf("Failed to count pickup slot holds: %v", err)
+				} else {
+					slot.Held = held
+				}
+			}
+			slot.Available = slot.Capacity - slot.Booked - slot.Held
+			if slot.Available < 0 {
+				slot.Available = 0
+			}
+			slot.PriceMultiplierPercent = 100
+			if rule := matchSlotPriceRule(priceRules, date.Weekday(), timeSlot); rule != nil {
+				slot.PriceLabel = &rule.Name
+				slot.PriceMultiplierPercent = rule.MultiplierPercent
+			}
+			day.Slots = append(day.Slots, slot)
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// SlotAlternative is an open pickup slot offered in place of a full one
+type SlotAlternative struct {
+	Date      string `json:"date"`
+	TimeSlot  string `json:"time_slot"`
+	Available int    `json:"available"`
+}
+
+// slotAlternatives finds open slots near a full one: later the same day
+// first, then the following days
+func slotAlternatives(ctx context.Context, db *sql.DB, holds SlotHoldStore, date time.Time, market, timeSlot string) ([]SlotAlternative, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if date.Before(today) {
+		date = today
+	}
+	days, err := pickupAvailability(ctx, db, holds, date, date.AddDate(0, 0, slotAlternativeDaysOut), market)
+	if err != nil {
+		return nil, err
+	}
+
+	alternatives := []SlotAlternative{}
+	for _, day := range days {
+		for _, slot := range day.Slots {
+			if slot.Available == 0 || (day.Date == date.Format("2006-01-02") && slot.TimeSlot == timeSlot) {
+				continue
+			}
+			alternatives = append(alternatives, SlotAlternative{Date: day.Date, TimeSlot: slot.TimeSlot, Available: slot.Available})
+			if len(alternatives) == maxSlotAlternatives {
+				return alternatives, nil
+			}
+		}
+	}
+	return alternatives, nil
+}
+
+// writeSlotFull rejects a full pickup slot, suggesting open slots nearby
+func writeSlotFull(w http.ResponseWriter, r *http.Request, db *sql.DB, holds SlotHoldStore, date time.Time, market, timeSlot string) {
+	alternatives, err := slotAlternatives(r.Context(), db, holds, date, market, timeSlot)
+	if err != nil {
+		log.Printf("Failed to find alternative pickup slots: %v", err)
+		alternatives = []SlotAlternative{}
+	}
+
+	message := "That pickup window is fully booked."
+	if len(alternatives) > 0 {
+		message += " Try one of the suggested windows instead."
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":        "Pickup time slot is full",
+		"message":      message,
+		"alternatives": alternatives,
+	})
+}
+
+// handleGetAvailability returns the open pickup slots for each date from
+// ?start= to ?end= (a week when end is left out), for ?zip_code= when given.
+// Full slots are left out.
+func (h *PickupSlotHandler) handleGetAvailability(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.getUserID(r, h.db); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	start, err := time.Parse("2006-01-02", r.URL.Query().Get("start"))
+	if err != nil {
+		http.Error(w, "Invalid start date", http.StatusBadRequest)
+		return
+	}
+	end := start.AddDate(0, 0, 6)
+	if param := r.URL.Query().Get("end"); param != "" {
+		if end, err = time.Parse("2006-01-02", param); err != nil {
+			http.Error(w, "Invalid end date", http.StatusBadRequest)
+			return
+		}
+	}
+	if end.Before(start) {
+		http.Error(w, "end must not be before start", http.StatusBadRequest)
+		return
+	}
+	if end.Sub(start) >= maxAvailabilityDays*24*time.Hour {
+		http.Error(w, fmt.Sprintf("Availability covers at most %d days", maxAvailabilityDays), http.StatusBadRequest)
+		return
+	}
+	// Past dates can't be booked
+	if today := time.Now().UTC().Truncate(24 * time.Hour); start.Before(today) {
+		start = today
+	}
+
+	days := []SlotDayAvailability{}
+	if !end.Before(start) {
+		days, err = pickupAvailability(r.Context(), h.db, h.holds, start, end, marketForZip(r.URL.Query().Get("zip_code")))
+		if err != nil {
+			http.Error(w, "Failed to fetch availability", http.StatusInternalServerError)
+			return
+		}
+	}
+	for i, day := range days {
+		open := []PickupSlotAvailability{}
+		for _, slot := range day.Slots {
+			if slot.Available > 0 {
+				open = append(open, slot)
+			}
+		}
+		days[i].Slots = open
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(days)
+}
+
+// validateSlotCapacity checks an override from the admin API
+func validateSlotCapacity(capacity SlotCapacity) error {
+	if capacity.TimeSlot == "" {
+		return fmt.Errorf("time_slot is required")
+	}
+	if capacity.Market == nil && capacity.DayOfWeek == nil {
+		return fmt.Errorf("market or day_of_week is required")
+	}
+	if capacity.Market != nil && !isMarket(*capacity.Market) {
+		return fmt.Errorf("market must be the first three digits of a ZIP code")
+	}
+	if capacity.DayOfWeek != nil && (*capacity.DayOfWeek < 0 || *capacity.DayOfWeek > 6) {
+		return fmt.Errorf("day_of_week must be between 0 (Sunday) and 6 (Saturday)")
+	}
+	if capacity.Capacity < 0 {
+		return fmt.Errorf("capacity can't be negative")
+	}
+	return nil
+}
+
+// writeSlotCapacityError maps constraint failures to client errors
+func writeSlotCapacityError(w http.ResponseWriter, err error, action string) {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "23505":
+			http.Error(w, "A capacity is already set for this market, day and time slot", http.StatusConflict)
+			return
+		case "23503":
+			http.Error(w, "Unknown time slot", http.StatusBadRequest)
+			return
+		}
+	}
+	http.Error(w, "Failed to "+action+" slot capacity", http.StatusInternalServerError)
+}
+
+// handleGetSlotCapacities lists every capacity override
+func (h *SlotCapacityHandler) handleGetSlotCapacities(w http.ResponseWriter, r *http.Request) {
+	overrides, err := querySlotCapacityOverrides(h.db)
+	if err != nil {
+		http.Error(w, "Failed to fetch slot capacities", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(overrides)
+}
+
+// handleCreateSlotCapacity sets a slot's capacity for a market and/or day
+func (h *SlotCapacityHandler) handleCreateSlotCapacity(w http.ResponseWriter, r *http.Request) {
+	var req SlotCapacity
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateSlotCapacity(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	row := h.db.QueryRow(`
+		INSERT INTO pickup_slot_capacities (market, day_of_week, time_slot, capacity)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+slotCapacityColumns,
+		req.Market, req.DayOfWeek, req.TimeSlot, req.Capacity,
+	)
+	override, err := scanSlotCapacity(row)
+	if err != nil {
+		writeSlotCapacityError(w, err, "create")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(override)
+}
+
+// handleUpdateSlotCapacity replaces an override. Orders already booked past
+// a lowered capacity are kept; the slot just stops taking more.
+func (h *SlotCapacityHandler) handleUpdateSlotCapacity(w http.ResponseWriter, r *http.Request) {
+	overrideID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid capacity ID", http.StatusBadRequest)
+		return
+	}
+
+	var req SlotCapacity
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateSlotCapacity(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	row := h.db.QueryRow(`
+		UPDATE pickup_slot_capacities
+		SET market = $1, day_of_week = $2, time_slot = $3, capacity = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $5
+		RETURNING `+slotCapacityColumns,
+		req.Market, req.DayOfWeek, req.TimeSlot, req.Capacity, overrideID,
+	)
+	override, err := scanSlotCapacity(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Slot capacity not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeSlotCapacityError(w, err, "update")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(override)
+}
+
+// handleDeleteSlotCapacity removes an override, putting the slot back on its
+// default capacity
+func (h *SlotCapacityHandler) handleDeleteSlotCapacity(w http.ResponseWriter, r *http.Request) {
+	overrideID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid capacity ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM pickup_slot_capacities WHERE id = $1", overrideID)
+	if err != nil {
+		http.Error(w, "Failed to delete slot capacity", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Slot capacity not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
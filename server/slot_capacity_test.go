@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlotCapacitiesLimit(t *testing.T) {
+	market := "123"
+	saturday := 6
+	capacities := &slotCapacities{
+		slots:    []string{"9am-12pm"},
+		defaults: map[string]int{"9am-12pm": 20},
+		overrides: []SlotCapacity{
+			{DayOfWeek: &saturday, TimeSlot: "9am-12pm", Capacity: 30},
+			{Market: &market, TimeSlot: "9am-12pm", Capacity: 5},
+			{Market: &market, DayOfWeek: &saturday, TimeSlot: "9am-12pm", Capacity: 8},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		weekday  time.Weekday
+		market   string
+		expected slotLimit
+	}{
+		{"default", time.Monday, "456", slotLimit{Capacity: 20}},
+		{"day override", time.Saturday, "456", slotLimit{Capacity: 30}},
+		{"market override", time.Monday, "123", slotLimit{Capacity: 5, Market: "123"}},
+		{"market and day override", time.Saturday, "123", slotLimit{Capacity: 8, Market: "123"}},
+		{"unknown market", time.Monday, "", slotLimit{Capacity: 20}},
+	}
+	for _, tt := range tests {
+		limit, limited := capacities.limit(tt.weekday, tt.market, "9am-12pm")
+		if !limited || limit != tt.expected {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.expected, limit)
+		}
+	}
+	if _, limited := capacities.limit(time.Monday, "456", "6pm-8pm"); limited {
+		t.Error("Expected an unconfigured slot to be unlimited")
+	}
+
+	// A market with its own capacity is counted apart from the default
+	monday := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	bookings := map[slotBookingKey]int{
+		{Date: "2026-10-19", TimeSlot: "9am-12pm", Market: "123"}: 4,
+		{Date: "2026-10-19", TimeSlot: "9am-12pm", Market: "456"}: 3,
+		{Date: "2026-10-19", TimeSlot: "9am-12pm", Market: ""}:    1,
+		{Date: "2026-10-20", TimeSlot: "9am-12pm", Market: "456"}: 7,
+	}
+	if got := capacities.booked(bookings, monday, "9am-12pm", slotLimit{Capacity: 5, Market: "123"}); got != 4 {
+		t.Errorf("Expected 4 booked in the market, got %d", got)
+	}
+	if got := capacities.booked(bookings, monday, "9am-12pm", slotLimit{Capacity: 20}); got != 4 {
+		t.Errorf("Expected 4 booked outside the market, got %d", got)
+	}
+}
+
+func TestCreateOrderRejectsFullMarketSlot(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	// The test address's market takes one morning pickup a day
+	if _, err := db.Exec("INSERT INTO pickup_slot_capacities (market, time_slot, capacity) VALUES ('123', '9am-12pm', 1)"); err != nil {
+		t.Fatalf("Failed to configure capacity: %v", err)
+	}
+
+	userID := db.CreateTestUser(t, "capacity@example.com", "Capacity", "Customer")
+	addressID := db.CreateTestAddress(t, userID)
+	date := time.Now().UTC().AddDate(0, 0, 2).Format("2006-01-02")
+	orderID := db.CreateTestOrder(t, userID, addressID)
+	db.Exec("UPDATE orders SET pickup_date = $1, pickup_time_slot = '9am-12pm' WHERE id = $2", date, orderID)
+
+	handler := NewOrderHandler(db.DB, nil)
+	handler.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+	body, _ := json.Marshal(CreateOrderRequest{
+		PickupAddressID:   addressID,
+		DeliveryAddressID: addressID,
+		PickupDate:        date,
+		DeliveryDate:      time.Now().UTC().AddDate(0, 0, 4).Format("2006-01-02"),
+		PickupTimeSlot:    "9am-12pm",
+		DeliveryTimeSlot:  "9am-12pm",
+	})
+	req := httptest.NewRequest("POST", "/api/v1/orders", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	handler.handleCreateOrder(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusConflict, w.Code, w.Body.String())
+	}
+	var response struct {
+		Alternatives []SlotAlternative `json:"alternatives"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if len(response.Alternatives) == 0 {
+		t.Fatalf("Expected alternative slots, got %s", w.Body.String())
+	}
+	for _, alternative := range response.Alternatives {
+		if alternative.Date == date && alternative.TimeSlot == "9am-12pm" {
+			t.Errorf("Expected the full slot left out of the alternatives, got %+v", alternative)
+		}
+	}
+
+	// Availability for the market leaves the full slot out
+	slots := NewPickupSlotHandler(db.DB, nil)
+	slots.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+	req = httptest.NewRequest("GET", "/api/v1/availability?start="+date+"&end="+date+"&zip_code=12345", nil)
+	w = httptest.NewRecorder()
+	slots.handleGetAvailability(w, req)
+	var days []SlotDayAvailability
+	json.Unmarshal(w.Body.Bytes(), &days)
+	if w.Code != http.StatusOK || len(days) != 1 {
+		t.Fatalf("Expected one day of availability, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, slot := range days[0].Slots {
+		if slot.TimeSlot == "9am-12pm" {
+			t.Errorf("Expected the full slot left out, got %+v", slot)
+		}
+	}
+}
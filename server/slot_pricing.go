@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"tumble-backend/money"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// SlotPricingHandler serves the admin CRUD for peak and off-peak slot pricing
+type SlotPricingHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewSlotPricingHandler(db *sql.DB) *SlotPricingHandler {
+	return &SlotPricingHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// SlotPriceRule scales an order's service price for pickups on a day of week,
+// in a time slot, or both. 120 is a 20% surcharge; 90 is a 10% discount.
+type SlotPriceRule struct {
+	ID                int     `json:"id"`
+	Name              string  `json:"name"`
+	DayOfWeek         *int    `json:"day_of_week"` // 0 = Sunday; nil matches every day
+	TimeSlot          *string `json:"time_slot"`   // nil matches every slot
+	MultiplierPercent int     `json:"multiplier_percent"`
+	IsActive          bool    `json:"is_active"`
+}
+
+// OrderSlotAdjustment is the slot pricing an order was sold with
+type OrderSlotAdjustment struct {
+	Label             string  `json:"label"`
+	MultiplierPercent int     `json:"multiplier_percent"`
+	Amount            float64 `json:"amount"` // Negative for discounts
+}
+
+// adjustmentCents returns the surcharge (or, when negative, discount) the
+// rule adds to a service subtotal
+func (rule *SlotPriceRule) adjustmentCents(subtotalCents int) int {
+	if rule == nil || subtotalCents <= 0 {
+		return 0
+	}
+	return money.Percent(subtotalCents, rule.MultiplierPercent-100)
+}
+
+// specificity ranks rules so a day-and-slot rule beats a slot-only rule,
+// which beats a day-only rule
+func (rule SlotPriceRule) specificity() int {
+	score := 0
+	if rule.TimeSlot != nil {
+		score += 2
+	}
+	if rule.DayOfWeek != nil {
+		score++
+	}
+	return score
+}
+
+// matchSlotPriceRule picks the most specific active rule for a pickup, or nil
+func matchSlotPriceRule(rules []SlotPriceRule, weekday time.Weekday, timeSlot string) *SlotPriceRule {
+	var match *SlotPriceRule
+	for i, rule := range rules {
+		if !rule.IsActive {
+			continue
+		}
+		if rule.DayOfWeek != nil && *rule.DayOfWeek != int(weekday) {
+			continue
+		}
+		if rule.TimeSlot != nil && *rule.TimeSlot != timeSlot {
+			continue
+		}
+		if match == nil || rule.specificity() > match.specificity() {
+			match = &rules[i]
+		}
+	}
+	return match
+}
+
+// validateSlotPriceRule checks a rule definition from the admin API
+func validateSlotPriceRule(rule SlotPriceRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if rule.DayOfWeek == nil && (rule.TimeSlot == nil || *rule.TimeSlot == "") {
+		return fmt.Errorf("day_of_week or time_slot is required")
+	}
+	if rule.DayOfWeek != nil && (*rule.DayOfWeek < 0 || *rule.DayOfWeek > 6) {
+		return fmt.Errorf("day_of_week must be between 0 (Sunday) and 6 (Saturday)")
+	}
+	if rule.MultiplierPercent <= 0 || rule.MultiplierPercent > 300 {
+		return fmt.Errorf("multiplier_percent must be between 1 and 300")
+	}
+	if rule.MultiplierPercent == 100 {
+		return fmt.Errorf("multiplier_percent of 100 doesn't change the price")
+	}
+	return nil
+}
+
+const slotPriceRuleColumns = `id, name, day_of_week, time_slot, multiplier_percent, is_active`
+
+func scanSlotPriceRule(scanner interface{ Scan(...interface{}) error }) (SlotPriceRule, error) {
+	var rule SlotPriceRule
+	var dayOfWeek sql.NullInt64
+	var timeSlot sql.NullString
+	err := scanner.Scan(&rule.ID, &rule.Name, &dayOfWeek, &timeSlot, &rule.MultiplierPercent, &rule.IsActive)
+	if err != nil {
+		return rule, err
+	}
+	if dayOfWeek.Valid {
+		day := int(dayOfWeek.Int64)
+		rule.DayOfWeek = &day
+	}
+	if timeSlot.Valid {
+		rule.TimeSlot = &timeSlot.String
+	}
+	return rule, nil
+}
+
+func querySlotPriceRules(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, where string, args ...interface{}) ([]SlotPriceRule, error) {
+	rows, err := q.Query("SELECT "+slotPriceRuleColumns+" FROM slot_price_rules "+where+
+		" ORDER BY day_of_week NULLS FIRST, time_slot NULLS FIRST, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []SlotPriceRule{}
+	for rows.Next() {
+		rule, err := scanSlotPriceRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// slotPriceRuleFor returns the rule that prices a pickup, or nil when the
+// slot is at the regular price
+func slotPriceRuleFor(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, pickupDate time.Time, timeSlot string) (*SlotPriceRule, error) {
+	rules, err := querySlotPriceRules(q, "WHERE is_active = true")
+	if err != nil {
+		return nil, err
+	}
+	return matchSlotPriceRule(rules, pickupDate.Weekday(), timeSlot), nil
+}
+
+// getOrderSlotAdjustment returns the slot pricing on an order, or nil if it
+// was sold at the regular price
+func getOrderSlotAdjustment(q queryRower, orderID int) (*OrderSlotAdjustment, error) {
+	var label sql.NullString
+	var multiplier sql.NullInt64
+	var adjustmentCents int
+	err := q.QueryRow(`
+		SELECT slot_price_label, slot_multiplier_percent, slot_adjustment_cents
+		FROM orders WHERE id = $1`,
+		orderID,
+	).Scan(&label, &multiplier, &adjustmentCents)
+	if err != nil {
+		return nil, err
+	}
+	if !label.Valid {
+		return nil, nil
+	}
+	return &OrderSlotAdjustment{
+		Label:             label.String,
+		MultiplierPercent: int(multiplier.Int64),
+		Amount:            centsToDollars(adjustmentCents),
+	}, nil
+}
+
+// writeSlotPriceRuleError maps constraint failures to client errors
+func writeSlotPriceRuleError(w http.ResponseWriter, err error, action string) {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "23505":
+			http.Error(w, "An active rule already covers this day and time slot", http.StatusConflict)
+			return
+		case "23503":
+			http.Error(w, "Unknown time slot", http.StatusBadRequest)
+			return
+		}
+	}
+	http.Error(w, "Failed to "+action+" slot pricing rule", http.StatusInternalServerError)
+}
+
+// handleGetSlotPriceRules lists every rule, including inactive ones
+func (h *SlotPricingHandler) handleGetSlotPriceRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rules, err := querySlotPriceRules(h.db, "")
+	if err != nil {
+		http.Error(w, "Failed to fetch slot pricing rules", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// handleCreateSlotPriceRule adds a surcharge or discount for a day and/or slot
+func (h *SlotPricingHandler) handleCreateSlotPriceRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := SlotPriceRule{IsActive: true}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateSlotPriceRule(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	row := h.db.QueryRow(`
+		INSERT INTO slot_price_rules (name, day_of_week, time_slot, multiplier_percent, is_active)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+slotPriceRuleColumns,
+		req.Name, req.DayOfWeek, req.TimeSlot, req.MultiplierPercent, req.IsActive,
+	)
+	rule, err := scanSlotPriceRule(row)
+	if err != nil {
+		writeSlotPriceRuleError(w, err, "create")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// handleUpdateSlotPriceRule replaces a rule. Orders already placed keep the
+// adjustment they were sold with.
+func (h *SlotPricingHandler) handleUpdateSlotPriceRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ruleID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid rule ID", http.StatusBadRequest)
+		return
+	}
+
+	var req SlotPriceRule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateSlotPriceRule(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	row := h.db.QueryRow(`
+		UPDATE slot_price_rules
+		SET name = $1, day_of_week = $2, time_slot = $3, multiplier_percent = $4,
+		    is_active = $5, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $6
+		RETURNING `+slotPriceRuleColumns,
+		req.Name, req.DayOfWeek, req.TimeSlot, req.MultiplierPercent, req.IsActive, ruleID,
+	)
+	rule, err := scanSlotPriceRule(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Slot pricing rule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeSlotPriceRuleError(w, err, "update")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// handleDeleteSlotPriceRule removes a rule. Orders copy the label and
+// multiplier, so their receipts are unaffected.
+func (h *SlotPricingHandler) handleDeleteSlotPriceRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ruleID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid rule ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM slot_price_rules WHERE id = $1", ruleID)
+	if err != nil {
+		http.Error(w, "Failed to delete slot pricing rule", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Slot pricing rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMatchSlotPriceRule(t *testing.T) {
+	sunday, evening := int(time.Sunday), "3pm-6pm"
+	rules := []SlotPriceRule{
+		{ID: 1, Name: "Weekend", DayOfWeek: &sunday, MultiplierPercent: 110, IsActive: true},
+		{ID: 2, Name: "Evening", TimeSlot: &evening, MultiplierPercent: 115, IsActive: true},
+		{ID: 3, Name: "Sunday evening peak", DayOfWeek: &sunday, TimeSlot: &evening, MultiplierPercent: 125, IsActive: true},
+		{ID: 4, Name: "Retired", TimeSlot: &evening, MultiplierPercent: 90, IsActive: false},
+	}
+	tests := []struct {
+		weekday  time.Weekday
+		timeSlot string
+		expected int
+	}{
+		{time.Sunday, "3pm-6pm", 3},
+		{time.Sunday, "9am-12pm", 1},
+		{time.Monday, "3pm-6pm", 2},
+		{time.Monday, "9am-12pm", 0},
+	}
+	for _, tt := range tests {
+		got := 0
+		if rule := matchSlotPriceRule(rules, tt.weekday, tt.timeSlot); rule != nil {
+			got = rule.ID
+		}
+		if got != tt.expected {
+			t.Errorf("matchSlotPriceRule(%s, %s) = rule %d, expected %d", tt.weekday, tt.timeSlot, got, tt.expected)
+		}
+	}
+}
+
+func TestSlotPriceRuleAdjustmentCents(t *testing.T) {
+	tests := []struct {
+		multiplier int
+		subtotal   int
+		expected   int
+	}{
+		{125, 6000, 1500},
+		{90, 6000, -600},
+		{115, 999, 150},
+		{120, 0, 0},
+	}
+	for _, tt := range tests {
+		rule := &SlotPriceRule{MultiplierPercent: tt.multiplier}
+		if got := rule.adjustmentCents(tt.subtotal); got != tt.expected {
+			t.Errorf("adjustmentCents(%d%% of %d) = %d, expected %d", tt.multiplier, tt.subtotal, got, tt.expected)
+		}
+	}
+	var none *SlotPriceRule
+	if got := none.adjustmentCents(6000); got != 0 {
+		t.Errorf("Expected no adjustment without a rule, got %d", got)
+	}
+}
+
+func TestValidateSlotPriceRule(t *testing.T) {
+	day, badDay, slot := 0, 7, "3pm-6pm"
+	tests := []struct {
+		rule  SlotPriceRule
+		valid bool
+	}{
+		{SlotPriceRule{Name: "Sunday peak", DayOfWeek: &day, MultiplierPercent: 120}, true},
+		{SlotPriceRule{Name: "Evening discount", TimeSlot: &slot, MultiplierPercent: 90}, true},
+		{SlotPriceRule{Name: "Everywhere", MultiplierPercent: 120}, false},
+		{SlotPriceRule{Name: "Bad day", DayOfWeek: &badDay, MultiplierPercent: 120}, false},
+		{SlotPriceRule{Name: "No change", DayOfWeek: &day, MultiplierPercent: 100}, false},
+		{SlotPriceRule{Name: "Too steep", DayOfWeek: &day, MultiplierPercent: 400}, false},
+		{SlotPriceRule{DayOfWeek: &day, MultiplierPercent: 120}, false},
+	}
+	for _, tt := range tests {
+		if err := validateSlotPriceRule(tt.rule); (err == nil) != tt.valid {
+			t.Errorf("validateSlotPriceRule(%+v) = %v, expected valid=%v", tt.rule, err, tt.valid)
+		}
+	}
+}
+
+func TestBuildOrderReceipt_SlotAdjustment(t *testing.T) {
+	subtotal := 54.00
+	order := &Order{
+		ID:       7,
+		Items:    []OrderItem{{ServiceName: "Standard Bag", Quantity: 2, Price: 30.00}},
+		Subtotal: &subtotal,
+		SlotAdjustment: &OrderSlotAdjustment{
+			Label: "Weekday morning discount", MultiplierPercent: 90, Amount: -6.00,
+		},
+	}
+	receipt := buildOrderReceipt(order)
+	if len(receipt.Lines) != 2 {
+		t.Fatalf("Expected a service line and a slot pricing line, got %+v", receipt.Lines)
+	}
+	line := receipt.Lines[1]
+	if line.Category != "peak_pricing" || line.LineTotal != -6.00 || line.Description != "Weekday morning discount (90% of services)" {
+		t.Errorf("Unexpected slot pricing line: %+v", line)
+	}
+}
+
+func TestSlotPricing_AdminRulesAndAvailability(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "slot-pricing@example.com", "Slot", "Pricing")
+	handler := NewSlotPricingHandler(db.DB)
+
+	create := func(rule SlotPriceRule) (SlotPriceRule, int) {
+		body, _ := json.Marshal(rule)
+		w := httptest.NewRecorder()
+		handler.handleCreateSlotPriceRule(w, httptest.NewRequest("POST", "/api/v1/admin/slot-pricing", bytes.NewBuffer(body)))
+		var created SlotPriceRule
+		json.Unmarshal(w.Body.Bytes(), &created)
+		return created, w.Code
+	}
+
+	// Pick a weekday that's a week out so the date is always in the future
+	date := time.Now().AddDate(0, 0, 7)
+	day, evening, unknown := int(date.Weekday()), "3pm-6pm", "midnight"
+	peak, code := create(SlotPriceRule{Name: "Evening peak", DayOfWeek: &day, TimeSlot: &evening, MultiplierPercent: 125, IsActive: true})
+	if code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, code)
+	}
+	if _, code := create(SlotPriceRule{Name: "Duplicate", DayOfWeek: &day, TimeSlot: &evening, MultiplierPercent: 110, IsActive: true}); code != http.StatusConflict {
+		t.Errorf("Expected status %d for an overlapping rule, got %d", http.StatusConflict, code)
+	}
+	if _, code := create(SlotPriceRule{Name: "Unknown", TimeSlot: &unknown, MultiplierPercent: 110, IsActive: true}); code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unknown slot, got %d", http.StatusBadRequest, code)
+	}
+	create(SlotPriceRule{Name: "Quiet day", DayOfWeek: &day, MultiplierPercent: 90, IsActive: true})
+
+	slots := NewPickupSlotHandler(db.DB, nil)
+	slots.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return userID, nil
+	}
+	w := httptest.NewRecorder()
+	slots.handleGetPickupSlots(w, httptest.NewRequest("GET", "/api/v1/pickup-slots?date="+date.Format("2006-01-02"), nil))
+	var availability []PickupSlotAvailability
+	json.Unmarshal(w.Body.Bytes(), &availability)
+	multipliers := map[string]int{}
+	for _, slot := range availability {
+		multipliers[slot.TimeSlot] = slot.PriceMultiplierPercent
+	}
+	if multipliers["3pm-6pm"] != 125 || multipliers["9am-12pm"] != 90 {
+		t.Errorf("Expected the evening peak and a discount elsewhere, got %v", multipliers)
+	}
+
+	// Turning the peak off falls back to the day-wide rule
+	peak.IsActive = false
+	body, _ := json.Marshal(peak)
+	req := mux.SetURLVars(httptest.NewRequest("PUT", "/api/v1/admin/slot-pricing/x", bytes.NewBuffer(body)),
+		map[string]string{"id": fmt.Sprint(peak.ID)})
+	w = httptest.NewRecorder()
+	handler.handleUpdateSlotPriceRule(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	rule, err := slotPriceRuleFor(db.DB, date, "3pm-6pm")
+	if err != nil || rule == nil || rule.Name != "Quiet day" {
+		t.Errorf("Expected the day-wide discount, got %+v (%v)", rule, err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.handleDeleteSlotPriceRule(w, mux.SetURLVars(httptest.NewRequest("DELETE", "/api/v1/admin/slot-pricing/x", nil),
+		map[string]string{"id": fmt.Sprint(peak.ID)}))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+}
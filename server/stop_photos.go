@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tumble-backend/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	maxStopPhotoUploadBytes = 5 << 20
+	// Drivers can attach this many photos to a single stop
+	maxPhotosPerStop = 5
+)
+
+// allowedStopPhotoContentTypes are the sniffed types accepted for stop photos
+var allowedStopPhotoContentTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+}
+
+// StopPhoto is a photo the driver took at a pickup or delivery stop
+type StopPhoto struct {
+	ID           int       `json:"id"`
+	RouteOrderID int       `json:"route_order_id"`
+	OrderID      int       `json:"order_id"`
+	StopType     string    `json:"stop_type"` // pickup or delivery
+	ContentType  string    `json:"content_type"`
+	URL          string    `json:"url,omitempty"` // Signed image link, valid for 15 minutes
+	TakenAt      time.Time `json:"taken_at"`
+	// What the upload checks flagged; empty when the photo passed
+	QualityIssues []string `json:"quality_issues,omitempty"`
+	storageKey    string
+}
+
+// orderStopPhotos lists the photos taken on an order's stops, oldest first,
+// with signed links to the images when a store is given
+func orderStopPhotos(ctx context.Context, db *sql.DB, store storage.Store, orderID int) ([]StopPhoto, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT sp.id, sp.route_order_id, sp.order_id, dr.route_type, sp.content_type, sp.taken_at, sp.storage_key,
+		       sp.quality_issues
+		FROM stop_photos sp
+		JOIN route_orders ro ON sp.route_order_id = ro.id
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		WHERE sp.order_id = $1
+		ORDER BY sp.taken_at, sp.id`,
+		orderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	photos := []StopPhoto{}
+	for rows.Next() {
+		var p StopPhoto
+		err := rows.Scan(&p.ID, &p.RouteOrderID, &p.OrderID, &p.StopType, &p.ContentType, &p.TakenAt, &p.storageKey, pq.Array(&p.QualityIssues))
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if store != nil {
+		for i := range photos {
+			if photos[i].URL, err = store.SignedURL(ctx, photos[i].storageKey, fileURLExpiry); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return photos, nil
+}
+
+// handleUploadStopPhoto attaches a photo to a pickup or delivery stop. The
+// image is sent as the "photo" field of a multipart form, optionally with the
+// app's SHA-256 of the photo as taken in "hash". Photos that fail the quality
+// checks are kept but flagged to admins, and the issues returned so the
+// driver can retake them.
+func (h *DriverRouteHandler) handleUploadStopPhoto(w http.ResponseWriter, r *http.Request) {
+	driverID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	routeOrderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid route order ID", http.StatusBadRequest)
+		return
+	}
+
+	var orderID, routeDriverID, photoCount int
+	var routeType, routeStatus string
+	err = h.db.QueryRow(`
+		SELECT ro.order_id, dr.driver_id, dr.route_type, dr.status,
+			(SELECT COUNT(*) FROM stop_photos sp WHERE sp.route_order_id = ro.id)
+		FROM route_orders ro
+		JOIN driver_routes dr ON ro.route_id = dr.id
+		WHERE ro.id = $1`,
+		routeOrderID,
+	).Scan(&orderID, &routeDriverID, &routeType, &routeStatus, &photoCount)
+	if err == sql.ErrNoRows || (err == nil && routeDriverID != driverID) {
+		http.Error(w, "Route order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch route order", http.StatusInternalServerError)
+		return
+	}
+	if isClosedRouteStatus(routeStatus) {
+		http.Error(w, "Route is closed", http.StatusForbidden)
+		return
+	}
+	if photoCount >= maxPhotosPerStop {
+		http.Error(w, fmt.Sprintf("A stop can have at most %d photos", maxPhotosPerStop), http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxStopPhotoUploadBytes+64<<10)
+	file, _, err := r.FormFile("photo")
+	if err != nil {
+		http.Error(w, "Photo is required (max 5MB)", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	var deviceHash *string
+	if hash := strings.ToLower(r.FormValue("hash")); hash != "" {
+		if !validDeviceHash(hash) {
+			http.Error(w, "hash must be a hex SHA-256", http.StatusBadRequest)
+			return
+		}
+		deviceHash = &hash
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxStopPhotoUploadBytes+1))
+	if err != nil {
+		http.Error(w, "Photo is too large", http.StatusBadRequest)
+		return
+	}
+	contentType, ext, err := storage.Validate(data, maxStopPhotoUploadBytes, allowedStopPhotoContentTypes)
+	if errors.Is(err, storage.ErrTooLarge) {
+		http.Error(w, "Photo is too large (max 5MB)", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Photo must be a PNG, JPEG or WebP image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	quality := analyzeStopPhoto(data, contentType, time.Now().UTC())
+	duplicated, err := stopPhotoDuplicated(h.db, routeOrderID, quality.ContentHash, deviceHash)
+	if err != nil {
+		http.Error(w, "Failed to check photo", http.StatusInternalServerError)
+		return
+	}
+	if duplicated {
+		quality.Issues = append(quality.Issues, photoIssueDuplicate)
+	}
+
+	key := fmt.Sprintf("stop-photos/%d/%d-%s%s", orderID, routeOrderID, generateRandomString(8), ext)
+	if err := h.store.Put(r.Context(), key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		LogRequest("upload_stop_photo", r.Method, r.URL.Path, driverID).Error("Failed to store stop photo", "error", err)
+		http.Error(w, "Failed to store photo", http.StatusInternalServerError)
+		return
+	}
+
+	photo := StopPhoto{
+		RouteOrderID:  routeOrderID,
+		OrderID:       orderID,
+		StopType:      routeType,
+		ContentType:   contentType,
+		QualityIssues: quality.Issues,
+		storageKey:    key,
+	}
+	var width, height *int
+	if quality.Width > 0 {
+		width, height = &quality.Width, &quality.Height
+	}
+	err = h.db.QueryRow(`
+		INSERT INTO stop_photos (route_order_id, order_id, driver_id, storage_key, content_type, size_bytes,
+		                         width, height, brightness, captured_at, content_hash, device_hash, quality_issues)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id, taken_at`,
+		routeOrderID, orderID, driverID, key, contentType, len(data),
+		width, height, quality.Brightness, quality.CapturedAt, quality.ContentHash, deviceHash, pq.Array(quality.Issues),
+	).Scan(&photo.ID, &photo.TakenAt)
+	if err != nil {
+		h.store.Delete(r.Context(), key)
+		http.Error(w, "Failed to store photo", http.StatusInternalServerError)
+		return
+	}
+
+	if len(quality.Issues) > 0 {
+		logAdminAlert(h.db, AdminAlert{
+			Type:      "stop_photo_quality",
+			Severity:  "warning",
+			Title:     fmt.Sprintf("Non-compliant %s photo on order #%d", routeType, orderID),
+			Message:   "Photo flagged: " + describePhotoIssues(quality.Issues),
+			OrderID:   &orderID,
+			DedupeKey: fmt.Sprintf("stop_photo_quality:%d", routeOrderID),
+			Data:      map[string]interface{}{"photo_id": photo.ID, "driver_id": driverID, "issues": quality.Issues},
+		})
+	}
+
+	if photo.URL, err = h.store.SignedURL(r.Context(), key, fileURLExpiry); err != nil {
+		http.Error(w, "Failed to sign photo URL", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(photo)
+}
+
+// ProofOfDeliveryHandler serves the photos and signatures taken on an
+// order's stops to admins
+type ProofOfDeliveryHandler struct {
+	db    *sql.DB
+	store storage.Store
+}
+
+func NewProofOfDeliveryHandler(db *sql.DB, store storage.Store) *ProofOfDeliveryHandler {
+	return &ProofOfDeliveryHandler{
+		db:    db,
+		store: store,
+	}
+}
+
+// ProofOfDelivery is everything captured by drivers at an order's stops
+type ProofOfDelivery struct {
+	OrderID           int                `json:"order_id"`
+	Photos            []StopPhoto        `json:"photos"`
+	PickupSignature   *DeliverySignature `json:"pickup_signature"`
+	DeliverySignature *DeliverySignature `json:"delivery_signature"`
+}
+
+// handleAdminGetProofOfDelivery returns the photos and signatures for an order
+func (h *ProofOfDeliveryHandler) handleAdminGetProofOfDelivery(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM orders WHERE id = $1)", orderID).Scan(&exists); err != nil || !exists {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	proof := ProofOfDelivery{OrderID: orderID}
+	if proof.Photos, err = orderStopPhotos(r.Context(), h.db, h.store, orderID); err != nil {
+		http.Error(w, "Failed to fetch photos", http.StatusInternalServerError)
+		return
+	}
+	if proof.PickupSignature, err = orderStopSignature(r.Context(), h.db, h.store, orderID, "pickup"); err != nil {
+		http.Error(w, "Failed to fetch signatures", http.StatusInternalServerError)
+		return
+	}
+	if proof.DeliverySignature, err = orderStopSignature(r.Context(), h.db, h.store, orderID, "delivery"); err != nil {
+		http.Error(w, "Failed to fetch signatures", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proof)
+}
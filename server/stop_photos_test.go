@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tumble-backend/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func TestStopPhotos(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	driverID := db.CreateTestUser(t, "photo-driver@example.com", "Photo", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "photo-customer@example.com", "Photo", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	var routeID, routeOrderID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, CURRENT_DATE, 'pickup', 'in_progress')
+		RETURNING id`,
+		driverID,
+	).Scan(&routeID)
+	db.QueryRow("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1) RETURNING id", routeID, orderID).Scan(&routeOrderID)
+
+	store := storage.NewLocal(t.TempDir(), "https://tumble.test/api/v1/storage", []byte("secret"))
+	handler := NewDriverRouteHandler(db.DB, NewMockRealtimeHandler())
+	handler.store = store
+
+	upload := func(asDriver int, image []byte) *httptest.ResponseRecorder {
+		handler.getUserID = CreateAuthMock(asDriver).getUserIDFromRequest
+		var form bytes.Buffer
+		writer := multipart.NewWriter(&form)
+		part, _ := writer.CreateFormFile("photo", "stop.jpg")
+		part.Write(image)
+		writer.Close()
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/v1/driver/route-orders/%d/photos", routeOrderID), &form)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(routeOrderID)})
+		w := httptest.NewRecorder()
+		handler.handleUploadStopPhoto(w, req)
+		return w
+	}
+
+	jpeg := append([]byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), make([]byte, 32)...)
+	if w := upload(customerID, jpeg); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for another driver's stop, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := upload(driverID, []byte("not an image")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status %d for a non-image, got %d", http.StatusUnsupportedMediaType, w.Code)
+	}
+	w := upload(driverID, jpeg)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var photo StopPhoto
+	json.Unmarshal(w.Body.Bytes(), &photo)
+	if photo.StopType != "pickup" || photo.URL == "" || photo.OrderID != orderID {
+		t.Errorf("Unexpected photo: %s", w.Body.String())
+	}
+
+	for i := 1; i < maxPhotosPerStop; i++ {
+		upload(driverID, jpeg)
+	}
+	if w := upload(driverID, jpeg); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d past the per-stop limit, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// The customer sees the photos on the tracking page
+	orders := &OrderHandler{db: db.DB, getUserID: CreateAuthMock(customerID).getUserIDFromRequest, fileStore: store}
+	req := mux.SetURLVars(httptest.NewRequest("GET", fmt.Sprintf("/api/v1/orders/%d/tracking", orderID), nil),
+		map[string]string{"id": fmt.Sprint(orderID)})
+	w = httptest.NewRecorder()
+	orders.handleGetOrderTracking(w, req)
+	var tracking struct {
+		Photos []StopPhoto `json:"photos"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &tracking)
+	if len(tracking.Photos) != maxPhotosPerStop || tracking.Photos[0].URL == "" {
+		t.Errorf("Expected %d photos on the tracking page, got %s", maxPhotosPerStop, w.Body.String())
+	}
+
+	// Admins see the photos alongside any signatures
+	req = mux.SetURLVars(httptest.NewRequest("GET", fmt.Sprintf("/api/v1/admin/orders/%d/proof-of-delivery", orderID), nil),
+		map[string]string{"id": fmt.Sprint(orderID)})
+	w = httptest.NewRecorder()
+	NewProofOfDeliveryHandler(db.DB, store).handleAdminGetProofOfDelivery(w, req)
+	var proof ProofOfDelivery
+	json.Unmarshal(w.Body.Bytes(), &proof)
+	if w.Code != http.StatusOK || len(proof.Photos) != maxPhotosPerStop || proof.PickupSignature != nil || proof.DeliverySignature != nil {
+		t.Errorf("Unexpected proof of delivery: %d %s", w.Code, w.Body.String())
+	}
+
+	// Nothing more can be attached once the route closes
+	db.Exec("DELETE FROM stop_photos WHERE route_order_id = $1", routeOrderID)
+	db.Exec("UPDATE driver_routes SET status = 'completed' WHERE id = $1", routeID)
+	if w := upload(driverID, jpeg); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d on a closed route, got %d", http.StatusForbidden, w.Code)
+	}
+}
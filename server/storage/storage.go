@@ -0,0 +1,136 @@
+// Package storage keeps uploaded files in a pluggable object store: a local
+// directory for development, or an S3 or Google Cloud Storage bucket. Stores
+// hand out time-limited signed URLs so files can be downloaded without
+// going through an authenticated API call.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a key doesn't exist in the store
+	ErrNotFound = errors.New("storage: object not found")
+	// ErrInvalidKey is returned for keys that are empty or try to escape
+	// their prefix
+	ErrInvalidKey = errors.New("storage: invalid key")
+	// ErrTooLarge is returned by Validate for uploads over the size limit
+	ErrTooLarge = errors.New("storage: file too large")
+	// ErrContentType is returned by Validate for uploads of a type that isn't
+	// allowed
+	ErrContentType = errors.New("storage: content type not allowed")
+)
+
+// Store is an object store. Keys are slash-separated paths like
+// "users/12/abc.jpg".
+type Store interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a URL anyone can GET the object from until expiry
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// Config selects and configures a backend. It's read from the environment by
+// ConfigFromEnv:
+//
+//	STORAGE_BACKEND            local (default), s3 or gcs
+//	STORAGE_LOCAL_DIR          local: directory files are kept in (default uploads/files)
+//	STORAGE_PUBLIC_URL         local: base URL the signed-download route is served at
+//	STORAGE_SIGNING_KEY        local: secret signed URLs are signed with
+//	STORAGE_BUCKET             s3/gcs: bucket name
+//	STORAGE_REGION             s3: bucket region (default us-east-1)
+//	STORAGE_ENDPOINT           s3: endpoint for S3-compatible services such as MinIO
+//	STORAGE_ACCESS_KEY_ID      s3/gcs: access key, or a GCS HMAC key
+//	STORAGE_SECRET_ACCESS_KEY  s3/gcs: secret for the access key
+type Config struct {
+	Backend     string
+	LocalDir    string
+	PublicURL   string
+	SigningKey  string
+	Bucket      string
+	Region      string
+	Endpoint    string
+	AccessKeyID string
+	SecretKey   string
+}
+
+func ConfigFromEnv() Config {
+	return Config{
+		Backend:     os.Getenv("STORAGE_BACKEND"),
+		LocalDir:    os.Getenv("STORAGE_LOCAL_DIR"),
+		PublicURL:   os.Getenv("STORAGE_PUBLIC_URL"),
+		SigningKey:  os.Getenv("STORAGE_SIGNING_KEY"),
+		Bucket:      os.Getenv("STORAGE_BUCKET"),
+		Region:      os.Getenv("STORAGE_REGION"),
+		Endpoint:    os.Getenv("STORAGE_ENDPOINT"),
+		AccessKeyID: os.Getenv("STORAGE_ACCESS_KEY_ID"),
+		SecretKey:   os.Getenv("STORAGE_SECRET_ACCESS_KEY"),
+	}
+}
+
+// New builds the store a config describes
+func New(config Config) (Store, error) {
+	switch config.Backend {
+	case "", "local":
+		dir := config.LocalDir
+		if dir == "" {
+			dir = "uploads/files"
+		}
+		if config.SigningKey == "" {
+			return nil, fmt.Errorf("STORAGE_SIGNING_KEY is required for local storage")
+		}
+		return NewLocal(dir, config.PublicURL, []byte(config.SigningKey)), nil
+	case "s3":
+		if config.Bucket == "" || config.AccessKeyID == "" || config.SecretKey == "" {
+			return nil, fmt.Errorf("STORAGE_BUCKET, STORAGE_ACCESS_KEY_ID and STORAGE_SECRET_ACCESS_KEY are required for s3 storage")
+		}
+		region := config.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		return NewS3(config.Endpoint, region, config.Bucket, config.AccessKeyID, config.SecretKey), nil
+	case "gcs":
+		if config.Bucket == "" || config.AccessKeyID == "" || config.SecretKey == "" {
+			return nil, fmt.Errorf("STORAGE_BUCKET, STORAGE_ACCESS_KEY_ID and STORAGE_SECRET_ACCESS_KEY are required for gcs storage")
+		}
+		return NewGCS(config.Bucket, config.AccessKeyID, config.SecretKey), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", config.Backend)
+	}
+}
+
+// Validate checks an upload against a size limit and a set of allowed types.
+// The type is sniffed from the content rather than trusted from the client,
+// and the matching file extension from allowed is returned with it.
+func Validate(data []byte, maxBytes int64, allowed map[string]string) (contentType, ext string, err error) {
+	if int64(len(data)) > maxBytes {
+		return "", "", ErrTooLarge
+	}
+	contentType = http.DetectContentType(data)
+	ext, ok := allowed[contentType]
+	if !ok {
+		return "", "", fmt.Errorf("%w: %s", ErrContentType, contentType)
+	}
+	return contentType, ext, nil
+}
+
+// cleanKey rejects keys that are empty, absolute or contain ".." segments
+func cleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", ErrInvalidKey
+		}
+	}
+	return key, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// stripeEventLease is how long an event being processed is left alone. A
+// request that dies mid-event leaves it claimed; after this Stripe's next
+// delivery, or an admin, may pick it up.
+const stripeEventLease = 5 * time.Minute
+
+// errStripeEventPayload means the event's object couldn't be decoded, so
+// retrying it won't help
+var errStripeEventPayload = errors.New("invalid event payload")
+
+// StripeWebhookEvent is a Stripe event we've received and what became of it
+type StripeWebhookEvent struct {
+	EventID     string     `json:"event_id"`
+	EventType   string     `json:"event_type"`
+	Status      string     `json:"status"` // processing, processed or failed
+	Attempts    int        `json:"attempts"`
+	LastError   *string    `json:"last_error,omitempty"`
+	ReplayedBy  *int       `json:"replayed_by,omitempty"`
+	ReceivedAt  time.Time  `json:"received_at"`
+	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+const stripeWebhookEventColumns = `event_id, event_type, status, attempts, last_error, replayed_by,
+	received_at, processed_at, updated_at`
+
+func scanStripeWebhookEvent(scanner interface{ Scan(...interface{}) error }) (StripeWebhookEvent, error) {
+	var e StripeWebhookEvent
+	err := scanner.Scan(&e.EventID, &e.EventType, &e.Status, &e.Attempts, &e.LastError, &e.ReplayedBy,
+		&e.ReceivedAt, &e.ProcessedAt, &e.UpdatedAt)
+	return e, err
+}
+
+// claimStripeEvent records an event as being processed. It returns false
+// when the event was already applied or another request is applying it.
+func claimStripeEvent(db *sql.DB, eventID, eventType string, payload []byte) (bool, error) {
+	var claimed string
+	err := db.QueryRow(`
+		INSERT INTO processed_webhook_events (event_id, event_type, payload)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (event_id) DO UPDATE
+		SET status = 'processing', attempts = processed_webhook_events.attempts + 1,
+		    last_error = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE processed_webhook_events.status = 'failed'
+		   OR (processed_webhook_events.status = 'processing'
+		       AND processed_webhook_events.updated_at < CURRENT_TIMESTAMP - make_interval(secs => $4))
+		RETURNING event_id`,
+		eventID, eventType, payload, stripeEventLease.Seconds(),
+	).Scan(&claimed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// finishStripeEvent records how applying a claimed event went
+func finishStripeEvent(db *sql.DB, eventID string, applyErr error) error {
+	if applyErr == nil {
+		_, err := db.Exec(`
+			UPDATE processed_webhook_events
+			SET status = 'processed', processed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+			WHERE event_id = $1`,
+			eventID,
+		)
+		return err
+	}
+	_, err := db.Exec(`
+		UPDATE processed_webhook_events
+		SET status = 'failed', last_error = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE event_id = $1`,
+		eventID, applyErr.Error(),
+	)
+	return err
+}
+
+// processStripeEvent applies an event unless it's already been applied.
+// It returns whether the event was applied this time.
+func (h *PaymentHandler) processStripeEvent(event stripe.Event, payload []byte) (bool, error) {
+	claimed, err := claimStripeEvent(h.db, event.ID, string(event.Type), payload)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	applyErr := h.applyStripeEvent(event)
+	if err := finishStripeEvent(h.db, event.ID, applyErr); err != nil {
+		log.Printf("Failed to record the outcome of Stripe event %s: %v", event.ID, err)
+	}
+	return applyErr == nil, applyErr
+}
+
+// handleGetStripeWebhookEvents lists Stripe events by status, most recent
+// first. Failed, the default, includes events whose processing died.
+func (h *PaymentHandler) handleGetStripeWebhookEvents(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "failed"
+	}
+	var where string
+	var args []interface{}
+	switch status {
+	case "failed":
+		where = "status = 'failed' OR (status = 'processing' AND updated_at < CURRENT_TIMESTAMP - make_interval(secs => $1))"
+		args = append(args, stripeEventLease.Seconds())
+	case "processing", "processed":
+		where = "status = $1"
+		args = append(args, status)
+	default:
+		http.Error(w, "status must be failed, processing or processed", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT `+stripeWebhookEventColumns+`
+		FROM processed_webhook_events
+		WHERE `+where+`
+		ORDER BY received_at DESC
+		LIMIT 100`,
+		args...,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch webhook events", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []StripeWebhookEvent{}
+	for rows.Next() {
+		event, err := scanStripeWebhookEvent(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse webhook events", http.StatusInternalServerError)
+			return
+		}
+		events = append(events, event)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// handleReplayStripeWebhookEvent applies a failed event again from its
+// stored payload, once whatever made it fail has been fixed
+func (h *PaymentHandler) handleReplayStripeWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	eventID := mux.Vars(r)["id"]
+
+	var payload []byte
+	err = h.db.QueryRow("SELECT payload FROM processed_webhook_events WHERE event_id = $1", eventID).Scan(&payload)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook event not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch webhook event", http.StatusInternalServerError)
+		return
+	}
+	var event stripe.Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		http.Error(w, "Stored event can't be decoded", http.StatusUnprocessableEntity)
+		return
+	}
+
+	claimed, err := claimStripeEvent(h.db, event.ID, string(event.Type), payload)
+	if err != nil {
+		http.Error(w, "Failed to replay webhook event", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		http.Error(w, "Event was already processed or is being processed", http.StatusConflict)
+		return
+	}
+	h.db.Exec("UPDATE processed_webhook_events SET replayed_by = $1 WHERE event_id = $2", adminID, event.ID)
+
+	applyErr := h.applyStripeEvent(event)
+	if err := finishStripeEvent(h.db, event.ID, applyErr); err != nil {
+		http.Error(w, "Failed to record replay", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := scanStripeWebhookEvent(h.db.QueryRow(
+		"SELECT "+stripeWebhookEventColumns+" FROM processed_webhook_events WHERE event_id = $1", event.ID))
+	if err != nil {
+		http.Error(w, "Failed to fetch webhook event", http.StatusInternalServerError)
+		return
+	}
+
+	// A replay that fails again still reports the event, with its new error
+	w.Header().Set("Content-Type", "application/json")
+	if applyErr != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// replayStripeEvents applies again every event received since then that
+// failed or whose processing died, oldest first. It returns how many were
+// applied and how many failed again.
+func (h *PaymentHandler) replayStripeEvents(since time.Time, adminID int) (replayed, failing int, err error) {
+	rows, err := h.db.Query(`
+		SELECT payload FROM processed_webhook_events
+		WHERE received_at >= $1
+		  AND (status = 'failed' OR (status = 'processing' AND updated_at < CURRENT_TIMESTAMP - make_interval(secs => $2)))
+		ORDER BY received_at`,
+		since, stripeEventLease.Seconds(),
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	var payloads [][]byte
+	for rows.Next() {
+		var payload []byte
+		if err := rows.Scan(&payload); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		payloads = append(payloads, payload)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, payload := range payloads {
+		var event stripe.Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			failing++
+			continue
+		}
+		claimed, err := claimStripeEvent(h.db, event.ID, string(event.Type), payload)
+		if err != nil {
+			return replayed, failing, err
+		}
+		if !claimed {
+			continue
+		}
+		h.db.Exec("UPDATE processed_webhook_events SET replayed_by = $1 WHERE event_id = $2", adminID, event.ID)
+
+		applyErr := h.applyStripeEvent(event)
+		if err := finishStripeEvent(h.db, event.ID, applyErr); err != nil {
+			return replayed, failing, err
+		}
+		if applyErr != nil {
+			failing++
+		} else {
+			replayed++
+		}
+	}
+	return replayed, failing, nil
+}
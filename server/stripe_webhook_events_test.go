@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+func TestStripeWebhookEvents_IdempotentAndReplayable(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	const secret = "whsec_test_idempotency"
+	t.Setenv("STRIPE_WEBHOOK_SECRET", secret)
+
+	customerID := db.CreateTestUser(t, "stripe-events@example.com", "Stripe", "Events")
+	adminID := db.CreateTestUser(t, "stripe-events-admin@example.com", "Stripe", "Admin")
+	addressID := db.CreateTestAddress(t, customerID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+	db.Exec(`
+		INSERT INTO payments (user_id, order_id, amount_cents, payment_type, status, stripe_payment_intent_id)
+		VALUES ($1, $2, 3000, 'extra_order', 'pending', 'pi_idempotency_test')`,
+		customerID, orderID)
+
+	handler := &PaymentHandler{
+		db:       db.DB,
+		realtime: NewMockRealtimeHandler(),
+		getUserID: func(r *http.Request, db *sql.DB) (int, error) {
+			return adminID, nil
+		},
+	}
+
+	deliver := func(eventID, eventType, object string) *httptest.ResponseRecorder {
+		payload := []byte(fmt.Sprintf(
+			`{"id": %q, "object": "event", "type": %q, "api_version": %q, "data": {"object": %s}}`,
+			eventID, eventType, stripe.APIVersion, object))
+		signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+			Payload:   payload,
+			Secret:    secret,
+			Timestamp: time.Now(),
+		})
+		req := httptest.NewRequest("POST", "/api/v1/payments/webhook", bytes.NewReader(signed.Payload))
+		req.Header.Set("Stripe-Signature", signed.Header)
+		w := httptest.NewRecorder()
+		handler.handleStripeWebhook(w, req)
+		return w
+	}
+	paymentStatus := func() string {
+		var status string
+		db.QueryRow("SELECT status FROM payments WHERE stripe_payment_intent_id = 'pi_idempotency_test'").Scan(&status)
+		return status
+	}
+	replay := func(eventID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/admin/payments/webhook-events/"+eventID+"/replay", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": eventID})
+		w := httptest.NewRecorder()
+		handler.handleReplayStripeWebhookEvent(w, req)
+		return w
+	}
+
+	t.Run("a redelivered event is applied once", func(t *testing.T) {
+		object := `{"id": "pi_idempotency_test", "object": "payment_intent", "amount": 3000}`
+		if w := deliver("evt_idempotency_1", "payment_intent.payment_failed", object); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := paymentStatus(); got != "failed" {
+			t.Fatalf("Expected the payment to be failed, got %s", got)
+		}
+
+		// Had it been applied again the payment would be failed once more
+		db.Exec("UPDATE payments SET status = 'pending' WHERE stripe_payment_intent_id = 'pi_idempotency_test'")
+		if w := deliver("evt_idempotency_1", "payment_intent.payment_failed", object); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for a redelivery, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := paymentStatus(); got != "pending" {
+			t.Errorf("Expected the redelivered event to be skipped, payment is %s", got)
+		}
+
+		var status string
+		var attempts int
+		db.QueryRow("SELECT status, attempts FROM processed_webhook_events WHERE event_id = 'evt_idempotency_1'").Scan(&status, &attempts)
+		if status != "processed" || attempts != 1 {
+			t.Errorf("Expected processed after 1 attempt, got %s after %d", status, attempts)
+		}
+
+		if w := replay("evt_idempotency_1"); w.Code != http.StatusConflict {
+			t.Errorf("Expected 409 replaying a processed event, got %d", w.Code)
+		}
+	})
+
+	t.Run("a failed event is listed and can be replayed", func(t *testing.T) {
+		if w := deliver("evt_idempotency_2", "payment_intent.succeeded", `"not an object"`); w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for an unreadable object, got %d: %s", w.Code, w.Body.String())
+		}
+
+		req := httptest.NewRequest("GET", "/api/v1/admin/payments/webhook-events", nil)
+		w := httptest.NewRecorder()
+		handler.handleGetStripeWebhookEvents(w, req)
+		var events []StripeWebhookEvent
+		if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		if len(events) != 1 || events[0].EventID != "evt_idempotency_2" || events[0].LastError == nil {
+			t.Fatalf("Expected only the failed event with its error, got %+v", events)
+		}
+
+		// The payload is still unreadable, so the replay fails again
+		w = replay("evt_idempotency_2")
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("Expected 422, got %d: %s", w.Code, w.Body.String())
+		}
+		var replayed StripeWebhookEvent
+		json.Unmarshal(w.Body.Bytes(), &replayed)
+		if replayed.Status != "failed" || replayed.Attempts != 2 {
+			t.Errorf("Expected failed after 2 attempts, got %s after %d", replayed.Status, replayed.Attempts)
+		}
+		if replayed.ReplayedBy == nil || *replayed.ReplayedBy != adminID {
+			t.Errorf("Expected the replay to record admin %d, got %v", adminID, replayed.ReplayedBy)
+		}
+
+		if w := replay("evt_missing"); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for an unknown event, got %d", w.Code)
+		}
+	})
+}
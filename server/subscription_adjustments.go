@@ -0,0 +1,629 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"tumble-backend/money"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/customerbalancetransaction"
+	"github.com/stripe/stripe-go/v82/subscription"
+)
+
+// Caps that keep a typo from crediting hundreds of customers far too much
+const (
+	maxBulkCreditCents = 10000
+	maxBulkExtendDays  = 60
+)
+
+// SubscriptionAdjustmentHandler compensates subscribers in bulk after an
+// incident, either with a Stripe balance credit or by extending their period
+type SubscriptionAdjustmentHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+	// creditCustomer applies a credit to a Stripe customer's balance and
+	// returns the balance transaction ID
+	creditCustomer func(customerID string, amountCents int, description string, metadata map[string]string) (string, error)
+	// extendSubscription holds off a Stripe subscription's next invoice until
+	// newEnd
+	extendSubscription func(subscriptionID string, newEnd time.Time, metadata map[string]string) error
+}
+
+func NewSubscriptionAdjustmentHandler(db *sql.DB) *SubscriptionAdjustmentHandler {
+	return &SubscriptionAdjustmentHandler{
+		db:                 db,
+		getUserID:          getUserIDFromRequest,
+		creditCustomer:     creditStripeCustomer,
+		extendSubscription: extendStripeSubscription,
+	}
+}
+
+// creditStripeCustomer adds a negative balance transaction, which Stripe
+// applies to the customer's next invoice
+func creditStripeCustomer(customerID string, amountCents int, description string, metadata map[string]string) (string, error) {
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	params := &stripe.CustomerBalanceTransactionParams{
+		Customer:    stripe.String(customerID),
+		Amount:      stripe.Int64(-int64(amountCents)),
+		Currency:    stripe.String(string(stripe.CurrencyUSD)),
+		Description: stripe.String(description),
+	}
+	for key, value := range metadata {
+		params.AddMetadata(key, value)
+	}
+	txn, err := customerbalancetransaction.New(params)
+	if err != nil {
+		return "", err
+	}
+	return txn.ID, nil
+}
+
+// extendStripeSubscription moves the subscription's trial end to newEnd.
+// Stripe doesn't bill until a trial ends and then starts a new period from
+// it, which its webhook syncs back to the local period.
+func extendStripeSubscription(subscriptionID string, newEnd time.Time, metadata map[string]string) error {
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	params := &stripe.SubscriptionParams{
+		TrialEnd:          stripe.Int64(newEnd.Unix()),
+		ProrationBehavior: stripe.String("none"),
+	}
+	for key, value := range metadata {
+		params.AddMetadata(key, value)
+	}
+	_, err := subscription.Update(subscriptionID, params)
+	return err
+}
+
+// BulkAdjustmentFilter picks subscribers with orders in the facility between
+// AffectedFrom and AffectedTo (picked up on or before To, delivered on or after From)
+type BulkAdjustmentFilter struct {
+	AffectedFrom  string   `json:"affected_from"`
+	AffectedTo    string   `json:"affected_to"`
+	OrderStatuses []string `json:"order_statuses,omitempty"`
+}
+
+type BulkAdjustmentRequest struct {
+	IncidentKey    string               `json:"incident_key"`
+	Reason         string               `json:"reason"`
+	Filter         BulkAdjustmentFilter `json:"filter"`
+	AdjustmentType string               `json:"adjustment_type"` // credit or extend_period
+	CreditAmount   float64              `json:"credit_amount,omitempty"`
+	ExtendDays     int                  `json:"extend_days,omitempty"`
+	// ExpectedCount must match the preview when applying, so nothing changed in between
+	ExpectedCount *int `json:"expected_count,omitempty"`
+}
+
+type BulkAdjustmentCandidate struct {
+	SubscriptionID   int     `json:"subscription_id"`
+	UserID           int     `json:"user_id"`
+	Email            string  `json:"email"`
+	Name             string  `json:"name"`
+	AffectedOrders   int     `json:"affected_orders"`
+	CurrentPeriodEnd string  `json:"current_period_end"`
+	NewPeriodEnd     *string `json:"new_period_end,omitempty"`
+	CreditAmount     float64 `json:"credit_amount,omitempty"`
+	AlreadyAdjusted  bool    `json:"already_adjusted"`
+	// Problem explains why the adjustment can't be applied, if it can't
+	Problem              *string `json:"problem,omitempty"`
+	stripeCustomerID     *string
+	stripeSubscriptionID *string
+}
+
+type BulkAdjustmentPreview struct {
+	AffectedSubscriptions int                       `json:"affected_subscriptions"`
+	Eligible              int                       `json:"eligible"`
+	AlreadyAdjusted       int                       `json:"already_adjusted"`
+	TotalCredit           float64                   `json:"total_credit"`
+	Candidates            []BulkAdjustmentCandidate `json:"candidates"`
+}
+
+type SubscriptionAdjustment struct {
+	ID                         int        `json:"id"`
+	SubscriptionID             int        `json:"subscription_id"`
+	UserID                     int        `json:"user_id"`
+	AdjustmentType             string     `json:"adjustment_type"`
+	CreditAmount               *float64   `json:"credit_amount,omitempty"`
+	ExtendDays                 *int       `json:"extend_days,omitempty"`
+	PreviousPeriodEnd          *string    `json:"previous_period_end,omitempty"`
+	NewPeriodEnd               *string    `json:"new_period_end,omitempty"`
+	StripeBalanceTransactionID *string    `json:"stripe_balance_transaction_id,omitempty"`
+	StripeTrialEnd             *time.Time `json:"stripe_trial_end,omitempty"`
+	Status                     string     `json:"status"`
+	Error                      *string    `json:"error,omitempty"`
+	CreatedAt                  time.Time  `json:"created_at"`
+}
+
+type SubscriptionAdjustmentBatch struct {
+	ID             int                      `json:"id"`
+	IncidentKey    string                   `json:"incident_key"`
+	Reason         string                   `json:"reason"`
+	AdjustmentType string                   `json:"adjustment_type"`
+	CreditAmount   *float64                 `json:"credit_amount,omitempty"`
+	ExtendDays     *int                     `json:"extend_days,omitempty"`
+	Filter         json.RawMessage          `json:"filter"`
+	AffectedCount  int                      `json:"affected_count"`
+	AppliedCount   int                      `json:"applied_count"`
+	FailedCount    int                      `json:"failed_count"`
+	SkippedCount   int                      `json:"skipped_count"`
+	CreatedBy      *int                     `json:"created_by,omitempty"`
+	CreatedAt      time.Time                `json:"created_at"`
+	Adjustments    []SubscriptionAdjustment `json:"adjustments,omitempty"`
+}
+
+func validateBulkAdjustment(req BulkAdjustmentRequest) error {
+	if req.IncidentKey == "" || len(req.IncidentKey) > 100 {
+		return fmt.Errorf("incident_key is required")
+	}
+	if req.Reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+	from, err := time.Parse("2006-01-02", req.Filter.AffectedFrom)
+	if err != nil {
+		return fmt.Errorf("filter.affected_from must be YYYY-MM-DD")
+	}
+	to, err := time.Parse("2006-01-02", req.Filter.AffectedTo)
+	if err != nil {
+		return fmt.Errorf("filter.affected_to must be YYYY-MM-DD")
+	}
+	if to.Before(from) {
+		return fmt.Errorf("filter.affected_to is before affected_from")
+	}
+	for _, status := range req.Filter.OrderStatuses {
+		if !isValidOrderStatus(status) {
+			return fmt.Errorf("unknown order status %q", status)
+		}
+	}
+
+	switch req.AdjustmentType {
+	case "credit":
+		cents := dollarsToCents(req.CreditAmount)
+		if cents <= 0 || cents > maxBulkCreditCents {
+			return fmt.Errorf("credit_amount must be between $0.01 and %s", money.Format(maxBulkCreditCents))
+		}
+	case "extend_period":
+		if req.ExtendDays <= 0 || req.ExtendDays > maxBulkExtendDays {
+			return fmt.Errorf("extend_days must be between 1 and %d", maxBulkExtendDays)
+		}
+	default:
+		return fmt.Errorf("adjustment_type must be credit or extend_period")
+	}
+	return nil
+}
+
+// findAdjustmentCandidates returns active and paused subscriptions whose
+// owners had orders in the affected window, with what the adjustment would do
+func (h *SubscriptionAdjustmentHandler) findAdjustmentCandidates(req BulkAdjustmentRequest) (*BulkAdjustmentPreview, error) {
+	rows, err := h.db.Query(`
+		SELECT s.id, s.user_id, u.email, u.first_name || ' ' || u.last_name, u.stripe_customer_id,
+		       s.stripe_subscription_id, s.current_period_end, COUNT(DISTINCT o.id),
+		       EXISTS (
+		           SELECT 1 FROM subscription_adjustments sa
+		           WHERE sa.subscription_id = s.id AND sa.incident_key = $3
+		             AND sa.status IN ('pending', 'applied')
+		       )
+		FROM subscriptions s
+		JOIN users u ON s.user_id = u.id
+		JOIN orders o ON o.user_id = s.user_id
+		WHERE s.status IN ('active', 'paused')
+		  AND o.status != 'cancelled'
+		  AND o.pickup_date <= $2 AND o.delivery_date >= $1
+		  AND (cardinality($4::text[]) = 0 OR o.status = ANY($4))
+		GROUP BY s.id, s.user_id, u.email, u.first_name, u.last_name, u.stripe_customer_id,
+		         s.stripe_subscription_id, s.current_period_end
+		ORDER BY s.id`,
+		req.Filter.AffectedFrom, req.Filter.AffectedTo, req.IncidentKey, pq.Array(append([]string{}, req.Filter.OrderStatuses...)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	preview := &BulkAdjustmentPreview{Candidates: []BulkAdjustmentCandidate{}}
+	for rows.Next() {
+		var c BulkAdjustmentCandidate
+		var periodEnd time.Time
+		if err := rows.Scan(&c.SubscriptionID, &c.UserID, &c.Email, &c.Name, &c.stripeCustomerID,
+			&c.stripeSubscriptionID, &periodEnd, &c.AffectedOrders, &c.AlreadyAdjusted); err != nil {
+			return nil, err
+		}
+		c.CurrentPeriodEnd = periodEnd.Format("2006-01-02")
+
+		switch req.AdjustmentType {
+		case "credit":
+			c.CreditAmount = centsToDollars(dollarsToCents(req.CreditAmount))
+			if c.stripeCustomerID == nil || *c.stripeCustomerID == "" {
+				problem := "No Stripe customer to credit"
+				c.Problem = &problem
+			}
+		case "extend_period":
+			newEnd := periodEnd.AddDate(0, 0, req.ExtendDays).Format("2006-01-02")
+			c.NewPeriodEnd = &newEnd
+		}
+
+		preview.AffectedSubscriptions++
+		if c.AlreadyAdjusted {
+			preview.AlreadyAdjusted++
+		} else if c.Problem == nil {
+			preview.Eligible++
+			preview.TotalCredit += c.CreditAmount
+		}
+		preview.Candidates = append(preview.Candidates, c)
+	}
+	return preview, rows.Err()
+}
+
+// applyAdjustment compensates one subscription and records the outcome. Each
+// subscription is committed on its own so one Stripe failure doesn't undo the rest.
+func (h *SubscriptionAdjustmentHandler) applyAdjustment(batchID int, req BulkAdjustmentRequest, c BulkAdjustmentCandidate) (string, error) {
+	if c.AlreadyAdjusted || c.Problem != nil {
+		status, note := "skipped", "Already adjusted for this incident"
+		if c.Problem != nil {
+			status, note = "failed", *c.Problem
+		}
+		_, err := h.db.Exec(`
+			INSERT INTO subscription_adjustments (batch_id, incident_key, subscription_id, user_id, adjustment_type, status, error)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			batchID, req.IncidentKey, c.SubscriptionID, c.UserID, req.AdjustmentType, status, note,
+		)
+		return status, err
+	}
+
+	if req.AdjustmentType == "extend_period" {
+		return h.applyExtension(batchID, req, c)
+	}
+
+	// Claim the subscription before calling Stripe so a concurrent run can't credit it twice
+	creditCents := dollarsToCents(req.CreditAmount)
+	var adjustmentID int
+	err := h.db.QueryRow(`
+		INSERT INTO subscription_adjustments (batch_id, incident_key, subscription_id, user_id, adjustment_type, credit_cents, status)
+		VALUES ($1, $2, $3, $4, 'credit', $5, 'pending')
+		ON CONFLICT (incident_key, subscription_id) WHERE status IN ('pending', 'applied') DO NOTHING
+		RETURNING id`,
+		batchID, req.IncidentKey, c.SubscriptionID, c.UserID, creditCents,
+	).Scan(&adjustmentID)
+	if err == sql.ErrNoRows {
+		_, err = h.db.Exec(`
+			INSERT INTO subscription_adjustments (batch_id, incident_key, subscription_id, user_id, adjustment_type, status, error)
+			VALUES ($1, $2, $3, $4, 'credit', 'skipped', 'Already adjusted for this incident')`,
+			batchID, req.IncidentKey, c.SubscriptionID, c.UserID,
+		)
+		return "skipped", err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	txnID, creditErr := h.creditCustomer(*c.stripeCustomerID, creditCents, req.Reason, map[string]string{
+		"incident_key":    req.IncidentKey,
+		"subscription_id": strconv.Itoa(c.SubscriptionID),
+	})
+	if creditErr != nil {
+		log.Printf("Error crediting subscription %d for %s: %v", c.SubscriptionID, req.IncidentKey, creditErr)
+		_, err = h.db.Exec("UPDATE subscription_adjustments SET status = 'failed', error = $1 WHERE id = $2", creditErr.Error(), adjustmentID)
+		return "failed", err
+	}
+	_, err = h.db.Exec(`
+		UPDATE subscription_adjustments SET status = 'applied', stripe_balance_transaction_id = $1
+		WHERE id = $2`,
+		txnID, adjustmentID,
+	)
+	return "applied", err
+}
+
+// applyExtension extends one subscription's period, in Stripe first when it
+// has a Stripe subscription so the local period never runs ahead of billing
+func (h *SubscriptionAdjustmentHandler) applyExtension(batchID int, req BulkAdjustmentRequest, c BulkAdjustmentCandidate) (string, error) {
+	// Claim the subscription before calling Stripe so a concurrent run can't extend it twice
+	var adjustmentID int
+	var newEnd time.Time
+	err := h.db.QueryRow(`
+		INSERT INTO subscription_adjustments (
+			batch_id, incident_key, subscription_id, user_id, adjustment_type,
+			extend_days, previous_period_end, new_period_end, stripe_subscription_id, status
+		)
+		SELECT $1, $2, id, $3, 'extend_period', $4, current_period_end, current_period_end + $4::integer, NULLIF(stripe_subscription_id, ''), 'pending'
+		FROM subscriptions WHERE id = $5
+		ON CONFLICT (incident_key, subscription_id) WHERE status IN ('pending', 'applied') DO NOTHING
+		RETURNING id, new_period_end`,
+		batchID, req.IncidentKey, c.UserID, req.ExtendDays, c.SubscriptionID,
+	).Scan(&adjustmentID, &newEnd)
+	if err == sql.ErrNoRows {
+		_, err = h.db.Exec(`
+			INSERT INTO subscription_adjustments (batch_id, incident_key, subscription_id, user_id, adjustment_type, status, error)
+			VALUES ($1, $2, $3, $4, 'extend_period', 'skipped', 'Already adjusted for this incident')`,
+			batchID, req.IncidentKey, c.SubscriptionID, c.UserID,
+		)
+		return "skipped", err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var trialEnd *time.Time
+	if c.stripeSubscriptionID != nil && *c.stripeSubscriptionID != "" {
+		extendErr := h.extendSubscription(*c.stripeSubscriptionID, newEnd, map[string]string{
+			"incident_key":    req.IncidentKey,
+			"subscription_id": strconv.Itoa(c.SubscriptionID),
+		})
+		if extendErr != nil {
+			log.Printf("Error extending subscription %d for %s: %v", c.SubscriptionID, req.IncidentKey, extendErr)
+			_, err = h.db.Exec("UPDATE subscription_adjustments SET status = 'failed', error = $1 WHERE id = $2", extendErr.Error(), adjustmentID)
+			return "failed", err
+		}
+		trialEnd = &newEnd
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE subscriptions SET current_period_end = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2`,
+		newEnd, c.SubscriptionID,
+	)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		UPDATE subscription_adjustments SET status = 'applied', stripe_trial_end = $1
+		WHERE id = $2`,
+		trialEnd, adjustmentID,
+	)
+	if err != nil {
+		return "", err
+	}
+	return "applied", tx.Commit()
+}
+
+// handlePreviewBulkAdjustment shows who an adjustment would reach without changing anything
+func (h *SubscriptionAdjustmentHandler) handlePreviewBulkAdjustment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req BulkAdjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateBulkAdjustment(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	preview, err := h.findAdjustmentCandidates(req)
+	if err != nil {
+		http.Error(w, "Failed to preview adjustment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
+
+// handleApplyBulkAdjustment applies an adjustment to every matching
+// subscription and records the batch and each outcome
+func (h *SubscriptionAdjustmentHandler) handleApplyBulkAdjustment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req BulkAdjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateBulkAdjustment(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ExpectedCount == nil {
+		http.Error(w, "expected_count from the preview is required", http.StatusBadRequest)
+		return
+	}
+
+	preview, err := h.findAdjustmentCandidates(req)
+	if err != nil {
+		http.Error(w, "Failed to apply adjustment", http.StatusInternalServerError)
+		return
+	}
+	if preview.Eligible != *req.ExpectedCount {
+		http.Error(w, fmt.Sprintf("Adjustment now reaches %d subscriptions, not %d; preview again", preview.Eligible, *req.ExpectedCount), http.StatusConflict)
+		return
+	}
+
+	filterJSON, _ := json.Marshal(req.Filter)
+	var creditCents *int
+	var extendDays *int
+	if req.AdjustmentType == "credit" {
+		cents := dollarsToCents(req.CreditAmount)
+		creditCents = &cents
+	} else {
+		extendDays = &req.ExtendDays
+	}
+
+	var batchID int
+	err = h.db.QueryRow(`
+		INSERT INTO subscription_adjustment_batches (
+			incident_key, reason, adjustment_type, credit_cents, extend_days, filter, affected_count, created_by
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`,
+		req.IncidentKey, req.Reason, req.AdjustmentType, creditCents, extendDays, filterJSON,
+		preview.AffectedSubscriptions, adminID,
+	).Scan(&batchID)
+	if err != nil {
+		http.Error(w, "Failed to record adjustment", http.StatusInternalServerError)
+		return
+	}
+
+	counts := map[string]int{}
+	for _, c := range preview.Candidates {
+		status, err := h.applyAdjustment(batchID, req, c)
+		if err != nil {
+			log.Printf("Error adjusting subscription %d in batch %d: %v", c.SubscriptionID, batchID, err)
+			status = "failed"
+			h.db.Exec(`
+				INSERT INTO subscription_adjustments (batch_id, incident_key, subscription_id, user_id, adjustment_type, status, error)
+				VALUES ($1, $2, $3, $4, $5, 'failed', $6)`,
+				batchID, req.IncidentKey, c.SubscriptionID, c.UserID, req.AdjustmentType, err.Error(),
+			)
+		}
+		counts[status]++
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE subscription_adjustment_batches
+		SET applied_count = $1, failed_count = $2, skipped_count = $3
+		WHERE id = $4`,
+		counts["applied"], counts["failed"], counts["skipped"], batchID,
+	)
+	if err != nil {
+		log.Printf("Error updating adjustment batch %d counts: %v", batchID, err)
+	}
+	log.Printf("Bulk adjustment %d (%s) by admin %d: %d applied, %d failed, %d skipped",
+		batchID, req.IncidentKey, adminID, counts["applied"], counts["failed"], counts["skipped"])
+
+	batch, err := h.getBatch(batchID)
+	if err != nil {
+		http.Error(w, "Failed to fetch adjustment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(batch)
+}
+
+const adjustmentBatchColumns = `
+	id, incident_key, reason, adjustment_type, credit_cents, extend_days, filter,
+	affected_count, applied_count, failed_count, skipped_count, created_by, created_at`
+
+func scanAdjustmentBatch(row interface{ Scan(...interface{}) error }) (*SubscriptionAdjustmentBatch, error) {
+	var batch SubscriptionAdjustmentBatch
+	var creditCents *int
+	err := row.Scan(&batch.ID, &batch.IncidentKey, &batch.Reason, &batch.AdjustmentType, &creditCents, &batch.ExtendDays,
+		&batch.Filter, &batch.AffectedCount, &batch.AppliedCount, &batch.FailedCount, &batch.SkippedCount,
+		&batch.CreatedBy, &batch.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if creditCents != nil {
+		amount := centsToDollars(*creditCents)
+		batch.CreditAmount = &amount
+	}
+	return &batch, nil
+}
+
+func (h *SubscriptionAdjustmentHandler) getBatch(batchID int) (*SubscriptionAdjustmentBatch, error) {
+	batch, err := scanAdjustmentBatch(h.db.QueryRow(
+		"SELECT "+adjustmentBatchColumns+" FROM subscription_adjustment_batches WHERE id = $1", batchID))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, subscription_id, user_id, adjustment_type, credit_cents, extend_days,
+		       to_char(previous_period_end, 'YYYY-MM-DD'), to_char(new_period_end, 'YYYY-MM-DD'),
+		       stripe_balance_transaction_id, stripe_trial_end, status, error, created_at
+		FROM subscription_adjustments
+		WHERE batch_id = $1
+		ORDER BY id`,
+		batchID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batch.Adjustments = []SubscriptionAdjustment{}
+	for rows.Next() {
+		var a SubscriptionAdjustment
+		var creditCents *int
+		if err := rows.Scan(&a.ID, &a.SubscriptionID, &a.UserID, &a.AdjustmentType, &creditCents, &a.ExtendDays,
+			&a.PreviousPeriodEnd, &a.NewPeriodEnd, &a.StripeBalanceTransactionID, &a.StripeTrialEnd, &a.Status, &a.Error, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		if creditCents != nil {
+			amount := centsToDollars(*creditCents)
+			a.CreditAmount = &amount
+		}
+		batch.Adjustments = append(batch.Adjustments, a)
+	}
+	return batch, rows.Err()
+}
+
+// handleGetBulkAdjustments lists past batches, newest first
+func (h *SubscriptionAdjustmentHandler) handleGetBulkAdjustments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := h.db.Query("SELECT " + adjustmentBatchColumns + " FROM subscription_adjustment_batches ORDER BY created_at DESC LIMIT 100")
+	if err != nil {
+		http.Error(w, "Failed to fetch adjustments", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	batches := []SubscriptionAdjustmentBatch{}
+	for rows.Next() {
+		batch, err := scanAdjustmentBatch(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch adjustments", http.StatusInternalServerError)
+			return
+		}
+		batches = append(batches, *batch)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batches)
+}
+
+// handleGetBulkAdjustment returns one batch with every subscription's outcome
+func (h *SubscriptionAdjustmentHandler) handleGetBulkAdjustment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	batchID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid adjustment ID", http.StatusBadRequest)
+		return
+	}
+
+	batch, err := h.getBatch(batchID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Adjustment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch adjustment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch)
+}
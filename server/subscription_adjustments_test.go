@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidateBulkAdjustment(t *testing.T) {
+	valid := BulkAdjustmentRequest{
+		IncidentKey:    "facility-outage-1",
+		Reason:         "Facility outage",
+		Filter:         BulkAdjustmentFilter{AffectedFrom: "2025-03-01", AffectedTo: "2025-03-03"},
+		AdjustmentType: "credit",
+		CreditAmount:   10,
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*BulkAdjustmentRequest)
+		wantErr bool
+	}{
+		{"Valid credit", func(r *BulkAdjustmentRequest) {}, false},
+		{"Valid extension", func(r *BulkAdjustmentRequest) { r.AdjustmentType = "extend_period"; r.ExtendDays = 7 }, false},
+		{"Missing incident key", func(r *BulkAdjustmentRequest) { r.IncidentKey = "" }, true},
+		{"Missing reason", func(r *BulkAdjustmentRequest) { r.Reason = "" }, true},
+		{"Reversed range", func(r *BulkAdjustmentRequest) { r.Filter.AffectedTo = "2025-02-28" }, true},
+		{"Unknown order status", func(r *BulkAdjustmentRequest) { r.Filter.OrderStatuses = []string{"lost"} }, true},
+		{"Zero credit", func(r *BulkAdjustmentRequest) { r.CreditAmount = 0 }, true},
+		{"Credit over cap", func(r *BulkAdjustmentRequest) { r.CreditAmount = 500 }, true},
+		{"Extension over cap", func(r *BulkAdjustmentRequest) { r.AdjustmentType = "extend_period"; r.ExtendDays = 365 }, true},
+		{"Unknown type", func(r *BulkAdjustmentRequest) { r.AdjustmentType = "refund" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid
+			tt.modify(&req)
+			err := validateBulkAdjustment(req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBulkAdjustment_CreditPreviewAndApply(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "adjust-admin@example.com", "Adjust", "Admin")
+	planID := db.GetPlanID(t, "Fresh Start")
+
+	// Two affected subscribers, one of whose Stripe credit fails, and one with no Stripe customer
+	for i, email := range []string{"affected-a@example.com", "affected-b@example.com", "no-stripe@example.com"} {
+		userID := db.CreateTestUser(t, email, "Affected", "Subscriber")
+		if i < 2 {
+			db.Exec("UPDATE users SET stripe_customer_id = $1 WHERE id = $2", email, userID)
+		}
+		addressID := db.CreateTestAddress(t, userID)
+		db.CreateTestOrder(t, userID, addressID)
+		db.CreateTestSubscription(t, userID, planID)
+	}
+
+	// Subscribers with no orders in the window aren't affected
+	unaffectedID := db.CreateTestUser(t, "unaffected@example.com", "Unaffected", "Subscriber")
+	db.CreateTestSubscription(t, unaffectedID, planID)
+
+	credited := map[string]int{}
+	handler := NewSubscriptionAdjustmentHandler(db.DB)
+	handler.getUserID = func(r *http.Request, _ *sql.DB) (int, error) {
+		return adminID, nil
+	}
+	handler.creditCustomer = func(customerID string, amountCents int, description string, metadata map[string]string) (string, error) {
+		if customerID == "affected-b@example.com" {
+			return "", errors.New("card_declined")
+		}
+		credited[customerID] += amountCents
+		return "cbtxn_" + customerID, nil
+	}
+
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	adjustment := BulkAdjustmentRequest{
+		IncidentKey:    "facility-outage",
+		Reason:         "Facility outage",
+		Filter:         BulkAdjustmentFilter{AffectedFrom: tomorrow, AffectedTo: tomorrow},
+		AdjustmentType: "credit",
+		CreditAmount:   15,
+	}
+
+	body, _ := json.Marshal(adjustment)
+	req := httptest.NewRequest("POST", "/api/v1/admin/subscriptions/bulk-adjustments/preview", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	handler.handlePreviewBulkAdjustment(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var preview BulkAdjustmentPreview
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	if preview.AffectedSubscriptions != 3 || preview.Eligible != 2 || preview.TotalCredit != 30 {
+		t.Fatalf("Expected 3 affected, 2 eligible for $30, got %+v", preview)
+	}
+
+	// Applying with a stale count is refused
+	stale := 5
+	adjustment.ExpectedCount = &stale
+	body, _ = json.Marshal(adjustment)
+	req = httptest.NewRequest("POST", "/api/v1/admin/subscriptions/bulk-adjustments", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	handler.handleApplyBulkAdjustment(w, req)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d for a stale preview, got %d", http.StatusConflict, w.Code)
+	}
+
+	adjustment.ExpectedCount = &preview.Eligible
+	body, _ = json.Marshal(adjustment)
+	req = httptest.NewRequest("POST", "/api/v1/admin/subscriptions/bulk-adjustments", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	handler.handleApplyBulkAdjustment(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var batch SubscriptionAdjustmentBatch
+	json.Unmarshal(w.Body.Bytes(), &batch)
+	if batch.AppliedCount != 1 || batch.FailedCount != 2 || len(batch.Adjustments) != 3 {
+		t.Fatalf("Expected 1 applied and 2 failed, got %+v", batch)
+	}
+	if credited["affected-a@example.com"] != 1500 {
+		t.Errorf("Expected a $15.00 credit, got %v", credited)
+	}
+
+	// Re-running the incident only retries the failures
+	retryable := 1
+	adjustment.ExpectedCount = &retryable
+	body, _ = json.Marshal(adjustment)
+	req = httptest.NewRequest("POST", "/api/v1/admin/subscriptions/bulk-adjustments", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	handler.handleApplyBulkAdjustment(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &batch)
+	if batch.AppliedCount != 0 || batch.SkippedCount != 1 || credited["affected-a@example.com"] != 1500 {
+		t.Errorf("Expected the credited subscriber to be skipped, got %+v", batch)
+	}
+}
+
+func TestBulkAdjustment_ExtendPeriod(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "extend@example.com", "Extended", "Subscriber")
+	addressID := db.CreateTestAddress(t, userID)
+	db.CreateTestOrder(t, userID, addressID)
+	subscriptionID := db.CreateTestSubscription(t, userID, db.GetPlanID(t, "Fresh Start"))
+	db.Exec("UPDATE subscriptions SET stripe_subscription_id = 'sub_extend' WHERE id = $1", subscriptionID)
+
+	var before time.Time
+	db.QueryRow("SELECT current_period_end FROM subscriptions WHERE id = $1", subscriptionID).Scan(&before)
+
+	handler := NewSubscriptionAdjustmentHandler(db.DB)
+	handler.getUserID = func(r *http.Request, _ *sql.DB) (int, error) {
+		return userID, nil
+	}
+	extended := map[string]time.Time{}
+	handler.extendSubscription = func(subscriptionID string, newEnd time.Time, metadata map[string]string) error {
+		extended[subscriptionID] = newEnd
+		return nil
+	}
+
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	expected := 1
+	body, _ := json.Marshal(BulkAdjustmentRequest{
+		IncidentKey:    "storm-closure",
+		Reason:         "Storm closure",
+		Filter:         BulkAdjustmentFilter{AffectedFrom: tomorrow, AffectedTo: tomorrow},
+		AdjustmentType: "extend_period",
+		ExtendDays:     7,
+		ExpectedCount:  &expected,
+	})
+	req := httptest.NewRequest("POST", "/api/v1/admin/subscriptions/bulk-adjustments", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	handler.handleApplyBulkAdjustment(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	var after time.Time
+	db.QueryRow("SELECT current_period_end FROM subscriptions WHERE id = $1", subscriptionID).Scan(&after)
+	if !after.Equal(before.AddDate(0, 0, 7)) {
+		t.Errorf("Expected period end %s, got %s", before.AddDate(0, 0, 7).Format("2006-01-02"), after.Format("2006-01-02"))
+	}
+
+	// Stripe holds off the next invoice until the new period end
+	if !extended["sub_extend"].Equal(after) {
+		t.Errorf("Expected the Stripe subscription extended to %s, got %v", after.Format("2006-01-02"), extended)
+	}
+	var batch SubscriptionAdjustmentBatch
+	json.Unmarshal(w.Body.Bytes(), &batch)
+	if len(batch.Adjustments) != 1 || batch.Adjustments[0].StripeTrialEnd == nil {
+		t.Errorf("Expected the Stripe trial end in the batch log, got %+v", batch.Adjustments)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/invoice"
+	"github.com/stripe/stripe-go/v82/invoiceitem"
+)
+
+// Subscribers pay for pickups past their quota on each order by default, or
+// choose to have them added up and billed with the monthly invoice
+const (
+	overageBillingPerOrder  = "per_order"
+	overageBillingPeriodEnd = "period_end"
+)
+
+var errOveragesNotBillable = errors.New("overages can only be billed at period end on a paid Stripe subscription")
+
+// SubscriptionOverage is one over-quota pickup fee left for the invoice
+type SubscriptionOverage struct {
+	ID          int        `json:"id"`
+	OrderID     int        `json:"order_id"`
+	Amount      float64    `json:"amount"`
+	Description string     `json:"description"`
+	PeriodEnd   string     `json:"period_end"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	InvoicedAt  *time.Time `json:"invoiced_at,omitempty"`
+}
+
+// SubscriptionOverages is a subscriber's billing choice and the overage
+// charges still waiting for an invoice
+type SubscriptionOverages struct {
+	Billing      string                `json:"billing"`
+	Pending      []SubscriptionOverage `json:"pending"`
+	PendingTotal float64               `json:"pending_total"`
+}
+
+// recordSubscriptionOverage leaves a new order's over-quota fee for the
+// subscription's invoice
+func recordSubscriptionOverage(q execer, quota *SubscriptionQuota, userID, orderID, amountCents int) error {
+	_, err := q.Exec(`
+		INSERT INTO subscription_overages (subscription_id, user_id, order_id, amount_cents, description, period_end)
+		VALUES ($1, $2, $3, $4, $5, $6::date)`,
+		quota.Period.SubscriptionID, userID, orderID, amountCents,
+		fmt.Sprintf("Over-quota pickup for order #%d", orderID), quota.Period.End,
+	)
+	return err
+}
+
+// voidCancelledOverages drops pending overages whose orders were cancelled,
+// however they were cancelled, so they're never billed
+func voidCancelledOverages(q execer, subscriptionID int) error {
+	_, err := q.Exec(`
+		UPDATE subscription_overages so
+		SET status = 'voided', voided_at = CURRENT_TIMESTAMP
+		FROM orders o
+		WHERE so.order_id = o.id AND so.subscription_id = $1
+		  AND so.status = 'pending' AND o.status = 'cancelled'`,
+		subscriptionID,
+	)
+	return err
+}
+
+// billSubscriptionOverages adds the subscription's pending overages from
+// periods ending on or before through, or all of them when it's nil, to a
+// Stripe invoice. With no invoice ID they're left pending on the customer
+// for the next invoice created. Each overage is marked as it's added, and
+// Stripe is given an idempotency key so a retry after a crash doesn't bill
+// it twice.
+func billSubscriptionOverages(db *sql.DB, addItem func(*stripe.InvoiceItemParams) (*stripe.InvoiceItem, error),
+	stripeSubscriptionID, customerID, invoiceID string, through *time.Time) (int, error) {
+	var subscriptionID int
+	err := db.QueryRow("SELECT id FROM subscriptions WHERE stripe_subscription_id = $1", stripeSubscriptionID).Scan(&subscriptionID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := voidCancelledOverages(db, subscriptionID); err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT id, amount_cents, description FROM subscription_overages
+		WHERE subscription_id = $1 AND status = 'pending' AND ($2::date IS NULL OR period_end <= $2::date)
+		ORDER BY id`,
+		subscriptionID, through,
+	)
+	if err != nil {
+		return 0, err
+	}
+	type overage struct {
+		id, amountCents int
+		description     string
+	}
+	var overages []overage
+	for rows.Next() {
+		var o overage
+		if err := rows.Scan(&o.id, &o.amountCents, &o.description); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		overages = append(overages, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	billed := 0
+	for _, o := range overages {
+		params := &stripe.InvoiceItemParams{
+			Customer:    stripe.String(customerID),
+			Amount:      stripe.Int64(int64(o.amountCents)),
+			Currency:    stripe.String(string(stripe.CurrencyUSD)),
+			Description: stripe.String(o.description),
+			Metadata:    map[string]string{"subscription_overage_id": strconv.Itoa(o.id)},
+		}
+		if invoiceID != "" {
+			params.Invoice = stripe.String(invoiceID)
+		}
+		params.SetIdempotencyKey("subscription-overage-" + strconv.Itoa(o.id))
+		item, err := addItem(params)
+		if err != nil {
+			return billed, fmt.Errorf("failed to bill overage %d: %v", o.id, err)
+		}
+		_, err = db.Exec(`
+			UPDATE subscription_overages
+			SET status = 'invoiced', stripe_invoice_item_id = $1, stripe_invoice_id = NULLIF($2, ''), invoiced_at = CURRENT_TIMESTAMP
+			WHERE id = $3`,
+			item.ID, invoiceID, o.id,
+		)
+		if err != nil {
+			return billed, err
+		}
+		billed++
+	}
+	return billed, nil
+}
+
+// stripeInvoiceItemAdder returns how the handler adds invoice items, which
+// tests replace
+func (h *PaymentHandler) stripeInvoiceItemAdder() func(*stripe.InvoiceItemParams) (*stripe.InvoiceItem, error) {
+	if h.addInvoiceItem != nil {
+		return h.addInvoiceItem
+	}
+	return invoiceitem.New
+}
+
+// handleInvoiceCreated puts the ended period's overages on a renewal
+// invoice while it's still a draft
+func (h *PaymentHandler) handleInvoiceCreated(inv *stripe.Invoice) error {
+	if inv.BillingReason != stripe.InvoiceBillingReasonSubscriptionCycle || inv.Customer == nil || inv.Lines == nil {
+		return nil
+	}
+	for _, line := range inv.Lines.Data {
+		if line.Subscription == nil {
+			continue
+		}
+		start, _, ok := invoiceSubscriptionPeriod(inv, line.Subscription.ID)
+		if !ok {
+			return nil
+		}
+		_, err := billSubscriptionOverages(h.db, h.stripeInvoiceItemAdder(), line.Subscription.ID, inv.Customer.ID, inv.ID, &start)
+		return err
+	}
+	return nil
+}
+
+// billOveragesOnCancellation invoices whatever overages are left when a
+// subscription ends, as there's no renewal invoice to carry them
+func (h *PaymentHandler) billOveragesOnCancellation(sub *stripe.Subscription) error {
+	if sub.Customer == nil {
+		return nil
+	}
+	if _, err := billSubscriptionOverages(h.db, h.stripeInvoiceItemAdder(), sub.ID, sub.Customer.ID, "", nil); err != nil {
+		return err
+	}
+
+	// Items added but not yet invoiced, including any from a retried event
+	var unbilled int
+	err := h.db.QueryRow(`
+		SELECT COUNT(*) FROM subscription_overages so
+		JOIN subscriptions s ON so.subscription_id = s.id
+		WHERE s.stripe_subscription_id = $1 AND so.status = 'invoiced' AND so.stripe_invoice_id IS NULL`,
+		sub.ID,
+	).Scan(&unbilled)
+	if err != nil || unbilled == 0 {
+		return err
+	}
+	createInvoice := h.createInvoice
+	if createInvoice == nil {
+		createInvoice = invoice.New
+	}
+	params := &stripe.InvoiceParams{
+		Customer:                    stripe.String(sub.Customer.ID),
+		AutoAdvance:                 stripe.Bool(true),
+		PendingInvoiceItemsBehavior: stripe.String("include"),
+		Description:                 stripe.String("Over-quota pickups from your cancelled subscription"),
+	}
+	params.SetIdempotencyKey("subscription-overages-final-" + sub.ID)
+	inv, err := createInvoice(params)
+	if err != nil {
+		return fmt.Errorf("failed to invoice overages for %s: %v", sub.ID, err)
+	}
+	_, err = h.db.Exec(`
+		UPDATE subscription_overages so
+		SET stripe_invoice_id = $1
+		FROM subscriptions s
+		WHERE so.subscription_id = s.id AND s.stripe_subscription_id = $2
+		  AND so.status = 'invoiced' AND so.stripe_invoice_id IS NULL`,
+		inv.ID, sub.ID,
+	)
+	return err
+}
+
+// handleGetSubscriptionOverages shows how the subscriber pays for pickups
+// past their quota and the charges waiting for the next invoice
+func (h *SubscriptionHandler) handleGetSubscriptionOverages(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var subscriptionID int
+	overages := SubscriptionOverages{Pending: []SubscriptionOverage{}}
+	err = h.db.QueryRow(`
+		SELECT id, overage_billing FROM subscriptions
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+		LIMIT 1`,
+		userID,
+	).Scan(&subscriptionID, &overages.Billing)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No subscription found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch overages", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT so.id, so.order_id, so.amount_cents, so.description, so.period_end::text, so.status, so.created_at, so.invoiced_at
+		FROM subscription_overages so
+		JOIN orders o ON so.order_id = o.id
+		WHERE so.subscription_id = $1 AND so.status = 'pending' AND o.status <> 'cancelled'
+		ORDER BY so.created_at`,
+		subscriptionID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch overages", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	totalCents := 0
+	for rows.Next() {
+		var o SubscriptionOverage
+		var amountCents int
+		if err := rows.Scan(&o.ID, &o.OrderID, &amountCents, &o.Description, &o.PeriodEnd, &o.Status, &o.CreatedAt, &o.InvoicedAt); err != nil {
+			http.Error(w, "Failed to fetch overages", http.StatusInternalServerError)
+			return
+		}
+		o.Amount = centsToDollars(amountCents)
+		totalCents += amountCents
+		overages.Pending = append(overages.Pending, o)
+	}
+	overages.PendingTotal = centsToDollars(totalCents)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(overages)
+}
+
+// handleUpdateSubscriptionOverages switches between paying over-quota fees
+// on each order and on the monthly invoice. The switch applies to orders
+// placed from now on.
+func (h *SubscriptionHandler) handleUpdateSubscriptionOverages(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Billing string `json:"billing"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Billing != overageBillingPerOrder && req.Billing != overageBillingPeriodEnd {
+		http.Error(w, "billing must be per_order or period_end", http.StatusBadRequest)
+		return
+	}
+
+	var subscriptionID int
+	var stripeSubscriptionID sql.NullString
+	err = h.db.QueryRow(`
+		SELECT id, stripe_subscription_id FROM subscriptions
+		WHERE user_id = $1 AND status = 'active'
+		ORDER BY created_at DESC
+		LIMIT 1`,
+		userID,
+	).Scan(&subscriptionID, &stripeSubscriptionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No active subscription found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update overage billing", http.StatusInternalServerError)
+		return
+	}
+	// Overages go on the Stripe invoice, so there has to be one
+	if req.Billing == overageBillingPeriodEnd && stripeSubscriptionID.String == "" {
+		http.Error(w, errOveragesNotBillable.Error(), http.StatusConflict)
+		return
+	}
+
+	if _, err := h.db.Exec(
+		"UPDATE subscriptions SET overage_billing = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		req.Billing, subscriptionID,
+	); err != nil {
+		http.Error(w, "Failed to update overage billing", http.StatusInternalServerError)
+		return
+	}
+
+	h.handleGetSubscriptionOverages(w, r)
+}
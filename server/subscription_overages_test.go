@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+func TestSubscriptionOverages(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "overages@example.com", "Over", "Quota")
+	addressID := db.CreateTestAddress(t, userID)
+	subscriptionID := db.CreateTestSubscription(t, userID, db.GetPlanID(t, "Family Fresh"))
+	db.Exec(`
+		UPDATE subscriptions SET current_period_start = '2024-03-01', current_period_end = '2024-04-01'
+		WHERE id = $1`, subscriptionID)
+
+	handler := &SubscriptionHandler{db: db.DB, getUserID: CreateAuthMock(userID).getUserIDFromRequest}
+	setBilling := func(billing string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.handleUpdateSubscriptionOverages(w, httptest.NewRequest("PUT", "/api/v1/subscriptions/overages", strings.NewReader(`{"billing": "`+billing+`"}`)))
+		return w
+	}
+	// Without a Stripe subscription there's no invoice to bill them on
+	if w := setBilling(overageBillingPeriodEnd); w.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+	db.Exec("UPDATE subscriptions SET stripe_subscription_id = 'sub_overages' WHERE id = $1", subscriptionID)
+	if w := setBilling(overageBillingPeriodEnd); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	quota := &SubscriptionQuota{Period: SubscriptionPeriod{SubscriptionID: subscriptionID, End: "2024-04-01"}}
+	billedOrder := db.CreateTestOrder(t, userID, addressID)
+	cancelledOrder := db.CreateTestOrder(t, userID, addressID)
+	for _, orderID := range []int{billedOrder, cancelledOrder} {
+		if err := recordSubscriptionOverage(db.DB, quota, userID, orderID, overQuotaPickupFeeCents); err != nil {
+			t.Fatalf("Failed to record overage: %v", err)
+		}
+	}
+	db.Exec("UPDATE orders SET status = 'cancelled' WHERE id = $1", cancelledOrder)
+
+	w := httptest.NewRecorder()
+	handler.handleGetSubscriptionOverages(w, httptest.NewRequest("GET", "/api/v1/subscriptions/overages", nil))
+	var overages SubscriptionOverages
+	json.Unmarshal(w.Body.Bytes(), &overages)
+	if overages.Billing != overageBillingPeriodEnd || len(overages.Pending) != 1 || overages.PendingTotal != 10 {
+		t.Fatalf("Expected one $10 overage pending, got %+v", overages)
+	}
+
+	// The renewal invoice for the next period picks it up
+	var added []*stripe.InvoiceItemParams
+	payments := &PaymentHandler{db: db.DB, addInvoiceItem: func(params *stripe.InvoiceItemParams) (*stripe.InvoiceItem, error) {
+		added = append(added, params)
+		return &stripe.InvoiceItem{ID: "ii_1"}, nil
+	}}
+	renewal := &stripe.Invoice{
+		ID:            "in_renewal",
+		BillingReason: stripe.InvoiceBillingReasonSubscriptionCycle,
+		Customer:      &stripe.Customer{ID: "cus_overages"},
+		Lines: &stripe.InvoiceLineItemList{Data: []*stripe.InvoiceLineItem{{
+			Subscription: &stripe.Subscription{ID: "sub_overages"},
+			Period: &stripe.Period{
+				Start: time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC).Unix(),
+				End:   time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC).Unix(),
+			},
+		}}},
+	}
+	for i := 0; i < 2; i++ {
+		if err := payments.handleInvoiceCreated(renewal); err != nil {
+			t.Fatalf("Failed to bill overages: %v", err)
+		}
+	}
+	if len(added) != 1 || *added[0].Amount != overQuotaPickupFeeCents || *added[0].Invoice != "in_renewal" {
+		t.Fatalf("Expected the overage added to the renewal invoice once, got %d items", len(added))
+	}
+
+	var billed, voided string
+	db.QueryRow("SELECT status FROM subscription_overages WHERE order_id = $1", billedOrder).Scan(&billed)
+	db.QueryRow("SELECT status FROM subscription_overages WHERE order_id = $1", cancelledOrder).Scan(&voided)
+	if billed != "invoiced" || voided != "voided" {
+		t.Errorf("Expected the overage invoiced and the cancelled order's voided, got %s and %s", billed, voided)
+	}
+}
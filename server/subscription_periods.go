@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/subscription"
+)
+
+// stripeSubscriptionPeriod returns the billing period Stripe has for a
+// subscription. Stripe keeps periods on the subscription's items; ours have
+// one item, and with more the earliest start and latest end are taken.
+func stripeSubscriptionPeriod(sub *stripe.Subscription) (start, end time.Time, ok bool) {
+	if sub == nil || sub.Items == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	var startUnix, endUnix int64
+	for _, item := range sub.Items.Data {
+		if item == nil || item.CurrentPeriodStart == 0 || item.CurrentPeriodEnd == 0 {
+			continue
+		}
+		if startUnix == 0 || item.CurrentPeriodStart < startUnix {
+			startUnix = item.CurrentPeriodStart
+		}
+		if item.CurrentPeriodEnd > endUnix {
+			endUnix = item.CurrentPeriodEnd
+		}
+	}
+	if startUnix == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	return time.Unix(startUnix, 0).UTC(), time.Unix(endUnix, 0).UTC(), true
+}
+
+// invoiceSubscriptionPeriod returns the period a subscription's create or
+// renewal invoice paid for. Other invoices, such as mid-period prorations,
+// don't cover a whole period and aren't used.
+func invoiceSubscriptionPeriod(invoice *stripe.Invoice, stripeSubscriptionID string) (start, end time.Time, ok bool) {
+	if invoice.BillingReason != stripe.InvoiceBillingReasonSubscriptionCreate &&
+		invoice.BillingReason != stripe.InvoiceBillingReasonSubscriptionCycle {
+		return time.Time{}, time.Time{}, false
+	}
+	if invoice.Lines == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	var startUnix, endUnix int64
+	for _, line := range invoice.Lines.Data {
+		if line.Subscription == nil || line.Subscription.ID != stripeSubscriptionID || line.Period == nil || line.Period.Start == 0 {
+			continue
+		}
+		if startUnix == 0 || line.Period.Start < startUnix {
+			startUnix = line.Period.Start
+		}
+		if line.Period.End > endUnix {
+			endUnix = line.Period.End
+		}
+	}
+	if startUnix == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	return time.Unix(startUnix, 0).UTC(), time.Unix(endUnix, 0).UTC(), true
+}
+
+// syncSubscriptionPeriod stores Stripe's period boundaries on the local
+// subscription and reports whether they changed. An end pushed out by an
+// extend_period adjustment is kept while the period it extended is current.
+func syncSubscriptionPeriod(q execer, stripeSubscriptionID string, start, end time.Time) (bool, error) {
+	res, err := q.Exec(`
+		UPDATE subscriptions
+		SET current_period_start = $1::date,
+		    current_period_end = CASE WHEN current_period_start = $1::date
+		                              THEN GREATEST(current_period_end, $2::date) ELSE $2::date END,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE stripe_subscription_id = $3
+		  AND (current_period_start <> $1::date OR current_period_end < $2::date)`,
+		start.Format("2006-01-02"), end.Format("2006-01-02"), stripeSubscriptionID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// syncSubscriptionPeriods re-reads every active Stripe subscription and
+// corrects local periods that have drifted. One subscription failing to
+// load doesn't stop the rest.
+func syncSubscriptionPeriods(db *sql.DB, get func(id string) (*stripe.Subscription, error)) (synced, failed int, err error) {
+	rows, err := db.Query(`
+		SELECT stripe_subscription_id FROM subscriptions
+		WHERE status = 'active' AND COALESCE(stripe_subscription_id, '') <> ''
+		ORDER BY id`)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, id := range ids {
+		sub, err := get(id)
+		if err != nil {
+			log.Printf("Failed to fetch Stripe subscription %s for period sync: %v", id, err)
+			failed++
+			continue
+		}
+		start, end, ok := stripeSubscriptionPeriod(sub)
+		if !ok {
+			continue
+		}
+		changed, err := syncSubscriptionPeriod(db, id, start, end)
+		if err != nil {
+			return synced, failed, fmt.Errorf("failed to sync period of %s: %v", id, err)
+		}
+		if changed {
+			synced++
+		}
+	}
+	return synced, failed, nil
+}
+
+// processSubscriptionPeriodSync catches periods the webhooks missed
+func (s *AutoScheduler) processSubscriptionPeriodSync() {
+	synced, failed, err := syncSubscriptionPeriods(s.db, func(id string) (*stripe.Subscription, error) {
+		return subscription.Get(id, nil)
+	})
+	if err != nil {
+		log.Printf("Error syncing subscription periods: %v", err)
+		return
+	}
+	if synced > 0 || failed > 0 {
+		log.Printf("Subscription period sync corrected %d subscriptions, %d couldn't be fetched", synced, failed)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+func TestInvoiceSubscriptionPeriod(t *testing.T) {
+	periodStart := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	periodEnd := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	invoice := &stripe.Invoice{
+		BillingReason: stripe.InvoiceBillingReasonSubscriptionCycle,
+		Lines: &stripe.InvoiceLineItemList{Data: []*stripe.InvoiceLineItem{
+			{Subscription: &stripe.Subscription{ID: "sub_other"}, Period: &stripe.Period{Start: 1, End: 2}},
+			{Subscription: &stripe.Subscription{ID: "sub_1"}, Period: &stripe.Period{Start: periodStart.Unix(), End: periodEnd.Unix()}},
+		}},
+	}
+	start, end, ok := invoiceSubscriptionPeriod(invoice, "sub_1")
+	if !ok || !start.Equal(periodStart) || !end.Equal(periodEnd) {
+		t.Errorf("Expected %v to %v, got %v to %v (%v)", periodStart, periodEnd, start, end, ok)
+	}
+
+	// A mid-period proration invoice doesn't cover the whole period
+	invoice.BillingReason = stripe.InvoiceBillingReasonSubscriptionUpdate
+	if _, _, ok := invoiceSubscriptionPeriod(invoice, "sub_1"); ok {
+		t.Error("Expected a proration invoice to be ignored")
+	}
+}
+
+func TestSyncSubscriptionPeriods(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	planID := db.GetPlanID(t, "Family Fresh")
+	driftedUser := db.CreateTestUser(t, "drifted@example.com", "Drifted", "Subscriber")
+	drifted := db.CreateTestSubscription(t, driftedUser, planID)
+	extendedUser := db.CreateTestUser(t, "extended@example.com", "Extended", "Subscriber")
+	extended := db.CreateTestSubscription(t, extendedUser, planID)
+	missingUser := db.CreateTestUser(t, "missing@example.com", "Missing", "Subscriber")
+	missing := db.CreateTestSubscription(t, missingUser, planID)
+	db.Exec("UPDATE subscriptions SET stripe_subscription_id = 'sub_drifted', current_period_start = '2024-01-05', current_period_end = '2024-02-05' WHERE id = $1", drifted)
+	// An incident extension pushed this period's end out by a week
+	db.Exec("UPDATE subscriptions SET stripe_subscription_id = 'sub_extended', current_period_start = '2024-03-01', current_period_end = '2024-04-08' WHERE id = $1", extended)
+	db.Exec("UPDATE subscriptions SET stripe_subscription_id = 'sub_missing' WHERE id = $1", missing)
+
+	stripeSub := func(id string, start, end string) *stripe.Subscription {
+		s, _ := time.Parse("2006-01-02", start)
+		e, _ := time.Parse("2006-01-02", end)
+		return &stripe.Subscription{ID: id, Items: &stripe.SubscriptionItemList{Data: []*stripe.SubscriptionItem{
+			{CurrentPeriodStart: s.Unix(), CurrentPeriodEnd: e.Unix()},
+		}}}
+	}
+	stripeSubs := map[string]*stripe.Subscription{
+		"sub_drifted":  stripeSub("sub_drifted", "2024-03-05", "2024-04-05"),
+		"sub_extended": stripeSub("sub_extended", "2024-03-01", "2024-04-01"),
+	}
+	synced, failed, err := syncSubscriptionPeriods(db.DB, func(id string) (*stripe.Subscription, error) {
+		if sub, ok := stripeSubs[id]; ok {
+			return sub, nil
+		}
+		return nil, errors.New("no such subscription")
+	})
+	if err != nil || synced != 1 || failed != 1 {
+		t.Fatalf("Expected one subscription synced and one failure, got %d, %d, %v", synced, failed, err)
+	}
+
+	period := func(id int) string {
+		var start, end string
+		db.QueryRow("SELECT current_period_start::text, current_period_end::text FROM subscriptions WHERE id = $1", id).Scan(&start, &end)
+		return start + " to " + end
+	}
+	if got := period(drifted); got != "2024-03-05 to 2024-04-05" {
+		t.Errorf("Expected the drifted period to follow Stripe, got %s", got)
+	}
+	if got := period(extended); got != "2024-03-01 to 2024-04-08" {
+		t.Errorf("Expected the extension kept, got %s", got)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// SubscriptionCharge is the next amount a subscription will bill
+type SubscriptionCharge struct {
+	Date     string  `json:"date"`
+	Amount   float64 `json:"amount"`
+	PlanID   int     `json:"plan_id"`
+	PlanName string  `json:"plan_name"`
+	// PlanChange is set when a scheduled plan change takes effect at this renewal
+	PlanChange bool `json:"plan_change"`
+}
+
+// SubscriptionPause is one stretch of time a subscription was paused
+type SubscriptionPause struct {
+	PausedAt  time.Time  `json:"paused_at"`
+	ResumedAt *time.Time `json:"resumed_at,omitempty"` // nil while still paused
+}
+
+// parseSubscriptionDate reads a period date, which comes back from the
+// database as a full timestamp
+func parseSubscriptionDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// subscriptionRenewal works out when a subscription next renews and when a
+// pending cancellation takes effect. Cancelled subscriptions stay active until
+// the end of the period unless Stripe says otherwise; paused ones don't renew.
+func subscriptionRenewal(status string, periodEnd time.Time, cancelAt *time.Time) (renewal, cancellation *time.Time) {
+	if cancelAt != nil {
+		return nil, cancelAt
+	}
+	switch status {
+	case "cancelled":
+		return nil, &periodEnd
+	case "active":
+		return &periodEnd, nil
+	}
+	return nil, nil
+}
+
+// stripeCancelAt returns when Stripe will end, or ended, a subscription, and
+// the end of its current period
+func stripeCancelAt(sub *stripe.Subscription) (cancelAt *time.Time, periodEnd *time.Time) {
+	if sub.Items != nil && len(sub.Items.Data) > 0 && sub.Items.Data[0].CurrentPeriodEnd > 0 {
+		end := time.Unix(sub.Items.Data[0].CurrentPeriodEnd, 0).UTC()
+		periodEnd = &end
+	}
+	switch {
+	case sub.EndedAt > 0:
+		ended := time.Unix(sub.EndedAt, 0).UTC()
+		cancelAt = &ended
+	case sub.CancelAt > 0:
+		at := time.Unix(sub.CancelAt, 0).UTC()
+		cancelAt = &at
+	case sub.CancelAtPeriodEnd && periodEnd != nil:
+		cancelAt = periodEnd
+	}
+	return cancelAt, periodEnd
+}
+
+// getSubscriptionPauses lists a subscription's pauses, most recent first
+func getSubscriptionPauses(db *sql.DB, subscriptionID int) ([]SubscriptionPause, error) {
+	rows, err := db.Query(`
+		SELECT paused_at, resumed_at FROM subscription_pauses
+		WHERE subscription_id = $1
+		ORDER BY paused_at DESC`,
+		subscriptionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pauses := []SubscriptionPause{}
+	for rows.Next() {
+		var pause SubscriptionPause
+		var resumedAt sql.NullTime
+		if err := rows.Scan(&pause.PausedAt, &resumedAt); err != nil {
+			return nil, err
+		}
+		if resumedAt.Valid {
+			pause.ResumedAt = &resumedAt.Time
+		}
+		pauses = append(pauses, pause)
+	}
+	return pauses, rows.Err()
+}
+
+// recordSubscriptionStatusChange opens a pause when a subscription is paused
+// and closes it when the subscription is resumed or cancelled
+func recordSubscriptionStatusChange(db execer, subscriptionID int, from, to string) error {
+	if to == "paused" && from != "paused" {
+		_, err := db.Exec("INSERT INTO subscription_pauses (subscription_id) VALUES ($1)", subscriptionID)
+		return err
+	}
+	if from == "paused" && to != "paused" {
+		_, err := db.Exec(`
+			UPDATE subscription_pauses SET resumed_at = CURRENT_TIMESTAMP
+			WHERE subscription_id = $1 AND resumed_at IS NULL`,
+			subscriptionID,
+		)
+		return err
+	}
+	return nil
+}
+
+// addRenewalInfo fills in the renewal date, next charge, cancellation date and
+// pause history on a subscription. Stripe is the source of truth for billing
+// dates when the subscription is billed there; the local period is used
+// otherwise or when Stripe can't be reached.
+func (h *SubscriptionHandler) addRenewalInfo(sub *Subscription) error {
+	periodEnd, err := parseSubscriptionDate(sub.CurrentPeriodEnd)
+	if err != nil {
+		return err
+	}
+
+	var cancelAt *time.Time
+	if sub.StripeSubscriptionID != nil && *sub.StripeSubscriptionID != "" && h.getStripeSubscription != nil {
+		stripeSub, err := h.getStripeSubscription(*sub.StripeSubscriptionID)
+		if err != nil {
+			log.Printf("Failed to fetch Stripe subscription %s for renewal info: %v", *sub.StripeSubscriptionID, err)
+		} else {
+			var stripePeriodEnd *time.Time
+			cancelAt, stripePeriodEnd = stripeCancelAt(stripeSub)
+			if stripePeriodEnd != nil {
+				periodEnd = *stripePeriodEnd
+			}
+		}
+	}
+
+	renewal, cancellation := subscriptionRenewal(sub.Status, periodEnd, cancelAt)
+	if cancellation != nil {
+		date := cancellation.Format("2006-01-02")
+		sub.CancellationEffectiveDate = &date
+	}
+	if renewal != nil && sub.Plan != nil {
+		date := renewal.Format("2006-01-02")
+		sub.RenewalDate = &date
+		charge := &SubscriptionCharge{
+			Date:     date,
+			Amount:   sub.Plan.PricePerMonth,
+			PlanID:   sub.Plan.ID,
+			PlanName: sub.Plan.Name,
+		}
+		// The first charge after a trial is at the intro price
+		if sub.OnTrial && sub.IntroPrice != nil {
+			charge.Amount = *sub.IntroPrice
+		}
+
+		// A scheduled plan migration switches the plan at this renewal
+		var toPlanID, toPriceCents int
+		var toPlanName string
+		err := h.db.QueryRow(`
+			SELECT tp.id, tp.name, tp.price_per_month_cents
+			FROM plan_migration_subscribers pms
+			JOIN plan_migrations pm ON pms.migration_id = pm.id
+			JOIN subscription_plans tp ON pm.to_plan_id = tp.id
+			WHERE pms.subscription_id = $1 AND pm.status = 'scheduled'
+			  AND pms.status IN ('pending', 'notified') AND pms.renewal_date <= $2
+			ORDER BY pms.renewal_date
+			LIMIT 1`,
+			sub.ID, date,
+		).Scan(&toPlanID, &toPlanName, &toPriceCents)
+		if err == nil {
+			charge.Amount = centsToDollars(toPriceCents)
+			charge.PlanID, charge.PlanName, charge.PlanChange = toPlanID, toPlanName, true
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+		sub.NextCharge = charge
+	}
+
+	sub.PauseHistory, err = getSubscriptionPauses(h.db, sub.ID)
+	return err
+}
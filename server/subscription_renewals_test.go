@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stripe/stripe-go/v82"
+)
+
+func TestSubscriptionRenewal(t *testing.T) {
+	periodEnd := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	stripeCancel := time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name                 string
+		status               string
+		cancelAt             *time.Time
+		expectedRenewal      *time.Time
+		expectedCancellation *time.Time
+	}{
+		{"Active renews at period end", "active", nil, &periodEnd, nil},
+		{"Cancelled runs to period end", "cancelled", nil, nil, &periodEnd},
+		{"Paused doesn't renew", "paused", nil, nil, nil},
+		{"Stripe cancellation date wins", "active", &stripeCancel, nil, &stripeCancel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renewal, cancellation := subscriptionRenewal(tt.status, periodEnd, tt.cancelAt)
+			if fmt.Sprint(renewal) != fmt.Sprint(tt.expectedRenewal) {
+				t.Errorf("renewal = %v, expected %v", renewal, tt.expectedRenewal)
+			}
+			if fmt.Sprint(cancellation) != fmt.Sprint(tt.expectedCancellation) {
+				t.Errorf("cancellation = %v, expected %v", cancellation, tt.expectedCancellation)
+			}
+		})
+	}
+}
+
+func TestStripeCancelAt(t *testing.T) {
+	periodEnd := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	sub := &stripe.Subscription{
+		CancelAtPeriodEnd: true,
+		Items: &stripe.SubscriptionItemList{Data: []*stripe.SubscriptionItem{
+			{CurrentPeriodEnd: periodEnd.Unix()},
+		}},
+	}
+	cancelAt, end := stripeCancelAt(sub)
+	if end == nil || !end.Equal(periodEnd) || cancelAt == nil || !cancelAt.Equal(periodEnd) {
+		t.Errorf("Expected cancellation at period end %s, got %v (period end %v)", periodEnd, cancelAt, end)
+	}
+
+	sub.CancelAtPeriodEnd = false
+	if cancelAt, _ := stripeCancelAt(sub); cancelAt != nil {
+		t.Errorf("Expected no cancellation, got %v", cancelAt)
+	}
+}
+
+func TestParseSubscriptionDate(t *testing.T) {
+	for _, value := range []string{"2026-11-01T00:00:00Z", "2026-11-01"} {
+		got, err := parseSubscriptionDate(value)
+		if err != nil || got.Format("2006-01-02") != "2026-11-01" {
+			t.Errorf("parseSubscriptionDate(%q) = %v, %v", value, got, err)
+		}
+	}
+}
+
+func TestSubscription_RenewalInfoAndPauseHistory(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+	defer db.Exec("DELETE FROM plan_migrations")
+
+	userID := db.CreateTestUser(t, "renewal@example.com", "Renewal", "Info")
+	planID := db.GetPlanID(t, "Fresh Start")
+	subscriptionID := db.CreateTestSubscription(t, userID, planID)
+
+	handler := &SubscriptionHandler{
+		db:        db.DB,
+		getUserID: func(r *http.Request, db *sql.DB) (int, error) { return userID, nil },
+	}
+	current := func() Subscription {
+		w := httptest.NewRecorder()
+		handler.handleGetSubscription(w, httptest.NewRequest("GET", "/api/v1/subscriptions/current", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var sub Subscription
+		json.Unmarshal(w.Body.Bytes(), &sub)
+		return sub
+	}
+	setStatus := func(status string) {
+		body, _ := json.Marshal(UpdateSubscriptionRequest{Status: status})
+		req := mux.SetURLVars(httptest.NewRequest("PUT", "/api/v1/subscriptions/x", bytes.NewBuffer(body)),
+			map[string]string{"id": fmt.Sprint(subscriptionID)})
+		w := httptest.NewRecorder()
+		handler.handleUpdateSubscription(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to set status %s: %d %s", status, w.Code, w.Body.String())
+		}
+	}
+
+	sub := current()
+	if sub.RenewalDate == nil || sub.NextCharge == nil || sub.NextCharge.PlanChange || sub.CancellationEffectiveDate != nil {
+		t.Fatalf("Expected an upcoming renewal on the current plan, got %+v", sub)
+	}
+	if sub.NextCharge.Amount != sub.Plan.PricePerMonth || sub.NextCharge.Date != *sub.RenewalDate {
+		t.Errorf("Unexpected next charge %+v", sub.NextCharge)
+	}
+	renewalDate := *sub.RenewalDate
+
+	// A scheduled plan migration changes the next charge
+	newPlanID := db.GetPlanID(t, "Family Fresh")
+	var migrationID int
+	db.QueryRow("INSERT INTO plan_migrations (from_plan_id, to_plan_id) VALUES ($1, $2) RETURNING id", planID, newPlanID).Scan(&migrationID)
+	db.Exec(`
+		INSERT INTO plan_migration_subscribers (migration_id, subscription_id, user_id, renewal_date)
+		VALUES ($1, $2, $3, $4)`,
+		migrationID, subscriptionID, userID, renewalDate,
+	)
+	if sub := current(); sub.NextCharge == nil || !sub.NextCharge.PlanChange || sub.NextCharge.PlanID != newPlanID || sub.NextCharge.Amount != 130 {
+		t.Errorf("Expected the next charge on the new plan, got %+v", sub.NextCharge)
+	}
+
+	// Pausing stops the renewal and starts the pause history
+	setStatus("paused")
+	sub = current()
+	if sub.RenewalDate != nil || sub.NextCharge != nil {
+		t.Errorf("Expected no renewal while paused, got %+v", sub)
+	}
+	if len(sub.PauseHistory) != 1 || sub.PauseHistory[0].ResumedAt != nil {
+		t.Errorf("Expected one open pause, got %+v", sub.PauseHistory)
+	}
+	setStatus("active")
+	if sub := current(); len(sub.PauseHistory) != 1 || sub.PauseHistory[0].ResumedAt == nil || sub.RenewalDate == nil {
+		t.Errorf("Expected the pause closed and renewal back, got %+v", sub)
+	}
+
+	// Stripe's cancellation date is reported when the subscription is billed there
+	db.Exec("UPDATE subscriptions SET stripe_subscription_id = 'sub_renewal' WHERE id = $1", subscriptionID)
+	cancelAt := time.Date(2030, 1, 15, 0, 0, 0, 0, time.UTC)
+	handler.getStripeSubscription = func(id string) (*stripe.Subscription, error) {
+		return &stripe.Subscription{ID: id, CancelAt: cancelAt.Unix()}, nil
+	}
+	if sub := current(); sub.CancellationEffectiveDate == nil || *sub.CancellationEffectiveDate != "2030-01-15" || sub.RenewalDate != nil {
+		t.Errorf("Expected Stripe's cancellation date, got %+v", sub)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SubscriptionService is the subscription operations handlers and other
+// surfaces share
+type SubscriptionService struct {
+	db     *sql.DB
+	quotas *QuotaService
+}
+
+func NewSubscriptionService(db *sql.DB, quotas *QuotaService) *SubscriptionService {
+	return &SubscriptionService{db: db, quotas: quotas}
+}
+
+// subscriptions returns the service behind the handler's subscription
+// operations
+func (h *SubscriptionHandler) subscriptions() *SubscriptionService {
+	return NewSubscriptionService(h.db, h.quotas())
+}
+
+// SubscriptionUsage is what a subscriber has used of their current period
+type SubscriptionUsage struct {
+	SubscriptionID     int    `json:"subscription_id"`
+	CurrentPeriodStart string `json:"current_period_start"`
+	CurrentPeriodEnd   string `json:"current_period_end"`
+	PickupsUsed        int    `json:"pickups_used"`
+	PickupsAllowed     int    `json:"pickups_allowed"`
+	PickupsRemaining   int    `json:"pickups_remaining"`
+	BagsUsed           int    `json:"bags_used"`
+	BagsAllowed        int    `json:"bags_allowed"`
+	BagsRemaining      int    `json:"bags_remaining"`
+	// Projection is left out when the period's dates can't be read
+	Projection *UsageProjection `json:"projection,omitempty"`
+}
+
+// Usage reports a customer's usage of their latest subscription, whatever
+// its status, and where it's heading by the end of the period
+func (s *SubscriptionService) Usage(ctx context.Context, userID int) (*SubscriptionUsage, error) {
+	quota, err := s.quotas.Quota(ctx, userID, false)
+	if err != nil {
+		return nil, err
+	}
+	if quota == nil {
+		return nil, serviceError(ErrNotFound, "No subscription found")
+	}
+	usage := &SubscriptionUsage{
+		SubscriptionID:     quota.Period.SubscriptionID,
+		CurrentPeriodStart: quota.Period.Start,
+		CurrentPeriodEnd:   quota.Period.End,
+		PickupsUsed:        quota.PickupsUsed,
+		PickupsAllowed:     quota.Period.PickupsPerMonth,
+		PickupsRemaining:   quota.PickupsRemaining(),
+		BagsUsed:           quota.BagsUsed,
+		BagsAllowed:        quota.BagsAllowed(),
+		BagsRemaining:      quota.BagsRemaining(),
+	}
+
+	// Project end-of-period usage so the UI can warn before the quota runs out
+	periodStart, startErr := parsePeriodDate(quota.Period.Start)
+	periodEnd, endErr := parsePeriodDate(quota.Period.End)
+	if startErr == nil && endErr == nil {
+		projection := projectUsage(quota.PickupsUsed, usage.PickupsAllowed, periodStart, periodEnd, time.Now().UTC())
+		if projection.OnPaceToExceed || projection.ShouldAlert {
+			projection.UpgradePlan, _ = findUpgradePlan(s.db, usage.PickupsAllowed, projection.ProjectedUsage)
+		}
+		usage.Projection = &projection
+	}
+	return usage, nil
+}
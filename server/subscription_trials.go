@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"tumble-backend/money"
+
+	"github.com/gorilla/mux"
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/coupon"
+	"github.com/stripe/stripe-go/v82/subscription"
+)
+
+const (
+	maxPlanTrialDays = 90
+	// Trial reminders go out, and the intro discount is attached in Stripe,
+	// this many days before the trial ends
+	trialReminderDays           = 3
+	trialEndingNotificationType = "trial_ending"
+)
+
+// PlanOfferHandler manages plan trial and intro pricing offers and reports how
+// well trials convert
+type PlanOfferHandler struct {
+	db *sql.DB
+}
+
+func NewPlanOfferHandler(db *sql.DB) *PlanOfferHandler {
+	return &PlanOfferHandler{db: db}
+}
+
+// PlanOffer is what a new subscriber gets when they start a plan: free trial
+// days, then an optional discounted first paid month
+type PlanOffer struct {
+	TrialDays       int
+	IntroPriceCents *int
+}
+
+// trialEnd is the date the trial ends, or nil without a trial
+func (o PlanOffer) trialEnd(now time.Time) *time.Time {
+	if o.TrialDays <= 0 {
+		return nil
+	}
+	end := now.AddDate(0, 0, o.TrialDays)
+	return &end
+}
+
+// periodEnd is the end of the first period: the trial, or a paid month
+func (o PlanOffer) periodEnd(now time.Time) time.Time {
+	if end := o.trialEnd(now); end != nil {
+		return *end
+	}
+	return now.AddDate(0, 1, 0)
+}
+
+// planOfferFor returns the plan's offer for a user. Offers are for new
+// customers, so anyone who has subscribed before starts at full price.
+func planOfferFor(q queryRower, userID, planID int) (PlanOffer, error) {
+	var offer PlanOffer
+	var introCents sql.NullInt64
+	var subscribedBefore bool
+	err := q.QueryRow(`
+		SELECT p.trial_days, p.intro_price_cents,
+		       EXISTS(SELECT 1 FROM subscriptions WHERE user_id = $1)
+		FROM subscription_plans p WHERE p.id = $2`,
+		userID, planID,
+	).Scan(&offer.TrialDays, &introCents, &subscribedBefore)
+	if err != nil || subscribedBefore {
+		return PlanOffer{}, err
+	}
+	if introCents.Valid {
+		cents := int(introCents.Int64)
+		offer.IntroPriceCents = &cents
+	}
+	return offer, nil
+}
+
+// newIntroCoupon creates the one-off Stripe coupon that brings the first paid
+// month down to the intro price
+func newIntroCoupon(planName string, priceCents, introCents int) (string, error) {
+	c, err := coupon.New(&stripe.CouponParams{
+		AmountOff:      stripe.Int64(int64(priceCents - introCents)),
+		Currency:       stripe.String(string(stripe.CurrencyUSD)),
+		Duration:       stripe.String(string(stripe.CouponDurationOnce)),
+		MaxRedemptions: stripe.Int64(1),
+		Name:           stripe.String(planName + " intro price"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return c.ID, nil
+}
+
+// fillSubscriptionOffer sets the offer fields on a subscription from its row
+func fillSubscriptionOffer(sub *Subscription, trialEndsAt sql.NullTime, introCents sql.NullInt64, convertedAt sql.NullTime) {
+	if trialEndsAt.Valid {
+		date := trialEndsAt.Time.Format("2006-01-02")
+		sub.TrialEndsAt = &date
+		sub.OnTrial = !convertedAt.Valid && sub.Status == "active"
+	}
+	if introCents.Valid {
+		price := centsToDollars(int(introCents.Int64))
+		sub.IntroPrice = &price
+	}
+}
+
+// recordTrialConversion marks a trial converted on its first paid invoice. The
+// first paid period starts when the trial ends.
+func recordTrialConversion(db execer, stripeSubscriptionID string, amountPaid int64) error {
+	if amountPaid <= 0 {
+		return nil
+	}
+	_, err := db.Exec(`
+		UPDATE subscriptions
+		SET converted_at = CURRENT_TIMESTAMP,
+		    current_period_start = trial_ends_at,
+		    current_period_end = trial_ends_at + INTERVAL '1 month',
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE stripe_subscription_id = $1 AND trial_ends_at IS NOT NULL AND converted_at IS NULL`,
+		stripeSubscriptionID,
+	)
+	return err
+}
+
+// UpdatePlanOfferRequest sets a plan's offer. A nil intro price removes it.
+type UpdatePlanOfferRequest struct {
+	TrialDays  int      `json:"trial_days"`
+	IntroPrice *float64 `json:"intro_price"`
+}
+
+// handleUpdatePlanOffer sets the trial days and intro price on a plan. It only
+// affects subscriptions started afterwards.
+func (h *PlanOfferHandler) handleUpdatePlanOffer(w http.ResponseWriter, r *http.Request) {
+	planID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid plan ID", http.StatusBadRequest)
+		return
+	}
+
+	var req UpdatePlanOfferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.TrialDays < 0 || req.TrialDays > maxPlanTrialDays {
+		http.Error(w, fmt.Sprintf("Trial days must be between 0 and %d", maxPlanTrialDays), http.StatusBadRequest)
+		return
+	}
+
+	var priceCents int
+	err = h.db.QueryRow("SELECT price_per_month_cents FROM subscription_plans WHERE id = $1", planID).Scan(&priceCents)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Plan not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch plan", http.StatusInternalServerError)
+		return
+	}
+
+	var introCents *int
+	if req.IntroPrice != nil {
+		cents := dollarsToCents(*req.IntroPrice)
+		if cents <= 0 || cents >= priceCents {
+			http.Error(w, fmt.Sprintf("Intro price must be more than $0 and less than the plan price of %s", money.Format(priceCents)), http.StatusBadRequest)
+			return
+		}
+		introCents = &cents
+	}
+
+	_, err = h.db.Exec(`
+		UPDATE subscription_plans SET trial_days = $1, intro_price_cents = $2
+		WHERE id = $3`,
+		req.TrialDays, introCents, planID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update plan offer", http.StatusInternalServerError)
+		return
+	}
+
+	plan := SubscriptionPlan{ID: planID, PricePerMonth: centsToDollars(priceCents), TrialDays: req.TrialDays}
+	if introCents != nil {
+		price := centsToDollars(*introCents)
+		plan.IntroPrice = &price
+	}
+	h.db.QueryRow(`
+		SELECT name, description, pickups_per_month, is_active FROM subscription_plans WHERE id = $1`,
+		planID,
+	).Scan(&plan.Name, &plan.Description, &plan.PickupsPerMonth, &plan.IsActive)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// TrialCohort is the trials started in one month and how they ended
+type TrialCohort struct {
+	Month     string `json:"month"`
+	Started   int    `json:"started"`
+	InTrial   int    `json:"in_trial"`
+	Converted int    `json:"converted"`
+	Cancelled int    `json:"cancelled"`
+	// ConversionRate is converted over trials that have finished
+	ConversionRate float64 `json:"conversion_rate"`
+}
+
+// IntroOfferStats shows how many intro price subscribers stay on
+type IntroOfferStats struct {
+	Started       int     `json:"started"`
+	Active        int     `json:"active"`
+	RetentionRate float64 `json:"retention_rate"`
+}
+
+type TrialAnalytics struct {
+	Months  int             `json:"months"`
+	Cohorts []TrialCohort   `json:"cohorts"`
+	Total   TrialCohort     `json:"total"`
+	Intro   IntroOfferStats `json:"intro"`
+}
+
+// trialConversionRate is the share of finished trials that converted
+func trialConversionRate(c TrialCohort) float64 {
+	finished := c.Started - c.InTrial
+	if finished <= 0 {
+		return 0
+	}
+	return float64(c.Converted) / float64(finished) * 100
+}
+
+// handleGetTrialAnalytics reports trial conversion by the month trials started
+func (h *PlanOfferHandler) handleGetTrialAnalytics(w http.ResponseWriter, r *http.Request) {
+	months := 6
+	if m, err := strconv.Atoi(r.URL.Query().Get("months")); err == nil && m > 0 && m <= 24 {
+		months = m
+	}
+	since := time.Now().UTC().AddDate(0, -(months - 1), 0)
+	since = time.Date(since.Year(), since.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	rows, err := h.db.Query(`
+		SELECT TO_CHAR(DATE_TRUNC('month', created_at), 'YYYY-MM') AS month,
+		       COUNT(*),
+		       COUNT(*) FILTER (WHERE converted_at IS NULL AND status = 'active' AND trial_ends_at >= CURRENT_DATE),
+		       COUNT(*) FILTER (WHERE converted_at IS NOT NULL),
+		       COUNT(*) FILTER (WHERE converted_at IS NULL AND status = 'cancelled')
+		FROM subscriptions
+		WHERE trial_ends_at IS NOT NULL AND created_at >= $1
+		GROUP BY month
+		ORDER BY month`,
+		since,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch trial analytics", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	analytics := TrialAnalytics{Months: months, Cohorts: []TrialCohort{}}
+	for rows.Next() {
+		var c TrialCohort
+		if err := rows.Scan(&c.Month, &c.Started, &c.InTrial, &c.Converted, &c.Cancelled); err != nil {
+			http.Error(w, "Failed to parse trial analytics", http.StatusInternalServerError)
+			return
+		}
+		c.ConversionRate = trialConversionRate(c)
+		analytics.Cohorts = append(analytics.Cohorts, c)
+
+		analytics.Total.Started += c.Started
+		analytics.Total.InTrial += c.InTrial
+		analytics.Total.Converted += c.Converted
+		analytics.Total.Cancelled += c.Cancelled
+	}
+	analytics.Total.Month = "total"
+	analytics.Total.ConversionRate = trialConversionRate(analytics.Total)
+
+	err = h.db.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE status = 'active')
+		FROM subscriptions
+		WHERE intro_price_cents IS NOT NULL AND created_at >= $1`,
+		since,
+	).Scan(&analytics.Intro.Started, &analytics.Intro.Active)
+	if err != nil {
+		http.Error(w, "Failed to fetch trial analytics", http.StatusInternalServerError)
+		return
+	}
+	if analytics.Intro.Started > 0 {
+		analytics.Intro.RetentionRate = float64(analytics.Intro.Active) / float64(analytics.Intro.Started) * 100
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analytics)
+}
+
+// trialEndingMessage tells a subscriber what they'll be charged once the trial ends
+func trialEndingMessage(planName string, trialEnds time.Time, priceCents int, introCents *int) string {
+	if introCents != nil {
+		return fmt.Sprintf("Your free trial of the %s plan ends on %s. Your first month will be %s, then %s/month. "+
+			"You can cancel any time before then and won't be charged.",
+			planName, trialEnds.Format("January 2"), money.Format(*introCents), money.Format(priceCents))
+	}
+	return fmt.Sprintf("Your free trial of the %s plan ends on %s, after which it's %s/month. "+
+		"You can cancel any time before then and won't be charged.",
+		planName, trialEnds.Format("January 2"), money.Format(priceCents))
+}
+
+// processTrialReminders tells subscribers their trial is about to end and
+// attaches the intro discount in Stripe ahead of the first paid invoice. The
+// discount waits until now because a one-off coupon attached at signup would
+// be used up by the $0 trial invoice.
+func (s *AutoScheduler) processTrialReminders() {
+	log.Println("Processing trial reminders...")
+
+	rows, err := s.db.Query(`
+		SELECT s.id, s.user_id, s.trial_ends_at, s.intro_price_cents, s.stripe_subscription_id,
+		       s.trial_reminder_sent_at IS NOT NULL,
+		       s.intro_price_cents IS NOT NULL AND s.intro_discount_applied_at IS NULL,
+		       p.name, p.price_per_month_cents
+		FROM subscriptions s
+		JOIN subscription_plans p ON s.plan_id = p.id
+		WHERE s.status = 'active' AND s.converted_at IS NULL
+		  AND s.trial_ends_at BETWEEN CURRENT_DATE AND CURRENT_DATE + $1::int
+		  AND (s.trial_reminder_sent_at IS NULL
+		       OR (s.intro_price_cents IS NOT NULL AND s.intro_discount_applied_at IS NULL))`,
+		trialReminderDays,
+	)
+	if err != nil {
+		log.Printf("Error fetching ending trials: %v", err)
+		return
+	}
+
+	type endingTrial struct {
+		SubscriptionID       int
+		UserID               int
+		TrialEndsAt          time.Time
+		IntroCents           sql.NullInt64
+		StripeSubscriptionID sql.NullString
+		Reminded             bool
+		NeedsDiscount        bool
+		PlanName             string
+		PriceCents           int
+	}
+	var trials []endingTrial
+	for rows.Next() {
+		var t endingTrial
+		err := rows.Scan(&t.SubscriptionID, &t.UserID, &t.TrialEndsAt, &t.IntroCents, &t.StripeSubscriptionID,
+			&t.Reminded, &t.NeedsDiscount, &t.PlanName, &t.PriceCents)
+		if err != nil {
+			log.Printf("Error scanning ending trial: %v", err)
+			continue
+		}
+		trials = append(trials, t)
+	}
+	rows.Close()
+
+	reminded, discounted := 0, 0
+	for _, t := range trials {
+		var introCents *int
+		if t.IntroCents.Valid {
+			cents := int(t.IntroCents.Int64)
+			introCents = &cents
+		}
+
+		if t.NeedsDiscount && t.StripeSubscriptionID.Valid && t.StripeSubscriptionID.String != "" {
+			couponID, err := newIntroCoupon(t.PlanName, t.PriceCents, *introCents)
+			if err == nil {
+				_, err = subscription.Update(t.StripeSubscriptionID.String, &stripe.SubscriptionParams{
+					Discounts: []*stripe.SubscriptionDiscountParams{{Coupon: stripe.String(couponID)}},
+				})
+			}
+			if err != nil {
+				log.Printf("Error applying intro discount to subscription %d: %v", t.SubscriptionID, err)
+			} else {
+				s.db.Exec("UPDATE subscriptions SET intro_discount_applied_at = CURRENT_TIMESTAMP WHERE id = $1", t.SubscriptionID)
+				discounted++
+			}
+		}
+
+		if t.Reminded {
+			continue
+		}
+		_, err := s.db.Exec(`
+			INSERT INTO notifications (user_id, type, title, message)
+			VALUES ($1, $2, $3, $4)`,
+			t.UserID, trialEndingNotificationType, "Your free trial is ending",
+			trialEndingMessage(t.PlanName, t.TrialEndsAt, t.PriceCents, introCents),
+		)
+		if err != nil {
+			log.Printf("Error creating trial reminder for user %d: %v", t.UserID, err)
+			continue
+		}
+		s.db.Exec("UPDATE subscriptions SET trial_reminder_sent_at = CURRENT_TIMESTAMP WHERE id = $1", t.SubscriptionID)
+		reminded++
+	}
+
+	log.Printf("Finished processing trial reminders - %d reminders sent, %d intro discounts applied", reminded, discounted)
+}
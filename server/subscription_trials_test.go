@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPlanOfferPeriodEnd(t *testing.T) {
+	now := time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)
+
+	if end := (PlanOffer{}).periodEnd(now).Format("2006-01-02"); end != "2026-03-03" {
+		t.Errorf("Expected a month without a trial, got %s", end)
+	}
+	trial := PlanOffer{TrialDays: 14}
+	if end := trial.periodEnd(now).Format("2006-01-02"); end != "2026-02-14" {
+		t.Errorf("Expected the first period to end with the trial, got %s", end)
+	}
+	if (PlanOffer{}).trialEnd(now) != nil {
+		t.Error("Expected no trial end without trial days")
+	}
+}
+
+func TestTrialConversionRate(t *testing.T) {
+	// Trials still running don't count against conversion
+	rate := trialConversionRate(TrialCohort{Started: 10, InTrial: 2, Converted: 6, Cancelled: 2})
+	if rate != 75 {
+		t.Errorf("Expected 75%% conversion, got %.2f", rate)
+	}
+	if rate := trialConversionRate(TrialCohort{Started: 3, InTrial: 3}); rate != 0 {
+		t.Errorf("Expected 0%% with every trial still running, got %.2f", rate)
+	}
+}
+
+func TestPlanTrialOffer(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	planID := db.GetPlanID(t, "Family Fresh")
+	defer db.Exec("UPDATE subscription_plans SET trial_days = 0, intro_price_cents = NULL WHERE id = $1", planID)
+
+	offers := NewPlanOfferHandler(db.DB)
+	setOffer := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/v1/admin/subscription-plans/offer", bytes.NewBufferString(body))
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(planID)})
+		w := httptest.NewRecorder()
+		offers.handleUpdatePlanOffer(w, req)
+		return w
+	}
+	if w := setOffer(`{"trial_days": 120}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for too long a trial, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := setOffer(`{"trial_days": 14, "intro_price": 1000}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an intro price above the plan price, got %d", http.StatusBadRequest, w.Code)
+	}
+	w := setOffer(`{"trial_days": 2, "intro_price": 9.99}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// A first-time subscriber starts on the trial
+	userID := db.CreateTestUser(t, "trial@example.com", "Trial", "Subscriber")
+	subscriptions := NewSubscriptionHandler(db.DB)
+	subscriptions.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+	body, _ := json.Marshal(CreateSubscriptionRequest{PlanID: planID})
+	w = httptest.NewRecorder()
+	subscriptions.handleCreateSubscription(w, httptest.NewRequest("POST", "/api/v1/subscriptions", bytes.NewBuffer(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var sub Subscription
+	json.Unmarshal(w.Body.Bytes(), &sub)
+	trialEnds := time.Now().AddDate(0, 0, 2).Format("2006-01-02")
+	if !sub.OnTrial || sub.TrialEndsAt == nil || *sub.TrialEndsAt != trialEnds || sub.IntroPrice == nil || *sub.IntroPrice != 9.99 {
+		t.Errorf("Expected a trial ending %s with a 9.99 intro price, got %+v", trialEnds, sub)
+	}
+
+	// Returning subscribers don't get the offer again
+	if offer, err := planOfferFor(db.DB, userID, planID); err != nil || offer.TrialDays != 0 || offer.IntroPriceCents != nil {
+		t.Errorf("Expected no offer for a returning subscriber, got %+v (%v)", offer, err)
+	}
+
+	// The trial ends within the reminder window, so the subscriber hears about it once
+	scheduler := &AutoScheduler{db: db.DB}
+	scheduler.processTrialReminders()
+	scheduler.processTrialReminders()
+	var reminders int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND type = $2", userID, trialEndingNotificationType).Scan(&reminders)
+	if reminders != 1 {
+		t.Errorf("Expected one trial reminder, got %d", reminders)
+	}
+
+	// The first paid invoice converts the trial and starts the paid period
+	db.Exec("UPDATE subscriptions SET stripe_subscription_id = 'sub_trial_test' WHERE id = $1", sub.ID)
+	if err := recordTrialConversion(db.DB, "sub_trial_test", 999); err != nil {
+		t.Fatalf("Failed to record conversion: %v", err)
+	}
+	w = httptest.NewRecorder()
+	offers.handleGetTrialAnalytics(w, httptest.NewRequest("GET", "/api/v1/admin/analytics/trials", nil))
+	var analytics TrialAnalytics
+	json.Unmarshal(w.Body.Bytes(), &analytics)
+	if analytics.Total.Started != 1 || analytics.Total.Converted != 1 || analytics.Total.ConversionRate != 100 {
+		t.Errorf("Expected one converted trial, got %+v", analytics.Total)
+	}
+	if analytics.Intro.Started != 1 || analytics.Intro.Active != 1 {
+		t.Errorf("Expected one active intro subscriber, got %+v", analytics.Intro)
+	}
+}
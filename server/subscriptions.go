@@ -10,6 +10,8 @@ import (
 	"strconv"
 	"time"
 
+	"tumble-backend/money"
+
 	"github.com/gorilla/mux"
 	"github.com/stripe/stripe-go/v82"
 	"github.com/stripe/stripe-go/v82/price"
@@ -20,6 +22,18 @@ import (
 type SubscriptionHandler struct {
 	db        *sql.DB
 	getUserID func(*http.Request, *sql.DB) (int, error)
+	// getStripeSubscription is nil in tests; renewal info then comes from the local period
+	getStripeSubscription func(id string) (*stripe.Subscription, error)
+	// quota is nil unless a test injects one; quotas are then read from db
+	quota *QuotaService
+}
+
+// quotas returns the service subscribers' quotas are worked out with
+func (h *SubscriptionHandler) quotas() *QuotaService {
+	if h.quota != nil {
+		return h.quota
+	}
+	return NewQuotaService(pgSubscriptionRepo{db: h.db})
 }
 
 type SubscriptionPlan struct {
@@ -29,6 +43,9 @@ type SubscriptionPlan struct {
 	PricePerMonth   float64 `json:"price_per_month"`   // Convert from cents for JSON
 	PickupsPerMonth int     `json:"pickups_per_month"`
 	IsActive        bool    `json:"is_active"`
+	// Offer for first-time subscribers
+	TrialDays  int      `json:"trial_days"`
+	IntroPrice *float64 `json:"intro_price,omitempty"`
 }
 
 type Subscription struct {
@@ -42,6 +59,15 @@ type Subscription struct {
 	StripeSubscriptionID *string           `json:"stripe_subscription_id,omitempty"`
 	CreatedAt            time.Time         `json:"created_at"`
 	UpdatedAt            time.Time         `json:"updated_at"`
+	// Renewal info, filled in for GET /subscriptions/current
+	RenewalDate               *string             `json:"renewal_date,omitempty"`
+	NextCharge                *SubscriptionCharge `json:"next_charge,omitempty"`
+	CancellationEffectiveDate *string             `json:"cancellation_effective_date,omitempty"`
+	PauseHistory              []SubscriptionPause `json:"pause_history,omitempty"`
+	// Offer the subscription started with
+	TrialEndsAt *string  `json:"trial_ends_at,omitempty"`
+	OnTrial     bool     `json:"on_trial"`
+	IntroPrice  *float64 `json:"intro_price,omitempty"`
 }
 
 type CreateSubscriptionRequest struct {
@@ -55,19 +81,21 @@ type UpdateSubscriptionRequest struct {
 
 // SubscriptionPreferences represents user preferences for recurring orders
 type SubscriptionPreferences struct {
-	ID                       int              `json:"id"`
-	UserID                   int              `json:"user_id"`
-	DefaultPickupAddressID   *int             `json:"default_pickup_address_id"`
-	DefaultDeliveryAddressID *int             `json:"default_delivery_address_id"`
-	PreferredPickupTimeSlot  string           `json:"preferred_pickup_time_slot"`
-	PreferredDeliveryTimeSlot string          `json:"preferred_delivery_time_slot"`
-	PreferredPickupDay       string           `json:"preferred_pickup_day"`
-	DefaultServices          []ServiceRequest `json:"default_services"`
-	AutoScheduleEnabled      bool             `json:"auto_schedule_enabled"`
-	LeadTimeDays             int              `json:"lead_time_days"`
-	SpecialInstructions      string           `json:"special_instructions"`
-	CreatedAt                time.Time        `json:"created_at"`
-	UpdatedAt                time.Time        `json:"updated_at"`
+	ID                        int                    `json:"id"`
+	UserID                    int                    `json:"user_id"`
+	DefaultPickupAddressID    *int                   `json:"default_pickup_address_id"`
+	DefaultDeliveryAddressID  *int                   `json:"default_delivery_address_id"`
+	PreferredPickupTimeSlot   string                 `json:"preferred_pickup_time_slot"`
+	PreferredDeliveryTimeSlot string                 `json:"preferred_delivery_time_slot"`
+	PreferredPickupDay        string                 `json:"preferred_pickup_day"`
+	DefaultServices           []ServiceRequest       `json:"default_services"`
+	AutoScheduleEnabled       bool                   `json:"auto_schedule_enabled"`
+	LeadTimeDays              int                    `json:"lead_time_days"`
+	SpecialInstructions       string                 `json:"special_instructions"`
+	AddressRotation           []AddressStop          `json:"address_rotation"`
+	WeekdayAddresses          map[string]AddressStop `json:"weekday_addresses"`
+	CreatedAt                 time.Time              `json:"created_at"`
+	UpdatedAt                 time.Time              `json:"updated_at"`
 }
 
 // ServiceRequest represents a service selection for recurring orders
@@ -76,17 +104,37 @@ type ServiceRequest struct {
 	Quantity  int `json:"quantity"`
 }
 
+// AddressStop is a pickup/delivery address pair for subscribers who alternate
+// locations (e.g. home one week, office the next)
+type AddressStop struct {
+	PickupAddressID   int `json:"pickup_address_id"`
+	DeliveryAddressID int `json:"delivery_address_id"`
+}
+
+// validPickupDays are the accepted weekday names for pickup preferences
+var validPickupDays = map[string]bool{
+	"sunday":    true,
+	"monday":    true,
+	"tuesday":   true,
+	"wednesday": true,
+	"thursday":  true,
+	"friday":    true,
+	"saturday":  true,
+}
+
 // CreateSubscriptionPreferencesRequest represents the request body for creating preferences
 type CreateSubscriptionPreferencesRequest struct {
-	DefaultPickupAddressID   *int             `json:"default_pickup_address_id"`
-	DefaultDeliveryAddressID *int             `json:"default_delivery_address_id"`
-	PreferredPickupTimeSlot  string           `json:"preferred_pickup_time_slot"`
-	PreferredDeliveryTimeSlot string          `json:"preferred_delivery_time_slot"`
-	PreferredPickupDay       string           `json:"preferred_pickup_day"`
-	DefaultServices          []ServiceRequest `json:"default_services"`
-	AutoScheduleEnabled      bool             `json:"auto_schedule_enabled"`
-	LeadTimeDays             int              `json:"lead_time_days"`
-	SpecialInstructions      string           `json:"special_instructions"`
+	DefaultPickupAddressID    *int                   `json:"default_pickup_address_id"`
+	DefaultDeliveryAddressID  *int                   `json:"default_delivery_address_id"`
+	PreferredPickupTimeSlot   string                 `json:"preferred_pickup_time_slot"`
+	PreferredDeliveryTimeSlot string                 `json:"preferred_delivery_time_slot"`
+	PreferredPickupDay        string                 `json:"preferred_pickup_day"`
+	DefaultServices           []ServiceRequest       `json:"default_services"`
+	AutoScheduleEnabled       bool                   `json:"auto_schedule_enabled"`
+	LeadTimeDays              int                    `json:"lead_time_days"`
+	SpecialInstructions       string                 `json:"special_instructions"`
+	AddressRotation           []AddressStop          `json:"address_rotation,omitempty"`
+	WeekdayAddresses          map[string]AddressStop `json:"weekday_addresses,omitempty"`
 }
 
 func NewSubscriptionHandler(db *sql.DB) *SubscriptionHandler {
@@ -96,6 +144,9 @@ func NewSubscriptionHandler(db *sql.DB) *SubscriptionHandler {
 	return &SubscriptionHandler{
 		db:        db,
 		getUserID: getUserIDFromRequest,
+		getStripeSubscription: func(id string) (*stripe.Subscription, error) {
+			return subscription.Get(id, nil)
+		},
 	}
 }
 
@@ -106,11 +157,19 @@ func (h *SubscriptionHandler) handleGetPlans(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// Plans sold in one market only are listed for that market
+	marketID, err := requestMarketID(r, h.db, h.getUserID)
+	if err != nil {
+		http.Error(w, "Failed to look up market", http.StatusInternalServerError)
+		return
+	}
+
 	rows, err := h.db.Query(`
-		SELECT id, name, description, price_per_month_cents, pickups_per_month, is_active
+		SELECT id, name, description, price_per_month_cents, pickups_per_month, is_active,
+		       trial_days, intro_price_cents
 		FROM subscription_plans
-		WHERE is_active = true
-		ORDER BY price_per_month_cents ASC`)
+		WHERE is_active = true AND `+fmt.Sprintf(soldInMarketSQL, "subscription_plans", "$1")+`
+		ORDER BY price_per_month_cents ASC`, marketID)
 	if err != nil {
 		http.Error(w, "Failed to fetch plans", http.StatusInternalServerError)
 		return
@@ -121,17 +180,22 @@ func (h *SubscriptionHandler) handleGetPlans(w http.ResponseWriter, r *http.Requ
 	for rows.Next() {
 		var plan SubscriptionPlan
 		var pricePerMonthCents int
+		var introPriceCents sql.NullInt64
 		err := rows.Scan(
 			&plan.ID, &plan.Name, &plan.Description,
 			&pricePerMonthCents, &plan.PickupsPerMonth,
-			&plan.IsActive,
+			&plan.IsActive, &plan.TrialDays, &introPriceCents,
 		)
 		if err != nil {
 			http.Error(w, "Failed to parse plans", http.StatusInternalServerError)
 			return
 		}
 		// Convert cents to dollars for JSON response
-		plan.PricePerMonth = float64(pricePerMonthCents) / 100.0
+		plan.PricePerMonth = centsToDollars(pricePerMonthCents)
+		if introPriceCents.Valid {
+			introPrice := centsToDollars(int(introPriceCents.Int64))
+			plan.IntroPrice = &introPrice
+		}
 		plans = append(plans, plan)
 	}
 
@@ -156,11 +220,14 @@ func (h *SubscriptionHandler) handleGetSubscription(w http.ResponseWriter, r *ht
 	var subscription Subscription
 	var plan SubscriptionPlan
 	var pricePerMonthCents int
+	var trialEndsAt, convertedAt sql.NullTime
+	var introPriceCents sql.NullInt64
 
 	err = h.db.QueryRow(`
 		SELECT s.id, s.user_id, s.plan_id, s.status,
 			   s.current_period_start, s.current_period_end,
 			   s.stripe_subscription_id, s.created_at, s.updated_at,
+			   s.trial_ends_at, s.intro_price_cents, s.converted_at,
 			   p.id, p.name, p.description, p.price_per_month_cents,
 			   p.pickups_per_month
 		FROM subscriptions s
@@ -174,6 +241,7 @@ func (h *SubscriptionHandler) handleGetSubscription(w http.ResponseWriter, r *ht
 		&subscription.Status, &subscription.CurrentPeriodStart,
 		&subscription.CurrentPeriodEnd, &subscription.StripeSubscriptionID, 
 		&subscription.CreatedAt, &subscription.UpdatedAt,
+		&trialEndsAt, &introPriceCents, &convertedAt,
 		&plan.ID, &plan.Name, &plan.Description, &pricePerMonthCents,
 		&plan.PickupsPerMonth,
 	)
@@ -188,9 +256,16 @@ func (h *SubscriptionHandler) handleGetSubscription(w http.ResponseWriter, r *ht
 	}
 	
 	// Convert cents to dollars for JSON response
-	plan.PricePerMonth = float64(pricePerMonthCents) / 100.0
+	plan.PricePerMonth = centsToDollars(pricePerMonthCents)
 
 	subscription.Plan = &plan
+	fillSubscriptionOffer(&subscription, trialEndsAt, introPriceCents, convertedAt)
+
+	if err := h.addRenewalInfo(&subscription); err != nil {
+		log.Printf("Failed to add renewal info to subscription %d: %v", subscription.ID, err)
+		http.Error(w, "Failed to fetch subscription", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(subscription)
@@ -232,32 +307,49 @@ func (h *SubscriptionHandler) handleCreateSubscription(w http.ResponseWriter, r
 		return
 	}
 
-	// Verify plan exists and is active
+	// Verify plan exists, is active and is sold in the customer's market
+	marketID, err := customerMarketID(h.db, userID)
+	if err != nil {
+		http.Error(w, "Failed to look up market", http.StatusInternalServerError)
+		return
+	}
 	var planExists bool
 	err = h.db.QueryRow(`
-		SELECT EXISTS(SELECT 1 FROM subscription_plans WHERE id = $1 AND is_active = true)`,
-		req.PlanID,
+		SELECT EXISTS(SELECT 1 FROM subscription_plans WHERE id = $1 AND is_active = true AND `+fmt.Sprintf(soldInMarketSQL, "subscription_plans", "$2")+`)`,
+		req.PlanID, marketID,
 	).Scan(&planExists)
 	if err != nil || !planExists {
 		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
 		return
 	}
 
-	// Calculate billing period
+	offer, err := planOfferFor(h.db, userID, req.PlanID)
+	if err != nil {
+		http.Error(w, "Failed to check plan offer", http.StatusInternalServerError)
+		return
+	}
+
+	// Calculate billing period; a trial is the first period
 	now := time.Now()
 	periodStart := now.Format("2006-01-02")
-	periodEnd := now.AddDate(0, 1, 0).Format("2006-01-02")
+	periodEnd := offer.periodEnd(now).Format("2006-01-02")
+	var trialEndsAt *string
+	if end := offer.trialEnd(now); end != nil {
+		date := end.Format("2006-01-02")
+		trialEndsAt = &date
+	}
 
 	// Create subscription
 	var subscriptionID int
 	err = h.db.QueryRow(`
 		INSERT INTO subscriptions (
 			user_id, plan_id, status, 
-			current_period_start, current_period_end
-		) VALUES ($1, $2, $3, $4, $5)
+			current_period_start, current_period_end,
+			trial_ends_at, intro_price_cents
+		) VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id`,
 		userID, req.PlanID, "active",
-		periodStart, periodEnd,
+		periodStart, periodEnd, trialEndsAt, offer.IntroPriceCents,
 	).Scan(&subscriptionID)
 	if err != nil {
 		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
@@ -349,13 +441,18 @@ func (h *SubscriptionHandler) handlePreviewSubscriptionChange(w http.ResponseWri
 		http.Error(w, "Current plan not found", http.StatusInternalServerError)
 		return
 	}
-	currentPlan.PricePerMonth = float64(currentPlanPriceCents) / 100.0
+	currentPlan.PricePerMonth = centsToDollars(currentPlanPriceCents)
 
+	marketID, err := customerMarketID(h.db, userID)
+	if err != nil {
+		http.Error(w, "Failed to look up market", http.StatusInternalServerError)
+		return
+	}
 	var newPlanPriceCents int
 	err = h.db.QueryRow(`
 		SELECT id, name, description, price_per_month_cents, pickups_per_month, is_active
-		FROM subscription_plans WHERE id = $1 AND is_active = true
-	`, req.NewPlanID).Scan(
+		FROM subscription_plans WHERE id = $1 AND is_active = true AND `+fmt.Sprintf(soldInMarketSQL, "subscription_plans", "$2")+`
+	`, req.NewPlanID, marketID).Scan(
 		&newPlan.ID, &newPlan.Name, &newPlan.Description,
 		&newPlanPriceCents, &newPlan.PickupsPerMonth,
 		&newPlan.IsActive,
@@ -364,7 +461,7 @@ func (h *SubscriptionHandler) handlePreviewSubscriptionChange(w http.ResponseWri
 		http.Error(w, "New plan not found", http.StatusBadRequest)
 		return
 	}
-	newPlan.PricePerMonth = float64(newPlanPriceCents) / 100.0
+	newPlan.PricePerMonth = centsToDollars(newPlanPriceCents)
 
 	preview := SubscriptionChangePreview{
 		CurrentPlan: &currentPlan,
@@ -397,15 +494,15 @@ func (h *SubscriptionHandler) handlePreviewSubscriptionChange(w http.ResponseWri
 	}
 
 	// Generate description based on price difference
-	priceDiff := newPlan.PricePerMonth - currentPlan.PricePerMonth
-	if priceDiff > 0 {
+	priceDiffCents := newPlanPriceCents - currentPlanPriceCents
+	if priceDiffCents > 0 {
 		if preview.ProrationDescription == "" {
-			preview.ProrationDescription = fmt.Sprintf("You'll be charged a prorated amount of approximately $%.2f today for the upgrade, and your next billing will be $%.2f/month.", 
-				preview.ImmediateCharge, newPlan.PricePerMonth)
+			preview.ProrationDescription = fmt.Sprintf("You'll be charged a prorated amount of approximately %s today for the upgrade, and your next billing will be %s/month.", 
+				money.Format(dollarsToCents(preview.ImmediateCharge)), money.Format(newPlanPriceCents))
 		}
 	} else {
-		preview.ProrationDescription = fmt.Sprintf("You'll receive a prorated credit of approximately $%.2f, and your next billing will be $%.2f/month.", 
-			preview.ImmediateCredit, newPlan.PricePerMonth)
+		preview.ProrationDescription = fmt.Sprintf("You'll receive a prorated credit of approximately %s, and your next billing will be %s/month.", 
+			money.Format(dollarsToCents(preview.ImmediateCredit)), money.Format(newPlanPriceCents))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -485,10 +582,11 @@ func (h *SubscriptionHandler) handleUpdateSubscription(w http.ResponseWriter, r
 
 	// Handle status changes
 	if req.Status != "" && req.Status != currentStatus {
-		// Build update query for status change
+		// Build update query for status change. A status the customer sets
+		// themselves is no longer down to a deactivation.
 		_, err := h.db.Exec(`
 			UPDATE subscriptions 
-			SET status = $1, updated_at = CURRENT_TIMESTAMP
+			SET status = $1, paused_by_deactivation = false, updated_at = CURRENT_TIMESTAMP
 			WHERE id = $2 AND user_id = $3
 		`, req.Status, subscriptionID, userID)
 		
@@ -496,6 +594,9 @@ func (h *SubscriptionHandler) handleUpdateSubscription(w http.ResponseWriter, r
 			http.Error(w, "Failed to update subscription status", http.StatusInternalServerError)
 			return
 		}
+		if err := recordSubscriptionStatusChange(h.db, subscriptionID, currentStatus, req.Status); err != nil {
+			log.Printf("Failed to record pause history for subscription %d: %v", subscriptionID, err)
+		}
 	}
 
 	// Fetch updated subscription
@@ -584,6 +685,10 @@ func (h *SubscriptionHandler) handleCancelSubscription(w http.ResponseWriter, r
 		http.Error(w, "Subscription not found", http.StatusNotFound)
 		return
 	}
+	// Cancelling a paused subscription ends its pause
+	if err := recordSubscriptionStatusChange(h.db, subscriptionID, "paused", "cancelled"); err != nil {
+		log.Printf("Failed to record pause history for subscription %d: %v", subscriptionID, err)
+	}
 
 	// Fetch and return the updated subscription
 	subscription, err := h.getSubscriptionByID(subscriptionID)
@@ -600,11 +705,14 @@ func (h *SubscriptionHandler) handleCancelSubscription(w http.ResponseWriter, r
 func (h *SubscriptionHandler) getSubscriptionByID(subscriptionID int) (*Subscription, error) {
 	var subscription Subscription
 	var plan SubscriptionPlan
+	var trialEndsAt, convertedAt sql.NullTime
+	var introPriceCents sql.NullInt64
 
 	err := h.db.QueryRow(`
 		SELECT s.id, s.user_id, s.plan_id, s.status,
 			   s.current_period_start, s.current_period_end,
 			   s.stripe_subscription_id, s.created_at, s.updated_at,
+			   s.trial_ends_at, s.intro_price_cents, s.converted_at,
 			   p.id, p.name, p.description, p.price_per_month_cents,
 			   p.pickups_per_month
 		FROM subscriptions s
@@ -616,6 +724,7 @@ func (h *SubscriptionHandler) getSubscriptionByID(subscriptionID int) (*Subscrip
 		&subscription.Status, &subscription.CurrentPeriodStart,
 		&subscription.CurrentPeriodEnd, &subscription.StripeSubscriptionID,
 		&subscription.CreatedAt, &subscription.UpdatedAt,
+		&trialEndsAt, &introPriceCents, &convertedAt,
 		&plan.ID, &plan.Name, &plan.Description, &plan.PricePerMonth,
 		&plan.PickupsPerMonth,
 	)
@@ -625,6 +734,7 @@ func (h *SubscriptionHandler) getSubscriptionByID(subscriptionID int) (*Subscrip
 	}
 
 	subscription.Plan = &plan
+	fillSubscriptionOffer(&subscription, trialEndsAt, introPriceCents, convertedAt)
 	return &subscription, nil
 }
 
@@ -642,77 +752,12 @@ func (h *SubscriptionHandler) handleGetSubscriptionUsage(w http.ResponseWriter,
 		return
 	}
 
-	// Get active subscription
-	var subscriptionID int
-	var planID int
-	var pickupsPerMonth int
-	var currentPeriodStart, currentPeriodEnd string
-
-	err = h.db.QueryRow(`
-		SELECT s.id, s.plan_id, s.current_period_start, s.current_period_end, p.pickups_per_month
-		FROM subscriptions s
-		JOIN subscription_plans p ON s.plan_id = p.id
-		WHERE s.user_id = $1
-		ORDER BY s.created_at DESC
-		LIMIT 1`,
-		userID,
-	).Scan(&subscriptionID, &planID, &currentPeriodStart, &currentPeriodEnd, &pickupsPerMonth)
-
+	usage, err := h.subscriptions().Usage(r.Context(), userID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "No subscription found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Failed to fetch subscription", http.StatusInternalServerError)
-		}
+		writeServiceError(w, err, "Failed to fetch usage data")
 		return
 	}
 
-	// Count orders in current period
-	var ordersCount int
-	var coveredBags int
-	err = h.db.QueryRow(`
-		SELECT 
-			COUNT(DISTINCT o.id), 
-			COALESCE(SUM(CASE WHEN oi.price_cents = 0 AND s.name = 'standard_bag' THEN oi.quantity ELSE 0 END), 0)
-		FROM orders o
-		LEFT JOIN order_items oi ON o.id = oi.order_id
-		LEFT JOIN services s ON oi.service_id = s.id
-		WHERE o.user_id = $1 
-		AND o.subscription_id = $2
-		AND o.pickup_date >= $3::date 
-		AND o.pickup_date < $4::date
-		AND o.status != 'cancelled'`,
-		userID, subscriptionID, currentPeriodStart, currentPeriodEnd,
-	).Scan(&ordersCount, &coveredBags)
-
-	if err != nil {
-		http.Error(w, "Failed to fetch usage data", http.StatusInternalServerError)
-		return
-	}
-
-	// Calculate remaining values, ensuring they never go below 0
-	pickupsRemaining := pickupsPerMonth - ordersCount
-	if pickupsRemaining < 0 {
-		pickupsRemaining = 0
-	}
-	
-	bagsRemaining := pickupsPerMonth - coveredBags
-	if bagsRemaining < 0 {
-		bagsRemaining = 0
-	}
-
-	usage := map[string]interface{}{
-		"subscription_id":      subscriptionID,
-		"current_period_start": currentPeriodStart,
-		"current_period_end":   currentPeriodEnd,
-		"pickups_used":         ordersCount,
-		"pickups_allowed":      pickupsPerMonth,
-		"pickups_remaining":    pickupsRemaining,
-		"bags_used":            coveredBags,
-		"bags_allowed":         pickupsPerMonth,             // Total bags allowed per month
-		"bags_remaining":       bagsRemaining, // Remaining bags = total allowed - bags covered (min 0)
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(usage)
 }
@@ -726,20 +771,20 @@ func (h *SubscriptionHandler) handleGetSubscriptionPreferences(w http.ResponseWr
 	}
 
 	var prefs SubscriptionPreferences
-	var defaultServicesJSON []byte
+	var defaultServicesJSON, addressRotationJSON, weekdayAddressesJSON []byte
 
 	err = h.db.QueryRow(`
 		SELECT id, user_id, default_pickup_address_id, default_delivery_address_id,
 			   preferred_pickup_time_slot, preferred_delivery_time_slot, preferred_pickup_day,
 			   default_services, auto_schedule_enabled, lead_time_days, special_instructions,
-			   created_at, updated_at
+			   address_rotation, weekday_addresses, created_at, updated_at
 		FROM subscription_preferences
 		WHERE user_id = $1
 	`, userID).Scan(
 		&prefs.ID, &prefs.UserID, &prefs.DefaultPickupAddressID, &prefs.DefaultDeliveryAddressID,
 		&prefs.PreferredPickupTimeSlot, &prefs.PreferredDeliveryTimeSlot, &prefs.PreferredPickupDay,
 		&defaultServicesJSON, &prefs.AutoScheduleEnabled, &prefs.LeadTimeDays, &prefs.SpecialInstructions,
-		&prefs.CreatedAt, &prefs.UpdatedAt,
+		&addressRotationJSON, &weekdayAddressesJSON, &prefs.CreatedAt, &prefs.UpdatedAt,
 	)
 
 	if err != nil {
@@ -762,6 +807,8 @@ func (h *SubscriptionHandler) handleGetSubscriptionPreferences(w http.ResponseWr
 				AutoScheduleEnabled:      true,
 				LeadTimeDays:             1,
 				SpecialInstructions:      "",
+				AddressRotation:          []AddressStop{},
+				WeekdayAddresses:         map[string]AddressStop{},
 			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(prefs)
@@ -780,6 +827,18 @@ func (h *SubscriptionHandler) handleGetSubscriptionPreferences(w http.ResponseWr
 		}
 	}
 
+	// Parse the multi-stop address preferences
+	prefs.AddressRotation = []AddressStop{}
+	prefs.WeekdayAddresses = map[string]AddressStop{}
+	if err := json.Unmarshal(addressRotationJSON, &prefs.AddressRotation); err != nil {
+		http.Error(w, "Failed to parse address rotation", http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(weekdayAddressesJSON, &prefs.WeekdayAddresses); err != nil {
+		http.Error(w, "Failed to parse weekday addresses", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(prefs)
 }
@@ -843,20 +902,55 @@ func (h *SubscriptionHandler) handleCreateOrUpdateSubscriptionPreferences(w http
 		}
 	}
 
+	// Validate multi-stop addresses: every stop must use the user's own addresses
+	if req.AddressRotation == nil {
+		req.AddressRotation = []AddressStop{}
+	}
+	if req.WeekdayAddresses == nil {
+		req.WeekdayAddresses = map[string]AddressStop{}
+	}
+	for day := range req.WeekdayAddresses {
+		if !validPickupDays[day] {
+			http.Error(w, fmt.Sprintf("Invalid weekday in weekday addresses: %s", day), http.StatusBadRequest)
+			return
+		}
+	}
+	stops := append([]AddressStop{}, req.AddressRotation...)
+	for _, stop := range req.WeekdayAddresses {
+		stops = append(stops, stop)
+	}
+	for _, stop := range stops {
+		if !h.userOwnsAddresses(userID, stop.PickupAddressID, stop.DeliveryAddressID) {
+			http.Error(w, "Invalid address in multi-stop preferences", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Convert default services to JSON
 	defaultServicesJSON, err := json.Marshal(req.DefaultServices)
 	if err != nil {
 		http.Error(w, "Failed to process default services", http.StatusInternalServerError)
 		return
 	}
+	addressRotationJSON, err := json.Marshal(req.AddressRotation)
+	if err != nil {
+		http.Error(w, "Failed to process address rotation", http.StatusInternalServerError)
+		return
+	}
+	weekdayAddressesJSON, err := json.Marshal(req.WeekdayAddresses)
+	if err != nil {
+		http.Error(w, "Failed to process weekday addresses", http.StatusInternalServerError)
+		return
+	}
 
 	// Use UPSERT to create or update preferences
 	_, err = h.db.Exec(`
 		INSERT INTO subscription_preferences (
 			user_id, default_pickup_address_id, default_delivery_address_id,
 			preferred_pickup_time_slot, preferred_delivery_time_slot, preferred_pickup_day,
-			default_services, auto_schedule_enabled, lead_time_days, special_instructions
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			default_services, auto_schedule_enabled, lead_time_days, special_instructions,
+			address_rotation, weekday_addresses
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 		ON CONFLICT (user_id) DO UPDATE SET
 			default_pickup_address_id = EXCLUDED.default_pickup_address_id,
 			default_delivery_address_id = EXCLUDED.default_delivery_address_id,
@@ -867,10 +961,18 @@ func (h *SubscriptionHandler) handleCreateOrUpdateSubscriptionPreferences(w http
 			auto_schedule_enabled = EXCLUDED.auto_schedule_enabled,
 			lead_time_days = EXCLUDED.lead_time_days,
 			special_instructions = EXCLUDED.special_instructions,
+			address_rotation = EXCLUDED.address_rotation,
+			weekday_addresses = EXCLUDED.weekday_addresses,
+			rotation_index = CASE
+				WHEN subscription_preferences.address_rotation = EXCLUDED.address_rotation
+				THEN subscription_preferences.rotation_index
+				ELSE 0
+			END,
 			updated_at = CURRENT_TIMESTAMP
 	`, userID, req.DefaultPickupAddressID, req.DefaultDeliveryAddressID,
 		req.PreferredPickupTimeSlot, req.PreferredDeliveryTimeSlot, req.PreferredPickupDay,
-		defaultServicesJSON, req.AutoScheduleEnabled, req.LeadTimeDays, req.SpecialInstructions)
+		defaultServicesJSON, req.AutoScheduleEnabled, req.LeadTimeDays, req.SpecialInstructions,
+		addressRotationJSON, weekdayAddressesJSON)
 
 	if err != nil {
 		http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
@@ -882,6 +984,19 @@ func (h *SubscriptionHandler) handleCreateOrUpdateSubscriptionPreferences(w http
 	json.NewEncoder(w).Encode(map[string]string{"message": "Preferences saved successfully"})
 }
 
+// userOwnsAddresses reports whether every given address belongs to the user
+func (h *SubscriptionHandler) userOwnsAddresses(userID int, addressIDs ...int) bool {
+	for _, addressID := range addressIDs {
+		var count int
+		err := h.db.QueryRow("SELECT COUNT(*) FROM addresses WHERE id = $1 AND user_id = $2",
+			addressID, userID).Scan(&count)
+		if err != nil || count == 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // processSubscriptionPlanChange handles the complete process of changing subscription plans
 func (h *SubscriptionHandler) processSubscriptionPlanChange(subscriptionID, userID, currentPlanID, newPlanID int, stripeSubscriptionID sql.NullString) error {
 	// Validate new plan exists and is active
@@ -889,11 +1004,15 @@ func (h *SubscriptionHandler) processSubscriptionPlanChange(subscriptionID, user
 	var newPlanPriceCents int
 	var currentPlanPriceCents int
 	
-	err := h.db.QueryRow(`
-		SELECT EXISTS(SELECT 1 FROM subscription_plans WHERE id = $1 AND is_active = true),
+	marketID, err := customerMarketID(h.db, userID)
+	if err != nil {
+		return err
+	}
+	err = h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM subscription_plans WHERE id = $1 AND is_active = true AND `+fmt.Sprintf(soldInMarketSQL, "subscription_plans", "$3")+`),
 		       (SELECT price_per_month_cents FROM subscription_plans WHERE id = $1),
 		       (SELECT price_per_month_cents FROM subscription_plans WHERE id = $2)
-	`, newPlanID, currentPlanID).Scan(&planExists, &newPlanPriceCents, &currentPlanPriceCents)
+	`, newPlanID, currentPlanID, marketID).Scan(&planExists, &newPlanPriceCents, &currentPlanPriceCents)
 	
 	if err != nil || !planExists {
 		return fmt.Errorf("invalid_plan")
@@ -913,7 +1032,7 @@ func (h *SubscriptionHandler) processSubscriptionPlanChange(subscriptionID, user
 
 	// Update Stripe subscription if we have one
 	if stripeSubscriptionID.Valid {
-		err = h.updateStripeSubscriptionPlan(stripeSubscriptionID.String, newPlanID)
+		err = h.updateStripeSubscriptionPlan(stripeSubscriptionID.String, newPlanID, "create_prorations")
 		if err != nil {
 			return fmt.Errorf("stripe_update_failed: %v", err)
 		}
@@ -961,22 +1080,21 @@ func (h *SubscriptionHandler) calculateProrationPreview(preview *SubscriptionCha
 	// Create a preview of the subscription update to get proration amount
 	// Note: This is a simplified approach. In production, you might want to use
 	// Stripe's upcoming invoice preview API for more accurate calculations
-	currentPrice := float64(sub.Items.Data[0].Price.UnitAmount) / 100
-	newPrice := float64(pricePerMonthCents) / 100.0
+	currentPriceCents := int(sub.Items.Data[0].Price.UnitAmount)
 	
 	// Calculate simple price difference for preview
 	// Note: This is a simplified calculation. For accurate proration,
 	// use Stripe's invoice preview API in production
-	priceDifference := newPrice - currentPrice
+	differenceCents := pricePerMonthCents - currentPriceCents
 	
-	if priceDifference > 0 {
+	if differenceCents > 0 {
 		// For upgrades, proration will be added to next invoice
-		preview.ImmediateCharge = priceDifference
-		preview.ProrationDescription = fmt.Sprintf("Upgrade to %s plan - $%.2f prorated charge will be added to your next bill", planName, priceDifference)
-	} else if priceDifference < 0 {
+		preview.ImmediateCharge = centsToDollars(differenceCents)
+		preview.ProrationDescription = fmt.Sprintf("Upgrade to %s plan - %s prorated charge will be added to your next bill", planName, money.Format(differenceCents))
+	} else if differenceCents < 0 {
 		// For downgrades, proration credit will reduce next invoice
-		preview.ImmediateCredit = -priceDifference
-		preview.ProrationDescription = fmt.Sprintf("Downgrade to %s plan - $%.2f prorated credit will reduce your next bill", planName, -priceDifference)
+		preview.ImmediateCredit = centsToDollars(-differenceCents)
+		preview.ProrationDescription = fmt.Sprintf("Downgrade to %s plan - %s prorated credit will reduce your next bill", planName, money.Format(-differenceCents))
 	} else {
 		preview.ProrationDescription = "No additional charge - plans have the same price"
 	}
@@ -984,8 +1102,9 @@ func (h *SubscriptionHandler) calculateProrationPreview(preview *SubscriptionCha
 	return nil
 }
 
-// updateStripeSubscriptionPlan updates the Stripe subscription to use a new plan
-func (h *SubscriptionHandler) updateStripeSubscriptionPlan(stripeSubscriptionID string, newPlanID int) error {
+// updateStripeSubscriptionPlan updates the Stripe subscription to use a new plan.
+// prorationBehavior is passed through to Stripe ("create_prorations" or "none").
+func (h *SubscriptionHandler) updateStripeSubscriptionPlan(stripeSubscriptionID string, newPlanID int, prorationBehavior string) error {
 	// Get plan details
 	var planName string
 	var pricePerMonthCents int
@@ -1017,7 +1136,7 @@ func (h *SubscriptionHandler) updateStripeSubscriptionPlan(stripeSubscriptionID
 				Price: stripe.String(priceID),
 			},
 		},
-		ProrationBehavior: stripe.String("create_prorations"),
+		ProrationBehavior: stripe.String(prorationBehavior),
 	}
 
 	_, err = subscription.Update(stripeSubscriptionID, params)
@@ -1025,7 +1144,7 @@ func (h *SubscriptionHandler) updateStripeSubscriptionPlan(stripeSubscriptionID
 		return fmt.Errorf("failed to update Stripe subscription: %v", err)
 	}
 
-	log.Printf("Successfully updated Stripe subscription %s to new plan with proration", stripeSubscriptionID)
+	log.Printf("Successfully updated Stripe subscription %s to new plan (proration: %s)", stripeSubscriptionID, prorationBehavior)
 	return nil
 }
 
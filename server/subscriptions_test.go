@@ -842,6 +842,92 @@ func TestSubscriptionHandler_CreateSubscriptionPreferences_InvalidAddress(t *tes
 	}
 }
 
+func TestSubscriptionHandler_SubscriptionPreferences_MultiStop(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "test@example.com", "Test", "User")
+	homeAddrID := db.CreateTestAddress(t, userID)
+	officeAddrID := db.CreateTestAddress(t, userID)
+	otherUserID := db.CreateTestUser(t, "other@example.com", "Other", "User")
+	otherUserAddrID := db.CreateTestAddress(t, otherUserID)
+
+	handler := NewSubscriptionHandler(db.DB)
+	handler.getUserID = func(r *http.Request, db *sql.DB) (int, error) {
+		return userID, nil
+	}
+
+	tests := []struct {
+		name           string
+		rotation       []AddressStop
+		weekdays       map[string]AddressStop
+		expectedStatus int
+	}{
+		{
+			name:           "Rotation of own addresses",
+			rotation:       []AddressStop{{homeAddrID, homeAddrID}, {officeAddrID, officeAddrID}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Weekday mapping",
+			weekdays:       map[string]AddressStop{"friday": {officeAddrID, homeAddrID}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Invalid weekday",
+			weekdays:       map[string]AddressStop{"someday": {homeAddrID, homeAddrID}},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Another user's address",
+			rotation:       []AddressStop{{homeAddrID, homeAddrID}, {otherUserAddrID, otherUserAddrID}},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqBody := CreateSubscriptionPreferencesRequest{
+				DefaultPickupAddressID:   &homeAddrID,
+				DefaultDeliveryAddressID: &homeAddrID,
+				PreferredPickupDay:       "friday",
+				AutoScheduleEnabled:      true,
+				AddressRotation:          tt.rotation,
+				WeekdayAddresses:         tt.weekdays,
+			}
+
+			body, _ := json.Marshal(reqBody)
+			req := httptest.NewRequest("PUT", "/api/subscriptions/preferences", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			handler.handleCreateOrUpdateSubscriptionPreferences(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			getReq := httptest.NewRequest("GET", "/api/subscriptions/preferences", nil)
+			getW := httptest.NewRecorder()
+			handler.handleGetSubscriptionPreferences(getW, getReq)
+
+			var prefs SubscriptionPreferences
+			if err := json.Unmarshal(getW.Body.Bytes(), &prefs); err != nil {
+				t.Fatalf("Failed to unmarshal preferences: %v", err)
+			}
+			if len(prefs.AddressRotation) != len(tt.rotation) {
+				t.Errorf("Expected %d rotation stops, got %d", len(tt.rotation), len(prefs.AddressRotation))
+			}
+			if len(prefs.WeekdayAddresses) != len(tt.weekdays) {
+				t.Errorf("Expected %d weekday addresses, got %d", len(tt.weekdays), len(prefs.WeekdayAddresses))
+			}
+		})
+	}
+}
+
 func TestSubscriptionHandler_GetSubscriptionPreferences_Unauthorized(t *testing.T) {
 	db := SetupTestDB(t)
 	defer db.CleanupTestDB()
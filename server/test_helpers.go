@@ -73,7 +73,8 @@ func (db *TestDB) CleanupTestDB() {
 }
 
 // TruncateTables clears all data from tables while preserving structure
-// Note: services and subscription_plans are NOT truncated to preserve seed data
+// Note: services and subscription_plans are NOT truncated to preserve seed data;
+// seeded services are restored instead
 func (db *TestDB) TruncateTables(t *testing.T) {
 	tables := []string{
 		"order_status_history",
@@ -91,6 +92,57 @@ func (db *TestDB) TruncateTables(t *testing.T) {
 			t.Errorf("Failed to truncate table %s: %v", table, err)
 		}
 	}
+
+	// Per-market slot limits would make later tests' pickups look full
+	if _, err := db.Exec("TRUNCATE TABLE pickup_slot_capacities RESTART IDENTITY"); err != nil {
+		t.Errorf("Failed to truncate table pickup_slot_capacities: %v", err)
+	}
+	// A leftover intake pause would turn away later tests' orders
+	if _, err := db.Exec("TRUNCATE TABLE intake_pauses RESTART IDENTITY"); err != nil {
+		t.Errorf("Failed to truncate table intake_pauses: %v", err)
+	}
+	// Markets can't be truncated without cascading into the catalog that
+	// references them, so untie it first
+	for _, table := range []string{"services", "subscription_plans"} {
+		if _, err := db.Exec(fmt.Sprintf("UPDATE %s SET market_id = NULL", table)); err != nil {
+			t.Errorf("Failed to untie %s from markets: %v", table, err)
+		}
+	}
+	if _, err := db.Exec("DELETE FROM markets"); err != nil {
+		t.Errorf("Failed to delete markets: %v", err)
+	}
+	db.restoreSeededServices(t)
+}
+
+// seededServices are the services rows migrations 000004 and 000009 insert,
+// in id order
+var seededServices = []struct {
+	name        string
+	description string
+	priceCents  int
+}{
+	{"pickup_service", "Pickup Service", 1000},
+	{"standard_bag", `Standard Bag (22"×33", ~2 loads)`, 3000},
+	{"rush_bag", "Rush Service (faster turnaround)", 1000},
+	{"additional_bag", "Additional Standard Bag", 3000},
+	{"bedding", "Bedding", 2500},
+	{"pickup_service", "Pickup and delivery service", 1000},
+	{"sensitive_skin_detergent", "Sensitive Skin Detergent add-on", 300},
+	{"scent_booster", "Scent Booster add-on", 300},
+}
+
+// restoreSeededServices undoes any renaming or repricing a test made to the
+// seeded services so the next test sees the catalog the migrations created
+func (db *TestDB) restoreSeededServices(t *testing.T) {
+	for i, service := range seededServices {
+		_, err := db.Exec(`
+			UPDATE services SET name = $2, description = $3, base_price_cents = $4, is_active = true
+			WHERE id = $1`,
+			i+1, service.name, service.description, service.priceCents)
+		if err != nil {
+			t.Errorf("Failed to restore seeded service %s: %v", service.name, err)
+		}
+	}
 }
 
 // CreateTestUser creates a test user and returns the user ID
@@ -207,6 +259,19 @@ func (db *TestDB) GetPlanID(t *testing.T, planName string) int {
 	return planID
 }
 
+// CompleteTestDriverOnboarding marks every onboarding step done so the driver can be assigned routes
+func (db *TestDB) CompleteTestDriverOnboarding(t *testing.T, driverID int) {
+	_, err := db.Exec(`
+		INSERT INTO driver_onboarding_progress (driver_id, step)
+		SELECT $1, step FROM driver_onboarding_steps
+		ON CONFLICT (driver_id, step) DO NOTHING`,
+		driverID,
+	)
+	if err != nil {
+		t.Fatalf("Failed to complete onboarding for driver %d: %v", driverID, err)
+	}
+}
+
 
 // CreateTestJWTToken creates a test JWT token for authentication
 func CreateTestJWTToken(userID int) string {
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"github.com/stripe/stripe-go/v82"
+)
+
+// Tracing records a span for each API request and for the SQL, Redis and
+// Stripe calls made while serving it, and exports them to an OpenTelemetry
+// collector over OTLP/HTTP with JSON encoding. It is off unless an endpoint
+// is configured.
+//
+//	OTEL_EXPORTER_OTLP_ENDPOINT         collector base URL, e.g. http://otel-collector:4318
+//	OTEL_EXPORTER_OTLP_TRACES_ENDPOINT  full traces URL, overriding the above
+//	OTEL_SERVICE_NAME                   service.name on every span (default tumble-backend)
+//	OTEL_TRACES_SAMPLER_ARG             fraction of new traces recorded, 0-1 (default 1)
+//
+// Trace context comes in on the W3C traceparent header and goes back out on
+// the response. SQL and Redis calls only get a span when their context
+// carries one, that is when a handler makes them with the Context variants,
+// so scheduled jobs don't start a trace per query.
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	tracingQueueSize     = 4096
+	tracingBatchSize     = 256
+	tracingFlushInterval = 5 * time.Second
+
+	// maxSpanStatementLength keeps huge generated SQL out of the collector
+	maxSpanStatementLength = 1000
+)
+
+type TracingConfig struct {
+	Endpoint    string
+	ServiceName string
+	SampleRatio float64
+}
+
+// tracingConfigFromEnv reads the OTLP settings. A sample ratio out of range
+// is an error rather than silently ignored.
+func tracingConfigFromEnv() (TracingConfig, error) {
+	config := TracingConfig{
+		Endpoint:    os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+		SampleRatio: 1,
+	}
+	if config.Endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			config.Endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = "tumble-backend"
+	}
+	if raw := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); raw != "" {
+		ratio, err := strconv.ParseFloat(raw, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return TracingConfig{}, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be between 0 and 1")
+		}
+		config.SampleRatio = ratio
+	}
+	return config, nil
+}
+
+// Tracer starts spans and exports them in batches. A nil Tracer records
+// nothing, so every hook below is safe to install unconditionally.
+type Tracer struct {
+	config  TracingConfig
+	client  *http.Client
+	queue   chan *Span
+	dropped atomic.Int64
+}
+
+// NewTracer returns nil when no endpoint is configured
+func NewTracer(config TracingConfig) *Tracer {
+	if config.Endpoint == "" {
+		return nil
+	}
+	return &Tracer{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *Span, tracingQueueSize),
+	}
+}
+
+// Start exports finished spans in the background until the process exits
+func (t *Tracer) Start() {
+	if t == nil {
+		return
+	}
+	log.Printf("Exporting traces to %s as %s, sampling %.0f%% of new traces",
+		t.config.Endpoint, t.config.ServiceName, t.config.SampleRatio*100)
+	go func() {
+		ticker := time.NewTicker(tracingFlushInterval)
+		defer ticker.Stop()
+		var batch []*Span
+		for {
+			select {
+			case span := <-t.queue:
+				batch = append(batch, span)
+				if len(batch) < tracingBatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			if err := t.export(batch); err != nil {
+				log.Printf("Failed to export %d spans: %v", len(batch), err)
+			}
+			batch = nil
+			if dropped := t.dropped.Swap(0); dropped > 0 {
+				log.Printf("Dropped %d spans while the export queue was full", dropped)
+			}
+		}
+	}()
+}
+
+// Span is one timed operation in a trace. Its methods are no-ops on a nil
+// Span, which is what callers get when the trace isn't being recorded.
+type Span struct {
+	tracer     *Tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+type spanContextKey struct{}
+
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a child of the span in ctx. Without one there's no trace
+// to add to, and it returns ctx and a nil span.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	return (*Tracer)(nil).startSpan(ctx, name, spanKindInternal)
+}
+
+// startSpan starts a child of the span in ctx, or a new sampled trace on t
+// when there isn't one
+func (t *Tracer) startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	span := &Span{name: name, kind: kind, start: time.Now(), attributes: map[string]interface{}{}}
+	if parent := spanFromContext(ctx); parent != nil {
+		span.tracer = parent.tracer
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		if t == nil || !t.sample() {
+			return ctx, nil
+		}
+		span.tracer = t
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func (t *Tracer) sample() bool {
+	if t.config.SampleRatio >= 1 {
+		return true
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < t.config.SampleRatio
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s != nil {
+		s.attributes[key] = value
+	}
+}
+
+// End finishes the span and queues it for export. A non-nil err marks it
+// failed.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	select {
+	case s.tracer.queue <- s:
+	default:
+		s.tracer.dropped.Add(1)
+	}
+}
+
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// parseTraceparent reads a W3C traceparent header. ok is false for anything
+// malformed, in which case the request starts a trace of its own.
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceID, parentID, false, false
+	}
+	var flags [1]byte
+	_, traceErr := hex.Decode(traceID[:], []byte(parts[1]))
+	_, parentErr := hex.Decode(parentID[:], []byte(parts[2]))
+	_, flagsErr := hex.Decode(flags[:], []byte(parts[3]))
+	if traceErr != nil || parentErr != nil || flagsErr != nil || traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// Middleware traces each request as a server span named after its route,
+// continuing the caller's trace when it sent a sampled traceparent and
+// skipping the request when it sent an unsampled one
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			if !sampled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx = context.WithValue(ctx, spanContextKey{}, &Span{tracer: t, traceID: traceID, spanID: parentID})
+		}
+
+		name := r.Method
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				name += " " + template
+			}
+		}
+		ctx, span := t.startSpan(ctx, name, spanKindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		w.Header().Set("traceparent", span.traceparent())
+
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+		span.SetAttribute("http.response.status_code", wrapped.statusCode)
+		var err error
+		if wrapped.statusCode >= http.StatusInternalServerError {
+			err = fmt.Errorf("HTTP %d", wrapped.statusCode)
+		}
+		span.End(err)
+	})
+}
+
+// tracingRoundTripper records a client span per Stripe API call. Stripe
+// calls are rare and slow enough to be worth a trace of their own when the
+// caller didn't pass a context.
+type tracingRoundTripper struct {
+	tracer *Tracer
+	next   http.RoundTripper
+}
+
+func (rt *tracingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, span := rt.tracer.startSpan(req.Context(), "stripe "+req.Method+" "+req.URL.Path, spanKindClient)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", req.URL.Host)
+	span.SetAttribute("url.path", req.URL.Path)
+	resp, err := rt.next.RoundTrip(req)
+	if err == nil {
+		span.SetAttribute("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		span.End(err)
+		return resp, nil
+	}
+	span.End(err)
+	return nil, err
+}
+
+// stripeTransport wraps next so Stripe calls are traced
+func (t *Tracer) stripeTransport(next http.RoundTripper) http.RoundTripper {
+	if t == nil {
+		return next
+	}
+	return &tracingRoundTripper{tracer: t, next: next}
+}
+
+// instrumentStripe points stripe-go at transport. Like chaos mode's fault
+// injection it must run before the first Stripe call, since stripe-go builds
+// its backends lazily from the client set here.
+func instrumentStripe(transport http.RoundTripper) {
+	if transport != http.DefaultTransport {
+		stripe.SetHTTPClient(&http.Client{Timeout: 80 * time.Second, Transport: transport})
+	}
+}
+
+// tracingRedisHook records a span per Redis command made with a traced context
+type tracingRedisHook struct{}
+
+func (tracingRedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (tracingRedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		_, span := (*Tracer)(nil).startSpan(ctx, "redis "+cmd.Name(), spanKindClient)
+		span.SetAttribute("db.system", "redis")
+		err := next(ctx, cmd)
+		if errors.Is(err, redis.Nil) {
+			span.End(nil)
+		} else {
+			span.End(err)
+		}
+		return err
+	}
+}
+
+func (tracingRedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		_, span := (*Tracer)(nil).startSpan(ctx, "redis pipeline", spanKindClient)
+		span.SetAttribute("db.system", "redis")
+		span.SetAttribute("db.operation.batch.size", len(cmds))
+		err := next(ctx, cmds)
+		if errors.Is(err, redis.Nil) {
+			span.End(nil)
+		} else {
+			span.End(err)
+		}
+		return err
+	}
+}
+
+// instrumentRedis adds the tracing hook to a Redis client
+func (t *Tracer) instrumentRedis(client *redis.Client) {
+	if t != nil {
+		client.AddHook(tracingRedisHook{})
+	}
+}
+
+// sqlDriver wraps next so queries and execs made with a traced context get
+// a span carrying their statement. Arguments are left out; they're customer
+// data.
+func (t *Tracer) sqlDriver(next driver.Driver) driver.Driver {
+	if t == nil {
+		return next
+	}
+	return &tracingDriver{next: next}
+}
+
+type tracingDriver struct {
+	next driver.Driver
+}
+
+func (d *tracingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.next.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tracingConn{Conn: conn}, nil
+}
+
+// tracingConn wraps a connection, timing queries and execs and delegating
+// everything else untouched
+type tracingConn struct {
+	driver.Conn
+}
+
+func startSQLSpan(ctx context.Context, query string) *Span {
+	operation := strings.ToUpper(strings.Fields(query + " query")[0])
+	_, span := (*Tracer)(nil).startSpan(ctx, "sql "+operation, spanKindClient)
+	if span != nil {
+		if len(query) > maxSpanStatementLength {
+			query = query[:maxSpanStatementLength] + "..."
+		}
+		span.SetAttribute("db.system", "postgresql")
+		span.SetAttribute("db.statement", strings.Join(strings.Fields(query), " "))
+	}
+	return span
+}
+
+func (c *tracingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if prep, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return prep.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *tracingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if begin, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return begin.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *tracingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startSQLSpan(ctx, query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	span.End(err)
+	return rows, err
+}
+
+func (c *tracingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startSQLSpan(ctx, query)
+	result, err := execer.ExecContext(ctx, query, args)
+	span.End(err)
+	return result, err
+}
+
+func (c *tracingConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracingConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracingConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// OTLP/JSON request body, trimmed to the fields we send. IDs are hex and
+// 64-bit integers are strings, per the protobuf JSON mapping.
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	converted := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		var value otlpValue
+		switch v := attributes[key].(type) {
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case bool:
+			value.BoolValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		converted = append(converted, otlpAttribute{Key: key, Value: value})
+	}
+	return converted
+}
+
+func (t *Tracer) otlpRequest(spans []*Span) otlpTraceRequest {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	scope.Scope.Name = "tumble-backend"
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            otlpStatus{Code: 1},
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+	return otlpTraceRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": t.config.ServiceName})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
+
+// export posts one batch of finished spans to the collector
+func (t *Tracer) export(spans []*Span) error {
+	body, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.config.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// drainSpans returns the spans a tracer has finished and not yet exported
+func drainSpans(tracer *Tracer) []*Span {
+	var spans []*Span
+	for {
+		select {
+		case span := <-tracer.queue:
+			spans = append(spans, span)
+		default:
+			return spans
+		}
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		sampled bool
+		ok      bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		traceID, parentID, sampled, ok := parseTraceparent(tt.header)
+		if ok != tt.ok || sampled != tt.sampled {
+			t.Errorf("%q: expected ok %v sampled %v, got %v %v", tt.header, tt.ok, tt.sampled, ok, sampled)
+		}
+		if ok && (hex.EncodeToString(traceID[:]) != tt.header[3:35] || hex.EncodeToString(parentID[:]) != tt.header[36:52]) {
+			t.Errorf("%q: got trace %x parent %x", tt.header, traceID, parentID)
+		}
+	}
+}
+
+func TestTracerMiddleware(t *testing.T) {
+	tracer := NewTracer(TracingConfig{Endpoint: "http://collector.invalid/v1/traces", ServiceName: "test", SampleRatio: 1})
+
+	router := mux.NewRouter()
+	router.Use(tracer.Middleware)
+	router.HandleFunc("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := StartSpan(r.Context(), "lookup")
+		span.End(errors.New("no such order"))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	})
+
+	req := httptest.NewRequest("GET", "/orders/42", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	spans := drainSpans(tracer)
+	if len(spans) != 2 {
+		t.Fatalf("Expected a server span and its child, got %d spans", len(spans))
+	}
+	child, server := spans[0], spans[1]
+	if server.name != "GET /orders/{id}" || server.kind != spanKindServer || server.err == nil {
+		t.Errorf("Unexpected server span %s kind %d err %v", server.name, server.kind, server.err)
+	}
+	if hex.EncodeToString(server.traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		hex.EncodeToString(server.parentID[:]) != "00f067aa0ba902b7" {
+		t.Errorf("Expected the server span to continue the caller's trace, got %x under %x", server.traceID, server.parentID)
+	}
+	if child.traceID != server.traceID || child.parentID != server.spanID || child.err == nil {
+		t.Errorf("Expected the child span under the server span, got %x under %x", child.traceID, child.parentID)
+	}
+	if status := server.attributes["http.response.status_code"]; status != http.StatusInternalServerError {
+		t.Errorf("Expected the status code recorded, got %v", status)
+	}
+	if w.Header().Get("traceparent") != server.traceparent() {
+		t.Errorf("Expected the response to carry the trace, got %q", w.Header().Get("traceparent"))
+	}
+
+	// A caller that isn't sampling isn't traced
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if spans := drainSpans(tracer); len(spans) != 0 {
+		t.Errorf("Expected no spans for an unsampled trace, got %d", len(spans))
+	}
+
+	// Without tracing configured nothing is wrapped or recorded
+	var off *Tracer
+	if _, span := off.startSpan(context.Background(), "request", spanKindServer); span != nil {
+		t.Error("Expected a nil tracer not to start spans")
+	}
+}
+
+func TestTracingDriver(t *testing.T) {
+	tracer := NewTracer(TracingConfig{Endpoint: "http://collector.invalid/v1/traces", ServiceName: "test", SampleRatio: 1})
+	db := sql.OpenDB(driverConnector{driver: tracer.sqlDriver(chaosTestDriver{})})
+	defer db.Close()
+
+	// Scheduled jobs and other untraced callers don't start traces
+	if _, err := db.Exec("UPDATE orders SET status = 'cancelled'"); err != nil {
+		t.Fatal(err)
+	}
+	if spans := drainSpans(tracer); len(spans) != 0 {
+		t.Fatalf("Expected no spans outside a trace, got %d", len(spans))
+	}
+
+	ctx, request := tracer.startSpan(context.Background(), "POST /api/v1/orders", spanKindServer)
+	if _, err := db.ExecContext(ctx, "UPDATE orders\n\tSET status = $1 WHERE id = $2", "cancelled", 42); err != nil {
+		t.Fatal(err)
+	}
+	spans := drainSpans(tracer)
+	if len(spans) != 1 {
+		t.Fatalf("Expected one span for the statement, got %d", len(spans))
+	}
+	if spans[0].name != "sql UPDATE" || spans[0].parentID != request.spanID ||
+		spans[0].attributes["db.statement"] != "UPDATE orders SET status = $1 WHERE id = $2" {
+		t.Errorf("Unexpected statement span %s %v", spans[0].name, spans[0].attributes)
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	var received otlpTraceRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected export to %s as %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer collector.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL+"/")
+	t.Setenv("OTEL_TRACES_SAMPLER_ARG", "")
+	config, err := tracingConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(config)
+
+	ctx, parent := tracer.startSpan(context.Background(), "POST /api/v1/orders", spanKindServer)
+	_, child := StartSpan(ctx, "redeemCredits")
+	child.SetAttribute("credits.applied", true)
+	child.End(errors.New("ledger locked"))
+	parent.End(nil)
+	if err := tracer.export(drainSpans(tracer)); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+
+	if len(received.ResourceSpans) != 1 || len(received.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Unexpected export %+v", received)
+	}
+	resource := received.ResourceSpans[0].Resource.Attributes
+	if len(resource) != 1 || resource[0].Key != "service.name" || *resource[0].Value.StringValue != "tumble-backend" {
+		t.Errorf("Expected the default service name, got %+v", resource)
+	}
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected two spans, got %d", len(spans))
+	}
+	if spans[0].Name != "redeemCredits" || spans[0].ParentSpanID != spans[1].SpanID || spans[0].TraceID != spans[1].TraceID {
+		t.Errorf("Expected redeemCredits under the request, got %+v", spans[0])
+	}
+	if spans[0].Status.Code != 2 || spans[0].Status.Message != "ledger locked" || spans[1].Status.Code != 1 {
+		t.Errorf("Unexpected statuses %+v and %+v", spans[0].Status, spans[1].Status)
+	}
+	if spans[1].ParentSpanID != "" || spans[1].Kind != spanKindServer {
+		t.Errorf("Expected the request as the root server span, got %+v", spans[1])
+	}
+
+	t.Setenv("OTEL_TRACES_SAMPLER_ARG", "1.5")
+	if _, err := tracingConfigFromEnv(); err == nil {
+		t.Error("Expected a sample ratio over 1 to be rejected")
+	}
+}
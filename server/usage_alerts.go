@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// UsageProjection estimates where a subscriber will land at the end of the
+// billing period if they keep their current pace
+type UsageProjection struct {
+	DaysElapsed      int          `json:"days_elapsed"`
+	DaysRemaining    int          `json:"days_remaining"`
+	PercentUsed      float64      `json:"percent_used"`
+	ProjectedUsage   int          `json:"projected_usage"`
+	ProjectedOverage int          `json:"projected_overage"`
+	OnPaceToExceed   bool         `json:"on_pace_to_exceed"`
+	ShouldAlert      bool         `json:"should_alert"`
+	UpgradePlan      *UpgradePlan `json:"upgrade_plan,omitempty"`
+}
+
+// UpgradePlan is the plan suggested to subscribers heading over quota
+type UpgradePlan struct {
+	ID              int     `json:"id"`
+	Name            string  `json:"name"`
+	PricePerMonth   float64 `json:"price_per_month"`
+	PickupsPerMonth int     `json:"pickups_per_month"`
+}
+
+const (
+	// Subscribers are alerted once they've used this share of their quota...
+	usageAlertThreshold = 0.8
+	// ...while at least this many days remain in the period
+	usageAlertMinDaysRemaining = 10
+	usageAlertNotificationType = "usage_projection_alert"
+)
+
+// parsePeriodDate accepts the formats period dates come back from Postgres in
+func parsePeriodDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// projectUsage linearly extrapolates usage to the end of the period
+func projectUsage(used, allowed int, periodStart, periodEnd, now time.Time) UsageProjection {
+	totalDays := int(math.Round(periodEnd.Sub(periodStart).Hours() / 24))
+	elapsed := int(now.Sub(periodStart).Hours()/24) + 1 // today counts as elapsed
+	if elapsed < 1 {
+		elapsed = 1
+	}
+	if elapsed > totalDays {
+		elapsed = totalDays
+	}
+
+	projection := UsageProjection{
+		DaysElapsed:    elapsed,
+		DaysRemaining:  totalDays - elapsed,
+		ProjectedUsage: used,
+	}
+	if totalDays > 0 {
+		projection.ProjectedUsage = int(math.Ceil(float64(used) * float64(totalDays) / float64(elapsed)))
+	}
+	if projection.ProjectedUsage < used {
+		projection.ProjectedUsage = used
+	}
+
+	if allowed > 0 {
+		projection.PercentUsed = float64(used) / float64(allowed)
+	}
+	if projection.ProjectedUsage > allowed {
+		projection.ProjectedOverage = projection.ProjectedUsage - allowed
+		projection.OnPaceToExceed = true
+	}
+
+	projection.ShouldAlert = projection.DaysRemaining > 0 && (projection.OnPaceToExceed ||
+		(projection.PercentUsed >= usageAlertThreshold && projection.DaysRemaining >= usageAlertMinDaysRemaining))
+
+	return projection
+}
+
+// findUpgradePlan returns the cheapest active plan that covers the projected
+// usage, falling back to the largest plan bigger than the current one
+func findUpgradePlan(db *sql.DB, currentPickups, projectedUsage int) (*UpgradePlan, error) {
+	var plan UpgradePlan
+	var priceCents int
+	err := db.QueryRow(`
+		SELECT id, name, price_per_month_cents, pickups_per_month
+		FROM subscription_plans
+		WHERE is_active = true AND pickups_per_month > $1
+		ORDER BY (pickups_per_month >= $2) DESC,
+		         CASE WHEN pickups_per_month >= $2 THEN price_per_month_cents ELSE -pickups_per_month END ASC
+		LIMIT 1`,
+		currentPickups, projectedUsage,
+	).Scan(&plan.ID, &plan.Name, &priceCents, &plan.PickupsPerMonth)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plan.PricePerMonth = centsToDollars(priceCents)
+	return &plan, nil
+}
+
+// processUsageAlerts notifies active subscribers who are on pace to exceed
+// their quota. Each subscriber is alerted at most once per billing period.
+func (s *AutoScheduler) processUsageAlerts() {
+	log.Println("Processing subscription usage alerts...")
+
+	rows, err := s.db.Query(`
+		SELECT s.user_id, s.current_period_start, s.current_period_end, p.pickups_per_month,
+			(SELECT COUNT(*) FROM orders o
+			 WHERE o.user_id = s.user_id AND o.subscription_id = s.id
+			   AND o.pickup_date >= s.current_period_start
+			   AND o.pickup_date < s.current_period_end
+			   AND o.status != 'cancelled') as pickups_used
+		FROM subscriptions s
+		JOIN subscription_plans p ON s.plan_id = p.id
+		WHERE s.status = 'active' AND `+notDeactivated("s.user_id")+`
+		  AND NOT EXISTS (
+			SELECT 1 FROM notifications n
+			WHERE n.user_id = s.user_id AND n.type = $1
+			  AND n.created_at >= s.current_period_start
+		  )`,
+		usageAlertNotificationType,
+	)
+	if err != nil {
+		log.Printf("Error fetching subscriptions for usage alerts: %v", err)
+		return
+	}
+
+	type subscriberUsage struct {
+		UserID         int
+		PeriodStart    string
+		PeriodEnd      string
+		PickupsAllowed int
+		PickupsUsed    int
+	}
+	var subscribers []subscriberUsage
+	for rows.Next() {
+		var su subscriberUsage
+		if err := rows.Scan(&su.UserID, &su.PeriodStart, &su.PeriodEnd, &su.PickupsAllowed, &su.PickupsUsed); err != nil {
+			log.Printf("Error scanning subscription usage: %v", err)
+			continue
+		}
+		subscribers = append(subscribers, su)
+	}
+	rows.Close()
+
+	alerted := 0
+	now := time.Now().UTC()
+	for _, su := range subscribers {
+		periodStart, err := parsePeriodDate(su.PeriodStart)
+		if err != nil {
+			continue
+		}
+		periodEnd, err := parsePeriodDate(su.PeriodEnd)
+		if err != nil {
+			continue
+		}
+
+		projection := projectUsage(su.PickupsUsed, su.PickupsAllowed, periodStart, periodEnd, now)
+		if !projection.ShouldAlert {
+			continue
+		}
+
+		message := fmt.Sprintf("You've used %d of %d pickups with %d days left in your billing period.",
+			su.PickupsUsed, su.PickupsAllowed, projection.DaysRemaining)
+		if upgrade, err := findUpgradePlan(s.db, su.PickupsAllowed, projection.ProjectedUsage); err == nil && upgrade != nil {
+			message += fmt.Sprintf(" Upgrade to %s for %d pickups a month and avoid over-quota fees.",
+				upgrade.Name, upgrade.PickupsPerMonth)
+		}
+
+		_, err = s.db.Exec(`
+			INSERT INTO notifications (user_id, type, title, message)
+			VALUES ($1, $2, $3, $4)`,
+			su.UserID, usageAlertNotificationType, "You're on pace to exceed your plan", message,
+		)
+		if err != nil {
+			log.Printf("Error creating usage alert for user %d: %v", su.UserID, err)
+			continue
+		}
+		alerted++
+	}
+
+	log.Printf("Finished processing usage alerts - %d subscribers notified", alerted)
+}
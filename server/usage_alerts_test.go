@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProjectUsage(t *testing.T) {
+	periodStart := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	periodEnd := time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC) // 30 day period
+
+	tests := []struct {
+		name              string
+		used              int
+		allowed           int
+		now               time.Time
+		expectedProjected int
+		expectedRemaining int
+		onPaceToExceed    bool
+		shouldAlert       bool
+	}{
+		{
+			name:              "Light usage mid-cycle",
+			used:              1,
+			allowed:           8,
+			now:               time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC),
+			expectedProjected: 2,
+			expectedRemaining: 15,
+		},
+		{
+			name:              "80% used with more than 10 days left",
+			used:              4,
+			allowed:           5,
+			now:               time.Date(2025, 3, 20, 0, 0, 0, 0, time.UTC),
+			expectedProjected: 6,
+			expectedRemaining: 10,
+			onPaceToExceed:    true,
+			shouldAlert:       true,
+		},
+		{
+			name:              "High usage near the end of the period",
+			used:              4,
+			allowed:           5,
+			now:               time.Date(2025, 3, 29, 0, 0, 0, 0, time.UTC),
+			expectedProjected: 5,
+			expectedRemaining: 1,
+		},
+		{
+			name:              "Early heavy usage projects an overage",
+			used:              2,
+			allowed:           4,
+			now:               time.Date(2025, 3, 5, 0, 0, 0, 0, time.UTC),
+			expectedProjected: 12,
+			expectedRemaining: 25,
+			onPaceToExceed:    true,
+			shouldAlert:       true,
+		},
+		{
+			name:              "Period already over",
+			used:              6,
+			allowed:           4,
+			now:               time.Date(2025, 4, 5, 0, 0, 0, 0, time.UTC),
+			expectedProjected: 6,
+			expectedRemaining: 0,
+			onPaceToExceed:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := projectUsage(tt.used, tt.allowed, periodStart, periodEnd, tt.now)
+
+			if p.ProjectedUsage != tt.expectedProjected {
+				t.Errorf("Expected projected usage %d, got %d", tt.expectedProjected, p.ProjectedUsage)
+			}
+			if p.DaysRemaining != tt.expectedRemaining {
+				t.Errorf("Expected %d days remaining, got %d", tt.expectedRemaining, p.DaysRemaining)
+			}
+			if p.OnPaceToExceed != tt.onPaceToExceed {
+				t.Errorf("Expected on_pace_to_exceed %v, got %v", tt.onPaceToExceed, p.OnPaceToExceed)
+			}
+			if p.ShouldAlert != tt.shouldAlert {
+				t.Errorf("Expected should_alert %v, got %v", tt.shouldAlert, p.ShouldAlert)
+			}
+		})
+	}
+}
+
+func TestParsePeriodDate(t *testing.T) {
+	for _, value := range []string{"2025-03-01", "2025-03-01T00:00:00Z"} {
+		parsed, err := parsePeriodDate(value)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", value, err)
+			continue
+		}
+		if parsed.Format("2006-01-02") != "2025-03-01" {
+			t.Errorf("Expected 2025-03-01, got %s", parsed.Format("2006-01-02"))
+		}
+	}
+
+	if _, err := parsePeriodDate("March 1st"); err == nil {
+		t.Error("Expected error for unparseable date")
+	}
+}
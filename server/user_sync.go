@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Headers on signed user sync requests, in both directions. The signature is
+// a hex HMAC-SHA256 of "<timestamp>.<nonce>.<body>" with the shared secret.
+const (
+	userSyncTimestampHeader = "X-Tumble-Timestamp"
+	userSyncNonceHeader     = "X-Tumble-Nonce"
+	userSyncSignatureHeader = "X-Tumble-Signature"
+)
+
+// userSyncMaxSkew is how far a signed request's timestamp may drift from our
+// clock. Nonces only need remembering for this long either side.
+const userSyncMaxSkew = 5 * time.Minute
+
+type UserSyncConfig struct {
+	WebhookURL string
+	Secret     string
+	RetryDelay time.Duration
+}
+
+// userSyncConfigFromEnv reads the sync configuration. Outbound callbacks are
+// disabled when USER_SYNC_WEBHOOK_URL is not set, and both directions are
+// disabled without USER_SYNC_SECRET.
+func userSyncConfigFromEnv() UserSyncConfig {
+	return UserSyncConfig{
+		WebhookURL: os.Getenv("USER_SYNC_WEBHOOK_URL"),
+		Secret:     os.Getenv("USER_SYNC_SECRET"),
+		RetryDelay: 2 * time.Second,
+	}
+}
+
+// UserSyncHandler keeps the Next.js app's NextAuth session claims in step
+// with the users table. Admin changes to a user's role, status or profile are
+// pushed to the app as signed callbacks, and the app can pull a user's
+// current claims from us with a signed, replay-protected request.
+type UserSyncHandler struct {
+	db     *sql.DB
+	config UserSyncConfig
+	client *http.Client
+}
+
+func NewUserSyncHandler(db *sql.DB, config UserSyncConfig) *UserSyncHandler {
+	return &UserSyncHandler{
+		db:     db,
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// UserSyncClaims are the user fields NextAuth keeps in its session token
+type UserSyncClaims struct {
+	UserID    int    `json:"user_id"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Role      string `json:"role"`
+	Status    string `json:"status"`
+}
+
+type UserSyncEvent struct {
+	Event  string         `json:"event"` // user.created, user.updated or user.deleted
+	User   UserSyncClaims `json:"user"`
+	SentAt time.Time      `json:"sent_at"`
+}
+
+type UserSyncRequest struct {
+	UserID int    `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+func getUserSyncClaims(db *sql.DB, userID int) (*UserSyncClaims, error) {
+	var claims UserSyncClaims
+	err := db.QueryRow(`
+		SELECT id, email, first_name, last_name, role, status
+		FROM users WHERE id = $1`,
+		userID,
+	).Scan(&claims.UserID, &claims.Email, &claims.FirstName, &claims.LastName, &claims.Role, &claims.Status)
+	if err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func signUserSync(secret, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyUser pushes a user's current claims to the app. Safe to call on a nil
+// or unconfigured handler, and never blocks the admin request that made the
+// change.
+func (h *UserSyncHandler) notifyUser(event string, userID int) {
+	if h == nil || h.config.WebhookURL == "" || h.config.Secret == "" {
+		return
+	}
+	claims, err := getUserSyncClaims(h.db, userID)
+	if err != nil {
+		log.Printf("User sync: failed to load user %d for %s: %v", userID, event, err)
+		return
+	}
+	h.notifyClaims(event, *claims)
+}
+
+// notifyClaims pushes claims captured by the caller, for users that no longer
+// exist by the time the callback goes out
+func (h *UserSyncHandler) notifyClaims(event string, claims UserSyncClaims) {
+	if h == nil || h.config.WebhookURL == "" || h.config.Secret == "" {
+		return
+	}
+	body, err := json.Marshal(UserSyncEvent{Event: event, User: claims, SentAt: time.Now().UTC()})
+	if err != nil {
+		log.Printf("User sync: failed to encode %s for user %d: %v", event, claims.UserID, err)
+		return
+	}
+	go func() {
+		if err := h.deliver(body); err != nil {
+			log.Printf("User sync: giving up on %s for user %d: %v", event, claims.UserID, err)
+		}
+	}()
+}
+
+// deliver posts a signed callback, retrying a few times with backoff. Each
+// attempt is signed afresh so a retry isn't rejected as a replay.
+func (h *UserSyncHandler) deliver(body []byte) error {
+	const attempts = 3
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(h.config.RetryDelay * time.Duration(attempt-1))
+		}
+
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req, err := http.NewRequest(http.MethodPost, h.config.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(userSyncTimestampHeader, timestamp)
+		req.Header.Set(userSyncNonceHeader, hex.EncodeToString(nonce))
+		req.Header.Set(userSyncSignatureHeader, signUserSync(h.config.Secret, timestamp, hex.EncodeToString(nonce), body))
+
+		resp, err := h.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("callback returned %d", resp.StatusCode)
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			// The app rejected the payload; retrying won't change its mind
+			break
+		}
+	}
+	return lastErr
+}
+
+var (
+	errUserSyncSignature = errors.New("invalid signature")
+	errUserSyncExpired   = errors.New("request timestamp outside the allowed window")
+	errUserSyncReplay    = errors.New("request already processed")
+)
+
+// verifyUserSyncRequest checks an inbound request's signature and timestamp,
+// then claims its nonce so the same request can't be replayed
+func (h *UserSyncHandler) verifyUserSyncRequest(r *http.Request, body []byte) error {
+	timestamp := r.Header.Get(userSyncTimestampHeader)
+	nonce := r.Header.Get(userSyncNonceHeader)
+	signature := r.Header.Get(userSyncSignatureHeader)
+	if nonce == "" || len(nonce) > 100 {
+		return errUserSyncSignature
+	}
+	expected := signUserSync(h.config.Secret, timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errUserSyncSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errUserSyncSignature
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > userSyncMaxSkew || skew < -userSyncMaxSkew {
+		return errUserSyncExpired
+	}
+
+	// Nonces older than the window can't be replayed anyway, since their
+	// timestamps would be rejected above
+	if _, err := h.db.Exec(
+		"DELETE FROM user_sync_nonces WHERE received_at < CURRENT_TIMESTAMP - make_interval(secs => $1)",
+		(2 * userSyncMaxSkew).Seconds(),
+	); err != nil {
+		return err
+	}
+	result, err := h.db.Exec(
+		"INSERT INTO user_sync_nonces (nonce) VALUES ($1) ON CONFLICT (nonce) DO NOTHING",
+		nonce,
+	)
+	if err != nil {
+		return err
+	}
+	if claimed, _ := result.RowsAffected(); claimed == 0 {
+		return errUserSyncReplay
+	}
+	return nil
+}
+
+// handleUserSync returns a user's current claims to the Next.js app, looked
+// up by user_id or email. Requests must be signed with the shared secret.
+func (h *UserSyncHandler) handleUserSync(w http.ResponseWriter, r *http.Request) {
+	if h.config.Secret == "" {
+		http.Error(w, "User sync is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := h.verifyUserSyncRequest(r, body); err != nil {
+		switch err {
+		case errUserSyncSignature, errUserSyncExpired:
+			http.Error(w, "Invalid or expired signature", http.StatusUnauthorized)
+		case errUserSyncReplay:
+			http.Error(w, "Request already processed", http.StatusConflict)
+		default:
+			http.Error(w, "Failed to verify request", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var req UserSyncRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	userID := req.UserID
+	if userID == 0 && req.Email != "" {
+		err = h.db.QueryRow("SELECT id FROM users WHERE email = $1", req.Email).Scan(&userID)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+			return
+		}
+	}
+	if userID == 0 && req.Email == "" {
+		http.Error(w, "user_id or email is required", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := getUserSyncClaims(h.db, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserSyncEvent{Event: "user.current", User: *claims, SentAt: time.Now().UTC()})
+}
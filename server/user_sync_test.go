@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUserSyncDeliver_SignsAndRetries(t *testing.T) {
+	var calls int32
+	nonces := map[string]bool{}
+	var received UserSyncEvent
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(userSyncTimestampHeader)
+		nonce := r.Header.Get(userSyncNonceHeader)
+		if r.Header.Get(userSyncSignatureHeader) != signUserSync("shared-secret", timestamp, nonce, body) || nonces[nonce] {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		nonces[nonce] = true
+		// Fail the first attempt to exercise the retry
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer app.Close()
+
+	handler := NewUserSyncHandler(nil, UserSyncConfig{WebhookURL: app.URL, Secret: "shared-secret", RetryDelay: time.Millisecond})
+	body, _ := json.Marshal(UserSyncEvent{
+		Event: "user.updated",
+		User:  UserSyncClaims{UserID: 4, Email: "sync@example.com", Role: "driver", Status: "active"},
+	})
+	if err := handler.deliver(body); err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	if calls != 2 || received.User.Role != "driver" {
+		t.Errorf("Expected 2 signed attempts delivering the driver role, got %d calls and %+v", calls, received)
+	}
+
+	// A rejected payload isn't retried
+	handler.config.Secret = "wrong-secret"
+	calls = 0
+	if err := handler.deliver(body); err == nil {
+		t.Error("Expected an error when the app rejects the signature")
+	}
+	if calls != 0 {
+		t.Errorf("Expected no retries after a 401, got %d successful calls", calls)
+	}
+}
+
+func TestUserSync_ReplayProtection(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	userID := db.CreateTestUser(t, "claims@example.com", "Claims", "User")
+	db.Exec("UPDATE users SET role = 'driver', status = 'suspended' WHERE id = $1", userID)
+	handler := NewUserSyncHandler(db.DB, UserSyncConfig{Secret: "shared-secret"})
+
+	send := func(body []byte, timestamp time.Time, nonce, secret string) *httptest.ResponseRecorder {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		req := httptest.NewRequest("POST", "/api/v1/auth/sync", bytes.NewReader(body))
+		req.Header.Set(userSyncTimestampHeader, ts)
+		req.Header.Set(userSyncNonceHeader, nonce)
+		req.Header.Set(userSyncSignatureHeader, signUserSync(secret, ts, nonce, body))
+		w := httptest.NewRecorder()
+		handler.handleUserSync(w, req)
+		return w
+	}
+
+	body := []byte(`{"email": "claims@example.com"}`)
+	w := send(body, time.Now(), "nonce-1", "shared-secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var event UserSyncEvent
+	json.Unmarshal(w.Body.Bytes(), &event)
+	if event.User.UserID != userID || event.User.Role != "driver" || event.User.Status != "suspended" {
+		t.Errorf("Expected the user's current claims, got %+v", event.User)
+	}
+
+	if w := send(body, time.Now(), "nonce-1", "shared-secret"); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a replayed nonce, got %d", http.StatusConflict, w.Code)
+	}
+	if w := send(body, time.Now().Add(-10*time.Minute), "nonce-2", "shared-secret"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a stale timestamp, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := send(body, time.Now(), "nonce-3", "wrong-secret"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a bad signature, got %d", http.StatusUnauthorized, w.Code)
+	}
+	missing := []byte(fmt.Sprintf(`{"user_id": %d}`, userID+1000))
+	if w := send(missing, time.Now(), "nonce-4", "shared-secret"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown user, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,790 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	weatherSeverityModerate = "moderate"
+	weatherSeveritySevere   = "severe"
+
+	// Forecasts are checked this many days ahead, today included
+	weatherForecastDays = 7
+	// Routes can be pushed out at most this far from the bad-weather day
+	weatherRescheduleMaxDays = 14
+
+	weatherRescheduleNotificationType = "weather_reschedule"
+)
+
+// WeatherDay is one day of a market's forecast
+type WeatherDay struct {
+	Date            string  `json:"date"`         // YYYY-MM-DD
+	WeatherCode     int     `json:"weather_code"` // WMO weather interpretation code
+	PrecipitationMM float64 `json:"precipitation_mm"`
+	SnowfallCM      float64 `json:"snowfall_cm"`
+	WindGustKmh     float64 `json:"wind_gust_kmh"`
+}
+
+// WeatherForecaster returns daily forecasts for a point from start to end
+type WeatherForecaster interface {
+	DailyForecast(ctx context.Context, point LatLng, start, end time.Time) ([]WeatherDay, error)
+}
+
+// OpenMeteoForecaster uses the Open-Meteo forecast API
+type OpenMeteoForecaster struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewOpenMeteoForecaster(baseURL string) *OpenMeteoForecaster {
+	return &OpenMeteoForecaster{baseURL: strings.TrimRight(baseURL, "/"), client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (o *OpenMeteoForecaster) DailyForecast(ctx context.Context, point LatLng, start, end time.Time) ([]WeatherDay, error) {
+	endpoint := o.baseURL + "/v1/forecast?" + url.Values{
+		"latitude":   {strconv.FormatFloat(point.Latitude, 'f', 4, 64)},
+		"longitude":  {strconv.FormatFloat(point.Longitude, 'f', 4, 64)},
+		"daily":      {"weather_code,precipitation_sum,snowfall_sum,wind_gusts_10m_max"},
+		"timezone":   {"auto"},
+		"start_date": {start.Format("2006-01-02")},
+		"end_date":   {end.Format("2006-01-02")},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open-meteo forecast returned %s", resp.Status)
+	}
+
+	// Values are null for days the model doesn't cover
+	var body struct {
+		Daily struct {
+			Time          []string   `json:"time"`
+			WeatherCode   []*int     `json:"weather_code"`
+			Precipitation []*float64 `json:"precipitation_sum"`  // mm
+			Snowfall      []*float64 `json:"snowfall_sum"`       // cm
+			WindGusts     []*float64 `json:"wind_gusts_10m_max"` // km/h
+		} `json:"daily"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	daily := body.Daily
+	if len(daily.WeatherCode) != len(daily.Time) || len(daily.Precipitation) != len(daily.Time) ||
+		len(daily.Snowfall) != len(daily.Time) || len(daily.WindGusts) != len(daily.Time) {
+		return nil, fmt.Errorf("open-meteo forecast returned mismatched daily series")
+	}
+
+	value := func(v *float64) float64 {
+		if v == nil {
+			return 0
+		}
+		return *v
+	}
+	days := make([]WeatherDay, 0, len(daily.Time))
+	for i, date := range daily.Time {
+		if daily.WeatherCode[i] == nil {
+			continue
+		}
+		days = append(days, WeatherDay{
+			Date:            date,
+			WeatherCode:     *daily.WeatherCode[i],
+			PrecipitationMM: value(daily.Precipitation[i]),
+			SnowfallCM:      value(daily.Snowfall[i]),
+			WindGustKmh:     value(daily.WindGusts[i]),
+		})
+	}
+	return days, nil
+}
+
+// weatherFromEnv returns the Open-Meteo forecaster when WEATHER_FORECAST_URL
+// is set. Without one, no advisories are raised.
+func weatherFromEnv() WeatherForecaster {
+	if baseURL := os.Getenv("WEATHER_FORECAST_URL"); baseURL != "" {
+		return NewOpenMeteoForecaster(baseURL)
+	}
+	return nil
+}
+
+// riskyWeatherCodes are the WMO codes that disrupt driving on their own
+var riskyWeatherCodes = map[int]struct {
+	severity    string
+	description string
+}{
+	65: {weatherSeverityModerate, "Heavy rain"},
+	66: {weatherSeverityModerate, "Freezing rain"},
+	67: {weatherSeveritySevere, "Heavy freezing rain"},
+	75: {weatherSeveritySevere, "Heavy snow"},
+	82: {weatherSeverityModerate, "Violent rain showers"},
+	86: {weatherSeveritySevere, "Heavy snow showers"},
+	95: {weatherSeverityModerate, "Thunderstorms"},
+	96: {weatherSeveritySevere, "Thunderstorms with hail"},
+	99: {weatherSeveritySevere, "Thunderstorms with heavy hail"},
+}
+
+// Daily totals past which a day is risky whatever its weather code
+const (
+	moderateSnowfallCM      = 5.0
+	severeSnowfallCM        = 15.0
+	moderateWindGustKmh     = 65.0
+	severeWindGustKmh       = 90.0
+	moderatePrecipitationMM = 25.0
+	severePrecipitationMM   = 50.0
+)
+
+// classifyWeather returns how risky a forecast day is for drivers and why,
+// or an empty severity when it isn't
+func classifyWeather(day WeatherDay) (severity, summary string) {
+	var reasons []string
+	flag := func(s, reason string) {
+		if severity != weatherSeveritySevere {
+			severity = s
+		}
+		reasons = append(reasons, reason)
+	}
+	if code, ok := riskyWeatherCodes[day.WeatherCode]; ok {
+		flag(code.severity, code.description)
+	}
+	threshold := func(value, moderate, severe float64, reason string) {
+		switch {
+		case value >= severe:
+			flag(weatherSeveritySevere, reason)
+		case value >= moderate:
+			flag(weatherSeverityModerate, reason)
+		}
+	}
+	threshold(day.SnowfallCM, moderateSnowfallCM, severeSnowfallCM, fmt.Sprintf("%.0f cm of snow", day.SnowfallCM))
+	threshold(day.WindGustKmh, moderateWindGustKmh, severeWindGustKmh, fmt.Sprintf("gusts to %.0f km/h", day.WindGustKmh))
+	threshold(day.PrecipitationMM, moderatePrecipitationMM, severePrecipitationMM, fmt.Sprintf("%.0f mm of rain", day.PrecipitationMM))
+	if severity == "" {
+		return "", ""
+	}
+	summary = strings.Join(reasons, ", ")
+	return severity, strings.ToUpper(summary[:1]) + summary[1:]
+}
+
+// weatherMarketLocations returns a point to forecast for each market we
+// serve or have work in from start to end: the middle of its geocoded
+// addresses
+func weatherMarketLocations(db *sql.DB, start, end time.Time) (map[string]LatLng, error) {
+	rows, err := db.Query(`
+		SELECT LEFT(a.zip_code, 3), AVG(a.latitude)::float8, AVG(a.longitude)::float8
+		FROM addresses a
+		WHERE a.latitude IS NOT NULL AND a.longitude IS NOT NULL
+		GROUP BY LEFT(a.zip_code, 3)
+		HAVING LEFT(a.zip_code, 3) IN (SELECT LEFT(zip_code, 3) FROM service_areas WHERE is_active = true)
+			OR bool_or(EXISTS (
+				SELECT 1 FROM orders o
+				WHERE (o.pickup_address_id = a.id OR o.delivery_address_id = a.id)
+				  AND o.status NOT IN ('delivered', 'cancelled')
+				  AND (o.pickup_date BETWEEN $1 AND $2 OR o.delivery_date BETWEEN $1 AND $2)
+			))`,
+		start.Format("2006-01-02"), end.Format("2006-01-02"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := map[string]LatLng{}
+	for rows.Next() {
+		var market string
+		var point LatLng
+		if err := rows.Scan(&market, &point.Latitude, &point.Longitude); err != nil {
+			return nil, err
+		}
+		if isMarket(market) {
+			locations[market] = point
+		}
+	}
+	return locations, rows.Err()
+}
+
+// WeatherRefresh is what one pass over the forecasts found
+type WeatherRefresh struct {
+	Markets int `json:"markets"`
+	Flagged int `json:"flagged"`
+	Cleared int `json:"cleared"`
+	Failed  int `json:"failed"`
+	// Raised holds advisories that are new or got worse
+	Raised []WeatherAdvisory `json:"raised"`
+}
+
+// refreshWeatherAdvisories forecasts every market for the days from start
+// and stores the risky ones. Advisories whose risk has passed are removed
+// unless routes were already moved for them. A market whose forecast can't
+// be fetched keeps the advisories it had.
+func refreshWeatherAdvisories(ctx context.Context, db *sql.DB, forecaster WeatherForecaster, start time.Time, days int) (WeatherRefresh, error) {
+	var refresh WeatherRefresh
+	end := start.AddDate(0, 0, days-1)
+	locations, err := weatherMarketLocations(db, start, end)
+	if err != nil {
+		return refresh, err
+	}
+	markets := make([]string, 0, len(locations))
+	for market := range locations {
+		markets = append(markets, market)
+	}
+	sort.Strings(markets)
+
+	for _, market := range markets {
+		forecast, err := forecaster.DailyForecast(ctx, locations[market], start, end)
+		if err != nil {
+			log.Printf("Failed to fetch weather forecast for market %s: %v", market, err)
+			refresh.Failed++
+			continue
+		}
+		refresh.Markets++
+
+		flagged := []string{}
+		for _, day := range forecast {
+			severity, summary := classifyWeather(day)
+			if severity == "" {
+				continue
+			}
+			var previous sql.NullString
+			err := db.QueryRow("SELECT severity FROM weather_advisories WHERE market = $1 AND advisory_date = $2",
+				market, day.Date).Scan(&previous)
+			if err != nil && err != sql.ErrNoRows {
+				return refresh, err
+			}
+			advisory, err := scanWeatherAdvisory(db.QueryRow(`
+				INSERT INTO weather_advisories (market, advisory_date, severity, summary,
+					weather_code, precipitation_mm, snowfall_cm, wind_gust_kmh)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+				ON CONFLICT (market, advisory_date) DO UPDATE
+				SET severity = EXCLUDED.severity, summary = EXCLUDED.summary,
+				    weather_code = EXCLUDED.weather_code, precipitation_mm = EXCLUDED.precipitation_mm,
+				    snowfall_cm = EXCLUDED.snowfall_cm, wind_gust_kmh = EXCLUDED.wind_gust_kmh,
+				    fetched_at = CURRENT_TIMESTAMP
+				RETURNING `+weatherAdvisoryColumns,
+				market, day.Date, severity, summary, day.WeatherCode, day.PrecipitationMM, day.SnowfallCM, day.WindGustKmh,
+			))
+			if err != nil {
+				return refresh, err
+			}
+			flagged = append(flagged, day.Date)
+			refresh.Flagged++
+			if !previous.Valid || (previous.String != weatherSeveritySevere && severity == weatherSeveritySevere) {
+				refresh.Raised = append(refresh.Raised, advisory)
+			}
+		}
+
+		res, err := db.Exec(`
+			DELETE FROM weather_advisories
+			WHERE market = $1 AND advisory_date BETWEEN $2 AND $3
+			  AND rescheduled_at IS NULL AND NOT (advisory_date::text = ANY($4))`,
+			market, start.Format("2006-01-02"), end.Format("2006-01-02"), pq.Array(flagged),
+		)
+		if err != nil {
+			return refresh, err
+		}
+		cleared, _ := res.RowsAffected()
+		refresh.Cleared += int(cleared)
+	}
+	return refresh, nil
+}
+
+// WeatherAdvisory is a market's weather risk on one day
+type WeatherAdvisory struct {
+	ID              int        `json:"id"`
+	Market          string     `json:"market"`
+	Date            string     `json:"date"`
+	Severity        string     `json:"severity"`
+	Summary         string     `json:"summary"`
+	WeatherCode     *int       `json:"weather_code,omitempty"`
+	PrecipitationMM *float64   `json:"precipitation_mm,omitempty"`
+	SnowfallCM      *float64   `json:"snowfall_cm,omitempty"`
+	WindGustKmh     *float64   `json:"wind_gust_kmh,omitempty"`
+	FetchedAt       time.Time  `json:"fetched_at"`
+	RescheduledTo   *string    `json:"rescheduled_to,omitempty"`
+	RescheduledBy   *int       `json:"rescheduled_by,omitempty"`
+	RescheduledAt   *time.Time `json:"rescheduled_at,omitempty"`
+	// Open routes with stops in the market that day, and the orders due
+	// there whether routed or not; set when listing for admins
+	Routes         []WeatherAffectedRoute `json:"routes,omitempty"`
+	AffectedOrders int                    `json:"affected_orders"`
+}
+
+const weatherAdvisoryColumns = `id, market, advisory_date::text, severity, summary,
+	weather_code, precipitation_mm::float8, snowfall_cm::float8, wind_gust_kmh::float8, fetched_at,
+	rescheduled_to::text, rescheduled_by, rescheduled_at`
+
+func scanWeatherAdvisory(scanner interface{ Scan(...interface{}) error }) (WeatherAdvisory, error) {
+	var a WeatherAdvisory
+	var code, rescheduledBy sql.NullInt64
+	var precipitation, snowfall, gusts sql.NullFloat64
+	var rescheduledTo sql.NullString
+	var rescheduledAt sql.NullTime
+	err := scanner.Scan(&a.ID, &a.Market, &a.Date, &a.Severity, &a.Summary,
+		&code, &precipitation, &snowfall, &gusts, &a.FetchedAt,
+		&rescheduledTo, &rescheduledBy, &rescheduledAt)
+	if err != nil {
+		return a, err
+	}
+	if code.Valid {
+		c := int(code.Int64)
+		a.WeatherCode = &c
+	}
+	if precipitation.Valid {
+		a.PrecipitationMM = &precipitation.Float64
+	}
+	if snowfall.Valid {
+		a.SnowfallCM = &snowfall.Float64
+	}
+	if gusts.Valid {
+		a.WindGustKmh = &gusts.Float64
+	}
+	if rescheduledTo.Valid {
+		a.RescheduledTo = &rescheduledTo.String
+	}
+	if rescheduledBy.Valid {
+		by := int(rescheduledBy.Int64)
+		a.RescheduledBy = &by
+	}
+	if rescheduledAt.Valid {
+		a.RescheduledAt = &rescheduledAt.Time
+	}
+	return a, nil
+}
+
+// DayWeatherRisk is the advisory customers see on a pickup day
+type DayWeatherRisk struct {
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+}
+
+// weatherRisksByDate returns a market's advisories from start to end, keyed
+// by date
+func weatherRisksByDate(db *sql.DB, market string, start, end time.Time) (map[string]*DayWeatherRisk, error) {
+	rows, err := db.Query(`
+		SELECT advisory_date::text, severity, summary FROM weather_advisories
+		WHERE market = $1 AND advisory_date BETWEEN $2 AND $3`,
+		market, start.Format("2006-01-02"), end.Format("2006-01-02"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	risks := map[string]*DayWeatherRisk{}
+	for rows.Next() {
+		var date string
+		var risk DayWeatherRisk
+		if err := rows.Scan(&date, &risk.Severity, &risk.Summary); err != nil {
+			return nil, err
+		}
+		risks[date] = &risk
+	}
+	return risks, rows.Err()
+}
+
+// WeatherAffectedRoute is an open route with stops in an advisory's market
+type WeatherAffectedRoute struct {
+	RouteID    int    `json:"route_id"`
+	RouteType  string `json:"route_type"`
+	Status     string `json:"status"`
+	DriverID   *int   `json:"driver_id,omitempty"`
+	DriverName string `json:"driver_name,omitempty"`
+	// Stops is how many of the route's stops are in the market
+	Stops int `json:"stops"`
+}
+
+// weatherAffectedRoutes returns the open routes on date with a stop in
+// market. A pickup stop is at the order's pickup address and a delivery
+// stop at its delivery address.
+func weatherAffectedRoutes(q queryer, market, date string) ([]WeatherAffectedRoute, error) {
+	rows, err := q.Query(`
+		SELECT dr.id, dr.route_type, dr.status, dr.driver_id,
+			COALESCE(u.first_name || ' ' || u.last_name, ''), COUNT(*)
+		FROM driver_routes dr
+		JOIN route_orders ro ON ro.route_id = dr.id
+		JOIN orders o ON o.id = ro.order_id
+		JOIN addresses a ON a.id = CASE WHEN dr.route_type = 'pickup' THEN o.pickup_address_id
+			ELSE COALESCE(o.delivery_address_id, o.pickup_address_id) END
+		LEFT JOIN users u ON u.id = dr.driver_id
+		WHERE dr.route_date = $2 AND dr.status <> ALL($3) AND LEFT(a.zip_code, 3) = $1
+		GROUP BY dr.id, u.first_name, u.last_name
+		ORDER BY dr.id`,
+		market, date, pq.Array(closedRouteStatuses),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	routes := []WeatherAffectedRoute{}
+	for rows.Next() {
+		var route WeatherAffectedRoute
+		var driverID sql.NullInt64
+		if err := rows.Scan(&route.RouteID, &route.RouteType, &route.Status, &driverID, &route.DriverName, &route.Stops); err != nil {
+			return nil, err
+		}
+		if driverID.Valid {
+			id := int(driverID.Int64)
+			route.DriverID = &id
+		}
+		routes = append(routes, route)
+	}
+	return routes, rows.Err()
+}
+
+// processWeatherAdvisories refreshes advisories from the latest forecasts
+// and tells ops about new bad-weather days that have routes planned
+func (s *AutoScheduler) processWeatherAdvisories() {
+	if s.weather == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	refresh, err := refreshWeatherAdvisories(ctx, s.db, s.weather, today, weatherForecastDays)
+	if err != nil {
+		log.Printf("Error refreshing weather advisories: %v", err)
+		return
+	}
+	if refresh.Flagged > 0 || refresh.Cleared > 0 || refresh.Failed > 0 {
+		log.Printf("Weather advisories: %d days flagged, %d cleared, %d markets failed", refresh.Flagged, refresh.Cleared, refresh.Failed)
+	}
+
+	for _, advisory := range refresh.Raised {
+		routes, err := weatherAffectedRoutes(s.db, advisory.Market, advisory.Date)
+		if err != nil {
+			log.Printf("Error loading routes for weather advisory %d: %v", advisory.ID, err)
+			continue
+		}
+		if len(routes) == 0 {
+			continue
+		}
+		routeIDs := make([]int, len(routes))
+		for i, route := range routes {
+			routeIDs[i] = route.RouteID
+		}
+		severity := "warning"
+		if advisory.Severity == weatherSeveritySevere {
+			severity = "critical"
+		}
+		logAdminAlert(s.db, AdminAlert{
+			Type:     "weather_advisory",
+			Severity: severity,
+			Title:    fmt.Sprintf("%s weather in %sxx on %s", strings.ToUpper(advisory.Severity[:1])+advisory.Severity[1:], advisory.Market, advisory.Date),
+			Message: fmt.Sprintf("%s. %d routes have stops there; reschedule them from the weather advisories page if needed",
+				advisory.Summary, len(routes)),
+			DedupeKey: fmt.Sprintf("weather_advisory:%s:%s:%s", advisory.Market, advisory.Date, advisory.Severity),
+			Data:      map[string]interface{}{"advisory_id": advisory.ID, "route_ids": routeIDs},
+		})
+	}
+}
+
+// handleGetWeatherAdvisories lists advisories from today, or from and to,
+// with the routes and orders each affects
+func (h *AdminHandler) handleGetWeatherAdvisories(w http.ResponseWriter, r *http.Request) {
+	from := time.Now().UTC().Truncate(24 * time.Hour)
+	to := from.AddDate(0, 0, weatherForecastDays-1)
+	for param, date := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := r.URL.Query().Get(param); value != "" {
+			parsed, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				http.Error(w, "Invalid "+param+" date", http.StatusBadRequest)
+				return
+			}
+			*date = parsed
+		}
+	}
+
+	rows, err := h.db.Query(`
+		SELECT `+weatherAdvisoryColumns+` FROM weather_advisories
+		WHERE advisory_date BETWEEN $1 AND $2
+		ORDER BY advisory_date, market`,
+		from.Format("2006-01-02"), to.Format("2006-01-02"),
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch weather advisories", http.StatusInternalServerError)
+		return
+	}
+	advisories := []WeatherAdvisory{}
+	for rows.Next() {
+		advisory, err := scanWeatherAdvisory(rows)
+		if err != nil {
+			rows.Close()
+			http.Error(w, "Failed to fetch weather advisories", http.StatusInternalServerError)
+			return
+		}
+		advisories = append(advisories, advisory)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to fetch weather advisories", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range advisories {
+		a := &advisories[i]
+		if a.Routes, err = weatherAffectedRoutes(h.db, a.Market, a.Date); err != nil {
+			http.Error(w, "Failed to fetch affected routes", http.StatusInternalServerError)
+			return
+		}
+		err = h.db.QueryRow(`
+			SELECT COUNT(DISTINCT o.id) FROM orders o
+			JOIN addresses a ON a.id = o.pickup_address_id OR a.id = o.delivery_address_id
+			WHERE LEFT(a.zip_code, 3) = $1 AND o.status NOT IN ('delivered', 'cancelled')
+			  AND ((o.pickup_date = $2 AND a.id = o.pickup_address_id)
+			    OR (o.delivery_date = $2 AND a.id = COALESCE(o.delivery_address_id, o.pickup_address_id)))`,
+			a.Market, a.Date,
+		).Scan(&a.AffectedOrders)
+		if err != nil {
+			http.Error(w, "Failed to count affected orders", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(advisories)
+}
+
+type WeatherRescheduleRequest struct {
+	NewDate string `json:"new_date"` // YYYY-MM-DD
+	// RouteIDs limits the move to these routes; empty moves every planned
+	// route with stops in the market
+	RouteIDs []int `json:"route_ids,omitempty"`
+}
+
+// WeatherRescheduledOrder is a customer told their pickup or delivery moved
+type WeatherRescheduledOrder struct {
+	OrderID   int    `json:"order_id"`
+	RouteID   int    `json:"route_id"`
+	RouteType string `json:"route_type"`
+	NewDate   string `json:"new_date"`
+	userID    int
+	status    string
+	message   string
+}
+
+type WeatherRescheduleResponse struct {
+	Advisory    WeatherAdvisory           `json:"advisory"`
+	MovedRoutes []int                     `json:"moved_routes"`
+	Orders      []WeatherRescheduledOrder `json:"orders"`
+}
+
+// handleRescheduleWeatherRoutes moves an advisory's planned routes to
+// another day in one go. A moved route keeps its driver and stops; each
+// customer on it gets the new date, and a moved pickup pushes the delivery
+// out by as many days so turnaround is unchanged. Routes already under way
+// aren't moved.
+func (h *AdminHandler) handleRescheduleWeatherRoutes(w http.ResponseWriter, r *http.Request) {
+	advisoryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid advisory ID", http.StatusBadRequest)
+		return
+	}
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req WeatherRescheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	newDate, err := time.Parse("2006-01-02", req.NewDate)
+	if err != nil {
+		http.Error(w, "Invalid new_date", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	advisory, err := scanWeatherAdvisory(tx.QueryRow(
+		"SELECT "+weatherAdvisoryColumns+" FROM weather_advisories WHERE id = $1 FOR UPDATE", advisoryID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Weather advisory not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch weather advisory", http.StatusInternalServerError)
+		return
+	}
+
+	advisoryDate, _ := time.Parse("2006-01-02", advisory.Date)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	shiftDays := int(newDate.Sub(advisoryDate).Hours() / 24)
+	if !newDate.After(today) {
+		http.Error(w, "Routes can only be moved to a future day", http.StatusBadRequest)
+		return
+	}
+	if shiftDays == 0 {
+		http.Error(w, "Routes are already on that day", http.StatusBadRequest)
+		return
+	}
+	if shiftDays > weatherRescheduleMaxDays || shiftDays < -weatherRescheduleMaxDays {
+		http.Error(w, fmt.Sprintf("Routes can be moved at most %d days", weatherRescheduleMaxDays), http.StatusBadRequest)
+		return
+	}
+
+	affected, err := weatherAffectedRoutes(tx, advisory.Market, advisory.Date)
+	if err != nil {
+		http.Error(w, "Failed to fetch affected routes", http.StatusInternalServerError)
+		return
+	}
+	requested := map[int]bool{}
+	for _, id := range req.RouteIDs {
+		requested[id] = true
+	}
+	var routes []WeatherAffectedRoute
+	for _, route := range affected {
+		if len(requested) > 0 && !requested[route.RouteID] {
+			continue
+		}
+		delete(requested, route.RouteID)
+		if route.Status == "planned" {
+			routes = append(routes, route)
+		} else if len(req.RouteIDs) > 0 {
+			http.Error(w, fmt.Sprintf("Route %d has already started", route.RouteID), http.StatusConflict)
+			return
+		}
+	}
+	for id := range requested {
+		http.Error(w, fmt.Sprintf("Route %d isn't affected by this advisory", id), http.StatusBadRequest)
+		return
+	}
+	if len(routes) == 0 {
+		http.Error(w, "No planned routes to reschedule", http.StatusConflict)
+		return
+	}
+
+	newDay := newDate.Format("2006-01-02")
+	moved := []int{}
+	orders := []WeatherRescheduledOrder{}
+	for _, route := range routes {
+		rows, err := tx.Query(`
+			SELECT o.id, o.user_id, o.status FROM route_orders ro
+			JOIN orders o ON o.id = ro.order_id
+			WHERE ro.route_id = $1 AND ro.status = 'pending' AND o.status <> 'cancelled'
+			ORDER BY ro.sequence_number, ro.id`,
+			route.RouteID,
+		)
+		if err != nil {
+			http.Error(w, "Failed to fetch route stops", http.StatusInternalServerError)
+			return
+		}
+		var stops []WeatherRescheduledOrder
+		for rows.Next() {
+			o := WeatherRescheduledOrder{RouteID: route.RouteID, RouteType: route.RouteType, NewDate: newDay}
+			if err := rows.Scan(&o.OrderID, &o.userID, &o.status); err != nil {
+				rows.Close()
+				http.Error(w, "Failed to fetch route stops", http.StatusInternalServerError)
+				return
+			}
+			stops = append(stops, o)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Failed to fetch route stops", http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := tx.Exec("UPDATE driver_routes SET route_date = $2 WHERE id = $1", route.RouteID, newDay); err != nil {
+			http.Error(w, "Failed to reschedule route", http.StatusInternalServerError)
+			return
+		}
+		moved = append(moved, route.RouteID)
+
+		for _, o := range stops {
+			if route.RouteType == "pickup" {
+				_, err = tx.Exec(`
+					UPDATE orders
+					SET pickup_date = $2, delivery_date = delivery_date + $3::int, updated_at = CURRENT_TIMESTAMP
+					WHERE id = $1`,
+					o.OrderID, newDay, shiftDays,
+				)
+			} else {
+				_, err = tx.Exec("UPDATE orders SET delivery_date = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1",
+					o.OrderID, newDay)
+			}
+			if err != nil {
+				http.Error(w, "Failed to reschedule orders", http.StatusInternalServerError)
+				return
+			}
+
+			o.message = fmt.Sprintf("Because of %s expected on %s, your %s is moved to %s",
+				strings.ToLower(advisory.Summary), advisoryDate.Format("Monday, January 2"), o.RouteType, newDate.Format("Monday, January 2"))
+			_, err = tx.Exec(`
+				INSERT INTO notifications (user_id, order_id, type, title, message)
+				VALUES ($1, $2, $3, $4, $5)`,
+				o.userID, o.OrderID, weatherRescheduleNotificationType,
+				fmt.Sprintf("Your %s was rescheduled for weather", o.RouteType), o.message,
+			)
+			if err == nil {
+				_, err = tx.Exec(`
+					INSERT INTO order_status_history (order_id, status, notes, updated_by)
+					VALUES ($1, $2, $3, $4)`,
+					o.OrderID, o.status,
+					fmt.Sprintf("%s moved from %s to %s for weather: %s",
+						strings.ToUpper(o.RouteType[:1])+o.RouteType[1:], advisory.Date, newDay, advisory.Summary),
+					adminID,
+				)
+			}
+			if err != nil {
+				http.Error(w, "Failed to notify customers", http.StatusInternalServerError)
+				return
+			}
+			orders = append(orders, o)
+		}
+	}
+
+	advisory, err = scanWeatherAdvisory(tx.QueryRow(`
+		UPDATE weather_advisories
+		SET rescheduled_to = $2, rescheduled_by = $3, rescheduled_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+weatherAdvisoryColumns,
+		advisoryID, newDay, adminID,
+	))
+	if err != nil {
+		http.Error(w, "Failed to update weather advisory", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to reschedule routes", http.StatusInternalServerError)
+		return
+	}
+
+	if h.realtime != nil {
+		for _, o := range orders {
+			h.realtime.PublishOrderUpdate(o.userID, o.OrderID, o.status, o.message, map[string]string{
+				o.RouteType + "_date": o.NewDate,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WeatherRescheduleResponse{Advisory: advisory, MovedRoutes: moved, Orders: orders})
+}
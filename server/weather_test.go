@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestClassifyWeather(t *testing.T) {
+	tests := []struct {
+		name     string
+		day      WeatherDay
+		severity string
+		summary  string
+	}{
+		{"clear", WeatherDay{WeatherCode: 1, PrecipitationMM: 2, WindGustKmh: 30}, "", ""},
+		{"thunderstorm", WeatherDay{WeatherCode: 95, PrecipitationMM: 12}, weatherSeverityModerate, "Thunderstorms"},
+		{"hail", WeatherDay{WeatherCode: 96}, weatherSeveritySevere, "Thunderstorms with hail"},
+		{"gale", WeatherDay{WeatherCode: 3, WindGustKmh: 95}, weatherSeveritySevere, "Gusts to 95 km/h"},
+		// A severe reason isn't downgraded by a moderate one after it
+		{"blizzard", WeatherDay{WeatherCode: 75, SnowfallCM: 8, WindGustKmh: 70}, weatherSeveritySevere, "Heavy snow, 8 cm of snow, gusts to 70 km/h"},
+	}
+	for _, tt := range tests {
+		severity, summary := classifyWeather(tt.day)
+		if severity != tt.severity || summary != tt.summary {
+			t.Errorf("%s: expected %q %q, got %q %q", tt.name, tt.severity, tt.summary, severity, summary)
+		}
+	}
+}
+
+type fakeForecaster map[string]WeatherDay
+
+func (f fakeForecaster) DailyForecast(ctx context.Context, point LatLng, start, end time.Time) ([]WeatherDay, error) {
+	var days []WeatherDay
+	for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+		day, ok := f[date.Format("2006-01-02")]
+		if !ok {
+			day = WeatherDay{WeatherCode: 1}
+		}
+		day.Date = date.Format("2006-01-02")
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+func TestWeatherReschedule(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	adminID := db.CreateTestUser(t, "weather-admin@example.com", "Weather", "Admin")
+	driverID := db.CreateTestUser(t, "weather-driver@example.com", "Weather", "Driver")
+	db.Exec("UPDATE users SET role = 'driver' WHERE id = $1", driverID)
+	customerID := db.CreateTestUser(t, "weather-customer@example.com", "Weather", "Customer")
+	addressID := db.CreateTestAddress(t, customerID)
+	db.Exec("UPDATE addresses SET latitude = 37.5, longitude = -122.1 WHERE id = $1", addressID)
+	orderID := db.CreateTestOrder(t, customerID, addressID)
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	stormDay := today.AddDate(0, 0, 1)
+	var routeID int
+	db.QueryRow(`
+		INSERT INTO driver_routes (driver_id, route_date, route_type, status)
+		VALUES ($1, $2, 'pickup', 'planned') RETURNING id`, driverID, stormDay.Format("2006-01-02")).Scan(&routeID)
+	db.Exec("INSERT INTO route_orders (route_id, order_id, sequence_number) VALUES ($1, $2, 1)", routeID, orderID)
+
+	forecast := fakeForecaster{stormDay.Format("2006-01-02"): {WeatherCode: 96, WindGustKmh: 70}}
+	refresh, err := refreshWeatherAdvisories(context.Background(), db.DB, forecast, today, weatherForecastDays)
+	if err != nil || refresh.Flagged != 1 || len(refresh.Raised) != 1 {
+		t.Fatalf("Expected the storm flagged and raised, got %+v %v", refresh, err)
+	}
+	advisory := refresh.Raised[0]
+	if advisory.Market != "123" || advisory.Severity != weatherSeveritySevere {
+		t.Fatalf("Expected a severe advisory in market 123, got %+v", advisory)
+	}
+
+	days, err := pickupAvailability(context.Background(), db.DB, nil, stormDay, stormDay, "123")
+	if err != nil || len(days) != 1 || days[0].Weather == nil || days[0].Weather.Severity != weatherSeveritySevere {
+		t.Fatalf("Expected the storm on the day's availability, got %+v %v", days, err)
+	}
+
+	handler := &AdminHandler{db: db.DB, getUserID: CreateAuthMock(adminID).getUserIDFromRequest}
+	reschedule := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.handleRescheduleWeatherRoutes(w, mux.SetURLVars(
+			httptest.NewRequest("POST", "/api/v1/admin/weather/advisories/x/reschedule", strings.NewReader(body)),
+			map[string]string{"id": fmt.Sprint(advisory.ID)},
+		))
+		return w
+	}
+	if w := reschedule(`{"new_date": "` + stormDay.Format("2006-01-02") + `"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for the same day, got %d", http.StatusBadRequest, w.Code)
+	}
+	newDate := stormDay.AddDate(0, 0, 2).Format("2006-01-02")
+	w := reschedule(`{"new_date": "` + newDate + `"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp WeatherRescheduleResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.MovedRoutes) != 1 || resp.MovedRoutes[0] != routeID || resp.Advisory.RescheduledTo == nil {
+		t.Fatalf("Expected the route moved and the advisory marked, got %s", w.Body.String())
+	}
+
+	var routeDate, pickupDate, deliveryDate string
+	db.QueryRow("SELECT route_date::text FROM driver_routes WHERE id = $1", routeID).Scan(&routeDate)
+	db.QueryRow("SELECT pickup_date::text, delivery_date::text FROM orders WHERE id = $1", orderID).Scan(&pickupDate, &deliveryDate)
+	if routeDate != newDate || pickupDate != newDate || deliveryDate != today.AddDate(0, 0, 5).Format("2006-01-02") {
+		t.Errorf("Expected the route and pickup on %s with delivery pushed out, got %s, %s and %s", newDate, routeDate, pickupDate, deliveryDate)
+	}
+	var notified int
+	db.QueryRow("SELECT COUNT(*) FROM notifications WHERE order_id = $1 AND type = $2", orderID, weatherRescheduleNotificationType).Scan(&notified)
+	if notified != 1 {
+		t.Errorf("Expected the customer notified once, got %d", notified)
+	}
+
+	// Once acted on, the advisory stays after the forecast clears
+	refresh, err = refreshWeatherAdvisories(context.Background(), db.DB, fakeForecaster{}, today, weatherForecastDays)
+	var remaining int
+	db.QueryRow("SELECT COUNT(*) FROM weather_advisories WHERE id = $1", advisory.ID).Scan(&remaining)
+	if err != nil || refresh.Cleared != 0 || remaining != 1 {
+		t.Errorf("Expected the rescheduled advisory kept, got %+v, %d remaining, %v", refresh, remaining, err)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	// maxWebhookAttempts is how many times a delivery is tried before it's
+	// marked failed. Partners reconcile counts, so a late event still helps.
+	maxWebhookAttempts = 6
+	// webhookDispatchBatch bounds how many deliveries one dispatch run posts
+	webhookDispatchBatch = 100
+	// webhookSendLease is how long a claimed delivery is left alone before
+	// another dispatch run may try it
+	webhookSendLease = 5 * time.Minute
+	// webhookEventIDHeader carries the item event's ID so partners can drop
+	// an event they've already processed when a retry arrives
+	webhookEventIDHeader = "X-Tumble-Event-ID"
+)
+
+// webhookRetryBackoff is the wait before each retry of a failed delivery
+var webhookRetryBackoff = []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour, 6 * time.Hour}
+
+// WebhookEndpoint is a partner URL that item events are posted to
+type WebhookEndpoint struct {
+	ID          int       `json:"id"`
+	UserID      *int      `json:"user_id"` // Only this customer's orders; nil for all
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Description *string   `json:"description,omitempty"`
+	IsActive    bool      `json:"is_active"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Secret signs deliveries; it's only returned when the endpoint is created
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookEvent is the body posted to an endpoint. It's signed like a user
+// sync callback: see signUserSync.
+type WebhookEvent struct {
+	ID        int            `json:"id"`
+	Event     string         `json:"event"`
+	CreatedAt time.Time      `json:"created_at"`
+	Data      OrderItemEvent `json:"data"`
+}
+
+// WebhookDelivery is one attempt history for an event at an endpoint
+type WebhookDelivery struct {
+	ID             int        `json:"id"`
+	ItemEventID    int        `json:"item_event_id"`
+	Event          string     `json:"event"`
+	OrderID        int        `json:"order_id"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	ResponseStatus *int       `json:"response_status,omitempty"`
+	LastError      *string    `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// validateWebhookEndpoint checks an endpoint's URL and events. Plain http is
+// only allowed to localhost, for testing a receiver.
+func validateWebhookEndpoint(endpoint WebhookEndpoint) error {
+	u, err := url.Parse(endpoint.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("url must be an absolute URL")
+	}
+	local := u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"
+	if u.Scheme != "https" && !(u.Scheme == "http" && local) {
+		return fmt.Errorf("url must use https")
+	}
+	if len(endpoint.Events) == 0 {
+		return fmt.Errorf("at least one event is required")
+	}
+	for _, event := range endpoint.Events {
+		if !isItemEvent(event) {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(secret), nil
+}
+
+const webhookEndpointColumns = "id, user_id, url, events, description, is_active, created_at, updated_at"
+
+func scanWebhookEndpoint(scanner interface{ Scan(...interface{}) error }) (WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	err := scanner.Scan(&e.ID, &e.UserID, &e.URL, pq.Array(&e.Events), &e.Description, &e.IsActive, &e.CreatedAt, &e.UpdatedAt)
+	return e, err
+}
+
+// WebhookHandler lets admins register partner endpoints and see how their
+// deliveries are going
+type WebhookHandler struct {
+	db        *sql.DB
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewWebhookHandler(db *sql.DB) *WebhookHandler {
+	return &WebhookHandler{
+		db:        db,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// handleGetWebhookEndpoints lists every endpoint, without secrets
+func (h *WebhookHandler) handleGetWebhookEndpoints(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query("SELECT " + webhookEndpointColumns + " FROM webhook_endpoints ORDER BY id")
+	if err != nil {
+		http.Error(w, "Failed to fetch webhook endpoints", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+	for rows.Next() {
+		endpoint, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse webhook endpoints", http.StatusInternalServerError)
+			return
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(endpoints)
+}
+
+// validWebhookUser writes an error response unless userID is nil or a
+// customer that exists
+func (h *WebhookHandler) validWebhookUser(w http.ResponseWriter, userID *int) bool {
+	if userID == nil {
+		return true
+	}
+	var exists bool
+	if err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", *userID).Scan(&exists); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// handleCreateWebhookEndpoint registers an endpoint and returns its signing
+// secret, which isn't shown again
+func (h *WebhookHandler) handleCreateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req := WebhookEndpoint{IsActive: true}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookEndpoint(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.validWebhookUser(w, req.UserID) {
+		return
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		http.Error(w, "Failed to create webhook endpoint", http.StatusInternalServerError)
+		return
+	}
+	endpoint, err := scanWebhookEndpoint(h.db.QueryRow(`
+		INSERT INTO webhook_endpoints (user_id, url, secret, events, description, is_active, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+webhookEndpointColumns,
+		req.UserID, req.URL, secret, pq.Array(req.Events), req.Description, req.IsActive, adminID,
+	))
+	if err != nil {
+		http.Error(w, "Failed to create webhook endpoint", http.StatusInternalServerError)
+		return
+	}
+	endpoint.Secret = secret
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(endpoint)
+}
+
+// handleUpdateWebhookEndpoint replaces an endpoint's settings; its secret is
+// kept. Deactivating it stops new events being queued but lets queued ones
+// finish.
+func (h *WebhookHandler) handleUpdateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook endpoint ID", http.StatusBadRequest)
+		return
+	}
+
+	var req WebhookEndpoint
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookEndpoint(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.validWebhookUser(w, req.UserID) {
+		return
+	}
+
+	endpoint, err := scanWebhookEndpoint(h.db.QueryRow(`
+		UPDATE webhook_endpoints
+		SET user_id = $1, url = $2, events = $3, description = $4, is_active = $5, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $6
+		RETURNING `+webhookEndpointColumns,
+		req.UserID, req.URL, pq.Array(req.Events), req.Description, req.IsActive, endpointID,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook endpoint not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update webhook endpoint", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(endpoint)
+}
+
+// handleDeleteWebhookEndpoint removes an endpoint and its delivery history
+func (h *WebhookHandler) handleDeleteWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook endpoint ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.Exec("DELETE FROM webhook_endpoints WHERE id = $1", endpointID)
+	if err != nil {
+		http.Error(w, "Failed to delete webhook endpoint", http.StatusInternalServerError)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		http.Error(w, "Webhook endpoint not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetWebhookDeliveries lists an endpoint's most recent deliveries
+func (h *WebhookHandler) handleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook endpoint ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT d.id, d.item_event_id, e.event, e.order_id, d.status, d.attempts,
+		       CASE WHEN d.status = 'pending' THEN d.next_attempt_at END,
+		       d.response_status, d.last_error, d.delivered_at, d.created_at
+		FROM webhook_deliveries d
+		JOIN order_item_events e ON d.item_event_id = e.id
+		WHERE d.endpoint_id = $1
+		ORDER BY d.id DESC
+		LIMIT 100`,
+		endpointID,
+	)
+	if err != nil {
+		http.Error(w, "Failed to fetch webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.ID, &d.ItemEventID, &d.Event, &d.OrderID, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.ResponseStatus, &d.LastError, &d.DeliveredAt, &d.CreatedAt)
+		if err != nil {
+			http.Error(w, "Failed to parse webhook deliveries", http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// WebhookDispatcher posts queued item events to partner endpoints
+type WebhookDispatcher struct {
+	db     *sql.DB
+	client *http.Client
+}
+
+func NewWebhookDispatcher(db *sql.DB) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:     db,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Dispatch posts deliveries that are due. Each is claimed for
+// webhookSendLease first, so the requests happen outside any transaction.
+func (d *WebhookDispatcher) Dispatch(ctx context.Context) (delivered, failed int, err error) {
+	rows, err := d.db.Query(`
+		UPDATE webhook_deliveries d SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+		FROM webhook_endpoints w
+		WHERE w.id = d.endpoint_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.item_event_id, d.attempts, w.url, w.secret`,
+		webhookDispatchBatch, webhookSendLease.Seconds(),
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	type claimed struct {
+		id, eventID, attempts int
+		url, secret           string
+	}
+	batch := []claimed{}
+	for rows.Next() {
+		var c claimed
+		if err := rows.Scan(&c.id, &c.eventID, &c.attempts, &c.url, &c.secret); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		batch = append(batch, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, c := range batch {
+		status, sendErr := d.send(ctx, c.url, c.secret, c.eventID)
+		var responseStatus *int
+		if status != 0 {
+			responseStatus = &status
+		}
+
+		switch {
+		case sendErr == nil:
+			delivered++
+			_, err = d.db.Exec(`
+				UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1, response_status = $2,
+					delivered_at = CURRENT_TIMESTAMP, last_error = NULL
+				WHERE id = $1`,
+				c.id, responseStatus,
+			)
+		case c.attempts+1 >= maxWebhookAttempts:
+			failed++
+			_, err = d.db.Exec(`
+				UPDATE webhook_deliveries SET status = 'failed', attempts = attempts + 1, response_status = $2, last_error = $3
+				WHERE id = $1`,
+				c.id, responseStatus, sendErr.Error(),
+			)
+		default:
+			failed++
+			_, err = d.db.Exec(`
+				UPDATE webhook_deliveries SET attempts = attempts + 1, response_status = $2, last_error = $3,
+					next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $4)
+				WHERE id = $1`,
+				c.id, responseStatus, sendErr.Error(), webhookRetryBackoff[c.attempts].Seconds(),
+			)
+		}
+		if err != nil {
+			return delivered, failed, err
+		}
+	}
+	return delivered, failed, nil
+}
+
+// send posts one event and returns the response status, or 0 when there
+// was no response
+func (d *WebhookDispatcher) send(ctx context.Context, endpointURL, secret string, eventID int) (int, error) {
+	event, err := scanOrderItemEvent(d.db.QueryRow(`
+		SELECT `+orderItemEventColumns+`
+		FROM order_item_events e`+orderItemEventJoins+`
+		WHERE e.id = $1`,
+		eventID,
+	))
+	if err != nil {
+		return 0, err
+	}
+	body, err := json.Marshal(WebhookEvent{ID: event.ID, Event: event.Event, CreatedAt: event.CreatedAt, Data: event})
+	if err != nil {
+		return 0, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventIDHeader, strconv.Itoa(event.ID))
+	req.Header.Set(userSyncTimestampHeader, timestamp)
+	req.Header.Set(userSyncNonceHeader, hex.EncodeToString(nonce))
+	req.Header.Set(userSyncSignatureHeader, signUserSync(secret, timestamp, hex.EncodeToString(nonce), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// processWebhookDeliveries posts queued item events and retries failed ones
+func (s *AutoScheduler) processWebhookDeliveries() {
+	if s.webhooks == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Second)
+	defer cancel()
+
+	delivered, failed, err := s.webhooks.Dispatch(ctx)
+	if err != nil {
+		log.Printf("Error dispatching webhooks: %v", err)
+	}
+	if delivered > 0 || failed > 0 {
+		log.Printf("Delivered %d webhooks, %d failed", delivered, failed)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateWebhookEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint WebhookEndpoint
+		valid    bool
+	}{
+		{"https", WebhookEndpoint{URL: "https://partner.example.com/hooks", Events: []string{itemEventAdded}}, true},
+		{"local http", WebhookEndpoint{URL: "http://localhost:4000/hooks", Events: []string{itemEventDamaged}}, true},
+		{"remote http", WebhookEndpoint{URL: "http://partner.example.com/hooks", Events: []string{itemEventAdded}}, false},
+		{"relative url", WebhookEndpoint{URL: "/hooks", Events: []string{itemEventAdded}}, false},
+		{"no events", WebhookEndpoint{URL: "https://partner.example.com/hooks"}, false},
+		{"unknown event", WebhookEndpoint{URL: "https://partner.example.com/hooks", Events: []string{"order.created"}}, false},
+	}
+	for _, tt := range tests {
+		if err := validateWebhookEndpoint(tt.endpoint); (err == nil) != tt.valid {
+			t.Errorf("%s: validateWebhookEndpoint() = %v, expected valid=%v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestWebhookDispatcher_Retries(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	customerID := db.CreateTestUser(t, "webhook-retry@example.com", "Webhook", "Retry")
+	orderID := db.CreateTestOrder(t, customerID, db.CreateTestAddress(t, customerID))
+	var garmentTypeID, garmentID, endpointID int
+	db.QueryRow("SELECT id FROM garment_types WHERE is_active = true ORDER BY id LIMIT 1").Scan(&garmentTypeID)
+	db.QueryRow(`
+		INSERT INTO order_garments (order_id, garment_type_id, quantity, unit_price_cents)
+		VALUES ($1, $2, 2, 500) RETURNING id`,
+		orderID, garmentTypeID,
+	).Scan(&garmentID)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	db.QueryRow(`
+		INSERT INTO webhook_endpoints (url, secret, events)
+		VALUES ($1, 'whsec_test', ARRAY['item.damaged']) RETURNING id`,
+		down.URL,
+	).Scan(&endpointID)
+
+	tx, _ := db.Begin()
+	if _, err := recordOrderItemEvent(tx, OrderItemEvent{OrderID: orderID, OrderGarmentID: garmentID, Event: itemEventDamaged, GarmentTypeID: garmentTypeID, Quantity: 1}); err != nil {
+		t.Fatalf("Failed to record item event: %v", err)
+	}
+	tx.Commit()
+
+	dispatcher := NewWebhookDispatcher(db.DB)
+	if delivered, failed, err := dispatcher.Dispatch(context.Background()); err != nil || delivered != 0 || failed != 1 {
+		t.Fatalf("Expected the delivery to fail, got %d/%d (%v)", delivered, failed, err)
+	}
+	var status string
+	var attempts, responseStatus int
+	db.QueryRow("SELECT status, attempts, response_status FROM webhook_deliveries WHERE endpoint_id = $1", endpointID).Scan(&status, &attempts, &responseStatus)
+	if status != "pending" || attempts != 1 || responseStatus != http.StatusServiceUnavailable {
+		t.Errorf("Expected the delivery kept for retry, got %s after %d attempts (%d)", status, attempts, responseStatus)
+	}
+	if delivered, failed, _ := dispatcher.Dispatch(context.Background()); delivered != 0 || failed != 0 {
+		t.Error("Expected the retry to wait for its backoff")
+	}
+
+	// The last attempt gives up
+	db.Exec("UPDATE webhook_deliveries SET attempts = $1, next_attempt_at = CURRENT_TIMESTAMP", maxWebhookAttempts-1)
+	dispatcher.Dispatch(context.Background())
+	db.QueryRow("SELECT status FROM webhook_deliveries WHERE endpoint_id = $1", endpointID).Scan(&status)
+	if status != "failed" {
+		t.Errorf("Expected the delivery marked failed, got %s", status)
+	}
+}
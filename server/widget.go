@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// The booking widget is embedded on partner websites. It calls a small public
+// API under /widget with a publishable key: quotes, pickup availability and
+// booking drafts. A key is public by design, so it only works from the
+// origins it was issued for, is rate limited per key and per visitor, and
+// nothing behind it reads or writes account data. The visitor finishes a
+// draft on our site once signed in.
+
+const (
+	widgetKeyHeader = "X-Publishable-Key"
+	// widgetDraftTTL is how long a visitor has to sign in and finish a draft
+	widgetDraftTTL = 24 * time.Hour
+	// widgetMaxBags and widgetMaxAvailabilityDays keep quotes and lookups to
+	// what a real booking asks for
+	widgetMaxBags             = 20
+	widgetMaxAvailabilityDays = 14
+)
+
+var errWidgetBadRequest = errors.New("invalid widget request")
+
+type widgetKeyContextKey struct{}
+
+// WidgetKey is a publishable key issued to a partner site
+type WidgetKey struct {
+	ID             int       `json:"id"`
+	PublishableKey string    `json:"publishable_key"`
+	Name           string    `json:"name"`
+	AllowedOrigins []string  `json:"allowed_origins"`
+	IsActive       bool      `json:"is_active"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// WidgetQuote prices a pay-as-you-go pickup the way checkout would, before
+// subscriptions, credit and add-ons
+type WidgetQuote struct {
+	ZipCode             string  `json:"zip_code"`
+	Bags                int     `json:"bags"`
+	BagPriceCents       int     `json:"bag_price_cents"`
+	SubtotalCents       int     `json:"subtotal_cents"`
+	SlotAdjustmentCents int     `json:"slot_adjustment_cents"`
+	SlotPriceLabel      *string `json:"slot_price_label,omitempty"`
+	ZoneSurchargeCents  int     `json:"zone_surcharge_cents"`
+	TotalCents          int     `json:"total_cents"`
+}
+
+type WidgetQuoteRequest struct {
+	ZipCode        string `json:"zip_code"`
+	Bags           int    `json:"bags"`
+	PickupDate     string `json:"pickup_date,omitempty"`
+	PickupTimeSlot string `json:"pickup_time_slot,omitempty"`
+}
+
+// WidgetSlot is whether a pickup slot can still be booked. Capacity and
+// booking counts stay internal.
+type WidgetSlot struct {
+	TimeSlot               string  `json:"time_slot"`
+	Available              bool    `json:"available"`
+	PriceLabel             *string `json:"price_label,omitempty"`
+	PriceMultiplierPercent int     `json:"price_multiplier_percent"`
+}
+
+type WidgetDay struct {
+	Date  string       `json:"date"`
+	Slots []WidgetSlot `json:"slots"`
+}
+
+// WidgetDraft is a booking started in the widget
+type WidgetDraft struct {
+	Token          string      `json:"token"`
+	ZipCode        string      `json:"zip_code"`
+	PickupDate     string      `json:"pickup_date"`
+	PickupTimeSlot string      `json:"pickup_time_slot"`
+	Bags           int         `json:"bags"`
+	Quote          WidgetQuote `json:"quote"`
+	ExpiresAt      time.Time   `json:"expires_at"`
+	ContinueURL    string      `json:"continue_url,omitempty"`
+}
+
+// newWidgetToken returns a random token: "pk_" for publishable keys, "wd_"
+// for drafts
+func newWidgetToken(prefix string) (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(token), nil
+}
+
+// normalizeWidgetOrigin returns origin as scheme://host[:port], or an error
+// when it's anything else. Plain http is only allowed to localhost, for
+// building a widget integration.
+func normalizeWidgetOrigin(origin string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%q must be an origin such as https://example.com", origin)
+	}
+	local := u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"
+	if u.Scheme != "https" && !(u.Scheme == "http" && local) {
+		return "", fmt.Errorf("%q must use https", origin)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+func widgetKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get(widgetKeyHeader); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("key")
+}
+
+// rateLimitWidgetKey buckets widget requests by publishable key, so one
+// partner's traffic can't crowd out another's
+func rateLimitWidgetKey(l *RateLimiter, r *http.Request) string {
+	return widgetKeyFromRequest(r)
+}
+
+const widgetKeyColumns = "id, publishable_key, name, allowed_origins, is_active, created_at, updated_at"
+
+func scanWidgetKey(scanner interface{ Scan(...interface{}) error }) (WidgetKey, error) {
+	var k WidgetKey
+	err := scanner.Scan(&k.ID, &k.PublishableKey, &k.Name, pq.Array(&k.AllowedOrigins), &k.IsActive, &k.CreatedAt, &k.UpdatedAt)
+	return k, err
+}
+
+type WidgetHandler struct {
+	db        *sql.DB
+	holds     SlotHoldStore
+	getUserID func(*http.Request, *sql.DB) (int, error)
+}
+
+func NewWidgetHandler(db *sql.DB, holds SlotHoldStore) *WidgetHandler {
+	return &WidgetHandler{
+		db:        db,
+		holds:     holds,
+		getUserID: getUserIDFromRequest,
+	}
+}
+
+// authorize admits widget requests carrying an active key from one of its
+// origins and answers them with CORS headers for that origin alone.
+// Preflights carry no key, so they're answered for any origin some active
+// key allows.
+func (h *WidgetHandler) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin, err := normalizeWidgetOrigin(r.Header.Get("Origin"))
+		if err != nil {
+			http.Error(w, "Widget requests must come from an allowed origin", http.StatusForbidden)
+			return
+		}
+
+		if r.Method == http.MethodOptions {
+			var allowed bool
+			err := h.db.QueryRow(
+				"SELECT EXISTS(SELECT 1 FROM widget_keys WHERE is_active AND $1 = ANY(allowed_origins))", origin,
+			).Scan(&allowed)
+			if err != nil || !allowed {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			setWidgetCORSHeaders(w, r.Header.Get("Origin"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		key, err := scanWidgetKey(h.db.QueryRow(
+			"SELECT "+widgetKeyColumns+" FROM widget_keys WHERE publishable_key = $1 AND is_active", widgetKeyFromRequest(r),
+		))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid publishable key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !containsString(key.AllowedOrigins, origin) {
+			http.Error(w, "Origin not allowed for this key", http.StatusForbidden)
+			return
+		}
+
+		setWidgetCORSHeaders(w, r.Header.Get("Origin"))
+		next(w, r.WithContext(context.WithValue(r.Context(), widgetKeyContextKey{}, key.ID)))
+	}
+}
+
+func setWidgetCORSHeaders(w http.ResponseWriter, origin string) {
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+widgetKeyHeader)
+	w.Header().Set("Access-Control-Expose-Headers", rateLimitHeaders)
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.Header().Add("Vary", "Origin")
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// widgetQuote prices bags of laundry picked up in zipCode, on pickupDate in
+// timeSlot when both are given
+func widgetQuote(db *sql.DB, zipCode string, bags int, pickupDate *time.Time, timeSlot string) (WidgetQuote, error) {
+	quote := WidgetQuote{ZipCode: zipCode, Bags: bags}
+	var bagServiceID int
+	err := db.QueryRow(
+		"SELECT id, base_price_cents FROM services WHERE name = 'standard_bag' AND is_active = true",
+	).Scan(&bagServiceID, &quote.BagPriceCents)
+	if err != nil {
+		return quote, err
+	}
+	bagPricing, err := bagPricingByService(db, zipCode)
+	if err != nil {
+		return quote, err
+	}
+	if pricing, ok := bagPricing[bagServiceID]; ok {
+		quote.BagPriceCents = dollarsToCents(pricing.Price)
+	}
+	quote.SubtotalCents = quote.BagPriceCents * bags
+
+	if pickupDate != nil && timeSlot != "" {
+		rule, err := slotPriceRuleFor(db, *pickupDate, timeSlot)
+		if err != nil {
+			return quote, err
+		}
+		if rule != nil {
+			quote.SlotAdjustmentCents = rule.adjustmentCents(quote.SubtotalCents)
+			quote.SlotPriceLabel = &rule.Name
+		}
+	}
+
+	area, err := checkServiceArea(db, zipCode)
+	if err != nil {
+		return quote, err
+	}
+	quote.ZoneSurchargeCents = area.surchargeCents
+	quote.TotalCents = quote.SubtotalCents + quote.SlotAdjustmentCents + quote.ZoneSurchargeCents
+	return quote, nil
+}
+
+// widgetRequestArea validates a ZIP and bag count from the widget, writing
+// the error and returning false when they're unusable or the ZIP isn't served
+func (h *WidgetHandler) widgetRequestArea(w http.ResponseWriter, zipCode string, bags int) (string, bool) {
+	if bags < 1 || bags > widgetMaxBags {
+		http.Error(w, fmt.Sprintf("bags must be between 1 and %d", widgetMaxBags), http.StatusBadRequest)
+		return "", false
+	}
+	area, ok := requireServiceArea(w, h.db, zipCode)
+	return area.ZipCode, ok
+}
+
+// parseWidgetPickup reads an optional pickup date and slot; a date without a
+// slot or a date in the past is an error
+func parseWidgetPickup(date, timeSlot string) (*time.Time, error) {
+	if date == "" && timeSlot == "" {
+		return nil, nil
+	}
+	pickupDate, err := time.Parse("2006-01-02", date)
+	if err != nil || timeSlot == "" {
+		return nil, fmt.Errorf("%w: pickup_date and pickup_time_slot go together", errWidgetBadRequest)
+	}
+	if pickupDate.Before(time.Now().UTC().Truncate(24 * time.Hour)) {
+		return nil, fmt.Errorf("%w: pickup_date is in the past", errWidgetBadRequest)
+	}
+	return &pickupDate, nil
+}
+
+// handleWidgetQuote prices a pickup for a visitor
+func (h *WidgetHandler) handleWidgetQuote(w http.ResponseWriter, r *http.Request) {
+	var req WidgetQuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	zipCode, ok := h.widgetRequestArea(w, req.ZipCode, req.Bags)
+	if !ok {
+		return
+	}
+	pickupDate, err := parseWidgetPickup(req.PickupDate, req.PickupTimeSlot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	quote, err := widgetQuote(h.db, zipCode, req.Bags, pickupDate, req.PickupTimeSlot)
+	if err != nil {
+		http.Error(w, "Failed to price pickup", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
+
+// handleWidgetAvailability lists which pickup slots can be booked in ?zip=
+// from ?from= (default today) for ?days= (default 7, at most 14)
+func (h *WidgetHandler) handleWidgetAvailability(w http.ResponseWriter, r *http.Request) {
+	zipCode, ok := normalizeZipCode(r.URL.Query().Get("zip"))
+	if !ok {
+		http.Error(w, "Invalid ZIP code", http.StatusBadRequest)
+		return
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	start := today
+	if raw := r.URL.Query().Get("from"); raw != "" {
+		parsed, err := time.Parse("2006-01-02", raw)
+		if err != nil || parsed.Before(today) {
+			http.Error(w, "from must be a date from today on", http.StatusBadRequest)
+			return
+		}
+		start = parsed
+	}
+	days := 7
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > widgetMaxAvailabilityDays {
+			http.Error(w, fmt.Sprintf("days must be between 1 and %d", widgetMaxAvailabilityDays), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	if _, ok := requireServiceArea(w, h.db, zipCode); !ok {
+		return
+	}
+
+	availability, err := pickupAvailability(r.Context(), h.db, h.holds, start, start.AddDate(0, 0, days-1), marketForZip(zipCode))
+	if err != nil {
+		http.Error(w, "Failed to fetch availability", http.StatusInternalServerError)
+		return
+	}
+	widgetDays := make([]WidgetDay, 0, len(availability))
+	for _, day := range availability {
+		widgetDay := WidgetDay{Date: day.Date, Slots: make([]WidgetSlot, 0, len(day.Slots))}
+		for _, slot := range day.Slots {
+			widgetDay.Slots = append(widgetDay.Slots, WidgetSlot{
+				TimeSlot:               slot.TimeSlot,
+				Available:              slot.Available > 0,
+				PriceLabel:             slot.PriceLabel,
+				PriceMultiplierPercent: slot.PriceMultiplierPercent,
+			})
+		}
+		widgetDays = append(widgetDays, widgetDay)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(widgetDays)
+}
+
+func widgetContinueURL(token string) string {
+	return os.Getenv("FRONTEND_URL") + "/book?draft=" + token
+}
+
+// handleCreateWidgetDraft saves a visitor's pickup choice and quote, and
+// returns the link that finishes booking on our site
+func (h *WidgetHandler) handleCreateWidgetDraft(w http.ResponseWriter, r *http.Request) {
+	keyID, _ := r.Context().Value(widgetKeyContextKey{}).(int)
+
+	var req WidgetQuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	zipCode, ok := h.widgetRequestArea(w, req.ZipCode, req.Bags)
+	if !ok {
+		return
+	}
+	pickupDate, err := parseWidgetPickup(req.PickupDate, req.PickupTimeSlot)
+	if err == nil && pickupDate == nil {
+		err = fmt.Errorf("%w: pickup_date and pickup_time_slot are required", errWidgetBadRequest)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := checkSlotCapacity(h.db, h.holds, *pickupDate, marketForZip(zipCode), req.PickupTimeSlot, ""); err == errSlotFull {
+		http.Error(w, "That pickup slot is full", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	quote, err := widgetQuote(h.db, zipCode, req.Bags, pickupDate, req.PickupTimeSlot)
+	if err != nil {
+		http.Error(w, "Failed to price pickup", http.StatusInternalServerError)
+		return
+	}
+	token, err := newWidgetToken("wd_")
+	if err != nil {
+		http.Error(w, "Failed to create draft", http.StatusInternalServerError)
+		return
+	}
+
+	draft := WidgetDraft{
+		Token:          token,
+		ZipCode:        zipCode,
+		PickupDate:     req.PickupDate,
+		PickupTimeSlot: req.PickupTimeSlot,
+		Bags:           req.Bags,
+		Quote:          quote,
+		ContinueURL:    widgetContinueURL(token),
+	}
+	err = h.db.QueryRow(`
+		INSERT INTO widget_drafts (token, widget_key_id, zip_code, pickup_date, pickup_time_slot, bags, quoted_cents, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING expires_at`,
+		token, keyID, zipCode, req.PickupDate, req.PickupTimeSlot, req.Bags, quote.TotalCents, time.Now().Add(widgetDraftTTL),
+	).Scan(&draft.ExpiresAt)
+	if err != nil {
+		http.Error(w, "Failed to create draft", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(draft)
+}
+
+// handleClaimWidgetDraft hands a signed-in customer the draft they started in
+// a widget, to prefill checkout. The first customer to open it claims it;
+// it's not found for anyone else or once it expires. The price is requoted,
+// since it may have changed since.
+func (h *WidgetHandler) handleClaimWidgetDraft(w http.ResponseWriter, r *http.Request) {
+	userID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var draft WidgetDraft
+	var pickupDate time.Time
+	err = h.db.QueryRow(`
+		UPDATE widget_drafts
+		SET claimed_by = $1, claimed_at = COALESCE(claimed_at, CURRENT_TIMESTAMP)
+		WHERE token = $2 AND expires_at > CURRENT_TIMESTAMP AND (claimed_by IS NULL OR claimed_by = $1)
+		RETURNING token, zip_code, pickup_date, pickup_time_slot, bags, expires_at`,
+		userID, mux.Vars(r)["token"],
+	).Scan(&draft.Token, &draft.ZipCode, &pickupDate, &draft.PickupTimeSlot, &draft.Bags, &draft.ExpiresAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Draft not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch draft", http.StatusInternalServerError)
+		return
+	}
+	draft.PickupDate = pickupDate.Format("2006-01-02")
+
+	if draft.Quote, err = widgetQuote(h.db, draft.ZipCode, draft.Bags, &pickupDate, draft.PickupTimeSlot); err != nil {
+		http.Error(w, "Failed to price pickup", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(draft)
+}
+
+type WidgetKeyRequest struct {
+	Name           string   `json:"name"`
+	AllowedOrigins []string `json:"allowed_origins"`
+	IsActive       *bool    `json:"is_active,omitempty"`
+}
+
+// validate trims the name and normalizes the origins
+func (req *WidgetKeyRequest) validate() error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		return fmt.Errorf("name is required, up to 100 characters")
+	}
+	if len(req.AllowedOrigins) == 0 {
+		return fmt.Errorf("at least one allowed origin is required")
+	}
+	for i, origin := range req.AllowedOrigins {
+		normalized, err := normalizeWidgetOrigin(origin)
+		if err != nil {
+			return err
+		}
+		req.AllowedOrigins[i] = normalized
+	}
+	return nil
+}
+
+// handleGetWidgetKeys lists every publishable key
+func (h *WidgetHandler) handleGetWidgetKeys(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query("SELECT " + widgetKeyColumns + " FROM widget_keys ORDER BY id")
+	if err != nil {
+		http.Error(w, "Failed to fetch widget keys", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []WidgetKey{}
+	for rows.Next() {
+		key, err := scanWidgetKey(rows)
+		if err != nil {
+			http.Error(w, "Failed to parse widget keys", http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// handleCreateWidgetKey issues a publishable key for a partner's origins
+func (h *WidgetHandler) handleCreateWidgetKey(w http.ResponseWriter, r *http.Request) {
+	adminID, err := h.getUserID(r, h.db)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req WidgetKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	publishableKey, err := newWidgetToken("pk_")
+	if err != nil {
+		http.Error(w, "Failed to create widget key", http.StatusInternalServerError)
+		return
+	}
+	key, err := scanWidgetKey(h.db.QueryRow(`
+		INSERT INTO widget_keys (publishable_key, name, allowed_origins, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+widgetKeyColumns,
+		publishableKey, req.Name, pq.Array(req.AllowedOrigins), adminID,
+	))
+	if err != nil {
+		http.Error(w, "Failed to create widget key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+// handleUpdateWidgetKey renames a key, replaces its origins, or turns it off.
+// The key itself never changes, since it's pasted into partner sites.
+func (h *WidgetHandler) handleUpdateWidgetKey(w http.ResponseWriter, r *http.Request) {
+	keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid widget key ID", http.StatusBadRequest)
+		return
+	}
+
+	var req WidgetKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key, err := scanWidgetKey(h.db.QueryRow(`
+		UPDATE widget_keys
+		SET name = $1, allowed_origins = $2, is_active = COALESCE($3, is_active), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $4
+		RETURNING `+widgetKeyColumns,
+		req.Name, pq.Array(req.AllowedOrigins), req.IsActive, keyID,
+	))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Widget key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update widget key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNormalizeWidgetOrigin(t *testing.T) {
+	tests := []struct {
+		origin   string
+		expected string
+	}{
+		{"https://Partner.example.com", "https://partner.example.com"},
+		{"https://partner.example.com:8443/", "https://partner.example.com:8443"},
+		{"http://localhost:3000", "http://localhost:3000"},
+		{"http://partner.example.com", ""},
+		{"https://partner.example.com/booking", ""},
+		{"partner.example.com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		origin, err := normalizeWidgetOrigin(tt.origin)
+		if tt.expected == "" && err == nil {
+			t.Errorf("%q: expected an error, got %q", tt.origin, origin)
+		}
+		if tt.expected != "" && origin != tt.expected {
+			t.Errorf("%q: expected %q, got %q (%v)", tt.origin, tt.expected, origin, err)
+		}
+	}
+}
+
+func TestWidget_QuoteDraftAndClaim(t *testing.T) {
+	db := SetupTestDB(t)
+	defer db.CleanupTestDB()
+
+	handler := NewWidgetHandler(db.DB, nil)
+	adminID := db.CreateTestUser(t, "widget-admin@example.com", "Widget", "Admin")
+	handler.getUserID = CreateAuthMock(adminID).getUserIDFromRequest
+
+	body, _ := json.Marshal(WidgetKeyRequest{Name: "Partner Gym", AllowedOrigins: []string{"https://Gym.example.com/"}})
+	w := httptest.NewRecorder()
+	handler.handleCreateWidgetKey(w, httptest.NewRequest("POST", "/api/v1/admin/widget-keys", bytes.NewBuffer(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var key WidgetKey
+	json.Unmarshal(w.Body.Bytes(), &key)
+	if len(key.AllowedOrigins) != 1 || key.AllowedOrigins[0] != "https://gym.example.com" {
+		t.Fatalf("Expected the origin normalized, got %v", key.AllowedOrigins)
+	}
+
+	call := func(h http.HandlerFunc, method, path, origin, publishableKey, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Origin", origin)
+		if publishableKey != "" {
+			req.Header.Set(widgetKeyHeader, publishableKey)
+		}
+		w := httptest.NewRecorder()
+		handler.authorize(h)(w, req)
+		return w
+	}
+
+	quoteBody := `{"zip_code": "12345", "bags": 2}`
+	if w := call(handler.handleWidgetQuote, "POST", "/api/v1/widget/quote", "https://gym.example.com", "pk_unknown", quoteBody); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for an unknown key, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := call(handler.handleWidgetQuote, "POST", "/api/v1/widget/quote", "https://elsewhere.example.com", key.PublishableKey, quoteBody); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d from another origin, got %d", http.StatusForbidden, w.Code)
+	}
+	preflight := call(handler.handleWidgetQuote, "OPTIONS", "/api/v1/widget/quote", "https://gym.example.com", "", "")
+	if preflight.Code != http.StatusNoContent || preflight.Header().Get("Access-Control-Allow-Origin") != "https://gym.example.com" {
+		t.Errorf("Expected the preflight allowed for the key's origin, got %d %q", preflight.Code, preflight.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	w = call(handler.handleWidgetQuote, "POST", "/api/v1/widget/quote", "https://gym.example.com", key.PublishableKey, quoteBody)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var quote WidgetQuote
+	json.Unmarshal(w.Body.Bytes(), &quote)
+	if quote.Bags != 2 || quote.BagPriceCents == 0 || quote.TotalCents != quote.SubtotalCents || quote.SubtotalCents != 2*quote.BagPriceCents {
+		t.Errorf("Unexpected quote %+v", quote)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://gym.example.com" {
+		t.Errorf("Expected CORS for the key's origin only, got %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	pickupDate := time.Now().UTC().AddDate(0, 0, 3).Format("2006-01-02")
+	draftBody := fmt.Sprintf(`{"zip_code": "12345", "bags": 2, "pickup_date": %q, "pickup_time_slot": "9am-12pm"}`, pickupDate)
+	w = call(handler.handleCreateWidgetDraft, "POST", "/api/v1/widget/drafts", "https://gym.example.com", key.PublishableKey, draftBody)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var draft WidgetDraft
+	json.Unmarshal(w.Body.Bytes(), &draft)
+	if draft.Token == "" || draft.Quote.TotalCents != quote.TotalCents {
+		t.Fatalf("Unexpected draft %+v", draft)
+	}
+
+	claim := func(userID int) *httptest.ResponseRecorder {
+		handler.getUserID = CreateAuthMock(userID).getUserIDFromRequest
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/booking-drafts/x", nil), map[string]string{"token": draft.Token})
+		w := httptest.NewRecorder()
+		handler.handleClaimWidgetDraft(w, req)
+		return w
+	}
+	customerID := db.CreateTestUser(t, "widget-visitor@example.com", "Widget", "Visitor")
+	if w := claim(customerID); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d. Response: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := claim(customerID); w.Code != http.StatusOK {
+		t.Errorf("Expected the claiming customer to reopen the draft, got %d", w.Code)
+	}
+	otherID := db.CreateTestUser(t, "widget-other@example.com", "Widget", "Other")
+	if w := claim(otherID); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for someone else's draft, got %d", http.StatusNotFound, w.Code)
+	}
+}